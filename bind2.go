@@ -0,0 +1,24 @@
+package xmpp
+
+import "github.com/meszmate/xmpp-go/plugins/sasl2"
+
+// ApplyInlineFeatures records the outcome of a SASL2 authentication that
+// bound the session inline with Bind2 (XEP-0386): the session takes f.JID as
+// its local address and becomes authenticated, bound and ready, so the
+// client skips resource binding and does not enable Stream Management or
+// Message Carbons a second time.
+func (s *Session) ApplyInlineFeatures(f sasl2.InlineFeatures) {
+	s.inline.Store(&f)
+	s.SetLocalAddr(f.JID)
+	s.SetState(StateAuthenticated | StateBound | StateReady)
+}
+
+// InlineFeatures returns the features negotiated inline with Bind2, if
+// ApplyInlineFeatures was called.
+func (s *Session) InlineFeatures() (sasl2.InlineFeatures, bool) {
+	f := s.inline.Load()
+	if f == nil {
+		return sasl2.InlineFeatures{}, false
+	}
+	return *f, true
+}
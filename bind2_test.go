@@ -0,0 +1,31 @@
+package xmpp
+
+import (
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
+)
+
+func TestSessionApplyInlineFeatures(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	if _, ok := s.InlineFeatures(); ok {
+		t.Fatal("InlineFeatures reported before negotiation")
+	}
+	f := sasl2.InlineFeatures{JID: jid.MustParse("juliet@example.com/balcony"), SMEnabled: true, SMResumeID: "abc"}
+	s.ApplyInlineFeatures(f)
+
+	got, ok := s.InlineFeatures()
+	if !ok || got != f {
+		t.Fatalf("InlineFeatures = %+v, %v", got, ok)
+	}
+	if !s.LocalAddr().Equal(f.JID) {
+		t.Errorf("LocalAddr = %s", s.LocalAddr())
+	}
+	if want := StateAuthenticated | StateBound | StateReady; s.State()&want != want {
+		t.Errorf("state = %b", s.State())
+	}
+}
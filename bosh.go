@@ -0,0 +1,688 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// Defaults for BOSHConfig.
+const (
+	DefaultBOSHWait       = 60 * time.Second
+	DefaultBOSHHold       = 1
+	DefaultBOSHInactivity = 60 * time.Second
+	DefaultBOSHMaxPause   = 120 * time.Second
+	DefaultBOSHMaxBody    = 1 << 20
+)
+
+// boshVersion is the version of XEP-0124 implemented.
+const boshVersion = "1.11"
+
+var errBOSHStartTLS = errors.New("xmpp: BOSH does not support STARTTLS; use HTTPS")
+
+// BOSHConfig configures a BOSH connection manager (XEP-0124/0206).
+type BOSHConfig struct {
+	// Wait is the longest a request is held while there is nothing to send.
+	// Clients may ask for less. It defaults to DefaultBOSHWait.
+	Wait time.Duration
+
+	// Hold is how many requests a session may have held at once. Clients
+	// may ask for fewer. It defaults to DefaultBOSHHold.
+	Hold int
+
+	// Inactivity is how long a session may go without a request before it
+	// is terminated. It defaults to DefaultBOSHInactivity.
+	Inactivity time.Duration
+
+	// MaxPause is the longest a client may pause its session for, for
+	// example while a web page is reloaded. It defaults to
+	// DefaultBOSHMaxPause.
+	MaxPause time.Duration
+
+	// MaxBody limits the size of a request. It defaults to
+	// DefaultBOSHMaxBody.
+	MaxBody int64
+
+	// Secure marks sessions as encrypted even when requests arrive over
+	// plain HTTP, for a handler behind a proxy that terminates TLS.
+	Secure bool
+
+	// AllowOrigin, when set, is sent as Access-Control-Allow-Origin so
+	// that web clients served from another origin can connect.
+	AllowOrigin string
+}
+
+// BOSHHandler is an http.Handler that runs XMPP sessions over BOSH, for
+// web clients that cannot open a TCP connection or a WebSocket. Each BOSH
+// session is turned into a Session whose stream is made of the payloads of
+// the client's requests and which is passed to a SessionHandlerFunc like a
+// TCP connection would be.
+type BOSHHandler struct {
+	domain  string
+	cfg     BOSHConfig
+	handler SessionHandlerFunc
+	opts    []SessionOption
+
+	// track, when set, is told about each session and returns a function
+	// to call when it ends, or nil if the session must not start because
+	// the server is shutting down.
+	track func(key string, session *Session) func()
+
+	mu       sync.Mutex
+	sessions map[string]*boshSession
+	closed   bool
+}
+
+// NewBOSHHandler returns a connection manager for domain that passes each
+// new session to handler. opts are applied to every Session created.
+func NewBOSHHandler(domain string, cfg BOSHConfig, handler SessionHandlerFunc, opts ...SessionOption) *BOSHHandler {
+	if cfg.Wait <= 0 {
+		cfg.Wait = DefaultBOSHWait
+	}
+	if cfg.Hold <= 0 {
+		cfg.Hold = DefaultBOSHHold
+	}
+	if cfg.Inactivity <= 0 {
+		cfg.Inactivity = DefaultBOSHInactivity
+	}
+	if cfg.MaxPause <= 0 {
+		cfg.MaxPause = DefaultBOSHMaxPause
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = DefaultBOSHMaxBody
+	}
+	return &BOSHHandler{
+		domain:   domain,
+		cfg:      cfg,
+		handler:  handler,
+		opts:     opts,
+		sessions: make(map[string]*boshSession),
+	}
+}
+
+// ServeHTTP handles a BOSH request.
+func (h *BOSHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", h.cfg.AllowOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.cfg.MaxBody))
+	if err != nil {
+		writeBOSH(w, boshTerminate("bad-request"))
+		return
+	}
+	body, err := parseBOSHBody(data)
+	if err != nil {
+		writeBOSH(w, boshTerminate("bad-request"))
+		return
+	}
+	if body.sid == "" {
+		writeBOSH(w, h.create(r, body))
+		return
+	}
+
+	h.mu.Lock()
+	b := h.sessions[body.sid]
+	h.mu.Unlock()
+	if b == nil {
+		writeBOSH(w, boshTerminate("item-not-found"))
+		return
+	}
+	if resp := b.handle(r.Context(), body); resp != nil {
+		writeBOSH(w, resp)
+	}
+}
+
+// Close terminates every session.
+func (h *BOSHHandler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	sessions := make([]*boshSession, 0, len(h.sessions))
+	for _, b := range h.sessions {
+		sessions = append(sessions, b)
+	}
+	h.mu.Unlock()
+
+	for _, b := range sessions {
+		b.finish("system-shutdown")
+	}
+	return nil
+}
+
+// create starts a session for a session creation request.
+func (h *BOSHHandler) create(r *http.Request, body *boshBody) []byte {
+	if body.rid <= 0 {
+		return boshTerminate("bad-request")
+	}
+	if body.to != h.domain {
+		return boshTerminate("host-unknown")
+	}
+	to, err := jid.New("", h.domain, "")
+	if err != nil {
+		return boshTerminate("host-unknown")
+	}
+
+	b := &boshSession{
+		h:         h,
+		sid:       randomBOSHID(),
+		wait:      h.cfg.Wait,
+		hold:      h.cfg.Hold,
+		first:     body.rid,
+		rid:       body.rid - 1,
+		advanced:  make(chan struct{}),
+		responses: make(map[int64][]byte),
+	}
+	if body.wait > 0 && body.wait < b.wait {
+		b.wait = body.wait
+	}
+	if body.hold >= 0 && body.hold < b.hold {
+		b.hold = body.hold
+	}
+	b.trans = newBOSHTransport(r.TLS != nil || h.cfg.Secure, remoteTCPAddr(r.RemoteAddr))
+	b.header = stream.Open(stream.Header{To: to, Lang: body.lang, NS: ns.Client})
+
+	// The session outlives the request that created it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	opts := append([]SessionOption{WithState(StateServer), WithRemoteAddr(jid.JID{})}, h.opts...)
+	session, err := NewSession(ctx, b.trans, opts...)
+	if err != nil {
+		cancel()
+		return boshTerminate("internal-server-error")
+	}
+	b.session = session
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		cancel()
+		return boshTerminate("system-shutdown")
+	}
+	h.sessions[b.sid] = b
+	h.mu.Unlock()
+
+	_, _ = b.trans.in.Write(b.header)
+	go func() {
+		boshElements(b.trans.out, b.opened, b.push)
+		b.finish("")
+	}()
+	go func() {
+		defer cancel()
+		if h.track != nil {
+			untrack := h.track("bosh:"+b.sid, session)
+			if untrack == nil {
+				// Created while the server was shutting down.
+				_ = session.SendStreamError(ctx, stream.NewError(stream.ErrSystemShutdown, ""))
+				_ = session.Close()
+				return
+			}
+			defer untrack()
+		}
+		if h.handler != nil {
+			h.handler(ctx, session)
+		}
+		_ = session.Close()
+	}()
+	return b.handle(r.Context(), body)
+}
+
+func (h *BOSHHandler) remove(sid string) {
+	h.mu.Lock()
+	delete(h.sessions, sid)
+	h.mu.Unlock()
+}
+
+// boshSession is one BOSH session and the Session it carries.
+type boshSession struct {
+	h       *BOSHHandler
+	sid     string
+	session *Session
+	trans   *boshTransport
+	header  []byte
+	wait    time.Duration
+	hold    int
+	first   int64
+
+	mu        sync.Mutex
+	rid       int64 // last request accepted
+	advanced  chan struct{}
+	responses map[int64][]byte
+	held      []*boshRequest
+	queue     [][]byte
+	streamID  string
+	streamErr bool
+	paused    time.Duration
+	idle      *time.Timer
+	done      bool
+	condition string
+}
+
+// boshRequest is a request held until there is something to answer it
+// with.
+type boshRequest struct {
+	rid   int64
+	reply chan []byte
+}
+
+// requests is how many requests the client may have outstanding.
+func (b *boshSession) requests() int64 {
+	return int64(b.hold) + 1
+}
+
+// handle processes a request of the session and returns its response, or
+// nil when the client went away first.
+func (b *boshSession) handle(ctx context.Context, body *boshBody) []byte {
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return boshTerminate(b.condition)
+	}
+
+	// Requests are processed in rid order; one that arrives early waits
+	// for the ones before it.
+	if body.rid > b.rid+1 && body.rid <= b.rid+b.requests() {
+		timer := time.NewTimer(b.wait)
+		defer timer.Stop()
+		for body.rid > b.rid+1 && !b.done {
+			advanced := b.advanced
+			b.mu.Unlock()
+			select {
+			case <-advanced:
+			case <-timer.C:
+				b.finish("item-not-found")
+				return boshTerminate("item-not-found")
+			case <-ctx.Done():
+				return nil
+			}
+			b.mu.Lock()
+		}
+	}
+
+	switch {
+	case b.done:
+		b.mu.Unlock()
+		return boshTerminate(b.condition)
+	case body.rid <= b.rid:
+		// A retransmission gets the response it was lost with.
+		resp, ok := b.responses[body.rid]
+		b.mu.Unlock()
+		if ok {
+			return resp
+		}
+		b.finish("item-not-found")
+		return boshTerminate("item-not-found")
+	case body.rid > b.rid+1:
+		b.mu.Unlock()
+		b.finish("item-not-found")
+		return boshTerminate("item-not-found")
+	case body.pause > b.h.cfg.MaxPause:
+		b.mu.Unlock()
+		b.finish("policy-violation")
+		return boshTerminate("policy-violation")
+	}
+
+	b.rid = body.rid
+	close(b.advanced)
+	b.advanced = make(chan struct{})
+	b.paused = body.pause
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = nil
+	}
+
+	if body.restart {
+		_, _ = b.trans.in.Write(b.header)
+	}
+	if len(body.payload) > 0 {
+		_, _ = b.trans.in.Write(body.payload)
+	}
+	if body.typ == "terminate" {
+		_, _ = b.trans.in.Write([]byte("</stream:stream>"))
+		b.mu.Unlock()
+		b.finish("")
+		return boshTerminate("")
+	}
+
+	req := &boshRequest{rid: body.rid, reply: make(chan []byte, 1)}
+	b.held = append(b.held, req)
+	switch {
+	case b.paused > 0:
+		// A paused client expects no data until it comes back.
+		for len(b.held) > 0 {
+			b.release(b.held[0])
+		}
+	case len(b.queue) > 0:
+		b.release(b.held[0])
+	}
+	for len(b.held) > b.hold {
+		b.release(b.held[0])
+	}
+	b.mu.Unlock()
+
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	select {
+	case resp := <-req.reply:
+		return resp
+	case <-timer.C:
+		b.mu.Lock()
+		b.release(req)
+		b.mu.Unlock()
+		return <-req.reply
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.drop(req)
+		b.mu.Unlock()
+		return nil
+	}
+}
+
+// release answers req if it is still held, with whatever is queued.
+func (b *boshSession) release(req *boshRequest) {
+	if !b.drop(req) {
+		return
+	}
+	var payload []byte
+	for _, e := range b.queue {
+		payload = append(payload, e...)
+	}
+	b.queue = nil
+
+	attrs := []xml.Attr{}
+	if req.rid == b.first {
+		attrs = append(attrs,
+			xml.Attr{Name: xml.Name{Local: "sid"}, Value: b.sid},
+			xml.Attr{Name: xml.Name{Local: "wait"}, Value: seconds(b.wait)},
+			xml.Attr{Name: xml.Name{Local: "requests"}, Value: strconv.FormatInt(b.requests(), 10)},
+			xml.Attr{Name: xml.Name{Local: "hold"}, Value: strconv.Itoa(b.hold)},
+			xml.Attr{Name: xml.Name{Local: "inactivity"}, Value: seconds(b.h.cfg.Inactivity)},
+			xml.Attr{Name: xml.Name{Local: "maxpause"}, Value: seconds(b.h.cfg.MaxPause)},
+			xml.Attr{Name: xml.Name{Local: "ver"}, Value: boshVersion},
+			xml.Attr{Name: xml.Name{Local: "from"}, Value: b.h.domain},
+			xml.Attr{Name: xml.Name{Local: "authid"}, Value: b.streamID},
+			xml.Attr{Name: xml.Name{Local: "xmlns:xmpp"}, Value: ns.BOSHXmpp},
+			xml.Attr{Name: xml.Name{Local: "xmpp:version"}, Value: stream.DefaultVersion},
+		)
+	}
+	if b.done {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "type"}, Value: "terminate"})
+		if b.condition != "" {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "condition"}, Value: b.condition})
+		}
+	}
+	resp := boshResponse(attrs, payload)
+
+	b.responses[req.rid] = resp
+	for rid := range b.responses {
+		if rid <= req.rid-b.requests() {
+			delete(b.responses, rid)
+		}
+	}
+	req.reply <- resp
+}
+
+// drop stops holding req and reports whether it was held. The session is
+// ended if no request is left for the inactivity period, or for the pause
+// the client asked for.
+func (b *boshSession) drop(req *boshRequest) bool {
+	i := -1
+	for j, held := range b.held {
+		if held == req {
+			i = j
+		}
+	}
+	if i < 0 {
+		return false
+	}
+	b.held = append(b.held[:i], b.held[i+1:]...)
+	if len(b.held) == 0 && !b.done && b.idle == nil {
+		d := b.h.cfg.Inactivity
+		if b.paused > 0 {
+			d = b.paused
+		}
+		b.idle = time.AfterFunc(d, b.expire)
+	}
+	return true
+}
+
+func (b *boshSession) expire() {
+	b.mu.Lock()
+	idle := len(b.held) == 0
+	b.mu.Unlock()
+	if idle {
+		b.finish("")
+	}
+}
+
+// opened records the id of a stream header the server wrote.
+func (b *boshSession) opened(header xml.StartElement) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, a := range header.Attr {
+		if a.Name.Space == "" && a.Name.Local == "id" {
+			b.streamID = a.Value
+		}
+	}
+}
+
+// push queues an element the server wrote and answers the oldest held
+// request with it.
+func (b *boshSession) push(e xml.StartElement, raw []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.queue = append(b.queue, raw)
+	if e.Name.Space == ns.Stream && e.Name.Local == "error" {
+		// The stream is closing; the error goes out with the terminate.
+		b.streamErr = true
+		return
+	}
+	if len(b.held) > 0 {
+		b.release(b.held[0])
+	}
+}
+
+// finish terminates the session, answering held requests with what is
+// left to send. A stream error from the server is reported as
+// remote-stream-error unless a condition is given.
+func (b *boshSession) finish(condition string) {
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return
+	}
+	b.done = true
+	if condition == "" && b.streamErr {
+		condition = "remote-stream-error"
+	}
+	b.condition = condition
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	for len(b.held) > 0 {
+		b.release(b.held[0])
+	}
+	close(b.advanced)
+	b.advanced = make(chan struct{})
+	b.mu.Unlock()
+
+	b.h.remove(b.sid)
+	_ = b.trans.Close()
+}
+
+// boshBody is a parsed request.
+type boshBody struct {
+	sid     string
+	rid     int64
+	to      string
+	typ     string
+	lang    string
+	wait    time.Duration
+	hold    int
+	pause   time.Duration
+	restart bool
+	payload []byte
+}
+
+// parseBOSHBody parses a <body/> wrapper, keeping its children as they
+// were sent.
+func parseBOSHBody(data []byte) (*boshBody, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var (
+		body  *boshBody
+		level int
+		start int64
+	)
+	for {
+		off := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF && body != nil {
+			return body, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if body == nil {
+				if t.Name.Space != ns.BOSH || t.Name.Local != "body" {
+					return nil, errors.New("xmpp: BOSH request is not a body")
+				}
+				if body, err = boshAttrs(t); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if level == 0 {
+				start = off
+			}
+			level++
+		case xml.EndElement:
+			if level == 0 {
+				continue
+			}
+			level--
+			if level == 0 {
+				body.payload = append(body.payload, data[start:dec.InputOffset()]...)
+			}
+		}
+	}
+}
+
+func boshAttrs(start xml.StartElement) (*boshBody, error) {
+	body := &boshBody{hold: -1}
+	for _, a := range start.Attr {
+		var err error
+		switch a.Name {
+		case xml.Name{Local: "sid"}:
+			body.sid = a.Value
+		case xml.Name{Local: "rid"}:
+			body.rid, err = strconv.ParseInt(a.Value, 10, 64)
+		case xml.Name{Local: "to"}:
+			body.to = a.Value
+		case xml.Name{Local: "type"}:
+			body.typ = a.Value
+		case xml.Name{Space: ns.XML, Local: "lang"}:
+			body.lang = a.Value
+		case xml.Name{Local: "wait"}:
+			body.wait, err = parseSeconds(a.Value)
+		case xml.Name{Local: "hold"}:
+			body.hold, err = strconv.Atoi(a.Value)
+		case xml.Name{Local: "pause"}:
+			body.pause, err = parseSeconds(a.Value)
+		case xml.Name{Space: ns.BOSHXmpp, Local: "restart"}:
+			body.restart = a.Value == "true" || a.Value == "1"
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func parseSeconds(v string) (time.Duration, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("xmpp: invalid BOSH duration " + strconv.Quote(v))
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Second))
+}
+
+// boshResponse builds a response body. The stream prefix is declared for
+// stream errors and features.
+func boshResponse(attrs []xml.Attr, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<body xmlns='" + ns.BOSH + "' xmlns:stream='" + ns.Stream + "'")
+	for _, a := range attrs {
+		buf.WriteString(" " + a.Name.Local + "='")
+		_ = xml.EscapeText(&buf, []byte(a.Value))
+		buf.WriteString("'")
+	}
+	if len(payload) == 0 {
+		buf.WriteString("/>")
+		return buf.Bytes()
+	}
+	buf.WriteString(">")
+	buf.Write(payload)
+	buf.WriteString("</body>")
+	return buf.Bytes()
+}
+
+// boshTerminate builds a response ending the session with condition.
+func boshTerminate(condition string) []byte {
+	attrs := []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "terminate"}}
+	if condition != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "condition"}, Value: condition})
+	}
+	return boshResponse(attrs, nil)
+}
+
+func writeBOSH(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	_, _ = w.Write(body)
+}
+
+func randomBOSHID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func remoteTCPAddr(addr string) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
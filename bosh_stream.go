@@ -0,0 +1,183 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+)
+
+// boshBuffer is an in-memory byte stream. Writes never block; reads wait
+// for data until the buffer is closed.
+type boshBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newBOSHBuffer() *boshBuffer {
+	b := &boshBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *boshBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *boshBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.buf.Write(p)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *boshBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// boshTransport is the server end of a BOSH session as seen by a Session:
+// in carries the payloads of the client's requests, out the stream written
+// back, which the connection manager splits into response bodies.
+type boshTransport struct {
+	in     *boshBuffer
+	out    *boshBuffer
+	secure bool
+	peer   net.Addr
+}
+
+func newBOSHTransport(secure bool, peer net.Addr) *boshTransport {
+	return &boshTransport{in: newBOSHBuffer(), out: newBOSHBuffer(), secure: secure, peer: peer}
+}
+
+func (t *boshTransport) Read(p []byte) (int, error)  { return t.in.Read(p) }
+func (t *boshTransport) Write(p []byte) (int, error) { return t.out.Write(p) }
+
+func (t *boshTransport) Close() error {
+	t.in.close()
+	t.out.close()
+	return nil
+}
+
+func (t *boshTransport) StartTLS(*tls.Config) error {
+	return errBOSHStartTLS
+}
+
+// ConnectionState reports whether the session's requests arrive over
+// HTTPS. No TLS state is returned: requests may come over different
+// connections, so there is no single channel to bind to.
+func (t *boshTransport) ConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, t.secure
+}
+
+func (t *boshTransport) Peer() net.Addr         { return t.peer }
+func (t *boshTransport) LocalAddress() net.Addr { return nil }
+
+// recordingReader keeps what was read from r so that elements found by an
+// xml.Decoder can be cut out of the input by offset.
+type recordingReader struct {
+	r    io.Reader
+	base int64
+	buf  []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+func (r *recordingReader) slice(start, end int64) []byte {
+	return bytes.Clone(r.buf[start-r.base : end-r.base])
+}
+
+// discard drops the input before offset off.
+func (r *recordingReader) discard(off int64) {
+	r.buf = r.buf[off-r.base:]
+	r.base = off
+}
+
+// boshElements splits the stream the server writes into top-level
+// elements. open is called for each stream header, element for each
+// element, with its namespace declared when it relied on the stream's
+// default. It returns when the stream is closed or cannot be parsed.
+func boshElements(r io.Reader, open func(xml.StartElement), element func(xml.StartElement, []byte)) {
+	rec := &recordingReader{r: r}
+	dec := xml.NewDecoder(rec)
+	var (
+		level int
+		start int64
+		first xml.StartElement
+	)
+	for {
+		off := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if level == 0 && t.Name.Space == ns.Stream && t.Name.Local == "stream" {
+				open(t)
+				rec.discard(dec.InputOffset())
+				continue
+			}
+			if level == 0 {
+				start, first = off, t.Copy()
+			}
+			level++
+		case xml.EndElement:
+			if level == 0 {
+				return
+			}
+			level--
+			if level == 0 {
+				end := dec.InputOffset()
+				element(first, declareNamespace(rec.slice(start, end), first))
+				rec.discard(end)
+			}
+		}
+	}
+}
+
+// declareNamespace adds xmlns='jabber:client' to the raw element e when it
+// is in that namespace only by inheriting the stream's default, since the
+// default namespace of a BOSH body is httpbind.
+func declareNamespace(raw []byte, e xml.StartElement) []byte {
+	if e.Name.Space != ns.Client {
+		return raw
+	}
+	for _, a := range e.Attr {
+		if a.Name.Space == "" && a.Name.Local == "xmlns" {
+			return raw
+		}
+	}
+	i := 1 + len(e.Name.Local)
+	if len(raw) < i || string(raw[1:i]) != e.Name.Local {
+		return raw
+	}
+	out := make([]byte, 0, len(raw)+len(ns.Client)+10)
+	out = append(out, raw[:i]...)
+	out = append(out, " xmlns='"+ns.Client+"'"...)
+	return append(out, raw[i:]...)
+}
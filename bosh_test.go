@@ -0,0 +1,391 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// boshEcho answers every stream header with features and echoes messages
+// back to their sender.
+func boshEcho(sessions chan<- *Session) SessionHandlerFunc {
+	return func(ctx context.Context, s *Session) {
+		sessions <- s
+		from := jid.MustParse("example.com")
+		n := 0
+		for {
+			tok, err := s.Reader().Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			if start.Name.Space == ns.Stream && start.Name.Local == "stream" {
+				n++
+				header := stream.Open(stream.Header{From: from, ID: "stream-" + strconv.Itoa(n)})
+				features := `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`
+				if err := s.SendRaw(ctx, strings.NewReader(string(header)+features)); err != nil {
+					return
+				}
+				continue
+			}
+			var msg stanza.Message
+			if err := s.Reader().DecodeElement(&msg, &start); err != nil {
+				return
+			}
+			reply := stanza.NewMessage(stanza.MessageChat)
+			reply.From = msg.To
+			reply.SetBody("echo " + msg.Body())
+			if err := s.Send(ctx, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type boshClient struct {
+	t   *testing.T
+	url string
+	sid string
+	rid int
+}
+
+func newBOSHServer(t *testing.T, cfg BOSHConfig) (*BOSHHandler, *boshClient, <-chan *Session) {
+	t.Helper()
+	sessions := make(chan *Session, 4)
+	h := NewBOSHHandler("example.com", cfg, boshEcho(sessions))
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() { h.Close(); srv.Close() })
+	return h, &boshClient{t: t, url: srv.URL, rid: 1000}, sessions
+}
+
+func (c *boshClient) post(body string) string {
+	c.t.Helper()
+	resp, err := http.Post(c.url, "text/xml; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("read response: %v", err)
+	}
+	return string(data)
+}
+
+// body builds a request with the next rid.
+func (c *boshClient) body(attrs, payload string) string {
+	c.rid++
+	return c.bodyRID(c.rid, attrs, payload)
+}
+
+func (c *boshClient) bodyRID(rid int, attrs, payload string) string {
+	return "<body xmlns='" + ns.BOSH + "' xmlns:xmpp='" + ns.BOSHXmpp + "' sid='" + c.sid + "' rid='" + strconv.Itoa(rid) + "' " + attrs + ">" + payload + "</body>"
+}
+
+func (c *boshClient) create() string {
+	c.t.Helper()
+	c.rid++
+	resp := c.post("<body xmlns='" + ns.BOSH + "' xmlns:xmpp='" + ns.BOSHXmpp + "' rid='" + strconv.Itoa(c.rid) +
+		"' to='example.com' wait='60' hold='1' ver='1.11' xml:lang='en' xmpp:version='1.0'/>")
+	var created struct {
+		SID string `xml:"sid,attr"`
+	}
+	if err := xml.Unmarshal([]byte(resp), &created); err != nil || created.SID == "" {
+		c.t.Fatalf("create = %s (%v)", resp, err)
+	}
+	c.sid = created.SID
+	return resp
+}
+
+func expectContains(t *testing.T, resp string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(resp, w) {
+			t.Fatalf("response %s lacks %s", resp, w)
+		}
+	}
+}
+
+const boshMessage = `<message xmlns='jabber:client' to='echo@example.com' type='chat'><body>hi</body></message>`
+
+func TestBOSHSession(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{})
+
+	resp := c.create()
+	expectContains(t, resp, "requests='2'", "hold='1'", "wait='60'", "authid='stream-1'", "from='example.com'", "xmpp:version='1.0'", "<stream:features>")
+
+	resp = c.post(c.body("", boshMessage))
+	expectContains(t, resp, `<message xmlns='jabber:client'`, "<body>echo hi</body>")
+	if _, err := parseBOSHBody([]byte(resp)); err != nil {
+		t.Fatalf("response is not a body: %v", err)
+	}
+
+	// A restart opens a new stream and gets its features.
+	expectContains(t, c.post(c.body("xmpp:restart='true'", "")), "<stream:features>")
+
+	expectContains(t, c.post(c.body("type='terminate'", `<presence xmlns='jabber:client' type='unavailable'/>`)), "type='terminate'")
+	expectContains(t, c.post(c.body("", "")), "type='terminate'", "condition='item-not-found'")
+}
+
+func TestBOSHRetransmission(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{})
+	c.create()
+
+	req := c.body("", boshMessage)
+	first := c.post(req)
+	if again := c.post(req); again != first {
+		t.Fatalf("retransmission = %s, want %s", again, first)
+	}
+	// An rid outside the window ends the session.
+	expectContains(t, c.post(c.bodyRID(c.rid+5, "", "")), "condition='item-not-found'")
+}
+
+func TestBOSHHoldsRequests(t *testing.T) {
+	t.Parallel()
+	_, c, sessions := newBOSHServer(t, BOSHConfig{})
+	c.create()
+	s := <-sessions
+
+	held := make(chan string, 1)
+	req := c.body("", "")
+	go func() { held <- c.post(req) }()
+	time.Sleep(50 * time.Millisecond)
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("pushed")
+	if err := s.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-held:
+		expectContains(t, resp, "<body>pushed</body>")
+	case <-time.After(2 * time.Second):
+		t.Fatal("held request not answered")
+	}
+
+	// With hold='1', a second request releases the first one empty.
+	first := c.body("", "")
+	go func() { held <- c.post(first) }()
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan string, 1)
+	next := c.body("", "")
+	go func() { second <- c.post(next) }()
+	select {
+	case resp := <-held:
+		if strings.Contains(resp, "<message") {
+			t.Fatalf("released request carried %s", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first request not released")
+	}
+	if err := s.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	expectContains(t, <-second, "<body>pushed</body>")
+}
+
+func TestBOSHWait(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{Wait: 50 * time.Millisecond})
+	c.create()
+	start := time.Now()
+	resp := c.post(c.body("", ""))
+	if strings.Contains(resp, "terminate") || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("empty response %s after %v", resp, time.Since(start))
+	}
+}
+
+func TestBOSHOutOfOrder(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{})
+	c.create()
+
+	msg := func(body string) string {
+		return `<message xmlns='jabber:client' to='echo@example.com'><body>` + body + `</body></message>`
+	}
+	early := make(chan string, 1)
+	second := c.bodyRID(c.rid+2, "", msg("two"))
+	go func() { early <- c.post(second) }()
+	time.Sleep(50 * time.Millisecond)
+
+	resp := c.post(c.bodyRID(c.rid+1, "", msg("one")))
+	c.rid += 2
+	// rid+1 is released empty once rid+2 is held; the echoes follow in
+	// order.
+	all := resp + <-early
+	if !strings.Contains(all, "echo two") {
+		all += c.post(c.body("", ""))
+	}
+	one, two := strings.Index(all, "echo one"), strings.Index(all, "echo two")
+	if one < 0 || two < 0 || two < one {
+		t.Fatalf("responses %s", all)
+	}
+}
+
+func TestBOSHPause(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{MaxPause: 2 * time.Second})
+	c.create()
+
+	start := time.Now()
+	resp := c.post(c.body("pause='1'", ""))
+	if strings.Contains(resp, "terminate") || time.Since(start) > time.Second {
+		t.Fatalf("pause answered with %s after %v", resp, time.Since(start))
+	}
+	// Coming back within the pause resumes the session.
+	expectContains(t, c.post(c.body("", boshMessage)), "<body>echo hi</body>")
+
+	expectContains(t, c.post(c.body("pause='5'", "")), "condition='policy-violation'")
+}
+
+func TestBOSHInactivity(t *testing.T) {
+	t.Parallel()
+	h, c, sessions := newBOSHServer(t, BOSHConfig{Inactivity: 50 * time.Millisecond})
+	c.create()
+	s := <-sessions
+
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("inactive session not closed")
+	}
+	h.mu.Lock()
+	n := len(h.sessions)
+	h.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions left", n)
+	}
+	expectContains(t, c.post(c.body("", "")), "condition='item-not-found'")
+}
+
+func TestBOSHStreamError(t *testing.T) {
+	t.Parallel()
+	_, c, sessions := newBOSHServer(t, BOSHConfig{})
+	c.create()
+	s := <-sessions
+
+	held := make(chan string, 1)
+	req := c.body("", "")
+	go func() { held <- c.post(req) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.SendRaw(context.Background(), strings.NewReader(`<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>`)); err != nil {
+		t.Fatal(err)
+	}
+	expectContains(t, <-held, "<conflict", "type='terminate'", "condition='remote-stream-error'")
+}
+
+func TestBOSHRejectedRequests(t *testing.T) {
+	t.Parallel()
+	_, c, _ := newBOSHServer(t, BOSHConfig{AllowOrigin: "https://web.example"})
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"<body xmlns='" + ns.BOSH + "' rid='1' to='other.example'/>", "condition='host-unknown'"},
+		{"<notbody/>", "condition='bad-request'"},
+		{"<body xmlns='" + ns.BOSH + "' to='example.com'/>", "condition='bad-request'"},
+		{"<body xmlns='" + ns.BOSH + "' sid='nope' rid='2'/>", "condition='item-not-found'"},
+	}
+	for _, tt := range tests {
+		expectContains(t, c.post(tt.body), tt.want)
+	}
+
+	resp, err := http.Get(c.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Access-Control-Allow-Origin") != "https://web.example" {
+		t.Fatalf("GET = %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestServerBOSHHandler(t *testing.T) {
+	t.Parallel()
+	sessions := make(chan *Session, 1)
+	server, err := NewServer("example.com", WithServerSessionHandler(boshEcho(sessions)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server.BOSHHandler(BOSHConfig{}))
+	defer srv.Close()
+
+	c := &boshClient{t: t, url: srv.URL, rid: 1}
+	c.create()
+	s := <-sessions
+	if server.SessionCount() != 1 {
+		t.Fatalf("SessionCount = %d, want 1", server.SessionCount())
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed with the server")
+	}
+}
+
+func TestServerBOSHHandlerAfterClose(t *testing.T) {
+	t.Parallel()
+	sessions := make(chan *Session, 1)
+	server, err := NewServer("example.com", WithServerSessionHandler(boshEcho(sessions)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server.BOSHHandler(BOSHConfig{}))
+	defer srv.Close()
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &boshClient{t: t, url: srv.URL, rid: 1}
+	resp := c.post("<body xmlns='" + ns.BOSH + "' rid='2' to='example.com' wait='60' hold='1'/>")
+	expectContains(t, resp, "<system-shutdown", "type='terminate'")
+	select {
+	case <-sessions:
+		t.Fatal("session started after the server closed")
+	default:
+	}
+	if n := server.SessionCount(); n != 0 {
+		t.Fatalf("SessionCount = %d, want 0", n)
+	}
+}
+
+func TestDeclareNamespace(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{`<message to="a@b"><body>x</body></message>`, `<message xmlns='jabber:client' to="a@b"><body>x</body></message>`},
+		{`<iq/>`, `<iq xmlns='jabber:client'/>`},
+		{`<message xmlns="jabber:client"/>`, `<message xmlns="jabber:client"/>`},
+		{`<stream:features/>`, `<stream:features/>`},
+	}
+	for _, tt := range tests {
+		var got []string
+		boshElements(strings.NewReader(string(stream.Open(stream.Header{}))+tt.in), func(xml.StartElement) {}, func(_ xml.StartElement, raw []byte) {
+			got = append(got, string(raw))
+		})
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("element %s = %q, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/meszmate/xmpp-go/plugins/dialback"
 	"github.com/meszmate/xmpp-go/plugins/disco"
 	"github.com/meszmate/xmpp-go/plugins/extdisco"
+	"github.com/meszmate/xmpp-go/plugins/fallback"
 	"github.com/meszmate/xmpp-go/plugins/filetransfer"
 	"github.com/meszmate/xmpp-go/plugins/form"
 	"github.com/meszmate/xmpp-go/plugins/forward"
@@ -36,14 +37,19 @@ import (
 	"github.com/meszmate/xmpp-go/plugins/oob"
 	"github.com/meszmate/xmpp-go/plugins/ping"
 	"github.com/meszmate/xmpp-go/plugins/presence"
+	"github.com/meszmate/xmpp-go/plugins/privilege"
 	"github.com/meszmate/xmpp-go/plugins/pubsub"
 	"github.com/meszmate/xmpp-go/plugins/push"
 	"github.com/meszmate/xmpp-go/plugins/reactions"
 	"github.com/meszmate/xmpp-go/plugins/receipts"
+	"github.com/meszmate/xmpp-go/plugins/reply"
 	"github.com/meszmate/xmpp-go/plugins/retraction"
 	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/plugins/rosterx"
 	"github.com/meszmate/xmpp-go/plugins/rsm"
 	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/plugins/serverinfo"
 	"github.com/meszmate/xmpp-go/plugins/sm"
 	"github.com/meszmate/xmpp-go/plugins/socks5"
 	"github.com/meszmate/xmpp-go/plugins/stanzaid"
@@ -73,6 +79,7 @@ func TestBuiltinPluginsInitializeAndClose(t *testing.T) {
 		dialback.New(),
 		disco.New(),
 		extdisco.New(),
+		fallback.New(),
 		filetransfer.New(),
 		form.New(),
 		forward.New(),
@@ -89,14 +96,19 @@ func TestBuiltinPluginsInitializeAndClose(t *testing.T) {
 		omemo.New(123456),
 		ping.New(),
 		presence.New(),
+		privilege.New(),
 		pubsub.New(),
 		push.New(),
 		reactions.New(),
 		receipts.New(),
+		reply.New(),
 		retraction.New(),
 		roster.New(),
+		rosterx.New(),
 		rsm.New(),
 		sasl2.New(),
+		search.New(),
+		serverinfo.New(),
 		sm.New(),
 		socks5.New(),
 		stanzaid.New(),
@@ -0,0 +1,90 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+
+	"github.com/meszmate/xmpp-go/plugins/carbons"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// EnableCarbons asks the server to copy to this client the messages sent
+// and received by the account's other resources (XEP-0280). The choice is
+// remembered and repeated on every new authenticated stream, including
+// after a reconnect; a resumed stream keeps it on the server's side.
+func (c *Client) EnableCarbons(ctx context.Context) error {
+	return c.setCarbons(ctx, true)
+}
+
+// DisableCarbons stops the copies requested with EnableCarbons.
+func (c *Client) DisableCarbons(ctx context.Context) error {
+	return c.setCarbons(ctx, false)
+}
+
+// CarbonsEnabled reports whether the application last enabled carbons.
+func (c *Client) CarbonsEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.carbons
+}
+
+func (c *Client) setCarbons(ctx context.Context, enabled bool) error {
+	c.mu.Lock()
+	c.carbons = enabled
+	s := c.session
+	c.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	iq, err := carbonsIQ(enabled)
+	if err != nil {
+		return err
+	}
+	reply, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return err
+	}
+	if reply.Type == stanza.IQError && reply.Error != nil {
+		return reply.Error
+	}
+	return nil
+}
+
+// resendCarbons enables carbons again on s, a new stream on which the server
+// starts with them disabled, if the application had enabled them. Streams
+// that are not authenticated yet, or that enabled carbons inline with Bind2,
+// are left alone.
+func (c *Client) resendCarbons(s *Session) {
+	c.mu.Lock()
+	enabled := c.carbons
+	c.mu.Unlock()
+
+	if !enabled || s.State()&StateAuthenticated == 0 {
+		return
+	}
+	if f, ok := s.InlineFeatures(); ok && f.CarbonsEnabled {
+		return
+	}
+	iq, err := carbonsIQ(true)
+	if err != nil {
+		return
+	}
+	// Serve reads the reply, so it cannot be waited for here; a failed
+	// write surfaces through Serve as well.
+	_ = s.Send(context.Background(), iq)
+}
+
+func carbonsIQ(enabled bool) (*stanza.IQ, error) {
+	var v any = carbons.Disable{}
+	if enabled {
+		v = carbons.Enable{}
+	}
+	payload, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = payload
+	return iq, nil
+}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/meszmate/xmpp-go/dial"
 	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/plugin"
 	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+	"github.com/meszmate/xmpp-go/transport"
 )
 
 // Client is a high-level XMPP client.
@@ -22,6 +25,27 @@ type Client struct {
 	dialer   *dial.Dialer
 	opts     clientOptions
 	handler  Handler
+	csi      csiState
+	carbons  bool
+	fast     *FastToken
+	closed   bool
+	done     chan struct{} // closed by Close
+	redirect string
+	queue    *sendQueue
+	sm       *streamMgmt
+
+	// connectMu serializes connects, which do their network I/O without
+	// mu, and guards fast.
+	connectMu sync.Mutex
+
+	callbacks    callbacks
+	roster       rosterCache
+	delivery     deliveryTracker
+	reconnecting bool
+
+	onStreamError  func(*stream.Error)
+	onReconnecting func(attempt int, delay time.Duration, err error)
+	onReconnected  func(attempt int)
 }
 
 // NewClient creates a new XMPP client.
@@ -29,34 +53,120 @@ func NewClient(addr jid.JID, password string, opts ...ClientOption) (*Client, er
 	c := &Client{
 		addr:     addr,
 		password: password,
-		dialer:   dial.NewDialer(),
 	}
 
 	for _, opt := range opts {
 		opt.apply(&c.opts)
 	}
+	c.dialer = c.opts.newDialer()
+	if c.opts.sasl2 != nil {
+		c.fast = c.opts.sasl2.Token
+	}
+	if c.opts.queueSize != 0 {
+		c.queue = newSendQueue(c.opts.queueSize, c.opts.queuePolicy)
+	}
+	if c.opts.streamMgmt {
+		c.sm = newStreamMgmt(c.opts.resumeTimeout)
+		c.sm.restarted = c.resendCarbons
+	}
 
 	return c, nil
 }
 
-// Connect establishes a connection to the XMPP server.
+// Connect establishes a connection to the XMPP server, authenticating first
+// if WithSASL2 is set. Once connected, the client reads the stream in its
+// own goroutine and dispatches stanzas to the handler set with WithHandler
+// (or the session mux). Callers must not call Serve on the returned Session
+// themselves.
 func (c *Client) Connect(ctx context.Context) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	// A session bound inline with Bind2 gets no stream features to react
+	// to, so the client's state is restored right away.
+	if _, ok := session.InlineFeatures(); ok {
+		c.streamReady(session)
+	}
+	return nil
+}
+
+// connect dials the server and starts serving a new session. The dial and
+// the authentication run without c.mu, so that Close can cancel them.
+func (c *Client) connect(ctx context.Context) (*Session, error) {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.done == nil || c.closed {
+		c.done = make(chan struct{})
+	}
+	c.closed = false
+	done := c.done
+	host := c.redirect
+	c.redirect = ""
+	c.mu.Unlock()
 
-	trans, err := c.dialer.Dial(ctx, c.addr.Domain())
+	// Close abandons a connect still in progress.
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-dctx.Done():
+		}
+	}()
+
+	var trans *transport.TCP
+	var err error
+	if host != "" {
+		trans, err = c.dialer.DialHost(dctx, host, c.addr.Domain())
+	} else {
+		trans, err = c.dialer.Dial(dctx, c.addr.Domain())
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	sessionOpts := []SessionOption{
 		WithLocalAddr(c.addr),
+		WithWireFormat(c.opts.wireFormat),
+		WithMetrics(c.opts.metrics),
+		WithTracer(c.opts.tracer),
+		WithLogger(c.opts.logger),
+		withStreamDump(c.opts.streamDump),
 	}
 
 	session, err := NewSession(ctx, trans, sessionOpts...)
 	if err != nil {
 		trans.Close()
-		return err
+		return nil, err
+	}
+	if _, ok := trans.ConnectionState(); ok {
+		session.SetState(StateSecure)
+	}
+	if c.opts.sasl2 != nil {
+		actx, cancel := context.WithTimeout(dctx, DefaultAuthTimeout)
+		err := c.authenticate(actx, session)
+		cancel()
+		if err != nil {
+			var failure *SASL2Error
+			if errors.As(err, &failure) {
+				session.Metrics().AuthFailed("")
+			}
+			session.Close()
+			return nil, err
+		}
+	} else if c.sm != nil {
+		c.sm.attach(session)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		session.Close()
+		return nil, ErrClientClosed
 	}
 	c.session = session
 
@@ -66,7 +176,7 @@ func (c *Client) Connect(ctx context.Context) error {
 			if err := mgr.Register(p); err != nil {
 				session.Close()
 				c.session = nil
-				return err
+				return nil, err
 			}
 		}
 		params := plugin.InitParams{
@@ -77,26 +187,63 @@ func (c *Client) Connect(ctx context.Context) error {
 			State:       func() uint32 { return uint32(session.State()) },
 			LocalJID:    func() string { return session.LocalAddr().String() },
 			RemoteJID:   func() string { return session.RemoteAddr().String() },
+			SendIQ:      session.SendIQ,
 		}
 		if err := mgr.Initialize(ctx, params); err != nil {
 			session.Close()
 			c.session = nil
-			return err
+			return nil, err
 		}
 		c.plugins = mgr
 	}
 
-	return nil
+	session.OnStreamFeatures(func() { c.streamReady(session) })
+
+	go c.serve(session)
+	if c.queue != nil {
+		go c.flushQueue(session)
+	}
+	if c.opts.livenessInterval > 0 {
+		go c.checkLiveness(session)
+	}
+	return session, nil
 }
 
-// Send sends a stanza.
+// streamReady restores the client's state on s once the server has
+// advertised its features. The CSI state and stream management can only be
+// sent once the server has advertised support. Carbons wait for a
+// resumption to fail, since a resumed stream still has them.
+func (c *Client) streamReady(s *Session) {
+	c.resendCSI(s)
+	if c.sm != nil {
+		_ = c.sm.negotiate(context.Background(), s)
+		if c.sm.resumes(s) {
+			return
+		}
+	}
+	c.resendCarbons(s)
+}
+
+// Send sends a stanza. With a queue enabled through WithSendQueue, a
+// stanza sent while disconnected is queued as if by Queue. With
+// WithDeliveryTracking, receipts and markers are requested for messages.
 func (c *Client) Send(ctx context.Context, st stanza.Stanza) error {
+	id := c.trackOutgoing(st)
+	err := c.send(ctx, st)
+	c.sentTracked(ctx, id, err)
+	return err
+}
+
+func (c *Client) send(ctx context.Context, st stanza.Stanza) error {
 	c.mu.Lock()
 	s := c.session
 	c.mu.Unlock()
 
 	if s == nil {
-		return errors.New("xmpp: not connected")
+		if c.queue != nil {
+			return c.Queue(st, nil)
+		}
+		return ErrNotConnected
 	}
 	return s.Send(ctx, st)
 }
@@ -110,9 +257,22 @@ func (c *Client) Session() *Session {
 
 // Close closes the client connection.
 func (c *Client) Close() error {
+	err := c.close()
+	c.failQueue(ErrClientClosed)
+	return err
+}
+
+func (c *Client) close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if !c.closed && c.done != nil {
+		close(c.done)
+	}
+	c.closed = true
+	if c.sm != nil {
+		c.sm.forget()
+	}
 	var firstErr error
 	if c.plugins != nil {
 		if err := c.plugins.Close(); err != nil {
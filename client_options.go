@@ -1,7 +1,10 @@
 package xmpp
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
+	"time"
 
 	"github.com/meszmate/xmpp-go/dial"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -10,10 +13,59 @@ import (
 type clientOptions struct {
 	tlsConfig *tls.Config
 	dialer    *dial.Dialer
+	dialFunc  func(ctx context.Context, network, addr string) (net.Conn, error)
+	resolver  *dial.Resolver
 	handler   Handler
 	directTLS bool
 	noTLS     bool
 	plugins   []plugin.Plugin
+
+	livenessInterval time.Duration
+	livenessTimeout  time.Duration
+
+	queueSize   int
+	queuePolicy QueuePolicy
+
+	wireFormat WireFormat
+
+	metrics Metrics
+	tracer  Tracer
+
+	logger     Logger
+	streamDump bool
+
+	streamMgmt    bool
+	resumeTimeout time.Duration
+
+	backoff *Backoff
+
+	sasl2 *SASL2Config
+
+	trackDelivery bool
+	autoReceipts  bool
+}
+
+// newDialer returns the dialer set with WithClientDialer, or a default
+// one, with the other connection options applied to a copy of it.
+func (o *clientOptions) newDialer() *dial.Dialer {
+	d := dial.NewDialer()
+	if o.dialer != nil {
+		cp := *o.dialer
+		d = &cp
+	}
+	if o.dialFunc != nil {
+		d.DialContext = o.dialFunc
+	}
+	if o.resolver != nil {
+		d.Resolver = o.resolver
+	}
+	if o.directTLS {
+		d.DirectTLS = true
+	}
+	if o.tlsConfig != nil && d.TLSConfig == nil {
+		d.TLSConfig = o.tlsConfig
+	}
+	return d
 }
 
 // ClientOption configures a Client.
@@ -39,6 +91,23 @@ func WithClientDialer(d *dial.Dialer) ClientOption {
 	})
 }
 
+// WithDialer makes the client open its TCP connections with dial instead
+// of a net.Dialer, for example to connect through a proxy or, in tests, to
+// a net.Pipe. SRV resolution and Direct TLS still apply on top of it.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.dialFunc = dial
+	})
+}
+
+// WithResolver sets the resolver used to look up the SRV records of the
+// server, for example one made with dial.NewResolverFunc.
+func WithResolver(r *dial.Resolver) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.resolver = r
+	})
+}
+
 // WithHandler sets the stanza handler for the client.
 func WithHandler(h Handler) ClientOption {
 	return clientOptionFunc(func(o *clientOptions) {
@@ -66,3 +135,126 @@ func WithPlugins(plugins ...plugin.Plugin) ClientOption {
 		o.plugins = append(o.plugins, plugins...)
 	})
 }
+
+// WithLivenessCheck enables a client-side liveness check. When nothing has
+// been received from the server for interval, the client sends an XEP-0199
+// ping; if no reply arrives within timeout the connection is considered dead
+// and the client reconnects. Any inbound traffic, including stream
+// management acks, counts as proof of liveness and defers the next ping.
+func WithLivenessCheck(interval, timeout time.Duration) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.livenessInterval = interval
+		o.livenessTimeout = timeout
+	})
+}
+
+// WithSendQueue buffers stanzas sent with Queue, or with Send while
+// disconnected, in a queue of at most size entries that is flushed in order
+// whenever the client (re)connects. When the queue is full, policy decides
+// whether the new stanza is refused or the oldest one is dropped. A negative
+// size means no bound.
+func WithSendQueue(size int, policy QueuePolicy) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.queueSize = size
+		o.queuePolicy = policy
+	})
+}
+
+// WithClientWireFormat sets the layout of the stanzas the client writes;
+// see WithWireFormat.
+func WithClientWireFormat(f WireFormat) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.wireFormat = f
+	})
+}
+
+// WithClientMetrics reports the client's sessions, the stanzas they carry
+// and rejected SASL2 authentications to m; see WithMetrics.
+func WithClientMetrics(m Metrics) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.metrics = m
+	})
+}
+
+// WithClientTracer starts a span with t around the handling of every
+// stanza the client receives; see WithTracer.
+func WithClientTracer(t Tracer) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.tracer = t
+	})
+}
+
+// WithClientLogger sets where the client and its sessions log; see
+// WithLogger.
+func WithClientLogger(l Logger) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.logger = l
+	})
+}
+
+// WithClientStreamDump logs the XML of the client's streams at debug
+// level; see WithStreamDump.
+func WithClientStreamDump() ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.streamDump = true
+	})
+}
+
+// WithStreamManagement enables Stream Management (XEP-0198) once the server
+// advertises it. Stanzas are counted and kept until the server acknowledges
+// them. When the connection drops, the client reconnects and resumes the
+// stream if it was lost less than resumeTimeout ago (or the shorter timeout
+// granted by the server), sending again whatever the server had not
+// acknowledged. A resumeTimeout of zero enables acks without resumption.
+func WithStreamManagement(resumeTimeout time.Duration) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.streamMgmt = true
+		o.resumeTimeout = resumeTimeout
+	})
+}
+
+// WithReconnect makes the client re-establish its connection whenever it is
+// lost, or ended by a stream error that a later attempt may not meet, until
+// Close is called. Attempts are spaced out as b describes and reported
+// through OnReconnecting and OnReconnected. Each attempt connects as Connect
+// does, initializing the plugins again, and the CSI and Message Carbons
+// states set on the client are restored on the new stream.
+func WithReconnect(b Backoff) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.backoff = &b
+	})
+}
+
+// WithSASL2 makes Connect open the stream and authenticate with SASL2
+// (XEP-0388), after STARTTLS unless the connection uses Direct TLS or
+// WithNoTLS is set. SCRAM is bound to the TLS channel with tls-exporter
+// when the server supports it (XEP-0440). If the server offers Bind2
+// (XEP-0386), the resource is bound and stream management and carbons are
+// enabled, or the previous stream resumed, in the same round trip; the
+// session is then ready when Connect returns. With cfg.FAST, later
+// connections use a XEP-0484 token instead of the password.
+func WithSASL2(cfg SASL2Config) ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.sasl2 = &cfg
+	})
+}
+
+// WithDeliveryTracking makes the client request a delivery receipt
+// (XEP-0184) and chat markers (XEP-0333) on the chat and normal messages
+// with a body it sends, and follow each message from sent to delivered and
+// displayed as the recipient's receipts and markers arrive. Changes are
+// reported through OnDelivery.
+func WithDeliveryTracking() ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.trackDelivery = true
+	})
+}
+
+// WithAutoReceipts makes the client answer the receipt requests of the
+// messages it receives, and send the received marker for markable ones.
+// Displayed markers are left to the application, with MarkDisplayed.
+func WithAutoReceipts() ClientOption {
+	return clientOptionFunc(func(o *clientOptions) {
+		o.autoReceipts = true
+	})
+}
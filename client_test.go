@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/dial"
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// clientRecords resolves the Direct TLS and plain client SRV records of
+// example.com to one target each; an empty target has no records.
+func clientRecords(direct, plain string) *dial.Resolver {
+	return dial.NewResolverFunc(func(_ context.Context, service, _, name string) (string, []*net.SRV, error) {
+		target := plain
+		if service == "xmpps-client" {
+			target = direct
+		}
+		if name != "example.com" || target == "" {
+			return "", nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}
+		return "", []*net.SRV{{Target: target + ".", Port: 5222, Priority: 10}}, nil
+	})
+}
+
+func TestClientConnectResolvesSRV(t *testing.T) {
+	t.Parallel()
+	var dialed []string
+	pipeDialer := func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c2.Close() })
+		return c1, nil
+	}
+
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(pipeDialer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	if len(dialed) != 1 || dialed[0] != "xmpp.example.net:5222" {
+		t.Fatalf("dialed %v", dialed)
+	}
+	if c.Session().State()&StateSecure != 0 {
+		t.Fatal("plain connection marked secure")
+	}
+}
+
+func TestClientConnectDirectTLS(t *testing.T) {
+	t.Parallel()
+	pool, certs := s2sCertificates(t, "example.com")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{certs["example.com"]}}
+	tlsDialer := func(_ context.Context, _, addr string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		srv := tls.Server(c2, serverTLS)
+		go func() { _, _ = io.Copy(io.Discard, srv) }()
+		t.Cleanup(func() { srv.Close() })
+		return c1, nil
+	}
+
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("tls.example.net", "")),
+		WithDialer(tlsDialer),
+		WithClientTLS(&tls.Config{RootCAs: pool}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if c.Session().State()&StateSecure == 0 {
+		t.Fatal("Direct TLS connection not marked secure")
+	}
+}
+
+func TestClientDialerOptions(t *testing.T) {
+	t.Parallel()
+	base := &dial.Dialer{Timeout: 5}
+	cfg := &tls.Config{ServerName: "example.com"}
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithClientDialer(base), WithDirectTLS(), WithClientTLS(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dialer == base || !c.dialer.DirectTLS || c.dialer.TLSConfig != cfg || c.dialer.Timeout != 5 {
+		t.Fatalf("dialer = %+v", c.dialer)
+	}
+	if base.DirectTLS {
+		t.Fatal("WithDirectTLS changed the caller's dialer")
+	}
+}
@@ -0,0 +1,36 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewFake(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Fatalf("Now = %v, want %v", got, start)
+	}
+	c.Advance(90 * time.Second)
+	if got, want := c.Now(), start.Add(90*time.Second); !got.Equal(want) {
+		t.Fatalf("after Advance: Now = %v, want %v", got, want)
+	}
+	c.Set(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Fatalf("after Set: Now = %v, want %v", got, start)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != System {
+		t.Fatal("Or(nil) should return System")
+	}
+	f := NewFake(time.Time{})
+	if Or(f) != Clock(f) {
+		t.Fatal("Or(f) should return f")
+	}
+	before := time.Now()
+	if got := System.Now(); got.Before(before) {
+		t.Fatalf("System.Now = %v, before %v", got, before)
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	xmpp "github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/commands"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// globalCommands runs the ad-hoc commands (XEP-0050) of the server JID. It
+// is nil when no administrator is listed in XMPP_ADMINS.
+var globalCommands *commands.Plugin
+
+// Service administration command nodes (XEP-0133).
+const (
+	adminAddUser        = ns.Admin + "#add-user"
+	adminDeleteUser     = ns.Admin + "#delete-user"
+	adminEndUserSession = ns.Admin + "#end-user-session"
+	adminOnlineUsers    = ns.Admin + "#get-online-users-list"
+	adminAnnounce       = ns.Admin + "#announce"
+	adminSetMOTD        = ns.Admin + "#set-motd"
+	adminEditMOTD       = ns.Admin + "#edit-motd"
+	adminDeleteMOTD     = ns.Admin + "#delete-motd"
+)
+
+// User data commands, beyond XEP-0133.
+const (
+	adminExportUserData = "urn:xmpp-go:admin#export-user-data"
+	adminEraseUserData  = "urn:xmpp-go:admin#erase-user-data"
+	adminAnnounceAll    = "urn:xmpp-go:admin#announce-all-users"
+)
+
+// Shared roster group commands.
+const (
+	adminListSharedGroups         = "urn:xmpp-go:admin#list-shared-groups"
+	adminSetSharedGroup           = "urn:xmpp-go:admin#set-shared-group"
+	adminDeleteSharedGroup        = "urn:xmpp-go:admin#delete-shared-group"
+	adminAddSharedGroupMembers    = "urn:xmpp-go:admin#add-shared-group-members"
+	adminRemoveSharedGroupMembers = "urn:xmpp-go:admin#remove-shared-group-members"
+)
+
+// adminCommands are the XEP-0133 commands offered to the administrators.
+type adminCommands struct {
+	cfg    Config
+	store  storage.Storage
+	admins map[string]bool
+}
+
+func newCommandService(cfg Config, store storage.Storage) *commands.Plugin {
+	if len(cfg.Admins) == 0 {
+		return nil
+	}
+	a := &adminCommands{cfg: cfg, store: store, admins: make(map[string]bool)}
+	for _, admin := range cfg.Admins {
+		a.admins[accountJID(admin, cfg.Domain)] = true
+	}
+	p := commands.New()
+	if store != nil && store.UserStore() != nil {
+		p.Register(adminAddUser, "Add User", a.allowed, commands.FormHandler(addUserForm, a.addUser))
+		p.Register(adminDeleteUser, "Delete User", a.allowed, commands.FormHandler(accountsForm("Delete User", "The accounts to delete"), a.deleteUser))
+	}
+	if store != nil {
+		p.Register(adminExportUserData, "Export User Data", a.allowed, commands.FormHandler(exportUserDataForm, a.exportUserData))
+		p.Register(adminEraseUserData, "Erase User Data", a.allowed, commands.FormHandler(accountsForm("Erase User Data", "The accounts to erase with all their data"), a.eraseUserData))
+		p.Register(adminAnnounceAll, "Send Announcement to All Users", a.allowed, commands.FormHandler(announceForm, a.announceAll))
+	}
+	if store != nil && store.SharedGroupStore() != nil && store.RosterStore() != nil {
+		p.Register(adminListSharedGroups, "List Shared Roster Groups", a.allowed, a.listSharedGroups)
+		p.Register(adminSetSharedGroup, "Set Shared Roster Group", a.allowed, commands.FormHandler(setSharedGroupForm, a.setSharedGroup))
+		p.Register(adminDeleteSharedGroup, "Delete Shared Roster Group", a.allowed, commands.FormHandler(deleteSharedGroupForm, a.deleteSharedGroup))
+		p.Register(adminAddSharedGroupMembers, "Add Shared Roster Group Members", a.allowed, commands.FormHandler(sharedGroupMembersForm("Add Shared Roster Group Members", "The accounts to add"), a.addSharedGroupMembers))
+		p.Register(adminRemoveSharedGroupMembers, "Remove Shared Roster Group Members", a.allowed, commands.FormHandler(sharedGroupMembersForm("Remove Shared Roster Group Members", "The accounts to remove"), a.removeSharedGroupMembers))
+	}
+	p.Register(adminEndUserSession, "End User Session", a.allowed, commands.FormHandler(accountsForm("End User Session", "The accounts or sessions to end"), a.endUserSession))
+	p.Register(adminOnlineUsers, "Get List of Online Users", a.allowed, commands.FormHandler(onlineUsersForm, a.onlineUsers))
+	p.Register(adminAnnounce, "Send Announcement to Online Users", a.allowed, commands.FormHandler(announceForm, a.announce))
+	p.Register(adminSetMOTD, "Set Message of the Day", a.allowed, commands.FormHandler(motdForm(false), a.setMOTD))
+	p.Register(adminEditMOTD, "Edit Message of the Day", a.allowed, commands.FormHandler(motdForm(true), a.editMOTD))
+	p.Register(adminDeleteMOTD, "Delete Message of the Day", a.allowed, a.deleteMOTD)
+	return p
+}
+
+// allowed reports whether from is a local administrator.
+func (a *adminCommands) allowed(from jid.JID) bool {
+	return from.Domain() == a.cfg.Domain && a.admins[from.Bare().String()]
+}
+
+// answerCommands returns the reply to an ad-hoc command request from source
+// or to its disco query for the commands of the server, or nil when iq is
+// neither.
+func answerCommands(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	if iq.From.IsZero() {
+		iq.From = source.RemoteAddr()
+	}
+	if iq.Type == stanza.IQGet {
+		var items disco.ItemsQuery
+		if xml.Unmarshal(iq.Query, &items) == nil && items.Node == ns.Commands {
+			if globalCommands == nil {
+				return payloadIQ(iq, disco.ItemsQuery{Node: ns.Commands})
+			}
+			// Local users address their own server.
+			server, err := jid.New("", iq.From.Domain(), "")
+			if err != nil {
+				return nil
+			}
+			return payloadIQ(iq, globalCommands.Items(server, iq.From))
+		}
+		var info disco.InfoQuery
+		if xml.Unmarshal(iq.Query, &info) == nil && info.Node != "" && globalCommands != nil {
+			if info, ok := globalCommands.Info(info.Node, iq.From); ok {
+				return payloadIQ(iq, info)
+			}
+		}
+		return nil
+	}
+	if err := xml.Unmarshal(iq.Query, &commands.Command{}); err != nil {
+		return nil
+	}
+	if globalCommands == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "unknown command"))
+	}
+	return globalCommands.HandleIQ(ctx, iq)
+}
+
+func adminForm(title, instructions string) *form.Form {
+	f := form.NewForm(form.TypeForm, title)
+	f.Instructions = []string{instructions}
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.Admin}})
+	return f
+}
+
+func addUserForm() *form.Form {
+	f := adminForm("Adding a User", "Fill out this form to add a user.")
+	f.AddField(form.Field{Var: "accountjid", Type: form.FieldJIDSingle, Label: "The Jabber ID for the account to be added", Required: true})
+	f.AddField(form.Field{Var: "password", Type: form.FieldTextPrivate, Label: "The password for this account", Required: true})
+	f.AddField(form.Field{Var: "password-verify", Type: form.FieldTextPrivate, Label: "Retype password", Required: true})
+	return f
+}
+
+func (a *adminCommands) addUser(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	account, err := a.localAccount(req.Form.GetValue("accountjid"))
+	if err != nil {
+		return nil, err
+	}
+	password := req.Form.GetValue("password")
+	if password == "" || password != req.Form.GetValue("password-verify") {
+		return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, "passwords do not match")
+	}
+	user, err := newUser(account.Local(), password, a.cfg.Registration.Iterations, a.cfg.Registration.KeepPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.UserStore().CreateUser(ctx, user); err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			return nil, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "account exists")
+		}
+		return nil, err
+	}
+	return commands.Completed("Added " + account.String() + "."), nil
+}
+
+// accountsForm returns the builder of a form asking for accountjids.
+func accountsForm(title, label string) func() *form.Form {
+	return func() *form.Form {
+		f := adminForm(title, "Fill out this form to "+strings.ToLower(title)+".")
+		f.AddField(form.Field{Var: "accountjids", Type: form.FieldJIDMulti, Label: label, Required: true})
+		return f
+	}
+}
+
+// accounts returns the JIDs of the accountjids field, which must all be
+// local.
+func (a *adminCommands) accounts(f *form.Form) ([]jid.JID, error) {
+	var out []jid.JID
+	if field := f.GetField("accountjids"); field != nil {
+		for _, v := range field.Values {
+			j, err := a.localAccount(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, j)
+		}
+	}
+	if len(out) == 0 {
+		return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "no account given")
+	}
+	return out, nil
+}
+
+// localAccount parses the JID of a local account. A resource is kept for
+// the commands that act on one session.
+func (a *adminCommands) localAccount(v string) (jid.JID, error) {
+	j, err := jid.Parse(strings.TrimSpace(v))
+	if err != nil || j.Local() == "" {
+		return jid.JID{}, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "invalid account JID")
+	}
+	if j.Domain() != a.cfg.Domain {
+		return jid.JID{}, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, j.String()+" is not a local account")
+	}
+	return j, nil
+}
+
+func (a *adminCommands) deleteUser(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	accounts, err := a.accounts(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	var deleted, missing []string
+	for _, account := range accounts {
+		account = account.Bare()
+		err := a.store.UserStore().DeleteUser(ctx, account.Local())
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			missing = append(missing, account.String())
+			continue
+		case err != nil:
+			return nil, err
+		}
+		disconnect(ctx, globalRouter.targets(account), stream.NewError(stream.ErrNotAuthorized, "account deleted"))
+		deleted = append(deleted, account.String())
+	}
+	return summary("Deleted", deleted, "Not found", missing), nil
+}
+
+func exportUserDataForm() *form.Form {
+	f := adminForm("Exporting User Data", "Fill out this form to export everything stored about an account.")
+	f.AddField(form.Field{Var: "accountjid", Type: form.FieldJIDSingle, Label: "The Jabber ID of the account", Required: true})
+	f.AddField(form.Field{Var: "format", Type: form.FieldListSingle, Label: "Format", Values: []string{string(storage.ExportJSON)}, Options: []form.Option{
+		{Label: "JSON", Value: string(storage.ExportJSON)},
+		{Label: "XML", Value: string(storage.ExportXML)},
+	}})
+	return f
+}
+
+// exportUserData returns the export of an account in a text-multi field,
+// one line of the export per value.
+func (a *adminCommands) exportUserData(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	account, err := a.localAccount(req.Form.GetValue("accountjid"))
+	if err != nil {
+		return nil, err
+	}
+	format := storage.ExportFormat(req.Form.GetValue("format"))
+	switch format {
+	case "":
+		format = storage.ExportJSON
+	case storage.ExportJSON, storage.ExportXML:
+	default:
+		return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "unknown format")
+	}
+	var buf strings.Builder
+	if err := exportUserData(ctx, a.cfg, a.store, account, format, &buf); err != nil {
+		return nil, err
+	}
+	f := form.NewForm(form.TypeResult, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.Admin}})
+	f.AddField(form.Field{Var: "accountjid", Type: form.FieldJIDSingle, Values: []string{account.Bare().String()}})
+	f.AddField(form.Field{Var: "userdata", Type: form.FieldTextMulti, Label: "The stored data of the account",
+		Values: strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")})
+	return &commands.Command{Status: commands.StatusCompleted, Form: f}, nil
+}
+
+// eraseUserData deletes accounts with everything stored about them.
+func (a *adminCommands) eraseUserData(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	accounts, err := a.accounts(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	var erased []string
+	for _, account := range accounts {
+		if err := eraseUserData(ctx, a.cfg, a.store, account); err != nil {
+			return nil, err
+		}
+		erased = append(erased, account.Bare().String())
+	}
+	return summary("Erased", erased, "", nil), nil
+}
+
+func (a *adminCommands) endUserSession(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	accounts, err := a.accounts(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	var ended, offline []string
+	for _, account := range accounts {
+		sessions := globalRouter.targets(account)
+		if len(sessions) == 0 {
+			offline = append(offline, account.String())
+			continue
+		}
+		disconnect(ctx, sessions, stream.NewError(stream.ErrPolicyViolation, "session ended by an administrator"))
+		ended = append(ended, account.String())
+	}
+	return summary("Ended sessions of", ended, "Not online", offline), nil
+}
+
+// summary completes a command acting on several accounts with a note
+// listing those it did and did not act on.
+func summary(done string, ok []string, failed string, missed []string) *commands.Command {
+	var parts []string
+	if len(ok) > 0 {
+		parts = append(parts, done+" "+strings.Join(ok, ", ")+".")
+	}
+	if len(missed) > 0 {
+		parts = append(parts, failed+": "+strings.Join(missed, ", ")+".")
+	}
+	cmd := commands.Completed(strings.Join(parts, " "))
+	if len(ok) == 0 {
+		cmd.Note.Type = commands.NoteWarn
+	}
+	return cmd
+}
+
+var maxItemsOptions = []string{"25", "50", "75", "100", "150", "200", "none"}
+
+func onlineUsersForm() *form.Form {
+	f := adminForm("Requesting List of Online Users", "Fill out this form to request the online users of this service.")
+	field := form.Field{Var: "max_items", Type: form.FieldListSingle, Label: "Maximum number of items to report", Values: []string{"100"}}
+	for _, v := range maxItemsOptions {
+		field.Options = append(field.Options, form.Option{Label: v, Value: v})
+	}
+	f.AddField(field)
+	return f
+}
+
+func (a *adminCommands) onlineUsers(_ context.Context, req commands.Request) (*commands.Command, error) {
+	limit := 0
+	if v := req.Form.GetValue("max_items"); v != "" && v != "none" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "invalid max_items")
+		}
+		limit = n
+	}
+	var users []string
+	for _, session := range globalRouter.all() {
+		bare := session.RemoteAddr().Bare().String()
+		if !slices.Contains(users, bare) {
+			users = append(users, bare)
+		}
+	}
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	f := form.NewForm(form.TypeResult, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.Admin}})
+	f.AddField(form.Field{Var: "onlineuserjids", Type: form.FieldJIDMulti, Label: "The list of all online users", Values: users})
+	return &commands.Command{Status: commands.StatusCompleted, Form: f}, nil
+}
+
+func announceForm() *form.Form {
+	f := adminForm("Making an Announcement", "Fill out this form to make an announcement to all active users of this service.")
+	f.AddField(form.Field{Var: "subject", Type: form.FieldTextSingle, Label: "Subject"})
+	f.AddField(form.Field{Var: "announcement", Type: form.FieldTextMulti, Label: "Announcement", Required: true})
+	return f
+}
+
+// announcementText returns the subject and the body of the announcement
+// in f.
+func announcementText(f *form.Form) (string, string, error) {
+	var body string
+	if field := f.GetField("announcement"); field != nil {
+		body = strings.Join(field.Values, "\n")
+	}
+	if strings.TrimSpace(body) == "" {
+		return "", "", stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "announcement required")
+	}
+	return f.GetValue("subject"), body, nil
+}
+
+// announce sends a headline from the server to every online session.
+func (a *adminCommands) announce(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	subject, body, err := announcementText(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	n := globalAnnouncements.online(ctx, subject, body)
+	return commands.Completed(fmt.Sprintf("Sent the announcement to %d sessions.", n)), nil
+}
+
+// announceAll sends a headline from the server to every account, kept
+// offline for those without a session.
+func (a *adminCommands) announceAll(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	subject, body, err := announcementText(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	n, err := globalAnnouncements.all(ctx, subject, body)
+	if errors.Is(err, errCannotListUsers) {
+		return nil, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorFeatureNotImplemented, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return commands.Completed(fmt.Sprintf("Sent the announcement to %d users.", n)), nil
+}
+
+// motdForm returns the builder of the form asking for the message of the
+// day, filled with the current one when editing.
+func motdForm(edit bool) func() *form.Form {
+	return func() *form.Form {
+		field := form.Field{Var: "motd", Type: form.FieldTextMulti, Label: "Message of the Day", Required: true}
+		if !edit {
+			f := adminForm("Setting the Message of the Day", "Fill out this form to set the message of the day.")
+			f.AddField(field)
+			return f
+		}
+		if motd := globalAnnouncements.messageOfTheDay(); motd != "" {
+			field.Values = strings.Split(motd, "\n")
+		}
+		f := adminForm("Editing the Message of the Day", "Fill out this form to edit the message of the day.")
+		f.AddField(field)
+		return f
+	}
+}
+
+// setMOTD sets the message of the day and sends it to every online
+// session; later ones receive it with their initial presence.
+func (a *adminCommands) setMOTD(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	motd, err := motdText(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	globalAnnouncements.setMOTD(motd)
+	n := globalAnnouncements.online(ctx, "", motd)
+	return commands.Completed(fmt.Sprintf("Set the message of the day and sent it to %d sessions.", n)), nil
+}
+
+// editMOTD replaces the message of the day without sending it to the
+// sessions that already received one.
+func (a *adminCommands) editMOTD(_ context.Context, req commands.Request) (*commands.Command, error) {
+	motd, err := motdText(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	globalAnnouncements.setMOTD(motd)
+	return commands.Completed("Changed the message of the day."), nil
+}
+
+// deleteMOTD removes the message of the day in a single stage.
+func (a *adminCommands) deleteMOTD(context.Context, commands.Request) (*commands.Command, error) {
+	globalAnnouncements.setMOTD("")
+	return commands.Completed("Deleted the message of the day."), nil
+}
+
+func motdText(f *form.Form) (string, error) {
+	var motd string
+	if field := f.GetField("motd"); field != nil {
+		motd = strings.Join(field.Values, "\n")
+	}
+	if strings.TrimSpace(motd) == "" {
+		return "", stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "message of the day required")
+	}
+	return motd, nil
+}
+
+// listSharedGroups reports every shared roster group with its members in a
+// single stage.
+func (a *adminCommands) listSharedGroups(ctx context.Context, _ commands.Request) (*commands.Command, error) {
+	groups, err := globalSharedGroups.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f := form.NewForm(form.TypeResult, "Shared Roster Groups")
+	f.Reported = &form.Reported{Fields: []form.Field{
+		{Var: "name", Type: form.FieldTextSingle, Label: "Name"},
+		{Var: "display", Type: form.FieldTextSingle, Label: "Roster group"},
+		{Var: "accountjids", Type: form.FieldJIDMulti, Label: "Members"},
+	}}
+	for _, g := range groups {
+		f.Items = append(f.Items, form.FormItem{Fields: []form.Field{
+			{Var: "name", Values: []string{g.Name}},
+			{Var: "display", Values: []string{g.RosterGroup()}},
+			{Var: "accountjids", Values: g.Members},
+		}})
+	}
+	return &commands.Command{Status: commands.StatusCompleted, Form: f}, nil
+}
+
+func setSharedGroupForm() *form.Form {
+	f := adminForm("Setting a Shared Roster Group", "Fill out this form to create a shared roster group or replace its members.")
+	f.AddField(form.Field{Var: "name", Type: form.FieldTextSingle, Label: "The name of the group", Required: true})
+	f.AddField(form.Field{Var: "display", Type: form.FieldTextSingle, Label: "The roster group members see each other in, if not the name"})
+	f.AddField(form.Field{Var: "accountjids", Type: form.FieldJIDMulti, Label: "The members"})
+	return f
+}
+
+func (a *adminCommands) setSharedGroup(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	var members []string
+	if field := req.Form.GetField("accountjids"); field != nil {
+		members = field.Values
+	}
+	group, err := globalSharedGroups.set(ctx, req.Form.GetValue("name"), req.Form.GetValue("display"), members)
+	if err != nil {
+		return nil, sharedGroupError(err)
+	}
+	return commands.Completed(fmt.Sprintf("Set %s with %d members.", group.Name, len(group.Members))), nil
+}
+
+func deleteSharedGroupForm() *form.Form {
+	f := adminForm("Deleting a Shared Roster Group", "Fill out this form to delete a shared roster group.")
+	f.AddField(form.Field{Var: "name", Type: form.FieldTextSingle, Label: "The name of the group", Required: true})
+	return f
+}
+
+func (a *adminCommands) deleteSharedGroup(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	name := req.Form.GetValue("name")
+	if err := globalSharedGroups.delete(ctx, name); err != nil {
+		return nil, sharedGroupError(err)
+	}
+	return commands.Completed("Deleted " + name + "."), nil
+}
+
+// sharedGroupMembersForm returns the builder of a form asking for a group
+// and accountjids.
+func sharedGroupMembersForm(title, label string) func() *form.Form {
+	return func() *form.Form {
+		f := adminForm(title, "Fill out this form to "+strings.ToLower(title)+".")
+		f.AddField(form.Field{Var: "name", Type: form.FieldTextSingle, Label: "The name of the group", Required: true})
+		f.AddField(form.Field{Var: "accountjids", Type: form.FieldJIDMulti, Label: label, Required: true})
+		return f
+	}
+}
+
+func (a *adminCommands) addSharedGroupMembers(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	return a.changeSharedGroupMembers(ctx, req, "Added", globalSharedGroups.addMember)
+}
+
+func (a *adminCommands) removeSharedGroupMembers(ctx context.Context, req commands.Request) (*commands.Command, error) {
+	return a.changeSharedGroupMembers(ctx, req, "Removed", globalSharedGroups.removeMember)
+}
+
+// changeSharedGroupMembers applies change to the group and each of the
+// accountjids of a submitted form.
+func (a *adminCommands) changeSharedGroupMembers(ctx context.Context, req commands.Request, done string, change func(context.Context, string, string) error) (*commands.Command, error) {
+	accounts, err := a.accounts(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	name := req.Form.GetValue("name")
+	var changed []string
+	for _, account := range accounts {
+		account = account.Bare()
+		if err := change(ctx, name, account.String()); err != nil {
+			return nil, sharedGroupError(err)
+		}
+		changed = append(changed, account.String())
+	}
+	return summary(done, changed, "", nil), nil
+}
+
+// sharedGroupError returns the stanza error for an error of the shared
+// group service.
+func sharedGroupError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such group")
+	case errors.Is(err, errInvalidGroupName), errors.Is(err, errInvalidMember):
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/commands"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupCommands installs the admin commands with alice as the
+// administrator for the duration of t.
+func setupCommands(t *testing.T) storage.Storage {
+	t.Helper()
+	store := memory.New()
+	cfg := Config{Domain: "example.com", Admins: []string{"alice@example.com"}}
+	cfg.Registration.Iterations = 4096
+	old, oldAnnouncements, oldSharedGroups := globalCommands, globalAnnouncements, globalSharedGroups
+	globalCommands = newCommandService(cfg, store)
+	globalAnnouncements = newAnnouncementService(cfg, store)
+	globalSharedGroups = newSharedGroupService(cfg, store)
+	t.Cleanup(func() {
+		globalCommands, globalAnnouncements, globalSharedGroups = old, oldAnnouncements, oldSharedGroups
+	})
+	return store
+}
+
+// execute runs a command on the server, submitting fields to the form of
+// its first stage, and returns the reply of the last one.
+func (p *orderedPeer) execute(t *testing.T, node string, fields map[string][]string) *stanza.IQ {
+	t.Helper()
+	reply := p.request(t, stanza.IQSet, "example.com", `<command xmlns='`+ns.Commands+`' node='`+node+`' action='execute'/>`)
+	if reply.Type != stanza.IQResult {
+		return reply
+	}
+	first := commandOf(t, reply)
+	if first.Status != commands.StatusExecuting || first.Form == nil {
+		t.Fatalf("%s: first stage %+v", node, first)
+	}
+	submit := form.NewForm(form.TypeSubmit, "")
+	submit.AddField(form.Field{Var: "FORM_TYPE", Values: []string{ns.Admin}})
+	for name, values := range fields {
+		if first.Form.GetField(name) == nil {
+			t.Fatalf("%s: form has no field %q", node, name)
+		}
+		submit.AddField(form.Field{Var: name, Values: values})
+	}
+	payload, err := xml.Marshal(commands.Command{Node: node, SessionID: first.SessionID, Action: commands.ActionComplete, Form: submit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ask(t, stanza.IQSet, "example.com", string(payload))
+	// An announcement reaches the administrator before the reply.
+	for {
+		if iq, ok := p.next(t).(*stanza.IQ); ok {
+			return iq
+		}
+	}
+}
+
+func commandOf(t *testing.T, iq *stanza.IQ) commands.Command {
+	t.Helper()
+	if iq.Type != stanza.IQResult {
+		t.Fatalf("command failed: %+v", iq.Error)
+	}
+	var cmd commands.Command
+	if err := xml.Unmarshal(iq.Query, &cmd); err != nil {
+		t.Fatalf("command reply %s: %v", iq.Query, err)
+	}
+	return cmd
+}
+
+func TestAdminCommandsDisco(t *testing.T) {
+	setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	query := `<query xmlns='` + ns.DiscoItems + `' node='` + ns.Commands + `'/>`
+
+	var items disco.ItemsQuery
+	if err := xml.Unmarshal(alice.request(t, stanza.IQGet, "example.com", query).Query, &items); err != nil {
+		t.Fatal(err)
+	}
+	var nodes []string
+	for _, item := range items.Items {
+		if item.JID != "example.com" {
+			t.Fatalf("item %+v", item)
+		}
+		nodes = append(nodes, item.Node)
+	}
+	want := []string{adminAddUser, adminAnnounce, adminDeleteMOTD, adminDeleteUser, adminEditMOTD, adminEndUserSession, adminOnlineUsers, adminSetMOTD,
+		adminAddSharedGroupMembers, adminAnnounceAll, adminDeleteSharedGroup, adminEraseUserData, adminExportUserData, adminListSharedGroups, adminRemoveSharedGroupMembers, adminSetSharedGroup}
+	if strings.Join(nodes, " ") != strings.Join(want, " ") {
+		t.Fatalf("nodes = %v", nodes)
+	}
+
+	// Others see no commands and cannot execute them.
+	items = disco.ItemsQuery{}
+	if err := xml.Unmarshal(bob.request(t, stanza.IQGet, "", query).Query, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 0 {
+		t.Fatalf("bob sees %+v", items.Items)
+	}
+	if reply := bob.execute(t, adminOnlineUsers, nil); reply.Type != stanza.IQError || !strings.Contains(string(reply.Query), "<forbidden") {
+		t.Fatalf("bob executed a command: %+v", reply)
+	}
+
+	reply := alice.request(t, stanza.IQGet, "example.com", `<query xmlns='`+ns.DiscoInfo+`' node='`+adminAddUser+`'/>`)
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(reply.Query, &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Identities) != 1 || info.Identities[0].Category != "automation" {
+		t.Fatalf("info = %+v", info)
+	}
+}
+
+func TestAdminCommandsUsers(t *testing.T) {
+	ctx := context.Background()
+	store := setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+
+	cmd := commandOf(t, alice.execute(t, adminAddUser, map[string][]string{
+		"accountjid":      {"carol@example.com"},
+		"password":        {"pencil"},
+		"password-verify": {"pencil"},
+	}))
+	if cmd.Status != commands.StatusCompleted || cmd.Note == nil {
+		t.Fatalf("add-user = %+v", cmd)
+	}
+	if err := verifyPassword(ctx, store.UserStore(), "carol", "pencil"); err != nil {
+		t.Fatalf("added user cannot authenticate: %v", err)
+	}
+	for _, fields := range []map[string][]string{
+		{"accountjid": {"carol@example.com"}, "password": {"x"}, "password-verify": {"x"}},
+		{"accountjid": {"dave@example.com"}, "password": {"x"}, "password-verify": {"y"}},
+		{"accountjid": {"dave@elsewhere.example"}, "password": {"x"}, "password-verify": {"x"}},
+	} {
+		if reply := alice.execute(t, adminAddUser, fields); reply.Type != stanza.IQError {
+			t.Fatalf("add-user %v succeeded", fields)
+		}
+	}
+
+	_, out := tcpPeer(t, "carol@example.com/laptop")
+	cmd = commandOf(t, alice.execute(t, adminDeleteUser, map[string][]string{"accountjids": {"carol@example.com", "nobody@example.com"}}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Deleted carol@example.com") || !strings.Contains(cmd.Note.Value, "nobody@example.com") {
+		t.Fatalf("delete-user = %+v", cmd.Note)
+	}
+	if exists, _ := store.UserStore().UserExists(ctx, "carol"); exists {
+		t.Fatal("user was not deleted")
+	}
+	if data := receiveClosed(t, out); !strings.Contains(data, "<not-authorized") {
+		t.Fatalf("deleted user's session received %q", data)
+	}
+}
+
+func TestAdminCommandsUserData(t *testing.T) {
+	ctx := context.Background()
+	store := setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	if err := store.UserStore().CreateUser(ctx, &storage.User{Username: "carol", Password: "pencil"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VCardStore().SetVCard(ctx, "carol@example.com", []byte("<vCard xmlns='vcard-temp'><FN>Carol</FN></vCard>")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := commandOf(t, alice.execute(t, adminExportUserData, map[string][]string{"accountjid": {"carol@example.com"}, "format": {"xml"}}))
+	if cmd.Status != commands.StatusCompleted || cmd.Form == nil {
+		t.Fatalf("export-user-data = %+v", cmd)
+	}
+	export := strings.Join(cmd.Form.GetValues("userdata"), "\n")
+	if !strings.Contains(export, "<FN>Carol</FN>") || !strings.Contains(export, `jid="carol@example.com"`) {
+		t.Fatalf("export = %s", export)
+	}
+	if reply := alice.execute(t, adminExportUserData, map[string][]string{"accountjid": {"carol@example.com"}, "format": {"csv"}}); reply.Type != stanza.IQError {
+		t.Fatal("export in an unknown format succeeded")
+	}
+
+	_, out := tcpPeer(t, "carol@example.com/laptop")
+	cmd = commandOf(t, alice.execute(t, adminEraseUserData, map[string][]string{"accountjids": {"carol@example.com"}}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Erased carol@example.com") {
+		t.Fatalf("erase-user-data = %+v", cmd.Note)
+	}
+	if data := receiveClosed(t, out); !strings.Contains(data, "<not-authorized") {
+		t.Fatalf("erased user's session received %q", data)
+	}
+	if exists, _ := store.UserStore().UserExists(ctx, "carol"); exists {
+		t.Fatal("user was not deleted")
+	}
+	if _, err := store.VCardStore().GetVCard(ctx, "carol@example.com"); err == nil {
+		t.Fatal("vCard was not deleted")
+	}
+}
+
+func TestAdminCommandsSharedGroups(t *testing.T) {
+	ctx := context.Background()
+	store := setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+
+	cmd := commandOf(t, alice.execute(t, adminSetSharedGroup, map[string][]string{
+		"name":        {"staff"},
+		"display":     {"Staff"},
+		"accountjids": {"bob@example.com", "carol@example.com"},
+	}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Set staff with 2 members") {
+		t.Fatalf("set-shared-group = %+v", cmd.Note)
+	}
+	if reply := alice.execute(t, adminSetSharedGroup, map[string][]string{"name": {"remote"}, "accountjids": {"dave@elsewhere.example"}}); reply.Type != stanza.IQError {
+		t.Fatal("set-shared-group with a remote member succeeded")
+	}
+
+	cmd = commandOf(t, alice.execute(t, adminAddSharedGroupMembers, map[string][]string{"name": {"staff"}, "accountjids": {"dave@example.com"}}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Added dave@example.com") {
+		t.Fatalf("add-shared-group-members = %+v", cmd.Note)
+	}
+	cmd = commandOf(t, alice.execute(t, adminRemoveSharedGroupMembers, map[string][]string{"name": {"staff"}, "accountjids": {"bob@example.com"}}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Removed bob@example.com") {
+		t.Fatalf("remove-shared-group-members = %+v", cmd.Note)
+	}
+	if reply := alice.execute(t, adminAddSharedGroupMembers, map[string][]string{"name": {"nope"}, "accountjids": {"bob@example.com"}}); reply.Type != stanza.IQError || !strings.Contains(string(reply.Query), "<item-not-found") {
+		t.Fatalf("add-shared-group-members to a missing group = %+v", reply)
+	}
+
+	cmd = commandOf(t, alice.request(t, stanza.IQSet, "example.com", `<command xmlns='`+ns.Commands+`' node='`+adminListSharedGroups+`' action='execute'/>`))
+	if cmd.Status != commands.StatusCompleted || cmd.Form == nil || len(cmd.Form.Items) != 1 {
+		t.Fatalf("list-shared-groups = %+v", cmd)
+	}
+	var members []string
+	for _, field := range cmd.Form.Items[0].Fields {
+		if field.Var == "accountjids" {
+			members = field.Values
+		}
+	}
+	if strings.Join(members, " ") != "carol@example.com dave@example.com" {
+		t.Fatalf("members = %v", members)
+	}
+
+	cmd = commandOf(t, alice.execute(t, adminDeleteSharedGroup, map[string][]string{"name": {"staff"}}))
+	if cmd.Note == nil || !strings.Contains(cmd.Note.Value, "Deleted staff") {
+		t.Fatalf("delete-shared-group = %+v", cmd.Note)
+	}
+	if groups, err := store.SharedGroupStore().ListSharedGroups(ctx); err != nil || len(groups) != 0 {
+		t.Fatalf("groups after delete = %v, %v", groups, err)
+	}
+}
+
+func TestAdminCommandsSessions(t *testing.T) {
+	setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	newOrderedPeer(t, "bob@example.com/laptop")
+	_, carolOut := tcpPeer(t, "carol@example.com/phone")
+
+	cmd := commandOf(t, alice.execute(t, adminOnlineUsers, map[string][]string{"max_items": {"none"}}))
+	if cmd.Form == nil || cmd.Form.Type != form.TypeResult {
+		t.Fatalf("get-online-users-list = %+v", cmd)
+	}
+	users := cmd.Form.GetField("onlineuserjids").Values
+	if strings.Join(users, ",") != "alice@example.com,bob@example.com,carol@example.com" {
+		t.Fatalf("online users = %v", users)
+	}
+
+	cmd = commandOf(t, alice.execute(t, adminAnnounce, map[string][]string{"subject": {"Maintenance"}, "announcement": {"Back soon", "at 10:00"}}))
+	if cmd.Status != commands.StatusCompleted {
+		t.Fatalf("announce = %+v", cmd)
+	}
+	msg := bob.message(t)
+	if msg.Type != stanza.MessageHeadline || msg.From.String() != "example.com" || msg.Body() != "Back soon\nat 10:00" || msg.Subject() != "Maintenance" {
+		t.Fatalf("announcement = %+v", msg)
+	}
+
+	commandOf(t, alice.execute(t, adminEndUserSession, map[string][]string{"accountjids": {"carol@example.com"}}))
+	if data := receiveClosed(t, carolOut); !strings.Contains(data, "<policy-violation") {
+		t.Fatalf("carol received %q", data)
+	}
+	if len(globalRouter.targets(jid.MustParse("carol@example.com"))) != 0 {
+		t.Fatal("ended session is still routed")
+	}
+}
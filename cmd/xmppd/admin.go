@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	xmpp "github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// adminAPI serves the admin HTTP API. Every request must carry the
+// configured token as a bearer token.
+type adminAPI struct {
+	cfg   Config
+	store storage.Storage
+	cert  *certificate
+	mux   *http.ServeMux
+}
+
+// newAdminAPI returns the admin API over store. cert is the certificate
+// reloaded by POST /admin/tls/reload; it is nil without TLS.
+func newAdminAPI(cfg Config, store storage.Storage, cert *certificate) *adminAPI {
+	a := &adminAPI{cfg: cfg, store: store, cert: cert, mux: http.NewServeMux()}
+	a.mux.HandleFunc("GET /admin/users", a.listUsers)
+	a.mux.HandleFunc("POST /admin/users", a.createUser)
+	a.mux.HandleFunc("DELETE /admin/users/{username}", a.deleteUser)
+	a.mux.HandleFunc("GET /admin/users/{username}/export", a.exportUser)
+	a.mux.HandleFunc("DELETE /admin/users/{username}/data", a.eraseUser)
+	a.mux.HandleFunc("GET /admin/sessions", a.listSessions)
+	a.mux.HandleFunc("DELETE /admin/sessions/{jid}", a.disconnectSessions)
+	a.mux.HandleFunc("GET /admin/muc/rooms", a.listRooms)
+	a.mux.HandleFunc("GET /admin/muc/rooms/{room}", a.getRoom)
+	a.mux.HandleFunc("GET /admin/proxy", a.proxyStats)
+	a.mux.HandleFunc("POST /admin/announcements", a.announce)
+	a.mux.HandleFunc("GET /admin/motd", a.getMOTD)
+	a.mux.HandleFunc("PUT /admin/motd", a.setMOTD)
+	a.mux.HandleFunc("DELETE /admin/motd", a.deleteMOTD)
+	a.mux.HandleFunc("GET /admin/shared-groups", a.listSharedGroups)
+	a.mux.HandleFunc("PUT /admin/shared-groups/{name}", a.setSharedGroup)
+	a.mux.HandleFunc("DELETE /admin/shared-groups/{name}", a.deleteSharedGroup)
+	a.mux.HandleFunc("PUT /admin/shared-groups/{name}/members/{jid}", a.addSharedGroupMember)
+	a.mux.HandleFunc("DELETE /admin/shared-groups/{name}/members/{jid}", a.removeSharedGroupMember)
+	a.mux.HandleFunc("POST /admin/tls/reload", a.reloadTLS)
+	return a
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="xmppd"`)
+		adminError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+type adminSession struct {
+	JID      string `json:"jid"`
+	Resource string `json:"resource"`
+	ID       string `json:"id"`
+	IP       string `json:"ip,omitempty"`
+}
+
+type adminRoom struct {
+	JID         string          `json:"jid"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Subject     string          `json:"subject,omitempty"`
+	Public      bool            `json:"public"`
+	Persistent  bool            `json:"persistent"`
+	Active      bool            `json:"active"`
+	Occupants   []adminOccupant `json:"occupants"`
+}
+
+type adminOccupant struct {
+	Nick        string `json:"nick"`
+	JID         string `json:"jid"`
+	Role        string `json:"role"`
+	Affiliation string `json:"affiliation"`
+}
+
+type adminSharedGroup struct {
+	Name    string   `json:"name"`
+	Display string   `json:"display,omitempty"`
+	Members []string `json:"members"`
+}
+
+func newAdminSharedGroup(g *storage.SharedGroup) adminSharedGroup {
+	members := g.Members
+	if members == nil {
+		members = []string{}
+	}
+	return adminSharedGroup{Name: g.Name, Display: g.Display, Members: members}
+}
+
+func (a *adminAPI) users() (storage.UserStore, bool) {
+	if a.store == nil || a.store.UserStore() == nil {
+		return nil, false
+	}
+	return a.store.UserStore(), true
+}
+
+func (a *adminAPI) listUsers(w http.ResponseWriter, r *http.Request) {
+	us, ok := a.users()
+	lister, listable := us.(storage.UserLister)
+	if !ok || !listable {
+		adminError(w, http.StatusNotImplemented, "storage cannot list users")
+		return
+	}
+	names, err := lister.ListUsers(r.Context())
+	if err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"users": names})
+}
+
+func (a *adminAPI) createUser(w http.ResponseWriter, r *http.Request) {
+	us, ok := a.users()
+	if !ok {
+		adminError(w, http.StatusNotImplemented, "storage does not support users")
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		adminError(w, http.StatusBadRequest, "username and password required")
+		return
+	}
+	addr, err := jid.New(req.Username, a.cfg.Domain, "")
+	if err != nil || addr.Local() != req.Username {
+		adminError(w, http.StatusBadRequest, "invalid username")
+		return
+	}
+	user, err := newUser(req.Username, req.Password, a.cfg.Registration.Iterations, a.cfg.Registration.KeepPlaintext)
+	if err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	switch err := us.CreateUser(r.Context(), user); {
+	case errors.Is(err, storage.ErrUserExists):
+		adminError(w, http.StatusConflict, "user exists")
+		return
+	case err != nil:
+		a.internalError(w, r, err)
+		return
+	}
+	adminJSON(w, http.StatusCreated, map[string]any{"jid": addr.String()})
+}
+
+// deleteUser deletes an account and ends its sessions.
+func (a *adminAPI) deleteUser(w http.ResponseWriter, r *http.Request) {
+	us, ok := a.users()
+	if !ok {
+		adminError(w, http.StatusNotImplemented, "storage does not support users")
+		return
+	}
+	username := r.PathValue("username")
+	addr, err := jid.New(username, a.cfg.Domain, "")
+	if err != nil {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	switch err := us.DeleteUser(r.Context(), username); {
+	case errors.Is(err, storage.ErrNotFound):
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	case err != nil:
+		a.internalError(w, r, err)
+		return
+	}
+	disconnect(r.Context(), globalRouter.targets(addr), stream.NewError(stream.ErrNotAuthorized, "account deleted"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exportUser streams everything stored about an account, as JSON or, with
+// ?format=xml, as XML.
+func (a *adminAPI) exportUser(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		adminError(w, http.StatusNotImplemented, "no storage configured")
+		return
+	}
+	addr, err := jid.New(r.PathValue("username"), a.cfg.Domain, "")
+	if err != nil {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	format := storage.ExportFormat(r.URL.Query().Get("format"))
+	contentType := "application/json"
+	switch format {
+	case "", storage.ExportJSON:
+		format = storage.ExportJSON
+	case storage.ExportXML:
+		contentType = "application/xml"
+	default:
+		adminError(w, http.StatusBadRequest, "unknown format")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+addr.Local()+"."+string(format)+`"`)
+	out := &trackingWriter{w: w}
+	if err := exportUserData(r.Context(), a.cfg, a.store, addr, format, out); err != nil {
+		if !out.written {
+			w.Header().Del("Content-Disposition")
+			a.internalError(w, r, err)
+			return
+		}
+		// Too late for an error status: the client gets a truncated
+		// document.
+		logError(r.Context(), "user data export failed", "jid", addr, "error", err)
+	}
+}
+
+// eraseUser deletes an account and everything stored about it, and ends its
+// sessions. Data left behind by an earlier, failed erasure is deleted even
+// if the account is already gone.
+func (a *adminAPI) eraseUser(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		adminError(w, http.StatusNotImplemented, "no storage configured")
+		return
+	}
+	addr, err := jid.New(r.PathValue("username"), a.cfg.Domain, "")
+	if err != nil {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err := eraseUserData(r.Context(), a.cfg, a.store, addr); err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "user data erased", "jid", addr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trackingWriter records whether anything was written through it.
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
+
+func (a *adminAPI) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []adminSession{}
+	for _, session := range globalRouter.all() {
+		addr := session.RemoteAddr()
+		s := adminSession{JID: addr.Bare().String(), Resource: addr.Resource(), ID: session.ID()}
+		if peer := session.Transport().Peer(); peer != nil {
+			s.IP = peerIP(peer.String())
+		}
+		sessions = append(sessions, s)
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"sessions": sessions})
+}
+
+// disconnectSessions ends the session of a full JID, or all sessions of a
+// bare one.
+func (a *adminAPI) disconnectSessions(w http.ResponseWriter, r *http.Request) {
+	addr, err := jid.Parse(r.PathValue("jid"))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid jid")
+		return
+	}
+	sessions := globalRouter.targets(addr)
+	if len(sessions) == 0 {
+		adminError(w, http.StatusNotFound, "no sessions")
+		return
+	}
+	disconnect(r.Context(), sessions, stream.NewError(stream.ErrPolicyViolation, "disconnected by an administrator"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) listRooms(w http.ResponseWriter, r *http.Request) {
+	if globalMUC == nil {
+		adminError(w, http.StatusNotFound, "muc is disabled")
+		return
+	}
+	confs, err := globalMUC.store.ListRooms(r.Context())
+	if err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	rooms := make([]adminRoom, 0, len(confs))
+	for _, conf := range confs {
+		room, err := jid.Parse(conf.RoomJID)
+		if err != nil {
+			continue
+		}
+		if info, err := globalMUC.describe(r.Context(), room); err == nil {
+			rooms = append(rooms, info)
+		}
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"rooms": rooms})
+}
+
+func (a *adminAPI) getRoom(w http.ResponseWriter, r *http.Request) {
+	if globalMUC == nil {
+		adminError(w, http.StatusNotFound, "muc is disabled")
+		return
+	}
+	room, err := jid.Parse(r.PathValue("room"))
+	if err != nil || !globalMUC.serves(room) {
+		adminError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	info, err := globalMUC.describe(r.Context(), room.Bare())
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		adminError(w, http.StatusNotFound, "room not found")
+	case err != nil:
+		a.internalError(w, r, err)
+	default:
+		adminJSON(w, http.StatusOK, info)
+	}
+}
+
+func (a *adminAPI) proxyStats(w http.ResponseWriter, _ *http.Request) {
+	if globalProxy == nil {
+		adminError(w, http.StatusNotFound, "proxy is disabled")
+		return
+	}
+	adminJSON(w, http.StatusOK, globalProxy.proxy.Stats())
+}
+
+// announce sends an announcement to the online sessions or, when all is
+// set, to every account.
+func (a *adminAPI) announce(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+		All     bool   `json:"all"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		adminError(w, http.StatusBadRequest, "body required")
+		return
+	}
+	if !req.All {
+		adminJSON(w, http.StatusOK, map[string]any{"sessions": globalAnnouncements.online(r.Context(), req.Subject, req.Body)})
+		return
+	}
+	n, err := globalAnnouncements.all(r.Context(), req.Subject, req.Body)
+	if errors.Is(err, errCannotListUsers) {
+		adminError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"users": n})
+}
+
+func (a *adminAPI) getMOTD(w http.ResponseWriter, _ *http.Request) {
+	adminJSON(w, http.StatusOK, map[string]string{"motd": globalAnnouncements.messageOfTheDay()})
+}
+
+// setMOTD replaces the message of the day. Unless send is false, it is
+// also sent to the online sessions.
+func (a *adminAPI) setMOTD(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MOTD string `json:"motd"`
+		Send *bool  `json:"send"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.MOTD) == "" {
+		adminError(w, http.StatusBadRequest, "motd required")
+		return
+	}
+	globalAnnouncements.setMOTD(req.MOTD)
+	sessions := 0
+	if req.Send == nil || *req.Send {
+		sessions = globalAnnouncements.online(r.Context(), "", req.MOTD)
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"motd": req.MOTD, "sessions": sessions})
+}
+
+func (a *adminAPI) deleteMOTD(w http.ResponseWriter, _ *http.Request) {
+	globalAnnouncements.setMOTD("")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) reloadTLS(w http.ResponseWriter, r *http.Request) {
+	if a.cert == nil {
+		adminError(w, http.StatusNotFound, "tls is not configured")
+		return
+	}
+	leaf, err := a.cert.reload()
+	if err != nil {
+		logError(r.Context(), "tls reload failed", "error", err)
+		adminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "tls certificate reloaded", "not_after", leaf.NotAfter)
+	adminJSON(w, http.StatusOK, map[string]any{"not_after": leaf.NotAfter.UTC().Format(time.RFC3339)})
+}
+
+func (a *adminAPI) listSharedGroups(w http.ResponseWriter, r *http.Request) {
+	if globalSharedGroups == nil {
+		adminError(w, http.StatusNotImplemented, "storage does not support shared groups")
+		return
+	}
+	groups, err := globalSharedGroups.list(r.Context())
+	if err != nil {
+		a.internalError(w, r, err)
+		return
+	}
+	out := make([]adminSharedGroup, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, newAdminSharedGroup(g))
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"groups": out})
+}
+
+// setSharedGroup creates a shared group or replaces its display name and
+// members.
+func (a *adminAPI) setSharedGroup(w http.ResponseWriter, r *http.Request) {
+	if globalSharedGroups == nil {
+		adminError(w, http.StatusNotImplemented, "storage does not support shared groups")
+		return
+	}
+	var req struct {
+		Display string   `json:"display"`
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	group, err := globalSharedGroups.set(r.Context(), r.PathValue("name"), req.Display, req.Members)
+	if err != nil {
+		a.sharedGroupError(w, r, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, newAdminSharedGroup(group))
+}
+
+func (a *adminAPI) deleteSharedGroup(w http.ResponseWriter, r *http.Request) {
+	a.changeSharedGroup(w, r, func(ctx context.Context, s *sharedGroupService) error {
+		return s.delete(ctx, r.PathValue("name"))
+	})
+}
+
+func (a *adminAPI) addSharedGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.changeSharedGroup(w, r, func(ctx context.Context, s *sharedGroupService) error {
+		return s.addMember(ctx, r.PathValue("name"), r.PathValue("jid"))
+	})
+}
+
+func (a *adminAPI) removeSharedGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.changeSharedGroup(w, r, func(ctx context.Context, s *sharedGroupService) error {
+		return s.removeMember(ctx, r.PathValue("name"), r.PathValue("jid"))
+	})
+}
+
+// changeSharedGroup applies change to the shared groups and answers with no
+// content.
+func (a *adminAPI) changeSharedGroup(w http.ResponseWriter, r *http.Request, change func(context.Context, *sharedGroupService) error) {
+	if globalSharedGroups == nil {
+		adminError(w, http.StatusNotImplemented, "storage does not support shared groups")
+		return
+	}
+	if err := change(r.Context(), globalSharedGroups); err != nil {
+		a.sharedGroupError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) sharedGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		adminError(w, http.StatusNotFound, "group not found")
+	case errors.Is(err, errInvalidGroupName), errors.Is(err, errInvalidMember):
+		adminError(w, http.StatusBadRequest, err.Error())
+	default:
+		a.internalError(w, r, err)
+	}
+}
+
+func (a *adminAPI) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r.Context(), "admin request failed", "path", r.URL.Path, "error", err)
+	adminError(w, http.StatusInternalServerError, "internal error")
+}
+
+// describe returns the configuration of a room and, while it is active,
+// its occupants.
+func (s *mucService) describe(ctx context.Context, roomJID jid.JID) (adminRoom, error) {
+	s.mu.Lock()
+	r := s.rooms[roomJID.String()]
+	s.mu.Unlock()
+
+	info := adminRoom{JID: roomJID.String(), Occupants: []adminOccupant{}}
+	var conf storage.MUCRoom
+	if r != nil {
+		r.mu.Lock()
+		if !r.gone {
+			conf, info.Active = r.conf, true
+			for _, o := range r.occupants {
+				info.Occupants = append(info.Occupants, adminOccupant{
+					Nick:        o.nick,
+					JID:         o.jid.String(),
+					Role:        o.role,
+					Affiliation: o.affiliation,
+				})
+			}
+		}
+		r.mu.Unlock()
+	}
+	if !info.Active {
+		stored, err := s.store.GetRoom(ctx, roomJID.String())
+		if err != nil {
+			return adminRoom{}, err
+		}
+		conf = *stored
+	}
+	slices.SortFunc(info.Occupants, func(a, b adminOccupant) int { return strings.Compare(a.Nick, b.Nick) })
+	info.Name, info.Description, info.Subject = conf.Name, conf.Description, conf.Subject
+	info.Public, info.Persistent = conf.Public, conf.Persistent
+	return info, nil
+}
+
+// disconnect ends the streams of sessions with se.
+func disconnect(ctx context.Context, sessions []*xmpp.Session, se *stream.Error) {
+	for _, session := range sessions {
+		globalRouter.unregister(session.RemoteAddr())
+		globalSM.closed(session)
+		_ = session.SendStreamError(ctx, se)
+		_ = session.Close()
+	}
+}
+
+// peerIP returns the host of a peer address, or addr if it has no port.
+func peerIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveAdmin serves the admin API on addr until ctx is done. Like the
+// metrics, it is served over plain HTTP, so the address should only be
+// reachable from a private network or through a TLS-terminating proxy.
+func serveAdmin(ctx context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
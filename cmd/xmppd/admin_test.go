@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+const testAdminToken = "s3cret"
+
+func newTestAdmin(t *testing.T, store storage.Storage, cert *certificate) *httptest.Server {
+	t.Helper()
+	cfg := Config{Domain: "example.com", AdminToken: testAdminToken}
+	cfg.Registration.Iterations = 4096
+	srv := httptest.NewServer(newAdminAPI(cfg, store, cert))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// adminDo sends an admin request and decodes the JSON response into out,
+// if it is not nil.
+func adminDo(t *testing.T, srv *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// tcpPeer is a session for full on a loopback connection. The returned
+// channel receives everything written to the peer once the session closes.
+func tcpPeer(t *testing.T, full string) (*xmpp.Session, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := jid.MustParse(full)
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(conn), xmpp.WithRemoteAddr(addr))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	out := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		out <- string(data)
+	}()
+	globalRouter.register(addr, session)
+	t.Cleanup(func() {
+		globalRouter.unregister(addr)
+		session.Close()
+		client.Close()
+	})
+	return session, out
+}
+
+func receiveClosed(t *testing.T, out <-chan string) string {
+	t.Helper()
+	select {
+	case data := <-out:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed")
+		return ""
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	srv := newTestAdmin(t, memory.New(), nil)
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testAdminToken, testAdminToken} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/users", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("Authorization %q: status %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	srv := newTestAdmin(t, store, nil)
+
+	for _, name := range []string{"bob", "alice"} {
+		var created struct{ JID string }
+		if code := adminDo(t, srv, http.MethodPost, "/admin/users", `{"username":"`+name+`","password":"pencil"}`, &created); code != http.StatusCreated {
+			t.Fatalf("create %s: status %d", name, code)
+		}
+		if created.JID != name+"@example.com" {
+			t.Fatalf("created %q", created.JID)
+		}
+	}
+	if err := verifyPassword(ctx, store.UserStore(), "alice", "pencil"); err != nil {
+		t.Fatalf("created user cannot authenticate: %v", err)
+	}
+	for body, want := range map[string]int{
+		`{"username":"alice","password":"other"}`: http.StatusConflict,
+		`{"username":"alice"}`:                    http.StatusBadRequest,
+		`{"username":"a@b","password":"pencil"}`:  http.StatusBadRequest,
+		`not json`:                                http.StatusBadRequest,
+	} {
+		if code := adminDo(t, srv, http.MethodPost, "/admin/users", body, nil); code != want {
+			t.Fatalf("create %s: status %d, want %d", body, code, want)
+		}
+	}
+
+	var list struct{ Users []string }
+	if code := adminDo(t, srv, http.MethodGet, "/admin/users", "", &list); code != http.StatusOK {
+		t.Fatalf("list: status %d", code)
+	}
+	if strings.Join(list.Users, ",") != "alice,bob" {
+		t.Fatalf("users = %v", list.Users)
+	}
+
+	// Deleting an account ends its sessions.
+	_, out := tcpPeer(t, "alice@example.com/phone")
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/users/alice", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", code)
+	}
+	if data := receiveClosed(t, out); !strings.Contains(data, "<not-authorized") {
+		t.Fatalf("session received %q", data)
+	}
+	if len(globalRouter.targets(jid.MustParse("alice@example.com"))) != 0 {
+		t.Fatal("deleted user is still routed")
+	}
+	if exists, _ := store.UserStore().UserExists(ctx, "alice"); exists {
+		t.Fatal("user was not deleted")
+	}
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/users/alice", "", nil); code != http.StatusNotFound {
+		t.Fatalf("delete again: status %d", code)
+	}
+}
+
+func TestAdminUserData(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	srv := newTestAdmin(t, store, nil)
+	if err := store.UserStore().CreateUser(ctx, &storage.User{Username: "alice", Password: "pencil"}); err != nil {
+		t.Fatal(err)
+	}
+	item := &storage.RosterItem{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "both"}
+	if err := store.RosterStore().UpsertRosterItem(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	var export struct {
+		JID     string
+		Account struct{ Username string }
+		Roster  struct{ Items []struct{ JID string } }
+	}
+	if code := adminDo(t, srv, http.MethodGet, "/admin/users/alice/export", "", &export); code != http.StatusOK {
+		t.Fatalf("export: status %d", code)
+	}
+	if export.JID != "alice@example.com" || export.Account.Username != "alice" ||
+		len(export.Roster.Items) != 1 || export.Roster.Items[0].JID != "bob@example.com" {
+		t.Fatalf("export = %+v", export)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/users/alice/export?format=xml", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/xml" || !strings.HasPrefix(string(data), "<user-data") {
+		t.Fatalf("xml export: %s %s", resp.Header.Get("Content-Type"), data)
+	}
+	if code := adminDo(t, srv, http.MethodGet, "/admin/users/alice/export?format=csv", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("csv export: status %d", code)
+	}
+
+	_, out := tcpPeer(t, "alice@example.com/phone")
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/users/alice/data", "", nil); code != http.StatusNoContent {
+		t.Fatalf("erase: status %d", code)
+	}
+	if data := receiveClosed(t, out); !strings.Contains(data, "<not-authorized") {
+		t.Fatalf("session received %q", data)
+	}
+	if exists, _ := store.UserStore().UserExists(ctx, "alice"); exists {
+		t.Fatal("user was not deleted")
+	}
+	if items, _ := store.RosterStore().GetRosterItems(ctx, "alice@example.com"); len(items) != 0 {
+		t.Fatalf("roster left: %v", items)
+	}
+	// Erasing is idempotent.
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/users/alice/data", "", nil); code != http.StatusNoContent {
+		t.Fatalf("erase again: status %d", code)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	srv := newTestAdmin(t, memory.New(), nil)
+	phone, phoneOut := tcpPeer(t, "alice@example.com/phone")
+	tcpPeer(t, "alice@example.com/laptop")
+	tcpPeer(t, "bob@example.com/desk")
+
+	var list struct{ Sessions []adminSession }
+	if code := adminDo(t, srv, http.MethodGet, "/admin/sessions", "", &list); code != http.StatusOK {
+		t.Fatalf("list: status %d", code)
+	}
+	var got []string
+	for _, s := range list.Sessions {
+		if s.IP != "127.0.0.1" || s.ID == "" {
+			t.Fatalf("session %+v", s)
+		}
+		got = append(got, s.JID+"/"+s.Resource)
+	}
+	if strings.Join(got, ",") != "alice@example.com/laptop,alice@example.com/phone,bob@example.com/desk" {
+		t.Fatalf("sessions = %v", got)
+	}
+	if list.Sessions[1].ID != phone.ID() {
+		t.Fatalf("phone session ID = %q, want %q", list.Sessions[1].ID, phone.ID())
+	}
+
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/sessions/alice@example.com%2Fphone", "", nil); code != http.StatusNoContent {
+		t.Fatalf("disconnect: status %d", code)
+	}
+	if data := receiveClosed(t, phoneOut); !strings.Contains(data, "<policy-violation") {
+		t.Fatalf("session received %q", data)
+	}
+	if n := len(globalRouter.targets(jid.MustParse("alice@example.com"))); n != 1 {
+		t.Fatalf("alice has %d sessions left, want 1", n)
+	}
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/sessions/carol@example.com", "", nil); code != http.StatusNotFound {
+		t.Fatalf("disconnect carol: status %d", code)
+	}
+}
+
+func TestAdminAnnouncements(t *testing.T) {
+	store := memory.New()
+	srv := newTestAdmin(t, store, nil)
+	setupAnnouncements(t, store, "")
+	_, msgs := messagePeer(t, "alice@example.com/phone")
+
+	var sent struct{ Sessions int }
+	if code := adminDo(t, srv, http.MethodPost, "/admin/announcements", `{"subject":"Hi","body":"Restarting"}`, &sent); code != http.StatusOK || sent.Sessions != 1 {
+		t.Fatalf("announce: status %d, %+v", code, sent)
+	}
+	if msg := receiveMessage(t, msgs); msg.Body() != "Restarting" || msg.Subject() != "Hi" {
+		t.Fatalf("announcement = %+v", msg)
+	}
+	if code := adminDo(t, srv, http.MethodPost, "/admin/announcements", `{"body":" "}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("empty announcement: status %d", code)
+	}
+
+	if code := adminDo(t, srv, http.MethodPut, "/admin/motd", `{"motd":"Hello","send":false}`, nil); code != http.StatusOK {
+		t.Fatalf("set motd: status %d", code)
+	}
+	expectNoMessage(t, msgs)
+	var got struct{ MOTD string }
+	if code := adminDo(t, srv, http.MethodGet, "/admin/motd", "", &got); code != http.StatusOK || got.MOTD != "Hello" {
+		t.Fatalf("get motd: status %d, %+v", code, got)
+	}
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/motd", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete motd: status %d", code)
+	}
+	if motd := globalAnnouncements.messageOfTheDay(); motd != "" {
+		t.Fatalf("motd after delete = %q", motd)
+	}
+}
+
+func TestAdminMUCRooms(t *testing.T) {
+	setupMUC(t)
+	srv := newTestAdmin(t, memory.New(), nil)
+	openRoom(t, `<field var='muc#roomconfig_roomname'><value>The Lounge</value></field>`)
+
+	var list struct{ Rooms []adminRoom }
+	if code := adminDo(t, srv, http.MethodGet, "/admin/muc/rooms", "", &list); code != http.StatusOK {
+		t.Fatalf("list: status %d", code)
+	}
+	if len(list.Rooms) != 1 || list.Rooms[0].JID != testRoom || list.Rooms[0].Name != "The Lounge" || !list.Rooms[0].Active {
+		t.Fatalf("rooms = %+v", list.Rooms)
+	}
+
+	var room adminRoom
+	if code := adminDo(t, srv, http.MethodGet, "/admin/muc/rooms/"+testRoom, "", &room); code != http.StatusOK {
+		t.Fatalf("get: status %d", code)
+	}
+	want := adminOccupant{Nick: "alice", JID: "alice@example.com/phone", Role: "moderator", Affiliation: "owner"}
+	if len(room.Occupants) != 1 || room.Occupants[0] != want {
+		t.Fatalf("occupants = %+v", room.Occupants)
+	}
+	for _, path := range []string{"/admin/muc/rooms/empty@conference.example.com", "/admin/muc/rooms/lounge@example.com"} {
+		if code := adminDo(t, srv, http.MethodGet, path, "", nil); code != http.StatusNotFound {
+			t.Fatalf("get %s: status %d", path, code)
+		}
+	}
+}
+
+func TestAdminSharedGroups(t *testing.T) {
+	store := setupSharedGroups(t)
+	srv := newTestAdmin(t, store, nil)
+
+	for body, want := range map[string]int{
+		`{"members":["alice@example.com","bob@elsewhere.example"]}`: http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if code := adminDo(t, srv, http.MethodPut, "/admin/shared-groups/staff", body, nil); code != want {
+			t.Fatalf("set %s: status %d, want %d", body, code, want)
+		}
+	}
+	var group adminSharedGroup
+	if code := adminDo(t, srv, http.MethodPut, "/admin/shared-groups/staff", `{"display":"Staff","members":["bob@example.com","alice@example.com"]}`, &group); code != http.StatusOK {
+		t.Fatalf("set: status %d", code)
+	}
+	if group.Name != "staff" || group.Display != "Staff" || strings.Join(group.Members, ",") != "alice@example.com,bob@example.com" {
+		t.Fatalf("group = %+v", group)
+	}
+
+	if code := adminDo(t, srv, http.MethodPut, "/admin/shared-groups/staff/members/carol@example.com", "", nil); code != http.StatusNoContent {
+		t.Fatalf("add member: status %d", code)
+	}
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/shared-groups/staff/members/bob@example.com", "", nil); code != http.StatusNoContent {
+		t.Fatalf("remove member: status %d", code)
+	}
+	if code := adminDo(t, srv, http.MethodPut, "/admin/shared-groups/nope/members/carol@example.com", "", nil); code != http.StatusNotFound {
+		t.Fatalf("add member to a missing group: status %d", code)
+	}
+	var list struct{ Groups []adminSharedGroup }
+	if code := adminDo(t, srv, http.MethodGet, "/admin/shared-groups", "", &list); code != http.StatusOK {
+		t.Fatalf("list: status %d", code)
+	}
+	if len(list.Groups) != 1 || strings.Join(list.Groups[0].Members, ",") != "alice@example.com,carol@example.com" {
+		t.Fatalf("groups = %+v", list.Groups)
+	}
+
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/shared-groups/staff", "", nil); code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", code)
+	}
+	if code := adminDo(t, srv, http.MethodDelete, "/admin/shared-groups/staff", "", nil); code != http.StatusNotFound {
+		t.Fatalf("delete again: status %d", code)
+	}
+}
+
+func TestAdminReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, err := ensureSelfSigned(Config{Domain: "old.example", TLSSelfSignedDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, cert, err := buildTLSConfig(context.Background(), Config{TLSCert: certPath, TLSKey: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestAdmin(t, memory.New(), cert)
+
+	next := filepath.Join(t.TempDir(), "next")
+	newCert, newKey, err := ensureSelfSigned(Config{Domain: "new.example", TLSSelfSignedDir: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for src, dst := range map[string]string{newCert: certPath, newKey: keyPath} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reloaded struct {
+		NotAfter string `json:"not_after"`
+	}
+	if code := adminDo(t, srv, http.MethodPost, "/admin/tls/reload", "", &reloaded); code != http.StatusOK {
+		t.Fatalf("reload: status %d", code)
+	}
+	if _, err := time.Parse(time.RFC3339, reloaded.NotAfter); err != nil {
+		t.Fatalf("not_after %q: %v", reloaded.NotAfter, err)
+	}
+	served, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := served.Leaf.Subject.CommonName; cn != "new.example" {
+		t.Fatalf("served certificate for %q after reload", cn)
+	}
+
+	// A broken certificate keeps the old one in use.
+	if err := os.WriteFile(certPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := adminDo(t, srv, http.MethodPost, "/admin/tls/reload", "", nil); code != http.StatusUnprocessableEntity {
+		t.Fatalf("reload broken: status %d", code)
+	}
+	if served, _ := tlsConfig.GetCertificate(&tls.ClientHelloInfo{}); served.Leaf.Subject.CommonName != "new.example" {
+		t.Fatal("broken reload replaced the certificate")
+	}
+
+	if code := adminDo(t, newTestAdmin(t, memory.New(), nil), http.MethodPost, "/admin/tls/reload", "", nil); code != http.StatusNotFound {
+		t.Fatalf("reload without tls: status %d", code)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalAnnouncements sends the announcements of the administrators and
+// holds the message of the day, which every resource receives with its
+// initial presence. The MOTD starts as XMPP_MOTD and is changed with the
+// ad-hoc commands or the admin API until the server restarts.
+var globalAnnouncements *announcementService
+
+// errCannotListUsers is returned when announcing to every account with a
+// storage that cannot list them.
+var errCannotListUsers = errors.New("storage cannot list users")
+
+type announcementService struct {
+	domain string
+	store  storage.Storage
+
+	mu   sync.Mutex
+	motd string
+}
+
+func newAnnouncementService(cfg Config, store storage.Storage) *announcementService {
+	return &announcementService{domain: cfg.Domain, store: store, motd: cfg.MOTD}
+}
+
+// announcement returns a headline from the server to to.
+func (s *announcementService) announcement(to jid.JID, subject, body string) *stanza.Message {
+	msg := stanza.NewMessage(stanza.MessageHeadline)
+	msg.From = jid.MustParse(s.domain)
+	msg.To = to
+	if subject != "" {
+		msg.SetSubject(subject)
+	}
+	msg.SetBody(body)
+	return msg
+}
+
+// online sends an announcement to every session of this node and returns
+// how many it was sent to.
+func (s *announcementService) online(ctx context.Context, subject, body string) int {
+	sessions := globalRouter.all()
+	for _, session := range sessions {
+		msg := s.announcement(session.RemoteAddr(), subject, body)
+		if err := session.Send(ctx, msg); err != nil {
+			logError(ctx, "announce error", "to", msg.To, "error", err)
+		}
+	}
+	return len(sessions)
+}
+
+// all sends an announcement to every account and returns how many it was
+// sent to. Accounts without a session receive it from offline storage
+// once they are back, whatever the policy for other headlines.
+func (s *announcementService) all(ctx context.Context, subject, body string) (int, error) {
+	if s.store == nil {
+		return 0, errCannotListUsers
+	}
+	lister, ok := s.store.UserStore().(storage.UserLister)
+	if !ok {
+		return 0, errCannotListUsers
+	}
+	users, err := lister.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	store, err := stanza.NewExtension(hints.Store{})
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, user := range users {
+		to, err := jid.New(user, s.domain, "")
+		if err != nil {
+			continue
+		}
+		msg := s.announcement(to, subject, body)
+		msg.Extensions = append(msg.Extensions, store)
+		if err := deliverMessage(ctx, msg); err != nil {
+			logError(ctx, "announce error", "to", to, "error", err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// messageOfTheDay returns the message of the day, empty when there is none.
+func (s *announcementService) messageOfTheDay() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.motd
+}
+
+// setMOTD replaces the message of the day; an empty one removes it.
+func (s *announcementService) setMOTD(motd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.motd = motd
+}
+
+// sendMOTD sends the message of the day, if there is one, to the resource
+// full on session.
+func (s *announcementService) sendMOTD(ctx context.Context, session *xmpp.Session, full jid.JID) {
+	motd := s.messageOfTheDay()
+	if motd == "" {
+		return
+	}
+	if err := session.Send(ctx, s.announcement(full, "", motd)); err != nil {
+		logError(ctx, "motd error", "to", full, "error", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/commands"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupAnnouncements installs the announcements over store, with motd as
+// the message of the day, for the duration of t.
+func setupAnnouncements(t *testing.T, store storage.Storage, motd string) {
+	t.Helper()
+	old := globalAnnouncements
+	globalAnnouncements = newAnnouncementService(Config{Domain: "example.com", MOTD: motd}, store)
+	t.Cleanup(func() { globalAnnouncements = old })
+}
+
+func TestMOTDOnInitialPresence(t *testing.T) {
+	setupAnnouncements(t, nil, "Welcome\nto example.com")
+	dora := newOrderedPeer(t, "dora@example.com/phone")
+
+	if err := routePresence(context.Background(), dora.session, stanza.NewPresence("")); err != nil {
+		t.Fatal(err)
+	}
+	msg := dora.message(t)
+	if msg.Type != stanza.MessageHeadline || msg.From.String() != "example.com" || msg.To.String() != "dora@example.com/phone" || msg.Body() != "Welcome\nto example.com" {
+		t.Fatalf("motd = %+v", msg)
+	}
+
+	// Only the initial presence brings the MOTD.
+	if err := routePresence(context.Background(), dora.session, stanza.NewPresence("")); err != nil {
+		t.Fatal(err)
+	}
+	dora.quiet(t)
+}
+
+func TestAnnounceAllUsers(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	for _, name := range []string{"erin", "frank"} {
+		if err := store.UserStore().CreateUser(ctx, &storage.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	setupAnnouncements(t, store, "")
+	erin := newOrderedPeer(t, "erin@example.com/desk")
+
+	n, err := globalAnnouncements.all(ctx, "Upgrade", "Down at noon")
+	if err != nil || n != 2 {
+		t.Fatalf("all = %d, %v", n, err)
+	}
+	if msg := erin.message(t); msg.Body() != "Down at noon" || msg.Subject() != "Upgrade" {
+		t.Fatalf("erin got %+v", msg)
+	}
+	kept, err := offline.GetOfflineMessages(ctx, "frank@example.com")
+	if err != nil || len(kept) != 1 {
+		t.Fatalf("kept for frank %d, %v", len(kept), err)
+	}
+	var msg stanza.Message
+	if err := xml.Unmarshal(kept[0].Data, &msg); err != nil || msg.Type != stanza.MessageHeadline || msg.Body() != "Down at noon" {
+		t.Fatalf("kept %s", kept[0].Data)
+	}
+
+	if _, err := newAnnouncementService(Config{Domain: "example.com"}, nil).all(ctx, "", "x"); err != errCannotListUsers {
+		t.Fatalf("all without storage = %v", err)
+	}
+}
+
+func TestAdminCommandsMOTD(t *testing.T) {
+	setupCommands(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	cmd := commandOf(t, alice.execute(t, adminSetMOTD, map[string][]string{"motd": {"Be nice", "please"}}))
+	if cmd.Status != commands.StatusCompleted {
+		t.Fatalf("set-motd = %+v", cmd)
+	}
+	if msg := bob.message(t); msg.Body() != "Be nice\nplease" {
+		t.Fatalf("bob got %+v", msg)
+	}
+	if got := globalAnnouncements.messageOfTheDay(); got != "Be nice\nplease" {
+		t.Fatalf("motd = %q", got)
+	}
+
+	// Editing shows the current MOTD and sends nothing.
+	reply := alice.request(t, stanza.IQSet, "example.com", `<command xmlns='`+ns.Commands+`' node='`+adminEditMOTD+`' action='execute'/>`)
+	if f := commandOf(t, reply).Form; f == nil || strings.Join(f.GetField("motd").Values, "\n") != "Be nice\nplease" {
+		t.Fatalf("edit-motd form = %+v", f)
+	}
+	commandOf(t, alice.execute(t, adminEditMOTD, map[string][]string{"motd": {"Be kind"}}))
+	bob.quiet(t)
+	if got := globalAnnouncements.messageOfTheDay(); got != "Be kind" {
+		t.Fatalf("edited motd = %q", got)
+	}
+
+	reply = alice.request(t, stanza.IQSet, "example.com", `<command xmlns='`+ns.Commands+`' node='`+adminDeleteMOTD+`' action='execute'/>`)
+	if cmd := commandOf(t, reply); cmd.Status != commands.StatusCompleted {
+		t.Fatalf("delete-motd = %+v", cmd)
+	}
+	if got := globalAnnouncements.messageOfTheDay(); got != "" {
+		t.Fatalf("motd after delete = %q", got)
+	}
+}
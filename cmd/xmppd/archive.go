@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/plugins/stanzaid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalArchive keeps the messages local accounts send and receive in their
+// message archives and answers their XEP-0313 queries. It is nil when the storage has no MAMStore.
+var globalArchive *archiveService
+
+type archiveService struct {
+	domain string
+	store  storage.MAMStore
+	roster storage.RosterStore
+	ack    bool
+}
+
+func newArchiveService(cfg Config, store storage.Storage) *archiveService {
+	if store == nil || store.MAMStore() == nil {
+		return nil
+	}
+	return &archiveService{
+		domain: cfg.Domain,
+		store:  store.MAMStore(),
+		roster: store.RosterStore(),
+		ack:    cfg.ArchiveAck,
+	}
+}
+
+// archiveSent stores msg, sent by source, in the sender's archive under a
+// new XEP-0359 stanza-id. It returns the archived copy, which carries the
+// stanza-id, or msg itself when nothing was archived. When the service acks,
+// source is told which stanza-id its message got.
+func (s *archiveService) archiveSent(ctx context.Context, source *xmpp.Session, msg *stanza.Message) *stanza.Message {
+	sender := source.RemoteAddr().Bare()
+	// A stanza-id claiming to be from the sender's archive can only come
+	// from the server; strip the ones the client made up (XEP-0359 §4).
+	msg.Extensions = withoutStanzaID(msg.Extensions, sender.String())
+	if s == nil || sender.Domain() != s.domain || !archivable(msg) {
+		return msg
+	}
+	archived, sid := s.archive(ctx, sender, msg.To.Bare(), msg)
+	if sid.ID != "" && s.ack && originID(msg) != "" {
+		if err := source.Send(ctx, archiveAck(source, msg, sid)); err != nil {
+			logError(ctx, "archive ack error", "to", source.RemoteAddr(), "error", err)
+		}
+	}
+	return archived
+}
+
+// archiveReceived stores msg in the archive of its recipient when that is a
+// local account. It returns the copy to deliver, which carries the
+// recipient's stanza-id when the message was archived and never one the
+// sender made up. Messages to oneself are only archived as sent.
+func (s *archiveService) archiveReceived(ctx context.Context, msg *stanza.Message) *stanza.Message {
+	owner := msg.To.Bare()
+	if s == nil || owner.Local() == "" || owner.Domain() != s.domain {
+		return msg
+	}
+	received := *msg
+	received.Extensions = withoutStanzaID(msg.Extensions, owner.String())
+	if !archivable(&received) || msg.From.Bare().Equal(owner) {
+		return &received
+	}
+	archived, _ := s.archive(ctx, owner, msg.From.Bare(), &received)
+	return archived
+}
+
+// archive stores msg in the archive of owner, a local account, as part of
+// the conversation with with, unless the owner's preferences keep it out.
+// It returns a copy of msg carrying the new stanza-id along with that
+// stanza-id, or msg itself and a zero stanza-id when nothing was archived.
+func (s *archiveService) archive(ctx context.Context, owner, with jid.JID, msg *stanza.Message) (*stanza.Message, stanzaid.StanzaID) {
+	if !s.wanted(ctx, owner, with) {
+		return msg, stanzaid.StanzaID{}
+	}
+	sid := stanzaid.StanzaID{ID: stanza.GenerateID(), By: owner.String()}
+	ext, err := stanza.NewExtension(sid)
+	if err != nil {
+		logError(ctx, "archive error", "user", owner, "error", err)
+		return msg, stanzaid.StanzaID{}
+	}
+	archived := *msg
+	archived.Extensions = append(append([]stanza.Extension(nil), msg.Extensions...), ext)
+	data, err := xml.Marshal(&archived)
+	if err != nil {
+		logError(ctx, "archive error", "user", owner, "error", err)
+		return msg, stanzaid.StanzaID{}
+	}
+	err = s.store.ArchiveMessage(ctx, &storage.ArchivedMessage{
+		ID:        sid.ID,
+		UserJID:   owner.String(),
+		WithJID:   with.String(),
+		FromJID:   msg.From.String(),
+		Data:      data,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		logError(ctx, "archive error", "user", owner, "error", err)
+		return msg, stanzaid.StanzaID{}
+	}
+	return &archived, sid
+}
+
+// wanted reports whether the preferences of owner let messages exchanged
+// with with into the owner's archive (XEP-0313 §7). The always and never
+// lists win over the default, and "roster" archives only the conversations
+// with contacts on the owner's roster. Nothing is archived while the
+// preferences cannot be read, as they may opt out.
+func (s *archiveService) wanted(ctx context.Context, owner, with jid.JID) bool {
+	prefs, err := s.preferences(ctx, owner)
+	if err != nil {
+		logError(ctx, "archive preference error", "user", owner, "error", err)
+		return false
+	}
+	switch {
+	case slices.Contains(prefs.Never, with.String()):
+		return false
+	case slices.Contains(prefs.Always, with.String()):
+		return true
+	}
+	switch prefs.Default {
+	case storage.MAMNever:
+		return false
+	case storage.MAMRoster:
+		if s.roster == nil {
+			return false
+		}
+		_, err := s.roster.GetRosterItem(ctx, owner.String(), with.String())
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logError(ctx, "archive preference error", "user", owner, "error", err)
+		}
+		return err == nil
+	}
+	return true
+}
+
+// archiveAck builds the message telling source that msg was archived as
+// sid: a bodyless headline from the sender's bare JID carrying the message's
+// origin-id, or its id when it has none, next to the stanza-id. It is marked
+// no-store and no-copy so that it never outlives the session.
+func archiveAck(source *xmpp.Session, msg *stanza.Message, sid stanzaid.StanzaID) *stanza.Message {
+	origin := stanzaid.OriginID{ID: originID(msg)}
+	ack, _ := stanza.BuildMessage().
+		From(source.RemoteAddr().Bare()).
+		To(source.RemoteAddr()).
+		Type(stanza.MessageHeadline).
+		Extension(origin).
+		Extension(sid).
+		Extension(hints.NoStore{}).
+		Extension(hints.NoCopy{}).
+		Build()
+	return ack
+}
+
+// originID returns the XEP-0359 origin-id of msg, or its id without one.
+func originID(msg *stanza.Message) string {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName == (xml.Name{Space: ns.StanzaID, Local: "origin-id"}) && attr(ext, "id") != "" {
+			return attr(ext, "id")
+		}
+	}
+	return msg.ID
+}
+
+// archivable reports whether msg goes to the sender's archive: chat
+// messages and normal messages with a body, unless the sender asked for
+// them not to be stored.
+func archivable(msg *stanza.Message) bool {
+	switch msg.Type {
+	case stanza.MessageChat, stanza.MessageNormal, "":
+	default:
+		return false
+	}
+	return len(msg.Bodies) > 0 && !noStore(msg)
+}
+
+// noStore reports whether msg carries an XEP-0334 hint against storing it.
+func noStore(msg *stanza.Message) bool {
+	for _, ext := range msg.Extensions {
+		switch ext.XMLName {
+		case xml.Name{Space: ns.Hints, Local: "no-store"},
+			xml.Name{Space: ns.Hints, Local: "no-permanent-store"}:
+			return true
+		}
+	}
+	return false
+}
+
+// withoutStanzaID returns exts without the stanza-id elements by the given
+// entity.
+func withoutStanzaID(exts []stanza.Extension, by string) []stanza.Extension {
+	out := exts[:0:0]
+	for _, ext := range exts {
+		if ext.XMLName == (xml.Name{Space: ns.StanzaID, Local: "stanza-id"}) && attr(ext, "by") == by {
+			continue
+		}
+		out = append(out, ext)
+	}
+	return out
+}
+
+func attr(ext stanza.Extension, name string) string {
+	for _, a := range ext.Attrs {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value
+		}
+	}
+	return ""
+}
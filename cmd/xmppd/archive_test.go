@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/plugins/stanzaid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func setupArchive(t *testing.T, cfg Config) storage.MAMStore {
+	t.Helper()
+	store := memory.New()
+	old := globalArchive
+	globalArchive = newArchiveService(cfg, store)
+	t.Cleanup(func() { globalArchive = old })
+	return store.MAMStore()
+}
+
+// stanzaIDs returns the id of each stanza-id in msg, keyed by its by.
+func stanzaIDs(msg stanza.Message) map[string]string {
+	ids := make(map[string]string)
+	for _, ext := range msg.Extensions {
+		if ext.XMLName == (xml.Name{Space: ns.StanzaID, Local: "stanza-id"}) {
+			ids[attr(ext, "by")] = attr(ext, "id")
+		}
+	}
+	return ids
+}
+
+func TestArchiveSentMessage(t *testing.T) {
+	ctx := context.Background()
+	mam := setupArchive(t, Config{Domain: "example.com", ArchiveAck: true})
+	phone, phoneMsgs := messagePeer(t, "alice@example.com/phone")
+	laptop, laptopMsgs := messagePeer(t, "alice@example.com/laptop")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+	enableCarbons(t, laptop)
+
+	msg, err := stanza.BuildMessage().
+		To(jid.MustParse("bob@example.com")).
+		Type(stanza.MessageChat).
+		Body("hi bob").
+		Extension(stanzaid.OriginID{ID: "origin-1"}).
+		// A forged stanza-id for alice's own archive is dropped.
+		Extension(stanzaid.StanzaID{ID: "forged", By: "alice@example.com"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := routeMessage(ctx, phone, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+
+	ack := receiveMessage(t, phoneMsgs)
+	if ack.Type != stanza.MessageHeadline || ack.From.String() != "alice@example.com" || len(ack.Bodies) != 0 {
+		t.Fatalf("ack = %+v", ack)
+	}
+	if originID(&ack) != "origin-1" {
+		t.Fatalf("ack origin-id = %q", originID(&ack))
+	}
+	id := stanzaIDs(ack)["alice@example.com"]
+	if id == "" || id == "forged" {
+		t.Fatalf("ack stanza-id = %q", id)
+	}
+
+	if got := stanzaIDs(sentMessage(t, receiveMessage(t, laptopMsgs)))["alice@example.com"]; got != id {
+		t.Fatalf("carbon stanza-id = %q, want %q", got, id)
+	}
+	bobID := stanzaIDs(receiveMessage(t, bobMsgs))
+	if len(bobID) != 1 || bobID["bob@example.com"] == "" || bobID["bob@example.com"] == id {
+		t.Fatalf("bob received stanza-ids %v", bobID)
+	}
+
+	res, err := mam.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 1 || res.Messages[0].ID != id || res.Messages[0].WithJID != "bob@example.com" {
+		t.Fatalf("archive = %+v", res.Messages)
+	}
+}
+
+func TestArchiveSkipped(t *testing.T) {
+	ctx := context.Background()
+	mam := setupArchive(t, Config{Domain: "example.com", ArchiveAck: true})
+	phone, phoneMsgs := messagePeer(t, "alice@example.com/phone")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	for _, b := range []*stanza.MessageBuilder{
+		stanza.BuildMessage().Type(stanza.MessageChat),
+		stanza.BuildMessage().Type(stanza.MessageHeadline).Body("news"),
+		stanza.BuildMessage().Type(stanza.MessageChat).Body("secret").Extension(hints.NoStore{}),
+		stanza.BuildMessage().Type(stanza.MessageChat).Body("secret").Extension(hints.NoPermanentStore{}),
+	} {
+		msg, err := b.To(jid.MustParse("bob@example.com")).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := routeMessage(ctx, phone, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+		receiveMessage(t, bobMsgs)
+	}
+	expectNoMessage(t, phoneMsgs)
+	res, err := mam.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 0 {
+		t.Fatalf("archived %d messages", len(res.Messages))
+	}
+}
+
+func TestArchiveWithoutAck(t *testing.T) {
+	ctx := context.Background()
+	mam := setupArchive(t, Config{Domain: "example.com"})
+	phone, phoneMsgs := messagePeer(t, "alice@example.com/phone")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse("bob@example.com")
+	msg.SetBody("hi")
+	if err := routeMessage(ctx, phone, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+	receiveMessage(t, bobMsgs)
+	expectNoMessage(t, phoneMsgs)
+	if res, err := mam.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"}); err != nil || len(res.Messages) != 1 {
+		t.Fatalf("archive = %+v, %v", res, err)
+	}
+}
+
+func TestArchiveReceivedMessage(t *testing.T) {
+	ctx := context.Background()
+	mam := setupArchive(t, Config{Domain: "example.com"})
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	msg, err := stanza.BuildMessage().
+		To(jid.MustParse("bob@example.com")).
+		Type(stanza.MessageChat).
+		Body("hi bob").
+		// alice cannot forge an id in bob's archive.
+		Extension(stanzaid.StanzaID{ID: "forged", By: "bob@example.com"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := routeMessage(ctx, alice, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+
+	id := stanzaIDs(receiveMessage(t, bobMsgs))["bob@example.com"]
+	res, err := mam.QueryMessages(ctx, &storage.MAMQuery{UserJID: "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 1 || res.Messages[0].ID != id || id == "forged" || res.Messages[0].WithJID != "alice@example.com" {
+		t.Fatalf("bob's archive = %+v, delivered id %q", res.Messages, id)
+	}
+}
+
+func TestArchivePreferences(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	old := globalArchive
+	globalArchive = newArchiveService(Config{Domain: "example.com"}, store)
+	t.Cleanup(func() { globalArchive = old })
+	err := store.RosterStore().UpsertRosterItem(ctx, &storage.RosterItem{
+		UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "both",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := jid.MustParse("alice@example.com")
+	tests := []struct {
+		prefs storage.MAMPrefs
+		with  string
+		want  bool
+	}{
+		{storage.MAMPrefs{Default: storage.MAMAlways}, "carol@example.com", true},
+		{storage.MAMPrefs{Default: storage.MAMNever}, "bob@example.com", false},
+		{storage.MAMPrefs{Default: storage.MAMRoster}, "bob@example.com", true},
+		{storage.MAMPrefs{Default: storage.MAMRoster}, "carol@example.com", false},
+		{storage.MAMPrefs{Default: storage.MAMNever, Always: []string{"carol@example.com"}}, "carol@example.com", true},
+		{storage.MAMPrefs{Default: storage.MAMAlways, Never: []string{"bob@example.com"}}, "bob@example.com", false},
+	}
+	for _, tt := range tests {
+		tt.prefs.UserJID = alice.String()
+		if err := store.MAMStore().SetMAMPrefs(ctx, &tt.prefs); err != nil {
+			t.Fatal(err)
+		}
+		if got := globalArchive.wanted(ctx, alice, jid.MustParse(tt.with)); got != tt.want {
+			t.Errorf("wanted(%+v, %s) = %v, want %v", tt.prefs, tt.with, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+const defaultSASLMechanisms = "SCRAM-SHA-256-PLUS,SCRAM-SHA-256,PLAIN"
+
+// supportedSASLMechanisms are the mechanisms XMPP_SASL_MECHANISMS may list.
+var supportedSASLMechanisms = []string{
+	"SCRAM-SHA-512-PLUS", "SCRAM-SHA-512",
+	"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256",
+	"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1",
+	"PLAIN",
+	"OAUTHBEARER",
+	"ANONYMOUS",
+}
+
+type saslChallenge struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl challenge"`
+	Value   string   `xml:",chardata"`
+}
+
+type saslResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Value   string   `xml:",chardata"`
+}
+
+// errSASLAborted is returned by challengeSASL when the client aborts.
+var errSASLAborted = errors.New("sasl: aborted by client")
+
+// parseSASLMechanisms parses a comma separated list of mechanism names.
+func parseSASLMechanisms(v string) []string {
+	mechs := parseCSV(v)
+	for i, m := range mechs {
+		mechs[i] = strings.ToUpper(m)
+	}
+	return mechs
+}
+
+// needsPlaintext reports whether one of mechs needs the plaintext password
+// of an account: every SCRAM variant but SCRAM-SHA-256, whose credentials
+// are stored.
+func needsPlaintext(mechs []string) bool {
+	for _, m := range mechs {
+		base := strings.TrimSuffix(m, "-PLUS")
+		if strings.HasPrefix(base, "SCRAM-") && base != scramStoredMechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// channelBinding returns the tls-exporter channel binding of session, or
+// the zero value when its connection cannot provide one.
+func channelBinding(session *xmpp.Session) sasl.ChannelBinding {
+	cs, ok := session.Transport().ConnectionState()
+	if !ok {
+		return sasl.ChannelBinding{}
+	}
+	data, err := sasl.TLSExporter(cs)
+	if err != nil {
+		return sasl.ChannelBinding{}
+	}
+	return sasl.ChannelBinding{Type: sasl.CBTypeTLSExporter, Data: data}
+}
+
+// offeredMechanisms returns the configured mechanisms session can use; the
+// -PLUS variants need a TLS 1.3 connection, and OAUTHBEARER an auth
+// provider that accepts tokens.
+func offeredMechanisms(cfg Config, session *xmpp.Session) []string {
+	bindable := len(channelBinding(session).Data) > 0
+	_, tokens := globalAuth.(tokenProvider)
+	var offered []string
+	for _, m := range cfg.SASLMechanisms {
+		if !slices.Contains(supportedSASLMechanisms, m) || strings.HasSuffix(m, "-PLUS") && !bindable || m == "OAUTHBEARER" && !tokens {
+			continue
+		}
+		offered = append(offered, m)
+	}
+	return offered
+}
+
+func newServerMechanism(ctx context.Context, name string, us storage.UserStore, cfg Config, session *xmpp.Session) (sasl.ServerMechanism, error) {
+	switch name {
+	case "PLAIN":
+		return sasl.NewPlainServer(func(username, password string) error {
+			if globalAuth != nil {
+				return verifyExternalPassword(ctx, us, cfg, username, password)
+			}
+			return verifyPassword(ctx, us, username, password)
+		}), nil
+	case "OAUTHBEARER":
+		return sasl.NewOAuthBearerServer(func(token string) (string, error) {
+			return verifyToken(ctx, us, cfg, token)
+		}), nil
+	case "ANONYMOUS":
+		return sasl.NewAnonymousServer(func() (string, error) {
+			return guestIdentity(ctx, us)
+		}), nil
+	}
+	key := saltKey(cfg)
+	m, err := sasl.NewSCRAMServer(name, credentialLookup(ctx, us, cfg.Registration.Iterations, key), channelBinding(session))
+	if err != nil {
+		return nil, err
+	}
+	m.SetSaltKey(key)
+	return m, nil
+}
+
+// processSaltKey keys the salts SCRAM makes up when XMPP_SASL_SECRET is not
+// set.
+var processSaltKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// saltKey returns the key of the SCRAM salts of accounts without stored
+// credentials and of unknown users. Both are derived from it, so neither
+// stands out from a stored salt by changing between attempts.
+func saltKey(cfg Config) []byte {
+	if cfg.SASLSecret != "" {
+		return []byte(cfg.SASLSecret)
+	}
+	return processSaltKey
+}
+
+// credentialLookup returns the SCRAM credentials of an account: the stored
+// SCRAM-SHA-256 ones, or for other hashes and older accounts, ones derived
+// from a plaintext password with a salt derived from saltKey. An account
+// SCRAM cannot authenticate looks like an unknown user, so that it fails
+// at the proof like a wrong password does.
+func credentialLookup(ctx context.Context, us storage.UserStore, iterations int, saltKey []byte) sasl.CredentialLookup {
+	return func(mechanism, username string) (sasl.SCRAMCredentials, error) {
+		user, err := us.GetUser(ctx, username)
+		if errors.Is(err, storage.ErrNotFound) {
+			return sasl.SCRAMCredentials{}, sasl.ErrUnknownUser
+		}
+		if err != nil {
+			return sasl.SCRAMCredentials{}, err
+		}
+		if strings.TrimSuffix(mechanism, "-PLUS") == scramStoredMechanism {
+			if creds, ok := storedCredentials(user); ok {
+				return creds, nil
+			}
+		}
+		// A hashed password cannot derive SCRAM credentials.
+		if user.Password == "" || credentials.IsHash(user.Password) {
+			return sasl.SCRAMCredentials{}, sasl.ErrUnknownUser
+		}
+		return sasl.NewSCRAMCredentials(mechanism, user.Password, sasl.DeriveSalt(saltKey, username), iterations)
+	}
+}
+
+// verifyPassword checks password against the stored SCRAM credentials of
+// username, falling back to the storage backend for accounts without them.
+func verifyPassword(ctx context.Context, us storage.UserStore, username, password string) error {
+	user, err := us.GetUser(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return sasl.ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if creds, ok := storedCredentials(user); ok {
+		if !creds.Verify(scramStoredMechanism, password) {
+			return sasl.ErrAuthFailed
+		}
+		return nil
+	}
+	ok, err := us.Authenticate(ctx, username, password)
+	if errors.Is(err, storage.ErrAuthFailed) || err == nil && !ok {
+		return sasl.ErrAuthFailed
+	}
+	return err
+}
+
+// saslCondition returns the SASL failure condition for err.
+func saslCondition(err error) string {
+	switch {
+	case errors.Is(err, sasl.ErrMalformedRequest):
+		return "malformed-request"
+	case errors.Is(err, errSASLAborted):
+		return "aborted"
+	case errors.Is(err, sasl.ErrAuthFailed), errors.Is(err, sasl.ErrUnknownUser), errors.Is(err, sasl.ErrChannelBinding):
+		return "not-authorized"
+	}
+	return "temporary-auth-failure"
+}
+
+// decodeSASL decodes the base64 payload of a SASL element, where "="
+// stands for an empty response.
+func decodeSASL(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if value == "=" {
+		return []byte{}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, sasl.ErrMalformedRequest
+	}
+	return data, nil
+}
+
+func encodeSASL(data []byte) string {
+	if len(data) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// saslStreamError wraps an error writing or reading the stream during a
+// SASL exchange, which ends the session instead of failing authentication.
+type saslStreamError struct{ err error }
+
+func (e saslStreamError) Error() string { return e.err.Error() }
+
+// challengeSASL sends a challenge carrying data and returns the client's
+// response.
+func challengeSASL(ctx context.Context, session *xmpp.Session, reader *xmppxml.StreamReader, data []byte) ([]byte, error) {
+	if err := session.SendElement(ctx, saslChallenge{Value: encodeSASL(data)}); err != nil {
+		return nil, saslStreamError{err}
+	}
+	for {
+		tok, err := reader.Token()
+		if err != nil {
+			return nil, saslStreamError{err}
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == ns.SASL && start.Name.Local == "response" {
+			var resp saslResponse
+			if err := reader.DecodeElement(&resp, &start); err != nil {
+				return nil, saslStreamError{err}
+			}
+			return decodeSASL(resp.Value)
+		}
+		if err := reader.Skip(); err != nil {
+			return nil, saslStreamError{err}
+		}
+		if start.Name.Space == ns.SASL && start.Name.Local == "abort" {
+			return nil, errSASLAborted
+		}
+		return nil, sasl.ErrMalformedRequest
+	}
+}
+
+func writeChannelBindingFeature(writer *xmppxml.StreamWriter, cbType string) error {
+	feature := xml.StartElement{Name: xml.Name{Space: ns.SASLCBind, Local: "sasl-channel-binding"}}
+	if err := writer.EncodeToken(feature); err != nil {
+		return err
+	}
+	binding := xml.StartElement{
+		Name: xml.Name{Local: "channel-binding"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: cbType}},
+	}
+	if err := writer.EncodeToken(binding); err != nil {
+		return err
+	}
+	if err := writer.EncodeToken(xml.EndElement{Name: binding.Name}); err != nil {
+		return err
+	}
+	return writer.EncodeToken(xml.EndElement{Name: feature.Name})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/metrics"
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+type saslReply struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+// saslPeer runs handleSASLAuth for a session whose client writes with send
+// and reads the server's replies from replies.
+type saslPeer struct {
+	session *xmpp.Session
+	send    func(string)
+	replies <-chan saslReply
+	done    <-chan error
+	user    *string
+}
+
+func newSASLPeer(t *testing.T, cfg Config, keepPlaintext bool, opts ...xmpp.SessionOption) *saslPeer {
+	t.Helper()
+	store := memory.New()
+	user, err := newUser("alice", "pencil", 4096, keepPlaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UserStore().CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), opts...)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	replies := make(chan saslReply, 4)
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			var r saslReply
+			if err := dec.Decode(&r); err != nil {
+				return
+			}
+			replies <- r
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close(); session.Close(); c2.Close() })
+	reader := xmppxml.NewStreamReader(pr)
+	done := make(chan error, 1)
+	var authenticated string
+	go func() {
+		tok, err := reader.Token()
+		if err != nil {
+			done <- err
+			return
+		}
+		start := tok.(xml.StartElement)
+		done <- handleSASLAuth(context.Background(), session, store.UserStore(), cfg, &authenticated, reader, &start)
+	}()
+	send := func(s string) {
+		go func() { _, _ = io.WriteString(pw, s) }()
+	}
+	return &saslPeer{session: session, send: send, replies: replies, done: done, user: &authenticated}
+}
+
+func (p *saslPeer) reply(t *testing.T) saslReply {
+	t.Helper()
+	select {
+	case r := <-p.replies:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply")
+		return saslReply{}
+	}
+}
+
+func (p *saslPeer) finish(t *testing.T) {
+	t.Helper()
+	select {
+	case err := <-p.done:
+		if err != nil {
+			t.Fatalf("handleSASLAuth: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleSASLAuth did not return")
+	}
+}
+
+func saslAuthElement(mechanism string, data []byte) string {
+	return "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='" + mechanism + "'>" + base64.StdEncoding.EncodeToString(data) + "</auth>"
+}
+
+func saslResponseElement(data []byte) string {
+	return "<response xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>" + base64.StdEncoding.EncodeToString(data) + "</response>"
+}
+
+func decodeReply(t *testing.T, r saslReply) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(r.Inner))
+	if err != nil {
+		t.Fatalf("%s payload %q: %v", r.XMLName.Local, r.Inner, err)
+	}
+	return data
+}
+
+func testConfig(mechs ...string) Config {
+	cfg := Config{Domain: "example.com", SASLMechanisms: mechs}
+	cfg.Registration.Iterations = 4096
+	return cfg
+}
+
+func TestSASLSCRAMWithStoredCredentials(t *testing.T) {
+	// The account has no plaintext password, only SCRAM-SHA-256 keys.
+	p := newSASLPeer(t, testConfig("SCRAM-SHA-256", "PLAIN"), false)
+	client := sasl.NewSCRAMSHA256(sasl.Credentials{Username: "alice", Password: "pencil"})
+	first, err := client.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(saslAuthElement(client.Name(), first))
+
+	challenge := p.reply(t)
+	if challenge.XMLName.Local != "challenge" {
+		t.Fatalf("got %s %s, want challenge", challenge.XMLName.Local, challenge.Inner)
+	}
+	final, err := client.Next(decodeReply(t, challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(saslResponseElement(final))
+
+	success := p.reply(t)
+	if success.XMLName.Local != "success" {
+		t.Fatalf("got %s %s, want success", success.XMLName.Local, success.Inner)
+	}
+	if _, err := client.Next(decodeReply(t, success)); err != nil || !client.Completed() {
+		t.Fatalf("server signature rejected: %v", err)
+	}
+	p.finish(t)
+	if *p.user != "alice" || p.session.State()&xmpp.StateAuthenticated == 0 || p.session.RemoteAddr().String() != "alice@example.com" {
+		t.Fatalf("user %q, state %v, address %s", *p.user, p.session.State(), p.session.RemoteAddr())
+	}
+}
+
+func TestSASLSCRAMWrongPassword(t *testing.T) {
+	p := newSASLPeer(t, testConfig("SCRAM-SHA-256"), false)
+	client := sasl.NewSCRAMSHA256(sasl.Credentials{Username: "alice", Password: "pen"})
+	first, _ := client.Start()
+	p.send(saslAuthElement(client.Name(), first))
+	final, err := client.Next(decodeReply(t, p.reply(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(saslResponseElement(final))
+	if r := p.reply(t); r.XMLName.Local != "failure" || !strings.Contains(r.Inner, "not-authorized") {
+		t.Fatalf("got %s %s, want not-authorized", r.XMLName.Local, r.Inner)
+	}
+	p.finish(t)
+	if p.session.State()&xmpp.StateAuthenticated != 0 {
+		t.Fatal("session authenticated")
+	}
+}
+
+func TestSASLSCRAMSHA1NeedsPlaintext(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		p := newSASLPeer(t, testConfig("SCRAM-SHA-1"), keep)
+		client := sasl.NewSCRAMSHA1(sasl.Credentials{Username: "alice", Password: "pencil"})
+		first, _ := client.Start()
+		p.send(saslAuthElement(client.Name(), first))
+		// Without a plaintext password the account fails at the proof,
+		// like a wrong password, rather than standing out at the start.
+		final, err := client.Next(decodeReply(t, p.reply(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.send(saslResponseElement(final))
+		r := p.reply(t)
+		if !keep {
+			if r.XMLName.Local != "failure" || !strings.Contains(r.Inner, "not-authorized") {
+				t.Fatalf("got %s %s, want not-authorized", r.XMLName.Local, r.Inner)
+			}
+			p.finish(t)
+			continue
+		}
+		if r.XMLName.Local != "success" {
+			t.Fatalf("got %s %s, want success", r.XMLName.Local, r.Inner)
+		}
+		p.finish(t)
+	}
+}
+
+func TestSASLSCRAMSaltIsStable(t *testing.T) {
+	salt := func(username string) string {
+		t.Helper()
+		p := newSASLPeer(t, testConfig("SCRAM-SHA-1"), false)
+		client := sasl.NewSCRAMSHA1(sasl.Credentials{Username: username, Password: "pencil"})
+		first, _ := client.Start()
+		p.send(saslAuthElement(client.Name(), first))
+		r := p.reply(t)
+		if r.XMLName.Local != "challenge" {
+			t.Fatalf("%s: got %s %s, want challenge", username, r.XMLName.Local, r.Inner)
+		}
+		for _, attr := range strings.Split(string(decodeReply(t, r)), ",") {
+			if v, ok := strings.CutPrefix(attr, "s="); ok {
+				return v
+			}
+		}
+		t.Fatalf("%s: no salt", username)
+		return ""
+	}
+	// Neither an account SCRAM-SHA-1 cannot serve nor an unknown user is
+	// told apart by a salt that changes between attempts.
+	for _, username := range []string{"alice", "nobody"} {
+		if a, b := salt(username), salt(username); a != b {
+			t.Errorf("%s: salt changed from %s to %s", username, a, b)
+		}
+	}
+}
+
+func TestSASLPlainWithStoredCredentials(t *testing.T) {
+	for _, tt := range []struct {
+		password, want string
+	}{
+		{"pencil", "success"},
+		{"pen", "failure"},
+	} {
+		p := newSASLPeer(t, testConfig("PLAIN"), false)
+		p.send(saslAuthElement("PLAIN", []byte("\x00alice\x00"+tt.password)))
+		if r := p.reply(t); r.XMLName.Local != tt.want {
+			t.Fatalf("password %q: got %s %s, want %s", tt.password, r.XMLName.Local, r.Inner, tt.want)
+		}
+		p.finish(t)
+	}
+}
+
+func TestSASLSCRAMAfterPlainUpgrade(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	us := store.UserStore()
+	if err := us.CreateUser(ctx, &storage.User{Username: "romeo", Password: "pencil"}); err != nil {
+		t.Fatal(err)
+	}
+	// A PLAIN login replaces the legacy plaintext password with a hash and
+	// SCRAM-SHA-256 keys, which SCRAM logins use from then on.
+	if err := verifyPassword(ctx, us, "romeo", "pencil"); err != nil {
+		t.Fatalf("PLAIN: %v", err)
+	}
+	user, err := us.GetUser(ctx, "romeo")
+	if err != nil || !credentials.IsHash(user.Password) {
+		t.Fatalf("user = %+v, %v", user, err)
+	}
+	creds, err := credentialLookup(ctx, us, 4096, nil)("SCRAM-SHA-256-PLUS", "romeo")
+	if err != nil || !creds.Verify(scramStoredMechanism, "pencil") {
+		t.Fatalf("SCRAM credentials: %v", err)
+	}
+}
+
+func TestSASLFailureMetrics(t *testing.T) {
+	prom := metrics.New()
+	for _, password := range []string{"pen", "pencil"} {
+		p := newSASLPeer(t, testConfig("PLAIN"), false, xmpp.WithMetrics(prom))
+		p.send(saslAuthElement("PLAIN", []byte("\x00alice\x00"+password)))
+		p.reply(t)
+		p.finish(t)
+	}
+	var out strings.Builder
+	if _, err := prom.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `xmpp_auth_failures_total{mechanism="PLAIN"} 1`+"\n") {
+		t.Fatalf("metrics:\n%s", out.String())
+	}
+}
+
+func TestSASLLockout(t *testing.T) {
+	limiter := xmpp.NewRateLimiter(xmpp.RateLimits{AuthFailures: 1, AuthLockout: time.Minute}, nil)
+	for _, tt := range []struct {
+		password, want string
+	}{
+		{"pen", "not-authorized"},
+		// The correct password does not lift the lockout.
+		{"pencil", "temporary-auth-failure"},
+	} {
+		p := newSASLPeer(t, testConfig("PLAIN"), false, xmpp.WithLimitPolicy(limiter))
+		p.send(saslAuthElement("PLAIN", []byte("\x00alice\x00"+tt.password)))
+		if r := p.reply(t); r.XMLName.Local != "failure" || !strings.Contains(r.Inner, tt.want) {
+			t.Fatalf("password %q: got %s %s, want %s", tt.password, r.XMLName.Local, r.Inner, tt.want)
+		}
+		p.finish(t)
+	}
+}
+
+func TestSASLRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		mechs     []string
+		request   []string
+		condition string
+	}{
+		{"not offered", []string{"PLAIN"}, []string{saslAuthElement("SCRAM-SHA-256", []byte("n,,n=alice,r=abc"))}, "invalid-mechanism"},
+		// Channel binding needs TLS 1.3, which this connection lacks.
+		{"plus without tls", []string{"SCRAM-SHA-256-PLUS"}, []string{saslAuthElement("SCRAM-SHA-256-PLUS", []byte("p=tls-exporter,,n=alice,r=abc"))}, "invalid-mechanism"},
+		{"bad base64", []string{"PLAIN"}, []string{"<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>!!</auth>"}, "malformed-request"},
+		{"other authzid", []string{"PLAIN"}, []string{saslAuthElement("PLAIN", []byte("bob@example.com\x00alice\x00pencil"))}, "invalid-authzid"},
+		{"aborted", []string{"SCRAM-SHA-256"}, []string{
+			saslAuthElement("SCRAM-SHA-256", []byte("n,,n=alice,r=abc")),
+			"<abort xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>",
+		}, "aborted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSASLPeer(t, testConfig(tt.mechs...), false)
+			var r saslReply
+			for _, req := range tt.request {
+				p.send(req)
+				r = p.reply(t)
+			}
+			if r.XMLName.Local != "failure" || !strings.Contains(r.Inner, tt.condition) {
+				t.Fatalf("got %s %s, want %s", r.XMLName.Local, r.Inner, tt.condition)
+			}
+			p.finish(t)
+		})
+	}
+}
+
+func TestNeedsPlaintext(t *testing.T) {
+	for mechs, want := range map[string]bool{
+		defaultSASLMechanisms:              false,
+		"SCRAM-SHA-256,SCRAM-SHA-1":        true,
+		"SCRAM-SHA-512-PLUS,PLAIN":         true,
+		"SCRAM-SHA-256-PLUS,SCRAM-SHA-256": false,
+	} {
+		if got := needsPlaintext(parseSASLMechanisms(mechs)); got != want {
+			t.Errorf("needsPlaintext(%s) = %v, want %v", mechs, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalAuth checks passwords and tokens in place of the UserStore. It is
+// nil when XMPP_AUTH_PROVIDER is local, the default.
+var globalAuth authProvider
+
+// authProvider checks the credentials of local accounts against an
+// external identity provider.
+type authProvider interface {
+	// verifyPassword checks the password of username, returning
+	// sasl.ErrAuthFailed when the provider rejects it.
+	verifyPassword(ctx context.Context, username, password string) error
+}
+
+// tokenProvider is an authProvider that also accepts bearer tokens, for
+// OAUTHBEARER.
+type tokenProvider interface {
+	authProvider
+
+	// verifyToken returns the username of the account token was issued
+	// to, or sasl.ErrAuthFailed when the provider rejects it.
+	verifyToken(ctx context.Context, token string) (string, error)
+}
+
+func newAuthProvider(ctx context.Context, cfg Config) (authProvider, error) {
+	switch cfg.AuthProvider {
+	case "", "local":
+		return nil, nil
+	case "oauth2":
+		p, err := newOAuthProvider(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown auth provider %q", cfg.AuthProvider)
+}
+
+// verifyExternalPassword checks password with the external provider and
+// makes sure username has a local account.
+func verifyExternalPassword(ctx context.Context, us storage.UserStore, cfg Config, username, password string) error {
+	if err := globalAuth.verifyPassword(ctx, username, password); err != nil {
+		return err
+	}
+	return provisionAccount(ctx, us, username, cfg.AuthProvision)
+}
+
+// verifyToken checks a bearer token with the external provider and
+// returns the username of its local account.
+func verifyToken(ctx context.Context, us storage.UserStore, cfg Config, token string) (string, error) {
+	tp, ok := globalAuth.(tokenProvider)
+	if !ok {
+		return "", sasl.ErrAuthFailed
+	}
+	username, err := tp.verifyToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return username, provisionAccount(ctx, us, username, cfg.AuthProvision)
+}
+
+// provisionAccount makes sure username, whose credentials the external
+// provider accepted, has a local account. Unless provision is set, the
+// account must have been created beforehand. Provisioned accounts have no
+// password of their own.
+func provisionAccount(ctx context.Context, us storage.UserStore, username string, provision bool) error {
+	exists, err := us.UserExists(ctx, username)
+	if err != nil || exists {
+		return err
+	}
+	if !provision {
+		return sasl.ErrUnknownUser
+	}
+	now := time.Now()
+	err = us.CreateUser(ctx, &storage.User{Username: username, CreatedAt: now, UpdatedAt: now})
+	if errors.Is(err, storage.ErrUserExists) {
+		// Another session provisioned it first.
+		return nil
+	}
+	return err
+}
+
+// accountFor maps the subject an identity provider vouched for, a username
+// or an address at the server's domain, to the username of a local account.
+func accountFor(domain, subject string) (string, error) {
+	local := subject
+	if i := strings.LastIndex(subject, "@"); i >= 0 {
+		if !strings.EqualFold(subject[i+1:], domain) {
+			return "", sasl.ErrAuthFailed
+		}
+		local = subject[:i]
+	}
+	j, err := jid.New(local, domain, "")
+	if err != nil || j.Local() == "" {
+		return "", sasl.ErrAuthFailed
+	}
+	return j.Local(), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/blocking"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalBlocking keeps the block lists of local users (XEP-0191). It is nil
+// when the storage has no BlockingStore.
+var globalBlocking *blockingService
+
+type blockingService struct {
+	domain string
+	store  storage.BlockingStore
+}
+
+func newBlockingService(cfg Config, store storage.Storage) *blockingService {
+	if store == nil || store.BlockingStore() == nil {
+		return nil
+	}
+	return &blockingService{domain: cfg.Domain, store: store.BlockingStore()}
+}
+
+// blocks reports whether the local user has blocked other.
+func (s *blockingService) blocks(ctx context.Context, user, other jid.JID) bool {
+	if s == nil || user.Domain() != s.domain || user.Local() == "" || other.IsZero() {
+		return false
+	}
+	list, err := s.store.GetBlockedJIDs(ctx, user.Bare().String())
+	if err != nil {
+		logError(ctx, "block list error", "user", user.Bare(), "error", err)
+		return false
+	}
+	for _, item := range list {
+		if j, err := jid.Parse(item); err == nil && blockMatches(j, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockMatches reports whether the block list item covers j. A bare JID
+// covers all its resources and a domain every JID at it (XEP-0191 §3.1).
+func blockMatches(item, j jid.JID) bool {
+	switch {
+	case item.Local() != "" && item.Resource() != "":
+		return item.Equal(j)
+	case item.Local() != "":
+		return item.Equal(j.Bare())
+	case item.Resource() != "":
+		return item.Domain() == j.Domain() && item.Resource() == j.Resource()
+	default:
+		return item.Domain() == j.Domain()
+	}
+}
+
+// check returns the error for a stanza from one JID to another that a block
+// stops: not-acceptable when the sender blocked the recipient and
+// service-unavailable when the recipient blocked the sender (XEP-0191 §3.5,
+// §3.6). It returns nil when the stanza may pass.
+func (s *blockingService) check(ctx context.Context, from, to jid.JID) *stanza.StanzaError {
+	if s.blocks(ctx, from, to) {
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAcceptable, "you blocked the recipient")
+	}
+	if s.blocks(ctx, to, from) {
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")
+	}
+	return nil
+}
+
+// answerBlocking answers the block list requests a user sends to their own
+// account, or returns nil when iq is not one. Changes are pushed to the
+// user's other resources, and blocked contacts stop seeing the user's
+// presence until they are unblocked.
+func answerBlocking(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	var list blocking.BlockList
+	var block blocking.Block
+	var unblock blocking.Unblock
+	switch {
+	case iq.Type == stanza.IQGet && xml.Unmarshal(iq.Query, &list) == nil:
+	case iq.Type == stanza.IQSet && xml.Unmarshal(iq.Query, &block) == nil:
+	case iq.Type == stanza.IQSet && xml.Unmarshal(iq.Query, &unblock) == nil:
+	default:
+		return nil
+	}
+	if globalBlocking == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "blocking disabled"))
+	}
+	s := globalBlocking
+	user := source.RemoteAddr().Bare()
+	fail := func(err error) *stanza.IQ {
+		logError(ctx, "block list error", "user", user, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+
+	if iq.Type == stanza.IQGet {
+		jids, err := s.store.GetBlockedJIDs(ctx, user.String())
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fail(err)
+		}
+		list.Items = []blocking.BlockItem{}
+		for _, j := range jids {
+			list.Items = append(list.Items, blocking.BlockItem{JID: j})
+		}
+		return payloadIQ(iq, list)
+	}
+
+	blocked := block.XMLName.Local != ""
+	items := unblock.Items
+	if blocked {
+		items = block.Items
+		if len(items) == 0 {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "block at least one JID"))
+		}
+	}
+	jids := make([]jid.JID, 0, len(items))
+	for i, item := range items {
+		j, err := jid.Parse(item.JID)
+		if err != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, ""))
+		}
+		items[i].JID = j.String()
+		jids = append(jids, j)
+	}
+	if !blocked && len(jids) == 0 {
+		// An empty unblock clears the list.
+		all, err := s.store.GetBlockedJIDs(ctx, user.String())
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fail(err)
+		}
+		for _, v := range all {
+			if j, err := jid.Parse(v); err == nil {
+				jids = append(jids, j)
+			}
+		}
+	}
+
+	// Contacts covered by the change stop or start seeing the user's presence.
+	subscribers, err := globalRoster.presenceSubscribers(ctx, user)
+	if err != nil {
+		logError(ctx, "block list error", "user", user, "error", err)
+	}
+	for _, j := range jids {
+		if blocked {
+			err = s.store.BlockJID(ctx, user.String(), j.String())
+		} else {
+			err = s.store.UnblockJID(ctx, user.String(), j.String())
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fail(err)
+		}
+		for _, contact := range subscribers {
+			switch {
+			case !blockMatches(j, contact):
+			case blocked:
+				hidePresence(ctx, user, contact)
+			case !s.blocks(ctx, user, contact):
+				for _, pres := range globalPresence.of(user) {
+					presenceTo(ctx, pres, contact)
+				}
+			}
+		}
+	}
+
+	var push any = blocking.Unblock{Items: items}
+	if blocked {
+		push = blocking.Block{Items: items}
+	}
+	payload, err := xml.Marshal(push)
+	if err != nil {
+		return fail(err)
+	}
+	for _, dst := range globalRouter.targets(user) {
+		if dst == source {
+			continue
+		}
+		out := stanza.NewIQ(stanza.IQSet)
+		out.To = dst.RemoteAddr()
+		out.Query = payload
+		if err := sendStanza(ctx, dst, out); err != nil {
+			logError(ctx, "block list push error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+	return iq.ResultIQ()
+}
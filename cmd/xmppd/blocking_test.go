@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"slices"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/blocking"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupBlocking installs roster and blocking services over one memory store
+// for the duration of t.
+func setupBlocking(t *testing.T) storage.Storage {
+	t.Helper()
+	store := memory.New()
+	cfg := Config{Domain: "example.com"}
+	setupRoster(t, cfg, store)
+	old := globalBlocking
+	globalBlocking = newBlockingService(cfg, store)
+	t.Cleanup(func() { globalBlocking = old })
+	return store
+}
+
+func blockedJIDs(t *testing.T, p *orderedPeer) []string {
+	t.Helper()
+	reply := p.request(t, stanza.IQGet, "", `<blocklist xmlns='urn:xmpp:blocking'/>`)
+	var list blocking.BlockList
+	if err := xml.Unmarshal(reply.Query, &list); err != nil {
+		t.Fatalf("blocklist %s: %v", reply.Query, err)
+	}
+	var out []string
+	for _, item := range list.Items {
+		out = append(out, item.JID)
+	}
+	return out
+}
+
+func TestBlockMatches(t *testing.T) {
+	tests := []struct {
+		item, j string
+		want    bool
+	}{
+		{"bob@example.com", "bob@example.com/phone", true},
+		{"bob@example.com", "carol@example.com", false},
+		{"bob@example.com/phone", "bob@example.com/desk", false},
+		{"bob@example.com/phone", "bob@example.com/phone", true},
+		{"spam.example", "anyone@spam.example/x", true},
+		{"spam.example/bot", "anyone@spam.example/bot", true},
+		{"spam.example/bot", "anyone@spam.example/human", false},
+	}
+	for _, tt := range tests {
+		if got := blockMatches(jid.MustParse(tt.item), jid.MustParse(tt.j)); got != tt.want {
+			t.Errorf("blockMatches(%s, %s) = %v", tt.item, tt.j, got)
+		}
+	}
+}
+
+func TestBlockListIQ(t *testing.T) {
+	setupBlocking(t)
+	phone := newOrderedPeer(t, "alice@example.com/phone")
+	laptop := newOrderedPeer(t, "alice@example.com/laptop")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	if got := blockedJIDs(t, phone); len(got) != 0 {
+		t.Fatalf("initial list %v", got)
+	}
+	reply := phone.request(t, stanza.IQSet, "", `<block xmlns='urn:xmpp:blocking'><item jid='bob@example.com'/></block>`)
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("block: %+v", reply.Error)
+	}
+	var push blocking.Block
+	if err := xml.Unmarshal(laptop.iq(t).Query, &push); err != nil || len(push.Items) != 1 || push.Items[0].JID != "bob@example.com" {
+		t.Fatalf("push %+v: %v", push, err)
+	}
+	phone.quiet(t)
+	if got := blockedJIDs(t, laptop); !slices.Equal(got, []string{"bob@example.com"}) {
+		t.Fatalf("list %v", got)
+	}
+
+	// bob's messages bounce, and alice cannot write to bob.
+	bob.say(t, "alice@example.com", "hi")
+	if msg := bob.message(t); msg.Type != stanza.MessageError || msg.Error == nil || msg.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("bob got %+v", msg)
+	}
+	phone.quiet(t)
+	phone.say(t, "bob@example.com", "hi")
+	if msg := phone.message(t); msg.Type != stanza.MessageError {
+		t.Fatalf("alice got %+v", msg)
+	}
+	bob.quiet(t)
+	if reply := bob.request(t, stanza.IQGet, "alice@example.com/phone", `<query xmlns='jabber:iq:version'/>`); reply.Type != stanza.IQError {
+		t.Fatalf("bob's request got %+v", reply)
+	}
+
+	if reply := phone.request(t, stanza.IQSet, "", `<block xmlns='urn:xmpp:blocking'/>`); reply.Type != stanza.IQError {
+		t.Fatal("empty block accepted")
+	}
+
+	// An empty unblock clears the list.
+	if reply := phone.request(t, stanza.IQSet, "", `<unblock xmlns='urn:xmpp:blocking'/>`); reply.Type != stanza.IQResult {
+		t.Fatalf("unblock: %+v", reply.Error)
+	}
+	var unpush blocking.Unblock
+	if err := xml.Unmarshal(laptop.iq(t).Query, &unpush); err != nil || len(unpush.Items) != 0 {
+		t.Fatalf("unblock push %+v: %v", unpush, err)
+	}
+	if got := blockedJIDs(t, phone); len(got) != 0 {
+		t.Fatalf("list after unblock %v", got)
+	}
+	bob.say(t, "alice@example.com/phone", "hi again")
+	if msg := phone.message(t); msg.Body() != "hi again" {
+		t.Fatalf("alice got %+v", msg)
+	}
+}
+
+func TestBlockHidesPresence(t *testing.T) {
+	store := setupBlocking(t)
+	ctx := context.Background()
+	for _, item := range []*storage.RosterItem{
+		{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "both"},
+		{UserJID: "bob@example.com", ContactJID: "alice@example.com", Subscription: "both"},
+	} {
+		if err := store.RosterStore().UpsertRosterItem(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	available := func(p *orderedPeer) {
+		t.Helper()
+		if err := routePresence(ctx, p.session, stanza.NewPresence("")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	available(alice)
+	available(bob)
+	alice.presence(t)
+	bob.presence(t)
+
+	alice.request(t, stanza.IQSet, "", `<block xmlns='urn:xmpp:blocking'><item jid='bob@example.com'/></block>`)
+	if pres := bob.presence(t); pres.Type != stanza.PresenceUnavailable || pres.From.String() != "alice@example.com/phone" {
+		t.Fatalf("bob got %+v", pres)
+	}
+
+	// Neither broadcast crosses the block.
+	available(alice)
+	available(bob)
+	alice.quiet(t)
+	bob.quiet(t)
+
+	alice.request(t, stanza.IQSet, "", `<unblock xmlns='urn:xmpp:blocking'><item jid='bob@example.com'/></unblock>`)
+	if pres := bob.presence(t); pres.Type != "" || pres.From.String() != "alice@example.com/phone" {
+		t.Fatalf("bob got %+v after unblock", pres)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// boshPath is where the BOSH connection manager is mounted.
+const boshPath = "/http-bind"
+
+// serveBOSH serves handler at boshPath on addr until ctx is done, over
+// HTTPS when tlsConfig is set.
+func serveBOSH(ctx context.Context, addr string, handler http.Handler, tlsConfig *tls.Config) error {
+	mux := http.NewServeMux()
+	mux.Handle(boshPath, handler)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	var err error
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestBOSHSessionFeatures(t *testing.T) {
+	cfg := loadConfig()
+	cfg.Domain = "example.com"
+	store := memory.New()
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := xmpp.NewBOSHHandler(cfg.Domain, xmpp.BOSHConfig{Secure: true}, func(ctx context.Context, session *xmpp.Session) {
+		serveSession(ctx, session, cfg, nil, store)
+	})
+	defer h.Close()
+	mux := http.NewServeMux()
+	mux.Handle(boshPath, h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	body := "<body xmlns='http://jabber.org/protocol/httpbind' xmlns:xmpp='urn:xmpp:xbosh' rid='1' to='example.com' wait='60' hold='1' ver='1.11' xmpp:version='1.0'/>"
+	resp, err := http.Post(srv.URL+boshPath, "text/xml; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"sid='", "authid='", "urn:ietf:params:xml:ns:xmpp-sasl", ">SCRAM-SHA-256</mechanism>"} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("session creation response %s lacks %s", data, want)
+		}
+	}
+	if strings.Contains(string(data), "starttls") {
+		t.Fatalf("STARTTLS offered over BOSH: %s", data)
+	}
+}
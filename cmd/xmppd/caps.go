@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/caps"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalCaps holds the entity capabilities (XEP-0115, XEP-0390) advertised
+// by the available resources of local users, so PEP notifications reach
+// the resources that asked for them. The disco#info behind a verification
+// string is kept in the storage's CapsStore once verified, so a client
+// advertising capabilities seen before is not queried, even after a
+// restart. Capabilities that do not verify are ignored.
+var globalCaps = newCapsTable(nil)
+
+type capsTable struct {
+	cache   *caps.Cache
+	queries sync.WaitGroup // disco#info queries in flight
+
+	mu       sync.Mutex
+	querying map[capsQuery]bool // asked for and not answered yet
+}
+
+// capsQuery identifies a disco#info query: the node and verification
+// string it asks about.
+type capsQuery struct {
+	node string
+	key  caps.Key
+}
+
+func newCapsTable(store storage.CapsStore) *capsTable {
+	return &capsTable{
+		cache:    caps.NewCache(store),
+		querying: make(map[capsQuery]bool),
+	}
+}
+
+// update records the capabilities in the available presence pres, which
+// source sent. A verification string that is not cached is resolved with
+// a disco#info query to the resource, in the background since the reply
+// arrives on source's own stream. Once the features of the resource are
+// known, it receives the last items of the PEP nodes it is interested in.
+func (t *capsTable) update(ctx context.Context, source *xmpp.Session, pres *stanza.Presence) {
+	k, node, ok := caps.Advertised(pres)
+	if !ok {
+		t.cache.Forget(pres.From)
+		return
+	}
+	old, _ := t.cache.Advertised(pres.From)
+	t.cache.Advertise(pres.From, k)
+	_, known, err := t.cache.Info(ctx, k)
+	if err != nil {
+		logError(ctx, "caps store error", "user", pres.From, "error", err)
+	}
+
+	q := capsQuery{node: node, key: k}
+	t.mu.Lock()
+	asking := !known && !t.querying[q]
+	if asking {
+		t.querying[q] = true
+		t.queries.Add(1)
+	}
+	t.mu.Unlock()
+
+	switch {
+	case known && old != k:
+		globalPEP.sendLastItems(ctx, pres.From)
+	case asking:
+		// The query outlives the presence that caused it; it ends with
+		// source at the latest, as the request does.
+		go t.query(context.WithoutCancel(ctx), source, pres.From, q)
+	}
+}
+
+// query asks full for the disco#info behind q. Every resource advertising
+// its verification string by the time a verified answer arrives gets its
+// last items.
+func (t *capsTable) query(ctx context.Context, source *xmpp.Session, full jid.JID, q capsQuery) {
+	defer t.queries.Done()
+	info, err := discoInfo(ctx, source, full, q.node)
+	if err == nil {
+		err = t.cache.Add(ctx, q.key, info)
+	}
+	t.mu.Lock()
+	delete(t.querying, q)
+	t.mu.Unlock()
+	if err != nil {
+		logError(ctx, "caps query error", "user", full, "error", err)
+		return
+	}
+
+	for _, resource := range t.cache.Entities(q.key) {
+		globalPEP.sendLastItems(ctx, resource)
+	}
+}
+
+func discoInfo(ctx context.Context, source *xmpp.Session, full jid.JID, node string) (disco.InfoQuery, error) {
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.From = jid.MustParse(full.Domain())
+	iq.To = full
+	payload, err := xml.Marshal(disco.InfoQuery{Node: node})
+	if err != nil {
+		return disco.InfoQuery{}, err
+	}
+	iq.Query = payload
+	reply, err := source.Request(ctx, iq)
+	if err != nil {
+		return disco.InfoQuery{}, err
+	}
+	if reply.Type != stanza.IQResult {
+		return disco.InfoQuery{}, fmt.Errorf("caps: disco#info %s: %s", node, reply.Type)
+	}
+	var info disco.InfoQuery
+	err = xml.Unmarshal(reply.Query, &info)
+	return info, err
+}
+
+// wait returns once the disco#info queries in flight have ended.
+func (t *capsTable) wait() {
+	t.queries.Wait()
+}
+
+// remove forgets the capabilities of full, which went offline. The
+// disco#info of its verification string stays cached for other resources.
+func (t *capsTable) remove(full jid.JID) {
+	t.cache.Forget(full)
+}
+
+// wants reports whether the resource full advertises feature.
+func (t *capsTable) wants(full jid.JID, feature string) bool {
+	return t.cache.HasFeature(full, feature)
+}
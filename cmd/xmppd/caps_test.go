@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/caps"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/hash"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupCaps installs a caps table over a fresh store for the duration of
+// t, after setupPEP, and returns the store.
+func setupCaps(t *testing.T) storage.CapsStore {
+	t.Helper()
+	store := memory.New().CapsStore()
+	globalCaps = newCapsTable(store)
+	return store
+}
+
+// online2 sends available presence advertising the XEP-0390 capabilities
+// of info.
+func (p *orderedPeer) online2(t *testing.T, info disco.InfoQuery) {
+	t.Helper()
+	c, err := caps.Generate2(info, hash.AlgoSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ext stanza.Extension
+	if err := xml.Unmarshal(data, &ext); err != nil {
+		t.Fatal(err)
+	}
+	pres := stanza.NewPresence("")
+	pres.Extensions = []stanza.Extension{ext}
+	if err := routePresence(context.Background(), p.session, pres); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+}
+
+func TestCapsStoredNotQueried(t *testing.T) {
+	setupPEP(t)
+	store := setupCaps(t)
+	interested := clientInfo("http://jabber.org/protocol/caps", avatarNode+"+notify")
+	ver, _ := caps.Hash("sha-1", interested)
+	if err := caps.NewCache(store).Add(context.Background(), caps.Key{NS: "http://jabber.org/protocol/caps", Algo: "sha-1", Ver: ver}, interested); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	if reply := publishAvatar(t, alice, "v1", ""); reply.Type != stanza.IQResult {
+		t.Fatalf("publish: %+v", reply.Error)
+	}
+
+	// Capabilities verified before, by another process or before a
+	// restart, are not asked for.
+	bob.online(t, interested)
+	if _, items := bob.event(t); items.Items[0].ID != "v1" {
+		t.Fatalf("last item %+v", items)
+	}
+}
+
+func TestCapsVerifiedBeforeStored(t *testing.T) {
+	setupPEP(t)
+	store := setupCaps(t)
+	interested := clientInfo("http://jabber.org/protocol/caps", avatarNode+"+notify")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	// bob answers with features other than those he advertised.
+	bob.online(t, interested)
+	bob.answerCaps(t, clientInfo("http://jabber.org/protocol/caps", "urn:xmpp:bookmarks:1+notify"))
+	bob.quietAfterPresence(t)
+	if globalCaps.wants(jid.MustParse("bob@example.com/desk"), "urn:xmpp:bookmarks:1+notify") {
+		t.Fatal("features not matching the verification string were used")
+	}
+	ver, _ := caps.Hash("sha-1", interested)
+	if _, err := store.GetCapsInfo(context.Background(), "http://jabber.org/protocol/caps#sha-1."+ver); err != storage.ErrNotFound {
+		t.Fatalf("GetCapsInfo: %v", err)
+	}
+}
+
+func TestCaps2(t *testing.T) {
+	setupPEP(t)
+	store := setupCaps(t)
+	interested := clientInfo("urn:xmpp:caps", avatarNode+"+notify")
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	if reply := publishAvatar(t, alice, "v1", ""); reply.Type != stanza.IQResult {
+		t.Fatalf("publish: %+v", reply.Error)
+	}
+
+	bob.online2(t, interested)
+	iq := bob.skipPresence(t).(*stanza.IQ)
+	h, _ := caps.Hash2(hash.AlgoSHA256, interested)
+	var q disco.InfoQuery
+	if xml.Unmarshal(iq.Query, &q) != nil || q.Node != "urn:xmpp:caps#sha-256."+h.Value {
+		t.Fatalf("caps query %s", iq.Query)
+	}
+	info := interested
+	info.Node = q.Node
+	reply := payloadIQ(iq, info)
+	reply.From, reply.To = bob.session.RemoteAddr(), iq.From
+	if !bob.session.ResolveRequest(reply) {
+		t.Fatal("caps reply not matched")
+	}
+	if _, items := bob.event(t); items.Items[0].ID != "v1" {
+		t.Fatalf("last item %+v", items)
+	}
+	if _, err := store.GetCapsInfo(context.Background(), q.Node); err != nil {
+		t.Fatalf("GetCapsInfo: %v", err)
+	}
+}
+
+func TestCapsQueriedOnce(t *testing.T) {
+	setupPEP(t)
+	setupCaps(t)
+	interested := clientInfo("http://jabber.org/protocol/caps", avatarNode+"+notify")
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	if reply := publishAvatar(t, alice, "v1", ""); reply.Type != stanza.IQResult {
+		t.Fatalf("publish: %+v", reply.Error)
+	}
+
+	// A second presence before the answer does not ask again.
+	bob.online(t, interested)
+	bob.online(t, interested)
+	bob.answerCaps(t, interested)
+	if _, items := bob.event(t); items.Items[0].ID != "v1" {
+		t.Fatalf("last item %+v", items)
+	}
+	bob.quietAfterPresence(t)
+}
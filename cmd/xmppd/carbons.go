@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/carbons"
+	"github.com/meszmate/xmpp-go/plugins/forward"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// globalCarbons holds the sessions that enabled XEP-0280 Message Carbons.
+var globalCarbons = newCarbonTable()
+
+type carbonTable struct {
+	mu      sync.RWMutex
+	enabled map[*xmpp.Session]bool
+}
+
+func newCarbonTable() *carbonTable {
+	return &carbonTable{enabled: make(map[*xmpp.Session]bool)}
+}
+
+func (t *carbonTable) set(session *xmpp.Session, on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if on {
+		t.enabled[session] = true
+	} else {
+		delete(t.enabled, session)
+	}
+}
+
+func (t *carbonTable) isEnabled(session *xmpp.Session) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.enabled[session]
+}
+
+// forget drops the state of a session that has ended.
+func (t *carbonTable) forget(session *xmpp.Session) { t.set(session, false) }
+
+// answerCarbons returns the reply to a request from source to enable or
+// disable carbons, or nil when iq is not one.
+func answerCarbons(source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	var on bool
+	if err := xml.Unmarshal(iq.Query, &carbons.Enable{}); err == nil {
+		on = true
+	} else if err := xml.Unmarshal(iq.Query, &carbons.Disable{}); err != nil {
+		return nil
+	}
+	if iq.Type != stanza.IQSet {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "carbons are toggled with a set"))
+	}
+	globalCarbons.set(source, on)
+	return iq.ResultIQ()
+}
+
+// sendCarbons delivers a <sent/> copy of msg, sent by source, to the other
+// resources of the sender that enabled carbons (XEP-0280 §6).
+func sendCarbons(ctx context.Context, source *xmpp.Session, msg *stanza.Message) {
+	sender := source.RemoteAddr()
+	if !carbonEligible(msg) || msg.To.Bare().Equal(sender.Bare()) {
+		return
+	}
+	var sent []byte
+	for _, dst := range globalRouter.targets(sender.Bare()) {
+		if dst == source || !globalCarbons.isEnabled(dst) {
+			continue
+		}
+		if sent == nil {
+			var err error
+			if sent, err = sentCopy(msg); err != nil {
+				logError(ctx, "carbon copy error", "user", sender, "error", err)
+				return
+			}
+		}
+		carbon := stanza.NewMessage(msg.Type)
+		carbon.From = sender.Bare()
+		carbon.To = dst.RemoteAddr()
+		carbon.Extensions = []stanza.Extension{{
+			XMLName: xml.Name{Space: ns.Carbons, Local: "sent"},
+			Inner:   sent,
+		}}
+		if err := sendStanza(ctx, dst, carbon); err != nil {
+			logError(ctx, "carbon route error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+}
+
+// sentCopy returns msg wrapped in the <forwarded/> element a <sent/> holds.
+func sentCopy(msg *stanza.Message) ([]byte, error) {
+	orig := *msg
+	orig.XMLName = xml.Name{Space: ns.Client, Local: "message"}
+	inner, err := xml.Marshal(&orig)
+	if err != nil {
+		return nil, err
+	}
+	return xml.Marshal(forward.Forwarded{Inner: inner})
+}
+
+// carbonEligible reports whether msg is copied to the sender's other
+// resources: chat messages and normal messages with a body, unless marked
+// private or no-copy, or already a carbon.
+func carbonEligible(msg *stanza.Message) bool {
+	switch msg.Type {
+	case stanza.MessageChat:
+	case stanza.MessageNormal, "":
+		if len(msg.Bodies) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, ext := range msg.Extensions {
+		switch ext.XMLName {
+		case xml.Name{Space: ns.Carbons, Local: "private"},
+			xml.Name{Space: ns.Carbons, Local: "sent"},
+			xml.Name{Space: ns.Carbons, Local: "received"},
+			xml.Name{Space: ns.Hints, Local: "no-copy"}:
+			return false
+		}
+	}
+	return true
+}
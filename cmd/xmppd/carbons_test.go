@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/carbons"
+	"github.com/meszmate/xmpp-go/plugins/forward"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// messagePeer connects a routed resource and returns the messages it receives.
+func messagePeer(t *testing.T, full string) (*xmpp.Session, <-chan stanza.Message) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	addr := jid.MustParse(full)
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(addr))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	msgs := make(chan stanza.Message, 8)
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			var msg stanza.Message
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	globalRouter.register(addr, session)
+	t.Cleanup(func() {
+		globalRouter.unregister(addr)
+		globalCarbons.forget(session)
+		session.Close()
+		c2.Close()
+	})
+	return session, msgs
+}
+
+func receiveMessage(t *testing.T, msgs <-chan stanza.Message) stanza.Message {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return stanza.Message{}
+	}
+}
+
+func expectNoMessage(t *testing.T, msgs <-chan stanza.Message) {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func enableCarbons(t *testing.T, session *xmpp.Session) {
+	t.Helper()
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = []byte(`<enable xmlns="urn:xmpp:carbons:2"/>`)
+	if reply := answerCarbons(session, iq); reply == nil || reply.Type != stanza.IQResult {
+		t.Fatalf("enable carbons: %+v", reply)
+	}
+}
+
+// sentMessage returns the message forwarded in the <sent/> carbon c.
+func sentMessage(t *testing.T, c stanza.Message) stanza.Message {
+	t.Helper()
+	for _, ext := range c.Extensions {
+		if ext.XMLName.Local != "sent" {
+			continue
+		}
+		data, err := xml.Marshal(ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent carbons.Sent
+		var fwd forward.Forwarded
+		var msg stanza.Message
+		if err := xml.Unmarshal(data, &sent); err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(sent.Forwarded, &fwd); err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(fwd.Inner, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	t.Fatalf("no <sent/> in %+v", c)
+	return stanza.Message{}
+}
+
+func TestSentCarbons(t *testing.T) {
+	ctx := context.Background()
+	phone, phoneMsgs := messagePeer(t, "alice@example.com/phone")
+	laptop, laptopMsgs := messagePeer(t, "alice@example.com/laptop")
+	_, tabletMsgs := messagePeer(t, "alice@example.com/tablet")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+	enableCarbons(t, phone)
+	enableCarbons(t, laptop)
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse("bob@example.com")
+	msg.SetBody("hi bob")
+	if err := routeMessage(ctx, phone, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+
+	if got := receiveMessage(t, bobMsgs); got.Body() != "hi bob" {
+		t.Fatalf("bob received %q", got.Body())
+	}
+	carbon := receiveMessage(t, laptopMsgs)
+	if carbon.From.String() != "alice@example.com" || carbon.To.String() != "alice@example.com/laptop" {
+		t.Fatalf("carbon from %s to %s", carbon.From, carbon.To)
+	}
+	sent := sentMessage(t, carbon)
+	if sent.ID != msg.ID || sent.From.String() != "alice@example.com/phone" || sent.To.String() != "bob@example.com" || sent.Body() != "hi bob" {
+		t.Fatalf("forwarded message %+v", sent)
+	}
+	// The sending resource and resources without carbons get no copy.
+	expectNoMessage(t, phoneMsgs)
+	expectNoMessage(t, tabletMsgs)
+}
+
+func TestSentCarbonsSkipped(t *testing.T) {
+	ctx := context.Background()
+	phone, _ := messagePeer(t, "alice@example.com/phone")
+	laptop, laptopMsgs := messagePeer(t, "alice@example.com/laptop")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+	enableCarbons(t, laptop)
+
+	private := stanza.NewMessage(stanza.MessageChat)
+	private.To = jid.MustParse("bob@example.com")
+	private.SetBody("just for bob")
+	private.Extensions = []stanza.Extension{{XMLName: xml.Name{Space: "urn:xmpp:carbons:2", Local: "private"}}}
+	headline := stanza.NewMessage(stanza.MessageHeadline)
+	headline.To = jid.MustParse("bob@example.com")
+	headline.SetBody("news")
+	for _, msg := range []*stanza.Message{private, headline} {
+		if err := routeMessage(ctx, phone, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+		receiveMessage(t, bobMsgs)
+	}
+	expectNoMessage(t, laptopMsgs)
+
+	disable := stanza.NewIQ(stanza.IQSet)
+	disable.Query = []byte(`<disable xmlns="urn:xmpp:carbons:2"/>`)
+	if reply := answerCarbons(laptop, disable); reply == nil || reply.Type != stanza.IQResult {
+		t.Fatalf("disable carbons: %+v", reply)
+	}
+	chat := stanza.NewMessage(stanza.MessageChat)
+	chat.To = jid.MustParse("bob@example.com")
+	chat.SetBody("hi")
+	if err := routeMessage(ctx, phone, chat); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+	receiveMessage(t, bobMsgs)
+	expectNoMessage(t, laptopMsgs)
+}
+
+func TestAnswerCarbons(t *testing.T) {
+	session, _ := messagePeer(t, "alice@example.com/phone")
+	get := stanza.NewIQ(stanza.IQGet)
+	get.Query = []byte(`<enable xmlns="urn:xmpp:carbons:2"/>`)
+	if reply := answerCarbons(session, get); reply == nil || reply.Type != stanza.IQError {
+		t.Fatalf("get enable: %+v", reply)
+	}
+	other := stanza.NewIQ(stanza.IQSet)
+	other.Query = []byte(`<query xmlns="jabber:iq:version"/>`)
+	if reply := answerCarbons(session, other); reply != nil {
+		t.Fatalf("answered a non-carbons iq: %+v", reply)
+	}
+	if globalCarbons.isEnabled(session) {
+		t.Fatal("carbons enabled by an invalid request")
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	redislib "github.com/redis/go-redis/v9"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/cache"
+)
+
+// globalCluster links this node to the other xmppd nodes of a cluster, so
+// that stanzas reach sessions bound on any of them. It is nil unless
+// XMPP_CLUSTER_NODE is set.
+var globalCluster *cluster
+
+// clusterNS is the namespace of the inter-node stream.
+const clusterNS = "urn:xmppd:cluster"
+
+// clusterDialTimeout bounds the requests to the bus and the handshake of a
+// stream from another node.
+const clusterDialTimeout = 5 * time.Second
+
+// clusterSendTimeout bounds connecting and writing to another node, which
+// happens while a stanza is routed. A node that could not be reached is not
+// dialed again for clusterRetryDelay; stanzas for it fail at once.
+const (
+	clusterSendTimeout = time.Second
+	clusterRetryDelay  = 2 * time.Second
+)
+
+// defaultClusterHeartbeat is how often a node tells the others it is
+// alive. A node not heard from for clusterMissedBeats heartbeats is taken
+// for gone, with its sessions.
+const (
+	defaultClusterHeartbeat = 5 * time.Second
+	clusterMissedBeats      = 3
+)
+
+// clusterEvent announces that a session was bound on a node, or ended.
+type clusterEvent struct {
+	Node string `json:"node"`
+	Addr string `json:"addr"` // where the node takes forwarded stanzas
+	JID  string `json:"jid"`
+	Up   bool   `json:"up"`
+	// Beat, when set, only tells the other nodes that the node is alive.
+	Beat bool `json:"beat,omitempty"`
+	// Cache, when set, makes the event tell the other nodes that the
+	// node wrote the data of this kind of the user JID, so that they drop
+	// it from their storage caches. It is not recorded for Sessions.
+	Cache cache.Kind `json:"cache,omitempty"`
+}
+
+// clusterBus carries the session registrations of the nodes of a cluster.
+type clusterBus interface {
+	// Publish announces ev to every node and records it for Sessions.
+	Publish(ctx context.Context, ev clusterEvent) error
+	// Heartbeat records that the node of ev is alive for ttl and announces
+	// ev to every node.
+	Heartbeat(ctx context.Context, ev clusterEvent, ttl time.Duration) error
+	// Sessions returns the recorded sessions of the nodes that are alive.
+	Sessions(ctx context.Context) ([]clusterEvent, error)
+	// Subscribe calls fn with the events published from now on, until ctx
+	// is done. It returns once the subscription is in place.
+	Subscribe(ctx context.Context, fn func(clusterEvent)) error
+}
+
+// cluster routes stanzas to the sessions of the other nodes. Each node
+// publishes the sessions it binds on the bus and keeps a table of the
+// sessions of the others; stanzas for those are forwarded over a stream
+// to the node holding the session, which delivers them locally. The nodes
+// send heartbeats, and the sessions of a node that stops are dropped.
+type cluster struct {
+	node      string
+	addr      string // the address advertised to the other nodes
+	secret    string
+	tls       *tls.Config // for the streams between nodes, nil without TLS
+	heartbeat time.Duration
+	bus       clusterBus
+	ln        net.Listener
+	clock     clock.Clock
+	// receive delivers a stanza forwarded by another node.
+	receive func(ctx context.Context, to jid.JID, st stanza.Stanza)
+
+	mu     sync.RWMutex
+	remote map[string]map[string]string // bare JID -> full JID -> node address
+	seen   map[string]time.Time         // node address -> last heard from
+	peers  map[string]*clusterPeer      // by node address
+}
+
+func newCluster(cfg Config) (*cluster, error) {
+	if cfg.ClusterNode == "" {
+		return nil, nil
+	}
+	if cfg.ClusterRedis == "" {
+		return nil, errors.New("XMPP_CLUSTER_REDIS is required")
+	}
+	opts, err := redislib.ParseURL(cfg.ClusterRedis)
+	if err != nil {
+		return nil, err
+	}
+	return listenCluster(cfg, &redisBus{client: redislib.NewClient(opts)})
+}
+
+// listenCluster listens at cfg.ClusterAddr for the stanzas other nodes
+// forward; the cluster joins with start.
+func listenCluster(cfg Config, bus clusterBus) (*cluster, error) {
+	if cfg.ClusterSecret == "" {
+		return nil, errors.New("XMPP_CLUSTER_SECRET is required")
+	}
+	tlsConfig, err := clusterTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", cfg.ClusterAddr)
+	if err != nil {
+		return nil, err
+	}
+	addr := cfg.ClusterAdvertise
+	if addr == "" {
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		addr = net.JoinHostPort(cfg.ClusterNode, port)
+	}
+	c := &cluster{
+		node:      cfg.ClusterNode,
+		addr:      addr,
+		secret:    cfg.ClusterSecret,
+		tls:       tlsConfig,
+		heartbeat: cmp.Or(cfg.ClusterHeartbeat, defaultClusterHeartbeat),
+		bus:       bus,
+		ln:        ln,
+		clock:     clock.System,
+		remote:    make(map[string]map[string]string),
+		seen:      make(map[string]time.Time),
+		peers:     make(map[string]*clusterPeer),
+	}
+	c.receive = c.deliverForwarded
+	return c, nil
+}
+
+// clusterTLSConfig loads the certificate of the node and the CA that
+// issued those of all nodes, with which the nodes authenticate each other.
+// It returns nil when XMPP_CLUSTER_TLS_CERT is not set.
+func clusterTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.ClusterTLSCert == "" {
+		return nil, nil
+	}
+	if cfg.ClusterTLSKey == "" || cfg.ClusterTLSCA == "" {
+		return nil, errors.New("XMPP_CLUSTER_TLS_CERT needs XMPP_CLUSTER_TLS_KEY and XMPP_CLUSTER_TLS_CA")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.ClusterTLSCert, cfg.ClusterTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(cfg.ClusterTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", cfg.ClusterTLSCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// start subscribes to the bus, learns the sessions of the other nodes and
+// takes forwarded stanzas until ctx is done. The sessions this node
+// recorded before a restart are withdrawn.
+func (c *cluster) start(ctx context.Context) error {
+	if err := c.bus.Subscribe(ctx, c.apply); err != nil {
+		return err
+	}
+	if err := c.beat(ctx); err != nil {
+		return err
+	}
+	sessions, err := c.bus.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ev := range sessions {
+		if ev.Node == c.node {
+			ev.Up = false
+			if err := c.bus.Publish(ctx, ev); err != nil {
+				return err
+			}
+			continue
+		}
+		c.apply(ev)
+	}
+	go c.keepAlive(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = c.ln.Close()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, p := range c.peers {
+			p.close()
+		}
+	}()
+	go c.serve(ctx)
+	return nil
+}
+
+// ttl is how long a node that is not heard from is taken to be alive.
+func (c *cluster) ttl() time.Duration {
+	return clusterMissedBeats * c.heartbeat
+}
+
+// beat tells the other nodes that this one is alive.
+func (c *cluster) beat(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterDialTimeout)
+	defer cancel()
+	return c.bus.Heartbeat(ctx, clusterEvent{Node: c.node, Addr: c.addr, Beat: true}, c.ttl())
+}
+
+// keepAlive sends the heartbeats of this node and drops the sessions of the
+// nodes that stopped sending theirs, until ctx is done.
+func (c *cluster) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.beat(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("cluster heartbeat error", "error", err)
+		}
+		c.reap()
+	}
+}
+
+// reap drops the sessions of the nodes not heard from for ttl, which
+// crashed or lost the bus, so their users are offline again.
+func (c *cluster) reap() {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, seen := range c.seen {
+		if now.Sub(seen) <= c.ttl() {
+			continue
+		}
+		delete(c.seen, addr)
+		for bare, sessions := range c.remote {
+			for full, at := range sessions {
+				if at == addr {
+					delete(sessions, full)
+				}
+			}
+			if len(sessions) == 0 {
+				delete(c.remote, bare)
+			}
+		}
+		slog.Warn("cluster node gone", "addr", addr)
+	}
+}
+
+// reload learns the sessions of node again, which was heard from after
+// it was taken for gone.
+func (c *cluster) reload(node string) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterDialTimeout)
+	defer cancel()
+	sessions, err := c.bus.Sessions(ctx)
+	if err != nil {
+		slog.Error("cluster sessions error", "node", node, "error", err)
+		return
+	}
+	for _, ev := range sessions {
+		if ev.Node == node {
+			c.apply(ev)
+		}
+	}
+}
+
+// apply records a session of another node, or that the node is alive.
+func (c *cluster) apply(ev clusterEvent) {
+	if ev.Node == c.node {
+		return
+	}
+	if ev.Beat {
+		c.mu.Lock()
+		_, known := c.seen[ev.Addr]
+		c.seen[ev.Addr] = c.clock.Now()
+		c.mu.Unlock()
+		if !known {
+			go c.reload(ev.Node)
+		}
+		return
+	}
+	if ev.Cache != "" {
+		if globalStorageCache != nil {
+			globalStorageCache.Invalidate(ev.Cache, ev.JID)
+		}
+		return
+	}
+	full, err := jid.Parse(ev.JID)
+	if err != nil {
+		return
+	}
+	bare := full.Bare().String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[ev.Addr] = c.clock.Now()
+	if !ev.Up {
+		// Only the node holding the session withdraws it, in case the
+		// resource was bound again on another node in the meantime.
+		if c.remote[bare][ev.JID] == ev.Addr {
+			delete(c.remote[bare], ev.JID)
+			if len(c.remote[bare]) == 0 {
+				delete(c.remote, bare)
+			}
+		}
+		return
+	}
+	if c.remote[bare] == nil {
+		c.remote[bare] = make(map[string]string)
+	}
+	c.remote[bare][ev.JID] = ev.Addr
+}
+
+// announce tells the other nodes that the session of full was bound here,
+// or ended.
+func (c *cluster) announce(full jid.JID, up bool) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterDialTimeout)
+	defer cancel()
+	if err := c.bus.Publish(ctx, clusterEvent{Node: c.node, Addr: c.addr, JID: full.String(), Up: up}); err != nil {
+		slog.Error("cluster announce error", "jid", full, "error", err)
+	}
+}
+
+// invalidate tells the other nodes that this one wrote the data of kind of
+// user, which their storage caches must drop.
+func (c *cluster) invalidate(kind cache.Kind, user string) {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterDialTimeout)
+	defer cancel()
+	if err := c.bus.Publish(ctx, clusterEvent{Node: c.node, JID: user, Cache: kind}); err != nil {
+		slog.Error("cluster cache invalidation error", "kind", kind, "user", user, "error", err)
+	}
+}
+
+// nodes returns the addresses of the other nodes holding a session of to:
+// the one of a full JID, or any resource of a bare JID.
+func (c *cluster) nodes(to jid.JID) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sessions := c.remote[to.Bare().String()]
+	if to.IsFull() {
+		if addr, ok := sessions[to.String()]; ok {
+			return []string{addr}
+		}
+		return nil
+	}
+	var out []string
+	for _, addr := range sessions {
+		if !slices.Contains(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// online reports whether bare has a session on another node.
+func (c *cluster) online(bare jid.JID) bool {
+	return c != nil && len(c.nodes(bare.Bare())) > 0
+}
+
+// forward sends st to the sessions of to on the other nodes and reports
+// whether it reached any. A message that reached none, because the nodes
+// holding the sessions could not be reached, is to be kept offline.
+func (c *cluster) forward(ctx context.Context, to jid.JID, st stanza.Stanza) bool {
+	if c == nil || to.IsZero() {
+		return false
+	}
+	sent := false
+	for _, addr := range c.nodes(to) {
+		if err := c.peer(addr).send(ctx, to, st); err != nil {
+			logError(ctx, "cluster forward error", "node", addr, "to", to, "error", err)
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
+
+func (c *cluster) peer(addr string) *clusterPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.peers[addr]
+	if p == nil {
+		p = &clusterPeer{addr: addr, node: c.node, secret: c.secret, tls: c.tls, clock: c.clock}
+		c.peers[addr] = p
+	}
+	return p
+}
+
+// serve takes the streams of the other nodes until the listener closes.
+func (c *cluster) serve(ctx context.Context) {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			return
+		}
+		if c.tls != nil {
+			conn = tls.Server(conn, c.tls)
+		}
+		go func() {
+			defer conn.Close()
+			if err := c.readStream(ctx, conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("cluster stream error", "remote", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+// readStream reads the stanzas another node forwards on conn, after it
+// proved that it knows the cluster secret. The secret itself never crosses
+// the network: each side answers a random challenge of the other with an
+// HMAC of it (see clusterMAC).
+//
+//	listener: <cluster xmlns='urn:xmppd:cluster' nonce='N1'>
+//	dialer:   <cluster xmlns='urn:xmppd:cluster' node='a' nonce='N2' mac='MAC(dialer, N1, a)'>
+//	listener: <ready mac='MAC(listener, N2)'/>
+func (c *cluster) readStream(ctx context.Context, conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(clusterDialTimeout))
+	challenge, err := clusterNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "<cluster xmlns='"+clusterNS+"' nonce='"+challenge+"'>"); err != nil {
+		return err
+	}
+	dec := xml.NewDecoder(conn)
+	start, err := nextStart(dec)
+	if err != nil {
+		return err
+	}
+	node, nonce := xmlAttr(start.Attr, "node"), xmlAttr(start.Attr, "nonce")
+	mac, _ := hex.DecodeString(xmlAttr(start.Attr, "mac"))
+	if start.Name != (xml.Name{Space: clusterNS, Local: "cluster"}) || nonce == "" ||
+		!hmac.Equal(mac, c.mac("dialer", challenge, node)) {
+		return fmt.Errorf("node %q refused", node)
+	}
+	if _, err := io.WriteString(conn, "<ready mac='"+hex.EncodeToString(c.mac("listener", nonce))+"'/>"); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	for {
+		route, err := nextStart(dec)
+		if err != nil {
+			return err
+		}
+		to, err := jid.Parse(xmlAttr(route.Attr, "to"))
+		if route.Name.Local != "route" || err != nil {
+			return fmt.Errorf("unexpected <%s/>", route.Name.Local)
+		}
+		inner, err := nextStart(dec)
+		if err != nil {
+			return err
+		}
+		var st stanza.Stanza
+		switch inner.Name.Local {
+		case "message":
+			st = &stanza.Message{}
+		case "presence":
+			st = &stanza.Presence{}
+		case "iq":
+			st = &stanza.IQ{}
+		default:
+			return fmt.Errorf("unexpected <%s/>", inner.Name.Local)
+		}
+		if err := dec.DecodeElement(st, &inner); err != nil {
+			return err
+		}
+		if err := dec.Skip(); err != nil { // the rest of <route/>
+			return err
+		}
+		c.receive(ctx, to, st)
+	}
+}
+
+// deliverForwarded delivers a stanza another node forwarded to the local
+// sessions of to. Broadcast presence goes to the available resources, and
+// probes are answered with the presence of the local ones.
+func (c *cluster) deliverForwarded(ctx context.Context, to jid.JID, st stanza.Stanza) {
+	pres, ok := st.(*stanza.Presence)
+	switch {
+	case ok && pres.Type == stanza.PresenceProbe:
+		answerClusterProbe(ctx, pres, to)
+	case ok && to.Resource() == "" && (pres.Type == "" || pres.Type == stanza.PresenceUnavailable):
+		for _, dst := range globalPresence.available(to) {
+			sendTo(ctx, dst, pres)
+		}
+	default:
+		deliverLocal(ctx, to, st)
+	}
+}
+
+// answerClusterProbe sends the resource on another node that sent probe
+// the presence of the local resources of user, provided they are its
+// siblings or the user's roster lets it see them.
+func answerClusterProbe(ctx context.Context, probe *stanza.Presence, user jid.JID) {
+	prober := probe.From
+	if !prober.Bare().Equal(user.Bare()) {
+		allowed, err := globalRoster.sendsPresenceTo(ctx, user.Bare(), prober.Bare())
+		if err != nil {
+			logError(ctx, "presence probe error", "user", user, "error", err)
+			return
+		}
+		if !allowed {
+			return
+		}
+	}
+	for _, pres := range globalPresence.of(user.Bare()) {
+		globalCluster.forward(ctx, prober, pres)
+	}
+}
+
+// probeCluster asks the other nodes for the presence of the resources of
+// contact they hold, for the new resource full.
+func probeCluster(ctx context.Context, full, contact jid.JID) {
+	if globalCluster == nil {
+		return
+	}
+	probe := stanza.NewPresence(stanza.PresenceProbe)
+	probe.From, probe.To = full, contact
+	globalCluster.forward(ctx, contact, probe)
+}
+
+// mac returns the HMAC-SHA256 with the cluster secret of role and fields,
+// by which a node answers the challenge of another.
+func (c *cluster) mac(role string, fields ...string) []byte {
+	return clusterMAC(c.secret, role, fields...)
+}
+
+func clusterMAC(secret, role string, fields ...string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(h, strings.Join(append([]string{clusterNS, role}, fields...), "\x00"))
+	return h.Sum(nil)
+}
+
+func clusterNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// clusterPeer is the stream to another node, opened on first use and
+// again after it broke.
+type clusterPeer struct {
+	addr, node, secret string
+	tls                *tls.Config
+	clock              clock.Clock
+
+	mu      sync.Mutex
+	conn    net.Conn
+	retryAt time.Time // when a node that could not be reached is dialed again
+}
+
+func (p *clusterPeer) send(ctx context.Context, to jid.JID, st stanza.Stanza) error {
+	data, err := xml.Marshal(st)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("<route to='")
+	_ = xml.EscapeText(&b, []byte(to.String()))
+	b.WriteString("'>")
+	b.Write(data)
+	b.WriteString("</route>")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A stream that broke since the last stanza is only noticed on
+	// writing, so one failed write is retried on a new stream.
+	for attempt := 0; ; attempt++ {
+		if p.conn == nil {
+			if p.clock.Now().Before(p.retryAt) {
+				return errors.New("node unreachable")
+			}
+			if err := p.dial(ctx); err != nil {
+				p.retryAt = p.clock.Now().Add(clusterRetryDelay)
+				return err
+			}
+		}
+		_ = p.conn.SetWriteDeadline(time.Now().Add(clusterSendTimeout))
+		_, err := io.WriteString(p.conn, b.String())
+		if err == nil {
+			return nil
+		}
+		p.conn.Close()
+		p.conn = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// dial opens the stream to the node and answers its challenge, within
+// clusterSendTimeout.
+func (p *clusterPeer) dial(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterSendTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	if p.tls != nil {
+		config := p.tls.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(p.addr)
+		conn = tls.Client(conn, config)
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if err := p.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	p.conn = conn
+	return nil
+}
+
+// handshake is the dialer's side of the exchange readStream describes.
+func (p *clusterPeer) handshake(conn net.Conn) error {
+	dec := xml.NewDecoder(conn)
+	start, err := nextStart(dec)
+	if err != nil {
+		return err
+	}
+	challenge := xmlAttr(start.Attr, "nonce")
+	if start.Name != (xml.Name{Space: clusterNS, Local: "cluster"}) || challenge == "" {
+		return errors.New("not a cluster node")
+	}
+	nonce, err := clusterNonce()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("<cluster xmlns='" + clusterNS + "' node='")
+	_ = xml.EscapeText(&b, []byte(p.node))
+	b.WriteString("' nonce='" + nonce + "' mac='" + hex.EncodeToString(clusterMAC(p.secret, "dialer", challenge, p.node)) + "'>")
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return err
+	}
+	ready, err := nextStart(dec)
+	if err != nil {
+		return err
+	}
+	mac, _ := hex.DecodeString(xmlAttr(ready.Attr, "mac"))
+	if ready.Name.Local != "ready" || !hmac.Equal(mac, clusterMAC(p.secret, "listener", nonce)) {
+		return errors.New("node does not know the cluster secret")
+	}
+	return nil
+}
+
+func (p *clusterPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		_ = p.conn.SetWriteDeadline(time.Now().Add(clusterSendTimeout))
+		_, _ = io.WriteString(p.conn, "</cluster>")
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// redisBus is the clusterBus on Redis: the sessions are kept in a hash and
+// the events published on a channel.
+type redisBus struct {
+	client *redislib.Client
+}
+
+const (
+	redisClusterSessions = "xmppd:cluster:sessions"
+	redisClusterChannel  = "xmppd:cluster:events"
+	// redisClusterNode prefixes the key each node keeps alive with its
+	// heartbeats; the sessions of a node without one are gone.
+	redisClusterNode = "xmppd:cluster:node:"
+)
+
+func (b *redisBus) Publish(ctx context.Context, ev clusterEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	// The field names the node too, so that a node withdrawing a session
+	// never removes the same resource bound since on another node.
+	if ev.Cache != "" {
+		return b.client.Publish(ctx, redisClusterChannel, data).Err()
+	}
+	field := ev.Node + " " + ev.JID
+	_, err = b.client.TxPipelined(ctx, func(pipe redislib.Pipeliner) error {
+		if ev.Up {
+			pipe.HSet(ctx, redisClusterSessions, field, data)
+		} else {
+			pipe.HDel(ctx, redisClusterSessions, field)
+		}
+		pipe.Publish(ctx, redisClusterChannel, data)
+		return nil
+	})
+	return err
+}
+
+func (b *redisBus) Heartbeat(ctx context.Context, ev clusterEvent, ttl time.Duration) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.TxPipelined(ctx, func(pipe redislib.Pipeliner) error {
+		pipe.Set(ctx, redisClusterNode+ev.Node, ev.Addr, ttl)
+		pipe.Publish(ctx, redisClusterChannel, data)
+		return nil
+	})
+	return err
+}
+
+// Sessions returns the recorded sessions of the nodes whose heartbeat key
+// is still there, and deletes those of the others.
+func (b *redisBus) Sessions(ctx context.Context) ([]clusterEvent, error) {
+	fields, err := b.client.HGetAll(ctx, redisClusterSessions).Result()
+	if err != nil {
+		return nil, err
+	}
+	alive := make(map[string]*redislib.IntCmd)
+	events := make(map[string]clusterEvent, len(fields))
+	for field, data := range fields {
+		var ev clusterEvent
+		if json.Unmarshal([]byte(data), &ev) == nil {
+			events[field] = ev
+			alive[ev.Node] = nil
+		}
+	}
+	if _, err := b.client.Pipelined(ctx, func(pipe redislib.Pipeliner) error {
+		for node := range alive {
+			alive[node] = pipe.Exists(ctx, redisClusterNode+node)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	out := make([]clusterEvent, 0, len(events))
+	var gone []string
+	for field, ev := range events {
+		if alive[ev.Node].Val() == 0 {
+			gone = append(gone, field)
+			continue
+		}
+		out = append(out, ev)
+	}
+	if len(gone) > 0 {
+		if err := b.client.HDel(ctx, redisClusterSessions, gone...).Err(); err != nil {
+			slog.Warn("cluster session cleanup error", "error", err)
+		}
+	}
+	return out, nil
+}
+
+func (b *redisBus) Subscribe(ctx context.Context, fn func(clusterEvent)) error {
+	sub := b.client.Subscribe(ctx, redisClusterChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var ev clusterEvent
+				if json.Unmarshal([]byte(msg.Payload), &ev) == nil {
+					fn(ev)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func nextStart(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+func xmlAttr(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
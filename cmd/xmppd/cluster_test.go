@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/cache"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// memoryBus is a clusterBus shared by the nodes of a test.
+type memoryBus struct {
+	mu       sync.Mutex
+	sessions map[string]clusterEvent
+	subs     []func(clusterEvent)
+}
+
+func (b *memoryBus) Publish(_ context.Context, ev clusterEvent) error {
+	b.mu.Lock()
+	if b.sessions == nil {
+		b.sessions = make(map[string]clusterEvent)
+	}
+	switch {
+	case ev.Cache != "", ev.Beat:
+	case ev.Up:
+		b.sessions[ev.Node+" "+ev.JID] = ev
+	default:
+		delete(b.sessions, ev.Node+" "+ev.JID)
+	}
+	subs := b.subs
+	b.mu.Unlock()
+	for _, fn := range subs {
+		fn(ev)
+	}
+	return nil
+}
+
+func (b *memoryBus) Heartbeat(ctx context.Context, ev clusterEvent, _ time.Duration) error {
+	return b.Publish(ctx, ev)
+}
+
+func (b *memoryBus) Sessions(context.Context) ([]clusterEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []clusterEvent
+	for _, ev := range b.sessions {
+		out = append(out, ev)
+	}
+	return out, nil
+}
+
+func (b *memoryBus) Subscribe(_ context.Context, fn func(clusterEvent)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+	return nil
+}
+
+type routedStanza struct {
+	to jid.JID
+	st stanza.Stanza
+}
+
+// startTestNode starts a cluster node on bus, listening on a loopback port.
+func startTestNode(t *testing.T, bus clusterBus, node string) *cluster {
+	t.Helper()
+	return startTestNodeConfig(t, bus, Config{ClusterNode: node, ClusterAddr: "127.0.0.1:0", ClusterSecret: "s3cret"})
+}
+
+func startTestNodeConfig(t *testing.T, bus clusterBus, cfg Config) *cluster {
+	t.Helper()
+	c, err := listenCluster(cfg, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addr = c.ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := c.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// captureRouted makes c hand the stanzas it is forwarded to the returned
+// channel instead of delivering them.
+func captureRouted(c *cluster) <-chan routedStanza {
+	ch := make(chan routedStanza, 8)
+	c.receive = func(_ context.Context, to jid.JID, st stanza.Stanza) { ch <- routedStanza{to, st} }
+	return ch
+}
+
+func useCluster(t *testing.T, c *cluster) {
+	t.Helper()
+	old := globalCluster
+	globalCluster = c
+	t.Cleanup(func() {
+		// Caps queries still running may forward through c.
+		globalCaps.wait()
+		globalCluster = old
+	})
+}
+
+func TestClusterForwardsToOtherNode(t *testing.T) {
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	bus := &memoryBus{}
+	a := startTestNode(t, bus, "a")
+	b := startTestNode(t, bus, "b")
+	routed := captureRouted(b)
+	useCluster(t, a)
+
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	b.announce(juliet, true)
+	if !a.online(juliet.Bare()) {
+		t.Fatal("juliet is not online on node a")
+	}
+
+	chat(t, romeo.session, "juliet@example.com", "wherefore")
+	select {
+	case r := <-routed:
+		msg, ok := r.st.(*stanza.Message)
+		if !ok || r.to.String() != "juliet@example.com" || msg.Body() != "wherefore" || msg.From.String() != "romeo@example.com/orchard" {
+			t.Fatalf("routed %v %+v", r.to, r.st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing routed to node b")
+	}
+	if msgs, err := offline.GetOfflineMessages(context.Background(), "juliet@example.com"); err != nil || len(msgs) != 0 {
+		t.Fatalf("offline = %v, %v", msgs, err)
+	}
+
+	romeo.ask(t, stanza.IQGet, "juliet@example.com/balcony", `<ping xmlns='urn:xmpp:ping'/>`)
+	romeo.quiet(t)
+	select {
+	case r := <-routed:
+		if iq, ok := r.st.(*stanza.IQ); !ok || iq.Type != stanza.IQGet {
+			t.Fatalf("routed %+v", r.st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("iq not routed to node b")
+	}
+
+	b.announce(juliet, false)
+	if a.online(juliet.Bare()) {
+		t.Fatal("juliet still online after her session ended")
+	}
+	chat(t, romeo.session, "juliet@example.com", "gone")
+	if msgs, err := offline.GetOfflineMessages(context.Background(), "juliet@example.com"); err != nil || len(msgs) != 1 {
+		t.Fatalf("offline = %v, %v", msgs, err)
+	}
+}
+
+func TestClusterDeliversForwarded(t *testing.T) {
+	bus := &memoryBus{}
+	a := startTestNode(t, bus, "a")
+	b := startTestNode(t, bus, "b")
+	useCluster(t, a)
+
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From, msg.To = jid.MustParse("juliet@example.com/balcony"), jid.MustParse("romeo@example.com/orchard")
+	msg.SetBody("hither")
+	if !b.forward(context.Background(), msg.To, msg) {
+		t.Fatal("node b does not know romeo's session")
+	}
+	if got := romeo.message(t); got.Body() != "hither" || got.From.String() != "juliet@example.com/balcony" {
+		t.Fatalf("delivered %+v", got)
+	}
+}
+
+func TestClusterRefusesWrongSecret(t *testing.T) {
+	a := startTestNode(t, &memoryBus{}, "a")
+	conn, err := net.Dial("tcp", a.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	dec := xml.NewDecoder(conn)
+	start, err := nextStart(dec)
+	if err != nil || xmlAttr(start.Attr, "nonce") == "" || xmlAttr(start.Attr, "secret") != "" {
+		t.Fatalf("challenge = %+v, %v", start, err)
+	}
+	mac := hex.EncodeToString(clusterMAC("guess", "dialer", xmlAttr(start.Attr, "nonce"), "m"))
+	if _, err := io.WriteString(conn, `<cluster xmlns='urn:xmppd:cluster' node='m' nonce='00' mac='`+mac+`'><route to='romeo@example.com'><message/></route>`); err != nil {
+		t.Fatal(err)
+	}
+	if el, err := nextStart(dec); err == nil {
+		t.Fatalf("read <%s/>, want the stream closed", el.Name.Local)
+	}
+
+	// A listener that does not know the secret gets nothing either.
+	p := &clusterPeer{addr: a.ln.Addr().String(), node: "b", secret: "guess", clock: clock.System}
+	if err := p.send(context.Background(), jid.MustParse("romeo@example.com"), stanza.NewMessage(stanza.MessageChat)); err == nil {
+		t.Fatal("sent to a node with another secret")
+	}
+}
+
+func TestClusterKeepsOfflineWhenNodeUnreachable(t *testing.T) {
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	bus := &memoryBus{}
+	a := startTestNode(t, bus, "a")
+	useCluster(t, a)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := ln.Addr().String()
+	ln.Close()
+	if err := bus.Publish(context.Background(), clusterEvent{Node: "b", Addr: gone, JID: "juliet@example.com/balcony", Up: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	chat(t, romeo.session, "juliet@example.com", "first")
+	start := time.Now()
+	chat(t, romeo.session, "juliet@example.com", "second")
+	if d := time.Since(start); d > clusterSendTimeout {
+		t.Errorf("routing took %v while the node is unreachable", d)
+	}
+	if msgs, err := offline.GetOfflineMessages(context.Background(), "juliet@example.com"); err != nil || len(msgs) != 2 {
+		t.Fatalf("offline = %v, %v", msgs, err)
+	}
+}
+
+func TestClusterDropsSilentNode(t *testing.T) {
+	bus := &memoryBus{}
+	a := startTestNode(t, bus, "a")
+	now := clock.NewFake(time.Now())
+	a.mu.Lock()
+	a.clock = now
+	a.mu.Unlock()
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	if err := bus.Publish(context.Background(), clusterEvent{Node: "b", Addr: "b:5270", JID: juliet.String(), Up: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	now.Advance(a.ttl() / 2)
+	if err := bus.Heartbeat(context.Background(), clusterEvent{Node: "b", Addr: "b:5270", Beat: true}, a.ttl()); err != nil {
+		t.Fatal(err)
+	}
+	now.Advance(a.ttl() / 2)
+	a.reap()
+	if !a.online(juliet) {
+		t.Fatal("session dropped while its node sends heartbeats")
+	}
+
+	now.Advance(a.ttl())
+	a.reap()
+	if a.online(juliet) {
+		t.Fatal("session of a silent node still online")
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeClusterCerts(t, dir)
+	cfg := func(node string) Config {
+		return Config{
+			ClusterNode: node, ClusterAddr: "127.0.0.1:0", ClusterSecret: "s3cret",
+			ClusterTLSCert: filepath.Join(dir, "cert.pem"), ClusterTLSKey: filepath.Join(dir, "key.pem"), ClusterTLSCA: ca,
+		}
+	}
+	bus := &memoryBus{}
+	a := startTestNodeConfig(t, bus, cfg("a"))
+	b := startTestNodeConfig(t, bus, cfg("b"))
+	routed := captureRouted(b)
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	b.announce(juliet, true)
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = juliet
+	if !a.forward(context.Background(), juliet, msg) {
+		t.Fatal("not forwarded over TLS")
+	}
+	select {
+	case <-routed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing routed to node b")
+	}
+
+	// A node without a certificate is refused even with the secret.
+	p := &clusterPeer{addr: b.ln.Addr().String(), node: "m", secret: "s3cret", clock: clock.System}
+	if err := p.send(context.Background(), juliet, msg); err == nil {
+		t.Fatal("sent without TLS")
+	}
+}
+
+// writeClusterCerts writes a CA to dir and a certificate for 127.0.0.1 it
+// issued, for both ends of a stream, and returns the path of the CA.
+func writeClusterCerts(t *testing.T, dir string) string {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: caDER},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "ca.pem")
+}
+
+func TestClusterInvalidatesCaches(t *testing.T) {
+	ctx := context.Background()
+	bus := &memoryBus{}
+	a := startTestNode(t, bus, "a")
+	b := startTestNode(t, bus, "b")
+	useCluster(t, a)
+	backend := memory.New()
+	old := globalStorageCache
+	globalStorageCache = cache.New(backend)
+	t.Cleanup(func() { globalStorageCache = old })
+
+	blocking := globalStorageCache.BlockingStore()
+	if blocked, _ := blocking.IsBlocked(ctx, "romeo@example.com", "tybalt@example.com"); blocked {
+		t.Fatal("blocked before blocking")
+	}
+	// Node b blocks through its own cache of the shared backend.
+	if err := backend.BlockingStore().BlockJID(ctx, "romeo@example.com", "tybalt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	b.invalidate(cache.KindBlocking, "romeo@example.com")
+	if blocked, _ := blocking.IsBlocked(ctx, "romeo@example.com", "tybalt@example.com"); !blocked {
+		t.Fatal("node a still serves the cached block list")
+	}
+}
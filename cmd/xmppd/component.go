@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/privilege"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// globalComponents serves the external components (XEP-0114) configured
+// with XMPP_COMPONENTS, nil unless it is set. Each component serves a
+// domain of its own: stanzas for it are routed to the component while it
+// is connected, and what it sends is delivered like stanzas from another
+// server. A component may be granted privileges (XEP-0356) over the users
+// of the server, to access their rosters or send messages on their behalf.
+var globalComponents *componentService
+
+// errComponentOffline is returned for stanzas to a component that is not
+// connected.
+var errComponentOffline = errors.New("component not connected")
+
+type componentService struct {
+	domain     string // the server's
+	ln         net.Listener
+	limits     xmpp.StreamLimits
+	secrets    map[string]string // by component domain
+	privileges map[string]privilege.Privilege
+
+	mu       sync.Mutex
+	sessions map[string]*xmpp.Session // connected, by domain
+}
+
+// newComponentService listens at cfg.ComponentAddr for the components of
+// cfg.Components; it is served with serve.
+func newComponentService(cfg Config) (*componentService, error) {
+	if len(cfg.Components) == 0 {
+		return nil, nil
+	}
+	s := &componentService{
+		domain: cfg.Domain,
+		// Components are trusted with the server's users, so they are not
+		// held to the read rate of clients.
+		limits:     xmpp.StreamLimits{MaxStanzaSize: int64(cfg.MaxStanzaSize), MaxDepth: cfg.MaxXMLDepth},
+		secrets:    make(map[string]string),
+		privileges: make(map[string]privilege.Privilege),
+		sessions:   make(map[string]*xmpp.Session),
+	}
+	for name, secret := range cfg.Components {
+		domain, err := jid.Parse(name)
+		if err != nil || !domain.IsDomainOnly() || domain.Domain() == cfg.Domain {
+			return nil, fmt.Errorf("component %q is not a domain of its own", name)
+		}
+		s.secrets[domain.Domain()] = secret
+	}
+	for name, perms := range cfg.ComponentPrivileges {
+		domain, err := jid.Parse(name)
+		if _, ok := s.secrets[domain.Domain()]; err != nil || !ok {
+			return nil, fmt.Errorf("privileges for unknown component %q", name)
+		}
+		p, err := parsePrivileges(perms)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %w", name, err)
+		}
+		s.privileges[domain.Domain()] = p
+	}
+	ln, err := net.Listen("tcp", cfg.ComponentAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.ln = ln
+	return s, nil
+}
+
+// parsePrivileges parses privileges written as access:type pairs separated
+// by spaces, such as "roster:both message:outgoing".
+func parsePrivileges(v string) (privilege.Privilege, error) {
+	var p privilege.Privilege
+	for _, field := range strings.Fields(v) {
+		access, typ, _ := strings.Cut(field, ":")
+		if !privilege.ValidType(access, typ) {
+			return privilege.Privilege{}, fmt.Errorf("invalid privilege %q", field)
+		}
+		p.Perms = append(p.Perms, privilege.Perm{Access: access, Type: typ})
+	}
+	return p, nil
+}
+
+// serve takes the streams of components until ctx is done.
+func (s *componentService) serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = s.ln.Close()
+	}()
+	for {
+		conn, err := s.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serves reports whether j is at the domain of a component.
+func (s *componentService) serves(j jid.JID) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.secrets[j.Domain()]
+	return ok
+}
+
+// send sends st to the component serving its recipient.
+func (s *componentService) send(ctx context.Context, st stanza.Stanza) error {
+	s.mu.Lock()
+	session := s.sessions[st.GetHeader().To.Domain()]
+	s.mu.Unlock()
+	if session == nil {
+		return errComponentOffline
+	}
+	return session.Send(ctx, stanza.WithNamespace(st, ns.Component))
+}
+
+// serveConn serves the stream of a component on conn until it ends.
+func (s *componentService) serveConn(ctx context.Context, conn net.Conn) {
+	session, err := xmpp.NewSession(ctx, transport.NewTCP(conn),
+		xmpp.WithState(xmpp.StateServer),
+		xmpp.WithStreamLimits(s.limits))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer session.Close()
+	defer context.AfterFunc(ctx, func() { _ = session.Close() })()
+
+	domain, err := s.accept(ctx, session)
+	if err == nil {
+		defer s.disconnect(domain, session)
+		err = s.read(ctx, session, domain)
+	}
+	var se *stream.Error
+	if !errors.As(err, &se) {
+		se = stream.ForReadError(err)
+	}
+	if se != nil {
+		_ = session.SendStreamError(ctx, se)
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		session.Log(ctx, slog.LevelWarn, "component stream error", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
+
+// accept answers the header of the stream on session and checks the
+// handshake of the component it names (XEP-0114 §3). A component already
+// connected is refused. It returns the component's domain.
+func (s *componentService) accept(ctx context.Context, session *xmpp.Session) (jid.JID, error) {
+	start, err := nextComponentElement(session)
+	if err != nil {
+		return jid.JID{}, err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "stream" {
+		return jid.JID{}, fmt.Errorf("expected stream header, got <%s>", start.Name.Local)
+	}
+	id := randomStreamID()
+	domain, _ := jid.Parse(xmlAttr(start.Attr, "to"))
+	header := stream.Open(stream.Header{From: domain, ID: id, NS: ns.Component})
+	if _, err := session.Writer().WriteRaw(header); err != nil {
+		return jid.JID{}, err
+	}
+	if xmlAttr(start.Attr, "xmlns") != ns.Component {
+		return jid.JID{}, stream.NewError(stream.ErrInvalidNamespace, "")
+	}
+	secret, ok := s.secrets[domain.Domain()]
+	if !ok || !domain.IsDomainOnly() {
+		return jid.JID{}, stream.NewError(stream.ErrHostUnknown, "")
+	}
+
+	if start, err = nextComponentElement(session); err != nil {
+		return jid.JID{}, err
+	}
+	if start.Name.Local != "handshake" {
+		return jid.JID{}, stream.NewError(stream.ErrNotAuthorized, "handshake first")
+	}
+	var h xmpp.ComponentHandshake
+	if err := session.Reader().DecodeElement(&h, &start); err != nil {
+		return jid.JID{}, err
+	}
+	want := xmpp.HandshakeHash(id, secret)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(strings.TrimSpace(h.Value))), []byte(want)) != 1 {
+		return jid.JID{}, stream.NewError(stream.ErrNotAuthorized, "")
+	}
+	if !s.connect(domain, session) {
+		return jid.JID{}, stream.NewError(stream.ErrConflict, "component already connected")
+	}
+	session.SetRemoteAddr(domain)
+	session.SetState(xmpp.StateAuthenticated | xmpp.StateReady)
+	if err := session.SendElement(ctx, xmpp.ComponentHandshake{}); err != nil {
+		return domain, err
+	}
+	return domain, s.advertise(ctx, session, domain)
+}
+
+// connect routes the stanzas for domain to session, unless another
+// session of the component is connected.
+func (s *componentService) connect(domain jid.JID, session *xmpp.Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[domain.Domain()] != nil {
+		return false
+	}
+	s.sessions[domain.Domain()] = session
+	return true
+}
+
+func (s *componentService) disconnect(domain jid.JID, session *xmpp.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[domain.Domain()] == session {
+		delete(s.sessions, domain.Domain())
+	}
+}
+
+// advertise tells the component of domain the privileges it was granted
+// (XEP-0356 §4.1), if any.
+func (s *componentService) advertise(ctx context.Context, session *xmpp.Session, domain jid.JID) error {
+	p, ok := s.privileges[domain.Domain()]
+	if !ok {
+		return nil
+	}
+	ext, err := stanza.NewExtension(p)
+	if err != nil {
+		return err
+	}
+	msg := stanza.NewMessage(stanza.MessageNormal)
+	msg.From = jid.MustParse(s.domain)
+	msg.To = domain
+	msg.Extensions = append(msg.Extensions, ext)
+	return session.Send(ctx, msg)
+}
+
+// read routes the stanzas the component of domain sends until its stream
+// ends. A stanza must be from the component's domain.
+func (s *componentService) read(ctx context.Context, session *xmpp.Session, domain jid.JID) error {
+	reader := session.Reader()
+	for {
+		start, err := nextComponentElement(session)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var st stanza.Stanza
+		switch start.Name.Local {
+		case "message":
+			st = &stanza.Message{}
+		case "presence":
+			st = &stanza.Presence{}
+		case "iq":
+			st = &stanza.IQ{}
+		default:
+			if err := reader.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := reader.DecodeElement(st, &start); err != nil {
+			return err
+		}
+		h := st.GetHeader()
+		session.Metrics().StanzaReceived(st.StanzaType(), h.Type)
+		if h.From.Domain() != domain.Domain() {
+			return stream.NewError(stream.ErrInvalidFrom, "")
+		}
+		ctx := xmpp.WithTraceID(withSession(ctx, session), xmpp.NewTraceID())
+		if err := s.route(ctx, session, domain, stanza.WithNamespace(st, ns.Client)); err != nil {
+			return err
+		}
+	}
+}
+
+// route delivers st, from the component of domain. Requests the component
+// makes with its privileges are answered here.
+func (s *componentService) route(ctx context.Context, session *xmpp.Session, domain jid.JID, st stanza.Stanza) error {
+	switch v := st.(type) {
+	case *stanza.Message:
+		if p, ok := forwardedPrivilege(v); ok {
+			return s.sendOnBehalf(ctx, session, domain, v, p)
+		}
+	case *stanza.IQ:
+		if reply := s.answerRoster(ctx, domain, v); reply != nil {
+			return session.Send(ctx, reply)
+		}
+	}
+	if isRemote(st.GetHeader().To) {
+		return sendRemote(ctx, nil, st)
+	}
+	return deliverRemote(ctx, session, st)
+}
+
+// forwardedPrivilege returns the privilege element of msg, if it has one.
+func forwardedPrivilege(msg *stanza.Message) (privilege.Privilege, bool) {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.Privilege || ext.XMLName.Local != "privilege" {
+			continue
+		}
+		var p privilege.Privilege
+		return p, decodeExtension(ext, &p) == nil
+	}
+	return privilege.Privilege{}, false
+}
+
+// sendOnBehalf sends the message the component of domain forwards in msg
+// on behalf of a local user (XEP-0356 §4.3), provided it may send
+// messages. Only messages from the bare JID of a local user are sent.
+func (s *componentService) sendOnBehalf(ctx context.Context, session *xmpp.Session, domain jid.JID, msg *stanza.Message, p privilege.Privilege) error {
+	if !s.privileges[domain.Domain()].Allows(privilege.AccessMessage, privilege.TypeOutgoing) {
+		return session.Send(ctx, messageError(msg, stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "")))
+	}
+	inner, err := p.Message()
+	if err != nil || inner.From.Domain() != s.domain || !isAccount(inner.From) || inner.To.IsZero() {
+		return session.Send(ctx, messageError(msg, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "forward a message from a local user")))
+	}
+	if stanzaErr := globalBlocking.check(ctx, inner.From, inner.To); stanzaErr != nil {
+		return session.Send(ctx, messageError(msg, stanzaErr))
+	}
+	if isRemote(inner.To) {
+		return sendRemote(ctx, nil, inner)
+	}
+	if err := deliverMessage(ctx, inner); err != nil && !errors.Is(err, errOfflineFull) {
+		logError(ctx, "offline store error", "user", inner.To.Bare(), "error", err)
+	}
+	return nil
+}
+
+// answerRoster answers the roster gets and sets the component of domain
+// addresses to local users (XEP-0356 §4.2) with the access it was granted,
+// or returns nil when iq is not one.
+func (s *componentService) answerRoster(ctx context.Context, domain jid.JID, iq *stanza.IQ) *stanza.IQ {
+	var q roster.Query
+	if (iq.Type != stanza.IQGet && iq.Type != stanza.IQSet) || iq.To.Domain() != s.domain || !isAccount(iq.To) || xml.Unmarshal(iq.Query, &q) != nil {
+		return nil
+	}
+	if !s.privileges[domain.Domain()].Allows(privilege.AccessRoster, iq.Type) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+	}
+	return answerRoster(ctx, iq.To, iq)
+}
+
+// items returns the domains of the components, for the disco#items of
+// the server.
+func (s *componentService) items() []string {
+	if s == nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(s.secrets))
+}
+
+func nextComponentElement(session *xmpp.Session) (xml.StartElement, error) {
+	for {
+		tok, err := session.Reader().Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
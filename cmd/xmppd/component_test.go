@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/privilege"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// setupComponents serves gateway.example.com, with the privileges perms,
+// for the duration of t.
+func setupComponents(t *testing.T, perms string) {
+	t.Helper()
+	cfg := Config{
+		Domain:        "example.com",
+		ComponentAddr: "127.0.0.1:0",
+		Components:    map[string]string{"gateway.example.com": "secret"},
+	}
+	if perms != "" {
+		cfg.ComponentPrivileges = map[string]string{"gateway.example.com": perms}
+	}
+	s, err := newComponentService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.serve(ctx)
+	}()
+	old := globalComponents
+	globalComponents = s
+	t.Cleanup(func() {
+		globalComponents = old
+		cancel()
+		<-done
+	})
+}
+
+// componentPeer connects gateway.example.com with secret and returns the
+// decoder of the stream, past the handshake.
+func componentPeer(t *testing.T, secret string) (net.Conn, *xml.Decoder) {
+	t.Helper()
+	conn, err := net.Dial("tcp", globalComponents.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='gateway.example.com'>`); err != nil {
+		t.Fatal(err)
+	}
+	dec := xml.NewDecoder(conn)
+	start := componentStart(t, dec)
+	var id string
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			id = a.Value
+		}
+	}
+	if _, err := io.WriteString(conn, `<handshake>`+xmpp.HandshakeHash(id, secret)+`</handshake>`); err != nil {
+		t.Fatal(err)
+	}
+	return conn, dec
+}
+
+func componentStart(t *testing.T, dec *xml.Decoder) xml.StartElement {
+	t.Helper()
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start
+		}
+	}
+}
+
+func TestParsePrivileges(t *testing.T) {
+	p, err := parsePrivileges("roster:get message:outgoing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Allows(privilege.AccessRoster, privilege.TypeGet) || p.Allows(privilege.AccessRoster, privilege.TypeSet) || !p.Allows(privilege.AccessMessage, privilege.TypeOutgoing) {
+		t.Fatalf("privileges %+v", p.Perms)
+	}
+	if _, err := parsePrivileges("roster:outgoing"); err == nil {
+		t.Fatal("invalid privilege accepted")
+	}
+}
+
+func TestComponentHandshakeRefused(t *testing.T) {
+	setupComponents(t, "")
+	_, dec := componentPeer(t, "wrong")
+	if start := componentStart(t, dec); start.Name.Local != "error" {
+		t.Fatalf("got <%s>, want a stream error", start.Name.Local)
+	}
+	if start := componentStart(t, dec); start.Name.Local != "not-authorized" {
+		t.Fatalf("condition <%s>", start.Name.Local)
+	}
+}
+
+func TestComponentRouting(t *testing.T) {
+	setupComponents(t, "")
+	conn, dec := componentPeer(t, "secret")
+	if start := componentStart(t, dec); start.Name.Local != "handshake" {
+		t.Fatalf("got <%s>, want handshake", start.Name.Local)
+	}
+	_ = dec.Skip()
+	romeo, msgs := messagePeer(t, "romeo@example.com/orchard")
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From = romeo.RemoteAddr()
+	msg.To = jid.MustParse("juliet@gateway.example.com")
+	msg.SetBody("hello gateway")
+	if err := routeMessage(context.Background(), romeo, msg); err != nil {
+		t.Fatal(err)
+	}
+	var got stanza.Message
+	start := componentStart(t, dec)
+	if err := dec.DecodeElement(&got, &start); err != nil {
+		t.Fatal(err)
+	}
+	if start.Name.Space != "jabber:component:accept" || got.Body() != "hello gateway" || !got.From.Equal(msg.From) {
+		t.Fatalf("component got %s %+v", start.Name.Space, got)
+	}
+
+	if _, err := io.WriteString(conn, `<message from='juliet@gateway.example.com' to='romeo@example.com/orchard' type='chat'><body>hello romeo</body></message>`); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveMessage(t, msgs); got.Body() != "hello romeo" || got.From.String() != "juliet@gateway.example.com" {
+		t.Fatalf("romeo got %+v", got)
+	}
+}
+
+func TestComponentPrivileges(t *testing.T) {
+	setupComponents(t, "message:outgoing")
+	conn, dec := componentPeer(t, "secret")
+	componentStart(t, dec)
+	_ = dec.Skip()
+
+	var adv stanza.Message
+	start := componentStart(t, dec)
+	if err := dec.DecodeElement(&adv, &start); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := forwardedPrivilege(&adv)
+	if !ok || !p.Allows(privilege.AccessMessage, privilege.TypeOutgoing) || adv.From.String() != "example.com" {
+		t.Fatalf("advertised %+v", adv)
+	}
+
+	_, msgs := messagePeer(t, "romeo@example.com/orchard")
+	if _, err := io.WriteString(conn, `<message from='gateway.example.com' to='example.com'>`+
+		`<privilege xmlns='urn:xmpp:privilege:2'><forwarded xmlns='urn:xmpp:forward:0'>`+
+		`<message xmlns='jabber:client' from='juliet@example.com' to='romeo@example.com' type='chat'><body>on behalf</body></message>`+
+		`</forwarded></privilege></message>`); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveMessage(t, msgs); got.Body() != "on behalf" || got.From.String() != "juliet@example.com" {
+		t.Fatalf("romeo got %+v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/transport"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+type compressRequest struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/compress compress"`
+	Methods []string `xml:"method"`
+}
+
+type compressed struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/compress compressed"`
+}
+
+// compressor returns the session's transport if it can be compressed now.
+func compressor(cfg Config, session *xmpp.Session) (transport.Compressor, bool) {
+	if !cfg.Compression || session.State()&xmpp.StateAuthenticated == 0 {
+		return nil, false
+	}
+	c, ok := session.Transport().(transport.Compressor)
+	if !ok || c.Compressed() {
+		return nil, false
+	}
+	return c, true
+}
+
+// handleCompress answers an XEP-0138 <compress/> request. Compression is
+// only offered to authenticated streams and only when enabled, so a refused
+// request gets <setup-failed/> rather than being skipped.
+func handleCompress(ctx context.Context, session *xmpp.Session, cfg Config, reader *xmppxml.StreamReader, start *xml.StartElement) error {
+	var req compressRequest
+	if err := reader.DecodeElement(&req, start); err != nil {
+		return err
+	}
+	c, ok := compressor(cfg, session)
+	if !ok {
+		return sendCompressFailure(ctx, session, "setup-failed")
+	}
+	if !slices.ContainsFunc(req.Methods, func(m string) bool { return strings.TrimSpace(m) == transport.CompressionZlib }) {
+		return sendCompressFailure(ctx, session, "unsupported-method")
+	}
+	if err := session.SendElement(ctx, compressed{}); err != nil {
+		return err
+	}
+	return c.StartCompression()
+}
+
+func sendCompressFailure(ctx context.Context, session *xmpp.Session, condition string) error {
+	xmlPayload := "<failure xmlns='" + ns.Compress + "'><" + condition + "/></failure>"
+	return session.SendRaw(ctx, strings.NewReader(xmlPayload))
+}
+
+func writeCompressionFeature(writer *xmppxml.StreamWriter) error {
+	feature := xml.StartElement{Name: xml.Name{Space: ns.CompressFeature, Local: "compression"}}
+	if err := writer.EncodeToken(feature); err != nil {
+		return err
+	}
+	method := xml.StartElement{Name: xml.Name{Local: "method"}}
+	if err := writer.EncodeToken(method); err != nil {
+		return err
+	}
+	if err := writer.EncodeToken(xml.CharData(transport.CompressionZlib)); err != nil {
+		return err
+	}
+	if err := writer.EncodeToken(xml.EndElement{Name: method.Name}); err != nil {
+		return err
+	}
+	return writer.EncodeToken(xml.EndElement{Name: feature.Name})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/transport"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// negotiateCompression feeds request to handleCompress on an authenticated
+// session and returns the reply it wrote.
+func negotiateCompression(t *testing.T, cfg Config, request string) (string, *transport.TCP) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	trans := transport.NewTCP(c1)
+	session, err := xmpp.NewSession(context.Background(), trans)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	session.SetState(xmpp.StateAuthenticated)
+
+	replies := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, _ := c2.Read(buf)
+		replies <- string(buf[:n])
+	}()
+
+	reader := xmppxml.NewStreamReader(strings.NewReader(request))
+	tok, err := reader.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := tok.(xml.StartElement)
+	if err := handleCompress(context.Background(), session, cfg, reader, &start); err != nil && err != io.EOF {
+		t.Fatalf("handleCompress: %v", err)
+	}
+	return <-replies, trans
+}
+
+const zlibRequest = "<compress xmlns='http://jabber.org/protocol/compress'><method>zlib</method></compress>"
+
+func TestCompressionRefusedWhenDisabled(t *testing.T) {
+	reply, trans := negotiateCompression(t, Config{}, zlibRequest)
+	if !strings.Contains(reply, "<setup-failed/>") {
+		t.Fatalf("reply = %q, want setup-failed", reply)
+	}
+	if trans.Compressed() {
+		t.Fatal("stream compressed although disabled")
+	}
+}
+
+func TestCompressionUnsupportedMethod(t *testing.T) {
+	reply, _ := negotiateCompression(t, Config{Compression: true},
+		"<compress xmlns='http://jabber.org/protocol/compress'><method>lzw</method></compress>")
+	if !strings.Contains(reply, "<unsupported-method/>") {
+		t.Fatalf("reply = %q, want unsupported-method", reply)
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	reply, trans := negotiateCompression(t, Config{Compression: true}, zlibRequest)
+	if !strings.Contains(reply, "compressed") {
+		t.Fatalf("reply = %q, want compressed", reply)
+	}
+	if !trans.Compressed() {
+		t.Fatal("stream not compressed after negotiation")
+	}
+}
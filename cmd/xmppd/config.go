@@ -1,10 +1,20 @@
 package main
 
 import (
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/plugins/csi"
+	"github.com/meszmate/xmpp-go/plugins/extdisco"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+	"github.com/meszmate/xmpp-go/plugins/socks5"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/cache"
+	"github.com/meszmate/xmpp-go/storage/ldap"
 )
 
 type Config struct {
@@ -14,9 +24,24 @@ type Config struct {
 	TLSKey           string
 	TLSSelfSigned    bool
 	TLSSelfSignedDir string
+	Compression      bool
 	Storage          string
 	StorageDSN       string
 	StoragePath      string
+	StorageNamespace string
+	AutoMigrate      bool
+	MaxRosterItems   int
+	StorageCacheSize int
+	StorageCacheTTL  time.Duration
+	BlobS3Endpoint   string
+	BlobS3Region     string
+	BlobS3Bucket     string
+	BlobS3AccessKey  string
+	BlobS3SecretKey  string
+	BlobS3PathStyle  bool
+	BlobS3Prefix     string
+	BlobThreshold    int
+	SearchDirectory  map[string]string
 	MongoDBName      string
 	Plugins          []string
 	DefaultAccounts  []Account
@@ -25,6 +50,146 @@ type Config struct {
 	VersionString    string
 	OMEMODeviceID    uint32
 	Registration     registrationConfig
+
+	SubscriptionPolicy          string
+	AccountSubscriptionPolicies map[string]string
+
+	SMMaxUnacked      int
+	SMMaxUnackedBytes int
+	SMResumeTimeout   time.Duration
+
+	RosterPushTimeout time.Duration
+	RosterPushResend  bool
+
+	TLSSessionTickets    bool
+	TLSTicketKeyRotation time.Duration
+
+	MaxConnsPerIP int
+	MaxConns      int
+
+	MaxStanzaSize int
+	MaxXMLDepth   int
+	ReadRate      int
+	ReadBurst     int
+
+	Limits        xmpp.RateLimits
+	FirewallRules string
+
+	ShutdownTimeout time.Duration
+
+	OfflineHeadline bool
+	OfflineBodyless bool
+	OfflineQuota    int
+	OfflineTTL      time.Duration
+
+	ArchiveAck            bool
+	ArchiveMaxAge         time.Duration
+	ArchiveMaxMessages    int
+	MUCArchiveMaxAge      time.Duration
+	MUCArchiveMaxMessages int
+	RetentionInterval     time.Duration
+
+	SASLMechanisms []string
+	SASLSecret     string
+	GuestServices  []string
+	GuestTTL       time.Duration
+
+	AuthProvider          string
+	AuthProvision         bool
+	OAuthIssuer           string
+	OAuthTokenURL         string
+	OAuthIntrospectionURL string
+	OAuthUserinfoURL      string
+	OAuthClientID         string
+	OAuthClientSecret     string
+	OAuthAudience         string
+	OAuthUserinfoTokens   bool
+	OAuthScopes           string
+	OAuthUsernameClaim    string
+
+	LDAPURL             string
+	LDAPStartTLS        bool
+	LDAPBindDN          string
+	LDAPBindPassword    string
+	LDAPBaseDN          string
+	LDAPUserFilter      string
+	LDAPUsernameAttr    string
+	LDAPVCard           map[string]string
+	LDAPGroupBaseDN     string
+	LDAPGroupFilter     string
+	LDAPGroupMemberAttr string
+	LDAPGroupNameAttr   string
+
+	S2S         bool
+	S2SAddr     string
+	S2SSecret   string
+	S2SInsecure bool
+
+	ComponentAddr       string
+	Components          map[string]string
+	ComponentPrivileges map[string]string
+
+	BOSHAddr        string
+	BOSHSecure      bool
+	BOSHAllowOrigin string
+
+	MetricsAddr string
+
+	AdminAddr  string
+	AdminToken string
+	Admins     []string
+	MOTD       string
+
+	ContactAddresses map[string]string
+	ServerInfo       map[string]string
+
+	LogLevel  slog.Level
+	LogFormat string
+	DebugXML  bool
+
+	MUC        bool
+	MUCDomain  string
+	MUCHistory int
+
+	MIX       bool
+	MIXDomain string
+
+	CSI           bool
+	CSIPresence   string
+	CSIChatStates string
+	CSIMaxQueued  int
+
+	Push               bool
+	PushIncludeBody    bool
+	PushGatewayDomain  string
+	PushGatewaySecret  string
+	PushFCMCredentials string
+	PushAPNsKey        string
+	PushAPNsKeyID      string
+	PushAPNsTeamID     string
+	PushAPNsTopic      string
+	PushAPNsSandbox    bool
+
+	ProxyDomain         string
+	ProxyAddr           string
+	ProxyHost           string
+	ProxyRate           int
+	ProxyTotalRate      int
+	ProxyPendingTimeout time.Duration
+
+	ExternalServices []string
+	TURNSecret       string
+	TURNTTL          time.Duration
+
+	ClusterNode      string
+	ClusterRedis     string
+	ClusterAddr      string
+	ClusterAdvertise string
+	ClusterSecret    string
+	ClusterHeartbeat time.Duration
+	ClusterTLSCert   string
+	ClusterTLSKey    string
+	ClusterTLSCA     string
 }
 
 type Account struct {
@@ -40,9 +205,24 @@ func loadConfig() Config {
 	cfg.TLSKey = os.Getenv("XMPP_TLS_KEY")
 	cfg.TLSSelfSigned = getenvBool("XMPP_TLS_SELF_SIGNED", false)
 	cfg.TLSSelfSignedDir = getenv("XMPP_TLS_SELF_SIGNED_DIR", "/var/lib/xmpp/tls")
+	cfg.Compression = getenvBool("XMPP_COMPRESSION", false)
 	cfg.Storage = strings.ToLower(getenv("XMPP_STORAGE", "file"))
 	cfg.StorageDSN = os.Getenv("XMPP_STORAGE_DSN")
 	cfg.StoragePath = getenv("XMPP_STORAGE_PATH", "/var/lib/xmpp/data")
+	cfg.StorageNamespace = os.Getenv("XMPP_STORAGE_NAMESPACE")
+	cfg.AutoMigrate = getenvBool("XMPP_STORAGE_AUTO_MIGRATE", true)
+	cfg.MaxRosterItems = getenvInt("XMPP_MAX_ROSTER_ITEMS", 0)
+	cfg.StorageCacheSize = getenvInt("XMPP_STORAGE_CACHE_SIZE", 0)
+	cfg.StorageCacheTTL = getenvDuration("XMPP_STORAGE_CACHE_TTL", cache.DefaultTTL)
+	cfg.BlobS3Endpoint = os.Getenv("XMPP_BLOB_S3_ENDPOINT")
+	cfg.BlobS3Region = os.Getenv("XMPP_BLOB_S3_REGION")
+	cfg.BlobS3Bucket = os.Getenv("XMPP_BLOB_S3_BUCKET")
+	cfg.BlobS3AccessKey = os.Getenv("XMPP_BLOB_S3_ACCESS_KEY")
+	cfg.BlobS3SecretKey = os.Getenv("XMPP_BLOB_S3_SECRET_KEY")
+	cfg.BlobS3PathStyle = getenvBool("XMPP_BLOB_S3_PATH_STYLE", false)
+	cfg.BlobS3Prefix = os.Getenv("XMPP_BLOB_S3_PREFIX")
+	cfg.BlobThreshold = getenvInt("XMPP_BLOB_THRESHOLD", storage.DefaultBlobThreshold)
+	cfg.SearchDirectory = parseKeyValues(os.Getenv("XMPP_SEARCH_DIRECTORY"))
 	cfg.MongoDBName = getenv("XMPP_MONGO_DB", "xmpp")
 	cfg.Plugins = parseCSV(getenv("XMPP_PLUGINS", "disco,roster,presence,ping,vcard,time,version"))
 	cfg.DefaultAccounts = parseAccounts(os.Getenv("XMPP_DEFAULT_ACCOUNTS"))
@@ -61,6 +241,143 @@ func loadConfig() Config {
 		DataForm:     getenvBool("XMPP_REGISTRATION_DATAFORM", true),
 		Instructions: getenv("XMPP_REGISTRATION_INSTRUCTIONS", "Fill out the form to create an account."),
 	}
+	cfg.SubscriptionPolicy = getenv("XMPP_SUBSCRIPTION_POLICY", "manual")
+	cfg.AccountSubscriptionPolicies = parseKeyValues(os.Getenv("XMPP_SUBSCRIPTION_POLICY_ACCOUNTS"))
+	cfg.SMMaxUnacked = getenvInt("XMPP_SM_MAX_UNACKED", sm.DefaultMaxUnacked)
+	cfg.SMMaxUnackedBytes = getenvInt("XMPP_SM_MAX_UNACKED_BYTES", sm.DefaultMaxUnackedBytes)
+	cfg.SMResumeTimeout = getenvDuration("XMPP_SM_RESUME_TIMEOUT", defaultSMResumeTimeout)
+	cfg.RosterPushTimeout = getenvDuration("XMPP_ROSTER_PUSH_TIMEOUT", defaultRosterPushTimeout)
+	cfg.RosterPushResend = getenvBool("XMPP_ROSTER_PUSH_RESEND", true)
+	cfg.TLSSessionTickets = getenvBool("XMPP_TLS_SESSION_TICKETS", true)
+	cfg.TLSTicketKeyRotation = getenvDuration("XMPP_TLS_TICKET_KEY_ROTATION", 0)
+	cfg.MaxConnsPerIP = getenvInt("XMPP_MAX_CONNS_PER_IP", 0)
+	cfg.MaxConns = getenvInt("XMPP_MAX_CONNS", 0)
+	cfg.MaxStanzaSize = getenvInt("XMPP_MAX_STANZA_SIZE", 256*1024)
+	cfg.MaxXMLDepth = getenvInt("XMPP_MAX_XML_DEPTH", 64)
+	cfg.ReadRate = getenvInt("XMPP_READ_RATE", 0)
+	cfg.ReadBurst = getenvInt("XMPP_READ_BURST", 0)
+	cfg.Limits = xmpp.RateLimits{
+		StanzasPerJID:    getenvRateLimit("XMPP_STANZA_RATE", "XMPP_STANZA_BURST"),
+		StanzasPerIP:     getenvRateLimit("XMPP_IP_STANZA_RATE", "XMPP_IP_STANZA_BURST"),
+		BytesPerJID:      getenvRateLimit("XMPP_BYTE_RATE", "XMPP_BYTE_BURST"),
+		BytesPerIP:       getenvRateLimit("XMPP_IP_BYTE_RATE", "XMPP_IP_BYTE_BURST"),
+		ConnectionsPerIP: getenvRateLimit("XMPP_CONNECT_RATE", "XMPP_CONNECT_BURST"),
+		AuthFailures:     getenvInt("XMPP_AUTH_FAILURES", 0),
+		AuthLockout:      getenvDuration("XMPP_AUTH_LOCKOUT", time.Minute),
+		MaxAuthLockout:   getenvDuration("XMPP_AUTH_MAX_LOCKOUT", time.Hour),
+	}
+	cfg.FirewallRules = os.Getenv("XMPP_FIREWALL_RULES")
+	cfg.ShutdownTimeout = getenvDuration("XMPP_SHUTDOWN_TIMEOUT", 10*time.Second)
+	cfg.OfflineHeadline = getenvBool("XMPP_OFFLINE_STORE_HEADLINE", false)
+	cfg.OfflineBodyless = getenvBool("XMPP_OFFLINE_STORE_BODYLESS", false)
+	cfg.OfflineQuota = getenvInt("XMPP_OFFLINE_QUOTA", 100)
+	cfg.OfflineTTL = getenvDuration("XMPP_OFFLINE_TTL", 0)
+	cfg.ArchiveAck = getenvBool("XMPP_ARCHIVE_ACK", true)
+	cfg.ArchiveMaxAge = getenvDuration("XMPP_ARCHIVE_MAX_AGE", 0)
+	cfg.ArchiveMaxMessages = getenvInt("XMPP_ARCHIVE_MAX_MESSAGES", 0)
+	cfg.MUCArchiveMaxAge = getenvDuration("XMPP_MUC_ARCHIVE_MAX_AGE", 0)
+	cfg.MUCArchiveMaxMessages = getenvInt("XMPP_MUC_ARCHIVE_MAX_MESSAGES", 0)
+	cfg.RetentionInterval = getenvDuration("XMPP_RETENTION_INTERVAL", time.Hour)
+	cfg.SASLMechanisms = parseSASLMechanisms(getenv("XMPP_SASL_MECHANISMS", defaultSASLMechanisms))
+	cfg.Registration.KeepPlaintext = needsPlaintext(cfg.SASLMechanisms)
+	cfg.SASLSecret = os.Getenv("XMPP_SASL_SECRET")
+	cfg.AuthProvider = strings.ToLower(getenv("XMPP_AUTH_PROVIDER", "local"))
+	cfg.AuthProvision = getenvBool("XMPP_AUTH_PROVISION", false)
+	cfg.OAuthIssuer = os.Getenv("XMPP_OAUTH_ISSUER")
+	cfg.OAuthTokenURL = os.Getenv("XMPP_OAUTH_TOKEN_URL")
+	cfg.OAuthIntrospectionURL = os.Getenv("XMPP_OAUTH_INTROSPECTION_URL")
+	cfg.OAuthUserinfoURL = os.Getenv("XMPP_OAUTH_USERINFO_URL")
+	cfg.OAuthClientID = os.Getenv("XMPP_OAUTH_CLIENT_ID")
+	cfg.OAuthClientSecret = os.Getenv("XMPP_OAUTH_CLIENT_SECRET")
+	cfg.OAuthAudience = os.Getenv("XMPP_OAUTH_AUDIENCE")
+	cfg.OAuthUserinfoTokens = getenvBool("XMPP_OAUTH_USERINFO_TOKENS", false)
+	cfg.OAuthScopes = getenv("XMPP_OAUTH_SCOPES", "openid")
+	cfg.OAuthUsernameClaim = getenv("XMPP_OAUTH_USERNAME_CLAIM", "preferred_username")
+	cfg.LDAPURL = os.Getenv("XMPP_LDAP_URL")
+	cfg.LDAPStartTLS = getenvBool("XMPP_LDAP_STARTTLS", false)
+	cfg.LDAPBindDN = os.Getenv("XMPP_LDAP_BIND_DN")
+	cfg.LDAPBindPassword = os.Getenv("XMPP_LDAP_BIND_PASSWORD")
+	cfg.LDAPBaseDN = os.Getenv("XMPP_LDAP_BASE_DN")
+	cfg.LDAPUserFilter = getenv("XMPP_LDAP_USER_FILTER", ldap.DefaultUserFilter)
+	cfg.LDAPUsernameAttr = getenv("XMPP_LDAP_USERNAME_ATTR", ldap.DefaultUsernameAttr)
+	cfg.LDAPVCard = parseKeyValues(os.Getenv("XMPP_LDAP_VCARD"))
+	cfg.LDAPGroupBaseDN = os.Getenv("XMPP_LDAP_GROUP_BASE_DN")
+	cfg.LDAPGroupFilter = getenv("XMPP_LDAP_GROUP_FILTER", ldap.DefaultGroupFilter)
+	cfg.LDAPGroupMemberAttr = getenv("XMPP_LDAP_GROUP_MEMBER_ATTR", ldap.DefaultGroupMemberAttr)
+	cfg.LDAPGroupNameAttr = getenv("XMPP_LDAP_GROUP_NAME_ATTR", ldap.DefaultGroupNameAttr)
+	cfg.S2S = getenvBool("XMPP_S2S", false)
+	cfg.S2SAddr = getenv("XMPP_S2S_ADDR", xmpp.DefaultS2SAddr)
+	cfg.S2SSecret = os.Getenv("XMPP_S2S_SECRET")
+	cfg.S2SInsecure = getenvBool("XMPP_S2S_INSECURE", false)
+	cfg.ComponentAddr = getenv("XMPP_COMPONENT_ADDR", ":5275")
+	cfg.Components = parseKeyValues(os.Getenv("XMPP_COMPONENTS"))
+	cfg.ComponentPrivileges = parseKeyValues(os.Getenv("XMPP_COMPONENT_PRIVILEGES"))
+	cfg.BOSHAddr = os.Getenv("XMPP_BOSH_ADDR")
+	cfg.BOSHSecure = getenvBool("XMPP_BOSH_SECURE", false)
+	cfg.BOSHAllowOrigin = os.Getenv("XMPP_BOSH_ALLOW_ORIGIN")
+	cfg.MetricsAddr = os.Getenv("XMPP_METRICS_ADDR")
+	cfg.AdminAddr = os.Getenv("XMPP_ADMIN_ADDR")
+	cfg.AdminToken = os.Getenv("XMPP_ADMIN_TOKEN")
+	cfg.Admins = parseCSV(os.Getenv("XMPP_ADMINS"))
+	cfg.MOTD = os.Getenv("XMPP_MOTD")
+	cfg.ContactAddresses = parseKeyValues(os.Getenv("XMPP_CONTACT_ADDRESSES"))
+	cfg.ServerInfo = parseKeyValues(os.Getenv("XMPP_SERVER_INFO"))
+	cfg.LogFormat = strings.ToLower(getenv("XMPP_LOG_FORMAT", "text"))
+	cfg.DebugXML = getenvBool("XMPP_DEBUG_XML", false)
+	if err := cfg.LogLevel.UnmarshalText([]byte(getenv("XMPP_LOG_LEVEL", "info"))); err != nil {
+		cfg.LogLevel = slog.LevelInfo
+	}
+	if cfg.DebugXML {
+		// The dump is logged at debug level.
+		cfg.LogLevel = min(cfg.LogLevel, slog.LevelDebug)
+	}
+	cfg.MUC = getenvBool("XMPP_MUC", true)
+	cfg.MUCDomain = getenv("XMPP_MUC_DOMAIN", "conference."+cfg.Domain)
+	cfg.MUCHistory = getenvInt("XMPP_MUC_HISTORY", 20)
+	cfg.MIX = getenvBool("XMPP_MIX", false)
+	cfg.MIXDomain = getenv("XMPP_MIX_DOMAIN", "mix."+cfg.Domain)
+	// Guests reach the chat rooms by default.
+	guestServices := ""
+	if cfg.MUC {
+		guestServices = cfg.MUCDomain
+	}
+	cfg.GuestServices = parseCSV(getenv("XMPP_GUEST_SERVICES", guestServices))
+	cfg.GuestTTL = getenvDuration("XMPP_GUEST_TTL", time.Hour)
+	cfg.CSI = getenvBool("XMPP_CSI", true)
+	cfg.CSIPresence = getenv("XMPP_CSI_PRESENCE", "buffer")
+	cfg.CSIChatStates = getenv("XMPP_CSI_CHAT_STATES", "drop")
+	cfg.CSIMaxQueued = getenvInt("XMPP_CSI_MAX_QUEUED", csi.DefaultMaxQueued)
+	cfg.Push = getenvBool("XMPP_PUSH", true)
+	cfg.PushIncludeBody = getenvBool("XMPP_PUSH_INCLUDE_BODY", false)
+	cfg.PushGatewayDomain = os.Getenv("XMPP_PUSH_GATEWAY_DOMAIN")
+	cfg.PushGatewaySecret = os.Getenv("XMPP_PUSH_GATEWAY_SECRET")
+	cfg.PushFCMCredentials = os.Getenv("XMPP_PUSH_FCM_CREDENTIALS")
+	cfg.PushAPNsKey = os.Getenv("XMPP_PUSH_APNS_KEY")
+	cfg.PushAPNsKeyID = os.Getenv("XMPP_PUSH_APNS_KEY_ID")
+	cfg.PushAPNsTeamID = os.Getenv("XMPP_PUSH_APNS_TEAM_ID")
+	cfg.PushAPNsTopic = os.Getenv("XMPP_PUSH_APNS_TOPIC")
+	cfg.PushAPNsSandbox = getenvBool("XMPP_PUSH_APNS_SANDBOX", false)
+	cfg.ProxyDomain = os.Getenv("XMPP_PROXY_DOMAIN")
+	cfg.ProxyAddr = getenv("XMPP_PROXY_ADDR", ":7777")
+	cfg.ProxyHost = getenv("XMPP_PROXY_HOST", cfg.Domain)
+	cfg.ProxyRate = getenvInt("XMPP_PROXY_RATE", 0)
+	cfg.ProxyTotalRate = getenvInt("XMPP_PROXY_TOTAL_RATE", 0)
+	cfg.ProxyPendingTimeout = getenvDuration("XMPP_PROXY_PENDING_TIMEOUT", socks5.DefaultPendingTimeout)
+	cfg.ExternalServices = parseCSV(os.Getenv("XMPP_EXTERNAL_SERVICES"))
+	cfg.TURNSecret = os.Getenv("XMPP_TURN_SECRET")
+	cfg.TURNTTL = getenvDuration("XMPP_TURN_TTL", extdisco.DefaultCredentialTTL)
+	cfg.ClusterNode = os.Getenv("XMPP_CLUSTER_NODE")
+	cfg.ClusterRedis = os.Getenv("XMPP_CLUSTER_REDIS")
+	if cfg.ClusterRedis == "" && cfg.Storage == "redis" {
+		cfg.ClusterRedis = cfg.StorageDSN
+	}
+	cfg.ClusterAddr = getenv("XMPP_CLUSTER_ADDR", ":5270")
+	cfg.ClusterAdvertise = os.Getenv("XMPP_CLUSTER_ADVERTISE")
+	cfg.ClusterSecret = os.Getenv("XMPP_CLUSTER_SECRET")
+	cfg.ClusterHeartbeat = getenvDuration("XMPP_CLUSTER_HEARTBEAT", defaultClusterHeartbeat)
+	cfg.ClusterTLSCert = os.Getenv("XMPP_CLUSTER_TLS_CERT")
+	cfg.ClusterTLSKey = os.Getenv("XMPP_CLUSTER_TLS_KEY")
+	cfg.ClusterTLSCA = os.Getenv("XMPP_CLUSTER_TLS_CA")
 	return cfg
 }
 
@@ -110,6 +427,16 @@ func getenvDuration(key string, fallback time.Duration) time.Duration {
 	return d
 }
 
+// getenvRateLimit reads a rate per second, which may be fractional, and
+// the burst allowed above it.
+func getenvRateLimit(rateKey, burstKey string) xmpp.RateLimit {
+	rate, err := strconv.ParseFloat(os.Getenv(rateKey), 64)
+	if err != nil || rate < 0 {
+		rate = 0
+	}
+	return xmpp.RateLimit{Rate: rate, Burst: getenvInt(burstKey, 0)}
+}
+
 func parseCSV(v string) []string {
 	if v == "" {
 		return nil
@@ -161,3 +488,24 @@ func parseTokenSet(v string) map[string]struct{} {
 	}
 	return out
 }
+
+// parseKeyValues parses "key=value" pairs separated by commas.
+func parseKeyValues(v string) map[string]string {
+	out := map[string]string{}
+	for _, p := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		val := strings.TrimSpace(kv[1])
+		if key == "" || val == "" {
+			continue
+		}
+		out[key] = val
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/csi"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+	"github.com/meszmate/xmpp-go/stanza"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// globalCSI holds back the stanzas routed to clients that reported being
+// inactive (XEP-0352). It does nothing until configured with XMPP_CSI on.
+var globalCSI = newCSIService()
+
+type csiService struct {
+	mu      sync.Mutex
+	enabled bool
+	rules   csi.Rules
+	max     int
+	queues  map[*xmpp.Session]*csi.Queue
+}
+
+func newCSIService() *csiService {
+	return &csiService{queues: make(map[*xmpp.Session]*csi.Queue)}
+}
+
+// configure applies the CSI settings of cfg to the sessions that report a
+// state from now on.
+func (c *csiService) configure(cfg Config) error {
+	presence, err := csi.ParseAction(cfg.CSIPresence)
+	if err != nil {
+		return fmt.Errorf("presence: %w", err)
+	}
+	chatStates, err := csi.ParseAction(cfg.CSIChatStates)
+	if err != nil {
+		return fmt.Errorf("chat states: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = cfg.CSI
+	c.rules = csi.Rules{Presence: presence, ChatStates: chatStates}
+	c.max = cfg.CSIMaxQueued
+	return nil
+}
+
+// offered reports whether CSI is advertised to clients.
+func (c *csiService) offered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enabled
+}
+
+// lookup returns the queue of session, or nil while it never reported a
+// state.
+func (c *csiService) lookup(session *xmpp.Session) *csi.Queue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queues[session]
+}
+
+// setActive records the state session reported, sending what was held for
+// it once it is active again. Reports are ignored while CSI is off, as it
+// is not advertised then.
+func (c *csiService) setActive(ctx context.Context, session *xmpp.Session, active bool) error {
+	c.mu.Lock()
+	if !c.enabled {
+		c.mu.Unlock()
+		return nil
+	}
+	q := c.queues[session]
+	if q == nil {
+		q = csi.NewQueue(c.rules, c.max)
+		c.queues[session] = q
+	}
+	c.mu.Unlock()
+	return q.SetActive(ctx, session, active)
+}
+
+// forget drops the queue of a session that has ended, along with what it
+// still held.
+func (c *csiService) forget(session *xmpp.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.queues, session)
+}
+
+// sendStanza routes st to the client of dst, through its CSI queue.
+// Replies to the client's own requests are sent directly instead.
+// A client that left too many stanzas unacknowledged is disconnected.
+func sendStanza(ctx context.Context, dst *xmpp.Session, st stanza.Stanza) error {
+	var err error
+	if q := globalCSI.lookup(dst); q != nil {
+		err = q.Send(ctx, dst, st)
+	} else {
+		err = dst.Send(ctx, st)
+	}
+	if errors.Is(err, sm.ErrUnackedLimit) {
+		overflowed(ctx, dst, st)
+		return nil
+	}
+	return err
+}
+
+// handleCSI processes an <active/> or <inactive/> nonza, which is ignored
+// before resource binding.
+func handleCSI(ctx context.Context, session *xmpp.Session, reader *xmppxml.StreamReader, start *xml.StartElement) error {
+	if err := reader.Skip(); err != nil {
+		return err
+	}
+	if session.State()&xmpp.StateReady == 0 {
+		return nil
+	}
+	switch start.Name.Local {
+	case "active":
+		return globalCSI.setActive(ctx, session, true)
+	case "inactive":
+		return globalCSI.setActive(ctx, session, false)
+	}
+	return nil
+}
+
+func writeCSIFeature(writer *xmppxml.StreamWriter) error {
+	feature := xml.StartElement{Name: xml.Name{Space: ns.CSI, Local: "csi"}}
+	if err := writer.EncodeToken(feature); err != nil {
+		return err
+	}
+	return writer.EncodeToken(xml.EndElement{Name: feature.Name})
+}
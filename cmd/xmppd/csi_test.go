@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// setupCSI enables CSI with the default rules for the duration of t.
+func setupCSI(t *testing.T) {
+	t.Helper()
+	if err := globalCSI.configure(Config{CSI: true, CSIPresence: "buffer", CSIChatStates: "drop", CSIMaxQueued: 100}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = globalCSI.configure(Config{CSIPresence: "buffer", CSIChatStates: "drop"}) })
+}
+
+// reportState feeds the CSI nonza for state to handleCSI.
+func reportState(t *testing.T, session *xmpp.Session, state string) {
+	t.Helper()
+	reader := xmppxml.NewStreamReader(strings.NewReader("<" + state + " xmlns='" + ns.CSI + "'/>"))
+	tok, err := reader.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := tok.(xml.StartElement)
+	if err := handleCSI(context.Background(), session, reader, &start); err != nil {
+		t.Fatalf("handleCSI: %v", err)
+	}
+}
+
+func TestCSIHoldsBackPresenceAndChatStates(t *testing.T) {
+	setupCSI(t)
+	ctx := context.Background()
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	carol := newOrderedPeer(t, "carol@example.com/phone")
+	carol.session.SetState(xmpp.StateBound | xmpp.StateReady)
+	t.Cleanup(func() { globalCSI.forget(carol.session) })
+
+	reportState(t, carol.session, "inactive")
+	for _, show := range []string{stanza.ShowAway, stanza.ShowDND} {
+		pres := stanza.NewPresence(stanza.PresenceAvailable)
+		pres.To, pres.Show = jid.MustParse("carol@example.com/phone"), show
+		if err := routePresence(ctx, bob.session, pres); err != nil {
+			t.Fatal(err)
+		}
+	}
+	typing := stanza.NewMessage(stanza.MessageChat)
+	typing.To = jid.MustParse("carol@example.com")
+	typing.Extensions = []stanza.Extension{{XMLName: xml.Name{Space: ns.ChatStates, Local: "composing"}}}
+	if err := routeMessage(ctx, bob.session, typing); err != nil {
+		t.Fatal(err)
+	}
+	carol.quiet(t)
+
+	// A message is urgent and brings the latest presence along.
+	chat(t, bob.session, "carol@example.com", "hello")
+	if pres := carol.presence(t); pres.Show != stanza.ShowDND {
+		t.Fatalf("presence show = %q", pres.Show)
+	}
+	if msg := carol.message(t); msg.Body() != "hello" {
+		t.Fatalf("message body = %q", msg.Body())
+	}
+	carol.quiet(t)
+
+	pres := stanza.NewPresence(stanza.PresenceUnavailable)
+	pres.To = jid.MustParse("carol@example.com/phone")
+	_ = routePresence(ctx, bob.session, pres)
+	carol.quiet(t)
+	reportState(t, carol.session, "active")
+	if pres := carol.presence(t); pres.Type != stanza.PresenceUnavailable {
+		t.Fatalf("presence type = %q", pres.Type)
+	}
+}
+
+func TestCSIIgnoredBeforeBind(t *testing.T) {
+	setupCSI(t)
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	carol := newOrderedPeer(t, "carol@example.com/phone")
+	reportState(t, carol.session, "inactive")
+	chat(t, bob.session, "carol@example.com", "hello")
+	if globalCSI.lookup(carol.session) != nil {
+		t.Fatal("state recorded before bind")
+	}
+	carol.message(t)
+}
+
+func TestCSIFeature(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		if enabled {
+			setupCSI(t)
+		}
+		session, err := xmpp.NewSession(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.SetState(xmpp.StateSecure | xmpp.StateAuthenticated)
+		var buf bytes.Buffer
+		writer := xmppxml.NewStreamWriter(&buf)
+		if err := writeStreamFeatures(writer, Config{}, session, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), ns.CSI); got != enabled {
+			t.Fatalf("enabled %v: features %s", enabled, buf.String())
+		}
+	}
+}
+
+func TestCSIDisabled(t *testing.T) {
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	carol := newOrderedPeer(t, "carol@example.com/phone")
+	carol.session.SetState(xmpp.StateBound | xmpp.StateReady)
+	reportState(t, carol.session, "inactive")
+	chat(t, bob.session, "carol@example.com", "hello")
+	if globalCSI.lookup(carol.session) != nil {
+		t.Fatal("state recorded while CSI is off")
+	}
+	carol.message(t)
+
+	if err := newCSIService().configure(Config{CSI: true, CSIPresence: "buffer", CSIChatStates: "hold"}); err == nil {
+		t.Fatal("unknown chat state action was accepted")
+	}
+}
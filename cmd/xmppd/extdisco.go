@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/plugins/extdisco"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// globalExtDisco tells local users of the STUN and TURN servers they can
+// use for Jingle calls (XEP-0215). It is nil unless services were listed
+// in XMPP_EXTERNAL_SERVICES.
+var globalExtDisco *extdisco.Plugin
+
+func newExternalServices(cfg Config) (*extdisco.Plugin, error) {
+	if len(cfg.ExternalServices) == 0 {
+		return nil, nil
+	}
+	services := make([]extdisco.Service, 0, len(cfg.ExternalServices))
+	for _, uri := range cfg.ExternalServices {
+		svc, err := extdisco.ParseServiceURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+	p := extdisco.New()
+	p.SetServices(services...)
+	if cfg.TURNSecret != "" {
+		p.SetSecret(cfg.TURNSecret, cfg.TURNTTL)
+	}
+	return p, nil
+}
+
+// answerExternalServices returns the reply to a request from source for
+// the external services or their credentials, or nil when iq is not one.
+// Credentials are only handed to local users.
+func answerExternalServices(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQGet {
+		return nil
+	}
+	if xml.Unmarshal(iq.Query, &extdisco.Services{}) != nil && xml.Unmarshal(iq.Query, &extdisco.Credentials{}) != nil {
+		return nil
+	}
+	if globalExtDisco == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "no external services"))
+	}
+	from := source.RemoteAddr()
+	if from.Local() == "" || isRemote(from) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+	}
+	iq.From = from
+	return globalExtDisco.HandleIQ(ctx, iq)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/extdisco"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestExternalServices(t *testing.T) {
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	const services = `<services xmlns='urn:xmpp:extdisco:2'/>`
+	if reply := romeo.request(t, stanza.IQGet, "example.com", services); !refused(reply, stanza.ErrorServiceUnavailable) {
+		t.Fatalf("disabled: %s", reply.Query)
+	}
+
+	if _, err := newExternalServices(Config{ExternalServices: []string{"ftp:example.com"}}); err == nil {
+		t.Fatal("a bad service URI was accepted")
+	}
+	p, err := newExternalServices(Config{
+		ExternalServices: []string{"stun:turn.example.com", "turn:turn.example.com?transport=tcp"},
+		TURNSecret:       "north",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := globalExtDisco
+	globalExtDisco = p
+	t.Cleanup(func() { globalExtDisco = old })
+
+	var q extdisco.Services
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "example.com", services).Query, &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Services) != 2 || q.Services[0].Restricted || !q.Services[1].Restricted {
+		t.Fatalf("services = %+v", q.Services)
+	}
+	if turn := q.Services[1]; turn.Transport != "tcp" || !strings.HasSuffix(turn.Username, ":romeo@example.com") || turn.Password == "" {
+		t.Fatalf("turn service = %+v", turn)
+	}
+
+	server := newOrderedPeer(t, "evil.example")
+	if reply := server.request(t, stanza.IQGet, "example.com", services); !refused(reply, stanza.ErrorForbidden) {
+		t.Fatalf("remote request: %s", reply.Query)
+	}
+}
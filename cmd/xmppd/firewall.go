@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// loadRules reads the stanza filtering rules of XMPP_FIREWALL_RULES.
+func loadRules(path string) ([]xmpp.Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRules(f)
+}
+
+// parseRules parses rules, one per line: an action followed by conditions,
+// such as
+//
+//	bounce=not-acceptable kind=message roster=unknown body="(?i)buy now"
+//
+// The actions are pass, drop, bounce[=condition], redirect=jid,
+// ratelimit=rate[/burst] and log. The conditions are name, dir (in or
+// out), kind, type, from and to (domains), body (a regular expression) and
+// roster (known or unknown); kind, type, from and to take comma-separated
+// lists. Values with spaces are double-quoted. Blank lines and lines
+// starting with # are ignored.
+func parseRules(r io.Reader) ([]xmpp.Rule, error) {
+	var rules []xmpp.Rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if rule.Name == "" {
+			rule.Name = "line " + strconv.Itoa(n)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (xmpp.Rule, error) {
+	var rule xmpp.Rule
+	fields, err := splitRuleFields(line)
+	if err != nil {
+		return rule, err
+	}
+	action, arg, _ := strings.Cut(fields[0], "=")
+	switch action {
+	case "pass":
+		rule.Action = xmpp.ActionPass
+	case "drop":
+		rule.Action = xmpp.ActionDrop
+	case "bounce":
+		rule.Action, rule.Condition = xmpp.ActionBounce, arg
+	case "redirect":
+		rule.Action = xmpp.ActionRedirect
+		if rule.RedirectTo, err = jid.Parse(arg); err != nil {
+			return rule, fmt.Errorf("redirect: %w", err)
+		}
+	case "ratelimit":
+		rule.Action = xmpp.ActionRateLimit
+		rate, burst, _ := strings.Cut(arg, "/")
+		if rule.Rate.Rate, err = strconv.ParseFloat(rate, 64); err != nil || rule.Rate.Rate <= 0 {
+			return rule, fmt.Errorf("ratelimit: bad rate %q", rate)
+		}
+		if burst != "" {
+			if rule.Rate.Burst, err = strconv.Atoi(burst); err != nil {
+				return rule, fmt.Errorf("ratelimit: bad burst %q", burst)
+			}
+		}
+	case "log":
+		rule.Action = xmpp.ActionLog
+	default:
+		return rule, fmt.Errorf("unknown action %q", action)
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return rule, fmt.Errorf("condition %q without a value", field)
+		}
+		switch key {
+		case "name":
+			rule.Name = value
+		case "dir":
+			switch value {
+			case "in":
+				rule.Direction = xmpp.RuleInbound
+			case "out":
+				rule.Direction = xmpp.RuleOutbound
+			default:
+				return rule, fmt.Errorf("dir: %q is not in or out", value)
+			}
+		case "kind":
+			rule.Kinds = parseCSV(value)
+		case "type":
+			rule.Types = parseCSV(value)
+		case "from":
+			rule.FromDomains = parseCSV(value)
+		case "to":
+			rule.ToDomains = parseCSV(value)
+		case "body":
+			if rule.Body, err = regexp.Compile(value); err != nil {
+				return rule, fmt.Errorf("body: %w", err)
+			}
+		case "roster":
+			switch value {
+			case "known":
+				rule.Roster = xmpp.RosterKnown
+			case "unknown":
+				rule.Roster = xmpp.RosterUnknown
+			default:
+				return rule, fmt.Errorf("roster: %q is not known or unknown", value)
+			}
+		default:
+			return rule, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+	return rule, nil
+}
+
+// splitRuleFields splits line at spaces outside double-quoted values,
+// unquoting them.
+func splitRuleFields(line string) ([]string, error) {
+	var fields []string
+	for line != "" {
+		end := strings.IndexAny(line, " \t")
+		if q := strings.IndexByte(line, '"'); q >= 0 && (end < 0 || q < end) {
+			// The value runs to the closing quote.
+			quoted, err := strconv.QuotedPrefix(line[q:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quote in %q", line)
+			}
+			value, _ := strconv.Unquote(quoted)
+			fields = append(fields, line[:q]+value)
+			line = strings.TrimLeft(line[q+len(quoted):], " \t")
+			continue
+		}
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = strings.TrimLeft(line[end:], " \t")
+	}
+	return fields, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+# Strangers may not advertise.
+bounce=not-acceptable name=ads dir=in kind=message roster=unknown body="(?i)buy now"
+drop from=*.spam.example,spam.example
+redirect=abuse@example.com to=example.com type=headline
+ratelimit=0.5/5 kind=presence
+log dir=out
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("parsed %d rules", len(rules))
+	}
+	ads := rules[0]
+	if ads.Name != "ads" || ads.Action != xmpp.ActionBounce || ads.Condition != "not-acceptable" || ads.Direction != xmpp.RuleInbound ||
+		ads.Roster != xmpp.RosterUnknown || !ads.Body.MatchString("Buy now!") || ads.Body.MatchString("buy") {
+		t.Fatalf("rule %+v", ads)
+	}
+	if r := rules[1]; r.Name != "line 4" || r.Action != xmpp.ActionDrop || len(r.FromDomains) != 2 {
+		t.Fatalf("rule %+v", r)
+	}
+	if r := rules[2]; r.RedirectTo.String() != "abuse@example.com" || r.ToDomains[0] != "example.com" || r.Types[0] != "headline" {
+		t.Fatalf("rule %+v", r)
+	}
+	if r := rules[3]; r.Rate != (xmpp.RateLimit{Rate: 0.5, Burst: 5}) {
+		t.Fatalf("rule %+v", r)
+	}
+	if r := rules[4]; r.Action != xmpp.ActionLog || r.Direction != xmpp.RuleOutbound {
+		t.Fatalf("rule %+v", r)
+	}
+
+	for _, line := range []string{
+		"reject kind=message",
+		"drop kind",
+		"drop colour=red",
+		"ratelimit=fast",
+		"redirect=",
+		`drop body="unterminated`,
+		"drop dir=sideways",
+	} {
+		if _, err := parseRules(strings.NewReader(line)); err == nil {
+			t.Errorf("parsed %q", line)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// guestPrefix starts the usernames given to guests.
+const guestPrefix = "guest-"
+
+// globalGuests tracks the sessions of guests, clients that logged in with
+// SASL ANONYMOUS. It is nil when XMPP_SASL_MECHANISMS does not offer
+// ANONYMOUS.
+var globalGuests *guestService
+
+type guestService struct {
+	cfg      Config
+	store    storage.Storage
+	services []string
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	sessions map[*xmpp.Session]*time.Timer
+}
+
+func newGuestService(cfg Config, store storage.Storage) *guestService {
+	if !slices.Contains(cfg.SASLMechanisms, "ANONYMOUS") {
+		return nil
+	}
+	return &guestService{
+		cfg:      cfg,
+		store:    store,
+		services: cfg.GuestServices,
+		ttl:      cfg.GuestTTL,
+		sessions: make(map[*xmpp.Session]*time.Timer),
+	}
+}
+
+// guestIdentity returns a new username for a guest that no account has.
+func guestIdentity(ctx context.Context, us storage.UserStore) (string, error) {
+	for {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		username := guestPrefix + hex.EncodeToString(b)
+		exists, err := us.UserExists(ctx, username)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return username, nil
+		}
+	}
+}
+
+// admit records that session belongs to a guest, and ends it once the guest
+// TTL is over.
+func (s *guestService) admit(ctx context.Context, session *xmpp.Session) {
+	if s == nil {
+		return
+	}
+	var timer *time.Timer
+	if s.ttl > 0 {
+		ctx := context.WithoutCancel(ctx)
+		timer = time.AfterFunc(s.ttl, func() {
+			session.Log(ctx, slog.LevelInfo, "guest session expired")
+			disconnect(ctx, []*xmpp.Session{session}, stream.NewError(stream.ErrPolicyViolation, "guest session expired"))
+		})
+	}
+	s.mu.Lock()
+	s.sessions[session] = timer
+	s.mu.Unlock()
+}
+
+// is reports whether session belongs to a guest.
+func (s *guestService) is(session *xmpp.Session) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.sessions[session]
+	return ok
+}
+
+// check returns the error to bounce st with when the guest of session may
+// not send it, or nil. Guests may talk to the server and to themselves, and
+// reach the service domains of XMPP_GUEST_SERVICES, but not other users or
+// in-band registration.
+func (s *guestService) check(session *xmpp.Session, st stanza.Stanza) *stanza.StanzaError {
+	if !s.is(session) {
+		return nil
+	}
+	var query struct{ XMLName xml.Name }
+	if iq, ok := st.(*stanza.IQ); ok && xml.Unmarshal(iq.Query, &query) == nil && query.XMLName.Space == ns.Register {
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "guests cannot register")
+	}
+	to := st.GetHeader().To
+	switch {
+	case to.IsZero(), to.String() == s.cfg.Domain, to.Bare().Equal(session.RemoteAddr().Bare()),
+		slices.Contains(s.services, "*"), slices.Contains(s.services, to.Domain()):
+		return nil
+	}
+	return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "guests cannot reach "+to.Domain())
+}
+
+// forget erases what the guest of session stored once its session is over.
+func (s *guestService) forget(ctx context.Context, session *xmpp.Session) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	timer, ok := s.sessions[session]
+	delete(s.sessions, session)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	ctx = context.WithoutCancel(ctx)
+	guest := session.RemoteAddr().Bare()
+	hosts, err := userDataHosts(ctx, s.cfg, s.store)
+	if err == nil {
+		err = storage.DeleteUserData(ctx, s.store, guest.String(), hosts...)
+	}
+	if err != nil {
+		logError(ctx, "guest cleanup error", "user", guest, "error", err)
+	}
+}
+
+// refuseStanza answers st, which session may not send, with stanzaErr.
+func refuseStanza(ctx context.Context, session *xmpp.Session, st stanza.Stanza, stanzaErr *stanza.StanzaError) error {
+	session.Metrics().RoutingFailed(stanzaErr.Condition)
+	switch v := st.(type) {
+	case *stanza.IQ:
+		if v.Type == stanza.IQGet || v.Type == stanza.IQSet {
+			return session.Send(ctx, v.ErrorIQ(stanzaErr))
+		}
+	case *stanza.Message:
+		if v.Type != stanza.MessageError {
+			return session.Send(ctx, messageError(v, stanzaErr))
+		}
+	case *stanza.Presence:
+		if v.Type != stanza.PresenceError {
+			return session.Send(ctx, presenceError(v, stanzaErr))
+		}
+	}
+	return nil
+}
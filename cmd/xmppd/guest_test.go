@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+func setupGuests(t *testing.T, cfg Config) *memory.Store {
+	t.Helper()
+	store := memory.New()
+	globalGuests = newGuestService(cfg, store)
+	t.Cleanup(func() { globalGuests = nil })
+	return store
+}
+
+func TestSASLAnonymousGuest(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig("PLAIN", "ANONYMOUS")
+	cfg.GuestServices = []string{"conference.example.com"}
+	store := setupGuests(t, cfg)
+
+	p := newSASLPeer(t, cfg, false)
+	p.send(saslAuthElement("ANONYMOUS", []byte("visitor@shop.example")))
+	if r := p.reply(t); r.XMLName.Local != "success" {
+		t.Fatalf("got %s %s, want success", r.XMLName.Local, r.Inner)
+	}
+	p.finish(t)
+	guest := p.session.RemoteAddr()
+	if !strings.HasPrefix(*p.user, guestPrefix) || guest.Local() != *p.user || !globalGuests.is(p.session) {
+		t.Fatalf("guest %q at %s", *p.user, guest)
+	}
+
+	for to, allowed := range map[string]bool{
+		"":                             true,
+		"example.com":                  true,
+		guest.String() + "/phone":      true,
+		"lobby@conference.example.com": true,
+		"bob@example.com":              false,
+		"remote.example":               false,
+	} {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		if to != "" {
+			msg.To = jid.MustParse(to)
+		}
+		if err := globalGuests.check(p.session, msg); (err == nil) != allowed {
+			t.Errorf("message to %q: %v", to, err)
+		}
+	}
+	register := stanza.NewIQ(stanza.IQGet)
+	register.Query = []byte("<query xmlns='jabber:iq:register'/>")
+	if err := globalGuests.check(p.session, register); err == nil {
+		t.Error("guest may register")
+	}
+
+	// Users are not restricted.
+	alice := newSASLPeer(t, cfg, false)
+	alice.send(saslAuthElement("PLAIN", []byte("\x00alice\x00pencil")))
+	alice.reply(t)
+	alice.finish(t)
+	if globalGuests.is(alice.session) || globalGuests.check(alice.session, stanza.NewMessage(stanza.MessageChat)) != nil {
+		t.Fatal("user treated as a guest")
+	}
+
+	if err := store.VCardStore().SetVCard(ctx, guest.String(), []byte("<vCard xmlns='vcard-temp'/>")); err != nil {
+		t.Fatal(err)
+	}
+	globalGuests.forget(ctx, p.session)
+	if globalGuests.is(p.session) {
+		t.Fatal("guest still tracked")
+	}
+	if _, err := store.VCardStore().GetVCard(ctx, guest.String()); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("guest vCard kept: %v", err)
+	}
+}
+
+func TestGuestTTL(t *testing.T) {
+	cfg := testConfig("ANONYMOUS")
+	cfg.GuestTTL = 10 * time.Millisecond
+	setupGuests(t, cfg)
+	c1, c2 := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	addr := jid.MustParse("guest-1@example.com/web")
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(addr))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close(); c2.Close() })
+	globalRouter.register(addr, session)
+	globalGuests.admit(context.Background(), session)
+	select {
+	case <-session.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("guest session outlived its TTL")
+	}
+	if len(globalRouter.targets(addr)) != 0 {
+		t.Fatal("expired guest still routed")
+	}
+}
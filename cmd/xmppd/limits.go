@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/meszmate/xmpp-go"
+)
+
+// newLimitPolicy returns the rate limiter configured with the XMPP_*_RATE
+// and XMPP_AUTH_* variables, logging the peers that cross a limit, or nil
+// when no limit is set.
+func newLimitPolicy(cfg Config) *xmpp.RateLimiter {
+	l := cfg.Limits
+	if l.StanzasPerJID.Rate <= 0 && l.StanzasPerIP.Rate <= 0 && l.BytesPerJID.Rate <= 0 && l.BytesPerIP.Rate <= 0 &&
+		l.ConnectionsPerIP.Rate <= 0 && (l.AuthFailures <= 0 || l.AuthLockout <= 0) {
+		return nil
+	}
+	limiter := xmpp.NewRateLimiter(l, nil)
+	limiter.OnLimit(func(ev xmpp.LimitEvent) {
+		args := []any{"limit", ev.Kind.String(), "ip", ev.IP}
+		if !ev.JID.IsZero() {
+			args = append(args, "jid", ev.JID.String())
+		}
+		if ev.Kind == xmpp.LimitAuth {
+			args = append(args, "user", ev.Username, "lockout", ev.Lockout)
+		}
+		slog.Warn("rate limit exceeded", args...)
+	})
+	return limiter
+}
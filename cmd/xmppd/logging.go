@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/meszmate/xmpp-go"
+)
+
+// newLogger returns the logger configured with XMPP_LOG_LEVEL and
+// XMPP_LOG_FORMAT. Its records carry the trace ID of the stanza being
+// handled.
+func newLogger(cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(xmpp.NewTraceHandler(h))
+}
+
+type sessionKey struct{}
+
+// withSession returns a copy of ctx whose log records carry the ID,
+// address and direction of session.
+func withSession(ctx context.Context, session *xmpp.Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// logAt logs msg with args at level, through the session ctx was made
+// with by withSession if there is one.
+func logAt(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if session, ok := ctx.Value(sessionKey{}).(*xmpp.Session); ok {
+		session.Log(ctx, level, msg, args...)
+		return
+	}
+	slog.Default().Log(ctx, level, msg, args...)
+}
+
+// logError logs a failure that is not reported to the peer.
+func logError(ctx context.Context, msg string, args ...any) {
+	logAt(ctx, slog.LevelError, msg, args...)
+}
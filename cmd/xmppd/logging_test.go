@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+func TestLogAtSession(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1),
+		xmpp.WithLogger(logger), xmpp.WithState(xmpp.StateServer), xmpp.WithRemoteAddr(jid.MustParse("alice@example.com/phone")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	ctx := xmpp.WithTraceID(withSession(context.Background(), session), "0123abcd")
+	logError(ctx, "archive error", "user", "alice@example.com", "error", "boom")
+	out := buf.String()
+	for _, want := range []string{
+		"level=ERROR", `msg="archive error"`, "session=" + session.ID(), "jid=alice@example.com/phone",
+		"direction=inbound", "trace_id=0123abcd", "user=alice@example.com", "error=boom",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output %q lacks %q", out, want)
+		}
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	t.Setenv("XMPP_LOG_LEVEL", "warn")
+	t.Setenv("XMPP_LOG_FORMAT", "JSON")
+	cfg := loadConfig()
+	if cfg.LogLevel != slog.LevelWarn || cfg.LogFormat != "json" || cfg.DebugXML {
+		t.Fatalf("level %v, format %q, debug %v", cfg.LogLevel, cfg.LogFormat, cfg.DebugXML)
+	}
+	if newLogger(cfg).Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("info enabled at warn level")
+	}
+
+	// The stream dump needs debug records.
+	t.Setenv("XMPP_DEBUG_XML", "true")
+	if cfg := loadConfig(); cfg.LogLevel != slog.LevelDebug || !cfg.DebugXML {
+		t.Fatalf("level %v, debug %v", cfg.LogLevel, cfg.DebugXML)
+	}
+}
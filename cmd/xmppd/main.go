@@ -10,23 +10,31 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	xmpp "github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/metrics"
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/cache"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 	"github.com/meszmate/xmpp-go/storage/file"
+	"github.com/meszmate/xmpp-go/storage/ldap"
 	"github.com/meszmate/xmpp-go/storage/memory"
 	"github.com/meszmate/xmpp-go/storage/mongodb"
 	"github.com/meszmate/xmpp-go/storage/mysql"
 	"github.com/meszmate/xmpp-go/storage/postgres"
 	"github.com/meszmate/xmpp-go/storage/redis"
+	"github.com/meszmate/xmpp-go/storage/s3"
+	xmppsql "github.com/meszmate/xmpp-go/storage/sql"
 	"github.com/meszmate/xmpp-go/storage/sqlite"
 
 	redislib "github.com/redis/go-redis/v9"
@@ -34,10 +42,18 @@ import (
 
 func main() {
 	cfg := loadConfig()
+	slog.SetDefault(newLogger(cfg))
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(ctx, cfg, os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
 	if cfg.TLSSelfSigned && (cfg.TLSCert == "" || cfg.TLSKey == "") {
 		certPath, keyPath, err := ensureSelfSigned(cfg)
 		if err != nil {
@@ -47,13 +63,53 @@ func main() {
 		cfg.TLSKey = keyPath
 	}
 	if cfg.Domain == "example.com" {
-		log.Printf("warning: XMPP_DOMAIN is set to example.com (default). Set it to your real domain.")
+		slog.Warn("XMPP_DOMAIN is set to example.com (default). Set it to your real domain.")
+	}
+
+	tlsConfig, cert, err := buildTLSConfig(ctx, cfg)
+	if err != nil {
+		log.Fatalf("tls: %v", err)
+	}
+
+	// Accounts upgraded at login keep what the configured mechanisms need.
+	credentials.KeepPlaintext = cfg.Registration.KeepPlaintext
+	if cfg.Registration.Iterations > 0 {
+		credentials.SCRAMIterations = cfg.Registration.Iterations
 	}
 
 	store, err := buildStorage(cfg)
 	if err != nil {
 		log.Fatalf("storage: %v", err)
 	}
+	if s, ok := store.(*xmppsql.Store); ok && !cfg.AutoMigrate {
+		// Refuse to start on an outdated schema rather than migrate it;
+		// "xmppd migrate" applies the pending migrations.
+		s.SetDryRun(true)
+	}
+	if store != nil && cfg.BlobS3Bucket != "" {
+		if globalBlobs, err = newBlobStore(cfg); err != nil {
+			log.Fatalf("blob storage: %v", err)
+		}
+		store = storage.Offload(store, globalBlobs, cfg.BlobThreshold)
+	}
+	if cfg.StorageNamespace != "" {
+		if store, err = storage.Namespace(store, cfg.StorageNamespace); err != nil {
+			log.Fatalf("storage: %v", err)
+		}
+	}
+	if store != nil && cfg.LDAPURL != "" {
+		if store, err = newLDAPStorage(store, cfg); err != nil {
+			log.Fatalf("ldap: %v", err)
+		}
+	}
+	if store != nil {
+		store = storage.LimitRosterItems(store, cfg.MaxRosterItems)
+		store = storage.ShareRosterGroups(store)
+	}
+	if store != nil && cfg.StorageCacheSize > 0 {
+		globalStorageCache = newStorageCache(store, cfg)
+		store = globalStorageCache
+	}
 
 	plugins, err := buildPlugins(cfg)
 	if err != nil {
@@ -65,6 +121,24 @@ func main() {
 
 	opts := []xmpp.ServerOption{
 		xmpp.WithServerAddr(cfg.Addr),
+		xmpp.WithMaxConnsPerIP(cfg.MaxConnsPerIP),
+		xmpp.WithMaxTotalConns(cfg.MaxConns),
+		xmpp.WithServerStreamLimits(xmpp.StreamLimits{
+			MaxStanzaSize: int64(cfg.MaxStanzaSize),
+			MaxDepth:      cfg.MaxXMLDepth,
+			ReadRate:      int64(cfg.ReadRate),
+			ReadBurst:     int64(cfg.ReadBurst),
+		}),
+	}
+	if limiter := newLimitPolicy(cfg); limiter != nil {
+		opts = append(opts, xmpp.WithServerLimitPolicy(limiter))
+	}
+	if cfg.FirewallRules != "" {
+		rules, err := loadRules(cfg.FirewallRules)
+		if err != nil {
+			log.Fatalf("firewall rules: %v", err)
+		}
+		opts = append(opts, xmpp.WithServerRules(rules))
 	}
 	if store != nil {
 		opts = append(opts, xmpp.WithServerStorage(store))
@@ -72,32 +146,255 @@ func main() {
 	if len(plugins) > 0 {
 		opts = append(opts, xmpp.WithServerPlugins(plugins...))
 	}
+	if cfg.S2S {
+		opts = append(opts, xmpp.WithServerS2S(s2sConfig(cfg, tlsConfig)))
+	}
+	if cfg.DebugXML {
+		opts = append(opts, xmpp.WithServerStreamDump())
+	}
+	var prom *metrics.Prometheus
+	if cfg.MetricsAddr != "" {
+		prom = metrics.New()
+		opts = append(opts, xmpp.WithServerMetrics(prom))
+	}
 	opts = append(opts, xmpp.WithServerSessionHandler(func(ctx context.Context, session *xmpp.Session) {
 		seedOnce.Do(func() {
 			if store == nil {
 				return
 			}
-			if err := seedDefaultAccounts(ctx, store, cfg.DefaultAccounts); err != nil {
+			if err := seedDefaultAccounts(ctx, store, cfg.DefaultAccounts, cfg.Registration); err != nil {
 				seedErr = err
 			}
 		})
 		if seedErr != nil {
-			log.Printf("seed accounts: %v", seedErr)
+			slog.Error("seed accounts failed", "error", seedErr)
 			_ = session.Close()
 			return
 		}
-		serveSession(ctx, session, cfg, store)
+		serveSession(ctx, session, cfg, tlsConfig, store)
 	}))
 
 	server, err := xmpp.NewServer(cfg.Domain, opts...)
 	if err != nil {
 		log.Fatalf("server: %v", err)
 	}
+	globalS2S = server.S2S()
+	// The services share the server's storage, so their calls are measured
+	// with the server's.
+	store = server.Storage()
 
-	log.Printf("xmpp-go server starting domain=%s addr=%s storage=%s", cfg.Domain, cfg.Addr, cfg.Storage)
-	if err := server.ListenAndServe(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+	globalRoster, err = newRosterService(ctx, cfg, store)
+	if err != nil {
+		log.Fatalf("roster: %v", err)
+	}
+	globalSharedGroups = newSharedGroupService(cfg, store)
+	globalPEP, err = newPEPService(ctx, cfg, store)
+	if err != nil {
+		log.Fatalf("pep: %v", err)
+	}
+	globalVCards = newVCardService(store)
+	globalCaps = newCapsTable(store.CapsStore())
+	globalSearch = newSearchService(cfg)
+	globalCommands = newCommandService(cfg, store)
+	globalAnnouncements = newAnnouncementService(cfg, store)
+	globalServerInfo, err = newServerInfo(cfg)
+	if err != nil {
+		log.Fatalf("server info: %v", err)
+	}
+	globalOffline = newOfflineService(cfg, store)
+	globalNotifications, err = newNotificationService(ctx, cfg, store)
+	if err != nil {
+		log.Fatalf("push: %v", err)
+	}
+	globalPushGateway, err = newPushGateway(cfg)
+	if err != nil {
+		log.Fatalf("push gateway: %v", err)
+	}
+	globalProxy, err = newBytestreamProxy(cfg)
+	if err != nil {
+		log.Fatalf("proxy: %v", err)
+	}
+	globalComponents, err = newComponentService(cfg)
+	if err != nil {
+		log.Fatalf("components: %v", err)
+	}
+	globalExtDisco, err = newExternalServices(cfg)
+	if err != nil {
+		log.Fatalf("external services: %v", err)
+	}
+	globalCluster, err = newCluster(cfg)
+	if err != nil {
+		log.Fatalf("cluster: %v", err)
+	}
+	if err := globalCSI.configure(cfg); err != nil {
+		log.Fatalf("csi: %v", err)
+	}
+	globalSM.configure(cfg)
+	globalArchive = newArchiveService(cfg, store)
+	globalMUC = newMUCService(cfg, store)
+	globalMIX, err = newMIXService(ctx, cfg, store)
+	if err != nil {
+		log.Fatalf("mix: %v", err)
+	}
+	globalBlocking = newBlockingService(cfg, store)
+	globalGuests = newGuestService(cfg, store)
+	globalRetention = newRetentionService(cfg, store)
+	globalAuth, err = newAuthProvider(ctx, cfg)
+	if err != nil {
+		log.Fatalf("auth provider: %v", err)
+	}
+	globalPushes = newPushTracker(cfg.RosterPushTimeout, cfg.RosterPushResend)
+
+	server.RegisterOnShutdown(drainSession)
+
+	// Sessions keep their context through a shutdown, so what they store
+	// on the way out is not cancelled with it.
+	serveCtx, cancelServe := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelServe()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		// A second signal stops the process at once.
+		stop()
+		slog.Info("shutting down, waiting for sessions to close", "timeout", cfg.ShutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown did not finish", "error", err)
+		}
+		cancelServe()
+	}()
+
+	if cfg.BOSHAddr != "" {
+		bosh := server.BOSHHandler(xmpp.BOSHConfig{Secure: cfg.BOSHSecure, AllowOrigin: cfg.BOSHAllowOrigin})
+		boshTLS := tlsConfig
+		if cfg.BOSHSecure {
+			// A proxy in front terminates TLS.
+			boshTLS = nil
+		}
+		go func() {
+			if err := serveBOSH(serveCtx, cfg.BOSHAddr, bosh, boshTLS); err != nil {
+				log.Fatalf("bosh: %v", err)
+			}
+		}()
+		slog.Info("bosh listening", "addr", cfg.BOSHAddr, "path", boshPath)
+	}
+
+	if globalProxy != nil {
+		go func() {
+			if err := globalProxy.serve(serveCtx); err != nil {
+				log.Fatalf("proxy: %v", err)
+			}
+		}()
+		slog.Info("bytestream proxy listening", "addr", globalProxy.ln.Addr(), "jid", globalProxy.domain)
+	}
+
+	if globalComponents != nil {
+		go func() {
+			if err := globalComponents.serve(serveCtx); err != nil {
+				log.Fatalf("components: %v", err)
+			}
+		}()
+		slog.Info("component listener listening", "addr", globalComponents.ln.Addr(), "components", globalComponents.items())
+	}
+
+	if globalCluster != nil {
+		if err := globalCluster.start(serveCtx); err != nil {
+			log.Fatalf("cluster: %v", err)
+		}
+		slog.Info("cluster listening", "addr", globalCluster.ln.Addr(), "node", globalCluster.node, "advertise", globalCluster.addr)
+	}
+
+	if globalRetention != nil {
+		go globalRetention.run(serveCtx)
+		slog.Info("message retention enabled", "interval", globalRetention.interval)
+	}
+
+	if prom != nil {
+		go func() {
+			if err := serveMetrics(serveCtx, cfg.MetricsAddr, prom); err != nil {
+				log.Fatalf("metrics: %v", err)
+			}
+		}()
+		slog.Info("metrics listening", "addr", cfg.MetricsAddr, "path", metricsPath)
+	}
+
+	if cfg.AdminAddr != "" {
+		if cfg.AdminToken == "" {
+			log.Fatalf("admin: XMPP_ADMIN_TOKEN is required with XMPP_ADMIN_ADDR")
+		}
+		admin := newAdminAPI(cfg, store, cert)
+		go func() {
+			if err := serveAdmin(serveCtx, cfg.AdminAddr, admin); err != nil {
+				log.Fatalf("admin: %v", err)
+			}
+		}()
+		slog.Info("admin api listening", "addr", cfg.AdminAddr)
+	}
+
+	slog.Info("xmpp-go server starting", "domain", cfg.Domain, "addr", cfg.Addr, "storage", cfg.Storage)
+	if err := server.ListenAndServe(serveCtx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 		log.Fatalf("server: %v", err)
 	}
+	<-shutdownDone
+}
+
+// globalBlobs keeps large vCards, pubsub payloads and uploaded files out of
+// the storage backend. It is nil unless XMPP_BLOB_S3_BUCKET is set.
+var globalBlobs storage.BlobStore
+
+func newBlobStore(cfg Config) (storage.BlobStore, error) {
+	return s3.New(s3.Config{
+		Endpoint:  cfg.BlobS3Endpoint,
+		Region:    cfg.BlobS3Region,
+		Bucket:    cfg.BlobS3Bucket,
+		AccessKey: cfg.BlobS3AccessKey,
+		SecretKey: cfg.BlobS3SecretKey,
+		PathStyle: cfg.BlobS3PathStyle,
+		Prefix:    cfg.BlobS3Prefix,
+	})
+}
+
+// globalStorageCache caches the rosters, vCards and block lists of the
+// storage backend. It is nil unless XMPP_STORAGE_CACHE_SIZE is set.
+var globalStorageCache *cache.Storage
+
+// newStorageCache wraps store in a cache. In a cluster, the writes of each
+// node drop the cached data on the others.
+func newStorageCache(store storage.Storage, cfg Config) *cache.Storage {
+	return cache.New(store,
+		cache.WithRoster(cfg.StorageCacheSize, cfg.StorageCacheTTL),
+		cache.WithVCard(cfg.StorageCacheSize, cfg.StorageCacheTTL),
+		cache.WithBlocking(cfg.StorageCacheSize, cfg.StorageCacheTTL),
+		cache.OnInvalidate(func(kind cache.Kind, user string) { globalCluster.invalidate(kind, user) }),
+	)
+}
+
+// newLDAPStorage takes the accounts of store from the directory at
+// XMPP_LDAP_URL, which checks their passwords.
+func newLDAPStorage(store storage.Storage, cfg Config) (storage.Storage, error) {
+	for _, m := range cfg.SASLMechanisms {
+		if strings.HasPrefix(m, "SCRAM-") {
+			slog.Warn("SCRAM cannot authenticate LDAP accounts; offer PLAIN over TLS", "mechanism", m)
+			break
+		}
+	}
+	return ldap.New(store, ldap.Config{
+		URL:             cfg.LDAPURL,
+		StartTLS:        cfg.LDAPStartTLS,
+		BindDN:          cfg.LDAPBindDN,
+		BindPassword:    cfg.LDAPBindPassword,
+		BaseDN:          cfg.LDAPBaseDN,
+		UserFilter:      cfg.LDAPUserFilter,
+		UsernameAttr:    cfg.LDAPUsernameAttr,
+		VCard:           cfg.LDAPVCard,
+		Domain:          cfg.Domain,
+		GroupBaseDN:     cfg.LDAPGroupBaseDN,
+		GroupFilter:     cfg.LDAPGroupFilter,
+		GroupMemberAttr: cfg.LDAPGroupMemberAttr,
+		GroupNameAttr:   cfg.LDAPGroupNameAttr,
+	})
 }
 
 func buildStorage(cfg Config) (storage.Storage, error) {
@@ -147,7 +444,7 @@ func buildStorage(cfg Config) (storage.Storage, error) {
 	}
 }
 
-func seedDefaultAccounts(ctx context.Context, st storage.Storage, accounts []Account) error {
+func seedDefaultAccounts(ctx context.Context, st storage.Storage, accounts []Account, reg registrationConfig) error {
 	if len(accounts) == 0 {
 		return nil
 	}
@@ -163,7 +460,11 @@ func seedDefaultAccounts(ctx context.Context, st storage.Storage, accounts []Acc
 		if exists {
 			continue
 		}
-		if err := us.CreateUser(ctx, &storage.User{Username: acc.Username, Password: acc.Password}); err != nil {
+		user, err := newUser(acc.Username, acc.Password, reg.Iterations, reg.KeepPlaintext)
+		if err != nil {
+			return err
+		}
+		if err := us.CreateUser(ctx, user); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/forward"
+	"github.com/meszmate/xmpp-go/plugins/mam"
+	"github.com/meszmate/xmpp-go/plugins/rsm"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// mamQuery is a urn:xmpp:mam:2 query with its data form and result set
+// request decoded.
+type mamQuery struct {
+	XMLName  xml.Name   `xml:"urn:xmpp:mam:2 query"`
+	QueryID  string     `xml:"queryid,attr,omitempty"`
+	Form     *form.Form `xml:"jabber:x:data x"`
+	Set      *mamSet    `xml:"http://jabber.org/protocol/rsm set"`
+	FlipPage *struct{}  `xml:"flip-page"`
+}
+
+// mamSet is an XEP-0059 request. Before is a pointer because an empty
+// <before/> asks for the last page.
+type mamSet struct {
+	Max    *int    `xml:"max"`
+	After  string  `xml:"after"`
+	Before *string `xml:"before"`
+}
+
+// answerArchive answers the XEP-0313 queries and preference requests a user
+// sends to their own archive, or returns nil when iq is not one. The results
+// of a query are sent to source before the returned reply.
+func answerArchive(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil
+	}
+	var q mamQuery
+	var prefs mam.Prefs
+	switch {
+	case xml.Unmarshal(iq.Query, &q) == nil:
+	case xml.Unmarshal(iq.Query, &prefs) == nil:
+	default:
+		return nil
+	}
+	if globalArchive == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "message archive disabled"))
+	}
+	owner := source.RemoteAddr().Bare()
+	if q.XMLName.Local == "" {
+		return globalArchive.answerPrefs(ctx, owner, iq, prefs)
+	}
+	if iq.Type == stanza.IQGet {
+		return payloadIQ(iq, mamQuery{Form: mamForm()})
+	}
+	return globalArchive.answerQuery(ctx, owner, source.RemoteAddr(), iq, q, source.Send)
+}
+
+// mamForm returns the fields a query can filter on (XEP-0313 §5.1).
+func mamForm() *form.Form {
+	f := form.NewForm(form.TypeForm, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.MAM}})
+	f.AddField(form.Field{Var: "with", Type: form.FieldJIDSingle})
+	f.AddField(form.Field{Var: "start", Type: form.FieldTextSingle})
+	f.AddField(form.Field{Var: "end", Type: form.FieldTextSingle})
+	return f
+}
+
+// answerQuery sends the page of owner's archive that q asks for to the
+// requester to with send, each message wrapped in a <result/>, and returns
+// the <fin/> reply.
+func (s *archiveService) answerQuery(ctx context.Context, owner, to jid.JID, iq *stanza.IQ, q mamQuery, send func(context.Context, stanza.Stanza) error) *stanza.IQ {
+	query, err := parseMAMQuery(owner, q)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, err.Error()))
+	}
+	res, err := s.store.QueryMessages(ctx, query)
+	if errors.Is(err, storage.ErrNotFound) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such message in the archive"))
+	}
+	if err != nil {
+		logError(ctx, "archive query error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+
+	for _, m := range res.Messages {
+		msg, err := archiveResult(owner, to, q.QueryID, m)
+		if err != nil {
+			logError(ctx, "archived message dropped", "user", owner, "id", m.ID, "error", err)
+			continue
+		}
+		if err := send(ctx, msg); err != nil {
+			logError(ctx, "archive query error", "to", to, "error", err)
+			return nil
+		}
+	}
+
+	set := rsm.Set{Count: &res.Count}
+	if res.First != "" {
+		set.First = &rsm.First{Index: res.Index, Value: res.First}
+		set.Last = res.Last
+	}
+	inner, err := xml.Marshal(set)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return payloadIQ(iq, mam.Fin{Complete: res.Complete, Set: inner})
+}
+
+// parseMAMQuery turns q into a storage query of owner's archive.
+func parseMAMQuery(owner jid.JID, q mamQuery) (*storage.MAMQuery, error) {
+	query := &storage.MAMQuery{UserJID: owner.String(), Flip: q.FlipPage != nil}
+	if f := q.Form; f != nil {
+		if v := f.GetValue("with"); v != "" {
+			with, err := jid.Parse(v)
+			if err != nil {
+				return nil, errors.New("invalid with")
+			}
+			query.WithJID = with.Bare().String()
+		}
+		for _, bound := range []struct {
+			name string
+			t    *time.Time
+		}{{"start", &query.Start}, {"end", &query.End}} {
+			v := f.GetValue(bound.name)
+			if v == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("invalid " + bound.name)
+			}
+			*bound.t = t
+		}
+	}
+	if set := q.Set; set != nil {
+		query.AfterID = set.After
+		if set.Before != nil {
+			// An empty <before/> asks for the last page.
+			query.BeforeID, query.Last = *set.Before, *set.Before == ""
+		}
+		if set.Max != nil {
+			if *set.Max < 0 {
+				return nil, errors.New("invalid max")
+			}
+			query.Max = min(*set.Max, storage.DefaultMAMPageSize)
+		}
+	}
+	return query, nil
+}
+
+// archiveResult wraps m, a message from owner's archive, in the <result/>
+// message sent to to in answer to the query with the given id.
+func archiveResult(owner, to jid.JID, queryID string, m *storage.ArchivedMessage) (*stanza.Message, error) {
+	var orig stanza.Message
+	if err := xml.Unmarshal(m.Data, &orig); err != nil {
+		return nil, err
+	}
+	// The archived message has no namespace of its own; inside <forwarded/>
+	// it must say that it is a jabber:client stanza.
+	var inner bytes.Buffer
+	start := xml.StartElement{Name: xml.Name{Space: ns.Client, Local: "message"}}
+	if err := xml.NewEncoder(&inner).EncodeElement(&orig, start); err != nil {
+		return nil, err
+	}
+	fwd, err := xml.Marshal(forward.Forwarded{
+		Delay: &forward.Delay{Stamp: m.CreatedAt.UTC().Format(time.RFC3339)},
+		Inner: inner.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stanza.BuildMessage().
+		From(owner).
+		To(to).
+		Extension(mam.Result{QueryID: queryID, ID: m.ID, Forwarded: fwd}).
+		Build()
+}
+
+// answerPrefs returns or replaces the archiving preferences of owner, which
+// are kept in the store.
+func (s *archiveService) answerPrefs(ctx context.Context, owner jid.JID, iq *stanza.IQ, prefs mam.Prefs) *stanza.IQ {
+	if iq.Type == stanza.IQSet {
+		switch prefs.Default {
+		case storage.MAMAlways, storage.MAMNever, storage.MAMRoster:
+		default:
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "invalid default"))
+		}
+		always, err := bareJIDs(prefs.Always)
+		if err != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, ""))
+		}
+		never, err := bareJIDs(prefs.Never)
+		if err != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, ""))
+		}
+		err = s.store.SetMAMPrefs(ctx, &storage.MAMPrefs{UserJID: owner.String(), Default: prefs.Default, Always: always, Never: never})
+		if err != nil {
+			logError(ctx, "archive preference error", "user", owner, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+	}
+	stored, err := s.preferences(ctx, owner)
+	if err != nil {
+		logError(ctx, "archive preference error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return payloadIQ(iq, mam.Prefs{
+		Default: stored.Default,
+		Always:  &mam.JIDList{JIDs: stored.Always},
+		Never:   &mam.JIDList{JIDs: stored.Never},
+	})
+}
+
+// bareJIDs returns the bare JIDs in list, without duplicates.
+func bareJIDs(list *mam.JIDList) ([]string, error) {
+	if list == nil {
+		return nil, nil
+	}
+	var jids []string
+	for _, v := range list.JIDs {
+		j, err := jid.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(jids, j.Bare().String()) {
+			jids = append(jids, j.Bare().String())
+		}
+	}
+	return jids, nil
+}
+
+// preferences returns the archiving preferences of owner, which archive
+// everything until the owner sets their own.
+func (s *archiveService) preferences(ctx context.Context, owner jid.JID) (*storage.MAMPrefs, error) {
+	prefs, err := s.store.GetMAMPrefs(ctx, owner.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return &storage.MAMPrefs{UserJID: owner.String(), Default: storage.MAMAlways}, nil
+	}
+	return prefs, err
+}
+
+// payloadIQ returns the result of iq carrying v, or an internal server error
+// when v does not marshal.
+func payloadIQ(iq *stanza.IQ, v any) *stanza.IQ {
+	payload, err := xml.Marshal(v)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	res := iq.ResultIQ()
+	res.Query = payload
+	return res
+}
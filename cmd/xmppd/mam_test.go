@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/forward"
+	"github.com/meszmate/xmpp-go/plugins/mam"
+	"github.com/meszmate/xmpp-go/plugins/rsm"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// archivePeer connects a resource and returns the messages and IQs it
+// receives.
+func archivePeer(t *testing.T, full string) (*xmpp.Session, <-chan stanza.Message, <-chan stanza.IQ) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(jid.MustParse(full)))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	msgs := make(chan stanza.Message, 16)
+	iqs := make(chan stanza.IQ, 4)
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			if start.Name.Local == "iq" {
+				var iq stanza.IQ
+				if dec.DecodeElement(&iq, &start) != nil {
+					return
+				}
+				iqs <- iq
+				continue
+			}
+			var msg stanza.Message
+			if dec.DecodeElement(&msg, &start) != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		session.Close()
+		c2.Close()
+	})
+	return session, msgs, iqs
+}
+
+// archiveMessages stores a message from alice's conversation with with for
+// each body, one second apart, under the ids m1, m2, ...
+func archiveMessages(t *testing.T, store storage.MAMStore, with string, bodies ...string) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, body := range bodies {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.From = jid.MustParse("alice@example.com/phone")
+		msg.To = jid.MustParse(with)
+		msg.SetBody(body)
+		data, err := xml.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.ArchiveMessage(context.Background(), &storage.ArchivedMessage{
+			ID:        fmt.Sprintf("m%d", i+1),
+			UserJID:   "alice@example.com",
+			WithJID:   with,
+			FromJID:   msg.From.String(),
+			Data:      data,
+			CreatedAt: base.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type archiveFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr"`
+	Set      rsm.Set
+}
+
+type archiveResultXML struct {
+	XMLName   xml.Name `xml:"urn:xmpp:mam:2 result"`
+	QueryID   string   `xml:"queryid,attr"`
+	ID        string   `xml:"id,attr"`
+	Forwarded struct {
+		Delay   forward.Delay  `xml:"urn:xmpp:delay delay"`
+		Message stanza.Message `xml:"jabber:client message"`
+	} `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// queryArchive sends a MAM query with the given payload and returns the
+// bodies of the results, checking their query id, and the reply.
+func queryArchive(t *testing.T, session *xmpp.Session, msgs <-chan stanza.Message, iqs <-chan stanza.IQ, payload string) ([]string, stanza.IQ) {
+	t.Helper()
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = []byte(payload)
+	if err := routeIQ(context.Background(), session, iq); err != nil {
+		t.Fatalf("routeIQ: %v", err)
+	}
+	var reply stanza.IQ
+	select {
+	case reply = <-iqs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply")
+	}
+	var bodies []string
+	for len(msgs) > 0 {
+		msg := <-msgs
+		var res archiveResultXML
+		for _, ext := range msg.Extensions {
+			if ext.XMLName.Local == "result" {
+				if err := xml.Unmarshal(extensionXML(t, ext), &res); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if res.QueryID != "q1" || res.Forwarded.Delay.Stamp == "" || msg.From.String() != "alice@example.com" {
+			t.Fatalf("result %+v from %s", res, msg.From)
+		}
+		bodies = append(bodies, res.Forwarded.Message.Body())
+	}
+	return bodies, reply
+}
+
+func finOf(t *testing.T, reply stanza.IQ) archiveFin {
+	t.Helper()
+	var fin archiveFin
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("reply = %+v", reply)
+	}
+	if err := xml.Unmarshal(reply.Query, &fin); err != nil {
+		t.Fatalf("fin %s: %v", reply.Query, err)
+	}
+	return fin
+}
+
+func TestArchiveQueryPages(t *testing.T) {
+	store := setupArchive(t, Config{Domain: "example.com"})
+	archiveMessages(t, store, "bob@example.com", "one", "two", "three", "four", "five")
+	alice, msgs, iqs := archivePeer(t, "alice@example.com/phone")
+
+	query := func(set string) ([]string, archiveFin) {
+		t.Helper()
+		bodies, reply := queryArchive(t, alice, msgs, iqs,
+			"<query xmlns='urn:xmpp:mam:2' queryid='q1'><set xmlns='http://jabber.org/protocol/rsm'>"+set+"</set></query>")
+		return bodies, finOf(t, reply)
+	}
+
+	tests := []struct {
+		set         string
+		want        string
+		first, last string
+		index       int
+		complete    bool
+	}{
+		{"<max>2</max>", "one two", "m1", "m2", 0, false},
+		{"<max>2</max><after>m2</after>", "three four", "m3", "m4", 2, false},
+		{"<max>2</max><after>m4</after>", "five", "m5", "m5", 4, true},
+		{"<max>2</max><before/>", "four five", "m4", "m5", 3, false},
+		{"<max>2</max><before>m3</before>", "one two", "m1", "m2", 0, true},
+	}
+	for _, tt := range tests {
+		bodies, fin := query(tt.set)
+		if strings.Join(bodies, " ") != tt.want || fin.Complete != tt.complete ||
+			fin.Set.First == nil || fin.Set.First.Value != tt.first || fin.Set.First.Index != tt.index ||
+			fin.Set.Last != tt.last || fin.Set.Count == nil || *fin.Set.Count != 5 {
+			t.Errorf("%s: bodies %q, fin %+v", tt.set, bodies, fin)
+		}
+	}
+
+	// A flipped page comes newest first; first and last still name its
+	// oldest and newest message.
+	bodies, reply := queryArchive(t, alice, msgs, iqs,
+		"<query xmlns='urn:xmpp:mam:2' queryid='q1'><set xmlns='http://jabber.org/protocol/rsm'><max>2</max><before/></set><flip-page/></query>")
+	if fin := finOf(t, reply); strings.Join(bodies, " ") != "five four" || fin.Set.First == nil || fin.Set.First.Value != "m4" || fin.Set.Last != "m5" {
+		t.Errorf("flipped: bodies %q, fin %+v", bodies, fin)
+	}
+
+	_, reply = queryArchive(t, alice, msgs, iqs,
+		"<query xmlns='urn:xmpp:mam:2' queryid='q1'><set xmlns='http://jabber.org/protocol/rsm'><after>nope</after></set></query>")
+	if reply.Type != stanza.IQError || reply.Error == nil || reply.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("unknown after: reply = %+v", reply)
+	}
+}
+
+func TestArchiveQueryFilters(t *testing.T) {
+	store := setupArchive(t, Config{Domain: "example.com"})
+	archiveMessages(t, store, "bob@example.com", "to bob")
+	alice, msgs, iqs := archivePeer(t, "alice@example.com/phone")
+
+	bodies, reply := queryArchive(t, alice, msgs, iqs, `<query xmlns='urn:xmpp:mam:2' queryid='q1'>
+		<x xmlns='jabber:x:data' type='submit'>
+			<field var='FORM_TYPE' type='hidden'><value>urn:xmpp:mam:2</value></field>
+			<field var='with'><value>carol@example.com</value></field>
+		</x></query>`)
+	if len(bodies) != 0 || !finOf(t, reply).Complete {
+		t.Fatalf("with carol: %q", bodies)
+	}
+
+	bodies, _ = queryArchive(t, alice, msgs, iqs, `<query xmlns='urn:xmpp:mam:2' queryid='q1'>
+		<x xmlns='jabber:x:data' type='submit'>
+			<field var='start'><value>2024-01-01T11:00:00Z</value></field>
+			<field var='end'><value>2024-01-01T13:00:00Z</value></field>
+		</x></query>`)
+	if strings.Join(bodies, " ") != "to bob" {
+		t.Fatalf("by time: %q", bodies)
+	}
+
+	_, reply = queryArchive(t, alice, msgs, iqs, `<query xmlns='urn:xmpp:mam:2' queryid='q1'>
+		<x xmlns='jabber:x:data' type='submit'><field var='start'><value>yesterday</value></field></x></query>`)
+	if reply.Type != stanza.IQError || reply.Error == nil || reply.Error.Type != stanza.ErrorTypeModify {
+		t.Fatalf("bad start: reply = %+v", reply)
+	}
+}
+
+func TestArchivePrefsIQ(t *testing.T) {
+	ms := setupArchive(t, Config{Domain: "example.com"})
+	alice, msgs, iqs := archivePeer(t, "alice@example.com/phone")
+
+	_, reply := queryArchive(t, alice, msgs, iqs, `<prefs xmlns='urn:xmpp:mam:2' default='roster'>
+		<always><jid>bob@example.com/desk</jid></always><never/></prefs>`)
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("set prefs: reply = %+v", reply)
+	}
+
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.Query = []byte(`<prefs xmlns='urn:xmpp:mam:2'/>`)
+	if err := routeIQ(context.Background(), alice, iq); err != nil {
+		t.Fatal(err)
+	}
+	var prefs mam.Prefs
+	if err := xml.Unmarshal((<-iqs).Query, &prefs); err != nil {
+		t.Fatal(err)
+	}
+	if prefs.Default != storage.MAMRoster || prefs.Always == nil || len(prefs.Always.JIDs) != 1 || prefs.Always.JIDs[0] != "bob@example.com" {
+		t.Fatalf("prefs = %+v", prefs)
+	}
+	stored, err := ms.GetMAMPrefs(context.Background(), "alice@example.com")
+	if err != nil || stored.Default != storage.MAMRoster || len(stored.Always) != 1 || len(stored.Never) != 0 {
+		t.Fatalf("stored prefs = %+v, %v", stored, err)
+	}
+
+	_, reply = queryArchive(t, alice, msgs, iqs, `<prefs xmlns='urn:xmpp:mam:2' default='sometimes'/>`)
+	if reply.Type != stanza.IQError || reply.Error == nil || reply.Error.Type != stanza.ErrorTypeModify {
+		t.Fatalf("bad default: reply = %+v", reply)
+	}
+}
+
+func TestArchiveQueryForm(t *testing.T) {
+	setupArchive(t, Config{Domain: "example.com"})
+	alice, _, iqs := archivePeer(t, "alice@example.com/phone")
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.To = jid.MustParse("alice@example.com")
+	iq.Query = []byte(`<query xmlns='urn:xmpp:mam:2'/>`)
+	if err := routeIQ(context.Background(), alice, iq); err != nil {
+		t.Fatal(err)
+	}
+	var q mamQuery
+	if err := xml.Unmarshal((<-iqs).Query, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Form == nil || q.Form.GetField("with") == nil || q.Form.GetValue("FORM_TYPE") != "urn:xmpp:mam:2" {
+		t.Fatalf("form = %+v", q.Form)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/meszmate/xmpp-go/storage"
+	xmppsql "github.com/meszmate/xmpp-go/storage/sql"
+	"github.com/meszmate/xmpp-go/storage/sql/migrations"
+)
+
+// runMigrate implements "xmppd migrate": it brings the schema of the
+// configured SQL backend up to date, or reverts it with -down, reporting
+// each migration on w. With -status it only lists the migrations, and with
+// -dry-run it lists what it would do.
+func runMigrate(ctx context.Context, cfg Config, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(w)
+	dryRun := flags.Bool("dry-run", false, "report the migrations without running them")
+	status := flags.Bool("status", false, "list applied and pending migrations")
+	down := flags.Int("down", -1, "revert the schema to `version`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	store, err := buildStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return migrateStore(ctx, store, w, *dryRun, *status, *down)
+}
+
+func migrateStore(ctx context.Context, store storage.Storage, w io.Writer, dryRun, status bool, down int) error {
+	s, ok := store.(*xmppsql.Store)
+	if !ok {
+		fmt.Fprintf(w, "storage has no schema migrations\n")
+		return nil
+	}
+	m := s.Migrator()
+	m.SetDryRun(dryRun)
+
+	if status {
+		applied, err := m.Applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range applied {
+			fmt.Fprintf(w, "applied  %3d  %s  %s\n", a.Version, a.AppliedAt.Format("2006-01-02 15:04:05"), a.Name)
+		}
+		pending, err := m.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range pending {
+			fmt.Fprintf(w, "pending  %3d  %s\n", mig.Version, mig.Name)
+		}
+		return nil
+	}
+
+	verb := "applied"
+	run := m.Up
+	if down >= 0 {
+		verb = "reverted"
+		run = func(ctx context.Context) ([]migrations.Migration, error) { return m.Down(ctx, down) }
+	}
+	if dryRun {
+		verb = map[string]string{"applied": "would apply", "reverted": "would revert"}[verb]
+	}
+	done, err := run(ctx)
+	for _, mig := range done {
+		fmt.Fprintf(w, "%s %d (%s)\n", verb, mig.Version, mig.Name)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "schema version %d of %d\n", version, m.Latest())
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/storage/sqlite"
+)
+
+func TestMigrate(t *testing.T) {
+	cfg := Config{Storage: "sqlite", StorageDSN: filepath.Join(t.TempDir(), "xmpp.db")}
+	latest := len(sqlite.SQLiteDialect{}.Migrations())
+	migrate := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := runMigrate(t.Context(), cfg, args, &out); err != nil {
+			t.Fatalf("migrate %v: %v\n%s", args, err, out.String())
+		}
+		return out.String()
+	}
+
+	out := migrate("-dry-run")
+	if !strings.Contains(out, "would apply 1 (users table)") || !strings.Contains(out, fmt.Sprintf("schema version 0 of %d", latest)) {
+		t.Fatalf("dry run:\n%s", out)
+	}
+	if out := migrate("-status"); strings.Count(out, "pending") != latest || strings.Contains(out, "applied") {
+		t.Fatalf("status before migrating:\n%s", out)
+	}
+
+	out = migrate()
+	if strings.Count(out, "applied ") != latest || !strings.Contains(out, fmt.Sprintf("schema version %d of %d", latest, latest)) {
+		t.Fatalf("migrate:\n%s", out)
+	}
+	if out := migrate(); strings.Contains(out, "applied ") {
+		t.Fatalf("second migrate applied again:\n%s", out)
+	}
+
+	out = migrate("-down", fmt.Sprint(latest-1))
+	if !strings.Contains(out, fmt.Sprintf("reverted %d", latest)) || !strings.Contains(out, fmt.Sprintf("schema version %d of", latest-1)) {
+		t.Fatalf("down:\n%s", out)
+	}
+	if out := migrate("-status"); strings.Count(out, "pending") != 1 || strings.Count(out, "applied") != latest-1 {
+		t.Fatalf("status after down:\n%s", out)
+	}
+
+	var errOut bytes.Buffer
+	if err := runMigrate(t.Context(), cfg, []string{"sideways"}, &errOut); err == nil {
+		t.Fatal("migrate accepted an unknown argument")
+	}
+}
+
+func TestMigrateWithoutSchema(t *testing.T) {
+	var out bytes.Buffer
+	if err := runMigrate(t.Context(), Config{Storage: "memory"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "no schema migrations") {
+		t.Fatalf("output: %s", out.String())
+	}
+}
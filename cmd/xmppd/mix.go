@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/mix"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalMIX hosts the MIX channels (XEP-0369) of the MIX domain. It is nil
+// when MIX is disabled or the storage has no PubSubStore.
+var globalMIX *mixService
+
+// mixNodes are the nodes of every channel; participants subscribe to the
+// ones they want when they join.
+var mixNodes = []string{mix.NodeMessages, mix.NodePresence, mix.NodeParticipants, mix.NodeInfo}
+
+// mixService keeps its channels in the PubSubStore: each channel is a
+// pubsub service of its own, with the nodes in mixNodes, and a node of the
+// same name on the MIX domain lists it along with its creator and the
+// secret its participant IDs are derived from. Channel messages go to the
+// message archive of the channel rather than to the messages node.
+type mixService struct {
+	domain string
+	local  string // the domain whose users may create channels
+	store  storage.PubSubStore
+
+	// mu serializes the changes to channels, so that nick checks and
+	// subscriptions do not race.
+	mu sync.Mutex
+}
+
+// mixChannel is a channel as listed on the MIX domain.
+type mixChannel struct {
+	jid     jid.JID
+	creator string
+	secret  string
+}
+
+func newMIXService(ctx context.Context, cfg Config, store storage.Storage) (*mixService, error) {
+	if !cfg.MIX || store == nil || store.PubSubStore() == nil {
+		return nil, nil
+	}
+	s := &mixService{domain: cfg.MIXDomain, local: cfg.Domain, store: store.PubSubStore()}
+	// Presence is only valid while the process runs.
+	channels, err := s.store.ListNodes(ctx, s.domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range channels {
+		host := node.NodeID + "@" + s.domain
+		items, err := s.store.GetItems(ctx, host, mix.NodePresence)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if err := s.store.DeleteItem(ctx, host, mix.NodePresence, item.ItemID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// serves reports whether j is the MIX service or one of its channels.
+func (s *mixService) serves(j jid.JID) bool {
+	return s != nil && j.Domain() == s.domain
+}
+
+// channel returns the channel with the given bare JID, or nil.
+func (s *mixService) channel(ctx context.Context, channelJID jid.JID) (*mixChannel, error) {
+	node, err := s.store.GetNode(ctx, s.domain, channelJID.Local())
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mixChannel{jid: channelJID, creator: node.Creator, secret: node.Config["secret"]}, nil
+}
+
+// participantID returns the ID of user in c, which stays the same every
+// time the user joins and does not reveal the user's JID.
+func (c *mixChannel) participantID(user jid.JID) string {
+	mac := hmac.New(sha256.New, []byte(c.secret))
+	mac.Write([]byte(user.Bare().String()))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// participant returns the participant item of user in c, or nil when the
+// user has not joined.
+func (s *mixService) participant(ctx context.Context, c *mixChannel, user jid.JID) (*mix.Participant, error) {
+	item, err := s.store.GetItem(ctx, c.jid.String(), mix.NodeParticipants, c.participantID(user))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p mix.Participant
+	if err := xml.Unmarshal(item.Payload, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// handleIQ answers the requests sent to the service and to its channels.
+func (s *mixService) handleIQ(ctx context.Context, iq *stanza.IQ) error {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil
+	}
+	mixSend(ctx, s.answerIQ(ctx, iq))
+	return nil
+}
+
+func (s *mixService) answerIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.To.Resource() != "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "participants cannot be queried through the channel"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if iq.To.Local() == "" {
+		return s.answerService(ctx, iq)
+	}
+	c, err := s.channel(ctx, iq.To)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", iq.To, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if c == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such channel"))
+	}
+
+	var join mix.Join
+	var setNick mix.SetNick
+	var items pubsub.PubSub
+	var archive mamQuery
+	switch {
+	case xml.Unmarshal(iq.Query, &disco.InfoQuery{}) == nil && iq.Type == stanza.IQGet:
+		return payloadIQ(iq, disco.InfoQuery{
+			Identities: []disco.Identity{{Category: "conference", Type: "mix", Name: c.jid.Local()}},
+			Features:   []disco.Feature{{Var: ns.DiscoInfo}, {Var: ns.DiscoItems}, {Var: ns.MIXCore}, {Var: ns.MAM}},
+		})
+	case xml.Unmarshal(iq.Query, &disco.ItemsQuery{}) == nil && iq.Type == stanza.IQGet:
+		out := disco.ItemsQuery{}
+		for _, node := range mixNodes {
+			out.Items = append(out.Items, disco.Item{JID: c.jid.String(), Node: node})
+		}
+		return payloadIQ(iq, out)
+	case xml.Unmarshal(iq.Query, &join) == nil && iq.Type == stanza.IQSet:
+		return s.join(ctx, c, iq, join)
+	case xml.Unmarshal(iq.Query, &mix.Leave{}) == nil && iq.Type == stanza.IQSet:
+		return s.leave(ctx, c, iq)
+	case xml.Unmarshal(iq.Query, &setNick) == nil && iq.Type == stanza.IQSet:
+		return s.setNick(ctx, c, iq, setNick.Nick)
+	case xml.Unmarshal(iq.Query, &items) == nil && iq.Type == stanza.IQGet && items.Items != nil:
+		return s.items(ctx, c, iq, items.Items)
+	case xml.Unmarshal(iq.Query, &archive) == nil:
+		return s.answerArchive(ctx, c, iq, archive)
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+}
+
+// answerService answers the requests sent to the service itself: its
+// service discovery, whose items are the channels, and the creation and
+// destruction of channels.
+func (s *mixService) answerService(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	var create mix.Create
+	var destroy mix.Destroy
+	switch {
+	case xml.Unmarshal(iq.Query, &disco.InfoQuery{}) == nil && iq.Type == stanza.IQGet:
+		return payloadIQ(iq, disco.InfoQuery{
+			Identities: []disco.Identity{{Category: "conference", Type: "mix", Name: "Channels"}},
+			Features:   []disco.Feature{{Var: ns.DiscoInfo}, {Var: ns.DiscoItems}, {Var: ns.MIXCore}, {Var: ns.MIXCore + "#create-channel"}, {Var: ns.MIXCore + "#searchable"}},
+		})
+	case xml.Unmarshal(iq.Query, &disco.ItemsQuery{}) == nil && iq.Type == stanza.IQGet:
+		channels, err := s.store.ListNodes(ctx, s.domain)
+		if err != nil {
+			logError(ctx, "mix service error", "service", s.domain, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		out := disco.ItemsQuery{}
+		for _, node := range channels {
+			out.Items = append(out.Items, disco.Item{JID: node.NodeID + "@" + s.domain})
+		}
+		slices.SortFunc(out.Items, func(a, b disco.Item) int { return strings.Compare(a.JID, b.JID) })
+		return payloadIQ(iq, out)
+	case xml.Unmarshal(iq.Query, &create) == nil && iq.Type == stanza.IQSet:
+		return s.create(ctx, iq, create.Channel)
+	case xml.Unmarshal(iq.Query, &destroy) == nil && iq.Type == stanza.IQSet:
+		return s.destroy(ctx, iq, destroy.Channel)
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+}
+
+// create creates the channel name, or one with a made-up name when name is
+// empty (XEP-0369 §7.3.1). Only local users create channels.
+func (s *mixService) create(ctx context.Context, iq *stanza.IQ, name string) *stanza.IQ {
+	if iq.From.Domain() != s.local {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only local users create channels"))
+	}
+	if name == "" {
+		name = stanza.GenerateID()[:12]
+	}
+	channelJID, err := jid.New(name, s.domain, "")
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "invalid channel name"))
+	}
+	name = channelJID.Local()
+	fail := func(err error) *stanza.IQ {
+		logError(ctx, "mix channel error", "channel", channelJID, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if c, err := s.channel(ctx, channelJID); err != nil {
+		return fail(err)
+	} else if c != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "the channel exists"))
+	}
+
+	creator := iq.From.Bare().String()
+	for _, node := range mixNodes {
+		if err := s.store.CreateNode(ctx, &storage.PubSubNode{Host: channelJID.String(), NodeID: node, Type: "leaf", Creator: creator}); err != nil {
+			return fail(err)
+		}
+	}
+	info := form.NewForm(form.TypeResult, "")
+	info.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.MIXCore}})
+	info.AddField(form.Field{Var: "Name", Values: []string{name}})
+	payload, err := xml.Marshal(info)
+	if err != nil {
+		return fail(err)
+	}
+	now := time.Now().UTC()
+	err = s.store.UpsertItem(ctx, &storage.PubSubItem{Host: channelJID.String(), NodeID: mix.NodeInfo, ItemID: now.Format(time.RFC3339), Publisher: creator, Payload: payload, CreatedAt: now})
+	if err != nil {
+		return fail(err)
+	}
+	// The channel is listed last, so that a failure above leaves no
+	// channel behind.
+	err = s.store.CreateNode(ctx, &storage.PubSubNode{Host: s.domain, NodeID: name, Type: "collection", Creator: creator, Config: map[string]string{"secret": stanza.GenerateID()}})
+	if err != nil {
+		return fail(err)
+	}
+	return payloadIQ(iq, mix.Create{Channel: name})
+}
+
+// destroy destroys the channel name with its archive. Only its creator
+// destroys a channel.
+func (s *mixService) destroy(ctx context.Context, iq *stanza.IQ, name string) *stanza.IQ {
+	channelJID, err := jid.New(name, s.domain, "")
+	if err != nil || name == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "no channel named"))
+	}
+	c, err := s.channel(ctx, channelJID)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", channelJID, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if c == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such channel"))
+	}
+	if c.creator != iq.From.Bare().String() {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only the creator destroys the channel"))
+	}
+	if err := s.store.DeleteNode(ctx, s.domain, channelJID.Local()); err != nil {
+		logError(ctx, "mix channel error", "channel", channelJID, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	for _, node := range mixNodes {
+		if err := s.store.DeleteNode(ctx, c.jid.String(), node); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		}
+	}
+	if globalArchive != nil {
+		if err := globalArchive.store.DeleteMessageArchive(ctx, c.jid.String()); err != nil {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		}
+	}
+	return iq.ResultIQ()
+}
+
+// join makes the sender of iq a participant of c, subscribed to the nodes
+// it asks for, and tells the subscribers of the participants node
+// (XEP-0369 §7.1.2). A participant joining again gets the same ID and
+// replaces its subscriptions.
+func (s *mixService) join(ctx context.Context, c *mixChannel, iq *stanza.IQ, req mix.Join) *stanza.IQ {
+	user := iq.From.Bare()
+	id := c.participantID(user)
+	if req.Nick != "" {
+		if taken, err := s.nickTaken(ctx, c, req.Nick, id); err != nil {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		} else if taken {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "the nick is in use"))
+		}
+	}
+	p := mix.Participant{Nick: req.Nick, JID: user.String()}
+	if err := s.publishParticipant(ctx, c, id, p); err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+
+	reply := mix.Join{ID: id, Nick: req.Nick}
+	for _, node := range mixNodes {
+		wanted := slices.ContainsFunc(req.Subscribe, func(sub mix.Subscribe) bool { return sub.Node == node })
+		var err error
+		if wanted {
+			err = s.store.Subscribe(ctx, &storage.PubSubSubscription{Host: c.jid.String(), NodeID: node, JID: user.String(), SubID: id, State: "subscribed"})
+			reply.Subscribe = append(reply.Subscribe, mix.Subscribe{Node: node})
+		} else {
+			err = s.store.Unsubscribe(ctx, c.jid.String(), node, user.String())
+		}
+		if err != nil {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+	}
+	return payloadIQ(iq, reply)
+}
+
+// leave removes the sender of iq from c along with its subscriptions and
+// presence (XEP-0369 §7.1.4).
+func (s *mixService) leave(ctx context.Context, c *mixChannel, iq *stanza.IQ) *stanza.IQ {
+	user := iq.From.Bare()
+	id := c.participantID(user)
+	err := s.store.DeleteItem(ctx, c.jid.String(), mix.NodeParticipants, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "not a participant"))
+	}
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	s.notify(ctx, c, mix.NodeParticipants, pubsub.EventItems{Node: mix.NodeParticipants, Retract: []pubsub.EventRetract{{ID: id}}})
+	for _, node := range mixNodes {
+		if err := s.store.Unsubscribe(ctx, c.jid.String(), node, user.String()); err != nil {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		}
+	}
+	items, err := s.store.GetItems(ctx, c.jid.String(), mix.NodePresence)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+	}
+	for _, item := range items {
+		if full, err := jid.Parse(item.ItemID); err == nil && full.Bare().Equal(user) {
+			s.removePresence(ctx, c, full, id, mix.Participant{JID: user.String()})
+		}
+	}
+	return payloadIQ(iq, mix.Leave{})
+}
+
+// setNick changes the nick of the sender of iq in c (XEP-0369 §7.1.5).
+func (s *mixService) setNick(ctx context.Context, c *mixChannel, iq *stanza.IQ, nick string) *stanza.IQ {
+	if nick == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "a nick is required"))
+	}
+	user := iq.From.Bare()
+	id := c.participantID(user)
+	p, err := s.participant(ctx, c, user)
+	var taken bool
+	if err == nil && p != nil {
+		taken, err = s.nickTaken(ctx, c, nick, id)
+	}
+	switch {
+	case err != nil:
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	case p == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "not a participant"))
+	case taken:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "the nick is in use"))
+	}
+	p.Nick = nick
+	if err := s.publishParticipant(ctx, c, id, *p); err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return payloadIQ(iq, mix.SetNick{Nick: nick})
+}
+
+// nickTaken reports whether a participant of c other than the one with
+// the given ID goes by nick.
+func (s *mixService) nickTaken(ctx context.Context, c *mixChannel, nick, id string) (bool, error) {
+	items, err := s.store.GetItems(ctx, c.jid.String(), mix.NodeParticipants)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range items {
+		var p mix.Participant
+		if item.ItemID != id && xml.Unmarshal(item.Payload, &p) == nil && p.Nick == nick {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// publishParticipant stores the participant item id and tells the
+// subscribers of the participants node.
+func (s *mixService) publishParticipant(ctx context.Context, c *mixChannel, id string, p mix.Participant) error {
+	payload, err := xml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = s.store.UpsertItem(ctx, &storage.PubSubItem{Host: c.jid.String(), NodeID: mix.NodeParticipants, ItemID: id, Publisher: p.JID, Payload: payload})
+	if err != nil {
+		return err
+	}
+	s.notify(ctx, c, mix.NodeParticipants, pubsub.EventItems{Node: mix.NodeParticipants, Items: []pubsub.PubItem{{ID: id, Payload: payload}}})
+	return nil
+}
+
+// items returns the items of a node of c. The info node is public; the
+// others are for participants.
+func (s *mixService) items(ctx context.Context, c *mixChannel, iq *stanza.IQ, req *pubsub.Items) *stanza.IQ {
+	if !slices.Contains(mixNodes, req.Node) || req.Node == mix.NodeMessages {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	}
+	if req.Node != mix.NodeInfo {
+		p, err := s.participant(ctx, c, iq.From)
+		if err != nil {
+			logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		if p == nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only participants read this node"))
+		}
+	}
+	stored, err := s.store.GetItems(ctx, c.jid.String(), req.Node)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	out := []pubsub.PubItem{}
+	for _, item := range stored {
+		out = append(out, pubsub.PubItem{ID: item.ItemID, Payload: item.Payload})
+	}
+	if req.MaxItems != nil && *req.MaxItems >= 0 && len(out) > *req.MaxItems {
+		out = out[len(out)-*req.MaxItems:]
+	}
+	return payloadIQ(iq, pubsub.PubSub{Items: &pubsub.Items{Node: req.Node, Items: out}})
+}
+
+// answerArchive answers the XEP-0313 queries participants send to the
+// archive of c, which holds the channel history.
+func (s *mixService) answerArchive(ctx context.Context, c *mixChannel, iq *stanza.IQ, q mamQuery) *stanza.IQ {
+	if globalArchive == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "message archive disabled"))
+	}
+	p, err := s.participant(ctx, c, iq.From)
+	switch {
+	case err != nil:
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	case p == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only participants may query the archive"))
+	case iq.Type == stanza.IQGet:
+		return payloadIQ(iq, mamQuery{Form: mamForm()})
+	}
+	send := func(ctx context.Context, st stanza.Stanza) error {
+		mixSend(ctx, st)
+		return nil
+	}
+	return globalArchive.answerQuery(ctx, c.jid, iq.From, iq, q, send)
+}
+
+// handleMessage distributes a groupchat message of a participant to the
+// subscribers of the messages node of the channel, from the channel and
+// annotated with the sender's nick and JID, after storing it in the
+// channel's archive (XEP-0369 §7.1.6).
+func (s *mixService) handleMessage(ctx context.Context, msg *stanza.Message) error {
+	if msg.Type == stanza.MessageError {
+		return nil
+	}
+	fail := func(typ, condition, text string) error {
+		mixSend(ctx, messageError(msg, stanza.NewStanzaError(typ, condition, text)))
+		return nil
+	}
+	if msg.To.Local() == "" || msg.To.Resource() != "" {
+		return fail(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")
+	}
+	if msg.Type != stanza.MessageGroupchat {
+		return fail(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "messages to the channel must be groupchat")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.channel(ctx, msg.To)
+	var p *mix.Participant
+	if err == nil && c != nil {
+		p, err = s.participant(ctx, c, msg.From)
+	}
+	switch {
+	case err != nil:
+		logError(ctx, "mix channel error", "channel", msg.To, "error", err)
+		return fail(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	case c == nil:
+		return fail(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such channel")
+	case p == nil:
+		return fail(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "only participants may send messages to the channel")
+	}
+
+	out := *msg
+	out.From, out.To = c.jid, jid.JID{}
+	out.Extensions = withoutStanzaID(msg.Extensions, c.jid.String())
+	if ext, err := stanza.NewExtension(mix.Mix{Nick: p.Nick, JID: p.JID}); err == nil {
+		out.Extensions = append(out.Extensions, ext)
+	}
+	if globalArchive != nil && len(out.Bodies) > 0 && !noStore(&out) {
+		archived, _ := globalArchive.archive(ctx, c.jid, msg.From.Bare(), &out)
+		out = *archived
+	}
+	subs, err := s.store.GetSubscriptions(ctx, c.jid.String(), mix.NodeMessages)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return nil
+	}
+	for _, sub := range subs {
+		to, err := jid.Parse(sub.JID)
+		if err != nil {
+			continue
+		}
+		delivered := out
+		delivered.To = to
+		mixSend(ctx, &delivered)
+	}
+	return nil
+}
+
+// handlePresence keeps the presence a participant's client sends to the
+// channel in the presence node, under the client's full JID, and passes it
+// on to the subscribers of the node from the participant's address in the
+// channel (XEP-0403).
+func (s *mixService) handlePresence(ctx context.Context, pres *stanza.Presence) error {
+	if pres.Type != "" && pres.Type != stanza.PresenceUnavailable {
+		return nil
+	}
+	if pres.To.Local() == "" || pres.To.Resource() != "" || pres.From.Resource() == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.channel(ctx, pres.To)
+	var p *mix.Participant
+	if err == nil && c != nil {
+		p, err = s.participant(ctx, c, pres.From)
+	}
+	switch {
+	case err != nil:
+		logError(ctx, "mix channel error", "channel", pres.To, "error", err)
+		mixSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")))
+		return nil
+	case c == nil:
+		mixSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such channel")))
+		return nil
+	case p == nil:
+		mixSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "only participants share presence")))
+		return nil
+	}
+	id := c.participantID(pres.From)
+	if pres.Type == stanza.PresenceUnavailable {
+		s.removePresence(ctx, c, pres.From, id, *p)
+		return nil
+	}
+	out := s.presenceOf(c, pres, id, *p)
+	payload, err := xml.Marshal(out)
+	if err == nil {
+		err = s.store.UpsertItem(ctx, &storage.PubSubItem{Host: c.jid.String(), NodeID: mix.NodePresence, ItemID: pres.From.String(), Publisher: p.JID, Payload: payload})
+	}
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return nil
+	}
+	s.sendPresence(ctx, c, out)
+	return nil
+}
+
+// removePresence removes the presence of the client full of the
+// participant p from c and tells the subscribers of the presence node.
+func (s *mixService) removePresence(ctx context.Context, c *mixChannel, full jid.JID, id string, p mix.Participant) {
+	err := s.store.DeleteItem(ctx, c.jid.String(), mix.NodePresence, full.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return
+	}
+	unavailable := stanza.NewPresence(stanza.PresenceUnavailable)
+	unavailable.From = full
+	s.sendPresence(ctx, c, s.presenceOf(c, unavailable, id, p))
+}
+
+// presenceOf returns pres, sent by a client of the participant p with the
+// given ID, as the channel passes it on.
+func (s *mixService) presenceOf(c *mixChannel, pres *stanza.Presence, id string, p mix.Participant) *stanza.Presence {
+	out := *pres
+	out.ID, out.To = "", jid.JID{}
+	out.From, _ = jid.New(c.jid.Local(), c.jid.Domain(), id)
+	out.Extensions = nil
+	for _, ext := range pres.Extensions {
+		if ext.XMLName.Space != ns.MIXCore {
+			out.Extensions = append(out.Extensions, ext)
+		}
+	}
+	if ext, err := stanza.NewExtension(mix.Mix{Nick: p.Nick, JID: pres.From.String()}); err == nil {
+		out.Extensions = append(out.Extensions, ext)
+	}
+	return &out
+}
+
+func (s *mixService) sendPresence(ctx context.Context, c *mixChannel, pres *stanza.Presence) {
+	subs, err := s.store.GetSubscriptions(ctx, c.jid.String(), mix.NodePresence)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return
+	}
+	for _, sub := range subs {
+		if to, err := jid.Parse(sub.JID); err == nil {
+			out := *pres
+			out.To = to
+			mixSend(ctx, &out)
+		}
+	}
+}
+
+// leaveAll removes the presence of the client full from every channel, as
+// if it had sent them unavailable presence. Its participation stays.
+func (s *mixService) leaveAll(ctx context.Context, full jid.JID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels, err := s.store.ListNodes(ctx, s.domain)
+	if err != nil {
+		logError(ctx, "mix service error", "service", s.domain, "error", err)
+		return
+	}
+	for _, node := range channels {
+		c := &mixChannel{creator: node.Creator, secret: node.Config["secret"]}
+		c.jid, err = jid.New(node.NodeID, s.domain, "")
+		if err != nil {
+			continue
+		}
+		if _, err := s.store.GetItem(ctx, c.jid.String(), mix.NodePresence, full.String()); err != nil {
+			continue
+		}
+		p, err := s.participant(ctx, c, full)
+		if err != nil || p == nil {
+			p = &mix.Participant{JID: full.Bare().String()}
+		}
+		s.removePresence(ctx, c, full, c.participantID(full), *p)
+	}
+}
+
+// notify sends the subscribers of node of c the event items.
+func (s *mixService) notify(ctx context.Context, c *mixChannel, node string, items pubsub.EventItems) {
+	subs, err := s.store.GetSubscriptions(ctx, c.jid.String(), node)
+	if err != nil {
+		logError(ctx, "mix channel error", "channel", c.jid, "error", err)
+		return
+	}
+	for _, sub := range subs {
+		to, err := jid.Parse(sub.JID)
+		if err != nil {
+			continue
+		}
+		msg, err := stanza.BuildMessage().From(c.jid).To(to).Extension(pubsub.Event{Items: &items}).Build()
+		if err == nil {
+			mixSend(ctx, msg)
+		}
+	}
+}
+
+// answerMIXPAM answers the requests of a client to join or leave a channel
+// through its account (XEP-0405 §5), or returns nil when iq is not one.
+// The account joins on behalf of the client; channels of other servers
+// cannot be joined.
+func answerMIXPAM(ctx context.Context, from jid.JID, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var join mix.ClientJoin
+	var leave mix.ClientLeave
+	var channel string
+	var inner any
+	switch {
+	case xml.Unmarshal(iq.Query, &join) == nil && join.Join != nil:
+		channel, inner = join.Channel, join.Join
+	case xml.Unmarshal(iq.Query, &leave) == nil:
+		channel, inner = leave.Channel, mix.Leave{}
+	default:
+		return nil
+	}
+	to, err := jid.Parse(channel)
+	if err != nil || to.Local() == "" || to.Resource() != "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "invalid channel"))
+	}
+	if !globalMIX.serves(to) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorRemoteServerNotFound, "channels of other services cannot be joined"))
+	}
+	query, err := xml.Marshal(inner)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	req := stanza.NewIQ(stanza.IQSet)
+	req.From, req.To, req.Query = from.Bare(), to, query
+	res := globalMIX.answerIQ(ctx, req)
+	if res.Type == stanza.IQError {
+		return iq.ErrorIQ(res.Error)
+	}
+	if join.Join != nil {
+		var joined mix.Join
+		_ = xml.Unmarshal(res.Query, &joined)
+		return payloadIQ(iq, mix.ClientJoin{Join: &joined})
+	}
+	return payloadIQ(iq, mix.ClientLeave{Leave: &mix.Leave{}})
+}
+
+// mixSend delivers st, sent by the MIX service, to its local recipient
+// unless the recipient blocked the sender.
+func mixSend(ctx context.Context, st stanza.Stanza) {
+	h := st.GetHeader()
+	if globalBlocking.blocks(ctx, h.To, h.From) {
+		return
+	}
+	deliver(ctx, h.To, st)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/mix"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+const testChannel = "coven@mix.example.com"
+
+// setupMIX installs a MIX service on mix.example.com, with a message
+// archive, for the duration of t.
+func setupMIX(t *testing.T) {
+	t.Helper()
+	setupArchive(t, Config{Domain: "example.com"})
+	s, err := newMIXService(context.Background(), Config{Domain: "example.com", MIX: true, MIXDomain: "mix.example.com"}, memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := globalMIX
+	globalMIX = s
+	t.Cleanup(func() { globalMIX = old })
+}
+
+func joinQuery(nick string, nodes ...string) string {
+	q := `<join xmlns='urn:xmpp:mix:core:1'>`
+	for _, node := range nodes {
+		q += `<subscribe node='` + node + `'/>`
+	}
+	return q + `<nick>` + nick + `</nick></join>`
+}
+
+// mixAnnotation returns the mix element of the extensions of a stanza the
+// channel sent.
+func mixAnnotation(t *testing.T, exts []stanza.Extension) mix.Mix {
+	t.Helper()
+	var m mix.Mix
+	for _, ext := range exts {
+		if ext.XMLName.Space == "urn:xmpp:mix:core:1" && ext.XMLName.Local == "mix" {
+			if err := xml.Unmarshal(extensionXML(t, ext), &m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return m
+}
+
+// participantEvent returns the participants node event in msg.
+func participantEvent(t *testing.T, msg *stanza.Message) pubsub.EventItems {
+	t.Helper()
+	for _, ext := range msg.Extensions {
+		var ev pubsub.Event
+		if ext.XMLName.Local == "event" && xml.Unmarshal(extensionXML(t, ext), &ev) == nil && ev.Items != nil && ev.Items.Node == mix.NodeParticipants {
+			return *ev.Items
+		}
+	}
+	t.Fatalf("no participants event in %+v", msg)
+	return pubsub.EventItems{}
+}
+
+func TestMIXChannel(t *testing.T) {
+	setupMIX(t)
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	juliet := newOrderedPeer(t, "juliet@example.com/balcony")
+
+	var created mix.Create
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQSet, "mix.example.com", `<create xmlns='urn:xmpp:mix:core:1' channel='coven'/>`).Query, &created); err != nil || created.Channel != "coven" {
+		t.Fatalf("create = %+v, %v", created, err)
+	}
+	if reply := juliet.request(t, stanza.IQSet, "mix.example.com", `<create xmlns='urn:xmpp:mix:core:1' channel='coven'/>`); !refused(reply, stanza.ErrorConflict) {
+		t.Fatalf("second create: %s", reply.Query)
+	}
+	var items disco.ItemsQuery
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "mix.example.com", `<query xmlns='http://jabber.org/protocol/disco#items'/>`).Query, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 || items.Items[0].JID != testChannel {
+		t.Fatalf("channels = %+v", items.Items)
+	}
+
+	var romeoJoin mix.Join
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQSet, testChannel, joinQuery("romeo", mix.NodeMessages, mix.NodePresence, mix.NodeParticipants)).Query, &romeoJoin); err != nil {
+		t.Fatal(err)
+	}
+	if romeoJoin.ID == "" || len(romeoJoin.Subscribe) != 3 {
+		t.Fatalf("join = %+v", romeoJoin)
+	}
+	if reply := juliet.request(t, stanza.IQSet, testChannel, joinQuery("romeo", mix.NodeMessages)); !refused(reply, stanza.ErrorConflict) {
+		t.Fatalf("join with a taken nick: %s", reply.Query)
+	}
+	var julietJoin mix.Join
+	if err := xml.Unmarshal(juliet.request(t, stanza.IQSet, testChannel, joinQuery("juliet", mix.NodeMessages, mix.NodeParticipants)).Query, &julietJoin); err != nil {
+		t.Fatal(err)
+	}
+	if ev := participantEvent(t, romeo.message(t)); len(ev.Items) != 1 || ev.Items[0].ID != julietJoin.ID {
+		t.Fatalf("join event = %+v", ev)
+	}
+
+	// Joining again keeps the participant ID.
+	romeo.ask(t, stanza.IQSet, testChannel, joinQuery("romeo", mix.NodeMessages, mix.NodePresence, mix.NodeParticipants))
+	participantEvent(t, romeo.message(t))
+	var again mix.Join
+	if err := xml.Unmarshal(romeo.iq(t).Query, &again); err != nil || again.ID != romeoJoin.ID {
+		t.Fatalf("rejoin = %+v, %v", again, err)
+	}
+	participantEvent(t, juliet.message(t))
+
+	juliet.say(t, testChannel, "wherefore")
+	for _, p := range []*orderedPeer{romeo, juliet} {
+		msg := p.message(t)
+		if msg.From.String() != testChannel || msg.Body() != "wherefore" || stanzaIDs(*msg)[testChannel] == "" {
+			t.Fatalf("distributed %+v", msg)
+		}
+		if m := mixAnnotation(t, msg.Extensions); m.Nick != "juliet" || m.JID != "juliet@example.com" {
+			t.Fatalf("annotation = %+v", m)
+		}
+	}
+	mallory := newOrderedPeer(t, "mallory@example.com/x")
+	mallory.say(t, testChannel, "let me in")
+	if msg := mallory.message(t); msg.Type != stanza.MessageError {
+		t.Fatalf("message from a stranger: %+v", msg)
+	}
+
+	romeo.ask(t, stanza.IQSet, testChannel, `<query xmlns='urn:xmpp:mam:2' queryid='q1'/>`)
+	var res archiveResultXML
+	for _, ext := range romeo.message(t).Extensions {
+		if ext.XMLName.Local == "result" {
+			_ = xml.Unmarshal(extensionXML(t, ext), &res)
+		}
+	}
+	if res.Forwarded.Message.Body() != "wherefore" {
+		t.Fatalf("archived %+v", res)
+	}
+	if fin := romeo.iq(t); fin.Type != stanza.IQResult {
+		t.Fatalf("fin = %+v", fin)
+	}
+	if reply := mallory.request(t, stanza.IQSet, testChannel, `<query xmlns='urn:xmpp:mam:2'/>`); !refused(reply, stanza.ErrorForbidden) {
+		t.Fatalf("archive query of a stranger: %s", reply.Query)
+	}
+
+	pres := stanza.NewPresence("")
+	pres.To = jid.MustParse(testChannel)
+	if err := routePresence(context.Background(), juliet.session, pres); err != nil {
+		t.Fatal(err)
+	}
+	got := romeo.presence(t)
+	if got.From.String() != testChannel+"/"+julietJoin.ID || mixAnnotation(t, got.Extensions).JID != "juliet@example.com/balcony" {
+		t.Fatalf("presence = %+v", got)
+	}
+
+	if reply := juliet.request(t, stanza.IQSet, "mix.example.com", `<destroy xmlns='urn:xmpp:mix:core:1' channel='coven'/>`); !refused(reply, stanza.ErrorForbidden) {
+		t.Fatalf("destroy by a participant: %s", reply.Query)
+	}
+	juliet.ask(t, stanza.IQSet, testChannel, `<leave xmlns='urn:xmpp:mix:core:1'/>`)
+	if ev := participantEvent(t, juliet.message(t)); len(ev.Retract) != 1 || ev.Retract[0].ID != julietJoin.ID {
+		t.Fatalf("leave event = %+v", ev)
+	}
+	if reply := juliet.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("leave: %+v", reply)
+	}
+	participantEvent(t, romeo.message(t))
+	if got := romeo.presence(t); got.Type != stanza.PresenceUnavailable {
+		t.Fatalf("presence after leaving = %+v", got)
+	}
+
+	if reply := romeo.request(t, stanza.IQSet, "mix.example.com", `<destroy xmlns='urn:xmpp:mix:core:1' channel='coven'/>`); reply.Type != stanza.IQResult {
+		t.Fatalf("destroy: %s", reply.Query)
+	}
+	if reply := romeo.request(t, stanza.IQGet, testChannel, `<query xmlns='http://jabber.org/protocol/disco#info'/>`); !refused(reply, stanza.ErrorItemNotFound) {
+		t.Fatalf("destroyed channel: %s", reply.Query)
+	}
+}
+
+func TestMIXClientJoin(t *testing.T) {
+	setupMIX(t)
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+	romeo.request(t, stanza.IQSet, "mix.example.com", `<create xmlns='urn:xmpp:mix:core:1' channel='coven'/>`)
+
+	reply := romeo.request(t, stanza.IQSet, "", `<client-join xmlns='urn:xmpp:mix:pam:2' channel='`+testChannel+`'>`+joinQuery("romeo", mix.NodeMessages)+`</client-join>`)
+	var joined mix.ClientJoin
+	if err := xml.Unmarshal(reply.Query, &joined); err != nil || joined.Join == nil || joined.Join.ID == "" {
+		t.Fatalf("client-join = %s, %v", reply.Query, err)
+	}
+	if reply := romeo.request(t, stanza.IQSet, "", `<client-join xmlns='urn:xmpp:mix:pam:2' channel='coven@mix.elsewhere.example'>`+joinQuery("romeo")+`</client-join>`); !refused(reply, stanza.ErrorRemoteServerNotFound) {
+		t.Fatalf("remote channel: %s", reply.Query)
+	}
+	if reply := romeo.request(t, stanza.IQSet, "", `<client-leave xmlns='urn:xmpp:mix:pam:2' channel='`+testChannel+`'><leave xmlns='urn:xmpp:mix:core:1'/></client-leave>`); reply.Type != stanza.IQResult {
+		t.Fatalf("client-leave: %s", reply.Query)
+	}
+	if reply := romeo.request(t, stanza.IQSet, "", `<client-leave xmlns='urn:xmpp:mix:pam:2' channel='`+testChannel+`'><leave xmlns='urn:xmpp:mix:core:1'/></client-leave>`); !refused(reply, stanza.ErrorItemNotFound) {
+		t.Fatalf("leaving twice: %s", reply.Query)
+	}
+}
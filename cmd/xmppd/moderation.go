@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/moderation"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/plugins/retraction"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// errNotAuthor is returned when someone other than its sender retracts a
+// message.
+var errNotAuthor = errors.New("not the author of the message")
+
+// answerModerate retracts a message of r on behalf of a moderator
+// (XEP-0425): the message is replaced by a tombstone in the room's archive
+// and history, and the occupants are told which moderator retracted it and
+// why.
+func (s *mucService) answerModerate(ctx context.Context, r *mucRoom, iq *stanza.IQ, q moderation.Moderate) *stanza.IQ {
+	actor := r.occupantByJID(iq.From)
+	switch {
+	case actor == nil || actor.role != muc.RoleModerator:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only moderators may moderate messages"))
+	case q.Retract == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorFeatureNotImplemented, "messages can only be retracted"))
+	case q.ID == "":
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "the message to moderate has no id"))
+	}
+	moderated := &moderation.Moderated{By: actor.addr.String()}
+	err := s.retractMessage(ctx, r, q.ID, jid.JID{}, moderation.Retracted{
+		Stamp:     time.Now().UTC().Format(time.RFC3339),
+		Moderated: moderated,
+		Reason:    q.Reason,
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such message"))
+	}
+	if err != nil {
+		logError(ctx, "muc moderation error", "room", r.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	notice, err := stanza.BuildMessage().
+		From(r.jid).
+		Type(stanza.MessageGroupchat).
+		Extension(moderation.Retraction{ID: q.ID, Moderated: moderated, Reason: q.Reason}).
+		Build()
+	if err == nil {
+		r.send(ctx, notice)
+	}
+	return iq.ResultIQ()
+}
+
+// checkRetraction handles the XEP-0424 retraction msg carries, if any,
+// before the room relays it: only the sender of a message may retract it,
+// and the message is replaced by a tombstone. It returns the error to
+// bounce msg with, or nil to relay it.
+func (s *mucService) checkRetraction(ctx context.Context, r *mucRoom, sender *mucOccupant, msg *stanza.Message) *stanza.StanzaError {
+	ext, ok := findExtension(msg.Extensions, xml.Name{Space: ns.Retraction, Local: "retract"})
+	if !ok {
+		return nil
+	}
+	var retract retraction.Retract
+	if err := decodeExtension(ext, &retract); err != nil || retract.ID == "" {
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "the message to retract has no id")
+	}
+	err := s.retractMessage(ctx, r, retract.ID, sender.jid.Bare(), moderation.Retracted{
+		Stamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	switch {
+	case errors.Is(err, errNotAuthor):
+		return stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only the sender may retract a message")
+	case errors.Is(err, storage.ErrNotFound):
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such message")
+	case err != nil:
+		logError(ctx, "muc retraction error", "room", r.jid, "error", err)
+		return stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	}
+	return nil
+}
+
+// retractMessage replaces the message of r with the given stanza-id by a
+// tombstone carrying retracted, in the room's archive when the storage
+// backend can edit it and in the history. Unless author is empty, the
+// message must have been sent by that bare JID. It returns
+// storage.ErrNotFound when the room has no such message.
+func (s *mucService) retractMessage(ctx context.Context, r *mucRoom, id string, author jid.JID, retracted moderation.Retracted) error {
+	h := -1
+	for i, entry := range r.history {
+		if stanzaIDBy(entry.msg, r.jid.String()) == id {
+			h = i
+			break
+		}
+	}
+	var archived *storage.ArchivedMessage
+	editor := globalArchive.editor()
+	if editor != nil {
+		var err error
+		archived, err = editor.GetArchivedMessage(ctx, r.jid.String(), id)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+
+	switch {
+	case archived == nil && h < 0:
+		return storage.ErrNotFound
+	case author.Equal(jid.JID{}):
+	case archived != nil && archived.WithJID != author.String(),
+		archived == nil && !r.history[h].sender.Equal(author):
+		return errNotAuthor
+	}
+
+	if archived != nil {
+		var msg stanza.Message
+		if err := xml.Unmarshal(archived.Data, &msg); err != nil {
+			return err
+		}
+		data, err := xml.Marshal(tombstone(&msg, retracted))
+		if err != nil {
+			return err
+		}
+		archived.Data = data
+		if err := editor.UpdateArchivedMessage(ctx, archived); err != nil {
+			return err
+		}
+	}
+	if h >= 0 {
+		r.history[h].msg = tombstone(r.history[h].msg, retracted)
+	}
+	return nil
+}
+
+// editor returns the archive's store when it can edit archived messages,
+// or nil.
+func (s *archiveService) editor() storage.MAMEditor {
+	if s == nil {
+		return nil
+	}
+	editor, _ := s.store.(storage.MAMEditor)
+	return editor
+}
+
+// tombstone returns a copy of msg with its content replaced by retracted.
+// Only its stanza-ids and origin-id are kept, so that it can still be
+// referred to (XEP-0424 §5.1).
+func tombstone(msg *stanza.Message, retracted moderation.Retracted) *stanza.Message {
+	out := *msg
+	out.Subjects, out.Bodies, out.Extensions = nil, nil, nil
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space == ns.StanzaID {
+			out.Extensions = append(out.Extensions, ext)
+		}
+	}
+	if ext, err := stanza.NewExtension(retracted); err == nil {
+		out.Extensions = append(out.Extensions, ext)
+	}
+	return &out
+}
+
+// stanzaIDBy returns the XEP-0359 stanza-id by gave msg, or "".
+func stanzaIDBy(msg *stanza.Message, by string) string {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName == (xml.Name{Space: ns.StanzaID, Local: "stanza-id"}) && attr(ext, "by") == by {
+			return attr(ext, "id")
+		}
+	}
+	return ""
+}
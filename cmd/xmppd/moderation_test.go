@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/moderation"
+	"github.com/meszmate/xmpp-go/plugins/retraction"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestMUCRetraction(t *testing.T) {
+	ctx := context.Background()
+	setupMUC(t)
+	setupArchive(t, Config{Domain: "example.com"})
+	alice := openRoom(t, "")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	var ids []string
+	for _, body := range []string{"buy now", "oops"} {
+		bob.say(t, testRoom, body)
+		alice.message(t)
+		ids = append(ids, stanzaIDs(*bob.message(t))[testRoom])
+	}
+	archived := func(id string) string {
+		t.Helper()
+		msg, err := globalArchive.editor().GetArchivedMessage(ctx, testRoom, id)
+		if err != nil {
+			t.Fatalf("GetArchivedMessage: %v", err)
+		}
+		return string(msg.Data)
+	}
+
+	retract := func(p *orderedPeer, id string) {
+		t.Helper()
+		msg := stanza.NewMessage(stanza.MessageGroupchat)
+		msg.To = jid.MustParse(testRoom)
+		msg.SetBody("This person attempted to retract a previous message.")
+		ext, err := stanza.NewExtension(retraction.Retract{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Extensions = []stanza.Extension{ext}
+		if err := routeMessage(ctx, p.session, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+	}
+	retract(alice, ids[1])
+	if msg := alice.message(t); msg.Type != stanza.MessageError || msg.Error == nil || msg.Error.Type != stanza.ErrorTypeAuth {
+		t.Fatalf("retraction of another's message: %+v", msg)
+	}
+	retract(bob, ids[1])
+	for _, p := range []*orderedPeer{alice, bob} {
+		if msg := p.message(t); msg.Type != stanza.MessageGroupchat || msg.From.String() != testRoom+"/bob" {
+			t.Fatalf("relayed retraction %+v", msg)
+		}
+	}
+	if data := archived(ids[1]); strings.Contains(data, "oops") || !strings.Contains(data, "retracted") || !strings.Contains(data, ids[1]) {
+		t.Fatalf("retracted message archived as %s", data)
+	}
+
+	moderate := `<moderate xmlns='urn:xmpp:message-moderate:1' id='` + ids[0] + `'><retract xmlns='urn:xmpp:message-retract:1'/><reason>Spam</reason></moderate>`
+	if reply := bob.request(t, stanza.IQSet, testRoom, moderate); reply.Type != stanza.IQError || reply.Error.Type != stanza.ErrorTypeAuth {
+		t.Fatalf("participant moderated: %+v", reply)
+	}
+	alice.ask(t, stanza.IQSet, testRoom, moderate)
+	for _, p := range []*orderedPeer{alice, bob} {
+		msg := p.message(t)
+		var notice moderation.Retraction
+		if len(msg.Extensions) != 1 || xml.Unmarshal(extensionXML(t, msg.Extensions[0]), &notice) != nil {
+			t.Fatalf("moderation notice %+v", msg)
+		}
+		if msg.From.String() != testRoom || notice.ID != ids[0] || notice.Moderated == nil || notice.Moderated.By != testRoom+"/alice" || notice.Reason != "Spam" {
+			t.Fatalf("moderation notice %+v from %s", notice, msg.From)
+		}
+	}
+	if reply := alice.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("moderate: %+v", reply.Error)
+	}
+	if data := archived(ids[0]); strings.Contains(data, "buy now") || !strings.Contains(data, "moderated") || !strings.Contains(data, "Spam") {
+		t.Fatalf("moderated message archived as %s", data)
+	}
+
+	unknown := `<moderate xmlns='urn:xmpp:message-moderate:1' id='missing'><retract xmlns='urn:xmpp:message-retract:1'/></moderate>`
+	if reply := alice.request(t, stanza.IQSet, testRoom, unknown); reply.Type != stanza.IQError || reply.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("unknown message moderated: %+v", reply)
+	}
+
+	// Newcomers get the tombstones in the history.
+	carol := newOrderedPeer(t, "carol@example.com/tab")
+	carol.join(t, "carol", "")
+	carol.presence(t)
+	carol.presence(t)
+	carol.presence(t)
+	if msg := carol.message(t); msg.Body() != "" || stanzaIDs(*msg)[testRoom] != ids[0] {
+		t.Fatalf("history %+v", msg)
+	}
+}
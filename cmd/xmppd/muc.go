@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/delay"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalMUC hosts the multi-user chat rooms (XEP-0045) of the MUC domain.
+// It is nil when MUC is disabled or the storage has no MUCRoomStore.
+var globalMUC *mucService
+
+// MUC status codes (XEP-0045 §15.6).
+const (
+	mucStatusSelf        = 110
+	mucStatusCreated     = 201
+	mucStatusBanned      = 301
+	mucStatusNickChanged = 303
+	mucStatusKicked      = 307
+	mucStatusMembersOnly = 321
+)
+
+type mucService struct {
+	domain  string
+	store   storage.MUCRoomStore
+	history int
+
+	mu    sync.Mutex
+	rooms map[string]*mucRoom
+}
+
+func newMUCService(cfg Config, store storage.Storage) *mucService {
+	if !cfg.MUC || store == nil || store.MUCRoomStore() == nil {
+		return nil
+	}
+	return &mucService{
+		domain:  cfg.MUCDomain,
+		store:   store.MUCRoomStore(),
+		history: cfg.MUCHistory,
+		rooms:   make(map[string]*mucRoom),
+	}
+}
+
+// mucRoom is a room with its occupants. The options MUCRoomStore has no
+// field for, and the history, last only as long as the process.
+type mucRoom struct {
+	mu            sync.Mutex
+	jid           jid.JID
+	conf          storage.MUCRoom
+	membersOnly   bool
+	moderated     bool
+	changeSubject bool
+	// locked rooms were just created and wait for their owner to configure
+	// them (XEP-0045 §10.1); nobody else can enter.
+	locked    bool
+	gone      bool
+	occupants map[string]*mucOccupant
+	history   []mucHistory
+	subject   *stanza.Message
+}
+
+type mucOccupant struct {
+	nick        string
+	addr        jid.JID // room@service/nick
+	jid         jid.JID // the occupant's real full JID
+	role        string
+	affiliation string
+	pres        *stanza.Presence
+}
+
+type mucHistory struct {
+	msg    *stanza.Message
+	sender jid.JID // the sender's real bare JID
+	at     time.Time
+}
+
+// mucNotice is what a presence about an occupant says besides the
+// occupant's own presence.
+type mucNotice struct {
+	unavailable bool
+	codes       []int // for everyone
+	selfCodes   []int // only for the occupant
+	nick        string
+	reason      string
+	destroy     *muc.Destroy
+}
+
+// serves reports whether j is the MUC service, one of its rooms or an
+// occupant of one.
+func (s *mucService) serves(j jid.JID) bool {
+	return s != nil && j.Domain() == s.domain
+}
+
+// open returns the room with the given bare JID, loading a stored one. A
+// room that does not exist is created, locked and owned by creator, unless
+// creator is zero; then open returns nil.
+func (s *mucService) open(ctx context.Context, roomJID, creator jid.JID) (*mucRoom, bool, error) {
+	key := roomJID.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.rooms[key]; r != nil {
+		return r, false, nil
+	}
+	conf, err := s.store.GetRoom(ctx, key)
+	switch {
+	case err == nil:
+		r := &mucRoom{jid: roomJID, conf: *conf, occupants: make(map[string]*mucOccupant)}
+		s.rooms[key] = r
+		return r, false, nil
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, false, err
+	case creator.IsZero():
+		return nil, false, nil
+	}
+
+	r := &mucRoom{
+		jid:       roomJID,
+		conf:      storage.MUCRoom{RoomJID: key, Name: roomJID.Local(), Public: true},
+		locked:    true,
+		occupants: make(map[string]*mucOccupant),
+	}
+	if err := s.store.CreateRoom(ctx, &r.conf); err != nil {
+		return nil, false, err
+	}
+	err = s.store.SetAffiliation(ctx, &storage.MUCAffiliation{RoomJID: key, UserJID: creator.Bare().String(), Affiliation: muc.AffOwner})
+	if err != nil {
+		return nil, false, err
+	}
+	s.rooms[key] = r
+	return r, true, nil
+}
+
+// lock opens the room with the given bare JID like open and returns it
+// locked, or nil.
+func (s *mucService) lock(ctx context.Context, roomJID, creator jid.JID) (*mucRoom, bool, error) {
+	for {
+		r, created, err := s.open(ctx, roomJID, creator)
+		if r == nil || err != nil {
+			return nil, false, err
+		}
+		r.mu.Lock()
+		if !r.gone {
+			return r, created, nil
+		}
+		// The room closed while we waited for it.
+		r.mu.Unlock()
+	}
+}
+
+// close forgets r, which is locked and empty or destroyed. The stored room
+// goes too unless it is persistent and configured.
+func (s *mucService) close(ctx context.Context, r *mucRoom, destroy bool) {
+	r.gone = true
+	s.mu.Lock()
+	delete(s.rooms, r.jid.String())
+	s.mu.Unlock()
+	if destroy || r.locked || !r.conf.Persistent {
+		if err := s.store.DeleteRoom(ctx, r.jid.String()); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logError(ctx, "muc room error", "room", r.jid, "error", err)
+		}
+	}
+}
+
+// affiliation returns the affiliation of user with r.
+func (s *mucService) affiliation(ctx context.Context, r *mucRoom, user jid.JID) (string, error) {
+	aff, err := s.store.GetAffiliation(ctx, r.jid.String(), user.Bare().String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return muc.AffNone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return aff.Affiliation, nil
+}
+
+// handlePresence handles presence sent to a room occupant: joining,
+// presence updates, nick changes and leaving.
+func (s *mucService) handlePresence(ctx context.Context, pres *stanza.Presence) error {
+	if pres.Type != "" && pres.Type != stanza.PresenceUnavailable {
+		return nil
+	}
+	available := pres.Type == ""
+	if available && (pres.To.Local() == "" || pres.To.Resource() == "") {
+		mucSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "a nickname is required")))
+		return nil
+	}
+	var creator jid.JID
+	if available {
+		creator = pres.From
+	}
+	r, created, err := s.lock(ctx, pres.To.Bare(), creator)
+	if err != nil {
+		mucSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")))
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	defer r.mu.Unlock()
+
+	o := r.occupantByJID(pres.From)
+	switch {
+	case !available:
+		if o != nil {
+			o.pres = mucPresence(pres)
+			s.remove(ctx, r, o, mucNotice{unavailable: true})
+		}
+		return nil
+	case o == nil:
+		return s.join(ctx, r, pres, created)
+	}
+	o.pres = mucPresence(pres)
+	if nick := pres.To.Resource(); nick != o.nick {
+		return s.changeNick(ctx, r, o, pres)
+	}
+	r.broadcast(ctx, o, mucNotice{})
+	return nil
+}
+
+// join lets the sender of pres into r under the nick it asks for, after
+// checking that it may enter (XEP-0045 §7.2). The new occupant receives the
+// other occupants' presence, its own, the history it asks for and the
+// subject.
+func (s *mucService) join(ctx context.Context, r *mucRoom, pres *stanza.Presence, created bool) error {
+	refuse := func(typ, condition, text string) error {
+		mucSend(ctx, presenceError(pres, stanza.NewStanzaError(typ, condition, text)))
+		if created {
+			s.close(ctx, r, true)
+		}
+		return nil
+	}
+	aff, err := s.affiliation(ctx, r, pres.From)
+	if err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return refuse(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	}
+	var req muc.MUC
+	if ext, ok := findExtension(pres.Extensions, xml.Name{Space: ns.MUC, Local: "x"}); ok {
+		_ = decodeExtension(ext, &req)
+	}
+	nick := pres.To.Resource()
+	privileged := aff == muc.AffOwner || aff == muc.AffAdmin
+
+	switch {
+	case r.locked && aff != muc.AffOwner:
+		return refuse(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "the room is not configured yet")
+	case aff == muc.AffOutcast:
+		return refuse(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "you are banned from this room")
+	case r.membersOnly && aff == muc.AffNone:
+		return refuse(stanza.ErrorTypeAuth, stanza.ErrorRegistrationRequired, "the room is members-only")
+	case r.occupants[nick] != nil:
+		return refuse(stanza.ErrorTypeCancel, stanza.ErrorConflict, "the nickname is in use")
+	case r.conf.MaxUsers > 0 && len(r.occupants) >= r.conf.MaxUsers && !privileged:
+		return refuse(stanza.ErrorTypeWait, stanza.ErrorServiceUnavailable, "the room is full")
+	case r.conf.Password != "" && req.Password != r.conf.Password && !privileged:
+		return refuse(stanza.ErrorTypeAuth, stanza.ErrorNotAuthorized, "a password is required")
+	}
+	if _, err := jid.New(r.jid.Local(), r.jid.Domain(), nick); err != nil {
+		return refuse(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "invalid nickname")
+	}
+
+	o := &mucOccupant{
+		nick:        nick,
+		addr:        pres.To,
+		jid:         pres.From,
+		affiliation: aff,
+		role:        r.defaultRole(aff),
+		pres:        mucPresence(pres),
+	}
+	for _, other := range r.occupants {
+		mucSend(ctx, r.presenceOf(other, o, mucNotice{}))
+	}
+	r.occupants[nick] = o
+	notice := mucNotice{}
+	if created {
+		notice.selfCodes = []int{mucStatusCreated}
+	}
+	r.broadcast(ctx, o, notice)
+	if created {
+		return nil
+	}
+
+	for _, h := range r.historyFor(req.History, time.Now()) {
+		msg := *h.msg
+		msg.To = o.jid
+		if stamp, err := stanza.NewExtension(delay.NewDelay(r.jid.String(), h.at)); err == nil {
+			msg.Extensions = append(append([]stanza.Extension(nil), msg.Extensions...), stamp)
+		}
+		mucSend(ctx, &msg)
+	}
+	subject := r.subject
+	if subject == nil {
+		subject = stanza.NewMessage(stanza.MessageGroupchat)
+		subject.From = r.jid
+		subject.SetSubject("")
+	}
+	msg := *subject
+	msg.To = o.jid
+	mucSend(ctx, &msg)
+	return nil
+}
+
+// changeNick moves o to the nick pres is addressed to (XEP-0045 §7.6).
+func (s *mucService) changeNick(ctx context.Context, r *mucRoom, o *mucOccupant, pres *stanza.Presence) error {
+	nick := pres.To.Resource()
+	if r.occupants[nick] != nil {
+		mucSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "the nickname is in use")))
+		return nil
+	}
+	if _, err := jid.New(r.jid.Local(), r.jid.Domain(), nick); err != nil {
+		mucSend(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "invalid nickname")))
+		return nil
+	}
+	r.broadcast(ctx, o, mucNotice{unavailable: true, codes: []int{mucStatusNickChanged}, nick: nick})
+	delete(r.occupants, o.nick)
+	o.nick, o.addr = nick, pres.To
+	r.occupants[nick] = o
+	r.broadcast(ctx, o, mucNotice{})
+	return nil
+}
+
+// remove takes o out of r, telling everyone with n, and closes the room
+// once it is empty or its owner left it before configuring it.
+func (s *mucService) remove(ctx context.Context, r *mucRoom, o *mucOccupant, n mucNotice) {
+	r.broadcast(ctx, o, n)
+	delete(r.occupants, o.nick)
+	if len(r.occupants) == 0 || r.locked {
+		for _, other := range r.occupants {
+			mucSend(ctx, r.presenceOf(other, other, mucNotice{unavailable: true, destroy: &muc.Destroy{}}))
+		}
+		s.close(ctx, r, false)
+	}
+}
+
+// leaveAll takes the resource full out of every room, as if it had sent
+// them unavailable presence.
+func (s *mucService) leaveAll(ctx context.Context, full jid.JID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	rooms := make([]*mucRoom, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		rooms = append(rooms, r)
+	}
+	s.mu.Unlock()
+	for _, r := range rooms {
+		r.mu.Lock()
+		if o := r.occupantByJID(full); o != nil && !r.gone {
+			s.remove(ctx, r, o, mucNotice{unavailable: true})
+		}
+		r.mu.Unlock()
+	}
+}
+
+// handleMessage handles messages sent to a room or an occupant.
+func (s *mucService) handleMessage(ctx context.Context, msg *stanza.Message) error {
+	if msg.Type == stanza.MessageError {
+		return nil
+	}
+	fail := func(typ, condition, text string) error {
+		mucSend(ctx, messageError(msg, stanza.NewStanzaError(typ, condition, text)))
+		return nil
+	}
+	if msg.To.Local() == "" {
+		return fail(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")
+	}
+	r, _, err := s.lock(ctx, msg.To.Bare(), jid.JID{})
+	if err != nil {
+		logError(ctx, "muc room error", "room", msg.To.Bare(), "error", err)
+		return fail(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	}
+	if r == nil {
+		return fail(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such room")
+	}
+	defer r.mu.Unlock()
+
+	sender := r.occupantByJID(msg.From)
+	if nick := msg.To.Resource(); nick != "" {
+		target := r.occupants[nick]
+		switch {
+		case sender == nil:
+			return fail(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, "only occupants may send private messages")
+		case msg.Type == stanza.MessageGroupchat:
+			return fail(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "private messages are not groupchat")
+		case target == nil:
+			return fail(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such occupant")
+		}
+		out := *msg
+		out.From, out.To = sender.addr, target.jid
+		if x, err := stanza.NewExtension(muc.UserX{}); err == nil {
+			out.Extensions = append(append([]stanza.Extension(nil), msg.Extensions...), x)
+		}
+		mucSend(ctx, &out)
+		return nil
+	}
+
+	if msg.Type != stanza.MessageGroupchat {
+		if ext, ok := findExtension(msg.Extensions, xml.Name{Space: ns.MUCUser, Local: "x"}); ok && sender != nil {
+			var x muc.UserX
+			if err := decodeExtension(ext, &x); err == nil && len(x.Invite) > 0 {
+				r.invite(ctx, sender, x)
+				return nil
+			}
+		}
+		return fail(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "messages to the room must be groupchat")
+	}
+	switch {
+	case sender == nil:
+		return fail(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, "only occupants may send messages to the room")
+	case len(msg.Subjects) > 0 && len(msg.Bodies) == 0:
+		if sender.role != muc.RoleModerator && (!r.changeSubject || sender.role == muc.RoleVisitor) {
+			return fail(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "you may not change the subject")
+		}
+		s.setSubject(ctx, r, sender, msg)
+		return nil
+	case sender.role == muc.RoleVisitor:
+		return fail(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "you have no voice in this room")
+	}
+	if stanzaErr := s.checkRetraction(ctx, r, sender, msg); stanzaErr != nil {
+		mucSend(ctx, messageError(msg, stanzaErr))
+		return nil
+	}
+
+	out := *msg
+	out.From, out.To = sender.addr, jid.JID{}
+	out.Extensions = withoutStanzaID(msg.Extensions, r.jid.String())
+	if globalArchive != nil && len(out.Bodies) > 0 && !noStore(&out) {
+		archived, _ := globalArchive.archive(ctx, r.jid, sender.jid.Bare(), &out)
+		out = *archived
+	}
+	if len(out.Bodies) > 0 && s.history > 0 {
+		r.history = append(r.history, mucHistory{msg: &out, sender: sender.jid.Bare(), at: time.Now()})
+		if len(r.history) > s.history {
+			r.history = r.history[len(r.history)-s.history:]
+		}
+	}
+	r.send(ctx, &out)
+	return nil
+}
+
+// setSubject makes the subject of msg, sent by o, the room's subject.
+func (s *mucService) setSubject(ctx context.Context, r *mucRoom, o *mucOccupant, msg *stanza.Message) {
+	subject := stanza.NewMessage(stanza.MessageGroupchat)
+	subject.ID = msg.ID
+	subject.From = o.addr
+	subject.Subjects = msg.Subjects
+	r.subject = subject
+	r.conf.Subject = msg.Subject()
+	if err := s.store.UpdateRoom(ctx, &r.conf); err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+	}
+	r.send(ctx, subject)
+}
+
+// invite passes the mediated invitations in x, sent by o, on to the
+// invitees (XEP-0045 §7.8.2).
+func (r *mucRoom) invite(ctx context.Context, o *mucOccupant, x muc.UserX) {
+	for _, inv := range x.Invite {
+		to, err := jid.Parse(inv.To)
+		if err != nil {
+			continue
+		}
+		msg, err := stanza.BuildMessage().
+			From(r.jid).
+			To(to).
+			Extension(muc.UserX{
+				Invite:   []muc.Invite{{From: o.jid.Bare().String(), Reason: inv.Reason}},
+				Password: r.conf.Password,
+			}).
+			Build()
+		if err == nil {
+			mucSend(ctx, msg)
+		}
+	}
+}
+
+// send delivers msg to every occupant.
+func (r *mucRoom) send(ctx context.Context, msg *stanza.Message) {
+	for _, o := range r.occupants {
+		out := *msg
+		out.To = o.jid
+		mucSend(ctx, &out)
+	}
+}
+
+// broadcast tells every occupant about o.
+func (r *mucRoom) broadcast(ctx context.Context, o *mucOccupant, n mucNotice) {
+	for _, viewer := range r.occupants {
+		mucSend(ctx, r.presenceOf(o, viewer, n))
+	}
+}
+
+// presenceOf returns the presence of o as viewer sees it: from the
+// occupant's room JID, with its affiliation and role. Only moderators and
+// the occupant itself see its real JID; the room is semi-anonymous.
+func (r *mucRoom) presenceOf(o, viewer *mucOccupant, n mucNotice) *stanza.Presence {
+	pres := *o.pres
+	pres.ID = ""
+	pres.From, pres.To = o.addr, viewer.jid
+	item := muc.UserItem{Affiliation: o.affiliation, Role: o.role, Nick: n.nick, Reason: n.reason}
+	if n.unavailable {
+		pres.Type = stanza.PresenceUnavailable
+		item.Role = muc.RoleNone
+	}
+	if viewer.role == muc.RoleModerator || viewer == o {
+		item.JID = o.jid.String()
+	}
+	x := muc.UserX{Items: []muc.UserItem{item}, Destroy: n.destroy}
+	for _, code := range n.codes {
+		x.Status = append(x.Status, muc.Status{Code: code})
+	}
+	if viewer == o {
+		x.Status = append(x.Status, muc.Status{Code: mucStatusSelf})
+		for _, code := range n.selfCodes {
+			x.Status = append(x.Status, muc.Status{Code: code})
+		}
+	}
+	if ext, err := stanza.NewExtension(x); err == nil {
+		pres.Extensions = append(append([]stanza.Extension(nil), o.pres.Extensions...), ext)
+	}
+	return &pres
+}
+
+func (r *mucRoom) occupantByJID(full jid.JID) *mucOccupant {
+	for _, o := range r.occupants {
+		if o.jid.Equal(full) {
+			return o
+		}
+	}
+	return nil
+}
+
+// defaultRole returns the role an occupant with affiliation aff gets.
+func (r *mucRoom) defaultRole(aff string) string {
+	switch aff {
+	case muc.AffOwner, muc.AffAdmin:
+		return muc.RoleModerator
+	case muc.AffMember:
+		return muc.RoleParticipant
+	}
+	if r.moderated {
+		return muc.RoleVisitor
+	}
+	return muc.RoleParticipant
+}
+
+// historyFor returns the part of the history a new occupant asked for with
+// h (XEP-0045 §7.2.13). Limits on characters other than none are ignored.
+func (r *mucRoom) historyFor(h *muc.History, now time.Time) []mucHistory {
+	entries := r.history
+	if h == nil {
+		return entries
+	}
+	if h.MaxChars != nil && *h.MaxChars == 0 {
+		return nil
+	}
+	since := time.Time{}
+	if h.Seconds != nil {
+		since = now.Add(-time.Duration(*h.Seconds) * time.Second)
+	}
+	if t, err := time.Parse(time.RFC3339, h.Since); err == nil && t.After(since) {
+		since = t
+	}
+	for len(entries) > 0 && entries[0].at.Before(since) {
+		entries = entries[1:]
+	}
+	if h.MaxStanzas != nil && len(entries) > *h.MaxStanzas {
+		entries = entries[len(entries)-max(*h.MaxStanzas, 0):]
+	}
+	return entries
+}
+
+// mucPresence returns pres without the MUC elements, as the presence to
+// show to the other occupants.
+func mucPresence(pres *stanza.Presence) *stanza.Presence {
+	out := *pres
+	out.Extensions = nil
+	for _, ext := range pres.Extensions {
+		switch ext.XMLName {
+		case xml.Name{Space: ns.MUC, Local: "x"}, xml.Name{Space: ns.MUCUser, Local: "x"}:
+			continue
+		}
+		out.Extensions = append(out.Extensions, ext)
+	}
+	return &out
+}
+
+// mucSend delivers st, sent by the MUC service, to its local recipient
+// unless the recipient blocked the sender. Rooms are not federated: S2S only
+// speaks for the main domain.
+func mucSend(ctx context.Context, st stanza.Stanza) {
+	h := st.GetHeader()
+	if globalBlocking.blocks(ctx, h.To, h.From) {
+		return
+	}
+	deliver(ctx, h.To, st)
+}
+
+func findExtension(exts []stanza.Extension, name xml.Name) (stanza.Extension, bool) {
+	for _, ext := range exts {
+		if ext.XMLName == name {
+			return ext, true
+		}
+	}
+	return stanza.Extension{}, false
+}
+
+// decodeExtension unmarshals ext into v.
+func decodeExtension(ext stanza.Extension, v any) error {
+	data, err := xml.Marshal(ext)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+const testRoom = "lounge@conference.example.com"
+
+// setupMUC installs a MUC service on conference.example.com for the
+// duration of t.
+func setupMUC(t *testing.T) storage.MUCRoomStore {
+	t.Helper()
+	store := memory.New()
+	old := globalMUC
+	globalMUC = newMUCService(Config{MUC: true, MUCDomain: "conference.example.com", MUCHistory: 20}, store)
+	t.Cleanup(func() { globalMUC = old })
+	return store.MUCRoomStore()
+}
+
+// orderedPeer is a connected resource that keeps the stanzas it receives in
+// order.
+type orderedPeer struct {
+	session *xmpp.Session
+	in      chan any
+}
+
+func newOrderedPeer(t *testing.T, full string) *orderedPeer {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	addr := jid.MustParse(full)
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(addr))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	p := &orderedPeer{session: session, in: make(chan any, 32)}
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			var v any
+			switch start.Name.Local {
+			case "presence":
+				v = &stanza.Presence{}
+			case "message":
+				v = &stanza.Message{}
+			default:
+				v = &stanza.IQ{}
+			}
+			if dec.DecodeElement(v, &start) != nil {
+				return
+			}
+			p.in <- v
+		}
+	}()
+	globalRouter.register(addr, session)
+	t.Cleanup(func() {
+		globalRouter.unregister(addr)
+		session.Close()
+		c2.Close()
+	})
+	return p
+}
+
+func (p *orderedPeer) next(t *testing.T) any {
+	t.Helper()
+	select {
+	case v := <-p.in:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+		return nil
+	}
+}
+
+func (p *orderedPeer) presence(t *testing.T) *stanza.Presence {
+	t.Helper()
+	pres, ok := p.next(t).(*stanza.Presence)
+	if !ok {
+		t.Fatal("expected presence")
+	}
+	return pres
+}
+
+func (p *orderedPeer) message(t *testing.T) *stanza.Message {
+	t.Helper()
+	msg, ok := p.next(t).(*stanza.Message)
+	if !ok {
+		t.Fatal("expected message")
+	}
+	return msg
+}
+
+func (p *orderedPeer) iq(t *testing.T) *stanza.IQ {
+	t.Helper()
+	iq, ok := p.next(t).(*stanza.IQ)
+	if !ok {
+		t.Fatal("expected iq")
+	}
+	return iq
+}
+
+func (p *orderedPeer) quiet(t *testing.T) {
+	t.Helper()
+	select {
+	case v := <-p.in:
+		t.Fatalf("unexpected %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// join sends presence to the room under nick with the given MUC element
+// children.
+func (p *orderedPeer) join(t *testing.T, nick, x string) {
+	t.Helper()
+	pres := stanza.NewPresence("")
+	pres.To = jid.MustParse(testRoom + "/" + nick)
+	pres.Extensions = []stanza.Extension{{XMLName: xml.Name{Space: "http://jabber.org/protocol/muc", Local: "x"}, Inner: []byte(x)}}
+	if err := routePresence(context.Background(), p.session, pres); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+}
+
+func (p *orderedPeer) say(t *testing.T, to, body string) {
+	t.Helper()
+	typ := stanza.MessageGroupchat
+	if jid.MustParse(to).Resource() != "" {
+		typ = stanza.MessageChat
+	}
+	msg := stanza.NewMessage(typ)
+	msg.To = jid.MustParse(to)
+	msg.SetBody(body)
+	if err := routeMessage(context.Background(), p.session, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+}
+
+// ask sends an IQ with the given payload to to, or to the account itself
+// when to is empty.
+func (p *orderedPeer) ask(t *testing.T, typ, to, payload string) {
+	t.Helper()
+	iq := stanza.NewIQ(typ)
+	if to != "" {
+		iq.To = jid.MustParse(to)
+	}
+	iq.Query = []byte(payload)
+	if err := routeIQ(context.Background(), p.session, iq); err != nil {
+		t.Fatalf("routeIQ: %v", err)
+	}
+}
+
+// request sends an IQ like ask and returns the reply.
+func (p *orderedPeer) request(t *testing.T, typ, to, payload string) *stanza.IQ {
+	t.Helper()
+	p.ask(t, typ, to, payload)
+	return p.iq(t)
+}
+
+// userX returns the muc#user element of pres.
+func userX(t *testing.T, exts []stanza.Extension) muc.UserX {
+	t.Helper()
+	var x muc.UserX
+	for _, ext := range exts {
+		if ext.XMLName.Local == "x" && ext.XMLName.Space == "http://jabber.org/protocol/muc#user" {
+			if err := xml.Unmarshal(extensionXML(t, ext), &x); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return x
+}
+
+func statusCodes(x muc.UserX) []int {
+	var codes []int
+	for _, s := range x.Status {
+		codes = append(codes, s.Code)
+	}
+	return codes
+}
+
+// configure submits a room configuration form with the given fields.
+func (p *orderedPeer) configure(t *testing.T, fields string) {
+	t.Helper()
+	reply := p.request(t, stanza.IQSet, testRoom, `<query xmlns='http://jabber.org/protocol/muc#owner'>
+		<x xmlns='jabber:x:data' type='submit'>
+			<field var='FORM_TYPE'><value>http://jabber.org/protocol/muc#roomconfig</value></field>`+fields+`</x></query>`)
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("configure: %+v", reply.Error)
+	}
+}
+
+// openRoom has alice create and configure the room with the given fields.
+func openRoom(t *testing.T, fields string) *orderedPeer {
+	t.Helper()
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	alice.join(t, "alice", "")
+	alice.presence(t)
+	alice.configure(t, fields)
+	return alice
+}
+
+// enter has p join the room as nick and skips what it receives until the
+// subject.
+func (p *orderedPeer) enter(t *testing.T, nick string) {
+	t.Helper()
+	p.join(t, nick, "")
+	for {
+		if msg, ok := p.next(t).(*stanza.Message); ok && len(msg.Subjects) > 0 {
+			return
+		}
+	}
+}
+
+func TestMUCCreateRoom(t *testing.T) {
+	store := setupMUC(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	alice.join(t, "alice", "")
+	pres := alice.presence(t)
+	x := userX(t, pres.Extensions)
+	if pres.From.String() != testRoom+"/alice" || !slices.Equal(statusCodes(x), []int{110, 201}) ||
+		len(x.Items) != 1 || x.Items[0].Affiliation != muc.AffOwner || x.Items[0].Role != muc.RoleModerator {
+		t.Fatalf("self presence %s: %+v", pres.From, x)
+	}
+	alice.quiet(t)
+
+	// The room stays locked until its owner configures it.
+	bob.join(t, "bob", "")
+	if pres := bob.presence(t); pres.Type != stanza.PresenceError || pres.Error == nil || pres.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("locked room: %+v", pres)
+	}
+
+	reply := alice.request(t, stanza.IQGet, testRoom, `<query xmlns='http://jabber.org/protocol/muc#owner'/>`)
+	var q mucOwnerQuery
+	if err := xml.Unmarshal(reply.Query, &q); err != nil || q.Form == nil || q.Form.GetField("muc#roomconfig_membersonly") == nil {
+		t.Fatalf("config form %s: %v", reply.Query, err)
+	}
+	if reply := bob.request(t, stanza.IQGet, testRoom, `<query xmlns='http://jabber.org/protocol/muc#owner'/>`); reply.Type != stanza.IQError {
+		t.Fatalf("non-owner got the form: %+v", reply)
+	}
+
+	alice.configure(t, `<field var='muc#roomconfig_roomname'><value>Lounge</value></field>
+		<field var='muc#roomconfig_persistentroom'><value>1</value></field>`)
+	room, err := store.GetRoom(context.Background(), testRoom)
+	if err != nil || room.Name != "Lounge" || !room.Persistent {
+		t.Fatalf("stored room %+v: %v", room, err)
+	}
+
+	bob.join(t, "bob", "")
+	if pres := bob.presence(t); pres.From.String() != testRoom+"/alice" || userX(t, pres.Extensions).Items[0].JID != "" {
+		t.Fatalf("bob sees alice as %+v", pres)
+	}
+	if pres := bob.presence(t); !slices.Equal(statusCodes(userX(t, pres.Extensions)), []int{110}) {
+		t.Fatalf("bob's self presence %+v", pres)
+	}
+	if msg := bob.message(t); len(msg.Subjects) != 1 || msg.From.String() != testRoom {
+		t.Fatalf("subject %+v", msg)
+	}
+	// Moderators see real JIDs.
+	if x := userX(t, alice.presence(t).Extensions); x.Items[0].JID != "bob@example.com/desk" {
+		t.Fatalf("alice sees bob as %+v", x)
+	}
+
+	carol := newOrderedPeer(t, "carol@example.com/tab")
+	carol.join(t, "bob", "")
+	if pres := carol.presence(t); pres.Type != stanza.PresenceError || pres.Error == nil {
+		t.Fatalf("nick conflict: %+v", pres)
+	}
+}
+
+func TestMUCMessages(t *testing.T) {
+	setupMUC(t)
+	alice := openRoom(t, "")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	bob.say(t, testRoom, "hello")
+	for _, p := range []*orderedPeer{alice, bob} {
+		if msg := p.message(t); msg.Body() != "hello" || msg.From.String() != testRoom+"/bob" || msg.Type != stanza.MessageGroupchat {
+			t.Fatalf("groupchat %+v", msg)
+		}
+	}
+
+	bob.say(t, testRoom+"/alice", "psst")
+	if msg := alice.message(t); msg.Body() != "psst" || msg.From.String() != testRoom+"/bob" {
+		t.Fatalf("private message %+v", msg)
+	}
+	bob.quiet(t)
+
+	subject := stanza.NewMessage(stanza.MessageGroupchat)
+	subject.To = jid.MustParse(testRoom)
+	subject.SetSubject("Today")
+	if err := routeMessage(context.Background(), alice.session, subject); err != nil {
+		t.Fatal(err)
+	}
+	alice.message(t)
+	bob.message(t)
+
+	carol := newOrderedPeer(t, "carol@example.com/tab")
+	carol.join(t, "carol", "<history maxstanzas='5'/>")
+	carol.presence(t)
+	carol.presence(t)
+	carol.presence(t)
+	msg := carol.message(t)
+	if msg.Body() != "hello" {
+		t.Fatalf("history %+v", msg)
+	}
+	if !slices.ContainsFunc(msg.Extensions, func(ext stanza.Extension) bool { return ext.XMLName.Local == "delay" }) {
+		t.Fatalf("history without delay: %+v", msg.Extensions)
+	}
+	if msg := carol.message(t); msg.Subject() != "Today" || msg.From.String() != testRoom+"/alice" {
+		t.Fatalf("subject %+v", msg)
+	}
+
+	outsider := newOrderedPeer(t, "dave@example.com/pc")
+	outsider.say(t, testRoom, "hi")
+	if msg := outsider.message(t); msg.Type != stanza.MessageError {
+		t.Fatalf("outsider message %+v", msg)
+	}
+}
+
+func TestMUCModeration(t *testing.T) {
+	setupMUC(t)
+	alice := openRoom(t, "")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	kick := `<query xmlns='http://jabber.org/protocol/muc#admin'><item nick='alice' role='none'/></query>`
+	if reply := bob.request(t, stanza.IQSet, testRoom, kick); reply.Type != stanza.IQError {
+		t.Fatalf("participant kicked: %+v", reply)
+	}
+
+	kick = `<query xmlns='http://jabber.org/protocol/muc#admin'><item nick='bob' role='none'><reason>spam</reason></item></query>`
+	alice.ask(t, stanza.IQSet, testRoom, kick)
+	pres := bob.presence(t)
+	if x := userX(t, pres.Extensions); pres.Type != stanza.PresenceUnavailable || !slices.Contains(statusCodes(x), mucStatusKicked) || x.Items[0].Reason != "spam" {
+		t.Fatalf("kicked presence %+v", x)
+	}
+	// The occupants hear of the kick before the moderator's reply.
+	alice.presence(t)
+	if reply := alice.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("kick: %+v", reply.Error)
+	}
+
+	ban := `<query xmlns='http://jabber.org/protocol/muc#admin'><item jid='bob@example.com' affiliation='outcast'/></query>`
+	if reply := alice.request(t, stanza.IQSet, testRoom, ban); reply.Type != stanza.IQResult {
+		t.Fatalf("ban: %+v", reply.Error)
+	}
+	bob.join(t, "bob", "")
+	if pres := bob.presence(t); pres.Type != stanza.PresenceError || pres.Error == nil || pres.Error.Type != stanza.ErrorTypeAuth {
+		t.Fatalf("banned user joined: %+v", pres)
+	}
+
+	reply := alice.request(t, stanza.IQGet, testRoom, `<query xmlns='http://jabber.org/protocol/muc#admin'><item affiliation='outcast'/></query>`)
+	var list muc.AdminQuery
+	if err := xml.Unmarshal(reply.Query, &list); err != nil || len(list.Items) != 1 || list.Items[0].JID != "bob@example.com" {
+		t.Fatalf("outcasts %s: %v", reply.Query, err)
+	}
+}
+
+func TestMUCMembersOnlyAndPassword(t *testing.T) {
+	setupMUC(t)
+	alice := openRoom(t, `<field var='muc#roomconfig_membersonly'><value>1</value></field>`)
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	bob.join(t, "bob", "")
+	if pres := bob.presence(t); pres.Type != stanza.PresenceError {
+		t.Fatalf("non-member joined: %+v", pres)
+	}
+	member := `<query xmlns='http://jabber.org/protocol/muc#admin'><item jid='bob@example.com' affiliation='member'/></query>`
+	if reply := alice.request(t, stanza.IQSet, testRoom, member); reply.Type != stanza.IQResult {
+		t.Fatalf("member: %+v", reply.Error)
+	}
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	// Taking the membership away removes bob from the room.
+	none := `<query xmlns='http://jabber.org/protocol/muc#admin'><item jid='bob@example.com' affiliation='none'/></query>`
+	alice.ask(t, stanza.IQSet, testRoom, none)
+	if pres := bob.presence(t); !slices.Contains(statusCodes(userX(t, pres.Extensions)), mucStatusMembersOnly) {
+		t.Fatalf("removed presence %+v", pres)
+	}
+	alice.presence(t)
+	if reply := alice.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("none: %+v", reply.Error)
+	}
+
+	alice.configure(t, `<field var='muc#roomconfig_membersonly'><value>0</value></field>
+		<field var='muc#roomconfig_passwordprotectedroom'><value>1</value></field>
+		<field var='muc#roomconfig_roomsecret'><value>s3cret</value></field>`)
+	bob.join(t, "bob", "<password>wrong</password>")
+	if pres := bob.presence(t); pres.Type != stanza.PresenceError {
+		t.Fatalf("wrong password joined: %+v", pres)
+	}
+	bob.join(t, "bob", "<password>s3cret</password>")
+	if pres := bob.presence(t); pres.Type != "" {
+		t.Fatalf("password join: %+v", pres)
+	}
+}
+
+func TestMUCDisco(t *testing.T) {
+	setupMUC(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+
+	reply := alice.request(t, stanza.IQGet, "conference.example.com", `<query xmlns='http://jabber.org/protocol/disco#info'/>`)
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(reply.Query, &info); err != nil || len(info.Identities) != 1 || info.Identities[0].Category != "conference" {
+		t.Fatalf("service info %s: %v", reply.Query, err)
+	}
+
+	items := func() []disco.Item {
+		t.Helper()
+		reply := alice.request(t, stanza.IQGet, "conference.example.com", `<query xmlns='http://jabber.org/protocol/disco#items'/>`)
+		var q disco.ItemsQuery
+		if err := xml.Unmarshal(reply.Query, &q); err != nil {
+			t.Fatal(err)
+		}
+		return q.Items
+	}
+	alice.join(t, "alice", "")
+	alice.presence(t)
+	if got := items(); len(got) != 0 {
+		t.Fatalf("locked room listed: %+v", got)
+	}
+	alice.configure(t, `<field var='muc#roomconfig_roomname'><value>Lounge</value></field>`)
+	if got := items(); len(got) != 1 || got[0].JID != testRoom || got[0].Name != "Lounge" {
+		t.Fatalf("items %+v", got)
+	}
+
+	reply = alice.request(t, stanza.IQGet, testRoom, `<query xmlns='http://jabber.org/protocol/disco#info'/>`)
+	info = disco.InfoQuery{}
+	if err := xml.Unmarshal(reply.Query, &info); err != nil {
+		t.Fatal(err)
+	}
+	var features []string
+	for _, f := range info.Features {
+		features = append(features, f.Var)
+	}
+	for _, want := range []string{"muc_public", "muc_temporary", "muc_open", "muc_unsecured"} {
+		if !slices.Contains(features, want) {
+			t.Errorf("room features %v lack %s", features, want)
+		}
+	}
+}
+
+func TestMUCDestroyAndLeave(t *testing.T) {
+	store := setupMUC(t)
+	alice := openRoom(t, "")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	// Going offline leaves the room.
+	sessionUnavailable(context.Background(), bob.session)
+	if pres := alice.presence(t); pres.Type != stanza.PresenceUnavailable || pres.From.String() != testRoom+"/bob" {
+		t.Fatalf("leave %+v", pres)
+	}
+	bob.enter(t, "bob")
+	alice.presence(t)
+
+	alice.ask(t, stanza.IQSet, testRoom, `<query xmlns='http://jabber.org/protocol/muc#owner'>
+		<destroy jid='other@conference.example.com'><reason>moved</reason></destroy></query>`)
+	pres := bob.presence(t)
+	if x := userX(t, pres.Extensions); pres.Type != stanza.PresenceUnavailable || x.Destroy == nil || x.Destroy.JID != "other@conference.example.com" {
+		t.Fatalf("destroy presence %+v", x)
+	}
+	alice.presence(t)
+	if reply := alice.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("destroy: %+v", reply.Error)
+	}
+	if _, err := store.GetRoom(context.Background(), testRoom); err == nil {
+		t.Fatal("destroyed room still stored")
+	}
+}
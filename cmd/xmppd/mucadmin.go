@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/moderation"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// mucRoomConfig is the FORM_TYPE of room configuration forms.
+const mucRoomConfig = "http://jabber.org/protocol/muc#roomconfig"
+
+// mucOwnerQuery is a muc#owner query with its configuration form or
+// destruction request decoded.
+type mucOwnerQuery struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *form.Form   `xml:"jabber:x:data x"`
+	Destroy *muc.Destroy `xml:"destroy"`
+}
+
+// affiliationRank orders affiliations from none to owner.
+var affiliationRank = map[string]int{
+	muc.AffOutcast: 0,
+	muc.AffNone:    0,
+	muc.AffMember:  1,
+	muc.AffAdmin:   2,
+	muc.AffOwner:   3,
+}
+
+// handleIQ answers the requests sent to the MUC service or its rooms.
+func (s *mucService) handleIQ(ctx context.Context, iq *stanza.IQ) error {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil
+	}
+	mucSend(ctx, s.answerIQ(ctx, iq))
+	return nil
+}
+
+func (s *mucService) answerIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.To.Resource() != "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "occupants cannot be queried through the room"))
+	}
+	if iq.To.Local() == "" {
+		return s.answerService(ctx, iq)
+	}
+	r, _, err := s.lock(ctx, iq.To, jid.JID{})
+	if err != nil {
+		logError(ctx, "muc room error", "room", iq.To, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if r == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such room"))
+	}
+	defer r.mu.Unlock()
+
+	var admin muc.AdminQuery
+	var owner mucOwnerQuery
+	var archive mamQuery
+	var moderate moderation.Moderate
+	switch {
+	case xml.Unmarshal(iq.Query, &disco.InfoQuery{}) == nil && iq.Type == stanza.IQGet:
+		return payloadIQ(iq, r.info())
+	case xml.Unmarshal(iq.Query, &disco.ItemsQuery{}) == nil && iq.Type == stanza.IQGet:
+		// Occupants are not listed; the room is semi-anonymous.
+		return payloadIQ(iq, disco.ItemsQuery{})
+	case xml.Unmarshal(iq.Query, &admin) == nil:
+		return s.answerAdmin(ctx, r, iq, admin)
+	case xml.Unmarshal(iq.Query, &owner) == nil:
+		return s.answerOwner(ctx, r, iq, owner)
+	case xml.Unmarshal(iq.Query, &archive) == nil:
+		return s.answerArchive(ctx, r, iq, archive)
+	case xml.Unmarshal(iq.Query, &moderate) == nil && iq.Type == stanza.IQSet:
+		return s.answerModerate(ctx, r, iq, moderate)
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+}
+
+// answerService answers the service discovery requests sent to the
+// service itself; its items are the public rooms.
+func (s *mucService) answerService(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type == stanza.IQGet && xml.Unmarshal(iq.Query, &disco.InfoQuery{}) == nil {
+		return payloadIQ(iq, disco.InfoQuery{
+			Identities: []disco.Identity{{Category: "conference", Type: "text", Name: "Chatrooms"}},
+			Features:   []disco.Feature{{Var: ns.DiscoInfo}, {Var: ns.DiscoItems}, {Var: ns.MUC}},
+		})
+	}
+	if iq.Type != stanza.IQGet || xml.Unmarshal(iq.Query, &disco.ItemsQuery{}) != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+	}
+	rooms, err := s.store.ListRooms(ctx)
+	if err != nil {
+		logError(ctx, "muc service error", "service", s.domain, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	items := disco.ItemsQuery{}
+	for _, room := range rooms {
+		if room.Public && !s.isLocked(room.RoomJID) {
+			items.Items = append(items.Items, disco.Item{JID: room.RoomJID, Name: room.Name})
+		}
+	}
+	return payloadIQ(iq, items)
+}
+
+// isLocked reports whether the room with the given JID waits for its
+// configuration.
+func (s *mucService) isLocked(roomJID string) bool {
+	s.mu.Lock()
+	r := s.rooms[roomJID]
+	s.mu.Unlock()
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.locked
+}
+
+// info describes r for service discovery (XEP-0045 §6.4).
+func (r *mucRoom) info() disco.InfoQuery {
+	pick := func(on bool, yes, no string) disco.Feature {
+		if on {
+			return disco.Feature{Var: yes}
+		}
+		return disco.Feature{Var: no}
+	}
+	features := []disco.Feature{
+		{Var: ns.MUC},
+		{Var: "muc_semianonymous"},
+		pick(r.conf.Public, "muc_public", "muc_hidden"),
+		pick(r.conf.Persistent, "muc_persistent", "muc_temporary"),
+		pick(r.membersOnly, "muc_membersonly", "muc_open"),
+		pick(r.moderated, "muc_moderated", "muc_unmoderated"),
+		pick(r.conf.Password != "", "muc_passwordprotected", "muc_unsecured"),
+	}
+	// Messages can only be referred to by the stanza-ids the archive gives
+	// them.
+	if globalArchive != nil {
+		features = append(features, disco.Feature{Var: ns.MAM}, disco.Feature{Var: ns.Moderation}, disco.Feature{Var: ns.Retraction})
+	}
+	return disco.InfoQuery{
+		Identities: []disco.Identity{{Category: "conference", Type: "text", Name: r.conf.Name}},
+		Features:   features,
+	}
+}
+
+// answerAdmin lists or changes roles and affiliations (XEP-0045 §8, §9).
+func (s *mucService) answerAdmin(ctx context.Context, r *mucRoom, iq *stanza.IQ, q muc.AdminQuery) *stanza.IQ {
+	actorAff, err := s.affiliation(ctx, r, iq.From)
+	if err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	actor := r.occupantByJID(iq.From)
+	if iq.Type == stanza.IQGet {
+		return s.adminList(ctx, r, iq, q, actor, actorAff)
+	}
+	for _, item := range q.Items {
+		var stanzaErr *stanza.StanzaError
+		switch {
+		case item.Affiliation != "" && item.JID != "":
+			stanzaErr = s.setAffiliation(ctx, r, actorAff, item)
+		case item.Role != "" && item.Nick != "":
+			stanzaErr = s.setRole(ctx, r, actor, actorAff, item)
+		default:
+			stanzaErr = stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "an item needs a role and nick or an affiliation and jid")
+		}
+		if stanzaErr != nil {
+			return iq.ErrorIQ(stanzaErr)
+		}
+	}
+	return iq.ResultIQ()
+}
+
+// adminList returns the occupants with a role or the users with an
+// affiliation. Roles are listed to moderators, affiliations to admins.
+func (s *mucService) adminList(ctx context.Context, r *mucRoom, iq *stanza.IQ, q muc.AdminQuery, actor *mucOccupant, actorAff string) *stanza.IQ {
+	if len(q.Items) != 1 {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "ask for one role or affiliation"))
+	}
+	want := q.Items[0]
+	var out muc.AdminQuery
+	switch {
+	case want.Affiliation != "":
+		if affiliationRank[actorAff] < affiliationRank[muc.AffAdmin] {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+		}
+		affs, err := s.store.GetAffiliations(ctx, r.jid.String())
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logError(ctx, "muc room error", "room", r.jid, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		for _, a := range affs {
+			if a.Affiliation == want.Affiliation {
+				out.Items = append(out.Items, muc.UserItem{Affiliation: a.Affiliation, JID: a.UserJID, Reason: a.Reason})
+			}
+		}
+	case want.Role != "":
+		if actor == nil || actor.role != muc.RoleModerator {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+		}
+		for _, o := range r.occupants {
+			if o.role == want.Role {
+				out.Items = append(out.Items, muc.UserItem{Affiliation: o.affiliation, Role: o.role, Nick: o.nick, JID: o.jid.String()})
+			}
+		}
+	default:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "ask for one role or affiliation"))
+	}
+	return payloadIQ(iq, out)
+}
+
+// setRole changes the role of the occupant item names; a moderator may
+// kick or silence those not above them and admins may make moderators.
+func (s *mucService) setRole(ctx context.Context, r *mucRoom, actor *mucOccupant, actorAff string, item muc.UserItem) *stanza.StanzaError {
+	target := r.occupants[item.Nick]
+	switch {
+	case actor == nil || actor.role != muc.RoleModerator:
+		return stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only moderators may change roles")
+	case target == nil:
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such occupant")
+	}
+	switch item.Role {
+	case muc.RoleNone, muc.RoleVisitor, muc.RoleParticipant:
+		if affiliationRank[target.affiliation] >= affiliationRank[muc.AffAdmin] ||
+			affiliationRank[target.affiliation] > affiliationRank[actorAff] {
+			return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "the occupant outranks you")
+		}
+	case muc.RoleModerator:
+		if affiliationRank[actorAff] < affiliationRank[muc.AffAdmin] {
+			return stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only admins may grant moderation")
+		}
+	default:
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "unknown role")
+	}
+	if item.Role == muc.RoleNone {
+		s.remove(ctx, r, target, mucNotice{unavailable: true, codes: []int{mucStatusKicked}, reason: item.Reason})
+		return nil
+	}
+	target.role = item.Role
+	r.broadcast(ctx, target, mucNotice{reason: item.Reason})
+	return nil
+}
+
+// setAffiliation changes the affiliation of the user item names. Admins
+// manage members and outcasts below them; owners manage everyone. Occupants
+// who may no longer stay are removed.
+func (s *mucService) setAffiliation(ctx context.Context, r *mucRoom, actorAff string, item muc.UserItem) *stanza.StanzaError {
+	user, err := jid.Parse(item.JID)
+	if err != nil {
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, "")
+	}
+	user = user.Bare()
+	if _, ok := affiliationRank[item.Affiliation]; !ok {
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "unknown affiliation")
+	}
+	current, err := s.affiliation(ctx, r, user)
+	if err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	}
+	if actorAff != muc.AffOwner {
+		if actorAff != muc.AffAdmin {
+			return stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only admins may change affiliations")
+		}
+		if affiliationRank[current] >= affiliationRank[muc.AffAdmin] || affiliationRank[item.Affiliation] >= affiliationRank[muc.AffAdmin] {
+			return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "only owners may manage admins and owners")
+		}
+	}
+
+	if item.Affiliation == muc.AffNone {
+		err = s.store.RemoveAffiliation(ctx, r.jid.String(), user.String())
+		if errors.Is(err, storage.ErrNotFound) {
+			err = nil
+		}
+	} else {
+		err = s.store.SetAffiliation(ctx, &storage.MUCAffiliation{
+			RoomJID: r.jid.String(), UserJID: user.String(), Affiliation: item.Affiliation, Reason: item.Reason,
+		})
+	}
+	if err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+	}
+
+	var affected []*mucOccupant
+	for _, o := range r.occupants {
+		if o.jid.Bare().Equal(user) {
+			affected = append(affected, o)
+		}
+	}
+	for _, o := range affected {
+		o.affiliation = item.Affiliation
+		switch {
+		case item.Affiliation == muc.AffOutcast:
+			s.remove(ctx, r, o, mucNotice{unavailable: true, codes: []int{mucStatusBanned}, reason: item.Reason})
+		case item.Affiliation == muc.AffNone && r.membersOnly:
+			s.remove(ctx, r, o, mucNotice{unavailable: true, codes: []int{mucStatusMembersOnly}, reason: item.Reason})
+		default:
+			o.role = r.defaultRole(item.Affiliation)
+			r.broadcast(ctx, o, mucNotice{reason: item.Reason})
+		}
+	}
+	return nil
+}
+
+// answerOwner hands out and applies the room configuration form and
+// destroys rooms (XEP-0045 §10). Only owners may.
+func (s *mucService) answerOwner(ctx context.Context, r *mucRoom, iq *stanza.IQ, q mucOwnerQuery) *stanza.IQ {
+	aff, err := s.affiliation(ctx, r, iq.From)
+	if err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if aff != muc.AffOwner {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only owners may configure the room"))
+	}
+	if iq.Type == stanza.IQGet {
+		return payloadIQ(iq, mucOwnerQuery{Form: r.configForm()})
+	}
+	switch {
+	case q.Destroy != nil:
+		s.destroy(ctx, r, q.Destroy)
+		return iq.ResultIQ()
+	case q.Form == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "a configuration form is required"))
+	case q.Form.Type == form.TypeCancel:
+		// Cancelling the configuration of a new room destroys it.
+		if r.locked {
+			s.destroy(ctx, r, &muc.Destroy{})
+		}
+		return iq.ResultIQ()
+	case q.Form.Type != form.TypeSubmit:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "submit or cancel the form"))
+	}
+	if err := r.configure(q.Form); err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, err.Error()))
+	}
+	r.locked = false
+	if err := s.store.UpdateRoom(ctx, &r.conf); err != nil {
+		logError(ctx, "muc room error", "room", r.jid, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return iq.ResultIQ()
+}
+
+// configForm returns the configuration form of r filled in with its
+// current settings.
+func (r *mucRoom) configForm() *form.Form {
+	boolean := func(on bool) []string {
+		if on {
+			return []string{"1"}
+		}
+		return []string{"0"}
+	}
+	f := form.NewForm(form.TypeForm, "Configuration of "+r.jid.String())
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{mucRoomConfig}})
+	f.AddField(form.Field{Var: "muc#roomconfig_roomname", Type: form.FieldTextSingle, Label: "Name", Values: []string{r.conf.Name}})
+	f.AddField(form.Field{Var: "muc#roomconfig_roomdesc", Type: form.FieldTextSingle, Label: "Description", Values: []string{r.conf.Description}})
+	f.AddField(form.Field{Var: "muc#roomconfig_persistentroom", Type: form.FieldBoolean, Label: "Persistent", Values: boolean(r.conf.Persistent)})
+	f.AddField(form.Field{Var: "muc#roomconfig_publicroom", Type: form.FieldBoolean, Label: "Listed in the directory", Values: boolean(r.conf.Public)})
+	f.AddField(form.Field{Var: "muc#roomconfig_membersonly", Type: form.FieldBoolean, Label: "Members only", Values: boolean(r.membersOnly)})
+	f.AddField(form.Field{Var: "muc#roomconfig_moderatedroom", Type: form.FieldBoolean, Label: "Moderated", Values: boolean(r.moderated)})
+	f.AddField(form.Field{Var: "muc#roomconfig_changesubject", Type: form.FieldBoolean, Label: "Participants may change the subject", Values: boolean(r.changeSubject)})
+	f.AddField(form.Field{Var: "muc#roomconfig_passwordprotectedroom", Type: form.FieldBoolean, Label: "Password protected", Values: boolean(r.conf.Password != "")})
+	f.AddField(form.Field{Var: "muc#roomconfig_roomsecret", Type: form.FieldTextPrivate, Label: "Password"})
+	f.AddField(form.Field{Var: "muc#roomconfig_maxusers", Type: form.FieldTextSingle, Label: "Maximum occupants (0 for no limit)", Values: []string{strconv.Itoa(r.conf.MaxUsers)}})
+	return f
+}
+
+// configure applies a submitted configuration form to r. Fields left out
+// keep their value.
+func (r *mucRoom) configure(f *form.Form) error {
+	conf := r.conf
+	membersOnly, moderated, changeSubject := r.membersOnly, r.moderated, r.changeSubject
+	protected := conf.Password != ""
+	secret := ""
+	for _, field := range f.Fields {
+		v := ""
+		if len(field.Values) > 0 {
+			v = field.Values[0]
+		}
+		on := v == "1" || v == "true"
+		switch field.Var {
+		case "muc#roomconfig_roomname":
+			conf.Name = v
+		case "muc#roomconfig_roomdesc":
+			conf.Description = v
+		case "muc#roomconfig_persistentroom":
+			conf.Persistent = on
+		case "muc#roomconfig_publicroom":
+			conf.Public = on
+		case "muc#roomconfig_membersonly":
+			membersOnly = on
+		case "muc#roomconfig_moderatedroom":
+			moderated = on
+		case "muc#roomconfig_changesubject":
+			changeSubject = on
+		case "muc#roomconfig_passwordprotectedroom":
+			protected = on
+		case "muc#roomconfig_roomsecret":
+			secret = v
+		case "muc#roomconfig_maxusers":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return errors.New("invalid maximum number of occupants")
+			}
+			conf.MaxUsers = n
+		}
+	}
+	switch {
+	case !protected:
+		conf.Password = ""
+	case secret != "":
+		conf.Password = secret
+	case conf.Password == "":
+		return errors.New("a password protected room needs a password")
+	}
+	r.conf = conf
+	r.membersOnly, r.moderated, r.changeSubject = membersOnly, moderated, changeSubject
+	return nil
+}
+
+// destroy sends every occupant out of r with d and removes the room.
+func (s *mucService) destroy(ctx context.Context, r *mucRoom, d *muc.Destroy) {
+	for _, o := range r.occupants {
+		mucSend(ctx, r.presenceOf(o, o, mucNotice{unavailable: true, destroy: d}))
+	}
+	r.occupants = make(map[string]*mucOccupant)
+	s.close(ctx, r, true)
+}
+
+// answerArchive answers the XEP-0313 queries occupants send to the room's
+// archive.
+func (s *mucService) answerArchive(ctx context.Context, r *mucRoom, iq *stanza.IQ, q mamQuery) *stanza.IQ {
+	switch {
+	case globalArchive == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "message archive disabled"))
+	case r.occupantByJID(iq.From) == nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only occupants may query the archive"))
+	case iq.Type == stanza.IQGet:
+		return payloadIQ(iq, mamQuery{Form: mamForm()})
+	}
+	send := func(ctx context.Context, st stanza.Stanza) error {
+		mucSend(ctx, st)
+		return nil
+	}
+	return globalArchive.answerQuery(ctx, r.jid, iq.From, iq, q, send)
+}
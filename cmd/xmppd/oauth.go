@@ -0,0 +1,224 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/meszmate/xmpp-go/sasl"
+)
+
+// oauthTimeout bounds each request to the identity provider.
+const oauthTimeout = 10 * time.Second
+
+// oauthProvider checks credentials with an OAuth 2.0 authorization server
+// or OpenID Connect provider: passwords with the resource owner password
+// grant (RFC 6749 §4.3) and bearer tokens with token introspection
+// (RFC 7662), which must show that they were issued for audience. The OIDC
+// userinfo endpoint, which cannot tell whom a token was issued for, only
+// checks tokens when userinfoTokens is set.
+type oauthProvider struct {
+	client *http.Client
+	domain string
+
+	tokenURL      string
+	introspectURL string
+	userinfoURL   string
+	clientID      string
+	clientSecret  string
+	scopes        string
+	claim         string
+
+	audience       string
+	userinfoTokens bool
+}
+
+func newOAuthProvider(ctx context.Context, cfg Config) (*oauthProvider, error) {
+	p := &oauthProvider{
+		client:        &http.Client{Timeout: oauthTimeout},
+		domain:        cfg.Domain,
+		tokenURL:      cfg.OAuthTokenURL,
+		introspectURL: cfg.OAuthIntrospectionURL,
+		userinfoURL:   cfg.OAuthUserinfoURL,
+		clientID:      cfg.OAuthClientID,
+		clientSecret:  cfg.OAuthClientSecret,
+		scopes:        cfg.OAuthScopes,
+		claim:         cfg.OAuthUsernameClaim,
+
+		audience:       cmp.Or(cfg.OAuthAudience, cfg.OAuthClientID),
+		userinfoTokens: cfg.OAuthUserinfoTokens,
+	}
+	if cfg.OAuthIssuer != "" {
+		if err := p.discover(ctx, cfg.OAuthIssuer); err != nil {
+			return nil, fmt.Errorf("oauth discovery: %w", err)
+		}
+	}
+	if p.tokenURL == "" && p.introspectURL == "" && p.userinfoURL == "" {
+		return nil, errors.New("oauth: set XMPP_OAUTH_ISSUER or the endpoint URLs")
+	}
+	return p, nil
+}
+
+// discover fills in the endpoints that are not configured from the OpenID
+// Connect discovery document of issuer.
+func (p *oauthProvider) discover(ctx context.Context, issuer string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		TokenEndpoint         string `json:"token_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := p.do(req, &doc); err != nil {
+		return err
+	}
+	fill := func(endpoint *string, discovered string) {
+		if *endpoint == "" {
+			*endpoint = discovered
+		}
+	}
+	fill(&p.tokenURL, doc.TokenEndpoint)
+	fill(&p.introspectURL, doc.IntrospectionEndpoint)
+	fill(&p.userinfoURL, doc.UserinfoEndpoint)
+	return nil
+}
+
+// verifyPassword asks the token endpoint for a token with the password of
+// username.
+func (p *oauthProvider) verifyPassword(ctx context.Context, username, password string) error {
+	if p.tokenURL == "" {
+		return errors.New("oauth: no token endpoint to check passwords with")
+	}
+	form := url.Values{"grant_type": {"password"}, "username": {username}, "password": {password}}
+	if p.scopes != "" {
+		form.Set("scope", p.scopes)
+	}
+	req, err := p.formRequest(ctx, p.tokenURL, form)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := p.do(req, &res); err != nil {
+		return err
+	}
+	if res.AccessToken == "" {
+		return sasl.ErrAuthFailed
+	}
+	return nil
+}
+
+// verifyToken looks up the claims of token and maps the configured claim
+// to a local username.
+func (p *oauthProvider) verifyToken(ctx context.Context, token string) (string, error) {
+	var claims map[string]any
+	switch {
+	case p.introspectURL != "":
+		req, err := p.formRequest(ctx, p.introspectURL, url.Values{"token": {token}, "token_type_hint": {"access_token"}})
+		if err != nil {
+			return "", err
+		}
+		if err := p.do(req, &claims); err != nil {
+			return "", err
+		}
+		if active, _ := claims["active"].(bool); !active {
+			return "", sasl.ErrAuthFailed
+		}
+		if p.audience == "" {
+			return "", errors.New("oauth: set XMPP_OAUTH_AUDIENCE or XMPP_OAUTH_CLIENT_ID to check whom tokens were issued for")
+		}
+		// A token another client of the provider got must not log in here.
+		if !issuedFor(claims, p.audience) {
+			return "", sasl.ErrAuthFailed
+		}
+	case p.userinfoURL != "" && p.userinfoTokens:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.userinfoURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if err := p.do(req, &claims); err != nil {
+			return "", err
+		}
+	case p.userinfoURL != "":
+		return "", errors.New("oauth: no introspection endpoint to check tokens with; set XMPP_OAUTH_USERINFO_TOKENS to accept any token the userinfo endpoint accepts")
+	default:
+		return "", errors.New("oauth: no introspection or userinfo endpoint to check tokens with")
+	}
+	subject, _ := claims[p.claim].(string)
+	if subject == "" {
+		return "", sasl.ErrAuthFailed
+	}
+	return accountFor(p.domain, subject)
+}
+
+// issuedFor reports whether the introspected claims name audience as the
+// token's audience (aud, a string or a list) or as the client it was
+// issued to (client_id).
+func issuedFor(claims map[string]any, audience string) bool {
+	if id, _ := claims["client_id"].(string); id == audience {
+		return true
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	}
+	return false
+}
+
+// formRequest returns a POST of form to endpoint, authenticated as the
+// client (RFC 6749 §2.3.1).
+func (p *oauthProvider) formRequest(ctx context.Context, endpoint string, form url.Values) (*http.Request, error) {
+	if p.clientSecret == "" && p.clientID != "" {
+		form.Set("client_id", p.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	return req, nil
+}
+
+// do sends req and decodes the JSON response into v. The provider refusing
+// the credentials (invalid_grant, or 401 from the userinfo endpoint) is
+// sasl.ErrAuthFailed.
+func (p *oauthProvider) do(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(body, &res)
+		if res.Error == "invalid_grant" || resp.StatusCode == http.StatusUnauthorized && req.Method == http.MethodGet {
+			return sasl.ErrAuthFailed
+		}
+		return fmt.Errorf("oauth: %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// newTestIdP serves OIDC discovery, a token endpoint accepting alice's
+// password, and token introspection for the tokens in subjects, which were
+// issued for xmppd unless they start with "app-".
+func newTestIdP(t *testing.T, subjects map[string]string) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token_endpoint":         srv.URL + "/token",
+			"introspection_endpoint": srv.URL + "/introspect",
+		})
+	})
+	client := func(w http.ResponseWriter, r *http.Request) bool {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "xmppd" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return false
+		}
+		return true
+	}
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if !client(w, r) {
+			return
+		}
+		if r.FormValue("grant_type") != "password" || r.FormValue("username") != "alice" || r.FormValue("password") != "pencil" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "alice-token", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("POST /introspect", func(w http.ResponseWriter, r *http.Request) {
+		if !client(w, r) {
+			return
+		}
+		token := r.FormValue("token")
+		subject, ok := subjects[token]
+		aud := []string{"xmppd"}
+		if strings.HasPrefix(token, "app-") {
+			aud = []string{"other-app"}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"active": ok, "aud": aud, "preferred_username": subject})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func setupOAuth(t *testing.T, subjects map[string]string) Config {
+	t.Helper()
+	cfg := testConfig("PLAIN", "OAUTHBEARER")
+	cfg.AuthProvider = "oauth2"
+	cfg.OAuthIssuer = newTestIdP(t, subjects)
+	cfg.OAuthClientID, cfg.OAuthClientSecret = "xmppd", "s3cret"
+	cfg.OAuthUsernameClaim = "preferred_username"
+	p, err := newAuthProvider(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newAuthProvider: %v", err)
+	}
+	globalAuth = p
+	t.Cleanup(func() { globalAuth = nil })
+	return cfg
+}
+
+func TestOAuthProviderPassword(t *testing.T) {
+	cfg := setupOAuth(t, nil)
+	for _, tt := range []struct {
+		password, want string
+	}{
+		{"pencil", "success"},
+		{"pen", "failure"},
+	} {
+		p := newSASLPeer(t, cfg, false)
+		p.send(saslAuthElement("PLAIN", []byte("\x00alice\x00"+tt.password)))
+		if r := p.reply(t); r.XMLName.Local != tt.want {
+			t.Fatalf("password %q: got %s %s, want %s", tt.password, r.XMLName.Local, r.Inner, tt.want)
+		}
+		p.finish(t)
+	}
+}
+
+func TestOAuthProviderBearer(t *testing.T) {
+	cfg := setupOAuth(t, map[string]string{
+		"alice-token": "alice@example.com",
+		"carol-token": "carol",
+		"other-token": "alice@other.example",
+		"app-token":   "alice",
+	})
+	p := newSASLPeer(t, cfg, false)
+	resp, _ := sasl.NewOAuthBearer("alice@example.com", "example.com", "alice-token").Start()
+	p.send(saslAuthElement("OAUTHBEARER", resp))
+	if r := p.reply(t); r.XMLName.Local != "success" {
+		t.Fatalf("got %s %s, want success", r.XMLName.Local, r.Inner)
+	}
+	p.finish(t)
+	if *p.user != "alice" || p.session.RemoteAddr().String() != "alice@example.com" {
+		t.Fatalf("user %q at %s", *p.user, p.session.RemoteAddr())
+	}
+
+	// carol has no local account, other-token is for another domain and
+	// app-token was issued for another client.
+	for _, token := range []string{"expired", "carol-token", "other-token", "app-token"} {
+		p := newSASLPeer(t, cfg, false)
+		resp, _ := sasl.NewOAuthBearer("", "", token).Start()
+		p.send(saslAuthElement("OAUTHBEARER", resp))
+		if r := p.reply(t); r.XMLName.Local != "challenge" || !strings.Contains(string(decodeReply(t, r)), "invalid_token") {
+			t.Fatalf("token %s: got %s %s, want error challenge", token, r.XMLName.Local, r.Inner)
+		}
+		p.send(saslResponseElement([]byte{0x01}))
+		if r := p.reply(t); r.XMLName.Local != "failure" || !strings.Contains(r.Inner, "not-authorized") {
+			t.Fatalf("token %s: got %s %s, want not-authorized", token, r.XMLName.Local, r.Inner)
+		}
+		p.finish(t)
+	}
+}
+
+func TestOAuthUserinfoTokens(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer alice-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"preferred_username": "alice"})
+	}))
+	t.Cleanup(srv.Close)
+	cfg := Config{Domain: "example.com", OAuthUserinfoURL: srv.URL, OAuthUsernameClaim: "preferred_username"}
+	ctx := context.Background()
+
+	p, err := newOAuthProvider(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := p.verifyToken(ctx, "alice-token"); err == nil {
+		t.Fatalf("userinfo token accepted as %q without XMPP_OAUTH_USERINFO_TOKENS", user)
+	}
+
+	cfg.OAuthUserinfoTokens = true
+	if p, err = newOAuthProvider(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := p.verifyToken(ctx, "alice-token"); err != nil || user != "alice" {
+		t.Fatalf("verifyToken = %q, %v", user, err)
+	}
+}
+
+func TestOAuthBearerNeedsTokenProvider(t *testing.T) {
+	p := newSASLPeer(t, testConfig("PLAIN", "OAUTHBEARER"), false)
+	if offered := offeredMechanisms(testConfig("PLAIN", "OAUTHBEARER"), p.session); slices.Contains(offered, "OAUTHBEARER") {
+		t.Fatalf("offered %v without an auth provider", offered)
+	}
+}
+
+func TestProvisionAccount(t *testing.T) {
+	ctx := context.Background()
+	us := memory.New().UserStore()
+	if err := provisionAccount(ctx, us, "carol", false); !errors.Is(err, sasl.ErrUnknownUser) {
+		t.Fatalf("provisionAccount without provisioning: %v", err)
+	}
+	for range 2 {
+		if err := provisionAccount(ctx, us, "carol", true); err != nil {
+			t.Fatalf("provisionAccount: %v", err)
+		}
+	}
+	user, err := us.GetUser(ctx, "carol")
+	if err != nil || user.Password != "" || user.StoredKey != "" {
+		t.Fatalf("provisioned %+v, %v", user, err)
+	}
+	// A provisioned account has no password to log in with locally.
+	if ok, _ := us.Authenticate(ctx, "carol", ""); ok {
+		t.Fatal("empty password accepted")
+	}
+}
+
+func TestAccountFor(t *testing.T) {
+	for subject, want := range map[string]string{
+		"alice":               "alice",
+		"alice@Example.com":   "alice",
+		"alice@other.example": "",
+		"":                    "",
+		"@example.com":        "",
+	} {
+		got, err := accountFor("example.com", subject)
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("accountFor(%q) = %q, %v; want %q", subject, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/delay"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalOffline keeps messages for local accounts without an available
+// resource. It is nil when the storage has no OfflineStore.
+var globalOffline *offlineService
+
+// errOfflineFull is returned by keep when the recipient already has as many
+// offline messages as the quota allows.
+var errOfflineFull = errors.New("offline storage full")
+
+type offlineService struct {
+	domain string
+	store  storage.OfflineStore
+	policy hints.OfflinePolicy
+	quota  int
+	ttl    time.Duration
+
+	// mu serializes keep, so the quota holds, and guards delivering.
+	mu sync.Mutex
+	// delivering has a lock for each user whose messages are being
+	// delivered, so two sessions logging in at once do not both get them.
+	delivering map[string]*deliveryLock
+}
+
+type deliveryLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockUser waits until no other session of user is being delivered its
+// messages, and returns the function that lets the next one go.
+func (s *offlineService) lockUser(user string) (unlock func()) {
+	s.mu.Lock()
+	if s.delivering == nil {
+		s.delivering = make(map[string]*deliveryLock)
+	}
+	l := s.delivering[user]
+	if l == nil {
+		l = &deliveryLock{}
+		s.delivering[user] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.delivering, user)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func newOfflineService(cfg Config, store storage.Storage) *offlineService {
+	if store == nil || store.OfflineStore() == nil {
+		return nil
+	}
+	return &offlineService{
+		domain: cfg.Domain,
+		store:  store.OfflineStore(),
+		policy: hints.OfflinePolicy{Headline: cfg.OfflineHeadline, Bodyless: cfg.OfflineBodyless},
+		quota:  cfg.OfflineQuota,
+		ttl:    cfg.OfflineTTL,
+	}
+}
+
+// keep stores msg, which could not be delivered, for its recipient and
+// reports whether it did. Only messages to local accounts that the policy
+// allows are kept, and only while the recipient is under the quota; past it
+// keep returns errOfflineFull.
+func (s *offlineService) keep(ctx context.Context, msg *stanza.Message) (bool, error) {
+	if s == nil || msg.To.Local() == "" || msg.To.Domain() != s.domain || !s.policy.Storable(msg) {
+		return false, nil
+	}
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	user := msg.To.Bare().String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota > 0 {
+		n, err := s.store.CountOfflineMessages(ctx, user)
+		if err != nil {
+			return false, err
+		}
+		if n >= s.quota {
+			return false, errOfflineFull
+		}
+	}
+	// The stanza ID may be missing or reused, so the stored message gets
+	// its own, by which it is deleted once delivered.
+	err = s.store.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+		ID:        stanza.GenerateID(),
+		UserJID:   user,
+		FromJID:   msg.From.String(),
+		Data:      data,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return false, err
+	}
+	globalNotifications.notify(ctx, msg)
+	return true, nil
+}
+
+// deliver sends the messages kept for user to session, each stamped with
+// when the server received it (XEP-0203), and forgets the ones it sent.
+// Messages that no longer parse or were kept for longer than the offline
+// TTL are dropped. If sending fails, the messages not yet sent stay for the
+// next session, as do messages kept meanwhile.
+func (s *offlineService) deliver(ctx context.Context, session *xmpp.Session, user jid.JID) error {
+	if s == nil {
+		return nil
+	}
+	defer s.lockUser(user.String())()
+	msgs, err := s.store.GetOfflineMessages(ctx, user.String())
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	done := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		if err := s.send(ctx, session, user, m); err != nil {
+			if len(done) > 0 {
+				err = errors.Join(err, s.store.DeleteOfflineMessagesByIDs(ctx, user.String(), done))
+			}
+			return err
+		}
+		done = append(done, m.ID)
+	}
+	return s.store.DeleteOfflineMessagesByIDs(ctx, user.String(), done)
+}
+
+// send sends the kept message m to session, unless it expired or no longer
+// parses.
+func (s *offlineService) send(ctx context.Context, session *xmpp.Session, user jid.JID, m *storage.OfflineMessage) error {
+	if expired(m, s.ttl, time.Now()) {
+		return nil
+	}
+	var msg stanza.Message
+	if err := xml.Unmarshal(m.Data, &msg); err != nil {
+		logError(ctx, "offline message dropped", "user", user, "id", m.ID, "error", err)
+		return nil
+	}
+	stamp, err := stanza.NewExtension(delay.NewDelay(s.domain, m.CreatedAt))
+	if err != nil {
+		return err
+	}
+	msg.Extensions = append(msg.Extensions, stamp)
+	return session.Send(ctx, &msg)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/delay"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func setupOffline(t *testing.T, cfg Config) storage.OfflineStore {
+	t.Helper()
+	store := memory.New()
+	old := globalOffline
+	globalOffline = newOfflineService(cfg, store)
+	t.Cleanup(func() { globalOffline = old })
+	return store.OfflineStore()
+}
+
+func TestRouteMessageStoresOffline(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	send := func(to, typ, body string, exts ...any) {
+		t.Helper()
+		b := stanza.BuildMessage().To(jid.MustParse(to)).Type(typ)
+		if body != "" {
+			b.Body(body)
+		}
+		for _, ext := range exts {
+			b.Extension(ext)
+		}
+		msg, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := routeMessage(ctx, alice, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+	}
+
+	send("carol@example.com", stanza.MessageChat, "stored")
+	send("carol@example.com/laptop", stanza.MessageNormal, "also stored")
+	send("carol@example.com", stanza.MessageHeadline, "news")
+	send("carol@example.com", stanza.MessageChat, "")
+	send("carol@example.com", stanza.MessageChat, "secret", hints.NoStore{})
+	send("carol@example.com", stanza.MessageChat, "", hints.Store{})
+	send("dave@elsewhere.example", stanza.MessageChat, "remote")
+	// bob is online, so nothing is stored for him.
+	send("bob@example.com", stanza.MessageChat, "live")
+	receiveMessage(t, bobMsgs)
+
+	msgs, err := offline.GetOfflineMessages(ctx, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("stored %d messages for carol, want 3", len(msgs))
+	}
+	for _, user := range []string{"bob@example.com", "dave@elsewhere.example"} {
+		if n, _ := offline.CountOfflineMessages(ctx, user); n != 0 {
+			t.Fatalf("stored %d messages for %s", n, user)
+		}
+	}
+}
+
+func TestDrainedSessionStoresOffline(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+	bob, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	// Once the server starts shutting down, bob's stream no longer
+	// receives messages; they wait for him in offline storage.
+	drainSession(ctx, bob)
+	msg, err := stanza.BuildMessage().To(jid.MustParse("bob@example.com")).Type(stanza.MessageChat).Body("later").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := routeMessage(ctx, alice, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+	if n, _ := offline.CountOfflineMessages(ctx, "bob@example.com"); n != 1 {
+		t.Fatalf("stored %d messages for bob, want 1", n)
+	}
+	select {
+	case msg := <-bobMsgs:
+		t.Fatalf("draining session received %+v", msg)
+	default:
+	}
+}
+
+func TestOfflinePolicyFromConfig(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com", OfflineHeadline: true, OfflineBodyless: true})
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+
+	for _, typ := range []string{stanza.MessageHeadline, stanza.MessageChat} {
+		msg := stanza.NewMessage(typ)
+		msg.To = jid.MustParse("carol@example.com")
+		if err := routeMessage(ctx, alice, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+	}
+	if n, _ := offline.CountOfflineMessages(ctx, "carol@example.com"); n != 2 {
+		t.Fatalf("stored %d messages, want 2", n)
+	}
+}
+
+func TestOfflineDeliveredOnAvailablePresence(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	setupRoster(t, Config{Domain: "example.com"}, memory.New())
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+	for _, body := range []string{"first", "second"} {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.To = jid.MustParse("carol@example.com")
+		msg.SetBody(body)
+		if err := routeMessage(ctx, alice, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+	}
+
+	carol, carolMsgs := messagePeer(t, "carol@example.com/laptop")
+	t.Cleanup(func() { globalPresence.remove(carol.RemoteAddr()) })
+	away := stanza.NewPresence("")
+	away.Priority = -1
+	if err := routePresence(ctx, carol, away); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+	expectNoMessage(t, carolMsgs)
+
+	if err := routePresence(ctx, carol, stanza.NewPresence("")); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+	for _, want := range []string{"first", "second"} {
+		msg := receiveMessage(t, carolMsgs)
+		if msg.Body() != want {
+			t.Fatalf("body = %q, want %q", msg.Body(), want)
+		}
+		var stamp *delay.Delay
+		for _, ext := range msg.Extensions {
+			if ext.XMLName.Local == "delay" {
+				stamp = new(delay.Delay)
+				if err := xml.Unmarshal(extensionXML(t, ext), stamp); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if stamp == nil || stamp.From != "example.com" {
+			t.Fatalf("message %q has delay %+v", want, stamp)
+		}
+		if _, err := stamp.ParseStamp(); err != nil {
+			t.Fatalf("stamp %q: %v", stamp.Stamp, err)
+		}
+	}
+	if n, _ := offline.CountOfflineMessages(ctx, "carol@example.com"); n != 0 {
+		t.Fatalf("%d messages left after delivery", n)
+	}
+}
+
+func TestOfflineDeliveryLocksPerUser(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	for _, user := range []string{"carol@example.com", "dave@example.com"} {
+		err := offline.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+			ID: "1", UserJID: user, CreatedAt: time.Now(),
+			Data: []byte("<message xmlns='jabber:client' to='" + user + "'><body>hi</body></message>"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	carol, carolMsgs := messagePeer(t, "carol@example.com/laptop")
+	dave, daveMsgs := messagePeer(t, "dave@example.com/desk")
+
+	// While carol's messages are being delivered, dave's still are.
+	unlock := globalOffline.lockUser("carol@example.com")
+	carolDone := make(chan error, 1)
+	go func() { carolDone <- globalOffline.deliver(ctx, carol, carol.RemoteAddr().Bare()) }()
+	if err := globalOffline.deliver(ctx, dave, dave.RemoteAddr().Bare()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	receiveMessage(t, daveMsgs)
+	expectNoMessage(t, carolMsgs)
+
+	unlock()
+	if err := <-carolDone; err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	receiveMessage(t, carolMsgs)
+	if n, _ := offline.CountOfflineMessages(ctx, "carol@example.com"); n != 0 {
+		t.Fatalf("%d messages left after delivery", n)
+	}
+	if len(globalOffline.delivering) != 0 {
+		t.Fatalf("delivery locks left: %v", globalOffline.delivering)
+	}
+}
+
+func TestOfflineQuotaBounces(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com", OfflineQuota: 1})
+	alice, aliceMsgs := messagePeer(t, "alice@example.com/phone")
+	for _, id := range []string{"m1", "m2"} {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.ID = id
+		msg.To = jid.MustParse("carol@example.com")
+		msg.SetBody("hello")
+		if err := routeMessage(ctx, alice, msg); err != nil {
+			t.Fatalf("routeMessage: %v", err)
+		}
+	}
+
+	bounce := receiveMessage(t, aliceMsgs)
+	if bounce.ID != "m2" || bounce.Type != stanza.MessageError || bounce.Error == nil || bounce.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("bounce = %+v", bounce)
+	}
+	expectNoMessage(t, aliceMsgs)
+	if n, _ := offline.CountOfflineMessages(ctx, "carol@example.com"); n != 1 {
+		t.Fatalf("stored %d messages, want 1", n)
+	}
+}
+
+func extensionXML(t *testing.T, ext stanza.Extension) []byte {
+	t.Helper()
+	data, err := xml.Marshal(ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
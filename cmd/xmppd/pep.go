@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalPEP is the personal eventing service (XEP-0163) of local accounts:
+// each account's bare JID is a pubsub service of its own. It is nil when
+// the storage has no PubSubStore.
+var globalPEP *pepService
+
+type pepService struct {
+	pubsub *pubsub.Plugin
+}
+
+func newPEPService(ctx context.Context, cfg Config, store storage.Storage) (*pepService, error) {
+	if store == nil || store.PubSubStore() == nil {
+		return nil, nil
+	}
+	p := pubsub.New()
+	if err := p.Initialize(ctx, plugin.InitParams{
+		LocalJID: func() string { return cfg.Domain },
+		Storage:  store,
+	}); err != nil {
+		return nil, err
+	}
+	p.SetNotifier(deliverPEPEvent)
+	p.SetPEPRecipients(pepRecipients)
+	return &pepService{pubsub: p}, nil
+}
+
+// deliverPEPEvent delivers a PEP notification like deliverEvent, logging
+// failures instead of reporting them: the publish they follow succeeded.
+func deliverPEPEvent(ctx context.Context, msg *stanza.Message) error {
+	if err := deliverEvent(ctx, msg); err != nil {
+		logError(ctx, "pep notification error", "to", msg.To, "error", err)
+	}
+	return nil
+}
+
+// pepRecipients returns the available resources of owner and of the local
+// contacts receiving its presence that advertise node+"+notify" in their
+// entity capabilities (XEP-0163 §4.3).
+func pepRecipients(ctx context.Context, owner jid.JID, node string) ([]jid.JID, error) {
+	subscribers, err := globalRoster.presenceSubscribers(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	feature := node + pubsub.NotifySuffix
+	var out []jid.JID
+	for _, contact := range append([]jid.JID{owner}, subscribers...) {
+		if isRemote(contact) {
+			continue
+		}
+		for _, pres := range globalPresence.of(contact) {
+			if globalCaps.wants(pres.From, feature) {
+				out = append(out, pres.From)
+			}
+		}
+	}
+	return out, nil
+}
+
+// sendLastItems sends the resource full the last item of every PEP node it
+// is interested in, on its own account and on the accounts of the local
+// contacts whose presence it receives (XEP-0163 §4.3.2).
+func (s *pepService) sendLastItems(ctx context.Context, full jid.JID) {
+	if s == nil {
+		return
+	}
+	user := full.Bare()
+	owners, err := globalRoster.presenceSubscriptions(ctx, user)
+	if err != nil {
+		logError(ctx, "pep error", "user", user, "error", err)
+	}
+	for _, owner := range append([]jid.JID{user}, owners...) {
+		if isRemote(owner) || globalBlocking.check(ctx, owner, full) != nil {
+			continue
+		}
+		nodes, err := s.pubsub.ListNodes(ctx, owner.String())
+		if err != nil {
+			logError(ctx, "pep error", "user", owner, "error", err)
+			continue
+		}
+		for _, node := range nodes {
+			if !globalCaps.wants(full, node.NodeID+pubsub.NotifySuffix) || !s.mayRead(ctx, owner, user, node) {
+				continue
+			}
+			if err := s.pubsub.SendLastItem(ctx, owner.String(), node.NodeID, full); err != nil {
+				logError(ctx, "pep error", "user", owner, "error", err)
+			}
+		}
+	}
+}
+
+// mayRead reports whether the access model of node lets requester
+// retrieve its items. The roster access model is treated like presence.
+func (s *pepService) mayRead(ctx context.Context, owner, requester jid.JID, node *storage.PubSubNode) bool {
+	if requester.Bare().Equal(owner) {
+		return true
+	}
+	switch pubsub.AccessModel(node.Host, node.Config) {
+	case pubsub.AccessOpen:
+		return true
+	case pubsub.AccessPresence, pubsub.AccessRoster:
+		allowed, err := globalRoster.sendsPresenceTo(ctx, owner, requester.Bare())
+		if err != nil {
+			logError(ctx, "pep error", "user", owner, "error", err)
+		}
+		return allowed
+	}
+	return false
+}
+
+// answerPEP answers the pubsub requests that from sends to the PEP service of a
+// local account, or returns nil when iq is not one. Requests without a
+// 'to' go to the sender's own account. Only the owner publishes and
+// retracts; items are retrieved as the node's access model allows.
+func answerPEP(ctx context.Context, from jid.JID, iq *stanza.IQ) *stanza.IQ {
+	var req pubsub.PubSub
+	if (iq.Type != stanza.IQGet && iq.Type != stanza.IQSet) || xml.Unmarshal(iq.Query, &req) != nil {
+		return nil
+	}
+	if globalPEP == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "no pubsub storage"))
+	}
+	owner := iq.To.Bare()
+	if iq.To.IsZero() {
+		owner = from.Bare()
+	}
+	switch {
+	case iq.Type == stanza.IQSet && req.Publish != nil:
+		return globalPEP.publish(ctx, from, owner, iq, req)
+	case iq.Type == stanza.IQSet && req.Retract != nil:
+		return globalPEP.retract(ctx, from, owner, iq, req.Retract)
+	case iq.Type == stanza.IQGet && req.Items != nil:
+		return globalPEP.items(ctx, from, owner, iq, req.Items)
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorFeatureNotImplemented, "unsupported pep request"))
+}
+
+// isAccount reports whether j is the bare JID of a local account.
+func isAccount(j jid.JID) bool {
+	return j.Local() != "" && j.Resource() == "" && !isRemote(j)
+}
+
+// pepFeatures are the disco#info features of an account that has a PEP
+// service.
+var pepFeatures = []string{
+	"http://jabber.org/protocol/pubsub#auto-create",
+	"http://jabber.org/protocol/pubsub#last-published",
+	"http://jabber.org/protocol/pubsub#publish",
+	"http://jabber.org/protocol/pubsub#publish-options",
+	"http://jabber.org/protocol/pubsub#retract-items",
+	"http://jabber.org/protocol/pubsub#retrieve-items",
+}
+
+// answerAccountInfo answers a disco#info query to the bare JID of a local
+// account, which advertises its PEP service (XEP-0163 §5), or returns nil
+// when iq is not one.
+func answerAccountInfo(iq *stanza.IQ) *stanza.IQ {
+	var q disco.InfoQuery
+	if iq.Type != stanza.IQGet || iq.To.IsZero() || xml.Unmarshal(iq.Query, &q) != nil || q.Node != "" {
+		return nil
+	}
+	info := disco.InfoQuery{Identities: []disco.Identity{{Category: "account", Type: "registered"}}}
+	if globalPEP != nil {
+		info.Identities = append(info.Identities, disco.Identity{Category: "pubsub", Type: "pep"})
+		for _, f := range pepFeatures {
+			info.Features = append(info.Features, disco.Feature{Var: f})
+		}
+	}
+	if globalNotifications != nil {
+		info.Features = append(info.Features, disco.Feature{Var: ns.Push})
+	}
+	if globalVCards != nil {
+		info.Features = append(info.Features, disco.Feature{Var: ns.VCard}, disco.Feature{Var: ns.VCard4})
+		if globalPEP != nil {
+			info.Features = append(info.Features, disco.Feature{Var: ns.PEPVCardConversion})
+		}
+	}
+	return payloadIQ(iq, info)
+}
+
+// publish stores the single item of a publish request, creating the node
+// on first publish with the publish-options, and notifies the interested
+// resources (XEP-0163 §3).
+func (s *pepService) publish(ctx context.Context, from, owner jid.JID, iq *stanza.IQ, req pubsub.PubSub) *stanza.IQ {
+	if !from.Bare().Equal(owner) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only the owner publishes"))
+	}
+	pub := req.Publish
+	if pub.Node == "" || len(pub.Items) > 1 {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "publish one item to a named node"))
+	}
+	var item pubsub.PubItem
+	if len(pub.Items) == 1 {
+		item = pub.Items[0]
+	}
+	if item.ID == "" {
+		item.ID = stanza.GenerateID()
+	}
+	options, err := publishOptions(req.PublishOptions)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "invalid publish-options"))
+	}
+
+	err = s.pubsub.PublishWithOptions(ctx, &storage.PubSubItem{
+		Host:      owner.String(),
+		NodeID:    pub.Node,
+		ItemID:    item.ID,
+		Publisher: from.String(),
+		Payload:   item.Payload,
+	}, options)
+	switch {
+	case errors.Is(err, pubsub.ErrPreconditionNotMet):
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "precondition not met"))
+	case err != nil:
+		logError(ctx, "pep publish error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	globalVCards.published(ctx, owner, pub.Node, item.Payload)
+	return payloadIQ(iq, pubsub.PubSub{Publish: &pubsub.Publish{Node: pub.Node, Items: []pubsub.PubItem{{ID: item.ID}}}})
+}
+
+func (s *pepService) retract(ctx context.Context, from, owner jid.JID, iq *stanza.IQ, req *pubsub.Retract) *stanza.IQ {
+	if !from.Bare().Equal(owner) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only the owner retracts"))
+	}
+	if req.Node == "" || len(req.Items) != 1 || req.Items[0].ID == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "retract one item from a named node"))
+	}
+	err := s.pubsub.RetractItem(ctx, owner.String(), req.Node, req.Items[0].ID, req.Notify)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	case err != nil:
+		logError(ctx, "pep retract error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return iq.ResultIQ()
+}
+
+// items returns the items of a node, newest last: those asked for by ID,
+// or all of them, or the newest max_items.
+func (s *pepService) items(ctx context.Context, from, owner jid.JID, iq *stanza.IQ, req *pubsub.Items) *stanza.IQ {
+	node, err := s.pubsub.GetNode(ctx, owner.String(), req.Node)
+	if errors.Is(err, storage.ErrNotFound) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	}
+	if err != nil {
+		logError(ctx, "pep items error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	if !s.mayRead(ctx, owner, from, node) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorNotAuthorized, "presence subscription required"))
+	}
+	stored, err := s.pubsub.GetItems(ctx, owner.String(), req.Node)
+	if err != nil {
+		logError(ctx, "pep items error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+
+	var wanted []string
+	for _, item := range req.Items {
+		wanted = append(wanted, item.ID)
+	}
+	var out []pubsub.PubItem
+	for _, item := range stored {
+		if len(wanted) == 0 || slices.Contains(wanted, item.ItemID) {
+			out = append(out, pubsub.PubItem{ID: item.ItemID, Payload: item.Payload})
+		}
+	}
+	if req.MaxItems != nil && *req.MaxItems >= 0 && len(out) > *req.MaxItems {
+		out = out[len(out)-*req.MaxItems:]
+	}
+	return payloadIQ(iq, pubsub.PubSub{Items: &pubsub.Items{Node: req.Node, Items: out}})
+}
+
+// publishOptions returns the fields of a publish-options form, nil when
+// there is none.
+func publishOptions(opts *pubsub.PublishOptions) (map[string]string, error) {
+	if opts == nil || len(opts.Form) == 0 {
+		return nil, nil
+	}
+	var f form.Form
+	if err := xml.Unmarshal(opts.Form, &f); err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, field := range f.Fields {
+		if field.Var != "FORM_TYPE" && len(field.Values) > 0 {
+			out[field.Var] = field.Values[0]
+		}
+	}
+	return out, nil
+}
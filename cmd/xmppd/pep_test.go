@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/plugins/caps"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+const avatarNode = "urn:xmpp:avatar:metadata"
+
+// setupPEP installs roster and PEP services over one memory store for the
+// duration of t. alice and bob see each other's presence; carol is a
+// stranger to both.
+func setupPEP(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	store := memory.New()
+	cfg := Config{Domain: "example.com"}
+	setupRoster(t, cfg, store)
+	pep, err := newPEPService(ctx, cfg, store)
+	if err != nil {
+		t.Fatalf("newPEPService: %v", err)
+	}
+	oldPEP, oldCaps := globalPEP, globalCaps
+	globalPEP, globalCaps = pep, newCapsTable(nil)
+	t.Cleanup(func() {
+		globalCaps.wait()
+		globalPEP, globalCaps = oldPEP, oldCaps
+	})
+
+	rosters := map[string][]storage.RosterItem{
+		"alice@example.com": {{ContactJID: "bob@example.com", Subscription: "both"}},
+		"bob@example.com":   {{ContactJID: "alice@example.com", Subscription: "both"}},
+	}
+	for user, items := range rosters {
+		if err := globalRoster.roster.Import(ctx, user, items, 0); err != nil {
+			t.Fatalf("Import %s: %v", user, err)
+		}
+	}
+}
+
+func clientInfo(features ...string) disco.InfoQuery {
+	info := disco.InfoQuery{Identities: []disco.Identity{{Category: "client", Type: "pc"}}}
+	for _, f := range features {
+		info.Features = append(info.Features, disco.Feature{Var: f})
+	}
+	return info
+}
+
+// online sends available presence advertising the capabilities of info.
+func (p *orderedPeer) online(t *testing.T, info disco.InfoQuery) {
+	t.Helper()
+	pres := stanza.NewPresence("")
+	pres.Extensions = []stanza.Extension{{
+		XMLName: xml.Name{Space: "http://jabber.org/protocol/caps", Local: "c"},
+		Attrs: []xml.Attr{
+			{Name: xml.Name{Local: "hash"}, Value: "sha-1"},
+			{Name: xml.Name{Local: "node"}, Value: "https://example.com/client"},
+			{Name: xml.Name{Local: "ver"}, Value: caps.New("").Ver(info)},
+		},
+	}}
+	if err := routePresence(context.Background(), p.session, pres); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+}
+
+// answerCaps answers the server's disco#info query for the capabilities
+// of p with info.
+func (p *orderedPeer) answerCaps(t *testing.T, info disco.InfoQuery) {
+	t.Helper()
+	iq := p.skipPresence(t).(*stanza.IQ)
+	var q disco.InfoQuery
+	if iq.Type != stanza.IQGet || xml.Unmarshal(iq.Query, &q) != nil || !strings.HasPrefix(q.Node, "https://example.com/client#") {
+		t.Fatalf("caps query %+v: %s", iq.Header, iq.Query)
+	}
+	info.Node = q.Node
+	reply := payloadIQ(iq, info)
+	reply.From, reply.To = p.session.RemoteAddr(), iq.From
+	if !p.session.ResolveRequest(reply) {
+		t.Fatal("caps reply not matched")
+	}
+}
+
+// skipPresence returns the next stanza p receives that is not presence.
+func (p *orderedPeer) skipPresence(t *testing.T) any {
+	t.Helper()
+	for {
+		v := p.next(t)
+		if _, ok := v.(*stanza.Presence); !ok {
+			return v
+		}
+	}
+}
+
+// event returns the PEP notification p receives next.
+func (p *orderedPeer) event(t *testing.T) (*stanza.Message, pubsub.EventItems) {
+	t.Helper()
+	msg, ok := p.skipPresence(t).(*stanza.Message)
+	if !ok {
+		t.Fatal("expected message")
+	}
+	var event pubsub.Event
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Local == "event" {
+			if err := xml.Unmarshal(extensionXML(t, ext), &event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if event.Items == nil {
+		t.Fatalf("no event items in %+v", msg)
+	}
+	return msg, *event.Items
+}
+
+// quietAfterPresence fails when p receives anything but presence.
+func (p *orderedPeer) quietAfterPresence(t *testing.T) {
+	t.Helper()
+	for {
+		select {
+		case v := <-p.in:
+			if _, ok := v.(*stanza.Presence); !ok {
+				t.Fatalf("unexpected %+v", v)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// refused reports whether reply is an error with condition.
+func refused(reply *stanza.IQ, condition string) bool {
+	return reply.Type == stanza.IQError && strings.Contains(string(reply.Query), "<"+condition)
+}
+
+func publishAvatar(t *testing.T, p *orderedPeer, id, options string) *stanza.IQ {
+	t.Helper()
+	p.ask(t, stanza.IQSet, "", `<pubsub xmlns='http://jabber.org/protocol/pubsub'>
+		<publish node='`+avatarNode+`'><item id='`+id+`'><metadata xmlns='urn:xmpp:avatar:metadata'/></item></publish>`+options+`</pubsub>`)
+	return p.skipPresence(t).(*stanza.IQ)
+}
+
+func TestPEPPublishAndNotify(t *testing.T) {
+	setupPEP(t)
+	interested := clientInfo("http://jabber.org/protocol/caps", avatarNode+"+notify")
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	carol := newOrderedPeer(t, "carol@example.com/laptop")
+
+	reply := publishAvatar(t, alice, "v1", "")
+	if reply.Type != stanza.IQResult || !strings.Contains(string(reply.Query), `id="v1"`) {
+		t.Fatalf("publish: %+v %s", reply.Error, reply.Query)
+	}
+	node, err := globalPEP.pubsub.GetNode(context.Background(), "alice@example.com", avatarNode)
+	if err != nil || node.Creator != "alice@example.com" {
+		t.Fatalf("auto-created node %+v: %v", node, err)
+	}
+
+	// bob comes online interested in avatars: the server learns his
+	// features and sends him alice's current avatar.
+	bob.online(t, interested)
+	bob.answerCaps(t, interested)
+	msg, items := bob.event(t)
+	if msg.From.String() != "alice@example.com" || items.Node != avatarNode || len(items.Items) != 1 || items.Items[0].ID != "v1" {
+		t.Fatalf("last item %+v %+v", msg.Header, items)
+	}
+
+	// A second resource with the same capabilities is not queried again.
+	bobPhone := newOrderedPeer(t, "bob@example.com/phone")
+	bobPhone.online(t, interested)
+	if _, items := bobPhone.event(t); items.Items[0].ID != "v1" {
+		t.Fatalf("last item %+v", items)
+	}
+
+	carol.online(t, interested)
+	alice.online(t, clientInfo("http://jabber.org/protocol/caps"))
+	alice.answerCaps(t, clientInfo("http://jabber.org/protocol/caps"))
+
+	bob.quietAfterPresence(t)
+	if reply := publishAvatar(t, alice, "v2", ""); reply.Type != stanza.IQResult {
+		t.Fatalf("publish: %+v", reply.Error)
+	}
+	for _, p := range []*orderedPeer{bob, bobPhone} {
+		if _, items := p.event(t); items.Items[0].ID != "v2" || !strings.Contains(string(items.Items[0].Payload), "metadata") {
+			t.Fatalf("%s notified %+v", p.session.RemoteAddr(), items)
+		}
+	}
+	// alice did not ask for avatar notifications, carol does not see
+	// alice's presence.
+	alice.quietAfterPresence(t)
+	carol.quietAfterPresence(t)
+}
+
+func TestPEPAccess(t *testing.T) {
+	setupPEP(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	carol := newOrderedPeer(t, "carol@example.com/laptop")
+
+	if reply := publishAvatar(t, alice, "v1", ""); reply.Type != stanza.IQResult {
+		t.Fatalf("publish: %+v", reply.Error)
+	}
+	get := `<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='` + avatarNode + `'/></pubsub>`
+	reply := bob.request(t, stanza.IQGet, "alice@example.com", get)
+	if reply.Type != stanza.IQResult || !strings.Contains(string(reply.Query), `id="v1"`) {
+		t.Fatalf("contact items: %+v %s", reply.Error, reply.Query)
+	}
+	if reply := carol.request(t, stanza.IQGet, "alice@example.com", get); !refused(reply, stanza.ErrorNotAuthorized) {
+		t.Fatalf("stranger items: %+v", reply)
+	}
+	if reply := bob.request(t, stanza.IQSet, "alice@example.com", `<pubsub xmlns='http://jabber.org/protocol/pubsub'>
+		<publish node='`+avatarNode+`'><item id='x'/></publish></pubsub>`); !refused(reply, stanza.ErrorForbidden) {
+		t.Fatalf("contact publish: %+v", reply)
+	}
+
+	// An open node is readable by anyone; publishing with a different
+	// access model than the node has is refused.
+	options := `<publish-options><x xmlns='jabber:x:data' type='submit'>
+		<field var='FORM_TYPE' type='hidden'><value>http://jabber.org/protocol/pubsub#publish-options</value></field>
+		<field var='pubsub#access_model'><value>open</value></field></x></publish-options>`
+	if reply := publishAvatar(t, alice, "v2", options); !refused(reply, stanza.ErrorConflict) {
+		t.Fatalf("conflicting publish-options: %+v", reply)
+	}
+	bundle := `<pubsub xmlns='http://jabber.org/protocol/pubsub'>
+		<publish node='urn:xmpp:omemo:2:bundles'><item id='1'><bundle xmlns='urn:xmpp:omemo:2'/></item></publish>` + options + `</pubsub>`
+	if reply := alice.request(t, stanza.IQSet, "", bundle); reply.Type != stanza.IQResult {
+		t.Fatalf("open publish: %+v", reply.Error)
+	}
+	reply = carol.request(t, stanza.IQGet, "alice@example.com", `<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='urn:xmpp:omemo:2:bundles'/></pubsub>`)
+	if reply.Type != stanza.IQResult || !strings.Contains(string(reply.Query), "bundle") {
+		t.Fatalf("open items: %+v %s", reply.Error, reply.Query)
+	}
+
+	retract := `<pubsub xmlns='http://jabber.org/protocol/pubsub'><retract node='` + avatarNode + `'><item id='v1'/></retract></pubsub>`
+	if reply := alice.request(t, stanza.IQSet, "", retract); reply.Type != stanza.IQResult {
+		t.Fatalf("retract: %+v", reply.Error)
+	}
+	if reply := alice.request(t, stanza.IQSet, "", retract); !refused(reply, stanza.ErrorItemNotFound) {
+		t.Fatalf("retract again: %+v", reply)
+	}
+}
+
+func TestAccountInfo(t *testing.T) {
+	setupPEP(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	reply := alice.request(t, stanza.IQGet, "alice@example.com", `<query xmlns='http://jabber.org/protocol/disco#info'/>`)
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(reply.Query, &info); err != nil {
+		t.Fatalf("disco#info %s: %v", reply.Query, err)
+	}
+	var pep, autoCreate bool
+	for _, id := range info.Identities {
+		pep = pep || id.Category == "pubsub" && id.Type == "pep"
+	}
+	for _, f := range info.Features {
+		autoCreate = autoCreate || f.Var == "http://jabber.org/protocol/pubsub#auto-create"
+	}
+	if !pep || !autoCreate {
+		t.Fatalf("account info %+v", info)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/meszmate/xmpp-go/plugins/dialback"
 	"github.com/meszmate/xmpp-go/plugins/disco"
 	"github.com/meszmate/xmpp-go/plugins/extdisco"
+	"github.com/meszmate/xmpp-go/plugins/fallback"
 	"github.com/meszmate/xmpp-go/plugins/filetransfer"
 	"github.com/meszmate/xmpp-go/plugins/form"
 	"github.com/meszmate/xmpp-go/plugins/forward"
@@ -36,15 +37,19 @@ import (
 	"github.com/meszmate/xmpp-go/plugins/oob"
 	"github.com/meszmate/xmpp-go/plugins/ping"
 	"github.com/meszmate/xmpp-go/plugins/presence"
-	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/plugins/privilege"
 	"github.com/meszmate/xmpp-go/plugins/push"
 	"github.com/meszmate/xmpp-go/plugins/reactions"
 	"github.com/meszmate/xmpp-go/plugins/receipts"
 	"github.com/meszmate/xmpp-go/plugins/register"
+	"github.com/meszmate/xmpp-go/plugins/reply"
 	"github.com/meszmate/xmpp-go/plugins/retraction"
 	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/plugins/rosterx"
 	"github.com/meszmate/xmpp-go/plugins/rsm"
 	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/plugins/serverinfo"
 	"github.com/meszmate/xmpp-go/plugins/sm"
 	"github.com/meszmate/xmpp-go/plugins/socks5"
 	"github.com/meszmate/xmpp-go/plugins/stanzaid"
@@ -72,6 +77,7 @@ func pluginRegistry(cfg Config) map[string]func() plugin.Plugin {
 		"dialback":     func() plugin.Plugin { return dialback.New() },
 		"disco":        func() plugin.Plugin { return disco.New() },
 		"extdisco":     func() plugin.Plugin { return extdisco.New() },
+		"fallback":     func() plugin.Plugin { return fallback.New() },
 		"filetransfer": func() plugin.Plugin { return filetransfer.New() },
 		"form":         func() plugin.Plugin { return form.New() },
 		"forward":      func() plugin.Plugin { return forward.New() },
@@ -88,26 +94,47 @@ func pluginRegistry(cfg Config) map[string]func() plugin.Plugin {
 		"omemo":        func() plugin.Plugin { return omemo.New(cfg.OMEMODeviceID) },
 		"ping":         func() plugin.Plugin { return ping.New() },
 		"presence":     func() plugin.Plugin { return presence.New() },
-		"pubsub":       func() plugin.Plugin { return pubsub.New() },
+		"privilege":    func() plugin.Plugin { return privilege.New() },
+		"pubsub":       func() plugin.Plugin { return newPubSubPlugin() },
 		"push":         func() plugin.Plugin { return push.New() },
 		"reactions":    func() plugin.Plugin { return reactions.New() },
 		"receipts":     func() plugin.Plugin { return receipts.New() },
 		"register":     func() plugin.Plugin { return register.New() },
+		"reply":        func() plugin.Plugin { return reply.New() },
 		"retraction":   func() plugin.Plugin { return retraction.New() },
 		"roster":       func() plugin.Plugin { return roster.New() },
+		"rosterx":      func() plugin.Plugin { return rosterx.New() },
 		"rsm":          func() plugin.Plugin { return rsm.New() },
 		"sasl2":        func() plugin.Plugin { return sasl2.New() },
-		"sm":           func() plugin.Plugin { return sm.New() },
+		"search":       func() plugin.Plugin { return search.New() },
+		"serverinfo":   func() plugin.Plugin { return serverinfo.New() },
+		"sm":           func() plugin.Plugin { return newSMPlugin(cfg) },
 		"socks5":       func() plugin.Plugin { return socks5.New() },
 		"stanzaid":     func() plugin.Plugin { return stanzaid.New() },
 		"styling":      func() plugin.Plugin { return styling.New() },
 		"time":         func() plugin.Plugin { return time.New() },
-		"upload":       func() plugin.Plugin { return upload.New() },
+		"upload":       func() plugin.Plugin { return newUploadPlugin() },
 		"vcard":        func() plugin.Plugin { return vcard.New() },
 		"version":      func() plugin.Plugin { return version.New(cfg.VersionName, cfg.VersionString) },
 	}
 }
 
+// newSMPlugin bounds the stanzas kept for resumption so a peer that stops
+// acking cannot grow the queue without limit.
+func newSMPlugin(cfg Config) *sm.Plugin {
+	p := sm.New()
+	p.SetLimits(cfg.SMMaxUnacked, cfg.SMMaxUnackedBytes)
+	return p
+}
+
+// newUploadPlugin keeps uploaded files in the blob store, when one is
+// configured.
+func newUploadPlugin() *upload.Plugin {
+	p := upload.New()
+	p.SetBlobStore(globalBlobs)
+	return p
+}
+
 func buildPlugins(cfg Config) ([]plugin.Plugin, error) {
 	reg := pluginRegistry(cfg)
 	if len(cfg.Plugins) == 0 {
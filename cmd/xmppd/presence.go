@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalPresence holds the last available presence of every resource.
+var globalPresence = newPresenceTable()
+
+type presenceTable struct {
+	mu     sync.RWMutex
+	byBare map[string]map[string]*stanza.Presence
+}
+
+func newPresenceTable() *presenceTable {
+	return &presenceTable{byBare: make(map[string]map[string]*stanza.Presence)}
+}
+
+// set records pres as the current presence of its sender and reports whether
+// this is the resource's initial presence.
+func (t *presenceTable) set(pres *stanza.Presence) bool {
+	bare, full := pres.From.Bare().String(), pres.From.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byBare[bare] == nil {
+		t.byBare[bare] = make(map[string]*stanza.Presence)
+	}
+	_, known := t.byBare[bare][full]
+	t.byBare[bare][full] = pres
+	return !known
+}
+
+// remove forgets the presence of full and reports whether it was available.
+func (t *presenceTable) remove(full jid.JID) bool {
+	bare := full.Bare().String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resources := t.byBare[bare]
+	if _, ok := resources[full.String()]; !ok {
+		return false
+	}
+	delete(resources, full.String())
+	if len(resources) == 0 {
+		delete(t.byBare, bare)
+	}
+	return true
+}
+
+// of returns the current presences of the available resources of bare.
+func (t *presenceTable) of(bare jid.JID) []*stanza.Presence {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	resources := t.byBare[bare.String()]
+	out := make([]*stanza.Presence, 0, len(resources))
+	for _, pres := range resources {
+		out = append(out, pres)
+	}
+	return out
+}
+
+// available returns the sessions of the available resources of bare.
+func (t *presenceTable) available(bare jid.JID) []*xmpp.Session {
+	var out []*xmpp.Session
+	for _, pres := range t.of(bare) {
+		out = append(out, globalRouter.targets(pres.From)...)
+	}
+	return out
+}
+
+// broadcastPresence handles presence without a 'to' address (RFC 6121 §4.2,
+// §4.5). It goes to the user's other available resources and to contacts
+// subscribed to the user ("from" or "both"). On initial presence the user's
+// subscriptions ("to" or "both") are probed and the new resource receives
+// the current presence of those contacts and of its sibling resources. An
+// available resource with a non-negative priority also receives the messages
+// kept while the user was offline (XEP-0160). A new resource receives the
+// message of the day, if there is one. The entity capabilities of an
+// available resource decide which PEP notifications it receives.
+func broadcastPresence(ctx context.Context, source *xmpp.Session, pres *stanza.Presence) {
+	if pres.Type != "" && pres.Type != stanza.PresenceUnavailable {
+		return
+	}
+	user := pres.From.Bare()
+
+	initial := false
+	if pres.Type == stanza.PresenceUnavailable {
+		globalMUC.leaveAll(ctx, pres.From)
+		globalMIX.leaveAll(ctx, pres.From)
+		globalCaps.remove(pres.From)
+		if !globalPresence.remove(pres.From) {
+			return
+		}
+	} else {
+		globalVCards.stampPresence(ctx, pres)
+		initial = globalPresence.set(pres)
+	}
+
+	for _, dst := range globalPresence.available(user) {
+		if dst != source {
+			sendTo(ctx, dst, pres)
+		}
+	}
+	globalCluster.forward(ctx, user, pres)
+	subscribers, err := globalRoster.presenceSubscribers(ctx, user)
+	if err != nil {
+		logError(ctx, "presence broadcast error", "user", user, "error", err)
+	}
+	for _, contact := range subscribers {
+		if globalBlocking.check(ctx, user, contact) != nil {
+			continue
+		}
+		if isRemote(contact) {
+			presenceTo(ctx, pres, contact)
+			continue
+		}
+		for _, dst := range globalPresence.available(contact) {
+			sendTo(ctx, dst, pres)
+		}
+		globalCluster.forward(ctx, contact, pres)
+	}
+
+	if initial {
+		sendInitialPresences(ctx, source, pres.From)
+		globalAnnouncements.sendMOTD(ctx, source, pres.From)
+	}
+	if pres.Type == "" {
+		globalCaps.update(ctx, source, pres)
+	}
+	if pres.Type == "" && pres.Priority >= 0 {
+		if err := globalOffline.deliver(ctx, source, user); err != nil {
+			logError(ctx, "offline delivery error", "user", user, "error", err)
+		}
+	}
+}
+
+// sendInitialPresences gives the new resource full the current presence of
+// its sibling resources and of the contacts its user is subscribed to.
+func sendInitialPresences(ctx context.Context, source *xmpp.Session, full jid.JID) {
+	user := full.Bare()
+	for _, sibling := range globalPresence.of(user) {
+		if !sibling.From.Equal(full) {
+			sendTo(ctx, source, sibling)
+		}
+	}
+	probeCluster(ctx, full, user)
+	probed, err := globalRoster.presenceSubscriptions(ctx, user)
+	if err != nil {
+		logError(ctx, "presence probe error", "user", user, "error", err)
+	}
+	for _, contact := range probed {
+		if globalBlocking.check(ctx, user, contact) != nil {
+			continue
+		}
+		if isRemote(contact) {
+			presenceTo(ctx, subscription(user, contact, stanza.PresenceProbe), contact)
+			continue
+		}
+		answerProbe(ctx, source, user, contact)
+		probeCluster(ctx, full, contact)
+	}
+}
+
+// answerProbe delivers the presence of a local contact to the probing
+// resource, provided the contact's roster lets user see it (RFC 6121 §4.3.2).
+func answerProbe(ctx context.Context, dst *xmpp.Session, user, contact jid.JID) {
+	if contact.Domain() != globalRoster.domain {
+		return
+	}
+	allowed, err := globalRoster.sendsPresenceTo(ctx, contact, user)
+	if err != nil {
+		logError(ctx, "presence probe error", "user", contact, "error", err)
+		return
+	}
+	if !allowed {
+		return
+	}
+	for _, pres := range globalPresence.of(contact) {
+		sendTo(ctx, dst, pres)
+	}
+}
+
+// answerRemoteProbe answers a probe from a remote server with the presence
+// of the local user it asks for, or unavailable presence when the user is
+// offline, provided the user's roster lets the prober see it.
+func answerRemoteProbe(ctx context.Context, probe *stanza.Presence) {
+	user, contact := probe.To.Bare(), probe.From.Bare()
+	allowed, err := globalRoster.sendsPresenceTo(ctx, user, contact)
+	if err != nil {
+		logError(ctx, "presence probe error", "user", user, "error", err)
+		return
+	}
+	if !allowed {
+		return
+	}
+	presences := globalPresence.of(user)
+	if len(presences) == 0 {
+		presenceTo(ctx, subscription(user, contact, stanza.PresenceUnavailable), contact)
+	}
+	for _, pres := range presences {
+		presenceTo(ctx, pres, contact)
+	}
+}
+
+// routeSubscription handles a subscription stanza a local user sends: the
+// user's roster changes first and the stanza then goes to the contact
+// (RFC 6121 §3). Approving a subscription also sends the contact the user's
+// current presence, and cancelling one sends it unavailable presence.
+// Subscriptions between members of a shared group cannot be cancelled.
+func routeSubscription(ctx context.Context, source *xmpp.Session, pres *stanza.Presence) error {
+	user := source.RemoteAddr().Bare()
+	pres.From, pres.To = user, pres.To.Bare()
+	// Members of a shared group stay subscribed to each other.
+	if (pres.Type == stanza.PresenceUnsubscribe || pres.Type == stanza.PresenceUnsubscribed) && globalSharedGroups.shared(ctx, user, pres.To) {
+		return nil
+	}
+	route, err := globalRoster.outbound(ctx, pres)
+	if errors.Is(err, storage.ErrRosterLimit) {
+		return source.Send(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "roster is full")))
+	}
+	if err != nil {
+		logError(ctx, "subscription error", "user", user, "error", err)
+		return nil
+	}
+	if !route {
+		return nil
+	}
+	if !isRemote(pres.To) {
+		if err := deliverSubscription(ctx, pres); errors.Is(err, storage.ErrRosterLimit) {
+			return source.Send(ctx, presenceError(pres, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "roster is full")))
+		}
+	} else if err := sendRemote(ctx, source, pres); err != nil {
+		return err
+	}
+	switch pres.Type {
+	case stanza.PresenceSubscribed:
+		for _, own := range globalPresence.of(user) {
+			presenceTo(ctx, own, pres.To)
+		}
+	case stanza.PresenceUnsubscribed:
+		hidePresence(ctx, user, pres.To)
+	}
+	return nil
+}
+
+// hidePresence sends contact unavailable presence from every available
+// resource of user, whose presence it may no longer see.
+func hidePresence(ctx context.Context, user, contact jid.JID) {
+	for _, own := range globalPresence.of(user) {
+		presenceTo(ctx, subscription(own.From, contact, stanza.PresenceUnavailable), contact)
+	}
+}
+
+// deliverSubscription applies a subscription stanza to the roster of its
+// local recipient and passes it on to the recipient's resources unless the
+// server answered it. A full roster is returned as storage.ErrRosterLimit
+// for the caller to bounce.
+func deliverSubscription(ctx context.Context, pres *stanza.Presence) error {
+	deliverIt, err := globalRoster.inbound(ctx, pres)
+	if errors.Is(err, storage.ErrRosterLimit) {
+		return err
+	}
+	if err != nil {
+		logError(ctx, "subscription error", "user", pres.To, "error", err)
+		return nil
+	}
+	if deliverIt {
+		deliver(ctx, pres.To.Bare(), pres)
+	}
+	return nil
+}
+
+// sendSubscription sends a subscription stanza the server generates on a
+// user's behalf to the contact's server, or applies it to a local contact's
+// roster.
+func sendSubscription(ctx context.Context, pres *stanza.Presence) {
+	if isRemote(pres.To) {
+		if err := sendRemote(ctx, nil, pres); err != nil {
+			logError(ctx, "s2s presence route error", "to", pres.To, "error", err)
+		}
+		return
+	}
+	if err := deliverSubscription(ctx, pres); err != nil {
+		logError(ctx, "subscription error", "user", pres.To, "error", err)
+	}
+}
+
+// approve tells contact that user approved its subscription and sends it
+// the user's current presence (RFC 6121 §3.1.5).
+func approve(ctx context.Context, user, contact jid.JID) {
+	sendSubscription(ctx, subscription(user, contact, stanza.PresenceSubscribed))
+	for _, pres := range globalPresence.of(user) {
+		presenceTo(ctx, pres, contact)
+	}
+}
+
+// presenceTo sends a copy of pres addressed to the bare JID to, on this
+// server or another.
+func presenceTo(ctx context.Context, pres *stanza.Presence, to jid.JID) {
+	out := *pres
+	out.To = to
+	if isRemote(to) {
+		if err := sendRemote(ctx, nil, &out); err != nil {
+			logError(ctx, "s2s presence route error", "to", to, "error", err)
+		}
+		return
+	}
+	deliver(ctx, to, &out)
+}
+
+// sessionUnavailable broadcasts unavailable presence for a resource whose
+// stream ended without sending one (RFC 6121 §4.6.1).
+func sessionUnavailable(ctx context.Context, session *xmpp.Session) {
+	from := session.RemoteAddr()
+	if from.IsZero() {
+		return
+	}
+	pres := stanza.NewPresence(stanza.PresenceUnavailable)
+	pres.From = from
+	broadcastPresence(ctx, session, pres)
+}
+
+func sendTo(ctx context.Context, dst *xmpp.Session, pres *stanza.Presence) {
+	if err := sendStanza(ctx, dst, pres); err != nil {
+		logError(ctx, "presence route error", "to", dst.RemoteAddr(), "error", err)
+	}
+}
+
+func (rs *rosterService) presenceSubscribers(ctx context.Context, user jid.JID) ([]jid.JID, error) {
+	if rs == nil {
+		return nil, nil
+	}
+	contacts, err := rs.roster.PresenceSubscribers(ctx, user.String())
+	return parseContacts(contacts), err
+}
+
+func (rs *rosterService) presenceSubscriptions(ctx context.Context, user jid.JID) ([]jid.JID, error) {
+	if rs == nil {
+		return nil, nil
+	}
+	contacts, err := rs.roster.PresenceSubscriptions(ctx, user.String())
+	return parseContacts(contacts), err
+}
+
+// sendsPresenceTo reports whether the roster of user lets contact receive
+// the user's presence.
+func (rs *rosterService) sendsPresenceTo(ctx context.Context, user, contact jid.JID) (bool, error) {
+	if rs == nil {
+		return false, nil
+	}
+	subscribers, err := rs.roster.PresenceSubscribers(ctx, user.String())
+	if err != nil {
+		return false, err
+	}
+	for _, s := range subscribers {
+		if s == contact.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseContacts(contacts []string) []jid.JID {
+	out := make([]jid.JID, 0, len(contacts))
+	for _, c := range contacts {
+		if j, err := jid.Parse(c); err == nil {
+			out = append(out, j.Bare())
+		}
+	}
+	return out
+}
+
+// presenceError builds the error reply to pres (RFC 6120 §8.3).
+func presenceError(pres *stanza.Presence, err *stanza.StanzaError) *stanza.Presence {
+	reply := stanza.NewPresence(stanza.PresenceError)
+	reply.ID = pres.ID
+	reply.From = pres.To
+	reply.To = pres.From
+	reply.Error = err
+	return reply
+}
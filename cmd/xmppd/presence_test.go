@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// testPeer is a connected resource that records the presence it receives.
+type testPeer struct {
+	session   *xmpp.Session
+	mu        sync.Mutex
+	presences []stanza.Presence
+}
+
+// received returns the sorted bare senders of the presence p received.
+func (p *testPeer) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, pres := range p.presences {
+		out = append(out, pres.From.Bare().String())
+	}
+	slices.Sort(out)
+	return out
+}
+
+func connectPeer(t *testing.T, full string) *testPeer {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	addr := jid.MustParse(full)
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(addr))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	p := &testPeer{session: session}
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			// Roster pushes and other stanzas are not recorded.
+			if start.Name.Local != "presence" {
+				if dec.Skip() != nil {
+					return
+				}
+				continue
+			}
+			var pres stanza.Presence
+			if err := dec.DecodeElement(&pres, &start); err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.presences = append(p.presences, pres)
+			p.mu.Unlock()
+		}
+	}()
+	globalRouter.register(addr, session)
+	t.Cleanup(func() {
+		globalRouter.unregister(addr)
+		globalPresence.remove(addr)
+		session.Close()
+		c2.Close()
+	})
+	return p
+}
+
+func setupPresenceTest(t *testing.T) {
+	t.Helper()
+	setupRoster(t, Config{Domain: "example.com"}, memory.New())
+	ctx := context.Background()
+
+	// alice's view of each contact and the contact's view of alice.
+	rosters := map[string][]storage.RosterItem{
+		"alice@example.com": {
+			{ContactJID: "none@example.com", Subscription: "none"},
+			{ContactJID: "to@example.com", Subscription: "to"},
+			{ContactJID: "from@example.com", Subscription: "from"},
+			{ContactJID: "both@example.com", Subscription: "both"},
+		},
+		"none@example.com": {{ContactJID: "alice@example.com", Subscription: "none"}},
+		"to@example.com":   {{ContactJID: "alice@example.com", Subscription: "from"}},
+		"from@example.com": {{ContactJID: "alice@example.com", Subscription: "to"}},
+		"both@example.com": {{ContactJID: "alice@example.com", Subscription: "both"}},
+	}
+	for user, items := range rosters {
+		if err := globalRoster.roster.Import(ctx, user, items, 0); err != nil {
+			t.Fatalf("Import %s: %v", user, err)
+		}
+	}
+}
+
+// setupRoster installs a roster service over store for the duration of t.
+func setupRoster(t *testing.T, cfg Config, store storage.Storage) {
+	t.Helper()
+	rs, err := newRosterService(context.Background(), cfg, store)
+	if err != nil {
+		t.Fatalf("newRosterService: %v", err)
+	}
+	oldRoster, oldPresence := globalRoster, globalPresence
+	globalRoster, globalPresence = rs, newPresenceTable()
+	t.Cleanup(func() { globalRoster, globalPresence = oldRoster, oldPresence })
+}
+
+func sendInitialPresence(t *testing.T, p *testPeer) {
+	t.Helper()
+	if err := routePresence(context.Background(), p.session, stanza.NewPresence("")); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+}
+
+func waitReceived(t *testing.T, p *testPeer, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.received()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give unexpected deliveries a moment to show up.
+	time.Sleep(20 * time.Millisecond)
+	if got := p.received(); !slices.Equal(got, want) {
+		t.Errorf("%s received presence from %v, want %v", p.session.RemoteAddr(), got, want)
+	}
+}
+
+func TestPresenceBroadcastFollowsSubscriptions(t *testing.T) {
+	setupPresenceTest(t)
+
+	contacts := map[string]*testPeer{}
+	for _, name := range []string{"none", "to", "from", "both"} {
+		p := connectPeer(t, name+"@example.com/res")
+		sendInitialPresence(t, p)
+		contacts[name] = p
+	}
+	// Contacts' own broadcasts never reach alice, who is offline.
+	alice := connectPeer(t, "alice@example.com/laptop")
+	sendInitialPresence(t, alice)
+
+	// Broadcast reaches contacts subscribed to alice: from and both.
+	waitReceived(t, contacts["none"], nil)
+	waitReceived(t, contacts["to"], nil)
+	waitReceived(t, contacts["from"], []string{"alice@example.com"})
+	waitReceived(t, contacts["both"], []string{"alice@example.com"})
+
+	// Probes reach contacts alice is subscribed to: to and both.
+	waitReceived(t, alice, []string{"both@example.com", "to@example.com"})
+}
+
+func TestPresenceUnavailableOnlyToSubscribers(t *testing.T) {
+	setupPresenceTest(t)
+
+	from := connectPeer(t, "from@example.com/res")
+	sendInitialPresence(t, from)
+	to := connectPeer(t, "to@example.com/res")
+	sendInitialPresence(t, to)
+
+	alice := connectPeer(t, "alice@example.com/laptop")
+	sendInitialPresence(t, alice)
+	sessionUnavailable(context.Background(), alice.session)
+
+	waitReceived(t, from, []string{"alice@example.com", "alice@example.com"})
+	waitReceived(t, to, nil)
+}
+
+func TestPresenceReachesOwnResources(t *testing.T) {
+	setupPresenceTest(t)
+
+	laptop := connectPeer(t, "alice@example.com/laptop")
+	sendInitialPresence(t, laptop)
+	phone := connectPeer(t, "alice@example.com/phone")
+	sendInitialPresence(t, phone)
+
+	waitReceived(t, laptop, []string{"alice@example.com"})
+	waitReceived(t, phone, []string{"alice@example.com"})
+}
+
+func TestSubscribeToFullRosterIsRefused(t *testing.T) {
+	store := storage.LimitRosterItems(memory.New(), 1)
+	setupRoster(t, Config{Domain: "example.com", SubscriptionPolicy: "auto-accept"}, store)
+	ctx := context.Background()
+	if err := store.RosterStore().UpsertRosterItem(ctx, &storage.RosterItem{
+		UserJID: "alice@example.com", ContactJID: "carol@example.com", Subscription: "both",
+	}); err != nil {
+		t.Fatalf("UpsertRosterItem: %v", err)
+	}
+
+	bob := connectPeer(t, "bob@example.com/res")
+	sub := stanza.NewPresence(stanza.PresenceSubscribe)
+	sub.To = jid.MustParse("alice@example.com")
+	if err := routePresence(ctx, bob.session, sub); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+	waitReceived(t, bob, []string{"alice@example.com"})
+
+	bob.mu.Lock()
+	defer bob.mu.Unlock()
+	got := bob.presences[0]
+	if got.Type != stanza.PresenceError || got.Error == nil || got.Error.Type != stanza.ErrorTypeWait {
+		t.Fatalf("reply = %+v, want a wait error", got)
+	}
+}
+
+// rosterState returns the subscription and pending request of contact in
+// user's roster.
+func rosterState(t *testing.T, store storage.RosterStore, user, contact string) string {
+	t.Helper()
+	item, err := store.GetRosterItem(context.Background(), user, contact)
+	if err != nil {
+		t.Fatalf("GetRosterItem %s/%s: %v", user, contact, err)
+	}
+	return item.Subscription + "/" + item.Ask
+}
+
+func sendSubscriptionPresence(t *testing.T, p *testPeer, to, typ string) {
+	t.Helper()
+	pres := stanza.NewPresence(typ)
+	pres.To = jid.MustParse(to)
+	if err := routePresence(context.Background(), p.session, pres); err != nil {
+		t.Fatalf("routePresence: %v", err)
+	}
+}
+
+// presenceTypes returns the types of the presence p received, in order.
+func (p *testPeer) presenceTypes() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, pres := range p.presences {
+		out = append(out, pres.Type)
+	}
+	return out
+}
+
+func TestSubscriptionHandshake(t *testing.T) {
+	store := memory.New()
+	setupRoster(t, Config{Domain: "example.com"}, store)
+	roster := store.RosterStore()
+	alice := connectPeer(t, "alice@example.com/laptop")
+	bob := connectPeer(t, "bob@example.com/phone")
+	sendInitialPresence(t, alice)
+	sendInitialPresence(t, bob)
+
+	sendSubscriptionPresence(t, alice, "bob@example.com/phone", stanza.PresenceSubscribe)
+	waitReceived(t, bob, []string{"alice@example.com"})
+	if got := rosterState(t, roster, "alice@example.com", "bob@example.com"); got != "none/subscribe" {
+		t.Fatalf("alice's item after subscribe = %s", got)
+	}
+	bob.mu.Lock()
+	req := bob.presences[0]
+	bob.mu.Unlock()
+	if req.Type != stanza.PresenceSubscribe || req.From.String() != "alice@example.com" || req.To.String() != "bob@example.com" {
+		t.Fatalf("request = %+v", req)
+	}
+
+	// Approving delivers the approval and bob's presence to alice.
+	sendSubscriptionPresence(t, bob, "alice@example.com", stanza.PresenceSubscribed)
+	waitReceived(t, alice, []string{"bob@example.com", "bob@example.com"})
+	if got := alice.presenceTypes(); !slices.Equal(got, []string{stanza.PresenceSubscribed, ""}) {
+		t.Fatalf("alice received %q", got)
+	}
+	if got := rosterState(t, roster, "alice@example.com", "bob@example.com"); got != "to/" {
+		t.Fatalf("alice's item after approval = %s", got)
+	}
+	if got := rosterState(t, roster, "bob@example.com", "alice@example.com"); got != "from/" {
+		t.Fatalf("bob's item after approval = %s", got)
+	}
+
+	// A repeated approval changes nothing and is not routed.
+	sendSubscriptionPresence(t, bob, "alice@example.com", stanza.PresenceSubscribed)
+	waitReceived(t, alice, []string{"bob@example.com", "bob@example.com"})
+
+	// Cancelling sends bob's unavailable presence after the cancellation.
+	sendSubscriptionPresence(t, bob, "alice@example.com", stanza.PresenceUnsubscribed)
+	waitReceived(t, alice, []string{"bob@example.com", "bob@example.com", "bob@example.com", "bob@example.com"})
+	if got := alice.presenceTypes()[2:]; !slices.Equal(got, []string{stanza.PresenceUnsubscribed, stanza.PresenceUnavailable}) {
+		t.Fatalf("alice received %q", got)
+	}
+	if got := rosterState(t, roster, "alice@example.com", "bob@example.com"); got != "none/" {
+		t.Fatalf("alice's item after cancellation = %s", got)
+	}
+	if got := rosterState(t, roster, "bob@example.com", "alice@example.com"); got != "none/" {
+		t.Fatalf("bob's item after cancellation = %s", got)
+	}
+}
+
+func TestSubscribeFromSubscribedContactIsAnswered(t *testing.T) {
+	store := memory.New()
+	setupRoster(t, Config{Domain: "example.com"}, store)
+	ctx := context.Background()
+	if err := store.RosterStore().UpsertRosterItem(ctx, &storage.RosterItem{
+		UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "from",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectPeer(t, "alice@example.com/laptop")
+	bob := connectPeer(t, "bob@example.com/phone")
+
+	sendSubscriptionPresence(t, bob, "alice@example.com", stanza.PresenceSubscribe)
+	waitReceived(t, alice, nil)
+	waitReceived(t, bob, []string{"alice@example.com"})
+	if got := bob.presenceTypes(); !slices.Equal(got, []string{stanza.PresenceSubscribed}) {
+		t.Fatalf("bob received %q", got)
+	}
+	if got := rosterState(t, store.RosterStore(), "bob@example.com", "alice@example.com"); got != "to/" {
+		t.Fatalf("bob's item = %s", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/socks5"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// globalProxy is the SOCKS5 bytestream proxy, nil unless XMPP_PROXY_DOMAIN
+// is set.
+var globalProxy *bytestreamProxy
+
+// bytestreamProxy relays the SOCKS5 bytestreams (XEP-0065) of local users
+// that cannot connect to each other directly.
+type bytestreamProxy struct {
+	domain jid.JID
+	local  string // the domain of the users it serves
+	proxy  *socks5.Proxy
+	ln     net.Listener
+}
+
+// newBytestreamProxy listens at cfg.ProxyAddr for the connections the
+// proxy relays; it is served with serve.
+func newBytestreamProxy(cfg Config) (*bytestreamProxy, error) {
+	if cfg.ProxyDomain == "" {
+		return nil, nil
+	}
+	domain, err := jid.Parse(cfg.ProxyDomain)
+	if err != nil || !domain.IsDomainOnly() {
+		return nil, fmt.Errorf("proxy domain %q is not a domain", cfg.ProxyDomain)
+	}
+	ln, err := net.Listen("tcp", cfg.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Clients are told the port actually bound, which matters for ":0".
+	port := ln.Addr().(*net.TCPAddr).Port
+	p := socks5.NewProxy(socks5.Streamhost{JID: domain.String(), Host: cfg.ProxyHost, Port: port})
+	p.SetRates(int64(cfg.ProxyRate), int64(cfg.ProxyTotalRate))
+	if cfg.ProxyPendingTimeout > 0 {
+		p.SetPendingTimeout(cfg.ProxyPendingTimeout)
+	}
+	return &bytestreamProxy{domain: domain, local: cfg.Domain, proxy: p, ln: ln}, nil
+}
+
+// serve relays bytestreams until ctx is done.
+func (p *bytestreamProxy) serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = p.ln.Close()
+	}()
+	return p.proxy.Serve(p.ln)
+}
+
+// serves reports whether j addresses the proxy.
+func (p *bytestreamProxy) serves(j jid.JID) bool {
+	return p != nil && j.Equal(p.domain)
+}
+
+// handleIQ answers the disco#info of the proxy, the requests for its
+// network address and activations. Only local users may use it, so that
+// it does not relay for anyone on the network.
+func (p *bytestreamProxy) handleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil
+	}
+	var q disco.InfoQuery
+	if iq.Type == stanza.IQGet && xml.Unmarshal(iq.Query, &q) == nil && q.Node == "" {
+		return payloadIQ(iq, disco.InfoQuery{
+			Identities: []disco.Identity{{Category: "proxy", Type: "bytestreams", Name: "SOCKS5 Bytestreams"}},
+			Features:   []disco.Feature{{Var: ns.DiscoInfo}, {Var: ns.SOCKS5}},
+		})
+	}
+	if iq.From.Domain() != p.local {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+	}
+	if reply := p.proxy.HandleIQ(ctx, iq); reply != nil {
+		return reply
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+}
+
+// answerServiceItems returns the disco#items of the server, which are the
+// services it hosts (XEP-0030 §4), or nil when iq is not a request for
+// them.
+func answerServiceItems(iq *stanza.IQ) *stanza.IQ {
+	var q disco.ItemsQuery
+	if iq.Type != stanza.IQGet || xml.Unmarshal(iq.Query, &q) != nil || q.Node != "" {
+		return nil
+	}
+	items := disco.ItemsQuery{}
+	if globalMUC != nil {
+		items.Items = append(items.Items, disco.Item{JID: globalMUC.domain, Name: "Chatrooms"})
+	}
+	if globalMIX != nil {
+		items.Items = append(items.Items, disco.Item{JID: globalMIX.domain, Name: "Channels"})
+	}
+	if globalProxy != nil {
+		items.Items = append(items.Items, disco.Item{JID: globalProxy.domain.String(), Name: "SOCKS5 Bytestreams"})
+	}
+	for _, domain := range globalComponents.items() {
+		items.Items = append(items.Items, disco.Item{JID: domain})
+	}
+	return payloadIQ(iq, items)
+}
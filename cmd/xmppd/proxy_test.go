@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/socks5"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+const bytestreamsQuery = `<query xmlns='http://jabber.org/protocol/bytestreams'/>`
+
+// setupProxy runs the bytestream proxy on proxy.example.com for the
+// duration of t.
+func setupProxy(t *testing.T) {
+	t.Helper()
+	p, err := newBytestreamProxy(Config{Domain: "example.com", ProxyDomain: "proxy.example.com", ProxyAddr: "127.0.0.1:0", ProxyHost: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = p.serve(ctx)
+	}()
+	old := globalProxy
+	globalProxy = p
+	t.Cleanup(func() {
+		globalProxy = old
+		cancel()
+		<-done
+	})
+}
+
+func TestProxyDisco(t *testing.T) {
+	setupProxy(t)
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "proxy.example.com", `<query xmlns='http://jabber.org/protocol/disco#info'/>`).Query, &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Identities) != 1 || info.Identities[0].Category != "proxy" || info.Identities[0].Type != "bytestreams" {
+		t.Fatalf("identities = %+v", info.Identities)
+	}
+
+	var items disco.ItemsQuery
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "example.com", `<query xmlns='http://jabber.org/protocol/disco#items'/>`).Query, &items); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, item := range items.Items {
+		found = found || item.JID == "proxy.example.com"
+	}
+	if !found {
+		t.Fatalf("server items = %+v", items.Items)
+	}
+}
+
+func TestProxyRelay(t *testing.T) {
+	setupProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+
+	var q socks5.Query
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "proxy.example.com", bytestreamsQuery).Query, &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Streamhosts) != 1 || q.Streamhosts[0].JID != "proxy.example.com" {
+		t.Fatalf("streamhosts = %+v", q.Streamhosts)
+	}
+	addr := net.JoinHostPort(q.Streamhosts[0].Host, strconv.Itoa(q.Streamhosts[0].Port))
+	dst := socks5.DstAddr("s1", jid.MustParse("romeo@example.com/orchard"), jid.MustParse("juliet@example.com/balcony"))
+	initiator, err := socks5.Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Close()
+	target, err := socks5.Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	activate := `<query xmlns='http://jabber.org/protocol/bytestreams' sid='s1'><activate>juliet@example.com/balcony</activate></query>`
+	mallory := newOrderedPeer(t, "mallory@evil.example/x")
+	if reply := mallory.request(t, stanza.IQSet, "proxy.example.com", activate); !refused(reply, stanza.ErrorForbidden) {
+		t.Fatalf("remote activation: %s", reply.Query)
+	}
+	// The connections may still be in the handshake.
+	for deadline := time.Now().Add(5 * time.Second); globalProxy.proxy.Stats().Pending != 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if reply := romeo.request(t, stanza.IQSet, "proxy.example.com", activate); reply.Type != stanza.IQResult {
+		t.Fatalf("activation: %+v", reply.Error)
+	}
+	if _, err := initiator.Write([]byte("wherefore")); err != nil {
+		t.Fatal(err)
+	}
+	initiator.Close()
+	if got, err := io.ReadAll(target); err != nil || string(got) != "wherefore" {
+		t.Fatalf("relayed %q, %v", got, err)
+	}
+
+	srv := newTestAdmin(t, memory.New(), nil)
+	var stats socks5.ProxyStats
+	if code := adminDo(t, srv, http.MethodGet, "/admin/proxy", "", &stats); code != http.StatusOK {
+		t.Fatalf("stats: status %d", code)
+	}
+	if stats.Activations != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
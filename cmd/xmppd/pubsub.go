@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// newPubSubPlugin returns the pubsub plugin with its event notifications
+// delivered through the session router.
+func newPubSubPlugin() *pubsub.Plugin {
+	p := pubsub.New()
+	p.SetNotifier(deliverEvent)
+	return p
+}
+
+// deliverEvent sends a pubsub event notification to the online resources
+// of a local subscriber, or to a remote subscriber's server. Notifications
+// a subscriber's block list refuses are dropped.
+func deliverEvent(ctx context.Context, msg *stanza.Message) error {
+	if globalBlocking.check(ctx, msg.From, msg.To) != nil {
+		return nil
+	}
+	if isRemote(msg.To) {
+		return sendRemote(ctx, nil, msg)
+	}
+	for _, dst := range globalRouter.targets(msg.To) {
+		if err := sendStanza(ctx, dst, msg); err != nil {
+			logError(ctx, "pubsub notification error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+	globalCluster.forward(ctx, msg.To, msg)
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestPubSubNotificationsRouted(t *testing.T) {
+	ctx := context.Background()
+	p := newPubSubPlugin()
+	if err := p.Initialize(ctx, plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatal(err)
+	}
+	_, phone := messagePeer(t, "alice@example.com/phone")
+	_, desk := messagePeer(t, "alice@example.com/desk")
+	_, other := messagePeer(t, "bob@example.com/phone")
+	for jid, state := range map[string]string{
+		"alice@example.com": pubsub.StateSubscribed,
+		"bob@example.com":   pubsub.StatePending,
+	} {
+		if err := p.SubscribeNode(ctx, &storage.PubSubSubscription{Host: "pubsub.example.com", NodeID: "news", JID: jid, State: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1", Payload: []byte("<headline/>")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msgs := range []<-chan stanza.Message{phone, desk} {
+		msg := receiveMessage(t, msgs)
+		if msg.From.String() != "pubsub.example.com" || len(msg.Extensions) != 1 || !strings.Contains(string(msg.Extensions[0].Inner), "headline") {
+			t.Fatalf("notification %+v", msg)
+		}
+	}
+	expectNoMessage(t, other)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/push"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalNotifications notifies the app servers users enabled push
+// notifications with (XEP-0357) of the messages kept for them offline. It is
+// nil when push notifications are disabled or the storage has no PushStore.
+//
+// Messages left unacknowledged in a stream management queue are kept offline
+// once the stream can no longer be resumed, which notifies of them too.
+var globalNotifications *notificationService
+
+// globalPushGateway is the built-in app server, nil unless
+// XMPP_PUSH_GATEWAY_DOMAIN is set.
+var globalPushGateway *pushGateway
+
+type notificationService struct {
+	push        *push.Plugin
+	offline     storage.OfflineStore
+	includeBody bool
+}
+
+func newNotificationService(ctx context.Context, cfg Config, store storage.Storage) (*notificationService, error) {
+	if !cfg.Push || store == nil || store.PushStore() == nil {
+		return nil, nil
+	}
+	p := push.New()
+	if err := p.Initialize(ctx, plugin.InitParams{Storage: store}); err != nil {
+		return nil, err
+	}
+	return &notificationService{push: p, offline: store.OfflineStore(), includeBody: cfg.PushIncludeBody}, nil
+}
+
+// answerPush returns the reply to a request of source to enable or disable
+// push notifications for its account, or nil when iq is not one.
+func answerPush(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	if xml.Unmarshal(iq.Query, &push.Enable{}) != nil && xml.Unmarshal(iq.Query, &push.Disable{}) != nil {
+		return nil
+	}
+	if globalNotifications == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "push notifications disabled"))
+	}
+	req := *iq
+	req.From = source.RemoteAddr()
+	return globalNotifications.push.HandleIQ(ctx, &req)
+}
+
+// notify tells the app servers of the recipient of msg, which was just
+// kept offline, about it. The notifications are sent in the background so
+// slow app servers do not hold up routing.
+func (s *notificationService) notify(ctx context.Context, msg *stanza.Message) {
+	if s == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		user := msg.To.Bare()
+		summary := push.Summary{MessageCount: 1, LastMessageSender: msg.From.Bare()}
+		if s.offline != nil {
+			if n, err := s.offline.CountOfflineMessages(ctx, user.String()); err == nil && n > 0 {
+				summary.MessageCount = n
+			}
+		}
+		if s.includeBody {
+			summary.LastMessageBody = msg.Body()
+		}
+		iqs, err := s.push.Notify(ctx, user, summary)
+		if err != nil {
+			logError(ctx, "push notification error", "user", user, "error", err)
+			return
+		}
+		for _, iq := range iqs {
+			s.send(ctx, iq)
+		}
+	}()
+}
+
+func (s *notificationService) send(ctx context.Context, iq *stanza.IQ) {
+	switch {
+	case globalPushGateway.serves(iq.To):
+		if reply := globalPushGateway.gateway.HandleIQ(ctx, iq); reply != nil {
+			s.push.HandleResult(ctx, reply)
+		}
+	case isRemote(iq.To):
+		if err := sendRemote(ctx, nil, iq); err != nil {
+			logError(ctx, "push notification error", "to", iq.To, "error", err)
+		}
+	default:
+		logError(ctx, "push notification to unknown app server", "to", iq.To)
+	}
+}
+
+// ack consumes the answer of an app server to a notification and reports
+// whether iq was one.
+func (s *notificationService) ack(ctx context.Context, iq *stanza.IQ) bool {
+	return s != nil && s.push.HandleResult(ctx, iq)
+}
+
+// pushGateway is an app server on a domain of its own that forwards the
+// notifications published to it to FCM and APNs.
+type pushGateway struct {
+	domain  jid.JID
+	gateway *push.Gateway
+}
+
+func newPushGateway(cfg Config) (*pushGateway, error) {
+	if cfg.PushGatewayDomain == "" {
+		return nil, nil
+	}
+	domain, err := jid.Parse(cfg.PushGatewayDomain)
+	if err != nil || !domain.IsDomainOnly() {
+		return nil, fmt.Errorf("push gateway domain %q is not a domain", cfg.PushGatewayDomain)
+	}
+	g := push.NewGateway()
+	g.SetSecret(cfg.PushGatewaySecret)
+	if cfg.PushFCMCredentials != "" {
+		data, err := os.ReadFile(cfg.PushFCMCredentials)
+		if err != nil {
+			return nil, err
+		}
+		account, err := push.ParseServiceAccount(data)
+		if err != nil {
+			return nil, err
+		}
+		g.Handle("fcm", &push.FCM{ProjectID: account.ProjectID, Token: account.Token})
+	}
+	if cfg.PushAPNsKey != "" {
+		data, err := os.ReadFile(cfg.PushAPNsKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := push.ParseAPNsKey(cfg.PushAPNsTeamID, cfg.PushAPNsKeyID, data)
+		if err != nil {
+			return nil, err
+		}
+		apns := &push.APNs{Topic: cfg.PushAPNsTopic, Token: key.Token}
+		if cfg.PushAPNsSandbox {
+			apns.Endpoint = push.APNsSandboxEndpoint
+		}
+		g.Handle("apns", apns)
+	}
+	return &pushGateway{domain: domain, gateway: g}, nil
+}
+
+// serves reports whether j addresses the gateway.
+func (g *pushGateway) serves(j jid.JID) bool {
+	return g != nil && j.Equal(g.domain)
+}
+
+// handleIQ answers the disco#info of the gateway and the notifications
+// published to it.
+func (g *pushGateway) handleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	var q disco.InfoQuery
+	if iq.Type == stanza.IQGet && xml.Unmarshal(iq.Query, &q) == nil && q.Node == "" {
+		return payloadIQ(iq, disco.InfoQuery{
+			Identities: []disco.Identity{{Category: "pubsub", Type: "push"}},
+			Features:   []disco.Feature{{Var: ns.DiscoInfo}, {Var: ns.PubSub}, {Var: ns.Push}},
+		})
+	}
+	if reply := g.gateway.HandleIQ(ctx, iq); reply != nil {
+		return reply
+	}
+	if iq.Type == stanza.IQGet || iq.Type == stanza.IQSet {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, ""))
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/push"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+type pushSender chan push.Push
+
+func (s pushSender) Send(_ context.Context, p push.Push) error {
+	s <- p
+	if p.Token == "gone" {
+		return push.ErrUnregistered
+	}
+	return nil
+}
+
+// setupPush enables push notifications and the gateway on
+// push.example.com, whose "test" service hands its pushes to the returned
+// channel, for the duration of t.
+func setupPush(t *testing.T, cfg Config) (storage.PushStore, <-chan push.Push) {
+	t.Helper()
+	store := memory.New()
+	cfg.Domain, cfg.Push = "example.com", true
+	notifications, err := newNotificationService(context.Background(), cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := newPushGateway(Config{PushGatewayDomain: "push.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(pushSender, 8)
+	gateway.gateway.Handle("test", sent)
+
+	oldOffline, oldNotifications, oldGateway := globalOffline, globalNotifications, globalPushGateway
+	globalOffline = newOfflineService(cfg, store)
+	globalNotifications, globalPushGateway = notifications, gateway
+	t.Cleanup(func() {
+		globalOffline, globalNotifications, globalPushGateway = oldOffline, oldNotifications, oldGateway
+	})
+	return store.PushStore(), sent
+}
+
+func receivePush(t *testing.T, pushes <-chan push.Push) push.Push {
+	t.Helper()
+	select {
+	case p := <-pushes:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no push")
+		return push.Push{}
+	}
+}
+
+func enablePush(t *testing.T, store storage.PushStore, user, token string) {
+	t.Helper()
+	options := `<x xmlns='jabber:x:data' type='submit'><field var='FORM_TYPE'><value>` + push.FormPublishOptions +
+		`</value></field><field var='service'><value>test</value></field><field var='token'><value>` + token + `</value></field></x>`
+	if err := store.SetPushRegistration(context.Background(), &storage.PushRegistration{
+		UserJID: user, JID: "push.example.com", Node: "n1", Options: []byte(options),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chat routes a chat message from source to to.
+func chat(t *testing.T, source *xmpp.Session, to, body string) {
+	t.Helper()
+	msg, err := stanza.BuildMessage().To(jid.MustParse(to)).Type(stanza.MessageChat).Body(body).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := routeMessage(context.Background(), source, msg); err != nil {
+		t.Fatalf("routeMessage: %v", err)
+	}
+}
+
+func TestPushEnableDisable(t *testing.T) {
+	ctx := context.Background()
+	store, _ := setupPush(t, Config{})
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+
+	reply := alice.request(t, stanza.IQSet, "", `<enable xmlns='`+ns.Push+`' jid='push.example.com' node='n1'/>`)
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("enable: %+v", reply.Error)
+	}
+	regs, _ := store.GetPushRegistrations(ctx, "alice@example.com")
+	if len(regs) != 1 || regs[0].JID != "push.example.com" || regs[0].Node != "n1" {
+		t.Fatalf("registrations = %+v", regs)
+	}
+	if reply := alice.request(t, stanza.IQSet, "alice@example.com", `<disable xmlns='`+ns.Push+`' jid='push.example.com'/>`); reply.Type != stanza.IQResult {
+		t.Fatalf("disable: %+v", reply.Error)
+	}
+	if regs, _ := store.GetPushRegistrations(ctx, "alice@example.com"); len(regs) != 0 {
+		t.Fatalf("registrations after disable = %+v", regs)
+	}
+
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.To = jid.MustParse("alice@example.com")
+	iq.Query = []byte(`<query xmlns='` + ns.DiscoInfo + `'/>`)
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(answerAccountInfo(iq).Query, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(info.Features, func(f disco.Feature) bool { return f.Var == ns.Push }) {
+		t.Fatalf("account features = %+v", info.Features)
+	}
+	reply = alice.request(t, stanza.IQGet, "push.example.com", `<query xmlns='`+ns.DiscoInfo+`'/>`)
+	info = disco.InfoQuery{}
+	if err := xml.Unmarshal(reply.Query, &info); err != nil || len(info.Identities) != 1 || info.Identities[0].Type != "push" {
+		t.Fatalf("gateway info = %s, %v", reply.Query, err)
+	}
+}
+
+func TestPushOnOfflineMessage(t *testing.T) {
+	ctx := context.Background()
+	store, pushes := setupPush(t, Config{})
+	enablePush(t, store, "carol@example.com", "t1")
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+
+	for i := 1; i <= 2; i++ {
+		chat(t, alice, "carol@example.com", "secret plans")
+		p := receivePush(t, pushes)
+		if p.Token != "t1" || p.Summary.MessageCount != i || p.Summary.LastMessageSender.String() != "alice@example.com" {
+			t.Fatalf("push %d = %+v", i, p)
+		}
+		if p.Summary.LastMessageBody != "" {
+			t.Fatal("the message body was disclosed")
+		}
+	}
+
+	// The gateway rejects a token the platform dropped, and the server
+	// disables the registration.
+	enablePush(t, store, "dave@example.com", "gone")
+	chat(t, alice, "dave@example.com", "hi")
+	receivePush(t, pushes)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if regs, _ := store.GetPushRegistrations(ctx, "dave@example.com"); len(regs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rejected registration was kept")
+		}
+	}
+}
+
+func TestPushIncludeBody(t *testing.T) {
+	store, pushes := setupPush(t, Config{PushIncludeBody: true})
+	enablePush(t, store, "carol@example.com", "t1")
+	alice, _ := messagePeer(t, "alice@example.com/phone")
+
+	chat(t, alice, "carol@example.com", "lunch?")
+	if p := receivePush(t, pushes); !strings.Contains(p.Summary.LastMessageBody, "lunch?") {
+		t.Fatalf("push = %+v", p)
+	}
+}
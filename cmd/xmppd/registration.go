@@ -10,6 +10,7 @@ import (
 	"time"
 
 	xmpp "github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugins/form"
 	"github.com/meszmate/xmpp-go/plugins/register"
@@ -36,6 +37,9 @@ type registrationConfig struct {
 	Iterations   int
 	DataForm     bool
 	Instructions string
+	// KeepPlaintext also stores the password itself, for SASL mechanisms
+	// that cannot use the stored SCRAM-SHA-256 credentials.
+	KeepPlaintext bool
 }
 
 type rateLimiter struct {
@@ -43,13 +47,15 @@ type rateLimiter struct {
 	window time.Duration
 	limit  int
 	items  map[string][]time.Time
+	clock  clock.Clock
 }
 
-func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+func newRateLimiter(limit int, window time.Duration, c clock.Clock) *rateLimiter {
 	return &rateLimiter{
 		window: window,
 		limit:  limit,
 		items:  make(map[string][]time.Time),
+		clock:  clock.Or(c),
 	}
 }
 
@@ -59,7 +65,8 @@ func (r *rateLimiter) Allow(key string) bool {
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	cutoff := time.Now().Add(-r.window)
+	now := r.clock.Now()
+	cutoff := now.Add(-r.window)
 	entries := r.items[key]
 	out := entries[:0]
 	for _, t := range entries {
@@ -71,7 +78,7 @@ func (r *rateLimiter) Allow(key string) bool {
 		r.items[key] = out
 		return false
 	}
-	out = append(out, time.Now())
+	out = append(out, now)
 	r.items[key] = out
 	return true
 }
@@ -86,7 +93,7 @@ func newRegistrationHandler(cfg registrationConfig, store storage.Storage) *regi
 	return &registrationHandler{
 		cfg:         cfg,
 		store:       store,
-		rateLimiter: newRateLimiter(cfg.RateLimit, cfg.RateWindow),
+		rateLimiter: newRateLimiter(cfg.RateLimit, cfg.RateWindow, clock.System),
 	}
 }
 
@@ -176,20 +183,10 @@ func (h *registrationHandler) handleSet(ctx context.Context, session *xmpp.Sessi
 		return session.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "user already exists")))
 	}
 
-	salt, iters, storedKey, serverKey, err := hashPasswordSCRAMSHA256(password, h.cfg.Iterations)
+	user, err := newUser(username, password, h.cfg.Iterations, h.cfg.KeepPlaintext)
 	if err != nil {
 		return session.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "password hashing failed")))
 	}
-
-	user := &storage.User{
-		Username: username,
-		// Keep plaintext populated for backends that still use UserStore.Authenticate.
-		Password:   password,
-		Salt:       salt,
-		Iterations: iters,
-		StoredKey:  storedKey,
-		ServerKey:  serverKey,
-	}
 	if err := us.CreateUser(ctx, user); err != nil {
 		if errors.Is(err, storage.ErrUserExists) {
 			return session.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "user already exists")))
@@ -209,8 +206,7 @@ func (h *registrationHandler) handleRemove(ctx context.Context, session *xmpp.Se
 		return session.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "username and password required")))
 	}
 	us := h.store.UserStore()
-	ok, err := us.Authenticate(ctx, username, password)
-	if err != nil || !ok {
+	if err := verifyPassword(ctx, us, username, password); err != nil {
 		return session.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorNotAuthorized, "authentication failed")))
 	}
 	if err := us.DeleteUser(ctx, username); err != nil {
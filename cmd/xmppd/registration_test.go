@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := newRateLimiter(2, time.Minute, c)
+
+	if !r.Allow("peer") || !r.Allow("peer") {
+		t.Fatal("first two attempts should be allowed")
+	}
+	if r.Allow("peer") {
+		t.Fatal("third attempt within the window should be refused")
+	}
+	if !r.Allow("other") {
+		t.Fatal("limits are per key")
+	}
+
+	c.Advance(59 * time.Second)
+	if r.Allow("peer") {
+		t.Fatal("attempt before the window expires should be refused")
+	}
+	c.Advance(time.Second)
+	if !r.Allow("peer") {
+		t.Fatal("attempt after the window expires should be allowed")
+	}
+}
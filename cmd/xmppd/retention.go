@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalRetention purges archived and offline messages past the retention
+// policies. It is nil when no policy is set.
+var globalRetention *retentionService
+
+// retentionPolicy limits a message archive. Zero values keep everything.
+type retentionPolicy struct {
+	maxAge      time.Duration
+	maxMessages int
+}
+
+func (p retentionPolicy) set() bool { return p.maxAge > 0 || p.maxMessages > 0 }
+
+type retentionService struct {
+	domain   string
+	interval time.Duration
+	archive  storage.MAMStore
+	offline  storage.OfflineStore
+	users    storage.UserLister
+	rooms    storage.MUCRoomStore
+
+	user       retentionPolicy
+	room       retentionPolicy
+	offlineTTL time.Duration
+	clock      clock.Clock
+}
+
+func newRetentionService(cfg Config, store storage.Storage) *retentionService {
+	s := &retentionService{
+		domain:     cfg.Domain,
+		interval:   cfg.RetentionInterval,
+		user:       retentionPolicy{maxAge: cfg.ArchiveMaxAge, maxMessages: cfg.ArchiveMaxMessages},
+		room:       retentionPolicy{maxAge: cfg.MUCArchiveMaxAge, maxMessages: cfg.MUCArchiveMaxMessages},
+		offlineTTL: cfg.OfflineTTL,
+		clock:      clock.System,
+	}
+	if store == nil || !s.user.set() && !s.room.set() && s.offlineTTL <= 0 {
+		return nil
+	}
+	if s.interval <= 0 {
+		s.interval = time.Hour
+	}
+	s.archive = store.MAMStore()
+	s.offline = store.OfflineStore()
+	s.users, _ = store.UserStore().(storage.UserLister)
+	s.rooms = store.MUCRoomStore()
+	if s.users == nil && (s.user.set() || s.offlineTTL > 0) {
+		slog.Warn("the account store cannot list accounts; user archives and offline messages are not purged")
+	}
+	return s
+}
+
+// run purges expired messages now and then every interval until ctx is
+// done.
+func (s *retentionService) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.purge(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge applies the policies once: the user policy to the archive of every
+// account, the room policy to the archive of every stored room, and the
+// offline TTL to the offline messages of every account. Failures are logged
+// and the purge goes on with the next archive.
+func (s *retentionService) purge(ctx context.Context) {
+	var archived, offline int
+	if s.users != nil && (s.user.set() && s.archive != nil || s.offlineTTL > 0 && s.offline != nil) {
+		usernames, err := s.users.ListUsers(ctx)
+		if err != nil {
+			logError(ctx, "retention error", "error", err)
+		}
+		for _, username := range usernames {
+			user := username + "@" + s.domain
+			if s.user.set() && s.archive != nil {
+				archived += s.expireArchive(ctx, user, s.user)
+			}
+			if s.offlineTTL > 0 && s.offline != nil {
+				offline += s.expireOffline(ctx, user)
+			}
+		}
+	}
+	if s.rooms != nil && s.room.set() && s.archive != nil {
+		rooms, err := s.rooms.ListRooms(ctx)
+		if err != nil {
+			logError(ctx, "retention error", "error", err)
+		}
+		for _, room := range rooms {
+			archived += s.expireArchive(ctx, room.RoomJID, s.room)
+		}
+	}
+	if archived > 0 || offline > 0 {
+		slog.InfoContext(ctx, "expired messages purged", "archived", archived, "offline", offline)
+	}
+}
+
+// expireArchive deletes the messages of owner's archive older than the
+// policy's maximum age, then the oldest messages past its maximum count,
+// and returns how many it deleted. Messages archived at the same instant as
+// the oldest one kept are kept with it.
+func (s *retentionService) expireArchive(ctx context.Context, owner string, p retentionPolicy) int {
+	var deleted int
+	if p.maxAge > 0 {
+		n, err := s.archive.DeleteMessagesBefore(ctx, owner, s.clock.Now().Add(-p.maxAge))
+		if err != nil {
+			logError(ctx, "retention error", "archive", owner, "error", err)
+			return deleted
+		}
+		deleted += n
+	}
+	if p.maxMessages > 0 {
+		res, err := s.archive.QueryMessages(ctx, &storage.MAMQuery{UserJID: owner, Last: true, Max: p.maxMessages})
+		if err != nil {
+			logError(ctx, "retention error", "archive", owner, "error", err)
+			return deleted
+		}
+		if res.Count <= len(res.Messages) || len(res.Messages) == 0 {
+			return deleted
+		}
+		n, err := s.archive.DeleteMessagesBefore(ctx, owner, res.Messages[0].CreatedAt)
+		if err != nil {
+			logError(ctx, "retention error", "archive", owner, "error", err)
+		}
+		deleted += n
+	}
+	return deleted
+}
+
+// expireOffline deletes the offline messages of user kept for longer than
+// the offline TTL and returns how many it deleted.
+func (s *retentionService) expireOffline(ctx context.Context, user string) int {
+	msgs, err := s.offline.GetOfflineMessages(ctx, user)
+	if err != nil {
+		logError(ctx, "retention error", "user", user, "error", err)
+		return 0
+	}
+	now := s.clock.Now()
+	var ids []string
+	for _, m := range msgs {
+		if expired(m, s.offlineTTL, now) {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+	if err := s.offline.DeleteOfflineMessagesByIDs(ctx, user, ids); err != nil {
+		logError(ctx, "retention error", "user", user, "error", err)
+		return 0
+	}
+	return len(ids)
+}
+
+// expired reports whether the offline message m was kept for longer than
+// ttl by now. Nothing expires when ttl is zero.
+func expired(m *storage.OfflineMessage, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(m.CreatedAt) > ttl
+}
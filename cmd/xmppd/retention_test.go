@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestRetentionPurge(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	cfg := Config{
+		Domain:                "example.com",
+		ArchiveMaxAge:         time.Hour,
+		MUCArchiveMaxMessages: 2,
+		OfflineTTL:            time.Hour,
+	}
+	if newRetentionService(Config{Domain: "example.com"}, store) != nil {
+		t.Fatal("retention without a policy")
+	}
+	retention := newRetentionService(cfg, store)
+	for _, user := range []string{"alice", "bob"} {
+		if err := store.UserStore().CreateUser(ctx, &storage.User{Username: user, Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.MUCRoomStore().CreateRoom(ctx, &storage.MUCRoom{RoomJID: "room@conference.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	archive := func(owner string, ages ...time.Duration) {
+		t.Helper()
+		for i, age := range ages {
+			err := store.MAMStore().ArchiveMessage(ctx, &storage.ArchivedMessage{
+				ID: fmt.Sprint(i), UserJID: owner, WithJID: "carol@example.com",
+				Data: []byte("<message/>"), CreatedAt: now.Add(-age),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	archive("alice@example.com", 3*time.Hour, 2*time.Hour, time.Minute)
+	archive("bob@example.com", time.Minute)
+	archive("room@conference.example.com", 5*time.Hour, 4*time.Hour, 3*time.Hour, 2*time.Hour)
+	for i, age := range []time.Duration{2 * time.Hour, time.Minute} {
+		err := store.OfflineStore().StoreOfflineMessage(ctx, &storage.OfflineMessage{
+			ID: fmt.Sprint(i), UserJID: "alice@example.com", Data: []byte("<message/>"), CreatedAt: now.Add(-age),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retention.purge(ctx)
+
+	for owner, want := range map[string][]string{
+		"alice@example.com":           {"2"},
+		"bob@example.com":             {"0"},
+		"room@conference.example.com": {"2", "3"},
+	} {
+		res, err := store.MAMStore().QueryMessages(ctx, &storage.MAMQuery{UserJID: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range res.Messages {
+			got = append(got, m.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s archive = %v, want %v", owner, got, want)
+		}
+	}
+	msgs, err := store.OfflineStore().GetOfflineMessages(ctx, "alice@example.com")
+	if err != nil || len(msgs) != 1 || msgs[0].ID != "1" {
+		t.Fatalf("offline messages = %+v, %v", msgs, err)
+	}
+}
+
+func TestRetentionFollowsClock(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	retention := newRetentionService(Config{Domain: "example.com", ArchiveMaxAge: time.Hour, OfflineTTL: time.Hour}, store)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	retention.clock = fake
+	if err := store.UserStore().CreateUser(ctx, &storage.User{Username: "alice", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	err := store.MAMStore().ArchiveMessage(ctx, &storage.ArchivedMessage{
+		ID: "a1", UserJID: "alice@example.com", WithJID: "carol@example.com",
+		Data: []byte("<message/>"), CreatedAt: fake.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.OfflineStore().StoreOfflineMessage(ctx, &storage.OfflineMessage{
+		ID: "o1", UserJID: "alice@example.com", Data: []byte("<message/>"), CreatedAt: fake.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := func() (archived, offline int) {
+		t.Helper()
+		res, err := store.MAMStore().QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := store.OfflineStore().CountOfflineMessages(ctx, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Messages), n
+	}
+
+	fake.Advance(59 * time.Minute)
+	retention.purge(ctx)
+	if archived, offline := left(); archived != 1 || offline != 1 {
+		t.Fatalf("purged within the limits: %d archived, %d offline left", archived, offline)
+	}
+	fake.Advance(2 * time.Minute)
+	retention.purge(ctx)
+	if archived, offline := left(); archived != 0 || offline != 0 {
+		t.Fatalf("%d archived, %d offline left past the limits", archived, offline)
+	}
+}
+
+func TestOfflineTTLOnDelivery(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com", OfflineTTL: time.Hour})
+	setupRoster(t, Config{Domain: "example.com"}, memory.New())
+	for i, age := range []time.Duration{2 * time.Hour, time.Minute} {
+		err := offline.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+			ID: fmt.Sprint(i), UserJID: "carol@example.com",
+			Data:      []byte(fmt.Sprintf("<message xmlns='jabber:client' to='carol@example.com'><body>%d</body></message>", i)),
+			CreatedAt: time.Now().Add(-age),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	carol, carolMsgs := messagePeer(t, "carol@example.com/laptop")
+	t.Cleanup(func() { globalPresence.remove(carol.RemoteAddr()) })
+	if err := globalOffline.deliver(ctx, carol, carol.RemoteAddr().Bare()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if msg := receiveMessage(t, carolMsgs); msg.Body() != "1" {
+		t.Fatalf("body = %q, want the message within the TTL", msg.Body())
+	}
+	expectNoMessage(t, carolMsgs)
+	if n, _ := offline.CountOfflineMessages(ctx, "carol@example.com"); n != 0 {
+		t.Fatalf("%d messages left after delivery", n)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// globalRoster applies roster policies for local accounts. It is nil when the
+// server runs without storage.
+var globalRoster *rosterService
+
+type rosterService struct {
+	domain string
+	roster *roster.Plugin
+}
+
+func newRosterService(ctx context.Context, cfg Config, store storage.Storage) (*rosterService, error) {
+	if store == nil || store.RosterStore() == nil {
+		return nil, nil
+	}
+	p := roster.New()
+	if err := p.Initialize(ctx, plugin.InitParams{
+		LocalJID: func() string { return cfg.Domain },
+		Storage:  store,
+	}); err != nil {
+		return nil, err
+	}
+
+	policy, err := roster.ParseSubscriptionPolicy(cfg.SubscriptionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	p.SetSubscriptionPolicy(policy)
+	for user, name := range cfg.AccountSubscriptionPolicies {
+		policy, err := roster.ParseSubscriptionPolicy(name)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", user, err)
+		}
+		p.SetAccountSubscriptionPolicy(accountJID(user, cfg.Domain), policy)
+	}
+	p.SetPusher(pushRosterItem)
+
+	return &rosterService{domain: cfg.Domain, roster: p}, nil
+}
+
+// writeRosterVerFeature advertises roster versioning, which answerRoster
+// implements for every roster request.
+func writeRosterVerFeature(writer *xmppxml.StreamWriter) error {
+	feature := xml.StartElement{Name: roster.VersioningFeature}
+	if err := writer.EncodeToken(feature); err != nil {
+		return err
+	}
+	return writer.EncodeToken(xml.EndElement{Name: feature.Name})
+}
+
+// accountJID returns the bare JID for a configured account name, which may be
+// a plain username or a full bare JID.
+func accountJID(user, domain string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	return user + "@" + domain
+}
+
+// pushRosterItem sends a roster push for item to every online resource of
+// userJID (RFC 6121 §2.1.6).
+func pushRosterItem(ctx context.Context, userJID, ver string, item roster.Item) error {
+	user, err := jid.Parse(userJID)
+	if err != nil {
+		return err
+	}
+	payload, err := xml.Marshal(roster.Query{Ver: ver, Items: []roster.Item{item}})
+	if err != nil {
+		return err
+	}
+	for _, dst := range globalRouter.targets(user.Bare()) {
+		iq := stanza.NewIQ(stanza.IQSet)
+		iq.To = dst.RemoteAddr()
+		iq.Query = payload
+		if err := globalPushes.send(ctx, dst, iq); err != nil {
+			logError(ctx, "roster push error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+	return nil
+}
+
+// answerRoster answers the roster gets and sets for the roster of the
+// local user (RFC 6121 §2), or returns nil when iq is not one. A get whose
+// ver matches the current roster version is answered without the roster;
+// changes are pushed to every resource of the user. Contacts in a shared
+// group with the user cannot be removed.
+func answerRoster(ctx context.Context, user jid.JID, iq *stanza.IQ) *stanza.IQ {
+	var q roster.Query
+	if (iq.Type != stanza.IQGet && iq.Type != stanza.IQSet) || xml.Unmarshal(iq.Query, &q) != nil {
+		return nil
+	}
+	if globalRoster == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "no roster storage"))
+	}
+	user = user.Bare()
+	if iq.Type == stanza.IQGet {
+		items, ver, err := globalRoster.roster.Roster(ctx, user.String())
+		if err != nil {
+			logError(ctx, "roster error", "user", user, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		if ver == "" {
+			ver = "0"
+		}
+		if q.Ver == ver {
+			return iq.ResultIQ()
+		}
+		return payloadIQ(iq, roster.Query{Ver: ver, Items: items})
+	}
+
+	if len(q.Items) != 1 {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "a roster set carries one item"))
+	}
+	item := q.Items[0]
+	if item.Subscription != roster.SubRemove {
+		err := globalRoster.roster.SetItem(ctx, user.String(), item)
+		switch {
+		case errors.Is(err, roster.ErrInvalidItem):
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, err.Error()))
+		case errors.Is(err, storage.ErrRosterLimit):
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "roster is full"))
+		case err != nil:
+			logError(ctx, "roster error", "user", user, "error", err)
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		return iq.ResultIQ()
+	}
+
+	contact, err := jid.Parse(item.JID)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, ""))
+	}
+	contact = contact.Bare()
+	if globalSharedGroups.shared(ctx, user, contact) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "contact is in a shared group"))
+	}
+	removed, err := globalRoster.roster.RemoveItem(ctx, user.String(), contact.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	}
+	if err != nil && removed == nil {
+		logError(ctx, "roster error", "user", user, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	// Removing a contact cancels the subscriptions both ways (RFC 6121 §2.5.2).
+	if roster.ProbesPresenceOf(removed.Subscription) || removed.Ask != "" {
+		sendSubscription(ctx, subscription(user, contact, stanza.PresenceUnsubscribe))
+	}
+	if roster.SendsPresenceTo(removed.Subscription) {
+		sendSubscription(ctx, subscription(user, contact, stanza.PresenceUnsubscribed))
+		hidePresence(ctx, user, contact)
+	}
+	return iq.ResultIQ()
+}
+
+// outbound applies a subscription stanza a local user sends to the user's
+// roster and reports whether it must be routed to the contact.
+func (rs *rosterService) outbound(ctx context.Context, pres *stanza.Presence) (bool, error) {
+	if rs == nil {
+		return true, nil
+	}
+	return rs.roster.OutboundSubscription(ctx, pres.From.Bare().String(), pres.To.Bare().String(), pres.Type)
+}
+
+// inbound applies a subscription stanza to the roster of its local
+// recipient and reports whether it must be delivered to the user's
+// resources. Subscribe requests the server can answer on the user's behalf,
+// because the contact is already subscribed or by the user's subscription
+// policy, are answered here.
+func (rs *rosterService) inbound(ctx context.Context, pres *stanza.Presence) (bool, error) {
+	if rs == nil || pres.To.Domain() != rs.domain || pres.To.Local() == "" {
+		return true, nil
+	}
+	user := pres.To.Bare()
+	contact := pres.From.Bare()
+
+	deliver, err := rs.roster.InboundSubscription(ctx, user.String(), contact.String(), pres.Type)
+	if err != nil || pres.Type != stanza.PresenceSubscribe {
+		return deliver, err
+	}
+	if !deliver {
+		approve(ctx, user, contact)
+		return false, nil
+	}
+
+	res, err := rs.roster.HandleSubscribe(ctx, user.String(), contact.String())
+	if err != nil {
+		return false, err
+	}
+
+	switch res.Policy {
+	case roster.PolicyAutoAccept:
+		approve(ctx, user, contact)
+		if res.SubscribeBack {
+			sendSubscription(ctx, subscription(user, contact, stanza.PresenceSubscribe))
+		}
+		return false, nil
+	case roster.PolicyAutoReject:
+		sendSubscription(ctx, subscription(user, contact, stanza.PresenceUnsubscribed))
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// subscription returns a subscription stanza of the given type from one bare
+// JID to another.
+func subscription(from, to jid.JID, typ string) *stanza.Presence {
+	pres := stanza.NewPresence(typ)
+	pres.From = from
+	pres.To = to
+	return pres
+}
+
+// isSubscription reports whether typ is one of the presence types that
+// manage subscriptions (RFC 6121 §3).
+func isSubscription(typ string) bool {
+	switch typ {
+	case stanza.PresenceSubscribe, stanza.PresenceSubscribed, stanza.PresenceUnsubscribe, stanza.PresenceUnsubscribed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"slices"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func rosterQuery(t *testing.T, iq *stanza.IQ) roster.Query {
+	t.Helper()
+	var q roster.Query
+	if err := xml.Unmarshal(iq.Query, &q); err != nil {
+		t.Fatalf("roster %s: %v", iq.Query, err)
+	}
+	return q
+}
+
+func TestRosterGetAndSet(t *testing.T) {
+	setupRoster(t, Config{Domain: "example.com"}, memory.New())
+	phone := newOrderedPeer(t, "alice@example.com/phone")
+	laptop := newOrderedPeer(t, "alice@example.com/laptop")
+
+	reply := phone.request(t, stanza.IQGet, "alice@example.com", `<query xmlns='jabber:iq:roster' ver=''/>`)
+	if q := rosterQuery(t, reply); reply.Type != stanza.IQResult || q.Ver != "0" || len(q.Items) != 0 {
+		t.Fatalf("empty roster = %+v", q)
+	}
+
+	phone.ask(t, stanza.IQSet, "alice@example.com", `<query xmlns='jabber:iq:roster'>
+		<item jid='bob@example.com' name='Bob' subscription='both'><group>Friends</group></item></query>`)
+	// Every resource gets the push, the sender before its result.
+	for _, p := range []*orderedPeer{phone, laptop} {
+		push := p.iq(t)
+		q := rosterQuery(t, push)
+		if push.Type != stanza.IQSet || q.Ver != "1" || len(q.Items) != 1 || q.Items[0].Subscription != roster.SubNone || q.Items[0].Name != "Bob" {
+			t.Fatalf("push = %+v", q)
+		}
+	}
+	if reply := phone.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("set: %+v", reply.Error)
+	}
+
+	reply = laptop.request(t, stanza.IQGet, "", `<query xmlns='jabber:iq:roster' ver='1'/>`)
+	if reply.Type != stanza.IQResult || len(reply.Query) != 0 {
+		t.Fatalf("current version answered with %s", reply.Query)
+	}
+	reply = laptop.request(t, stanza.IQGet, "", `<query xmlns='jabber:iq:roster' ver='0'/>`)
+	if q := rosterQuery(t, reply); q.Ver != "1" || len(q.Items) != 1 || !slices.Equal(q.Items[0].Groups, []string{"Friends"}) {
+		t.Fatalf("roster = %+v", q)
+	}
+
+	for _, bad := range []string{
+		`<query xmlns='jabber:iq:roster'/>`,
+		`<query xmlns='jabber:iq:roster'><item jid='bob@example.com'><group>a</group><group>a</group></item></query>`,
+		`<query xmlns='jabber:iq:roster'><item jid='carol@example.com' subscription='remove'/></query>`,
+	} {
+		if reply := phone.request(t, stanza.IQSet, "", bad); reply.Type != stanza.IQError {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestRosterRemoveCancelsSubscriptions(t *testing.T) {
+	store := memory.New()
+	setupRoster(t, Config{Domain: "example.com"}, store)
+	ctx := context.Background()
+	for _, item := range []*storage.RosterItem{
+		{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: roster.SubBoth},
+		{UserJID: "bob@example.com", ContactJID: "alice@example.com", Subscription: roster.SubBoth},
+	} {
+		if err := store.RosterStore().UpsertRosterItem(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+
+	alice.ask(t, stanza.IQSet, "", `<query xmlns='jabber:iq:roster'><item jid='bob@example.com' subscription='remove'/></query>`)
+	if q := rosterQuery(t, alice.iq(t)); q.Items[0].Subscription != roster.SubRemove {
+		t.Fatalf("push = %+v", q)
+	}
+	if reply := alice.iq(t); reply.Type != stanza.IQResult {
+		t.Fatalf("remove: %+v", reply.Error)
+	}
+
+	// bob's roster follows both cancellations, each pushed and delivered.
+	var types []string
+	for range 4 {
+		switch v := bob.next(t).(type) {
+		case *stanza.Presence:
+			types = append(types, v.Type)
+		case *stanza.IQ:
+			types = append(types, "push")
+		}
+	}
+	if want := []string{"push", stanza.PresenceUnsubscribe, "push", stanza.PresenceUnsubscribed}; !slices.Equal(types, want) {
+		t.Fatalf("bob received %q, want %q", types, want)
+	}
+	item, err := store.RosterStore().GetRosterItem(ctx, "bob@example.com", "alice@example.com")
+	if err != nil || item.Subscription != roster.SubNone {
+		t.Fatalf("bob's item = %+v, %v", item, err)
+	}
+}
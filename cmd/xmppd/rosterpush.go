@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// defaultRosterPushTimeout is how long a roster push may go unanswered.
+const defaultRosterPushTimeout = 30 * time.Second
+
+// globalPushes tracks the roster pushes that clients have not answered yet.
+var globalPushes = newPushTracker(defaultRosterPushTimeout, true)
+
+// pushTracker sends roster pushes and waits for the result the client must
+// return (RFC 6121 §2.1.6). A push that is not answered within timeout is
+// sent once more if resend is set, then logged and counted as unacknowledged.
+// Waiting never blocks the sender.
+type pushTracker struct {
+	timeout time.Duration
+	resend  bool
+
+	mu      sync.Mutex
+	pending map[pushKey]*pendingPush
+	seq     atomic.Uint64
+	unacked atomic.Uint64
+}
+
+type pushKey struct {
+	session *xmpp.Session
+	id      string
+}
+
+type pendingPush struct {
+	iq     *stanza.IQ
+	timer  *time.Timer
+	resent bool
+}
+
+// newPushTracker returns a tracker for the given timeout. A timeout of zero
+// or less disables tracking and pushes are sent without waiting for results.
+func newPushTracker(timeout time.Duration, resend bool) *pushTracker {
+	return &pushTracker{timeout: timeout, resend: resend, pending: make(map[pushKey]*pendingPush)}
+}
+
+// send delivers the roster push iq to dst, giving it an ID when it has none.
+func (t *pushTracker) send(ctx context.Context, dst *xmpp.Session, iq *stanza.IQ) error {
+	if iq.ID == "" {
+		iq.ID = "push-" + strconv.FormatUint(t.seq.Add(1), 10)
+	}
+	if t.timeout <= 0 {
+		return sendStanza(ctx, dst, iq)
+	}
+	key := pushKey{session: dst, id: iq.ID}
+	ctx = context.WithoutCancel(ctx)
+
+	t.mu.Lock()
+	p := &pendingPush{iq: iq}
+	p.timer = time.AfterFunc(t.timeout, func() { t.expire(ctx, key) })
+	t.pending[key] = p
+	t.mu.Unlock()
+
+	if err := sendStanza(ctx, dst, iq); err != nil {
+		t.drop(key)
+		return err
+	}
+	return nil
+}
+
+// expire handles a push whose result did not arrive in time.
+func (t *pushTracker) expire(ctx context.Context, key pushKey) {
+	t.mu.Lock()
+	p, ok := t.pending[key]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	if !t.resend || p.resent {
+		delete(t.pending, key)
+		t.mu.Unlock()
+		t.unacked.Add(1)
+		key.session.Log(ctx, slog.LevelWarn, "roster push not acknowledged", "id", key.id)
+		return
+	}
+	p.resent = true
+	p.timer.Reset(t.timeout)
+	t.mu.Unlock()
+
+	if err := key.session.Send(ctx, p.iq); err != nil {
+		key.session.Log(ctx, slog.LevelError, "roster push resend error", "error", err)
+	}
+}
+
+// ack consumes the result or error answering a push sent to source and
+// reports whether iq was such an answer.
+func (t *pushTracker) ack(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) bool {
+	if iq.Type != stanza.IQResult && iq.Type != stanza.IQError {
+		return false
+	}
+	key := pushKey{session: source, id: iq.ID}
+	if !t.drop(key) {
+		return false
+	}
+	if iq.Type == stanza.IQError {
+		source.Log(ctx, slog.LevelWarn, "roster push rejected", "id", iq.ID)
+	}
+	return true
+}
+
+// forget stops tracking the pushes sent to a session that has ended.
+func (t *pushTracker) forget(session *xmpp.Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, p := range t.pending {
+		if key.session == session {
+			p.timer.Stop()
+			delete(t.pending, key)
+		}
+	}
+}
+
+func (t *pushTracker) drop(key pushKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[key]
+	if ok {
+		p.timer.Stop()
+		delete(t.pending, key)
+	}
+	return ok
+}
+
+// outstanding returns the number of pushes awaiting a result.
+func (t *pushTracker) outstanding() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// unacknowledged returns the number of pushes that were never answered.
+func (t *pushTracker) unacknowledged() uint64 {
+	return t.unacked.Load()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// iqPeer returns a session and a channel of the IQs written to it.
+func iqPeer(t *testing.T, full string) (*xmpp.Session, <-chan stanza.IQ) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1), xmpp.WithRemoteAddr(jid.MustParse(full)))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	iqs := make(chan stanza.IQ, 8)
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			var iq stanza.IQ
+			if err := dec.Decode(&iq); err != nil {
+				return
+			}
+			iqs <- iq
+		}
+	}()
+	t.Cleanup(func() {
+		session.Close()
+		c2.Close()
+	})
+	return session, iqs
+}
+
+func receiveIQ(t *testing.T, iqs <-chan stanza.IQ) stanza.IQ {
+	t.Helper()
+	select {
+	case iq := <-iqs:
+		return iq
+	case <-time.After(2 * time.Second):
+		t.Fatal("no IQ received")
+		return stanza.IQ{}
+	}
+}
+
+func expectNoIQ(t *testing.T, iqs <-chan stanza.IQ, wait time.Duration) {
+	t.Helper()
+	select {
+	case iq := <-iqs:
+		t.Fatalf("unexpected IQ %+v", iq)
+	case <-time.After(wait):
+	}
+}
+
+func waitUnacked(t *testing.T, tr *pushTracker, want uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for tr.unacknowledged() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("unacknowledged = %d, want %d", tr.unacknowledged(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func rosterPush() *stanza.IQ {
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = []byte(`<query xmlns="jabber:iq:roster"><item jid="bob@example.com"/></query>`)
+	return iq
+}
+
+func TestRosterPushAcknowledged(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(time.Minute, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	push := receiveIQ(t, iqs)
+	if push.ID == "" || tr.outstanding() != 1 {
+		t.Fatalf("push id %q, outstanding %d", push.ID, tr.outstanding())
+	}
+
+	result := stanza.NewIQ(stanza.IQResult)
+	result.ID = push.ID
+	if other, _ := iqPeer(t, "alice@example.com/laptop"); tr.ack(ctx, other, result) {
+		t.Fatal("ack accepted a result from another session")
+	}
+	if !tr.ack(ctx, session, result) {
+		t.Fatal("ack did not match the result")
+	}
+	if tr.ack(ctx, session, result) {
+		t.Fatal("ack matched the same result twice")
+	}
+	if tr.outstanding() != 0 || tr.unacknowledged() != 0 {
+		t.Fatalf("outstanding %d, unacknowledged %d", tr.outstanding(), tr.unacknowledged())
+	}
+}
+
+func TestRosterPushAckIgnoresRequests(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(time.Minute, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	push := receiveIQ(t, iqs)
+
+	get := stanza.NewIQ(stanza.IQGet)
+	get.ID = push.ID
+	if tr.ack(ctx, session, get) {
+		t.Fatal("ack consumed a get")
+	}
+	if tr.outstanding() != 1 {
+		t.Fatalf("outstanding = %d, want 1", tr.outstanding())
+	}
+}
+
+func TestRosterPushResentOnceThenCounted(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(20*time.Millisecond, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	first := receiveIQ(t, iqs)
+	again := receiveIQ(t, iqs)
+	if again.ID != first.ID {
+		t.Fatalf("resent id %q, want %q", again.ID, first.ID)
+	}
+	waitUnacked(t, tr, 1)
+	expectNoIQ(t, iqs, 60*time.Millisecond)
+	if tr.outstanding() != 0 {
+		t.Fatalf("outstanding = %d, want 0", tr.outstanding())
+	}
+}
+
+func TestRosterPushResultAfterResend(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(20*time.Millisecond, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	receiveIQ(t, iqs)
+	push := receiveIQ(t, iqs)
+	result := stanza.NewIQ(stanza.IQResult)
+	result.ID = push.ID
+	if !tr.ack(ctx, session, result) {
+		t.Fatal("ack did not match the resent push")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if tr.unacknowledged() != 0 {
+		t.Fatalf("unacknowledged = %d, want 0", tr.unacknowledged())
+	}
+}
+
+func TestRosterPushWithoutResend(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(20*time.Millisecond, false)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	receiveIQ(t, iqs)
+	waitUnacked(t, tr, 1)
+	expectNoIQ(t, iqs, 60*time.Millisecond)
+}
+
+func TestRosterPushForgottenWithSession(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(20*time.Millisecond, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	receiveIQ(t, iqs)
+	tr.forget(session)
+	expectNoIQ(t, iqs, 60*time.Millisecond)
+	if tr.outstanding() != 0 || tr.unacknowledged() != 0 {
+		t.Fatalf("outstanding %d, unacknowledged %d", tr.outstanding(), tr.unacknowledged())
+	}
+}
+
+func TestRosterPushTrackingDisabled(t *testing.T) {
+	ctx := context.Background()
+	tr := newPushTracker(0, true)
+	session, iqs := iqPeer(t, "alice@example.com/phone")
+
+	if err := tr.send(ctx, session, rosterPush()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if push := receiveIQ(t, iqs); push.ID == "" {
+		t.Fatal("push sent without an id")
+	}
+	if tr.outstanding() != 0 {
+		t.Fatalf("outstanding = %d, want 0", tr.outstanding())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalS2S routes stanzas to and from other servers; nil unless
+// XMPP_S2S is set.
+var globalS2S *xmpp.S2S
+
+func s2sConfig(cfg Config, tlsConfig *tls.Config) xmpp.S2SConfig {
+	return xmpp.S2SConfig{
+		Addr:          cfg.S2SAddr,
+		TLSConfig:     tlsConfig,
+		AllowInsecure: cfg.S2SInsecure,
+		Secret:        cfg.S2SSecret,
+		Handler:       xmpp.HandlerFunc(deliverRemote),
+	}
+}
+
+// isRemote reports whether j belongs to a domain served by another server,
+// or by a component.
+func isRemote(j jid.JID) bool {
+	if globalComponents.serves(j) {
+		return true
+	}
+	return globalS2S != nil && j.Domain() != "" && j.Domain() != globalS2S.Domain()
+}
+
+// sendRemote sends st to the server or component of its recipient. When
+// that fails, a message or request is bounced to source with
+// remote-server-not-found.
+func sendRemote(ctx context.Context, source *xmpp.Session, st stanza.Stanza) error {
+	var err error
+	if globalComponents.serves(st.GetHeader().To) {
+		err = globalComponents.send(ctx, st)
+	} else {
+		err = globalS2S.Send(ctx, st)
+	}
+	if err == nil || source == nil {
+		return err
+	}
+	logError(ctx, "s2s route error", "to", st.GetHeader().To, "error", err)
+	source.Metrics().RoutingFailed(stanza.ErrorRemoteServerNotFound)
+	stanzaErr := stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorRemoteServerNotFound, "")
+	switch v := st.(type) {
+	case *stanza.Message:
+		if v.Type == stanza.MessageError {
+			return nil
+		}
+		return source.Send(ctx, messageError(v, stanzaErr))
+	case *stanza.IQ:
+		if v.Type == stanza.IQGet || v.Type == stanza.IQSet {
+			return source.Send(ctx, v.ErrorIQ(stanzaErr))
+		}
+	}
+	return nil
+}
+
+func messageError(msg *stanza.Message, err *stanza.StanzaError) *stanza.Message {
+	reply := stanza.NewMessage(stanza.MessageError)
+	reply.ID = msg.ID
+	reply.From = msg.To
+	reply.To = msg.From
+	reply.Error = err
+	return reply
+}
+
+// deliverRemote delivers a stanza a remote server sent to a local user.
+func deliverRemote(ctx context.Context, session *xmpp.Session, st stanza.Stanza) error {
+	ctx = xmpp.WithTraceID(withSession(ctx, session), xmpp.NewTraceID())
+	h := st.GetHeader()
+	if stanzaErr := globalBlocking.check(ctx, h.From, h.To); stanzaErr != nil {
+		switch v := st.(type) {
+		case *stanza.Message:
+			if v.Type != stanza.MessageError {
+				return sendRemote(ctx, nil, messageError(v, stanzaErr))
+			}
+		case *stanza.IQ:
+			if v.Type == stanza.IQGet || v.Type == stanza.IQSet {
+				return sendRemote(ctx, nil, v.ErrorIQ(stanzaErr))
+			}
+		}
+		return nil
+	}
+	switch v := st.(type) {
+	case *stanza.Message:
+		if err := deliverMessage(ctx, v); errors.Is(err, errOfflineFull) {
+			return sendRemote(ctx, nil, messageError(v, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "offline storage full")))
+		} else if err != nil {
+			logError(ctx, "offline store error", "user", v.To.Bare(), "error", err)
+		}
+	case *stanza.Presence:
+		switch {
+		case v.Type == stanza.PresenceProbe:
+			answerRemoteProbe(ctx, v)
+		case isSubscription(v.Type):
+			if err := deliverSubscription(ctx, v); errors.Is(err, storage.ErrRosterLimit) {
+				return sendRemote(ctx, nil, presenceError(v, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "roster is full")))
+			}
+		default:
+			deliver(ctx, v.To, v)
+		}
+	case *stanza.IQ:
+		if globalNotifications.ack(ctx, v) {
+			return nil
+		}
+		if isAccount(v.To) {
+			if reply := answerPEP(ctx, v.From, v); reply != nil {
+				return sendRemote(ctx, nil, reply)
+			}
+			if reply := answerAccountInfo(v); reply != nil {
+				return sendRemote(ctx, nil, reply)
+			}
+		}
+		// Other servers and directories discover this one.
+		if globalS2S != nil && v.To.IsDomainOnly() && v.To.Domain() == globalS2S.Domain() {
+			if reply := answerServiceInfo(v); reply != nil {
+				return sendRemote(ctx, nil, reply)
+			}
+			if reply := answerServiceItems(v); reply != nil {
+				return sendRemote(ctx, nil, reply)
+			}
+		}
+		targets := globalRouter.targets(v.To)
+		if len(targets) == 0 && v.To.IsFull() && globalCluster.forward(ctx, v.To, v) {
+			return nil
+		}
+		if len(targets) == 0 || v.To.IsZero() || v.To.IsDomainOnly() {
+			if v.Type == stanza.IQGet || v.Type == stanza.IQSet {
+				return sendRemote(ctx, nil, v.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")))
+			}
+			return nil
+		}
+		if err := sendStanza(ctx, targets[0], v); err != nil {
+			logError(ctx, "iq route error", "to", targets[0].RemoteAddr(), "error", err)
+		}
+	}
+	return nil
+}
+
+// deliverMessage delivers msg, from another domain, to its local
+// recipient. It is kept offline when the recipient has no session here and
+// it reached none on another node.
+func deliverMessage(ctx context.Context, msg *stanza.Message) error {
+	delivered := globalArchive.archiveReceived(ctx, msg)
+	deliverLocal(ctx, msg.To, delivered)
+	forwarded := globalCluster.forward(ctx, msg.To, delivered)
+	if len(globalRouter.targets(msg.To.Bare())) == 0 && !forwarded {
+		_, err := globalOffline.keep(ctx, delivered)
+		return err
+	}
+	return nil
+}
+
+// deliver sends st to the sessions of to, on this node and the others of
+// the cluster.
+func deliver(ctx context.Context, to jid.JID, st stanza.Stanza) {
+	deliverLocal(ctx, to, st)
+	globalCluster.forward(ctx, to, st)
+}
+
+// deliverLocal sends st to the local sessions of to.
+func deliverLocal(ctx context.Context, to jid.JID, st stanza.Stanza) {
+	for _, dst := range globalRouter.targets(to) {
+		if err := sendStanza(ctx, dst, st); err != nil {
+			logError(ctx, "route error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// setupS2S federates example.com with no reachable remote servers.
+func setupS2S(t *testing.T) {
+	t.Helper()
+	x, err := xmpp.NewS2S("example.com", xmpp.S2SConfig{
+		Dial: func(context.Context, string) (*transport.TCP, error) {
+			return nil, errors.New("unreachable")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := globalS2S
+	globalS2S = x
+	t.Cleanup(func() { globalS2S = old; x.Close() })
+}
+
+func TestIsRemote(t *testing.T) {
+	if isRemote(jid.MustParse("bob@remote.example")) {
+		t.Fatal("remote JID without federation")
+	}
+	setupS2S(t)
+	tests := map[string]bool{
+		"bob@remote.example":   true,
+		"remote.example":       true,
+		"bob@example.com/desk": false,
+		"example.com":          false,
+	}
+	for s, want := range tests {
+		if got := isRemote(jid.MustParse(s)); got != want {
+			t.Errorf("isRemote(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestRouteMessageRemoteUnreachable(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	setupS2S(t)
+	alice, aliceMsgs := messagePeer(t, "alice@example.com/phone")
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.ID = "m1"
+	msg.To = jid.MustParse("bob@remote.example")
+	msg.SetBody("hello")
+	if err := routeMessage(ctx, alice, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	bounce := receiveMessage(t, aliceMsgs)
+	if bounce.Type != stanza.MessageError || bounce.ID != "m1" || bounce.Error == nil || bounce.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("bounce = %+v", bounce)
+	}
+	if bounce.From.String() != "bob@remote.example" {
+		t.Fatalf("bounce from %s", bounce.From)
+	}
+	if n, err := offline.CountOfflineMessages(ctx, "bob@remote.example"); err != nil || n != 0 {
+		t.Fatalf("remote message stored offline: %d, %v", n, err)
+	}
+}
+
+func TestDeliverRemote(t *testing.T) {
+	ctx := context.Background()
+	offline := setupOffline(t, Config{Domain: "example.com"})
+	setupS2S(t)
+	_, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From = jid.MustParse("alice@remote.example/phone")
+	msg.To = jid.MustParse("bob@example.com")
+	msg.SetBody("hello")
+	if err := deliverRemote(ctx, nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveMessage(t, bobMsgs); got.Body() != "hello" || got.From.String() != "alice@remote.example/phone" {
+		t.Fatalf("delivered %+v", got)
+	}
+
+	msg.To = jid.MustParse("carol@example.com")
+	if err := deliverRemote(ctx, nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := offline.CountOfflineMessages(ctx, "carol@example.com"); err != nil || n != 1 {
+		t.Fatalf("offline count = %d, %v", n, err)
+	}
+	expectNoMessage(t, bobMsgs)
+}
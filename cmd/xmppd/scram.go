@@ -1,41 +1,59 @@
 package main
 
 import (
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 
-	"golang.org/x/crypto/pbkdf2"
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
 )
 
-func hashPasswordSCRAMSHA256(password string, iterations int) (salt string, iters int, storedKey string, serverKey string, err error) {
-	saltBytes := make([]byte, 16)
-	if _, err = rand.Read(saltBytes); err != nil {
-		return
+// scramStoredMechanism is the SCRAM mechanism whose credentials are kept for
+// each account.
+const scramStoredMechanism = "SCRAM-SHA-256"
+
+// newUser returns the account record for username with SCRAM-SHA-256
+// credentials derived from password. The plaintext password is only kept
+// when keepPlaintext is set, for mechanisms that cannot use those
+// credentials.
+func newUser(username, password string, iterations int, keepPlaintext bool) (*storage.User, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
 	}
-
-	iters = iterations
-	saltedPwd := pbkdf2.Key([]byte(password), saltBytes, iters, sha256.Size, sha256.New)
-
-	clientKey := scramHMAC(sha256.New, saltedPwd, []byte("Client Key"))
-	sk := sha256Sum(clientKey)
-	srvKey := scramHMAC(sha256.New, saltedPwd, []byte("Server Key"))
-
-	salt = base64.StdEncoding.EncodeToString(saltBytes)
-	storedKey = base64.StdEncoding.EncodeToString(sk)
-	serverKey = base64.StdEncoding.EncodeToString(srvKey)
-	return
-}
-
-func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
-	mac := hmac.New(h, key)
-	mac.Write(data)
-	return mac.Sum(nil)
+	creds, err := sasl.NewSCRAMCredentials(scramStoredMechanism, password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	user := &storage.User{
+		Username:   username,
+		Salt:       base64.StdEncoding.EncodeToString(creds.Salt),
+		Iterations: creds.Iterations,
+		StoredKey:  base64.StdEncoding.EncodeToString(creds.StoredKey),
+		ServerKey:  base64.StdEncoding.EncodeToString(creds.ServerKey),
+	}
+	if keepPlaintext {
+		user.Password = password
+	}
+	return user, nil
 }
 
-func sha256Sum(data []byte) []byte {
-	h := sha256.Sum256(data)
-	return h[:]
+// storedCredentials decodes the SCRAM-SHA-256 credentials of user. ok is
+// false for accounts created before they were stored.
+func storedCredentials(user *storage.User) (creds sasl.SCRAMCredentials, ok bool) {
+	if user.Salt == "" || user.StoredKey == "" || user.ServerKey == "" || user.Iterations <= 0 {
+		return creds, false
+	}
+	var err error
+	if creds.Salt, err = base64.StdEncoding.DecodeString(user.Salt); err != nil {
+		return creds, false
+	}
+	if creds.StoredKey, err = base64.StdEncoding.DecodeString(user.StoredKey); err != nil {
+		return creds, false
+	}
+	if creds.ServerKey, err = base64.StdEncoding.DecodeString(user.ServerKey); err != nil {
+		return creds, false
+	}
+	creds.Iterations = user.Iterations
+	return creds, true
 }
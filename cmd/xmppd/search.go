@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"maps"
+	"slices"
+
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// globalSearch answers XEP-0055 searches of the user directory addressed to
+// the server. It is nil unless accounts were listed in XMPP_SEARCH_DIRECTORY;
+// no other account can be found.
+var globalSearch *search.Plugin
+
+func newSearchService(cfg Config) *search.Plugin {
+	if len(cfg.SearchDirectory) == 0 {
+		return nil
+	}
+	dir := search.NewMemoryDirectory()
+	for _, user := range slices.Sorted(maps.Keys(cfg.SearchDirectory)) {
+		dir.List(search.Entry{JID: accountJID(user, cfg.Domain), Nick: cfg.SearchDirectory[user]})
+	}
+	p := search.New()
+	p.SetDirectory(dir)
+	return p
+}
+
+// answerSearch returns the reply to a jabber:iq:search request, or nil when
+// iq is not one.
+func answerSearch(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil
+	}
+	if err := xml.Unmarshal(iq.Query, &search.Query{}); err != nil {
+		return nil
+	}
+	if globalSearch == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "user directory disabled"))
+	}
+	return globalSearch.HandleIQ(ctx, iq)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func searchIQ(t *testing.T, typ string, q search.Query) *stanza.IQ {
+	t.Helper()
+	payload, err := xml.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq := stanza.NewIQ(typ)
+	iq.Query = payload
+	return iq
+}
+
+func TestSearchDisabledByDefault(t *testing.T) {
+	globalSearch = newSearchService(Config{Domain: "example.com"})
+	reply := answerSearch(context.Background(), searchIQ(t, stanza.IQGet, search.Query{}))
+	if reply == nil || reply.Type != stanza.IQError {
+		t.Fatalf("reply = %+v, want error", reply)
+	}
+}
+
+func TestSearchFindsOnlyListedAccounts(t *testing.T) {
+	globalSearch = newSearchService(Config{
+		Domain:          "example.com",
+		SearchDirectory: map[string]string{"alice": "Alice"},
+	})
+	t.Cleanup(func() { globalSearch = nil })
+
+	nick := "ali"
+	reply := answerSearch(context.Background(), searchIQ(t, stanza.IQSet, search.Query{Nick: &nick}))
+	if reply == nil || reply.Type != stanza.IQResult {
+		t.Fatalf("reply = %+v", reply)
+	}
+	var q search.Query
+	if err := xml.Unmarshal(reply.Query, &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Items) != 1 || q.Items[0].JID != "alice@example.com" {
+		t.Fatalf("items = %+v", q.Items)
+	}
+}
+
+func TestAnswerSearchIgnoresOtherQueries(t *testing.T) {
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.Query = []byte("<query xmlns='jabber:iq:version'/>")
+	if reply := answerSearch(context.Background(), iq); reply != nil {
+		t.Fatalf("reply = %+v, want nil", reply)
+	}
+}
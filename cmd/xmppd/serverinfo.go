@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/serverinfo"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// globalServerInfo is the form of contact addresses (XEP-0157) and other
+// server information configured with XMPP_CONTACT_ADDRESSES and
+// XMPP_SERVER_INFO, served in the disco#info of the server. It is nil when
+// neither is set.
+var globalServerInfo *form.Form
+
+// newServerInfo returns the server information form of cfg, or nil when it
+// has none. Addresses and values are separated by spaces.
+func newServerInfo(cfg Config) (*form.Form, error) {
+	if len(cfg.ContactAddresses) == 0 && len(cfg.ServerInfo) == 0 {
+		return nil, nil
+	}
+	addrs := make(serverinfo.Addresses)
+	for typ, v := range cfg.ContactAddresses {
+		if !serverinfo.ValidType(typ) {
+			return nil, fmt.Errorf("unknown contact address type %q", typ)
+		}
+		addrs[typ] = strings.Fields(v)
+	}
+	var extra []form.Field
+	for _, name := range slices.Sorted(maps.Keys(cfg.ServerInfo)) {
+		typ, isAddress := strings.CutSuffix(name, "-addresses")
+		if name == "FORM_TYPE" || (isAddress && serverinfo.ValidType(typ)) {
+			return nil, fmt.Errorf("server info field %q is reserved", name)
+		}
+		extra = append(extra, form.Field{Var: name, Values: strings.Fields(cfg.ServerInfo[name])})
+	}
+	return serverinfo.Form(addrs, extra...), nil
+}
+
+// answerServiceInfo returns the disco#info of the server, with the
+// features of the services it runs on its own JID and the server
+// information form, or nil when iq is not a request for it.
+func answerServiceInfo(iq *stanza.IQ) *stanza.IQ {
+	var q disco.InfoQuery
+	if iq.Type != stanza.IQGet || xml.Unmarshal(iq.Query, &q) != nil || q.Node != "" {
+		return nil
+	}
+	info := disco.InfoQuery{Identities: []disco.Identity{{Category: "server", Type: "im"}}}
+	features := []string{ns.DiscoInfo, ns.DiscoItems, ns.Carbons}
+	if globalBlocking != nil {
+		features = append(features, ns.Blocking)
+	}
+	if globalCommands != nil {
+		features = append(features, ns.Commands)
+	}
+	if globalSearch != nil {
+		features = append(features, ns.Search)
+	}
+	if globalExtDisco != nil {
+		features = append(features, ns.ExtDisco)
+	}
+	for _, f := range features {
+		info.Features = append(info.Features, disco.Feature{Var: f})
+	}
+	if globalServerInfo != nil {
+		info.Forms = append(info.Forms, *globalServerInfo)
+	}
+	return payloadIQ(iq, info)
+}
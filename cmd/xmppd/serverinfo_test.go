@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/serverinfo"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestNewServerInfo(t *testing.T) {
+	if f, err := newServerInfo(Config{}); f != nil || err != nil {
+		t.Fatalf("without configuration = %+v, %v", f, err)
+	}
+	if _, err := newServerInfo(Config{ContactAddresses: map[string]string{"ceo": "mailto:ceo@example.com"}}); err == nil {
+		t.Fatal("unknown address type accepted")
+	}
+	if _, err := newServerInfo(Config{ServerInfo: map[string]string{"abuse-addresses": "mailto:x@example.com"}}); err == nil {
+		t.Fatal("address field accepted as server info")
+	}
+}
+
+func TestServiceInfo(t *testing.T) {
+	f, err := newServerInfo(Config{
+		ContactAddresses: map[string]string{"abuse": "mailto:abuse@example.com xmpp:abuse@example.com", "support": "https://example.com/help"},
+		ServerInfo:       map[string]string{"x-location": "EU"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := globalServerInfo
+	globalServerInfo = f
+	t.Cleanup(func() { globalServerInfo = old })
+	romeo := newOrderedPeer(t, "romeo@example.com/orchard")
+
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(romeo.request(t, stanza.IQGet, "example.com", `<query xmlns='`+ns.DiscoInfo+`'/>`).Query, &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Identities) != 1 || info.Identities[0].Category != "server" || info.Identities[0].Type != "im" {
+		t.Fatalf("identities = %+v", info.Identities)
+	}
+	if !slices.Contains(info.Features, disco.Feature{XMLName: xml.Name{Space: ns.DiscoInfo, Local: "feature"}, Var: ns.Carbons}) {
+		t.Fatalf("features = %+v", info.Features)
+	}
+	addrs, ok := serverinfo.Parse(info.Forms)
+	if !ok || strings.Join(addrs[serverinfo.Abuse], " ") != "mailto:abuse@example.com xmpp:abuse@example.com" || addrs[serverinfo.Support][0] != "https://example.com/help" {
+		t.Fatalf("addresses = %v, %v", addrs, ok)
+	}
+	if v := info.Forms[0].GetValue("x-location"); v != "EU" {
+		t.Fatalf("x-location = %q", v)
+	}
+
+	// A node is not the server's own disco#info.
+	if reply := romeo.request(t, stanza.IQGet, "example.com", `<query xmlns='`+ns.DiscoInfo+`' node='urn:example'/>`); reply.Type != stanza.IQError {
+		t.Fatalf("node info = %+v", reply)
+	}
+}
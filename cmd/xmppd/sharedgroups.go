@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/cache"
+)
+
+// globalSharedGroups manages the shared roster groups, whose members have
+// each other in their rosters. It is nil when the storage has no shared
+// groups or no rosters.
+var globalSharedGroups *sharedGroupService
+
+// errInvalidMember is returned for a member that is not a local account.
+var errInvalidMember = errors.New("members must be local accounts")
+
+// errInvalidGroupName is returned for an empty group name.
+var errInvalidGroupName = errors.New("invalid group name")
+
+type sharedGroupService struct {
+	domain string
+	groups storage.SharedGroupStore
+	roster storage.RosterStore
+}
+
+func newSharedGroupService(cfg Config, store storage.Storage) *sharedGroupService {
+	if store == nil || store.SharedGroupStore() == nil || store.RosterStore() == nil {
+		return nil
+	}
+	return &sharedGroupService{domain: cfg.Domain, groups: store.SharedGroupStore(), roster: store.RosterStore()}
+}
+
+// member returns the bare JID of a member, which must be a local account.
+func (s *sharedGroupService) member(v string) (string, error) {
+	j, err := jid.Parse(strings.TrimSpace(v))
+	if err != nil || j.Local() == "" || j.Domain() != s.domain {
+		return "", errInvalidMember
+	}
+	return j.Bare().String(), nil
+}
+
+// shared reports whether user and contact are in a shared group together,
+// so that their subscriptions cannot be cancelled.
+func (s *sharedGroupService) shared(ctx context.Context, user, contact jid.JID) bool {
+	if s == nil || user.Domain() != s.domain || contact.Domain() != s.domain {
+		return false
+	}
+	groups, err := s.groups.GetMemberSharedGroups(ctx, user.Bare().String())
+	if err != nil {
+		logError(ctx, "shared group error", "user", user, "error", err)
+		return false
+	}
+	for _, g := range groups {
+		if slices.Contains(g.Members, contact.Bare().String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sharedGroupService) list(ctx context.Context) ([]*storage.SharedGroup, error) {
+	return s.groups.ListSharedGroups(ctx)
+}
+
+// set creates a group or replaces its display name and members.
+func (s *sharedGroupService) set(ctx context.Context, name, display string, members []string) (*storage.SharedGroup, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errInvalidGroupName
+	}
+	group := &storage.SharedGroup{Name: name, Display: strings.TrimSpace(display)}
+	for _, v := range members {
+		m, err := s.member(v)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(group.Members, m) {
+			group.Members = append(group.Members, m)
+		}
+	}
+	slices.Sort(group.Members)
+
+	var affected []string
+	switch old, err := s.groups.GetSharedGroup(ctx, name); {
+	case err == nil:
+		affected = old.Members
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	if err := s.groups.SetSharedGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	for _, m := range group.Members {
+		if !slices.Contains(affected, m) {
+			affected = append(affected, m)
+		}
+	}
+	s.changed(ctx, affected, "")
+	return group, nil
+}
+
+// delete removes a group; its members drop out of each other's rosters
+// unless they share another group or subscribed to each other.
+func (s *sharedGroupService) delete(ctx context.Context, name string) error {
+	group, err := s.groups.GetSharedGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := s.groups.DeleteSharedGroup(ctx, name); err != nil {
+		return err
+	}
+	s.changed(ctx, group.Members, "")
+	return nil
+}
+
+func (s *sharedGroupService) addMember(ctx context.Context, name, member string) error {
+	m, err := s.member(member)
+	if err != nil {
+		return err
+	}
+	if err := s.groups.AddSharedGroupMember(ctx, name, m); err != nil {
+		return err
+	}
+	group, err := s.groups.GetSharedGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	s.changed(ctx, group.Members, m)
+	return nil
+}
+
+func (s *sharedGroupService) removeMember(ctx context.Context, name, member string) error {
+	m, err := s.member(member)
+	if err != nil {
+		return err
+	}
+	group, err := s.groups.GetSharedGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(group.Members, m) {
+		return nil
+	}
+	if err := s.groups.RemoveSharedGroupMember(ctx, name, m); err != nil {
+		return err
+	}
+	s.changed(ctx, group.Members, m)
+	return nil
+}
+
+// coMembers returns the members of the groups of member, member included.
+func (s *sharedGroupService) coMembers(ctx context.Context, member string) []string {
+	if s == nil {
+		return nil
+	}
+	groups, err := s.groups.GetMemberSharedGroups(ctx, member)
+	if err != nil {
+		logError(ctx, "shared group error", "user", member, "error", err)
+		return nil
+	}
+	var members []string
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if !slices.Contains(members, m) {
+				members = append(members, m)
+			}
+		}
+	}
+	return members
+}
+
+// changed brings the rosters of members up to date after the groups they
+// share changed: between every pair of them or, if member is set, between
+// member and each of the others.
+func (s *sharedGroupService) changed(ctx context.Context, members []string, member string) {
+	if s == nil {
+		return
+	}
+	for _, m := range members {
+		if globalStorageCache != nil {
+			globalStorageCache.Invalidate(cache.KindRoster, m)
+		}
+		globalCluster.invalidate(cache.KindRoster, m)
+	}
+	for _, user := range members {
+		for _, contact := range members {
+			if user != contact && (member == "" || user == member || contact == member) {
+				s.update(ctx, user, contact)
+			}
+		}
+	}
+}
+
+// update pushes the roster item of contact to the online resources of user,
+// or its removal, and shows or hides the presence of user to contact.
+func (s *sharedGroupService) update(ctx context.Context, userJID, contactJID string) {
+	user, err := jid.Parse(userJID)
+	if err != nil || len(globalRouter.targets(user)) == 0 {
+		return
+	}
+	contact, err := jid.Parse(contactJID)
+	if err != nil {
+		return
+	}
+	push := roster.Item{JID: contactJID, Subscription: roster.SubRemove}
+	stored, err := s.roster.GetRosterItem(ctx, userJID, contactJID)
+	switch {
+	case err == nil:
+		push = roster.Item{JID: contactJID, Name: stored.Name, Subscription: stored.Subscription, Ask: stored.Ask, Groups: stored.Groups}
+	case !errors.Is(err, storage.ErrNotFound):
+		logError(ctx, "shared group error", "user", userJID, "error", err)
+		return
+	}
+	ver, err := s.roster.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		logError(ctx, "shared group error", "user", userJID, "error", err)
+		return
+	}
+	if err := pushRosterItem(ctx, userJID, ver, push); err != nil {
+		logError(ctx, "roster push error", "user", userJID, "error", err)
+	}
+	if stored != nil && roster.SendsPresenceTo(stored.Subscription) {
+		for _, own := range globalPresence.of(user) {
+			presenceTo(ctx, own, contact)
+		}
+	} else {
+		hidePresence(ctx, user, contact)
+	}
+}
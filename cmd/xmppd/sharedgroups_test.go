@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupSharedGroups installs a roster with shared groups over a memory
+// store for the duration of t and returns the store under the groups.
+func setupSharedGroups(t *testing.T) storage.Storage {
+	t.Helper()
+	cfg := Config{Domain: "example.com"}
+	backend := memory.New()
+	store := storage.ShareRosterGroups(backend)
+	setupRoster(t, cfg, store)
+	old := globalSharedGroups
+	globalSharedGroups = newSharedGroupService(cfg, store)
+	t.Cleanup(func() { globalSharedGroups = old })
+	return backend
+}
+
+func TestSharedGroupRoster(t *testing.T) {
+	ctx := context.Background()
+	backend := setupSharedGroups(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+
+	if _, err := globalSharedGroups.set(ctx, "staff", "Staff", []string{"alice@example.com", "bob@example.com", "carol@elsewhere.example"}); !errors.Is(err, errInvalidMember) {
+		t.Fatalf("set with a remote member: %v", err)
+	}
+	if _, err := globalSharedGroups.set(ctx, "staff", "Staff", []string{"bob@example.com", "alice@example.com/phone"}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	push := rosterQuery(t, alice.iq(t))
+	if len(push.Items) != 1 || push.Items[0].JID != "bob@example.com" || push.Items[0].Subscription != roster.SubBoth || !slices.Equal(push.Items[0].Groups, []string{"Staff"}) {
+		t.Fatalf("push = %+v", push)
+	}
+	q := rosterQuery(t, alice.request(t, stanza.IQGet, "", `<query xmlns='jabber:iq:roster'/>`))
+	if q.Ver != push.Ver || len(q.Items) != 1 || q.Items[0].JID != "bob@example.com" {
+		t.Fatalf("roster = %+v", q)
+	}
+
+	// Shared contacts cannot be removed or unsubscribed from.
+	reply := alice.request(t, stanza.IQSet, "", `<query xmlns='jabber:iq:roster'><item jid='bob@example.com' subscription='remove'/></query>`)
+	if reply.Type != stanza.IQError || !strings.Contains(string(reply.Query), "<not-allowed") {
+		t.Fatalf("remove = %+v", reply)
+	}
+	pres := stanza.NewPresence(stanza.PresenceUnsubscribe)
+	pres.To = jid.MustParse("bob@example.com")
+	if err := routePresence(ctx, alice.session, pres); err != nil {
+		t.Fatal(err)
+	}
+	alice.quiet(t)
+	if _, err := backend.RosterStore().GetRosterItem(ctx, "alice@example.com", "bob@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("unsubscribe was stored: %v", err)
+	}
+
+	// Leaving the group removes bob.
+	if err := globalSharedGroups.removeMember(ctx, "staff", "bob@example.com"); err != nil {
+		t.Fatalf("removeMember: %v", err)
+	}
+	if push := rosterQuery(t, alice.iq(t)); len(push.Items) != 1 || push.Items[0].Subscription != roster.SubRemove {
+		t.Fatalf("push = %+v", push)
+	}
+	if err := globalSharedGroups.addMember(ctx, "nope", "bob@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("addMember to a missing group: %v", err)
+	}
+	if err := globalSharedGroups.addMember(ctx, "staff", "bob@example.com"); err != nil {
+		t.Fatalf("addMember: %v", err)
+	}
+	if push := rosterQuery(t, alice.iq(t)); len(push.Items) != 1 || push.Items[0].Subscription != roster.SubBoth {
+		t.Fatalf("push = %+v", push)
+	}
+	if err := globalSharedGroups.delete(ctx, "staff"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if push := rosterQuery(t, alice.iq(t)); len(push.Items) != 1 || push.Items[0].Subscription != roster.SubRemove {
+		t.Fatalf("push = %+v", push)
+	}
+}
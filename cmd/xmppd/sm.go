@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// globalSM holds the XEP-0198 stream management sessions of clients. A
+// stream that breaks stays resumable for the resumption timeout: its
+// resource remains available, and the stanzas the client did not
+// acknowledge wait for a new stream to resume it. Messages for the resource
+// meanwhile are kept offline. When the timeout passes, or a stream ends
+// without resumption, the unacknowledged messages are kept offline too.
+var globalSM = newSMService()
+
+type smService struct {
+	mu         sync.Mutex
+	timeout    time.Duration
+	maxStanzas int
+	maxBytes   int
+	streams    map[*xmpp.Session]*smStream
+	resumable  map[string]*smStream // by resumption ID
+	// replaced are the sessions whose stream was resumed on another one
+	// before they noticed the connection broke.
+	replaced map[*xmpp.Session]bool
+}
+
+// smStream is a stream management session, bound to session or, while it
+// waits for resumption, to none.
+type smStream struct {
+	id      string
+	full    jid.JID
+	state   *xmpp.StreamMgmt
+	session *xmpp.Session
+	closed  bool        // the client closed the stream, which ends it
+	carbons bool        // whether the resource had carbons enabled
+	expiry  *time.Timer // running while detached
+	breaks  int         // times the stream broke, telling expiry timers apart
+}
+
+func newSMService() *smService {
+	return &smService{
+		timeout:    defaultSMResumeTimeout,
+		maxStanzas: sm.DefaultMaxUnacked,
+		maxBytes:   sm.DefaultMaxUnackedBytes,
+		streams:    make(map[*xmpp.Session]*smStream),
+		resumable:  make(map[string]*smStream),
+		replaced:   make(map[*xmpp.Session]bool),
+	}
+}
+
+// defaultSMResumeTimeout is how long a broken stream stays resumable.
+const defaultSMResumeTimeout = 5 * time.Minute
+
+// configure applies the stream management settings of cfg to the streams
+// that enable it from now on.
+func (s *smService) configure(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout = cfg.SMResumeTimeout
+	s.maxStanzas, s.maxBytes = cfg.SMMaxUnacked, cfg.SMMaxUnackedBytes
+}
+
+func (s *smService) lookup(session *xmpp.Session) *smStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[session]
+}
+
+// handleSM processes a stream management element from the client of
+// session.
+func handleSM(ctx context.Context, session *xmpp.Session, authenticatedUser string, reader *xmppxml.StreamReader, start *xml.StartElement) error {
+	switch start.Name.Local {
+	case "enable":
+		var req sm.Enable
+		if err := reader.DecodeElement(&req, start); err != nil {
+			return err
+		}
+		return globalSM.enable(ctx, session, req)
+	case "resume":
+		var req sm.Resume
+		if err := reader.DecodeElement(&req, start); err != nil {
+			return err
+		}
+		return globalSM.resume(ctx, session, authenticatedUser, req)
+	}
+	if st := globalSM.lookup(session); st != nil {
+		return st.state.Handle(start)
+	}
+	return reader.Skip()
+}
+
+func smFailed(ctx context.Context, session *xmpp.Session, condition string) error {
+	return session.SendElement(ctx, sm.Failed{Condition: sm.NewCondition(condition)})
+}
+
+// enable starts stream management on session once it has bound a
+// resource, resumable unless the timeout is zero.
+func (s *smService) enable(ctx context.Context, session *xmpp.Session, req sm.Enable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session.State()&xmpp.StateBound == 0 || s.streams[session] != nil {
+		return smFailed(ctx, session, stanza.ErrorUnexpectedRequest)
+	}
+	st := &smStream{full: session.RemoteAddr(), session: session}
+	enabled := sm.Enabled{}
+	// The data of a guest is erased when its stream ends, so it cannot be
+	// resumed.
+	if req.Resume && s.timeout > 0 && !globalGuests.is(session) {
+		st.id = randomStreamID()
+		enabled.ID, enabled.Resume, enabled.Max = st.id, true, int(s.timeout/time.Second)
+	}
+	state, err := session.EnableStreamMgmt(enabled, s.maxStanzas, s.maxBytes)
+	if err != nil {
+		return err
+	}
+	st.state = state
+	s.streams[session] = st
+	if st.id != "" {
+		s.resumable[st.id] = st
+	}
+	return nil
+}
+
+// resume moves the stream management session the client of session asks
+// for onto it, in place of binding a resource. A session whose old stream
+// is still open takes it over; that stream is closed.
+func (s *smService) resume(ctx context.Context, session *xmpp.Session, username string, req sm.Resume) error {
+	if username == "" {
+		username = session.RemoteAddr().Local()
+	}
+	state := session.State()
+	if state&xmpp.StateAuthenticated == 0 || state&xmpp.StateBound != 0 {
+		return smFailed(ctx, session, stanza.ErrorUnexpectedRequest)
+	}
+	s.mu.Lock()
+	st := s.resumable[req.PrevID]
+	if st == nil || st.full.Local() != username {
+		s.mu.Unlock()
+		return smFailed(ctx, session, stanza.ErrorItemNotFound)
+	}
+	old := st.session
+	if old != nil {
+		delete(s.streams, old)
+		s.replaced[old] = true
+		st.carbons = globalCarbons.isEnabled(old)
+	}
+	if st.expiry != nil {
+		st.expiry.Stop()
+		st.expiry = nil
+	}
+	st.session = session
+	s.streams[session] = st
+	s.mu.Unlock()
+
+	if old != nil {
+		_ = old.SendStreamError(ctx, stream.NewError(stream.ErrConflict, "stream resumed elsewhere"))
+		_ = old.Close()
+	}
+	session.SetRemoteAddr(st.full)
+	session.SetState(xmpp.StateBound | xmpp.StateReady)
+	globalCarbons.set(session, st.carbons)
+	if err := st.state.Resume(session, req.H); err != nil {
+		return err
+	}
+	globalRouter.register(st.full, session)
+
+	// Messages kept offline while the stream was broken.
+	for _, pres := range globalPresence.of(st.full.Bare()) {
+		if pres.From.Equal(st.full) && pres.Priority >= 0 {
+			return globalOffline.deliver(ctx, session, st.full.Bare())
+		}
+	}
+	return nil
+}
+
+// received counts a stanza handled from the client of session.
+func (s *smService) received(session *xmpp.Session) {
+	if st := s.lookup(session); st != nil {
+		st.state.Received()
+	}
+}
+
+// closed records that the client of session closed its stream, which ends
+// stream management rather than leaving it to be resumed.
+func (s *smService) closed(session *xmpp.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[session]; st != nil {
+		st.closed = true
+	}
+}
+
+// detach unbinds the stream management session of session, whose stream
+// has ended, and reports whether its resource lives on: when the stream
+// may be resumed, or already was. The resource then stays available but
+// is no longer routed to. Otherwise the messages the stream left
+// unacknowledged are kept offline.
+func (s *smService) detach(ctx context.Context, session *xmpp.Session) bool {
+	s.mu.Lock()
+	if s.replaced[session] {
+		delete(s.replaced, session)
+		s.mu.Unlock()
+		return true
+	}
+	st := s.streams[session]
+	if st == nil {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.streams, session)
+	st.session = nil
+	if !st.state.Detach(session) || st.closed || s.timeout <= 0 {
+		delete(s.resumable, st.id)
+		s.mu.Unlock()
+		keepUnacked(ctx, st)
+		return false
+	}
+	st.carbons = globalCarbons.isEnabled(session)
+	// Messages for the resource are kept offline until it is resumed.
+	globalRouter.unregister(st.full)
+	st.breaks++
+	breaks := st.breaks
+	st.expiry = time.AfterFunc(s.timeout, func() { s.expire(st, breaks) })
+	s.mu.Unlock()
+	return true
+}
+
+// expire ends the stream management session st once it was not resumed in
+// time: its unacknowledged messages are kept offline and its resource
+// becomes unavailable, unless a new stream bound it meanwhile.
+func (s *smService) expire(st *smStream, breaks int) {
+	s.mu.Lock()
+	if st.expiry == nil || st.breaks != breaks {
+		s.mu.Unlock()
+		return
+	}
+	st.expiry = nil
+	delete(s.resumable, st.id)
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	keepUnacked(ctx, st)
+	if len(globalRouter.targets(st.full)) == 0 {
+		pres := stanza.NewPresence(stanza.PresenceUnavailable)
+		pres.From = st.full
+		broadcastPresence(ctx, nil, pres)
+	}
+}
+
+// keepUnacked keeps the messages the client of st did not acknowledge
+// offline. Carbon copies are left out, as the message they copy reached
+// its recipient.
+func keepUnacked(ctx context.Context, st *smStream) {
+	for _, data := range st.state.Unacked() {
+		var msg stanza.Message
+		if xml.Unmarshal(data, &msg) != nil || msg.From.Bare().Equal(st.full.Bare()) {
+			continue
+		}
+		keepOffline(ctx, &msg)
+	}
+}
+
+// overflowed handles a stanza that could not be sent to dst because its
+// client left too many unacknowledged. The session is ended, to be resumed
+// once the client catches up, and a message is kept offline.
+func overflowed(ctx context.Context, dst *xmpp.Session, st stanza.Stanza) {
+	if msg, ok := st.(*stanza.Message); ok {
+		keepOffline(ctx, msg)
+	}
+	_ = dst.SendStreamError(ctx, stream.NewError(stream.ErrPolicyViolation, "too many unacknowledged stanzas"))
+	_ = dst.Close()
+}
+
+// keepOffline keeps msg offline for a recipient whose session did not
+// take it. Like routeMessage, it answers the sender with service-unavailable
+// when the recipient's offline storage is full; the sender's session is
+// not at hand, so the error is routed to it.
+func keepOffline(ctx context.Context, msg *stanza.Message) {
+	_, err := globalOffline.keep(ctx, msg)
+	if errors.Is(err, errOfflineFull) && !msg.From.IsZero() {
+		bounce := messageError(msg, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "offline storage full"))
+		if isRemote(bounce.To) {
+			err = sendRemote(ctx, nil, bounce)
+		} else {
+			deliver(ctx, bounce.To, bounce)
+			err = nil
+		}
+	}
+	if err != nil {
+		logError(ctx, "offline store error", "user", msg.To.Bare(), "error", err)
+	}
+}
+
+func writeSMFeature(writer *xmppxml.StreamWriter) error {
+	feature := xml.StartElement{Name: xml.Name{Space: ns.SM, Local: "sm"}}
+	if err := writer.EncodeToken(feature); err != nil {
+		return err
+	}
+	return writer.EncodeToken(xml.EndElement{Name: feature.Name})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+const smClientHeader = `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' to='example.com' version='1.0'>`
+
+// setupSM installs a stream management service resuming streams for
+// timeout, and offline storage, for the duration of t.
+func setupSM(t *testing.T, timeout time.Duration) storage.OfflineStore {
+	t.Helper()
+	old := globalSM
+	globalSM = newSMService()
+	globalSM.configure(Config{SMResumeTimeout: timeout, SMMaxUnacked: 100})
+	t.Cleanup(func() {
+		globalSM.mu.Lock()
+		for _, st := range globalSM.resumable {
+			if st.expiry != nil {
+				st.expiry.Stop()
+			}
+		}
+		globalSM.mu.Unlock()
+		globalSM = old
+	})
+	return setupOffline(t, Config{Domain: "example.com"})
+}
+
+// smElement is an element the server wrote to a client.
+type smElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (e smElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// smClient is a client of alice's, authenticated, on a stream served by
+// serveSession.
+type smClient struct {
+	conn    net.Conn
+	out     chan string
+	written chan struct{}
+	in      chan smElement
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newSMClient(t *testing.T) *smClient {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	session, err := xmpp.NewSession(context.Background(), transport.NewTCP(c1),
+		xmpp.WithRemoteAddr(jid.MustParse("alice@example.com")),
+		xmpp.WithState(xmpp.StateServer|xmpp.StateSecure|xmpp.StateAuthenticated))
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	c := &smClient{
+		conn:    c2,
+		out:     make(chan string, 16),
+		written: make(chan struct{}),
+		in:      make(chan smElement, 32),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		serveSession(context.Background(), session, Config{Domain: "example.com"}, nil, memory.New())
+		session.Close()
+		close(c.done)
+	}()
+	go func() {
+		defer close(c.written)
+		for data := range c.out {
+			if _, err := c2.Write([]byte(data)); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		dec := xml.NewDecoder(c2)
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			e := smElement{XMLName: start.Name}
+			if start.Name.Local != "stream" {
+				if dec.DecodeElement(&e, &start) != nil {
+					return
+				}
+			}
+			c.in <- e
+		}
+	}()
+	t.Cleanup(func() { c.drop() })
+	c.send(smClientHeader)
+	c.next(t, "stream")
+	if features := c.next(t, "features"); !strings.Contains(features.Inner, "urn:xmpp:sm:3") {
+		t.Fatalf("features %s", features.Inner)
+	}
+	return c
+}
+
+func (c *smClient) send(data string) { c.out <- data }
+
+func (c *smClient) next(t *testing.T, local string) smElement {
+	t.Helper()
+	select {
+	case e := <-c.in:
+		if e.XMLName.Local != local {
+			t.Fatalf("got <%s>%s, want <%s>", e.XMLName.Local, e.Inner, local)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no <%s> received", local)
+		return smElement{}
+	}
+}
+
+// drop breaks the connection, once what was sent is written, and waits for
+// the server to notice.
+func (c *smClient) drop() {
+	c.once.Do(func() {
+		close(c.out)
+		<-c.written
+		c.conn.Close()
+	})
+	<-c.done
+}
+
+// bindAndEnable binds the resource phone, enables resumable stream
+// management and sends available presence. It returns the resumption ID.
+func (c *smClient) bindAndEnable(t *testing.T) string {
+	t.Helper()
+	c.send(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><resource>phone</resource></bind></iq>`)
+	if iq := c.next(t, "iq"); iq.attr("type") != "result" {
+		t.Fatalf("bind %+v %s", iq.Attrs, iq.Inner)
+	}
+	c.send(`<enable xmlns='urn:xmpp:sm:3' resume='true'/>`)
+	enabled := c.next(t, "enabled")
+	if enabled.attr("resume") != "true" || enabled.attr("id") == "" {
+		t.Fatalf("enabled %+v", enabled.Attrs)
+	}
+	c.send(`<presence/>`)
+	waitFor(t, func() bool { return len(globalPresence.of(jid.MustParse("alice@example.com"))) == 1 })
+	return enabled.attr("id")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSMResume(t *testing.T) {
+	offline := setupSM(t, time.Minute)
+	ctx := context.Background()
+	alice := jid.MustParse("alice@example.com/phone")
+	t.Cleanup(func() { globalPresence.remove(alice) })
+	bob, _ := messagePeer(t, "bob@example.com/desk")
+
+	c := newSMClient(t)
+	id := c.bindAndEnable(t)
+	chat(t, bob, alice.String(), "one")
+	if msg := c.next(t, "message"); !strings.Contains(msg.Inner, "one") {
+		t.Fatalf("message %s", msg.Inner)
+	}
+	c.next(t, "r")
+	c.send(`<r xmlns='urn:xmpp:sm:3'/>`)
+	if a := c.next(t, "a"); a.attr("h") != "1" {
+		t.Fatalf("a %+v, want the presence handled", a.Attrs)
+	}
+
+	// The connection breaks: alice stays available, and messages for her
+	// are kept offline until she resumes.
+	c.drop()
+	if len(globalRouter.targets(alice)) != 0 || len(globalPresence.of(alice.Bare())) != 1 {
+		t.Fatal("detached resource still routed or no longer available")
+	}
+	chat(t, bob, alice.String(), "two")
+	if n, _ := offline.CountOfflineMessages(ctx, "alice@example.com"); n != 1 {
+		t.Fatalf("%d offline messages", n)
+	}
+
+	resumed := newSMClient(t)
+	resumed.send(`<resume xmlns='urn:xmpp:sm:3' previd='` + id + `' h='0'/>`)
+	if r := resumed.next(t, "resumed"); r.attr("previd") != id || r.attr("h") != "1" {
+		t.Fatalf("resumed %+v", r.Attrs)
+	}
+	if msg := resumed.next(t, "message"); !strings.Contains(msg.Inner, "one") {
+		t.Fatalf("resent %s", msg.Inner)
+	}
+	resumed.next(t, "r")
+	if msg := resumed.next(t, "message"); !strings.Contains(msg.Inner, "two") {
+		t.Fatalf("offline message %s", msg.Inner)
+	}
+	if targets := globalRouter.targets(alice); len(targets) != 1 {
+		t.Fatalf("%d sessions routed after resuming", len(targets))
+	}
+
+	// A stream is resumed once.
+	again := newSMClient(t)
+	again.send(`<resume xmlns='urn:xmpp:sm:3' previd='unknown' h='0'/>`)
+	if failed := again.next(t, "failed"); !strings.Contains(failed.Inner, "item-not-found") {
+		t.Fatalf("failed %s", failed.Inner)
+	}
+}
+
+func TestSMExpiryKeepsUnackedOffline(t *testing.T) {
+	offline := setupSM(t, time.Minute)
+	ctx := context.Background()
+	alice := jid.MustParse("alice@example.com/phone")
+	t.Cleanup(func() { globalPresence.remove(alice) })
+	bob, _ := messagePeer(t, "bob@example.com/desk")
+
+	c := newSMClient(t)
+	id := c.bindAndEnable(t)
+	chat(t, bob, alice.String(), "unacked")
+	c.next(t, "message")
+	c.drop()
+
+	// The timeout passes.
+	globalSM.mu.Lock()
+	st := globalSM.resumable[id]
+	st.expiry.Stop()
+	globalSM.mu.Unlock()
+	globalSM.expire(st, st.breaks)
+
+	if len(globalPresence.of(alice.Bare())) != 0 {
+		t.Fatal("resource still available")
+	}
+	msgs, err := offline.GetOfflineMessages(ctx, "alice@example.com")
+	if err != nil || len(msgs) != 1 || !strings.Contains(string(msgs[0].Data), "unacked") {
+		t.Fatalf("offline messages %v: %v", msgs, err)
+	}
+}
+
+func TestSMExpiryBouncesWhenOfflineFull(t *testing.T) {
+	offline := setupSM(t, time.Minute)
+	globalOffline.quota = 1
+	ctx := context.Background()
+	alice := jid.MustParse("alice@example.com/phone")
+	t.Cleanup(func() { globalPresence.remove(alice) })
+	bob, bobMsgs := messagePeer(t, "bob@example.com/desk")
+
+	c := newSMClient(t)
+	id := c.bindAndEnable(t)
+	chat(t, bob, alice.String(), "unacked")
+	c.next(t, "message")
+	c.drop()
+	// Another node of the cluster filled alice's offline storage meanwhile.
+	err := offline.StoreOfflineMessage(ctx, &storage.OfflineMessage{ID: "other", UserJID: "alice@example.com", Data: []byte("<message/>"), CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	globalSM.mu.Lock()
+	st := globalSM.resumable[id]
+	st.expiry.Stop()
+	globalSM.mu.Unlock()
+	globalSM.expire(st, st.breaks)
+
+	bounce := receiveMessage(t, bobMsgs)
+	if bounce.Type != stanza.MessageError || bounce.Error == nil || bounce.Error.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("bounce = %+v", bounce)
+	}
+	if n, _ := offline.CountOfflineMessages(ctx, "alice@example.com"); n != 1 {
+		t.Fatalf("%d offline messages, want the one kept meanwhile", n)
+	}
+}
+
+func TestSMClosedStreamIsNotResumable(t *testing.T) {
+	offline := setupSM(t, time.Minute)
+	ctx := context.Background()
+	alice := jid.MustParse("alice@example.com/phone")
+	t.Cleanup(func() { globalPresence.remove(alice) })
+	bob, _ := messagePeer(t, "bob@example.com/desk")
+
+	c := newSMClient(t)
+	id := c.bindAndEnable(t)
+	chat(t, bob, alice.String(), "unacked")
+	c.next(t, "message")
+	c.send(`</stream:stream>`)
+	c.drop()
+
+	if len(globalPresence.of(alice.Bare())) != 0 {
+		t.Fatal("resource still available")
+	}
+	if n, _ := offline.CountOfflineMessages(ctx, "alice@example.com"); n != 1 {
+		t.Fatalf("%d offline messages", n)
+	}
+	again := newSMClient(t)
+	again.send(`<resume xmlns='urn:xmpp:sm:3' previd='` + id + `' h='0'/>`)
+	again.next(t, "failed")
+}
+
+func TestSMEnableBeforeBind(t *testing.T) {
+	setupSM(t, time.Minute)
+	c := newSMClient(t)
+	c.send(`<enable xmlns='urn:xmpp:sm:3'/>`)
+	if failed := c.next(t, "failed"); !strings.Contains(failed.Inner, "unexpected-request") {
+		t.Fatalf("failed %s", failed.Inner)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	xmpp "github.com/meszmate/xmpp-go"
 	"github.com/meszmate/xmpp-go/internal/ns"
@@ -41,6 +45,7 @@ func (r *sessionRouter) register(full jid.JID, session *xmpp.Session) {
 	if fullStr == "" {
 		return
 	}
+	globalCluster.announce(full, true)
 	bare := full.Bare().String()
 
 	r.mu.Lock()
@@ -57,6 +62,7 @@ func (r *sessionRouter) unregister(full jid.JID) {
 	if fullStr == "" {
 		return
 	}
+	globalCluster.announce(full, false)
 	bare := full.Bare().String()
 
 	r.mu.Lock()
@@ -70,6 +76,13 @@ func (r *sessionRouter) unregister(full jid.JID) {
 	}
 }
 
+// drainSession stops routing stanzas to session while the server shuts
+// down, so messages for its user that arrive before the stream has ended
+// are kept offline instead of being written to a stream about to close.
+func drainSession(_ context.Context, session *xmpp.Session) {
+	globalRouter.unregister(session.RemoteAddr())
+}
+
 func (r *sessionRouter) targets(to jid.JID) []*xmpp.Session {
 	if to.IsZero() {
 		return nil
@@ -97,6 +110,17 @@ func (r *sessionRouter) targets(to jid.JID) []*xmpp.Session {
 	return out
 }
 
+// all returns every routed session, ordered by full JID.
+func (r *sessionRouter) all() []*xmpp.Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*xmpp.Session, 0, len(r.byFull))
+	for _, full := range slices.Sorted(maps.Keys(r.byFull)) {
+		out = append(out, r.byFull[full])
+	}
+	return out
+}
+
 type startTLSRequest struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
 }
@@ -117,15 +141,12 @@ type saslAuth struct {
 
 type saslSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+	Value   string   `xml:",chardata"`
 }
 
-func serveSession(ctx context.Context, session *xmpp.Session, cfg Config, store storage.Storage) {
+func serveSession(ctx context.Context, session *xmpp.Session, cfg Config, tlsConfig *tls.Config, store storage.Storage) {
+	ctx = withSession(ctx, session)
 	regHandler := newRegistrationHandler(cfg.Registration, store)
-	tlsConfig, err := buildTLSConfig(cfg)
-	if err != nil {
-		log.Printf("session tls setup error: %v", err)
-		return
-	}
 
 	if _, secure := session.Transport().ConnectionState(); secure {
 		session.SetState(xmpp.StateSecure)
@@ -133,11 +154,21 @@ func serveSession(ctx context.Context, session *xmpp.Session, cfg Config, store
 
 	var authenticatedUser string
 	defer func() {
-		globalRouter.unregister(session.RemoteAddr())
+		if !globalSM.detach(ctx, session) {
+			sessionUnavailable(ctx, session)
+			globalRouter.unregister(session.RemoteAddr())
+		}
+		globalPushes.forget(session)
+		globalCarbons.forget(session)
+		globalCSI.forget(session)
+		globalGuests.forget(ctx, session)
 	}()
 
 	if err := serveStream(ctx, session, regHandler, cfg, tlsConfig, &authenticatedUser); err != nil {
-		log.Printf("session error: %v", err)
+		if se := stream.ForReadError(err); se != nil {
+			_ = session.SendStreamError(ctx, se)
+		}
+		session.Log(ctx, slog.LevelInfo, "session error", "error", err)
 	}
 }
 
@@ -162,6 +193,9 @@ func serveStream(ctx context.Context, session *xmpp.Session, regHandler *registr
 
 		start, ok := tok.(xml.StartElement)
 		if !ok {
+			if end, ok := tok.(xml.EndElement); ok && end.Name.Space == ns.Stream && end.Name.Local == "stream" {
+				globalSM.closed(session)
+			}
 			continue
 		}
 
@@ -169,12 +203,13 @@ func serveStream(ctx context.Context, session *xmpp.Session, regHandler *registr
 			if err := writeStreamStart(writer, cfg.Domain); err != nil {
 				return err
 			}
-			if err := writeStreamFeatures(writer, cfg, session.State(), tlsConfig); err != nil {
+			if err := writeStreamFeatures(writer, cfg, session, tlsConfig); err != nil {
 				return err
 			}
 			continue
 		}
 
+		ctx := xmpp.WithTraceID(ctx, xmpp.NewTraceID())
 		switch {
 		case start.Name.Space == ns.TLS && start.Name.Local == "starttls":
 			if err := handleStartTLS(ctx, session, tlsConfig, reader); err != nil {
@@ -184,18 +219,33 @@ func serveStream(ctx context.Context, session *xmpp.Session, regHandler *registr
 			if err := handleSASLAuth(ctx, session, storeUserStore(regHandler), cfg, authenticatedUser, reader, &start); err != nil {
 				return err
 			}
+		case start.Name.Space == ns.Compress && start.Name.Local == "compress":
+			if err := handleCompress(ctx, session, cfg, reader, &start); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.CSI:
+			if err := handleCSI(ctx, session, reader, &start); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.SM:
+			if err := handleSM(ctx, session, *authenticatedUser, reader, &start); err != nil {
+				return err
+			}
 		case start.Name.Local == "message":
 			if err := handleMessage(ctx, session, reader, &start); err != nil {
 				return err
 			}
+			globalSM.received(session)
 		case start.Name.Local == "presence":
 			if err := handlePresence(ctx, session, reader, &start); err != nil {
 				return err
 			}
+			globalSM.received(session)
 		case start.Name.Local == "iq":
 			if err := handleIQ(ctx, session, regHandler, cfg, authenticatedUser, reader, &start); err != nil {
 				return err
 			}
+			globalSM.received(session)
 		default:
 			if err := reader.Skip(); err != nil {
 				return err
@@ -241,42 +291,83 @@ func handleSASLAuth(ctx context.Context, session *xmpp.Session, userStore storag
 		return err
 	}
 
-	if strings.ToUpper(strings.TrimSpace(auth.Mechanism)) != "PLAIN" {
+	name := strings.ToUpper(strings.TrimSpace(auth.Mechanism))
+	if !slices.Contains(offeredMechanisms(cfg, session), name) {
+		session.Metrics().AuthFailed(name)
 		return sendSASLFailure(ctx, session, "invalid-mechanism")
 	}
-
-	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth.Value))
-	if err != nil {
-		return sendSASLFailure(ctx, session, "malformed-request")
-	}
-	parts := strings.SplitN(string(payload), "\x00", 3)
-	if len(parts) != 3 || strings.TrimSpace(parts[1]) == "" {
-		return sendSASLFailure(ctx, session, "malformed-request")
-	}
-
-	username := strings.TrimSpace(parts[1])
-	password := parts[2]
 	if userStore == nil {
 		return sendSASLFailure(ctx, session, "temporary-auth-failure")
 	}
-
-	ok, err := userStore.Authenticate(ctx, username, password)
+	// A peer locked out after failed attempts is refused without looking
+	// at its credentials.
+	if session.AuthLockout("") > 0 {
+		session.Metrics().AuthFailed(name)
+		return sendSASLFailure(ctx, session, "temporary-auth-failure")
+	}
+	mech, err := newServerMechanism(ctx, name, userStore, cfg, session)
 	if err != nil {
-		log.Printf("auth lookup failed for %s: %v", username, err)
+		logError(ctx, "sasl setup failed", "mechanism", name, "error", err)
 		return sendSASLFailure(ctx, session, "temporary-auth-failure")
 	}
-	if !ok {
-		return sendSASLFailure(ctx, session, "not-authorized")
+
+	// Without an initial response, the exchange starts with an empty
+	// challenge.
+	var response, data []byte
+	if strings.TrimSpace(auth.Value) == "" {
+		response, err = challengeSASL(ctx, session, reader, nil)
+	} else {
+		response, err = decodeSASL(auth.Value)
+	}
+	for err == nil {
+		if data, err = mech.Next(response); err != nil || mech.Completed() {
+			break
+		}
+		response, err = challengeSASL(ctx, session, reader, data)
+	}
+	if err != nil {
+		var streamErr saslStreamError
+		if errors.As(err, &streamErr) {
+			return streamErr.err
+		}
+		condition := saslCondition(err)
+		if condition == "temporary-auth-failure" {
+			logError(ctx, "sasl failed", "mechanism", name, "user", mech.Username(), "error", err)
+		}
+		if condition == "not-authorized" {
+			session.AuthResult(mech.Username(), false)
+		}
+		session.Metrics().AuthFailed(name)
+		return sendSASLFailure(ctx, session, condition)
 	}
 
+	username := mech.Username()
 	j, err := jid.New(username, cfg.Domain, "")
 	if err != nil {
+		session.Metrics().AuthFailed(name)
 		return sendSASLFailure(ctx, session, "not-authorized")
 	}
-	*authenticatedUser = username
+	if authz := mech.AuthzID(); authz != "" && authz != j.String() {
+		session.Metrics().AuthFailed(name)
+		return sendSASLFailure(ctx, session, "invalid-authzid")
+	}
+	// Valid credentials do not lift the lockout of the account.
+	if session.AuthLockout(username) > 0 {
+		session.Metrics().AuthFailed(name)
+		return sendSASLFailure(ctx, session, "temporary-auth-failure")
+	}
+	session.AuthResult(username, true)
+	if name == "ANONYMOUS" {
+		globalGuests.admit(ctx, session)
+	}
+	*authenticatedUser = j.Local()
 	session.SetRemoteAddr(j)
 	session.SetState(xmpp.StateAuthenticated)
-	return session.SendElement(ctx, saslSuccess{})
+	success := saslSuccess{}
+	if len(data) > 0 {
+		success.Value = encodeSASL(data)
+	}
+	return session.SendElement(ctx, success)
 }
 
 func handleIQ(ctx context.Context, session *xmpp.Session, regHandler *registrationHandler, cfg Config, authenticatedUser *string, reader *xmppxml.StreamReader, start *xml.StartElement) error {
@@ -284,6 +375,14 @@ func handleIQ(ctx context.Context, session *xmpp.Session, regHandler *registrati
 	if err := reader.DecodeElement(&iq, start); err != nil {
 		return err
 	}
+	session.Metrics().StanzaReceived(iq.StanzaType(), iq.Type)
+
+	if session.ResolveRequest(&iq) {
+		return nil
+	}
+	if ok, err := admitStanza(ctx, session, &iq); !ok {
+		return err
+	}
 
 	if isBindRequestIQ(&iq) {
 		return handleBindIQ(ctx, session, cfg, authenticatedUser, &iq)
@@ -359,8 +458,9 @@ func handleMessage(ctx context.Context, session *xmpp.Session, reader *xmppxml.S
 	if err := reader.DecodeElement(&msg, start); err != nil {
 		return err
 	}
-	if session.State()&xmpp.StateReady == 0 {
-		return nil
+	session.Metrics().StanzaReceived(msg.StanzaType(), msg.Type)
+	if ok, err := admitStanza(ctx, session, &msg); !ok || session.State()&xmpp.StateReady == 0 {
+		return err
 	}
 	return routeMessage(ctx, session, &msg)
 }
@@ -370,25 +470,75 @@ func handlePresence(ctx context.Context, session *xmpp.Session, reader *xmppxml.
 	if err := reader.DecodeElement(&pres, start); err != nil {
 		return err
 	}
-	if session.State()&xmpp.StateReady == 0 {
-		return nil
+	session.Metrics().StanzaReceived(pres.StanzaType(), pres.Type)
+	if ok, err := admitStanza(ctx, session, &pres); !ok || session.State()&xmpp.StateReady == 0 {
+		return err
 	}
 	return routePresence(ctx, session, &pres)
 }
 
+// admitStanza applies the rate limits and firewall rules of session to st,
+// just read from it, and the guest policy when session belongs to a guest,
+// reporting whether it is to be handled.
+func admitStanza(ctx context.Context, session *xmpp.Session, st stanza.Stanza) (bool, error) {
+	if ok, err := session.AllowStanza(ctx, st); !ok {
+		return false, err
+	}
+	if ok, err := session.FilterStanza(ctx, st); !ok {
+		return false, err
+	}
+	if stanzaErr := globalGuests.check(session, st); stanzaErr != nil {
+		return false, refuseStanza(ctx, session, st, stanzaErr)
+	}
+	return true, nil
+}
+
 func routeMessage(ctx context.Context, source *xmpp.Session, msg *stanza.Message) error {
 	if msg.From.IsZero() {
 		msg.From = source.RemoteAddr()
 	}
+	if stanzaErr := globalBlocking.check(ctx, msg.From, msg.To); stanzaErr != nil {
+		source.Metrics().RoutingFailed(stanzaErr.Condition)
+		if msg.Type == stanza.MessageError {
+			return nil
+		}
+		return source.Send(ctx, messageError(msg, stanzaErr))
+	}
+	if globalMUC.serves(msg.To) {
+		return globalMUC.handleMessage(ctx, msg)
+	}
+	if globalMIX.serves(msg.To) {
+		return globalMIX.handleMessage(ctx, msg)
+	}
+	archived := globalArchive.archiveSent(ctx, source, msg)
+	if isRemote(msg.To) {
+		err := sendRemote(ctx, source, msg)
+		sendCarbons(ctx, source, archived)
+		return err
+	}
+	delivered := globalArchive.archiveReceived(ctx, msg)
 	targets := globalRouter.targets(msg.To)
 	for _, dst := range targets {
 		if dst == source {
 			continue
 		}
-		if err := dst.Send(ctx, msg); err != nil {
-			log.Printf("message route error to %s: %v", dst.RemoteAddr(), err)
+		if err := sendStanza(ctx, dst, delivered); err != nil {
+			logError(ctx, "message route error", "to", dst.RemoteAddr(), "error", err)
+		}
+	}
+	// A message for a user with no session here is kept offline unless it
+	// reached one on another node.
+	forwarded := globalCluster.forward(ctx, msg.To, delivered)
+	if len(globalRouter.targets(msg.To.Bare())) == 0 && !forwarded {
+		if _, err := globalOffline.keep(ctx, delivered); errors.Is(err, errOfflineFull) {
+			source.Metrics().RoutingFailed(stanza.ErrorServiceUnavailable)
+			sendCarbons(ctx, source, archived)
+			return source.Send(ctx, messageError(msg, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "offline storage full")))
+		} else if err != nil {
+			logError(ctx, "offline store error", "user", msg.To.Bare(), "error", err)
 		}
 	}
+	sendCarbons(ctx, source, archived)
 	return nil
 }
 
@@ -397,22 +547,129 @@ func routePresence(ctx context.Context, source *xmpp.Session, pres *stanza.Prese
 		pres.From = source.RemoteAddr()
 	}
 	if pres.To.IsZero() {
+		pres.From = source.RemoteAddr()
+		broadcastPresence(ctx, source, pres)
 		return nil
 	}
+	// Presence to or from a blocked JID is dropped silently.
+	if globalBlocking.check(ctx, pres.From, pres.To) != nil {
+		return nil
+	}
+	if globalMUC.serves(pres.To) {
+		return globalMUC.handlePresence(ctx, pres)
+	}
+	if globalMIX.serves(pres.To) {
+		return globalMIX.handlePresence(ctx, pres)
+	}
+	if isSubscription(pres.Type) {
+		return routeSubscription(ctx, source, pres)
+	}
+	if isRemote(pres.To) {
+		return sendRemote(ctx, source, pres)
+	}
 	targets := globalRouter.targets(pres.To)
 	for _, dst := range targets {
 		if dst == source {
 			continue
 		}
-		if err := dst.Send(ctx, pres); err != nil {
-			log.Printf("presence route error to %s: %v", dst.RemoteAddr(), err)
+		if err := sendStanza(ctx, dst, pres); err != nil {
+			logError(ctx, "presence route error", "to", dst.RemoteAddr(), "error", err)
 		}
 	}
+	globalCluster.forward(ctx, pres.To, pres)
 	return nil
 }
 
 func routeIQ(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) error {
+	if globalPushes.ack(ctx, source, iq) {
+		return nil
+	}
+	if stanzaErr := globalBlocking.check(ctx, source.RemoteAddr(), iq.To); stanzaErr != nil {
+		source.Metrics().RoutingFailed(stanzaErr.Condition)
+		if iq.Type == stanza.IQGet || iq.Type == stanza.IQSet {
+			return source.Send(ctx, iq.ErrorIQ(stanzaErr))
+		}
+		return nil
+	}
+	if globalMUC.serves(iq.To) {
+		if iq.From.IsZero() {
+			iq.From = source.RemoteAddr()
+		}
+		return globalMUC.handleIQ(ctx, iq)
+	}
+	if globalMIX.serves(iq.To) {
+		if iq.From.IsZero() {
+			iq.From = source.RemoteAddr()
+		}
+		return globalMIX.handleIQ(ctx, iq)
+	}
+	if globalPushGateway.serves(iq.To) {
+		if iq.From.IsZero() {
+			iq.From = source.RemoteAddr()
+		}
+		if reply := globalPushGateway.handleIQ(ctx, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		return nil
+	}
+	if globalProxy.serves(iq.To) {
+		if iq.From.IsZero() {
+			iq.From = source.RemoteAddr()
+		}
+		if reply := globalProxy.handleIQ(ctx, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		return nil
+	}
+	if iq.To.IsZero() || isAccount(iq.To) {
+		if reply := answerPEP(ctx, source.RemoteAddr(), iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerVCard(ctx, source.RemoteAddr(), iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+	}
+	if isAccount(iq.To) {
+		if reply := answerAccountInfo(iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+	}
+	if iq.To.IsZero() || iq.To.Equal(source.RemoteAddr().Bare()) {
+		if reply := answerRoster(ctx, source.RemoteAddr(), iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerBlocking(ctx, source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerArchive(ctx, source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerPush(ctx, source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerMIXPAM(ctx, source.RemoteAddr(), iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+	}
 	if iq.To.IsZero() || iq.To.IsDomainOnly() {
+		if reply := answerCarbons(source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerSearch(ctx, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerCommands(ctx, source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerExternalServices(ctx, source, iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerServiceInfo(iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
+		if reply := answerServiceItems(iq); reply != nil {
+			return source.Send(ctx, reply)
+		}
 		if iq.Type == stanza.IQGet || iq.Type == stanza.IQSet {
 			return source.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "unsupported server iq")))
 		}
@@ -421,9 +678,16 @@ func routeIQ(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) error {
 	if iq.From.IsZero() {
 		iq.From = source.RemoteAddr()
 	}
+	if isRemote(iq.To) {
+		return sendRemote(ctx, source, iq)
+	}
 
 	targets := globalRouter.targets(iq.To)
+	if len(targets) == 0 && iq.To.IsFull() && globalCluster.forward(ctx, iq.To, iq) {
+		return nil
+	}
 	if len(targets) == 0 {
+		source.Metrics().RoutingFailed(stanza.ErrorItemNotFound)
 		if iq.Type == stanza.IQGet || iq.Type == stanza.IQSet {
 			return source.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "recipient not found")))
 		}
@@ -434,8 +698,8 @@ func routeIQ(ctx context.Context, source *xmpp.Session, iq *stanza.IQ) error {
 		if dst == source {
 			continue
 		}
-		if err := dst.Send(ctx, iq); err != nil {
-			log.Printf("iq route error to %s: %v", dst.RemoteAddr(), err)
+		if err := sendStanza(ctx, dst, iq); err != nil {
+			logError(ctx, "iq route error", "to", dst.RemoteAddr(), "error", err)
 		}
 		if iq.To.IsFull() {
 			break
@@ -465,18 +729,49 @@ func randomResource() string {
 	return "roster-" + hex.EncodeToString(b)
 }
 
-func buildTLSConfig(cfg Config) (*tls.Config, error) {
+// buildTLSConfig returns the TLS config shared by all sessions and the
+// certificate it serves, or nils when no certificate is configured. Sharing
+// the config lets clients resume sessions with tickets issued on an earlier
+// connection; ticket key rotation runs until ctx is done.
+func buildTLSConfig(ctx context.Context, cfg Config) (*tls.Config, *certificate, error) {
 	if cfg.TLSCert == "" || cfg.TLSKey == "" {
-		return nil, nil
+		return nil, nil, nil
+	}
+	cert := &certificate{certFile: cfg.TLSCert, keyFile: cfg.TLSKey}
+	if _, err := cert.reload(); err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: cert.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+	tickets := xmpp.SessionTicketPolicy{Disabled: !cfg.TLSSessionTickets, Rotation: cfg.TLSTicketKeyRotation}
+	if err := tickets.Apply(ctx, tlsConfig); err != nil {
+		return nil, nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	return tlsConfig, cert, nil
+}
+
+// certificate is the server certificate loaded from XMPP_TLS_CERT and
+// XMPP_TLS_KEY. Reloading it replaces the certificate of new connections
+// without a restart.
+type certificate struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// reload loads the certificate files again and returns the new leaf.
+func (c *certificate) reload() (*x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	c.cert.Store(&cert)
+	return cert.Leaf, nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
 }
 
 func writeStreamStart(writer *xmppxml.StreamWriter, domain string) error {
@@ -496,12 +791,13 @@ func writeStreamStart(writer *xmppxml.StreamWriter, domain string) error {
 	return err
 }
 
-func writeStreamFeatures(writer *xmppxml.StreamWriter, cfg Config, state xmpp.SessionState, tlsConfig *tls.Config) error {
+func writeStreamFeatures(writer *xmppxml.StreamWriter, cfg Config, session *xmpp.Session, tlsConfig *tls.Config) error {
 	start := xml.StartElement{Name: xml.Name{Space: ns.Stream, Local: "features"}}
 	if err := writer.EncodeToken(start); err != nil {
 		return err
 	}
 
+	state := session.State()
 	secure := state&xmpp.StateSecure != 0
 	authenticated := state&xmpp.StateAuthenticated != 0
 	bound := state&xmpp.StateBound != 0
@@ -519,9 +815,14 @@ func writeStreamFeatures(writer *xmppxml.StreamWriter, cfg Config, state xmpp.Se
 	}
 
 	if !authenticated {
-		if err := writeSASLMechanisms(writer, []string{"PLAIN"}); err != nil {
+		if err := writeSASLMechanisms(writer, offeredMechanisms(cfg, session)); err != nil {
 			return err
 		}
+		if cb := channelBinding(session); len(cb.Data) > 0 {
+			if err := writeChannelBindingFeature(writer, cb.Type); err != nil {
+				return err
+			}
+		}
 		if cfg.Registration.Policy != registrationClosed {
 			if err := writeRegistrationFeature(writer); err != nil {
 				return err
@@ -535,6 +836,24 @@ func writeStreamFeatures(writer *xmppxml.StreamWriter, cfg Config, state xmpp.Se
 			return err
 		}
 	}
+	if err := writeSMFeature(writer); err != nil {
+		return err
+	}
+	if _, ok := compressor(cfg, session); ok {
+		if err := writeCompressionFeature(writer); err != nil {
+			return err
+		}
+	}
+	if globalCSI.offered() {
+		if err := writeCSIFeature(writer); err != nil {
+			return err
+		}
+	}
+	if globalRoster != nil {
+		if err := writeRosterVerFeature(writer); err != nil {
+			return err
+		}
+	}
 
 	return writer.EncodeToken(xml.EndElement{Name: start.Name})
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// userDataHosts returns the pubsub services users hold subscriptions on:
+// the server itself and, with MIX, every channel.
+func userDataHosts(ctx context.Context, cfg Config, store storage.Storage) ([]string, error) {
+	hosts := []string{cfg.Domain}
+	if !cfg.MIX || store.PubSubStore() == nil {
+		return hosts, nil
+	}
+	channels, err := store.PubSubStore().ListNodes(ctx, cfg.MIXDomain)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range channels {
+		hosts = append(hosts, node.NodeID+"@"+cfg.MIXDomain)
+	}
+	return hosts, nil
+}
+
+// exportUserData writes the stored data of the local account to w.
+func exportUserData(ctx context.Context, cfg Config, store storage.Storage, account jid.JID, format storage.ExportFormat, w io.Writer) error {
+	hosts, err := userDataHosts(ctx, cfg, store)
+	if err != nil {
+		return err
+	}
+	return storage.ExportUser(ctx, store, account.Bare().String(), w, storage.ExportOptions{Format: format, PubSubHosts: hosts})
+}
+
+// eraseUserData deletes the account and everything stored about it, and
+// ends its sessions.
+func eraseUserData(ctx context.Context, cfg Config, store storage.Storage, account jid.JID) error {
+	account = account.Bare()
+	hosts, err := userDataHosts(ctx, cfg, store)
+	if err != nil {
+		return err
+	}
+	// Sessions end first, so that they cannot store anything new while the
+	// data is erased.
+	disconnect(ctx, globalRouter.targets(account), stream.NewError(stream.ErrNotAuthorized, "account deleted"))
+	members := globalSharedGroups.coMembers(ctx, account.String())
+	err = storage.DeleteUserData(ctx, store, account.String(), hosts...)
+	// The account leaves its shared groups with its data.
+	globalSharedGroups.changed(ctx, members, account.String())
+	return err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/avatar"
+	"github.com/meszmate/xmpp-go/plugins/vcard"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// globalVCards serves the vCards of local accounts as vcard-temp
+// (XEP-0054) and vCard4 (XEP-0292), and keeps them and the PEP avatar in
+// step (XEP-0398). It is nil when the storage has no VCardStore.
+var globalVCards *vcardService
+
+// vcardService keeps one vCard per account, stored as vcard-temp. With
+// PEP, a vCard4 set either way is also published to the urn:xmpp:vcard4
+// node, and the avatar nodes (XEP-0084) follow the vcard-temp PHOTO and the
+// other way round.
+type vcardService struct {
+	store storage.VCardStore
+
+	mu     sync.Mutex
+	hashes map[string]string // bare JID -> SHA-1 of the PHOTO, "" for none
+}
+
+func newVCardService(store storage.Storage) *vcardService {
+	if store == nil || store.VCardStore() == nil {
+		return nil
+	}
+	return &vcardService{store: store.VCardStore(), hashes: make(map[string]string)}
+}
+
+// answerVCard answers the vcard-temp and vCard4 requests that from sends
+// to the bare JID of a local account, or returns nil when iq is not one.
+// Requests without a 'to' go to the sender's own account. Anyone retrieves
+// a vCard; only the owner sets it.
+func answerVCard(ctx context.Context, from jid.JID, iq *stanza.IQ) *stanza.IQ {
+	var q struct{ XMLName xml.Name }
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet || xml.Unmarshal(iq.Query, &q) != nil {
+		return nil
+	}
+	name := q.XMLName
+	if name != (xml.Name{Space: ns.VCard, Local: "vCard"}) && name != (xml.Name{Space: ns.VCard4, Local: "vcard"}) {
+		return nil
+	}
+	if globalVCards == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "no vcard storage"))
+	}
+	owner := iq.To.Bare()
+	if iq.To.IsZero() {
+		owner = from.Bare()
+	}
+	if iq.Type == stanza.IQSet && !from.Bare().Equal(owner) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, "only the owner sets a vcard"))
+	}
+
+	var err error
+	var reply *stanza.IQ
+	switch {
+	case name.Space == ns.VCard && iq.Type == stanza.IQGet:
+		reply, err = globalVCards.get(ctx, owner, iq)
+	case name.Space == ns.VCard:
+		var v vcard.VCard
+		if xml.Unmarshal(iq.Query, &v) != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "invalid vcard"))
+		}
+		reply, err = iq.ResultIQ(), globalVCards.setVCardTemp(ctx, owner, iq.Query, &v)
+	case iq.Type == stanza.IQGet:
+		reply, err = globalVCards.get4(ctx, from, owner, iq)
+	default:
+		var v vcard.VCard4
+		if xml.Unmarshal(iq.Query, &v) != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "invalid vcard"))
+		}
+		reply, err = iq.ResultIQ(), globalVCards.setVCard4(ctx, owner, iq.Query, &v)
+	}
+	if err != nil {
+		logError(ctx, "vcard error", "user", owner, "error", err)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return reply
+}
+
+// get returns the vcard-temp of owner as it was set, or an empty one.
+func (s *vcardService) get(ctx context.Context, owner jid.JID, iq *stanza.IQ) (*stanza.IQ, error) {
+	data, err := s.store.GetVCard(ctx, owner.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return payloadIQ(iq, vcard.VCard{}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply := iq.ResultIQ()
+	reply.Query = data
+	return reply, nil
+}
+
+// get4 returns the vCard4 of owner: the one published to PEP if the
+// requester may read it, or else the vcard-temp converted.
+func (s *vcardService) get4(ctx context.Context, from, owner jid.JID, iq *stanza.IQ) (*stanza.IQ, error) {
+	if globalPEP != nil {
+		node, err := globalPEP.pubsub.GetNode(ctx, owner.String(), vcard.NodeVCard4)
+		if err == nil && globalPEP.mayRead(ctx, owner, from, node) {
+			items, err := globalPEP.pubsub.GetItems(ctx, owner.String(), vcard.NodeVCard4)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(items); n > 0 {
+				reply := iq.ResultIQ()
+				reply.Query = items[n-1].Payload
+				return reply, nil
+			}
+		} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+	v, err := s.load(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	return payloadIQ(iq, vcard.ToVCard4(v)), nil
+}
+
+// load returns the stored vcard-temp of owner, or an empty one.
+func (s *vcardService) load(ctx context.Context, owner jid.JID) (*vcard.VCard, error) {
+	data, err := s.store.GetVCard(ctx, owner.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return &vcard.VCard{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v vcard.VCard
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// setVCardTemp stores the vcard-temp data of owner, then publishes it as
+// vCard4 and its PHOTO as the avatar.
+func (s *vcardService) setVCardTemp(ctx context.Context, owner jid.JID, data []byte, v *vcard.VCard) error {
+	if err := s.store.SetVCard(ctx, owner.String(), data); err != nil {
+		return err
+	}
+	hash := s.remember(owner, v)
+	if globalPEP == nil {
+		return nil
+	}
+	payload, err := xml.Marshal(vcard.ToVCard4(v))
+	if err != nil {
+		return err
+	}
+	if err := globalPEP.publishAs(ctx, owner, vcard.NodeVCard4, vcard.ItemCurrent, payload); err != nil {
+		return err
+	}
+	return s.publishAvatar(ctx, owner, v.Photo, hash)
+}
+
+// setVCard4 stores the vCard4 data of owner as vcard-temp and publishes it.
+func (s *vcardService) setVCard4(ctx context.Context, owner jid.JID, data []byte, v *vcard.VCard4) error {
+	if err := s.storeVCard4(ctx, owner, v); err != nil {
+		return err
+	}
+	if globalPEP == nil {
+		return nil
+	}
+	return globalPEP.publishAs(ctx, owner, vcard.NodeVCard4, vcard.ItemCurrent, data)
+}
+
+// storeVCard4 stores v as the vcard-temp of owner. A vCard4 without a
+// photo keeps the current PHOTO, which the avatar nodes manage.
+func (s *vcardService) storeVCard4(ctx context.Context, owner jid.JID, v *vcard.VCard4) error {
+	temp := vcard.FromVCard4(v)
+	if temp.Photo == nil {
+		current, err := s.load(ctx, owner)
+		if err != nil {
+			return err
+		}
+		temp.Photo = current.Photo
+	}
+	return s.save(ctx, owner, temp)
+}
+
+func (s *vcardService) save(ctx context.Context, owner jid.JID, v *vcard.VCard) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetVCard(ctx, owner.String(), data); err != nil {
+		return err
+	}
+	s.remember(owner, v)
+	return nil
+}
+
+// published follows a PEP publish of owner into the vcard-temp: a vCard4
+// replaces its fields and an avatar its PHOTO (XEP-0398 §4).
+func (s *vcardService) published(ctx context.Context, owner jid.JID, node string, payload []byte) {
+	if s == nil {
+		return
+	}
+	var err error
+	switch node {
+	case vcard.NodeVCard4:
+		var v vcard.VCard4
+		if xml.Unmarshal(payload, &v) != nil {
+			return
+		}
+		err = s.storeVCard4(ctx, owner, &v)
+	case ns.AvatarMetadata:
+		var meta avatar.Metadata
+		if xml.Unmarshal(payload, &meta) != nil {
+			return
+		}
+		err = s.avatarToPhoto(ctx, owner, &meta)
+	}
+	if err != nil {
+		logError(ctx, "vcard conversion error", "user", owner, "node", node, "error", err)
+	}
+}
+
+// avatarToPhoto sets the PHOTO of owner to the avatar meta describes,
+// which was published to the data node, or removes it when the avatar is
+// disabled.
+func (s *vcardService) avatarToPhoto(ctx context.Context, owner jid.JID, meta *avatar.Metadata) error {
+	v, err := s.load(ctx, owner)
+	if err != nil {
+		return err
+	}
+	info, ok := meta.Stored()
+	if !ok {
+		if v.Photo == nil {
+			return nil
+		}
+		v.Photo = nil
+		return s.save(ctx, owner, v)
+	}
+	if s.hash(ctx, owner) == info.ID {
+		return nil
+	}
+	items, err := globalPEP.pubsub.GetItems(ctx, owner.String(), ns.AvatarData)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	var data avatar.Data
+	found := false
+	for _, item := range items {
+		if item.ItemID == info.ID {
+			if err := xml.Unmarshal(item.Payload, &data); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		// Metadata published before its data: nothing to convert.
+		return nil
+	}
+	v.Photo = &vcard.Photo{Type: info.Type, BinVal: strings.Join(strings.Fields(data.Value), "")}
+	return s.save(ctx, owner, v)
+}
+
+// publishAvatar publishes photo as the avatar of owner (XEP-0398 §3), or
+// disables the avatar when the PHOTO was removed. hash is the SHA-1 of the
+// photo, "" for none.
+func (s *vcardService) publishAvatar(ctx context.Context, owner jid.JID, photo *vcard.Photo, hash string) error {
+	current := ""
+	if items, err := globalPEP.pubsub.GetItems(ctx, owner.String(), ns.AvatarMetadata); err == nil && len(items) > 0 {
+		var meta avatar.Metadata
+		if xml.Unmarshal(items[len(items)-1].Payload, &meta) == nil {
+			info, _ := meta.Stored()
+			current = info.ID
+		}
+	} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if hash == current {
+		return nil
+	}
+	if hash == "" {
+		payload, err := xml.Marshal(avatar.Metadata{})
+		if err != nil {
+			return err
+		}
+		return globalPEP.publishAs(ctx, owner, ns.AvatarMetadata, stanza.GenerateID(), payload)
+	}
+	raw, err := base64.StdEncoding.DecodeString(photo.BinVal)
+	if err != nil {
+		return nil
+	}
+	data, meta := avatar.NewAvatar(raw, photo.Type)
+	for _, item := range []struct {
+		node string
+		v    any
+	}{{ns.AvatarData, data}, {ns.AvatarMetadata, meta}} {
+		payload, err := xml.Marshal(item.v)
+		if err != nil {
+			return err
+		}
+		if err := globalPEP.publishAs(ctx, owner, item.node, hash, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remember records the photo hash of v for owner and returns it.
+func (s *vcardService) remember(owner jid.JID, v *vcard.VCard) string {
+	hash := photoHash(v)
+	s.mu.Lock()
+	s.hashes[owner.String()] = hash
+	s.mu.Unlock()
+	return hash
+}
+
+// hash returns the SHA-1 of the PHOTO of owner, "" for none.
+func (s *vcardService) hash(ctx context.Context, owner jid.JID) string {
+	s.mu.Lock()
+	hash, ok := s.hashes[owner.String()]
+	s.mu.Unlock()
+	if ok {
+		return hash
+	}
+	v, err := s.load(ctx, owner)
+	if err != nil {
+		logError(ctx, "vcard error", "user", owner, "error", err)
+		return ""
+	}
+	return s.remember(owner, v)
+}
+
+// photoHash returns the SHA-1 of the embedded PHOTO of v, "" for none.
+func photoHash(v *vcard.VCard) string {
+	if v.Photo == nil || v.Photo.BinVal == "" {
+		return ""
+	}
+	v.Photo.BinVal = strings.Join(strings.Fields(v.Photo.BinVal), "")
+	raw, err := base64.StdEncoding.DecodeString(v.Photo.BinVal)
+	if err != nil {
+		return ""
+	}
+	return avatar.Hash(raw)
+}
+
+// stampPresence adds the photo hash of the sender's avatar to available
+// presence that does not carry one, so that clients knowing only XEP-0153
+// see avatars set through PEP (XEP-0398 §5).
+func (s *vcardService) stampPresence(ctx context.Context, pres *stanza.Presence) {
+	if s == nil || pres.Type != "" {
+		return
+	}
+	i := -1
+	for j, ext := range pres.Extensions {
+		if ext.XMLName.Space == ns.VCardUpdate && ext.XMLName.Local == "x" {
+			var update avatar.VCardUpdate
+			if err := decodeExtension(ext, &update); err == nil && update.Photo != nil {
+				return
+			}
+			i = j
+		}
+	}
+	hash := s.hash(ctx, pres.From.Bare())
+	if hash == "" {
+		return
+	}
+	ext := stanza.Extension{XMLName: xml.Name{Space: ns.VCardUpdate, Local: "x"}, Inner: []byte("<photo>" + hash + "</photo>")}
+	if i >= 0 {
+		pres.Extensions[i] = ext
+	} else {
+		pres.Extensions = append(pres.Extensions, ext)
+	}
+}
+
+// publishAs publishes payload to node of owner's PEP service as owner,
+// notifying the interested resources.
+func (s *pepService) publishAs(ctx context.Context, owner jid.JID, node, id string, payload []byte) error {
+	return s.pubsub.PublishWithOptions(ctx, &storage.PubSubItem{
+		Host:      owner.String(),
+		NodeID:    node,
+		ItemID:    id,
+		Publisher: owner.String(),
+		Payload:   payload,
+	}, nil)
+}
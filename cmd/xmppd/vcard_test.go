@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/avatar"
+	"github.com/meszmate/xmpp-go/plugins/vcard"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// setupVCards installs a vCard service next to the PEP service of
+// setupPEP for the duration of t.
+func setupVCards(t *testing.T) {
+	t.Helper()
+	setupPEP(t)
+	old := globalVCards
+	globalVCards = newVCardService(memory.New())
+	t.Cleanup(func() { globalVCards = old })
+}
+
+// testPNG returns a 2x1 PNG image.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 1))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pepItem returns the payload of the newest item of a PEP node of alice.
+func pepItem(t *testing.T, node string) (id string, payload []byte) {
+	t.Helper()
+	items, err := globalPEP.pubsub.GetItems(context.Background(), "alice@example.com", node)
+	if err != nil || len(items) == 0 {
+		t.Fatalf("%s items %v: %v", node, items, err)
+	}
+	item := items[len(items)-1]
+	return item.ItemID, item.Payload
+}
+
+func TestVCardTempConverted(t *testing.T) {
+	setupVCards(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	bob := newOrderedPeer(t, "bob@example.com/desk")
+	img := testPNG(t)
+	hash := avatar.Hash(img)
+
+	// An account without a vCard has an empty one.
+	reply := bob.request(t, stanza.IQGet, "alice@example.com", `<vCard xmlns='vcard-temp'/>`)
+	if reply.Type != stanza.IQResult || !strings.Contains(string(reply.Query), "vCard") {
+		t.Fatalf("empty vcard %+v %s", reply.Error, reply.Query)
+	}
+
+	reply = alice.request(t, stanza.IQSet, "", `<vCard xmlns='vcard-temp'><FN>Alice</FN>
+		<PHOTO><TYPE>image/png</TYPE><BINVAL>`+base64.StdEncoding.EncodeToString(img)+`</BINVAL></PHOTO></vCard>`)
+	if reply.Type != stanza.IQResult {
+		t.Fatalf("set: %+v", reply.Error)
+	}
+	if reply := bob.request(t, stanza.IQSet, "alice@example.com", `<vCard xmlns='vcard-temp'/>`); !refused(reply, "forbidden") {
+		t.Fatalf("set by bob: %+v", reply)
+	}
+
+	reply = bob.request(t, stanza.IQGet, "alice@example.com", `<vcard xmlns='urn:ietf:params:xml:ns:vcard-4.0'/>`)
+	var v4 vcard.VCard4
+	if err := xml.Unmarshal(reply.Query, &v4); err != nil || v4.FN == nil || v4.FN.Text != "Alice" ||
+		v4.Photo == nil || !strings.HasPrefix(v4.Photo.URI, "data:image/png;base64,") {
+		t.Fatalf("vcard4 %s: %v", reply.Query, err)
+	}
+	if _, payload := pepItem(t, vcard.NodeVCard4); !strings.Contains(string(payload), "Alice") {
+		t.Fatalf("published vcard4 %s", payload)
+	}
+
+	// The PHOTO became the PEP avatar.
+	id, payload := pepItem(t, avatarNode)
+	var meta avatar.Metadata
+	if err := xml.Unmarshal(payload, &meta); err != nil || id != hash {
+		t.Fatalf("avatar metadata %s %s: %v", id, payload, err)
+	}
+	if info, ok := meta.Stored(); !ok || info.Type != "image/png" || info.Width != 2 || info.Height != 1 {
+		t.Fatalf("avatar info %+v", meta)
+	}
+	if id, _ := pepItem(t, "urn:xmpp:avatar:data"); id != hash {
+		t.Fatalf("avatar data %s", id)
+	}
+
+	// Presence tells XEP-0153 clients about the avatar.
+	pres := stanza.NewPresence("")
+	pres.From = alice.session.RemoteAddr()
+	globalVCards.stampPresence(context.Background(), pres)
+	if len(pres.Extensions) != 1 || string(pres.Extensions[0].Inner) != "<photo>"+hash+"</photo>" {
+		t.Fatalf("presence extensions %+v", pres.Extensions)
+	}
+
+	// Removing the PHOTO disables the avatar.
+	if reply := alice.request(t, stanza.IQSet, "", `<vCard xmlns='vcard-temp'><FN>Alice</FN></vCard>`); reply.Type != stanza.IQResult {
+		t.Fatalf("set: %+v", reply.Error)
+	}
+	if _, payload := pepItem(t, avatarNode); strings.Contains(string(payload), "info") {
+		t.Fatalf("avatar not disabled: %s", payload)
+	}
+}
+
+func TestVCardFromPEP(t *testing.T) {
+	setupVCards(t)
+	alice := newOrderedPeer(t, "alice@example.com/phone")
+	img := testPNG(t)
+	data, meta := avatar.NewAvatar(img, "image/png")
+	hash := avatar.Hash(img)
+
+	publish := func(node, id string, v any) {
+		t.Helper()
+		payload, err := xml.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := alice.request(t, stanza.IQSet, "", `<pubsub xmlns='http://jabber.org/protocol/pubsub'>
+			<publish node='`+node+`'><item id='`+id+`'>`+string(payload)+`</item></publish></pubsub>`)
+		if reply.Type != stanza.IQResult {
+			t.Fatalf("publish to %s: %+v", node, reply.Error)
+		}
+	}
+	vcardTemp := func() vcard.VCard {
+		t.Helper()
+		reply := alice.request(t, stanza.IQGet, "", `<vCard xmlns='vcard-temp'/>`)
+		var v vcard.VCard
+		if err := xml.Unmarshal(reply.Query, &v); err != nil {
+			t.Fatalf("vcard %s: %v", reply.Query, err)
+		}
+		return v
+	}
+
+	publish("urn:xmpp:avatar:data", hash, data)
+	publish(avatarNode, hash, meta)
+	if v := vcardTemp(); v.Photo == nil || v.Photo.Type != "image/png" || v.Photo.BinVal != base64.StdEncoding.EncodeToString(img) {
+		t.Fatalf("photo %+v", v.Photo)
+	}
+
+	// A vCard4 without a photo keeps the avatar.
+	publish(vcard.NodeVCard4, vcard.ItemCurrent, vcard.VCard4{FN: &vcard.Text{Text: "Alice"}})
+	if v := vcardTemp(); v.FN != "Alice" || v.Photo == nil {
+		t.Fatalf("vcard %+v", v)
+	}
+
+	publish(avatarNode, "off", avatar.Metadata{})
+	if v := vcardTemp(); v.FN != "Alice" || v.Photo != nil {
+		t.Fatalf("vcard %+v", v)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
 
+	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/stanza"
 	"github.com/meszmate/xmpp-go/stream"
@@ -83,21 +85,67 @@ func (c *Component) Connect(ctx context.Context) error {
 	// Send stream header
 	header := stream.Open(stream.Header{
 		To: domainJID,
-		NS: "jabber:component:accept",
+		NS: ns.Component,
 	})
 	if _, err := session.Writer().WriteRaw(header); err != nil {
 		session.Close()
 		return err
 	}
+	if err := c.handshake(ctx, session); err != nil {
+		session.Close()
+		return fmt.Errorf("component: handshake: %w", err)
+	}
 
 	c.session = session
 	return nil
 }
 
+// ComponentHandshake is the element a component authenticates with, whose
+// value is the handshake hash. The server confirms it with an empty one
+// (XEP-0114 §3).
+type ComponentHandshake struct {
+	XMLName xml.Name `xml:"jabber:component:accept handshake"`
+	Value   string   `xml:",chardata"`
+}
+
+// handshake authenticates with the stream ID the server announced in its
+// header. A server refusing the secret answers with a stream error.
+func (c *Component) handshake(ctx context.Context, session *Session) error {
+	start, err := nextElement(session)
+	if err != nil {
+		return err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "stream" {
+		return fmt.Errorf("expected stream header, got <%s>", start.Name.Local)
+	}
+	var id string
+	for _, a := range start.Attr {
+		if a.Name.Space == "" && a.Name.Local == "id" {
+			id = a.Value
+		}
+	}
+	if err := session.SendElement(ctx, ComponentHandshake{Value: c.Handshake(id)}); err != nil {
+		return err
+	}
+	if start, err = nextElement(session); err != nil {
+		return err
+	}
+	if start.Name.Local != "handshake" {
+		return fmt.Errorf("expected handshake, got <%s>", start.Name.Local)
+	}
+	return session.Reader().Skip()
+}
+
 // Handshake generates the component handshake hash.
 func (c *Component) Handshake(streamID string) string {
+	return HandshakeHash(streamID, c.secret)
+}
+
+// HandshakeHash returns the handshake hash of a component knowing secret
+// on the stream streamID: the hex SHA-1 of the two concatenated.
+func HandshakeHash(streamID, secret string) string {
 	h := sha1.New()
-	h.Write([]byte(streamID + c.secret))
+	h.Write([]byte(streamID + secret))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -1,9 +1,16 @@
 package xmpp
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
 	"testing"
+
+	"github.com/meszmate/xmpp-go/stream"
 )
 
 func TestComponentHandshakeHash(t *testing.T) {
@@ -76,3 +83,81 @@ func TestComponentCloseBeforeConnect(t *testing.T) {
 		t.Errorf("Close before Connect should return nil, got %v", err)
 	}
 }
+
+// serveComponent accepts one component stream on ln, announcing the stream
+// ID id, and answers its handshake with reply.
+func serveComponent(t *testing.T, ln net.Listener, id, reply string) <-chan string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := xml.NewDecoder(conn)
+		if _, err := dec.Token(); err != nil { // the stream header
+			return
+		}
+		_, _ = conn.Write([]byte(`<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='gateway.example.com' id='` + id + `'>`))
+		var h ComponentHandshake
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "handshake" {
+				if dec.DecodeElement(&h, &start) != nil {
+					return
+				}
+				break
+			}
+		}
+		got <- h.Value
+		_, _ = conn.Write([]byte(reply))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	return got
+}
+
+func TestComponentConnect(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := serveComponent(t, ln, "s1", `<handshake/>`)
+
+	c, _ := NewComponent("gateway.example.com", "secret", WithComponentAddr(ln.Addr().String()))
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if h := <-got; h != HandshakeHash("s1", "secret") {
+		t.Fatalf("handshake %q", h)
+	}
+	if c.Session() == nil {
+		t.Fatal("no session after Connect")
+	}
+}
+
+func TestComponentConnectRefused(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serveComponent(t, ln, "s1", `<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`)
+
+	c, _ := NewComponent("gateway.example.com", "wrong", WithComponentAddr(ln.Addr().String()))
+	err = c.Connect(context.Background())
+	var se *stream.Error
+	if !errors.As(err, &se) || se.Condition != stream.ErrNotAuthorized {
+		t.Fatalf("Connect = %v, want not-authorized", err)
+	}
+	if c.Session() != nil {
+		t.Fatal("session kept after a refused handshake")
+	}
+}
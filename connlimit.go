@@ -0,0 +1,95 @@
+package xmpp
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnStats reports the connections a Server currently holds open.
+type ConnStats struct {
+	// Total is the number of open connections.
+	Total int
+	// PerIP is the number of open connections by client IP address.
+	PerIP map[string]int
+	// Rejected is the number of connections closed at accept time because
+	// a limit was reached or the limit policy refused them, since the
+	// server started.
+	Rejected uint64
+}
+
+// connLimiter counts open connections and enforces the limits set with
+// WithMaxConnsPerIP and WithMaxTotalConns. A limit of zero or less is
+// no limit.
+type connLimiter struct {
+	maxPerIP int
+	maxTotal int
+
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+	rejected uint64
+}
+
+func newConnLimiter(maxPerIP, maxTotal int) *connLimiter {
+	return &connLimiter{maxPerIP: maxPerIP, maxTotal: maxTotal, perIP: make(map[string]int)}
+}
+
+// acquire counts a new connection from ip and reports whether it is within
+// the limits. A connection that is not must be closed without release.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (l.maxTotal > 0 && l.total >= l.maxTotal) || (l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP) {
+		l.rejected++
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+// reject counts a connection refused before acquire.
+func (l *connLimiter) reject() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rejected++
+}
+
+// release uncounts a connection from ip that acquire accepted.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+func (l *connLimiter) stats() ConnStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	perIP := make(map[string]int, len(l.perIP))
+	for ip, n := range l.perIP {
+		perIP[ip] = n
+	}
+	return ConnStats{Total: l.total, PerIP: perIP, Rejected: l.rejected}
+}
+
+// remoteIP returns the IP address of a connection's peer. Behind a proxy
+// speaking the PROXY protocol, pass a listener that decodes it with
+// WithServerListener, so that RemoteAddr reports the client's address.
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
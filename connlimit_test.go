@@ -0,0 +1,135 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2, 3)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1"} {
+		if !l.acquire(ip) {
+			t.Fatalf("acquire %s rejected below the limits", ip)
+		}
+	}
+	if l.acquire("10.0.0.1") {
+		t.Fatal("acquire accepted a third connection from one IP")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Fatal("acquire rejected another IP")
+	}
+	if l.acquire("10.0.0.3") {
+		t.Fatal("acquire accepted a connection over the total limit")
+	}
+
+	st := l.stats()
+	if st.Total != 3 || st.PerIP["10.0.0.1"] != 2 || st.PerIP["10.0.0.2"] != 1 || st.Rejected != 2 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	l.release("10.0.0.1")
+	l.release("10.0.0.2")
+	if !l.acquire("10.0.0.1") {
+		t.Fatal("acquire rejected after release")
+	}
+	if st := l.stats(); st.Total != 2 || len(st.PerIP) != 1 {
+		t.Fatalf("stats after release = %+v", st)
+	}
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	l := newConnLimiter(0, -1)
+	for range 100 {
+		if !l.acquire("10.0.0.1") {
+			t.Fatal("acquire rejected without limits")
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5222}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5222}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "/run/xmpp.sock", Net: "unix"}, "/run/xmpp.sock"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := remoteIP(tt.addr); got != tt.want {
+			t.Errorf("remoteIP(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestServerMaxConnsPerIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	s, err := NewServer("example.com",
+		WithServerListener(ln),
+		WithMaxConnsPerIP(2),
+		WithServerSessionHandler(func(context.Context, *Session) {
+			started <- struct{}{}
+			<-release
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.ListenAndServe(ctx) }()
+	defer s.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	for range 2 {
+		dial()
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session not started")
+		}
+	}
+
+	// The third connection is closed before any stream is negotiated.
+	c := dial()
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read on rejected connection: %v, want EOF", err)
+	}
+	if st := s.ConnStats(); st.Total != 2 || st.PerIP["127.0.0.1"] != 2 || st.Rejected != 1 {
+		t.Fatalf("ConnStats() = %+v", st)
+	}
+
+	// Once sessions end, new connections are accepted again.
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.ConnStats().Total != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ConnStats() = %+v after sessions ended", s.ConnStats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	dial()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not started after release")
+	}
+}
@@ -11,4 +11,5 @@ var (
 	ErrNoPreKey         = errors.New("omemo: no pre-key available")
 	ErrInvalidKeyLength = errors.New("omemo: invalid key length")
 	ErrSkippedKeyLimit  = errors.New("omemo: too many skipped message keys")
+	ErrNoBundle         = errors.New("omemo: no local bundle")
 )
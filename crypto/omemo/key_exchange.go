@@ -0,0 +1,75 @@
+package omemo
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyExchange holds the X3DH values of a pre-key message: the initiator's
+// identity and ephemeral keys, and which of the recipient's pre-keys were
+// used.
+type KeyExchange struct {
+	IdentityKey    ed25519.PublicKey
+	EphemeralKey   []byte  // 32 bytes, X25519
+	PreKeyID       *uint32 // nil if no one-time pre-key was used
+	SignedPreKeyID uint32
+}
+
+const keyExchangeSize = 32 + 32 + 4 + 1 // without the optional pre-key ID
+
+// MarshalBinary encodes a KeyExchange to bytes.
+func (k *KeyExchange) MarshalBinary() ([]byte, error) {
+	if len(k.IdentityKey) != ed25519.PublicKeySize || len(k.EphemeralKey) != 32 {
+		return nil, ErrInvalidKeyLength
+	}
+	buf := make([]byte, 0, keyExchangeSize+4)
+	buf = append(buf, k.IdentityKey...)
+	buf = append(buf, k.EphemeralKey...)
+	buf = binary.BigEndian.AppendUint32(buf, k.SignedPreKeyID)
+	if k.PreKeyID == nil {
+		return append(buf, 0), nil
+	}
+	buf = append(buf, 1)
+	return binary.BigEndian.AppendUint32(buf, *k.PreKeyID), nil
+}
+
+// UnmarshalBinary decodes a KeyExchange from bytes.
+func (k *KeyExchange) UnmarshalBinary(data []byte) error {
+	kex, rest, err := ParseKeyExchange(data)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after key exchange", ErrInvalidMessage, len(rest))
+	}
+	*k = *kex
+	return nil
+}
+
+// ParseKeyExchange decodes the KeyExchange at the start of data, as
+// written by MarshalBinary in front of a pre-key message, and returns the
+// bytes that follow it.
+func ParseKeyExchange(data []byte) (*KeyExchange, []byte, error) {
+	if len(data) < keyExchangeSize {
+		return nil, nil, fmt.Errorf("%w: key exchange size %d", ErrInvalidMessage, len(data))
+	}
+	k := &KeyExchange{
+		IdentityKey:    ed25519.PublicKey(append([]byte(nil), data[:32]...)),
+		EphemeralKey:   append([]byte(nil), data[32:64]...),
+		SignedPreKeyID: binary.BigEndian.Uint32(data[64:68]),
+	}
+	switch data[68] {
+	case 0:
+		return k, data[keyExchangeSize:], nil
+	case 1:
+		if len(data) < keyExchangeSize+4 {
+			return nil, nil, fmt.Errorf("%w: truncated key exchange", ErrInvalidMessage)
+		}
+		id := binary.BigEndian.Uint32(data[keyExchangeSize:])
+		k.PreKeyID = &id
+		return k, data[keyExchangeSize+4:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: bad pre-key flag %d", ErrInvalidMessage, data[68])
+	}
+}
@@ -0,0 +1,65 @@
+package omemo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyExchangeRoundTrip(t *testing.T) {
+	ikp, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := bytes.Repeat([]byte{7}, 32)
+	preKeyID := uint32(3)
+
+	for _, kex := range []*KeyExchange{
+		{IdentityKey: ikp.PublicKey, EphemeralKey: ek, PreKeyID: &preKeyID, SignedPreKeyID: 1},
+		{IdentityKey: ikp.PublicKey, EphemeralKey: ek, SignedPreKeyID: 2},
+	} {
+		data, err := kex.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, rest, err := ParseKeyExchange(append(data, "ratchet"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != "ratchet" {
+			t.Errorf("rest = %q", rest)
+		}
+		if !bytes.Equal(got.IdentityKey, kex.IdentityKey) || !bytes.Equal(got.EphemeralKey, ek) || got.SignedPreKeyID != kex.SignedPreKeyID {
+			t.Errorf("decoded %+v, want %+v", got, kex)
+		}
+		if (got.PreKeyID == nil) != (kex.PreKeyID == nil) || (got.PreKeyID != nil && *got.PreKeyID != preKeyID) {
+			t.Errorf("pre-key ID %v, want %v", got.PreKeyID, kex.PreKeyID)
+		}
+
+		var k KeyExchange
+		if err := k.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.UnmarshalBinary(append(data, 0)); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("trailing byte: %v", err)
+		}
+	}
+}
+
+func TestKeyExchangeMalformed(t *testing.T) {
+	if _, err := (&KeyExchange{EphemeralKey: make([]byte, 32)}).MarshalBinary(); !errors.Is(err, ErrInvalidKeyLength) {
+		t.Errorf("missing identity key: %v", err)
+	}
+	if _, _, err := ParseKeyExchange(make([]byte, keyExchangeSize-1)); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("short data: %v", err)
+	}
+	data := make([]byte, keyExchangeSize)
+	data[68] = 1
+	if _, _, err := ParseKeyExchange(data); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("truncated pre-key ID: %v", err)
+	}
+	data[68] = 2
+	if _, _, err := ParseKeyExchange(data); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("bad flag: %v", err)
+	}
+}
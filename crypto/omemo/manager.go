@@ -6,23 +6,41 @@ import (
 	"crypto/rand"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Manager provides the high-level API for OMEMO encryption and decryption.
 type Manager struct {
-	mu      sync.Mutex
-	store   Store
-	bundles map[Address]*Bundle   // cached remote bundles
-	sessions map[Address]*Session // active sessions
+	mu       sync.Mutex
+	store    Store
+	bundles  map[Address]*Bundle   // cached remote bundles
+	sessions map[Address]*Session  // active sessions
+	local    *Bundle               // local bundle, without the pre-keys used since
+	failures map[Address]int       // decryption failures in a row
+	lastUsed map[Address]time.Time // last successful use of a session
+	created  time.Time
+	now      func() time.Time
+
+	policy          TrustPolicy
+	refuseUntrusted bool
 }
 
 // NewManager creates a new OMEMO Manager.
-func NewManager(store Store) *Manager {
-	return &Manager{
+func NewManager(store Store, opts ...Option) *Manager {
+	m := &Manager{
 		store:    store,
 		bundles:  make(map[Address]*Bundle),
 		sessions: make(map[Address]*Session),
+		failures: make(map[Address]int),
+		lastUsed: make(map[Address]time.Time),
+		created:  time.Now(),
+		now:      time.Now,
+		policy:   BTBV{},
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 // ProcessBundle stores a remote bundle for later X3DH initiation.
@@ -32,9 +50,18 @@ func (m *Manager) ProcessBundle(addr Address, bundle *Bundle) {
 	m.bundles[addr] = bundle
 }
 
-// GenerateBundle generates a new OMEMO bundle for the local device.
+// GenerateBundle generates a new OMEMO bundle for the local device. The
+// Manager keeps it current as pre-keys are used; see Bundle and
+// ReplenishPreKeys.
 func (m *Manager) GenerateBundle(preKeyCount int) (*Bundle, error) {
-	return GenerateBundle(m.store, preKeyCount)
+	bundle, err := GenerateBundle(m.store, preKeyCount)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.local = copyBundle(bundle)
+	return bundle, nil
 }
 
 // Encrypt encrypts plaintext for multiple recipients.
@@ -72,38 +99,9 @@ func (m *Manager) Encrypt(plaintext []byte, recipients ...Address) (*EncryptedMe
 	if err != nil {
 		return nil, err
 	}
-
-	keys := make([]MessageKey, 0, len(recipients))
-	for _, addr := range recipients {
-		session, err := m.getOrCreateSession(addr)
-		if err != nil {
-			return nil, fmt.Errorf("session for %s: %w", addr, err)
-		}
-
-		header, ct, isPreKey, err := session.Encrypt(keyMaterial)
-		if err != nil {
-			return nil, fmt.Errorf("encrypt for %s: %w", addr, err)
-		}
-
-		// Serialize header + ciphertext together
-		headerBytes, err := header.MarshalBinary()
-		if err != nil {
-			return nil, err
-		}
-		data := make([]byte, len(headerBytes)+len(ct))
-		copy(data, headerBytes)
-		copy(data[len(headerBytes):], ct)
-
-		keys = append(keys, MessageKey{
-			DeviceID: addr.DeviceID,
-			Data:     data,
-			IsPreKey: isPreKey,
-		})
-
-		// Save session
-		if err := m.saveSession(addr, session); err != nil {
-			return nil, err
-		}
+	keys, err := m.encryptKeyMaterial(keyMaterial, recipients)
+	if err != nil {
+		return nil, err
 	}
 
 	return &EncryptedMessage{
@@ -114,7 +112,11 @@ func (m *Manager) Encrypt(plaintext []byte, recipients ...Address) (*EncryptedMe
 	}, nil
 }
 
-// Decrypt decrypts an OMEMO encrypted message.
+// Decrypt decrypts an OMEMO encrypted message. A key transport message,
+// which has no payload, only advances the session and returns nil.
+//
+// Failures are counted per sender, see NeedsReset. After a failure the
+// session goes back to its last saved state.
 func (m *Manager) Decrypt(sender Address, msg *EncryptedMessage) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -136,6 +138,19 @@ func (m *Manager) Decrypt(sender Address, msg *EncryptedMessage) ([]byte, error)
 		return nil, fmt.Errorf("%w: no key for device %d", ErrInvalidMessage, deviceID)
 	}
 
+	plaintext, err := m.decrypt(sender, ourKey, msg)
+	if err != nil {
+		// The ratchet may have moved before failing.
+		delete(m.sessions, sender)
+		m.failures[sender]++
+		return nil, err
+	}
+	delete(m.failures, sender)
+	m.lastUsed[sender] = m.now()
+	return plaintext, nil
+}
+
+func (m *Manager) decrypt(sender Address, ourKey *MessageKey, msg *EncryptedMessage) ([]byte, error) {
 	// Parse header from the key data
 	if len(ourKey.Data) < ratchetHeaderSize {
 		return nil, ErrInvalidMessage
@@ -147,13 +162,22 @@ func (m *Manager) Decrypt(sender Address, msg *EncryptedMessage) ([]byte, error)
 	ratchetCiphertext := ourKey.Data[ratchetHeaderSize:]
 
 	// 2. Get or create session
-	session, err := m.getOrCreateSessionForDecrypt(sender, ourKey.IsPreKey)
+	session, fresh, err := m.getOrCreateSessionForDecrypt(sender, ourKey)
 	if err != nil {
 		return nil, err
 	}
 
 	// 3. Ratchet-decrypt → 48-byte key_material
 	keyMaterial, err := session.Decrypt(&header, ratchetCiphertext)
+	if err != nil && !fresh && ourKey.KeyExchange != nil {
+		// The sender started over, most likely after losing its session.
+		kex := ourKey.KeyExchange
+		session, err = m.respond(sender, kex.IdentityKey, kex.EphemeralKey, kex.PreKeyID, kex.SignedPreKeyID)
+		if err != nil {
+			return nil, err
+		}
+		keyMaterial, err = session.Decrypt(&header, ratchetCiphertext)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -162,18 +186,21 @@ func (m *Manager) Decrypt(sender Address, msg *EncryptedMessage) ([]byte, error)
 		return nil, fmt.Errorf("%w: key material length %d, expected 48", ErrInvalidMessage, len(keyMaterial))
 	}
 
-	// 4. Split: message_key = [:32], auth_tag = [32:48]
-	messageKey := keyMaterial[:32]
-	authTag := keyMaterial[32:48]
+	var plaintext []byte
+	if len(msg.Payload) > 0 {
+		// 4. Split: message_key = [:32], auth_tag = [32:48]
+		messageKey := keyMaterial[:32]
+		authTag := keyMaterial[32:48]
 
-	// 5. AES-GCM decrypt payload||authTag with messageKey and IV
-	fullCiphertext := make([]byte, len(msg.Payload)+len(authTag))
-	copy(fullCiphertext, msg.Payload)
-	copy(fullCiphertext[len(msg.Payload):], authTag)
+		// 5. AES-GCM decrypt payload||authTag with messageKey and IV
+		fullCiphertext := make([]byte, len(msg.Payload)+len(authTag))
+		copy(fullCiphertext, msg.Payload)
+		copy(fullCiphertext[len(msg.Payload):], authTag)
 
-	plaintext, err := aesGCMDecrypt(messageKey, msg.IV, fullCiphertext)
-	if err != nil {
-		return nil, err
+		plaintext, err = aesGCMDecrypt(messageKey, msg.IV, fullCiphertext)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Save session
@@ -184,6 +211,60 @@ func (m *Manager) Decrypt(sender Address, msg *EncryptedMessage) ([]byte, error)
 	return plaintext, nil
 }
 
+// encryptKeyMaterial ratchet-encrypts keyMaterial for each recipient.
+func (m *Manager) encryptKeyMaterial(keyMaterial []byte, recipients []Address) ([]MessageKey, error) {
+	keys := make([]MessageKey, 0, len(recipients))
+	for _, addr := range recipients {
+		session, err := m.getOrCreateSession(addr)
+		if err != nil {
+			return nil, fmt.Errorf("session for %s: %w", addr, err)
+		}
+		if err := m.checkTrust(addr, session); err != nil {
+			return nil, err
+		}
+
+		header, ct, isPreKey, err := session.Encrypt(keyMaterial)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt for %s: %w", addr, err)
+		}
+
+		// Serialize header + ciphertext together
+		headerBytes, err := header.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, len(headerBytes)+len(ct))
+		copy(data, headerBytes)
+		copy(data[len(headerBytes):], ct)
+
+		key := MessageKey{
+			DeviceID: addr.DeviceID,
+			Data:     data,
+			IsPreKey: isPreKey,
+		}
+		if isPreKey && session.PendingPreKey != nil {
+			ikp, err := m.store.GetIdentityKeyPair()
+			if err != nil {
+				return nil, err
+			}
+			key.KeyExchange = &KeyExchange{
+				IdentityKey:    ikp.PublicKey,
+				EphemeralKey:   session.PendingPreKey.EphemeralPubKey,
+				PreKeyID:       session.PendingPreKey.PreKeyID,
+				SignedPreKeyID: session.PendingPreKey.SignedPreKeyID,
+			}
+		}
+		keys = append(keys, key)
+
+		// Save session
+		if err := m.saveSession(addr, session); err != nil {
+			return nil, err
+		}
+		m.lastUsed[addr] = m.now()
+	}
+	return keys, nil
+}
+
 func (m *Manager) getOrCreateSession(addr Address) (*Session, error) {
 	// Check in-memory sessions first
 	if session, ok := m.sessions[addr]; ok {
@@ -219,8 +300,8 @@ func (m *Manager) getOrCreateSession(addr Address) (*Session, error) {
 		return nil, err
 	}
 
-	// Save remote identity (TOFU)
-	if err := m.store.SaveRemoteIdentity(addr, bundle.IdentityKey); err != nil {
+	// Save remote identity
+	if err := m.saveIdentity(addr, bundle.IdentityKey); err != nil {
 		return nil, err
 	}
 
@@ -233,10 +314,12 @@ func (m *Manager) getOrCreateSession(addr Address) (*Session, error) {
 	return session, nil
 }
 
-func (m *Manager) getOrCreateSessionForDecrypt(sender Address, isPreKey bool) (*Session, error) {
+// getOrCreateSessionForDecrypt returns the session with sender, and whether
+// it was created for this message.
+func (m *Manager) getOrCreateSessionForDecrypt(sender Address, key *MessageKey) (*Session, bool, error) {
 	// Try existing session first
 	if session, ok := m.sessions[sender]; ok {
-		return session, nil
+		return session, false, nil
 	}
 
 	// Try loading from store
@@ -245,16 +328,21 @@ func (m *Manager) getOrCreateSessionForDecrypt(sender Address, isPreKey bool) (*
 		session := &Session{}
 		if err := session.UnmarshalBinary(data); err == nil {
 			m.sessions[sender] = session
-			return session, nil
+			return session, false, nil
 		}
 	}
 
 	// If this is a pre-key message, create session as Bob
-	if !isPreKey {
-		return nil, fmt.Errorf("%w: %s", ErrNoSession, sender)
+	if !key.IsPreKey {
+		return nil, false, fmt.Errorf("%w: %s", ErrNoSession, sender)
 	}
-
-	return m.createSessionFromPreKeyMessage(sender)
+	var session *Session
+	if kex := key.KeyExchange; kex != nil {
+		session, err = m.respond(sender, kex.IdentityKey, kex.EphemeralKey, kex.PreKeyID, kex.SignedPreKeyID)
+	} else {
+		session, err = m.createSessionFromPreKeyMessage(sender)
+	}
+	return session, true, err
 }
 
 func (m *Manager) createSessionFromPreKeyMessage(sender Address) (*Session, error) {
@@ -292,8 +380,8 @@ func (m *Manager) createSessionFromPreKeyMessage(sender Address) (*Session, erro
 		return nil, err
 	}
 
-	// Save remote identity (TOFU)
-	if err := m.store.SaveRemoteIdentity(sender, bundle.IdentityKey); err != nil {
+	// Save remote identity
+	if err := m.saveIdentity(sender, bundle.IdentityKey); err != nil {
 		return nil, err
 	}
 
@@ -301,28 +389,15 @@ func (m *Manager) createSessionFromPreKeyMessage(sender Address) (*Session, erro
 	return session, nil
 }
 
-func (m *Manager) saveSession(addr Address, session *Session) error {
-	data, err := session.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	return m.store.SaveSession(addr, data)
-}
-
-// DecryptPreKeyMessage handles the full pre-key message decryption flow.
-// It takes the sender's identity key, ephemeral key, and optionally the used pre-key ID
-// to establish a new session as Bob and decrypt the message.
-func (m *Manager) DecryptPreKeyMessage(
+// respond creates the session as Bob for a pre-key message from sender,
+// consuming the one-time pre-key it used.
+func (m *Manager) respond(
 	sender Address,
 	senderIdentityKey ed25519.PublicKey,
 	ephemeralPubKey []byte,
 	usedPreKeyID *uint32,
 	signedPreKeyID uint32,
-	msg *EncryptedMessage,
-) ([]byte, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
+) (*Session, error) {
 	// Get our identity key pair
 	ikp, err := m.store.GetIdentityKeyPair()
 	if err != nil {
@@ -355,6 +430,7 @@ func (m *Manager) DecryptPreKeyMessage(
 		}
 		// Remove the used one-time pre-key
 		_ = m.store.RemovePreKey(*usedPreKeyID)
+		m.removeLocalPreKey(*usedPreKeyID)
 	}
 
 	// Create session as Bob
@@ -364,11 +440,40 @@ func (m *Manager) DecryptPreKeyMessage(
 	}
 
 	// Save remote identity
-	if err := m.store.SaveRemoteIdentity(sender, senderIdentityKey); err != nil {
+	if err := m.saveIdentity(sender, senderIdentityKey); err != nil {
 		return nil, err
 	}
 
 	m.sessions[sender] = session
+	return session, nil
+}
+
+func (m *Manager) saveSession(addr Address, session *Session) error {
+	data, err := session.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return m.store.SaveSession(addr, data)
+}
+
+// DecryptPreKeyMessage handles the full pre-key message decryption flow.
+// It takes the sender's identity key, ephemeral key, and optionally the used pre-key ID
+// to establish a new session as Bob and decrypt the message.
+func (m *Manager) DecryptPreKeyMessage(
+	sender Address,
+	senderIdentityKey ed25519.PublicKey,
+	ephemeralPubKey []byte,
+	usedPreKeyID *uint32,
+	signedPreKeyID uint32,
+	msg *EncryptedMessage,
+) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, err := m.respond(sender, senderIdentityKey, ephemeralPubKey, usedPreKeyID, signedPreKeyID)
+	if err != nil {
+		return nil, err
+	}
 
 	// Find our key
 	deviceID, err := m.store.GetLocalDeviceID()
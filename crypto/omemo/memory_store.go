@@ -2,17 +2,20 @@ package omemo
 
 import (
 	"bytes"
+	"cmp"
 	"crypto/ed25519"
+	"slices"
 	"sync"
 )
 
 // MemoryStore is an in-memory Store implementation for testing.
-// It uses a Trust On First Use (TOFU) model for identity trust.
+// IsTrusted uses a Trust On First Use (TOFU) model for identity trust.
 type MemoryStore struct {
 	mu            sync.RWMutex
 	identityKey   *IdentityKeyPair
 	deviceID      uint32
 	remoteKeys    map[Address]ed25519.PublicKey
+	trust         map[Address]TrustLevel // for the key in remoteKeys
 	preKeys       map[uint32]*PreKeyRecord
 	signedPreKeys map[uint32]*SignedPreKeyRecord
 	sessions      map[Address][]byte
@@ -23,6 +26,7 @@ func NewMemoryStore(deviceID uint32) *MemoryStore {
 	return &MemoryStore{
 		deviceID:      deviceID,
 		remoteKeys:    make(map[Address]ed25519.PublicKey),
+		trust:         make(map[Address]TrustLevel),
 		preKeys:       make(map[uint32]*PreKeyRecord),
 		signedPreKeys: make(map[uint32]*SignedPreKeyRecord),
 		sessions:      make(map[Address][]byte),
@@ -61,6 +65,9 @@ func (s *MemoryStore) GetRemoteIdentity(addr Address) (ed25519.PublicKey, error)
 func (s *MemoryStore) SaveRemoteIdentity(addr Address, key ed25519.PublicKey) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !bytes.Equal(s.remoteKeys[addr], key) {
+		delete(s.trust, addr)
+	}
 	s.remoteKeys[addr] = key
 	return nil
 }
@@ -144,3 +151,55 @@ func (s *MemoryStore) ContainsSession(addr Address) (bool, error) {
 	_, ok := s.sessions[addr]
 	return ok, nil
 }
+
+func (s *MemoryStore) DeleteSession(addr Address) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, addr)
+	return nil
+}
+
+func (s *MemoryStore) SessionDevices(jid string) ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var devices []uint32
+	for addr := range s.sessions {
+		if addr.JID == jid {
+			devices = append(devices, addr.DeviceID)
+		}
+	}
+	slices.Sort(devices)
+	return devices, nil
+}
+
+func (s *MemoryStore) GetTrust(addr Address, key ed25519.PublicKey) (TrustLevel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !bytes.Equal(s.remoteKeys[addr], key) {
+		return TrustUnknown, nil
+	}
+	return s.trust[addr], nil
+}
+
+func (s *MemoryStore) SaveTrust(addr Address, key ed25519.PublicKey, level TrustLevel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteKeys[addr] = key
+	s.trust[addr] = level
+	return nil
+}
+
+func (s *MemoryStore) Identities(jid string) ([]Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []Identity
+	for addr, key := range s.remoteKeys {
+		if addr.JID == jid {
+			ids = append(ids, Identity{Address: addr, IdentityKey: key, Trust: s.trust[addr]})
+		}
+	}
+	slices.SortFunc(ids, func(a, b Identity) int {
+		return cmp.Compare(a.Address.DeviceID, b.Address.DeviceID)
+	})
+	return ids, nil
+}
@@ -164,4 +164,55 @@ func TestMemoryStoreSessions(t *testing.T) {
 	if got2[0] == 0xFF {
 		t.Error("session data should be independent copies")
 	}
+
+	other := Address{JID: "bob@example.com", DeviceID: 5}
+	if err := store.SaveSession(other, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveSession(Address{JID: "carol@example.com", DeviceID: 3}, data); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := store.SessionDevices("bob@example.com")
+	if err != nil || len(devices) != 2 || devices[0] != 1 || devices[1] != 5 {
+		t.Fatalf("SessionDevices = %v, %v", devices, err)
+	}
+
+	if err := store.DeleteSession(addr); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := store.ContainsSession(addr); exists {
+		t.Error("session still exists after DeleteSession")
+	}
+}
+
+func TestMemoryStoreTrust(t *testing.T) {
+	store := NewMemoryStore(1)
+	addr := Address{JID: "bob@example.com", DeviceID: 2}
+	key := make([]byte, 32)
+	if level, err := store.GetTrust(addr, key); err != nil || level != TrustUnknown {
+		t.Fatalf("GetTrust = %s, %v", level, err)
+	}
+	if err := store.SaveTrust(addr, key, TrustVerified); err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := store.GetTrust(addr, key); level != TrustVerified {
+		t.Fatalf("GetTrust = %s", level)
+	}
+	ids, err := store.Identities("bob@example.com")
+	if err != nil || len(ids) != 1 || ids[0].Address != addr || ids[0].Trust != TrustVerified {
+		t.Fatalf("Identities = %+v, %v", ids, err)
+	}
+
+	// A new key for the address loses the trust of the old one.
+	other := make([]byte, 32)
+	other[0] = 1
+	if err := store.SaveRemoteIdentity(addr, other); err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := store.GetTrust(addr, other); level != TrustUnknown {
+		t.Fatalf("trust of a changed key: %s", level)
+	}
+	if level, _ := store.GetTrust(addr, key); level != TrustUnknown {
+		t.Fatalf("trust of the old key: %s", level)
+	}
 }
@@ -13,4 +13,8 @@ type MessageKey struct {
 	DeviceID uint32
 	Data     []byte // ratchet-encrypted key material (header + ciphertext)
 	IsPreKey bool   // true if this is a pre-key message (first message in a session)
+
+	// KeyExchange carries the X3DH data the recipient needs to set up the
+	// session. Encrypt sets it on pre-key messages.
+	KeyExchange *KeyExchange
 }
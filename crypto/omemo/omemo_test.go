@@ -141,6 +141,67 @@ func TestFullConversation(t *testing.T) {
 	}
 }
 
+// TestDecryptWithKeyExchange tests that Decrypt sets up the session from
+// the key exchange Encrypt attaches to pre-key messages.
+func TestDecryptWithKeyExchange(t *testing.T) {
+	aliceManager := NewManager(NewMemoryStore(1))
+	if _, err := aliceManager.GenerateBundle(5); err != nil {
+		t.Fatal(err)
+	}
+	aliceAddr := Address{JID: "alice@example.com", DeviceID: 1}
+
+	bobStore := NewMemoryStore(2)
+	bobManager := NewManager(bobStore)
+	bobBundle, err := bobManager.GenerateBundle(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobAddr := Address{JID: "bob@example.com", DeviceID: 2}
+
+	// Only Alice knows the other's bundle.
+	aliceManager.ProcessBundle(bobAddr, bobBundle)
+
+	for _, text := range []string{"first", "second before any reply"} {
+		msg, err := aliceManager.Encrypt([]byte(text), bobAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kex := msg.Keys[0].KeyExchange
+		if !msg.Keys[0].IsPreKey || kex == nil || kex.PreKeyID == nil {
+			t.Fatalf("%q: key %+v", text, msg.Keys[0])
+		}
+		plaintext, err := bobManager.Decrypt(aliceAddr, msg)
+		if err != nil {
+			t.Fatalf("bob decrypt %q: %v", text, err)
+		}
+		if string(plaintext) != text {
+			t.Errorf("decrypted %q, want %q", plaintext, text)
+		}
+	}
+	if _, err := bobStore.GetPreKey(1); err == nil {
+		t.Error("used one-time pre-key was not removed")
+	}
+
+	reply, err := bobManager.Encrypt([]byte("reply"), aliceAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Keys[0].IsPreKey || reply.Keys[0].KeyExchange != nil {
+		t.Error("bob's reply should not be a pre-key message")
+	}
+	if plaintext, err := aliceManager.Decrypt(bobAddr, reply); err != nil || string(plaintext) != "reply" {
+		t.Fatalf("alice decrypt = %q, %v", plaintext, err)
+	}
+
+	next, err := aliceManager.Encrypt([]byte("after reply"), bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Keys[0].KeyExchange != nil {
+		t.Error("key exchange sent after the session was confirmed")
+	}
+}
+
 // TestSessionPersistence tests that sessions survive serialization/deserialization.
 func TestSessionPersistence(t *testing.T) {
 	// Setup Alice and Bob
@@ -0,0 +1,19 @@
+module github.com/meszmate/xmpp-go/crypto/omemo/omemoxmpp
+
+go 1.25.0
+
+require (
+	github.com/meszmate/xmpp-go v0.0.0
+	github.com/meszmate/xmpp-go/crypto/omemo v0.0.0
+)
+
+require (
+	golang.org/x/crypto v0.47.0 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
+)
+
+replace (
+	github.com/meszmate/xmpp-go => ../../..
+	github.com/meszmate/xmpp-go/crypto/omemo => ..
+)
@@ -0,0 +1,241 @@
+// Package omemoxmpp backs the omemo client plugin with the crypto/omemo
+// Manager. It is a module of its own, so that crypto/omemo keeps no
+// dependency on the main library.
+package omemoxmpp
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/meszmate/xmpp-go/crypto/omemo"
+	omemoplugin "github.com/meszmate/xmpp-go/plugins/omemo"
+)
+
+// Cipher implements omemoplugin.Cipher with a Manager. It also tops up the
+// Manager's pre-keys and resets broken sessions for the plugin.
+type Cipher struct {
+	m *omemo.Manager
+}
+
+var (
+	_ omemoplugin.Cipher            = (*Cipher)(nil)
+	_ omemoplugin.PreKeyReplenisher = (*Cipher)(nil)
+	_ omemoplugin.SessionHealer     = (*Cipher)(nil)
+	_ omemoplugin.TrustFunc         = (*Cipher)(nil).Trust
+)
+
+// New returns a Cipher encrypting with m. The plugin publishes the local
+// bundle of m, so m.GenerateBundle must have been called.
+func New(m *omemo.Manager) *Cipher {
+	return &Cipher{m: m}
+}
+
+// Bundle returns the local bundle in its XML form.
+func (c *Cipher) Bundle() (*omemoplugin.Bundle, error) {
+	bundle := c.m.Bundle()
+	if bundle == nil {
+		return nil, omemo.ErrNoBundle
+	}
+	return BundleToXML(bundle), nil
+}
+
+// ProcessBundle checks the signature on the signed pre-key of a remote
+// bundle and hands the bundle to the Manager.
+func (c *Cipher) ProcessBundle(addr omemoplugin.Address, b *omemoplugin.Bundle) error {
+	bundle, err := BundleFromXML(b)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(bundle.IdentityKey, bundle.SignedPreKey, bundle.SignedPreKeySignature) {
+		return omemo.ErrInvalidSignature
+	}
+	c.m.ProcessBundle(address(addr), bundle)
+	return nil
+}
+
+// Encrypt encrypts plaintext for the devices in to.
+func (c *Cipher) Encrypt(plaintext []byte, to ...omemoplugin.Address) (*omemoplugin.Encrypted, error) {
+	msg, err := c.m.Encrypt(plaintext, addresses(to)...)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptedToXML(msg)
+}
+
+// Decrypt decrypts enc, sent by from. Pre-key messages set up the session
+// from the key exchange they carry. A key transport element decrypts to
+// nil.
+func (c *Cipher) Decrypt(from omemoplugin.Address, enc *omemoplugin.Encrypted) ([]byte, error) {
+	msg, err := EncryptedFromXML(enc)
+	if err != nil {
+		return nil, err
+	}
+	return c.m.Decrypt(address(from), msg)
+}
+
+// Trust decides on a device seen for the first time with the trust policy
+// of the Manager. It is meant to be passed to the plugin's OnNewDevice.
+func (c *Cipher) Trust(addr omemoplugin.Address, identityKey []byte) bool {
+	if len(identityKey) != ed25519.PublicKeySize {
+		return false
+	}
+	level, err := c.m.DecideTrust(address(addr), identityKey)
+	return err == nil && level.Trusted()
+}
+
+// ReplenishPreKeys tops up the one-time pre-keys of the Manager with the
+// package defaults and reports whether the bundle changed.
+func (c *Cipher) ReplenishPreKeys() (bool, error) {
+	return c.m.ReplenishPreKeys(omemo.DefaultPreKeyThreshold, omemo.DefaultPreKeyCount)
+}
+
+// DecryptFailed resets the session with from once its messages failed to
+// decrypt omemo.SessionResetFailures times in a row.
+func (c *Cipher) DecryptFailed(from omemoplugin.Address) bool {
+	addr := address(from)
+	if !c.m.NeedsReset(addr) {
+		return false
+	}
+	return c.m.ResetSession(addr) == nil
+}
+
+// KeyTransport returns a key transport element for the devices in to.
+func (c *Cipher) KeyTransport(to ...omemoplugin.Address) (*omemoplugin.Encrypted, error) {
+	msg, err := c.m.KeyTransport(addresses(to)...)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptedToXML(msg)
+}
+
+func addresses(to []omemoplugin.Address) []omemo.Address {
+	recipients := make([]omemo.Address, len(to))
+	for i, addr := range to {
+		recipients[i] = address(addr)
+	}
+	return recipients
+}
+
+func address(addr omemoplugin.Address) omemo.Address {
+	return omemo.Address{JID: addr.JID, DeviceID: addr.DeviceID}
+}
+
+// BundleToXML converts a bundle to the element published on PEP.
+func BundleToXML(b *omemo.Bundle) *omemoplugin.Bundle {
+	preKeys := make([]omemoplugin.Prekey, len(b.PreKeys))
+	for i, pk := range b.PreKeys {
+		preKeys[i] = omemoplugin.Prekey{ID: pk.ID, Value: base64.StdEncoding.EncodeToString(pk.PublicKey)}
+	}
+	return &omemoplugin.Bundle{
+		SPK:     omemoplugin.SPK{ID: b.SignedPreKeyID, Value: base64.StdEncoding.EncodeToString(b.SignedPreKey)},
+		SPKS:    base64.StdEncoding.EncodeToString(b.SignedPreKeySignature),
+		IK:      base64.StdEncoding.EncodeToString(b.IdentityKey),
+		Prekeys: preKeys,
+	}
+}
+
+// BundleFromXML converts a bundle fetched from PEP.
+func BundleFromXML(b *omemoplugin.Bundle) (*omemo.Bundle, error) {
+	ik, err := decode(b.IK, "identity key")
+	if err != nil {
+		return nil, err
+	}
+	spk, err := decode(b.SPK.Value, "signed pre-key")
+	if err != nil {
+		return nil, err
+	}
+	spks, err := decode(b.SPKS, "signed pre-key signature")
+	if err != nil {
+		return nil, err
+	}
+	if len(ik) != ed25519.PublicKeySize || len(spk) != 32 {
+		return nil, omemo.ErrInvalidKeyLength
+	}
+	preKeys := make([]omemo.BundlePreKey, len(b.Prekeys))
+	for i, pk := range b.Prekeys {
+		pub, err := decode(pk.Value, "pre-key")
+		if err != nil {
+			return nil, err
+		}
+		preKeys[i] = omemo.BundlePreKey{ID: pk.ID, PublicKey: pub}
+	}
+	return &omemo.Bundle{
+		IdentityKey:           ik,
+		SignedPreKey:          spk,
+		SignedPreKeyID:        b.SPK.ID,
+		SignedPreKeySignature: spks,
+		PreKeys:               preKeys,
+	}, nil
+}
+
+// EncryptedToXML converts an encrypted message to its <encrypted/>
+// element. The key exchange of a pre-key message is written in front of its
+// key data.
+func EncryptedToXML(msg *omemo.EncryptedMessage) (*omemoplugin.Encrypted, error) {
+	keys := make([]omemoplugin.Key, len(msg.Keys))
+	for i, k := range msg.Keys {
+		data := k.Data
+		if k.IsPreKey && k.KeyExchange != nil {
+			kex, err := k.KeyExchange.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			data = append(kex, data...)
+		}
+		keys[i] = omemoplugin.Key{
+			RID:    k.DeviceID,
+			Prekey: k.IsPreKey,
+			Value:  base64.StdEncoding.EncodeToString(data),
+		}
+	}
+	enc := &omemoplugin.Encrypted{
+		Header: omemoplugin.Header{
+			SID:  msg.SenderDeviceID,
+			Keys: keys,
+			IV:   base64.StdEncoding.EncodeToString(msg.IV),
+		},
+	}
+	if len(msg.Payload) > 0 {
+		enc.Payload = &omemoplugin.Payload{Value: base64.StdEncoding.EncodeToString(msg.Payload)}
+	}
+	return enc, nil
+}
+
+// EncryptedFromXML converts a received <encrypted/> element.
+func EncryptedFromXML(enc *omemoplugin.Encrypted) (*omemo.EncryptedMessage, error) {
+	iv, err := decode(enc.Header.IV, "iv")
+	if err != nil {
+		return nil, err
+	}
+	msg := &omemo.EncryptedMessage{SenderDeviceID: enc.Header.SID, IV: iv}
+	if enc.Payload != nil {
+		if msg.Payload, err = decode(enc.Payload.Value, "payload"); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range enc.Header.Keys {
+		data, err := decode(k.Value, "key")
+		if err != nil {
+			return nil, err
+		}
+		key := omemo.MessageKey{DeviceID: k.RID, Data: data, IsPreKey: k.Prekey}
+		// Keys for other devices may come from other implementations, so a
+		// key exchange that does not parse is left in the data.
+		if k.Prekey {
+			if kex, rest, err := omemo.ParseKeyExchange(data); err == nil {
+				key.KeyExchange, key.Data = kex, rest
+			}
+		}
+		msg.Keys = append(msg.Keys, key)
+	}
+	return msg, nil
+}
+
+func decode(s, what string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", omemo.ErrInvalidMessage, what, err)
+	}
+	return b, nil
+}
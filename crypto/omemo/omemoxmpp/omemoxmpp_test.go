@@ -0,0 +1,254 @@
+package omemoxmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/crypto/omemo"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	omemoplugin "github.com/meszmate/xmpp-go/plugins/omemo"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// pep keeps the PEP items of all accounts, keyed by owner and node.
+type pep struct {
+	mu    sync.Mutex
+	items map[string][]pubsub.PubItem
+}
+
+func (s *pep) sendIQ(own string) func(context.Context, *stanza.IQ) (*stanza.IQ, error) {
+	return func(_ context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var req pubsub.PubSub
+		if err := xml.Unmarshal(iq.Query, &req); err != nil {
+			return nil, err
+		}
+		owner := own
+		if !iq.To.IsZero() {
+			owner = iq.To.String()
+		}
+		reply := iq.ResultIQ()
+		if req.Publish != nil {
+			key := owner + " " + req.Publish.Node
+			s.items[key] = append(s.items[key], req.Publish.Items...)
+			return reply, nil
+		}
+		items, ok := s.items[owner+" "+req.Items.Node]
+		if !ok {
+			return reply, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "")
+		}
+		var resp []pubsub.PubItem
+		for i := len(items) - 1; i >= 0; i-- {
+			if len(req.Items.Items) == 0 || req.Items.Items[0].ID == items[i].ID {
+				resp = append(resp, items[i])
+				break
+			}
+		}
+		reply.Query, _ = xml.Marshal(pubsub.PubSub{Items: &pubsub.Items{Node: req.Items.Node, Items: resp}})
+		return reply, nil
+	}
+}
+
+// device is one OMEMO device, with the stanzas its plugin sent.
+type device struct {
+	*omemoplugin.Plugin
+	m    *omemo.Manager
+	jid  string
+	sent chan *stanza.Message
+}
+
+func newDevice(t *testing.T, server *pep, account string, id uint32) *device {
+	t.Helper()
+	d := &device{
+		Plugin: omemoplugin.New(id),
+		m:      omemo.NewManager(omemo.NewMemoryStore(id)),
+		jid:    account,
+		sent:   make(chan *stanza.Message, 1),
+	}
+	if _, err := d.m.GenerateBundle(5); err != nil {
+		t.Fatal(err)
+	}
+	d.SetCipher(New(d.m))
+	if err := d.Initialize(context.Background(), plugin.InitParams{
+		LocalJID: func() string { return account + "/res" },
+		SendIQ:   server.sendIQ(account),
+		SendElement: func(_ context.Context, v any) error {
+			d.sent <- v.(*stanza.Message)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	deadline := time.Now().Add(2 * time.Second)
+	for len(d.GetDevices(account)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("device not published")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return d
+}
+
+// receive decodes msg as it would arrive at to and decrypts it.
+func receive(t *testing.T, from, to *device, msg *stanza.Message) (string, error) {
+	t.Helper()
+	msg.From = jid.MustParse(from.jid + "/res")
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received stanza.Message
+	if err := xml.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	return to.DecryptMessage(context.Background(), &received)
+}
+
+// encrypt returns text encrypted by from for to.
+func encrypt(t *testing.T, from, to *device, text string) *stanza.Message {
+	t.Helper()
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse(to.jid)
+	msg.SetBody(text)
+	if err := from.EncryptMessage(context.Background(), msg); err != nil {
+		t.Fatalf("encrypt %q: %v", text, err)
+	}
+	if msg.Body() == text {
+		t.Fatalf("%q sent in the clear", text)
+	}
+	return msg
+}
+
+func send(t *testing.T, from, to *device, text string) {
+	t.Helper()
+	body, err := receive(t, from, to, encrypt(t, from, to, text))
+	if err != nil {
+		t.Fatalf("decrypt %q: %v", text, err)
+	}
+	if body != text {
+		t.Fatalf("decrypted %q, want %q", body, text)
+	}
+}
+
+func TestConversation(t *testing.T) {
+	server := &pep{items: make(map[string][]pubsub.PubItem)}
+	alice := newDevice(t, server, "alice@example.com", 1)
+	bob := newDevice(t, server, "bob@example.com", 2)
+
+	send(t, alice, bob, "Hello Bob!")
+	send(t, alice, bob, "Are you there?")
+	send(t, bob, alice, "Hi Alice!")
+	send(t, alice, bob, "Great")
+}
+
+func TestSessionHealing(t *testing.T) {
+	server := &pep{items: make(map[string][]pubsub.PubItem)}
+	alice := newDevice(t, server, "alice@example.com", 1)
+	bob := newDevice(t, server, "bob@example.com", 2)
+	send(t, alice, bob, "Hello Bob!")
+	send(t, bob, alice, "Hi Alice!")
+
+	// Bob loses his session with Alice, so her messages stop decrypting.
+	aliceAddr := omemo.Address{JID: "alice@example.com", DeviceID: 1}
+	if err := bob.m.ResetSession(aliceAddr); err != nil {
+		t.Fatal(err)
+	}
+	for range omemo.SessionResetFailures {
+		if _, err := receive(t, alice, bob, encrypt(t, alice, bob, "lost")); err == nil {
+			t.Fatal("decrypted without a session")
+		}
+	}
+
+	var kt *stanza.Message
+	select {
+	case kt = <-bob.sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no key transport sent")
+	}
+	if body, err := receive(t, bob, alice, kt); err != nil || body != "" {
+		t.Fatalf("key transport = %q, %v", body, err)
+	}
+	send(t, alice, bob, "Back again")
+	send(t, bob, alice, "Welcome back")
+}
+
+func TestPreKeysReplenished(t *testing.T) {
+	server := &pep{items: make(map[string][]pubsub.PubItem)}
+	alice := newDevice(t, server, "alice@example.com", 1)
+	bob := newDevice(t, server, "bob@example.com", 2)
+	send(t, alice, bob, "Hello Bob!")
+
+	// Bob's bundle of 5 is below the default threshold, so the first
+	// message tops it up and it is published again.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		server.mu.Lock()
+		items := server.items["bob@example.com "+omemoplugin.NodeBundles]
+		var b omemoplugin.Bundle
+		err := xml.Unmarshal(items[len(items)-1].Payload, &b)
+		server.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b.Prekeys) == omemo.DefaultPreKeyCount {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("published bundle has %d pre-keys", len(b.Prekeys))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessBundleChecksSignature(t *testing.T) {
+	m := omemo.NewManager(omemo.NewMemoryStore(1))
+	bundle, err := m.GenerateBundle(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(m)
+	b := BundleToXML(bundle)
+	addr := omemoplugin.Address{JID: "bob@example.com", DeviceID: 2}
+	if err := c.ProcessBundle(addr, b); err != nil {
+		t.Fatal(err)
+	}
+	other, err := omemo.GenerateBundle(omemo.NewMemoryStore(3), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SPKS = BundleToXML(other).SPKS
+	if err := c.ProcessBundle(addr, b); err != omemo.ErrInvalidSignature {
+		t.Fatalf("forged signature: %v", err)
+	}
+}
+
+func TestTrust(t *testing.T) {
+	m := omemo.NewManager(omemo.NewMemoryStore(1))
+	c := New(m)
+	desk := omemoplugin.Address{JID: "bob@example.com", DeviceID: 2}
+	phone := omemoplugin.Address{JID: "bob@example.com", DeviceID: 3}
+	for _, addr := range []omemoplugin.Address{desk, phone} {
+		ikp, err := omemo.GenerateIdentityKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr == phone {
+			if err := m.SetTrust(address(desk), omemo.TrustVerified); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, want := c.Trust(addr, ikp.PublicKey), addr == desk; got != want {
+			t.Errorf("Trust(%v) = %v", addr, got)
+		}
+	}
+	if c.Trust(desk, []byte("short")) {
+		t.Error("trusted a malformed identity key")
+	}
+}
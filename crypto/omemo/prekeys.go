@@ -0,0 +1,67 @@
+package omemo
+
+import "slices"
+
+// Defaults for keeping the published one-time pre-keys topped up.
+const (
+	DefaultPreKeyCount     = 100
+	DefaultPreKeyThreshold = 90
+)
+
+// Bundle returns a copy of the local bundle, without the one-time pre-keys
+// used since it was generated, or nil before GenerateBundle.
+func (m *Manager) Bundle() *Bundle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.local == nil {
+		return nil
+	}
+	return copyBundle(m.local)
+}
+
+// ReplenishPreKeys tops the local bundle up to count one-time pre-keys once
+// fewer than threshold are left. The new keys get IDs above the ones in
+// use. It reports whether keys were added, in which case the bundle has to
+// be published again.
+func (m *Manager) ReplenishPreKeys(threshold, count int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.local == nil {
+		return false, ErrNoBundle
+	}
+	if len(m.local.PreKeys) >= threshold || len(m.local.PreKeys) >= count {
+		return false, nil
+	}
+
+	var next uint32
+	for _, pk := range m.local.PreKeys {
+		next = max(next, pk.ID)
+	}
+	for range count - len(m.local.PreKeys) {
+		next++
+		pk, err := generatePreKey(next)
+		if err != nil {
+			return false, err
+		}
+		if err := m.store.SavePreKey(pk); err != nil {
+			return false, err
+		}
+		m.local.PreKeys = append(m.local.PreKeys, BundlePreKey{ID: pk.ID, PublicKey: pk.PublicKey})
+	}
+	return true, nil
+}
+
+func (m *Manager) removeLocalPreKey(id uint32) {
+	if m.local == nil {
+		return
+	}
+	m.local.PreKeys = slices.DeleteFunc(m.local.PreKeys, func(pk BundlePreKey) bool {
+		return pk.ID == id
+	})
+}
+
+func copyBundle(b *Bundle) *Bundle {
+	c := *b
+	c.PreKeys = slices.Clone(b.PreKeys)
+	return &c
+}
@@ -0,0 +1,60 @@
+package omemo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplenishPreKeys(t *testing.T) {
+	aliceManager := NewManager(NewMemoryStore(1))
+	if _, err := aliceManager.ReplenishPreKeys(3, 5); !errors.Is(err, ErrNoBundle) {
+		t.Fatalf("ReplenishPreKeys without a bundle: %v", err)
+	}
+	if _, err := aliceManager.GenerateBundle(1); err != nil {
+		t.Fatal(err)
+	}
+
+	bobStore := NewMemoryStore(2)
+	bobManager := NewManager(bobStore)
+	bobBundle, err := bobManager.GenerateBundle(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobAddr := Address{JID: "bob@example.com", DeviceID: 2}
+	aliceManager.ProcessBundle(bobAddr, bobBundle)
+
+	if added, err := bobManager.ReplenishPreKeys(5, 5); err != nil || added {
+		t.Fatalf("full bundle: added=%v, %v", added, err)
+	}
+
+	// Alice uses Bob's first pre-key.
+	msg, err := aliceManager.Encrypt([]byte("hi"), bobAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bobManager.Decrypt(Address{JID: "alice@example.com", DeviceID: 1}, msg); err != nil {
+		t.Fatal(err)
+	}
+	bundle := bobManager.Bundle()
+	if len(bundle.PreKeys) != 4 || bundle.PreKeys[0].ID != 2 {
+		t.Fatalf("pre-keys after use %+v", bundle.PreKeys)
+	}
+	bundle.PreKeys = nil
+	if len(bobManager.Bundle().PreKeys) != 4 {
+		t.Fatal("Bundle did not return a copy")
+	}
+
+	added, err := bobManager.ReplenishPreKeys(5, 6)
+	if err != nil || !added {
+		t.Fatalf("ReplenishPreKeys = %v, %v", added, err)
+	}
+	bundle = bobManager.Bundle()
+	if len(bundle.PreKeys) != 6 || bundle.PreKeys[4].ID != 6 || bundle.PreKeys[5].ID != 7 {
+		t.Fatalf("pre-keys after replenishing %+v", bundle.PreKeys)
+	}
+	for _, pk := range bundle.PreKeys {
+		if _, err := bobStore.GetPreKey(pk.ID); err != nil {
+			t.Errorf("pre-key %d not stored: %v", pk.ID, err)
+		}
+	}
+}
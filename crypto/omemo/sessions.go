@@ -0,0 +1,112 @@
+package omemo
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// SessionResetFailures is the number of decryption failures in a row after
+// which NeedsReset reports a session as broken.
+const SessionResetFailures = 3
+
+// SessionInfo describes the session with a remote device.
+type SessionInfo struct {
+	Address  Address
+	LastUsed time.Time // zero if not used since the Manager was created
+	Failures int       // decryption failures in a row
+}
+
+// Sessions lists the sessions with the devices of jid.
+func (m *Manager) Sessions(jid string) ([]SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices, err := m.store.SessionDevices(jid)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SessionInfo, len(devices))
+	for i, id := range devices {
+		addr := Address{JID: jid, DeviceID: id}
+		infos[i] = SessionInfo{Address: addr, LastUsed: m.lastUsed[addr], Failures: m.failures[addr]}
+	}
+	return infos, nil
+}
+
+// ExpireSessions deletes the sessions with the devices of jid that were not
+// used for maxIdle, and returns their addresses. Sessions not used since
+// the Manager was created count as idle from its creation.
+func (m *Manager) ExpireSessions(jid string, maxIdle time.Duration) ([]Address, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices, err := m.store.SessionDevices(jid)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	var expired []Address
+	for _, id := range devices {
+		addr := Address{JID: jid, DeviceID: id}
+		last, ok := m.lastUsed[addr]
+		if !ok {
+			last = m.created
+		}
+		if now.Sub(last) < maxIdle {
+			continue
+		}
+		if err := m.resetSession(addr); err != nil {
+			return expired, err
+		}
+		expired = append(expired, addr)
+	}
+	return expired, nil
+}
+
+// NeedsReset reports whether messages from addr failed to decrypt
+// SessionResetFailures times in a row. The session is then best replaced
+// with ResetSession followed by a KeyTransport message.
+func (m *Manager) NeedsReset(addr Address) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failures[addr] >= SessionResetFailures
+}
+
+// ResetSession deletes the session with addr. The next message to addr
+// starts a new one from its bundle, which has to be processed again.
+func (m *Manager) ResetSession(addr Address) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resetSession(addr)
+}
+
+func (m *Manager) resetSession(addr Address) error {
+	delete(m.sessions, addr)
+	delete(m.failures, addr)
+	delete(m.lastUsed, addr)
+	return m.store.DeleteSession(addr)
+}
+
+// KeyTransport returns a message without payload for recipients. It sets
+// up or advances the sessions with them, so it is sent after ResetSession
+// to have the peer build the new session right away.
+func (m *Manager) KeyTransport(recipients ...Address) (*EncryptedMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keyMaterial := make([]byte, 48)
+	if _, err := rand.Read(keyMaterial); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aesNonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	deviceID, err := m.store.GetLocalDeviceID()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := m.encryptKeyMaterial(keyMaterial, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedMessage{SenderDeviceID: deviceID, Keys: keys, IV: iv}, nil
+}
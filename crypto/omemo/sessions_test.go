@@ -0,0 +1,124 @@
+package omemo
+
+import (
+	"testing"
+	"time"
+)
+
+// newConversation returns managers for Alice (device 1) and Bob (device 2)
+// that have exchanged a message each.
+func newConversation(t *testing.T) (alice, bob *Manager) {
+	t.Helper()
+	alice = NewManager(NewMemoryStore(1))
+	bob = NewManager(NewMemoryStore(2))
+	if _, err := alice.GenerateBundle(5); err != nil {
+		t.Fatal(err)
+	}
+	bobBundle, err := bob.GenerateBundle(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.ProcessBundle(bobAddr, bobBundle)
+	exchange(t, alice, aliceAddr, bob, bobAddr, "hello")
+	exchange(t, bob, bobAddr, alice, aliceAddr, "hi")
+	return alice, bob
+}
+
+var (
+	aliceAddr = Address{JID: "alice@example.com", DeviceID: 1}
+	bobAddr   = Address{JID: "bob@example.com", DeviceID: 2}
+)
+
+func exchange(t *testing.T, from *Manager, fromAddr Address, to *Manager, toAddr Address, text string) {
+	t.Helper()
+	msg, err := from.Encrypt([]byte(text), toAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := to.Decrypt(fromAddr, msg); err != nil || string(plaintext) != text {
+		t.Fatalf("decrypt %q = %q, %v", text, plaintext, err)
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	alice, bob := newConversation(t)
+
+	for i := range SessionResetFailures {
+		if bob.NeedsReset(aliceAddr) {
+			t.Fatalf("reset needed after %d failures", i)
+		}
+		msg, err := alice.Encrypt([]byte("lost"), bobAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Keys[0].Data[len(msg.Keys[0].Data)-1] ^= 1
+		if _, err := bob.Decrypt(aliceAddr, msg); err == nil {
+			t.Fatal("tampered message decrypted")
+		}
+	}
+	if !bob.NeedsReset(aliceAddr) {
+		t.Fatal("no reset needed after repeated failures")
+	}
+	if infos, err := bob.Sessions(aliceAddr.JID); err != nil || len(infos) != 1 || infos[0].Failures != SessionResetFailures {
+		t.Fatalf("Sessions = %+v, %v", infos, err)
+	}
+
+	// The session is still usable, as failures do not advance it.
+	exchange(t, alice, aliceAddr, bob, bobAddr, "still there")
+	if bob.NeedsReset(aliceAddr) {
+		t.Fatal("failures not cleared by a decrypted message")
+	}
+
+	// Bob starts over and tells Alice with a key transport message.
+	if err := bob.ResetSession(aliceAddr); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := bob.Sessions(aliceAddr.JID); len(infos) != 0 {
+		t.Fatalf("sessions after reset %+v", infos)
+	}
+	bob.ProcessBundle(aliceAddr, alice.Bundle())
+	kt, err := bob.KeyTransport(aliceAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kt.Payload) != 0 || kt.Keys[0].KeyExchange == nil {
+		t.Fatalf("key transport %+v", kt)
+	}
+	if plaintext, err := alice.Decrypt(bobAddr, kt); err != nil || plaintext != nil {
+		t.Fatalf("key transport decrypted to %q, %v", plaintext, err)
+	}
+	exchange(t, alice, aliceAddr, bob, bobAddr, "new session")
+	exchange(t, bob, bobAddr, alice, aliceAddr, "confirmed")
+}
+
+func TestExpireSessions(t *testing.T) {
+	alice, _ := newConversation(t)
+	phoneAddr := Address{JID: "bob@example.com", DeviceID: 3}
+	phone := NewManager(NewMemoryStore(3))
+	phoneBundle, err := phone.GenerateBundle(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.ProcessBundle(phoneAddr, phoneBundle)
+
+	// An hour after the conversation with Bob, Alice writes to his other
+	// device.
+	now := time.Now().Add(time.Hour)
+	alice.now = func() time.Time { return now }
+	exchange(t, alice, aliceAddr, phone, phoneAddr, "later")
+
+	infos, err := alice.Sessions(bobAddr.JID)
+	if err != nil || len(infos) != 2 || infos[0].Address != bobAddr || infos[1].LastUsed.IsZero() {
+		t.Fatalf("Sessions = %+v, %v", infos, err)
+	}
+	expired, err := alice.ExpireSessions(bobAddr.JID, 30*time.Minute)
+	if err != nil || len(expired) != 1 || expired[0] != bobAddr {
+		t.Fatalf("ExpireSessions = %v, %v", expired, err)
+	}
+	if infos, _ := alice.Sessions(bobAddr.JID); len(infos) != 1 || infos[0].Address != phoneAddr {
+		t.Fatalf("sessions left %+v", infos)
+	}
+	if expired, _ := alice.ExpireSessions(bobAddr.JID, 2*time.Hour); len(expired) != 0 {
+		t.Fatalf("expired recently used sessions %v", expired)
+	}
+}
@@ -19,6 +19,8 @@ type SignedPreKeyRecord struct {
 
 // Store defines the persistence interface for OMEMO state.
 type Store interface {
+	TrustStore
+
 	// GetIdentityKeyPair returns the local identity key pair.
 	GetIdentityKeyPair() (*IdentityKeyPair, error)
 
@@ -60,4 +62,10 @@ type Store interface {
 
 	// ContainsSession returns whether a session exists for an address.
 	ContainsSession(addr Address) (bool, error)
+
+	// DeleteSession removes the session state for an address.
+	DeleteSession(addr Address) error
+
+	// SessionDevices returns the device IDs of jid that have a session.
+	SessionDevices(jid string) ([]uint32, error)
 }
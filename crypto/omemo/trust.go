@@ -0,0 +1,243 @@
+package omemo
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TrustLevel is the trust placed in the identity key of a remote device.
+type TrustLevel int
+
+const (
+	// TrustUnknown means no decision was made for the key yet.
+	TrustUnknown TrustLevel = iota
+	// TrustUndecided means the key waits for the user to verify it.
+	TrustUndecided
+	// TrustBlind means the key is trusted without having been verified.
+	TrustBlind
+	// TrustVerified means the user verified the key's fingerprint.
+	TrustVerified
+	// TrustDistrusted means the user refused the key.
+	TrustDistrusted
+)
+
+// Trusted reports whether messages may be encrypted for a key of level l.
+func (l TrustLevel) Trusted() bool {
+	return l == TrustBlind || l == TrustVerified
+}
+
+func (l TrustLevel) String() string {
+	switch l {
+	case TrustUnknown:
+		return "unknown"
+	case TrustUndecided:
+		return "undecided"
+	case TrustBlind:
+		return "blind"
+	case TrustVerified:
+		return "verified"
+	case TrustDistrusted:
+		return "distrusted"
+	}
+	return fmt.Sprintf("TrustLevel(%d)", int(l))
+}
+
+// TrustStore persists the trust placed in remote identity keys. It is part
+// of Store.
+type TrustStore interface {
+	// GetTrust returns the trust level of key for an address, or
+	// TrustUnknown when none was saved for that key.
+	GetTrust(addr Address, key ed25519.PublicKey) (TrustLevel, error)
+
+	// SaveTrust stores the identity key of an address with its trust level.
+	SaveTrust(addr Address, key ed25519.PublicKey, level TrustLevel) error
+
+	// Identities returns the identity keys stored for the devices of jid.
+	Identities(jid string) ([]Identity, error)
+}
+
+// Identity is the identity key of a remote device and the trust placed in
+// it.
+type Identity struct {
+	Address     Address
+	IdentityKey ed25519.PublicKey
+	Trust       TrustLevel
+}
+
+// Fingerprint returns the fingerprint of the identity key, see Fingerprint.
+func (id Identity) Fingerprint() string {
+	return Fingerprint(id.IdentityKey)
+}
+
+// Fingerprint formats an identity key for comparison by users: lowercase
+// hex in groups of eight digits.
+func Fingerprint(key ed25519.PublicKey) string {
+	h := hex.EncodeToString(key)
+	var b strings.Builder
+	for i := 0; i < len(h); i += 8 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(h[i:min(i+8, len(h))])
+	}
+	return b.String()
+}
+
+// TrustPolicy decides on identity keys seen for the first time.
+type TrustPolicy interface {
+	// Decide returns the trust level of a new identity key for addr.
+	Decide(store TrustStore, addr Address, key ed25519.PublicKey) (TrustLevel, error)
+
+	// Verified is called after the user verified the identity key of addr.
+	Verified(store TrustStore, addr Address) error
+}
+
+// BTBV implements Blind Trust Before Verification. The keys of a contact
+// are trusted blindly until the user verifies one of them. From then on
+// new keys of the contact wait for verification, and the keys that were
+// only trusted blindly do too.
+type BTBV struct{}
+
+// Decide trusts key blindly unless a key of addr.JID was verified.
+func (BTBV) Decide(store TrustStore, addr Address, _ ed25519.PublicKey) (TrustLevel, error) {
+	verified, err := hasVerified(store, addr.JID)
+	if err != nil {
+		return TrustUnknown, err
+	}
+	if verified {
+		return TrustUndecided, nil
+	}
+	return TrustBlind, nil
+}
+
+// Verified withdraws blind trust from the other keys of addr.JID.
+func (BTBV) Verified(store TrustStore, addr Address) error {
+	ids, err := store.Identities(addr.JID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id.Trust == TrustBlind {
+			if err := store.SaveTrust(id.Address, id.IdentityKey, TrustUndecided); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasVerified(store TrustStore, jid string) (bool, error) {
+	ids, err := store.Identities(jid)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if id.Trust == TrustVerified {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithTrustPolicy sets the policy deciding on new identity keys. The
+// default is BTBV.
+func WithTrustPolicy(p TrustPolicy) Option {
+	return func(m *Manager) { m.policy = p }
+}
+
+// WithRefuseUntrusted makes Encrypt and KeyTransport fail with
+// ErrUntrustedIdentity for devices whose identity key is not trusted.
+func WithRefuseUntrusted() Option {
+	return func(m *Manager) { m.refuseUntrusted = true }
+}
+
+// Fingerprint returns the fingerprint of the local identity key.
+func (m *Manager) Fingerprint() (string, error) {
+	ikp, err := m.store.GetIdentityKeyPair()
+	if err != nil {
+		return "", err
+	}
+	if ikp == nil {
+		return "", fmt.Errorf("no local identity key pair")
+	}
+	return Fingerprint(ikp.PublicKey), nil
+}
+
+// Identities lists the identity keys of the devices of jid with the trust
+// placed in them.
+func (m *Manager) Identities(jid string) ([]Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.Identities(jid)
+}
+
+// DecideTrust returns the trust level of key for addr, applying the trust
+// policy if the key is seen for the first time.
+func (m *Manager) DecideTrust(addr Address, key ed25519.PublicKey) (TrustLevel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.decideTrust(addr, key)
+}
+
+// SetTrust records the user's decision on the identity key stored for
+// addr. Verifying a key lets the trust policy react, see BTBV.
+func (m *Manager) SetTrust(addr Address, level TrustLevel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.store.GetRemoteIdentity(addr)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("%w: no identity key for %s", ErrUntrustedIdentity, addr)
+	}
+	if err := m.store.SaveTrust(addr, key, level); err != nil {
+		return err
+	}
+	if level == TrustVerified {
+		return m.policy.Verified(m.store, addr)
+	}
+	return nil
+}
+
+func (m *Manager) decideTrust(addr Address, key ed25519.PublicKey) (TrustLevel, error) {
+	level, err := m.store.GetTrust(addr, key)
+	if err != nil || level != TrustUnknown {
+		return level, err
+	}
+	if level, err = m.policy.Decide(m.store, addr, key); err != nil {
+		return TrustUnknown, err
+	}
+	return level, m.store.SaveTrust(addr, key, level)
+}
+
+// saveIdentity stores the identity key of a device a session is set up
+// with, deciding on its trust if it is new.
+func (m *Manager) saveIdentity(addr Address, key ed25519.PublicKey) error {
+	if err := m.store.SaveRemoteIdentity(addr, key); err != nil {
+		return err
+	}
+	_, err := m.decideTrust(addr, key)
+	return err
+}
+
+// checkTrust fails for a session with an untrusted device when the Manager
+// refuses those.
+func (m *Manager) checkTrust(addr Address, session *Session) error {
+	if !m.refuseUntrusted {
+		return nil
+	}
+	level, err := m.decideTrust(addr, session.RemoteIdentity)
+	if err != nil {
+		return err
+	}
+	if !level.Trusted() {
+		return fmt.Errorf("%w: %s is %s", ErrUntrustedIdentity, addr, level)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package omemo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	key := make([]byte, 32)
+	key[0], key[31] = 0xab, 0x01
+	got := Fingerprint(key)
+	if want := "ab000000 " + strings.Repeat("00000000 ", 6) + "00000001"; got != want {
+		t.Fatalf("Fingerprint = %q, want %q", got, want)
+	}
+	if TrustVerified.String() != "verified" || TrustLevel(9).String() != "TrustLevel(9)" {
+		t.Errorf("String = %s, %s", TrustVerified, TrustLevel(9))
+	}
+}
+
+func TestBTBV(t *testing.T) {
+	alice := NewManager(NewMemoryStore(1), WithRefuseUntrusted())
+	if _, err := alice.GenerateBundle(1); err != nil {
+		t.Fatal(err)
+	}
+	desk := Address{JID: "bob@example.com", DeviceID: 2}
+	phone := Address{JID: "bob@example.com", DeviceID: 3}
+	laptop := Address{JID: "bob@example.com", DeviceID: 4}
+	for _, addr := range []Address{desk, phone, laptop} {
+		bundle, err := NewManager(NewMemoryStore(addr.DeviceID)).GenerateBundle(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice.ProcessBundle(addr, bundle)
+	}
+
+	// Before any verification, Bob's devices are trusted blindly.
+	if _, err := alice.Encrypt([]byte("hi"), desk, phone); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := alice.Identities(desk.JID)
+	if err != nil || len(ids) != 2 || ids[0].Trust != TrustBlind || ids[1].Trust != TrustBlind {
+		t.Fatalf("Identities = %+v, %v", ids, err)
+	}
+	if len(strings.Fields(ids[0].Fingerprint())) != 8 {
+		t.Errorf("fingerprint %q", ids[0].Fingerprint())
+	}
+
+	// Verifying the desk withdraws blind trust from the phone and keeps it
+	// from new devices.
+	if err := alice.SetTrust(desk, TrustVerified); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Encrypt([]byte("hi"), desk); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []Address{phone, laptop} {
+		if _, err := alice.Encrypt([]byte("hi"), addr); !errors.Is(err, ErrUntrustedIdentity) {
+			t.Fatalf("encrypt for %s: %v", addr, err)
+		}
+	}
+	ids, _ = alice.Identities(desk.JID)
+	if len(ids) != 3 || ids[0].Trust != TrustVerified || ids[1].Trust != TrustUndecided || ids[2].Trust != TrustUndecided {
+		t.Fatalf("after verification %+v", ids)
+	}
+
+	if err := alice.SetTrust(phone, TrustVerified); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetTrust(desk, TrustDistrusted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Encrypt([]byte("hi"), phone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Encrypt([]byte("hi"), desk); !errors.Is(err, ErrUntrustedIdentity) {
+		t.Fatalf("encrypt for distrusted device: %v", err)
+	}
+	if err := alice.SetTrust(Address{JID: "carol@example.com", DeviceID: 5}, TrustVerified); err == nil {
+		t.Fatal("trusted a device without identity key")
+	}
+}
+
+func TestDecideTrust(t *testing.T) {
+	m := NewManager(NewMemoryStore(1))
+	ikp, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := Address{JID: "bob@example.com", DeviceID: 2}
+	if level, err := m.DecideTrust(addr, ikp.PublicKey); err != nil || level != TrustBlind {
+		t.Fatalf("DecideTrust = %s, %v", level, err)
+	}
+	if err := m.SetTrust(addr, TrustDistrusted); err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := m.DecideTrust(addr, ikp.PublicKey); level != TrustDistrusted {
+		t.Fatalf("decision not kept: %s", level)
+	}
+
+	// A new key for the device is decided on afresh.
+	other, err := GenerateIdentityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level, _ := m.DecideTrust(addr, other.PublicKey); level != TrustBlind {
+		t.Fatalf("new key for the device: %s", level)
+	}
+}
@@ -0,0 +1,77 @@
+package xmpp
+
+import (
+	"context"
+
+	"github.com/meszmate/xmpp-go/plugins/csi"
+)
+
+// csiState is the client state last requested by the application (XEP-0352).
+type csiState uint8
+
+const (
+	csiUnset csiState = iota
+	csiActive
+	csiInactive
+)
+
+// SetActive tells the server that the client is in the foreground (XEP-0352).
+// The state is remembered and re-asserted whenever the server advertises CSI
+// on a new stream, including after a reconnect.
+// Nothing is sent if the server does not advertise CSI support.
+func (c *Client) SetActive(ctx context.Context) error {
+	return c.setCSIState(ctx, csiActive)
+}
+
+// SetInactive tells the server that the client is in the background, allowing
+// a CSI-aware server to hold back non-urgent traffic (XEP-0352).
+// The state is remembered and re-asserted whenever the server advertises CSI
+// on a new stream, including after a reconnect.
+// Nothing is sent if the server does not advertise CSI support.
+func (c *Client) SetInactive(ctx context.Context) error {
+	return c.setCSIState(ctx, csiInactive)
+}
+
+// IsInactive reports whether the application last marked the client inactive.
+func (c *Client) IsInactive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.csi == csiInactive
+}
+
+func (c *Client) setCSIState(ctx context.Context, state csiState) error {
+	c.mu.Lock()
+	c.csi = state
+	s := c.session
+	c.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	return sendCSI(ctx, s, state)
+}
+
+// resendCSI re-asserts the stored client state once s has advertised its
+// stream features. Servers reset the state for every new stream.
+func (c *Client) resendCSI(s *Session) {
+	c.mu.Lock()
+	state := c.csi
+	c.mu.Unlock()
+
+	// A failed write surfaces through Serve, which owns the stream.
+	_ = sendCSI(context.Background(), s, state)
+}
+
+func sendCSI(ctx context.Context, s *Session, state csiState) error {
+	if !s.HasStreamFeature(csi.Feature) {
+		return nil
+	}
+	switch state {
+	case csiActive:
+		return s.SendElement(ctx, csi.Active{})
+	case csiInactive:
+		return s.SendElement(ctx, csi.Inactive{})
+	default:
+		return nil
+	}
+}
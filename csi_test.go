@@ -0,0 +1,123 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/csi"
+)
+
+func TestClientSetInactiveSendsNonza(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	s.SetStreamFeatures(csi.Feature)
+	c := &Client{session: s}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SetInactive(context.Background())
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatalf("pipe Read: %v", err)
+	}
+	got := string(buf[:n])
+	if !strings.Contains(got, "<inactive") || !strings.Contains(got, `xmlns="urn:xmpp:csi:0"`) {
+		t.Fatalf("unexpected CSI nonza: %s", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SetInactive: %v", err)
+	}
+	if !c.IsInactive() {
+		t.Error("IsInactive() = false after SetInactive")
+	}
+}
+
+func TestClientSetActiveWithoutServerSupport(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	c := &Client{session: s}
+
+	// Without the advertised feature nothing is written, so the pipe never blocks.
+	if err := c.SetInactive(context.Background()); err != nil {
+		t.Fatalf("SetInactive: %v", err)
+	}
+	if !c.IsInactive() {
+		t.Error("state should be remembered even when the server lacks CSI")
+	}
+	if err := c.SetActive(context.Background()); err != nil {
+		t.Fatalf("SetActive: %v", err)
+	}
+	if c.IsInactive() {
+		t.Error("IsInactive() = true after SetActive")
+	}
+}
+
+func TestClientCSIStateBeforeConnect(t *testing.T) {
+	t.Parallel()
+	c := &Client{}
+	if err := c.SetInactive(context.Background()); err != nil {
+		t.Fatalf("SetInactive: %v", err)
+	}
+	if c.csi != csiInactive {
+		t.Errorf("csi = %v, want %v", c.csi, csiInactive)
+	}
+}
+
+func TestClientCSIStateSentWhenFeaturesArrive(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	c.redirect = ln.Addr().String()
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The server has not advertised CSI yet, so the state is only stored.
+	if err := c.SetInactive(context.Background()); err != nil {
+		t.Fatalf("SetInactive: %v", err)
+	}
+
+	features := `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+		`<stream:features><csi xmlns='urn:xmpp:csi:0'/></stream:features>`
+	if _, err := conn.Write([]byte(features)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := bufio.NewReader(conn).ReadString('>')
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !strings.Contains(got, "<inactive") || !strings.Contains(got, `xmlns="urn:xmpp:csi:0"`) {
+		t.Fatalf("unexpected CSI nonza: %s", got)
+	}
+}
@@ -0,0 +1,288 @@
+package xmpp
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/chatmarkers"
+	"github.com/meszmate/xmpp-go/plugins/receipts"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DeliveryState is how far a sent message got, as reported by the receipts
+// (XEP-0184) and chat markers (XEP-0333) of its recipient. It only moves
+// forward.
+type DeliveryState uint8
+
+const (
+	// DeliverySent is the state of a message handed to the server.
+	DeliverySent DeliveryState = iota + 1
+	// DeliveryDelivered is the state of a message a client of the
+	// recipient received.
+	DeliveryDelivered
+	// DeliveryDisplayed is the state of a message the recipient saw.
+	DeliveryDisplayed
+	// DeliveryAcknowledged is the state of a message the recipient
+	// acknowledged explicitly.
+	DeliveryAcknowledged
+)
+
+var deliveryStateNames = [...]string{"unknown", "sent", "delivered", "displayed", "acknowledged"}
+
+func (s DeliveryState) String() string {
+	if int(s) < len(deliveryStateNames) {
+		return deliveryStateNames[s]
+	}
+	return deliveryStateNames[0]
+}
+
+// Delivery reports the new state of the sent message with ID ID.
+type Delivery struct {
+	ID    string
+	To    jid.JID
+	State DeliveryState
+}
+
+// maxTrackedMessages bounds the messages whose delivery is followed; the
+// oldest are forgotten first.
+const maxTrackedMessages = 1024
+
+// deliveryTracker follows the messages sent with WithDeliveryTracking.
+type deliveryTracker struct {
+	mu       sync.Mutex
+	messages map[string]*trackedMessage
+	order    []string // IDs, oldest first
+	seq      uint64
+	onChange []func(context.Context, Delivery)
+}
+
+type trackedMessage struct {
+	to    jid.JID
+	seq   uint64
+	state DeliveryState
+}
+
+// OnDelivery registers f for the state changes of the messages sent with
+// WithDeliveryTracking, starting with DeliverySent. A chat marker also
+// applies to the earlier messages sent to the same contact, each of which
+// is reported.
+func (c *Client) OnDelivery(f func(ctx context.Context, d Delivery)) {
+	c.delivery.mu.Lock()
+	defer c.delivery.mu.Unlock()
+	c.delivery.onChange = append(c.delivery.onChange, f)
+}
+
+// DeliveryState returns the state of the sent message with ID id, if its
+// delivery is followed.
+func (c *Client) DeliveryState(id string) (DeliveryState, bool) {
+	c.delivery.mu.Lock()
+	defer c.delivery.mu.Unlock()
+	m, ok := c.delivery.messages[id]
+	if !ok {
+		return 0, false
+	}
+	return m.state, true
+}
+
+// MarkDisplayed tells the sender of msg that it was displayed, if msg is
+// markable.
+func (c *Client) MarkDisplayed(ctx context.Context, msg *stanza.Message) error {
+	if msg.ID == "" || !hasExtensionName(msg.Extensions, ns.ChatMarkers, "markable") {
+		return nil
+	}
+	marker, err := stanza.NewExtension(chatmarkers.Displayed{ID: msg.ID})
+	if err != nil {
+		return err
+	}
+	reply := stanza.NewMessage(msg.Type)
+	reply.To = msg.From.Bare()
+	reply.Extensions = []stanza.Extension{marker}
+	return c.Send(ctx, reply)
+}
+
+// trackOutgoing adds the receipt request and markable element to st, if it
+// is a message whose delivery is to be followed, and starts following it.
+// It returns the ID the message is followed by, or "".
+func (c *Client) trackOutgoing(st stanza.Stanza) string {
+	msg, ok := st.(*stanza.Message)
+	if !ok || !c.opts.trackDelivery || len(msg.Bodies) == 0 || msg.To.IsZero() {
+		return ""
+	}
+	if msg.Type != stanza.MessageChat && msg.Type != stanza.MessageNormal && msg.Type != "" {
+		return ""
+	}
+	if msg.ID == "" {
+		msg.ID = stanza.GenerateID()
+	}
+	if !hasExtensionName(msg.Extensions, ns.Receipts, "request") {
+		if ext, err := stanza.NewExtension(receipts.Request{}); err == nil {
+			msg.Extensions = append(msg.Extensions, ext)
+		}
+	}
+	if !hasExtensionName(msg.Extensions, ns.ChatMarkers, "markable") {
+		if ext, err := stanza.NewExtension(chatmarkers.Markable{}); err == nil {
+			msg.Extensions = append(msg.Extensions, ext)
+		}
+	}
+
+	t := &c.delivery
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.messages == nil {
+		t.messages = make(map[string]*trackedMessage)
+	}
+	if _, ok := t.messages[msg.ID]; !ok {
+		t.order = append(t.order, msg.ID)
+	}
+	t.seq++
+	t.messages[msg.ID] = &trackedMessage{to: msg.To, seq: t.seq}
+	for len(t.order) > maxTrackedMessages {
+		delete(t.messages, t.order[0])
+		t.order = t.order[1:]
+	}
+	return msg.ID
+}
+
+// sentTracked records that the message followed as id was sent, or
+// forgets it when sending failed.
+func (c *Client) sentTracked(ctx context.Context, id string, err error) {
+	if id == "" {
+		return
+	}
+	t := &c.delivery
+	t.mu.Lock()
+	m, ok := t.messages[id]
+	if ok && err != nil {
+		delete(t.messages, id)
+		t.order = slices.DeleteFunc(t.order, func(v string) bool { return v == id })
+	}
+	if !ok || err != nil || m.state != 0 {
+		t.mu.Unlock()
+		return
+	}
+	m.state = DeliverySent
+	callbacks := t.onChange
+	t.mu.Unlock()
+	notifyDelivery(ctx, callbacks, []Delivery{{ID: id, To: m.to, State: DeliverySent}})
+}
+
+// trackDeliveries returns a handler that follows the receipts and markers
+// of incoming messages, answers receipt requests with WithAutoReceipts and
+// passes every stanza on to next.
+func (c *Client) trackDeliveries(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		if msg, ok := st.(*stanza.Message); ok && msg.Type != stanza.MessageError && msg.Type != stanza.MessageGroupchat {
+			if c.opts.autoReceipts {
+				c.acknowledge(ctx, s, msg)
+			}
+			if c.opts.trackDelivery {
+				c.delivered(ctx, msg)
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		return next.HandleStanza(ctx, s, st)
+	})
+}
+
+// acknowledge answers the receipt request of msg and sends the received
+// marker if it is markable.
+func (c *Client) acknowledge(ctx context.Context, s *Session, msg *stanza.Message) {
+	if msg.ID == "" || msg.From.IsZero() {
+		return
+	}
+	var acks []any
+	if hasExtensionName(msg.Extensions, ns.Receipts, "request") {
+		acks = append(acks, receipts.Received{ID: msg.ID})
+	}
+	if hasExtensionName(msg.Extensions, ns.ChatMarkers, "markable") {
+		acks = append(acks, chatmarkers.Received{ID: msg.ID})
+	}
+	if len(acks) == 0 {
+		return
+	}
+	reply := stanza.NewMessage(msg.Type)
+	reply.To = msg.From
+	for _, v := range acks {
+		if ext, err := stanza.NewExtension(v); err == nil {
+			reply.Extensions = append(reply.Extensions, ext)
+		}
+	}
+	// A failed write surfaces through Serve, which owns the stream.
+	_ = s.Send(ctx, reply)
+}
+
+// delivered advances the sent messages msg carries a receipt or marker
+// for.
+func (c *Client) delivered(ctx context.Context, msg *stanza.Message) {
+	for _, ext := range msg.Extensions {
+		var state DeliveryState
+		marker := false
+		switch {
+		case ext.XMLName.Space == ns.Receipts && ext.XMLName.Local == "received":
+			state = DeliveryDelivered
+		case ext.XMLName.Space == ns.ChatMarkers && ext.XMLName.Local == "received":
+			state, marker = DeliveryDelivered, true
+		case ext.XMLName.Space == ns.ChatMarkers && ext.XMLName.Local == "displayed":
+			state, marker = DeliveryDisplayed, true
+		case ext.XMLName.Space == ns.ChatMarkers && ext.XMLName.Local == "acknowledged":
+			state, marker = DeliveryAcknowledged, true
+		default:
+			continue
+		}
+		c.advance(ctx, msg.From, extensionAttr(ext, "id"), state, marker)
+	}
+}
+
+// advance moves the message id sent to from, and with a marker the earlier
+// messages sent to it, to state.
+func (c *Client) advance(ctx context.Context, from jid.JID, id string, state DeliveryState, marker bool) {
+	t := &c.delivery
+	t.mu.Lock()
+	target, ok := t.messages[id]
+	if !ok || !target.to.Bare().Equal(from.Bare()) {
+		t.mu.Unlock()
+		return
+	}
+	var changed []Delivery
+	for _, mid := range t.order {
+		m := t.messages[mid]
+		if mid != id && (!marker || m.seq > target.seq || !m.to.Bare().Equal(target.to.Bare())) {
+			continue
+		}
+		if m.state < state {
+			m.state = state
+			changed = append(changed, Delivery{ID: mid, To: m.to, State: state})
+		}
+	}
+	callbacks := t.onChange
+	t.mu.Unlock()
+	notifyDelivery(ctx, callbacks, changed)
+}
+
+func notifyDelivery(ctx context.Context, callbacks []func(context.Context, Delivery), changes []Delivery) {
+	for _, d := range changes {
+		for _, f := range callbacks {
+			f(ctx, d)
+		}
+	}
+}
+
+func hasExtensionName(exts []stanza.Extension, space, local string) bool {
+	return slices.ContainsFunc(exts, func(ext stanza.Extension) bool {
+		return ext.XMLName.Space == space && ext.XMLName.Local == local
+	})
+}
+
+func extensionAttr(ext stanza.Extension, name string) string {
+	for _, a := range ext.Attrs {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value
+		}
+	}
+	return ""
+}
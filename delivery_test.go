@@ -0,0 +1,134 @@
+package xmpp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestClientDeliveryTracking(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+	c.opts.trackDelivery = true
+	updates := make(chan Delivery, 8)
+	c.OnDelivery(func(_ context.Context, d Delivery) { updates <- d })
+	go c.serve(s)
+	if _, err := c2.Write([]byte(testStreamHeader)); err != nil {
+		t.Fatal(err)
+	}
+	next := func() Delivery {
+		t.Helper()
+		select {
+		case d := <-updates:
+			return d
+		case <-time.After(2 * time.Second):
+			t.Fatal("no delivery update")
+			return Delivery{}
+		}
+	}
+
+	bob := jid.MustParse("bob@example.com")
+	var ids [2]string
+	for i := range ids {
+		id, err := c.SendChatMessage(ctx, bob, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+		w := nextMessage(t, writes)
+		if !strings.Contains(w, `<request xmlns="urn:xmpp:receipts">`) || !strings.Contains(w, `<markable xmlns="urn:xmpp:chat-markers:0">`) {
+			t.Fatalf("sent %s", w)
+		}
+		if d := next(); d.ID != id || d.State != DeliverySent {
+			t.Fatalf("update %+v", d)
+		}
+	}
+
+	// A receipt from someone else is not correlated.
+	input := `<message from='mallory@example.com/x' id='r0'><received xmlns='urn:xmpp:receipts' id='` + ids[0] + `'/></message>` +
+		`<message from='bob@example.com/phone' id='r1'><received xmlns='urn:xmpp:receipts' id='` + ids[0] + `'/></message>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	if d := next(); d.ID != ids[0] || d.State != DeliveryDelivered {
+		t.Fatalf("update %+v", d)
+	}
+
+	// A displayed marker also covers the earlier message.
+	if _, err := c2.Write([]byte(`<message from='bob@example.com/phone' type='chat'><displayed xmlns='urn:xmpp:chat-markers:0' id='` + ids[1] + `'/></message>`)); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]DeliveryState{}
+	for range 2 {
+		d := next()
+		got[d.ID] = d.State
+	}
+	if got[ids[0]] != DeliveryDisplayed || got[ids[1]] != DeliveryDisplayed {
+		t.Fatalf("updates %v", got)
+	}
+	if state, ok := c.DeliveryState(ids[0]); !ok || state != DeliveryDisplayed || state.String() != "displayed" {
+		t.Fatalf("state %v, %v", state, ok)
+	}
+
+	// A late receipt does not move the message back.
+	if _, err := c2.Write([]byte(`<message from='bob@example.com/phone'><received xmlns='urn:xmpp:receipts' id='` + ids[1] + `'/></message>`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-updates:
+		t.Fatalf("update %+v after displayed", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientAutoReceipts(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+	c.opts.autoReceipts = true
+	received := make(chan struct{}, 1)
+	c.OnMessage(func(ctx context.Context, msg *stanza.Message) {
+		if err := c.MarkDisplayed(ctx, msg); err != nil {
+			t.Error(err)
+		}
+		received <- struct{}{}
+	})
+	go c.serve(s)
+
+	input := testStreamHeader + `<message from='bob@example.com/phone' id='m1' type='chat'><body>hi</body>` +
+		`<request xmlns='urn:xmpp:receipts'/><markable xmlns='urn:xmpp:chat-markers:0'/></message>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	w := nextMessage(t, writes)
+	if !strings.Contains(w, `to="bob@example.com/phone"`) || !strings.Contains(w, `<received xmlns="urn:xmpp:receipts" id="m1">`) || !strings.Contains(w, `<received xmlns="urn:xmpp:chat-markers:0" id="m1">`) {
+		t.Fatalf("acknowledgement %s", w)
+	}
+	<-received
+	if w := nextMessage(t, writes); !strings.Contains(w, `to="bob@example.com"`) || !strings.Contains(w, `<displayed xmlns="urn:xmpp:chat-markers:0" id="m1">`) {
+		t.Fatalf("displayed marker %s", w)
+	}
+}
+
+// nextMessage returns the next message the client writes, which may take
+// several writes.
+func nextMessage(t *testing.T, writes <-chan string) string {
+	t.Helper()
+	w := nextWrite(t, writes)
+	for !strings.HasSuffix(w, "</message>") {
+		w += nextWrite(t, writes)
+	}
+	return w
+}
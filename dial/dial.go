@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/meszmate/xmpp-go/transport"
@@ -16,6 +17,10 @@ type Dialer struct {
 	TLSConfig *tls.Config
 	Timeout   time.Duration
 	DirectTLS bool
+
+	// DialContext opens the TCP connections. It defaults to a net.Dialer
+	// bounded by Timeout.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 // NewDialer creates a new Dialer with default settings.
@@ -26,50 +31,27 @@ func NewDialer() *Dialer {
 	}
 }
 
-// Dial connects to an XMPP server for the given domain.
+// Dial connects to an XMPP server for the given domain (RFC 6120 §3.2).
+// The _xmpps-client and _xmpp-client SRV records are tried by priority and
+// weight, Direct TLS ones first within a priority (XEP-0368); with
+// DirectTLS set only the former are. Without records it falls back to the
+// domain itself on port 5222, or 5223 with DirectTLS.
 func (d *Dialer) Dial(ctx context.Context, domain string) (*transport.TCP, error) {
-	if d.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
-		defer cancel()
-	}
-
-	var records []SRVRecord
-	var err error
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 
-	if d.DirectTLS {
-		records, err = d.Resolver.ResolveClientTLS(ctx, domain)
-	} else {
-		records, err = d.Resolver.ResolveClient(ctx, domain)
-	}
-
-	// Fall back to domain:5222 if SRV lookup fails
-	if err != nil || len(records) == 0 {
-		port := "5222"
-		if d.DirectTLS {
-			port = "5223"
-		}
-		records = []SRVRecord{{Target: domain, Port: parsePort(port)}}
+	records := d.clientRecords(ctx, domain)
+	if len(records) == 0 {
+		records = []SRVRecord{{Target: domain, Port: d.clientPort(), DirectTLS: d.DirectTLS}}
 	}
 
 	// Try each record in order
 	var lastErr error
-	netDialer := &net.Dialer{Timeout: d.Timeout}
 	for _, rec := range records {
-		addr := net.JoinHostPort(rec.Target, fmt.Sprintf("%d", rec.Port))
+		addr := net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), fmt.Sprintf("%d", rec.Port))
 
 		var conn net.Conn
-		if d.DirectTLS {
-			tlsCfg := d.tlsConfig(domain)
-			tlsDialer := &tls.Dialer{
-				NetDialer: netDialer,
-				Config:    tlsCfg,
-			}
-			conn, lastErr = tlsDialer.DialContext(ctx, "tcp", addr)
-		} else {
-			conn, lastErr = netDialer.DialContext(ctx, "tcp", addr)
-		}
-
+		conn, lastErr = d.dialAddr(ctx, addr, domain, rec.DirectTLS)
 		if lastErr == nil {
 			return transport.NewTCP(conn), nil
 		}
@@ -78,24 +60,106 @@ func (d *Dialer) Dial(ctx context.Context, domain string) (*transport.TCP, error
 	return nil, fmt.Errorf("dial: failed to connect to %s: %w", domain, lastErr)
 }
 
-// DialServer connects to an XMPP server for S2S communication.
-func (d *Dialer) DialServer(ctx context.Context, domain string) (*transport.TCP, error) {
+// clientRecords resolves the client SRV records of domain. A failed lookup
+// counts as no records.
+func (d *Dialer) clientRecords(ctx context.Context, domain string) []SRVRecord {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = NewResolver()
+	}
+	direct, _ := resolver.ResolveClientTLS(ctx, domain)
+	if d.DirectTLS {
+		return direct
+	}
+	plain, _ := resolver.ResolveClient(ctx, domain)
+
+	records := make([]SRVRecord, 0, len(direct)+len(plain))
+	for len(direct) > 0 || len(plain) > 0 {
+		if len(plain) == 0 || len(direct) > 0 && direct[0].Priority <= plain[0].Priority {
+			records, direct = append(records, direct[0]), direct[1:]
+		} else {
+			records, plain = append(records, plain[0]), plain[1:]
+		}
+	}
+	return records
+}
+
+// DialHost connects directly to the given host, bypassing SRV resolution.
+// The host may carry a port; if it does not, the default client port is used.
+// This is used to follow see-other-host stream errors (RFC 6120 §4.9.3.19).
+func (d *Dialer) DialHost(ctx context.Context, host, domain string) (*transport.TCP, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(strings.Trim(host, "[]"), fmt.Sprintf("%d", d.clientPort()))
+	}
+
+	conn, err := d.dialAddr(ctx, addr, domain, d.DirectTLS)
+	if err != nil {
+		return nil, fmt.Errorf("dial: failed to connect to %s: %w", addr, err)
+	}
+	return transport.NewTCP(conn), nil
+}
+
+// withTimeout bounds ctx by the dialer timeout, if one is set.
+func (d *Dialer) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
 	if d.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
-		defer cancel()
+		return context.WithTimeout(ctx, d.Timeout)
 	}
+	return ctx, func() {}
+}
 
-	records, err := d.Resolver.ResolveServer(ctx, domain)
+// clientPort returns the default client port for the configured TLS mode.
+func (d *Dialer) clientPort() uint16 {
+	if d.DirectTLS {
+		return 5223
+	}
+	return 5222
+}
+
+// dialAddr connects to addr, negotiating TLS up front when directTLS is
+// set.
+func (d *Dialer) dialAddr(ctx context.Context, addr, domain string, directTLS bool) (net.Conn, error) {
+	conn, err := d.dialTCP(ctx, addr)
+	if err != nil || !directTLS {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, d.tlsConfig(domain))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if d.DialContext != nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	netDialer := &net.Dialer{Timeout: d.Timeout}
+	return netDialer.DialContext(ctx, "tcp", addr)
+}
+
+// DialServer connects to an XMPP server for S2S communication.
+func (d *Dialer) DialServer(ctx context.Context, domain string) (*transport.TCP, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = NewResolver()
+	}
+	records, err := resolver.ResolveServer(ctx, domain)
 	if err != nil || len(records) == 0 {
 		records = []SRVRecord{{Target: domain, Port: 5269}}
 	}
 
 	var lastErr error
-	netDialer := &net.Dialer{Timeout: d.Timeout}
 	for _, rec := range records {
-		addr := net.JoinHostPort(rec.Target, fmt.Sprintf("%d", rec.Port))
-		conn, dialErr := netDialer.DialContext(ctx, "tcp", addr)
+		addr := net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), fmt.Sprintf("%d", rec.Port))
+		conn, dialErr := d.dialTCP(ctx, addr)
 		if dialErr == nil {
 			return transport.NewTCP(conn), nil
 		}
@@ -115,9 +179,3 @@ func (d *Dialer) tlsConfig(domain string) *tls.Config {
 	}
 	return &tls.Config{ServerName: domain}
 }
-
-func parsePort(s string) uint16 {
-	var port uint16
-	fmt.Sscanf(s, "%d", &port)
-	return port
-}
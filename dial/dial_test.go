@@ -0,0 +1,113 @@
+package dial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDialHostWithPort(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	d := NewDialer()
+	trans, err := d.DialHost(context.Background(), ln.Addr().String(), "example.com")
+	if err != nil {
+		t.Fatalf("DialHost: %v", err)
+	}
+	defer trans.Close()
+
+	if trans.Peer().String() != ln.Addr().String() {
+		t.Errorf("Peer() = %v, want %v", trans.Peer(), ln.Addr())
+	}
+}
+
+// refuseDialer records the addresses dialed and fails every attempt.
+func refuseDialer(dialed *[]string) func(context.Context, string, string) (net.Conn, error) {
+	return func(_ context.Context, _, addr string) (net.Conn, error) {
+		*dialed = append(*dialed, addr)
+		return nil, errors.New("refused")
+	}
+}
+
+func TestDialCandidateOrder(t *testing.T) {
+	t.Parallel()
+	r := NewResolverFunc(func(_ context.Context, service, _, _ string) (string, []*net.SRV, error) {
+		if service == "xmpps-client" {
+			return "", []*net.SRV{
+				{Target: "tls.example.com.", Port: 5223, Priority: 10},
+				{Target: "tls-backup.example.com.", Port: 443, Priority: 30},
+			}, nil
+		}
+		return "", []*net.SRV{
+			{Target: "primary.example.com.", Port: 5222, Priority: 5},
+			{Target: "plain.example.com.", Port: 5222, Priority: 10},
+		}, nil
+	})
+
+	var dialed []string
+	d := &Dialer{Resolver: r, DialContext: refuseDialer(&dialed)}
+	if _, err := d.Dial(context.Background(), "example.com"); err == nil {
+		t.Fatal("Dial succeeded with every candidate refused")
+	}
+	want := []string{"primary.example.com:5222", "tls.example.com:5223", "plain.example.com:5222", "tls-backup.example.com:443"}
+	if fmt.Sprint(dialed) != fmt.Sprint(want) {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+
+	dialed = nil
+	d.DirectTLS = true
+	_, _ = d.Dial(context.Background(), "example.com")
+	want = []string{"tls.example.com:5223", "tls-backup.example.com:443"}
+	if fmt.Sprint(dialed) != fmt.Sprint(want) {
+		t.Fatalf("Direct TLS dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestDialFallsBackToDomain(t *testing.T) {
+	t.Parallel()
+	r := NewResolverFunc(func(context.Context, string, string, string) (string, []*net.SRV, error) {
+		return "", nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	})
+
+	var dialed []string
+	d := &Dialer{Resolver: r, DialContext: refuseDialer(&dialed)}
+	_, _ = d.Dial(context.Background(), "example.com")
+	d.DirectTLS = true
+	_, _ = d.Dial(context.Background(), "example.com")
+	want := []string{"example.com:5222", "example.com:5223"}
+	if fmt.Sprint(dialed) != fmt.Sprint(want) {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestDialUsesDialContext(t *testing.T) {
+	t.Parallel()
+	r := NewResolverFunc(func(context.Context, string, string, string) (string, []*net.SRV, error) {
+		return "", nil, nil
+	})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	d := &Dialer{Resolver: r, DialContext: func(context.Context, string, string) (net.Conn, error) {
+		return c1, nil
+	}}
+	trans, err := d.Dial(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer trans.Close()
+	if _, ok := trans.ConnectionState(); ok {
+		t.Fatal("plain candidate negotiated TLS")
+	}
+}
@@ -4,8 +4,10 @@ package dial
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"sort"
+	"strings"
 )
 
 // SRVRecord represents a resolved SRV record.
@@ -14,18 +16,30 @@ type SRVRecord struct {
 	Port     uint16
 	Priority uint16
 	Weight   uint16
+
+	// DirectTLS is set for records of a Direct TLS service (XEP-0368),
+	// where TLS is negotiated as soon as the connection is open.
+	DirectTLS bool
 }
 
+// LookupSRVFunc looks up SRV records, like net.Resolver.LookupSRV.
+type LookupSRVFunc func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
 // Resolver resolves XMPP server addresses via DNS SRV records.
 type Resolver struct {
-	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	lookupSRV LookupSRVFunc
+	intn      func(n int) int
 }
 
 // NewResolver creates a new Resolver.
 func NewResolver() *Resolver {
-	return &Resolver{
-		lookupSRV: net.DefaultResolver.LookupSRV,
-	}
+	return NewResolverFunc(net.DefaultResolver.LookupSRV)
+}
+
+// NewResolverFunc creates a Resolver that looks records up with lookup,
+// for example to resolve against a fixed set of records in tests.
+func NewResolverFunc(lookup LookupSRVFunc) *Resolver {
+	return &Resolver{lookupSRV: lookup, intn: rand.IntN}
 }
 
 // ResolveClient resolves client-to-server SRV records for a domain.
@@ -65,16 +79,49 @@ func (r *Resolver) resolve(ctx context.Context, service, proto, name string) ([]
 			Port:     addr.Port,
 			Priority: addr.Priority,
 			Weight:   addr.Weight,
+
+			DirectTLS: strings.HasPrefix(service, "xmpps-"),
 		})
 	}
 
-	// Sort by priority (ascending), then weight (descending)
-	sort.Slice(records, func(i, j int) bool {
-		if records[i].Priority != records[j].Priority {
-			return records[i].Priority < records[j].Priority
-		}
-		return records[i].Weight > records[j].Weight
-	})
+	return r.order(records), nil
+}
 
-	return records, nil
+// order sorts records by priority and, within a priority, picks them at
+// random in proportion to their weight (RFC 2782).
+func (r *Resolver) order(records []SRVRecord) []SRVRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	out := make([]SRVRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := records[start:end]
+		// Records of weight zero go first so that they have a small chance
+		// of being picked.
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for len(group) > 0 {
+			total := 0
+			for _, rec := range group {
+				total += int(rec.Weight)
+			}
+			pick, sum := r.intn(total+1), 0
+			i := 0
+			for ; i < len(group)-1; i++ {
+				sum += int(group[i].Weight)
+				if sum >= pick {
+					break
+				}
+			}
+			out = append(out, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return out
 }
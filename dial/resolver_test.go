@@ -87,6 +87,8 @@ func TestResolveSortOrder(t *testing.T) {
 		{Target: "high-pri.example.com.", Port: 5222, Priority: 5, Weight: 50},
 		{Target: "high-weight.example.com.", Port: 5222, Priority: 10, Weight: 90},
 	}, nil)
+	// Draw the highest number, which falls in the range of the last record.
+	r.intn = func(n int) int { return n - 1 }
 
 	records, err := r.ResolveClient(context.Background(), "example.com")
 	if err != nil {
@@ -99,7 +101,7 @@ func TestResolveSortOrder(t *testing.T) {
 	if records[0].Priority != 5 {
 		t.Errorf("records[0].Priority = %d, want 5", records[0].Priority)
 	}
-	// Among priority 10, higher weight should come first
+	// Among priority 10, the weighted draw picks the heavier record first
 	if records[1].Weight != 90 {
 		t.Errorf("records[1].Weight = %d, want 90", records[1].Weight)
 	}
@@ -138,3 +140,51 @@ func TestResolveLookupError(t *testing.T) {
 		t.Error("expected error from failed lookup")
 	}
 }
+
+func TestResolveWeightedDraw(t *testing.T) {
+	t.Parallel()
+	r := NewResolverFunc(mockLookupSRV([]*net.SRV{
+		{Target: "a.example.com.", Port: 5222, Priority: 10, Weight: 60},
+		{Target: "b.example.com.", Port: 5222, Priority: 10, Weight: 0},
+		{Target: "c.example.com.", Port: 5222, Priority: 10, Weight: 40},
+	}, nil))
+
+	tests := []struct {
+		draws []int
+		want  []string
+	}{
+		// Zero weight records are only picked by a draw of zero.
+		{[]int{0, 0, 0}, []string{"b", "a", "c"}},
+		{[]int{1, 61, 40}, []string{"a", "c", "b"}},
+		{[]int{70, 0, 0}, []string{"c", "b", "a"}},
+	}
+	for _, tt := range tests {
+		draws := tt.draws
+		r.intn = func(n int) int {
+			d := draws[0]
+			draws = draws[1:]
+			return min(d, n-1)
+		}
+		records, err := r.ResolveClient(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rec := range records {
+			got = append(got, rec.Target[:1])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("draws %v: order = %v, want %v", tt.draws, got, tt.want)
+		}
+	}
+}
+
+func TestResolveMarksDirectTLS(t *testing.T) {
+	t.Parallel()
+	r := NewResolverFunc(mockLookupSRV([]*net.SRV{{Target: "xmpp.example.com.", Port: 5223}}, nil))
+	direct, _ := r.ResolveClientTLS(context.Background(), "example.com")
+	plain, _ := r.ResolveClient(context.Background(), "example.com")
+	if len(direct) != 1 || !direct[0].DirectTLS || len(plain) != 1 || plain[0].DirectTLS {
+		t.Fatalf("direct = %+v, plain = %+v", direct, plain)
+	}
+}
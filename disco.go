@@ -0,0 +1,33 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DiscoInfo queries the disco#info of node at to (XEP-0030 §3.1) and waits
+// for the answer. It has the signature of disco.Fetcher, so it can be handed
+// to the disco plugin's SetFetcher to back its remote cache.
+func (s *Session) DiscoInfo(ctx context.Context, to jid.JID, node string) (disco.InfoQuery, error) {
+	payload, err := xml.Marshal(disco.InfoQuery{Node: node})
+	if err != nil {
+		return disco.InfoQuery{}, err
+	}
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.To = to
+	iq.Query = payload
+
+	reply, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return disco.InfoQuery{}, err
+	}
+	var info disco.InfoQuery
+	if err := xml.Unmarshal(reply.Query, &info); err != nil {
+		return disco.InfoQuery{}, err
+	}
+	return info, nil
+}
@@ -0,0 +1,51 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestSessionDiscoInfo(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		return nil
+	}))
+
+	queries := make(chan disco.InfoQuery, 1)
+	go func() {
+		dec := xml.NewDecoder(peer)
+		var iq stanza.IQ
+		if err := dec.Decode(&iq); err != nil {
+			return
+		}
+		var q disco.InfoQuery
+		_ = xml.Unmarshal(iq.Query, &q)
+		queries <- q
+		fmt.Fprintf(peer, "<iq type='result' id='%s' from='example.org'>"+
+			"<query xmlns='http://jabber.org/protocol/disco#info' node='%s'>"+
+			"<identity category='server' type='im'/><feature var='urn:xmpp:ping'/>"+
+			"</query></iq>", iq.ID, q.Node)
+	}()
+
+	d := disco.New()
+	d.SetFetcher(s.DiscoInfo)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ok, err := d.SupportsFeature(ctx, jid.MustParse("example.org"), "urn:xmpp:ping")
+	if err != nil || !ok {
+		t.Fatalf("SupportsFeature = %v, %v", ok, err)
+	}
+	if q := <-queries; q.Node != "" {
+		t.Fatalf("query node = %q, want empty", q.Node)
+	}
+}
@@ -0,0 +1,377 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// RuleDirection selects the stanzas a Rule applies to.
+type RuleDirection uint8
+
+const (
+	// RuleBoth applies a rule to the stanzas of both directions.
+	RuleBoth RuleDirection = iota
+	// RuleInbound applies a rule to the stanzas read from a session's peer.
+	RuleInbound
+	// RuleOutbound applies a rule to the stanzas sent to a session's peer.
+	RuleOutbound
+)
+
+var ruleDirectionNames = [...]string{"both", "inbound", "outbound"}
+
+func (d RuleDirection) String() string {
+	if int(d) < len(ruleDirectionNames) {
+		return ruleDirectionNames[d]
+	}
+	return "unknown"
+}
+
+// RuleAction is what a Rule does with the stanzas it applies to.
+type RuleAction uint8
+
+const (
+	// ActionPass accepts the stanza without looking at later rules.
+	ActionPass RuleAction = iota
+	// ActionDrop discards the stanza silently.
+	ActionDrop
+	// ActionBounce discards the stanza and answers it with an error.
+	ActionBounce
+	// ActionRedirect addresses an inbound stanza to another recipient.
+	ActionRedirect
+	// ActionRateLimit drops the stanzas of a sender beyond the rule's rate
+	// and lets the others on to later rules.
+	ActionRateLimit
+	// ActionLog logs the stanza and goes on with later rules.
+	ActionLog
+)
+
+var ruleActionNames = [...]string{"pass", "drop", "bounce", "redirect", "ratelimit", "log"}
+
+func (a RuleAction) String() string {
+	if int(a) < len(ruleActionNames) {
+		return ruleActionNames[a]
+	}
+	return "unknown"
+}
+
+// RosterRelation is a condition on the roster of a stanza's recipient.
+type RosterRelation uint8
+
+const (
+	// RosterAny does not look at the roster.
+	RosterAny RosterRelation = iota
+	// RosterKnown matches stanzas to an account that has the sender in its
+	// roster.
+	RosterKnown
+	// RosterUnknown matches stanzas to an account that does not have the
+	// sender in its roster.
+	RosterUnknown
+)
+
+// Rule is a stanza filtering rule. It applies to the stanzas that meet all
+// the conditions it sets; a rule without conditions applies to all.
+type Rule struct {
+	// Name identifies the rule in logs and verdicts.
+	Name      string
+	Direction RuleDirection
+
+	// Kinds are the stanza kinds, message, presence or iq.
+	Kinds []string
+	// Types are the type attributes. A message without one has the type
+	// normal, and a presence without one the type available.
+	Types []string
+	// FromDomains and ToDomains are the domains of the sender and the
+	// recipient. "*.example.com" matches the subdomains of example.com.
+	FromDomains []string
+	ToDomains   []string
+	// Body matches one of the bodies of a message. Other stanzas do not
+	// match a rule with a Body.
+	Body *regexp.Regexp
+	// Roster is the relation of the sender to the recipient's roster. It
+	// only matches stanzas to an account of the firewall's domain.
+	Roster RosterRelation
+	// Match, if set, is a further condition.
+	Match func(ctx context.Context, st stanza.Stanza) bool
+
+	Action RuleAction
+	// Condition is the stanza error condition ActionBounce answers with.
+	// It defaults to policy-violation.
+	Condition string
+	// RedirectTo is the recipient of the stanzas of ActionRedirect.
+	RedirectTo jid.JID
+	// Rate is the limit on the stanzas of one sender of ActionRateLimit.
+	Rate RateLimit
+}
+
+// Verdict is the outcome of checking a stanza against the rules.
+type Verdict struct {
+	// Action is ActionPass when the stanza is to be handled, or the
+	// action of the rule that decided otherwise. ActionRateLimit means
+	// the stanza is to be dropped, and ActionRedirect that it is to be
+	// handled after addressing it to To.
+	Action RuleAction
+	// Rule is the name of the deciding rule.
+	Rule string
+	// Error is the error ActionBounce answers with.
+	Error *stanza.StanzaError
+	// To is the new recipient of ActionRedirect.
+	To jid.JID
+}
+
+// FirewallConfig configures a Firewall.
+type FirewallConfig struct {
+	// Rules are checked in order.
+	Rules []Rule
+	// Domain is the domain whose accounts' rosters RosterKnown and
+	// RosterUnknown look at.
+	Domain string
+	// Roster is the store of those rosters.
+	Roster storage.RosterStore
+	// Logger receives the records of ActionLog. It defaults to slog's
+	// default logger.
+	Logger Logger
+	// Clock is the clock of ActionRateLimit. It defaults to clock.System.
+	Clock clock.Clock
+}
+
+// Firewall checks stanzas against an ordered list of rules, in the manner
+// of Prosody's mod_firewall. The first rule that applies and passes, drops,
+// bounces or redirects a stanza decides; logging and rate-limiting rules
+// that let it through go on to the next rule. Stanzas no rule decides on
+// pass.
+type Firewall struct {
+	cfg   FirewallConfig
+	clock clock.Clock
+
+	mu      sync.Mutex
+	buckets map[ruleBucketKey]*tokenBucket
+	ops     int
+}
+
+type ruleBucketKey struct {
+	rule   int
+	sender string
+}
+
+// NewFirewall returns a Firewall checking stanzas against cfg.Rules. It
+// fails for rules it cannot apply, such as a redirect without a recipient.
+func NewFirewall(cfg FirewallConfig) (*Firewall, error) {
+	for i, r := range cfg.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		switch {
+		case r.Action > ActionLog:
+			return nil, fmt.Errorf("xmpp: rule %s: unknown action %d", name, r.Action)
+		case r.Action == ActionRedirect && r.RedirectTo.IsZero():
+			return nil, fmt.Errorf("xmpp: rule %s: redirect without a recipient", name)
+		case r.Action == ActionRedirect && r.Direction == RuleOutbound:
+			return nil, fmt.Errorf("xmpp: rule %s: outbound stanzas cannot be redirected", name)
+		case r.Action == ActionRateLimit && r.Rate.Rate <= 0:
+			return nil, fmt.Errorf("xmpp: rule %s: rate limit without a rate", name)
+		case r.Roster != RosterAny && cfg.Roster == nil:
+			return nil, fmt.Errorf("xmpp: rule %s: roster condition without a roster store", name)
+		}
+	}
+	return &Firewall{cfg: cfg, clock: clock.Or(cfg.Clock), buckets: make(map[ruleBucketKey]*tokenBucket)}, nil
+}
+
+// Check checks st, sent by from in direction dir, against the rules.
+func (f *Firewall) Check(ctx context.Context, dir RuleDirection, from jid.JID, st stanza.Stanza) Verdict {
+	for i := range f.cfg.Rules {
+		r := &f.cfg.Rules[i]
+		if r.Direction != RuleBoth && r.Direction != dir || r.Action == ActionRedirect && dir != RuleInbound {
+			continue
+		}
+		if !f.matches(ctx, r, from, st) {
+			continue
+		}
+		switch r.Action {
+		case ActionLog:
+			h := st.GetHeader()
+			loggerOr(f.cfg.Logger).Log(ctx, slog.LevelInfo, "xmpp: firewall rule matched",
+				"rule", r.Name, "direction", dir.String(), "kind", st.StanzaType(), "type", h.Type,
+				"from", from.String(), "to", h.To.String(), "id", h.ID)
+			continue
+		case ActionRateLimit:
+			if f.allow(i, r.Rate, from.Bare().String()) {
+				continue
+			}
+		case ActionBounce:
+			condition := r.Condition
+			if condition == "" {
+				condition = stanza.ErrorPolicyViolation
+			}
+			return Verdict{Action: ActionBounce, Rule: r.Name, Error: stanza.NewStanzaError(stanza.ErrorTypeCancel, condition, "")}
+		case ActionRedirect:
+			return Verdict{Action: ActionRedirect, Rule: r.Name, To: r.RedirectTo}
+		}
+		return Verdict{Action: r.Action, Rule: r.Name}
+	}
+	return Verdict{Action: ActionPass}
+}
+
+func (f *Firewall) matches(ctx context.Context, r *Rule, from jid.JID, st stanza.Stanza) bool {
+	h := st.GetHeader()
+	if len(r.Kinds) > 0 && !slices.Contains(r.Kinds, st.StanzaType()) {
+		return false
+	}
+	if len(r.Types) > 0 && !slices.Contains(r.Types, stanzaType(st)) {
+		return false
+	}
+	if len(r.FromDomains) > 0 && !domainMatches(r.FromDomains, from.Domain()) {
+		return false
+	}
+	if len(r.ToDomains) > 0 && !domainMatches(r.ToDomains, h.To.Domain()) {
+		return false
+	}
+	if r.Body != nil {
+		msg, ok := st.(*stanza.Message)
+		if !ok || !slices.ContainsFunc(msg.Bodies, func(b stanza.Text) bool { return r.Body.MatchString(b.Value) }) {
+			return false
+		}
+	}
+	if r.Roster != RosterAny {
+		known, ok := f.inRoster(ctx, from, h.To)
+		if !ok || known != (r.Roster == RosterKnown) {
+			return false
+		}
+	}
+	return r.Match == nil || r.Match(ctx, st)
+}
+
+// inRoster reports whether the account to has from in its roster, if to is
+// an account of the firewall's domain and its roster could be read.
+func (f *Firewall) inRoster(ctx context.Context, from, to jid.JID) (known, ok bool) {
+	if to.Local() == "" || !strings.EqualFold(to.Domain(), f.cfg.Domain) || from.IsZero() {
+		return false, false
+	}
+	_, err := f.cfg.Roster.GetRosterItem(ctx, to.Bare().String(), from.Bare().String())
+	switch {
+	case err == nil:
+		return true, true
+	case errors.Is(err, storage.ErrNotFound):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// allow takes a token from the bucket of sender for rule i.
+func (f *Firewall) allow(i int, limit RateLimit, sender string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	key := ruleBucketKey{i, sender}
+	b, ok := f.buckets[key]
+	if !ok {
+		if f.ops++; f.ops >= pruneEvery {
+			f.ops = 0
+			for k, b := range f.buckets {
+				if b.full(f.cfg.Rules[k.rule].Rate, now) {
+					delete(f.buckets, k)
+				}
+			}
+		}
+		b = newTokenBucket(limit, now)
+		f.buckets[key] = b
+	}
+	return b.take(limit, 1, now)
+}
+
+// stanzaType returns the type of st, with the defaults of messages and
+// presence spelled out.
+func stanzaType(st stanza.Stanza) string {
+	typ := st.GetHeader().Type
+	if typ != "" {
+		return typ
+	}
+	switch st.(type) {
+	case *stanza.Message:
+		return stanza.MessageNormal
+	case *stanza.Presence:
+		return "available"
+	}
+	return ""
+}
+
+func domainMatches(patterns []string, domain string) bool {
+	for _, p := range patterns {
+		if parent, ok := strings.CutPrefix(p, "*."); ok {
+			if len(domain) > len(parent) && strings.HasSuffix(strings.ToLower(domain), "."+strings.ToLower(parent)) {
+				return true
+			}
+		} else if strings.EqualFold(p, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStanza applies the inbound rules of the firewall set with
+// WithFirewall to st, just read from the stream, taking a stanza without a
+// sender to come from the session's peer. It reports whether st is to be
+// handled: a stanza a rule drops or bounces is not, and a bounced request
+// or message is answered with the rule's error. A redirected stanza is
+// addressed to its new recipient. Serve calls FilterStanza for every
+// stanza it reads; servers that read the stream themselves call it before
+// handling one.
+func (s *Session) FilterStanza(ctx context.Context, st stanza.Stanza) (bool, error) {
+	if s.firewall == nil {
+		return true, nil
+	}
+	h := st.GetHeader()
+	from := h.From
+	if from.IsZero() {
+		from = s.RemoteAddr()
+	}
+	v := s.firewall.Check(ctx, RuleInbound, from, st)
+	switch v.Action {
+	case ActionPass:
+		return true, nil
+	case ActionRedirect:
+		h.To = v.To
+		return true, nil
+	case ActionBounce:
+		if reply := bounce(st, v.Error); reply != nil {
+			return false, s.Send(ctx, reply)
+		}
+	}
+	return false, nil
+}
+
+// bounce returns the error reply to st, or nil for a stanza that is not
+// answered with errors.
+func bounce(st stanza.Stanza, stanzaErr *stanza.StanzaError) stanza.Stanza {
+	switch v := st.(type) {
+	case *stanza.IQ:
+		if v.Type == stanza.IQGet || v.Type == stanza.IQSet {
+			return v.ErrorIQ(stanzaErr)
+		}
+	case *stanza.Message:
+		if v.Type != stanza.MessageError {
+			reply := stanza.NewMessage(stanza.MessageError)
+			reply.ID, reply.From, reply.To, reply.Error = v.ID, v.To, v.From, stanzaErr
+			return reply
+		}
+	case *stanza.Presence:
+		if v.Type != stanza.PresenceError {
+			reply := stanza.NewPresence(stanza.PresenceError)
+			reply.ID, reply.From, reply.To, reply.Error = v.ID, v.To, v.From, stanzaErr
+			return reply
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestFirewall(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	if err := store.RosterStore().UpsertRosterItem(ctx, &storage.RosterItem{UserJID: "alice@example.com", ContactJID: "bob@friends.example", Subscription: "both"}); err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Unix(0, 0))
+	f, err := NewFirewall(FirewallConfig{
+		Rules: []Rule{
+			{Name: "trusted", FromDomains: []string{"trusted.example"}, Action: ActionPass},
+			{Name: "spam", FromDomains: []string{"*.spam.example"}, Action: ActionDrop},
+			{Name: "presence", Kinds: []string{"presence"}, Types: []string{"available"}, Action: ActionRateLimit, Rate: RateLimit{Rate: 1}},
+			{Name: "log", Kinds: []string{"message"}, Action: ActionLog},
+			{Name: "abuse", Direction: RuleInbound, ToDomains: []string{"example.com"}, Body: regexp.MustCompile(`(?i)report`), Action: ActionRedirect, RedirectTo: jid.MustParse("abuse@example.com")},
+			{Name: "strangers", Kinds: []string{"message"}, Roster: RosterUnknown, Action: ActionBounce, Condition: stanza.ErrorNotAcceptable},
+		},
+		Domain: "example.com",
+		Roster: store.RosterStore(),
+		Clock:  clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := func(to, body string) *stanza.Message {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.To = jid.MustParse(to)
+		msg.SetBody(body)
+		return msg
+	}
+
+	tests := []struct {
+		name string
+		dir  RuleDirection
+		from string
+		st   stanza.Stanza
+		want Verdict
+	}{
+		{"trusted stranger", RuleInbound, "eve@trusted.example", message("alice@example.com", "hi"), Verdict{Action: ActionPass, Rule: "trusted"}},
+		{"subdomain", RuleInbound, "x@mail.spam.example", message("alice@example.com", "hi"), Verdict{Action: ActionDrop, Rule: "spam"}},
+		{"parent domain", RuleInbound, "x@spam.example", message("alice@spam.example", "hi"), Verdict{Action: ActionPass}},
+		{"contact", RuleInbound, "bob@friends.example/phone", message("alice@example.com", "hi"), Verdict{Action: ActionPass}},
+		{"stranger", RuleOutbound, "mallory@evil.example", message("alice@example.com/pc", "hi"), Verdict{Action: ActionBounce, Rule: "strangers"}},
+		{"remote recipient", RuleInbound, "alice@example.com", message("mallory@evil.example", "hi"), Verdict{Action: ActionPass}},
+		{"report", RuleInbound, "mallory@evil.example", message("alice@example.com", "Report spam"), Verdict{Action: ActionRedirect, Rule: "abuse", To: jid.MustParse("abuse@example.com")}},
+		{"report outbound", RuleOutbound, "mallory@evil.example", message("alice@example.com", "Report spam"), Verdict{Action: ActionBounce, Rule: "strangers"}},
+		{"presence", RuleInbound, "bob@friends.example", stanza.NewPresence(""), Verdict{Action: ActionPass}},
+		{"presence flood", RuleInbound, "bob@friends.example", stanza.NewPresence(""), Verdict{Action: ActionRateLimit, Rule: "presence"}},
+		{"other sender", RuleInbound, "carol@friends.example", stanza.NewPresence(""), Verdict{Action: ActionPass}},
+		{"unavailable", RuleInbound, "bob@friends.example", stanza.NewPresence(stanza.PresenceUnavailable), Verdict{Action: ActionPass}},
+	}
+	for _, tt := range tests {
+		got := f.Check(ctx, tt.dir, jid.MustParse(tt.from), tt.st)
+		if got.Action != tt.want.Action || got.Rule != tt.want.Rule || !got.To.Equal(tt.want.To) {
+			t.Errorf("%s: got %s by %q, want %s by %q", tt.name, got.Action, got.Rule, tt.want.Action, tt.want.Rule)
+		}
+		if got.Action == ActionBounce && got.Error.Condition != stanza.ErrorNotAcceptable {
+			t.Errorf("%s: bounced with %s", tt.name, got.Error.Condition)
+		}
+	}
+
+	for _, rule := range []Rule{
+		{Action: ActionRedirect},
+		{Action: ActionRateLimit},
+		{Roster: RosterKnown},
+	} {
+		if _, err := NewFirewall(FirewallConfig{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("NewFirewall accepted %+v", rule)
+		}
+	}
+}
+
+func TestSessionFirewall(t *testing.T) {
+	t.Parallel()
+	f, err := NewFirewall(FirewallConfig{Rules: []Rule{
+		{Direction: RuleInbound, Body: regexp.MustCompile("spam"), Action: ActionBounce},
+		{Direction: RuleOutbound, Kinds: []string{"presence"}, Action: ActionDrop},
+		{Direction: RuleOutbound, Types: []string{"headline"}, Action: ActionBounce},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, c2 := newTestSession(t, WithFirewall(f))
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	handled := make(chan stanza.Stanza, 4)
+	go s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		handled <- st
+		return nil
+	}))
+
+	input := testStreamHeader + `<message id='m1' from='mallory@evil.example' to='alice@example.com'><body>spam</body></message>` +
+		`<message id='m2' from='bob@example.com' to='alice@example.com'><body>hi</body></message>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	if w := nextMessage(t, writes); !strings.Contains(w, `id="m1"`) || !strings.Contains(w, `type="error"`) || !strings.Contains(w, "policy-violation") {
+		t.Fatalf("bounce %s", w)
+	}
+	if st := <-handled; st.GetHeader().ID != "m2" {
+		t.Fatalf("handled %s", st.GetHeader().ID)
+	}
+
+	ctx := context.Background()
+	if err := s.Send(ctx, stanza.NewPresence("")); err != nil {
+		t.Fatalf("dropped presence: %v", err)
+	}
+	var stanzaErr *stanza.StanzaError
+	if err := s.Send(ctx, stanza.NewMessage(stanza.MessageHeadline)); !errors.As(err, &stanzaErr) || stanzaErr.Condition != stanza.ErrorPolicyViolation {
+		t.Fatalf("bounced headline: %v", err)
+	}
+	select {
+	case w := <-writes:
+		t.Fatalf("filtered stanza sent: %s", w)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
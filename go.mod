@@ -2,4 +2,10 @@ module github.com/meszmate/xmpp-go
 
 go 1.25.0
 
-require golang.org/x/crypto v0.47.0 // indirect
+require (
+	golang.org/x/crypto v0.47.0
+	golang.org/x/net v0.49.0
+	golang.org/x/text v0.33.0
+)
+
+require golang.org/x/sys v0.40.0 // indirect
@@ -13,9 +13,19 @@ const (
 	Session = "urn:ietf:params:xml:ns:xmpp-session"
 	Stanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 
+	// XML namespace of the xml:lang attribute
+	XML = "http://www.w3.org/XML/1998/namespace"
+
+	// Stream Compression (XEP-0138)
+	Compress        = "http://jabber.org/protocol/compress"
+	CompressFeature = "http://jabber.org/features/compress"
+
 	// Roster (RFC 6121)
 	Roster = "jabber:iq:roster"
 
+	// Roster Versioning stream feature (RFC 6121)
+	RosterVer = "urn:xmpp:features:rosterver"
+
 	// Service Discovery (XEP-0030)
 	DiscoInfo  = "http://jabber.org/protocol/disco#info"
 	DiscoItems = "http://jabber.org/protocol/disco#items"
@@ -23,9 +33,15 @@ const (
 	// Entity Capabilities (XEP-0115)
 	Caps = "http://jabber.org/protocol/caps"
 
+	// Entity Capabilities 2.0 (XEP-0390)
+	Caps2 = "urn:xmpp:caps"
+
 	// Data Forms (XEP-0004)
 	DataForms = "jabber:x:data"
 
+	// Data Forms Media Element (XEP-0221)
+	DataFormsMedia = "urn:xmpp:media-element"
+
 	// Multi-User Chat (XEP-0045)
 	MUC      = "http://jabber.org/protocol/muc"
 	MUCUser  = "http://jabber.org/protocol/muc#user"
@@ -67,6 +83,12 @@ const (
 	// Message Reactions (XEP-0444)
 	Reactions = "urn:xmpp:reactions:0"
 
+	// Message Replies (XEP-0461)
+	Reply = "urn:xmpp:reply:0"
+
+	// Fallback Indication (XEP-0428)
+	Fallback = "urn:xmpp:fallback:0"
+
 	// Message Moderation (XEP-0425)
 	Moderation = "urn:xmpp:message-moderate:1"
 
@@ -88,14 +110,24 @@ const (
 	// PEP Native Bookmarks (XEP-0402)
 	Bookmarks = "urn:xmpp:bookmarks:1"
 
+	// Bookmarks (XEP-0048), the storage PEP Native Bookmarks replace
+	BookmarksLegacy = "storage:bookmarks"
+
+	// Private XML Storage (XEP-0049)
+	PrivateXML = "jabber:iq:private"
+
 	// In-Band Registration (XEP-0077)
 	Register = "jabber:iq:register"
 
+	// Jabber Search (XEP-0055)
+	Search = "jabber:iq:search"
+
 	// vcard-temp (XEP-0054)
 	VCard = "vcard-temp"
 
 	// vCard4 (XEP-0292)
-	VCard4 = "urn:ietf:params:xml:ns:vcard-4.0"
+	VCard4     = "urn:ietf:params:xml:ns:vcard-4.0"
+	VCard4Node = "urn:xmpp:vcard4"
 
 	// User Avatar (XEP-0084)
 	AvatarData     = "urn:xmpp:avatar:data"
@@ -104,6 +136,9 @@ const (
 	// vCard-Based Avatars (XEP-0153)
 	VCardUpdate = "vcard-temp:x:update"
 
+	// User Avatar to vCard-Based Avatars Conversion (XEP-0398)
+	PEPVCardConversion = "urn:xmpp:pep-vcard-conversion:0"
+
 	// HTTP File Upload (XEP-0363)
 	HTTPUpload = "urn:xmpp:http:upload:0"
 
@@ -126,6 +161,12 @@ const (
 	// Jingle RTP Sessions (XEP-0167)
 	JingleRTP = "urn:xmpp:jingle:apps:rtp:1"
 
+	// Jingle SOCKS5 Bytestreams Transport (XEP-0260)
+	JingleS5B = "urn:xmpp:jingle:transports:s5b:1"
+
+	// Jingle In-Band Bytestreams Transport (XEP-0261)
+	JingleIBB = "urn:xmpp:jingle:transports:ibb:1"
+
 	// Jingle ICE-UDP Transport (XEP-0176)
 	JingleICEUDP = "urn:xmpp:jingle:transports:ice-udp:1"
 
@@ -150,12 +191,21 @@ const (
 	// Ad-Hoc Commands (XEP-0050)
 	Commands = "http://jabber.org/protocol/commands"
 
+	// Service Administration (XEP-0133)
+	Admin = "http://jabber.org/protocol/admin"
+
+	// Contact Addresses for XMPP Services (XEP-0157)
+	ServerInfo = "http://jabber.org/network/serverinfo"
+
 	// Client State Indication (XEP-0352)
 	CSI = "urn:xmpp:csi:0"
 
 	// Push Notifications (XEP-0357)
 	Push = "urn:xmpp:push:0"
 
+	// Roster Item Exchange (XEP-0144)
+	RosterX = "http://jabber.org/protocol/rosterx"
+
 	// Last Activity (XEP-0012)
 	LastActivity = "jabber:iq:last"
 
@@ -204,7 +254,8 @@ const (
 	ExtDisco = "urn:xmpp:extdisco:2"
 
 	// Server Dialback (XEP-0220)
-	Dialback = "jabber:server:dialback"
+	Dialback        = "jabber:server:dialback"
+	DialbackFeature = "urn:xmpp:features:dialback"
 
 	// Bidirectional S2S (XEP-0288)
 	BidiS2S = "urn:xmpp:bidi"
@@ -213,6 +264,9 @@ const (
 	Component       = "jabber:component:accept"
 	ComponentSecret = "jabber:component:connect"
 
+	// Privileged Entity (XEP-0356)
+	Privilege = "urn:xmpp:privilege:2"
+
 	// WebSocket framing (RFC 7395)
 	Framing = "urn:ietf:params:xml:ns:xmpp-framing"
 
@@ -0,0 +1,201 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// ErrTooManyPendingIQ is returned by SendIQ and Request when the session
+// already has the maximum number of requests awaiting a reply.
+var ErrTooManyPendingIQ = errors.New("xmpp: too many pending IQ requests")
+
+// ErrIQIDInUse is returned by SendIQ and Request when a request with the
+// same ID already awaits a reply.
+var ErrIQIDInUse = errors.New("xmpp: IQ ID already in use")
+
+// ErrNotRequest is returned by SendIQ and Request for an IQ that is not a
+// get or set, which gets no reply.
+var ErrNotRequest = errors.New("xmpp: IQ is not a get or set request")
+
+// Defaults for requests sent with SendIQ and Request.
+const (
+	DefaultMaxPendingIQ = 256
+	DefaultIQTimeout    = time.Minute
+)
+
+// iqTracker correlates outgoing IQ requests with their replies by ID.
+type iqTracker struct {
+	mu      sync.Mutex
+	pending map[string]pendingIQ
+}
+
+// pendingIQ is a request awaiting its reply.
+type pendingIQ struct {
+	to    jid.JID
+	reply chan *stanza.IQ
+}
+
+// add registers a request with the given ID sent to to. It fails when max
+// requests are already pending, max <= 0 meaning no limit, or when the ID
+// is taken.
+func (t *iqTracker) add(id string, to jid.JID, max int) (chan *stanza.IQ, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && len(t.pending) >= max {
+		return nil, ErrTooManyPendingIQ
+	}
+	if _, ok := t.pending[id]; ok {
+		return nil, ErrIQIDInUse
+	}
+	if t.pending == nil {
+		t.pending = make(map[string]pendingIQ)
+	}
+	ch := make(chan *stanza.IQ, 1)
+	t.pending[id] = pendingIQ{to: to, reply: ch}
+	return ch, nil
+}
+
+// remove drops the request with the given ID if it is still the one
+// waiting on ch. Once its reply was delivered or it timed out, the ID may
+// already belong to a newer request, which must stay pending.
+func (t *iqTracker) remove(id string, ch chan *stanza.IQ) {
+	t.mu.Lock()
+	if p, ok := t.pending[id]; ok && p.reply == ch {
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+}
+
+func (t *iqTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// resolve delivers a result or error IQ to the request waiting for it, if
+// iq comes from where that request went. from is the sender of iq, zero if
+// the peer of the stream sent it without a "from"; self is the address of
+// the session's own account.
+func (t *iqTracker) resolve(iq *stanza.IQ, from, self jid.JID) bool {
+	if iq.Type != stanza.IQResult && iq.Type != stanza.IQError {
+		return false
+	}
+	t.mu.Lock()
+	p, ok := t.pending[iq.ID]
+	if ok && repliesTo(from, p.to, self) {
+		delete(t.pending, iq.ID)
+	} else {
+		ok = false
+	}
+	t.mu.Unlock()
+	if ok {
+		p.reply <- iq
+	}
+	return ok
+}
+
+// repliesTo reports whether a reply from from can answer a request sent to
+// to by the account self (RFC 6120 §8.1.2.1). A request to the account
+// itself, with no "to" or its bare JID, may be answered by the account or
+// its server; any other request only by its addressee. A reply without a
+// "from" comes from the server, so it only answers requests to the account
+// or the server.
+func repliesTo(from, to, self jid.JID) bool {
+	if from.IsZero() {
+		return to.IsZero() || to.Equal(self.Bare()) || to.String() == self.Domain()
+	}
+	if from.Equal(to) {
+		return true
+	}
+	if to.IsZero() || to.Equal(self.Bare()) {
+		return from.Equal(self.Bare()) || from.Equal(self) || from.String() == self.Domain()
+	}
+	return false
+}
+
+// SendIQ sends an IQ request and waits for the matching result or error.
+// An ID is generated if the IQ has none; an ID another pending request uses
+// fails with ErrIQIDInUse, and an IQ that is not a get or set with
+// ErrNotRequest. Only a reply from the request's addressee, as
+// RFC 6120 §8.1.2.1 defines it, is matched, so others cannot answer for it.
+// If the peer answers with an error IQ, the reply is returned together with
+// its stanza error. Replies are only matched while Serve is reading from the
+// session.
+//
+// At most DefaultMaxPendingIQ requests (see WithMaxPendingIQ) may await a
+// reply at once; further calls fail with ErrTooManyPendingIQ. A request is
+// dropped from the pending set when ctx is done or, at the latest, after
+// DefaultIQTimeout (see WithIQTimeout), so a peer that never answers cannot
+// make it grow without bound.
+func (s *Session) SendIQ(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+	return s.roundTrip(ctx, &s.pending, iq)
+}
+
+// Request sends an IQ request originated by the server to the peer of this
+// session, such as a XEP-0199 ping or a disco query for the client's caps,
+// and waits for the reply. It mirrors SendIQ but keeps its own set of
+// pending requests, so it can be used on a server session alongside IQs the
+// client routes through it. The same limit and timeout apply.
+//
+// Replies are matched while Serve reads from the session. Servers that read
+// the stream themselves must pass incoming IQs to ResolveRequest.
+func (s *Session) Request(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+	return s.roundTrip(ctx, &s.requests, iq)
+}
+
+// ResolveRequest delivers iq to the Request call waiting for it. Only result
+// and error IQs addressed to the server itself (no "to", or a bare domain)
+// are matched, so a client cannot answer a server request with a stanza
+// routed to someone else. A reply without a "from" comes from the peer, at
+// RemoteAddr. It reports whether iq was consumed.
+func (s *Session) ResolveRequest(iq *stanza.IQ) bool {
+	if !iq.To.IsZero() && (!iq.To.IsDomainOnly() || iq.To.IsFull()) {
+		return false
+	}
+	from := iq.From
+	if from.IsZero() {
+		from = s.RemoteAddr()
+	}
+	return s.requests.resolve(iq, from, s.LocalAddr())
+}
+
+func (s *Session) roundTrip(ctx context.Context, t *iqTracker, iq *stanza.IQ) (*stanza.IQ, error) {
+	if iq.Type != stanza.IQGet && iq.Type != stanza.IQSet {
+		return nil, ErrNotRequest
+	}
+	if iq.ID == "" {
+		iq.ID = stanza.GenerateID()
+	}
+	ch, err := t.add(iq.ID, iq.To, s.maxPendingIQ)
+	if err != nil {
+		return nil, err
+	}
+	defer t.remove(iq.ID, ch)
+
+	if s.iqTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.iqTimeout)
+		defer cancel()
+	}
+
+	if err := s.Send(ctx, iq); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		if reply.Type == stanza.IQError && reply.Error != nil {
+			return reply, reply.Error
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, errors.New("xmpp: session closed")
+	}
+}
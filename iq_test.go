@@ -0,0 +1,304 @@
+package xmpp
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestSessionSendIQ(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		return nil
+	}))
+	go func() {
+		dec := xml.NewDecoder(peer)
+		var req stanza.IQ
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		fmt.Fprintf(peer, "<iq type='result' id='%s'><done/></iq>", req.ID)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := s.SendIQ(ctx, stanza.NewIQ(stanza.IQGet))
+	if err != nil {
+		t.Fatalf("SendIQ: %v", err)
+	}
+	if reply.Type != stanza.IQResult {
+		t.Errorf("reply Type = %q, want %q", reply.Type, stanza.IQResult)
+	}
+}
+
+func TestSessionSendIQLimit(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t, WithMaxPendingIQ(1))
+	defer s.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.SendIQ(ctx, stanza.NewIQ(stanza.IQGet))
+		first <- err
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if s.pending.len() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first request never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := s.SendIQ(context.Background(), stanza.NewIQ(stanza.IQGet)); !errors.Is(err, ErrTooManyPendingIQ) {
+		t.Fatalf("second SendIQ error = %v, want ErrTooManyPendingIQ", err)
+	}
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first SendIQ error = %v, want context.Canceled", err)
+	}
+	if n := s.pending.len(); n != 0 {
+		t.Errorf("pending = %d after cancel, want 0", n)
+	}
+}
+
+func TestSessionSendIQTimeout(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t, WithIQTimeout(20*time.Millisecond))
+	defer s.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	_, err := s.SendIQ(context.Background(), stanza.NewIQ(stanza.IQGet))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SendIQ error = %v, want context.DeadlineExceeded", err)
+	}
+	if n := s.pending.len(); n != 0 {
+		t.Errorf("pending = %d after timeout, want 0", n)
+	}
+}
+
+func TestSessionRequest(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t, WithState(StateServer), WithRemoteAddr(jid.MustParse("alice@example.com/laptop")))
+	defer s.Close()
+	defer peer.Close()
+
+	routed := make(chan *stanza.IQ, 1)
+	go s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		if iq, ok := st.(*stanza.IQ); ok {
+			routed <- iq
+		}
+		return nil
+	}))
+	go func() {
+		dec := xml.NewDecoder(peer)
+		var req stanza.IQ
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		// A reply with the right ID but addressed to another entity must be
+		// routed, not taken as the answer.
+		fmt.Fprintf(peer, "<iq type='result' id='%s' to='bob@example.com/phone'/>", req.ID)
+		fmt.Fprintf(peer, "<iq type='result' id='%s' to='example.com'><pong/></iq>", req.ID)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req := stanza.NewIQ(stanza.IQGet)
+	req.To = jid.MustParse("alice@example.com/laptop")
+	reply, err := s.Request(ctx, req)
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if reply.Type != stanza.IQResult || !reply.To.Equal(jid.MustParse("example.com")) {
+		t.Errorf("reply = %+v, want result addressed to the server", reply)
+	}
+
+	select {
+	case iq := <-routed:
+		if iq.To.String() != "bob@example.com/phone" {
+			t.Errorf("routed IQ to = %s", iq.To)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("misaddressed reply was not routed to the handler")
+	}
+	if n := s.requests.len(); n != 0 {
+		t.Errorf("requests = %d after reply, want 0", n)
+	}
+}
+
+func TestSessionRequestSeparateFromSendIQ(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := stanza.NewIQ(stanza.IQGet)
+		req.ID = "shared"
+		_, _ = s.Request(ctx, req)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.requests.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	reply := &stanza.IQ{Header: stanza.Header{ID: "shared", Type: stanza.IQResult}}
+	if s.pending.resolve(reply, reply.From, jid.JID{}) {
+		t.Error("SendIQ tracker matched a server request")
+	}
+	if !s.ResolveRequest(reply) {
+		t.Error("ResolveRequest did not match the pending request")
+	}
+	<-done
+}
+
+func TestSessionSendIQReplySender(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t, WithLocalAddr(jid.MustParse("alice@example.com/phone")))
+	defer s.Close()
+	defer peer.Close()
+
+	routed := make(chan *stanza.IQ, 2)
+	go s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		if iq, ok := st.(*stanza.IQ); ok {
+			routed <- iq
+		}
+		return nil
+	}))
+	go func() {
+		dec := xml.NewDecoder(peer)
+		for {
+			var req stanza.IQ
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			// Only the addressee may answer; the account's server answers
+			// for requests to the account, with or without a "from".
+			if !req.To.IsZero() {
+				fmt.Fprintf(peer, "<iq type='result' id='%s' from='mallory@evil.example'/>", req.ID)
+				fmt.Fprintf(peer, "<iq type='result' id='%s'/>", req.ID)
+			}
+			fmt.Fprintf(peer, "<iq type='result' id='%s' from='%s'/>", req.ID, cmp.Or(req.To.String(), "example.com"))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, to := range []string{"", "bob@example.com/desk"} {
+		req := stanza.NewIQ(stanza.IQGet)
+		if to != "" {
+			req.To = jid.MustParse(to)
+		}
+		reply, err := s.SendIQ(ctx, req)
+		if err != nil {
+			t.Fatalf("SendIQ to %q: %v", to, err)
+		}
+		if want := cmp.Or(to, "example.com"); reply.From.String() != want {
+			t.Errorf("reply to %q from %s, want %s", to, reply.From, want)
+		}
+	}
+	for _, want := range []string{"mallory@evil.example", ""} {
+		select {
+		case iq := <-routed:
+			if iq.From.String() != want {
+				t.Errorf("routed IQ from %q, want %q", iq.From, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("reply from %q was not routed to the handler", want)
+		}
+	}
+
+	if _, err := s.SendIQ(ctx, stanza.NewIQ(stanza.IQResult)); !errors.Is(err, ErrNotRequest) {
+		t.Errorf("SendIQ of a result: %v, want ErrNotRequest", err)
+	}
+}
+
+func TestSessionSendIQDuplicateID(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		req := stanza.NewIQ(stanza.IQGet)
+		req.ID = "dup"
+		_, _ = s.SendIQ(ctx, req)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.pending.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	req := stanza.NewIQ(stanza.IQGet)
+	req.ID = "dup"
+	if _, err := s.SendIQ(ctx, req); !errors.Is(err, ErrIQIDInUse) {
+		t.Fatalf("SendIQ error = %v, want ErrIQIDInUse", err)
+	}
+}
+
+func TestIQTrackerReusedID(t *testing.T) {
+	t.Parallel()
+	var tr iqTracker
+	to := jid.MustParse("peer@example.com")
+	self := jid.MustParse("user@example.com/res")
+	reply := stanza.NewIQ(stanza.IQResult)
+	reply.ID = "id1"
+
+	first, err := tr.add("id1", to, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first request timed out just as its reply came in, and the ID
+	// was reused before the first caller's deferred remove ran.
+	if !tr.resolve(reply, to, self) {
+		t.Fatal("reply to the first request not matched")
+	}
+	second, err := tr.add("id1", to, 0)
+	if err != nil {
+		t.Fatalf("add after timeout: %v", err)
+	}
+	tr.remove("id1", first)
+	if n := tr.len(); n != 1 {
+		t.Fatalf("pending = %d, want the second request kept", n)
+	}
+
+	if !tr.resolve(reply, to, self) {
+		t.Fatal("reply to the second request not matched")
+	}
+	if got := <-second; got != reply {
+		t.Errorf("second request got %v", got)
+	}
+}
@@ -51,6 +51,11 @@ func New(local, domain, resource string) (JID, error) {
 }
 
 // Parse parses a JID string into a JID.
+//
+// The resourcepart is everything after the first '/', so it may itself
+// contain '/' ("user@example.com//res" has the resource "/res"). A '/'
+// followed by nothing is rejected with ErrInvalidResource, as RFC 7622 §3.4
+// forbids a zero-length resourcepart; pass "" to New for a bare JID instead.
 func Parse(s string) (JID, error) {
 	if s == "" {
 		return JID{}, ErrEmptyJID
@@ -62,6 +67,9 @@ func Parse(s string) (JID, error) {
 	if slashIdx := strings.IndexByte(s, '/'); slashIdx != -1 {
 		resource = s[slashIdx+1:]
 		s = s[:slashIdx]
+		if resource == "" {
+			return JID{}, ErrInvalidResource
+		}
 	}
 
 	// Extract local and domain
@@ -211,6 +219,48 @@ func UnescapeLocal(s string) string {
 	return unescapeReplacer.Replace(s)
 }
 
+// ParseEscaped parses an address as typed by a user, whose localpart may
+// contain characters that are not allowed in a JID, such as spaces, '@' or
+// '/' ("space cadet@gateway.example"). The localpart is everything before
+// the first '@' that is followed by a domainpart without another '@'; it is
+// trimmed of surrounding spaces and escaped per XEP-0106. Use ParseEscaped at
+// input boundaries (address books, gateway registration) and Parse for JIDs
+// read from the wire, which are already escaped.
+func ParseEscaped(s string) (JID, error) {
+	if s == "" {
+		return JID{}, ErrEmptyJID
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '@' {
+			continue
+		}
+		rest := s[i+1:]
+		domain := rest
+		if slash := strings.IndexByte(rest, '/'); slash != -1 {
+			domain = rest[:slash]
+		}
+		if strings.IndexByte(domain, '@') != -1 {
+			continue
+		}
+		local := strings.Trim(s[:i], " ")
+		if local == "" {
+			return JID{}, ErrInvalidLocal
+		}
+		return Parse(EscapeLocal(local) + "@" + rest)
+	}
+	return Parse(s)
+}
+
+// Display returns the JID for presentation to a user, with the localpart
+// unescaped per XEP-0106. The result is not necessarily a valid JID; use
+// String when the address is sent over the wire or stored.
+func (j JID) Display() string {
+	if j.local == "" {
+		return j.String()
+	}
+	return JID{local: UnescapeLocal(j.local), domain: j.domain, resource: j.resource}.String()
+}
+
 func validLocal(s string) bool {
 	if s == "" {
 		return true
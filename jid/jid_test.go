@@ -56,6 +56,9 @@ func TestParse(t *testing.T) {
 		{"empty string", "", "", "", "", true},
 		{"just @", "@example.com", "", "example.com", "", false},
 		{"domain with resource", "example.com/res", "", "example.com", "res", false},
+		{"resource starting with slash", "user@example.com//res", "user", "example.com", "/res", false},
+		{"empty resource", "user@example.com/", "", "", "", true},
+		{"domain with empty resource", "example.com/", "", "", "", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -80,6 +83,31 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseResourceEdgeCases(t *testing.T) {
+	t.Parallel()
+	if _, err := Parse("user@example.com/"); err != ErrInvalidResource {
+		t.Errorf("Parse(trailing slash) error = %v, want ErrInvalidResource", err)
+	}
+
+	// New treats an empty resource as "no resource", which only has the
+	// bare string form.
+	bare, err := New("user", "example.com", "")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !bare.IsBare() || bare.String() != "user@example.com" {
+		t.Errorf("New with empty resource = %q, want bare JID", bare)
+	}
+
+	j := MustParse("user@example.com//res")
+	if j.String() != "user@example.com//res" {
+		t.Errorf("String() = %q, want round trip", j.String())
+	}
+	if got := MustParse(j.String()); !got.Equal(j) {
+		t.Errorf("reparsed %q = %v, want %v", j, got, j)
+	}
+}
+
 func TestMustParse(t *testing.T) {
 	t.Parallel()
 	j := MustParse("user@example.com/res")
@@ -204,6 +232,59 @@ func TestMarshalUnmarshalText(t *testing.T) {
 	}
 }
 
+func TestParseEscaped(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		input     string
+		want      string
+		wantLocal string
+		wantErr   error
+	}{
+		{"spaces", "space cadet@example.com", `space\20cadet@example.com`, "space cadet", nil},
+		{"at sign", "joe@home@gateway.example/phone", `joe\40home@gateway.example/phone`, "joe@home", nil},
+		{"spaces and at", `"moe larry"@curly@example.com`, `\22moe\20larry\22\40curly@example.com`, `"moe larry"@curly`, nil},
+		{"slash in local", "c/o@example.com", `c\2fo@example.com`, "c/o", nil},
+		{"at in resource", "user@example.com/a@b", "user@example.com/a@b", "user", nil},
+		{"surrounding spaces trimmed", " alice @example.com", "alice@example.com", "alice", nil},
+		{"domain only", "example.com", "example.com", "", nil},
+		{"blank local", " @example.com", "", "", ErrInvalidLocal},
+		{"empty", "", "", "", ErrEmptyJID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			j, err := ParseEscaped(tt.input)
+			if err != tt.wantErr {
+				t.Fatalf("ParseEscaped(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if j.String() != tt.want {
+				t.Errorf("String() = %q, want %q", j.String(), tt.want)
+			}
+			if got := UnescapeLocal(j.Local()); got != tt.wantLocal {
+				t.Errorf("unescaped local = %q, want %q", got, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	t.Parallel()
+	j, err := ParseEscaped("joe smith@home@gateway.example/desk")
+	if err != nil {
+		t.Fatalf("ParseEscaped: %v", err)
+	}
+	if got, want := j.Display(), "joe smith@home@gateway.example/desk"; got != want {
+		t.Errorf("Display() = %q, want %q", got, want)
+	}
+	if got, want := MustParse("example.com/res").Display(), "example.com/res"; got != want {
+		t.Errorf("Display() = %q, want %q", got, want)
+	}
+}
+
 func TestEscapeLocal(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -0,0 +1,68 @@
+package jid
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/secure/precis"
+)
+
+var domainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+)
+
+// Build creates a JID from its parts after normalizing them as described in
+// RFC 7622 §3: the localpart with the PRECIS UsernameCaseMapped profile, the
+// domainpart converted to lowercase Unicode labels with IDNA2008 and the
+// resourcepart with the PRECIS OpaqueString profile. Length limits are
+// checked on the normalized parts. Use Build for JIDs taken from user input
+// so that equal addresses compare equal.
+func Build(local, domain, resource string) (JID, error) {
+	var err error
+	if local != "" {
+		if local, err = precis.UsernameCaseMapped.String(local); err != nil {
+			return JID{}, ErrInvalidLocal
+		}
+	}
+	if domain, err = normalizeDomain(domain); err != nil {
+		return JID{}, err
+	}
+	if resource != "" {
+		if resource, err = precis.OpaqueString.String(resource); err != nil {
+			return JID{}, ErrInvalidResource
+		}
+	}
+	return New(local, domain, resource)
+}
+
+// ParseNormalized parses s like Parse and normalizes the result like Build.
+func ParseNormalized(s string) (JID, error) {
+	j, err := Parse(s)
+	if err != nil {
+		return JID{}, err
+	}
+	return Build(j.local, j.domain, j.resource)
+}
+
+// normalizeDomain drops a trailing label separator and converts the domain
+// to lowercase U-labels. IP literals are returned unchanged.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", ErrInvalidDomain
+	}
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return domain, nil
+	}
+	if net.ParseIP(domain) != nil {
+		return domain, nil
+	}
+	u, err := domainProfile.ToUnicode(domain)
+	if err != nil {
+		return "", ErrInvalidDomain
+	}
+	return u, nil
+}
@@ -0,0 +1,65 @@
+package jid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name               string
+		local, domain, res string
+		want               string
+		wantErr            error
+	}{
+		{"lowercases local and domain", "Juliet", "Example.COM", "Balcony", "juliet@example.com/Balcony", nil},
+		{"trailing dot", "juliet", "example.com.", "", "juliet@example.com", nil},
+		{"width mapping", "ｊｕｌｉｅｔ", "example.com", "", "juliet@example.com", nil},
+		{"punycode domain", "user", "xn--bcher-kva.example", "", "user@bücher.example", nil},
+		{"unicode domain", "user", "BÜCHER.example", "", "user@bücher.example", nil},
+		{"ip literal", "user", "[::1]", "", "user@[::1]", nil},
+		{"ipv4", "", "127.0.0.1", "", "127.0.0.1", nil},
+		{"resource keeps case and spaces", "user", "example.com", "My Phone", "user@example.com/My Phone", nil},
+		{"space in local", "ro meo", "example.com", "", "", ErrInvalidLocal},
+		{"control char in resource", "user", "example.com", "a\u0007b", "", ErrInvalidResource},
+		{"empty domain", "user", "", "", "", ErrInvalidDomain},
+		{"only dot", "user", ".", "", "", ErrInvalidDomain},
+		{"invalid domain label", "user", "exa mple.com", "", "", ErrInvalidDomain},
+		{"too long after normalization", strings.Repeat("a", 1024), "example.com", "", "", ErrTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			j, err := Build(tt.local, tt.domain, tt.res)
+			if err != tt.wantErr {
+				t.Fatalf("Build(%q, %q, %q) error = %v, want %v", tt.local, tt.domain, tt.res, err, tt.wantErr)
+			}
+			if err == nil && j.String() != tt.want {
+				t.Errorf("Build(%q, %q, %q) = %q, want %q", tt.local, tt.domain, tt.res, j, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNormalized(t *testing.T) {
+	t.Parallel()
+	a, err := ParseNormalized("Juliet@Example.com/balcony")
+	if err != nil {
+		t.Fatalf("ParseNormalized: %v", err)
+	}
+	b, err := ParseNormalized("juliet@EXAMPLE.COM./balcony")
+	if err != nil {
+		t.Fatalf("ParseNormalized: %v", err)
+	}
+	if !a.Equal(b) {
+		t.Errorf("%q and %q should be equal after normalization", a, b)
+	}
+
+	if _, err := ParseNormalized("user@example.com/"); err != ErrInvalidResource {
+		t.Errorf("ParseNormalized(trailing slash) error = %v, want ErrInvalidResource", err)
+	}
+	if _, err := ParseNormalized(""); err != ErrEmptyJID {
+		t.Errorf("ParseNormalized(\"\") error = %v, want ErrEmptyJID", err)
+	}
+}
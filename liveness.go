@@ -0,0 +1,94 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/ping"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// ErrLivenessTimeout is reported when the server does not answer a liveness
+// ping in time.
+var ErrLivenessTimeout = errors.New("xmpp: liveness ping timed out")
+
+// checkLiveness runs the liveness check for s and reconnects if it fails.
+func (c *Client) checkLiveness(s *Session) {
+	server, err := jid.New("", c.addr.Domain(), "")
+	if err != nil {
+		return
+	}
+	timeout := c.opts.livenessTimeout
+	if timeout <= 0 {
+		timeout = c.opts.livenessInterval
+	}
+	err = monitorLiveness(s, server, c.opts.livenessInterval, timeout)
+	if err == nil {
+		return
+	}
+	c.dropSession(s)
+	c.reconnect(s, "", err)
+}
+
+// monitorLiveness pings server whenever s has been silent for interval. It
+// returns nil once s is closed, or ErrLivenessTimeout if a ping goes
+// unanswered for timeout, so a dead stream is noticed within
+// interval+timeout of the last inbound traffic.
+func monitorLiveness(s *Session, server jid.JID, interval, timeout time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		// Recent traffic, including stream management acks, already
+		// proves the stream is alive; wait until it has been quiet long enough.
+		if idle := s.clock.Now().Sub(s.LastReceived()); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		iq, err := pingIQ(server)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		reply, err := s.SendIQ(ctx, iq)
+		cancel()
+
+		// Any reply, even an error, shows the server is still there.
+		if reply != nil {
+			timer.Reset(interval)
+			continue
+		}
+		select {
+		case <-s.Done():
+			return nil
+		default:
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return ErrLivenessTimeout
+		}
+		return err
+	}
+}
+
+// pingIQ builds an XEP-0199 ping addressed to server.
+func pingIQ(server jid.JID) (*stanza.IQ, error) {
+	payload, err := xml.Marshal(ping.Ping{})
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.To = server
+	iq.Query = payload
+	return iq, nil
+}
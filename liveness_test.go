@@ -0,0 +1,148 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestMonitorLivenessTimeout(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	// Swallow the ping without answering.
+	go func() {
+		dec := xml.NewDecoder(peer)
+		for {
+			if _, err := dec.Token(); err != nil {
+				return
+			}
+		}
+	}()
+
+	server := jid.MustParse("example.com")
+	err := monitorLiveness(s, server, 20*time.Millisecond, 50*time.Millisecond)
+	if !errors.Is(err, ErrLivenessTimeout) {
+		t.Fatalf("monitorLiveness error = %v, want ErrLivenessTimeout", err)
+	}
+}
+
+func TestMonitorLivenessAnswered(t *testing.T) {
+	s, peer := newTestSession(t, WithLocalAddr(jid.MustParse("alice@example.com/phone")))
+	defer peer.Close()
+
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		return nil
+	}))
+
+	pings := make(chan struct{}, 8)
+	go func() {
+		dec := xml.NewDecoder(peer)
+		for {
+			var iq stanza.IQ
+			if err := dec.Decode(&iq); err != nil {
+				return
+			}
+			fmt.Fprintf(peer, "<iq type='result' id='%s'/>", iq.ID)
+			pings <- struct{}{}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- monitorLiveness(s, jid.MustParse("example.com"), 20*time.Millisecond, time.Second)
+	}()
+
+	for range 2 {
+		select {
+		case <-pings:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for ping")
+		}
+	}
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("monitorLiveness error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitorLiveness did not return after session close")
+	}
+}
+
+func TestMonitorLivenessStalledWrite(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	// Nobody reads from peer, so the ping write blocks until its deadline.
+	done := make(chan error, 1)
+	go func() {
+		done <- monitorLiveness(s, jid.MustParse("example.com"), 20*time.Millisecond, 50*time.Millisecond)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLivenessTimeout) {
+			t.Fatalf("monitorLiveness error = %v, want ErrLivenessTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("monitorLiveness blocked on a stalled write")
+	}
+}
+
+func TestMonitorLivenessSkipsPingWhileAcksArrive(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	go s.Serve(nil)
+
+	pings := make(chan struct{}, 8)
+	go func() {
+		dec := xml.NewDecoder(peer)
+		for {
+			var iq stanza.IQ
+			if err := dec.Decode(&iq); err != nil {
+				return
+			}
+			pings <- struct{}{}
+		}
+	}()
+
+	const interval = 50 * time.Millisecond
+	if _, err := fmt.Fprint(peer, `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>`); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	go monitorLiveness(s, jid.MustParse("example.com"), interval, time.Second)
+
+	// Keep the stream busy with stream management acks for several intervals.
+	for range 15 {
+		if _, err := fmt.Fprint(peer, `<a xmlns='urn:xmpp:sm:3' h='0'/>`); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(interval / 5)
+	}
+	select {
+	case <-pings:
+		t.Fatal("ping sent although acks kept arriving")
+	default:
+	}
+
+	// Once the stream goes quiet the ping follows.
+	select {
+	case <-pings:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no ping after the stream went quiet")
+	}
+}
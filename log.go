@@ -0,0 +1,250 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Logger receives the records of sessions, servers and clients. It is the
+// Log method of *slog.Logger, so a *slog.Logger can be used as is; wrap
+// its handler with NewTraceHandler to also tag records logged outside a
+// session with trace IDs.
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+// defaultLogger is used by sessions without a Logger. It is looked up on
+// every record so that slog.SetDefault applies to sessions already open.
+type defaultLogger struct{}
+
+func (defaultLogger) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	slog.Default().Log(ctx, level, msg, args...)
+}
+
+// loggerOr returns l, or the default logger when l is nil.
+func loggerOr(l Logger) Logger {
+	if l == nil {
+		return defaultLogger{}
+	}
+	return l
+}
+
+// Session directions, logged under the "direction" key.
+const (
+	// DirectionInbound is a stream the peer opened to us.
+	DirectionInbound = "inbound"
+	// DirectionOutbound is a stream we opened to the peer.
+	DirectionOutbound = "outbound"
+)
+
+// WithLogger sets where the session logs. It defaults to slog.Default().
+func WithLogger(l Logger) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		if l != nil {
+			s.logger = l
+		}
+	})
+}
+
+// WithStreamDump logs the XML the session reads and writes at debug level,
+// as "xmpp: recv" and "xmpp: send" records with the raw bytes under the
+// "xml" key. SASL and SASL2 payloads, dialback keys, FAST tokens and
+// passwords are replaced with [redacted], but everything else, message
+// bodies included, is logged as sent: it is meant for troubleshooting, not
+// for production.
+func WithStreamDump() SessionOption {
+	return withStreamDump(true)
+}
+
+// withStreamDump is WithStreamDump when on is set and does nothing
+// otherwise, for servers passing their settings to their sessions.
+func withStreamDump(on bool) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		if on {
+			s.wire.in = &redactor{}
+			s.wire.out = &redactor{}
+		}
+	})
+}
+
+// withDirection sets the direction of a session whose role does not tell
+// it, such as an outbound server-to-server stream.
+func withDirection(dir string) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.direction = dir
+	})
+}
+
+// ID returns the random ID the session was created with, which tells its
+// log records apart from those of other sessions of the same peer.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Log logs msg with args at level, adding the session ID, the remote JID,
+// the direction of the stream and the trace ID carried by ctx.
+func (s *Session) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	attrs := make([]any, 0, len(args)+8)
+	attrs = append(attrs,
+		"session", s.id,
+		"jid", s.RemoteAddr().String(),
+		"direction", s.direction,
+	)
+	if id := TraceID(ctx); id != "" {
+		attrs = append(attrs, TraceKey, id)
+	}
+	s.logger.Log(ctx, level, msg, append(attrs, args...)...)
+}
+
+// logSession logs through session, or through slog.Default() with the
+// trace ID of ctx when there is no session.
+func logSession(ctx context.Context, session *Session, level slog.Level, msg string, args ...any) {
+	if session != nil {
+		session.Log(ctx, level, msg, args...)
+		return
+	}
+	if id := TraceID(ctx); id != "" {
+		args = append(args, TraceKey, id)
+	}
+	defaultLogger{}.Log(ctx, level, msg, args...)
+}
+
+func newSessionID() string {
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// wire sits between the transport and the session's reader and writer,
+// and dumps what passes through when WithStreamDump is set.
+type wire struct {
+	s       *Session
+	in, out *redactor
+	read    atomic.Int64 // bytes read since the last AllowStanza
+}
+
+func (w *wire) Read(p []byte) (int, error) {
+	n, err := w.s.trans.Read(p)
+	w.read.Add(int64(n))
+	if w.in != nil && n > 0 {
+		w.dump("xmpp: recv", w.in, p[:n])
+	}
+	return n, err
+}
+
+func (w *wire) Write(p []byte) (int, error) {
+	n, err := w.s.trans.Write(p)
+	if w.out != nil && n > 0 {
+		w.dump("xmpp: send", w.out, p[:n])
+	}
+	return n, err
+}
+
+func (w *wire) dump(msg string, r *redactor, p []byte) {
+	if xml := r.redact(p); xml != "" {
+		w.s.Log(context.Background(), slog.LevelDebug, msg, "xml", xml)
+	}
+}
+
+// secretText lists the elements whose text is replaced by the stream
+// dump: SASL and SASL2 exchanges, dialback keys and passwords.
+var secretText = map[string]bool{
+	"auth":             true,
+	"challenge":        true,
+	"response":         true,
+	"success":          true,
+	"initial-response": true,
+	"additional-data":  true,
+	"password":         true,
+	"db:result":        true,
+	"db:verify":        true,
+}
+
+const redacted = "[redacted]"
+
+// redactor removes secrets from one direction of a stream. A tag split
+// across reads is held back until it is complete, so its name is known
+// before the text after it is written.
+type redactor struct {
+	mu      sync.Mutex
+	partial string // start of a tag not yet complete
+	secret  bool   // within the text of an element in secretText
+}
+
+func (r *redactor) redact(p []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	in := r.partial + string(p)
+	r.partial = ""
+	var b strings.Builder
+	for in != "" {
+		if r.secret {
+			i := strings.IndexByte(in, '<')
+			if i < 0 {
+				return b.String() + redacted
+			}
+			if i > 0 {
+				b.WriteString(redacted)
+			}
+			r.secret = false
+			in = in[i:]
+			continue
+		}
+		if in[0] != '<' {
+			i := strings.IndexByte(in, '<')
+			if i < 0 {
+				i = len(in)
+			}
+			b.WriteString(in[:i])
+			in = in[i:]
+			continue
+		}
+		end := strings.IndexByte(in, '>')
+		if end < 0 {
+			r.partial = in
+			break
+		}
+		tag := in[:end+1]
+		in = in[end+1:]
+		name := tagName(tag)
+		if name == "token" {
+			tag = redactAttr(tag, "token")
+		}
+		b.WriteString(tag)
+		r.secret = secretText[name] && !strings.HasPrefix(tag, "</") && !strings.HasSuffix(tag, "/>")
+	}
+	return b.String()
+}
+
+// tagName returns the qualified name of the start or end tag t.
+func tagName(t string) string {
+	t = strings.TrimPrefix(strings.TrimPrefix(t, "<"), "/")
+	if i := strings.IndexAny(t, " \t\r\n/>"); i >= 0 {
+		t = t[:i]
+	}
+	return t
+}
+
+// redactAttr replaces the value of the attribute name in the tag t.
+func redactAttr(t, name string) string {
+	for _, q := range []string{"'", `"`} {
+		prefix := " " + name + "=" + q
+		i := strings.Index(t, prefix)
+		if i < 0 {
+			continue
+		}
+		start := i + len(prefix)
+		end := strings.Index(t[start:], q)
+		if end < 0 {
+			continue
+		}
+		return t[:start] + redacted + t[start+end:]
+	}
+	return t
+}
@@ -0,0 +1,142 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// syncBuffer is a bytes.Buffer that a session may log to while the test
+// reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSessionLog(t *testing.T) {
+	t.Parallel()
+	var buf syncBuffer
+	logger := slog.New(NewTraceHandler(slog.NewTextHandler(&buf, nil)))
+	s, peer := newTestSession(t, WithLogger(logger), WithState(StateServer), WithRemoteAddr(jid.MustParse("alice@example.com/phone")))
+	defer s.Close()
+	defer peer.Close()
+
+	if s.ID() == "" {
+		t.Fatal("session has no ID")
+	}
+	s.Log(WithTraceID(context.Background(), "0123abcd"), slog.LevelWarn, "hello", "k", "v")
+	out := buf.String()
+	for _, want := range []string{
+		"level=WARN", "msg=hello", "session=" + s.ID(), "jid=alice@example.com/phone",
+		"direction=inbound", TraceKey + "=0123abcd", "k=v",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output %q lacks %q", out, want)
+		}
+	}
+	if n := strings.Count(out, TraceKey+"="); n != 1 {
+		t.Errorf("trace ID logged %d times", n)
+	}
+
+	client, peer2 := newTestSession(t)
+	defer client.Close()
+	defer peer2.Close()
+	if client.direction != DirectionOutbound {
+		t.Errorf("client direction = %q", client.direction)
+	}
+	if client.ID() == s.ID() {
+		t.Error("sessions share an ID")
+	}
+}
+
+func TestSessionStreamDump(t *testing.T) {
+	t.Parallel()
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, peer := newTestSession(t, WithLogger(logger), WithStreamDump())
+	defer s.Close()
+	defer peer.Close()
+
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("hello")
+	if err := s.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := s.SendRaw(context.Background(), strings.NewReader("<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AGFsaWNlAHBlbmNpbA==</auth>")); err != nil {
+		t.Fatalf("SendRaw: %v", err)
+	}
+
+	handled := make(chan struct{})
+	go s.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error {
+		close(handled)
+		return nil
+	}))
+	if _, err := peer.Write([]byte("<presence/>")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for presence")
+	}
+
+	out := buf.String()
+	for _, want := range []string{`msg="xmpp: send"`, "hello", `msg="xmpp: recv"`, "<presence/>", "[redacted]"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dump %q lacks %q", out, want)
+		}
+	}
+	if strings.Contains(out, "AGFsaWNlAHBlbmNpbA") {
+		t.Errorf("dump %q leaks the SASL payload", out)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"plain", []string{"<message><body>hi</body></message>"}, "<message><body>hi</body></message>"},
+		{"sasl", []string{"<auth mechanism='PLAIN'>c2VjcmV0</auth>"}, "<auth mechanism='PLAIN'>[redacted]</auth>"},
+		{"empty sasl", []string{"<response/><success></success>"}, "<response/><success></success>"},
+		{"split tag", []string{"<chall", "enge xmlns='urn:xmpp:sasl:2'>c2Vj", "cmV0</challenge>"}, "<challenge xmlns='urn:xmpp:sasl:2'>[redacted][redacted]</challenge>"},
+		{"password", []string{"<query><username>alice</username><password>pencil</password></query>"}, "<query><username>alice</username><password>[redacted]</password></query>"},
+		{"dialback", []string{"<db:result from='a' to='b'>b4835385f37fe2895af6c196b59097b16862406db80559900d596a5dbd8ac2ff</db:result>"}, "<db:result from='a' to='b'>[redacted]</db:result>"},
+		{"fast token", []string{`<token xmlns='urn:xmpp:fast:0' expiry='2026-01-01T00:00:00Z' token="s3cr3t"/>`}, `<token xmlns='urn:xmpp:fast:0' expiry='2026-01-01T00:00:00Z' token="[redacted]"/>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r redactor
+			var got strings.Builder
+			for _, c := range tt.chunks {
+				got.WriteString(r.redact([]byte(c)))
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
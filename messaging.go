@@ -0,0 +1,225 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// ErrNotConnected is returned when the client has no session to send on.
+var ErrNotConnected = errors.New("xmpp: not connected")
+
+// Matcher selects the stanzas delivered to a callback registered with
+// OnMessage, OnPresence or OnIQ. A callback registered with several
+// matchers receives the stanzas that match all of them.
+type Matcher func(st stanza.Stanza) bool
+
+// MatchFrom matches stanzas sent by j. A bare JID matches all its
+// resources and a domain JID the domain itself.
+func MatchFrom(j jid.JID) Matcher {
+	return func(st stanza.Stanza) bool {
+		from := st.GetHeader().From
+		if j.IsFull() {
+			return from.Equal(j)
+		}
+		return from.Bare().Equal(j)
+	}
+}
+
+// MatchType matches stanzas whose type attribute is typ, such as
+// stanza.MessageChat or stanza.IQGet.
+func MatchType(typ string) Matcher {
+	return func(st stanza.Stanza) bool {
+		return st.GetHeader().Type == typ
+	}
+}
+
+// MatchNamespace matches stanzas carrying a payload in namespace space: an
+// extension element of a message or presence, or the child of an IQ.
+func MatchNamespace(space string) Matcher {
+	return func(st stanza.Stanza) bool {
+		switch st := st.(type) {
+		case *stanza.Message:
+			return hasExtension(st.Extensions, space)
+		case *stanza.Presence:
+			return hasExtension(st.Extensions, space)
+		case *stanza.IQ:
+			return payloadName(st.Query).Space == space
+		default:
+			return false
+		}
+	}
+}
+
+func hasExtension(exts []stanza.Extension, space string) bool {
+	for _, ext := range exts {
+		if ext.XMLName.Space == space {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadName returns the name of the first element in an IQ payload, or
+// the zero name if there is none.
+func payloadName(payload []byte) xml.Name {
+	dec := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name
+		}
+	}
+}
+
+func matchAll(matchers []Matcher, st stanza.Stanza) bool {
+	for _, m := range matchers {
+		if !m(st) {
+			return false
+		}
+	}
+	return true
+}
+
+type messageCallback struct {
+	match []Matcher
+	f     func(context.Context, *stanza.Message)
+}
+
+type presenceCallback struct {
+	match []Matcher
+	f     func(context.Context, *stanza.Presence)
+}
+
+type iqCallback struct {
+	match []Matcher
+	f     func(context.Context, *stanza.IQ) *stanza.IQ
+}
+
+// callbacks are the typed handlers of a Client. They outlive its sessions,
+// so they keep working across reconnects.
+type callbacks struct {
+	mu        sync.RWMutex
+	messages  []messageCallback
+	presences []presenceCallback
+	iqs       []iqCallback
+}
+
+// OnMessage registers f for incoming messages that match all of match.
+// Every matching callback is called, in registration order, and the message
+// is then passed on to the handler set with WithHandler or the session mux.
+func (c *Client) OnMessage(f func(ctx context.Context, msg *stanza.Message), match ...Matcher) {
+	c.callbacks.mu.Lock()
+	defer c.callbacks.mu.Unlock()
+	c.callbacks.messages = append(c.callbacks.messages, messageCallback{match, f})
+}
+
+// OnPresence registers f for incoming presence that matches all of match,
+// delivered like messages are by OnMessage.
+func (c *Client) OnPresence(f func(ctx context.Context, pres *stanza.Presence), match ...Matcher) {
+	c.callbacks.mu.Lock()
+	defer c.callbacks.mu.Unlock()
+	c.callbacks.presences = append(c.callbacks.presences, presenceCallback{match, f})
+}
+
+// OnIQ registers f to answer get and set requests that match all of match.
+// The first matching callback handles the request and the IQ it returns,
+// typically built with ResultIQ or ErrorIQ, is sent back; a nil IQ sends
+// nothing. Requests no callback matches go to the handler set with
+// WithHandler or the session mux. Results and errors are not delivered
+// here; Request and Session.SendIQ receive them.
+func (c *Client) OnIQ(f func(ctx context.Context, iq *stanza.IQ) *stanza.IQ, match ...Matcher) {
+	c.callbacks.mu.Lock()
+	defer c.callbacks.mu.Unlock()
+	c.callbacks.iqs = append(c.callbacks.iqs, iqCallback{match, f})
+}
+
+// wrap returns a handler that runs the matching callbacks before next.
+func (cb *callbacks) wrap(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		cb.mu.RLock()
+		messages, presences, iqs := cb.messages, cb.presences, cb.iqs
+		cb.mu.RUnlock()
+
+		switch st := st.(type) {
+		case *stanza.Message:
+			for _, m := range messages {
+				if matchAll(m.match, st) {
+					m.f(ctx, st)
+				}
+			}
+		case *stanza.Presence:
+			for _, p := range presences {
+				if matchAll(p.match, st) {
+					p.f(ctx, st)
+				}
+			}
+		case *stanza.IQ:
+			if st.Type != stanza.IQGet && st.Type != stanza.IQSet {
+				break
+			}
+			for _, q := range iqs {
+				if !matchAll(q.match, st) {
+					continue
+				}
+				if reply := q.f(ctx, st); reply != nil {
+					return s.Send(ctx, reply)
+				}
+				return nil
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		return next.HandleStanza(ctx, s, st)
+	})
+}
+
+// SendChatMessage sends body to to as a chat message and returns the ID it
+// was given, with which receipts and corrections refer to it.
+func (c *Client) SendChatMessage(ctx context.Context, to jid.JID, body string) (string, error) {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = to
+	msg.SetBody(body)
+	if err := c.Send(ctx, msg); err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// Request sends an IQ of type typ (stanza.IQGet or stanza.IQSet) with
+// payload to to and waits for the answer, matched by ID, until ctx is done.
+// The payload of a result is decoded into response unless it is nil. An
+// error reply is returned as its *stanza.StanzaError.
+func (c *Client) Request(ctx context.Context, typ string, to jid.JID, payload, response any) error {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+	if s == nil {
+		return ErrNotConnected
+	}
+
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	iq := stanza.NewIQ(typ)
+	iq.To = to
+	iq.Query = data
+	reply, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return err
+	}
+	if response == nil || len(bytes.TrimSpace(reply.Query)) == 0 {
+		return nil
+	}
+	return xml.Unmarshal(reply.Query, response)
+}
@@ -0,0 +1,225 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const testStreamHeader = `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>`
+
+// pipeWrites returns the chunks the client writes to its end of conn.
+func pipeWrites(conn net.Conn) <-chan string {
+	out := make(chan string, 16)
+	go func() {
+		defer close(out)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			out <- string(buf[:n])
+		}
+	}()
+	return out
+}
+
+func nextWrite(t *testing.T, writes <-chan string) string {
+	t.Helper()
+	select {
+	case w := <-writes:
+		return w
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing written")
+		return ""
+	}
+}
+
+var idAttr = regexp.MustCompile(`id="([^"]+)"`)
+
+func TestMatchers(t *testing.T) {
+	t.Parallel()
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From = jid.MustParse("bob@example.com/phone")
+	msg.Extensions = []stanza.Extension{{XMLName: xml.Name{Space: "urn:xmpp:receipts", Local: "request"}}}
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.Query = []byte(`<query xmlns='jabber:iq:version'/>`)
+
+	tests := []struct {
+		name string
+		m    Matcher
+		st   stanza.Stanza
+		want bool
+	}{
+		{"bare from", MatchFrom(jid.MustParse("bob@example.com")), msg, true},
+		{"full from", MatchFrom(jid.MustParse("bob@example.com/phone")), msg, true},
+		{"other resource", MatchFrom(jid.MustParse("bob@example.com/desk")), msg, false},
+		{"domain from", MatchFrom(jid.MustParse("example.com")), msg, false},
+		{"type", MatchType(stanza.MessageChat), msg, true},
+		{"other type", MatchType(stanza.MessageGroupchat), msg, false},
+		{"message namespace", MatchNamespace("urn:xmpp:receipts"), msg, true},
+		{"missing namespace", MatchNamespace("urn:xmpp:chat-markers:0"), msg, false},
+		{"iq namespace", MatchNamespace("jabber:iq:version"), iq, true},
+		{"iq other namespace", MatchNamespace("jabber:iq:roster"), iq, false},
+	}
+	for _, tt := range tests {
+		if got := tt.m(tt.st); got != tt.want {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+}
+
+func TestClientCallbacks(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+
+	passed := make(chan stanza.Stanza, 4)
+	c := &Client{session: s}
+	c.opts.handler = HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		passed <- st
+		return nil
+	})
+	fromBob := make(chan string, 4)
+	c.OnMessage(func(_ context.Context, msg *stanza.Message) {
+		fromBob <- msg.Body()
+	}, MatchFrom(jid.MustParse("bob@example.com")), MatchType(stanza.MessageChat))
+	c.OnIQ(func(_ context.Context, iq *stanza.IQ) *stanza.IQ {
+		reply := iq.ResultIQ()
+		reply.Query = []byte(`<query xmlns='jabber:iq:version'><name>test</name></query>`)
+		return reply
+	}, MatchNamespace("jabber:iq:version"))
+	go c.serve(s)
+
+	input := testStreamHeader +
+		`<message from='carol@example.com/x' type='chat'><body>not for the callback</body></message>` +
+		`<message from='bob@example.com/phone' type='chat'><body>hello</body></message>` +
+		`<iq from='bob@example.com/phone' type='get' id='v1'><query xmlns='jabber:iq:version'/></iq>` +
+		`<iq from='bob@example.com/phone' type='get' id='t1'><time xmlns='urn:xmpp:time'/></iq>`
+	go func() { _, _ = c2.Write([]byte(input)) }()
+
+	select {
+	case body := <-fromBob:
+		if body != "hello" {
+			t.Fatalf("callback got %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message callback not called")
+	}
+	if w := nextWrite(t, writes); !strings.Contains(w, `id="v1"`) || !strings.Contains(w, "<name>test</name>") {
+		t.Fatalf("version reply %s", w)
+	}
+
+	// Both messages and the unanswered IQ reach the handler; the answered
+	// one does not.
+	var got []string
+	for range 3 {
+		select {
+		case st := <-passed:
+			got = append(got, st.StanzaType()+":"+st.GetHeader().From.String())
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handler got only %v", got)
+		}
+	}
+	if got[2] != "iq:bob@example.com/phone" {
+		t.Fatalf("handler got %v", got)
+	}
+	select {
+	case st := <-passed:
+		t.Fatalf("handler also got %+v", st)
+	case <-fromBob:
+		t.Fatal("callback called for carol")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type versionQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name,omitempty"`
+}
+
+func TestClientRequest(t *testing.T) {
+	t.Parallel()
+	if err := (&Client{}).Request(context.Background(), stanza.IQGet, jid.JID{}, versionQuery{}, nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Request without a session: %v", err)
+	}
+
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+	go c.serve(s)
+	if _, err := c2.Write([]byte(testStreamHeader)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := jid.MustParse("example.com")
+	var resp versionQuery
+	done := make(chan error, 1)
+	go func() { done <- c.Request(context.Background(), stanza.IQGet, server, versionQuery{}, &resp) }()
+	w := nextWrite(t, writes)
+	id := idAttr.FindStringSubmatch(w)
+	if id == nil || !strings.Contains(w, `to="example.com"`) || !strings.Contains(w, "jabber:iq:version") {
+		t.Fatalf("request %s", w)
+	}
+	reply := `<iq from='example.com' type='result' id='` + id[1] + `'><query xmlns='jabber:iq:version'><name>xmppd</name></query></iq>`
+	if _, err := c2.Write([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil || resp.Name != "xmppd" {
+		t.Fatalf("Request = %v, response %+v", err, resp)
+	}
+
+	go func() { done <- c.Request(context.Background(), stanza.IQGet, server, versionQuery{}, &resp) }()
+	id = idAttr.FindStringSubmatch(nextWrite(t, writes))
+	reply = `<iq from='example.com' type='error' id='` + id[1] + `'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`
+	if _, err := c2.Write([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	var se *stanza.StanzaError
+	if err := <-done; !errors.As(err, &se) || se.Type != stanza.ErrorTypeCancel {
+		t.Fatalf("error reply returned %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() { done <- c.Request(ctx, stanza.IQGet, server, versionQuery{}, nil) }()
+	nextWrite(t, writes)
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unanswered request returned %v", err)
+	}
+}
+
+func TestClientSendChatMessage(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+
+	id, err := c.SendChatMessage(context.Background(), jid.MustParse("bob@example.com"), "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := nextWrite(t, writes)
+	if id == "" || !strings.Contains(w, `id="`+id+`"`) || !strings.Contains(w, `type="chat"`) || !strings.Contains(w, "<body>hi</body>") {
+		t.Fatalf("sent %s with id %q", w, id)
+	}
+
+	if _, err := (&Client{}).SendChatMessage(context.Background(), jid.MustParse("bob@example.com"), "hi"); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("SendChatMessage without a session: %v", err)
+	}
+}
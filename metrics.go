@@ -0,0 +1,97 @@
+package xmpp
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Metrics receives instrumentation events from sessions, servers and
+// clients. Implementations must be safe for concurrent use. The metrics
+// package provides one that is exported in the Prometheus text format.
+type Metrics interface {
+	// StanzaReceived and StanzaSent count the stanzas read from and
+	// written to a stream. kind is message, presence or iq, and typ the
+	// type attribute, which may be empty.
+	StanzaReceived(kind, typ string)
+	StanzaSent(kind, typ string)
+
+	// SessionStarted and SessionEnded bracket every session, so their
+	// difference is the number of active sessions.
+	SessionStarted()
+	SessionEnded()
+
+	// AuthFailed counts a failed authentication with mechanism, or with
+	// "" when the mechanism is not known.
+	AuthFailed(mechanism string)
+
+	// RoutingFailed counts a stanza that could not be delivered, with the
+	// stanza error condition or another short reason.
+	RoutingFailed(reason string)
+
+	// StorageOp records a call to the storage method op that took d and
+	// returned err.
+	StorageOp(op string, d time.Duration, err error)
+}
+
+// Tracer starts a span around the handling of each stanza. The returned
+// context is passed to the handler and end is called with the handler's
+// error. An OpenTelemetry tracer is adapted with a few lines calling
+// trace.Tracer.Start and converting attrs to attributes.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, attrs ...slog.Attr) (_ context.Context, end func(err error))
+}
+
+// nopMetrics is used by sessions without Metrics.
+type nopMetrics struct{}
+
+func (nopMetrics) StanzaReceived(string, string)          {}
+func (nopMetrics) StanzaSent(string, string)              {}
+func (nopMetrics) SessionStarted()                        {}
+func (nopMetrics) SessionEnded()                          {}
+func (nopMetrics) AuthFailed(string)                      {}
+func (nopMetrics) RoutingFailed(string)                   {}
+func (nopMetrics) StorageOp(string, time.Duration, error) {}
+
+// WithMetrics sets where the session reports the stanzas it reads and
+// writes and its start and end.
+func WithMetrics(m Metrics) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		if m != nil {
+			s.metrics = m
+		}
+	})
+}
+
+// WithTracer sets the tracer that Serve starts a span with for every
+// stanza it hands to the handler.
+func WithTracer(t Tracer) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.tracer = t
+	})
+}
+
+// Metrics returns the metrics of the session, which discard everything
+// when none were set. Handlers that read the stream themselves report the
+// stanzas, authentication failures and routing errors they see here.
+func (s *Session) Metrics() Metrics {
+	return s.metrics
+}
+
+// handle passes st to handler within a span of the session's tracer.
+func (s *Session) handle(ctx context.Context, handler Handler, st stanza.Stanza) error {
+	if s.tracer == nil {
+		return handler.HandleStanza(ctx, s, st)
+	}
+	header := st.GetHeader()
+	ctx, end := s.tracer.StartSpan(ctx, "xmpp.handle "+st.StanzaType(),
+		slog.String("xmpp.stanza.type", header.Type),
+		slog.String("xmpp.stanza.id", header.ID),
+		slog.String(TraceKey, TraceID(ctx)),
+	)
+	err := handler.HandleStanza(ctx, s, st)
+	end(err)
+	return err
+}
@@ -0,0 +1,216 @@
+// Package metrics provides an implementation of xmpp.Metrics that is
+// scraped by Prometheus. It writes the text exposition format itself, so it
+// adds no dependency to the programs using it.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the storage latency
+// histogram.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Prometheus counts the events reported to it and serves them to a
+// Prometheus scraper as an http.Handler. The exported series are:
+//
+//	xmpp_stanzas_received_total{kind,type}
+//	xmpp_stanzas_sent_total{kind,type}
+//	xmpp_sessions_active
+//	xmpp_sessions_total
+//	xmpp_auth_failures_total{mechanism}
+//	xmpp_routing_errors_total{reason}
+//	xmpp_storage_duration_seconds{op} (histogram)
+//	xmpp_storage_errors_total{op}
+//
+// storage.ErrNotFound is an answer rather than a failure and is not
+// counted as a storage error.
+type Prometheus struct {
+	mu       sync.Mutex
+	received map[[2]string]uint64
+	sent     map[[2]string]uint64
+	active   int64
+	sessions uint64
+	auth     map[string]uint64
+	routing  map[string]uint64
+	storage  map[string]*histogram
+	errors   map[string]uint64
+	buckets  []float64
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// New returns an empty Prometheus with DefaultBuckets.
+func New() *Prometheus {
+	return &Prometheus{
+		received: make(map[[2]string]uint64),
+		sent:     make(map[[2]string]uint64),
+		auth:     make(map[string]uint64),
+		routing:  make(map[string]uint64),
+		storage:  make(map[string]*histogram),
+		errors:   make(map[string]uint64),
+		buckets:  DefaultBuckets,
+	}
+}
+
+func (p *Prometheus) StanzaReceived(kind, typ string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.received[[2]string{kind, typ}]++
+}
+
+func (p *Prometheus) StanzaSent(kind, typ string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent[[2]string{kind, typ}]++
+}
+
+func (p *Prometheus) SessionStarted() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+	p.sessions++
+}
+
+func (p *Prometheus) SessionEnded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+}
+
+func (p *Prometheus) AuthFailed(mechanism string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.auth[mechanism]++
+}
+
+func (p *Prometheus) RoutingFailed(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routing[reason]++
+}
+
+func (p *Prometheus) StorageOp(op string, d time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.storage[op]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(p.buckets))}
+		p.storage[op] = h
+	}
+	secs := d.Seconds()
+	if i, _ := slices.BinarySearch(p.buckets, secs); i < len(p.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += secs
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		p.errors[op]++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = p.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	p.mu.Lock()
+	writeStanzas(&b, "xmpp_stanzas_received_total", "Stanzas read from streams.", p.received)
+	writeStanzas(&b, "xmpp_stanzas_sent_total", "Stanzas written to streams.", p.sent)
+	writeHeader(&b, "xmpp_sessions_active", "Sessions currently open.", "gauge")
+	fmt.Fprintf(&b, "xmpp_sessions_active %d\n", p.active)
+	writeHeader(&b, "xmpp_sessions_total", "Sessions opened.", "counter")
+	fmt.Fprintf(&b, "xmpp_sessions_total %d\n", p.sessions)
+	writeCounters(&b, "xmpp_auth_failures_total", "Failed authentications.", "mechanism", p.auth)
+	writeCounters(&b, "xmpp_routing_errors_total", "Stanzas that could not be delivered.", "reason", p.routing)
+	p.writeStorage(&b)
+	writeCounters(&b, "xmpp_storage_errors_total", "Storage calls that failed.", "op", p.errors)
+	p.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (p *Prometheus) writeStorage(b *strings.Builder) {
+	const name = "xmpp_storage_duration_seconds"
+	writeHeader(b, name, "Duration of storage calls.", "histogram")
+	for _, op := range sortedKeys(p.storage) {
+		h := p.storage[op]
+		label := `op="` + escape(op) + `"`
+		var cumulative uint64
+		for i, le := range p.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, label, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, label, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, label, h.count)
+	}
+}
+
+func writeHeader(b *strings.Builder, name, help, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeStanzas(b *strings.Builder, name, help string, counts map[[2]string]uint64) {
+	writeHeader(b, name, help, "counter")
+	keys := make([][2]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{kind=\"%s\",type=\"%s\"} %d\n", name, escape(k[0]), escape(k[1]), counts[k])
+	}
+}
+
+func writeCounters(b *strings.Builder, name, help, label string, counts map[string]uint64) {
+	writeHeader(b, name, help, "counter")
+	for _, k := range sortedKeys(counts) {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, escape(k), counts[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	xmpp "github.com/meszmate/xmpp-go"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+var _ xmpp.Metrics = (*Prometheus)(nil)
+
+func TestPrometheus(t *testing.T) {
+	t.Parallel()
+	p := New()
+	p.StanzaReceived("message", "chat")
+	p.StanzaReceived("message", "chat")
+	p.StanzaReceived("iq", "get")
+	p.StanzaSent("presence", "")
+	p.SessionStarted()
+	p.SessionStarted()
+	p.SessionEnded()
+	p.AuthFailed("SCRAM-SHA-1")
+	p.RoutingFailed(`item-"not"-found`)
+	p.StorageOp("GetUser", 2*time.Millisecond, nil)
+	p.StorageOp("GetUser", 300*time.Millisecond, storage.ErrNotFound)
+	p.StorageOp("GetUser", 5*time.Second, errors.New("down"))
+
+	var b strings.Builder
+	if _, err := p.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE xmpp_stanzas_received_total counter",
+		`xmpp_stanzas_received_total{kind="iq",type="get"} 1`,
+		`xmpp_stanzas_received_total{kind="message",type="chat"} 2`,
+		`xmpp_stanzas_sent_total{kind="presence",type=""} 1`,
+		"xmpp_sessions_active 1",
+		"xmpp_sessions_total 2",
+		`xmpp_auth_failures_total{mechanism="SCRAM-SHA-1"} 1`,
+		`xmpp_routing_errors_total{reason="item-\"not\"-found"} 1`,
+		"# TYPE xmpp_storage_duration_seconds histogram",
+		`xmpp_storage_duration_seconds_bucket{op="GetUser",le="0.001"} 0`,
+		`xmpp_storage_duration_seconds_bucket{op="GetUser",le="0.0025"} 1`,
+		`xmpp_storage_duration_seconds_bucket{op="GetUser",le="0.5"} 2`,
+		`xmpp_storage_duration_seconds_bucket{op="GetUser",le="2.5"} 2`,
+		`xmpp_storage_duration_seconds_bucket{op="GetUser",le="+Inf"} 3`,
+		`xmpp_storage_duration_seconds_sum{op="GetUser"} 5.302`,
+		`xmpp_storage_duration_seconds_count{op="GetUser"} 3`,
+		`xmpp_storage_errors_total{op="GetUser"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+	if i, j := strings.Index(out, `kind="iq"`), strings.Index(out, `kind="message"`); i > j {
+		t.Error("series are not sorted")
+	}
+}
+
+func TestPrometheusServeHTTP(t *testing.T) {
+	t.Parallel()
+	p := New()
+	p.SessionStarted()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "xmpp_sessions_total 1\n") {
+		t.Errorf("body:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,141 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// recordMetrics records the events reported to it.
+type recordMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	received []string
+	sent     []string
+	started  int
+	ended    int
+}
+
+func (m *recordMetrics) StanzaReceived(kind, typ string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received = append(m.received, kind+"/"+typ)
+}
+
+func (m *recordMetrics) StanzaSent(kind, typ string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, kind+"/"+typ)
+}
+
+func (m *recordMetrics) SessionStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+}
+
+func (m *recordMetrics) SessionEnded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended++
+}
+
+type recordTracer struct {
+	spans chan string
+	ended chan error
+}
+
+func (t *recordTracer) StartSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, func(error)) {
+	for _, a := range attrs {
+		name += " " + a.String()
+	}
+	t.spans <- name
+	return ctx, func(err error) { t.ended <- err }
+}
+
+func TestSessionMetrics(t *testing.T) {
+	t.Parallel()
+	m := &recordMetrics{}
+	s, peer := newTestSession(t, WithMetrics(m))
+	defer peer.Close()
+	if s.Metrics() != Metrics(m) {
+		t.Fatal("Metrics did not return the configured metrics")
+	}
+
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	if err := s.Send(context.Background(), stanza.NewMessage(stanza.MessageChat)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	handled := make(chan struct{})
+	go s.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error {
+		close(handled)
+		return nil
+	}))
+	if _, err := peer.Write([]byte("<iq type='get' id='1'/>")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for iq")
+	}
+	s.Close()
+	s.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.received) != 1 || m.received[0] != "iq/get" {
+		t.Errorf("received = %v", m.received)
+	}
+	if len(m.sent) != 1 || m.sent[0] != "message/chat" {
+		t.Errorf("sent = %v", m.sent)
+	}
+	if m.started != 1 || m.ended != 1 {
+		t.Errorf("started %d, ended %d sessions", m.started, m.ended)
+	}
+}
+
+func TestSessionTracer(t *testing.T) {
+	t.Parallel()
+	tr := &recordTracer{spans: make(chan string, 1), ended: make(chan error, 1)}
+	s, peer := newTestSession(t, WithTracer(tr))
+	defer s.Close()
+	defer peer.Close()
+
+	errHandler := errors.New("handler failed")
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(HandlerFunc(func(ctx context.Context, _ *Session, _ stanza.Stanza) error {
+			if TraceID(ctx) == "" {
+				t.Error("handler context has no trace ID")
+			}
+			return errHandler
+		}))
+	}()
+	if _, err := peer.Write([]byte("<message type='chat' id='m1'/>")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case span := <-tr.spans:
+		want := "xmpp.handle message xmpp.stanza.type=chat xmpp.stanza.id=m1 trace_id="
+		if len(span) <= len(want) || span[:len(want)] != want {
+			t.Errorf("span = %q", span)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for span")
+	}
+	if err := <-tr.ended; !errors.Is(err, errHandler) {
+		t.Errorf("span ended with %v", err)
+	}
+	if err := <-served; !errors.Is(err, errHandler) {
+		t.Errorf("Serve = %v", err)
+	}
+}
@@ -2,7 +2,7 @@ package xmpp
 
 import (
 	"context"
-	"log"
+	"log/slog"
 
 	"github.com/meszmate/xmpp-go/stanza"
 )
@@ -23,8 +23,12 @@ func LogMiddleware() Middleware {
 	return func(next Handler) Handler {
 		return HandlerFunc(func(ctx context.Context, session *Session, st stanza.Stanza) error {
 			header := st.GetHeader()
-			log.Printf("xmpp: %s from=%s to=%s id=%s type=%s",
-				st.StanzaType(), header.From, header.To, header.ID, header.Type)
+			logSession(ctx, session, slog.LevelInfo, "xmpp: stanza",
+				"kind", st.StanzaType(),
+				"from", header.From.String(),
+				"to", header.To.String(),
+				"id", header.ID,
+				"type", header.Type)
 			return next.HandleStanza(ctx, session, st)
 		})
 	}
@@ -36,7 +40,7 @@ func RecoverMiddleware() Middleware {
 		return HandlerFunc(func(ctx context.Context, session *Session, st stanza.Stanza) error {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("xmpp: recovered from panic: %v", r)
+					logSession(ctx, session, slog.LevelError, "xmpp: recovered from panic", "panic", r)
 				}
 			}()
 			return next.HandleStanza(ctx, session, st)
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+
+	"github.com/meszmate/xmpp-go/clock"
 )
 
 var (
@@ -59,6 +61,7 @@ func (m *Manager) Initialize(ctx context.Context, params InitParams) error {
 	}
 	m.order = order
 
+	params.Clock = clock.Or(params.Clock)
 	params.Get = func(name string) (Plugin, bool) {
 		p, ok := m.plugins[name]
 		return p, ok
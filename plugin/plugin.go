@@ -4,6 +4,8 @@ package plugin
 import (
 	"context"
 
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/stanza"
 	"github.com/meszmate/xmpp-go/storage"
 )
 
@@ -38,8 +40,25 @@ type InitParams struct {
 	LocalJID func() string
 	// RemoteJID returns the remote JID string.
 	RemoteJID func() string
+	// SendIQ sends an IQ request and waits for the reply, returning an
+	// error reply as its *stanza.StanzaError. Clients set it; it is nil on
+	// servers.
+	SendIQ func(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error)
 	// Get retrieves another plugin by name.
 	Get func(name string) (Plugin, bool)
 	// Storage provides access to the pluggable storage layer. May be nil.
 	Storage storage.Storage
+	// Clock reports the current time. Manager.Initialize sets it to
+	// clock.System when nil.
+	Clock clock.Clock
+}
+
+// StorageUser is implemented by plugins whose features are backed by a
+// storage sub-store and that return storage.ErrStorageUnavailable without
+// one. Servers refuse to start when such a plugin is configured but its
+// sub-store is missing.
+type StorageUser interface {
+	// StorageAvailable reports whether Initialize found the sub-store the
+	// plugin needs.
+	StorageAvailable() bool
 }
@@ -2,8 +2,17 @@
 package avatar
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -39,6 +48,42 @@ type VCardUpdate struct {
 	Photo   *string  `xml:"photo"`
 }
 
+// Hash returns the SHA-1 of avatar image data as lowercase hex: the item
+// ID of a XEP-0084 avatar and the photo hash of XEP-0153.
+func Hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAvatar returns the data and metadata items publishing an image of
+// mediaType as the avatar, both with the ID Hash(data). Its dimensions are
+// included for GIF, JPEG and PNG images.
+func NewAvatar(data []byte, mediaType string) (Data, Metadata) {
+	info := MetadataInfo{Bytes: len(data), ID: Hash(data), Type: mediaType}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	return Data{Value: base64.StdEncoding.EncodeToString(data)}, Metadata{Info: []MetadataInfo{info}}
+}
+
+// Bytes decodes the image data, ignoring the line breaks base64 is often
+// wrapped with.
+func (d Data) Bytes() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(d.Value), ""))
+}
+
+// Stored returns the info of the image published to the data node, as
+// opposed to those hosted at a URL. An empty metadata element, which
+// disables the avatar, has none.
+func (m *Metadata) Stored() (MetadataInfo, bool) {
+	for _, info := range m.Info {
+		if info.URL == "" && info.ID != "" {
+			return info, true
+		}
+	}
+	return MetadataInfo{}, false
+}
+
 type Plugin struct {
 	params plugin.InitParams
 }
@@ -58,4 +103,5 @@ func init() {
 	_ = ns.AvatarData
 	_ = ns.AvatarMetadata
 	_ = ns.VCardUpdate
+	_ = ns.PEPVCardConversion
 }
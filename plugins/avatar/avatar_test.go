@@ -0,0 +1,47 @@
+package avatar
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestNewAvatar(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	data, meta := NewAvatar(buf.Bytes(), "image/png")
+	info, ok := meta.Stored()
+	if !ok || info.ID != Hash(buf.Bytes()) || info.Bytes != buf.Len() || info.Width != 4 || info.Height != 3 || info.Type != "image/png" {
+		t.Fatalf("info = %+v", info)
+	}
+	if len(info.ID) != 40 {
+		t.Fatalf("hash %q is not hex SHA-1", info.ID)
+	}
+	// Wrapped base64 decodes like unwrapped.
+	data.Value = data.Value[:10] + "\n  " + data.Value[10:]
+	if got, err := data.Bytes(); err != nil || !bytes.Equal(got, buf.Bytes()) {
+		t.Fatalf("Bytes = %v", err)
+	}
+
+	// Images of unknown formats have no dimensions.
+	_, meta = NewAvatar([]byte("not an image"), "image/webp")
+	if info, _ := meta.Stored(); info.Width != 0 || info.Height != 0 {
+		t.Fatalf("info = %+v", info)
+	}
+}
+
+func TestMetadataStored(t *testing.T) {
+	meta := Metadata{Info: []MetadataInfo{
+		{ID: "a", URL: "https://example.com/a.png"},
+		{ID: "b", Type: "image/png"},
+	}}
+	if info, ok := meta.Stored(); !ok || info.ID != "b" {
+		t.Fatalf("Stored = %+v, %v", info, ok)
+	}
+	if _, ok := (&Metadata{}).Stored(); ok {
+		t.Fatal("empty metadata has a stored image")
+	}
+}
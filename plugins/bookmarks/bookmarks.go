@@ -1,4 +1,6 @@
-// Package bookmarks implements XEP-0402 PEP Native Bookmarks.
+// Package bookmarks implements XEP-0402 PEP Native Bookmarks: the storage
+// of a server, and the synchronization of a client's bookmarks, converted
+// from XEP-0048 storage when needed.
 package bookmarks
 
 import (
@@ -32,50 +34,61 @@ type Extension struct {
 type Plugin struct {
 	store  storage.BookmarkStore
 	params plugin.InitParams
+	client clientState
 }
 
 func New() *Plugin { return &Plugin{} }
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
-func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
-	p.params = params
+
+// Initialize sets the plugin up for a session. On a client with autojoin
+// enabled, the bookmarked rooms are joined in the background.
+func (p *Plugin) Initialize(ctx context.Context, params plugin.InitParams) error {
 	if params.Storage != nil {
 		p.store = params.Storage.BookmarkStore()
 	}
+	p.start(ctx, params)
+	return nil
+}
+func (p *Plugin) Close() error {
+	p.stop()
 	return nil
 }
-func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-// Set adds or updates a bookmark. Returns nil if no store is configured.
+// StorageAvailable reports whether the configured storage provides a
+// BookmarkStore. It implements plugin.StorageUser.
+func (p *Plugin) StorageAvailable() bool { return p.store != nil }
+
+// Set adds or updates a bookmark. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) Set(ctx context.Context, bm *storage.Bookmark) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.SetBookmark(ctx, bm)
 }
 
-// Get retrieves a bookmark. Returns nil if no store is configured.
+// Get retrieves a bookmark. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) Get(ctx context.Context, userJID, roomJID string) (*storage.Bookmark, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetBookmark(ctx, userJID, roomJID)
 }
 
-// List retrieves all bookmarks for a user. Returns nil if no store is configured.
+// List retrieves all bookmarks for a user. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) List(ctx context.Context, userJID string) ([]*storage.Bookmark, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetBookmarks(ctx, userJID)
 }
 
-// Delete removes a bookmark. Returns nil if no store is configured.
+// Delete removes a bookmark. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) Delete(ctx context.Context, userJID, roomJID string) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.DeleteBookmark(ctx, userJID, roomJID)
 }
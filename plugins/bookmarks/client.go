@@ -0,0 +1,415 @@
+package bookmarks
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	// ErrNotConnected is returned when bookmarks have to be fetched or
+	// published but the plugin was not initialized by a client.
+	ErrNotConnected = errors.New("bookmarks: not connected")
+	// ErrNoMUC is returned when autojoining rooms without the muc plugin.
+	ErrNoMUC = errors.New("bookmarks: muc plugin not registered")
+)
+
+// Bookmark is a bookmarked room of the account.
+type Bookmark struct {
+	JID        jid.JID
+	Conference Conference
+}
+
+// ChangeHandler is called when a bookmark of room is published or, with a
+// nil c, retracted, usually by another client of the account.
+type ChangeHandler func(ctx context.Context, room jid.JID, c *Conference)
+
+// LegacyStorage is the XEP-0048 bookmark storage older clients keep in
+// private XML storage (XEP-0049).
+type LegacyStorage struct {
+	XMLName     xml.Name           `xml:"storage:bookmarks storage"`
+	Conferences []LegacyConference `xml:"conference"`
+}
+
+type LegacyConference struct {
+	XMLName  xml.Name `xml:"conference"`
+	JID      string   `xml:"jid,attr"`
+	Name     string   `xml:"name,attr,omitempty"`
+	Autojoin bool     `xml:"autojoin,attr,omitempty"`
+	Nick     string   `xml:"nick,omitempty"`
+	Password string   `xml:"password,omitempty"`
+}
+
+type privateQuery struct {
+	XMLName xml.Name       `xml:"jabber:iq:private query"`
+	Storage *LegacyStorage `xml:"storage:bookmarks storage"`
+}
+
+// clientState is the state of the plugin on a client.
+type clientState struct {
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	autojoin bool
+	onChange ChangeHandler
+	onError  func(error)
+}
+
+// SetAutojoin sets whether the rooms bookmarked with autojoin are joined
+// through the muc plugin on connect, and joined and left as other clients
+// of the account change their bookmarks. The muc plugin must be registered
+// with the same manager.
+func (p *Plugin) SetAutojoin(enabled bool) {
+	p.client.mu.Lock()
+	defer p.client.mu.Unlock()
+	p.client.autojoin = enabled
+}
+
+// OnChange registers the callback invoked by HandleEvent.
+func (p *Plugin) OnChange(f ChangeHandler) {
+	p.client.mu.Lock()
+	defer p.client.mu.Unlock()
+	p.client.onChange = f
+}
+
+// OnError sets the function called when autojoining a room fails.
+func (p *Plugin) OnError(f func(error)) {
+	p.client.mu.Lock()
+	defer p.client.mu.Unlock()
+	p.client.onError = f
+}
+
+// start sets the plugin up for a session and, on a client, autojoins the
+// bookmarked rooms in the background when enabled.
+func (p *Plugin) start(ctx context.Context, params plugin.InitParams) {
+	c := &p.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.params = params
+	if c.cancel != nil {
+		c.cancel()
+		c.ctx, c.cancel = nil, nil
+	}
+	if params.SendIQ == nil {
+		return
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	if c.autojoin {
+		go p.run(c.ctx, p.autojoinAll)
+	}
+}
+
+func (p *Plugin) stop() {
+	c := &p.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.ctx, c.cancel = nil, nil
+	}
+}
+
+func (p *Plugin) run(ctx context.Context, f func(context.Context) error) {
+	err := f(ctx)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	p.client.mu.RLock()
+	report := p.client.onError
+	p.client.mu.RUnlock()
+	if report != nil {
+		report(err)
+	}
+}
+
+// Fetch returns the bookmarks of the account.
+func (p *Plugin) Fetch(ctx context.Context) ([]Bookmark, error) {
+	reply, err := p.sendIQ(ctx, stanza.IQGet, &pubsub.PubSub{Items: &pubsub.Items{Node: Node}})
+	var se *stanza.StanzaError
+	if errors.As(err, &se) && se.Condition == stanza.ErrorItemNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp pubsub.PubSub
+	if err := xml.Unmarshal(reply.Query, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Items == nil {
+		return nil, nil
+	}
+	bookmarks := make([]Bookmark, 0, len(resp.Items.Items))
+	for _, item := range resp.Items.Items {
+		if b, ok := parseItem(item); ok {
+			bookmarks = append(bookmarks, b)
+		}
+	}
+	return bookmarks, nil
+}
+
+// Publish adds or replaces the bookmark of room, with the node
+// configuration XEP-0402 requires so that it stays private and kept.
+func (p *Plugin) Publish(ctx context.Context, room jid.JID, c Conference) error {
+	payload, err := xml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	options := form.NewForm("submit", "")
+	options.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.PubSub + "#publish-options"}})
+	options.AddField(form.Field{Var: "pubsub#persist_items", Values: []string{"true"}})
+	options.AddField(form.Field{Var: "pubsub#max_items", Values: []string{"max"}})
+	options.AddField(form.Field{Var: "pubsub#send_last_published_item", Values: []string{"never"}})
+	options.AddField(form.Field{Var: "pubsub#access_model", Values: []string{"whitelist"}})
+	optionsXML, err := xml.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = p.sendIQ(ctx, stanza.IQSet, &pubsub.PubSub{
+		Publish: &pubsub.Publish{
+			Node:  Node,
+			Items: []pubsub.PubItem{{ID: room.Bare().String(), Payload: payload}},
+		},
+		PublishOptions: &pubsub.PublishOptions{Form: optionsXML},
+	})
+	return err
+}
+
+// Retract removes the bookmark of room.
+func (p *Plugin) Retract(ctx context.Context, room jid.JID) error {
+	_, err := p.sendIQ(ctx, stanza.IQSet, &pubsub.PubSub{
+		Retract: &pubsub.Retract{
+			Node:   Node,
+			Notify: true,
+			Items:  []pubsub.PubItem{{ID: room.Bare().String()}},
+		},
+	})
+	return err
+}
+
+// FetchLegacy returns the XEP-0048 bookmarks of the account, kept in
+// private XML storage.
+func (p *Plugin) FetchLegacy(ctx context.Context) ([]Bookmark, error) {
+	reply, err := p.sendIQ(ctx, stanza.IQGet, privateQuery{Storage: &LegacyStorage{}})
+	if err != nil {
+		return nil, err
+	}
+	var q privateQuery
+	if err := xml.Unmarshal(reply.Query, &q); err != nil {
+		return nil, err
+	}
+	if q.Storage == nil {
+		return nil, nil
+	}
+	bookmarks := make([]Bookmark, 0, len(q.Storage.Conferences))
+	for _, lc := range q.Storage.Conferences {
+		room, err := jid.Parse(lc.JID)
+		if err != nil {
+			continue
+		}
+		bookmarks = append(bookmarks, Bookmark{
+			JID:        room.Bare(),
+			Conference: Conference{Autojoin: lc.Autojoin, Name: lc.Name, Nick: lc.Nick, Password: lc.Password},
+		})
+	}
+	return bookmarks, nil
+}
+
+// ConvertLegacy publishes the XEP-0048 bookmarks of the account that have
+// no PEP native bookmark yet and returns how many it published. The legacy
+// storage is left as is for the clients that still read it.
+func (p *Plugin) ConvertLegacy(ctx context.Context) (int, error) {
+	legacy, err := p.FetchLegacy(ctx)
+	if err != nil || len(legacy) == 0 {
+		return 0, err
+	}
+	current, err := p.Fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	have := make(map[string]bool, len(current))
+	for _, b := range current {
+		have[b.JID.String()] = true
+	}
+	converted := 0
+	for _, b := range legacy {
+		if have[b.JID.String()] {
+			continue
+		}
+		if err := p.Publish(ctx, b.JID, b.Conference); err != nil {
+			return converted, err
+		}
+		have[b.JID.String()] = true
+		converted++
+	}
+	return converted, nil
+}
+
+// HandleEvent passes the bookmarks published or retracted in a PEP
+// notification of the account to the callback set with OnChange, and
+// joins or leaves the rooms when autojoin is enabled. It reports whether
+// msg carried such a notification.
+func (p *Plugin) HandleEvent(ctx context.Context, msg *stanza.Message) bool {
+	if own, err := p.ownJID(); err == nil && !msg.From.IsZero() && !msg.From.Equal(own) {
+		return false
+	}
+	var event pubsub.Event
+	found := false
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.PubSubEvent || ext.XMLName.Local != "event" {
+			continue
+		}
+		data, err := xml.Marshal(ext)
+		if err != nil || xml.Unmarshal(data, &event) != nil {
+			return false
+		}
+		found = true
+		break
+	}
+	if !found || event.Items == nil || event.Items.Node != Node {
+		return false
+	}
+
+	p.client.mu.RLock()
+	f, autojoin, bg := p.client.onChange, p.client.autojoin, p.client.ctx
+	p.client.mu.RUnlock()
+	for _, item := range event.Items.Items {
+		b, ok := parseItem(item)
+		if !ok {
+			continue
+		}
+		if f != nil {
+			f(ctx, b.JID, &b.Conference)
+		}
+		if autojoin && bg != nil {
+			go p.run(bg, func(ctx context.Context) error { return p.apply(ctx, b.JID, &b.Conference) })
+		}
+	}
+	for _, r := range event.Items.Retract {
+		room, err := jid.Parse(r.ID)
+		if err != nil {
+			continue
+		}
+		if f != nil {
+			f(ctx, room, nil)
+		}
+		if autojoin && bg != nil {
+			go p.run(bg, func(ctx context.Context) error { return p.apply(ctx, room, nil) })
+		}
+	}
+	return true
+}
+
+// autojoinAll joins the rooms bookmarked with autojoin that the muc plugin
+// does not join again by itself.
+func (p *Plugin) autojoinAll(ctx context.Context) error {
+	bookmarks, err := p.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range bookmarks {
+		if b.Conference.Autojoin {
+			go p.run(ctx, func(ctx context.Context) error { return p.apply(ctx, b.JID, &b.Conference) })
+		}
+	}
+	return nil
+}
+
+// apply joins room when c is to be autojoined, and leaves it when its
+// bookmark was retracted or no longer is.
+func (p *Plugin) apply(ctx context.Context, room jid.JID, c *Conference) error {
+	m, err := p.muc()
+	if err != nil {
+		return err
+	}
+	r := m.Room(room)
+	if c == nil || !c.Autojoin {
+		if !r.Rejoins() {
+			return nil
+		}
+		return r.Leave(ctx, "")
+	}
+	if r.Rejoins() {
+		return nil
+	}
+	nick := c.Nick
+	if nick == "" {
+		own, err := p.ownJID()
+		if err != nil {
+			return err
+		}
+		nick = own.Local()
+	}
+	return r.Join(ctx, nick, muc.JoinOptions{Password: c.Password})
+}
+
+// session returns the parameters the plugin was last initialized with.
+func (p *Plugin) session() plugin.InitParams {
+	p.client.mu.RLock()
+	defer p.client.mu.RUnlock()
+	return p.params
+}
+
+func (p *Plugin) muc() (*muc.Plugin, error) {
+	get := p.session().Get
+	if get == nil {
+		return nil, ErrNoMUC
+	}
+	mp, ok := get(muc.Name)
+	if !ok {
+		return nil, ErrNoMUC
+	}
+	m, ok := mp.(*muc.Plugin)
+	if !ok {
+		return nil, ErrNoMUC
+	}
+	return m, nil
+}
+
+func (p *Plugin) ownJID() (jid.JID, error) {
+	local := p.session().LocalJID
+	if local == nil {
+		return jid.JID{}, ErrNotConnected
+	}
+	own, err := jid.Parse(local())
+	if err != nil {
+		return jid.JID{}, err
+	}
+	return own.Bare(), nil
+}
+
+func (p *Plugin) sendIQ(ctx context.Context, typ string, v any) (*stanza.IQ, error) {
+	send := p.session().SendIQ
+	if send == nil {
+		return nil, ErrNotConnected
+	}
+	query, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(typ)
+	iq.Query = query
+	return send(ctx, iq)
+}
+
+// parseItem decodes a bookmark item, whose ID is the JID of the room.
+func parseItem(item pubsub.PubItem) (Bookmark, bool) {
+	room, err := jid.Parse(item.ID)
+	if err != nil {
+		return Bookmark{}, false
+	}
+	var c Conference
+	if err := xml.Unmarshal(item.Payload, &c); err != nil {
+		return Bookmark{}, false
+	}
+	return Bookmark{JID: room.Bare(), Conference: c}, true
+}
@@ -0,0 +1,151 @@
+package bookmarks
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/muc"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// fakeAccount answers the IQs of a client with the native bookmarks items
+// and the legacy storage legacy, recording what it publishes.
+type fakeAccount struct {
+	items     string
+	legacy    string
+	published chan pubsub.PubSub
+	sent      chan any
+}
+
+func newFakeAccount(items, legacy string) *fakeAccount {
+	return &fakeAccount{items: items, legacy: legacy, published: make(chan pubsub.PubSub, 8), sent: make(chan any, 8)}
+}
+
+func (a *fakeAccount) params() plugin.InitParams {
+	return plugin.InitParams{
+		LocalJID: func() string { return "juliet@capulet.lit/balcony" },
+		SendElement: func(_ context.Context, v any) error {
+			a.sent <- v
+			return nil
+		},
+		SendIQ: func(_ context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+			reply := iq.ResultIQ()
+			if strings.Contains(string(iq.Query), "jabber:iq:private") {
+				reply.Query = []byte(`<query xmlns='jabber:iq:private'>` + a.legacy + `</query>`)
+				return reply, nil
+			}
+			var ps pubsub.PubSub
+			if err := xml.Unmarshal(iq.Query, &ps); err != nil {
+				return nil, err
+			}
+			if ps.Items != nil {
+				reply.Query = []byte(`<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='urn:xmpp:bookmarks:1'>` + a.items + `</items></pubsub>`)
+				return reply, nil
+			}
+			a.published <- ps
+			return reply, nil
+		},
+	}
+}
+
+func TestConvertLegacy(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeAccount(
+		`<item id='theplay@conference.shakespeare.lit'><conference xmlns='urn:xmpp:bookmarks:1' name='The Play'/></item>`,
+		`<storage xmlns='storage:bookmarks'>`+
+			`<conference jid='theplay@conference.shakespeare.lit' name='The Play'/>`+
+			`<conference jid='orchard@conference.shakespeare.lit' name='The Orchard' autojoin='1'><nick>JC</nick></conference>`+
+			`</storage>`)
+	p := New()
+	if err := p.Initialize(ctx, a.params()); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := p.ConvertLegacy(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("ConvertLegacy = %d, %v", n, err)
+	}
+	ps := <-a.published
+	if ps.Publish == nil || ps.Publish.Node != Node || ps.Publish.Items[0].ID != "orchard@conference.shakespeare.lit" {
+		t.Fatalf("published %+v", ps.Publish)
+	}
+	var c Conference
+	if err := xml.Unmarshal(ps.Publish.Items[0].Payload, &c); err != nil || !c.Autojoin || c.Nick != "JC" || c.Name != "The Orchard" {
+		t.Fatalf("conference %+v, %v", c, err)
+	}
+	if ps.PublishOptions == nil || !strings.Contains(string(ps.PublishOptions.Form), "whitelist") {
+		t.Fatalf("publish options %+v", ps.PublishOptions)
+	}
+}
+
+func TestAutojoinAndChanges(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeAccount(`<item id='orchard@conference.shakespeare.lit'><conference xmlns='urn:xmpp:bookmarks:1' autojoin='true'/></item>`, "")
+	mgr := plugin.NewManager()
+	m, p := muc.New(), New()
+	for _, pl := range []plugin.Plugin{m, p} {
+		if err := mgr.Register(pl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.SetAutojoin(true)
+	changes := make(chan *Conference, 4)
+	p.OnChange(func(_ context.Context, room jid.JID, c *Conference) { changes <- c })
+	if err := mgr.Initialize(ctx, a.params()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = mgr.Close() })
+
+	pres := nextPresence(t, a.sent)
+	if pres.To.String() != "orchard@conference.shakespeare.lit/juliet" {
+		t.Fatalf("joined %s", pres.To)
+	}
+	var self stanza.Presence
+	if err := xml.Unmarshal([]byte(`<presence from='orchard@conference.shakespeare.lit/juliet'><x xmlns='http://jabber.org/protocol/muc#user'><status code='110'/></x></presence>`), &self); err != nil {
+		t.Fatal(err)
+	}
+	m.HandlePresence(ctx, &self)
+
+	event := func(from string) *stanza.Message {
+		var msg stanza.Message
+		input := `<message from='` + from + `'><event xmlns='http://jabber.org/protocol/pubsub#event'><items node='urn:xmpp:bookmarks:1'>` +
+			`<retract id='orchard@conference.shakespeare.lit'/></items></event></message>`
+		if err := xml.Unmarshal([]byte(input), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	if p.HandleEvent(ctx, event("mallory@evil.example")) {
+		t.Fatal("accepted bookmarks of another account")
+	}
+	if !p.HandleEvent(ctx, event("juliet@capulet.lit")) {
+		t.Fatal("HandleEvent ignored the account's retraction")
+	}
+	if c := <-changes; c != nil {
+		t.Fatalf("change %+v, want a retraction", c)
+	}
+	if pres := nextPresence(t, a.sent); pres.Type != stanza.PresenceUnavailable || pres.To.String() != "orchard@conference.shakespeare.lit/juliet" {
+		t.Fatalf("left with %+v", pres)
+	}
+}
+
+func nextPresence(t *testing.T, sent <-chan any) *stanza.Presence {
+	t.Helper()
+	select {
+	case v := <-sent:
+		pres, ok := v.(*stanza.Presence)
+		if !ok {
+			t.Fatalf("sent %+v, want presence", v)
+		}
+		return pres
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence sent")
+		return nil
+	}
+}
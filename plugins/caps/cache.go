@@ -0,0 +1,191 @@
+package caps
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// ErrMismatch is returned by Cache.Add for disco#info that does not hash
+// to the verification string it was given for.
+var ErrMismatch = errors.New("caps: disco#info does not match the verification string")
+
+// Key is a verification string qualified by how it was computed: the
+// namespace of the specification, ns.Caps for XEP-0115 or ns.Caps2 for
+// XEP-0390, and the hash function.
+type Key struct {
+	NS   string
+	Algo string
+	Ver  string
+}
+
+// Key returns the key of the verification string c advertises.
+func (c Caps) Key() Key {
+	return Key{NS: ns.Caps, Algo: c.Hash, Ver: c.Ver}
+}
+
+// Keys returns the keys of the hashes c advertises.
+func (c Caps2) Keys() []Key {
+	keys := make([]Key, len(c.Hashes))
+	for i, h := range c.Hashes {
+		keys[i] = Key{NS: ns.Caps2, Algo: h.Algo, Ver: h.Value}
+	}
+	return keys
+}
+
+// String returns k as namespace#algo.ver, which for XEP-0390 is the node
+// to query the entity's disco#info at.
+func (k Key) String() string {
+	return k.NS + "#" + k.Algo + "." + k.Ver
+}
+
+// Verify reports whether info hashes to k. A key with a hash function
+// that is not supported, such as a legacy XEP-0115 string without one,
+// never verifies.
+func (k Key) Verify(info disco.InfoQuery) bool {
+	switch k.NS {
+	case ns.Caps:
+		ver, err := Hash(k.Algo, info)
+		return err == nil && ver == k.Ver
+	case ns.Caps2:
+		h, err := Hash2(k.Algo, info)
+		return err == nil && h.Value == k.Ver
+	}
+	return false
+}
+
+// Cache keeps verified disco#info by verification string, in memory and,
+// given a store, persistently, so that an entity advertising capabilities
+// seen before, even by another process or before a restart, need not be
+// queried. It also tracks the capabilities each entity advertises, for
+// looking up its features. A Cache is safe for concurrent use.
+type Cache struct {
+	store storage.CapsStore
+
+	mu       sync.Mutex
+	infos    map[Key]disco.InfoQuery
+	entities map[string]Key // JID -> key advertised
+}
+
+// NewCache returns a Cache persisting to store, which may be nil to keep
+// entries in memory only.
+func NewCache(store storage.CapsStore) *Cache {
+	return &Cache{
+		store:    store,
+		infos:    make(map[Key]disco.InfoQuery),
+		entities: make(map[string]Key),
+	}
+}
+
+// Info returns the disco#info cached for k, reading it from the store if
+// it is not in memory.
+func (c *Cache) Info(ctx context.Context, k Key) (disco.InfoQuery, bool, error) {
+	c.mu.Lock()
+	info, ok := c.infos[k]
+	c.mu.Unlock()
+	if ok || c.store == nil {
+		return info, ok, nil
+	}
+
+	data, err := c.store.GetCapsInfo(ctx, k.String())
+	if errors.Is(err, storage.ErrNotFound) {
+		return disco.InfoQuery{}, false, nil
+	}
+	if err != nil {
+		return disco.InfoQuery{}, false, err
+	}
+	if err := xml.Unmarshal(data, &info); err != nil {
+		return disco.InfoQuery{}, false, err
+	}
+	c.mu.Lock()
+	c.infos[k] = info
+	c.mu.Unlock()
+	return info, true, nil
+}
+
+// Add caches info for k once it verifies against it, and returns
+// ErrMismatch otherwise.
+func (c *Cache) Add(ctx context.Context, k Key, info disco.InfoQuery) error {
+	if !k.Verify(info) {
+		return ErrMismatch
+	}
+	info.Node = ""
+	c.mu.Lock()
+	c.infos[k] = info
+	c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+	data, err := xml.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.store.SetCapsInfo(ctx, k.String(), data)
+}
+
+// Advertise records that entity advertises k, replacing what it advertised
+// before.
+func (c *Cache) Advertise(entity jid.JID, k Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entities[entity.String()] = k
+}
+
+// Forget drops what entity advertised, when it goes offline. What is
+// cached for its verification string stays, for other entities.
+func (c *Cache) Forget(entity jid.JID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entities, entity.String())
+}
+
+// Advertised returns the key entity advertises, if any.
+func (c *Cache) Advertised(entity jid.JID) (Key, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.entities[entity.String()]
+	return k, ok
+}
+
+// Entities returns the entities advertising k.
+func (c *Cache) Entities(k Key) []jid.JID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []jid.JID
+	for entity, advertised := range c.entities {
+		if advertised == k {
+			out = append(out, jid.MustParse(entity))
+		}
+	}
+	return out
+}
+
+// EntityInfo returns the disco#info behind the capabilities entity
+// advertises, if they are cached.
+func (c *Cache) EntityInfo(ctx context.Context, entity jid.JID) (disco.InfoQuery, bool, error) {
+	k, ok := c.Advertised(entity)
+	if !ok {
+		return disco.InfoQuery{}, false, nil
+	}
+	return c.Info(ctx, k)
+}
+
+// HasFeature reports whether entity advertises capabilities known to
+// include feature. Only memory is consulted, so it is cheap enough to call
+// for every recipient of a notification.
+func (c *Cache) HasFeature(entity jid.JID, feature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.entities[entity.String()]
+	if !ok {
+		return false
+	}
+	return slices.ContainsFunc(c.infos[k].Features, func(f disco.Feature) bool { return f.Var == feature })
+}
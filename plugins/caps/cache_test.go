@@ -0,0 +1,173 @@
+package caps
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/hash"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func features(vars ...string) []disco.Feature {
+	fs := make([]disco.Feature, len(vars))
+	for i, v := range vars {
+		fs[i] = disco.Feature{Var: v}
+	}
+	return fs
+}
+
+// The examples of XEP-0115 §5.2 and §5.3.
+var (
+	simpleInfo = disco.InfoQuery{
+		Identities: []disco.Identity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		Features:   features(ns.Caps, ns.DiscoInfo, ns.DiscoItems, ns.MUC),
+	}
+	complexInfo = disco.InfoQuery{
+		Identities: []disco.Identity{
+			{Category: "client", Type: "pc", Lang: "en", Name: "Psi 0.11"},
+			{Category: "client", Type: "pc", Lang: "el", Name: "Ψ 0.11"},
+		},
+		Features: features(ns.Caps, ns.DiscoInfo, ns.DiscoItems, ns.MUC),
+		Forms: []form.Form{{Type: form.TypeResult, Fields: []form.Field{
+			{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{"urn:xmpp:dataforms:softwareinfo"}},
+			{Var: "ip_version", Values: []string{"ipv6", "ipv4"}},
+			{Var: "os", Values: []string{"Mac"}},
+			{Var: "os_version", Values: []string{"10.5.1"}},
+			{Var: "software", Values: []string{"Psi"}},
+			{Var: "software_version", Values: []string{"0.11"}},
+		}}},
+	}
+)
+
+func TestHashExamples(t *testing.T) {
+	for _, tc := range []struct {
+		info disco.InfoQuery
+		want string
+	}{
+		{simpleInfo, "QgayPKawpkPSDYmwT/WM94uAlu0="},
+		{complexInfo, "q07IKJEyjvHSyhy//CH0CxmKi8w="},
+	} {
+		if got, err := Hash("sha-1", tc.info); err != nil || got != tc.want {
+			t.Errorf("Hash = %q, %v, want %q", got, err, tc.want)
+		}
+	}
+}
+
+func TestHash2(t *testing.T) {
+	h, err := Hash2(hash.AlgoSHA256, complexInfo)
+	if err != nil {
+		t.Fatalf("Hash2: %v", err)
+	}
+	// The hash does not depend on the order of anything in the info.
+	reordered := complexInfo
+	reordered.Identities = []disco.Identity{complexInfo.Identities[1], complexInfo.Identities[0]}
+	reordered.Features = features(ns.MUC, ns.DiscoItems, ns.DiscoInfo, ns.Caps)
+	if again, _ := Hash2(hash.AlgoSHA256, reordered); again != h {
+		t.Fatalf("reordered info hashes to %q, want %q", again.Value, h.Value)
+	}
+	if other, _ := Hash2(hash.AlgoSHA256, simpleInfo); other == h {
+		t.Fatal("different info hashes the same")
+	}
+
+	c, err := Generate2(complexInfo, hash.AlgoSHA256, hash.AlgoSHA512)
+	if err != nil || len(c.Hashes) != 2 || c.Hashes[0] != h {
+		t.Fatalf("Generate2 = %+v, %v", c, err)
+	}
+	data, err := xml.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pres := stanza.NewPresence(stanza.PresenceAvailable)
+	var ext stanza.Extension
+	if err := xml.Unmarshal(data, &ext); err != nil {
+		t.Fatal(err)
+	}
+	pres.Extensions = append(pres.Extensions, ext)
+	k, node, ok := Advertised(pres)
+	if !ok || k != c.Keys()[0] || node != "urn:xmpp:caps#sha-256."+h.Value {
+		t.Fatalf("Advertised = %+v, %q, %v", k, node, ok)
+	}
+	if !k.Verify(complexInfo) || k.Verify(simpleInfo) {
+		t.Fatal("Verify does not tell the infos apart")
+	}
+}
+
+func TestCachePersists(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	cache := NewCache(store.CapsStore())
+	ver, _ := Hash("sha-1", simpleInfo)
+	k := Key{NS: ns.Caps, Algo: "sha-1", Ver: ver}
+
+	if err := cache.Add(ctx, k, complexInfo); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Add of info not matching: %v", err)
+	}
+	if err := cache.Add(ctx, Key{NS: ns.Caps, Ver: ver}, simpleInfo); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Add without a hash function: %v", err)
+	}
+	if err := cache.Add(ctx, k, simpleInfo); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// Another process sharing the store knows the info without asking.
+	other := NewCache(store.CapsStore())
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	if other.HasFeature(juliet, ns.MUC) {
+		t.Fatal("HasFeature of an entity advertising nothing")
+	}
+	other.Advertise(juliet, k)
+	info, ok, err := other.EntityInfo(ctx, juliet)
+	if err != nil || !ok || len(info.Features) != 4 {
+		t.Fatalf("EntityInfo = %+v, %v, %v", info, ok, err)
+	}
+	if !other.HasFeature(juliet, ns.MUC) || other.HasFeature(juliet, ns.Caps2) {
+		t.Fatal("HasFeature does not match the cached features")
+	}
+	other.Forget(juliet)
+	if other.HasFeature(juliet, ns.MUC) {
+		t.Fatal("HasFeature after Forget")
+	}
+}
+
+func TestResolveQueriesOnce(t *testing.T) {
+	mgr := plugin.NewManager()
+	d, c := disco.New(), New("http://example.com/server")
+	for _, p := range []plugin.Plugin{d, c} {
+		if err := mgr.Register(p); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+	if err := mgr.Initialize(context.Background(), plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	ver, _ := Hash("sha-1", simpleInfo)
+	var nodes []string
+	d.SetFetcher(func(_ context.Context, _ jid.JID, node string) (disco.InfoQuery, error) {
+		nodes = append(nodes, node)
+		info := simpleInfo
+		info.Node = node
+		return info, nil
+	})
+
+	for _, from := range []string{"juliet@example.com/balcony", "romeo@example.net/orchard"} {
+		c.HandlePresence(capsPresence(from, ver))
+		info, err := c.Resolve(context.Background(), jid.MustParse(from))
+		if err != nil || len(info.Features) != 4 {
+			t.Fatalf("Resolve(%s) = %+v, %v", from, info, err)
+		}
+		if !c.Cache().HasFeature(jid.MustParse(from), ns.MUC) {
+			t.Fatalf("HasFeature(%s) after Resolve", from)
+		}
+	}
+	if len(nodes) != 1 || nodes[0] != "http://example.com/client#"+ver {
+		t.Fatalf("queried nodes %q, want one query for both entities", nodes)
+	}
+}
@@ -1,4 +1,5 @@
-// Package caps implements XEP-0115 Entity Capabilities.
+// Package caps implements XEP-0115 Entity Capabilities and XEP-0390 Entity
+// Capabilities 2.0.
 package caps
 
 import (
@@ -6,16 +7,28 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/plugin"
 	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/hash"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
 )
 
 const Name = "caps"
 
+// ErrNoDisco is returned by Resolve when the disco plugin is not
+// registered.
+var ErrNoDisco = errors.New("caps: disco plugin not available")
+
 // Caps represents an entity capabilities element.
 type Caps struct {
 	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
@@ -24,10 +37,21 @@ type Caps struct {
 	Ver     string   `xml:"ver,attr"`
 }
 
-// Plugin implements XEP-0115.
+// Plugin implements XEP-0115 and XEP-0390.
 type Plugin struct {
 	node   string
 	params plugin.InitParams
+	cache  *Cache
+
+	mu   sync.Mutex
+	seen map[string]advert // full JID -> last advertised capabilities
+}
+
+// advert is what an entity advertised: the key of its capabilities and
+// the node to query their disco#info at.
+type advert struct {
+	key  Key
+	node string
 }
 
 // New creates a new caps plugin with the given node URI.
@@ -38,16 +62,38 @@ func New(node string) *Plugin {
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
 
+// Initialize keeps verified disco#info in the CapsStore of params.Storage,
+// when there is one, and otherwise in memory.
 func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 	p.params = params
+	var store storage.CapsStore
+	if params.Storage != nil {
+		store = params.Storage.CapsStore()
+	}
+	p.cache = NewCache(store)
 	return nil
 }
 
+// Cache returns the cache of the capabilities of the entities whose
+// presence the plugin handled, for other plugins to look features up in.
+func (p *Plugin) Cache() *Cache {
+	return p.cache
+}
+
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return []string{disco.Name} }
 
-// Ver computes the verification string from disco info.
+// Ver computes the SHA-1 verification string from disco info.
 func (p *Plugin) Ver(info disco.InfoQuery) string {
+	ver, _ := Hash("sha-1", info)
+	return ver
+}
+
+// Hash computes the XEP-0115 verification string of info with the hash
+// function algo, "sha-1" or one of those package hash supports. Extended
+// information forms are included, in the order of their FORM_TYPE; forms
+// without one are left out.
+func Hash(algo string, info disco.InfoQuery) (string, error) {
 	var s strings.Builder
 
 	// Sort identities
@@ -74,8 +120,57 @@ func (p *Plugin) Ver(info disco.InfoQuery) string {
 		s.WriteString(f + "<")
 	}
 
-	h := sha1.Sum([]byte(s.String()))
-	return base64.StdEncoding.EncodeToString(h[:])
+	forms := make(map[string][]form.Field)
+	var types []string
+	for _, f := range info.Forms {
+		if formType := formType(f); formType != "" {
+			forms[formType] = f.Fields
+			types = append(types, formType)
+		}
+	}
+	sort.Strings(types)
+	for _, formType := range types {
+		s.WriteString(formType + "<")
+		fields := slices.Clone(forms[formType])
+		sort.Slice(fields, func(i, j int) bool { return fields[i].Var < fields[j].Var })
+		for _, field := range fields {
+			if field.Var == formTypeVar {
+				continue
+			}
+			s.WriteString(field.Var + "<")
+			values := slices.Clone(field.Values)
+			sort.Strings(values)
+			for _, v := range values {
+				s.WriteString(v + "<")
+			}
+		}
+	}
+	return digest(algo, []byte(s.String()))
+}
+
+// formTypeVar is the field naming the kind of an extended information form.
+const formTypeVar = "FORM_TYPE"
+
+func formType(f form.Form) string {
+	for _, field := range f.Fields {
+		if field.Var == formTypeVar && len(field.Values) > 0 {
+			return field.Values[0]
+		}
+	}
+	return ""
+}
+
+// digest hashes data with algo and returns the hash in base64.
+func digest(algo string, data []byte) (string, error) {
+	if algo == "sha-1" {
+		h := sha1.Sum(data)
+		return base64.StdEncoding.EncodeToString(h[:]), nil
+	}
+	h, err := hash.Compute(algo, data)
+	if err != nil {
+		return "", err
+	}
+	return h.Value, nil
 }
 
 // Generate creates a Caps element from the current disco info.
@@ -87,6 +182,131 @@ func (p *Plugin) Generate(info disco.InfoQuery) Caps {
 	}
 }
 
+// FromPresence extracts the capabilities advertised in pres, if any.
+func FromPresence(pres *stanza.Presence) (Caps, bool) {
+	for _, ext := range pres.Extensions {
+		if ext.XMLName.Space != ns.Caps || ext.XMLName.Local != "c" {
+			continue
+		}
+		c := Caps{XMLName: ext.XMLName}
+		for _, attr := range ext.Attrs {
+			switch attr.Name.Local {
+			case "hash":
+				c.Hash = attr.Value
+			case "node":
+				c.Node = attr.Value
+			case "ver":
+				c.Ver = attr.Value
+			}
+		}
+		return c, true
+	}
+	return Caps{}, false
+}
+
+// Advertised returns the key of the capabilities advertised in pres and
+// the node to query their disco#info at. A XEP-0390 hash with a supported
+// hash function is preferred over a XEP-0115 verification string.
+func Advertised(pres *stanza.Presence) (Key, string, bool) {
+	if c, ok := Caps2FromPresence(pres); ok {
+		for _, k := range c.Keys() {
+			if _, err := hash.Compute(k.Algo, nil); err == nil {
+				return k, k.String(), true
+			}
+		}
+	}
+	if c, ok := FromPresence(pres); ok && c.Ver != "" {
+		return c.Key(), c.Node + "#" + c.Ver, true
+	}
+	return Key{}, "", false
+}
+
+// HandlePresence tracks the capabilities advertised by the sender of pres.
+// When they change, or the sender goes offline, its cached remote
+// disco#info is dropped from the disco plugin so the next lookup queries
+// the entity again.
+func (p *Plugin) HandlePresence(pres *stanza.Presence) {
+	from := pres.From.String()
+	var a advert
+	switch pres.Type {
+	case stanza.PresenceAvailable:
+		k, node, ok := Advertised(pres)
+		if !ok {
+			return
+		}
+		a = advert{k, node}
+	case stanza.PresenceUnavailable:
+	default:
+		return
+	}
+
+	p.mu.Lock()
+	old, known := p.seen[from]
+	if a.node == "" {
+		delete(p.seen, from)
+	} else {
+		if p.seen == nil {
+			p.seen = make(map[string]advert)
+		}
+		p.seen[from] = a
+	}
+	p.mu.Unlock()
+	if p.cache != nil {
+		if a.node == "" {
+			p.cache.Forget(pres.From)
+		} else {
+			p.cache.Advertise(pres.From, a.key)
+		}
+	}
+
+	if known && old == a {
+		return
+	}
+	if d, ok := p.disco(); ok {
+		d.InvalidateRemote(pres.From)
+	}
+}
+
+// Resolve returns the disco#info of entity. When the capabilities it
+// advertised are cached, the entity is not queried; otherwise the answer
+// is cached once it verifies, for every entity advertising the same.
+func (p *Plugin) Resolve(ctx context.Context, entity jid.JID) (disco.InfoQuery, error) {
+	d, ok := p.disco()
+	if !ok {
+		return disco.InfoQuery{}, ErrNoDisco
+	}
+	p.mu.Lock()
+	a, advertised := p.seen[entity.String()]
+	p.mu.Unlock()
+	if !advertised || p.cache == nil {
+		return d.RemoteInfo(ctx, entity, "")
+	}
+
+	if info, ok, err := p.cache.Info(ctx, a.key); err != nil || ok {
+		return info, err
+	}
+	info, err := d.RemoteInfo(ctx, entity, a.node)
+	if err != nil {
+		return disco.InfoQuery{}, err
+	}
+	if err := p.cache.Add(ctx, a.key, info); err != nil && !errors.Is(err, ErrMismatch) {
+		return info, err
+	}
+	return info, nil
+}
+
+func (p *Plugin) disco() (*disco.Plugin, bool) {
+	if p.params.Get == nil {
+		return nil, false
+	}
+	dp, ok := p.params.Get(disco.Name)
+	if !ok {
+		return nil, false
+	}
+	d, ok := dp.(*disco.Plugin)
+	return d, ok
+}
+
 func init() {
 	_ = ns.Caps // ensure ns import is used
 }
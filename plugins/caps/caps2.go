@@ -0,0 +1,110 @@
+package caps
+
+import (
+	"bytes"
+	"encoding/xml"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/hash"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Caps2 represents an XEP-0390 Entity Capabilities 2.0 element, carrying
+// one hash of the entity's disco#info per hash function.
+type Caps2 struct {
+	XMLName xml.Name    `xml:"urn:xmpp:caps c"`
+	Hashes  []hash.Hash `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// Separators of the XEP-0390 hashing input.
+const (
+	unitSep   = "\x1f" // after each value
+	recordSep = "\x1e" // after each identity and field
+	groupSep  = "\x1d" // after each form
+	fileSep   = "\x1c" // after the features, identities and forms
+)
+
+// Hash2 computes the XEP-0390 hash of info with the hash function algo.
+func Hash2(algo string, info disco.InfoQuery) (hash.Hash, error) {
+	return hash.Compute(algo, hashInput2(info))
+}
+
+// Generate2 creates a Caps2 element from info with a hash for each of
+// algos.
+func Generate2(info disco.InfoQuery, algos ...string) (Caps2, error) {
+	var c Caps2
+	for _, algo := range algos {
+		h, err := Hash2(algo, info)
+		if err != nil {
+			return Caps2{}, err
+		}
+		c.Hashes = append(c.Hashes, h)
+	}
+	return c, nil
+}
+
+func hashInput2(info disco.InfoQuery) []byte {
+	var b bytes.Buffer
+
+	features := make([]string, len(info.Features))
+	for i, f := range info.Features {
+		features[i] = f.Var + unitSep
+	}
+	writeSorted(&b, features, fileSep)
+
+	identities := make([]string, len(info.Identities))
+	for i, id := range info.Identities {
+		identities[i] = id.Category + unitSep + id.Type + unitSep + id.Lang + unitSep + id.Name + unitSep + recordSep
+	}
+	writeSorted(&b, identities, fileSep)
+
+	forms := make([]string, len(info.Forms))
+	for i, f := range info.Forms {
+		fields := make([]string, len(f.Fields))
+		for j, field := range f.Fields {
+			var s strings.Builder
+			s.WriteString(field.Var + unitSep)
+			values := slices.Clone(field.Values)
+			slices.Sort(values)
+			for _, v := range values {
+				s.WriteString(v + unitSep)
+			}
+			s.WriteString(recordSep)
+			fields[j] = s.String()
+		}
+		var s bytes.Buffer
+		writeSorted(&s, fields, groupSep)
+		forms[i] = s.String()
+	}
+	writeSorted(&b, forms, fileSep)
+	return b.Bytes()
+}
+
+// writeSorted writes items in octet order, followed by sep.
+func writeSorted(b *bytes.Buffer, items []string, sep string) {
+	slices.Sort(items)
+	for _, item := range items {
+		b.WriteString(item)
+	}
+	b.WriteString(sep)
+}
+
+// Caps2FromPresence extracts the XEP-0390 capabilities advertised in pres,
+// if any.
+func Caps2FromPresence(pres *stanza.Presence) (Caps2, bool) {
+	for _, ext := range pres.Extensions {
+		if ext.XMLName.Space != ns.Caps2 || ext.XMLName.Local != "c" {
+			continue
+		}
+		var c Caps2
+		data, err := xml.Marshal(ext)
+		if err != nil || xml.Unmarshal(data, &c) != nil {
+			return Caps2{}, false
+		}
+		return c, true
+	}
+	return Caps2{}, false
+}
@@ -0,0 +1,84 @@
+package caps
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func capsPresence(from, ver string) *stanza.Presence {
+	pres := stanza.NewPresence(stanza.PresenceAvailable)
+	pres.From = jid.MustParse(from)
+	pres.Extensions = []stanza.Extension{{
+		XMLName: xml.Name{Space: ns.Caps, Local: "c"},
+		Attrs: []xml.Attr{
+			{Name: xml.Name{Local: "hash"}, Value: "sha-1"},
+			{Name: xml.Name{Local: "node"}, Value: "http://example.com/client"},
+			{Name: xml.Name{Local: "ver"}, Value: ver},
+		},
+	}}
+	return pres
+}
+
+func TestHandlePresenceInvalidatesDisco(t *testing.T) {
+	mgr := plugin.NewManager()
+	d, c := disco.New(), New("http://example.com/server")
+	for _, p := range []plugin.Plugin{d, c} {
+		if err := mgr.Register(p); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+	if err := mgr.Initialize(context.Background(), plugin.InitParams{}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	calls := 0
+	d.SetFetcher(func(context.Context, jid.JID, string) (disco.InfoQuery, error) {
+		calls++
+		return disco.InfoQuery{}, nil
+	})
+	from := "juliet@example.com/balcony"
+	lookup := func() {
+		if _, err := d.RemoteInfo(context.Background(), jid.MustParse(from), ""); err != nil {
+			t.Fatalf("RemoteInfo: %v", err)
+		}
+	}
+
+	c.HandlePresence(capsPresence(from, "ver1"))
+	lookup()
+	c.HandlePresence(capsPresence(from, "ver1"))
+	lookup()
+	if calls != 1 {
+		t.Fatalf("fetches = %d with unchanged caps, want 1", calls)
+	}
+
+	c.HandlePresence(capsPresence(from, "ver2"))
+	lookup()
+	if calls != 2 {
+		t.Fatalf("fetches = %d after caps change, want 2", calls)
+	}
+
+	unavailable := stanza.NewPresence(stanza.PresenceUnavailable)
+	unavailable.From = jid.MustParse(from)
+	c.HandlePresence(unavailable)
+	lookup()
+	if calls != 3 {
+		t.Fatalf("fetches = %d after going offline, want 3", calls)
+	}
+}
+
+func TestFromPresence(t *testing.T) {
+	got, ok := FromPresence(capsPresence("juliet@example.com/balcony", "abc="))
+	if !ok || got.Hash != "sha-1" || got.Node != "http://example.com/client" || got.Ver != "abc=" {
+		t.Fatalf("FromPresence = %+v, %v", got, ok)
+	}
+	if _, ok := FromPresence(stanza.NewPresence("")); ok {
+		t.Fatal("FromPresence found caps in a bare presence")
+	}
+}
@@ -3,14 +3,30 @@ package commands
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
 )
 
 const Name = "commands"
 
+// DefaultSessionTimeout is how long a command session waits for its next
+// stage before it is forgotten.
+const DefaultSessionTimeout = 10 * time.Minute
+
 const (
 	StatusExecuting = "executing"
 	StatusCompleted = "completed"
@@ -25,15 +41,22 @@ const (
 	ActionComplete = "complete"
 )
 
+// Note types.
+const (
+	NoteInfo  = "info"
+	NoteWarn  = "warn"
+	NoteError = "error"
+)
+
 type Command struct {
-	XMLName   xml.Name `xml:"http://jabber.org/protocol/commands command"`
-	Node      string   `xml:"node,attr"`
-	SessionID string   `xml:"sessionid,attr,omitempty"`
-	Action    string   `xml:"action,attr,omitempty"`
-	Status    string   `xml:"status,attr,omitempty"`
-	Actions   *Actions `xml:"actions,omitempty"`
-	Note      *Note    `xml:"note,omitempty"`
-	Form      []byte   `xml:",innerxml"`
+	XMLName   xml.Name   `xml:"http://jabber.org/protocol/commands command"`
+	Node      string     `xml:"node,attr"`
+	SessionID string     `xml:"sessionid,attr,omitempty"`
+	Action    string     `xml:"action,attr,omitempty"`
+	Status    string     `xml:"status,attr,omitempty"`
+	Actions   *Actions   `xml:"actions,omitempty"`
+	Note      *Note      `xml:"note,omitempty"`
+	Form      *form.Form `xml:"jabber:x:data x,omitempty"`
 }
 
 type Actions struct {
@@ -52,11 +75,86 @@ type Note struct {
 
 type Empty struct{}
 
+// Request is one stage of a command execution.
+type Request struct {
+	// From is the entity executing the command.
+	From jid.JID
+	Node string
+	// Action is the action requested, ActionExecute when none was named.
+	Action string
+	// Form is the form submitted with the request, if any.
+	Form *form.Form
+	// Stage is the number of stages already completed in the session,
+	// zero for the request that starts it.
+	Stage int
+}
+
+// Handler executes a stage of a command. It returns the command element of
+// the reply; the node and session ID are filled in for it, and the status
+// defaults to StatusCompleted. A *stanza.StanzaError returned as the error
+// is sent to the requester; other errors are reported as
+// internal-server-error.
+type Handler func(ctx context.Context, req Request) (*Command, error)
+
+// Completed returns a reply that completes a command with an info note.
+func Completed(note string) *Command {
+	cmd := &Command{Status: StatusCompleted}
+	if note != "" {
+		cmd.Note = &Note{Type: NoteInfo, Value: note}
+	}
+	return cmd
+}
+
+// FormHandler returns a Handler for the common two-stage command: the first
+// stage replies with the form built by newForm, and submit handles the
+// completed form of the second.
+func FormHandler(newForm func() *form.Form, submit Handler) Handler {
+	return func(ctx context.Context, req Request) (*Command, error) {
+		if req.Form == nil || req.Form.Type != form.TypeSubmit {
+			if req.Stage > 0 {
+				return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "form submission expected")
+			}
+			return &Command{
+				Status:  StatusExecuting,
+				Actions: &Actions{Execute: ActionComplete, Complete: &Empty{}},
+				Form:    newForm(),
+			}, nil
+		}
+		return submit(ctx, req)
+	}
+}
+
+type command struct {
+	node    string
+	name    string
+	allow   func(jid.JID) bool
+	handler Handler
+}
+
+type session struct {
+	from    string
+	node    string
+	stage   int
+	expires time.Time
+}
+
+// Plugin offers registered commands to the entities allowed to execute
+// them and runs their sessions.
 type Plugin struct {
-	params plugin.InitParams
+	mu       sync.Mutex
+	commands map[string]*command
+	sessions map[string]*session
+	timeout  time.Duration
+	params   plugin.InitParams
 }
 
-func New() *Plugin { return &Plugin{} }
+func New() *Plugin {
+	return &Plugin{
+		commands: make(map[string]*command),
+		sessions: make(map[string]*session),
+		timeout:  DefaultSessionTimeout,
+	}
+}
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
@@ -67,4 +165,174 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-func init() { _ = ns.Commands }
+// Register offers the command node under the human-readable name to the
+// entities for which allow reports true, or to everyone if allow is nil.
+// It replaces any command registered for node before.
+func (p *Plugin) Register(node, name string, allow func(from jid.JID) bool, h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commands[node] = &command{node: node, name: name, allow: allow, handler: h}
+}
+
+// SetSessionTimeout sets how long a session waits for its next stage.
+// Values below one restore DefaultSessionTimeout.
+func (p *Plugin) SetSessionTimeout(d time.Duration) {
+	if d < 1 {
+		d = DefaultSessionTimeout
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+}
+
+// Items returns the commands from may execute as disco items of the entity
+// owner, for a disco#items request to the commands node (XEP-0050 §2.2).
+func (p *Plugin) Items(owner, from jid.JID) disco.ItemsQuery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	items := disco.ItemsQuery{Node: ns.Commands, Items: []disco.Item{}}
+	for _, node := range slices.Sorted(maps.Keys(p.commands)) {
+		if c := p.commands[node]; c.allowed(from) {
+			items.Items = append(items.Items, disco.Item{JID: owner.String(), Node: c.node, Name: c.name})
+		}
+	}
+	return items
+}
+
+// Info returns the disco#info of a command node from may execute, or false
+// if there is none (XEP-0050 §2.3).
+func (p *Plugin) Info(node string, from jid.JID) (disco.InfoQuery, bool) {
+	p.mu.Lock()
+	c := p.commands[node]
+	p.mu.Unlock()
+	if !c.allowed(from) {
+		return disco.InfoQuery{}, false
+	}
+	return disco.InfoQuery{
+		Node:       node,
+		Identities: []disco.Identity{{Category: "automation", Type: "command-node", Name: c.name}},
+		Features:   []disco.Feature{{Var: ns.Commands}, {Var: ns.DataForms}},
+	}, true
+}
+
+// HandleIQ executes the command requested by iq and returns the reply, or
+// nil when iq is not a command request.
+func (p *Plugin) HandleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var req Command
+	if err := xml.Unmarshal(iq.Query, &req); err != nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	c := p.commands[req.Node]
+	p.mu.Unlock()
+	if c == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "unknown command"))
+	}
+	if !c.allowed(iq.From) {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorForbidden, "not allowed to execute this command"))
+	}
+
+	stage := 0
+	if req.SessionID != "" {
+		s, ok := p.session(req.SessionID, req.Node, iq.From)
+		if !ok {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "bad-sessionid"))
+		}
+		stage = s.stage
+	}
+	if req.Action == ActionCancel {
+		p.end(req.SessionID)
+		return reply(iq, &Command{Node: req.Node, SessionID: req.SessionID, Status: StatusCanceled})
+	}
+
+	action := req.Action
+	if action == "" {
+		action = ActionExecute
+	}
+	res, err := c.handler(ctx, Request{From: iq.From, Node: req.Node, Action: action, Form: req.Form, Stage: stage})
+	if err != nil {
+		p.end(req.SessionID)
+		var se *stanza.StanzaError
+		if !errors.As(err, &se) {
+			se = stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, "")
+		}
+		return iq.ErrorIQ(se)
+	}
+
+	res.Node, res.SessionID, res.Action = req.Node, req.SessionID, ""
+	if res.Status == "" {
+		res.Status = StatusCompleted
+	}
+	if res.Status == StatusExecuting {
+		res.SessionID = p.advance(req.SessionID, req.Node, iq.From, stage+1)
+	} else {
+		p.end(req.SessionID)
+	}
+	return reply(iq, res)
+}
+
+func (c *command) allowed(from jid.JID) bool {
+	return c != nil && (c.allow == nil || c.allow(from))
+}
+
+// session returns the live session id of from executing node.
+func (p *Plugin) session(id, node string, from jid.JID) (*session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.sessions[id]
+	if s == nil || s.node != node || s.from != from.String() {
+		return nil, false
+	}
+	if !clock.Or(p.params.Clock).Now().Before(s.expires) {
+		delete(p.sessions, id)
+		return nil, false
+	}
+	return s, true
+}
+
+// advance records that the session id reached stage, starting a new one
+// when id is empty, and returns its ID.
+func (p *Plugin) advance(id, node string, from jid.JID, stage int) string {
+	now := clock.Or(p.params.Clock).Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id == "" {
+		for sid, s := range p.sessions {
+			if !now.Before(s.expires) {
+				delete(p.sessions, sid)
+			}
+		}
+		id = newSessionID()
+	}
+	p.sessions[id] = &session{from: from.String(), node: node, stage: stage, expires: now.Add(p.timeout)}
+	return id
+}
+
+func (p *Plugin) end(id string) {
+	if id == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, id)
+}
+
+func newSessionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func reply(iq *stanza.IQ, cmd *Command) *stanza.IQ {
+	payload, err := xml.Marshal(cmd)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	res := iq.ResultIQ()
+	res.Query = payload
+	return res
+}
@@ -0,0 +1,173 @@
+package commands
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const greetNode = "greet"
+
+var (
+	admin = jid.MustParse("admin@example.com/desk")
+	guest = jid.MustParse("guest@example.com/phone")
+)
+
+func newGreeter(t *testing.T) (*Plugin, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{Clock: clk}); err != nil {
+		t.Fatal(err)
+	}
+	nameForm := func() *form.Form {
+		f := form.NewForm(form.TypeForm, "Greeting")
+		f.AddField(form.Field{Var: "name", Type: form.FieldTextSingle, Required: true})
+		return f
+	}
+	p.Register(greetNode, "Greet someone", func(from jid.JID) bool { return from.Local() == "admin" },
+		FormHandler(nameForm, func(_ context.Context, req Request) (*Command, error) {
+			name := req.Form.GetValue("name")
+			if name == "" {
+				return nil, stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "name required")
+			}
+			return Completed("Hello, " + name), nil
+		}))
+	return p, clk
+}
+
+func execute(t *testing.T, p *Plugin, from jid.JID, cmd Command) (*stanza.IQ, *Command) {
+	t.Helper()
+	payload, err := xml.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.From = from
+	iq.Query = payload
+	res := p.HandleIQ(context.Background(), iq)
+	if res == nil {
+		t.Fatal("HandleIQ returned nil")
+	}
+	if res.Type != stanza.IQResult {
+		return res, nil
+	}
+	var out Command
+	if err := xml.Unmarshal(res.Query, &out); err != nil {
+		t.Fatalf("reply %s: %v", res.Query, err)
+	}
+	return res, &out
+}
+
+func submitted(name string) *form.Form {
+	f := form.NewForm(form.TypeSubmit, "")
+	f.AddField(form.Field{Var: "name", Values: []string{name}})
+	return f
+}
+
+func TestExecuteFormCommand(t *testing.T) {
+	p, _ := newGreeter(t)
+
+	_, first := execute(t, p, admin, Command{Node: greetNode, Action: ActionExecute})
+	if first == nil || first.Status != StatusExecuting || first.SessionID == "" || first.Form == nil || first.Form.GetField("name") == nil {
+		t.Fatalf("first stage = %+v", first)
+	}
+	if first.Actions == nil || first.Actions.Execute != ActionComplete {
+		t.Fatalf("actions = %+v", first.Actions)
+	}
+
+	_, done := execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Action: ActionComplete, Form: submitted("Alice")})
+	if done == nil || done.Status != StatusCompleted || done.SessionID != first.SessionID || done.Note == nil || done.Note.Value != "Hello, Alice" {
+		t.Fatalf("second stage = %+v", done)
+	}
+
+	// The session ended with the command.
+	res, _ := execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Form: submitted("Bob")})
+	if res.Error == nil || res.Error.Condition != stanza.ErrorBadRequest {
+		t.Fatalf("reused session: %+v", res.Error)
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	p, clk := newGreeter(t)
+
+	res, _ := execute(t, p, guest, Command{Node: greetNode})
+	if res.Error == nil || res.Error.Condition != stanza.ErrorForbidden {
+		t.Fatalf("guest: %+v", res.Error)
+	}
+	res, _ = execute(t, p, admin, Command{Node: "missing"})
+	if res.Error == nil || res.Error.Condition != stanza.ErrorItemNotFound {
+		t.Fatalf("unknown node: %+v", res.Error)
+	}
+
+	_, first := execute(t, p, admin, Command{Node: greetNode})
+	// Only the entity that started a session may continue it.
+	other := jid.MustParse("admin@example.com/laptop")
+	res, _ = execute(t, p, other, Command{Node: greetNode, SessionID: first.SessionID, Form: submitted("Alice")})
+	if res.Error == nil || res.Error.Condition != stanza.ErrorBadRequest {
+		t.Fatalf("other resource: %+v", res.Error)
+	}
+	res, _ = execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Form: submitted("")})
+	if res.Error == nil || res.Error.Text != "name required" {
+		t.Fatalf("handler error: %+v", res.Error)
+	}
+
+	_, first = execute(t, p, admin, Command{Node: greetNode})
+	clk.Advance(DefaultSessionTimeout)
+	res, _ = execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Form: submitted("Alice")})
+	if res.Error == nil || res.Error.Condition != stanza.ErrorBadRequest {
+		t.Fatalf("expired session: %+v", res.Error)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	p, _ := newGreeter(t)
+	_, first := execute(t, p, admin, Command{Node: greetNode})
+	_, canceled := execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Action: ActionCancel})
+	if canceled == nil || canceled.Status != StatusCanceled {
+		t.Fatalf("cancel = %+v", canceled)
+	}
+	res, _ := execute(t, p, admin, Command{Node: greetNode, SessionID: first.SessionID, Form: submitted("Alice")})
+	if res.Error == nil {
+		t.Fatal("canceled session continued")
+	}
+}
+
+func TestDisco(t *testing.T) {
+	p, _ := newGreeter(t)
+	p.Register("ping", "Ping", nil, func(context.Context, Request) (*Command, error) { return Completed("pong"), nil })
+	server := jid.MustParse("example.com")
+
+	items := p.Items(server, admin)
+	if items.Node != ns.Commands || len(items.Items) != 2 || items.Items[0].Node != greetNode || items.Items[1].Node != "ping" || items.Items[0].JID != "example.com" {
+		t.Fatalf("admin items = %+v", items)
+	}
+	if items := p.Items(server, guest); len(items.Items) != 1 || items.Items[0].Node != "ping" {
+		t.Fatalf("guest items = %+v", items)
+	}
+
+	info, ok := p.Info(greetNode, admin)
+	if !ok || len(info.Identities) != 1 || info.Identities[0].Type != "command-node" || info.Node != greetNode {
+		t.Fatalf("info = %+v, %v", info, ok)
+	}
+	if _, ok := p.Info(greetNode, guest); ok {
+		t.Fatal("guest sees the info of an admin command")
+	}
+}
+
+func TestHandleIQIgnoresOtherPayloads(t *testing.T) {
+	p, _ := newGreeter(t)
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = []byte(`<query xmlns='jabber:iq:version'/>`)
+	if res := p.HandleIQ(context.Background(), iq); res != nil {
+		t.Fatalf("HandleIQ = %+v", res)
+	}
+}
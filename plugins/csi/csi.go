@@ -11,6 +11,9 @@ import (
 
 const Name = "csi"
 
+// Feature is the stream feature advertised by servers that support CSI.
+var Feature = xml.Name{Space: ns.CSI, Local: "csi"}
+
 type Active struct {
 	XMLName xml.Name `xml:"urn:xmpp:csi:0 active"`
 }
@@ -0,0 +1,214 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DefaultMaxQueued is the number of stanzas a Queue holds for an inactive
+// client before it flushes them anyway.
+const DefaultMaxQueued = 100
+
+// Action is what a Queue does with a stanza for an inactive client.
+type Action int
+
+const (
+	// Deliver sends the stanza at once, after the stanzas held before it.
+	Deliver Action = iota
+	// Buffer holds the stanza until the client becomes active or something
+	// urgent is sent. Of the presence of a contact, only the latest is held.
+	Buffer
+	// Drop discards the stanza.
+	Drop
+)
+
+// String returns the configuration name of the action.
+func (a Action) String() string {
+	switch a {
+	case Buffer:
+		return "buffer"
+	case Drop:
+		return "drop"
+	default:
+		return "deliver"
+	}
+}
+
+// ParseAction parses "deliver", "buffer" or "drop".
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "deliver":
+		return Deliver, nil
+	case "buffer":
+		return Buffer, nil
+	case "drop":
+		return Drop, nil
+	default:
+		return Deliver, fmt.Errorf("csi: unknown action %q", s)
+	}
+}
+
+// Rules decide what happens to the stanzas routed to an inactive client.
+// Everything they do not cover, such as messages with a body, IQs and
+// subscription requests, is delivered.
+type Rules struct {
+	// Presence applies to available and unavailable presence.
+	Presence Action
+	// ChatStates applies to messages that carry nothing but a chat state
+	// notification (XEP-0085).
+	ChatStates Action
+}
+
+// DefaultRules buffer presence and drop chat state notifications.
+func DefaultRules() Rules {
+	return Rules{Presence: Buffer, ChatStates: Drop}
+}
+
+// Classify returns the action for st.
+func (r Rules) Classify(st stanza.Stanza) Action {
+	switch v := st.(type) {
+	case *stanza.Presence:
+		if v.Type == stanza.PresenceAvailable || v.Type == stanza.PresenceUnavailable {
+			return r.Presence
+		}
+	case *stanza.Message:
+		if chatStateOnly(v) {
+			return r.ChatStates
+		}
+	}
+	return Deliver
+}
+
+// chatStateOnly reports whether msg carries a chat state notification and,
+// apart from processing hints, nothing else.
+func chatStateOnly(msg *stanza.Message) bool {
+	if len(msg.Bodies) > 0 || len(msg.Subjects) > 0 || msg.Error != nil {
+		return false
+	}
+	state := false
+	for _, ext := range msg.Extensions {
+		switch ext.XMLName.Space {
+		case ns.ChatStates:
+			state = true
+		case ns.Hints:
+		default:
+			return false
+		}
+	}
+	return state
+}
+
+// Sender writes stanzas to a client, such as an *xmpp.Session.
+type Sender interface {
+	Send(ctx context.Context, st stanza.Stanza) error
+}
+
+// Queue holds back the stanzas for a client while it reports being inactive
+// (XEP-0352), so that presence floods and typing notifications do not wake
+// up a device in a pocket. Stanzas it holds are not written to the stream,
+// so stream management counts them only once they are flushed.
+type Queue struct {
+	mu       sync.Mutex
+	rules    Rules
+	max      int
+	inactive bool
+	held     []stanza.Stanza
+	// presence indexes the presence in held by sender.
+	presence map[string]int
+}
+
+// NewQueue returns a queue for an active client that applies rules once the
+// client becomes inactive and holds at most max stanzas. A max of zero or
+// less removes the bound.
+func NewQueue(rules Rules, max int) *Queue {
+	return &Queue{rules: rules, max: max, presence: make(map[string]int)}
+}
+
+// Active reports whether the client is active.
+func (q *Queue) Active() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return !q.inactive
+}
+
+// Len returns the number of stanzas held.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.held)
+}
+
+// SetActive records the state the client reported. When it becomes active,
+// the stanzas held for it are sent to w.
+func (q *Queue) SetActive(ctx context.Context, w Sender, active bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inactive = !active
+	if active {
+		return q.flush(ctx, w)
+	}
+	return nil
+}
+
+// Send sends st to w, or holds or drops it while the client is inactive.
+// Stanzas that are sent go out after the ones held before them, so the
+// client sees presence and messages in the order they were routed.
+func (q *Queue) Send(ctx context.Context, w Sender, st stanza.Stanza) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	action := Deliver
+	if q.inactive {
+		action = q.rules.Classify(st)
+	}
+	switch action {
+	case Drop:
+		return nil
+	case Buffer:
+		if q.hold(st) {
+			return nil
+		}
+	}
+	if err := q.flush(ctx, w); err != nil {
+		return err
+	}
+	return w.Send(ctx, st)
+}
+
+// hold keeps st and reports whether the queue has room for it.
+func (q *Queue) hold(st stanza.Stanza) bool {
+	from := ""
+	if pres, ok := st.(*stanza.Presence); ok {
+		from = pres.From.String()
+		if i, ok := q.presence[from]; ok {
+			q.held[i] = st
+			return true
+		}
+	}
+	if q.max > 0 && len(q.held) >= q.max {
+		return false
+	}
+	if from != "" {
+		q.presence[from] = len(q.held)
+	}
+	q.held = append(q.held, st)
+	return true
+}
+
+// flush sends the held stanzas to w. The queue is emptied even when sending
+// fails, since the stream is then usually gone.
+func (q *Queue) flush(ctx context.Context, w Sender) error {
+	held := q.held
+	q.held = nil
+	clear(q.presence)
+	for _, st := range held {
+		if err := w.Send(ctx, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
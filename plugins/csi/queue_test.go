@@ -0,0 +1,130 @@
+package csi
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+type recorder struct {
+	sent []stanza.Stanza
+	err  error
+}
+
+func (r *recorder) Send(_ context.Context, st stanza.Stanza) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.sent = append(r.sent, st)
+	return nil
+}
+
+func presence(from, show string) *stanza.Presence {
+	p := stanza.NewPresence(stanza.PresenceAvailable)
+	p.From = jid.MustParse(from)
+	p.Show = show
+	return p
+}
+
+func chatState(state string) *stanza.Message {
+	m := stanza.NewMessage(stanza.MessageChat)
+	m.Extensions = []stanza.Extension{
+		{XMLName: xml.Name{Space: ns.ChatStates, Local: state}},
+		{XMLName: xml.Name{Space: ns.Hints, Local: "no-store"}},
+	}
+	return m
+}
+
+func chatMessage(body string) *stanza.Message {
+	m := stanza.NewMessage(stanza.MessageChat)
+	m.Bodies = []stanza.Text{{Value: body}}
+	return m
+}
+
+func TestQueueInactive(t *testing.T) {
+	ctx := context.Background()
+	w := &recorder{}
+	q := NewQueue(DefaultRules(), 0)
+
+	if err := q.Send(ctx, w, presence("bob@example.com/a", "away")); err != nil || len(w.sent) != 1 {
+		t.Fatalf("active client: %v, sent %d", err, len(w.sent))
+	}
+	w.sent = nil
+
+	_ = q.SetActive(ctx, w, false)
+	_ = q.Send(ctx, w, presence("bob@example.com/a", "away"))
+	_ = q.Send(ctx, w, presence("carol@example.com/b", ""))
+	_ = q.Send(ctx, w, presence("bob@example.com/a", "dnd"))
+	_ = q.Send(ctx, w, chatState("composing"))
+	if len(w.sent) != 0 || q.Len() != 2 {
+		t.Fatalf("inactive client got %d stanzas, %d held", len(w.sent), q.Len())
+	}
+
+	// A message flushes the queue ahead of itself.
+	msg := chatMessage("hi")
+	if err := q.Send(ctx, w, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.sent) != 3 || w.sent[2] != msg {
+		t.Fatalf("sent %d stanzas", len(w.sent))
+	}
+	if p := w.sent[0].(*stanza.Presence); p.From.String() != "bob@example.com/a" || p.Show != "dnd" {
+		t.Fatalf("first presence = %+v", p)
+	}
+	if q.Len() != 0 || q.Active() {
+		t.Fatal("queue state after flush")
+	}
+
+	_ = q.Send(ctx, w, presence("bob@example.com/a", ""))
+	if err := q.SetActive(ctx, w, true); err != nil || len(w.sent) != 4 || !q.Active() {
+		t.Fatalf("activation: %v, sent %d", err, len(w.sent))
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	ctx := context.Background()
+	w := &recorder{}
+	q := NewQueue(DefaultRules(), 2)
+	_ = q.SetActive(ctx, w, false)
+	for _, from := range []string{"a@example.com/1", "b@example.com/1", "c@example.com/1"} {
+		_ = q.Send(ctx, w, presence(from, ""))
+	}
+	if len(w.sent) != 3 || q.Len() != 0 {
+		t.Fatalf("full queue: sent %d, %d held", len(w.sent), q.Len())
+	}
+}
+
+func TestQueueRules(t *testing.T) {
+	ctx := context.Background()
+	w := &recorder{}
+	q := NewQueue(Rules{Presence: Drop, ChatStates: Deliver}, 0)
+	_ = q.SetActive(ctx, w, false)
+	_ = q.Send(ctx, w, presence("bob@example.com/a", ""))
+	_ = q.Send(ctx, w, chatState("paused"))
+	sub := stanza.NewPresence(stanza.PresenceSubscribe)
+	_ = q.Send(ctx, w, sub)
+	if len(w.sent) != 2 || w.sent[1] != sub || q.Len() != 0 {
+		t.Fatalf("sent %d, %d held", len(w.sent), q.Len())
+	}
+
+	w.err = errors.New("closed")
+	if err := q.Send(ctx, w, chatMessage("hi")); err == nil {
+		t.Fatal("send error was lost")
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	for _, a := range []Action{Deliver, Buffer, Drop} {
+		if got, err := ParseAction(a.String()); err != nil || got != a {
+			t.Fatalf("%s: %v, %v", a, got, err)
+		}
+	}
+	if _, err := ParseAction("queue"); err == nil {
+		t.Fatal("unknown action was accepted")
+	}
+}
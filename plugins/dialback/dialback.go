@@ -3,6 +3,9 @@ package dialback
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
@@ -11,6 +14,13 @@ import (
 
 const Name = "dialback"
 
+// Result and verification types.
+const (
+	TypeValid   = "valid"
+	TypeInvalid = "invalid"
+	TypeError   = "error"
+)
+
 type Result struct {
 	XMLName xml.Name `xml:"jabber:server:dialback result"`
 	From    string   `xml:"from,attr"`
@@ -28,6 +38,22 @@ type Verify struct {
 	Key     string   `xml:",chardata"`
 }
 
+// Feature is the stream feature announcing support for dialback.
+type Feature struct {
+	XMLName xml.Name  `xml:"urn:xmpp:features:dialback dialback"`
+	Errors  *struct{} `xml:"errors"`
+}
+
+// Key returns the dialback key of XEP-0185 that the originating server
+// sends on the stream with id it opened to the receiving server. Only a
+// server knowing secret can compute it again to verify it.
+func Key(secret, receiving, originating, id string) string {
+	sum := sha256.Sum256([]byte(secret))
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(sum[:])))
+	mac.Write([]byte(receiving + " " + originating + " " + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // Bidi represents XEP-0288 bidirectional S2S.
 type Bidi struct {
 	XMLName xml.Name `xml:"urn:xmpp:bidi bidi"`
@@ -50,5 +76,6 @@ func (p *Plugin) Dependencies() []string { return nil }
 
 func init() {
 	_ = ns.Dialback
+	_ = ns.DialbackFeature
 	_ = ns.BidiS2S
 }
@@ -0,0 +1,34 @@
+package dialback
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	// The example of XEP-0185: the HMAC key is the hex encoded SHA-256 of
+	// the secret.
+	mac := hmac.New(sha256.New, []byte("a7136eb1f46c9ef18c5e78c36ca257067c69b3d518285f0b18a96c33beae9acc"))
+	mac.Write([]byte("example.net example.com D60000229F"))
+	got := Key("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229F")
+	if want := hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Fatalf("Key = %s, want %s", got, want)
+	}
+	if Key("s3cr3tf0rd14lb4ck", "example.net", "example.com", "D60000229G") == got {
+		t.Fatal("key does not depend on the stream id")
+	}
+}
+
+func TestFeatureMarshal(t *testing.T) {
+	data, err := xml.Marshal(Feature{Errors: &struct{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, `xmlns="urn:xmpp:features:dialback"`) || !strings.Contains(s, "<errors>") {
+		t.Fatalf("Feature = %s", s)
+	}
+}
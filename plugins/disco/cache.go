@@ -0,0 +1,187 @@
+package disco
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// Defaults for the remote disco#info cache.
+const (
+	DefaultCacheTTL  = time.Hour
+	DefaultCacheSize = 1024
+)
+
+// ErrNoFetcher is returned when remote disco#info is requested before a
+// fetcher has been set with SetFetcher.
+var ErrNoFetcher = errors.New("disco: no fetcher for remote entities")
+
+// Fetcher queries the disco#info of node at a remote entity.
+type Fetcher func(ctx context.Context, to jid.JID, node string) (InfoQuery, error)
+
+type cacheKey struct {
+	jid  string
+	node string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	info    InfoQuery
+	expires time.Time
+}
+
+// Cache holds disco#info results of remote entities keyed by JID and node.
+// Entries expire after a TTL and the least recently used entry is evicted
+// once the cache is full. It is safe for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	clock   clock.Clock
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// NewCache returns a cache keeping at most size entries for ttl each. A
+// size of zero or less means no bound; a ttl of zero or less means entries
+// only leave the cache when evicted or invalidated.
+func NewCache(ttl time.Duration, size int, c clock.Clock) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		size:    size,
+		clock:   clock.Or(c),
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached info for node at to, if present and not expired.
+func (c *Cache) Get(to jid.JID, node string) (InfoQuery, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey{to.String(), node}]
+	if !ok {
+		return InfoQuery{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.ttl > 0 && !c.clock.Now().Before(e.expires) {
+		c.removeLocked(el)
+		return InfoQuery{}, false
+	}
+	c.lru.MoveToFront(el)
+	return copyInfo(e.info), true
+}
+
+// Put stores info for node at to.
+func (c *Cache) Put(to jid.JID, node string, info InfoQuery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{to.String(), node}
+	e := &cacheEntry{key: key, info: copyInfo(info), expires: c.clock.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// Invalidate drops every cached node of to, for example when its entity
+// capabilities change.
+func (c *Cache) Invalidate(to jid.JID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := to.String()
+	for key, el := range c.entries {
+		if key.jid == s {
+			c.removeLocked(el)
+		}
+	}
+}
+
+// Len returns the number of cached entries, including expired ones not yet
+// dropped.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) removeLocked(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+func copyInfo(info InfoQuery) InfoQuery {
+	info.Identities = slices.Clone(info.Identities)
+	info.Features = slices.Clone(info.Features)
+	return info
+}
+
+// SetFetcher sets the function used to query remote entities that are not
+// in the cache.
+func (p *Plugin) SetFetcher(f Fetcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fetch = f
+}
+
+// SetCache replaces the remote disco#info cache, for example to change its
+// TTL or size. Without it, a cache of DefaultCacheSize entries kept for
+// DefaultCacheTTL is created on first use.
+func (p *Plugin) SetCache(c *Cache) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = c
+}
+
+// RemoteInfo returns the disco#info of node at to, querying the entity only
+// when the cache has no fresh entry.
+func (p *Plugin) RemoteInfo(ctx context.Context, to jid.JID, node string) (InfoQuery, error) {
+	cache, fetch := p.remote()
+	if info, ok := cache.Get(to, node); ok {
+		return info, nil
+	}
+	if fetch == nil {
+		return InfoQuery{}, ErrNoFetcher
+	}
+	info, err := fetch(ctx, to, node)
+	if err != nil {
+		return InfoQuery{}, err
+	}
+	cache.Put(to, node, info)
+	return info, nil
+}
+
+// SupportsFeature reports whether the remote entity to advertises feature.
+func (p *Plugin) SupportsFeature(ctx context.Context, to jid.JID, feature string) (bool, error) {
+	info, err := p.RemoteInfo(ctx, to, "")
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(info.Features, func(f Feature) bool { return f.Var == feature }), nil
+}
+
+// InvalidateRemote drops the cached disco#info of to.
+func (p *Plugin) InvalidateRemote(to jid.JID) {
+	cache, _ := p.remote()
+	cache.Invalidate(to)
+}
+
+func (p *Plugin) remote() (*Cache, Fetcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cache == nil {
+		p.cache = NewCache(DefaultCacheTTL, DefaultCacheSize, p.params.Clock)
+	}
+	return p.cache, p.fetch
+}
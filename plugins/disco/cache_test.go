@@ -0,0 +1,127 @@
+package disco
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewCache(time.Minute, 0, c)
+	to := jid.MustParse("pubsub.example.org")
+
+	cache.Put(to, "", InfoQuery{Features: []Feature{{Var: "urn:xmpp:ping"}}})
+	if _, ok := cache.Get(to, ""); !ok {
+		t.Fatal("fresh entry missing")
+	}
+	if _, ok := cache.Get(to, "other"); ok {
+		t.Fatal("entries are keyed by node")
+	}
+	c.Advance(time.Minute)
+	if _, ok := cache.Get(to, ""); ok {
+		t.Fatal("expired entry returned")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("Len = %d after expiry, want 0", cache.Len())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCache(0, 2, nil)
+	a, b, c := jid.MustParse("a.example"), jid.MustParse("b.example"), jid.MustParse("c.example")
+
+	cache.Put(a, "", InfoQuery{})
+	cache.Put(b, "", InfoQuery{})
+	cache.Get(a, "")
+	cache.Put(c, "", InfoQuery{})
+
+	if _, ok := cache.Get(b, ""); ok {
+		t.Fatal("least recently used entry was kept")
+	}
+	for _, j := range []jid.JID{a, c} {
+		if _, ok := cache.Get(j, ""); !ok {
+			t.Fatalf("%s evicted", j)
+		}
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	cache := NewCache(time.Hour, 0, nil)
+	to := jid.MustParse("juliet@example.com/balcony")
+	other := jid.MustParse("romeo@example.net/orchard")
+
+	cache.Put(to, "", InfoQuery{})
+	cache.Put(to, "http://example.com#ver", InfoQuery{})
+	cache.Put(other, "", InfoQuery{})
+	cache.Invalidate(to)
+
+	if _, ok := cache.Get(to, ""); ok {
+		t.Fatal("invalidated entry returned")
+	}
+	if _, ok := cache.Get(to, "http://example.com#ver"); ok {
+		t.Fatal("invalidated node entry returned")
+	}
+	if _, ok := cache.Get(other, ""); !ok {
+		t.Fatal("unrelated entry invalidated")
+	}
+}
+
+func TestSupportsFeatureUsesCache(t *testing.T) {
+	p := New()
+	to := jid.MustParse("example.org")
+	ctx := context.Background()
+
+	if _, err := p.SupportsFeature(ctx, to, "urn:xmpp:ping"); !errors.Is(err, ErrNoFetcher) {
+		t.Fatalf("SupportsFeature without fetcher: %v, want ErrNoFetcher", err)
+	}
+
+	calls := 0
+	p.SetFetcher(func(_ context.Context, j jid.JID, node string) (InfoQuery, error) {
+		calls++
+		return InfoQuery{Features: []Feature{{Var: "urn:xmpp:ping"}}}, nil
+	})
+	for range 3 {
+		ok, err := p.SupportsFeature(ctx, to, "urn:xmpp:ping")
+		if err != nil || !ok {
+			t.Fatalf("SupportsFeature = %v, %v", ok, err)
+		}
+	}
+	if ok, _ := p.SupportsFeature(ctx, to, "urn:xmpp:mam:2"); ok {
+		t.Fatal("unadvertised feature reported as supported")
+	}
+	if calls != 1 {
+		t.Fatalf("fetcher called %d times, want 1", calls)
+	}
+
+	p.InvalidateRemote(to)
+	if _, err := p.SupportsFeature(ctx, to, "urn:xmpp:ping"); err != nil {
+		t.Fatalf("SupportsFeature: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("fetcher called %d times after invalidation, want 2", calls)
+	}
+}
+
+func TestRemoteInfoDoesNotCacheErrors(t *testing.T) {
+	p := New()
+	to := jid.MustParse("example.org")
+	fail := true
+	p.SetFetcher(func(context.Context, jid.JID, string) (InfoQuery, error) {
+		if fail {
+			return InfoQuery{}, errors.New("timeout")
+		}
+		return InfoQuery{}, nil
+	})
+	if _, err := p.RemoteInfo(context.Background(), to, ""); err == nil {
+		t.Fatal("expected fetch error")
+	}
+	fail = false
+	if _, err := p.RemoteInfo(context.Background(), to, ""); err != nil {
+		t.Fatalf("RemoteInfo after failure: %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
 )
 
 const Name = "disco"
@@ -18,7 +19,7 @@ type Identity struct {
 	Category string   `xml:"category,attr"`
 	Type     string   `xml:"type,attr"`
 	Name     string   `xml:"name,attr,omitempty"`
-	Lang     string   `xml:"xml:lang,attr,omitempty"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 }
 
 // Feature represents a disco feature.
@@ -27,12 +28,14 @@ type Feature struct {
 	Var     string   `xml:"var,attr"`
 }
 
-// InfoQuery represents a disco#info query.
+// InfoQuery represents a disco#info query. Forms are the extended
+// information data forms of XEP-0128.
 type InfoQuery struct {
-	XMLName    xml.Name   `xml:"http://jabber.org/protocol/disco#info query"`
-	Node       string     `xml:"node,attr,omitempty"`
-	Identities []Identity `xml:"identity"`
-	Features   []Feature  `xml:"feature"`
+	XMLName    xml.Name    `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string      `xml:"node,attr,omitempty"`
+	Identities []Identity  `xml:"identity"`
+	Features   []Feature   `xml:"feature"`
+	Forms      []form.Form `xml:"jabber:x:data x"`
 }
 
 // Item represents a disco item.
@@ -57,6 +60,9 @@ type Plugin struct {
 	features   []Feature
 	items      []Item
 	params     plugin.InitParams
+
+	cache *Cache
+	fetch Fetcher
 }
 
 // New creates a new disco plugin.
@@ -4,6 +4,8 @@ package extdisco
 import (
 	"context"
 	"encoding/xml"
+	"sync"
+	"time"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -37,6 +39,11 @@ type Credentials struct {
 
 type Plugin struct {
 	params plugin.InitParams
+
+	mu       sync.RWMutex
+	services []Service
+	secret   string
+	ttl      time.Duration
 }
 
 func New() *Plugin { return &Plugin{} }
@@ -0,0 +1,168 @@
+package extdisco
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DefaultCredentialTTL is how long the credentials handed out for
+// restricted services stay valid.
+const DefaultCredentialTTL = 24 * time.Hour
+
+// Service types of STUN and TURN servers (XEP-0215 §4)
+const (
+	TypeSTUN  = "stun"
+	TypeSTUNS = "stuns"
+	TypeTURN  = "turn"
+	TypeTURNS = "turns"
+)
+
+// ParseServiceURI parses a STUN or TURN URI (RFC 7064, RFC 7065), such as
+// "turn:turn.example.com:3478?transport=udp", into the service it names.
+// Without a port the default port of the scheme is used.
+func ParseServiceURI(s string) (Service, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Service{}, fmt.Errorf("extdisco: service %q: %w", s, err)
+	}
+	svc := Service{Type: strings.ToLower(u.Scheme)}
+	var defaultPort int
+	switch svc.Type {
+	case TypeSTUN, TypeTURN:
+		defaultPort = 3478
+	case TypeSTUNS, TypeTURNS:
+		defaultPort = 5349
+	default:
+		return Service{}, fmt.Errorf("extdisco: service %q: unknown scheme", s)
+	}
+	// The URIs are opaque: "turn:host:port", not "turn://host:port".
+	hostport := u.Opaque
+	if hostport == "" {
+		hostport = u.Host
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), strconv.Itoa(defaultPort)
+	}
+	if host == "" {
+		return Service{}, fmt.Errorf("extdisco: service %q: no host", s)
+	}
+	svc.Host = host
+	if svc.Port, err = strconv.Atoi(port); err != nil || svc.Port <= 0 || svc.Port > 65535 {
+		return Service{}, fmt.Errorf("extdisco: service %q: bad port", s)
+	}
+	switch transport := u.Query().Get("transport"); transport {
+	case "", "udp", "tcp":
+		svc.Transport = transport
+	default:
+		return Service{}, fmt.Errorf("extdisco: service %q: unknown transport %q", s, transport)
+	}
+	if svc.Transport == "" {
+		svc.Transport = "udp"
+		if svc.Type == TypeSTUNS || svc.Type == TypeTURNS {
+			svc.Transport = "tcp"
+		}
+	}
+	return svc, nil
+}
+
+// TURNCredentials returns the username and password of user for a TURN
+// server that shares secret with the XMPP server, valid until expires.
+// They follow the TURN REST API convention coturn implements with
+// use-auth-secret: the username is the expiry as a Unix time and user
+// joined by a colon, the password the base64 HMAC-SHA1 of the username.
+func TURNCredentials(secret, user string, expires time.Time) (username, password string) {
+	username = strconv.FormatInt(expires.Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SetServices sets the services the plugin announces to requesters. The
+// TURN services are restricted once a secret is set with SetSecret.
+func (p *Plugin) SetServices(services ...Service) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.services = append([]Service(nil), services...)
+}
+
+// SetSecret sets the secret shared with the TURN servers. Requesters
+// then get TURN credentials valid for ttl, or DefaultCredentialTTL when
+// ttl is zero.
+func (p *Plugin) SetSecret(secret string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ttl <= 0 {
+		ttl = DefaultCredentialTTL
+	}
+	p.secret, p.ttl = secret, ttl
+}
+
+// HandleIQ answers a request for the services (XEP-0215 §3.1) or for the
+// credentials of one of them (§3.3), or returns nil when iq is neither.
+func (p *Plugin) HandleIQ(_ context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQGet {
+		return nil
+	}
+	var list Services
+	if err := xml.Unmarshal(iq.Query, &list); err == nil {
+		return servicesIQ(iq, Services{Type: list.Type, Services: p.offer(iq.From, list.Type)})
+	}
+	var creds Credentials
+	if err := xml.Unmarshal(iq.Query, &creds); err != nil {
+		return nil
+	}
+	if creds.Service == nil || creds.Service.Host == "" || creds.Service.Type == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "service host and type required"))
+	}
+	for _, svc := range p.offer(iq.From, creds.Service.Type) {
+		if svc.Host == creds.Service.Host && (creds.Service.Port == 0 || svc.Port == creds.Service.Port) {
+			if svc.Username == "" {
+				return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAcceptable, "service needs no credentials"))
+			}
+			return servicesIQ(iq, Credentials{Service: &svc})
+		}
+	}
+	return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+}
+
+// offer returns the services of type typ, or all of them when typ is
+// empty, with credentials for requester.
+func (p *Plugin) offer(requester jid.JID, typ string) []Service {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := clock.Or(p.params.Clock).Now()
+	var out []Service
+	for _, svc := range p.services {
+		if typ != "" && svc.Type != typ {
+			continue
+		}
+		if p.secret != "" && (svc.Type == TypeTURN || svc.Type == TypeTURNS) {
+			expires := now.Add(p.ttl).Truncate(time.Second)
+			svc.Username, svc.Password = TURNCredentials(p.secret, requester.Bare().String(), expires)
+			svc.Restricted = true
+			svc.Expires = expires.UTC().Format(time.RFC3339)
+		}
+		out = append(out, svc)
+	}
+	return out
+}
+
+func servicesIQ(iq *stanza.IQ, v any) *stanza.IQ {
+	reply := iq.ResultIQ()
+	reply.Query, _ = xml.Marshal(v)
+	return reply
+}
@@ -0,0 +1,102 @@
+package extdisco
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestParseServiceURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want Service
+	}{
+		{"stun:stun.example.com", Service{Type: TypeSTUN, Host: "stun.example.com", Port: 3478, Transport: "udp"}},
+		{"turn:turn.example.com:3479?transport=tcp", Service{Type: TypeTURN, Host: "turn.example.com", Port: 3479, Transport: "tcp"}},
+		{"turns:[2001:db8::1]", Service{Type: TypeTURNS, Host: "2001:db8::1", Port: 5349, Transport: "tcp"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseServiceURI(tt.uri)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseServiceURI(%q) = %+v, %v; want %+v", tt.uri, got, err, tt.want)
+		}
+	}
+	for _, uri := range []string{"http://example.com", "turn:", "turn:example.com:http", "turn:example.com?transport=sctp"} {
+		if _, err := ParseServiceURI(uri); err == nil {
+			t.Errorf("ParseServiceURI(%q) succeeded", uri)
+		}
+	}
+}
+
+func TestTURNCredentials(t *testing.T) {
+	// The password coturn computes for the same secret and username.
+	user, pass := TURNCredentials("north", "romeo@example.com", time.Unix(1700086400, 0))
+	if user != "1700086400:romeo@example.com" || pass != "8cYlKo9VrtMPrFTwXElLT/h732M=" {
+		t.Fatalf("credentials = %q, %q", user, pass)
+	}
+}
+
+func servicesRequest(query string) *stanza.IQ {
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.From = jid.MustParse("romeo@example.com/orchard")
+	iq.Query = []byte(query)
+	return iq
+}
+
+func TestHandleIQ(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	if err := p.Initialize(ctx, plugin.InitParams{Clock: clock.NewFake(time.Unix(1700000000, 0))}); err != nil {
+		t.Fatal(err)
+	}
+	stun, _ := ParseServiceURI("stun:stun.example.com")
+	turn, _ := ParseServiceURI("turn:turn.example.com")
+	p.SetServices(stun, turn)
+
+	reply := p.HandleIQ(ctx, servicesRequest(`<services xmlns='urn:xmpp:extdisco:2'/>`))
+	var all Services
+	if err := xml.Unmarshal(reply.Query, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Services) != 2 || all.Services[1].Restricted || all.Services[1].Username != "" {
+		t.Fatalf("services without a secret = %+v", all.Services)
+	}
+
+	p.SetSecret("north", 0)
+	reply = p.HandleIQ(ctx, servicesRequest(`<services xmlns='urn:xmpp:extdisco:2' type='turn'/>`))
+	var turns Services
+	if err := xml.Unmarshal(reply.Query, &turns); err != nil {
+		t.Fatal(err)
+	}
+	if len(turns.Services) != 1 {
+		t.Fatalf("turn services = %+v", turns.Services)
+	}
+	got := turns.Services[0]
+	if !got.Restricted || got.Username != "1700086400:romeo@example.com" || got.Password != "8cYlKo9VrtMPrFTwXElLT/h732M=" || got.Expires != "2023-11-15T22:13:20Z" {
+		t.Fatalf("turn service = %+v", got)
+	}
+
+	reply = p.HandleIQ(ctx, servicesRequest(`<credentials xmlns='urn:xmpp:extdisco:2'><service host='turn.example.com' type='turn'/></credentials>`))
+	var creds Credentials
+	if err := xml.Unmarshal(reply.Query, &creds); err != nil || creds.Service == nil || creds.Service.Password != got.Password {
+		t.Fatalf("credentials = %s, %v", reply.Query, err)
+	}
+	for query, condition := range map[string]string{
+		`<credentials xmlns='urn:xmpp:extdisco:2'><service host='stun.example.com' type='stun'/></credentials>`:  stanza.ErrorNotAcceptable,
+		`<credentials xmlns='urn:xmpp:extdisco:2'><service host='other.example.com' type='turn'/></credentials>`: stanza.ErrorItemNotFound,
+		`<credentials xmlns='urn:xmpp:extdisco:2'/>`:                                                             stanza.ErrorBadRequest,
+	} {
+		if reply := p.HandleIQ(ctx, servicesRequest(query)); reply.Error == nil || reply.Error.Condition != condition {
+			t.Errorf("%s: error %+v, want %s", query, reply.Error, condition)
+		}
+	}
+	if reply := p.HandleIQ(ctx, servicesRequest(`<query xmlns='jabber:iq:version'/>`)); reply != nil {
+		t.Fatalf("foreign query answered: %+v", reply)
+	}
+}
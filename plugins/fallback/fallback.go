@@ -0,0 +1,162 @@
+// Package fallback implements XEP-0428 Fallback Indication.
+package fallback
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const Name = "fallback"
+
+var (
+	// ErrInvalidRange is returned for a range that is not within the text
+	// or has only one of its offsets.
+	ErrInvalidRange = errors.New("fallback: invalid range")
+	// ErrInvalidUTF8 is returned when the text is not valid UTF-8, so code
+	// point offsets cannot be applied to it.
+	ErrInvalidUTF8 = errors.New("fallback: text is not valid UTF-8")
+)
+
+// Fallback marks text of a message as a fallback for receivers that do not
+// support the specification with namespace For. Without Bodies or Subjects
+// the whole body is fallback.
+type Fallback struct {
+	XMLName  xml.Name `xml:"urn:xmpp:fallback:0 fallback"`
+	For      string   `xml:"for,attr"`
+	Bodies   []Range  `xml:"body"`
+	Subjects []Range  `xml:"subject"`
+}
+
+// Range is a fallback range of a body or subject, in Unicode code points
+// from Start up to but not including End. A range without offsets covers
+// the whole text.
+type Range struct {
+	Start *int `xml:"start,attr,omitempty"`
+	End   *int `xml:"end,attr,omitempty"`
+}
+
+// NewRange returns the range from start to end.
+func NewRange(start, end int) Range {
+	return Range{Start: &start, End: &end}
+}
+
+// bounds returns the code point offsets of r in a text of n code points.
+func (r Range) bounds(n int) (int, int, error) {
+	switch {
+	case r.Start == nil && r.End == nil:
+		return 0, n, nil
+	case r.Start == nil || r.End == nil:
+		return 0, 0, ErrInvalidRange
+	case *r.Start < 0 || *r.Start > *r.End || *r.End > n:
+		return 0, 0, ErrInvalidRange
+	}
+	return *r.Start, *r.End, nil
+}
+
+// Strip removes ranges from text. Offsets count Unicode code points, so
+// text must be valid UTF-8, and every range must lie within it. Ranges may
+// overlap and be given in any order.
+func Strip(text string, ranges []Range) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", ErrInvalidUTF8
+	}
+	runes := []rune(text)
+	type span struct{ start, end int }
+	spans := make([]span, 0, len(ranges))
+	for _, r := range ranges {
+		start, end, err := r.bounds(len(runes))
+		if err != nil {
+			return "", err
+		}
+		spans = append(spans, span{start, end})
+	}
+	slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+
+	out := make([]rune, 0, len(runes))
+	pos := 0
+	for _, s := range spans {
+		if s.start > pos {
+			out = append(out, runes[pos:s.start]...)
+		}
+		pos = max(pos, s.end)
+	}
+	out = append(out, runes[pos:]...)
+	return string(out), nil
+}
+
+// StripFallback returns the body of msg without the text marked as
+// fallback for the specification with namespace forNamespace, such as the
+// quote of a reply (XEP-0461) for ns.Reply. An empty forNamespace strips
+// all fallback text. A fallback without body ranges covers the whole body.
+func StripFallback(msg *stanza.Message, forNamespace string) (string, error) {
+	fallbacks, err := FromMessage(msg)
+	if err != nil {
+		return "", err
+	}
+	var ranges []Range
+	for _, f := range fallbacks {
+		if forNamespace != "" && f.For != forNamespace {
+			continue
+		}
+		if len(f.Bodies) == 0 {
+			ranges = append(ranges, Range{})
+		}
+		ranges = append(ranges, f.Bodies...)
+	}
+	return Strip(msg.Body(), ranges)
+}
+
+// FromMessage returns the fallback indications in msg.
+func FromMessage(msg *stanza.Message) ([]Fallback, error) {
+	var out []Fallback
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.Fallback || ext.XMLName.Local != "fallback" {
+			continue
+		}
+		data, err := xml.Marshal(ext)
+		if err != nil {
+			return nil, err
+		}
+		var f Fallback
+		if err := xml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// Attach adds f to msg.
+func Attach(msg *stanza.Message, f Fallback) error {
+	ext, err := stanza.NewExtension(f)
+	if err != nil {
+		return err
+	}
+	msg.Extensions = append(msg.Extensions, ext)
+	return nil
+}
+
+// Plugin implements XEP-0428.
+type Plugin struct {
+	params plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
+
+func init() { _ = ns.Fallback }
@@ -0,0 +1,94 @@
+package fallback
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestStrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		ranges []Range
+		want   string
+		err    error
+	}{
+		{"none", "hello", nil, "hello", nil},
+		{"prefix", "> hi\nhello", []Range{NewRange(0, 5)}, "hello", nil},
+		{"whole", "hello", []Range{{}}, "", nil},
+		{"code points", "🎂 cake", []Range{NewRange(0, 2)}, "cake", nil},
+		{"several", "abcdef", []Range{NewRange(4, 5), NewRange(0, 1)}, "bcdf", nil},
+		{"overlapping", "abcdef", []Range{NewRange(1, 4), NewRange(2, 5)}, "af", nil},
+		{"empty range", "abc", []Range{NewRange(1, 1)}, "abc", nil},
+		{"end past text", "🎂", []Range{NewRange(0, 2)}, "", ErrInvalidRange},
+		{"start after end", "abc", []Range{NewRange(2, 1)}, "", ErrInvalidRange},
+		{"negative", "abc", []Range{NewRange(-1, 1)}, "", ErrInvalidRange},
+		{"start only", "abc", []Range{{Start: NewRange(0, 1).Start}}, "", ErrInvalidRange},
+		{"invalid utf-8", "a\xffb", []Range{NewRange(0, 1)}, "", ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Strip(tt.text, tt.ranges)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Fatalf("Strip() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestStripFallback(t *testing.T) {
+	var msg stanza.Message
+	err := xml.Unmarshal([]byte(`<message xmlns='jabber:client'>
+  <body>> Anna wrote:
+> Cake?
+👍 Yes!</body>
+  <reply xmlns='urn:xmpp:reply:0' id='m1'/>
+  <fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:reply:0'>
+    <body start='0' end='22'/>
+  </fallback>
+  <fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:reactions:0'>
+    <body start='22' end='23'/>
+  </fallback>
+</message>`), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ forNS, want string }{
+		{ns.Reply, "👍 Yes!"},
+		{ns.Reactions, "> Anna wrote:\n> Cake?\n Yes!"},
+		{"", " Yes!"},
+		{"urn:example:other", msg.Body()},
+	} {
+		got, err := StripFallback(&msg, tt.forNS)
+		if err != nil || got != tt.want {
+			t.Fatalf("StripFallback(%q) = %q, %v, want %q", tt.forNS, got, err, tt.want)
+		}
+	}
+}
+
+func TestStripFallbackWholeBody(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("This message was encrypted.")
+	if err := Attach(msg, Fallback{For: "urn:xmpp:omemo:2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := StripFallback(msg, "urn:xmpp:omemo:2"); err != nil || got != "" {
+		t.Fatalf("StripFallback() = %q, %v", got, err)
+	}
+}
+
+func TestStripFallbackInvalid(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("short")
+	if err := Attach(msg, Fallback{For: ns.Reply, Bodies: []Range{NewRange(0, 50)}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StripFallback(msg, ns.Reply); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("StripFallback() error = %v, want ErrInvalidRange", err)
+	}
+}
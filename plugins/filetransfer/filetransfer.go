@@ -4,6 +4,7 @@ package filetransfer
 import (
 	"context"
 	"encoding/xml"
+	"sync"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -62,8 +63,14 @@ type Source struct {
 	Target  string   `xml:"target,attr"`
 }
 
+// Plugin sends and receives files in Jingle sessions of the jingle plugin
+// over the transports set with SetTransports.
 type Plugin struct {
 	params plugin.InitParams
+
+	mu         sync.Mutex
+	transports []Transport
+	onOffer    OfferFunc
 }
 
 func New() *Plugin { return &Plugin{} }
@@ -72,13 +79,15 @@ func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
 func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 	p.params = params
+	if j, ok := p.jingle(); ok {
+		j.RegisterApplication(ns.JingleFT, p.offered)
+	}
 	return nil
 }
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
 func init() {
-	_ = ns.JingleFT
 	_ = ns.FileMetadata
 	_ = ns.SFS
 }
@@ -0,0 +1,465 @@
+package filetransfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/ibb"
+	"github.com/meszmate/xmpp-go/plugins/jingle"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// contentName names the one content of the sessions this plugin starts.
+const contentName = "file"
+
+var (
+	// ErrNoJingle is returned when no jingle plugin is registered.
+	ErrNoJingle = errors.New("filetransfer: jingle plugin not registered")
+	// ErrNoTransport is returned when no transport is set and no ibb
+	// plugin is registered to fall back to.
+	ErrNoTransport = errors.New("filetransfer: no transport")
+	// ErrTerminated is returned when the peer ends the session before the
+	// file was transferred, such as by declining it.
+	ErrTerminated = errors.New("filetransfer: session terminated by peer")
+)
+
+// OfferFunc is called with every file a peer offers to send. It runs in
+// its own goroutine and must Accept or Decline o.
+type OfferFunc func(ctx context.Context, o *Offer)
+
+// Offer is a file a peer offers to send.
+type Offer struct {
+	File File
+	From jid.JID
+
+	t       *Transfer
+	content jingle.Content
+}
+
+// Accept takes the file and writes it to w. The transfer runs in the
+// background; its outcome is reported by Transfer.Wait.
+func (o *Offer) Accept(ctx context.Context, w io.Writer) (*Transfer, error) {
+	t := o.t
+	tr := t.plugin.transport(o.content.TransportNS())
+	if tr == nil {
+		_ = t.Session.Terminate(ctx, jingle.ReasonUnsupportedTransports, "")
+		t.finish(ErrNoTransport)
+		return nil, ErrNoTransport
+	}
+	n, content, err := t.answer(tr, o.content)
+	if err == nil {
+		err = t.Session.Accept(ctx, content)
+	}
+	if err != nil {
+		_ = t.Session.Terminate(ctx, jingle.ReasonFailedTransport, "")
+		t.finish(err)
+		return nil, err
+	}
+	go t.receive(w, tr, n)
+	return t, nil
+}
+
+// Decline refuses the file.
+func (o *Offer) Decline(ctx context.Context) error {
+	o.t.finish(ErrTerminated)
+	return o.t.Session.Terminate(ctx, jingle.ReasonDecline, "")
+}
+
+// Transfer is a file being sent or received in a Jingle session.
+type Transfer struct {
+	File    File
+	Session *jingle.Session
+
+	plugin *Plugin
+	ctx    context.Context // done when the transfer ends
+	cancel context.CancelFunc
+	events chan *jingle.Jingle
+
+	mu   sync.Mutex
+	ns   string      // namespace of the transport being negotiated
+	info chan []byte // its transport-info elements
+	done chan struct{}
+	err  error
+}
+
+func newTransfer(p *Plugin, s *jingle.Session, f File) *Transfer {
+	t := &Transfer{File: f, Session: s, plugin: p, events: make(chan *jingle.Jingle, 8), done: make(chan struct{})}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	s.Handle(t.handle)
+	return t
+}
+
+// Wait waits for the transfer to end and returns why it failed, or nil
+// once the file was transferred.
+func (t *Transfer) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel aborts the transfer.
+func (t *Transfer) Cancel(ctx context.Context) error {
+	t.finish(context.Canceled)
+	return t.Session.Terminate(ctx, jingle.ReasonCancel, "")
+}
+
+// handle takes the actions of the peer. Transport-info of the transport
+// being negotiated goes to its Negotiation, the rest to the goroutine
+// running the transfer.
+func (t *Transfer) handle(_ context.Context, _ *jingle.Session, j *jingle.Jingle) error {
+	if j.Action == jingle.ActionTransportInfo {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, c := range j.Contents {
+			if c.Name != contentName || c.TransportNS() != t.ns {
+				continue
+			}
+			select {
+			case t.info <- c.Element("transport"):
+			default:
+				return stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "")
+			}
+		}
+		return nil
+	}
+	select {
+	case t.events <- j:
+	default:
+		return stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "")
+	}
+	if j.Action == jingle.ActionSessionTerminate {
+		t.cancel()
+	}
+	return nil
+}
+
+// next returns the next action of the peer other than transport-info.
+func (t *Transfer) next() (*jingle.Jingle, error) {
+	select {
+	case j := <-t.events:
+		return j, nil
+	case <-t.ctx.Done():
+		select {
+		case j := <-t.events:
+			return j, nil
+		default:
+			return nil, t.ctx.Err()
+		}
+	}
+}
+
+// negotiate starts the negotiation of tr, directing its transport-info
+// to it.
+func (t *Transfer) negotiate(tr Transport) *Negotiation {
+	info := make(chan []byte, 8)
+	t.mu.Lock()
+	t.ns, t.info = tr.Namespace(), info
+	t.mu.Unlock()
+	return &Negotiation{Session: t.Session, Content: contentName, Info: info}
+}
+
+// answer answers the offer of content with tr and returns the content to
+// accept it with.
+func (t *Transfer) answer(tr Transport, content jingle.Content) (*Negotiation, jingle.Content, error) {
+	n := t.negotiate(tr)
+	n.Offer = content.Element("transport")
+	answer, err := tr.Answer(t.ctx, n)
+	if err != nil {
+		return nil, jingle.Content{}, err
+	}
+	c, err := jingle.NewContent(jingle.CreatorInitiator, contentName, nil, answer)
+	if err != nil {
+		return nil, jingle.Content{}, err
+	}
+	n.Answer = c.Element("transport")
+	return n, content.WithTransport(n.Answer), nil
+}
+
+// finish ends the transfer with err unless it already ended.
+func (t *Transfer) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	t.err = err
+	close(t.done)
+	t.cancel()
+}
+
+// send runs the transfer of a file the local entity offered, from its
+// session-accept to the session-terminate of the receiver.
+func (t *Transfer) send(r io.Reader, transports []Transport, n *Negotiation) {
+	j, err := t.next()
+	if err == nil && j.Action != jingle.ActionSessionAccept {
+		err = terminated(j)
+	}
+	var conn io.ReadWriteCloser
+	for i := 0; err == nil; {
+		if c, ok := t.Session.Content(contentName); ok {
+			n.Answer = c.Element("transport")
+		}
+		if conn, err = transports[i].Connect(t.ctx, n); err == nil {
+			break
+		}
+		if i++; i == len(transports) {
+			break
+		}
+		n, err = t.replace(transports[i])
+	}
+	if err != nil {
+		t.fail(jingle.ReasonFailedTransport, err)
+		return
+	}
+
+	stop := context.AfterFunc(t.ctx, func() { conn.Close() })
+	_, err = io.Copy(conn, r)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	stop()
+	if err != nil {
+		t.fail(jingle.ReasonConnectivityError, err)
+		return
+	}
+	// The receiver ends the session once it has the whole file.
+	if j, err = t.next(); err == nil {
+		err = terminated(j)
+	}
+	t.finish(err)
+}
+
+// replace offers tr instead of the transport that failed and waits for
+// the receiver to take it.
+func (t *Transfer) replace(tr Transport) (*Negotiation, error) {
+	n := t.negotiate(tr)
+	offer, err := tr.Offer(t.ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	c, err := jingle.NewContent(jingle.CreatorInitiator, contentName, nil, offer)
+	if err != nil {
+		return nil, err
+	}
+	n.Offer = c.Element("transport")
+	if err := t.Session.Send(t.ctx, jingle.ActionTransportReplace, c); err != nil {
+		return nil, err
+	}
+	for {
+		j, err := t.next()
+		switch {
+		case err != nil:
+			return nil, err
+		case j.Action == jingle.ActionTransportAccept:
+			return n, nil
+		case j.Action == jingle.ActionTransportReject, j.Action == jingle.ActionSessionTerminate:
+			return nil, terminated(j)
+		}
+	}
+}
+
+// receive runs the transfer of a file the local entity accepted.
+func (t *Transfer) receive(w io.Writer, tr Transport, n *Negotiation) {
+	conn, err := tr.Connect(t.ctx, n)
+	for err != nil {
+		// The sender replaces a transport that failed, or gives up.
+		var j *jingle.Jingle
+		if j, err = t.next(); err != nil {
+			t.finish(err)
+			return
+		}
+		switch j.Action {
+		case jingle.ActionSessionTerminate:
+			t.finish(terminated(j))
+			return
+		case jingle.ActionTransportReplace:
+			err = errors.New("filetransfer: transport not replaced")
+			if len(j.Contents) == 0 {
+				continue
+			}
+			if tr = t.plugin.transport(j.Contents[0].TransportNS()); tr == nil {
+				_ = t.Session.Send(t.ctx, jingle.ActionTransportReject, j.Contents...)
+				continue
+			}
+			var c jingle.Content
+			if n, c, err = t.answer(tr, j.Contents[0]); err != nil {
+				_ = t.Session.Send(t.ctx, jingle.ActionTransportReject, j.Contents...)
+				continue
+			}
+			if err = t.Session.Send(t.ctx, jingle.ActionTransportAccept, c); err == nil {
+				conn, err = tr.Connect(t.ctx, n)
+			}
+		}
+	}
+
+	stop := context.AfterFunc(t.ctx, func() { conn.Close() })
+	read, err := io.Copy(w, conn)
+	conn.Close()
+	stop()
+	switch {
+	case err != nil:
+		t.fail(jingle.ReasonConnectivityError, err)
+	case t.File.Size > 0 && read != t.File.Size:
+		t.fail(jingle.ReasonMediaError, fmt.Errorf("filetransfer: received %d of %d bytes", read, t.File.Size))
+	default:
+		_ = t.Session.Terminate(context.Background(), jingle.ReasonSuccess, "")
+		t.finish(nil)
+	}
+}
+
+// fail terminates the session with condition and ends the transfer with
+// err.
+func (t *Transfer) fail(condition string, err error) {
+	if t.Session.State() != jingle.StateEnded {
+		_ = t.Session.Terminate(context.Background(), condition, "")
+	}
+	t.finish(err)
+}
+
+// terminated returns the error of an unexpected action j of the peer.
+func terminated(j *jingle.Jingle) error {
+	if j.Action != jingle.ActionSessionTerminate {
+		return fmt.Errorf("filetransfer: unexpected %s", j.Action)
+	}
+	if j.Reason == nil {
+		return ErrTerminated
+	}
+	if j.Reason.Condition == jingle.ReasonSuccess {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrTerminated, j.Reason.Condition)
+}
+
+// SetTransports sets the transports files are sent with, in order of
+// preference; the later ones are fallbacks. Offers are accepted with any
+// of them. By default files go over In-Band Bytestreams when the ibb
+// plugin is registered.
+func (p *Plugin) SetTransports(transports ...Transport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transports = transports
+}
+
+// OnOffer sets the function called with the files peers offer. Without
+// one, offers are refused.
+func (p *Plugin) OnOffer(f OfferFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onOffer = f
+}
+
+// Send offers f to peer and sends what r yields once the peer accepts.
+// The transfer runs in the background; its outcome is reported by
+// Transfer.Wait. f.Size should be set so that the peer can check it got
+// the whole file.
+func (p *Plugin) Send(ctx context.Context, peer jid.JID, f File, r io.Reader) (*Transfer, error) {
+	j, ok := p.jingle()
+	if !ok {
+		return nil, ErrNoJingle
+	}
+	transports := p.transportList()
+	if len(transports) == 0 {
+		return nil, ErrNoTransport
+	}
+
+	s, err := j.NewSession(peer)
+	if err != nil {
+		return nil, err
+	}
+	t := newTransfer(p, s, f)
+	n := t.negotiate(transports[0])
+	offer, err := transports[0].Offer(t.ctx, n)
+	if err == nil {
+		var c jingle.Content
+		if c, err = jingle.NewContent(jingle.CreatorInitiator, contentName, Description{File: &f}, offer); err == nil {
+			n.Offer = c.Element("transport")
+			err = s.Initiate(ctx, c)
+		}
+	}
+	if err != nil {
+		t.finish(err)
+		return nil, err
+	}
+	go t.send(r, transports, n)
+	return t, nil
+}
+
+// offered is the jingle Application of file transfers.
+func (p *Plugin) offered(ctx context.Context, s *jingle.Session) error {
+	p.mu.Lock()
+	onOffer := p.onOffer
+	p.mu.Unlock()
+	if onOffer == nil {
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")
+	}
+	content, ok := s.Content(contentName)
+	if !ok {
+		contents := s.Contents()
+		content = contents[0]
+	}
+	var desc Description
+	if err := content.Decode(&desc); err != nil || desc.File == nil {
+		return stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "no file")
+	}
+	o := &Offer{File: *desc.File, From: s.Peer(), content: content}
+	o.t = newTransfer(p, s, o.File)
+	go onOffer(context.WithoutCancel(ctx), o)
+	return nil
+}
+
+// transport returns the transport of namespace space.
+func (p *Plugin) transport(space string) Transport {
+	for _, tr := range p.transportList() {
+		if tr.Namespace() == space {
+			return tr
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) transportList() []Transport {
+	p.mu.Lock()
+	transports := p.transports
+	p.mu.Unlock()
+	if transports != nil {
+		return transports
+	}
+	if p.params.Get == nil {
+		return nil
+	}
+	if ip, ok := p.params.Get(ibb.Name); ok {
+		if b, ok := ip.(*ibb.Plugin); ok {
+			return []Transport{&IBBTransport{Plugin: b}}
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) jingle() (*jingle.Plugin, bool) {
+	if p.params.Get == nil {
+		return nil, false
+	}
+	jp, ok := p.params.Get(jingle.Name)
+	if !ok {
+		return nil, false
+	}
+	j, ok := jp.(*jingle.Plugin)
+	return j, ok
+}
+
+func (p *Plugin) local() jid.JID {
+	if p.params.LocalJID == nil {
+		return jid.JID{}
+	}
+	local, _ := jid.Parse(p.params.LocalJID())
+	return local
+}
@@ -0,0 +1,228 @@
+package filetransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/ibb"
+	"github.com/meszmate/xmpp-go/plugins/jingle"
+	"github.com/meszmate/xmpp-go/plugins/socks5"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	romeo  = jid.MustParse("romeo@example.com/orchard")
+	juliet = jid.MustParse("juliet@example.com/balcony")
+)
+
+// party is the plugins of one side of a transfer.
+type party struct {
+	jingle *jingle.Plugin
+	ibb    *ibb.Plugin
+	socks5 *socks5.Plugin
+	ft     *Plugin
+	// proxy answers the requests to proxyJID.
+	proxy *socks5.Proxy
+}
+
+var proxyJID = jid.MustParse("proxy.example.com")
+
+func (p *party) handleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if reply := p.jingle.HandleIQ(ctx, iq); reply != nil {
+		return reply
+	}
+	return p.ibb.HandleIQ(ctx, iq)
+}
+
+// connect returns the parties of romeo and juliet, whose requests reach
+// each other.
+func connect(t *testing.T) (*party, *party) {
+	t.Helper()
+	a, b := &party{}, &party{}
+	link := func(p *party, local jid.JID, peer *party) {
+		p.jingle, p.ibb, p.socks5, p.ft = jingle.New(), ibb.New(), socks5.New(), New()
+		m := plugin.NewManager()
+		for _, pl := range []plugin.Plugin{p.jingle, p.ibb, p.socks5, p.ft} {
+			if err := m.Register(pl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := m.Initialize(context.Background(), plugin.InitParams{
+			LocalJID: local.String,
+			SendIQ: func(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+				req := *iq
+				req.From = local
+				var reply *stanza.IQ
+				if req.To.Equal(proxyJID) && p.proxy != nil {
+					reply = p.proxy.HandleIQ(ctx, &req)
+				} else {
+					reply = peer.handleIQ(ctx, &req)
+				}
+				if reply == nil {
+					return nil, errors.New("no reply")
+				}
+				if reply.Error != nil {
+					return reply, reply.Error
+				}
+				return reply, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link(a, romeo, b)
+	link(b, juliet, a)
+	return a, b
+}
+
+// receive makes p accept the next offer into a buffer, returning the
+// transfer once it was accepted.
+func receive(t *testing.T, p *party) (<-chan *Transfer, *syncBuffer) {
+	t.Helper()
+	buf := &syncBuffer{}
+	accepted := make(chan *Transfer, 1)
+	p.ft.OnOffer(func(ctx context.Context, o *Offer) {
+		tr, err := o.Accept(ctx, buf)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		accepted <- tr
+	})
+	return accepted, buf
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// transfer sends data from a to b and returns the namespace of the
+// transport it went over.
+func transfer(t *testing.T, a, b *party, data string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	accepted, buf := receive(t, b)
+	out, err := a.ft.Send(ctx, juliet, File{Name: "letter.txt", Size: int64(len(data))}, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Wait(ctx); err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	in := <-accepted
+	if err := in.Wait(ctx); err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	if in.File.Name != "letter.txt" || buf.String() != data {
+		t.Fatalf("received %q as %q", buf.String(), in.File.Name)
+	}
+	c, _ := out.Session.Content(contentName)
+	return c.TransportNS()
+}
+
+func TestSendOverIBB(t *testing.T) {
+	a, b := connect(t)
+	data := strings.Repeat("But soft, what light through yonder window breaks? ", 200)
+	if got := transfer(t, a, b, data); got != ns.JingleIBB {
+		t.Fatalf("sent over %s", got)
+	}
+}
+
+func TestSendOverS5B(t *testing.T) {
+	a, b := connect(t)
+	for _, p := range []*party{a, b} {
+		p.ft.SetTransports(&S5BTransport{Listen: "127.0.0.1:0"}, &IBBTransport{Plugin: p.ibb})
+	}
+	if got := transfer(t, a, b, strings.Repeat("x", 100000)); got != ns.JingleS5B {
+		t.Fatalf("sent over %s", got)
+	}
+}
+
+func TestSendOverProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	streamhost := socks5.Streamhost{JID: proxyJID.String(), Host: addr.IP.String(), Port: addr.Port}
+	proxy := socks5.NewProxy(streamhost)
+	go proxy.Serve(ln)
+	defer ln.Close()
+
+	a, b := connect(t)
+	a.proxy = proxy
+	a.ft.SetTransports(&S5BTransport{Plugin: a.socks5, Proxies: []socks5.Streamhost{streamhost}})
+	b.ft.SetTransports(&S5BTransport{})
+	if got := transfer(t, a, b, strings.Repeat("y", 50000)); got != ns.JingleS5B {
+		t.Fatalf("sent over %s", got)
+	}
+	// The proxy counts a block once it was written on.
+	for deadline := time.Now().Add(5 * time.Second); proxy.Stats().Bytes != 50000 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := proxy.Stats(); stats.Activations != 1 || stats.Bytes != 50000 {
+		t.Fatalf("proxy stats %+v", stats)
+	}
+}
+
+func TestFallbackToIBB(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	a, b := connect(t)
+	unreachable := []socks5.Streamhost{{JID: "proxy.example.com", Host: "127.0.0.1", Port: port}}
+	a.ft.SetTransports(&S5BTransport{Proxies: unreachable, Timeout: time.Second}, &IBBTransport{Plugin: a.ibb})
+	b.ft.SetTransports(&S5BTransport{Timeout: time.Second}, &IBBTransport{Plugin: b.ibb})
+	if got := transfer(t, a, b, "hello"); got != ns.JingleIBB {
+		t.Fatalf("sent over %s", got)
+	}
+}
+
+func TestDecline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b := connect(t)
+	b.ft.OnOffer(func(ctx context.Context, o *Offer) { _ = o.Decline(ctx) })
+	out, err := a.ft.Send(ctx, juliet, File{Name: "letter.txt", Size: 5}, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Wait(ctx); !errors.Is(err, ErrTerminated) || !strings.Contains(err.Error(), jingle.ReasonDecline) {
+		t.Fatalf("declined transfer: %v", err)
+	}
+
+	b.ft.OnOffer(nil)
+	if _, err := a.ft.Send(ctx, juliet, File{Name: "letter.txt"}, strings.NewReader("")); err == nil {
+		t.Fatal("offer without an offer handler was taken")
+	}
+	if _, err := New().Send(ctx, juliet, File{}, strings.NewReader("")); !errors.Is(err, ErrNoJingle) {
+		t.Fatalf("send without jingle: %v", err)
+	}
+}
@@ -0,0 +1,389 @@
+package filetransfer
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/ibb"
+	"github.com/meszmate/xmpp-go/plugins/jingle"
+	"github.com/meszmate/xmpp-go/plugins/socks5"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Transport carries the data of a file over a Jingle transport method.
+// A transfer tries the transports set with SetTransports in order; when
+// one cannot connect, the sender replaces it with the next one.
+type Transport interface {
+	// Namespace returns the namespace of the transport element.
+	Namespace() string
+	// Offer returns the transport element the initiator proposes.
+	Offer(ctx context.Context, n *Negotiation) (any, error)
+	// Answer returns the transport element the responder takes n.Offer
+	// with.
+	Answer(ctx context.Context, n *Negotiation) (any, error)
+	// Connect opens the bytestream once both parties agreed on the
+	// transport.
+	Connect(ctx context.Context, n *Negotiation) (io.ReadWriteCloser, error)
+}
+
+// Negotiation is the state of one transport of a transfer. The context
+// its methods get is cancelled when the transfer ends, which is when
+// anything a transport set up for it is released.
+type Negotiation struct {
+	Session *jingle.Session
+	Content string
+	// Offer and Answer are the transport elements of the initiator and
+	// the responder.
+	Offer  []byte
+	Answer []byte
+	// Info delivers the transport elements of the transport-info actions
+	// the peer sends for the content.
+	Info <-chan []byte
+	// Value holds what the transport keeps between its calls.
+	Value any
+}
+
+// Local returns the transport element the local entity sent.
+func (n *Negotiation) Local() []byte {
+	if n.Session.IsInitiator() {
+		return n.Offer
+	}
+	return n.Answer
+}
+
+// Remote returns the transport element the peer sent.
+func (n *Negotiation) Remote() []byte {
+	if n.Session.IsInitiator() {
+		return n.Answer
+	}
+	return n.Offer
+}
+
+// SendInfo sends transport in a transport-info action for the content.
+func (n *Negotiation) SendInfo(ctx context.Context, transport any) error {
+	c, err := jingle.NewContent(jingle.CreatorInitiator, n.Content, nil, transport)
+	if err != nil {
+		return err
+	}
+	return n.Session.Send(ctx, jingle.ActionTransportInfo, c)
+}
+
+// IBBTransport sends files over In-Band Bytestreams (XEP-0261). It works
+// wherever the peer is reachable but is slow, so it is best tried last.
+type IBBTransport struct {
+	Plugin *ibb.Plugin
+	// BlockSize is the block size offered; it defaults to
+	// ibb.DefaultBlockSize.
+	BlockSize int
+}
+
+func (t *IBBTransport) Namespace() string { return ns.JingleIBB }
+
+func (t *IBBTransport) Offer(_ context.Context, _ *Negotiation) (any, error) {
+	size := t.BlockSize
+	if size <= 0 {
+		size = ibb.DefaultBlockSize
+	}
+	return ibb.Transport{BlockSize: size, SID: stanza.GenerateID()}, nil
+}
+
+func (t *IBBTransport) Answer(ctx context.Context, n *Negotiation) (any, error) {
+	var offer ibb.Transport
+	if err := xml.Unmarshal(n.Offer, &offer); err != nil {
+		return nil, err
+	}
+	if offer.BlockSize <= 0 {
+		return nil, errors.New("filetransfer: no block size offered")
+	}
+	if t.BlockSize > 0 {
+		offer.BlockSize = min(offer.BlockSize, t.BlockSize)
+	}
+	// The initiator opens the bytestream as soon as the answer arrives.
+	conn := t.Plugin.Expect(n.Session.Peer(), offer.SID)
+	context.AfterFunc(ctx, func() { conn.Close() })
+	n.Value = conn
+	return offer, nil
+}
+
+func (t *IBBTransport) Connect(ctx context.Context, n *Negotiation) (io.ReadWriteCloser, error) {
+	if conn, ok := n.Value.(*ibb.Conn); ok {
+		return conn, nil
+	}
+	var answer ibb.Transport
+	if err := xml.Unmarshal(n.Answer, &answer); err != nil {
+		return nil, err
+	}
+	return t.Plugin.Open(ctx, n.Session.Peer(), answer.SID, answer.BlockSize)
+}
+
+// S5BTransport sends files over SOCKS5 Bytestreams (XEP-0260). Both
+// parties offer their candidates, try those of the other and report the
+// outcome; the candidate of higher priority is used, a proxy one after
+// the party that offered it activated it.
+type S5BTransport struct {
+	// Plugin activates proxies. It is needed only with Proxies.
+	Plugin *socks5.Plugin
+	// Listen is the address a direct candidate takes connections at, such
+	// as ":0". Without it no direct candidate is offered.
+	Listen string
+	// Host is the host the direct candidate is offered with. It defaults
+	// to the IP address the listener is bound to.
+	Host string
+	// Proxies are offered as proxy candidates, as returned by
+	// socks5.Plugin.Streamhosts.
+	Proxies []socks5.Streamhost
+	// Timeout bounds connecting to each candidate of the peer. It defaults
+	// to socks5.DefaultDialTimeout.
+	Timeout time.Duration
+}
+
+// s5bState is the Negotiation.Value of an S5BTransport.
+type s5bState struct {
+	sid      string
+	accepted chan net.Conn // connections to the direct candidate
+}
+
+func (t *S5BTransport) Namespace() string { return ns.JingleS5B }
+
+func (t *S5BTransport) Offer(ctx context.Context, n *Negotiation) (any, error) {
+	return t.candidates(ctx, n, stanza.GenerateID())
+}
+
+func (t *S5BTransport) Answer(ctx context.Context, n *Negotiation) (any, error) {
+	var offer socks5.Transport
+	if err := xml.Unmarshal(n.Offer, &offer); err != nil {
+		return nil, err
+	}
+	if offer.Mode == "udp" {
+		return nil, errors.New("filetransfer: udp mode is not supported")
+	}
+	return t.candidates(ctx, n, offer.SID)
+}
+
+// candidates returns the local transport element, listening for the
+// direct candidate until ctx is done.
+func (t *S5BTransport) candidates(ctx context.Context, n *Negotiation, sid string) (socks5.Transport, error) {
+	local, err := localJID(n.Session)
+	if err != nil {
+		return socks5.Transport{}, err
+	}
+	dst := socks5.DstAddr(sid, local, n.Session.Peer())
+	st := &s5bState{sid: sid, accepted: make(chan net.Conn, 1)}
+	n.Value = st
+	tr := socks5.Transport{SID: sid, DstAddr: dst, Mode: "tcp"}
+
+	if t.Listen != "" {
+		ln, err := net.Listen("tcp", t.Listen)
+		if err != nil {
+			return socks5.Transport{}, err
+		}
+		context.AfterFunc(ctx, func() { ln.Close() })
+		go accept(ln, dst, st.accepted)
+		addr := ln.Addr().(*net.TCPAddr)
+		host := t.Host
+		if host == "" {
+			host = addr.IP.String()
+		}
+		tr.Candidates = append(tr.Candidates, socks5.Candidate{
+			CID: stanza.GenerateID(), Host: host, JID: local.String(), Port: addr.Port,
+			Priority: socks5.CandidatePriority(socks5.CandidateDirect, 0), Type: socks5.CandidateDirect,
+		})
+	}
+	for i, proxy := range t.Proxies {
+		tr.Candidates = append(tr.Candidates, socks5.Candidate{
+			CID: stanza.GenerateID(), Host: proxy.Host, JID: proxy.JID, Port: proxy.Port,
+			Priority: socks5.CandidatePriority(socks5.CandidateProxy, 65535-i), Type: socks5.CandidateProxy,
+		})
+	}
+	return tr, nil
+}
+
+// accept hands over the first connection to ln that asks for dst.
+func accept(ln net.Listener, dst string, accepted chan<- net.Conn) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.SetDeadline(time.Now().Add(socks5.DefaultDialTimeout))
+		if _, err := socks5.Handshake(conn, func(addr string) bool { return addr == dst }); err != nil {
+			conn.Close()
+			continue
+		}
+		_ = conn.SetDeadline(time.Time{})
+		accepted <- conn
+		return
+	}
+}
+
+func (t *S5BTransport) Connect(ctx context.Context, n *Negotiation) (io.ReadWriteCloser, error) {
+	st, ok := n.Value.(*s5bState)
+	if !ok {
+		return nil, errors.New("filetransfer: transport not offered")
+	}
+	var local, remote socks5.Transport
+	if err := xml.Unmarshal(n.Local(), &local); err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(n.Remote(), &remote); err != nil {
+		return nil, err
+	}
+	me, err := localJID(n.Session)
+	if err != nil {
+		return nil, err
+	}
+	peer := n.Session.Peer()
+
+	// Try the candidates of the peer and tell it the outcome.
+	used, conn := t.dial(ctx, remote.Candidates, socks5.DstAddr(st.sid, peer, me))
+	report := socks5.Transport{SID: st.sid}
+	if used != nil {
+		report.CandidateUsed = &socks5.CandidateRef{CID: used.CID}
+	} else {
+		report.CandidateError = &struct{}{}
+	}
+	if err := n.SendInfo(ctx, report); err != nil {
+		closeConn(conn)
+		return nil, err
+	}
+
+	// The peer reports once it tried the local candidates.
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(len(local.Candidates)+1)*t.timeout())
+	defer cancel()
+	peerReport, err := waitInfo(waitCtx, n.Info, func(tr *socks5.Transport) bool {
+		return tr.CandidateUsed != nil || tr.CandidateError != nil
+	})
+	if err != nil {
+		closeConn(conn)
+		return nil, err
+	}
+	var picked *socks5.Candidate
+	if peerReport.CandidateUsed != nil {
+		if i := slices.IndexFunc(local.Candidates, func(c socks5.Candidate) bool { return c.CID == peerReport.CandidateUsed.CID }); i >= 0 {
+			picked = &local.Candidates[i]
+		}
+	}
+
+	switch {
+	case used == nil && picked == nil:
+		return nil, errors.New("filetransfer: no candidate could be connected")
+	case used != nil && (picked == nil || used.Priority > picked.Priority || used.Priority == picked.Priority && n.Session.IsInitiator()):
+		// The candidate of the peer is used; a proxy one is activated by
+		// the peer.
+		if used.Type == socks5.CandidateProxy {
+			activated, err := waitInfo(waitCtx, n.Info, func(tr *socks5.Transport) bool {
+				return tr.Activated != nil || tr.ProxyError != nil
+			})
+			if err != nil || activated.Activated == nil {
+				conn.Close()
+				return nil, errors.New("filetransfer: proxy not activated")
+			}
+		}
+		return conn, nil
+	}
+
+	closeConn(conn)
+	if picked.Type != socks5.CandidateProxy {
+		select {
+		case conn := <-st.accepted:
+			return conn, nil
+		case <-waitCtx.Done():
+			return nil, waitCtx.Err()
+		}
+	}
+	return t.activate(ctx, n, picked, socks5.DstAddr(st.sid, me, peer))
+}
+
+// activate connects to the local proxy candidate the peer used and asks
+// the proxy to relay the bytestream.
+func (t *S5BTransport) activate(ctx context.Context, n *Negotiation, c *socks5.Candidate, dst string) (io.ReadWriteCloser, error) {
+	proxy, err := jid.Parse(c.JID)
+	if err == nil && t.Plugin == nil {
+		err = socks5.ErrNotConnected
+	}
+	var conn net.Conn
+	if err == nil {
+		dialCtx, cancel := context.WithTimeout(ctx, t.timeout())
+		conn, err = socks5.Dial(dialCtx, net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), dst)
+		cancel()
+	}
+	if err == nil {
+		err = t.Plugin.Activate(ctx, proxy, n.Value.(*s5bState).sid, n.Session.Peer())
+	}
+	if err != nil {
+		closeConn(conn)
+		_ = n.SendInfo(ctx, socks5.Transport{SID: n.Value.(*s5bState).sid, ProxyError: &struct{}{}})
+		return nil, fmt.Errorf("filetransfer: activate proxy: %w", err)
+	}
+	if err := n.SendInfo(ctx, socks5.Transport{SID: n.Value.(*s5bState).sid, Activated: &socks5.CandidateRef{CID: c.CID}}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial connects to the first of candidates that can be reached, in order
+// of priority.
+func (t *S5BTransport) dial(ctx context.Context, candidates []socks5.Candidate, dst string) (*socks5.Candidate, net.Conn) {
+	candidates = slices.Clone(candidates)
+	slices.SortStableFunc(candidates, func(a, b socks5.Candidate) int { return b.Priority - a.Priority })
+	for i := range candidates {
+		c := &candidates[i]
+		dialCtx, cancel := context.WithTimeout(ctx, t.timeout())
+		conn, err := socks5.Dial(dialCtx, net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), dst)
+		cancel()
+		if err == nil {
+			return c, conn
+		}
+	}
+	return nil, nil
+}
+
+func (t *S5BTransport) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return socks5.DefaultDialTimeout
+}
+
+// waitInfo returns the first transport-info of the peer that match
+// accepts.
+func waitInfo(ctx context.Context, info <-chan []byte, match func(*socks5.Transport) bool) (*socks5.Transport, error) {
+	for {
+		select {
+		case data := <-info:
+			var tr socks5.Transport
+			if xml.Unmarshal(data, &tr) == nil && match(&tr) {
+				return &tr, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func localJID(s *jingle.Session) (jid.JID, error) {
+	if s.IsInitiator() {
+		return s.Initiator, nil
+	}
+	if s.Responder.IsZero() {
+		return jid.JID{}, errors.New("filetransfer: local address unknown")
+	}
+	return s.Responder, nil
+}
@@ -54,6 +54,62 @@ type Field struct {
 	Desc     string   `xml:"desc,omitempty"`
 	Values   []string `xml:"value,omitempty"`
 	Options  []Option `xml:"option,omitempty"`
+	Media    *Media   `xml:"urn:xmpp:media-element media,omitempty"`
+}
+
+// fieldXML carries Required as the <required/> child element.
+type fieldXML struct {
+	XMLName  xml.Name  `xml:"field"`
+	Var      string    `xml:"var,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	Label    string    `xml:"label,attr,omitempty"`
+	Desc     string    `xml:"desc,omitempty"`
+	Required *struct{} `xml:"required"`
+	Values   []string  `xml:"value,omitempty"`
+	Options  []Option  `xml:"option,omitempty"`
+	Media    *Media    `xml:"urn:xmpp:media-element media,omitempty"`
+}
+
+// MarshalXML implements xml.Marshaler, writing Required as <required/>.
+func (f Field) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := fieldXML{
+		Var: f.Var, Type: f.Type, Label: f.Label, Desc: f.Desc,
+		Values: f.Values, Options: f.Options, Media: f.Media,
+	}
+	if f.Required {
+		x.Required = &struct{}{}
+	}
+	return e.EncodeElement(x, start)
+}
+
+// UnmarshalXML implements xml.Unmarshaler, setting Required from
+// <required/>.
+func (f *Field) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var x fieldXML
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	*f = Field{
+		XMLName: x.XMLName, Var: x.Var, Type: x.Type, Label: x.Label,
+		Required: x.Required != nil, Desc: x.Desc,
+		Values: x.Values, Options: x.Options, Media: x.Media,
+	}
+	return nil
+}
+
+// Media is an XEP-0221 media element attached to a field, such as a CAPTCHA
+// image or audio clip.
+type Media struct {
+	XMLName xml.Name   `xml:"urn:xmpp:media-element media"`
+	Height  int        `xml:"height,attr,omitempty"`
+	Width   int        `xml:"width,attr,omitempty"`
+	URIs    []MediaURI `xml:"uri"`
+}
+
+// MediaURI locates one representation of a media element.
+type MediaURI struct {
+	Type string `xml:"type,attr"`
+	URI  string `xml:",chardata"`
 }
 
 // Option represents a field option.
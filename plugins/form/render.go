@@ -0,0 +1,150 @@
+package form
+
+import (
+	"slices"
+	"strings"
+)
+
+// RenderModel is a view of a Form shaped for user interfaces. Fields carry
+// display labels, descriptions, required markers, option lists with their
+// selection state and XEP-0221 media, and a result form's <reported> and
+// <item> elements are flattened into table columns and rows.
+type RenderModel struct {
+	Type         string
+	Title        string
+	Instructions []string
+	// Fields are the visible fields in document order.
+	Fields []RenderField
+	// Hidden holds the values of hidden fields, which a client echoes back
+	// unchanged when submitting the form.
+	Hidden map[string][]string
+	// Columns and Rows form the result table of a form with <reported>.
+	Columns []Column
+	Rows    []Row
+}
+
+// RenderField describes how to present one field.
+type RenderField struct {
+	Var  string
+	Type string
+	// Label is the field's label, or its var when it has none.
+	Label       string
+	Description string
+	Required    bool
+	Values      []string
+	Options     []RenderOption
+	Media       *Media
+	// Multi is set for field types that take several values.
+	Multi bool
+	// ReadOnly is set for fixed fields, which are shown but not edited.
+	// A fixed field without a var acts as a section heading.
+	ReadOnly bool
+	// Secret is set for text-private fields, whose input should be masked.
+	Secret bool
+}
+
+// RenderOption is a choice of a list field.
+type RenderOption struct {
+	// Label is the option's label, or its value when it has none.
+	Label    string
+	Value    string
+	Selected bool
+}
+
+// Column is a column of a result table, taken from <reported>.
+type Column struct {
+	Var   string
+	Label string
+}
+
+// Row is one <item> of a result table. Cells line up with the model's
+// Columns; a column the item has no field for gets an empty cell.
+type Row struct {
+	Cells []Cell
+}
+
+// Cell holds the values of one column in a row.
+type Cell struct {
+	Values []string
+}
+
+// Text returns the cell's values joined by newlines.
+func (c Cell) Text() string {
+	return strings.Join(c.Values, "\n")
+}
+
+// NewRenderModel builds the render model of f.
+func NewRenderModel(f *Form) *RenderModel {
+	m := &RenderModel{
+		Type:         f.Type,
+		Title:        f.Title,
+		Instructions: slices.Clone(f.Instructions),
+	}
+	for _, field := range f.Fields {
+		if field.Type == FieldHidden {
+			if m.Hidden == nil {
+				m.Hidden = make(map[string][]string)
+			}
+			m.Hidden[field.Var] = slices.Clone(field.Values)
+			continue
+		}
+		m.Fields = append(m.Fields, renderField(field))
+	}
+
+	if f.Reported != nil {
+		for _, field := range f.Reported.Fields {
+			m.Columns = append(m.Columns, Column{Var: field.Var, Label: fieldLabel(field)})
+		}
+		for _, item := range f.Items {
+			row := Row{Cells: make([]Cell, len(m.Columns))}
+			for i, col := range m.Columns {
+				for _, field := range item.Fields {
+					if field.Var == col.Var {
+						row.Cells[i].Values = slices.Clone(field.Values)
+						break
+					}
+				}
+			}
+			m.Rows = append(m.Rows, row)
+		}
+	}
+	return m
+}
+
+func renderField(field Field) RenderField {
+	typ := field.Type
+	if typ == "" {
+		typ = FieldTextSingle
+	}
+	rf := RenderField{
+		Var:         field.Var,
+		Type:        typ,
+		Label:       fieldLabel(field),
+		Description: field.Desc,
+		Required:    field.Required,
+		Values:      slices.Clone(field.Values),
+		Media:       field.Media,
+		Multi:       typ == FieldListMulti || typ == FieldJIDMulti || typ == FieldTextMulti,
+		ReadOnly:    typ == FieldFixed,
+		Secret:      typ == FieldTextPrivate,
+	}
+	for _, opt := range field.Options {
+		label := opt.Label
+		if label == "" {
+			label = opt.Value
+		}
+		rf.Options = append(rf.Options, RenderOption{
+			Label:    label,
+			Value:    opt.Value,
+			Selected: slices.Contains(field.Values, opt.Value),
+		})
+	}
+	return rf
+}
+
+func fieldLabel(field Field) string {
+	if field.Label != "" {
+		return field.Label
+	}
+	return field.Var
+}
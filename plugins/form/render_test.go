@@ -0,0 +1,122 @@
+package form
+
+import (
+	"encoding/xml"
+	"slices"
+	"testing"
+)
+
+const searchResult = `<x xmlns='jabber:x:data' type='result'>
+  <title>Search results</title>
+  <reported>
+    <field var='jid' label='JID' type='jid-single'/>
+    <field var='nick' type='text-single'/>
+  </reported>
+  <item>
+    <field var='jid'><value>juliet@example.com</value></field>
+    <field var='nick'><value>Juliet</value></field>
+  </item>
+  <item>
+    <field var='jid'><value>romeo@example.net</value></field>
+  </item>
+</x>`
+
+const registrationForm = `<x xmlns='jabber:x:data' type='form'>
+  <title>Sign up</title>
+  <instructions>Fill in the form.</instructions>
+  <field type='hidden' var='FORM_TYPE'><value>jabber:iq:register</value></field>
+  <field type='fixed'><value>Account</value></field>
+  <field type='text-single' var='username' label='Username'><required/><desc>Your name</desc></field>
+  <field type='text-private' var='password'><required/></field>
+  <field type='list-multi' var='topics' label='Topics'>
+    <value>go</value>
+    <option label='Go'><value>go</value></option>
+    <option><value>xmpp</value></option>
+  </field>
+  <field var='ocr' label='Enter the text you see'>
+    <media xmlns='urn:xmpp:media-element' height='80' width='290'>
+      <uri type='image/jpeg'>http://www.victim.example/challenges/ocr.jpeg?F3A6292C</uri>
+      <uri type='image/png'>cid:sha1+f24030b8d91d233bac14777be5ab531ca3b9f102@bob.xmpp.org</uri>
+    </media>
+  </field>
+</x>`
+
+func TestRenderModelFields(t *testing.T) {
+	var f Form
+	if err := xml.Unmarshal([]byte(registrationForm), &f); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := NewRenderModel(&f)
+
+	if m.Title != "Sign up" || len(m.Instructions) != 1 {
+		t.Fatalf("title/instructions = %q, %q", m.Title, m.Instructions)
+	}
+	if got := m.Hidden["FORM_TYPE"]; !slices.Equal(got, []string{"jabber:iq:register"}) {
+		t.Fatalf("Hidden[FORM_TYPE] = %v", got)
+	}
+	if len(m.Fields) != 5 {
+		t.Fatalf("got %d visible fields, want 5", len(m.Fields))
+	}
+
+	heading := m.Fields[0]
+	if !heading.ReadOnly || heading.Var != "" || heading.Values[0] != "Account" {
+		t.Errorf("heading = %+v", heading)
+	}
+	user := m.Fields[1]
+	if user.Label != "Username" || !user.Required || user.Description != "Your name" {
+		t.Errorf("username = %+v", user)
+	}
+	pass := m.Fields[2]
+	if pass.Label != "password" || !pass.Required || !pass.Secret {
+		t.Errorf("password = %+v", pass)
+	}
+	topics := m.Fields[3]
+	want := []RenderOption{{Label: "Go", Value: "go", Selected: true}, {Label: "xmpp", Value: "xmpp"}}
+	if !topics.Multi || !slices.Equal(topics.Options, want) {
+		t.Errorf("topics = %+v", topics)
+	}
+	ocr := m.Fields[4]
+	if ocr.Type != FieldTextSingle || ocr.Media == nil || ocr.Media.Width != 290 || len(ocr.Media.URIs) != 2 {
+		t.Fatalf("ocr = %+v", ocr)
+	}
+	if ocr.Media.URIs[0].Type != "image/jpeg" || ocr.Media.URIs[0].URI != "http://www.victim.example/challenges/ocr.jpeg?F3A6292C" {
+		t.Errorf("media uri = %+v", ocr.Media.URIs[0])
+	}
+}
+
+func TestRenderModelTable(t *testing.T) {
+	var f Form
+	if err := xml.Unmarshal([]byte(searchResult), &f); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	m := NewRenderModel(&f)
+
+	wantCols := []Column{{Var: "jid", Label: "JID"}, {Var: "nick", Label: "nick"}}
+	if !slices.Equal(m.Columns, wantCols) {
+		t.Fatalf("Columns = %+v", m.Columns)
+	}
+	if len(m.Rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(m.Rows))
+	}
+	if m.Rows[0].Cells[0].Text() != "juliet@example.com" || m.Rows[0].Cells[1].Text() != "Juliet" {
+		t.Errorf("row 0 = %+v", m.Rows[0])
+	}
+	if m.Rows[1].Cells[0].Text() != "romeo@example.net" || m.Rows[1].Cells[1].Text() != "" {
+		t.Errorf("row 1 = %+v", m.Rows[1])
+	}
+}
+
+func TestFieldRequiredRoundTrip(t *testing.T) {
+	in := Form{Type: TypeForm, Fields: []Field{{Var: "a", Required: true}, {Var: "b"}}}
+	data, err := xml.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out Form
+	if err := xml.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !out.Fields[0].Required || out.Fields[1].Required {
+		t.Fatalf("Required not preserved: %s", data)
+	}
+}
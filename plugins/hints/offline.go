@@ -0,0 +1,60 @@
+package hints
+
+import (
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// OfflinePolicy decides which stanzas a server keeps for an account that has
+// no available resource (XEP-0160), honoring the hints of XEP-0334. The zero
+// value applies the rules those specifications recommend.
+type OfflinePolicy struct {
+	// Headline also stores headline messages, which are dropped by default
+	// since they are only of interest when they arrive.
+	Headline bool
+	// Bodyless also stores chat and normal messages without a body, such
+	// as chat states and receipts, which are dropped by default.
+	Bodyless bool
+}
+
+// Storable reports whether st is stored offline:
+//
+//   - presence and IQ stanzas never are, nor are error and groupchat
+//     messages;
+//   - a message with a no-store hint is not, whatever else it carries;
+//   - a message with a store hint is, even without a body or as a headline;
+//   - other chat and normal messages are stored when they have a body, and
+//     headline messages are dropped, unless the policy says otherwise.
+//
+// A no-permanent-store hint allows offline storage, which is temporary.
+func (p OfflinePolicy) Storable(st stanza.Stanza) bool {
+	msg, ok := st.(*stanza.Message)
+	if !ok {
+		return false
+	}
+	switch msg.Type {
+	case stanza.MessageChat, stanza.MessageNormal, "", stanza.MessageHeadline:
+	default:
+		return false
+	}
+	if has(msg, "no-store") {
+		return false
+	}
+	if has(msg, "store") {
+		return true
+	}
+	if msg.Type == stanza.MessageHeadline {
+		return p.Headline
+	}
+	return len(msg.Bodies) > 0 || p.Bodyless
+}
+
+// has reports whether msg carries the hint with the given element name.
+func has(msg *stanza.Message, hint string) bool {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space == ns.Hints && ext.XMLName.Local == hint {
+			return true
+		}
+	}
+	return false
+}
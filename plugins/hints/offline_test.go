@@ -0,0 +1,102 @@
+package hints
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func message(typ string, body bool, hints ...any) *stanza.Message {
+	msg := stanza.NewMessage(typ)
+	if body {
+		msg.SetBody("hello")
+	}
+	for _, h := range hints {
+		ext, err := stanza.NewExtension(h)
+		if err != nil {
+			panic(err)
+		}
+		msg.Extensions = append(msg.Extensions, ext)
+	}
+	return msg
+}
+
+func TestOfflineStorableNonMessages(t *testing.T) {
+	p := OfflinePolicy{Headline: true, Bodyless: true}
+	for _, st := range []stanza.Stanza{
+		stanza.NewPresence(stanza.PresenceAvailable),
+		stanza.NewPresence(stanza.PresenceSubscribe),
+		stanza.NewIQ(stanza.IQSet),
+	} {
+		if p.Storable(st) {
+			t.Errorf("Storable(%s) = true", st.StanzaType())
+		}
+	}
+}
+
+func TestOfflineStorableMessages(t *testing.T) {
+	types := []string{stanza.MessageChat, stanza.MessageNormal, "", stanza.MessageHeadline, stanza.MessageGroupchat, stanza.MessageError}
+	hintSets := map[string][]any{
+		"none":               nil,
+		"store":              {Store{}},
+		"no-store":           {NoStore{}},
+		"no-permanent-store": {NoPermanentStore{}},
+		"no-copy":            {NoCopy{}},
+		"store+no-store":     {Store{}, NoStore{}},
+	}
+	// want[type][hints][body] for the default policy.
+	want := map[string]map[string][2]bool{
+		stanza.MessageChat: {
+			"none": {false, true}, "store": {true, true}, "no-store": {false, false},
+			"no-permanent-store": {false, true}, "no-copy": {false, true}, "store+no-store": {false, false},
+		},
+		stanza.MessageHeadline: {
+			"none": {false, false}, "store": {true, true}, "no-store": {false, false},
+			"no-permanent-store": {false, false}, "no-copy": {false, false}, "store+no-store": {false, false},
+		},
+	}
+	want[stanza.MessageNormal] = want[stanza.MessageChat]
+	want[""] = want[stanza.MessageChat]
+
+	for _, typ := range types {
+		for name, hs := range hintSets {
+			for _, body := range []bool{false, true} {
+				msg := message(typ, body, hs...)
+				expected := want[typ][name][boolIndex(body)]
+				if got := (OfflinePolicy{}).Storable(msg); got != expected {
+					t.Errorf("type %q, hints %s, body %v: Storable = %v, want %v", typ, name, body, got, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestOfflineStorablePolicy(t *testing.T) {
+	tests := []struct {
+		policy OfflinePolicy
+		msg    *stanza.Message
+		want   bool
+	}{
+		{OfflinePolicy{Headline: true}, message(stanza.MessageHeadline, true), true},
+		{OfflinePolicy{Headline: true}, message(stanza.MessageHeadline, true, NoStore{}), false},
+		{OfflinePolicy{Bodyless: true}, message(stanza.MessageChat, false), true},
+		{OfflinePolicy{Bodyless: true}, message(stanza.MessageChat, false, NoStore{}), false},
+		{OfflinePolicy{Headline: true, Bodyless: true}, message(stanza.MessageGroupchat, true, Store{}), false},
+		{OfflinePolicy{Headline: true, Bodyless: true}, message(stanza.MessageError, true), false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if got := tt.policy.Storable(tt.msg); got != tt.want {
+				t.Fatalf("%+v.Storable(%s message) = %v, want %v", tt.policy, tt.msg.Type, got, tt.want)
+			}
+		})
+	}
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,285 @@
+package ibb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DefaultBlockSize is the block size Jingle file transfers offer. It stays
+// well below the stanza size limits of common servers once encoded.
+const DefaultBlockSize = 4096
+
+// MaxBlockSize is the largest block size a peer may open a bytestream
+// with.
+const MaxBlockSize = 65535
+
+// ErrNotConnected is returned when the plugin was not initialized by a
+// client, which is needed to send bytestream requests.
+var ErrNotConnected = errors.New("ibb: not connected")
+
+// Transport is the Jingle In-Band Bytestreams transport (XEP-0261).
+type Transport struct {
+	XMLName   xml.Name `xml:"urn:xmpp:jingle:transports:ibb:1 transport"`
+	BlockSize int      `xml:"block-size,attr"`
+	SID       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"`
+}
+
+// Conn is an in-band bytestream with a peer. Reads return what the peer
+// sent. Writes are split into blocks of at most the block size, each sent
+// in an IQ that waits for the peer's reply, which paces the sender.
+type Conn struct {
+	p    *Plugin
+	peer jid.JID
+	sid  string
+
+	wmu     sync.Mutex // serializes writes
+	sendSeq uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	opened    bool
+	blockSize int
+	buf       bytes.Buffer
+	recvSeq   uint16
+	eof       bool  // the peer closed the bytestream
+	err       error // the bytestream broke or was closed locally
+}
+
+func newConn(p *Plugin, peer jid.JID, sid string) *Conn {
+	c := &Conn{p: p, peer: peer, sid: sid}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// SID returns the session ID of the bytestream.
+func (c *Conn) SID() string { return c.sid }
+
+// Read reads what the peer sent. It returns io.EOF once the peer closed
+// the bytestream and everything before was read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.buf.Len() == 0 && !c.eof && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.buf.Len() > 0 {
+		return c.buf.Read(b)
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return 0, io.EOF
+}
+
+// Write sends b to the peer.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	opened, size, err := c.opened, c.blockSize, c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !opened {
+		return 0, errors.New("ibb: bytestream not open")
+	}
+	n := 0
+	for n < len(b) {
+		block := b[n:min(n+size, len(b))]
+		data := Data{SID: c.sid, Seq: c.sendSeq, Value: base64.StdEncoding.EncodeToString(block)}
+		if err := c.p.request(context.Background(), c.peer, data); err != nil {
+			c.fail(err)
+			return n, err
+		}
+		c.sendSeq++
+		n += len(block)
+	}
+	return n, nil
+}
+
+// Close closes the bytestream, telling the peer if it is still open.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	// Nothing is sent for a bytestream that never opened, broke or was
+	// closed by the peer.
+	quiet := !c.opened || c.err != nil || c.eof
+	if c.err == nil {
+		c.err = io.ErrClosedPipe
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.p.forget(c)
+	if quiet {
+		return nil
+	}
+	return c.p.request(context.Background(), c.peer, Close{SID: c.sid})
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+}
+
+// Open opens a bytestream identified by sid to peer with blocks of at most
+// blockSize bytes.
+func (p *Plugin) Open(ctx context.Context, peer jid.JID, sid string, blockSize int) (*Conn, error) {
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		blockSize = DefaultBlockSize
+	}
+	c := newConn(p, peer, sid)
+	c.opened, c.blockSize = true, blockSize
+	if !p.track(c) {
+		return nil, errors.New("ibb: bytestream exists")
+	}
+	if err := p.request(ctx, peer, Open{SID: sid, BlockSize: blockSize, Stanza: "iq"}); err != nil {
+		p.forget(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// Expect returns the bytestream peer is about to open with sid. Reads on
+// it wait for the peer to open it and send data; an open from a peer that
+// is not expected is refused.
+func (p *Plugin) Expect(peer jid.JID, sid string) *Conn {
+	c := newConn(p, peer, sid)
+	if !p.track(c) {
+		c.fail(errors.New("ibb: bytestream exists"))
+	}
+	return c
+}
+
+// HandleIQ processes a bytestream request from a peer and returns the
+// reply, or nil when iq is not one.
+func (p *Plugin) HandleIQ(_ context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var open Open
+	var data Data
+	var closing Close
+	switch {
+	case xml.Unmarshal(iq.Query, &open) == nil:
+		return p.opened(iq, &open)
+	case xml.Unmarshal(iq.Query, &data) == nil:
+		return p.received(iq, &data)
+	case xml.Unmarshal(iq.Query, &closing) == nil:
+		c := p.conn(iq.From, closing.SID)
+		if c == nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+		}
+		c.mu.Lock()
+		c.eof = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		p.forget(c)
+		return iq.ResultIQ()
+	}
+	return nil
+}
+
+func (p *Plugin) opened(iq *stanza.IQ, open *Open) *stanza.IQ {
+	if open.Stanza != "" && open.Stanza != "iq" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorFeatureNotImplemented, "only iq stanzas are supported"))
+	}
+	if open.BlockSize <= 0 || open.BlockSize > MaxBlockSize {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorResourceConstraint, "block size not acceptable"))
+	}
+	c := p.conn(iq.From, open.SID)
+	if c == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAcceptable, ""))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opened {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAcceptable, "already open"))
+	}
+	c.opened, c.blockSize = true, open.BlockSize
+	return iq.ResultIQ()
+}
+
+func (p *Plugin) received(iq *stanza.IQ, data *Data) *stanza.IQ {
+	c := p.conn(iq.From, data.SID)
+	if c == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	}
+	block, err := base64.StdEncoding.DecodeString(data.Value)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case !c.opened:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))
+	case err != nil || len(block) > c.blockSize:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "bad block"))
+	case data.Seq != c.recvSeq:
+		// A lost block cannot be recovered; the bytestream is closed.
+		c.err = errors.New("ibb: block out of sequence")
+		c.cond.Broadcast()
+		p.forget(c)
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorUnexpectedRequest, ""))
+	}
+	c.buf.Write(block)
+	c.recvSeq++
+	c.cond.Broadcast()
+	return iq.ResultIQ()
+}
+
+func (p *Plugin) request(ctx context.Context, peer jid.JID, payload any) error {
+	if p.params.SendIQ == nil {
+		return ErrNotConnected
+	}
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.To, iq.Query = peer, data
+	_, err = p.params.SendIQ(ctx, iq)
+	return err
+}
+
+// track registers c and reports whether no other bytestream has its ID.
+func (p *Plugin) track(c *Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := connKey(c.peer, c.sid)
+	if p.conns == nil {
+		p.conns = make(map[string]*Conn)
+	}
+	if _, ok := p.conns[key]; ok {
+		return false
+	}
+	p.conns[key] = c
+	return true
+}
+
+func (p *Plugin) conn(peer jid.JID, sid string) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[connKey(peer, sid)]
+}
+
+func (p *Plugin) forget(c *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := connKey(c.peer, c.sid)
+	if p.conns[key] == c {
+		delete(p.conns, key)
+	}
+}
+
+func connKey(peer jid.JID, sid string) string { return peer.String() + " " + sid }
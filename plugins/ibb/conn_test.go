@@ -0,0 +1,101 @@
+package ibb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	romeo  = jid.MustParse("romeo@example.com/orchard")
+	juliet = jid.MustParse("juliet@example.com/balcony")
+)
+
+// connect returns the plugins of romeo and juliet, whose requests reach
+// each other's HandleIQ.
+func connect(t *testing.T) (*Plugin, *Plugin) {
+	t.Helper()
+	a, b := New(), New()
+	link := func(p *Plugin, local jid.JID, peer func() *Plugin) {
+		_ = p.Initialize(context.Background(), plugin.InitParams{
+			SendIQ: func(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+				req := *iq
+				req.From = local
+				reply := peer().HandleIQ(ctx, &req)
+				if reply == nil {
+					return nil, errors.New("no reply")
+				}
+				if reply.Error != nil {
+					return reply, reply.Error
+				}
+				return reply, nil
+			},
+		})
+	}
+	link(a, romeo, func() *Plugin { return b })
+	link(b, juliet, func() *Plugin { return a })
+	return a, b
+}
+
+func TestBytestream(t *testing.T) {
+	ctx := context.Background()
+	a, b := connect(t)
+
+	if _, err := a.Open(ctx, juliet, "s1", 16); err == nil {
+		t.Fatal("unexpected bytestream was accepted")
+	}
+	in := b.Expect(romeo, "s1")
+	out, err := a.Open(ctx, juliet, "s1", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	go func() {
+		_, _ = out.Write(payload)
+		_ = out.Close()
+	}()
+	got, err := io.ReadAll(in)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if in.Close() != nil {
+		t.Fatal("closing a bytestream the peer closed failed")
+	}
+	if _, err := out.Write([]byte("more")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}
+
+func TestBytestreamErrors(t *testing.T) {
+	ctx := context.Background()
+	a, b := connect(t)
+	b.Expect(romeo, "s1")
+	if _, err := a.Open(ctx, juliet, "s1", MaxBlockSize+1); err != nil {
+		t.Fatalf("oversized block size was not capped: %v", err)
+	}
+
+	in := b.Expect(romeo, "s2")
+	open := stanza.NewIQ(stanza.IQSet)
+	open.From, open.Query = romeo, []byte(`<open xmlns='http://jabber.org/protocol/ibb' sid='s2' block-size='4'/>`)
+	if reply := b.HandleIQ(ctx, open); reply.Type != stanza.IQResult {
+		t.Fatalf("open: %+v", reply.Error)
+	}
+	data := stanza.NewIQ(stanza.IQSet)
+	data.From, data.Query = romeo, []byte(`<data xmlns='http://jabber.org/protocol/ibb' sid='s2' seq='1'>AAAA</data>`)
+	if reply := b.HandleIQ(ctx, data); reply.Error == nil || reply.Error.Condition != stanza.ErrorUnexpectedRequest {
+		t.Fatalf("block out of sequence: %+v", reply.Error)
+	}
+	if _, err := in.Read(make([]byte, 4)); err == nil || err == io.EOF {
+		t.Fatalf("read after a lost block: %v", err)
+	}
+
+	if _, err := New().Open(ctx, juliet, "s3", 0); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("unconnected open: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ package ibb
 import (
 	"context"
 	"encoding/xml"
+	"sync"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -30,8 +31,13 @@ type Close struct {
 	SID     string   `xml:"sid,attr"`
 }
 
+// Plugin opens and accepts the in-band bytestreams of a client. Incoming
+// requests are passed to HandleIQ.
 type Plugin struct {
 	params plugin.InitParams
+
+	mu    sync.Mutex
+	conns map[string]*Conn
 }
 
 func New() *Plugin { return &Plugin{} }
@@ -45,4 +51,7 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-func init() { _ = ns.IBB }
+func init() {
+	_ = ns.IBB
+	_ = ns.JingleIBB
+}
@@ -0,0 +1,127 @@
+package jingle
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Content creators (XEP-0166 §7.3)
+const (
+	CreatorInitiator = "initiator"
+	CreatorResponder = "responder"
+)
+
+// ErrNoElement is returned by Content.Decode when the content has no child
+// v decodes from.
+var ErrNoElement = errors.New("jingle: content has no such element")
+
+// NewContent returns a content of creator named name that holds the
+// application description and the transport. Either may be nil, as in a
+// transport-info, which carries only the transport.
+func NewContent(creator, name string, description, transport any) (Content, error) {
+	c := Content{Creator: creator, Name: name}
+	for _, v := range []any{description, transport} {
+		if v == nil {
+			continue
+		}
+		data, err := xml.Marshal(v)
+		if err != nil {
+			return Content{}, fmt.Errorf("jingle: content %s: %w", name, err)
+		}
+		c.Description = append(c.Description, data...)
+	}
+	return c, nil
+}
+
+// Decode decodes the first child of c that v accepts, such as its
+// description or transport, into v. It returns ErrNoElement when there is
+// none.
+func (c Content) Decode(v any) error {
+	dec := xml.NewDecoder(bytes.NewReader(c.Description))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return ErrNoElement
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		// A child of another name is refused before it is consumed.
+		if err := dec.DecodeElement(v, &start); err == nil {
+			return nil
+		} else if _, ok := err.(xml.UnmarshalError); !ok {
+			return err
+		}
+		if err := dec.Skip(); err != nil {
+			return err
+		}
+	}
+}
+
+// DescriptionNS returns the namespace of the application description of c.
+func (c Content) DescriptionNS() string { return c.childNS("description") }
+
+// TransportNS returns the namespace of the transport of c.
+func (c Content) TransportNS() string { return c.childNS("transport") }
+
+// Element returns the child of c named local, such as "transport", as
+// XML, or nil when there is none.
+func (c Content) Element(local string) []byte {
+	dec := xml.NewDecoder(bytes.NewReader(c.Description))
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if err := dec.Skip(); err != nil {
+			return nil
+		}
+		if start.Name.Local == local {
+			return c.Description[offset:dec.InputOffset()]
+		}
+	}
+}
+
+// WithTransport returns a copy of c whose transport is replaced by
+// transport, which is already XML.
+func (c Content) WithTransport(transport []byte) Content {
+	out := c
+	out.Description = nil
+	if desc := c.Element("description"); desc != nil {
+		out.Description = append(out.Description, desc...)
+	}
+	out.Description = append(out.Description, transport...)
+	return out
+}
+
+func (c Content) childNS(local string) string {
+	dec := xml.NewDecoder(bytes.NewReader(c.Description))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == local {
+			return start.Name.Space
+		}
+		if err := dec.Skip(); err != nil {
+			return ""
+		}
+	}
+}
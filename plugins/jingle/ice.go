@@ -0,0 +1,102 @@
+package jingle
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"strconv"
+)
+
+// ICE candidate types (RFC 8445 §5.1.1)
+const (
+	CandidateHost  = "host"
+	CandidatePrflx = "prflx"
+	CandidateSrflx = "srflx"
+	CandidateRelay = "relay"
+)
+
+// ICE components of an RTP session (XEP-0176 §5.2)
+const (
+	ComponentRTP  = 1
+	ComponentRTCP = 2
+)
+
+// DTLS setup roles (XEP-0320 §3)
+const (
+	SetupActive  = "active"
+	SetupPassive = "passive"
+	SetupActPass = "actpass"
+)
+
+// NewICEUDPTransport returns an ICE-UDP transport description with fresh
+// ICE credentials and no candidates yet. The credentials are long enough
+// for RFC 8445 §5.3.
+func NewICEUDPTransport() *ICEUDPTransport {
+	return &ICEUDPTransport{Ufrag: randomICEString(8), Pwd: randomICEString(24)}
+}
+
+// AddCandidate adds c to the transport. Fields left zero are filled in:
+// the type defaults to host, the protocol to UDP, the priority follows
+// RFC 8445 §5.1.2.1 with a local preference that favours earlier
+// candidates, and the foundation is shared by candidates of the same type
+// and base address. A missing ID is generated.
+func (t *ICEUDPTransport) AddCandidate(c Candidate) {
+	if c.Type == "" {
+		c.Type = CandidateHost
+	}
+	if c.Protocol == "" {
+		c.Protocol = "udp"
+	}
+	if c.Component == 0 {
+		c.Component = ComponentRTP
+	}
+	if c.Priority == 0 {
+		c.Priority = CandidatePriority(c.Type, 65535-len(t.Candidates), c.Component)
+	}
+	if c.Foundation == "" {
+		base := c.IP
+		if c.Type != CandidateHost && c.RelAddr != "" {
+			base = c.RelAddr
+		}
+		c.Foundation = strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(c.Type+" "+base+" "+c.Protocol))), 10)
+	}
+	if c.ID == "" {
+		c.ID = randomICEString(10)
+	}
+	t.Candidates = append(t.Candidates, c)
+}
+
+// SetFingerprint adds the DTLS certificate fingerprint the peer checks the
+// handshake against (XEP-0320), with hash naming the algorithm, such as
+// "sha-256", and setup the DTLS role.
+func (t *ICEUDPTransport) SetFingerprint(hash, setup, value string) {
+	t.Fingerprint = &Fingerprint{Hash: hash, Setup: setup, Value: value}
+}
+
+// CandidatePriority returns the priority of a candidate of type typ for
+// component, with localPref between 0 and 65535 ranking candidates of
+// the same type (RFC 8445 §5.1.2.1).
+func CandidatePriority(typ string, localPref, component int) int {
+	var typePref int
+	switch typ {
+	case CandidateHost:
+		typePref = 126
+	case CandidatePrflx:
+		typePref = 110
+	case CandidateSrflx:
+		typePref = 100
+	}
+	localPref = min(max(localPref, 0), 65535)
+	return typePref<<24 + localPref<<8 + (256 - component)
+}
+
+// iceChars are the characters of ice-char (RFC 8839 §5.4).
+const iceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func randomICEString(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = iceChars[int(b[i])%len(iceChars)]
+	}
+	return string(b)
+}
@@ -4,6 +4,7 @@ package jingle
 import (
 	"context"
 	"encoding/xml"
+	"sync"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -46,12 +47,84 @@ type Content struct {
 	Description []byte   `xml:",innerxml"`
 }
 
+// Reason conditions (XEP-0166 §7.4)
+const (
+	ReasonAlternativeSession      = "alternative-session"
+	ReasonBusy                    = "busy"
+	ReasonCancel                  = "cancel"
+	ReasonConnectivityError       = "connectivity-error"
+	ReasonDecline                 = "decline"
+	ReasonExpired                 = "expired"
+	ReasonFailedApplication       = "failed-application"
+	ReasonFailedTransport         = "failed-transport"
+	ReasonGeneralError            = "general-error"
+	ReasonGone                    = "gone"
+	ReasonIncompatibleParameters  = "incompatible-parameters"
+	ReasonMediaError              = "media-error"
+	ReasonSecurityError           = "security-error"
+	ReasonSuccess                 = "success"
+	ReasonTimeout                 = "timeout"
+	ReasonUnsupportedApplications = "unsupported-applications"
+	ReasonUnsupportedTransports   = "unsupported-transports"
+)
+
+// Reason says why a session or transport ended. The condition is written
+// as an empty child element.
 type Reason struct {
 	XMLName   xml.Name `xml:"reason"`
 	Condition string   `xml:"-"`
 	Text      string   `xml:"text,omitempty"`
 }
 
+func (r Reason) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "reason"}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if r.Condition != "" {
+		cond := xml.StartElement{Name: xml.Name{Local: r.Condition}}
+		if err := enc.EncodeToken(cond); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(cond.End()); err != nil {
+			return err
+		}
+	}
+	if r.Text != "" {
+		if err := enc.EncodeElement(r.Text, xml.StartElement{Name: xml.Name{Local: "text"}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func (r *Reason) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	r.XMLName = start.Name
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "text" {
+				if err := dec.DecodeElement(&r.Text, &t); err != nil {
+					return err
+				}
+				continue
+			}
+			if r.Condition == "" {
+				r.Condition = t.Name.Local
+			}
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
 // RTP Description (XEP-0167)
 type RTPDescription struct {
 	XMLName      xml.Name      `xml:"urn:xmpp:jingle:apps:rtp:1 description"`
@@ -156,8 +229,15 @@ type Proceed struct {
 	ID      string   `xml:"id,attr"`
 }
 
+// Plugin manages the Jingle sessions of a client. Incoming requests are
+// passed to HandleIQ; sessions peers initiate go to the Application
+// registered for their description.
 type Plugin struct {
 	params plugin.InitParams
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	apps     map[string]Application
 }
 
 func New() *Plugin { return &Plugin{} }
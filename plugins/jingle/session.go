@@ -0,0 +1,405 @@
+package jingle
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	// ErrNotConnected is returned when the plugin was not initialized by a
+	// client, which is needed to send Jingle requests.
+	ErrNotConnected = errors.New("jingle: not connected")
+	// ErrSessionEnded is returned for actions on a terminated session.
+	ErrSessionEnded = errors.New("jingle: session ended")
+	// ErrOutOfOrder is returned for an action the session is not in the
+	// state for, such as accepting a session twice.
+	ErrOutOfOrder = errors.New("jingle: action out of order")
+)
+
+// State is the stage of the lifecycle of a session (XEP-0166 §6).
+type State int
+
+const (
+	// StatePending is a session initiated but not accepted yet.
+	StatePending State = iota
+	// StateActive is an accepted session.
+	StateActive
+	// StateEnded is a terminated session.
+	StateEnded
+)
+
+func (s State) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateEnded:
+		return "ended"
+	default:
+		return "pending"
+	}
+}
+
+// Handler is called with every action the peer of a session sends after
+// the session-initiate, including the session-terminate. An error, for
+// which a *stanza.StanzaError is used as it is, is returned to the peer.
+// It must not block, as the reply is sent once it returns.
+type Handler func(ctx context.Context, s *Session, j *Jingle) error
+
+// Application takes the sessions peers initiate with a description in its
+// namespace. It sets the Handler of s and may accept or terminate s later.
+// An error is returned to the initiator and the session is dropped.
+type Application func(ctx context.Context, s *Session) error
+
+// Session is one Jingle session between the local entity and a peer.
+type Session struct {
+	SID       string
+	Initiator jid.JID
+	Responder jid.JID
+
+	plugin *Plugin
+	local  bool // the local entity initiated the session
+
+	mu       sync.Mutex
+	state    State
+	contents []Content
+	reason   *Reason
+	handler  Handler
+}
+
+// Peer returns the other party of the session.
+func (s *Session) Peer() jid.JID {
+	if s.local {
+		return s.Responder
+	}
+	return s.Initiator
+}
+
+// IsInitiator reports whether the local entity initiated the session.
+func (s *Session) IsInitiator() bool { return s.local }
+
+// State returns the stage the session is in.
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Contents returns the contents of the session as last negotiated.
+func (s *Session) Contents() []Content {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Content(nil), s.contents...)
+}
+
+// Content returns the content named name.
+func (s *Session) Content(name string) (Content, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.contents {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Content{}, false
+}
+
+// Reason returns why the session was terminated, or nil while it is not.
+func (s *Session) Reason() *Reason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// Handle sets the function called with the actions the peer sends.
+func (s *Session) Handle(h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = h
+}
+
+// Accept accepts a session the peer initiated with contents, or with the
+// offered contents when none are given.
+func (s *Session) Accept(ctx context.Context, contents ...Content) error {
+	s.mu.Lock()
+	if s.local || s.state != StatePending {
+		s.mu.Unlock()
+		return ErrOutOfOrder
+	}
+	if len(contents) == 0 {
+		contents = s.contents
+	}
+	s.mu.Unlock()
+	if err := s.send(ctx, &Jingle{Action: ActionSessionAccept, Responder: s.Responder.String(), Contents: contents}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == StatePending {
+		s.state, s.contents = StateActive, contents
+	}
+	return nil
+}
+
+// Terminate ends the session with the reason condition, such as
+// ReasonSuccess or ReasonDecline. The session ends even when the peer
+// cannot be told.
+func (s *Session) Terminate(ctx context.Context, condition, text string) error {
+	reason := &Reason{Condition: condition, Text: text}
+	if !s.end(reason) {
+		return ErrSessionEnded
+	}
+	return s.send(ctx, &Jingle{Action: ActionSessionTerminate, Reason: reason})
+}
+
+// Send sends an action other than session-initiate, session-accept and
+// session-terminate, such as transport-info or transport-replace, for
+// contents. A transport-accept also makes its transports the negotiated
+// ones.
+func (s *Session) Send(ctx context.Context, action string, contents ...Content) error {
+	switch action {
+	case ActionSessionInitiate, ActionSessionAccept, ActionSessionTerminate:
+		return fmt.Errorf("jingle: %s is not sent with Send", action)
+	}
+	if s.State() == StateEnded {
+		return ErrSessionEnded
+	}
+	if err := s.send(ctx, &Jingle{Action: action, Contents: contents}); err != nil {
+		return err
+	}
+	if action == ActionTransportAccept {
+		s.replaceTransports(contents)
+	}
+	return nil
+}
+
+func (s *Session) send(ctx context.Context, j *Jingle) error {
+	j.SID = s.SID
+	return s.plugin.send(ctx, s.Peer(), j)
+}
+
+// end marks the session ended and reports whether it was not already.
+func (s *Session) end(reason *Reason) bool {
+	s.mu.Lock()
+	if s.state == StateEnded {
+		s.mu.Unlock()
+		return false
+	}
+	s.state, s.reason = StateEnded, reason
+	s.mu.Unlock()
+	s.plugin.forget(s)
+	return true
+}
+
+// replaceTransports makes the transports of contents those of the
+// session's contents of the same names.
+func (s *Session) replaceTransports(contents []Content) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range contents {
+		transport := c.Element("transport")
+		for i := range s.contents {
+			if s.contents[i].Name == c.Name && transport != nil {
+				s.contents[i] = s.contents[i].WithTransport(transport)
+			}
+		}
+	}
+}
+
+// handle applies an action of the peer to the session and passes it on
+// to the handler.
+func (s *Session) handle(ctx context.Context, j *Jingle) error {
+	s.mu.Lock()
+	switch j.Action {
+	case ActionSessionAccept:
+		if !s.local || s.state != StatePending {
+			s.mu.Unlock()
+			return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorUnexpectedRequest, "out-of-order")
+		}
+		s.state = StateActive
+		if len(j.Contents) > 0 {
+			s.contents = j.Contents
+		}
+	}
+	h := s.handler
+	s.mu.Unlock()
+
+	switch j.Action {
+	case ActionSessionTerminate:
+		s.end(j.Reason)
+	case ActionTransportAccept:
+		s.replaceTransports(j.Contents)
+	}
+	if h == nil {
+		return nil
+	}
+	return h(ctx, s, j)
+}
+
+// RegisterApplication sets the function that takes the sessions peers
+// initiate with a description in namespace space.
+func (p *Plugin) RegisterApplication(space string, app Application) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.apps == nil {
+		p.apps = make(map[string]Application)
+	}
+	p.apps[space] = app
+}
+
+// Initiate starts a session with peer for contents. The session is
+// pending until the peer accepts it, which the handler set with
+// Session.Handle is told about.
+func (p *Plugin) Initiate(ctx context.Context, peer jid.JID, contents ...Content) (*Session, error) {
+	s, err := p.NewSession(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Initiate(ctx, contents...); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSession returns a session with peer that is not initiated yet, so
+// that its handler can be set and its contents built with its ID first.
+func (p *Plugin) NewSession(peer jid.JID) (*Session, error) {
+	if p.params.SendIQ == nil || p.params.LocalJID == nil {
+		return nil, ErrNotConnected
+	}
+	local, err := jid.Parse(p.params.LocalJID())
+	if err != nil {
+		return nil, fmt.Errorf("jingle: local address: %w", err)
+	}
+	return &Session{SID: stanza.GenerateID(), Initiator: local, Responder: peer, plugin: p, local: true}, nil
+}
+
+// Initiate sends the session-initiate of a session from NewSession.
+func (s *Session) Initiate(ctx context.Context, contents ...Content) error {
+	s.mu.Lock()
+	if !s.local || s.state != StatePending || s.contents != nil {
+		s.mu.Unlock()
+		return ErrOutOfOrder
+	}
+	s.contents = contents
+	s.mu.Unlock()
+	s.plugin.track(s)
+	if err := s.send(ctx, &Jingle{Action: ActionSessionInitiate, Initiator: s.Initiator.String(), Contents: contents}); err != nil {
+		s.end(nil)
+		return err
+	}
+	return nil
+}
+
+// Session returns the session with peer identified by sid.
+func (p *Plugin) Session(peer jid.JID, sid string) (*Session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[sessionKey(peer, sid)]
+	return s, ok
+}
+
+// HandleIQ processes a Jingle request from a peer and returns the reply,
+// or nil when iq is not one.
+func (p *Plugin) HandleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var j Jingle
+	if err := xml.Unmarshal(iq.Query, &j); err != nil {
+		return nil
+	}
+	if j.SID == "" || j.Action == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "missing sid or action"))
+	}
+	if j.Action == ActionSessionInitiate {
+		return p.initiated(ctx, iq, &j)
+	}
+	s, ok := p.Session(iq.From, j.SID)
+	if !ok {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "unknown-session"))
+	}
+	if err := s.handle(ctx, &j); err != nil {
+		return iq.ErrorIQ(stanzaError(err))
+	}
+	return iq.ResultIQ()
+}
+
+// initiated takes a session-initiate from a peer.
+func (p *Plugin) initiated(ctx context.Context, iq *stanza.IQ, j *Jingle) *stanza.IQ {
+	if _, ok := p.Session(iq.From, j.SID); ok {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorConflict, "session exists"))
+	}
+	if len(j.Contents) == 0 {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "no content"))
+	}
+	p.mu.Lock()
+	app := p.apps[j.Contents[0].DescriptionNS()]
+	p.mu.Unlock()
+	if app == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorFeatureNotImplemented, ReasonUnsupportedApplications))
+	}
+
+	// The initiator attribute is advisory; the sender is the initiator.
+	s := &Session{SID: j.SID, Initiator: iq.From, Responder: iq.To, plugin: p, contents: j.Contents}
+	if s.Responder.IsZero() && p.params.LocalJID != nil {
+		s.Responder, _ = jid.Parse(p.params.LocalJID())
+	}
+	p.track(s)
+	if err := app(ctx, s); err != nil {
+		p.forget(s)
+		return iq.ErrorIQ(stanzaError(err))
+	}
+	return iq.ResultIQ()
+}
+
+func (p *Plugin) send(ctx context.Context, to jid.JID, j *Jingle) error {
+	if p.params.SendIQ == nil {
+		return ErrNotConnected
+	}
+	data, err := xml.Marshal(j)
+	if err != nil {
+		return err
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.To, iq.Query = to, data
+	_, err = p.params.SendIQ(ctx, iq)
+	return err
+}
+
+func (p *Plugin) track(s *Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[string]*Session)
+	}
+	p.sessions[sessionKey(s.Peer(), s.SID)] = s
+}
+
+func (p *Plugin) forget(s *Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := sessionKey(s.Peer(), s.SID)
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+	}
+}
+
+// sessionKey identifies a session by its peer as well as its ID, which
+// the initiator chooses.
+func sessionKey(peer jid.JID, sid string) string {
+	return peer.String() + " " + sid
+}
+
+func stanzaError(err error) *stanza.StanzaError {
+	var se *stanza.StanzaError
+	if errors.As(err, &se) {
+		return se
+	}
+	return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorUndefinedCondition, err.Error())
+}
@@ -0,0 +1,250 @@
+package jingle
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	romeo  = jid.MustParse("romeo@example.com/orchard")
+	juliet = jid.MustParse("juliet@example.com/balcony")
+)
+
+// connect returns the plugins of romeo and juliet, whose requests reach
+// each other's HandleIQ.
+func connect(t *testing.T) (*Plugin, *Plugin) {
+	t.Helper()
+	a, b := New(), New()
+	link := func(p *Plugin, local jid.JID, peer func() *Plugin) {
+		err := p.Initialize(context.Background(), plugin.InitParams{
+			LocalJID: local.String,
+			SendIQ: func(ctx context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+				req := *iq
+				req.From = local
+				reply := peer().HandleIQ(ctx, &req)
+				if reply == nil {
+					return nil, errors.New("no reply")
+				}
+				if reply.Error != nil {
+					return reply, reply.Error
+				}
+				return reply, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	link(a, romeo, func() *Plugin { return b })
+	link(b, juliet, func() *Plugin { return a })
+	return a, b
+}
+
+// recorder collects the actions a session handler sees.
+type recorder struct {
+	mu      sync.Mutex
+	actions []string
+}
+
+func (r *recorder) handle(_ context.Context, _ *Session, j *Jingle) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions = append(r.actions, j.Action)
+	return nil
+}
+
+func (r *recorder) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.actions...)
+}
+
+func testContent(t *testing.T) Content {
+	t.Helper()
+	transport := NewICEUDPTransport()
+	transport.AddCandidate(Candidate{IP: "192.0.2.1", Port: 5000})
+	c, err := NewContent(CreatorInitiator, "voice", RTPDescription{Media: "audio"}, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	ctx := context.Background()
+	a, b := connect(t)
+	var remote *Session
+	var responder recorder
+	b.RegisterApplication(ns.JingleRTP, func(_ context.Context, s *Session) error {
+		remote = s
+		s.Handle(responder.handle)
+		return nil
+	})
+
+	var initiator recorder
+	s, err := a.Initiate(ctx, juliet, testContent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle(initiator.handle)
+	if remote == nil || remote.SID != s.SID || !remote.Peer().Equal(romeo) || remote.IsInitiator() {
+		t.Fatalf("responder session %+v", remote)
+	}
+	if remote.State() != StatePending || len(remote.Contents()) != 1 {
+		t.Fatalf("responder state %s, contents %d", remote.State(), len(remote.Contents()))
+	}
+	if err := s.Accept(ctx); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("initiator accepted: %v", err)
+	}
+
+	if err := remote.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.State() != StateActive || remote.State() != StateActive {
+		t.Fatalf("states after accept: %s, %s", s.State(), remote.State())
+	}
+	if err := remote.Accept(ctx); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("accepted twice: %v", err)
+	}
+
+	info, _ := NewContent(CreatorInitiator, "voice", nil, ICEUDPTransport{Candidates: []Candidate{{IP: "198.51.100.7", Port: 6000, Type: CandidateSrflx}}})
+	if err := s.Send(ctx, ActionTransportInfo, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Terminate(ctx, ReasonSuccess, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if s.State() != StateEnded || s.Reason() == nil || s.Reason().Condition != ReasonSuccess || s.Reason().Text != "bye" {
+		t.Fatalf("initiator after terminate: %s, %+v", s.State(), s.Reason())
+	}
+	if _, ok := a.Session(juliet, s.SID); ok {
+		t.Fatal("ended session still tracked")
+	}
+	if err := s.Send(ctx, ActionSessionInfo); !errors.Is(err, ErrSessionEnded) {
+		t.Fatalf("send after end: %v", err)
+	}
+	if got := initiator.seen(); len(got) != 2 || got[0] != ActionSessionAccept || got[1] != ActionSessionTerminate {
+		t.Fatalf("initiator saw %v", got)
+	}
+	if got := responder.seen(); len(got) != 1 || got[0] != ActionTransportInfo {
+		t.Fatalf("responder saw %v", got)
+	}
+}
+
+func TestHandleIQErrors(t *testing.T) {
+	ctx := context.Background()
+	a, b := connect(t)
+
+	if _, err := a.Initiate(ctx, juliet, testContent(t)); err == nil {
+		t.Fatal("session without an application was taken")
+	}
+	b.RegisterApplication(ns.JingleRTP, func(context.Context, *Session) error {
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAcceptable, "")
+	})
+	var se *stanza.StanzaError
+	if _, err := a.Initiate(ctx, juliet, testContent(t)); !errors.As(err, &se) || se.Condition != stanza.ErrorNotAcceptable {
+		t.Fatalf("refused session: %v", err)
+	}
+
+	data, _ := xml.Marshal(Jingle{Action: ActionTransportInfo, SID: "nope"})
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.From, iq.Query = romeo, data
+	if reply := b.HandleIQ(ctx, iq); reply.Error == nil || reply.Error.Condition != stanza.ErrorItemNotFound {
+		t.Fatalf("unknown session: %+v", reply.Error)
+	}
+	iq.Query = []byte(`<ping xmlns='urn:xmpp:ping'/>`)
+	if b.HandleIQ(ctx, iq) != nil {
+		t.Fatal("ping was handled")
+	}
+	if _, err := New().Initiate(ctx, juliet); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("unconnected initiate: %v", err)
+	}
+}
+
+func TestTransportReplace(t *testing.T) {
+	ctx := context.Background()
+	a, b := connect(t)
+	b.RegisterApplication(ns.JingleRTP, func(_ context.Context, s *Session) error {
+		s.Handle(func(ctx context.Context, s *Session, j *Jingle) error {
+			if j.Action == ActionTransportReplace {
+				go s.Send(context.WithoutCancel(ctx), ActionTransportAccept, j.Contents...)
+			}
+			return nil
+		})
+		return s.Accept(context.WithoutCancel(ctx))
+	})
+	accepted := make(chan []Content, 1)
+	s, err := a.Initiate(ctx, juliet, testContent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Handle(func(_ context.Context, _ *Session, j *Jingle) error {
+		if j.Action == ActionTransportAccept {
+			accepted <- j.Contents
+		}
+		return nil
+	})
+	raw, _ := NewContent(CreatorInitiator, "voice", nil, RawUDPTransport{Candidates: []RawCandidate{{IP: "192.0.2.9", Port: 7000}}})
+	if err := s.Send(ctx, ActionTransportReplace, raw); err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	c, _ := s.Content("voice")
+	if c.TransportNS() != ns.JingleRawUDP || c.DescriptionNS() != ns.JingleRTP {
+		t.Fatalf("content after replace: %s", c.Description)
+	}
+}
+
+func TestReasonXML(t *testing.T) {
+	data, err := xml.Marshal(Jingle{Action: ActionSessionTerminate, SID: "s1", Reason: &Reason{Condition: ReasonDecline, Text: "busy now"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j Jingle
+	if err := xml.Unmarshal(data, &j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Reason == nil || j.Reason.Condition != ReasonDecline || j.Reason.Text != "busy now" {
+		t.Fatalf("reason = %+v from %s", j.Reason, data)
+	}
+}
+
+func TestICEUDPTransport(t *testing.T) {
+	tr := NewICEUDPTransport()
+	if len(tr.Ufrag) < 4 || len(tr.Pwd) < 22 {
+		t.Fatalf("credentials %q %q", tr.Ufrag, tr.Pwd)
+	}
+	tr.AddCandidate(Candidate{IP: "192.0.2.1", Port: 5000})
+	tr.AddCandidate(Candidate{IP: "192.0.2.1", Port: 5001, Component: ComponentRTCP})
+	tr.AddCandidate(Candidate{IP: "203.0.113.4", Port: 6000, Type: CandidateSrflx, RelAddr: "192.0.2.1", RelPort: 5000})
+	tr.SetFingerprint("sha-256", SetupActPass, "AB:CD")
+	host, rtcp, srflx := tr.Candidates[0], tr.Candidates[1], tr.Candidates[2]
+	if host.Priority != CandidatePriority(CandidateHost, 65535, 1) || host.Protocol != "udp" || host.ID == "" {
+		t.Fatalf("host candidate %+v", host)
+	}
+	if host.Foundation != rtcp.Foundation || host.Foundation == srflx.Foundation {
+		t.Fatalf("foundations %s %s %s", host.Foundation, rtcp.Foundation, srflx.Foundation)
+	}
+	if !(host.Priority > rtcp.Priority && rtcp.Priority > srflx.Priority) {
+		t.Fatalf("priorities %d %d %d", host.Priority, rtcp.Priority, srflx.Priority)
+	}
+	c, err := NewContent(CreatorInitiator, "voice", RTPDescription{Media: "audio"}, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ICEUDPTransport
+	if err := c.Decode(&got); err != nil || len(got.Candidates) != 3 || got.Fingerprint == nil || got.Fingerprint.Setup != SetupActPass {
+		t.Fatalf("decoded %+v, %v", got, err)
+	}
+	if err := c.Decode(&RawUDPTransport{}); !errors.Is(err, ErrNoElement) {
+		t.Fatalf("decode of a missing transport: %v", err)
+	}
+}
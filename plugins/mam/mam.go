@@ -74,18 +74,32 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-// StoreMessage archives a message. Returns nil if no store is configured.
+// StorageAvailable reports whether the configured storage provides a
+// MAMStore. It implements plugin.StorageUser.
+func (p *Plugin) StorageAvailable() bool { return p.store != nil }
+
+// StoreMessage archives a message. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) StoreMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.ArchiveMessage(ctx, msg)
 }
 
-// QueryMessages queries the message archive. Returns nil result if no store is configured.
+// StoreMessages archives several messages in one storage operation, for
+// example to import an archive. Returns storage.ErrStorageUnavailable if no
+// store is configured.
+func (p *Plugin) StoreMessages(ctx context.Context, msgs []*storage.ArchivedMessage) error {
+	if p.store == nil {
+		return storage.ErrStorageUnavailable
+	}
+	return p.store.ArchiveMessages(ctx, msgs)
+}
+
+// QueryMessages queries the message archive. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
 	if p.store == nil {
-		return &storage.MAMResult{Complete: true}, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.QueryMessages(ctx, query)
 }
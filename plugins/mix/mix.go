@@ -44,6 +44,14 @@ type Participant struct {
 	JID     string   `xml:"jid,omitempty"`
 }
 
+// Mix annotates the messages and presence a channel distributes with the
+// sender's nick and bare JID.
+type Mix struct {
+	XMLName xml.Name `xml:"urn:xmpp:mix:core:1 mix"`
+	Nick    string   `xml:"nick,omitempty"`
+	JID     string   `xml:"jid,omitempty"`
+}
+
 type SetNick struct {
 	XMLName xml.Name `xml:"urn:xmpp:mix:core:1 setnick"`
 	Nick    string   `xml:"nick"`
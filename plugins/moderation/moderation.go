@@ -27,6 +27,20 @@ type Moderated struct {
 	By      string   `xml:"by,attr"`
 }
 
+type Retraction struct {
+	XMLName   xml.Name `xml:"urn:xmpp:message-retract:1 retract"`
+	ID        string   `xml:"id,attr"`
+	Moderated *Moderated
+	Reason    string `xml:"reason,omitempty"`
+}
+
+type Retracted struct {
+	XMLName   xml.Name `xml:"urn:xmpp:message-retract:1 retracted"`
+	Stamp     string   `xml:"stamp,attr,omitempty"`
+	Moderated *Moderated
+	Reason    string `xml:"reason,omitempty"`
+}
+
 type Plugin struct {
 	params plugin.InitParams
 }
@@ -45,11 +45,13 @@ type History struct {
 }
 
 type UserX struct {
-	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
-	Items   []UserItem  `xml:"item"`
-	Status  []Status    `xml:"status"`
-	Invite  []Invite    `xml:"invite"`
-	Decline *Decline    `xml:"decline,omitempty"`
+	XMLName  xml.Name   `xml:"http://jabber.org/protocol/muc#user x"`
+	Items    []UserItem `xml:"item"`
+	Status   []Status   `xml:"status"`
+	Invite   []Invite   `xml:"invite"`
+	Decline  *Decline   `xml:"decline,omitempty"`
+	Destroy  *Destroy   `xml:"destroy,omitempty"`
+	Password string     `xml:"password,omitempty"`
 }
 
 type UserItem struct {
@@ -80,6 +82,13 @@ type Decline struct {
 	Reason  string   `xml:"reason,omitempty"`
 }
 
+// Destroy tells occupants that the room is gone, and where to go instead.
+type Destroy struct {
+	XMLName xml.Name `xml:"destroy"`
+	JID     string   `xml:"jid,attr,omitempty"`
+	Reason  string   `xml:"reason,omitempty"`
+}
+
 type AdminQuery struct {
 	XMLName xml.Name   `xml:"http://jabber.org/protocol/muc#admin query"`
 	Items   []UserItem `xml:"item"`
@@ -98,17 +107,23 @@ type DirectInvite struct {
 	Reason   string   `xml:"reason,attr,omitempty"`
 }
 
-type Room struct {
-	JID     string
-	Nick    string
-	Joined  bool
+// RoomEntry is a room recorded with JoinRoom.
+type RoomEntry struct {
+	JID    string
+	Nick   string
+	Joined bool
 }
 
 type Plugin struct {
 	mu     sync.RWMutex
-	rooms  map[string]*Room // in-memory fallback
+	rooms  map[string]*RoomEntry // in-memory fallback
 	store  storage.MUCRoomStore
 	params plugin.InitParams
+
+	// active are the rooms of the client, by bare JID.
+	active map[string]*Room
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func New() *Plugin {
@@ -117,17 +132,50 @@ func New() *Plugin {
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
-func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+
+// Initialize sets the plugin up for a session. On a client, the rooms that
+// were joined on a previous session are joined again, asking for the
+// history missed since.
+func (p *Plugin) Initialize(ctx context.Context, params plugin.InitParams) error {
+	p.mu.Lock()
 	p.params = params
 	if params.Storage != nil {
 		p.store = params.Storage.MUCRoomStore()
 	}
-	if p.store == nil {
-		p.rooms = make(map[string]*Room)
+	if p.store == nil && p.rooms == nil {
+		p.rooms = make(map[string]*RoomEntry)
+	}
+	if p.cancel != nil {
+		p.cancel()
+		p.ctx, p.cancel = nil, nil
+	}
+	var rejoin []*Room
+	if params.SendIQ != nil {
+		p.ctx, p.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		for _, r := range p.active {
+			if r.Rejoins() {
+				rejoin = append(rejoin, r)
+			}
+		}
+	}
+	rctx := p.ctx
+	p.mu.Unlock()
+	for _, r := range rejoin {
+		go r.rejoin(rctx)
 	}
 	return nil
 }
-func (p *Plugin) Close() error           { return nil }
+
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.ctx, p.cancel = nil, nil
+	}
+	return nil
+}
+
 func (p *Plugin) Dependencies() []string { return nil }
 
 func (p *Plugin) JoinRoom(ctx context.Context, roomJID, nick string) error {
@@ -144,7 +192,7 @@ func (p *Plugin) JoinRoom(ctx context.Context, roomJID, nick string) error {
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.rooms[roomJID] = &Room{JID: roomJID, Nick: nick, Joined: true}
+	p.rooms[roomJID] = &RoomEntry{JID: roomJID, Nick: nick, Joined: true}
 	return nil
 }
 
@@ -158,7 +206,7 @@ func (p *Plugin) LeaveRoom(ctx context.Context, roomJID string) error {
 	return nil
 }
 
-func (p *Plugin) GetRoom(ctx context.Context, roomJID string) (*Room, bool, error) {
+func (p *Plugin) GetRoom(ctx context.Context, roomJID string) (*RoomEntry, bool, error) {
 	if p.store != nil {
 		room, err := p.store.GetRoom(ctx, roomJID)
 		if err != nil {
@@ -167,7 +215,7 @@ func (p *Plugin) GetRoom(ctx context.Context, roomJID string) (*Room, bool, erro
 			}
 			return nil, false, err
 		}
-		return &Room{JID: room.RoomJID, Nick: room.Name, Joined: true}, true, nil
+		return &RoomEntry{JID: room.RoomJID, Nick: room.Name, Joined: true}, true, nil
 	}
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -175,21 +223,21 @@ func (p *Plugin) GetRoom(ctx context.Context, roomJID string) (*Room, bool, erro
 	return r, ok, nil
 }
 
-func (p *Plugin) Rooms(ctx context.Context) ([]*Room, error) {
+func (p *Plugin) Rooms(ctx context.Context) ([]*RoomEntry, error) {
 	if p.store != nil {
 		mucRooms, err := p.store.ListRooms(ctx)
 		if err != nil {
 			return nil, err
 		}
-		rooms := make([]*Room, len(mucRooms))
+		rooms := make([]*RoomEntry, len(mucRooms))
 		for i, r := range mucRooms {
-			rooms[i] = &Room{JID: r.RoomJID, Nick: r.Name, Joined: true}
+			rooms[i] = &RoomEntry{JID: r.RoomJID, Nick: r.Name, Joined: true}
 		}
 		return rooms, nil
 	}
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	rooms := make([]*Room, 0, len(p.rooms))
+	rooms := make([]*RoomEntry, 0, len(p.rooms))
 	for _, r := range p.rooms {
 		rooms = append(rooms, r)
 	}
@@ -0,0 +1,491 @@
+package muc
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Status codes of muc#user presence and messages the client acts on.
+const (
+	StatusSelf         = 110
+	StatusNickAssigned = 210
+	StatusBanned       = 301
+	StatusNickChanged  = 303
+	StatusKicked       = 307
+	StatusShutdown     = 332
+)
+
+var (
+	// ErrNotConnected is returned when a stanza has to be sent but the
+	// plugin was not initialized by a client.
+	ErrNotConnected = errors.New("muc: not connected")
+	// ErrNotJoined is returned when sending to a room that was not joined.
+	ErrNotJoined = errors.New("muc: room not joined")
+)
+
+// JoinOptions are the options of Room.Join.
+type JoinOptions struct {
+	// Password is the password of a password-protected room.
+	Password string
+	// History limits the discussion history the room sends on joining;
+	// nil leaves it to the room.
+	History *History
+}
+
+// HistoryMaxStanzas asks for at most n messages of history; 0 asks for
+// none.
+func HistoryMaxStanzas(n int) *History { return &History{MaxStanzas: &n} }
+
+// HistorySeconds asks for the history of the last n seconds.
+func HistorySeconds(n int) *History { return &History{Seconds: &n} }
+
+// HistorySince asks for the history since t.
+func HistorySince(t time.Time) *History {
+	return &History{Since: t.UTC().Format(time.RFC3339)}
+}
+
+// Occupant is an occupant of a room, as of its last presence.
+type Occupant struct {
+	Nick string
+	// JID is the real JID of the occupant, when the room discloses it.
+	JID         jid.JID
+	Affiliation string
+	Role        string
+	Show        string
+	Status      string
+}
+
+// Room is a room of the client, joined with Join. The plugin tracks its
+// occupants and subject from the presence and messages passed to
+// HandlePresence and HandleMessage, and joins it again when the client
+// reconnects, asking for the history missed meanwhile.
+type Room struct {
+	p    *Plugin
+	addr jid.JID
+
+	mu        sync.Mutex
+	nick      string
+	opts      JoinOptions
+	joined    bool
+	want      bool // join again on the next session
+	pending   chan error
+	occupants map[string]Occupant
+	subject   string
+	lastSeen  time.Time
+
+	onJoined  func(context.Context, Occupant)
+	onLeft    func(context.Context, Occupant)
+	onNick    func(ctx context.Context, o Occupant, newNick string)
+	onMessage func(context.Context, *stanza.Message)
+}
+
+// Room returns the room at addr, which is created on first use. The same
+// *Room is returned for every call with the same bare JID.
+func (p *Plugin) Room(addr jid.JID) *Room {
+	addr = addr.Bare()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.active[addr.String()]; ok {
+		return r
+	}
+	if p.active == nil {
+		p.active = make(map[string]*Room)
+	}
+	r := &Room{p: p, addr: addr, occupants: make(map[string]Occupant)}
+	p.active[addr.String()] = r
+	return r
+}
+
+func (p *Plugin) lookup(addr jid.JID) *Room {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.active[addr.Bare().String()]
+}
+
+func (p *Plugin) send(ctx context.Context, v any) error {
+	p.mu.RLock()
+	send := p.params.SendElement
+	p.mu.RUnlock()
+	if send == nil {
+		return ErrNotConnected
+	}
+	return send(ctx, v)
+}
+
+func (p *Plugin) request(ctx context.Context, to jid.JID, q AdminQuery) error {
+	p.mu.RLock()
+	sendIQ := p.params.SendIQ
+	p.mu.RUnlock()
+	if sendIQ == nil {
+		return ErrNotConnected
+	}
+	data, err := xml.Marshal(q)
+	if err != nil {
+		return err
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.To, iq.Query = to, data
+	_, err = sendIQ(ctx, iq)
+	return err
+}
+
+func (p *Plugin) now() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return clock.Or(p.params.Clock).Now()
+}
+
+// JID returns the bare JID of the room.
+func (r *Room) JID() jid.JID { return r.addr }
+
+// Nick returns the nickname of the user in the room.
+func (r *Room) Nick() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nick
+}
+
+// Joined reports whether the user is in the room.
+func (r *Room) Joined() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.joined
+}
+
+// Subject returns the subject of the room.
+func (r *Room) Subject() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subject
+}
+
+// Occupants returns the occupants of the room, the user included, sorted
+// by nickname.
+func (r *Room) Occupants() []Occupant {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	occupants := make([]Occupant, 0, len(r.occupants))
+	for _, o := range r.occupants {
+		occupants = append(occupants, o)
+	}
+	slices.SortFunc(occupants, func(a, b Occupant) int { return strings.Compare(a.Nick, b.Nick) })
+	return occupants
+}
+
+// Occupant returns the occupant with the nickname nick.
+func (r *Room) Occupant(nick string) (Occupant, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.occupants[nick]
+	return o, ok
+}
+
+// OnOccupantJoined registers the callback invoked when an occupant enters
+// the room, the user included. The occupants already in the room are
+// reported on joining.
+func (r *Room) OnOccupantJoined(f func(ctx context.Context, o Occupant)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onJoined = f
+}
+
+// OnOccupantLeft registers the callback invoked when an occupant leaves
+// the room or is removed from it.
+func (r *Room) OnOccupantLeft(f func(ctx context.Context, o Occupant)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onLeft = f
+}
+
+// OnOccupantNickChanged registers the callback invoked when the occupant
+// o changes its nickname to newNick.
+func (r *Room) OnOccupantNickChanged(f func(ctx context.Context, o Occupant, newNick string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onNick = f
+}
+
+// OnMessage registers the callback invoked with the groupchat messages of
+// the room, history and subject changes included.
+func (r *Room) OnMessage(f func(ctx context.Context, msg *stanza.Message)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onMessage = f
+}
+
+// Join enters the room as nick and waits until the room reports the user
+// in, or refuses with the stanza error it returned. The room is joined
+// again after a reconnect until Leave is called or the user is removed.
+func (r *Room) Join(ctx context.Context, nick string, opts JoinOptions) error {
+	pending := make(chan error, 1)
+	r.mu.Lock()
+	r.nick, r.opts, r.want, r.pending = nick, opts, true, pending
+	r.joined = false
+	clear(r.occupants)
+	r.mu.Unlock()
+	if err := r.sendJoin(ctx, nick, opts); err != nil {
+		r.mu.Lock()
+		r.want, r.pending = false, nil
+		r.mu.Unlock()
+		return err
+	}
+	select {
+	case err := <-pending:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Room) sendJoin(ctx context.Context, nick string, opts JoinOptions) error {
+	to, err := jid.New(r.addr.Local(), r.addr.Domain(), nick)
+	if err != nil {
+		return err
+	}
+	x, err := stanza.NewExtension(MUC{Password: opts.Password, History: opts.History})
+	if err != nil {
+		return err
+	}
+	pres := stanza.NewPresence(stanza.PresenceAvailable)
+	pres.To = to
+	pres.Extensions = []stanza.Extension{x}
+	return r.p.send(ctx, pres)
+}
+
+// Rejoins reports whether the room is joined again after a reconnect,
+// which is the case from Join until Leave or the removal of the user.
+func (r *Room) Rejoins() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.want
+}
+
+// rejoin joins the room again on a new session, asking for the messages
+// since the last one received.
+func (r *Room) rejoin(ctx context.Context) {
+	r.mu.Lock()
+	nick, opts := r.nick, r.opts
+	if !r.lastSeen.IsZero() {
+		opts.History = HistorySince(r.lastSeen)
+	}
+	r.joined = false
+	clear(r.occupants)
+	r.mu.Unlock()
+	// Failures leave the room not joined; the next session tries again.
+	_ = r.sendJoin(ctx, nick, opts)
+}
+
+// Leave exits the room with an optional status message.
+func (r *Room) Leave(ctx context.Context, status string) error {
+	r.mu.Lock()
+	nick := r.nick
+	r.want = false
+	r.mu.Unlock()
+	to, err := jid.New(r.addr.Local(), r.addr.Domain(), nick)
+	if err != nil {
+		return err
+	}
+	pres := stanza.NewPresence(stanza.PresenceUnavailable)
+	pres.To, pres.Status = to, status
+	return r.p.send(ctx, pres)
+}
+
+// SendMessage sends body to the occupants of the room and returns the ID
+// of the message, which the room reflects back to the user.
+func (r *Room) SendMessage(ctx context.Context, body string) (string, error) {
+	if !r.Joined() {
+		return "", ErrNotJoined
+	}
+	msg := stanza.NewMessage(stanza.MessageGroupchat)
+	msg.To = r.addr
+	msg.SetBody(body)
+	return msg.ID, r.p.send(ctx, msg)
+}
+
+// SetSubject changes the subject of the room.
+func (r *Room) SetSubject(ctx context.Context, subject string) error {
+	if !r.Joined() {
+		return ErrNotJoined
+	}
+	msg := stanza.NewMessage(stanza.MessageGroupchat)
+	msg.To = r.addr
+	msg.SetSubject(subject)
+	return r.p.send(ctx, msg)
+}
+
+// Invite invites to to the room, through the room (a mediated
+// invitation).
+func (r *Room) Invite(ctx context.Context, to jid.JID, reason string) error {
+	x, err := stanza.NewExtension(UserX{Invite: []Invite{{To: to.String(), Reason: reason}}})
+	if err != nil {
+		return err
+	}
+	msg := stanza.NewMessage(stanza.MessageNormal)
+	msg.To = r.addr
+	msg.Extensions = []stanza.Extension{x}
+	return r.p.send(ctx, msg)
+}
+
+// Kick removes the occupant nick from the room.
+func (r *Room) Kick(ctx context.Context, nick, reason string) error {
+	return r.p.request(ctx, r.addr, AdminQuery{Items: []UserItem{{Nick: nick, Role: RoleNone, Reason: reason}}})
+}
+
+// Ban bans user from the room, removing it if it is an occupant.
+func (r *Room) Ban(ctx context.Context, user jid.JID, reason string) error {
+	return r.p.request(ctx, r.addr, AdminQuery{Items: []UserItem{{JID: user.Bare().String(), Affiliation: AffOutcast, Reason: reason}}})
+}
+
+// HandlePresence tracks the occupants of the rooms of the client from
+// pres. It reports whether pres came from one of them.
+func (p *Plugin) HandlePresence(ctx context.Context, pres *stanza.Presence) bool {
+	r := p.lookup(pres.From)
+	if r == nil {
+		return false
+	}
+	r.handlePresence(ctx, pres)
+	return true
+}
+
+func (r *Room) handlePresence(ctx context.Context, pres *stanza.Presence) {
+	nick := pres.From.Resource()
+	x, _ := FromExtensions(pres.Extensions)
+	var item UserItem
+	if len(x.Items) > 0 {
+		item = x.Items[0]
+	}
+
+	r.mu.Lock()
+	self := x.HasStatus(StatusSelf) || nick == r.nick
+	switch pres.Type {
+	case stanza.PresenceError:
+		done := r.pending
+		if self && done != nil {
+			r.pending, r.want = nil, false
+		}
+		r.mu.Unlock()
+		if self && done != nil {
+			var err error = stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorUndefinedCondition, "")
+			if pres.Error != nil {
+				err = pres.Error
+			}
+			done <- err
+		}
+
+	case stanza.PresenceAvailable:
+		o := Occupant{Nick: nick, Affiliation: item.Affiliation, Role: item.Role, Show: pres.Show, Status: pres.Status}
+		if item.JID != "" {
+			o.JID, _ = jid.Parse(item.JID)
+		}
+		_, known := r.occupants[nick]
+		r.occupants[nick] = o
+		var done chan error
+		if self {
+			r.nick, r.joined = nick, true
+			done, r.pending = r.pending, nil
+		}
+		f := r.onJoined
+		r.mu.Unlock()
+		if done != nil {
+			done <- nil
+		}
+		if !known && f != nil {
+			f(ctx, o)
+		}
+
+	case stanza.PresenceUnavailable:
+		o, known := r.occupants[nick]
+		if !known {
+			o = Occupant{Nick: nick}
+		}
+		delete(r.occupants, nick)
+		if x.HasStatus(StatusNickChanged) && item.Nick != "" {
+			renamed := o
+			renamed.Nick = item.Nick
+			r.occupants[item.Nick] = renamed
+			if self {
+				r.nick = item.Nick
+			}
+			f := r.onNick
+			r.mu.Unlock()
+			if f != nil {
+				f(ctx, o, item.Nick)
+			}
+			return
+		}
+		if self {
+			// Whether it left, was kicked or banned, or the room was
+			// destroyed, the user is out and stays out.
+			r.joined, r.want = false, false
+			clear(r.occupants)
+		}
+		f := r.onLeft
+		r.mu.Unlock()
+		if f != nil {
+			f(ctx, o)
+		}
+
+	default:
+		r.mu.Unlock()
+	}
+}
+
+// HandleMessage passes the groupchat messages of the rooms of the client
+// to their OnMessage callback and tracks their subject. It reports whether
+// msg was one of them; private messages from occupants and invitations are
+// left to the caller.
+func (p *Plugin) HandleMessage(ctx context.Context, msg *stanza.Message) bool {
+	if msg.Type != stanza.MessageGroupchat {
+		return false
+	}
+	r := p.lookup(msg.From)
+	if r == nil {
+		return false
+	}
+	now := p.now()
+	r.mu.Lock()
+	r.lastSeen = now
+	if len(msg.Subjects) > 0 && len(msg.Bodies) == 0 {
+		r.subject = msg.Subject()
+	}
+	f := r.onMessage
+	r.mu.Unlock()
+	if f != nil {
+		f(ctx, msg)
+	}
+	return true
+}
+
+// FromExtensions returns the muc#user element among exts, if there is one.
+func FromExtensions(exts []stanza.Extension) (UserX, bool) {
+	for _, ext := range exts {
+		if ext.XMLName.Space != ns.MUCUser || ext.XMLName.Local != "x" {
+			continue
+		}
+		data, err := xml.Marshal(ext)
+		if err != nil {
+			return UserX{}, false
+		}
+		var x UserX
+		if err := xml.Unmarshal(data, &x); err != nil {
+			return UserX{}, false
+		}
+		return x, true
+	}
+	return UserX{}, false
+}
+
+// HasStatus reports whether x carries the status code.
+func (x UserX) HasStatus(code int) bool {
+	return slices.ContainsFunc(x.Status, func(s Status) bool { return s.Code == code })
+}
@@ -0,0 +1,215 @@
+package muc
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// fakeClient initializes p as a client would and returns the channels of
+// the stanzas and IQs it sends.
+func fakeClient(t *testing.T, p *Plugin, clk clock.Clock) (<-chan any, <-chan *stanza.IQ) {
+	t.Helper()
+	sent := make(chan any, 16)
+	iqs := make(chan *stanza.IQ, 16)
+	err := p.Initialize(context.Background(), plugin.InitParams{
+		SendElement: func(_ context.Context, v any) error {
+			sent <- v
+			return nil
+		},
+		SendIQ: func(_ context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+			iqs <- iq
+			return iq.ResultIQ(), nil
+		},
+		Clock: clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return sent, iqs
+}
+
+func joinPresence(t *testing.T, sent <-chan any) (*stanza.Presence, MUC) {
+	t.Helper()
+	var v any
+	select {
+	case v = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no join presence sent")
+	}
+	pres, ok := v.(*stanza.Presence)
+	if !ok || len(pres.Extensions) != 1 {
+		t.Fatalf("sent %+v, want a join presence", v)
+	}
+	data, _ := xml.Marshal(pres.Extensions[0])
+	var x MUC
+	if err := xml.Unmarshal(data, &x); err != nil {
+		t.Fatalf("join element %s: %v", data, err)
+	}
+	return pres, x
+}
+
+func occupantPresence(t *testing.T, from, typ, x string) *stanza.Presence {
+	t.Helper()
+	var pres stanza.Presence
+	input := `<presence xmlns='jabber:client' from='` + from + `'`
+	if typ != "" {
+		input += ` type='` + typ + `'`
+	}
+	input += `><x xmlns='http://jabber.org/protocol/muc#user'>` + x + `</x></presence>`
+	if err := xml.Unmarshal([]byte(input), &pres); err != nil {
+		t.Fatal(err)
+	}
+	return &pres
+}
+
+func TestRoomJoinAndOccupants(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	sent, iqs := fakeClient(t, p, nil)
+	room := p.Room(jid.MustParse("coven@chat.example.com/ignored"))
+
+	var joined, left []string
+	var renamed [2]string
+	room.OnOccupantJoined(func(_ context.Context, o Occupant) { joined = append(joined, o.Nick) })
+	room.OnOccupantLeft(func(_ context.Context, o Occupant) { left = append(left, o.Nick) })
+	room.OnOccupantNickChanged(func(_ context.Context, o Occupant, nick string) { renamed = [2]string{o.Nick, nick} })
+
+	done := make(chan error, 1)
+	go func() { done <- room.Join(ctx, "thirdwitch", JoinOptions{History: HistoryMaxStanzas(20)}) }()
+	pres, x := joinPresence(t, sent)
+	if pres.To.String() != "coven@chat.example.com/thirdwitch" || x.History == nil || *x.History.MaxStanzas != 20 {
+		t.Fatalf("join %+v %+v", pres, x)
+	}
+
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/firstwitch", "", `<item affiliation='owner' role='moderator' jid='crone1@shakespeare.lit/desktop'/>`))
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/thirdwitch", "", `<item affiliation='member' role='participant'/><status code='110'/>`))
+	if err := <-done; err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	if !room.Joined() {
+		t.Fatal("room not joined")
+	}
+	if o, ok := room.Occupant("firstwitch"); !ok || o.Role != RoleModerator || o.JID.String() != "crone1@shakespeare.lit/desktop" {
+		t.Fatalf("firstwitch = %+v, %v", o, ok)
+	}
+
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/firstwitch", "unavailable", `<item nick='oldhag'/><status code='303'/>`))
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/oldhag", "", `<item affiliation='owner' role='moderator'/>`))
+	if renamed != [2]string{"firstwitch", "oldhag"} {
+		t.Fatalf("renamed %v", renamed)
+	}
+	occupants := room.Occupants()
+	if len(occupants) != 2 || occupants[0].Nick != "oldhag" || occupants[1].Nick != "thirdwitch" {
+		t.Fatalf("occupants %+v", occupants)
+	}
+
+	if err := room.Kick(ctx, "oldhag", "Avaunt"); err != nil {
+		t.Fatal(err)
+	}
+	var q AdminQuery
+	if iq := <-iqs; iq.Type != stanza.IQSet || xml.Unmarshal(iq.Query, &q) != nil || q.Items[0].Nick != "oldhag" || q.Items[0].Role != RoleNone {
+		t.Fatalf("kick %s", iq.Query)
+	}
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/oldhag", "unavailable", `<item role='none'/><status code='307'/>`))
+
+	if len(joined) != 2 || len(left) != 1 || left[0] != "oldhag" {
+		t.Fatalf("joined %v, left %v", joined, left)
+	}
+}
+
+func TestRoomJoinRefused(t *testing.T) {
+	p := New()
+	sent, _ := fakeClient(t, p, nil)
+	room := p.Room(jid.MustParse("coven@chat.example.com"))
+
+	done := make(chan error, 1)
+	go func() { done <- room.Join(context.Background(), "thirdwitch", JoinOptions{}) }()
+	joinPresence(t, sent)
+	var pres stanza.Presence
+	if err := xml.Unmarshal([]byte(`<presence from='coven@chat.example.com/thirdwitch' type='error'><error type='auth'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>`), &pres); err != nil {
+		t.Fatal(err)
+	}
+	p.HandlePresence(context.Background(), &pres)
+	if err := <-done; err == nil {
+		t.Fatal("Join succeeded")
+	}
+	if room.Joined() || room.Rejoins() {
+		t.Fatal("refused room is to be joined")
+	}
+}
+
+func TestRoomMessagesAndRejoin(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	p := New()
+	sent, _ := fakeClient(t, p, clk)
+	room := p.Room(jid.MustParse("coven@chat.example.com"))
+	var bodies []string
+	room.OnMessage(func(_ context.Context, msg *stanza.Message) { bodies = append(bodies, msg.Body()) })
+
+	if _, err := room.SendMessage(ctx, "too early"); err != ErrNotJoined {
+		t.Fatalf("SendMessage before joining = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- room.Join(ctx, "thirdwitch", JoinOptions{}) }()
+	joinPresence(t, sent)
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/thirdwitch", "", `<status code='110'/>`))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := room.SendMessage(ctx, "Harpier cries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := (<-sent).(*stanza.Message); msg.ID != id || msg.Type != stanza.MessageGroupchat || msg.To.String() != "coven@chat.example.com" {
+		t.Fatalf("sent %+v", msg)
+	}
+
+	subject := stanza.NewMessage(stanza.MessageGroupchat)
+	subject.From = jid.MustParse("coven@chat.example.com/secondwitch")
+	subject.SetSubject("Fire Burn and Cauldron Bubble!")
+	msg := stanza.NewMessage(stanza.MessageGroupchat)
+	msg.From = jid.MustParse("coven@chat.example.com/secondwitch")
+	msg.SetBody("Thrice the brinded cat hath mew'd.")
+	other := stanza.NewMessage(stanza.MessageGroupchat)
+	other.From = jid.MustParse("elsewhere@chat.example.com/someone")
+	if !p.HandleMessage(ctx, subject) || !p.HandleMessage(ctx, msg) || p.HandleMessage(ctx, other) {
+		t.Fatal("HandleMessage misreported the rooms' messages")
+	}
+	if room.Subject() != "Fire Burn and Cauldron Bubble!" || len(bodies) != 2 || bodies[1] != "Thrice the brinded cat hath mew'd." {
+		t.Fatalf("subject %q, bodies %q", room.Subject(), bodies)
+	}
+
+	// A new session joins the room again, asking for what was missed.
+	clk.Advance(time.Hour)
+	sent, _ = fakeClient(t, p, clk)
+	pres, x := joinPresence(t, sent)
+	if pres.To.String() != "coven@chat.example.com/thirdwitch" || x.History == nil || x.History.Since != "2024-05-01T12:00:00Z" {
+		t.Fatalf("rejoin %+v %+v", pres, x.History)
+	}
+	if room.Joined() {
+		t.Fatal("room joined before the room answered")
+	}
+
+	// After leaving, it is not.
+	if err := room.Leave(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+	p.HandlePresence(ctx, occupantPresence(t, "coven@chat.example.com/thirdwitch", "unavailable", `<status code='110'/>`))
+	sent, _ = fakeClient(t, p, clk)
+	select {
+	case v := <-sent:
+		t.Fatalf("sent %+v after leaving", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
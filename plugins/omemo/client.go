@@ -0,0 +1,570 @@
+package omemo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strconv"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/hints"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+var (
+	// ErrNoCipher is returned when encrypting, decrypting or publishing
+	// before SetCipher was called.
+	ErrNoCipher = errors.New("omemo: no cipher set")
+	// ErrNotConnected is returned when a device list or bundle has to be
+	// fetched or published but the plugin was not initialized by a client.
+	ErrNotConnected = errors.New("omemo: not connected")
+	// ErrNotEncrypted is returned by DecryptMessage for a message without
+	// an <encrypted/> element.
+	ErrNotEncrypted = errors.New("omemo: message is not encrypted")
+	// ErrUntrusted is returned by DecryptMessage for a message from a
+	// device the TrustFunc rejected.
+	ErrUntrusted = errors.New("omemo: untrusted device")
+	// ErrNoDevices is returned by EncryptMessage when the recipient has no
+	// device to encrypt for.
+	ErrNoDevices = errors.New("omemo: no trusted devices")
+)
+
+// FallbackBody is the body EncryptMessage leaves for clients without OMEMO
+// support.
+const FallbackBody = "This message is encrypted with OMEMO, which your client does not seem to support."
+
+// Address identifies one device of an account.
+type Address struct {
+	JID      string // bare JID
+	DeviceID uint32
+}
+
+// Cipher is the Signal protocol layer the plugin encrypts with. It works on
+// the XML types of this package; the adapter in
+// github.com/meszmate/xmpp-go/crypto/omemo/omemoxmpp backs it with the
+// crypto/omemo Manager.
+type Cipher interface {
+	// Bundle returns the public bundle of the local device.
+	Bundle() (*Bundle, error)
+	// ProcessBundle makes the bundle of a remote device available for
+	// starting a session with it.
+	ProcessBundle(addr Address, b *Bundle) error
+	// Encrypt encrypts plaintext for every device in to.
+	Encrypt(plaintext []byte, to ...Address) (*Encrypted, error)
+	// Decrypt decrypts enc, sent by the device from.
+	Decrypt(from Address, enc *Encrypted) ([]byte, error)
+}
+
+// PreKeyReplenisher is implemented by ciphers that top up their one-time
+// pre-keys as sessions use them up. After each decrypted message the plugin
+// calls ReplenishPreKeys and publishes the bundle again when it reports
+// that keys were added.
+type PreKeyReplenisher interface {
+	ReplenishPreKeys() (bool, error)
+}
+
+// SessionHealer is implemented by ciphers that recover from sessions that
+// stopped working.
+type SessionHealer interface {
+	// DecryptFailed is called for each message from a device that failed
+	// to decrypt. It reports whether the session with the device was
+	// reset, in which case the plugin sets up a new one and sends the
+	// device a key transport element for it.
+	DecryptFailed(from Address) bool
+	// KeyTransport returns an <encrypted/> element without payload for the
+	// devices in to.
+	KeyTransport(to ...Address) (*Encrypted, error)
+}
+
+// TrustFunc decides whether to trust a device the plugin has not seen
+// before, given the identity key from its bundle. Untrusted devices are
+// left out when encrypting and their messages are not decrypted.
+type TrustFunc func(addr Address, identityKey []byte) bool
+
+// SetCipher sets the cipher used to encrypt and decrypt. It must be set
+// before the client connects for the bundle to be published automatically.
+func (p *Plugin) SetCipher(c Cipher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cipher = c
+}
+
+// OnNewDevice sets the function that decides whether to trust a device
+// seen for the first time. Without one, every device is trusted on first
+// use. The decision is remembered for the lifetime of the plugin.
+func (p *Plugin) OnNewDevice(f TrustFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trust = f
+}
+
+// OnError sets the function called when work done in the background, such
+// as publishing or healing a session, fails.
+func (p *Plugin) OnError(f func(error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onError = f
+}
+
+// background runs f in its own goroutine until Close. It does nothing when
+// the plugin was not initialized by a client.
+func (p *Plugin) background(f func(context.Context) error) {
+	p.mu.RLock()
+	ctx := p.ctx
+	p.mu.RUnlock()
+	if ctx != nil {
+		go p.run(ctx, f)
+	}
+}
+
+func (p *Plugin) run(ctx context.Context, f func(context.Context) error) {
+	err := f(ctx)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	p.report(err)
+}
+
+func (p *Plugin) report(err error) {
+	p.mu.RLock()
+	f := p.onError
+	p.mu.RUnlock()
+	if f != nil {
+		f(err)
+	}
+}
+
+// Publish publishes the bundle of the local device and then adds the device
+// to the account's device list if it is missing. Both nodes are published
+// with an open access model, so that anyone can start a session with the
+// device.
+func (p *Plugin) Publish(ctx context.Context) error {
+	p.mu.RLock()
+	cipher := p.cipher
+	p.mu.RUnlock()
+	if cipher == nil {
+		return ErrNoCipher
+	}
+	own, err := p.ownJID()
+	if err != nil {
+		return err
+	}
+	if err := p.publishBundle(ctx, cipher); err != nil {
+		return err
+	}
+
+	devices, err := p.fetchDevices(ctx, own)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.ID == p.deviceID {
+			p.SetDevices(own.String(), devices)
+			return nil
+		}
+	}
+	devices = append(devices, Device{ID: p.deviceID})
+	if err := p.publish(ctx, NodeDeviceList, "current", &DeviceList{Devices: devices}); err != nil {
+		return err
+	}
+	p.SetDevices(own.String(), devices)
+	return nil
+}
+
+func (p *Plugin) publishBundle(ctx context.Context, cipher Cipher) error {
+	bundle, err := cipher.Bundle()
+	if err != nil {
+		return err
+	}
+	return p.publish(ctx, NodeBundles, strconv.FormatUint(uint64(p.deviceID), 10), bundle)
+}
+
+// Devices returns the devices of owner's account, fetching its device list
+// unless it is cached from an earlier fetch, SetDevices or a notification
+// passed to HandleEvent.
+func (p *Plugin) Devices(ctx context.Context, owner jid.JID) ([]Device, error) {
+	owner = owner.Bare()
+	p.mu.RLock()
+	devices, ok := p.devices[owner.String()]
+	p.mu.RUnlock()
+	if ok {
+		return devices, nil
+	}
+	devices, err := p.fetchDevices(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	p.SetDevices(owner.String(), devices)
+	return devices, nil
+}
+
+// HandleEvent updates the cached device list from a PEP notification and
+// reports whether msg carried one.
+func (p *Plugin) HandleEvent(msg *stanza.Message) bool {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.PubSubEvent || ext.XMLName.Local != "event" {
+			continue
+		}
+		var event pubsub.Event
+		if err := unmarshalExtension(ext, &event); err != nil || event.Items == nil || event.Items.Node != NodeDeviceList {
+			return false
+		}
+		var list DeviceList
+		if len(event.Items.Items) > 0 {
+			if err := xml.Unmarshal(event.Items.Items[0].Payload, &list); err != nil {
+				return false
+			}
+		}
+		p.SetDevices(msg.From.Bare().String(), list.Devices)
+		return true
+	}
+	return false
+}
+
+// EncryptMessage encrypts the body of msg for the devices of its
+// recipient and for the other devices of the local account, fetching and
+// processing the bundles of devices seen for the first time. The body is
+// replaced with FallbackBody and the <encrypted/> and EME elements are
+// added.
+func (p *Plugin) EncryptMessage(ctx context.Context, msg *stanza.Message) error {
+	p.mu.RLock()
+	cipher := p.cipher
+	p.mu.RUnlock()
+	if cipher == nil {
+		return ErrNoCipher
+	}
+	own, err := p.ownJID()
+	if err != nil {
+		return err
+	}
+
+	to := msg.To.Bare()
+	owners := []jid.JID{to}
+	if !to.Equal(own) {
+		owners = append(owners, own)
+	}
+	var recipients []Address
+	for _, owner := range owners {
+		devices, err := p.Devices(ctx, owner)
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			addr := Address{JID: owner.String(), DeviceID: d.ID}
+			if owner.Equal(own) && d.ID == p.deviceID {
+				continue
+			}
+			if ok, err := p.prepare(ctx, cipher, addr); err == nil && ok {
+				recipients = append(recipients, addr)
+			}
+		}
+		if owner.Equal(to) && len(recipients) == 0 {
+			return ErrNoDevices
+		}
+	}
+
+	enc, err := cipher.Encrypt([]byte(msg.Body()), recipients...)
+	if err != nil {
+		return err
+	}
+	encExt, err := stanza.NewExtension(enc)
+	if err != nil {
+		return err
+	}
+	emeExt, err := stanza.NewExtension(NewEME())
+	if err != nil {
+		return err
+	}
+	msg.SetBody(FallbackBody)
+	msg.Extensions = append(msg.Extensions, encExt, emeExt)
+	return nil
+}
+
+// DecryptMessage decrypts the <encrypted/> element of msg, replaces the
+// body with the plaintext and returns it. A key transport element, which
+// has no payload, leaves msg alone and returns an empty string. With a
+// TrustFunc set, the bundle of a sending device seen for the first time is
+// fetched so the function can decide on its identity key.
+//
+// A cipher implementing SessionHealer is told about failures, and a new
+// session is set up in the background once it resets one. A cipher
+// implementing PreKeyReplenisher gets to top up its pre-keys after each
+// decrypted message.
+func (p *Plugin) DecryptMessage(ctx context.Context, msg *stanza.Message) (string, error) {
+	p.mu.RLock()
+	cipher, trust := p.cipher, p.trust
+	p.mu.RUnlock()
+	if cipher == nil {
+		return "", ErrNoCipher
+	}
+	var enc *Encrypted
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space == ns.OMEMO && ext.XMLName.Local == "encrypted" {
+			enc = new(Encrypted)
+			if err := unmarshalExtension(ext, enc); err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+	if enc == nil {
+		return "", ErrNotEncrypted
+	}
+
+	from := Address{JID: msg.From.Bare().String(), DeviceID: enc.Header.SID}
+	if trust != nil {
+		p.mu.RLock()
+		trusted, decided := p.trusted[from]
+		p.mu.RUnlock()
+		if !decided {
+			b, err := p.fetchBundle(ctx, msg.From.Bare(), from.DeviceID)
+			if err != nil {
+				return "", err
+			}
+			if trusted, err = p.decide(from, b); err != nil {
+				return "", err
+			}
+		}
+		if !trusted {
+			return "", ErrUntrusted
+		}
+	}
+
+	plaintext, err := cipher.Decrypt(from, enc)
+	if err != nil {
+		if h, ok := cipher.(SessionHealer); ok && h.DecryptFailed(from) {
+			p.background(func(ctx context.Context) error {
+				return p.heal(ctx, cipher, h, from)
+			})
+		}
+		return "", err
+	}
+	if r, ok := cipher.(PreKeyReplenisher); ok {
+		if added, err := r.ReplenishPreKeys(); err != nil {
+			p.report(err)
+		} else if added {
+			p.background(func(ctx context.Context) error {
+				return p.publishBundle(ctx, cipher)
+			})
+		}
+	}
+	if enc.Payload == nil {
+		return "", nil
+	}
+	msg.SetBody(string(plaintext))
+	return string(plaintext), nil
+}
+
+// heal sets up a new session with a device after the cipher reset the old
+// one, and sends the device a key transport element so that it does too.
+func (p *Plugin) heal(ctx context.Context, cipher Cipher, h SessionHealer, addr Address) error {
+	p.mu.Lock()
+	delete(p.ready, addr)
+	send := p.params.SendElement
+	p.mu.Unlock()
+	if send == nil {
+		return ErrNotConnected
+	}
+	if ok, err := p.prepare(ctx, cipher, addr); err != nil || !ok {
+		return err
+	}
+	enc, err := h.KeyTransport(addr)
+	if err != nil {
+		return err
+	}
+	to, err := jid.Parse(addr.JID)
+	if err != nil {
+		return err
+	}
+	encExt, err := stanza.NewExtension(enc)
+	if err != nil {
+		return err
+	}
+	storeExt, err := stanza.NewExtension(hints.Store{})
+	if err != nil {
+		return err
+	}
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = to
+	msg.Extensions = append(msg.Extensions, encExt, storeExt)
+	return send(ctx, msg)
+}
+
+// prepare fetches the bundle of a device seen for the first time, asks
+// whether to trust it and hands it to the cipher. It reports whether
+// messages may be encrypted for the device.
+func (p *Plugin) prepare(ctx context.Context, cipher Cipher, addr Address) (bool, error) {
+	p.mu.RLock()
+	ready, trusted := p.ready[addr], p.trusted[addr]
+	p.mu.RUnlock()
+	if ready {
+		return trusted, nil
+	}
+	owner, err := jid.Parse(addr.JID)
+	if err != nil {
+		return false, err
+	}
+	b, err := p.fetchBundle(ctx, owner, addr.DeviceID)
+	if err != nil {
+		return false, err
+	}
+	if trusted, err = p.decide(addr, b); err != nil {
+		return false, err
+	}
+	if trusted {
+		if err := cipher.ProcessBundle(addr, b); err != nil {
+			return false, err
+		}
+	}
+	p.mu.Lock()
+	p.ready[addr] = true
+	p.mu.Unlock()
+	return trusted, nil
+}
+
+// decide returns the trust decision for addr, asking the TrustFunc if none
+// was made yet.
+func (p *Plugin) decide(addr Address, b *Bundle) (bool, error) {
+	p.mu.RLock()
+	trusted, decided := p.trusted[addr]
+	trust := p.trust
+	p.mu.RUnlock()
+	if decided {
+		return trusted, nil
+	}
+	trusted = true
+	if trust != nil {
+		ik, err := base64.StdEncoding.DecodeString(b.IK)
+		if err != nil {
+			return false, err
+		}
+		trusted = trust(addr, ik)
+	}
+	p.mu.Lock()
+	p.trusted[addr] = trusted
+	p.mu.Unlock()
+	return trusted, nil
+}
+
+func (p *Plugin) ownJID() (jid.JID, error) {
+	p.mu.RLock()
+	local := p.params.LocalJID
+	p.mu.RUnlock()
+	if local == nil {
+		return jid.JID{}, ErrNotConnected
+	}
+	own, err := jid.Parse(local())
+	if err != nil {
+		return jid.JID{}, err
+	}
+	return own.Bare(), nil
+}
+
+// fetchDevices fetches the device list of owner. A missing node is an
+// empty list.
+func (p *Plugin) fetchDevices(ctx context.Context, owner jid.JID) ([]Device, error) {
+	items, err := p.items(ctx, owner, &pubsub.Items{Node: NodeDeviceList})
+	var se *stanza.StanzaError
+	if errors.As(err, &se) && se.Condition == stanza.ErrorItemNotFound {
+		return nil, nil
+	}
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	var list DeviceList
+	if err := xml.Unmarshal(items[0].Payload, &list); err != nil {
+		return nil, err
+	}
+	return list.Devices, nil
+}
+
+// fetchBundle fetches the bundle of one of owner's devices.
+func (p *Plugin) fetchBundle(ctx context.Context, owner jid.JID, device uint32) (*Bundle, error) {
+	items, err := p.items(ctx, owner, &pubsub.Items{
+		Node:  NodeBundles,
+		Items: []pubsub.PubItem{{ID: strconv.FormatUint(uint64(device), 10)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "")
+	}
+	var b Bundle
+	if err := xml.Unmarshal(items[0].Payload, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (p *Plugin) items(ctx context.Context, owner jid.JID, req *pubsub.Items) ([]pubsub.PubItem, error) {
+	reply, err := p.sendPubSub(ctx, stanza.IQGet, owner, &pubsub.PubSub{Items: req})
+	if err != nil {
+		return nil, err
+	}
+	var resp pubsub.PubSub
+	if err := xml.Unmarshal(reply.Query, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Items == nil {
+		return nil, nil
+	}
+	return resp.Items.Items, nil
+}
+
+// publish publishes v as item id of node on the local account with an open
+// access model.
+func (p *Plugin) publish(ctx context.Context, node, id string, v any) error {
+	payload, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	options := form.NewForm("submit", "")
+	options.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.PubSub + "#publish-options"}})
+	options.AddField(form.Field{Var: "pubsub#access_model", Values: []string{"open"}})
+	if node == NodeBundles {
+		options.AddField(form.Field{Var: "pubsub#max_items", Values: []string{"max"}})
+	}
+	optionsXML, err := xml.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = p.sendPubSub(ctx, stanza.IQSet, jid.JID{}, &pubsub.PubSub{
+		Publish: &pubsub.Publish{
+			Node:  node,
+			Items: []pubsub.PubItem{{ID: id, Payload: payload}},
+		},
+		PublishOptions: &pubsub.PublishOptions{Form: optionsXML},
+	})
+	return err
+}
+
+func (p *Plugin) sendPubSub(ctx context.Context, typ string, to jid.JID, ps *pubsub.PubSub) (*stanza.IQ, error) {
+	p.mu.RLock()
+	send := p.params.SendIQ
+	p.mu.RUnlock()
+	if send == nil {
+		return nil, ErrNotConnected
+	}
+	query, err := xml.Marshal(ps)
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(typ)
+	iq.To = to
+	iq.Query = query
+	return send(ctx, iq)
+}
+
+// unmarshalExtension decodes a generic extension element into v.
+func unmarshalExtension(ext stanza.Extension, v any) error {
+	data, err := xml.Marshal(ext)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
@@ -0,0 +1,471 @@
+package omemo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// pepServer answers the PubSub IQs of the plugin from memory.
+type pepServer struct {
+	mu        sync.Mutex
+	items     map[string][]pubsub.PubItem // owner + " " + node -> items
+	published []string                    // node of every publish, with its options
+	fetches   int
+}
+
+func newPEPServer() *pepServer {
+	return &pepServer{items: make(map[string][]pubsub.PubItem)}
+}
+
+func (s *pepServer) set(owner, node, id string, v any) {
+	payload, _ := xml.Marshal(v)
+	s.items[owner+" "+node] = append(s.items[owner+" "+node], pubsub.PubItem{ID: id, Payload: payload})
+}
+
+func (s *pepServer) sendIQ(own string) func(context.Context, *stanza.IQ) (*stanza.IQ, error) {
+	return func(_ context.Context, iq *stanza.IQ) (*stanza.IQ, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var req pubsub.PubSub
+		if err := xml.Unmarshal(iq.Query, &req); err != nil {
+			return nil, err
+		}
+		owner := own
+		if !iq.To.IsZero() {
+			owner = iq.To.String()
+		}
+		reply := iq.ResultIQ()
+		switch {
+		case req.Publish != nil:
+			item := req.Publish.Items[0]
+			key := owner + " " + req.Publish.Node
+			items := s.items[key][:0]
+			for _, it := range s.items[key] {
+				if it.ID != item.ID {
+					items = append(items, it)
+				}
+			}
+			s.items[key] = append(items, item)
+			s.published = append(s.published, req.Publish.Node+" "+string(req.PublishOptions.Form))
+		case req.Items != nil:
+			s.fetches++
+			items, ok := s.items[owner+" "+req.Items.Node]
+			if !ok {
+				return reply, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "")
+			}
+			var resp []pubsub.PubItem
+			for _, it := range items {
+				if len(req.Items.Items) == 0 || req.Items.Items[0].ID == it.ID {
+					resp = append(resp, it)
+				}
+			}
+			reply.Query, _ = xml.Marshal(pubsub.PubSub{Items: &pubsub.Items{Node: req.Items.Node, Items: resp}})
+		}
+		return reply, nil
+	}
+}
+
+// fakeCipher "encrypts" by base64 encoding and records the bundles it got.
+type fakeCipher struct {
+	device  uint32
+	mu      sync.Mutex
+	bundles []Address
+}
+
+func (c *fakeCipher) Bundle() (*Bundle, error) {
+	return testBundle(c.device), nil
+}
+
+func (c *fakeCipher) ProcessBundle(addr Address, _ *Bundle) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bundles = append(c.bundles, addr)
+	return nil
+}
+
+func (c *fakeCipher) Encrypt(plaintext []byte, to ...Address) (*Encrypted, error) {
+	enc := &Encrypted{Header: Header{SID: c.device}, Payload: &Payload{Value: base64.StdEncoding.EncodeToString(plaintext)}}
+	for _, addr := range to {
+		enc.Header.Keys = append(enc.Header.Keys, Key{RID: addr.DeviceID, Value: addr.JID})
+	}
+	return enc, nil
+}
+
+func (c *fakeCipher) Decrypt(_ Address, enc *Encrypted) ([]byte, error) {
+	if enc.Payload == nil {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(enc.Payload.Value)
+}
+
+// healingCipher fails to decrypt messages from broken devices, resetting
+// the session on the second failure, and adds pre-keys when asked to.
+type healingCipher struct {
+	*fakeCipher
+	broken    map[Address]int // failures so far
+	replenish bool
+}
+
+func (c *healingCipher) Decrypt(from Address, enc *Encrypted) ([]byte, error) {
+	c.mu.Lock()
+	_, broken := c.broken[from]
+	c.mu.Unlock()
+	if broken {
+		return nil, errors.New("bad mac")
+	}
+	return c.fakeCipher.Decrypt(from, enc)
+}
+
+func (c *healingCipher) DecryptFailed(from Address) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broken[from]++
+	if c.broken[from] < 2 {
+		return false
+	}
+	delete(c.broken, from)
+	return true
+}
+
+func (c *healingCipher) KeyTransport(to ...Address) (*Encrypted, error) {
+	enc, err := c.Encrypt(nil, to...)
+	enc.Payload = nil
+	return enc, err
+}
+
+func (c *healingCipher) ReplenishPreKeys() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := c.replenish
+	c.replenish = false
+	return added, nil
+}
+
+func testBundle(device uint32) *Bundle {
+	return &Bundle{IK: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("ik-%d", device)))}
+}
+
+func newTestPlugin(t *testing.T, server *pepServer) (*Plugin, *fakeCipher) {
+	t.Helper()
+	p := New(1)
+	c := &fakeCipher{device: 1}
+	p.SetCipher(c)
+	err := p.Initialize(context.Background(), plugin.InitParams{
+		LocalJID: func() string { return "alice@example.com/phone" },
+		SendIQ:   server.sendIQ("alice@example.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, c
+}
+
+func waitPublished(t *testing.T, p *Plugin) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.GetDevices("alice@example.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("device list not published")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublishOnInitialize(t *testing.T) {
+	server := newPEPServer()
+	server.set("alice@example.com", NodeDeviceList, "current", &DeviceList{Devices: []Device{{ID: 7, Label: "laptop"}}})
+	p, _ := newTestPlugin(t, server)
+	waitPublished(t, p)
+
+	server.mu.Lock()
+	published := server.published
+	server.published = nil
+	items := server.items
+	server.mu.Unlock()
+	if len(published) != 2 || !strings.HasPrefix(published[0], NodeBundles) || !strings.HasPrefix(published[1], NodeDeviceList) {
+		t.Fatalf("published %v", published)
+	}
+	if !strings.Contains(published[0], "<value>open</value>") {
+		t.Errorf("bundle published without an open access model: %s", published[0])
+	}
+	var list DeviceList
+	if err := xml.Unmarshal(items["alice@example.com "+NodeDeviceList][0].Payload, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Devices) != 2 || list.Devices[0].Label != "laptop" || list.Devices[1].ID != 1 {
+		t.Fatalf("device list %+v", list.Devices)
+	}
+	if b := items["alice@example.com "+NodeBundles]; len(b) != 1 || b[0].ID != "1" {
+		t.Fatalf("bundles %+v", b)
+	}
+
+	// A device list that already has the device is left alone.
+	if err := p.Publish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.published) != 1 {
+		t.Fatalf("second Publish published %v", server.published)
+	}
+}
+
+func TestEncryptMessage(t *testing.T) {
+	server := newPEPServer()
+	server.set("alice@example.com", NodeDeviceList, "current", &DeviceList{Devices: []Device{{ID: 1}, {ID: 7}}})
+	server.set("alice@example.com", NodeBundles, "7", testBundle(7))
+	server.set("bob@example.com", NodeDeviceList, "current", &DeviceList{Devices: []Device{{ID: 2}, {ID: 3}, {ID: 4}}})
+	server.set("bob@example.com", NodeBundles, "2", testBundle(2))
+	server.set("bob@example.com", NodeBundles, "3", testBundle(3))
+	// Device 4 has no bundle and is skipped.
+	p, c := newTestPlugin(t, server)
+	waitPublished(t, p)
+
+	var asked []string
+	p.OnNewDevice(func(addr Address, ik []byte) bool {
+		asked = append(asked, fmt.Sprintf("%s:%d:%s", addr.JID, addr.DeviceID, ik))
+		return addr.DeviceID != 3
+	})
+
+	for range 2 {
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.To = jid.MustParse("bob@example.com/desk")
+		msg.SetBody("secret")
+		if err := p.EncryptMessage(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Body() != FallbackBody || len(msg.Extensions) != 2 {
+			t.Fatalf("message %+v", msg)
+		}
+		var enc Encrypted
+		if err := unmarshalExtension(msg.Extensions[0], &enc); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, k := range enc.Header.Keys {
+			got = append(got, fmt.Sprintf("%s:%d", k.Value, k.RID))
+		}
+		if strings.Join(got, " ") != "bob@example.com:2 alice@example.com:7" {
+			t.Fatalf("encrypted for %v", got)
+		}
+		if msg.Extensions[1].XMLName.Local != "encryption" {
+			t.Errorf("no EME element: %+v", msg.Extensions[1])
+		}
+	}
+	if strings.Join(asked, " ") != "bob@example.com:2:ik-2 bob@example.com:3:ik-3 alice@example.com:7:ik-7" {
+		t.Fatalf("trust asked for %v", asked)
+	}
+	if len(c.bundles) != 2 {
+		t.Fatalf("cipher got bundles of %v", c.bundles)
+	}
+
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse("carol@example.com")
+	msg.SetBody("secret")
+	if err := p.EncryptMessage(context.Background(), msg); !errors.Is(err, ErrNoDevices) {
+		t.Fatalf("recipient without devices: %v", err)
+	}
+}
+
+func TestDecryptMessage(t *testing.T) {
+	server := newPEPServer()
+	server.set("bob@example.com", NodeBundles, "2", testBundle(2))
+	server.set("bob@example.com", NodeBundles, "3", testBundle(3))
+	p, _ := newTestPlugin(t, server)
+	waitPublished(t, p)
+	p.OnNewDevice(func(addr Address, _ []byte) bool { return addr.DeviceID == 2 })
+
+	incoming := func(sid uint32) *stanza.Message {
+		enc, _ := (&fakeCipher{device: sid}).Encrypt([]byte("hello"), Address{JID: "alice@example.com", DeviceID: 1})
+		ext, err := stanza.NewExtension(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.From = jid.MustParse("bob@example.com/desk")
+		msg.SetBody(FallbackBody)
+		msg.Extensions = []stanza.Extension{ext}
+		return msg
+	}
+
+	msg := incoming(2)
+	if body, err := p.DecryptMessage(context.Background(), msg); err != nil || body != "hello" || msg.Body() != "hello" {
+		t.Fatalf("DecryptMessage = %q, %v; body %q", body, err, msg.Body())
+	}
+	if _, err := p.DecryptMessage(context.Background(), incoming(3)); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("untrusted device: %v", err)
+	}
+	fetches := server.fetches
+	if _, err := p.DecryptMessage(context.Background(), incoming(2)); err != nil || server.fetches != fetches {
+		t.Fatalf("second message: %v after %d more fetches", err, server.fetches-fetches)
+	}
+	if _, err := p.DecryptMessage(context.Background(), stanza.NewMessage(stanza.MessageChat)); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("plain message: %v", err)
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	p := New(1)
+	msg := stanza.NewMessage(stanza.MessageNormal)
+	msg.From = jid.MustParse("bob@example.com")
+	list, _ := xml.Marshal(&DeviceList{Devices: []Device{{ID: 2}, {ID: 5}}})
+	ext, err := stanza.NewExtension(pubsub.Event{Items: &pubsub.EventItems{
+		Node:  NodeDeviceList,
+		Items: []pubsub.PubItem{{ID: "current", Payload: list}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Extensions = []stanza.Extension{ext}
+	if !p.HandleEvent(msg) {
+		t.Fatal("device list notification not handled")
+	}
+	if devices := p.GetDevices("bob@example.com"); len(devices) != 2 || devices[1].ID != 5 {
+		t.Fatalf("devices %+v", devices)
+	}
+	if p.HandleEvent(stanza.NewMessage(stanza.MessageChat)) {
+		t.Fatal("plain message handled")
+	}
+}
+
+func TestWithoutClient(t *testing.T) {
+	p := New(1)
+	if err := p.Publish(context.Background()); !errors.Is(err, ErrNoCipher) {
+		t.Fatalf("Publish without cipher: %v", err)
+	}
+	p.SetCipher(&fakeCipher{device: 1})
+	if err := p.Initialize(context.Background(), plugin.InitParams{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Publish without a client: %v", err)
+	}
+}
+
+func TestDecryptHealsSession(t *testing.T) {
+	server := newPEPServer()
+	server.set("bob@example.com", NodeBundles, "2", testBundle(2))
+	bob := Address{JID: "bob@example.com", DeviceID: 2}
+	c := &healingCipher{fakeCipher: &fakeCipher{device: 1}, broken: map[Address]int{bob: 0}}
+	sent := make(chan *stanza.Message, 1)
+	p := New(1)
+	p.SetCipher(c)
+	if err := p.Initialize(context.Background(), plugin.InitParams{
+		LocalJID: func() string { return "alice@example.com/phone" },
+		SendIQ:   server.sendIQ("alice@example.com"),
+		SendElement: func(_ context.Context, v any) error {
+			sent <- v.(*stanza.Message)
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	waitPublished(t, p)
+
+	incoming := func(payload bool) *stanza.Message {
+		enc, _ := (&fakeCipher{device: 2}).Encrypt([]byte("hello"), Address{JID: "alice@example.com", DeviceID: 1})
+		if !payload {
+			enc.Payload = nil
+		}
+		ext, err := stanza.NewExtension(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := stanza.NewMessage(stanza.MessageChat)
+		msg.From = jid.MustParse("bob@example.com/desk")
+		msg.Extensions = []stanza.Extension{ext}
+		return msg
+	}
+
+	for range 2 {
+		if _, err := p.DecryptMessage(context.Background(), incoming(true)); err == nil {
+			t.Fatal("broken session decrypted")
+		}
+	}
+	var msg *stanza.Message
+	select {
+	case msg = <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no key transport sent")
+	}
+	if msg.To.String() != "bob@example.com" || len(msg.Extensions) != 2 || msg.Extensions[1].XMLName.Local != "store" {
+		t.Fatalf("key transport %+v", msg)
+	}
+	var enc Encrypted
+	if err := unmarshalExtension(msg.Extensions[0], &enc); err != nil {
+		t.Fatal(err)
+	}
+	if enc.Payload != nil || len(enc.Header.Keys) != 1 || enc.Header.Keys[0].RID != 2 {
+		t.Fatalf("key transport element %+v", enc)
+	}
+	c.mu.Lock()
+	bundles := len(c.bundles)
+	c.mu.Unlock()
+	if bundles != 1 {
+		t.Fatalf("bundle processed %d times", bundles)
+	}
+
+	// Bob's key transport element for the new session carries no body.
+	kt := incoming(false)
+	if body, err := p.DecryptMessage(context.Background(), kt); err != nil || body != "" || kt.Body() != "" {
+		t.Fatalf("key transport = %q, %v; body %q", body, err, kt.Body())
+	}
+}
+
+func TestDecryptReplenishesPreKeys(t *testing.T) {
+	server := newPEPServer()
+	c := &healingCipher{fakeCipher: &fakeCipher{device: 1}, replenish: true}
+	p := New(1)
+	p.SetCipher(c)
+	if err := p.Initialize(context.Background(), plugin.InitParams{
+		LocalJID: func() string { return "alice@example.com/phone" },
+		SendIQ:   server.sendIQ("alice@example.com"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	waitPublished(t, p)
+
+	enc, _ := (&fakeCipher{device: 2}).Encrypt([]byte("hello"), Address{JID: "alice@example.com", DeviceID: 1})
+	ext, err := stanza.NewExtension(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From = jid.MustParse("bob@example.com/desk")
+	msg.Extensions = []stanza.Extension{ext}
+	if _, err := p.DecryptMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		server.mu.Lock()
+		n := len(server.published)
+		last := server.published[n-1]
+		server.mu.Unlock()
+		if n == 3 {
+			if !strings.HasPrefix(last, NodeBundles) {
+				t.Fatalf("published %s", last)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bundle not republished after %d publishes", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -93,22 +93,58 @@ type Plugin struct {
 	deviceID uint32
 	devices  map[string][]Device // jid -> devices
 	params   plugin.InitParams
+
+	cipher  Cipher
+	trust   TrustFunc
+	onError func(error)
+	trusted map[Address]bool // trust decisions by device
+	ready   map[Address]bool // devices whose bundle the cipher has
+	ctx     context.Context  // background work, canceled by Close
+	cancel  context.CancelFunc
 }
 
 func New(deviceID uint32) *Plugin {
 	return &Plugin{
 		deviceID: deviceID,
 		devices:  make(map[string][]Device),
+		trusted:  make(map[Address]bool),
+		ready:    make(map[Address]bool),
 	}
 }
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
-func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+
+// Initialize publishes the device list and bundle in the background when
+// a cipher is set and the session can send IQs, which is the case on
+// clients. Publishing errors go to the handler set with OnError.
+func (p *Plugin) Initialize(ctx context.Context, params plugin.InitParams) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.params = params
+	if p.cancel != nil {
+		p.cancel()
+		p.ctx, p.cancel = nil, nil
+	}
+	if params.SendIQ != nil {
+		p.ctx, p.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		if p.cipher != nil {
+			go p.run(p.ctx, p.Publish)
+		}
+	}
 	return nil
 }
-func (p *Plugin) Close() error           { return nil }
+
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.ctx, p.cancel = nil, nil
+	}
+	return nil
+}
+
 func (p *Plugin) Dependencies() []string { return nil }
 
 func (p *Plugin) DeviceID() uint32 { return p.deviceID }
@@ -0,0 +1,115 @@
+// Package privilege implements XEP-0356 Privileged Entity, with which a
+// server grants an external component access to the rosters of its users
+// and permission to send messages on their behalf.
+package privilege
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/forward"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const Name = "privilege"
+
+// Accesses a privilege grants.
+const (
+	AccessRoster  = "roster"
+	AccessMessage = "message"
+)
+
+// Types of access. Roster access is get, set or both; message access is
+// outgoing.
+const (
+	TypeNone     = "none"
+	TypeGet      = "get"
+	TypeSet      = "set"
+	TypeBoth     = "both"
+	TypeOutgoing = "outgoing"
+)
+
+// ErrNoMessage is returned by Privilege.Message when nothing is forwarded.
+var ErrNoMessage = errors.New("privilege: no forwarded message")
+
+// Privilege is what a server advertises to a component it grants
+// privileges to, in a message sent once the component connects. A
+// component sending a message on behalf of a user forwards it in one,
+// addressed to the server.
+type Privilege struct {
+	XMLName   xml.Name           `xml:"urn:xmpp:privilege:2 privilege"`
+	Perms     []Perm             `xml:"urn:xmpp:privilege:2 perm"`
+	Forwarded *forward.Forwarded `xml:"urn:xmpp:forward:0 forwarded,omitempty"`
+}
+
+// Perm is a privilege granted for one access.
+type Perm struct {
+	Access string `xml:"access,attr"`
+	Type   string `xml:"type,attr"`
+	Push   bool   `xml:"push,attr,omitempty"`
+}
+
+// Allows reports whether p grants access of type typ. Roster access of
+// type both grants get and set.
+func (p Privilege) Allows(access, typ string) bool {
+	for _, perm := range p.Perms {
+		if perm.Access != access {
+			continue
+		}
+		return perm.Type == typ || (access == AccessRoster && perm.Type == TypeBoth && (typ == TypeGet || typ == TypeSet))
+	}
+	return false
+}
+
+// ValidType reports whether typ is a type of access.
+func ValidType(access, typ string) bool {
+	switch access {
+	case AccessRoster:
+		return typ == TypeNone || typ == TypeGet || typ == TypeSet || typ == TypeBoth
+	case AccessMessage:
+		return typ == TypeNone || typ == TypeOutgoing
+	}
+	return false
+}
+
+// Forward returns the privilege element forwarding msg.
+func Forward(msg *stanza.Message) (Privilege, error) {
+	inner, err := xml.Marshal(msg)
+	if err != nil {
+		return Privilege{}, err
+	}
+	return Privilege{Forwarded: &forward.Forwarded{Inner: inner}}, nil
+}
+
+// Message returns the message p forwards.
+func (p Privilege) Message() (*stanza.Message, error) {
+	if p.Forwarded == nil || len(p.Forwarded.Inner) == 0 {
+		return nil, ErrNoMessage
+	}
+	var msg stanza.Message
+	if err := xml.Unmarshal(p.Forwarded.Inner, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Plugin implements XEP-0356.
+type Plugin struct {
+	params plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
+
+func init() { _ = ns.Privilege }
@@ -0,0 +1,81 @@
+package privilege
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestAllows(t *testing.T) {
+	input := `<privilege xmlns='urn:xmpp:privilege:2'>` +
+		`<perm access='roster' type='both' push='true'/>` +
+		`<perm access='message' type='outgoing'/>` +
+		`</privilege>`
+	var p Privilege
+	if err := xml.Unmarshal([]byte(input), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(p.Perms) != 2 || !p.Perms[0].Push {
+		t.Fatalf("perms = %+v", p.Perms)
+	}
+	for _, tc := range []struct {
+		access, typ string
+		want        bool
+	}{
+		{AccessRoster, TypeGet, true},
+		{AccessRoster, TypeSet, true},
+		{AccessMessage, TypeOutgoing, true},
+		{AccessMessage, TypeGet, false},
+		{"presence", TypeGet, false},
+	} {
+		if got := p.Allows(tc.access, tc.typ); got != tc.want {
+			t.Errorf("Allows(%s, %s) = %v", tc.access, tc.typ, got)
+		}
+	}
+	if (Privilege{Perms: []Perm{{Access: AccessRoster, Type: TypeGet}}}).Allows(AccessRoster, TypeSet) {
+		t.Error("get grants set")
+	}
+}
+
+func TestValidType(t *testing.T) {
+	if !ValidType(AccessRoster, TypeBoth) || !ValidType(AccessMessage, TypeOutgoing) {
+		t.Error("valid type refused")
+	}
+	if ValidType(AccessMessage, TypeBoth) || ValidType("iq", TypeGet) {
+		t.Error("invalid type accepted")
+	}
+}
+
+func TestForwardRoundTrip(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageHeadline)
+	msg.From = jid.MustParse("juliet@capulet.lit")
+	msg.To = jid.MustParse("romeo@montague.lit")
+	msg.SetBody("wherefore")
+	p, err := Forward(msg)
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	data, err := xml.Marshal(p)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got Privilege
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal %s: %v", data, err)
+	}
+	inner, err := got.Message()
+	if err != nil {
+		t.Fatalf("Message: %v", err)
+	}
+	if !inner.From.Equal(msg.From) || !inner.To.Equal(msg.To) || inner.Body() != "wherefore" {
+		t.Fatalf("forwarded %+v", inner)
+	}
+
+	if _, err := (Privilege{}).Message(); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("Message without forwarded = %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// Node configuration fields PublishItem honors (XEP-0060 §16.4.3). Each is
+// on unless the node's Config sets it to "0" or "false".
+const (
+	ConfigDeliverNotifications = "pubsub#deliver_notifications"
+	ConfigDeliverPayloads      = "pubsub#deliver_payloads"
+	ConfigPersistItems         = "pubsub#persist_items"
+)
+
+// Subscription states.
+const (
+	StateSubscribed   = "subscribed"
+	StatePending      = "pending"
+	StateUnconfigured = "unconfigured"
+	StateNone         = "none"
+)
+
+// NotifyFunc delivers an event notification to msg.To.
+type NotifyFunc func(ctx context.Context, msg *stanza.Message) error
+
+// SetNotifier sets the function PublishItem delivers event notifications
+// with. Without one, nobody is notified.
+func (p *Plugin) SetNotifier(f NotifyFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notify = f
+}
+
+// nodeConfig returns the configuration of a node, nil for a node that was
+// never created.
+func (p *Plugin) nodeConfig(ctx context.Context, host, nodeID string) (map[string]string, error) {
+	node, err := p.store.GetNode(ctx, host, nodeID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return node.Config, nil
+}
+
+func configEnabled(config map[string]string, field string) bool {
+	switch config[field] {
+	case "0", "false":
+		return false
+	}
+	return true
+}
+
+// notifyEvent sends items as an event to every subscriber of the node
+// whose subscription is active and, on a PEP service, to the recipients
+// the function set with SetPEPRecipients adds. Each JID is notified once.
+// All recipients are tried; the delivery errors are returned together.
+func (p *Plugin) notifyEvent(ctx context.Context, host, nodeID string, items EventItems) error {
+	p.mu.RLock()
+	notify := p.notify
+	p.mu.RUnlock()
+	if notify == nil {
+		return nil
+	}
+	subs, err := p.store.GetSubscriptions(ctx, host, nodeID)
+	if err != nil {
+		return err
+	}
+	pep, err := p.pepRecipients(ctx, host, nodeID)
+	if err != nil {
+		return err
+	}
+	msg, err := eventMessage(host, items)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	send := func(to jid.JID) {
+		if seen[to.String()] {
+			return
+		}
+		seen[to.String()] = true
+		out := *msg
+		out.To = to
+		if err := notify(ctx, &out); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, sub := range subs {
+		if sub.State != StateSubscribed {
+			continue
+		}
+		to, err := jid.Parse(sub.JID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		send(to)
+	}
+	for _, to := range pep {
+		send(to)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func newNotifyingPlugin(t *testing.T) (*Plugin, *[]*stanza.Message) {
+	t.Helper()
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatal(err)
+	}
+	var sent []*stanza.Message
+	p.SetNotifier(func(_ context.Context, msg *stanza.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+	ctx := context.Background()
+	for jid, state := range map[string]string{
+		"alice@example.com":     StateSubscribed,
+		"bob@example.com/phone": StateSubscribed,
+		"carol@example.com":     StatePending,
+		"dave@example.com":      StateUnconfigured,
+	} {
+		if err := p.SubscribeNode(ctx, &storage.PubSubSubscription{Host: "pubsub.example.com", NodeID: "news", JID: jid, State: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, &sent
+}
+
+func TestPublishNotifiesSubscribers(t *testing.T) {
+	p, sent := newNotifyingPlugin(t)
+	ctx := context.Background()
+	item := &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1", Payload: []byte(`<entry xmlns="http://www.w3.org/2005/Atom">hi</entry>`)}
+	if err := p.PublishItem(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := p.GetItems(ctx, "pubsub.example.com", "news"); len(items) != 1 {
+		t.Fatalf("stored %d items", len(items))
+	}
+
+	var to []string
+	for _, msg := range *sent {
+		to = append(to, msg.To.String())
+		if msg.From.String() != "pubsub.example.com" || msg.Type != stanza.MessageHeadline {
+			t.Errorf("notification %+v", msg.Header)
+		}
+		data, err := xml.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{`node="news"`, `id="1"`, "<entry", ">hi</entry>"} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("notification lacks %s: %s", want, data)
+			}
+		}
+	}
+	if len(to) != 2 || !strings.Contains(strings.Join(to, " "), "alice@example.com") || !strings.Contains(strings.Join(to, " "), "bob@example.com/phone") {
+		t.Fatalf("notified %v", to)
+	}
+}
+
+func TestPublishHonorsNodeConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		config           map[string]string
+		stored, notified int
+		payload          bool
+	}{
+		{map[string]string{ConfigDeliverNotifications: "0"}, 1, 0, false},
+		{map[string]string{ConfigPersistItems: "false"}, 0, 2, true},
+		{map[string]string{ConfigDeliverPayloads: "0"}, 1, 2, false},
+		{map[string]string{ConfigDeliverNotifications: "1", ConfigPersistItems: "true"}, 1, 2, true},
+	} {
+		p, sent := newNotifyingPlugin(t)
+		if err := p.CreateNode(ctx, &storage.PubSubNode{Host: "pubsub.example.com", NodeID: "news", Config: tc.config}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1", Payload: []byte("<x/>")}); err != nil {
+			t.Fatal(err)
+		}
+		items, _ := p.GetItems(ctx, "pubsub.example.com", "news")
+		if len(items) != tc.stored || len(*sent) != tc.notified {
+			t.Errorf("%v: stored %d, notified %d", tc.config, len(items), len(*sent))
+			continue
+		}
+		for _, msg := range *sent {
+			data, _ := xml.Marshal(msg)
+			if got := strings.Contains(string(data), "<x"); got != tc.payload {
+				t.Errorf("%v: payload delivered = %v: %s", tc.config, got, data)
+			}
+		}
+	}
+}
+
+func TestPublishReportsDeliveryErrors(t *testing.T) {
+	p, _ := newNotifyingPlugin(t)
+	var tried int
+	errOffline := errors.New("offline")
+	p.SetNotifier(func(context.Context, *stanza.Message) error {
+		tried++
+		return errOffline
+	})
+	err := p.PublishItem(context.Background(), &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1"})
+	if !errors.Is(err, errOffline) || tried != 2 {
+		t.Fatalf("PublishItem = %v after %d deliveries", err, tried)
+	}
+	if items, _ := p.GetItems(context.Background(), "pubsub.example.com", "news"); len(items) != 1 {
+		t.Fatal("item not stored before notifying")
+	}
+}
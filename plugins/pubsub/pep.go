@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"maps"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// NotifySuffix is appended to a node name to form the entity capabilities
+// feature with which a client asks for its notifications (XEP-0163 §4.3).
+const NotifySuffix = "+notify"
+
+// ConfigAccessModel is the node configuration field naming who may
+// retrieve items (XEP-0060 §4.5).
+const ConfigAccessModel = "pubsub#access_model"
+
+// Access models. PEP nodes default to AccessPresence.
+const (
+	AccessOpen      = "open"
+	AccessPresence  = "presence"
+	AccessRoster    = "roster"
+	AccessAuthorize = "authorize"
+	AccessWhitelist = "whitelist"
+)
+
+// ErrPreconditionNotMet is returned by PublishWithOptions when the
+// publish-options do not match the configuration of an existing node
+// (XEP-0060 §7.1.5).
+var ErrPreconditionNotMet = errors.New("pubsub: precondition not met")
+
+// RecipientsFunc returns the full JIDs to notify of a publish to node on
+// the personal eventing service of owner: those of the owner's resources
+// and of its contacts that advertise node+NotifySuffix in their entity
+// capabilities.
+type RecipientsFunc func(ctx context.Context, owner jid.JID, node string) ([]jid.JID, error)
+
+// SetPEPRecipients sets the function that adds presence-based recipients
+// to the notifications of PEP nodes. Without one, PEP nodes notify their
+// explicit subscribers only.
+func (p *Plugin) SetPEPRecipients(f RecipientsFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pep = f
+}
+
+// IsPEP reports whether host is the personal eventing service of an
+// account, that is a bare JID with a localpart (XEP-0163 §1.2).
+func IsPEP(host string) bool {
+	j, err := jid.Parse(host)
+	return err == nil && j.Local() != "" && j.Resource() == ""
+}
+
+// AccessModel returns the access model of a node with config on host.
+func AccessModel(host string, config map[string]string) string {
+	if model := config[ConfigAccessModel]; model != "" {
+		return model
+	}
+	if IsPEP(host) {
+		return AccessPresence
+	}
+	return AccessOpen
+}
+
+// PublishWithOptions publishes item like PublishItem. On a PEP service a
+// node that does not exist yet is created first, owned by the account
+// and configured with options (XEP-0163 §3). For an existing node, every
+// option must match its configuration, or ErrPreconditionNotMet is
+// returned and nothing is published.
+func (p *Plugin) PublishWithOptions(ctx context.Context, item *storage.PubSubItem, options map[string]string) error {
+	if p.store == nil {
+		return storage.ErrStorageUnavailable
+	}
+	node, err := p.store.GetNode(ctx, item.Host, item.NodeID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound) && IsPEP(item.Host):
+		if node, err = p.autoCreate(ctx, item.Host, item.NodeID, options); err != nil {
+			return err
+		}
+	case errors.Is(err, storage.ErrNotFound):
+		node = &storage.PubSubNode{Host: item.Host, NodeID: item.NodeID}
+	case err != nil:
+		return err
+	case !meetsPreconditions(node, options):
+		return ErrPreconditionNotMet
+	}
+	return p.publish(ctx, node.Config, item)
+}
+
+func meetsPreconditions(node *storage.PubSubNode, options map[string]string) bool {
+	for field, value := range options {
+		current := node.Config[field]
+		if field == ConfigAccessModel {
+			current = AccessModel(node.Host, node.Config)
+		}
+		if current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// autoCreate creates a leaf node on the PEP service host. A node created
+// concurrently by another publish is used as it is.
+func (p *Plugin) autoCreate(ctx context.Context, host, nodeID string, options map[string]string) (*storage.PubSubNode, error) {
+	node := &storage.PubSubNode{Host: host, NodeID: nodeID, Type: "leaf", Creator: host}
+	if len(options) > 0 {
+		node.Config = maps.Clone(options)
+	}
+	if err := p.store.CreateNode(ctx, node); err != nil {
+		if existing, getErr := p.store.GetNode(ctx, host, nodeID); getErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return node, nil
+}
+
+// RetractItem deletes an item from a node. With notify set, the
+// subscribers are told of the retraction as they are of a publish.
+// Returns storage.ErrStorageUnavailable if no store is configured.
+func (p *Plugin) RetractItem(ctx context.Context, host, nodeID, itemID string, notify bool) error {
+	if p.store == nil {
+		return storage.ErrStorageUnavailable
+	}
+	if err := p.store.DeleteItem(ctx, host, nodeID, itemID); err != nil {
+		return err
+	}
+	if !notify {
+		return nil
+	}
+	return p.notifyEvent(ctx, host, nodeID, EventItems{Node: nodeID, Retract: []EventRetract{{ID: itemID}}})
+}
+
+// SendLastItem sends the newest item of a node to to, as PEP services do
+// when a contact comes online interested in the node (XEP-0163 §4.3.2).
+// A node without items sends nothing.
+func (p *Plugin) SendLastItem(ctx context.Context, host, nodeID string, to jid.JID) error {
+	if p.store == nil {
+		return storage.ErrStorageUnavailable
+	}
+	p.mu.RLock()
+	notify := p.notify
+	p.mu.RUnlock()
+	if notify == nil {
+		return nil
+	}
+	config, err := p.nodeConfig(ctx, host, nodeID)
+	if err != nil {
+		return err
+	}
+	items, err := p.store.GetItems(ctx, host, nodeID)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+	msg, err := eventMessage(host, eventItems(items[len(items)-1], configEnabled(config, ConfigDeliverPayloads)))
+	if err != nil {
+		return err
+	}
+	msg.To = to
+	return notify(ctx, msg)
+}
+
+// pepRecipients returns the presence-based recipients of a PEP node, none
+// for a node on another kind of service.
+func (p *Plugin) pepRecipients(ctx context.Context, host, nodeID string) ([]jid.JID, error) {
+	p.mu.RLock()
+	recipients := p.pep
+	p.mu.RUnlock()
+	if recipients == nil || !IsPEP(host) {
+		return nil, nil
+	}
+	owner, err := jid.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	return recipients(ctx, owner, nodeID)
+}
+
+// eventMessage returns a headline message from host carrying items, to be
+// addressed by the caller.
+func eventMessage(host string, items EventItems) (*stanza.Message, error) {
+	from, err := jid.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := stanza.NewExtension(Event{Items: &items})
+	if err != nil {
+		return nil, err
+	}
+	msg := stanza.NewMessage(stanza.MessageHeadline)
+	msg.From = from
+	msg.Extensions = []stanza.Extension{ext}
+	return msg, nil
+}
+
+func eventItems(item *storage.PubSubItem, payload bool) EventItems {
+	event := PubItem{ID: item.ItemID}
+	if payload {
+		event.Payload = item.Payload
+	}
+	return EventItems{Node: item.NodeID, Items: []PubItem{event}}
+}
@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+const pepHost = "alice@example.com"
+
+func recipientsOf(sent []*stanza.Message) []string {
+	var to []string
+	for _, msg := range sent {
+		to = append(to, msg.To.String())
+	}
+	slices.Sort(to)
+	return to
+}
+
+func TestIsPEP(t *testing.T) {
+	for host, want := range map[string]bool{
+		"alice@example.com":       true,
+		"pubsub.example.com":      false,
+		"alice@example.com/phone": false,
+		"":                        false,
+	} {
+		if got := IsPEP(host); got != want {
+			t.Errorf("IsPEP(%q) = %v", host, got)
+		}
+	}
+	if got := AccessModel(pepHost, nil); got != AccessPresence {
+		t.Errorf("PEP access model %q", got)
+	}
+	if got := AccessModel("pubsub.example.com", nil); got != AccessOpen {
+		t.Errorf("service access model %q", got)
+	}
+}
+
+func TestPEPAutoCreate(t *testing.T) {
+	p, _ := newNotifyingPlugin(t)
+	ctx := context.Background()
+	item := &storage.PubSubItem{Host: pepHost, NodeID: "urn:xmpp:avatar:metadata", ItemID: "1", Payload: []byte("<metadata/>")}
+	if err := p.PublishWithOptions(ctx, item, map[string]string{ConfigAccessModel: AccessOpen}); err != nil {
+		t.Fatal(err)
+	}
+	node, err := p.GetNode(ctx, pepHost, "urn:xmpp:avatar:metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Creator != pepHost || node.Type != "leaf" || node.Config[ConfigAccessModel] != AccessOpen {
+		t.Fatalf("created %+v", node)
+	}
+
+	// Matching options publish again; conflicting ones are refused.
+	if err := p.PublishWithOptions(ctx, item, map[string]string{ConfigAccessModel: AccessOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PublishWithOptions(ctx, item, map[string]string{ConfigAccessModel: AccessWhitelist}); !errors.Is(err, ErrPreconditionNotMet) {
+		t.Fatalf("conflicting options: %v", err)
+	}
+
+	// Only PEP services create nodes on publish.
+	if err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetNode(ctx, "pubsub.example.com", "news"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("service node: %v", err)
+	}
+}
+
+func TestPEPPreconditionDefaults(t *testing.T) {
+	p, _ := newNotifyingPlugin(t)
+	ctx := context.Background()
+	item := &storage.PubSubItem{Host: pepHost, NodeID: "storage:bookmarks", ItemID: "current"}
+	if err := p.PublishItem(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	// The default access model of a PEP node satisfies a precondition on it.
+	if err := p.PublishWithOptions(ctx, item, map[string]string{ConfigAccessModel: AccessPresence}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPEPRecipients(t *testing.T) {
+	p, sent := newNotifyingPlugin(t)
+	ctx := context.Background()
+	if err := p.SubscribeNode(ctx, &storage.PubSubSubscription{Host: pepHost, NodeID: "n", JID: "bob@example.com/phone", State: StateSubscribed}); err != nil {
+		t.Fatal(err)
+	}
+	var asked string
+	p.SetPEPRecipients(func(_ context.Context, owner jid.JID, node string) ([]jid.JID, error) {
+		asked = owner.String() + " " + node
+		return []jid.JID{jid.MustParse("alice@example.com/laptop"), jid.MustParse("bob@example.com/phone")}, nil
+	})
+	if err := p.PublishItem(ctx, &storage.PubSubItem{Host: pepHost, NodeID: "n", ItemID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if asked != pepHost+" n" {
+		t.Errorf("recipients asked for %q", asked)
+	}
+	if got := recipientsOf(*sent); !slices.Equal(got, []string{"alice@example.com/laptop", "bob@example.com/phone"}) {
+		t.Fatalf("notified %v", got)
+	}
+
+	// Other services do not ask for presence-based recipients.
+	*sent, asked = nil, ""
+	if err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if asked != "" || len(*sent) != 2 {
+		t.Fatalf("asked %q, notified %v", asked, recipientsOf(*sent))
+	}
+}
+
+func TestRetractItem(t *testing.T) {
+	p, sent := newNotifyingPlugin(t)
+	ctx := context.Background()
+	if err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	*sent = nil
+	if err := p.RetractItem(ctx, "pubsub.example.com", "news", "1", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 0 {
+		t.Fatalf("silent retract notified %v", recipientsOf(*sent))
+	}
+	if err := p.RetractItem(ctx, "pubsub.example.com", "news", "1", true); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("retracting a missing item: %v", err)
+	}
+
+	if err := p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "news", ItemID: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	*sent = nil
+	if err := p.RetractItem(ctx, "pubsub.example.com", "news", "2", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("notified %v", recipientsOf(*sent))
+	}
+	data, _ := xml.Marshal((*sent)[0])
+	if !strings.Contains(string(data), `<retract id="2">`) {
+		t.Fatalf("notification %s", data)
+	}
+}
+
+func TestSendLastItem(t *testing.T) {
+	p, sent := newNotifyingPlugin(t)
+	ctx := context.Background()
+	to := jid.MustParse("bob@example.com/phone")
+	if err := p.SendLastItem(ctx, pepHost, "n", to); err != nil || len(*sent) != 0 {
+		t.Fatalf("empty node: %v, sent %d", err, len(*sent))
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := p.PublishItem(ctx, &storage.PubSubItem{Host: pepHost, NodeID: "n", ItemID: id, Payload: []byte("<v>" + id + "</v>")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*sent = nil
+	if err := p.SendLastItem(ctx, pepHost, "n", to); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 1 || !(*sent)[0].To.Equal(to) {
+		t.Fatalf("sent %v", recipientsOf(*sent))
+	}
+	data, _ := xml.Marshal((*sent)[0])
+	if !strings.Contains(string(data), `id="2"`) || !strings.Contains(string(data), "<v>2</v>") {
+		t.Fatalf("last item %s", data)
+	}
+}
@@ -4,6 +4,7 @@ package pubsub
 import (
 	"context"
 	"encoding/xml"
+	"sync"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
@@ -19,6 +20,7 @@ type PubSub struct {
 	Subscribe   *SubReq      `xml:"subscribe,omitempty"`
 	Unsubscribe *Unsub       `xml:"unsubscribe,omitempty"`
 	Publish     *Publish     `xml:"publish,omitempty"`
+	PublishOptions *PublishOptions `xml:"publish-options,omitempty"`
 	Retract     *Retract     `xml:"retract,omitempty"`
 	Items       *Items       `xml:"items,omitempty"`
 	Subscription *Subscription `xml:"subscription,omitempty"`
@@ -53,6 +55,13 @@ type Publish struct {
 	Items   []PubItem `xml:"item"`
 }
 
+// PublishOptions carries the XEP-0060 §7.1.5 publish-options form that
+// accompanies a publish request.
+type PublishOptions struct {
+	XMLName xml.Name `xml:"publish-options"`
+	Form    []byte   `xml:",innerxml"`
+}
+
 type PubItem struct {
 	XMLName xml.Name `xml:"item"`
 	ID      string   `xml:"id,attr,omitempty"`
@@ -137,8 +146,11 @@ type OwnerPurge struct {
 }
 
 type Plugin struct {
+	mu     sync.RWMutex
 	store  storage.PubSubStore
 	params plugin.InitParams
+	notify NotifyFunc
+	pep    RecipientsFunc
 }
 
 func New() *Plugin { return &Plugin{} }
@@ -155,82 +167,101 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-// CreateNode creates a new pubsub node. Returns nil if no store is configured.
+// StorageAvailable reports whether the configured storage provides a
+// PubSubStore. It implements plugin.StorageUser.
+func (p *Plugin) StorageAvailable() bool { return p.store != nil }
+
+// CreateNode creates a new pubsub node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) CreateNode(ctx context.Context, node *storage.PubSubNode) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.CreateNode(ctx, node)
 }
 
-// GetNode retrieves a pubsub node. Returns nil if no store is configured.
+// GetNode retrieves a pubsub node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) GetNode(ctx context.Context, host, nodeID string) (*storage.PubSubNode, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetNode(ctx, host, nodeID)
 }
 
-// DeleteNode deletes a pubsub node. Returns nil if no store is configured.
+// DeleteNode deletes a pubsub node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) DeleteNode(ctx context.Context, host, nodeID string) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.DeleteNode(ctx, host, nodeID)
 }
 
-// ListNodes lists all nodes for a host. Returns nil if no store is configured.
+// ListNodes lists all nodes for a host. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) ListNodes(ctx context.Context, host string) ([]*storage.PubSubNode, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.ListNodes(ctx, host)
 }
 
-// PublishItem publishes or updates an item on a node. Returns nil if no store is configured.
+// PublishItem publishes or updates an item on a node and notifies the
+// node's subscribers through the function set with SetNotifier, as the
+// node's deliver_notifications, deliver_payloads and persist_items
+// settings allow. The item is stored before anyone is notified; errors
+// delivering notifications are returned after all subscribers were tried.
+// A node missing on a PEP service is created as by PublishWithOptions.
+// Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) PublishItem(ctx context.Context, item *storage.PubSubItem) error {
-	if p.store == nil {
+	return p.PublishWithOptions(ctx, item, nil)
+}
+
+func (p *Plugin) publish(ctx context.Context, config map[string]string, item *storage.PubSubItem) error {
+	if configEnabled(config, ConfigPersistItems) {
+		if err := p.store.UpsertItem(ctx, item); err != nil {
+			return err
+		}
+	}
+	if !configEnabled(config, ConfigDeliverNotifications) {
 		return nil
 	}
-	return p.store.UpsertItem(ctx, item)
+	return p.notifyEvent(ctx, item.Host, item.NodeID, eventItems(item, configEnabled(config, ConfigDeliverPayloads)))
 }
 
-// GetItems retrieves all items from a node. Returns nil if no store is configured.
+// GetItems retrieves all items from a node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) GetItems(ctx context.Context, host, nodeID string) ([]*storage.PubSubItem, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetItems(ctx, host, nodeID)
 }
 
-// DeleteItem deletes an item from a node. Returns nil if no store is configured.
+// DeleteItem deletes an item from a node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) DeleteItem(ctx context.Context, host, nodeID, itemID string) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.DeleteItem(ctx, host, nodeID, itemID)
 }
 
-// SubscribeNode adds a subscription. Returns nil if no store is configured.
+// SubscribeNode adds a subscription. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) SubscribeNode(ctx context.Context, sub *storage.PubSubSubscription) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.Subscribe(ctx, sub)
 }
 
-// UnsubscribeNode removes a subscription. Returns nil if no store is configured.
+// UnsubscribeNode removes a subscription. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) UnsubscribeNode(ctx context.Context, host, nodeID, jid string) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.Unsubscribe(ctx, host, nodeID, jid)
 }
 
-// GetSubscriptions retrieves all subscriptions for a node. Returns nil if no store is configured.
+// GetSubscriptions retrieves all subscriptions for a node. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) GetSubscriptions(ctx context.Context, host, nodeID string) ([]*storage.PubSubSubscription, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetSubscriptions(ctx, host, nodeID)
 }
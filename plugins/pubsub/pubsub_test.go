@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestWithoutStoreReportsUnavailable(t *testing.T) {
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if p.StorageAvailable() {
+		t.Fatal("StorageAvailable = true without storage")
+	}
+	ctx := context.Background()
+	calls := map[string]error{
+		"CreateNode":    p.CreateNode(ctx, &storage.PubSubNode{Host: "pubsub.example.com", NodeID: "n"}),
+		"PublishItem":   p.PublishItem(ctx, &storage.PubSubItem{Host: "pubsub.example.com", NodeID: "n", ItemID: "1"}),
+		"SubscribeNode": p.SubscribeNode(ctx, &storage.PubSubSubscription{Host: "pubsub.example.com", NodeID: "n", JID: "alice@example.com"}),
+	}
+	_, calls["GetNode"] = p.GetNode(ctx, "pubsub.example.com", "n")
+	_, calls["ListNodes"] = p.ListNodes(ctx, "pubsub.example.com")
+	_, calls["GetItems"] = p.GetItems(ctx, "pubsub.example.com", "n")
+	for name, err := range calls {
+		if !errors.Is(err, storage.ErrStorageUnavailable) {
+			t.Errorf("%s: %v, want ErrStorageUnavailable", name, err)
+		}
+	}
+}
+
+func TestWithStoreAvailable(t *testing.T) {
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if !p.StorageAvailable() {
+		t.Fatal("StorageAvailable = false with memory storage")
+	}
+}
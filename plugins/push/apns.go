@@ -0,0 +1,171 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+)
+
+// APNs endpoints for production and development builds of an app.
+const (
+	APNsEndpoint        = "https://api.push.apple.com"
+	APNsSandboxEndpoint = "https://api.sandbox.push.apple.com"
+)
+
+// apnsTokenLifetime is how long a provider token is reused. Apple rejects
+// tokens older than an hour and ones renewed more often than every 20
+// minutes.
+const apnsTokenLifetime = 50 * time.Minute
+
+// APNs sends notifications through the Apple Push Notification service as
+// alerts naming the sender, with the summary fields as custom keys.
+type APNs struct {
+	// Topic is the bundle ID of the app.
+	Topic string
+	// Token returns a provider authentication token, such as
+	// APNsKey.Token.
+	Token func(ctx context.Context) (string, error)
+	// Client sends the requests; nil means http.DefaultClient, which
+	// speaks the HTTP/2 APNs requires.
+	Client *http.Client
+	// Endpoint is the base URL of the service; empty means APNsEndpoint.
+	Endpoint string
+}
+
+func (a *APNs) Send(ctx context.Context, p Push) error {
+	token, err := a.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("push: apns token: %w", err)
+	}
+	alert := map[string]string{"body": "New message"}
+	if !p.Summary.LastMessageSender.IsZero() {
+		alert["title"] = p.Summary.LastMessageSender.Bare().String()
+	}
+	if p.Summary.LastMessageBody != "" {
+		alert["body"] = p.Summary.LastMessageBody
+	}
+	aps := map[string]any{"alert": alert, "sound": "default", "mutable-content": 1}
+	payload := map[string]any{"aps": aps}
+	if p.Summary.MessageCount > 0 {
+		aps["badge"] = p.Summary.MessageCount
+		payload["message-count"] = p.Summary.MessageCount
+	}
+	if !p.Summary.LastMessageSender.IsZero() {
+		payload["last-message-sender"] = p.Summary.LastMessageSender.String()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = APNsEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/3/device/"+url.PathEscape(p.Token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	resp, err := httpClient(a.Client).Do(req)
+	if err != nil {
+		return fmt.Errorf("push: apns: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if resp.StatusCode == http.StatusGone {
+		return ErrUnregistered
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	if resp.StatusCode == http.StatusBadRequest && json.NewDecoder(resp.Body).Decode(&reason) == nil {
+		if reason.Reason == "BadDeviceToken" || reason.Reason == "Unregistered" {
+			return ErrUnregistered
+		}
+		return fmt.Errorf("push: apns: %s: %s", resp.Status, reason.Reason)
+	}
+	return fmt.Errorf("push: apns: %s", responseError(resp))
+}
+
+// APNsKey issues provider authentication tokens signed with an APNs
+// authentication key, reusing each for apnsTokenLifetime.
+type APNsKey struct {
+	TeamID string
+	KeyID  string
+	// Clock stamps the tokens; nil means clock.System.
+	Clock clock.Clock
+
+	key *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// ParseAPNsKey reads the .p8 authentication key with the ID keyID that the
+// Apple developer account of team teamID issued.
+func ParseAPNsKey(teamID, keyID string, pemData []byte) (*APNsKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("push: apns key: no PEM data")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("push: apns key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("push: apns key: private key is not ECDSA")
+	}
+	return &APNsKey{TeamID: teamID, KeyID: keyID, key: key}, nil
+}
+
+// Token returns the current provider token, signing a new one when it is
+// due.
+func (k *APNsKey) Token(context.Context) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := clock.Or(k.Clock).Now()
+	if k.token != "" && now.Sub(k.issued) < apnsTokenLifetime {
+		return k.token, nil
+	}
+	token, err := signJWT(
+		map[string]string{"alg": "ES256", "kid": k.KeyID},
+		map[string]any{"iss": k.TeamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, k.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants the fixed-size concatenation of r and s.
+			size := (k.key.Curve.Params().BitSize + 7) / 8
+			sig := make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+			return sig, nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	k.token, k.issued = token, now
+	return token, nil
+}
@@ -0,0 +1,228 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+)
+
+// FCMEndpoint is the base URL of the Firebase Cloud Messaging API.
+const FCMEndpoint = "https://fcm.googleapis.com"
+
+// fcmScope is the OAuth 2.0 scope of the FCM HTTP v1 API.
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// FCM sends notifications through the Firebase Cloud Messaging HTTP v1 API
+// as high-priority data messages carrying the summary fields.
+type FCM struct {
+	ProjectID string
+	// Token returns an OAuth 2.0 access token for the FCM API, such as
+	// ServiceAccount.Token.
+	Token func(ctx context.Context) (string, error)
+	// Client sends the requests; nil means http.DefaultClient.
+	Client *http.Client
+	// Endpoint is the base URL of the API; empty means FCMEndpoint.
+	Endpoint string
+}
+
+func (f *FCM) Send(ctx context.Context, p Push) error {
+	token, err := f.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("push: fcm token: %w", err)
+	}
+	data := map[string]string{}
+	if p.Summary.MessageCount > 0 {
+		data["message-count"] = strconv.Itoa(p.Summary.MessageCount)
+	}
+	if !p.Summary.LastMessageSender.IsZero() {
+		data["last-message-sender"] = p.Summary.LastMessageSender.String()
+	}
+	if p.Summary.LastMessageBody != "" {
+		data["last-message-body"] = p.Summary.LastMessageBody
+	}
+	body, err := json.Marshal(map[string]any{"message": map[string]any{
+		"token":   p.Token,
+		"data":    data,
+		"android": map[string]string{"priority": "high"},
+	}})
+	if err != nil {
+		return err
+	}
+
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = FCMEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v1/projects/"+url.PathEscape(f.ProjectID)+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient(f.Client).Do(req)
+	if err != nil {
+		return fmt.Errorf("push: fcm: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// FCM reports UNREGISTERED for tokens of uninstalled apps.
+		return ErrUnregistered
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("push: fcm: %s", responseError(resp))
+	}
+	return nil
+}
+
+// ServiceAccount issues access tokens for the FCM API from the key of a
+// Google service account, caching each until shortly before it expires.
+type ServiceAccount struct {
+	ProjectID   string
+	ClientEmail string
+	// TokenURI is where access tokens are requested.
+	TokenURI string
+	// Client sends the requests; nil means http.DefaultClient.
+	Client *http.Client
+	// Clock stamps the token requests; nil means clock.System.
+	Clock clock.Clock
+
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// ParseServiceAccount reads a service account key file in the JSON format
+// the Google Cloud console downloads.
+func ParseServiceAccount(data []byte) (*ServiceAccount, error) {
+	var f struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("push: service account: %w", err)
+	}
+	block, _ := pem.Decode([]byte(f.PrivateKey))
+	if block == nil || f.ClientEmail == "" || f.TokenURI == "" {
+		return nil, errors.New("push: service account: missing client_email, token_uri or private_key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("push: service account: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("push: service account: private key is not RSA")
+	}
+	return &ServiceAccount{ProjectID: f.ProjectID, ClientEmail: f.ClientEmail, TokenURI: f.TokenURI, key: key}, nil
+}
+
+// Token returns an access token for the FCM API, requesting a new one
+// with a signed JWT assertion (RFC 7523) when the cached one is about to
+// expire.
+func (a *ServiceAccount) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := clock.Or(a.Clock).Now()
+	if a.token != "" && now.Before(a.expires) {
+		return a.token, nil
+	}
+
+	assertion, err := signJWT(
+		map[string]string{"alg": "RS256", "typ": "JWT"},
+		map[string]any{"iss": a.ClientEmail, "scope": fcmScope, "aud": a.TokenURI, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest)
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient(a.Client).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s", responseError(resp))
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	if res.AccessToken == "" {
+		return "", errors.New("token request: no access token")
+	}
+	// Renew a minute early so a token never expires in flight.
+	a.token, a.expires = res.AccessToken, now.Add(time.Duration(res.ExpiresIn)*time.Second-time.Minute)
+	return a.token, nil
+}
+
+// signJWT returns the compact serialization of a JWT with header and
+// claims, signed by sign over the SHA-256 digest of its signing input.
+func signJWT(header, claims any, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64URL(h) + "." + base64URL(c)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64URL(sig), nil
+}
+
+func base64URL(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func httpClient(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
+
+// responseError describes a failed response by its status and the start of
+// its body.
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return resp.Status
+	}
+	return resp.Status + ": " + string(bytes.TrimSpace(body))
+}
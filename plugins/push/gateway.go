@@ -0,0 +1,105 @@
+package push
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// ErrUnregistered is returned by a Sender for a device token the platform
+// no longer accepts. The Gateway then answers the notification with
+// item-not-found, so the user's server disables the registration.
+var ErrUnregistered = errors.New("push: device token not registered")
+
+// Push is a notification for one device, as a Gateway hands it to a
+// Sender.
+type Push struct {
+	// Token is the device token the client registered with.
+	Token   string
+	Summary Summary
+}
+
+// Sender delivers notifications through a platform push service.
+type Sender interface {
+	Send(ctx context.Context, p Push) error
+}
+
+// Gateway is an XMPP Push Service: it receives the notifications users'
+// servers publish to it and forwards them to the Sender of the device's
+// platform.
+//
+// A client enables push notifications with the gateway's JID, a node of its
+// choosing, and publish-options naming the platform in the "service" field
+// and its device token in the "token" field, such as "fcm" and the FCM
+// registration token.
+type Gateway struct {
+	mu      sync.RWMutex
+	senders map[string]Sender
+	secret  string
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{senders: make(map[string]Sender)}
+}
+
+// Handle forwards the notifications for the platform service to s.
+func (g *Gateway) Handle(service string, s Sender) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.senders[service] = s
+}
+
+// SetSecret makes the gateway forward only notifications whose
+// publish-options carry secret in the "secret" field. An empty secret
+// accepts every notification.
+func (g *Gateway) SetSecret(secret string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.secret = secret
+}
+
+// HandleIQ forwards the notification published by iq and returns the
+// reply, or nil when iq is not a publish request.
+func (g *Gateway) HandleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var req pubsub.PubSub
+	if err := xml.Unmarshal(iq.Query, &req); err != nil || req.Publish == nil {
+		return nil
+	}
+	var n Notification
+	if len(req.Publish.Items) != 1 || xml.Unmarshal(req.Publish.Items[0].Payload, &n) != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "publish one notification"))
+	}
+	var opts form.Form
+	if req.PublishOptions == nil || xml.Unmarshal(req.PublishOptions.Form, &opts) != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, "publish options required"))
+	}
+
+	g.mu.RLock()
+	sender, secret := g.senders[opts.GetValue("service")], g.secret
+	g.mu.RUnlock()
+	if secret != "" && subtle.ConstantTimeCompare([]byte(opts.GetValue("secret")), []byte(secret)) != 1 {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeAuth, stanza.ErrorForbidden, ""))
+	}
+	token := opts.GetValue("token")
+	if sender == nil || token == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "unknown push service or token"))
+	}
+
+	err := sender.Send(ctx, Push{Token: token, Summary: ParseSummary(n.Form)})
+	switch {
+	case errors.Is(err, ErrUnregistered):
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "device token not registered"))
+	case err != nil:
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorRemoteServerTimeout, ""))
+	}
+	return iq.ResultIQ()
+}
@@ -0,0 +1,252 @@
+package push
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+type senderFunc func(ctx context.Context, p Push) error
+
+func (f senderFunc) Send(ctx context.Context, p Push) error { return f(ctx, p) }
+
+// notification returns what the server of alice publishes to the gateway
+// for a registration with opts.
+func notification(t *testing.T, opts map[string]string) *stanza.IQ {
+	t.Helper()
+	p, _ := newPlugin(t)
+	request(t, p, alice, Enable{JID: "push.example.net", Node: "device-1", Form: publishOptions(opts)})
+	return notify(t, p, alice, Summary{MessageCount: 1, LastMessageSender: bob})[0]
+}
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	var got []Push
+	g := NewGateway()
+	g.Handle("fcm", senderFunc(func(_ context.Context, p Push) error {
+		if p.Token == "gone" {
+			return ErrUnregistered
+		}
+		if p.Token == "broken" {
+			return errors.New("unavailable")
+		}
+		got = append(got, p)
+		return nil
+	}))
+
+	res := g.HandleIQ(ctx, notification(t, map[string]string{"service": "fcm", "token": "abc"}))
+	if res == nil || res.Type != stanza.IQResult {
+		t.Fatalf("reply = %+v", res)
+	}
+	if len(got) != 1 || got[0].Token != "abc" || got[0].Summary.MessageCount != 1 || !got[0].Summary.LastMessageSender.Equal(bob) {
+		t.Fatalf("pushed %+v", got)
+	}
+
+	for _, tc := range []struct {
+		opts      map[string]string
+		condition string
+	}{
+		{map[string]string{"service": "apns", "token": "abc"}, stanza.ErrorItemNotFound},
+		{map[string]string{"service": "fcm"}, stanza.ErrorItemNotFound},
+		{map[string]string{"service": "fcm", "token": "gone"}, stanza.ErrorItemNotFound},
+		{map[string]string{"service": "fcm", "token": "broken"}, stanza.ErrorRemoteServerTimeout},
+	} {
+		res := g.HandleIQ(ctx, notification(t, tc.opts))
+		if res.Error == nil || res.Error.Condition != tc.condition {
+			t.Fatalf("%v: %+v", tc.opts, res.Error)
+		}
+	}
+
+	g.SetSecret("s3")
+	if res := g.HandleIQ(ctx, notification(t, map[string]string{"service": "fcm", "token": "abc", "secret": "nope"})); res.Error == nil || res.Error.Condition != stanza.ErrorForbidden {
+		t.Fatalf("wrong secret: %+v", res.Error)
+	}
+	if res := g.HandleIQ(ctx, notification(t, map[string]string{"service": "fcm", "token": "abc", "secret": "s3"})); res.Type != stanza.IQResult {
+		t.Fatalf("right secret: %+v", res.Error)
+	}
+
+	ping := stanza.NewIQ(stanza.IQGet)
+	ping.Query = []byte(`<ping xmlns='urn:xmpp:ping'/>`)
+	if res := g.HandleIQ(ctx, ping); res != nil {
+		t.Fatalf("ping = %+v", res)
+	}
+}
+
+// jwtPart decodes part i of token into v.
+func jwtPart(t *testing.T, token string, i int, v any) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFCM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	var tokenRequests int
+	var sent map[string]map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			assertion := r.FormValue("assertion")
+			parts := strings.Split(assertion, ".")
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+				http.Error(w, "bad signature", http.StatusBadRequest)
+				return
+			}
+			var claims map[string]any
+			jwtPart(t, assertion, 1, &claims)
+			if claims["iss"] != "push@example.iam" || claims["scope"] != fcmScope {
+				http.Error(w, "bad claims", http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, `{"access_token":"at-1","expires_in":3600}`)
+		case "/v1/projects/demo/messages:send":
+			if r.Header.Get("Authorization") != "Bearer at-1" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewDecoder(r.Body).Decode(&sent)
+			if sent["message"]["token"] == "gone" {
+				http.Error(w, `{"error":{"status":"NOT_FOUND"}}`, http.StatusNotFound)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	keyFile, _ := json.Marshal(map[string]string{
+		"project_id":   "demo",
+		"client_email": "push@example.iam",
+		"token_uri":    srv.URL + "/token",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	account, err := ParseServiceAccount(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	account.Clock = clk
+	fcm := &FCM{ProjectID: account.ProjectID, Token: account.Token, Endpoint: srv.URL}
+
+	ctx := context.Background()
+	if err := fcm.Send(ctx, Push{Token: "abc", Summary: Summary{MessageCount: 2, LastMessageSender: bob}}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := sent["message"]["data"].(map[string]any)
+	if sent["message"]["token"] != "abc" || data["message-count"] != "2" || data["last-message-sender"] != bob.String() {
+		t.Fatalf("sent %v", sent)
+	}
+	if err := fcm.Send(ctx, Push{Token: "gone"}); !errors.Is(err, ErrUnregistered) {
+		t.Fatalf("unregistered token: %v", err)
+	}
+	if tokenRequests != 1 {
+		t.Fatalf("token requests = %d", tokenRequests)
+	}
+	clk.Advance(time.Hour)
+	if err := fcm.Send(ctx, Push{Token: "abc"}); err != nil || tokenRequests != 2 {
+		t.Fatalf("renewed token: %v, %d requests", err, tokenRequests)
+	}
+}
+
+func TestAPNs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	apnsKey, err := ParseAPNsKey("TEAM", "KEY", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	apnsKey.Clock = clk
+
+	var payload map[string]any
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+		parts := strings.Split(token, ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		tokens = append(tokens, token)
+		if r.Header.Get("apns-topic") != "com.example.chat" || r.Header.Get("apns-push-type") != "alert" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/3/device/abc":
+			_ = json.NewDecoder(r.Body).Decode(&payload)
+		case "/3/device/gone":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"reason":"BadDeviceToken"}`)
+		}
+	}))
+	defer srv.Close()
+
+	apns := &APNs{Topic: "com.example.chat", Token: apnsKey.Token, Endpoint: srv.URL}
+	ctx := context.Background()
+	if err := apns.Send(ctx, Push{Token: "abc", Summary: Summary{MessageCount: 3, LastMessageSender: bob}}); err != nil {
+		t.Fatal(err)
+	}
+	aps, _ := payload["aps"].(map[string]any)
+	alert, _ := aps["alert"].(map[string]any)
+	if aps["badge"] != 3.0 || alert["title"] != "bob@example.com" || alert["body"] != "New message" {
+		t.Fatalf("payload = %v", payload)
+	}
+	var header, claims map[string]any
+	jwtPart(t, tokens[0], 0, &header)
+	jwtPart(t, tokens[0], 1, &claims)
+	if header["alg"] != "ES256" || header["kid"] != "KEY" || claims["iss"] != "TEAM" {
+		t.Fatalf("token header %v, claims %v", header, claims)
+	}
+
+	for _, token := range []string{"gone", "bad"} {
+		if err := apns.Send(ctx, Push{Token: token}); !errors.Is(err, ErrUnregistered) {
+			t.Fatalf("%s: %v", token, err)
+		}
+	}
+	if tokens[1] != tokens[0] {
+		t.Fatal("provider token was not reused")
+	}
+	clk.Advance(apnsTokenLifetime)
+	if err := apns.Send(ctx, Push{Token: "abc"}); err != nil || tokens[len(tokens)-1] == tokens[0] {
+		t.Fatalf("provider token was not renewed: %v", err)
+	}
+}
@@ -1,21 +1,46 @@
 // Package push implements XEP-0357 Push Notifications.
+//
+// On a server, the Plugin keeps the registrations users enable with the app
+// servers of their clients and builds the notifications sent to them. The
+// Gateway is the other end: an XMPP Push Service that hands notifications to
+// a platform push service such as FCM or APNs.
 package push
 
 import (
 	"context"
 	"encoding/xml"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
 )
 
 const Name = "push"
 
+// FormSummary is the FORM_TYPE of the notification summary.
+const FormSummary = "urn:xmpp:push:summary"
+
+// FormPublishOptions is the FORM_TYPE of the publish-options a client
+// enables push notifications with.
+const FormPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+
+// ResultTimeout is how long a notification waits for the answer of its app
+// server before it is forgotten.
+const ResultTimeout = time.Minute
+
 type Enable struct {
-	XMLName xml.Name `xml:"urn:xmpp:push:0 enable"`
-	JID     string   `xml:"jid,attr"`
-	Node    string   `xml:"node,attr"`
-	Form    []byte   `xml:",innerxml"`
+	XMLName xml.Name   `xml:"urn:xmpp:push:0 enable"`
+	JID     string     `xml:"jid,attr"`
+	Node    string     `xml:"node,attr"`
+	Form    *form.Form `xml:"jabber:x:data x,omitempty"`
 }
 
 type Disable struct {
@@ -24,19 +49,211 @@ type Disable struct {
 	Node    string   `xml:"node,attr,omitempty"`
 }
 
+// Notification is the item published to the node of an app server.
+type Notification struct {
+	XMLName xml.Name   `xml:"urn:xmpp:push:0 notification"`
+	Form    *form.Form `xml:"jabber:x:data x,omitempty"`
+}
+
+// Summary describes the messages a notification is about (XEP-0357 §7).
+type Summary struct {
+	MessageCount      int
+	LastMessageSender jid.JID
+	// LastMessageBody is left empty unless the server was configured to
+	// disclose message content to app servers.
+	LastMessageBody string
+}
+
+// Form returns the summary as a submitted urn:xmpp:push:summary form,
+// leaving out the fields that are not set.
+func (s Summary) Form() *form.Form {
+	f := form.NewForm(form.TypeSubmit, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{FormSummary}})
+	if s.MessageCount > 0 {
+		f.AddField(form.Field{Var: "message-count", Values: []string{strconv.Itoa(s.MessageCount)}})
+	}
+	if !s.LastMessageSender.IsZero() {
+		f.AddField(form.Field{Var: "last-message-sender", Values: []string{s.LastMessageSender.String()}})
+	}
+	if s.LastMessageBody != "" {
+		f.AddField(form.Field{Var: "last-message-body", Values: []string{s.LastMessageBody}})
+	}
+	return f
+}
+
+// ParseSummary reads the summary form of a notification. Fields that are
+// missing or malformed are left zero.
+func ParseSummary(f *form.Form) Summary {
+	var s Summary
+	if f == nil || f.GetValue("FORM_TYPE") != FormSummary {
+		return s
+	}
+	s.MessageCount, _ = strconv.Atoi(f.GetValue("message-count"))
+	s.LastMessageSender, _ = jid.Parse(f.GetValue("last-message-sender"))
+	s.LastMessageBody = f.GetValue("last-message-body")
+	return s
+}
+
+type pending struct {
+	reg  storage.PushRegistration
+	sent time.Time
+}
+
+// Plugin keeps the push registrations of a server's users in the
+// storage.PushStore it is initialized with and notifies their app servers.
 type Plugin struct {
+	store  storage.PushStore
 	params plugin.InitParams
+
+	mu      sync.Mutex
+	pending map[string]pending // notification IQ ID -> registration
 }
 
-func New() *Plugin { return &Plugin{} }
+func New() *Plugin { return &Plugin{pending: make(map[string]pending)} }
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
 func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 	p.params = params
+	if params.Storage != nil {
+		p.store = params.Storage.PushStore()
+	}
 	return nil
 }
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
+// StorageAvailable reports whether the configured storage provides a
+// PushStore. It implements plugin.StorageUser.
+func (p *Plugin) StorageAvailable() bool { return p.store != nil }
+
+// HandleIQ enables or disables push notifications for the account of the
+// sender of iq and returns the reply, or nil when iq is neither request
+// (XEP-0357 §5, §6).
+func (p *Plugin) HandleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	if iq.Type != stanza.IQSet {
+		return nil
+	}
+	var enable Enable
+	var disable Disable
+	switch {
+	case xml.Unmarshal(iq.Query, &enable) == nil:
+		return p.enable(ctx, iq, enable)
+	case xml.Unmarshal(iq.Query, &disable) == nil:
+		return p.disable(ctx, iq, disable)
+	}
+	return nil
+}
+
+func (p *Plugin) enable(ctx context.Context, iq *stanza.IQ, req Enable) *stanza.IQ {
+	service, err := jid.Parse(req.JID)
+	if err != nil || req.Node == "" {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "enable needs the jid and node of the app server"))
+	}
+	if p.store == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "push notifications unavailable"))
+	}
+	reg := &storage.PushRegistration{UserJID: iq.From.Bare().String(), JID: service.String(), Node: req.Node}
+	if req.Form != nil {
+		if req.Form.Type != form.TypeSubmit || req.Form.GetValue("FORM_TYPE") != FormPublishOptions {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "publish options must be a submitted "+FormPublishOptions+" form"))
+		}
+		if reg.Options, err = xml.Marshal(req.Form); err != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, ""))
+		}
+	}
+	if err := p.store.SetPushRegistration(ctx, reg); err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return iq.ResultIQ()
+}
+
+func (p *Plugin) disable(ctx context.Context, iq *stanza.IQ, req Disable) *stanza.IQ {
+	service, err := jid.Parse(req.JID)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "disable needs the jid of the app server"))
+	}
+	if p.store == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "push notifications unavailable"))
+	}
+	if err := p.store.DeletePushRegistrations(ctx, iq.From.Bare().String(), service.String(), req.Node); err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	return iq.ResultIQ()
+}
+
+// Notify returns the notifications summarizing s for each app server user
+// enabled push notifications with, or none when there is no registration.
+// They are sent from the account of user; their answers go to
+// HandleResult.
+func (p *Plugin) Notify(ctx context.Context, user jid.JID, s Summary) ([]*stanza.IQ, error) {
+	if p.store == nil {
+		return nil, storage.ErrStorageUnavailable
+	}
+	regs, err := p.store.GetPushRegistrations(ctx, user.Bare().String())
+	if err != nil || len(regs) == 0 {
+		return nil, err
+	}
+	item, err := xml.Marshal(Notification{Form: s.Form()})
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Or(p.params.Clock).Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, n := range p.pending {
+		if now.Sub(n.sent) >= ResultTimeout {
+			delete(p.pending, id)
+		}
+	}
+	iqs := make([]*stanza.IQ, 0, len(regs))
+	for _, reg := range regs {
+		to, err := jid.Parse(reg.JID)
+		if err != nil {
+			continue
+		}
+		req := pubsub.PubSub{Publish: &pubsub.Publish{Node: reg.Node, Items: []pubsub.PubItem{{Payload: item}}}}
+		if len(reg.Options) > 0 {
+			req.PublishOptions = &pubsub.PublishOptions{Form: reg.Options}
+		}
+		payload, err := xml.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		iq := stanza.NewIQ(stanza.IQSet)
+		iq.From, iq.To, iq.Query = user.Bare(), to, payload
+		p.pending[iq.ID] = pending{reg: *reg, sent: now}
+		iqs = append(iqs, iq)
+	}
+	return iqs, nil
+}
+
+// HandleResult handles the answer of an app server to a notification and
+// reports whether iq was one. An app server that rejects a notification
+// with an error other than a temporary one no longer serves the
+// registration, so it is disabled (XEP-0357 §8).
+func (p *Plugin) HandleResult(ctx context.Context, iq *stanza.IQ) bool {
+	if iq.Type != stanza.IQResult && iq.Type != stanza.IQError {
+		return false
+	}
+	p.mu.Lock()
+	n, ok := p.pending[iq.ID]
+	if ok && n.reg.JID == iq.From.String() && n.reg.UserJID == iq.To.Bare().String() {
+		delete(p.pending, iq.ID)
+	} else {
+		ok = false
+	}
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if iq.Type == stanza.IQError && (iq.Error == nil || iq.Error.Type != stanza.ErrorTypeWait) {
+		// The registration is tried again with the next notification
+		// if it cannot be removed now.
+		_ = p.store.DeletePushRegistrations(ctx, n.reg.UserJID, n.reg.JID, n.reg.Node)
+	}
+	return true
+}
+
 func init() { _ = ns.Push }
@@ -0,0 +1,205 @@
+package push
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+var (
+	alice = jid.MustParse("alice@example.com/phone")
+	bob   = jid.MustParse("bob@example.com/desk")
+)
+
+func newPlugin(t *testing.T) (*Plugin, *clock.Fake) {
+	t.Helper()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{Storage: memory.New(), Clock: clk}); err != nil {
+		t.Fatal(err)
+	}
+	return p, clk
+}
+
+func request(t *testing.T, p *Plugin, from jid.JID, payload any) *stanza.IQ {
+	t.Helper()
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.From, iq.Query = from, data
+	res := p.HandleIQ(context.Background(), iq)
+	if res == nil {
+		t.Fatal("HandleIQ returned nil")
+	}
+	return res
+}
+
+func publishOptions(fields map[string]string) *form.Form {
+	f := form.NewForm(form.TypeSubmit, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Values: []string{FormPublishOptions}})
+	for name, value := range fields {
+		f.AddField(form.Field{Var: name, Values: []string{value}})
+	}
+	return f
+}
+
+func notify(t *testing.T, p *Plugin, user jid.JID, s Summary) []*stanza.IQ {
+	t.Helper()
+	iqs, err := p.Notify(context.Background(), user, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iqs
+}
+
+func TestEnableAndNotify(t *testing.T) {
+	p, _ := newPlugin(t)
+	if res := request(t, p, alice, Enable{JID: "push.example.net", Node: "device-1", Form: publishOptions(map[string]string{"secret": "s3"})}); res.Type != stanza.IQResult {
+		t.Fatalf("enable: %+v", res.Error)
+	}
+	if iqs := notify(t, p, bob.Bare(), Summary{MessageCount: 1}); len(iqs) != 0 {
+		t.Fatalf("bob has notifications: %d", len(iqs))
+	}
+
+	iqs := notify(t, p, alice.Bare(), Summary{MessageCount: 2, LastMessageSender: bob})
+	if len(iqs) != 1 {
+		t.Fatalf("notifications = %d", len(iqs))
+	}
+	iq := iqs[0]
+	if iq.Type != stanza.IQSet || iq.From.String() != "alice@example.com" || iq.To.String() != "push.example.net" {
+		t.Fatalf("notification %+v", iq.Header)
+	}
+	var req pubsub.PubSub
+	if err := xml.Unmarshal(iq.Query, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Publish == nil || req.Publish.Node != "device-1" || len(req.Publish.Items) != 1 || req.PublishOptions == nil {
+		t.Fatalf("publish = %s", iq.Query)
+	}
+	var n Notification
+	if err := xml.Unmarshal(req.Publish.Items[0].Payload, &n); err != nil {
+		t.Fatal(err)
+	}
+	if s := ParseSummary(n.Form); s.MessageCount != 2 || !s.LastMessageSender.Equal(bob) || s.LastMessageBody != "" {
+		t.Fatalf("summary = %+v", s)
+	}
+	var opts form.Form
+	if err := xml.Unmarshal(req.PublishOptions.Form, &opts); err != nil || opts.GetValue("secret") != "s3" {
+		t.Fatalf("publish options = %s, %v", req.PublishOptions.Form, err)
+	}
+}
+
+func TestEnableErrors(t *testing.T) {
+	p, _ := newPlugin(t)
+	for _, req := range []Enable{
+		{JID: "push.example.net"},
+		{Node: "device-1"},
+		{JID: "push.example.net", Node: "device-1", Form: form.NewForm(form.TypeSubmit, "")},
+	} {
+		if res := request(t, p, alice, req); res.Error == nil || res.Error.Condition != stanza.ErrorBadRequest {
+			t.Fatalf("enable %+v: %+v", req, res.Error)
+		}
+	}
+
+	noStore := New()
+	if res := request(t, noStore, alice, Enable{JID: "push.example.net", Node: "device-1"}); res.Error == nil || res.Error.Condition != stanza.ErrorServiceUnavailable {
+		t.Fatalf("enable without storage: %+v", res.Error)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	p, _ := newPlugin(t)
+	for _, node := range []string{"device-1", "device-2"} {
+		request(t, p, alice, Enable{JID: "push.example.net", Node: node})
+	}
+	request(t, p, alice, Enable{JID: "push.example.org", Node: "device-1"})
+
+	if res := request(t, p, alice, Disable{JID: "push.example.net", Node: "device-1"}); res.Type != stanza.IQResult {
+		t.Fatalf("disable node: %+v", res.Error)
+	}
+	if n := len(notify(t, p, alice, Summary{})); n != 2 {
+		t.Fatalf("after disabling a node: %d notifications", n)
+	}
+	if res := request(t, p, alice, Disable{JID: "push.example.net"}); res.Type != stanza.IQResult {
+		t.Fatalf("disable service: %+v", res.Error)
+	}
+	iqs := notify(t, p, alice, Summary{})
+	if len(iqs) != 1 || iqs[0].To.String() != "push.example.org" {
+		t.Fatalf("after disabling a service: %+v", iqs)
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	ctx := context.Background()
+	p, clk := newPlugin(t)
+	request(t, p, alice, Enable{JID: "push.example.net", Node: "device-1"})
+
+	answer := func(iq *stanza.IQ, err *stanza.StanzaError) *stanza.IQ {
+		res := iq.ResultIQ()
+		if err != nil {
+			res = iq.ErrorIQ(err)
+		}
+		return res
+	}
+
+	iq := notify(t, p, alice, Summary{})[0]
+	if !p.HandleResult(ctx, answer(iq, nil)) {
+		t.Fatal("result was not handled")
+	}
+	if p.HandleResult(ctx, answer(iq, nil)) {
+		t.Fatal("result was handled twice")
+	}
+	other := stanza.NewIQ(stanza.IQResult)
+	if p.HandleResult(ctx, other) {
+		t.Fatal("unrelated result was handled")
+	}
+
+	// A temporary error keeps the registration.
+	iq = notify(t, p, alice, Summary{})[0]
+	p.HandleResult(ctx, answer(iq, stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "")))
+	iq = notify(t, p, alice, Summary{})[0]
+
+	// An unanswered notification is forgotten.
+	clk.Advance(ResultTimeout)
+	notify(t, p, alice, Summary{})
+	if p.HandleResult(ctx, answer(iq, nil)) {
+		t.Fatal("expired notification was handled")
+	}
+
+	iq = notify(t, p, alice, Summary{})[0]
+	if !p.HandleResult(ctx, answer(iq, stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, ""))) {
+		t.Fatal("error was not handled")
+	}
+	if n := len(notify(t, p, alice, Summary{})); n != 0 {
+		t.Fatalf("rejected registration still notified: %d", n)
+	}
+}
+
+func TestSummaryForm(t *testing.T) {
+	s := Summary{MessageCount: 3, LastMessageSender: bob, LastMessageBody: "hi"}
+	data, err := xml.Marshal(s.Form())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f form.Form
+	if err := xml.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	if got := ParseSummary(&f); got != s {
+		t.Fatalf("round trip = %+v", got)
+	}
+	if got := (Summary{}).Form(); len(got.Fields) != 1 {
+		t.Fatalf("empty summary has fields %+v", got.Fields)
+	}
+}
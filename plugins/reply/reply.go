@@ -0,0 +1,134 @@
+// Package reply implements XEP-0461 Message Replies.
+package reply
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/fallback"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const Name = "reply"
+
+// ReplyTo returns the reply reference to the message with ID targetID
+// written by author, which may be the zero JID if unknown.
+func ReplyTo(targetID string, author jid.JID) stanza.ReplyRef {
+	return stanza.ReplyRef{ID: targetID, To: author}
+}
+
+// Attach marks msg as a reply by adding ref. If quote is not empty it is
+// quoted at the start of the body for clients without reply support, and
+// the quote is marked as fallback (XEP-0428) so that the others can strip
+// it again with Body.
+func Attach(msg *stanza.Message, ref stanza.ReplyRef, quote string) error {
+	ext, err := stanza.NewExtension(ref)
+	if err != nil {
+		return err
+	}
+	msg.Extensions = append(msg.Extensions, ext)
+	if quote == "" {
+		return nil
+	}
+
+	// The quote starts every body, so the fallback range holds for each.
+	quoted := Quote(quote)
+	if len(msg.Bodies) == 0 {
+		msg.SetBody("")
+	}
+	for i := range msg.Bodies {
+		msg.Bodies[i].Value = quoted + msg.Bodies[i].Value
+	}
+	return fallback.Attach(msg, fallback.Fallback{
+		For:    ns.Reply,
+		Bodies: []fallback.Range{fallback.NewRange(0, utf8.RuneCountInString(quoted))},
+	})
+}
+
+// Quote returns text as a quotation in XEP-0393 styling, each line prefixed
+// with "> ", followed by a newline.
+func Quote(text string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		b.WriteString("> ")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Build returns a reply to target with body, in target's conversation and
+// quoting target's body. In group chats the reference uses the ID the room
+// assigned to target (XEP-0359) and the occupant JID of its author, as
+// message IDs chosen by senders are not unique there.
+func Build(target *stanza.Message, body string) (*stanza.Message, error) {
+	msg := target.Reply(body)
+	ref := ReplyTo(target.ID, target.From.Bare())
+	if target.Type == stanza.MessageGroupchat {
+		ref.To = target.From
+		if id := roomStanzaID(target); id != "" {
+			ref.ID = id
+		}
+	}
+	if err := Attach(msg, ref, target.Body()); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// roomStanzaID returns the stanza ID the room of a groupchat message
+// assigned to it.
+func roomStanzaID(msg *stanza.Message) string {
+	room := msg.From.Bare().String()
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.StanzaID || ext.XMLName.Local != "stanza-id" {
+			continue
+		}
+		var id, by string
+		for _, attr := range ext.Attrs {
+			switch attr.Name.Local {
+			case "id":
+				id = attr.Value
+			case "by":
+				by = attr.Value
+			}
+		}
+		if by == room {
+			return id
+		}
+	}
+	return ""
+}
+
+// Body returns the body of msg without the quote of the replied-to message
+// that was added as fallback. If the fallback ranges are invalid the body
+// is returned as it is.
+func Body(msg *stanza.Message) string {
+	body, err := fallback.StripFallback(msg, ns.Reply)
+	if err != nil {
+		return msg.Body()
+	}
+	return body
+}
+
+// Plugin implements XEP-0461.
+type Plugin struct {
+	params plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
+
+func init() { _ = ns.Reply }
@@ -0,0 +1,143 @@
+package reply
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/fallback"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestParseReply(t *testing.T) {
+	var msg stanza.Message
+	err := xml.Unmarshal([]byte(`<message to='anna@example.com' id='message-id2' type='chat' xmlns='jabber:client'>
+  <body>> Anna wrote:
+> We should bake a cake
+Great idea!</body>
+  <reply to='anna@example.com/laptop' id='message-id1' xmlns='urn:xmpp:reply:0' />
+  <fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:reply:0'>
+    <body start="0" end="38" />
+  </fallback>
+</message>`), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, ok := msg.ReplyTo()
+	if !ok || ref.ID != "message-id1" || ref.To.String() != "anna@example.com/laptop" {
+		t.Fatalf("ReplyTo() = %+v, %v", ref, ok)
+	}
+	if got := Body(&msg); got != "Great idea!" {
+		t.Fatalf("Body() = %q", got)
+	}
+
+	var plain stanza.Message
+	if err := xml.Unmarshal([]byte(`<message><body>hi</body></message>`), &plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.ReplyTo(); ok {
+		t.Fatal("ReplyTo() reported a reply on a plain message")
+	}
+	if got := Body(&plain); got != "hi" {
+		t.Fatalf("Body() = %q", got)
+	}
+}
+
+func TestAttachRoundTrip(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("Sounds good 👍")
+	if err := Attach(msg, ReplyTo("m1", jid.MustParse("anna@example.com")), "Cake at 5? 🎂"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "> Cake at 5? 🎂\nSounds good 👍"; msg.Body() != want {
+		t.Fatalf("body = %q, want %q", msg.Body(), want)
+	}
+
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<reply xmlns="urn:xmpp:reply:0" to="anna@example.com" id="m1"></reply>`,
+		`<fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="15"></body></fallback>`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("%s\ndoes not contain %s", data, want)
+		}
+	}
+
+	var got stanza.Message
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if ref, ok := got.ReplyTo(); !ok || ref.ID != "m1" {
+		t.Fatalf("ReplyTo() = %+v, %v", ref, ok)
+	}
+	if Body(&got) != "Sounds good 👍" {
+		t.Fatalf("Body() = %q", Body(&got))
+	}
+}
+
+func TestAttachWithoutQuote(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.SetBody("ok")
+	if err := Attach(msg, ReplyTo("m1", jid.JID{}), ""); err != nil {
+		t.Fatal(err)
+	}
+	if fs, _ := fallback.FromMessage(msg); len(fs) != 0 {
+		t.Fatalf("fallbacks = %+v, want none", fs)
+	}
+	data, _ := xml.Marshal(msg)
+	if strings.Contains(string(data), "to=") {
+		t.Fatalf("reply without author has a to attribute: %s", data)
+	}
+}
+
+func TestBuildGroupchat(t *testing.T) {
+	var target stanza.Message
+	err := xml.Unmarshal([]byte(`<message from='room@muc.example.com/anna' id='client-id' type='groupchat' xmlns='jabber:client'>
+  <body>Line one
+line two</body>
+  <thread>t1</thread>
+  <stanza-id xmlns='urn:xmpp:sid:0' id='spoofed' by='anna@example.com'/>
+  <stanza-id xmlns='urn:xmpp:sid:0' id='room-id' by='room@muc.example.com'/>
+</message>`), &target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Build(&target, "Agreed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To.String() != "room@muc.example.com" || msg.Type != stanza.MessageGroupchat || msg.ThreadID() != "t1" {
+		t.Fatalf("reply to %s type %q thread %q", msg.To, msg.Type, msg.ThreadID())
+	}
+	ref, ok := msg.ReplyTo()
+	if !ok || ref.ID != "room-id" || ref.To.String() != "room@muc.example.com/anna" {
+		t.Fatalf("ReplyTo() = %+v", ref)
+	}
+	if msg.Body() != "> Line one\n> line two\nAgreed" || Body(msg) != "Agreed" {
+		t.Fatalf("body = %q, stripped %q", msg.Body(), Body(msg))
+	}
+}
+
+func TestBuildChat(t *testing.T) {
+	target := stanza.NewMessage(stanza.MessageChat)
+	target.ID = "m7"
+	target.From = jid.MustParse("anna@example.com/laptop")
+	target.SetBody("Hi")
+	msg, err := Build(target, "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := msg.ReplyTo()
+	if ref.ID != "m7" || ref.To.String() != "anna@example.com" {
+		t.Fatalf("ReplyTo() = %+v", ref)
+	}
+	fs, err := fallback.FromMessage(msg)
+	if err != nil || len(fs) != 1 || fs[0].For != ns.Reply {
+		t.Fatalf("fallbacks = %+v, %v", fs, err)
+	}
+}
@@ -0,0 +1,105 @@
+package roster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// ErrInvalidItem is returned by SetItem for an item a client may not set
+// (RFC 6121 §2.3.3).
+var ErrInvalidItem = errors.New("roster: invalid item")
+
+// Roster returns the roster of userJID and its version.
+func (p *Plugin) Roster(ctx context.Context, userJID string) ([]Item, string, error) {
+	if p.store == nil {
+		return nil, "", ErrNoStore
+	}
+	ris, err := p.store.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, "", err
+	}
+	ver, err := p.store.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]Item, len(ris))
+	for i, ri := range ris {
+		items[i] = rosterItemToItem(ri)
+	}
+	return items, ver, nil
+}
+
+// SetItem adds item to the roster of userJID or changes its name and
+// groups, as a client roster set does. The subscription state is the
+// server's to manage, so the item's subscription and ask are ignored. The
+// roster version is bumped and the item pushed.
+func (p *Plugin) SetItem(ctx context.Context, userJID string, item Item) error {
+	if p.store == nil {
+		return ErrNoStore
+	}
+	contact, err := jid.Parse(item.JID)
+	if err != nil {
+		return fmt.Errorf("%w: invalid JID %q", ErrInvalidItem, item.JID)
+	}
+	contactJID := contact.Bare().String()
+	if contactJID == userJID {
+		return fmt.Errorf("%w: a user cannot be in their own roster", ErrInvalidItem)
+	}
+	seen := make(map[string]bool, len(item.Groups))
+	for _, g := range item.Groups {
+		if g == "" {
+			return fmt.Errorf("%w: empty group name", ErrInvalidItem)
+		}
+		if seen[g] {
+			return fmt.Errorf("%w: duplicate group %q", ErrInvalidItem, g)
+		}
+		seen[g] = true
+	}
+
+	ri, err := p.rosterItem(ctx, userJID, contactJID)
+	if err != nil {
+		return err
+	}
+	ri.Name = item.Name
+	ri.Groups = slices.Clone(item.Groups)
+	return p.update(ctx, ri)
+}
+
+// RemoveItem deletes contactJID from the roster of userJID, bumps the
+// roster version and pushes the removal. It returns the removed item, whose
+// subscriptions the caller cancels, or storage.ErrNotFound.
+func (p *Plugin) RemoveItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
+	if p.store == nil {
+		return nil, ErrNoStore
+	}
+	ri, err := p.store.GetRosterItem(ctx, userJID, contactJID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.store.DeleteRosterItem(ctx, userJID, contactJID); err != nil {
+		return nil, err
+	}
+	ver, err := p.store.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	ver = nextVersion(ver)
+	if err := p.store.SetRosterVersion(ctx, userJID, ver); err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	push := p.pusher
+	p.mu.RUnlock()
+	if push != nil {
+		if err := push(ctx, userJID, ver, Item{JID: contactJID, Subscription: SubRemove}); err != nil {
+			return ri, err
+		}
+	}
+	return ri, nil
+}
@@ -0,0 +1,228 @@
+package roster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// ErrNoStore is returned by bulk operations when no roster store is configured.
+var ErrNoStore = errors.New("roster: no roster store")
+
+// ImportMode controls how Import combines items with an existing roster.
+type ImportMode int
+
+const (
+	// ImportMerge adds or updates the given items and keeps all others.
+	ImportMerge ImportMode = iota
+	// ImportReplace makes the given items the user's entire roster.
+	ImportReplace
+)
+
+// PushFunc delivers a roster push for userJID to its online resources.
+type PushFunc func(ctx context.Context, userJID, ver string, item Item) error
+
+// SetPusher sets the function Import uses to push changed items.
+func (p *Plugin) SetPusher(f PushFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pusher = f
+}
+
+// Export returns the full roster of userJID.
+func (p *Plugin) Export(ctx context.Context, userJID string) ([]storage.RosterItem, error) {
+	if p.store == nil {
+		return nil, ErrNoStore
+	}
+	ris, err := p.store.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]storage.RosterItem, len(ris))
+	for i, ri := range ris {
+		items[i] = *ri
+		items[i].Groups = slices.Clone(ri.Groups)
+	}
+	return items, nil
+}
+
+// Import writes items to the roster of userJID, either merging them into the
+// existing roster or replacing it. All items are validated before anything is
+// written. The roster version is bumped once and every changed item is pushed
+// through the function set with SetPusher.
+func (p *Plugin) Import(ctx context.Context, userJID string, items []storage.RosterItem, mode ImportMode) error {
+	if p.store == nil {
+		return ErrNoStore
+	}
+	user, err := jid.Parse(userJID)
+	if err != nil {
+		return fmt.Errorf("roster: invalid user JID %q: %w", userJID, err)
+	}
+	userJID = user.Bare().String()
+
+	incoming, err := normalizeImport(userJID, items)
+	if err != nil {
+		return err
+	}
+
+	current, err := p.store.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*storage.RosterItem, len(current))
+	for _, ri := range current {
+		existing[ri.ContactJID] = ri
+	}
+
+	var final []*storage.RosterItem
+	var removed []string
+	if mode == ImportReplace {
+		final = incoming
+		for contact := range existing {
+			if !slices.ContainsFunc(incoming, func(ri *storage.RosterItem) bool { return ri.ContactJID == contact }) {
+				removed = append(removed, contact)
+			}
+		}
+	} else {
+		final = slices.Clone(incoming)
+		for _, ri := range current {
+			if !slices.ContainsFunc(incoming, func(in *storage.RosterItem) bool { return in.ContactJID == ri.ContactJID }) {
+				final = append(final, ri)
+			}
+		}
+	}
+
+	var changed []*storage.RosterItem
+	for _, ri := range incoming {
+		if old, ok := existing[ri.ContactJID]; !ok || !sameRosterItem(old, ri) {
+			changed = append(changed, ri)
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	ver, err := p.store.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return err
+	}
+	ver = nextVersion(ver)
+
+	if rr, ok := p.store.(storage.RosterReplacer); ok {
+		err = rr.ReplaceRosterItems(ctx, userJID, final, ver)
+	} else {
+		err = p.applyImport(ctx, userJID, current, changed, removed, ver)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	push := p.pusher
+	p.mu.RUnlock()
+	if push == nil {
+		return nil
+	}
+	for _, ri := range changed {
+		if err := push(ctx, userJID, ver, rosterItemToItem(ri)); err != nil {
+			return err
+		}
+	}
+	for _, contact := range removed {
+		if err := push(ctx, userJID, ver, Item{JID: contact, Subscription: SubRemove}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyImport writes an import in steps for stores without RosterReplacer,
+// restoring the previous roster if a write fails.
+func (p *Plugin) applyImport(ctx context.Context, userJID string, previous, changed []*storage.RosterItem, removed []string, ver string) error {
+	err := func() error {
+		if err := p.store.UpsertRosterItems(ctx, changed); err != nil {
+			return err
+		}
+		for _, contact := range removed {
+			if err := p.store.DeleteRosterItem(ctx, userJID, contact); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+		}
+		return p.store.SetRosterVersion(ctx, userJID, ver)
+	}()
+	if err == nil {
+		return nil
+	}
+
+	// Best-effort rollback to the roster as it was before the import.
+	for _, ri := range changed {
+		if !slices.ContainsFunc(previous, func(old *storage.RosterItem) bool { return old.ContactJID == ri.ContactJID }) {
+			_ = p.store.DeleteRosterItem(ctx, userJID, ri.ContactJID)
+		}
+	}
+	_ = p.store.UpsertRosterItems(ctx, previous)
+	return err
+}
+
+// normalizeImport validates items and returns them keyed to userJID with
+// normalized bare contact JIDs.
+func normalizeImport(userJID string, items []storage.RosterItem) ([]*storage.RosterItem, error) {
+	seen := make(map[string]bool, len(items))
+	out := make([]*storage.RosterItem, 0, len(items))
+	for _, item := range items {
+		contact, err := jid.Parse(item.ContactJID)
+		if err != nil {
+			return nil, fmt.Errorf("roster: invalid contact JID %q: %w", item.ContactJID, err)
+		}
+		contactJID := contact.Bare().String()
+		if contactJID == userJID {
+			return nil, fmt.Errorf("roster: user %s cannot be in their own roster", userJID)
+		}
+		if seen[contactJID] {
+			return nil, fmt.Errorf("roster: duplicate contact %s", contactJID)
+		}
+		seen[contactJID] = true
+
+		sub := item.Subscription
+		if sub == "" {
+			sub = SubNone
+		}
+		switch sub {
+		case SubNone, SubTo, SubFrom, SubBoth:
+		default:
+			return nil, fmt.Errorf("roster: invalid subscription %q for %s", item.Subscription, contactJID)
+		}
+		if item.Ask != "" && item.Ask != "subscribe" {
+			return nil, fmt.Errorf("roster: invalid ask %q for %s", item.Ask, contactJID)
+		}
+
+		out = append(out, &storage.RosterItem{
+			UserJID:      userJID,
+			ContactJID:   contactJID,
+			Name:         item.Name,
+			Subscription: sub,
+			Ask:          item.Ask,
+			Groups:       slices.Clone(item.Groups),
+		})
+	}
+	return out, nil
+}
+
+func sameRosterItem(a, b *storage.RosterItem) bool {
+	return a.Name == b.Name && a.Subscription == b.Subscription && a.Ask == b.Ask && slices.Equal(a.Groups, b.Groups)
+}
+
+// nextVersion returns the roster version following ver. Numeric versions are
+// incremented; anything else starts a new numeric sequence.
+func nextVersion(ver string) string {
+	n, err := strconv.ParseUint(ver, 10, 64)
+	if err != nil {
+		return "1"
+	}
+	return strconv.FormatUint(n+1, 10)
+}
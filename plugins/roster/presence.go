@@ -0,0 +1,53 @@
+package roster
+
+import "context"
+
+// SendsPresenceTo reports whether a contact with the given subscription
+// state receives the user's presence broadcasts, i.e. the contact is
+// subscribed to the user ("from" or "both", RFC 6121 §4.2.2).
+func SendsPresenceTo(subscription string) bool {
+	return subscription == SubFrom || subscription == SubBoth
+}
+
+// ProbesPresenceOf reports whether the user is subscribed to a contact with
+// the given subscription state and so probes it at login ("to" or "both",
+// RFC 6121 §4.3.1).
+func ProbesPresenceOf(subscription string) bool {
+	return subscription == SubTo || subscription == SubBoth
+}
+
+// PresenceSubscribers returns the contacts of userJID that receive its
+// presence broadcasts.
+func (p *Plugin) PresenceSubscribers(ctx context.Context, userJID string) ([]string, error) {
+	return p.contactsWhere(ctx, userJID, SendsPresenceTo)
+}
+
+// PresenceSubscriptions returns the contacts whose presence userJID is
+// subscribed to, which are probed when it becomes available.
+func (p *Plugin) PresenceSubscriptions(ctx context.Context, userJID string) ([]string, error) {
+	return p.contactsWhere(ctx, userJID, ProbesPresenceOf)
+}
+
+func (p *Plugin) contactsWhere(ctx context.Context, userJID string, match func(string) bool) ([]string, error) {
+	var contacts []string
+	if p.store == nil {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for _, item := range p.items {
+			if match(item.Subscription) {
+				contacts = append(contacts, item.JID)
+			}
+		}
+		return contacts, nil
+	}
+	items, err := p.store.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if match(item.Subscription) {
+			contacts = append(contacts, item.ContactJID)
+		}
+	}
+	return contacts, nil
+}
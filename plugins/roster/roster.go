@@ -22,6 +22,10 @@ const (
 	SubRemove = "remove"
 )
 
+// VersioningFeature is the stream feature of servers that support roster
+// versioning.
+var VersioningFeature = xml.Name{Space: ns.RosterVer, Local: "ver"}
+
 // Item represents a roster item.
 type Item struct {
 	XMLName      xml.Name `xml:"item"`
@@ -46,6 +50,11 @@ type Plugin struct {
 	ver    string
 	store  storage.RosterStore
 	params plugin.InitParams
+	pusher PushFunc
+
+	subPolicy       SubscriptionPolicy
+	accountPolicies map[string]SubscriptionPolicy
+	decider         SubscriptionDecider
 }
 
 // New creates a new roster plugin.
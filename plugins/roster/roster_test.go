@@ -2,9 +2,12 @@ package roster
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"testing"
 
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/storage"
 	"github.com/meszmate/xmpp-go/storage/memory"
 )
 
@@ -38,3 +41,346 @@ func TestRosterPluginWithMemoryStoreWithoutInit(t *testing.T) {
 		t.Fatalf("Get: got name %q, want Bob", item.Name)
 	}
 }
+
+// rosterOnly hides optional interfaces so the item-by-item import path is used.
+type rosterOnly struct{ storage.RosterStore }
+
+func TestRosterImportExport(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		store func(*memory.Store) storage.RosterStore
+	}{
+		{"replacer", func(s *memory.Store) storage.RosterStore { return s }},
+		{"fallback", func(s *memory.Store) storage.RosterStore { return rosterOnly{s} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := memory.New()
+			if err := mem.Init(ctx); err != nil {
+				t.Fatalf("Init: %v", err)
+			}
+			p := New()
+			p.store = tc.store(mem)
+
+			var pushes []Item
+			p.SetPusher(func(_ context.Context, user, ver string, item Item) error {
+				if user != "alice@example.com" {
+					t.Errorf("push user = %q", user)
+				}
+				pushes = append(pushes, item)
+				return nil
+			})
+
+			err := p.Import(ctx, "alice@example.com", []storage.RosterItem{
+				{ContactJID: "bob@example.com/phone", Name: "Bob", Subscription: SubBoth},
+				{ContactJID: "carol@example.com", Subscription: SubTo, Groups: []string{"work"}},
+			}, ImportMerge)
+			if err != nil {
+				t.Fatalf("Import merge: %v", err)
+			}
+			if ver, _ := mem.GetRosterVersion(ctx, "alice@example.com"); ver != "1" {
+				t.Fatalf("version after first import = %q, want 1", ver)
+			}
+
+			pushes = nil
+			err = p.Import(ctx, "alice@example.com", []storage.RosterItem{
+				{ContactJID: "bob@example.com", Name: "Bob", Subscription: SubBoth},
+				{ContactJID: "dave@example.com", Subscription: SubNone, Ask: "subscribe"},
+			}, ImportReplace)
+			if err != nil {
+				t.Fatalf("Import replace: %v", err)
+			}
+			if ver, _ := mem.GetRosterVersion(ctx, "alice@example.com"); ver != "2" {
+				t.Fatalf("version after replace = %q, want 2", ver)
+			}
+			// bob is unchanged; dave is new and carol was removed.
+			if len(pushes) != 2 {
+				t.Fatalf("pushes = %+v, want dave and carol", pushes)
+			}
+
+			items, err := p.Export(ctx, "alice@example.com")
+			if err != nil {
+				t.Fatalf("Export: %v", err)
+			}
+			got := map[string]string{}
+			for _, item := range items {
+				got[item.ContactJID] = item.Subscription
+			}
+			want := map[string]string{"bob@example.com": SubBoth, "dave@example.com": SubNone}
+			if len(got) != len(want) || got["bob@example.com"] != SubBoth || got["dave@example.com"] != SubNone {
+				t.Fatalf("Export = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRosterImportValidation(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New()
+	if err := mem.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	p := New()
+	p.store = mem
+
+	bad := [][]storage.RosterItem{
+		{{ContactJID: "not a jid@@"}},
+		{{ContactJID: "bob@example.com", Subscription: "pending"}},
+		{{ContactJID: "bob@example.com", Ask: "unsubscribe"}},
+		{{ContactJID: "bob@example.com"}, {ContactJID: "bob@example.com/laptop"}},
+		{{ContactJID: "alice@example.com"}},
+	}
+	for _, items := range bad {
+		if err := p.Import(ctx, "alice@example.com", items, ImportMerge); err == nil {
+			t.Errorf("Import(%+v) succeeded, want error", items)
+		}
+	}
+	if items, _ := mem.GetRosterItems(ctx, "alice@example.com"); len(items) != 0 {
+		t.Fatalf("invalid imports wrote %d items", len(items))
+	}
+}
+
+func TestRosterHandleSubscribe(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New()
+	if err := mem.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	p := New()
+	p.store = mem
+
+	var pushed []Item
+	p.SetPusher(func(_ context.Context, _, _ string, item Item) error {
+		pushed = append(pushed, item)
+		return nil
+	})
+
+	// Manual by default: nothing is written.
+	res, err := p.HandleSubscribe(ctx, "bot@example.com", "alice@example.com")
+	if err != nil || res.Policy != PolicyManual {
+		t.Fatalf("HandleSubscribe manual = %+v, %v", res, err)
+	}
+	if items, _ := mem.GetRosterItems(ctx, "bot@example.com"); len(items) != 0 {
+		t.Fatalf("manual policy wrote %d items", len(items))
+	}
+
+	p.SetAccountSubscriptionPolicy("bot@example.com", PolicyAutoAccept)
+	res, err = p.HandleSubscribe(ctx, "bot@example.com", "alice@example.com")
+	if err != nil {
+		t.Fatalf("HandleSubscribe auto-accept: %v", err)
+	}
+	if res.Policy != PolicyAutoAccept || !res.SubscribeBack {
+		t.Fatalf("HandleSubscribe auto-accept = %+v", res)
+	}
+	item, err := mem.GetRosterItem(ctx, "bot@example.com", "alice@example.com")
+	if err != nil || item.Subscription != SubFrom || item.Ask != "subscribe" {
+		t.Fatalf("roster item after auto-accept = %+v, %v", item, err)
+	}
+	if len(pushed) != 1 || pushed[0].JID != "alice@example.com" {
+		t.Fatalf("pushes = %+v", pushed)
+	}
+	if ver, _ := mem.GetRosterVersion(ctx, "bot@example.com"); ver != "1" {
+		t.Fatalf("roster version = %q, want 1", ver)
+	}
+
+	// The decider can override the configured policy.
+	p.SetSubscriptionDecider(func(_ context.Context, _, contact string, def SubscriptionPolicy) SubscriptionPolicy {
+		if contact == "spam@example.net" {
+			return PolicyAutoReject
+		}
+		return def
+	})
+	res, err = p.HandleSubscribe(ctx, "bot@example.com", "spam@example.net")
+	if err != nil || res.Policy != PolicyAutoReject {
+		t.Fatalf("HandleSubscribe decider = %+v, %v", res, err)
+	}
+}
+
+func TestParseSubscriptionPolicy(t *testing.T) {
+	for _, policy := range []SubscriptionPolicy{PolicyManual, PolicyAutoAccept, PolicyAutoReject} {
+		got, err := ParseSubscriptionPolicy(policy.String())
+		if err != nil || got != policy {
+			t.Errorf("ParseSubscriptionPolicy(%q) = %v, %v", policy.String(), got, err)
+		}
+	}
+	if _, err := ParseSubscriptionPolicy("sometimes"); err == nil {
+		t.Error("ParseSubscriptionPolicy accepted an unknown policy")
+	}
+}
+
+func TestRosterPresenceTargets(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	if err := p.Initialize(ctx, plugin.InitParams{
+		LocalJID: func() string { return "alice@example.com" },
+		Storage:  memory.New(),
+	}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if err := p.Import(ctx, "alice@example.com", []storage.RosterItem{
+		{ContactJID: "none@example.com", Subscription: SubNone},
+		{ContactJID: "pending@example.com", Subscription: SubNone, Ask: "subscribe"},
+		{ContactJID: "to@example.com", Subscription: SubTo},
+		{ContactJID: "from@example.com", Subscription: SubFrom},
+		{ContactJID: "both@example.com", Subscription: SubBoth},
+	}, ImportReplace); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	subscribers, err := p.PresenceSubscribers(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("PresenceSubscribers: %v", err)
+	}
+	slices.Sort(subscribers)
+	if want := []string{"both@example.com", "from@example.com"}; !slices.Equal(subscribers, want) {
+		t.Errorf("PresenceSubscribers = %v, want %v", subscribers, want)
+	}
+
+	probed, err := p.PresenceSubscriptions(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("PresenceSubscriptions: %v", err)
+	}
+	slices.Sort(probed)
+	if want := []string{"both@example.com", "to@example.com"}; !slices.Equal(probed, want) {
+		t.Errorf("PresenceSubscriptions = %v, want %v", probed, want)
+	}
+}
+
+func TestSubscriptionTransitions(t *testing.T) {
+	tests := []struct {
+		sub, ask, typ string
+		outbound      bool
+		wantSub       string
+		wantAsk       string
+		route         bool
+	}{
+		{SubNone, "", "subscribe", true, SubNone, "subscribe", true},
+		{SubTo, "", "subscribe", true, SubTo, "", true},
+		{SubNone, "", "subscribed", true, SubFrom, "", true},
+		{SubTo, "", "subscribed", true, SubBoth, "", true},
+		{SubFrom, "", "subscribed", true, SubFrom, "", false},
+		{SubBoth, "", "unsubscribe", true, SubFrom, "", true},
+		{SubNone, "subscribe", "unsubscribe", true, SubNone, "", true},
+		{SubBoth, "", "unsubscribed", true, SubTo, "", true},
+		{SubFrom, "", "subscribe", false, SubFrom, "", false},
+		{SubNone, "", "subscribe", false, SubNone, "", true},
+		{SubNone, "subscribe", "subscribed", false, SubTo, "", true},
+		{SubFrom, "subscribe", "subscribed", false, SubBoth, "", true},
+		{SubNone, "", "subscribed", false, SubNone, "", false},
+		{SubBoth, "", "unsubscribe", false, SubTo, "", true},
+		{SubTo, "", "unsubscribe", false, SubTo, "", false},
+		{SubBoth, "", "unsubscribed", false, SubFrom, "", true},
+		{SubNone, "subscribe", "unsubscribed", false, SubNone, "", true},
+		{SubFrom, "", "unsubscribed", false, SubFrom, "", false},
+	}
+	for _, tt := range tests {
+		sub, ask, route := transition(tt.sub, tt.ask, tt.typ, tt.outbound)
+		if sub != tt.wantSub || ask != tt.wantAsk || route != tt.route {
+			t.Errorf("transition(%q, %q, %q, %v) = %q, %q, %v; want %q, %q, %v",
+				tt.sub, tt.ask, tt.typ, tt.outbound, sub, ask, route, tt.wantSub, tt.wantAsk, tt.route)
+		}
+	}
+}
+
+func TestSubscriptionFlow(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	if err := p.Initialize(ctx, plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	var pushed []Item
+	p.SetPusher(func(_ context.Context, _, _ string, item Item) error {
+		pushed = append(pushed, item)
+		return nil
+	})
+	state := func(user, contact string) string {
+		t.Helper()
+		item, err := p.store.GetRosterItem(ctx, user, contact)
+		if err != nil {
+			t.Fatalf("GetRosterItem: %v", err)
+		}
+		return item.Subscription + "/" + item.Ask
+	}
+
+	// alice asks bob, and bob approves.
+	steps := []struct {
+		apply func(context.Context, string, string, string) (bool, error)
+		user  string
+		other string
+		typ   string
+	}{
+		{p.OutboundSubscription, "alice@example.com", "bob@example.com", "subscribe"},
+		{p.InboundSubscription, "bob@example.com", "alice@example.com", "subscribe"},
+		{p.OutboundSubscription, "bob@example.com", "alice@example.com", "subscribed"},
+		{p.InboundSubscription, "alice@example.com", "bob@example.com", "subscribed"},
+	}
+	for _, s := range steps {
+		if route, err := s.apply(ctx, s.user, s.other, s.typ); err != nil || !route {
+			t.Fatalf("%s %s: route %v, %v", s.user, s.typ, route, err)
+		}
+	}
+	if got := state("alice@example.com", "bob@example.com"); got != "to/" {
+		t.Fatalf("alice's item = %s", got)
+	}
+	if got := state("bob@example.com", "alice@example.com"); got != "from/" {
+		t.Fatalf("bob's item = %s", got)
+	}
+	if len(pushed) != 3 {
+		t.Fatalf("pushed %d items, want 3", len(pushed))
+	}
+
+	// A second request from a subscribed contact is answered by the server.
+	if route, err := p.InboundSubscription(ctx, "bob@example.com", "alice@example.com", "subscribe"); err != nil || route {
+		t.Fatalf("repeated subscribe routed: %v, %v", route, err)
+	}
+}
+
+func TestRosterSetAndRemoveItem(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	if err := p.Initialize(ctx, plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	var pushed []Item
+	p.SetPusher(func(_ context.Context, _, _ string, item Item) error {
+		pushed = append(pushed, item)
+		return nil
+	})
+
+	// Clients cannot set the subscription state.
+	err := p.SetItem(ctx, "alice@example.com", Item{JID: "bob@example.com/phone", Name: "Bob", Subscription: SubBoth, Groups: []string{"Friends"}})
+	if err != nil {
+		t.Fatalf("SetItem: %v", err)
+	}
+	items, ver, err := p.Roster(ctx, "alice@example.com")
+	if err != nil || ver != "1" || len(items) != 1 {
+		t.Fatalf("Roster = %+v, %q, %v", items, ver, err)
+	}
+	if got := items[0]; got.JID != "bob@example.com" || got.Name != "Bob" || got.Subscription != SubNone || !slices.Equal(got.Groups, []string{"Friends"}) {
+		t.Fatalf("item = %+v", got)
+	}
+
+	for _, bad := range []Item{
+		{JID: "alice@example.com"},
+		{JID: "carol@example.com", Groups: []string{""}},
+		{JID: "carol@example.com", Groups: []string{"a", "a"}},
+	} {
+		if err := p.SetItem(ctx, "alice@example.com", bad); !errors.Is(err, ErrInvalidItem) {
+			t.Errorf("SetItem(%+v) = %v, want ErrInvalidItem", bad, err)
+		}
+	}
+
+	removed, err := p.RemoveItem(ctx, "alice@example.com", "bob@example.com")
+	if err != nil || removed.Name != "Bob" {
+		t.Fatalf("RemoveItem = %+v, %v", removed, err)
+	}
+	if _, err := p.RemoveItem(ctx, "alice@example.com", "bob@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("second RemoveItem = %v", err)
+	}
+	if len(pushed) != 2 || pushed[1].Subscription != SubRemove {
+		t.Fatalf("pushes = %+v", pushed)
+	}
+	if _, ver, _ := p.Roster(ctx, "alice@example.com"); ver != "2" {
+		t.Fatalf("version after removal = %q", ver)
+	}
+}
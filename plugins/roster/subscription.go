@@ -0,0 +1,275 @@
+package roster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// SubscriptionPolicy decides how an inbound subscription request is handled.
+type SubscriptionPolicy int
+
+const (
+	// PolicyManual forwards the request to the user for approval.
+	PolicyManual SubscriptionPolicy = iota
+	// PolicyAutoAccept approves the request on the user's behalf.
+	PolicyAutoAccept
+	// PolicyAutoReject denies the request on the user's behalf.
+	PolicyAutoReject
+)
+
+// String returns the configuration name of the policy.
+func (sp SubscriptionPolicy) String() string {
+	switch sp {
+	case PolicyAutoAccept:
+		return "auto-accept"
+	case PolicyAutoReject:
+		return "auto-reject"
+	default:
+		return "manual"
+	}
+}
+
+// ParseSubscriptionPolicy parses "manual", "auto-accept" or "auto-reject".
+func ParseSubscriptionPolicy(s string) (SubscriptionPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "manual":
+		return PolicyManual, nil
+	case "auto-accept":
+		return PolicyAutoAccept, nil
+	case "auto-reject":
+		return PolicyAutoReject, nil
+	default:
+		return PolicyManual, fmt.Errorf("roster: unknown subscription policy %q", s)
+	}
+}
+
+// SubscriptionDecider makes a custom decision for a subscription request from
+// contactJID to userJID. The policy configured for the account is passed as
+// def; returning it keeps the configured behaviour.
+type SubscriptionDecider func(ctx context.Context, userJID, contactJID string, def SubscriptionPolicy) SubscriptionPolicy
+
+// SubscribeResult describes how HandleSubscribe resolved a request.
+type SubscribeResult struct {
+	// Policy is the decision that was applied.
+	Policy SubscriptionPolicy
+	// SubscribeBack is set when an auto-accepted request should be answered
+	// with a subscription request of our own, making it mutual.
+	SubscribeBack bool
+}
+
+// SetSubscriptionPolicy sets the server-wide default policy.
+func (p *Plugin) SetSubscriptionPolicy(policy SubscriptionPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subPolicy = policy
+}
+
+// SetAccountSubscriptionPolicy overrides the policy for a single account.
+func (p *Plugin) SetAccountSubscriptionPolicy(userJID string, policy SubscriptionPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accountPolicies == nil {
+		p.accountPolicies = make(map[string]SubscriptionPolicy)
+	}
+	p.accountPolicies[userJID] = policy
+}
+
+// SetSubscriptionDecider installs a hook consulted for every request.
+func (p *Plugin) SetSubscriptionDecider(f SubscriptionDecider) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.decider = f
+}
+
+// SubscriptionPolicyFor returns the configured policy for userJID.
+func (p *Plugin) SubscriptionPolicyFor(userJID string) SubscriptionPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.accountPolicies[userJID]; ok {
+		return policy
+	}
+	return p.subPolicy
+}
+
+// HandleSubscribe applies the subscription policy to a subscribe request
+// from contactJID to userJID (both bare JIDs). For PolicyAutoAccept the
+// contact is recorded as subscribed to the user, a reverse subscription is
+// requested if the user is not yet subscribed to the contact, the roster
+// version is bumped and the item is pushed. The caller is responsible for
+// sending the subscribed/unsubscribed answer, or forwarding the request for
+// PolicyManual.
+func (p *Plugin) HandleSubscribe(ctx context.Context, userJID, contactJID string) (SubscribeResult, error) {
+	policy := p.SubscriptionPolicyFor(userJID)
+
+	p.mu.RLock()
+	decide := p.decider
+	p.mu.RUnlock()
+	if decide != nil {
+		policy = decide(ctx, userJID, contactJID, policy)
+	}
+
+	res := SubscribeResult{Policy: policy}
+	if policy != PolicyAutoAccept {
+		return res, nil
+	}
+
+	item, err := p.rosterItem(ctx, userJID, contactJID)
+	if err != nil {
+		return res, err
+	}
+	switch item.Subscription {
+	case SubTo, SubBoth:
+		item.Subscription = SubBoth
+	default:
+		item.Subscription = SubFrom
+		if item.Ask == "" {
+			item.Ask = "subscribe"
+			res.SubscribeBack = true
+		}
+	}
+
+	return res, p.update(ctx, item)
+}
+
+// OutboundSubscription applies a subscription stanza of type typ that
+// userJID sends to contactJID to the user's roster (RFC 6121 Appendix A.2)
+// and reports whether the stanza must be routed to the contact. A changed
+// item is stored and pushed like in HandleSubscribe.
+func (p *Plugin) OutboundSubscription(ctx context.Context, userJID, contactJID, typ string) (bool, error) {
+	return p.applySubscription(ctx, userJID, contactJID, typ, true)
+}
+
+// InboundSubscription applies a subscription stanza of type typ that
+// contactJID sends to userJID to the user's roster (RFC 6121 Appendix A.3)
+// and reports whether the stanza must be delivered to the user. A subscribe
+// request from a contact that is already subscribed is not delivered; the
+// caller answers it with subscribed. Other subscribe requests leave the
+// roster alone and go through HandleSubscribe.
+func (p *Plugin) InboundSubscription(ctx context.Context, userJID, contactJID, typ string) (bool, error) {
+	return p.applySubscription(ctx, userJID, contactJID, typ, false)
+}
+
+func (p *Plugin) applySubscription(ctx context.Context, userJID, contactJID, typ string, outbound bool) (bool, error) {
+	item, err := p.rosterItem(ctx, userJID, contactJID)
+	if err != nil {
+		return false, err
+	}
+	sub, ask, route := transition(item.Subscription, item.Ask, typ, outbound)
+	if sub == item.Subscription && ask == item.Ask {
+		return route, nil
+	}
+	item.Subscription, item.Ask = sub, ask
+	return route, p.update(ctx, item)
+}
+
+// transition returns the subscription state and pending outbound request of
+// a roster item after a subscription stanza of type typ, sent by the user
+// when outbound is set and received by it otherwise, and whether the stanza
+// goes on to the other party (RFC 6121 Appendix A). Inbound requests the
+// user has not answered yet are not tracked.
+func transition(sub, ask, typ string, outbound bool) (string, string, bool) {
+	if sub == "" {
+		sub = SubNone
+	}
+	from := sub == SubFrom || sub == SubBoth
+	to := sub == SubTo || sub == SubBoth
+	state := func(to, from bool) string {
+		switch {
+		case to && from:
+			return SubBoth
+		case to:
+			return SubTo
+		case from:
+			return SubFrom
+		}
+		return SubNone
+	}
+
+	switch {
+	case outbound && typ == "subscribe":
+		if !to {
+			ask = "subscribe"
+		}
+		return sub, ask, true
+	case outbound && typ == "subscribed":
+		return state(to, true), ask, !from
+	case outbound && typ == "unsubscribe":
+		return state(false, from), "", true
+	case outbound && typ == "unsubscribed":
+		return state(to, false), ask, true
+	case typ == "subscribe":
+		return sub, ask, !from
+	case typ == "subscribed":
+		if ask == "" || to {
+			return sub, ask, false
+		}
+		return state(true, from), "", true
+	case typ == "unsubscribe":
+		return state(to, false), ask, from
+	case typ == "unsubscribed":
+		return state(false, from), "", to || ask != ""
+	}
+	return sub, ask, false
+}
+
+// update stores item, bumping the roster version, and pushes it.
+func (p *Plugin) update(ctx context.Context, item *storage.RosterItem) error {
+	ver, err := p.storeItem(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	push := p.pusher
+	p.mu.RUnlock()
+	if push != nil {
+		return push(ctx, item.UserJID, ver, rosterItemToItem(item))
+	}
+	return nil
+}
+
+// rosterItem returns the roster item for contactJID, or a fresh one with no
+// subscription if the contact is not in the roster yet.
+func (p *Plugin) rosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
+	if p.store == nil {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		item, ok := p.items[contactJID]
+		if !ok {
+			return &storage.RosterItem{UserJID: userJID, ContactJID: contactJID, Subscription: SubNone}, nil
+		}
+		return &storage.RosterItem{
+			UserJID: userJID, ContactJID: contactJID, Name: item.Name,
+			Subscription: item.Subscription, Ask: item.Ask, Groups: item.Groups,
+		}, nil
+	}
+	item, err := p.store.GetRosterItem(ctx, userJID, contactJID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &storage.RosterItem{UserJID: userJID, ContactJID: contactJID, Subscription: SubNone}, nil
+	}
+	return item, err
+}
+
+// storeItem writes item and bumps the roster version, returning the new one.
+func (p *Plugin) storeItem(ctx context.Context, item *storage.RosterItem) (string, error) {
+	if p.store == nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.items[item.ContactJID] = rosterItemToItem(item)
+		p.ver = nextVersion(p.ver)
+		return p.ver, nil
+	}
+	if err := p.store.UpsertRosterItem(ctx, item); err != nil {
+		return "", err
+	}
+	ver, err := p.store.GetRosterVersion(ctx, item.UserJID)
+	if err != nil {
+		return "", err
+	}
+	ver = nextVersion(ver)
+	return ver, p.store.SetRosterVersion(ctx, item.UserJID, ver)
+}
@@ -0,0 +1,194 @@
+// Package rosterx implements XEP-0144 Roster Item Exchange.
+package rosterx
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+const Name = "rosterx"
+
+// Item actions.
+const (
+	ActionAdd    = "add"
+	ActionModify = "modify"
+	ActionDelete = "delete"
+)
+
+// ErrNoRoster is returned by Apply when the roster plugin is not registered.
+var ErrNoRoster = errors.New("rosterx: roster plugin not available")
+
+// Exchange is the <x/> element carrying suggested roster items.
+type Exchange struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rosterx x"`
+	Items   []Item   `xml:"item"`
+}
+
+// Item is a suggested roster change. An empty action means add.
+type Item struct {
+	XMLName xml.Name `xml:"item"`
+	Action  string   `xml:"action,attr,omitempty"`
+	JID     string   `xml:"jid,attr"`
+	Name    string   `xml:"name,attr,omitempty"`
+	Groups  []string `xml:"group,omitempty"`
+}
+
+// SuggestionHandler is called with roster items suggested by from.
+type SuggestionHandler func(ctx context.Context, from jid.JID, items []Item)
+
+type Plugin struct {
+	mu        sync.RWMutex
+	onSuggest SuggestionHandler
+	params    plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
+
+// OnRosterSuggestion registers the callback invoked by HandleMessage.
+func (p *Plugin) OnRosterSuggestion(f SuggestionHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onSuggest = f
+}
+
+// HandleMessage passes roster items suggested in msg to the callback set with
+// OnRosterSuggestion. It reports whether msg carried a roster exchange.
+func (p *Plugin) HandleMessage(ctx context.Context, msg *stanza.Message) (bool, error) {
+	x, ok, err := FromMessage(msg)
+	if !ok || err != nil {
+		return ok, err
+	}
+	p.mu.RLock()
+	f := p.onSuggest
+	p.mu.RUnlock()
+	if f != nil {
+		f(ctx, msg.From, x.Items)
+	}
+	return true, nil
+}
+
+// FromMessage extracts a roster exchange from msg, if it carries one.
+func FromMessage(msg *stanza.Message) (*Exchange, bool, error) {
+	for _, ext := range msg.Extensions {
+		if ext.XMLName.Space != ns.RosterX || ext.XMLName.Local != "x" {
+			continue
+		}
+		data, err := xml.Marshal(ext)
+		if err != nil {
+			return nil, true, err
+		}
+		var x Exchange
+		if err := xml.Unmarshal(data, &x); err != nil {
+			return nil, true, err
+		}
+		return &x, true, nil
+	}
+	return nil, false, nil
+}
+
+// Attach adds a roster exchange with items to msg.
+func Attach(msg *stanza.Message, items ...Item) error {
+	ext, err := stanza.NewExtension(Exchange{Items: items})
+	if err != nil {
+		return err
+	}
+	msg.Extensions = append(msg.Extensions, ext)
+	return nil
+}
+
+// Apply applies accepted suggestions to the roster of userJID using the
+// roster plugin's Import. Added contacts start without a subscription; the
+// caller decides whether to request one.
+func (p *Plugin) Apply(ctx context.Context, userJID string, items []Item) error {
+	if p.params.Get == nil {
+		return ErrNoRoster
+	}
+	rp, ok := p.params.Get(roster.Name)
+	if !ok {
+		return ErrNoRoster
+	}
+	r, ok := rp.(*roster.Plugin)
+	if !ok {
+		return ErrNoRoster
+	}
+
+	current, err := r.Export(ctx, userJID)
+	if err != nil {
+		return err
+	}
+	next := ApplyItems(current, items)
+	return r.Import(ctx, userJID, next, roster.ImportReplace)
+}
+
+// ApplyItems returns roster with the suggested items applied as described in
+// XEP-0144 §5: add creates a contact or adds groups to it, modify replaces
+// its name and groups, and delete removes the listed groups or, without
+// groups, the whole contact.
+func ApplyItems(current []storage.RosterItem, items []Item) []storage.RosterItem {
+	next := slices.Clone(current)
+	index := func(contact string) int {
+		return slices.IndexFunc(next, func(ri storage.RosterItem) bool { return ri.ContactJID == contact })
+	}
+
+	for _, item := range items {
+		i := index(item.JID)
+		switch item.Action {
+		case ActionModify:
+			if i < 0 {
+				continue
+			}
+			next[i].Name = item.Name
+			next[i].Groups = slices.Clone(item.Groups)
+		case ActionDelete:
+			if i < 0 {
+				continue
+			}
+			if len(item.Groups) == 0 {
+				next = slices.Delete(next, i, i+1)
+				continue
+			}
+			next[i].Groups = slices.DeleteFunc(slices.Clone(next[i].Groups), func(g string) bool {
+				return slices.Contains(item.Groups, g)
+			})
+		default:
+			if i < 0 {
+				next = append(next, storage.RosterItem{
+					ContactJID:   item.JID,
+					Name:         item.Name,
+					Subscription: roster.SubNone,
+					Groups:       slices.Clone(item.Groups),
+				})
+				continue
+			}
+			groups := slices.Clone(next[i].Groups)
+			for _, g := range item.Groups {
+				if !slices.Contains(groups, g) {
+					groups = append(groups, g)
+				}
+			}
+			next[i].Groups = groups
+		}
+	}
+	return next
+}
+
+func init() { _ = ns.RosterX }
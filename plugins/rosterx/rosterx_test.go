@@ -0,0 +1,107 @@
+package rosterx
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestHandleMessageSuggestion(t *testing.T) {
+	input := `<message from='gateway@example.com' to='alice@example.com'>` +
+		`<x xmlns='http://jabber.org/protocol/rosterx'>` +
+		`<item action='add' jid='bob@example.com' name='Bob'><group>Friends</group></item>` +
+		`<item action='delete' jid='eve@example.com'/>` +
+		`</x></message>`
+	var msg stanza.Message
+	if err := xml.Unmarshal([]byte(input), &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	p := New()
+	var got []Item
+	var from jid.JID
+	p.OnRosterSuggestion(func(_ context.Context, f jid.JID, items []Item) {
+		from, got = f, items
+	})
+	ok, err := p.HandleMessage(context.Background(), &msg)
+	if err != nil || !ok {
+		t.Fatalf("HandleMessage = %v, %v", ok, err)
+	}
+	if from.String() != "gateway@example.com" {
+		t.Errorf("from = %s", from)
+	}
+	if len(got) != 2 || got[0].JID != "bob@example.com" || got[0].Groups[0] != "Friends" || got[1].Action != ActionDelete {
+		t.Fatalf("items = %+v", got)
+	}
+}
+
+func TestAttachRoundTrip(t *testing.T) {
+	msg := stanza.NewMessage(stanza.MessageNormal)
+	if err := Attach(msg, Item{Action: ActionModify, JID: "bob@example.com", Groups: []string{"Work"}}); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var back stanza.Message
+	if err := xml.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	x, ok, err := FromMessage(&back)
+	if err != nil || !ok {
+		t.Fatalf("FromMessage = %v, %v (%s)", ok, err, data)
+	}
+	if len(x.Items) != 1 || x.Items[0].Action != ActionModify || x.Items[0].Groups[0] != "Work" {
+		t.Fatalf("items = %+v", x.Items)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	mgr := plugin.NewManager()
+	r := roster.New()
+	p := New()
+	for _, pl := range []plugin.Plugin{r, p} {
+		if err := mgr.Register(pl); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+	store := memory.New()
+	if err := store.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := mgr.Initialize(ctx, plugin.InitParams{
+		LocalJID: func() string { return "alice@example.com" },
+		Storage:  store,
+	}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	if err := p.Apply(ctx, "alice@example.com", []Item{
+		{Action: ActionAdd, JID: "bob@example.com", Groups: []string{"Friends"}},
+		{Action: ActionAdd, JID: "carol@example.com"},
+	}); err != nil {
+		t.Fatalf("Apply add: %v", err)
+	}
+	if err := p.Apply(ctx, "alice@example.com", []Item{
+		{Action: ActionAdd, JID: "bob@example.com", Groups: []string{"Work"}},
+		{Action: ActionDelete, JID: "carol@example.com"},
+	}); err != nil {
+		t.Fatalf("Apply delete: %v", err)
+	}
+
+	items, err := r.Export(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(items) != 1 || items[0].ContactJID != "bob@example.com" || len(items[0].Groups) != 2 {
+		t.Fatalf("roster = %+v", items)
+	}
+}
@@ -0,0 +1,200 @@
+package sasl2
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/carbons"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+)
+
+// ErrNoBoundJID is returned by ParseInline when a success carries no
+// authorization identifier to bind to.
+var ErrNoBoundJID = errors.New("sasl2: success without a bound JID")
+
+// BindRequest describes a Bind2 request and the features to enable inline
+// with it (XEP-0386 §2.4).
+type BindRequest struct {
+	// Tag identifies the client software; the server derives the resource
+	// from it.
+	Tag string
+	// SM enables XEP-0198 Stream Management, resumable if Resume is set.
+	SM     bool
+	Resume bool
+	// Carbons enables XEP-0280 Message Carbons.
+	Carbons bool
+}
+
+// Element returns the <bind/> element to put in the <authenticate/> request.
+func (r BindRequest) Element() (Bind2, error) {
+	var inner []any
+	if r.Carbons {
+		inner = append(inner, carbons.Enable{})
+	}
+	if r.SM {
+		inner = append(inner, sm.Enable{Resume: r.Resume})
+	}
+	b := Bind2{Tag: r.Tag}
+	for _, v := range inner {
+		data, err := xml.Marshal(v)
+		if err != nil {
+			return Bind2{}, err
+		}
+		b.Inner = append(b.Inner, data...)
+	}
+	return b, nil
+}
+
+// InlineFeatures is what a SASL2 success negotiated for a Bind2 request.
+// The client uses it instead of binding and enabling the features again.
+type InlineFeatures struct {
+	// JID is the full JID the session was bound to.
+	JID jid.JID
+	// SMEnabled reports whether Stream Management is active. SMResumeID is
+	// set when the stream can be resumed, within SMMax seconds if the server
+	// gave a limit.
+	SMEnabled  bool
+	SMResumeID string
+	SMMax      int
+	// CarbonsEnabled reports whether Message Carbons are active. Servers do
+	// not confirm carbons inline, so it is set when they were requested and
+	// the bind succeeded.
+	CarbonsEnabled bool
+}
+
+type smFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+}
+
+// ParseInline extracts the features negotiated for req from a SASL2 success
+// (XEP-0386 §2.5).
+func ParseInline(s *Success, req BindRequest) (InlineFeatures, error) {
+	if s.AuthzID == "" {
+		return InlineFeatures{}, ErrNoBoundJID
+	}
+	bound, err := jid.Parse(s.AuthzID)
+	if err != nil {
+		return InlineFeatures{}, err
+	}
+	f := InlineFeatures{JID: bound, CarbonsEnabled: req.Carbons}
+
+	d := xml.NewDecoder(bytes.NewReader(s.Inner))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return InlineFeatures{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Space != ns.Bind2 || start.Name.Local != "bound" {
+			continue
+		}
+		var b Bound
+		if err := d.DecodeElement(&b, &start); err != nil {
+			return InlineFeatures{}, err
+		}
+		if err := parseBound(b.Inner, &f); err != nil {
+			return InlineFeatures{}, err
+		}
+	}
+	return f, nil
+}
+
+func parseBound(inner []byte, f *InlineFeatures) error {
+	d := xml.NewDecoder(bytes.NewReader(inner))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Space != ns.SM {
+			continue
+		}
+		switch start.Name.Local {
+		case "enabled":
+			var e sm.Enabled
+			if err := d.DecodeElement(&e, &start); err != nil {
+				return err
+			}
+			f.SMEnabled = true
+			if e.Resume {
+				f.SMResumeID = e.ID
+			}
+			f.SMMax = e.Max
+		case "failed":
+			if err := d.DecodeElement(&smFailed{}, &start); err != nil {
+				return err
+			}
+			f.SMEnabled = false
+		}
+	}
+}
+
+// InlineHandler is called with the features negotiated inline.
+type InlineHandler func(ctx context.Context, f InlineFeatures)
+
+type inlineState struct {
+	mu         sync.RWMutex
+	negotiated *InlineFeatures
+	onInline   InlineHandler
+}
+
+// OnInlineFeatures registers the callback invoked by HandleSuccess.
+func (p *Plugin) OnInlineFeatures(f InlineHandler) {
+	p.inline.mu.Lock()
+	defer p.inline.mu.Unlock()
+	p.inline.onInline = f
+}
+
+// Negotiated returns the features negotiated by the last HandleSuccess.
+func (p *Plugin) Negotiated() (InlineFeatures, bool) {
+	p.inline.mu.RLock()
+	defer p.inline.mu.RUnlock()
+	if p.inline.negotiated == nil {
+		return InlineFeatures{}, false
+	}
+	return *p.inline.negotiated, true
+}
+
+// HandleSuccess records what a SASL2 success negotiated for req, updates
+// the sm and carbons plugins when they are registered, and invokes the
+// callback set with OnInlineFeatures.
+func (p *Plugin) HandleSuccess(ctx context.Context, s *Success, req BindRequest) (InlineFeatures, error) {
+	f, err := ParseInline(s, req)
+	if err != nil {
+		return InlineFeatures{}, err
+	}
+	if p.params.Get != nil {
+		if sp, ok := p.params.Get(sm.Name); ok {
+			if smp, ok := sp.(*sm.Plugin); ok && f.SMEnabled {
+				smp.SetID(f.SMResumeID)
+			}
+		}
+		if cp, ok := p.params.Get(carbons.Name); ok {
+			if cbp, ok := cp.(*carbons.Plugin); ok && f.CarbonsEnabled {
+				cbp.SetEnabled(true)
+			}
+		}
+	}
+
+	p.inline.mu.Lock()
+	p.inline.negotiated = &f
+	cb := p.inline.onInline
+	p.inline.mu.Unlock()
+	if cb != nil {
+		cb(ctx, f)
+	}
+	return f, nil
+}
@@ -0,0 +1,119 @@
+package sasl2
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/carbons"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+)
+
+const successXML = `<success xmlns='urn:xmpp:sasl:2'>
+  <additional-data>ShouldBeServerFinalMessage</additional-data>
+  <authorization-identifier>juliet@montague.example/Balcony.abcd</authorization-identifier>
+  <bound xmlns='urn:xmpp:bind:0'>
+    <enabled xmlns='urn:xmpp:sm:3' id='SGVsbG8=' resume='true' max='600'/>
+  </bound>
+</success>`
+
+func decodeSuccess(t *testing.T, data string) *Success {
+	t.Helper()
+	var s Success
+	if err := xml.Unmarshal([]byte(data), &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func TestBindRequestElement(t *testing.T) {
+	b, err := BindRequest{Tag: "AwesomeXMPP", SM: true, Resume: true, Carbons: true}.Element()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<tag>AwesomeXMPP</tag>", `xmlns="urn:xmpp:carbons:2"`, `resume="true"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("bind element %s lacks %s", data, want)
+		}
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	f, err := ParseInline(decodeSuccess(t, successXML), BindRequest{SM: true, Resume: true, Carbons: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.JID.String() != "juliet@montague.example/Balcony.abcd" {
+		t.Errorf("JID = %s", f.JID)
+	}
+	if !f.SMEnabled || f.SMResumeID != "SGVsbG8=" || f.SMMax != 600 {
+		t.Errorf("SM = %v %q %d", f.SMEnabled, f.SMResumeID, f.SMMax)
+	}
+	if !f.CarbonsEnabled {
+		t.Error("carbons not reported as enabled")
+	}
+}
+
+func TestParseInlineSMFailed(t *testing.T) {
+	f, err := ParseInline(decodeSuccess(t, `<success xmlns='urn:xmpp:sasl:2'>
+  <authorization-identifier>juliet@montague.example/Balcony</authorization-identifier>
+  <bound xmlns='urn:xmpp:bind:0'><failed xmlns='urn:xmpp:sm:3'/></bound>
+</success>`), BindRequest{SM: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.SMEnabled || f.CarbonsEnabled {
+		t.Errorf("features = %+v, want none enabled", f)
+	}
+}
+
+func TestParseInlineWithoutJID(t *testing.T) {
+	_, err := ParseInline(decodeSuccess(t, `<success xmlns='urn:xmpp:sasl:2'/>`), BindRequest{})
+	if !errors.Is(err, ErrNoBoundJID) {
+		t.Fatalf("err = %v, want ErrNoBoundJID", err)
+	}
+}
+
+func TestHandleSuccessUpdatesPlugins(t *testing.T) {
+	smp, cbp := sm.New(), carbons.New()
+	p := New()
+	if err := p.Initialize(context.Background(), plugin.InitParams{
+		Get: func(name string) (plugin.Plugin, bool) {
+			switch name {
+			case sm.Name:
+				return smp, true
+			case carbons.Name:
+				return cbp, true
+			}
+			return nil, false
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got InlineFeatures
+	p.OnInlineFeatures(func(_ context.Context, f InlineFeatures) { got = f })
+	f, err := p.HandleSuccess(context.Background(), decodeSuccess(t, successXML), BindRequest{SM: true, Resume: true, Carbons: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != f {
+		t.Errorf("callback got %+v, want %+v", got, f)
+	}
+	if n, ok := p.Negotiated(); !ok || n != f {
+		t.Errorf("Negotiated = %+v, %v", n, ok)
+	}
+	if smp.ID() != "SGVsbG8=" {
+		t.Errorf("sm ID = %q", smp.ID())
+	}
+	if !cbp.IsEnabled() {
+		t.Error("carbons plugin not enabled")
+	}
+}
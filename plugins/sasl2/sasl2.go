@@ -108,6 +108,7 @@ type ChannelBinding struct {
 }
 
 type Plugin struct {
+	inline inlineState
 	params plugin.InitParams
 }
 
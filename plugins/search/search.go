@@ -0,0 +1,404 @@
+// Package search implements XEP-0055 Jabber Search.
+package search
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const Name = "search"
+
+// DefaultMaxResults caps the number of users returned for one search.
+const DefaultMaxResults = 50
+
+// Search field names, shared by the legacy query and the data form.
+const (
+	FieldJID   = "jid"
+	FieldFirst = "first"
+	FieldLast  = "last"
+	FieldNick  = "nick"
+	FieldEmail = "email"
+)
+
+// ErrUnknownField is returned when a criterion names a field the search
+// service does not offer.
+var ErrUnknownField = errors.New("search: field not offered by the service")
+
+// Query is the jabber:iq:search payload. In a search form reply, empty
+// legacy fields mark the fields the service can search on; an extended
+// service sends Form instead.
+type Query struct {
+	XMLName      xml.Name   `xml:"jabber:iq:search query"`
+	Instructions string     `xml:"instructions,omitempty"`
+	First        *string    `xml:"first,omitempty"`
+	Last         *string    `xml:"last,omitempty"`
+	Nick         *string    `xml:"nick,omitempty"`
+	Email        *string    `xml:"email,omitempty"`
+	Items        []Item     `xml:"item,omitempty"`
+	Form         *form.Form `xml:"jabber:x:data x,omitempty"`
+}
+
+// Item is a legacy search result.
+type Item struct {
+	XMLName xml.Name `xml:"item"`
+	JID     string   `xml:"jid,attr"`
+	First   string   `xml:"first,omitempty"`
+	Last    string   `xml:"last,omitempty"`
+	Nick    string   `xml:"nick,omitempty"`
+	Email   string   `xml:"email,omitempty"`
+}
+
+// Result is a user found by a search. Fields maps each reported field,
+// including FieldJID, to its value.
+type Result struct {
+	JID    string
+	Fields map[string]string
+}
+
+// Entry is a user listed in a Directory. Empty fields are never matched or
+// returned, so users share only what they chose to.
+type Entry struct {
+	JID   string
+	First string
+	Last  string
+	Nick  string
+	Email string
+}
+
+// Criteria are the values searched for. Empty criteria are ignored; the
+// others must all match.
+type Criteria struct {
+	First string
+	Last  string
+	Nick  string
+	Email string
+}
+
+func (c Criteria) empty() bool {
+	return c.First == "" && c.Last == "" && c.Nick == "" && c.Email == ""
+}
+
+// Directory holds the users who opted in to being found by search.
+type Directory interface {
+	Search(ctx context.Context, c Criteria, max int) ([]Entry, error)
+}
+
+// MemoryDirectory is an in-memory Directory. Users appear in search results
+// only after List and disappear again on Unlist.
+type MemoryDirectory struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+	order   []string
+}
+
+// NewMemoryDirectory returns an empty directory.
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{entries: make(map[string]Entry)}
+}
+
+// List adds e to the directory or replaces the user's previous entry.
+func (d *MemoryDirectory) List(e Entry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[e.JID]; !ok {
+		d.order = append(d.order, e.JID)
+	}
+	d.entries[e.JID] = e
+}
+
+// Unlist removes the user with the bare JID jid from the directory.
+func (d *MemoryDirectory) Unlist(jid string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[jid]; !ok {
+		return
+	}
+	delete(d.entries, jid)
+	for i, j := range d.order {
+		if j == jid {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Listed reports whether the user with the bare JID jid is in the directory.
+func (d *MemoryDirectory) Listed(jid string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.entries[jid]
+	return ok
+}
+
+// Search returns up to max entries matching c in listing order. A value
+// matches a criterion when it contains it, ignoring case.
+func (d *MemoryDirectory) Search(_ context.Context, c Criteria, max int) ([]Entry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var out []Entry
+	for _, j := range d.order {
+		if max > 0 && len(out) == max {
+			break
+		}
+		if e := d.entries[j]; Match(e, c) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// Match reports whether e matches every non-empty criterion of c.
+func Match(e Entry, c Criteria) bool {
+	return matches(e.First, c.First) && matches(e.Last, c.Last) &&
+		matches(e.Nick, c.Nick) && matches(e.Email, c.Email)
+}
+
+func matches(value, criterion string) bool {
+	if criterion == "" {
+		return true
+	}
+	return value != "" && strings.Contains(strings.ToLower(value), strings.ToLower(criterion))
+}
+
+// Plugin answers jabber:iq:search requests from a Directory. Without a
+// directory the service is unavailable, so no user is ever exposed unless
+// the deployment opts in.
+type Plugin struct {
+	mu         sync.RWMutex
+	dir        Directory
+	maxResults int
+	params     plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{maxResults: DefaultMaxResults} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
+
+// SetDirectory sets the directory searched by HandleIQ.
+func (p *Plugin) SetDirectory(d Directory) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dir = d
+}
+
+// SetMaxResults sets the number of users returned for one search. Values
+// below one restore DefaultMaxResults.
+func (p *Plugin) SetMaxResults(n int) {
+	if n < 1 {
+		n = DefaultMaxResults
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxResults = n
+}
+
+// SearchForm returns the form a client fills in to search (XEP-0055 §3).
+func SearchForm() *form.Form {
+	f := form.NewForm(form.TypeForm, "User Directory Search")
+	f.Instructions = []string{"Fill in one or more fields to search for users."}
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.Search}})
+	f.AddField(form.Field{Var: FieldFirst, Type: form.FieldTextSingle, Label: "Given Name"})
+	f.AddField(form.Field{Var: FieldLast, Type: form.FieldTextSingle, Label: "Family Name"})
+	f.AddField(form.Field{Var: FieldNick, Type: form.FieldTextSingle, Label: "Nickname"})
+	f.AddField(form.Field{Var: FieldEmail, Type: form.FieldTextSingle, Label: "Email"})
+	return f
+}
+
+// HandleIQ answers a jabber:iq:search get with the search form and a set
+// with the matching users, replying in the format of the request: a result
+// form for form submissions and legacy items otherwise. Searches without
+// any criterion are refused so the directory cannot be dumped wholesale.
+func (p *Plugin) HandleIQ(ctx context.Context, iq *stanza.IQ) *stanza.IQ {
+	p.mu.RLock()
+	dir, max := p.dir, p.maxResults
+	p.mu.RUnlock()
+	if dir == nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "user directory disabled"))
+	}
+
+	var q Query
+	if err := xml.Unmarshal(iq.Query, &q); err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "malformed search query"))
+	}
+
+	switch iq.Type {
+	case stanza.IQGet:
+		empty := ""
+		return reply(iq, Query{
+			Instructions: "Fill in one or more fields to search for users.",
+			First:        &empty, Last: &empty, Nick: &empty, Email: &empty,
+			Form: SearchForm(),
+		})
+	case stanza.IQSet:
+		c := criteriaOf(q)
+		if c.empty() {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorNotAcceptable, "at least one search field is required"))
+		}
+		entries, err := dir.Search(ctx, c, max)
+		if err != nil {
+			return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+		}
+		if q.Form != nil {
+			return reply(iq, Query{Form: ResultForm(entries)})
+		}
+		items := make([]Item, 0, len(entries))
+		for _, e := range entries {
+			items = append(items, Item{JID: e.JID, First: e.First, Last: e.Last, Nick: e.Nick, Email: e.Email})
+		}
+		return reply(iq, Query{Items: items})
+	default:
+		return nil
+	}
+}
+
+// ResultForm returns entries as a result form with a reported table
+// (XEP-0055 §3.1).
+func ResultForm(entries []Entry) *form.Form {
+	f := form.NewForm(form.TypeResult, "User Directory Search")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.Search}})
+	f.Reported = &form.Reported{Fields: []form.Field{
+		{Var: FieldJID, Type: form.FieldJIDSingle, Label: "JID"},
+		{Var: FieldFirst, Type: form.FieldTextSingle, Label: "Given Name"},
+		{Var: FieldLast, Type: form.FieldTextSingle, Label: "Family Name"},
+		{Var: FieldNick, Type: form.FieldTextSingle, Label: "Nickname"},
+		{Var: FieldEmail, Type: form.FieldTextSingle, Label: "Email"},
+	}}
+	for _, e := range entries {
+		f.Items = append(f.Items, form.FormItem{Fields: []form.Field{
+			{Var: FieldJID, Values: []string{e.JID}},
+			{Var: FieldFirst, Values: values(e.First)},
+			{Var: FieldLast, Values: values(e.Last)},
+			{Var: FieldNick, Values: values(e.Nick)},
+			{Var: FieldEmail, Values: values(e.Email)},
+		}})
+	}
+	return f
+}
+
+func values(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+func criteriaOf(q Query) Criteria {
+	if q.Form != nil {
+		return Criteria{
+			First: q.Form.GetValue(FieldFirst),
+			Last:  q.Form.GetValue(FieldLast),
+			Nick:  q.Form.GetValue(FieldNick),
+			Email: q.Form.GetValue(FieldEmail),
+		}
+	}
+	return Criteria{First: deref(q.First), Last: deref(q.Last), Nick: deref(q.Nick), Email: deref(q.Email)}
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func reply(iq *stanza.IQ, q Query) *stanza.IQ {
+	payload, err := xml.Marshal(q)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorInternalServerError, ""))
+	}
+	res := iq.ResultIQ()
+	res.Query = payload
+	return res
+}
+
+// Request fills the search form returned by a service with criteria, keyed
+// by field var, and returns the query to submit. The data form is preferred
+// when the service offers one; otherwise the legacy fields are used.
+func Request(offered Query, criteria map[string]string) (Query, error) {
+	if offered.Form != nil {
+		submit := form.NewForm(form.TypeSubmit, "")
+		for _, f := range offered.Form.Fields {
+			if f.Type == form.FieldHidden {
+				submit.AddField(form.Field{Var: f.Var, Values: f.Values})
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(criteria)) {
+			if offered.Form.GetField(name) == nil {
+				return Query{}, fmt.Errorf("%w: %s", ErrUnknownField, name)
+			}
+			submit.AddField(form.Field{Var: name, Values: []string{criteria[name]}})
+		}
+		return Query{Form: submit}, nil
+	}
+
+	var q Query
+	for name, value := range criteria {
+		var offeredField **string
+		switch name {
+		case FieldFirst:
+			q.First, offeredField = &value, &offered.First
+		case FieldLast:
+			q.Last, offeredField = &value, &offered.Last
+		case FieldNick:
+			q.Nick, offeredField = &value, &offered.Nick
+		case FieldEmail:
+			q.Email, offeredField = &value, &offered.Email
+		}
+		if offeredField == nil || *offeredField == nil {
+			return Query{}, fmt.Errorf("%w: %s", ErrUnknownField, name)
+		}
+	}
+	return q, nil
+}
+
+// Results extracts the users found from a search reply, reading either the
+// reported table of a result form or the legacy items.
+func Results(q Query) []Result {
+	if q.Form != nil {
+		model := form.NewRenderModel(q.Form)
+		out := make([]Result, 0, len(model.Rows))
+		for _, row := range model.Rows {
+			r := Result{Fields: make(map[string]string, len(model.Columns))}
+			for i, col := range model.Columns {
+				if text := row.Cells[i].Text(); text != "" {
+					r.Fields[col.Var] = text
+				}
+			}
+			r.JID = r.Fields[FieldJID]
+			out = append(out, r)
+		}
+		return out
+	}
+
+	out := make([]Result, 0, len(q.Items))
+	for _, item := range q.Items {
+		fields := map[string]string{FieldJID: item.JID}
+		for name, v := range map[string]string{FieldFirst: item.First, FieldLast: item.Last, FieldNick: item.Nick, FieldEmail: item.Email} {
+			if v != "" {
+				fields[name] = v
+			}
+		}
+		out = append(out, Result{JID: item.JID, Fields: fields})
+	}
+	return out
+}
+
+func init() { _ = ns.Search }
@@ -0,0 +1,128 @@
+package search
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/form"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func ask(t *testing.T, p *Plugin, typ string, q Query) *stanza.IQ {
+	t.Helper()
+	payload, err := xml.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iq := stanza.NewIQ(typ)
+	iq.Query = payload
+	return p.HandleIQ(context.Background(), iq)
+}
+
+func decode(t *testing.T, iq *stanza.IQ) Query {
+	t.Helper()
+	if iq.Type != stanza.IQResult {
+		t.Fatalf("reply type = %q, error %+v", iq.Type, iq.Error)
+	}
+	var q Query
+	if err := xml.Unmarshal(iq.Query, &q); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func newService() (*Plugin, *MemoryDirectory) {
+	dir := NewMemoryDirectory()
+	dir.List(Entry{JID: "juliet@example.org", First: "Juliet", Last: "Capulet"})
+	dir.List(Entry{JID: "tybalt@example.org", Nick: "Prince of Cats"})
+	p := New()
+	p.SetDirectory(dir)
+	return p, dir
+}
+
+func TestDisabledWithoutDirectory(t *testing.T) {
+	reply := ask(t, New(), stanza.IQGet, Query{})
+	if reply.Type != stanza.IQError || reply.Error.Condition != stanza.ErrorServiceUnavailable {
+		t.Fatalf("reply = %+v", reply)
+	}
+}
+
+func TestLegacySearch(t *testing.T) {
+	p, _ := newService()
+	offered := decode(t, ask(t, p, stanza.IQGet, Query{}))
+	offered.Form = nil
+	req, err := Request(offered, map[string]string{FieldLast: "capu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := Results(decode(t, ask(t, p, stanza.IQSet, req)))
+	if len(found) != 1 || found[0].JID != "juliet@example.org" || found[0].Fields[FieldFirst] != "Juliet" {
+		t.Fatalf("results = %+v", found)
+	}
+}
+
+func TestFormSearch(t *testing.T) {
+	p, _ := newService()
+	offered := decode(t, ask(t, p, stanza.IQGet, Query{}))
+	req, err := Request(offered, map[string]string{FieldNick: "cats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := decode(t, ask(t, p, stanza.IQSet, req))
+	if reply.Form == nil || reply.Form.Reported == nil {
+		t.Fatalf("reply has no result table: %+v", reply)
+	}
+	found := Results(reply)
+	if len(found) != 1 || found[0].JID != "tybalt@example.org" {
+		t.Fatalf("results = %+v", found)
+	}
+	if _, ok := found[0].Fields[FieldEmail]; ok {
+		t.Fatal("unshared field reported")
+	}
+}
+
+func TestUnlistedUsersAreNotFound(t *testing.T) {
+	p, dir := newService()
+	dir.Unlist("juliet@example.org")
+	found := Results(decode(t, ask(t, p, stanza.IQSet, Query{Form: searchSubmit(FieldFirst, "juliet")})))
+	if len(found) != 0 {
+		t.Fatalf("results = %+v", found)
+	}
+}
+
+func TestEmptySearchRefused(t *testing.T) {
+	p, _ := newService()
+	reply := ask(t, p, stanza.IQSet, Query{Form: searchSubmit(FieldFirst, "")})
+	if reply.Type != stanza.IQError || reply.Error.Condition != stanza.ErrorNotAcceptable {
+		t.Fatalf("reply = %+v", reply)
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	p, dir := newService()
+	dir.List(Entry{JID: "julia@example.org", First: "Julia"})
+	p.SetMaxResults(1)
+	found := Results(decode(t, ask(t, p, stanza.IQSet, Query{Form: searchSubmit(FieldFirst, "jul")})))
+	if len(found) != 1 {
+		t.Fatalf("results = %+v", found)
+	}
+}
+
+func TestRequestUnknownField(t *testing.T) {
+	_, err := Request(Query{Form: SearchForm()}, map[string]string{"city": "Verona"})
+	if !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("err = %v", err)
+	}
+	empty := ""
+	_, err = Request(Query{Nick: &empty}, map[string]string{FieldFirst: "Juliet"})
+	if !errors.Is(err, ErrUnknownField) {
+		t.Fatalf("legacy err = %v", err)
+	}
+}
+
+func searchSubmit(field, value string) *form.Form {
+	q, _ := Request(Query{Form: SearchForm()}, map[string]string{field: value})
+	return q.Form
+}
@@ -0,0 +1,92 @@
+// Package serverinfo implements XEP-0157 Contact Addresses for XMPP
+// Services, which a server publishes in its disco#info as an extended
+// information form (XEP-0128).
+package serverinfo
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/plugins/form"
+)
+
+const Name = "serverinfo"
+
+// Types of contact address (XEP-0157 §2).
+const (
+	Abuse    = "abuse"
+	Admin    = "admin"
+	Feedback = "feedback"
+	Sales    = "sales"
+	Security = "security"
+	Status   = "status"
+	Support  = "support"
+)
+
+// Types lists the types of contact address, in the order they are
+// published.
+var Types = []string{Abuse, Admin, Feedback, Sales, Security, Status, Support}
+
+// Addresses are the contact addresses of a service by type: URIs such as
+// mailto:, xmpp: or https: ones.
+type Addresses map[string][]string
+
+// ValidType reports whether typ is a type of contact address.
+func ValidType(typ string) bool {
+	return slices.Contains(Types, typ)
+}
+
+// Form returns the form publishing addrs, with the fields of extra after
+// them. Types without an address are left out.
+func Form(addrs Addresses, extra ...form.Field) *form.Form {
+	f := form.NewForm(form.TypeResult, "")
+	f.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{ns.ServerInfo}})
+	for _, typ := range Types {
+		if len(addrs[typ]) > 0 {
+			f.AddField(form.Field{Var: typ + "-addresses", Type: form.FieldListMulti, Values: addrs[typ]})
+		}
+	}
+	for _, field := range extra {
+		f.AddField(field)
+	}
+	return f
+}
+
+// Parse returns the contact addresses published in forms, the extended
+// information of a disco#info result. It reports false when none of the
+// forms is of XEP-0157.
+func Parse(forms []form.Form) (Addresses, bool) {
+	for _, f := range forms {
+		if f.GetValue("FORM_TYPE") != ns.ServerInfo {
+			continue
+		}
+		addrs := make(Addresses)
+		for _, field := range f.Fields {
+			typ, ok := strings.CutSuffix(field.Var, "-addresses")
+			if ok && ValidType(typ) && len(field.Values) > 0 {
+				addrs[typ] = field.Values
+			}
+		}
+		return addrs, true
+	}
+	return nil, false
+}
+
+// Plugin implements XEP-0157.
+type Plugin struct {
+	params plugin.InitParams
+}
+
+func New() *Plugin { return &Plugin{} }
+
+func (p *Plugin) Name() string    { return Name }
+func (p *Plugin) Version() string { return "1.0.0" }
+func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
+	p.params = params
+	return nil
+}
+func (p *Plugin) Close() error           { return nil }
+func (p *Plugin) Dependencies() []string { return nil }
@@ -0,0 +1,55 @@
+package serverinfo
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugins/disco"
+	"github.com/meszmate/xmpp-go/plugins/form"
+)
+
+func TestFormRoundTrip(t *testing.T) {
+	addrs := Addresses{
+		Support: {"https://example.com/support", "xmpp:support@example.com"},
+		Abuse:   {"mailto:abuse@example.com"},
+		Sales:   nil,
+	}
+	info := disco.InfoQuery{Forms: []form.Form{*Form(addrs, form.Field{Var: "example-field", Values: []string{"x"}})}}
+	data, err := xml.Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(data), "http://jabber.org/network/serverinfo") {
+		t.Fatalf("no FORM_TYPE in %s", data)
+	}
+
+	var got disco.InfoQuery
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	f := got.Forms[0]
+	var vars []string
+	for _, field := range f.Fields {
+		vars = append(vars, field.Var)
+	}
+	if strings.Join(vars, " ") != "FORM_TYPE abuse-addresses support-addresses example-field" {
+		t.Fatalf("fields %v", vars)
+	}
+	parsed, ok := Parse(got.Forms)
+	if !ok || len(parsed) != 2 || strings.Join(parsed[Support], " ") != "https://example.com/support xmpp:support@example.com" || parsed[Abuse][0] != "mailto:abuse@example.com" {
+		t.Fatalf("Parse = %v, %v", parsed, ok)
+	}
+}
+
+func TestParseWithoutServerInfo(t *testing.T) {
+	other := form.NewForm(form.TypeResult, "")
+	other.AddField(form.Field{Var: "FORM_TYPE", Type: form.FieldHidden, Values: []string{"urn:example"}})
+	other.AddField(form.Field{Var: "abuse-addresses", Values: []string{"mailto:x@example.com"}})
+	if _, ok := Parse([]form.Form{*other}); ok {
+		t.Fatal("parsed a form of another type")
+	}
+	if ValidType("ceo") || !ValidType(Security) {
+		t.Fatal("ValidType")
+	}
+}
@@ -4,6 +4,7 @@ package sm
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"sync"
 	"sync/atomic"
 
@@ -13,9 +14,25 @@ import (
 
 const Name = "sm"
 
+// Default limits on the stanzas kept for resumption until the peer acks them.
+const (
+	DefaultMaxUnacked      = 1000
+	DefaultMaxUnackedBytes = 4 << 20
+)
+
+// ErrUnackedLimit is returned by Enqueue when the peer has left too many
+// stanzas unacknowledged. The caller should request an ack and pause sending
+// with WaitRoom, or end the session if the peer does not catch up.
+var ErrUnackedLimit = errors.New("sm: too many unacknowledged stanzas")
+
+// Feature is the stream feature advertised by servers that support stream
+// management.
+var Feature = xml.Name{Space: ns.SM, Local: "sm"}
+
 type Enable struct {
 	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
 	Resume  bool     `xml:"resume,attr,omitempty"`
+	Max     int      `xml:"max,attr,omitempty"`
 }
 
 type Enabled struct {
@@ -38,6 +55,27 @@ type Resumed struct {
 	PrevID  string   `xml:"previd,attr"`
 }
 
+// Failed reports that enabling or resuming stream management failed. H, if
+// set, acknowledges the stanzas the peer handled before the stream broke.
+// Condition, if set, says why, such as item-not-found for a stream that can
+// no longer be resumed.
+type Failed struct {
+	XMLName   xml.Name   `xml:"urn:xmpp:sm:3 failed"`
+	H         uint32     `xml:"h,attr,omitempty"`
+	Condition *Condition `xml:",any"`
+}
+
+// Condition is a stanza error condition element, such as
+// <item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>.
+type Condition struct {
+	XMLName xml.Name
+}
+
+// NewCondition returns the stanza error condition named name.
+func NewCondition(name string) *Condition {
+	return &Condition{XMLName: xml.Name{Space: ns.Stanzas, Local: name}}
+}
+
 type Ack struct {
 	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
 	H       uint32   `xml:"h,attr"`
@@ -52,11 +90,22 @@ type Plugin struct {
 	inbound  atomic.Uint32
 	outbound atomic.Uint32
 	queue    [][]byte
-	id       string
-	params   plugin.InitParams
+	bytes    int
+	maxCount int
+	maxBytes int
+	// acked is closed and replaced whenever an ack frees queue space.
+	acked  chan struct{}
+	id     string
+	params plugin.InitParams
 }
 
-func New() *Plugin { return &Plugin{} }
+func New() *Plugin {
+	return &Plugin{
+		maxCount: DefaultMaxUnacked,
+		maxBytes: DefaultMaxUnackedBytes,
+		acked:    make(chan struct{}),
+	}
+}
 
 func (p *Plugin) Name() string    { return Name }
 func (p *Plugin) Version() string { return "1.0.0" }
@@ -72,10 +121,79 @@ func (p *Plugin) OutboundCount() uint32 { return p.outbound.Load() }
 func (p *Plugin) IncrementInbound()     { p.inbound.Add(1) }
 func (p *Plugin) IncrementOutbound()    { p.outbound.Add(1) }
 
-func (p *Plugin) Enqueue(data []byte) {
+// SetLimits bounds the unacknowledged stanzas kept for resumption by count
+// and by total size in bytes. A limit of zero or less removes that bound.
+func (p *Plugin) SetLimits(maxStanzas, maxBytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxCount = maxStanzas
+	p.maxBytes = maxBytes
+}
+
+// Pending returns the number and total size of unacknowledged stanzas.
+func (p *Plugin) Pending() (stanzas, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), p.bytes
+}
+
+// Enqueue keeps data until the peer acks it. It returns ErrUnackedLimit
+// without queueing when data does not fit within the limits; of several
+// stanzas, either all are queued or none. A stanza is always accepted into
+// an empty queue, however large.
+func (p *Plugin) Enqueue(data ...[]byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, bytes := len(p.queue), p.bytes
+	for _, d := range data {
+		if !p.fits(n, bytes, len(d)) {
+			return ErrUnackedLimit
+		}
+		n, bytes = n+1, bytes+len(d)
+	}
+	p.queue = append(p.queue, data...)
+	p.bytes = bytes
+	return nil
+}
+
+// fits reports whether a stanza of size bytes fits after n stanzas of
+// bytes in total.
+func (p *Plugin) fits(n, bytes, size int) bool {
+	if n == 0 {
+		return true
+	}
+	if p.maxCount > 0 && n >= p.maxCount {
+		return false
+	}
+	return p.maxBytes <= 0 || bytes+size <= p.maxBytes
+}
+
+// WaitRoom blocks until a stanza of size bytes fits within the limits or
+// ctx is done. Senders use it to pause while the peer catches up on acks.
+func (p *Plugin) WaitRoom(ctx context.Context, size int) error {
+	for {
+		p.mu.Lock()
+		if p.fits(len(p.queue), p.bytes, size) {
+			p.mu.Unlock()
+			return nil
+		}
+		acked := p.acked
+		p.mu.Unlock()
+
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unacked returns the stanzas the peer has not acknowledged yet, oldest
+// first, for resending after a resumption.
+func (p *Plugin) Unacked() [][]byte {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.queue = append(p.queue, data)
+	return append([][]byte(nil), p.queue...)
 }
 
 func (p *Plugin) Ack(h uint32) {
@@ -83,7 +201,12 @@ func (p *Plugin) Ack(h uint32) {
 	defer p.mu.Unlock()
 	diff := int(h) - int(p.outbound.Load()-uint32(len(p.queue)))
 	if diff > 0 && diff <= len(p.queue) {
+		for _, data := range p.queue[:diff] {
+			p.bytes -= len(data)
+		}
 		p.queue = p.queue[diff:]
+		close(p.acked)
+		p.acked = make(chan struct{})
 	}
 }
 
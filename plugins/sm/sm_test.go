@@ -0,0 +1,114 @@
+package sm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// send queues data the way a session does when it writes a stanza.
+func send(p *Plugin, data string) error {
+	if err := p.Enqueue([]byte(data)); err != nil {
+		return err
+	}
+	p.IncrementOutbound()
+	return nil
+}
+
+func TestEnqueueStanzaLimit(t *testing.T) {
+	p := New()
+	p.SetLimits(3, 0)
+	for i := 0; i < 3; i++ {
+		if err := send(p, "<message/>"); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := send(p, "<message/>"); !errors.Is(err, ErrUnackedLimit) {
+		t.Fatalf("send over limit = %v, want ErrUnackedLimit", err)
+	}
+	if n, _ := p.Pending(); n != 3 {
+		t.Fatalf("pending = %d, want 3", n)
+	}
+
+	p.Ack(2)
+	if n, size := p.Pending(); n != 1 || size != len("<message/>") {
+		t.Fatalf("pending after ack = %d stanzas, %d bytes", n, size)
+	}
+	if err := send(p, "<message/>"); err != nil {
+		t.Fatalf("send after ack: %v", err)
+	}
+}
+
+func TestEnqueueByteLimit(t *testing.T) {
+	p := New()
+	p.SetLimits(0, 16)
+	if err := send(p, "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(p, "0123456789"); !errors.Is(err, ErrUnackedLimit) {
+		t.Fatalf("send over byte limit = %v, want ErrUnackedLimit", err)
+	}
+	p.Ack(1)
+	// An oversized stanza still goes out once nothing else is pending.
+	if err := send(p, "0123456789abcdefghij"); err != nil {
+		t.Fatalf("oversized send into empty queue: %v", err)
+	}
+}
+
+func TestWaitRoomResumesOnAck(t *testing.T) {
+	p := New()
+	p.SetLimits(1, 0)
+	if err := send(p, "<iq/>"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.WaitRoom(context.Background(), 5) }()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitRoom returned %v before ack", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.Ack(1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitRoom: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitRoom did not return after ack")
+	}
+}
+
+func TestWaitRoomContext(t *testing.T) {
+	p := New()
+	p.SetLimits(1, 0)
+	if err := send(p, "<iq/>"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.WaitRoom(ctx, 5); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitRoom = %v, want deadline exceeded", err)
+	}
+}
+
+func TestUnackedReturnsCopy(t *testing.T) {
+	p := New()
+	for _, data := range []string{"<message>1</message>", "<message>2</message>"} {
+		if err := send(p, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Ack(1)
+	got := p.Unacked()
+	if len(got) != 1 || string(got[0]) != "<message>2</message>" {
+		t.Fatalf("Unacked = %q", got)
+	}
+	got[0] = nil
+	if n, _ := p.Pending(); n != 1 || p.Unacked()[0] == nil {
+		t.Fatal("Unacked shares the queue")
+	}
+}
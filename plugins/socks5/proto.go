@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// SOCKS5 protocol values (RFC 1928) used by XEP-0065, which only connects
+// by domain name without authentication.
+const (
+	socksVersion    = 5
+	methodNoAuth    = 0
+	methodNone      = 0xff
+	cmdConnect      = 1
+	atypDomain      = 3
+	replySucceeded  = 0
+	replyFailure    = 1
+	replyNotAllowed = 2
+	replyCommand    = 7
+	replyAddress    = 8
+)
+
+// DefaultDialTimeout bounds each connection attempt to a streamhost.
+const DefaultDialTimeout = 10 * time.Second
+
+// ErrRefused is returned by Dial when the streamhost refuses the
+// connection.
+var ErrRefused = errors.New("socks5: connection refused by streamhost")
+
+// DstAddr returns the address both parties connect to a streamhost with:
+// the hex SHA-1 hash of the session ID and the requester's and target's
+// full JIDs (XEP-0065 §5.3.2).
+func DstAddr(sid string, requester, target jid.JID) string {
+	sum := sha1.Sum([]byte(sid + requester.String() + target.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Dial connects to the streamhost at address, a host:port, and asks it
+// for dstAddr.
+func Dial(ctx context.Context, address, dstAddr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := connect(conn, dstAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func connect(conn net.Conn, dstAddr string) error {
+	if len(dstAddr) > 255 {
+		return errors.New("socks5: address too long")
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, methodNoAuth}); err != nil {
+		return err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		return err
+	}
+	if method[0] != socksVersion || method[1] != methodNoAuth {
+		return ErrRefused
+	}
+	req := append([]byte{socksVersion, cmdConnect, 0, atypDomain, byte(len(dstAddr))}, dstAddr...)
+	if _, err := conn.Write(append(req, 0, 0)); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socksVersion {
+		return fmt.Errorf("socks5: bad reply version %d", head[0])
+	}
+	if head[1] != replySucceeded {
+		return ErrRefused
+	}
+	return skipAddress(conn, head[3])
+}
+
+// skipAddress reads the bound address of a reply, which XEP-0065 does not
+// use.
+func skipAddress(r io.Reader, atyp byte) error {
+	var n int
+	switch atyp {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case atypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("socks5: bad address type %d", atyp)
+	}
+	_, err := io.ReadFull(r, make([]byte, n+2))
+	return err
+}
+
+// Handshake performs the streamhost side of the SOCKS5 negotiation on
+// conn and returns the address the peer asked for. allow decides whether
+// to take the connection; a refused one is answered with an error reply.
+// With a nil allow every address is taken.
+func Handshake(conn net.Conn, allow func(dstAddr string) bool) (string, error) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return "", err
+	}
+	if greeting[0] != socksVersion {
+		return "", fmt.Errorf("socks5: bad version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == methodNoAuth
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socksVersion, methodNone})
+		return "", errors.New("socks5: peer requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, methodNoAuth}); err != nil {
+		return "", err
+	}
+
+	var head [5]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[1] != cmdConnect {
+		reply(conn, replyCommand, "")
+		return "", fmt.Errorf("socks5: unsupported command %d", head[1])
+	}
+	if head[3] != atypDomain {
+		reply(conn, replyAddress, "")
+		return "", fmt.Errorf("socks5: unsupported address type %d", head[3])
+	}
+	addr := make([]byte, int(head[4])+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return "", err
+	}
+	dstAddr := string(addr[:head[4]])
+	if allow != nil && !allow(dstAddr) {
+		reply(conn, replyNotAllowed, "")
+		return "", errors.New("socks5: unknown address")
+	}
+	if err := reply(conn, replySucceeded, dstAddr); err != nil {
+		return "", err
+	}
+	return dstAddr, nil
+}
+
+func reply(conn net.Conn, code byte, dstAddr string) error {
+	msg := append([]byte{socksVersion, code, 0, atypDomain, byte(len(dstAddr))}, dstAddr...)
+	_, err := conn.Write(append(msg, 0, 0))
+	return err
+}
+
+// Fail answers a connection whose handshake is done but that cannot be
+// used after all.
+func Fail(conn net.Conn) { _ = reply(conn, replyFailure, "") }
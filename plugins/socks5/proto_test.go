@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+func TestDstAddr(t *testing.T) {
+	romeo := jid.MustParse("romeo@montague.example/dr4hcr0st3lup4c")
+	juliet := jid.MustParse("juliet@capulet.example/yn0cl4bnw0yr3vym")
+	got := DstAddr("vj3hs98y", romeo, juliet)
+	if len(got) != 40 || got != DstAddr("vj3hs98y", romeo, juliet) {
+		t.Fatalf("DstAddr = %q", got)
+	}
+	if got == DstAddr("vj3hs98y", juliet, romeo) {
+		t.Fatal("requester and target are interchangeable")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dst, err := Handshake(conn, func(dst string) bool { return dst == "wanted" })
+			if err != nil {
+				accepted <- "refused"
+				conn.Close()
+				continue
+			}
+			accepted <- dst
+			_, _ = conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, ln.Addr().String(), "wanted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-accepted; got != "wanted" {
+		t.Fatalf("streamhost saw %q", got)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	conn.Close()
+
+	if _, err := Dial(ctx, ln.Addr().String(), "unknown"); !errors.Is(err, ErrRefused) {
+		t.Fatalf("unknown address: %v", err)
+	}
+	if got := <-accepted; got != "refused" {
+		t.Fatalf("streamhost saw %q", got)
+	}
+}
+
+func TestTransportXML(t *testing.T) {
+	tr := Transport{SID: "vj3hs98y", DstAddr: "972b7bf4", Mode: "tcp", Candidates: []Candidate{
+		{CID: "hft54dqy", Host: "192.0.2.1", JID: "romeo@example.com/orchard", Port: 7777, Priority: CandidatePriority(CandidateDirect, 0), Type: CandidateDirect},
+		{CID: "hutr46fe", Host: "proxy.example.com", JID: "proxy.example.com", Port: 7777, Priority: CandidatePriority(CandidateProxy, 0), Type: CandidateProxy},
+	}}
+	data, err := xml.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Transport
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Candidates) != 2 || got.Candidates[0].Priority <= got.Candidates[1].Priority || got.CandidateError != nil {
+		t.Fatalf("decoded %+v from %s", got, data)
+	}
+
+	if err := xml.Unmarshal([]byte(`<transport xmlns='urn:xmpp:jingle:transports:s5b:1' sid='s1'><candidate-error/></transport>`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.CandidateError == nil || got.CandidateUsed != nil {
+		t.Fatalf("candidate-error decoded as %+v", got)
+	}
+}
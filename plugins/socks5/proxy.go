@@ -0,0 +1,299 @@
+package socks5
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// DefaultPendingTimeout is how long a Proxy keeps a connection that was
+// not activated.
+const DefaultPendingTimeout = time.Minute
+
+// ProxyStats counts what a Proxy did.
+type ProxyStats struct {
+	// Activations is the number of bytestreams activated.
+	Activations uint64 `json:"activations"`
+	// Refused is the number of activations refused because the parties
+	// were not both connected.
+	Refused uint64 `json:"refused"`
+	// Active is the number of bytestreams being relayed.
+	Active int `json:"active"`
+	// Pending is the number of connections waiting for activation.
+	Pending int `json:"pending"`
+	// Bytes is the number of bytes relayed.
+	Bytes uint64 `json:"bytes"`
+}
+
+// Proxy is a SOCKS5 bytestream proxy (XEP-0065 §6). Both parties of a
+// bytestream connect to it with the same destination address; once the
+// requester activates the bytestream, it relays data between them.
+type Proxy struct {
+	streamhost Streamhost
+
+	mu          sync.Mutex
+	streamRate  int64
+	total       *rateLimiter
+	timeout     time.Duration
+	pending     map[string][]*pendingConn // by destination address
+	stats       ProxyStats
+	activeConns map[net.Conn]struct{}
+}
+
+type pendingConn struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// NewProxy returns a proxy that clients reach at the address of
+// streamhost.
+func NewProxy(streamhost Streamhost) *Proxy {
+	return &Proxy{
+		streamhost:  streamhost,
+		timeout:     DefaultPendingTimeout,
+		pending:     make(map[string][]*pendingConn),
+		activeConns: make(map[net.Conn]struct{}),
+	}
+}
+
+// SetRates caps the bandwidth of each bytestream and of all of them
+// together, in bytes per second in each direction. Zero leaves a cap
+// off. Bytestreams activated before keep their cap.
+func (p *Proxy) SetRates(stream, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.streamRate = stream
+	p.total = newRateLimiter(total)
+}
+
+// SetPendingTimeout sets how long a connection waits for activation
+// before it is closed.
+func (p *Proxy) SetPendingTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+}
+
+// Stats returns what the proxy did so far.
+func (p *Proxy) Stats() ProxyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	for _, conns := range p.pending {
+		stats.Pending += len(conns)
+	}
+	return stats
+}
+
+// Serve takes the connections of clients on ln until it is closed, when
+// the bytestreams being relayed are closed as well.
+func (p *Proxy) Serve(ln net.Listener) error {
+	defer p.closeAll()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.accept(conn)
+	}
+}
+
+func (p *Proxy) accept(conn net.Conn) {
+	p.mu.Lock()
+	timeout := p.timeout
+	p.mu.Unlock()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	// A bytestream has two parties; a third connection is refused.
+	dst, err := Handshake(conn, func(dst string) bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.pending[dst]) < 2
+	})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending[dst]) >= 2 {
+		conn.Close()
+		return
+	}
+	pc := &pendingConn{conn: conn}
+	pc.timer = time.AfterFunc(timeout, func() { p.expire(dst, pc) })
+	p.pending[dst] = append(p.pending[dst], pc)
+}
+
+// expire closes pc, which was not activated in time.
+func (p *Proxy) expire(dst string, pc *pendingConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.pending[dst]
+	for i, c := range conns {
+		if c == pc {
+			p.pending[dst] = append(conns[:i:i], conns[i+1:]...)
+			if len(p.pending[dst]) == 0 {
+				delete(p.pending, dst)
+			}
+			pc.conn.Close()
+			return
+		}
+	}
+}
+
+// HandleIQ answers a request for the network address of the proxy and
+// activates bytestreams, or returns nil when iq is neither.
+func (p *Proxy) HandleIQ(_ context.Context, iq *stanza.IQ) *stanza.IQ {
+	var q Query
+	if err := xml.Unmarshal(iq.Query, &q); err != nil {
+		return nil
+	}
+	switch {
+	case iq.Type == stanza.IQGet:
+		return queryIQ(iq, Query{Streamhosts: []Streamhost{p.streamhost}})
+	case iq.Type != stanza.IQSet:
+		return nil
+	case q.SID == "" || q.Activate == "":
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "sid and activate required"))
+	}
+	target, err := jid.Parse(q.Activate)
+	if err != nil {
+		return iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorJIDMalformed, ""))
+	}
+	// Only the requester knows the address, which is derived from its own
+	// JID, so nobody else can activate its bytestream.
+	if err := p.activate(DstAddr(q.SID, iq.From, target)); err != nil {
+		return iq.ErrorIQ(err)
+	}
+	return iq.ResultIQ()
+}
+
+func (p *Proxy) activate(dst string) *stanza.StanzaError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.pending[dst]
+	if len(conns) < 2 {
+		p.stats.Refused++
+		if len(conns) == 0 {
+			return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorItemNotFound, "no such bytestream")
+		}
+		return stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorNotAllowed, "target not connected")
+	}
+	delete(p.pending, dst)
+	for _, c := range conns {
+		c.timer.Stop()
+		p.activeConns[c.conn] = struct{}{}
+	}
+	p.stats.Activations++
+	p.stats.Active++
+	stream := newRateLimiter(p.streamRate)
+	go p.relay(conns[0].conn, conns[1].conn, stream, p.total)
+	return nil
+}
+
+// relay copies data both ways until either party closes its connection.
+func (p *Proxy) relay(a, b net.Conn, limiters ...*rateLimiter) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(&countingWriter{p: p, w: dst, limiters: limiters}, src)
+		// The other direction ends as well once one party is done.
+		dst.Close()
+		src.Close()
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.activeConns, a)
+	delete(p.activeConns, b)
+	p.stats.Active--
+}
+
+func (p *Proxy) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dst, conns := range p.pending {
+		for _, c := range conns {
+			c.timer.Stop()
+			c.conn.Close()
+		}
+		delete(p.pending, dst)
+	}
+	for conn := range p.activeConns {
+		conn.Close()
+	}
+}
+
+// countingWriter writes at the pace of limiters and counts what was
+// written.
+type countingWriter struct {
+	p        *Proxy
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	for _, l := range c.limiters {
+		l.wait(len(b))
+	}
+	n, err := c.w.Write(b)
+	c.p.mu.Lock()
+	c.p.stats.Bytes += uint64(n)
+	c.p.mu.Unlock()
+	return n, err
+}
+
+// rateLimiter is a token bucket holding a second's worth of bytes. A nil
+// rateLimiter does not limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, sleeping for as long as the bucket is in debt.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+func queryIQ(iq *stanza.IQ, q Query) *stanza.IQ {
+	reply := iq.ResultIQ()
+	reply.Query, _ = xml.Marshal(q)
+	return reply
+}
@@ -0,0 +1,156 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func startProxy(t *testing.T) (*Proxy, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	p := NewProxy(Streamhost{JID: "proxy.example.com", Host: addr.IP.String(), Port: addr.Port})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = p.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	return p, ln.Addr().String()
+}
+
+func activateIQ(from jid.JID, sid string, target jid.JID) *stanza.IQ {
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.From = from
+	iq.Query = []byte(`<query xmlns='http://jabber.org/protocol/bytestreams' sid='` + sid + `'><activate>` + target.String() + `</activate></query>`)
+	return iq
+}
+
+// waitPending waits for the proxy to hold n connections.
+func waitPending(t *testing.T, p *Proxy, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); p.Stats().Pending != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending = %d, want %d", p.Stats().Pending, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	romeo := jid.MustParse("romeo@example.com/orchard")
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	p, addr := startProxy(t)
+
+	get := stanza.NewIQ(stanza.IQGet)
+	get.Query = []byte(`<query xmlns='http://jabber.org/protocol/bytestreams'/>`)
+	if reply := p.HandleIQ(ctx, get); reply == nil || reply.Type != stanza.IQResult {
+		t.Fatalf("streamhost query: %+v", reply)
+	}
+
+	dst := DstAddr("s1", romeo, juliet)
+	initiator, err := Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Close()
+	waitPending(t, p, 1)
+	if reply := p.HandleIQ(ctx, activateIQ(romeo, "s1", juliet)); reply.Error == nil || reply.Error.Condition != stanza.ErrorNotAllowed {
+		t.Fatalf("activation with one party: %+v", reply.Error)
+	}
+	target, err := Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	waitPending(t, p, 2)
+	if _, err := Dial(ctx, addr, dst); err == nil {
+		t.Fatal("a third party connected")
+	}
+
+	// Only the requester's JID yields the address.
+	if reply := p.HandleIQ(ctx, activateIQ(juliet, "s1", romeo)); reply.Error == nil || reply.Error.Condition != stanza.ErrorItemNotFound {
+		t.Fatalf("activation by the target: %+v", reply.Error)
+	}
+	if reply := p.HandleIQ(ctx, activateIQ(romeo, "s1", juliet)); reply.Error != nil {
+		t.Fatalf("activation: %+v", reply.Error)
+	}
+	if _, err := initiator.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	initiator.Close()
+	got, err := io.ReadAll(target)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("relayed %q, %v", got, err)
+	}
+	stats := p.Stats()
+	if stats.Activations != 1 || stats.Refused != 2 || stats.Bytes != 5 || stats.Pending != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestProxyRates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	romeo := jid.MustParse("romeo@example.com/orchard")
+	juliet := jid.MustParse("juliet@example.com/balcony")
+	p, addr := startProxy(t)
+	p.SetRates(1000, 0)
+
+	dst := DstAddr("s1", romeo, juliet)
+	initiator, err := Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := Dial(ctx, addr, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	waitPending(t, p, 2)
+	if reply := p.HandleIQ(ctx, activateIQ(romeo, "s1", juliet)); reply.Error != nil {
+		t.Fatalf("activation: %+v", reply.Error)
+	}
+	start := time.Now()
+	go func() {
+		_, _ = initiator.Write(make([]byte, 1500))
+		initiator.Close()
+	}()
+	got, err := io.ReadAll(target)
+	if err != nil || len(got) != 1500 {
+		t.Fatalf("relayed %d bytes, %v", len(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("1500 bytes at 1000 B/s took %s", elapsed)
+	}
+}
+
+func TestProxyPendingTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, addr := startProxy(t)
+	p.SetPendingTimeout(50 * time.Millisecond)
+	conn, err := Dial(ctx, addr, "lonely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unactivated connection stayed open")
+	}
+	waitPending(t, p, 0)
+}
@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// ErrNotConnected is returned when the plugin was not initialized by a
+// client, which is needed to talk to proxies.
+var ErrNotConnected = errors.New("socks5: not connected")
+
+// Jingle SOCKS5 candidate types (XEP-0260 §2.2)
+const (
+	CandidateDirect   = "direct"
+	CandidateAssisted = "assisted"
+	CandidateTunnel   = "tunnel"
+	CandidateProxy    = "proxy"
+)
+
+// Transport is the Jingle SOCKS5 Bytestreams transport (XEP-0260). Its
+// candidates are offered in session-initiate and session-accept; the
+// outcome of trying the peer's candidates and the proxy activation are
+// reported with transport-info.
+type Transport struct {
+	XMLName        xml.Name      `xml:"urn:xmpp:jingle:transports:s5b:1 transport"`
+	SID            string        `xml:"sid,attr"`
+	DstAddr        string        `xml:"dstaddr,attr,omitempty"`
+	Mode           string        `xml:"mode,attr,omitempty"`
+	Candidates     []Candidate   `xml:"candidate"`
+	CandidateUsed  *CandidateRef `xml:"candidate-used"`
+	Activated      *CandidateRef `xml:"activated"`
+	CandidateError *struct{}     `xml:"candidate-error"`
+	ProxyError     *struct{}     `xml:"proxy-error"`
+}
+
+// Candidate is a streamhost one party can be reached at.
+type Candidate struct {
+	CID      string `xml:"cid,attr"`
+	Host     string `xml:"host,attr"`
+	JID      string `xml:"jid,attr"`
+	Port     int    `xml:"port,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	Type     string `xml:"type,attr"`
+}
+
+// CandidateRef names a candidate by its ID.
+type CandidateRef struct {
+	CID string `xml:"cid,attr"`
+}
+
+// CandidatePriority returns the priority of a candidate of type typ, with
+// localPref between 0 and 65535 ranking candidates of the same type
+// (XEP-0260 §2.4).
+func CandidatePriority(typ string, localPref int) int {
+	var typePref int
+	switch typ {
+	case CandidateDirect:
+		typePref = 126
+	case CandidateAssisted:
+		typePref = 120
+	case CandidateTunnel:
+		typePref = 110
+	case CandidateProxy:
+		typePref = 10
+	}
+	return typePref<<16 + min(max(localPref, 0), 65535)
+}
+
+// Streamhosts asks the proxy for the network address it takes
+// connections at.
+func (p *Plugin) Streamhosts(ctx context.Context, proxy jid.JID) ([]Streamhost, error) {
+	reply, err := p.request(ctx, stanza.IQGet, proxy, Query{})
+	if err != nil {
+		return nil, err
+	}
+	var q Query
+	if err := xml.Unmarshal(reply.Query, &q); err != nil {
+		return nil, err
+	}
+	return q.Streamhosts, nil
+}
+
+// Activate asks the proxy to relay the bytestream sid, which the local
+// entity and target are both connected to.
+func (p *Plugin) Activate(ctx context.Context, proxy jid.JID, sid string, target jid.JID) error {
+	_, err := p.request(ctx, stanza.IQSet, proxy, Query{SID: sid, Activate: target.String()})
+	return err
+}
+
+func (p *Plugin) request(ctx context.Context, typ string, to jid.JID, q Query) (*stanza.IQ, error) {
+	if p.params.SendIQ == nil {
+		return nil, ErrNotConnected
+	}
+	data, err := xml.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(typ)
+	iq.To, iq.Query = to, data
+	return p.params.SendIQ(ctx, iq)
+}
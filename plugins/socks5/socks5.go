@@ -13,10 +13,11 @@ const Name = "socks5"
 
 type Query struct {
 	XMLName     xml.Name        `xml:"http://jabber.org/protocol/bytestreams query"`
-	SID         string          `xml:"sid,attr"`
+	SID         string          `xml:"sid,attr,omitempty"`
 	Mode        string          `xml:"mode,attr,omitempty"`
 	Streamhosts []Streamhost    `xml:"streamhost"`
 	Used        *StreamhostUsed `xml:"streamhost-used,omitempty"`
+	Activate    string          `xml:"activate,omitempty"`
 }
 
 type Streamhost struct {
@@ -31,6 +32,7 @@ type StreamhostUsed struct {
 	JID     string   `xml:"jid,attr"`
 }
 
+// Plugin discovers and activates SOCKS5 proxies for bytestreams.
 type Plugin struct {
 	params plugin.InitParams
 }
@@ -46,4 +48,7 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-func init() { _ = ns.SOCKS5 }
+func init() {
+	_ = ns.SOCKS5
+	_ = ns.JingleS5B
+}
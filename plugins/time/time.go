@@ -6,6 +6,7 @@ import (
 	"encoding/xml"
 	gotime "time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
 )
@@ -37,7 +38,7 @@ func (p *Plugin) Dependencies() []string { return nil }
 
 // Now returns the current entity time.
 func (p *Plugin) Now() Time {
-	now := gotime.Now()
+	now := clock.Or(p.params.Clock).Now()
 	return Time{
 		TZO: now.Format("-07:00"),
 		UTC: now.UTC().Format("2006-01-02T15:04:05Z"),
@@ -7,6 +7,7 @@ import (
 
 	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/storage"
 )
 
 const Name = "upload"
@@ -42,6 +43,7 @@ type Header struct {
 }
 
 type Plugin struct {
+	blobs  storage.BlobStore
 	params plugin.InitParams
 }
 
@@ -56,4 +58,36 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
+// SetBlobStore sets the store uploaded files are kept in. Without one the
+// file methods return storage.ErrStorageUnavailable.
+func (p *Plugin) SetBlobStore(bs storage.BlobStore) { p.blobs = bs }
+
+// fileKey returns the blob key of the file uploaded to slot.
+func fileKey(slot string) string { return "upload/" + slot }
+
+// StoreFile keeps data, the file uploaded to the slot with the given ID.
+func (p *Plugin) StoreFile(ctx context.Context, slot string, data []byte, contentType string) error {
+	if p.blobs == nil {
+		return storage.ErrStorageUnavailable
+	}
+	return p.blobs.PutBlob(ctx, fileKey(slot), data, contentType)
+}
+
+// File returns the file uploaded to slot and its content type. Returns
+// storage.ErrNotFound if nothing was uploaded there.
+func (p *Plugin) File(ctx context.Context, slot string) ([]byte, string, error) {
+	if p.blobs == nil {
+		return nil, "", storage.ErrStorageUnavailable
+	}
+	return p.blobs.GetBlob(ctx, fileKey(slot))
+}
+
+// DeleteFile removes the file uploaded to slot.
+func (p *Plugin) DeleteFile(ctx context.Context, slot string) error {
+	if p.blobs == nil {
+		return storage.ErrStorageUnavailable
+	}
+	return p.blobs.DeleteBlob(ctx, fileKey(slot))
+}
+
 func init() { _ = ns.HTTPUpload }
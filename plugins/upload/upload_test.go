@@ -0,0 +1,32 @@
+package upload
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestFiles(t *testing.T) {
+	ctx := t.Context()
+	p := New()
+	if err := p.StoreFile(ctx, "slot1", []byte("png"), "image/png"); !errors.Is(err, storage.ErrStorageUnavailable) {
+		t.Fatalf("StoreFile without a blob store = %v", err)
+	}
+
+	p.SetBlobStore(memory.NewBlobStore())
+	if err := p.StoreFile(ctx, "slot1", []byte("png"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	data, contentType, err := p.File(ctx, "slot1")
+	if err != nil || string(data) != "png" || contentType != "image/png" {
+		t.Fatalf("File = %q, %q, %v", data, contentType, err)
+	}
+	if err := p.DeleteFile(ctx, "slot1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.File(ctx, "slot1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("File after delete = %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package vcard
+
+import "strings"
+
+// ToVCard4 converts a vcard-temp to vCard4. Only the fields both formats
+// share are converted. A PHOTO becomes a data: URI, or its EXTVAL URL, and
+// DESC becomes the note.
+func ToVCard4(v *VCard) *VCard4 {
+	out := &VCard4{
+		FN:       text(v.FN),
+		Nickname: text(v.Nickname),
+		Title:    text(v.Title),
+		Note:     text(v.Desc),
+	}
+	if v.N != nil && (v.N.Family != "" || v.N.Given != "" || v.N.Middle != "") {
+		out.N = &VCard4N{Surname: v.N.Family, Given: v.N.Given, Additional: v.N.Middle}
+	}
+	if v.Photo != nil {
+		switch {
+		case v.Photo.BinVal != "":
+			out.Photo = &URI{URI: "data:" + v.Photo.Type + ";base64," + stripSpace(v.Photo.BinVal)}
+		case v.Photo.ExtVal != "":
+			out.Photo = &URI{URI: v.Photo.ExtVal}
+		}
+	}
+	if v.Bday != "" {
+		out.Bday = &Date{Date: v.Bday}
+	}
+	if v.Email != nil && v.Email.UserID != "" {
+		out.Email = &Text{Text: v.Email.UserID}
+	}
+	if v.URL != "" {
+		out.URL = &URI{URI: v.URL}
+	}
+	if v.Org != nil && v.Org.OrgName != "" {
+		out.Org = &VCard4Org{Text: []string{v.Org.OrgName}}
+		if v.Org.OrgUnit != "" {
+			out.Org.Text = append(out.Org.Text, v.Org.OrgUnit)
+		}
+	}
+	return out
+}
+
+// FromVCard4 converts a vCard4 to vcard-temp, the reverse of ToVCard4. A
+// photo given as a base64 data: URI is decoded into TYPE and BINVAL; any
+// other URI becomes EXTVAL.
+func FromVCard4(v *VCard4) *VCard {
+	out := &VCard{
+		FN:       textValue(v.FN),
+		Nickname: textValue(v.Nickname),
+		Title:    textValue(v.Title),
+		Desc:     textValue(v.Note),
+	}
+	if v.N != nil && (v.N.Surname != "" || v.N.Given != "" || v.N.Additional != "") {
+		out.N = &Name_{Family: v.N.Surname, Given: v.N.Given, Middle: v.N.Additional}
+	}
+	if v.Photo != nil && v.Photo.URI != "" {
+		if mediaType, data, ok := parseDataURI(v.Photo.URI); ok {
+			out.Photo = &Photo{Type: mediaType, BinVal: data}
+		} else {
+			out.Photo = &Photo{ExtVal: v.Photo.URI}
+		}
+	}
+	if v.Bday != nil {
+		out.Bday = v.Bday.Date
+	}
+	if v.Email != nil && v.Email.Text != "" {
+		out.Email = &Email{UserID: v.Email.Text}
+	}
+	if v.URL != nil {
+		out.URL = v.URL.URI
+	}
+	if v.Org != nil && len(v.Org.Text) > 0 && v.Org.Text[0] != "" {
+		out.Org = &Org{OrgName: v.Org.Text[0]}
+		if len(v.Org.Text) > 1 {
+			out.Org.OrgUnit = v.Org.Text[1]
+		}
+	}
+	return out
+}
+
+func text(s string) *Text {
+	if s == "" {
+		return nil
+	}
+	return &Text{Text: s}
+}
+
+func textValue(t *Text) string {
+	if t == nil {
+		return ""
+	}
+	return t.Text
+}
+
+// parseDataURI splits a base64 data: URI into its media type and data.
+func parseDataURI(uri string) (mediaType, data string, ok bool) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", "", false
+	}
+	header, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", false
+	}
+	mediaType, ok = strings.CutSuffix(header, ";base64")
+	if !ok {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
+
+// stripSpace removes the line breaks and other white space BINVAL values
+// are often wrapped with.
+func stripSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
@@ -0,0 +1,80 @@
+package vcard
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestConvertRoundTrip(t *testing.T) {
+	temp := &VCard{
+		XMLName:  xml.Name{Space: "vcard-temp", Local: "vCard"},
+		FN:       "Alice Liddell",
+		N:        &Name_{Family: "Liddell", Given: "Alice", Middle: "Pleasance"},
+		Nickname: "alice",
+		Email:    &Email{UserID: "alice@example.com"},
+		URL:      "https://example.com/alice",
+		Photo:    &Photo{Type: "image/png", BinVal: "iVBORw0K\nGgoAAAAN"},
+		Bday:     "1852-05-04",
+		Org:      &Org{OrgName: "Wonderland", OrgUnit: "Tea Party"},
+		Title:    "Guest",
+		Desc:     "Curiouser and curiouser.",
+	}
+	v4 := ToVCard4(temp)
+	if v4.Photo == nil || v4.Photo.URI != "data:image/png;base64,iVBORw0KGgoAAAAN" {
+		t.Fatalf("photo = %+v", v4.Photo)
+	}
+	if v4.N.Additional != "Pleasance" || v4.Org.Text[1] != "Tea Party" || v4.Note.Text != "Curiouser and curiouser." {
+		t.Fatalf("vCard4 = %+v", v4)
+	}
+
+	back := FromVCard4(v4)
+	back.XMLName = temp.XMLName
+	temp.Photo.BinVal = "iVBORw0KGgoAAAAN"
+	if !reflect.DeepEqual(back, temp) {
+		t.Fatalf("round trip:\n got %+v\nwant %+v", back, temp)
+	}
+}
+
+func TestConvertPhotoURL(t *testing.T) {
+	v4 := ToVCard4(&VCard{Photo: &Photo{ExtVal: "https://example.com/a.png"}})
+	if v4.Photo.URI != "https://example.com/a.png" {
+		t.Fatalf("photo = %+v", v4.Photo)
+	}
+	if temp := FromVCard4(v4); temp.Photo.ExtVal != "https://example.com/a.png" || temp.Photo.BinVal != "" {
+		t.Fatalf("photo = %+v", temp.Photo)
+	}
+	// Empty values are left out rather than converted to empty elements.
+	data, err := xml.Marshal(ToVCard4(&VCard{FN: "Bob", N: &Name_{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != `<vcard xmlns="urn:ietf:params:xml:ns:vcard-4.0"><fn><text>Bob</text></fn></vcard>` {
+		t.Fatalf("marshaled %s", got)
+	}
+}
+
+func TestPluginVCard4(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	if err := p.Initialize(ctx, plugin.InitParams{Storage: memory.New()}); err != nil {
+		t.Fatal(err)
+	}
+	v4 := &VCard4{FN: &Text{Text: "Alice"}, Email: &Text{Text: "alice@example.com"}}
+	if err := p.SetVCard4(ctx, "alice@example.com", v4); err != nil {
+		t.Fatalf("SetVCard4: %v", err)
+	}
+	stored, err := p.GetVCard(ctx, "alice@example.com")
+	if err != nil || !strings.Contains(string(stored), `<vCard xmlns="vcard-temp"><FN>Alice</FN>`) {
+		t.Fatalf("stored %s, %v", stored, err)
+	}
+	got, err := p.GetVCard4(ctx, "alice@example.com")
+	if err != nil || got.FN.Text != "Alice" || got.Email.Text != "alice@example.com" {
+		t.Fatalf("GetVCard4 = %+v, %v", got, err)
+	}
+}
@@ -48,19 +48,31 @@ type Org struct {
 	OrgUnit string `xml:"ORGUNIT,omitempty"`
 }
 
-// VCard4 represents a vCard4 (XEP-0292).
+// VCard4 represents a vCard4 (XEP-0292, RFC 6351). It is the payload of
+// vCard4 IQs and of the item published to the urn:xmpp:vcard4 PEP node.
 type VCard4 struct {
-	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:vcard-4.0 vcard"`
-	FN       *Text    `xml:"fn,omitempty"`
-	N        *VCard4N `xml:"n,omitempty"`
-	Email    *Text    `xml:"email,omitempty"`
-	URL      *URI     `xml:"url,omitempty"`
-	Nickname *Text    `xml:"nickname,omitempty"`
+	XMLName  xml.Name   `xml:"urn:ietf:params:xml:ns:vcard-4.0 vcard"`
+	FN       *Text      `xml:"fn,omitempty"`
+	N        *VCard4N   `xml:"n,omitempty"`
+	Nickname *Text      `xml:"nickname,omitempty"`
+	Photo    *URI       `xml:"photo,omitempty"`
+	Bday     *Date      `xml:"bday,omitempty"`
+	Email    *Text      `xml:"email,omitempty"`
+	URL      *URI       `xml:"url,omitempty"`
+	Org      *VCard4Org `xml:"org,omitempty"`
+	Title    *Text      `xml:"title,omitempty"`
+	Note     *Text      `xml:"note,omitempty"`
 }
 
 type VCard4N struct {
-	Surname string `xml:"surname,omitempty"`
-	Given   string `xml:"given,omitempty"`
+	Surname    string `xml:"surname,omitempty"`
+	Given      string `xml:"given,omitempty"`
+	Additional string `xml:"additional,omitempty"`
+}
+
+// VCard4Org is an organization and its units, outermost first.
+type VCard4Org struct {
+	Text []string `xml:"text"`
 }
 
 type Text struct {
@@ -71,6 +83,17 @@ type URI struct {
 	URI string `xml:"uri"`
 }
 
+type Date struct {
+	Date string `xml:"date"`
+}
+
+// NodeVCard4 is the PEP node a vCard4 is published to, as the item
+// ItemCurrent.
+const (
+	NodeVCard4  = ns.VCard4Node
+	ItemCurrent = "current"
+)
+
 type Plugin struct {
 	store  storage.VCardStore
 	params plugin.InitParams
@@ -90,10 +113,14 @@ func (p *Plugin) Initialize(_ context.Context, params plugin.InitParams) error {
 func (p *Plugin) Close() error           { return nil }
 func (p *Plugin) Dependencies() []string { return nil }
 
-// GetVCard retrieves the vCard for the local user. Returns nil if no store is configured.
+// StorageAvailable reports whether the configured storage provides a
+// VCardStore. It implements plugin.StorageUser.
+func (p *Plugin) StorageAvailable() bool { return p.store != nil }
+
+// GetVCard retrieves the vCard for the local user. Returns storage.ErrStorageUnavailable if no store is configured.
 func (p *Plugin) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
 	if p.store == nil {
-		return nil, nil
+		return nil, storage.ErrStorageUnavailable
 	}
 	return p.store.GetVCard(ctx, userJID)
 }
@@ -101,15 +128,38 @@ func (p *Plugin) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
 // SetVCard stores the vCard for the local user.
 func (p *Plugin) SetVCard(ctx context.Context, userJID string, data []byte) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.SetVCard(ctx, userJID, data)
 }
 
+// GetVCard4 retrieves the vCard for the local user, stored as vcard-temp,
+// converted to vCard4.
+func (p *Plugin) GetVCard4(ctx context.Context, userJID string) (*VCard4, error) {
+	data, err := p.GetVCard(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	var v VCard
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return ToVCard4(&v), nil
+}
+
+// SetVCard4 stores a vCard4 for the local user, converted to vcard-temp.
+func (p *Plugin) SetVCard4(ctx context.Context, userJID string, v *VCard4) error {
+	data, err := xml.Marshal(FromVCard4(v))
+	if err != nil {
+		return err
+	}
+	return p.SetVCard(ctx, userJID, data)
+}
+
 // DeleteVCard removes the vCard for the local user.
 func (p *Plugin) DeleteVCard(ctx context.Context, userJID string) error {
 	if p.store == nil {
-		return nil
+		return storage.ErrStorageUnavailable
 	}
 	return p.store.DeleteVCard(ctx, userJID)
 }
@@ -0,0 +1,188 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Errors reported to the callbacks of queued stanzas.
+var (
+	// ErrQueueFull is returned by Queue, or passed to the callback of an
+	// evicted stanza, when the outgoing queue has no room.
+	ErrQueueFull = errors.New("xmpp: outgoing queue full")
+	// ErrClientClosed is passed to the callbacks of stanzas still queued
+	// when the client is closed.
+	ErrClientClosed = errors.New("xmpp: client closed")
+)
+
+// QueuePolicy decides which stanza is dropped when the outgoing queue is
+// full.
+type QueuePolicy uint8
+
+const (
+	// DropNewest refuses the stanza being queued.
+	DropNewest QueuePolicy = iota
+	// DropOldest evicts the stanza that has waited longest to make room.
+	DropOldest
+)
+
+type queuedStanza struct {
+	st   stanza.Stanza
+	done func(error)
+}
+
+// sendQueue buffers outgoing stanzas while the client is disconnected.
+type sendQueue struct {
+	mu     sync.Mutex
+	items  []queuedStanza
+	size   int
+	policy QueuePolicy
+	wake   chan struct{}
+}
+
+func newSendQueue(size int, policy QueuePolicy) *sendQueue {
+	return &sendQueue{size: size, policy: policy, wake: make(chan struct{}, 1)}
+}
+
+// push appends st, applying the drop policy when the queue is full. It
+// returns the evicted entry, if any.
+func (q *sendQueue) push(st stanza.Stanza, done func(error)) (evicted *queuedStanza, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 && len(q.items) >= q.size {
+		if q.policy != DropOldest {
+			return nil, ErrQueueFull
+		}
+		oldest := q.items[0]
+		q.items = q.items[1:]
+		evicted = &oldest
+	}
+	q.items = append(q.items, queuedStanza{st: st, done: done})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return evicted, nil
+}
+
+// pop removes and returns the oldest entry.
+func (q *sendQueue) pop() (queuedStanza, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return queuedStanza{}, false
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item, true
+}
+
+// requeue puts back an entry that pop returned but could not be written,
+// so it is the first to go out on the next session.
+func (q *sendQueue) requeue(item queuedStanza) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append([]queuedStanza{item}, q.items...)
+}
+
+// drain removes and returns every queued entry.
+func (q *sendQueue) drain() []queuedStanza {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Queue sends st through the outgoing queue enabled with WithSendQueue.
+// Stanzas are written in order as soon as the client is connected; while it
+// is disconnected or reconnecting they wait in the queue and are flushed
+// once a new session is established. done, if non-nil, is called exactly
+// once with the outcome: nil when the stanza was written, ErrQueueFull if
+// it was evicted, ErrClientClosed if the client was closed first, or the
+// write error.
+//
+// Without a queue, Queue sends st directly like Send.
+func (c *Client) Queue(st stanza.Stanza, done func(error)) error {
+	if c.queue == nil {
+		err := c.Send(context.Background(), st)
+		if done != nil {
+			done(err)
+		}
+		return err
+	}
+	evicted, err := c.queue.push(st, done)
+	if err != nil {
+		return err
+	}
+	if evicted != nil && evicted.done != nil {
+		evicted.done(ErrQueueFull)
+	}
+	return nil
+}
+
+// QueueLen returns the number of stanzas waiting in the outgoing queue.
+func (c *Client) QueueLen() int {
+	if c.queue == nil {
+		return 0
+	}
+	return c.queue.len()
+}
+
+// flushQueue writes queued stanzas to s in order until s is closed,
+// starting once s is ready: stanzas sent before the resource is bound or
+// the stream resumed would be rejected. A stanza whose write fails because
+// the session went away stays at the front of the queue for the next
+// session.
+func (c *Client) flushQueue(s *Session) {
+	q := c.queue
+	select {
+	case <-s.ready:
+	case <-s.Done():
+		return
+	}
+	for {
+		item, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.wake:
+				continue
+			case <-s.Done():
+				return
+			}
+		}
+		err := s.Send(context.Background(), item.st)
+		if err != nil {
+			select {
+			case <-s.Done():
+				q.requeue(item)
+				return
+			default:
+			}
+		}
+		if item.done != nil {
+			item.done(err)
+		}
+	}
+}
+
+// failQueue reports every queued stanza as failed with err.
+func (c *Client) failQueue(err error) {
+	if c.queue == nil {
+		return
+	}
+	for _, item := range c.queue.drain() {
+		if item.done != nil {
+			item.done(err)
+		}
+	}
+}
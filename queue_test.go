@@ -0,0 +1,202 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func queueTestClient(t *testing.T, size int, policy QueuePolicy) *Client {
+	t.Helper()
+	c, err := NewClient(jid.MustParse("alice@example.com"), "pw", WithSendQueue(size, policy))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func queuedMessage(id string) *stanza.Message {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.ID = id
+	msg.To = jid.MustParse("bob@example.com")
+	return msg
+}
+
+func TestQueueFlushesInOrderOnConnect(t *testing.T) {
+	c := queueTestClient(t, 10, DropNewest)
+	results := make(chan string, 3)
+	for _, id := range []string{"m1", "m2"} {
+		if err := c.Queue(queuedMessage(id), func(err error) {
+			if err != nil {
+				t.Errorf("callback for %s: %v", id, err)
+			}
+			results <- id
+		}); err != nil {
+			t.Fatalf("Queue %s: %v", id, err)
+		}
+	}
+	// Send while disconnected goes to the queue too.
+	if err := c.Send(t.Context(), queuedMessage("m3")); err != nil {
+		t.Fatalf("Send while disconnected: %v", err)
+	}
+	if n := c.QueueLen(); n != 3 {
+		t.Fatalf("QueueLen = %d, want 3", n)
+	}
+
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+	c.session = s
+	s.SetState(StateAuthenticated | StateBound | StateReady)
+	go c.flushQueue(s)
+
+	dec := xml.NewDecoder(peer)
+	for _, want := range []string{"m1", "m2", "m3"} {
+		var msg stanza.Message
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.ID != want {
+			t.Fatalf("flushed %q, want %q", msg.ID, want)
+		}
+	}
+	for _, want := range []string{"m1", "m2"} {
+		select {
+		case got := <-results:
+			if got != want {
+				t.Fatalf("callback order: got %s, want %s", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for callback")
+		}
+	}
+}
+
+func TestQueueWaitsForReadySession(t *testing.T) {
+	c := queueTestClient(t, 10, DropNewest)
+	if err := c.Queue(queuedMessage("m1"), nil); err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+	flushed := make(chan struct{})
+	go func() {
+		c.flushQueue(s)
+		close(flushed)
+	}()
+	decoded := make(chan string, 1)
+	go func() {
+		var msg stanza.Message
+		if err := xml.NewDecoder(peer).Decode(&msg); err == nil {
+			decoded <- msg.ID
+		}
+	}()
+
+	// Authentication alone does not make the stream ready.
+	s.SetState(StateAuthenticated)
+	select {
+	case id := <-decoded:
+		t.Fatalf("flushed %s before the session was ready", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.SetState(StateBound | StateReady)
+	select {
+	case id := <-decoded:
+		if id != "m1" {
+			t.Fatalf("flushed %q, want m1", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queue not flushed once the session was ready")
+	}
+	s.Close()
+	<-flushed
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	c := queueTestClient(t, 1, DropNewest)
+	if err := c.Queue(queuedMessage("m1"), nil); err != nil {
+		t.Fatalf("Queue m1: %v", err)
+	}
+	if err := c.Queue(queuedMessage("m2"), nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Queue m2: %v, want ErrQueueFull", err)
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("QueueLen = %d, want 1", n)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	c := queueTestClient(t, 1, DropOldest)
+	var evicted error
+	if err := c.Queue(queuedMessage("m1"), func(err error) { evicted = err }); err != nil {
+		t.Fatalf("Queue m1: %v", err)
+	}
+	if err := c.Queue(queuedMessage("m2"), nil); err != nil {
+		t.Fatalf("Queue m2: %v", err)
+	}
+	if !errors.Is(evicted, ErrQueueFull) {
+		t.Fatalf("evicted callback got %v, want ErrQueueFull", evicted)
+	}
+	item, _ := c.queue.pop()
+	if item.st.(*stanza.Message).ID != "m2" {
+		t.Fatalf("queue holds %v, want m2", item.st)
+	}
+}
+
+func TestQueueFailsOnClose(t *testing.T) {
+	c := queueTestClient(t, 10, DropNewest)
+	var got error
+	if err := c.Queue(queuedMessage("m1"), func(err error) { got = err }); err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !errors.Is(got, ErrClientClosed) {
+		t.Fatalf("callback got %v, want ErrClientClosed", got)
+	}
+	if n := c.QueueLen(); n != 0 {
+		t.Fatalf("QueueLen after Close = %d, want 0", n)
+	}
+}
+
+func TestQueueKeepsStanzaWhenSessionDrops(t *testing.T) {
+	c := queueTestClient(t, 10, DropNewest)
+	called := false
+	if err := c.Queue(queuedMessage("m1"), func(error) { called = true }); err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+
+	s, peer := newTestSession(t)
+	peer.Close()
+	s.Close()
+	c.flushQueue(s)
+
+	if called {
+		t.Fatal("callback ran for a stanza that was never written")
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("QueueLen = %d, want 1", n)
+	}
+}
+
+func TestQueueWithoutQueueSendsDirectly(t *testing.T) {
+	c, err := NewClient(jid.MustParse("alice@example.com"), "pw")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	var got error
+	if err := c.Queue(queuedMessage("m1"), func(err error) { got = err }); err == nil {
+		t.Fatal("Queue without a queue or session should fail")
+	}
+	if got == nil {
+		t.Fatal("callback not told about the failure")
+	}
+}
@@ -0,0 +1,419 @@
+package xmpp
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// LimitPolicy decides whether a peer may go on, so that a server can fight
+// floods and password guessing. A Server consults the policy set with
+// WithServerLimitPolicy for every connection it accepts, and a Session the
+// policy set with WithLimitPolicy for every stanza and authentication.
+// Methods are called concurrently.
+type LimitPolicy interface {
+	// AllowConnection reports whether a new connection from ip is
+	// accepted.
+	AllowConnection(ip string) bool
+	// AllowStanza reports whether a stanza from ip, sent by the account
+	// from once authenticated, is handled. size is the number of bytes
+	// read since the previous stanza of the connection.
+	AllowStanza(ip string, from jid.JID, size int64) bool
+	// AuthLockout returns how long authentication attempts from ip, or
+	// for username unless it is "", remain refused, or zero.
+	AuthLockout(ip, username string) time.Duration
+	// AuthResult records an authentication attempt for username from ip
+	// that succeeded if ok.
+	AuthResult(ip, username string, ok bool)
+}
+
+// RateLimit allows Rate events per second on average, in bursts of up to
+// Burst. A zero Rate is no limit; a zero Burst is the Rate, but at least
+// one.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(math.Ceil(l.Rate), 1)
+}
+
+// RateLimits configures a RateLimiter. Zero fields are no limit.
+type RateLimits struct {
+	// StanzasPerJID and StanzasPerIP limit the stanzas handled for one
+	// account, over all its sessions, and for one IP address.
+	StanzasPerJID RateLimit
+	StanzasPerIP  RateLimit
+	// BytesPerJID and BytesPerIP limit the bytes of the stanzas handled
+	// for one account and one IP address. Unlike StreamLimits.ReadRate,
+	// which slows down a single connection, they refuse stanzas and
+	// apply to all the connections of the account or address.
+	BytesPerJID RateLimit
+	BytesPerIP  RateLimit
+	// ConnectionsPerIP limits the connection attempts from one IP address.
+	ConnectionsPerIP RateLimit
+	// AuthFailures is the number of failed authentications from one IP
+	// address, or for one username, that lock it out for AuthLockout.
+	// Every further failure doubles the lockout, up to MaxAuthLockout if it
+	// is set. Failures are forgotten after an hour without any.
+	AuthFailures   int
+	AuthLockout    time.Duration
+	MaxAuthLockout time.Duration
+}
+
+// LimitKind identifies the limit a LimitEvent reports.
+type LimitKind uint8
+
+const (
+	// LimitConnections is the limit on connection attempts.
+	LimitConnections LimitKind = iota + 1
+	// LimitStanzas is the limit on the number of stanzas.
+	LimitStanzas
+	// LimitBytes is the limit on the bytes of stanzas.
+	LimitBytes
+	// LimitAuth is the lockout after failed authentications.
+	LimitAuth
+)
+
+var limitKindNames = [...]string{"unknown", "connections", "stanzas", "bytes", "auth"}
+
+func (k LimitKind) String() string {
+	if int(k) < len(limitKindNames) {
+		return limitKindNames[k]
+	}
+	return limitKindNames[0]
+}
+
+// LimitEvent reports a peer that crossed a limit of a RateLimiter.
+type LimitEvent struct {
+	Kind LimitKind
+	// IP is the address the peer connected from.
+	IP string
+	// JID is the account whose limit was crossed, or the zero JID for a
+	// limit of IP.
+	JID jid.JID
+	// Username is the username locked out with LimitAuth, or "" when
+	// IP is.
+	Username string
+	// Lockout is how long authentication is refused with LimitAuth.
+	Lockout time.Duration
+}
+
+// authForget is how long a failed authentication is remembered after the
+// last one, or after the lockout it caused.
+const authForget = time.Hour
+
+// pruneEvery is the number of limited events after which a RateLimiter
+// forgets the peers it no longer limits.
+const pruneEvery = 1024
+
+// RateLimiter is a LimitPolicy that enforces RateLimits with token buckets
+// and locks out authentication after repeated failures.
+type RateLimiter struct {
+	limits RateLimits
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	buckets map[limitKey]*tokenBucket
+	auth    map[string]*authFailures
+	ops     int
+	onLimit []func(LimitEvent)
+}
+
+type limitKey struct {
+	kind LimitKind
+	ip   bool
+	key  string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // the last take was refused
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: limit.burst(), last: now}
+}
+
+// take refills b for the time since its last use and takes n tokens,
+// reporting whether they were available. A request larger than the burst
+// is allowed from a full bucket and leaves it in debt.
+func (b *tokenBucket) take(limit RateLimit, n float64, now time.Time) bool {
+	burst := limit.burst()
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*limit.Rate, burst)
+	b.last = now
+	if b.tokens < math.Min(n, burst) {
+		b.limited = true
+		return false
+	}
+	b.tokens -= n
+	b.limited = false
+	return true
+}
+
+// full reports whether b has refilled by now, so that forgetting it
+// changes nothing.
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst()
+}
+
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// NewRateLimiter returns a RateLimiter enforcing limits, reading the time
+// from c, or from clock.System if c is nil.
+func NewRateLimiter(limits RateLimits, c clock.Clock) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		clock:   clock.Or(c),
+		buckets: make(map[limitKey]*tokenBucket),
+		auth:    make(map[string]*authFailures),
+	}
+}
+
+// OnLimit registers f for the peers that cross a limit. A peer is reported
+// when it first crosses the limit, not again for every refusal until it is
+// back within it. f must not block.
+func (l *RateLimiter) OnLimit(f func(LimitEvent)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onLimit = append(l.onLimit, f)
+}
+
+// AllowConnection implements LimitPolicy.
+func (l *RateLimiter) AllowConnection(ip string) bool {
+	var events []LimitEvent
+	l.mu.Lock()
+	ok := l.take(limitKey{LimitConnections, true, ip}, l.limits.ConnectionsPerIP, 1, LimitEvent{Kind: LimitConnections, IP: ip}, &events)
+	callbacks := l.onLimit
+	l.mu.Unlock()
+	notifyLimits(callbacks, events)
+	return ok
+}
+
+// AllowStanza implements LimitPolicy.
+func (l *RateLimiter) AllowStanza(ip string, from jid.JID, size int64) bool {
+	from = from.Bare()
+	account := from.String()
+	var events []LimitEvent
+	l.mu.Lock()
+	ok := l.take(limitKey{LimitStanzas, true, ip}, l.limits.StanzasPerIP, 1, LimitEvent{Kind: LimitStanzas, IP: ip}, &events)
+	ok = l.take(limitKey{LimitBytes, true, ip}, l.limits.BytesPerIP, float64(size), LimitEvent{Kind: LimitBytes, IP: ip}, &events) && ok
+	if !from.IsZero() {
+		ok = l.take(limitKey{LimitStanzas, false, account}, l.limits.StanzasPerJID, 1, LimitEvent{Kind: LimitStanzas, IP: ip, JID: from}, &events) && ok
+		ok = l.take(limitKey{LimitBytes, false, account}, l.limits.BytesPerJID, float64(size), LimitEvent{Kind: LimitBytes, IP: ip, JID: from}, &events) && ok
+	}
+	callbacks := l.onLimit
+	l.mu.Unlock()
+	notifyLimits(callbacks, events)
+	return ok
+}
+
+// take takes n tokens from the bucket of key. ev is added to events when
+// the bucket starts refusing.
+func (l *RateLimiter) take(key limitKey, limit RateLimit, n float64, ev LimitEvent, events *[]LimitEvent) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	now := l.clock.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		b = newTokenBucket(limit, now)
+		l.buckets[key] = b
+	}
+	wasLimited := b.limited
+	if b.take(limit, n, now) {
+		return true
+	}
+	if !wasLimited {
+		*events = append(*events, ev)
+	}
+	return false
+}
+
+// prune forgets, every pruneEvery new peers, the buckets that have refilled
+// and the authentication failures that are no longer remembered.
+func (l *RateLimiter) prune(now time.Time) {
+	if l.ops++; l.ops < pruneEvery {
+		return
+	}
+	l.ops = 0
+	for key, b := range l.buckets {
+		if b.full(l.limit(key.kind, key.ip), now) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, f := range l.auth {
+		if now.Sub(f.last) > authForget && now.Sub(f.until) > authForget {
+			delete(l.auth, key)
+		}
+	}
+}
+
+func (l *RateLimiter) limit(kind LimitKind, ip bool) RateLimit {
+	switch {
+	case kind == LimitConnections:
+		return l.limits.ConnectionsPerIP
+	case kind == LimitStanzas && ip:
+		return l.limits.StanzasPerIP
+	case kind == LimitStanzas:
+		return l.limits.StanzasPerJID
+	case kind == LimitBytes && ip:
+		return l.limits.BytesPerIP
+	default:
+		return l.limits.BytesPerJID
+	}
+}
+
+// AuthLockout implements LimitPolicy.
+func (l *RateLimiter) AuthLockout(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	var d time.Duration
+	for _, key := range authKeys(ip, username) {
+		if f, ok := l.auth[key]; ok {
+			d = max(d, f.until.Sub(now))
+		}
+	}
+	return d
+}
+
+// AuthResult implements LimitPolicy. A success clears the failures of
+// username, but not those of ip, so that an account of its own does not
+// help an attacker guess the passwords of others.
+func (l *RateLimiter) AuthResult(ip, username string, ok bool) {
+	if l.limits.AuthFailures <= 0 || l.limits.AuthLockout <= 0 {
+		return
+	}
+	keys := authKeys(ip, username)
+	var events []LimitEvent
+	l.mu.Lock()
+	if ok {
+		if len(keys) > 1 {
+			delete(l.auth, keys[1])
+		}
+		l.mu.Unlock()
+		return
+	}
+	now := l.clock.Now()
+	for i, key := range keys {
+		f, found := l.auth[key]
+		if !found || (now.Sub(f.last) > authForget && now.Sub(f.until) > authForget) {
+			l.prune(now)
+			f = &authFailures{}
+			l.auth[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count < l.limits.AuthFailures {
+			continue
+		}
+		lockout := l.lockout(f.count - l.limits.AuthFailures)
+		f.until = now.Add(lockout)
+		ev := LimitEvent{Kind: LimitAuth, IP: ip, Lockout: lockout}
+		if i > 0 {
+			ev.Username = username
+		}
+		events = append(events, ev)
+	}
+	callbacks := l.onLimit
+	l.mu.Unlock()
+	notifyLimits(callbacks, events)
+}
+
+// lockout returns the lockout after the given number of failures beyond
+// the first lockout.
+func (l *RateLimiter) lockout(extra int) time.Duration {
+	d := l.limits.AuthLockout
+	for range extra {
+		if l.limits.MaxAuthLockout > 0 && d >= l.limits.MaxAuthLockout || d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if l.limits.MaxAuthLockout > 0 {
+		d = min(d, l.limits.MaxAuthLockout)
+	}
+	return d
+}
+
+// authKeys returns the keys under which the failures of ip and username
+// are counted.
+func authKeys(ip, username string) []string {
+	keys := []string{"ip " + ip}
+	if username != "" {
+		keys = append(keys, "user "+strings.ToLower(username))
+	}
+	return keys
+}
+
+func notifyLimits(callbacks []func(LimitEvent), events []LimitEvent) {
+	for _, ev := range events {
+		for _, f := range callbacks {
+			f(ev)
+		}
+	}
+}
+
+// PeerIP returns the IP address the session's peer connected from, or ""
+// if the transport does not know it.
+func (s *Session) PeerIP() string {
+	if s.trans == nil {
+		return ""
+	}
+	return remoteIP(s.trans.Peer())
+}
+
+// AllowStanza reports whether st, just read from the stream, is within the
+// policy set with WithLimitPolicy, charging it the bytes read since the
+// previous stanza. When it is not, a request is answered with a
+// resource-constraint error, so that the peer does not wait for it, and
+// other stanzas are to be dropped. Serve calls AllowStanza for every
+// stanza it reads; servers that read the stream themselves call it before
+// handling one.
+func (s *Session) AllowStanza(ctx context.Context, st stanza.Stanza) (bool, error) {
+	size := s.wire.read.Swap(0)
+	if s.limits == nil || s.limits.AllowStanza(s.PeerIP(), s.RemoteAddr().Bare(), size) {
+		return true, nil
+	}
+	if iq, ok := st.(*stanza.IQ); ok && (iq.Type == stanza.IQGet || iq.Type == stanza.IQSet) {
+		return false, s.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeWait, stanza.ErrorResourceConstraint, "")))
+	}
+	return false, nil
+}
+
+// AuthLockout returns how long the policy set with WithLimitPolicy refuses
+// authentication from the session's peer, or for username unless it is "",
+// or zero. A server checks it before authenticating, and refuses even valid
+// credentials while it is not zero.
+func (s *Session) AuthLockout(username string) time.Duration {
+	if s.limits == nil {
+		return 0
+	}
+	return s.limits.AuthLockout(s.PeerIP(), username)
+}
+
+// AuthResult records an authentication attempt of the session's peer for
+// username with the policy set with WithLimitPolicy. Only attempts that
+// failed because of the credentials are to be recorded as failures.
+func (s *Session) AuthResult(username string, ok bool) {
+	if s.limits != nil {
+		s.limits.AuthResult(s.PeerIP(), username, ok)
+	}
+}
@@ -0,0 +1,136 @@
+package xmpp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	l := NewRateLimiter(RateLimits{
+		StanzasPerJID:    RateLimit{Rate: 1, Burst: 2},
+		BytesPerIP:       RateLimit{Rate: 100},
+		ConnectionsPerIP: RateLimit{Rate: 0.5},
+	}, clk)
+	var events []LimitEvent
+	l.OnLimit(func(ev LimitEvent) { events = append(events, ev) })
+
+	alice := jid.MustParse("alice@example.com/phone")
+	for i, want := range []bool{true, true, false, false} {
+		if got := l.AllowStanza("10.0.0.1", alice, 10); got != want {
+			t.Fatalf("stanza %d allowed %v", i, got)
+		}
+	}
+	// Another account has a bucket of its own, and the IP has no stanza
+	// limit.
+	if !l.AllowStanza("10.0.0.1", jid.MustParse("bob@example.com"), 10) {
+		t.Fatal("stanza of another account refused")
+	}
+	if len(events) != 1 || events[0].Kind != LimitStanzas || events[0].JID.String() != "alice@example.com" {
+		t.Fatalf("events %+v", events)
+	}
+	clk.Advance(time.Second)
+	if !l.AllowStanza("10.0.0.1", alice, 10) {
+		t.Fatal("stanza refused after refill")
+	}
+
+	// A stanza larger than the burst passes a full bucket and leaves it in
+	// debt.
+	if !l.AllowStanza("10.0.0.2", jid.JID{}, 250) || l.AllowStanza("10.0.0.2", jid.JID{}, 1) {
+		t.Fatal("bytes limit not enforced")
+	}
+	if ev := events[len(events)-1]; ev.Kind != LimitBytes || ev.IP != "10.0.0.2" || ev.Kind.String() != "bytes" {
+		t.Fatalf("event %+v", ev)
+	}
+
+	if !l.AllowConnection("10.0.0.3") || l.AllowConnection("10.0.0.3") {
+		t.Fatal("connection limit not enforced")
+	}
+	clk.Advance(2 * time.Second)
+	if !l.AllowConnection("10.0.0.3") {
+		t.Fatal("connection refused after refill")
+	}
+}
+
+func TestRateLimiterAuthLockout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	l := NewRateLimiter(RateLimits{AuthFailures: 2, AuthLockout: time.Minute, MaxAuthLockout: 3 * time.Minute}, clk)
+	var events []LimitEvent
+	l.OnLimit(func(ev LimitEvent) { events = append(events, ev) })
+
+	l.AuthResult("10.0.0.1", "alice", false)
+	if d := l.AuthLockout("10.0.0.1", "alice"); d != 0 {
+		t.Fatalf("locked out for %v after one failure", d)
+	}
+	l.AuthResult("10.0.0.2", "Alice", false)
+	if d := l.AuthLockout("10.0.0.3", "alice"); d != time.Minute {
+		t.Fatalf("username locked out for %v", d)
+	}
+	if d := l.AuthLockout("10.0.0.1", ""); d != 0 {
+		t.Fatalf("address locked out for %v", d)
+	}
+	if len(events) != 1 || events[0].Kind != LimitAuth || events[0].Username != "Alice" || events[0].Lockout != time.Minute {
+		t.Fatalf("events %+v", events)
+	}
+
+	// Every further failure doubles the lockout, up to the maximum.
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		l.AuthResult("10.0.0.4", "alice", false)
+		if d := l.AuthLockout("", "alice"); d != want {
+			t.Fatalf("locked out for %v, want %v", d, want)
+		}
+	}
+
+	// A success clears the username but not the address.
+	l.AuthResult("10.0.0.4", "alice", true)
+	if d := l.AuthLockout("", "alice"); d != 0 {
+		t.Fatalf("username locked out for %v after a success", d)
+	}
+	l.AuthResult("10.0.0.4", "bob", false)
+	if d := l.AuthLockout("10.0.0.4", ""); d != 3*time.Minute {
+		t.Fatalf("address locked out for %v", d)
+	}
+	clk.Advance(3 * time.Minute)
+	if d := l.AuthLockout("10.0.0.4", "bob"); d != 0 {
+		t.Fatalf("locked out for %v after the lockout", d)
+	}
+}
+
+func TestSessionLimitPolicy(t *testing.T) {
+	t.Parallel()
+	l := NewRateLimiter(RateLimits{StanzasPerIP: RateLimit{Rate: 0.001, Burst: 1}}, nil)
+	s, c2 := newTestSession(t, WithLimitPolicy(l))
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	handled := make(chan stanza.Stanza, 4)
+	go s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		handled <- st
+		return nil
+	}))
+
+	input := testStreamHeader + `<message id='m1'><body>1</body></message><message id='m2'><body>2</body></message>` +
+		`<iq type='get' id='q1'><ping xmlns='urn:xmpp:ping'/></iq>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	w := nextWrite(t, writes)
+	for !strings.HasSuffix(w, "</iq>") {
+		w += nextWrite(t, writes)
+	}
+	if !strings.Contains(w, `id="q1"`) || !strings.Contains(w, "resource-constraint") {
+		t.Fatalf("refused request answered with %s", w)
+	}
+	if st := <-handled; st.GetHeader().ID != "m1" || len(handled) != 0 {
+		t.Fatalf("handled %s and %d more", st.GetHeader().ID, len(handled))
+	}
+	if d := s.AuthLockout("alice"); d != 0 {
+		t.Fatalf("locked out for %v", d)
+	}
+}
@@ -0,0 +1,193 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// errConnectionLost is the cause reported when a stream ends without an
+// error of its own.
+var errConnectionLost = errors.New("xmpp: connection lost")
+
+// ErrCannotReauthenticate is why a client without WithSASL2 gives up on
+// reconnecting after losing an authenticated stream: it can neither
+// authenticate nor bind a new one, so the stream would come back without
+// the account and the state set on it.
+var ErrCannotReauthenticate = errors.New("xmpp: cannot authenticate a new stream without SASL2")
+
+// Backoff spaces out the attempts of a client reconnecting with
+// WithReconnect. The first attempt is made right away; after each failure
+// the client waits Initial, then Multiplier times longer, up to Max.
+type Backoff struct {
+	// Initial is the delay after the first failed attempt. Zero means one
+	// second.
+	Initial time.Duration
+	// Max caps the delay between attempts. Zero means five minutes.
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt. Values below 1
+	// mean 2.
+	Multiplier float64
+	// Jitter moves each delay by a random amount of up to this fraction of
+	// it, in either direction, so that clients dropped by the same server
+	// restart do not all come back at once. Zero disables it.
+	Jitter float64
+	// MaxAttempts is the number of attempts after which the client gives
+	// up. Zero keeps trying until the client is closed.
+	MaxAttempts int
+}
+
+// DefaultBackoff retries after one second, doubling up to five minutes,
+// with 20% jitter and no limit on the number of attempts.
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// delay returns how long to wait after failures failed attempts. r is a
+// random number in [0, 1) that places the jitter.
+func (b Backoff) delay(failures int, r float64) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	initial, limit, mult := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if limit <= 0 {
+		limit = 5 * time.Minute
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(initial)
+	for i := 1; i < failures && d < float64(limit); i++ {
+		d *= mult
+	}
+	d = min(d, float64(limit))
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*r - 1)
+	}
+	return time.Duration(max(d, 0))
+}
+
+// OnReconnecting registers a callback invoked before each reconnection
+// attempt with its number, starting at 1, the delay the client waits before
+// making it and the error that caused it: why the connection was lost for
+// the first attempt and why the previous attempt failed after that.
+func (c *Client) OnReconnecting(f func(attempt int, delay time.Duration, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReconnecting = f
+}
+
+// OnReconnected registers a callback invoked once a reconnection attempt,
+// numbered as for OnReconnecting, has succeeded. The new session is then
+// available through Session.
+func (c *Client) OnReconnected(f func(attempt int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReconnected = f
+}
+
+// reconnect re-establishes the connection lost with s, first to host if it
+// is set, unless the client was closed or has reconnected in the meantime.
+// Without WithReconnect a single attempt is made; with it the client keeps
+// trying as its Backoff allows. An authenticated stream is only
+// re-established with WithSASL2, which authenticates the new one.
+func (c *Client) reconnect(s *Session, host string, cause error) {
+	if c.opts.sasl2 == nil && s.State()&StateAuthenticated != 0 {
+		loggerOr(c.opts.logger).Log(context.Background(), slog.LevelError, "xmpp: giving up reconnecting", "error", ErrCannotReauthenticate, "cause", cause)
+		return
+	}
+	c.mu.Lock()
+	if c.closed || c.session != nil || c.reconnecting {
+		c.mu.Unlock()
+		return
+	}
+	c.reconnecting = true
+	c.redirect = host
+	done := c.done
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+	}()
+
+	b := c.opts.backoff
+	if b == nil {
+		b = &Backoff{MaxAttempts: 1}
+	}
+	for attempt := 1; b.MaxAttempts <= 0 || attempt <= b.MaxAttempts; attempt++ {
+		delay := b.delay(attempt-1, rand.Float64())
+
+		c.mu.Lock()
+		f := c.onReconnecting
+		c.mu.Unlock()
+		if f != nil {
+			f(attempt, delay, cause)
+		}
+		if !sleep(done, delay) {
+			return
+		}
+
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		if cause = c.Connect(context.Background()); cause == nil {
+			c.mu.Lock()
+			f := c.onReconnected
+			c.mu.Unlock()
+			if f != nil {
+				f(attempt)
+			}
+			return
+		}
+	}
+	loggerOr(c.opts.logger).Log(context.Background(), slog.LevelError, "xmpp: giving up reconnecting", "error", cause)
+}
+
+// sleep waits for d and reports whether it did so before done was closed.
+func sleep(done <-chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-done:
+			return false
+		default:
+			return true
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// transientStreamError reports whether a stream error only reflects the
+// server's state at the time, so that a client set up with WithReconnect
+// may try again. Errors about the client itself, such as conflict or
+// not-authorized, would only repeat.
+func transientStreamError(se *stream.Error) bool {
+	switch se.Condition {
+	case stream.ErrConnectionTimeout, stream.ErrInternalServerError,
+		stream.ErrRemoteConnectionFailed, stream.ErrReset,
+		stream.ErrResourceConstraint:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,313 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	t.Parallel()
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 3}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 3 * time.Second},
+		{3, 9 * time.Second},
+		{4, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := b.delay(tt.failures, 0.5); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	if got := (Backoff{}).delay(2, 0); got != 2*time.Second {
+		t.Errorf("zero Backoff delay(2) = %v, want 2s", got)
+	}
+
+	j := Backoff{Initial: time.Second, Jitter: 0.5}
+	if lo, hi := j.delay(1, 0), j.delay(1, 0.999999); lo != 500*time.Millisecond || hi < 1499*time.Millisecond || hi > 1500*time.Millisecond {
+		t.Errorf("jittered delays %v..%v, want 500ms..1.5s", lo, hi)
+	}
+}
+
+// flakyDialer hands out pipes, failing the dials numbered in fail (counting
+// from 1). The server ends of the pipes are sent on conns.
+type flakyDialer struct {
+	mu    sync.Mutex
+	n     int
+	fail  func(n int) bool
+	conns chan net.Conn
+}
+
+func (d *flakyDialer) dial(_ context.Context, _, _ string) (net.Conn, error) {
+	d.mu.Lock()
+	d.n++
+	n := d.n
+	d.mu.Unlock()
+	if d.fail(n) {
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	d.conns <- c2
+	return c1, nil
+}
+
+func newReconnectClient(t *testing.T, d *flakyDialer, b Backoff) *Client {
+	t.Helper()
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(d.dial),
+		WithReconnect(b),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientReconnectsWithBackoff(t *testing.T) {
+	t.Parallel()
+	d := &flakyDialer{fail: func(n int) bool { return n == 2 || n == 3 }, conns: make(chan net.Conn, 4)}
+	c := newReconnectClient(t, d, Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond})
+	defer c.Close()
+
+	type attempt struct {
+		n     int
+		delay time.Duration
+		err   error
+	}
+	var attempts []attempt
+	reconnected := make(chan int, 1)
+	c.OnReconnecting(func(n int, delay time.Duration, err error) {
+		attempts = append(attempts, attempt{n, delay, err})
+	})
+	c.OnReconnected(func(n int) { reconnected <- n })
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	first := <-d.conns
+	first.Close()
+
+	select {
+	case n := <-reconnected:
+		if n != 3 {
+			t.Errorf("reconnected on attempt %d, want 3", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	second := <-d.conns
+	defer second.Close()
+
+	if len(attempts) != 3 {
+		t.Fatalf("attempts = %+v", attempts)
+	}
+	if attempts[0].delay != 0 || attempts[1].delay != time.Millisecond || attempts[2].delay != 2*time.Millisecond {
+		t.Errorf("delays = %v, %v, %v", attempts[0].delay, attempts[1].delay, attempts[2].delay)
+	}
+	if !errors.Is(attempts[0].err, errConnectionLost) {
+		t.Errorf("first cause = %v", attempts[0].err)
+	}
+	if attempts[1].err == nil || !strings.Contains(attempts[1].err.Error(), "connection refused") {
+		t.Errorf("second cause = %v", attempts[1].err)
+	}
+	if c.Session() == nil {
+		t.Error("no session after reconnecting")
+	}
+}
+
+func TestClientReconnectGivesUp(t *testing.T) {
+	t.Parallel()
+	d := &flakyDialer{fail: func(n int) bool { return n > 1 }, conns: make(chan net.Conn, 1)}
+	c := newReconnectClient(t, d, Backoff{Initial: time.Millisecond, MaxAttempts: 2})
+	defer c.Close()
+
+	attempts := make(chan int, 3)
+	c.OnReconnecting(func(n int, _ time.Duration, _ error) { attempts <- n })
+	c.OnReconnected(func(int) { t.Error("reconnected") })
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	(<-d.conns).Close()
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case n := <-attempts:
+			if n != want {
+				t.Fatalf("attempt %d, want %d", n, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("attempt %d not made", want)
+		}
+	}
+	select {
+	case n := <-attempts:
+		t.Fatalf("attempt %d beyond MaxAttempts", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if c.Session() != nil {
+		t.Error("session set after giving up")
+	}
+}
+
+func TestClientCloseStopsReconnecting(t *testing.T) {
+	t.Parallel()
+	d := &flakyDialer{fail: func(n int) bool { return n > 1 }, conns: make(chan net.Conn, 1)}
+	c := newReconnectClient(t, d, Backoff{Initial: time.Hour})
+
+	waiting := make(chan struct{}, 1)
+	c.OnReconnecting(func(n int, _ time.Duration, _ error) {
+		if n == 2 {
+			waiting <- struct{}{}
+		}
+	})
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	(<-d.conns).Close()
+	select {
+	case <-waiting:
+	case <-time.After(2 * time.Second):
+		t.Fatal("second attempt not scheduled")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Close ends the wait and nothing is dialed afterwards.
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		busy := c.reconnecting
+		c.mu.Unlock()
+		if !busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reconnect loop still running after Close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.n != 2 {
+		t.Errorf("dialed %d times, want 2", d.n)
+	}
+}
+
+func TestClientReconnectWithoutSASL2(t *testing.T) {
+	t.Parallel()
+	var logs syncBuffer
+	d := &flakyDialer{fail: func(int) bool { return false }, conns: make(chan net.Conn, 2)}
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(d.dial),
+		WithReconnect(Backoff{Initial: time.Millisecond}),
+		WithClientLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.OnReconnecting(func(n int, _ time.Duration, _ error) { t.Errorf("reconnect attempt %d", n) })
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	// The application authenticated the stream itself, which the client
+	// cannot repeat on a new one.
+	c.Session().SetState(StateAuthenticated | StateBound)
+	(<-d.conns).Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), ErrCannotReauthenticate.Error()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no give-up logged: %s", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Session() != nil {
+		t.Error("session set after giving up")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.n != 1 {
+		t.Errorf("dialed %d times, want 1", d.n)
+	}
+}
+
+func TestTransientStreamError(t *testing.T) {
+	t.Parallel()
+	for cond, want := range map[string]bool{
+		stream.ErrConnectionTimeout:   true,
+		stream.ErrInternalServerError: true,
+		stream.ErrReset:               true,
+		stream.ErrConflict:            false,
+		stream.ErrNotAuthorized:       false,
+		stream.ErrPolicyViolation:     false,
+	} {
+		if got := transientStreamError(stream.NewError(cond, "")); got != want {
+			t.Errorf("transientStreamError(%s) = %v", cond, got)
+		}
+	}
+}
+
+func TestClientResendsCarbons(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	c := &Client{carbons: true}
+
+	// Nothing goes out before authentication, so the pipe never blocks.
+	c.resendCarbons(s)
+
+	s.SetState(StateAuthenticated)
+	go c.resendCarbons(s)
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatalf("pipe Read: %v", err)
+	}
+	if got := string(buf[:n]); !strings.Contains(got, "<enable") || !strings.Contains(got, "urn:xmpp:carbons:2") {
+		t.Fatalf("unexpected carbons request: %s", got)
+	}
+
+	// Bind2 already enabled them on this stream.
+	s.ApplyInlineFeatures(sasl2.InlineFeatures{JID: jid.MustParse("user@example.com/res"), CarbonsEnabled: true})
+	c.resendCarbons(s)
+}
+
+func TestClientCarbonsStateBeforeConnect(t *testing.T) {
+	t.Parallel()
+	c := &Client{}
+	if err := c.EnableCarbons(context.Background()); err != nil {
+		t.Fatalf("EnableCarbons: %v", err)
+	}
+	if !c.CarbonsEnabled() {
+		t.Error("CarbonsEnabled() = false after EnableCarbons")
+	}
+	if err := c.DisableCarbons(context.Background()); err != nil {
+		t.Fatalf("DisableCarbons: %v", err)
+	}
+	if c.CarbonsEnabled() {
+		t.Error("CarbonsEnabled() = true after DisableCarbons")
+	}
+}
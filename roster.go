@@ -0,0 +1,282 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// rosterCache is the client's copy of the account's roster, filled by
+// FetchRoster or LoadRoster and kept current by the server's roster
+// pushes. It outlives sessions, so a reconnect only fetches the changes.
+type rosterCache struct {
+	mu       sync.RWMutex
+	loaded   bool // roster pushes are handled once a roster is loaded
+	ver      string
+	items    map[string]roster.Item
+	onChange []func(context.Context, roster.Item)
+}
+
+// LoadRoster fills the roster cache with items at version ver, a roster
+// the application kept from an earlier session. A server that supports
+// roster versioning then sends FetchRoster only the changes since.
+func (c *Client) LoadRoster(ver string, items []roster.Item) {
+	c.roster.mu.Lock()
+	defer c.roster.mu.Unlock()
+	c.roster.items = make(map[string]roster.Item, len(items))
+	for _, item := range items {
+		c.roster.items[item.JID] = item
+	}
+	c.roster.ver = ver
+	c.roster.loaded = true
+}
+
+// FetchRoster requests the roster from the server and returns it. With a
+// roster in the cache and a server that supports roster versioning, only
+// the changes since are sent, as roster pushes. Items that differ from the
+// cache are passed to the OnRosterChange callbacks. Once a roster is
+// fetched, the client answers the server's roster pushes itself and keeps
+// the cache current.
+func (c *Client) FetchRoster(ctx context.Context) ([]roster.Item, error) {
+	s := c.Session()
+	if s == nil {
+		return nil, ErrNotConnected
+	}
+	var q roster.Query
+	if s.HasStreamFeature(roster.VersioningFeature) {
+		c.roster.mu.RLock()
+		q.Ver = c.roster.ver
+		c.roster.mu.RUnlock()
+	}
+	payload, err := xml.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.Query = payload
+	reply, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty result means the cached version is current.
+	if len(bytes.TrimSpace(reply.Query)) == 0 {
+		c.roster.mu.Lock()
+		c.roster.loaded = true
+		c.roster.mu.Unlock()
+		return c.Roster(), nil
+	}
+	var result roster.Query
+	if err := xml.Unmarshal(reply.Query, &result); err != nil {
+		return nil, err
+	}
+	c.roster.mu.Lock()
+	old := c.roster.items
+	c.roster.items = make(map[string]roster.Item, len(result.Items))
+	var changed []roster.Item
+	for _, item := range result.Items {
+		c.roster.items[item.JID] = item
+		if prev, ok := old[item.JID]; !ok || !sameItem(prev, item) {
+			changed = append(changed, item)
+		}
+	}
+	for contact, prev := range old {
+		if _, ok := c.roster.items[contact]; !ok {
+			prev.Subscription = roster.SubRemove
+			changed = append(changed, prev)
+		}
+	}
+	c.roster.ver = result.Ver
+	c.roster.loaded = true
+	callbacks := c.roster.onChange
+	c.roster.mu.Unlock()
+	notifyRoster(ctx, callbacks, changed)
+	return c.Roster(), nil
+}
+
+// Roster returns the cached roster, sorted by JID.
+func (c *Client) Roster() []roster.Item {
+	c.roster.mu.RLock()
+	defer c.roster.mu.RUnlock()
+	items := slices.Collect(maps.Values(c.roster.items))
+	slices.SortFunc(items, func(a, b roster.Item) int { return strings.Compare(a.JID, b.JID) })
+	return items
+}
+
+// RosterVersion returns the version of the cached roster, which the
+// application stores with the roster to pass to LoadRoster later.
+func (c *Client) RosterVersion() string {
+	c.roster.mu.RLock()
+	defer c.roster.mu.RUnlock()
+	return c.roster.ver
+}
+
+// Contact returns the cached roster item of contact.
+func (c *Client) Contact(contact jid.JID) (roster.Item, bool) {
+	c.roster.mu.RLock()
+	defer c.roster.mu.RUnlock()
+	item, ok := c.roster.items[contact.Bare().String()]
+	return item, ok
+}
+
+// RosterGroups returns the groups of the cached roster, sorted.
+func (c *Client) RosterGroups() []string {
+	c.roster.mu.RLock()
+	defer c.roster.mu.RUnlock()
+	var groups []string
+	for _, item := range c.roster.items {
+		for _, g := range item.Groups {
+			if !slices.Contains(groups, g) {
+				groups = append(groups, g)
+			}
+		}
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+// OnRosterChange registers f for changes to the cached roster, whether
+// fetched or pushed by the server. A removed contact has the subscription
+// roster.SubRemove.
+func (c *Client) OnRosterChange(f func(ctx context.Context, item roster.Item)) {
+	c.roster.mu.Lock()
+	defer c.roster.mu.Unlock()
+	c.roster.onChange = append(c.roster.onChange, f)
+}
+
+// AddContact adds contact to the roster with a name and groups, and asks
+// to subscribe to its presence.
+func (c *Client) AddContact(ctx context.Context, contact jid.JID, name string, groups ...string) error {
+	contact = contact.Bare()
+	if err := c.setRosterItem(ctx, roster.Item{JID: contact.String(), Name: name, Groups: groups}); err != nil {
+		return err
+	}
+	pres := stanza.NewPresence(stanza.PresenceSubscribe)
+	pres.To = contact
+	return c.Send(ctx, pres)
+}
+
+// RemoveContact removes contact from the roster. The server cancels the
+// presence subscriptions in both directions.
+func (c *Client) RemoveContact(ctx context.Context, contact jid.JID) error {
+	return c.setRosterItem(ctx, roster.Item{JID: contact.Bare().String(), Subscription: roster.SubRemove})
+}
+
+// RenameContact changes the name of contact, keeping its groups.
+func (c *Client) RenameContact(ctx context.Context, contact jid.JID, name string) error {
+	item := c.contactItem(contact)
+	item.Name = name
+	return c.setRosterItem(ctx, item)
+}
+
+// SetContactGroups replaces the groups of contact, keeping its name.
+func (c *Client) SetContactGroups(ctx context.Context, contact jid.JID, groups ...string) error {
+	item := c.contactItem(contact)
+	item.Groups = groups
+	return c.setRosterItem(ctx, item)
+}
+
+// MoveContact moves contact from group from to group to, leaving its
+// other groups alone. A contact that is not in from is added to to.
+func (c *Client) MoveContact(ctx context.Context, contact jid.JID, from, to string) error {
+	item := c.contactItem(contact)
+	groups := slices.DeleteFunc(slices.Clone(item.Groups), func(g string) bool { return g == from || g == to })
+	item.Groups = append(groups, to)
+	return c.setRosterItem(ctx, item)
+}
+
+// contactItem returns the cached item of contact, or a new one.
+func (c *Client) contactItem(contact jid.JID) roster.Item {
+	item, ok := c.Contact(contact)
+	if !ok {
+		item = roster.Item{JID: contact.Bare().String()}
+	}
+	return item
+}
+
+// setRosterItem asks the server to add, change or remove item. The cache
+// is updated by the roster push that follows.
+func (c *Client) setRosterItem(ctx context.Context, item roster.Item) error {
+	s := c.Session()
+	if s == nil {
+		return ErrNotConnected
+	}
+	// Clients only set the subscription to remove it, and never ask.
+	if item.Subscription != roster.SubRemove {
+		item.Subscription = ""
+	}
+	item.Ask = ""
+	payload, err := xml.Marshal(roster.Query{Items: []roster.Item{item}})
+	if err != nil {
+		return err
+	}
+	iq := stanza.NewIQ(stanza.IQSet)
+	iq.Query = payload
+	_, err = s.SendIQ(ctx, iq)
+	return err
+}
+
+// rosterPushes returns a handler that applies the roster pushes of the
+// server to the cache once a roster is loaded, and passes other stanzas to
+// next. Before, pushes go to next like any other request.
+func (c *Client) rosterPushes(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		iq, ok := st.(*stanza.IQ)
+		c.roster.mu.RLock()
+		loaded := c.roster.loaded
+		c.roster.mu.RUnlock()
+		if !ok || !loaded || iq.Type != stanza.IQSet || payloadName(iq.Query) != (xml.Name{Space: ns.Roster, Local: "query"}) {
+			if next == nil {
+				return nil
+			}
+			return next.HandleStanza(ctx, s, st)
+		}
+		// Only the account's server may push roster changes (RFC 6121
+		// §2.1.6).
+		if !iq.From.IsZero() && !iq.From.Equal(s.LocalAddr().Bare()) {
+			return s.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeCancel, stanza.ErrorServiceUnavailable, "")))
+		}
+		var q roster.Query
+		if err := xml.Unmarshal(iq.Query, &q); err != nil || len(q.Items) != 1 {
+			return s.Send(ctx, iq.ErrorIQ(stanza.NewStanzaError(stanza.ErrorTypeModify, stanza.ErrorBadRequest, "")))
+		}
+		item := q.Items[0]
+		c.roster.mu.Lock()
+		if c.roster.items == nil {
+			c.roster.items = make(map[string]roster.Item)
+		}
+		if item.Subscription == roster.SubRemove {
+			delete(c.roster.items, item.JID)
+		} else {
+			c.roster.items[item.JID] = item
+		}
+		if q.Ver != "" {
+			c.roster.ver = q.Ver
+		}
+		callbacks := c.roster.onChange
+		c.roster.mu.Unlock()
+		notifyRoster(ctx, callbacks, []roster.Item{item})
+		return s.Send(ctx, iq.ResultIQ())
+	})
+}
+
+func notifyRoster(ctx context.Context, callbacks []func(context.Context, roster.Item), items []roster.Item) {
+	for _, item := range items {
+		for _, f := range callbacks {
+			f(ctx, item)
+		}
+	}
+}
+
+func sameItem(a, b roster.Item) bool {
+	return a.Name == b.Name && a.Subscription == b.Subscription && a.Ask == b.Ask && slices.Equal(a.Groups, b.Groups)
+}
@@ -0,0 +1,149 @@
+package xmpp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/roster"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestClientRoster(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+	changes := make(chan roster.Item, 8)
+	c.OnRosterChange(func(_ context.Context, item roster.Item) { changes <- item })
+	go c.serve(s)
+	if _, err := c2.Write([]byte(testStreamHeader)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.FetchRoster(ctx)
+		done <- err
+	}()
+	w := nextWrite(t, writes)
+	id := idAttr.FindStringSubmatch(w)
+	if id == nil || !strings.Contains(w, `type="get"`) || !strings.Contains(w, "jabber:iq:roster") || strings.Contains(w, "ver=") {
+		t.Fatalf("roster request %s", w)
+	}
+	reply := `<iq type='result' id='` + id[1] + `'><query xmlns='jabber:iq:roster' ver='v1'>` +
+		`<item jid='romeo@example.net' name='Romeo' subscription='both'><group>Friends</group></item>` +
+		`<item jid='mercutio@example.com' subscription='from'/>` +
+		`</query></iq>`
+	if _, err := c2.Write([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FetchRoster: %v", err)
+	}
+	if items := c.Roster(); len(items) != 2 || items[0].JID != "mercutio@example.com" || c.RosterVersion() != "v1" {
+		t.Fatalf("roster %+v at %q", items, c.RosterVersion())
+	}
+	<-changes
+	<-changes
+
+	// Moving a contact keeps its name and other groups.
+	go func() { done <- c.MoveContact(ctx, jid.MustParse("romeo@example.net"), "Friends", "Lovers") }()
+	w = nextWrite(t, writes)
+	id = idAttr.FindStringSubmatch(w)
+	if !strings.Contains(w, `name="Romeo"`) || !strings.Contains(w, "<group>Lovers</group>") || strings.Contains(w, "Friends") || strings.Contains(w, "subscription") {
+		t.Fatalf("move %s", w)
+	}
+	push := `<iq type='set' id='push1'><query xmlns='jabber:iq:roster' ver='v2'>` +
+		`<item jid='romeo@example.net' name='Romeo' subscription='both'><group>Lovers</group></item></query></iq>`
+	if _, err := c2.Write([]byte(push + `<iq type='result' id='` + id[1] + `'/>`)); err != nil {
+		t.Fatal(err)
+	}
+	if w := nextWrite(t, writes); !strings.Contains(w, `id="push1"`) || !strings.Contains(w, `type="result"`) {
+		t.Fatalf("push answer %s", w)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("MoveContact: %v", err)
+	}
+	if item := <-changes; item.JID != "romeo@example.net" || item.Groups[0] != "Lovers" {
+		t.Fatalf("change %+v", item)
+	}
+	if groups := c.RosterGroups(); len(groups) != 1 || groups[0] != "Lovers" || c.RosterVersion() != "v2" {
+		t.Fatalf("groups %v at %q", groups, c.RosterVersion())
+	}
+
+	// Pushes from anyone but the account are refused.
+	if _, err := c2.Write([]byte(`<iq type='set' id='spoof' from='mallory@evil.example'><query xmlns='jabber:iq:roster'><item jid='mallory@evil.example'/></query></iq>`)); err != nil {
+		t.Fatal(err)
+	}
+	if w := nextWrite(t, writes); !strings.Contains(w, `id="spoof"`) || !strings.Contains(w, `type="error"`) {
+		t.Fatalf("spoofed push answer %s", w)
+	}
+	if _, ok := c.Contact(jid.MustParse("mallory@evil.example")); ok {
+		t.Fatal("spoofed push applied")
+	}
+
+	// Adding a contact subscribes to its presence.
+	go func() { done <- c.AddContact(ctx, jid.MustParse("juliet@example.com/balcony"), "Juliet", "Lovers") }()
+	w = nextWrite(t, writes)
+	id = idAttr.FindStringSubmatch(w)
+	if !strings.Contains(w, `jid="juliet@example.com"`) {
+		t.Fatalf("add %s", w)
+	}
+	if _, err := c2.Write([]byte(`<iq type='result' id='` + id[1] + `'/>`)); err != nil {
+		t.Fatal(err)
+	}
+	if w := nextWrite(t, writes); !strings.Contains(w, "<presence") || !strings.Contains(w, `type="subscribe"`) || !strings.Contains(w, `to="juliet@example.com"`) {
+		t.Fatalf("subscription request %s", w)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("AddContact: %v", err)
+	}
+}
+
+func TestClientRosterVersioning(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+	writes := pipeWrites(c2)
+	c := &Client{session: s}
+	c.LoadRoster("v7", []roster.Item{{JID: "romeo@example.net", Subscription: roster.SubBoth}})
+	ready := make(chan struct{})
+	c.OnMessage(func(context.Context, *stanza.Message) { close(ready) })
+	go c.serve(s)
+	if _, err := c2.Write([]byte(testStreamHeader +
+		`<stream:features><ver xmlns='urn:xmpp:features:rosterver'/></stream:features><message><body>ready</body></message>`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ready:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream features not read")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.FetchRoster(context.Background())
+		done <- err
+	}()
+	w := nextWrite(t, writes)
+	id := idAttr.FindStringSubmatch(w)
+	if id == nil || !strings.Contains(w, `ver="v7"`) {
+		t.Fatalf("roster request %s", w)
+	}
+	if _, err := c2.Write([]byte(`<iq type='result' id='` + id[1] + `'/>`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if items := c.Roster(); len(items) != 1 || items[0].JID != "romeo@example.net" {
+		t.Fatalf("roster after an unchanged version %+v", items)
+	}
+}
@@ -0,0 +1,650 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/dial"
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/dialback"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// DefaultS2SAddr is the address S2S listens on unless S2SConfig.Addr is set.
+const DefaultS2SAddr = ":5269"
+
+// DefaultS2STimeout bounds the negotiation of a server-to-server stream.
+const DefaultS2STimeout = 30 * time.Second
+
+var (
+	// ErrS2SClosed is returned by S2S.Send after Close.
+	ErrS2SClosed = errors.New("xmpp: s2s closed")
+
+	// ErrS2SLocalDomain is returned by S2S.Send for stanzas addressed to the
+	// local domain, which are not routed over server-to-server streams.
+	ErrS2SLocalDomain = errors.New("xmpp: s2s: recipient is local")
+
+	// ErrS2SAuthFailed is returned when the remote server neither accepted
+	// SASL EXTERNAL nor a dialback key.
+	ErrS2SAuthFailed = errors.New("xmpp: s2s: authentication failed")
+
+	// ErrS2SInsecure is returned when the remote server does not offer TLS
+	// and S2SConfig.AllowInsecure is not set.
+	ErrS2SInsecure = errors.New("xmpp: s2s: remote server does not offer TLS")
+)
+
+// S2SConfig configures server-to-server federation.
+type S2SConfig struct {
+	// Addr is the address inbound streams are accepted on; it defaults to
+	// DefaultS2SAddr. Listener, when set, is used instead.
+	Addr     string
+	Listener net.Listener
+
+	// TLSConfig holds the certificate of the local domain, offered to
+	// servers connecting in and presented to servers connected to for SASL
+	// EXTERNAL (XEP-0178). RootCAs verifies the certificates of remote
+	// servers; nil means the system roots.
+	TLSConfig *tls.Config
+
+	// AllowInsecure permits streams without TLS, in both directions. It is
+	// meant for tests and private networks.
+	AllowInsecure bool
+
+	// Secret is the dialback secret (XEP-0185). A random one is generated
+	// when it is empty, which is fine for a single server but not for
+	// several sharing a domain.
+	Secret string
+
+	// Dial connects to the server of a remote domain. It defaults to an
+	// SRV lookup of _xmpp-server._tcp with dial.Dialer.
+	Dial func(ctx context.Context, domain string) (*transport.TCP, error)
+
+	// Handler receives the stanzas remote servers send to the local domain.
+	// Replies must be sent with S2S.Send, since inbound streams only carry
+	// stanzas one way.
+	Handler Handler
+
+	// Timeout bounds the negotiation of a stream, DefaultS2STimeout when
+	// zero.
+	Timeout time.Duration
+
+	// Limits bounds what is read from each inbound and outbound stream.
+	// Server defaults it to the limits set with WithServerStreamLimits.
+	Limits StreamLimits
+
+	// Metrics and Tracer instrument the streams like those of clients.
+	// Server defaults them to those set with WithServerMetrics and
+	// WithServerTracer.
+	Metrics Metrics
+	Tracer  Tracer
+
+	// Logger receives the records of the streams, and StreamDump logs
+	// their XML; see WithLogger and WithStreamDump. Server defaults them
+	// to the settings of WithServerLogger and WithServerStreamDump.
+	Logger     Logger
+	StreamDump bool
+
+	Clock clock.Clock
+}
+
+// S2S connects the local domain to remote XMPP servers. Stanzas for a remote
+// domain are sent with Send over an outbound stream that is dialled on first
+// use and kept for later stanzas; stanzas from remote servers arrive on
+// inbound streams and are passed to S2SConfig.Handler once the sending
+// domain has been authenticated with SASL EXTERNAL or Server Dialback
+// (XEP-0220).
+type S2S struct {
+	domain    jid.JID
+	cfg       S2SConfig
+	secret    string
+	clientTLS func(domain string) *tls.Config
+	serverTLS *tls.Config
+
+	mu       sync.Mutex
+	out      map[string]*s2sLink
+	in       map[*Session]struct{}
+	listener net.Listener
+	closed   bool
+}
+
+// s2sLink is a pooled outbound stream. ready is closed once the stream is
+// negotiated, or err is set.
+type s2sLink struct {
+	ready   chan struct{}
+	session *Session
+	err     error
+}
+
+// NewS2S returns the server-to-server router of domain.
+func NewS2S(domain string, cfg S2SConfig) (*S2S, error) {
+	local, err := jid.New("", domain, "")
+	if err != nil {
+		return nil, err
+	}
+	x := &S2S{
+		domain: local,
+		cfg:    cfg,
+		secret: cfg.Secret,
+		out:    make(map[string]*s2sLink),
+		in:     make(map[*Session]struct{}),
+	}
+	if x.secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		x.secret = hex.EncodeToString(b)
+	}
+	if x.cfg.Dial == nil {
+		x.cfg.Dial = dial.NewDialer().DialServer
+	}
+	if x.cfg.Timeout <= 0 {
+		x.cfg.Timeout = DefaultS2STimeout
+	}
+	x.cfg.Clock = clock.Or(x.cfg.Clock)
+	if cfg.TLSConfig != nil {
+		x.serverTLS, x.clientTLS = s2sTLSConfigs(cfg.TLSConfig)
+	}
+	return x, nil
+}
+
+// s2sTLSConfigs derives the configs of inbound and outbound streams from
+// the one of the domain.
+func s2sTLSConfigs(base *tls.Config) (server *tls.Config, client func(domain string) *tls.Config) {
+	if len(base.Certificates) > 0 || base.GetCertificate != nil || base.GetConfigForClient != nil {
+		server = base.Clone()
+		// Peers may authenticate with SASL EXTERNAL, for which their
+		// certificate is verified against the domain they claim.
+		if server.ClientAuth == tls.NoClientCert {
+			server.ClientAuth = tls.RequestClientCert
+		}
+	}
+	client = func(domain string) *tls.Config {
+		c := base.Clone()
+		certs, get := c.Certificates, c.GetCertificate
+		// transport.TCP takes a config with a certificate for the server
+		// side, so the certificate is only handed over on request.
+		c.Certificates, c.GetCertificate, c.GetConfigForClient = nil, nil, nil
+		switch {
+		case len(certs) > 0:
+			c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &certs[0], nil
+			}
+		case get != nil:
+			// A certificate that is reloaded at run time is only
+			// available through GetCertificate.
+			c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return get(&tls.ClientHelloInfo{})
+			}
+		}
+		c.ServerName = domain
+		return c
+	}
+	return server, client
+}
+
+// Domain returns the local domain.
+func (x *S2S) Domain() string {
+	return x.domain.Domain()
+}
+
+// Send routes st to the server of its recipient's domain, negotiating a
+// stream first unless one is already open.
+func (x *S2S) Send(ctx context.Context, st stanza.Stanza) error {
+	remote := st.GetHeader().To.Domain()
+	if remote == "" || remote == x.domain.Domain() {
+		return ErrS2SLocalDomain
+	}
+	st = stanza.WithNamespace(st, ns.Server)
+	var err error
+	// A pooled stream may have died since it was last used; a new one is
+	// tried once.
+	for range 2 {
+		var l *s2sLink
+		if l, err = x.link(ctx, remote); err != nil {
+			return err
+		}
+		if err = l.session.Send(ctx, st); err == nil {
+			return nil
+		}
+		x.drop(remote, l)
+	}
+	return err
+}
+
+// link returns the outbound stream to remote, negotiating it if needed.
+func (x *S2S) link(ctx context.Context, remote string) (*s2sLink, error) {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil, ErrS2SClosed
+	}
+	l, ok := x.out[remote]
+	if !ok {
+		l = &s2sLink{ready: make(chan struct{})}
+		x.out[remote] = l
+		go x.establish(remote, l)
+	}
+	x.mu.Unlock()
+
+	select {
+	case <-l.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l, nil
+}
+
+func (x *S2S) establish(remote string, l *s2sLink) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.cfg.Timeout)
+	l.session, l.err = x.connect(ctx, remote)
+	cancel()
+	if l.err != nil {
+		x.drop(remote, l)
+		close(l.ready)
+		return
+	}
+	close(l.ready)
+
+	// Nothing but stream errors and the end of the stream is expected on
+	// an outbound stream.
+	_ = l.session.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error { return nil }))
+	x.drop(remote, l)
+}
+
+// drop removes l from the pool and closes it.
+func (x *S2S) drop(remote string, l *s2sLink) {
+	x.mu.Lock()
+	if x.out[remote] == l {
+		delete(x.out, remote)
+	}
+	x.mu.Unlock()
+	if l.session != nil {
+		_ = l.session.Close()
+	}
+}
+
+// Links returns the remote domains an outbound stream is open or being
+// negotiated to.
+func (x *S2S) Links() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	domains := make([]string, 0, len(x.out))
+	for d := range x.out {
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// connect opens an authenticated stream to remote: TLS when offered, then
+// SASL EXTERNAL when the local certificate is accepted, or dialback.
+func (x *S2S) connect(ctx context.Context, remote string) (*Session, error) {
+	session, err := x.dialStream(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	// A stuck peer must not hold the negotiation past ctx.
+	stop := context.AfterFunc(ctx, func() { _ = session.Transport().Close() })
+	defer stop()
+
+	fail := func(err error) (*Session, error) {
+		_ = session.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("xmpp: s2s to %s: %w", remote, err)
+	}
+	for {
+		info, err := x.openStream(session, remote)
+		if err != nil {
+			return fail(err)
+		}
+		if session.State()&StateAuthenticated != 0 {
+			session.SetState(StateReady)
+			return session, nil
+		}
+		if session.State()&StateSecure == 0 {
+			if info.startTLS && x.clientTLS != nil {
+				if err := x.startTLS(session, remote); err != nil {
+					return fail(err)
+				}
+				continue
+			}
+			if !x.cfg.AllowInsecure {
+				return fail(ErrS2SInsecure)
+			}
+		}
+		if session.State()&StateSecure != 0 && info.external && x.hasCertificate() {
+			ok, err := x.external(session)
+			if err != nil {
+				return fail(err)
+			}
+			if ok {
+				session.SetState(StateAuthenticated)
+				continue
+			}
+		}
+		if !info.dialback {
+			return fail(ErrS2SAuthFailed)
+		}
+		if err := x.dialback(session, remote, info.id); err != nil {
+			return fail(err)
+		}
+		session.SetState(StateAuthenticated | StateReady)
+		return session, nil
+	}
+}
+
+func (x *S2S) hasCertificate() bool {
+	return x.cfg.TLSConfig != nil && (len(x.cfg.TLSConfig.Certificates) > 0 || x.cfg.TLSConfig.GetCertificate != nil)
+}
+
+// dialStream connects to the server of remote.
+func (x *S2S) dialStream(ctx context.Context, remote string) (*Session, error) {
+	remoteJID, err := jid.New("", remote, "")
+	if err != nil {
+		return nil, err
+	}
+	trans, err := x.cfg.Dial(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	session, err := NewSession(ctx, trans,
+		WithState(StateServer|StateS2S),
+		WithLocalAddr(x.domain),
+		WithRemoteAddr(remoteJID),
+		WithClock(x.cfg.Clock),
+		WithStreamLimits(x.cfg.Limits),
+		WithMetrics(x.cfg.Metrics),
+		WithTracer(x.cfg.Tracer),
+		WithLogger(x.cfg.Logger),
+		withStreamDump(x.cfg.StreamDump),
+		withDirection(DirectionOutbound),
+	)
+	if err != nil {
+		trans.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// s2sStream is what a receiving server announced for a stream.
+type s2sStream struct {
+	id       string
+	startTLS bool
+	external bool
+	dialback bool
+}
+
+type s2sFeatures struct {
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+	Dialback   *struct{} `xml:"urn:xmpp:features:dialback dialback"`
+}
+
+// openStream (re)opens the stream to remote and reads the answer.
+func (x *S2S) openStream(session *Session, remote string) (s2sStream, error) {
+	var info s2sStream
+	if _, err := session.Writer().WriteRaw(s2sHeader(x.domain, session.RemoteAddr(), "")); err != nil {
+		return info, err
+	}
+	start, err := nextElement(session)
+	if err != nil {
+		return info, err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "stream" {
+		return info, fmt.Errorf("expected stream header, got <%s>", start.Name.Local)
+	}
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "" && a.Name.Local == "id":
+			info.id = a.Value
+		case a.Name.Space == "xmlns" && a.Name.Local == "db" && a.Value == ns.Dialback:
+			// Servers predating the dialback stream feature announce
+			// support this way.
+			info.dialback = true
+		}
+	}
+	if start, err = nextElement(session); err != nil {
+		return info, err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "features" {
+		return info, fmt.Errorf("expected stream features, got <%s>", start.Name.Local)
+	}
+	var f s2sFeatures
+	if err := session.Reader().DecodeElement(&f, &start); err != nil {
+		return info, err
+	}
+	info.startTLS = f.StartTLS != nil
+	info.dialback = info.dialback || f.Dialback != nil
+	for _, m := range f.Mechanisms {
+		if m == "EXTERNAL" {
+			info.external = true
+		}
+	}
+	return info, nil
+}
+
+// nextElement returns the next element of the stream, or the stream error
+// it carries.
+func nextElement(session *Session) (xml.StartElement, error) {
+	for {
+		tok, err := session.Reader().Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == ns.Stream && start.Name.Local == "error" {
+			se := &stream.Error{}
+			if err := session.Reader().DecodeElement(se, &start); err != nil {
+				return xml.StartElement{}, err
+			}
+			return xml.StartElement{}, se
+		}
+		return start, nil
+	}
+}
+
+// s2sHeader returns the header of a stream between servers. Declaring the
+// dialback namespace announces support for it.
+func s2sHeader(from, to jid.JID, id string) []byte {
+	header := stream.Open(stream.Header{From: from, To: to, ID: id, NS: ns.Server})
+	return append(header[:len(header)-1], " xmlns:db='"+ns.Dialback+"'>"...)
+}
+
+type tlsStart struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+}
+
+type tlsProceed struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls proceed"`
+}
+
+type tlsFailure struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls failure"`
+}
+
+func (x *S2S) startTLS(session *Session, remote string) error {
+	if err := session.SendElement(context.Background(), tlsStart{}); err != nil {
+		return err
+	}
+	start, err := nextElement(session)
+	if err != nil {
+		return err
+	}
+	if err := session.Reader().Skip(); err != nil {
+		return err
+	}
+	if start.Name.Space != ns.TLS || start.Name.Local != "proceed" {
+		return errors.New("STARTTLS refused")
+	}
+	if err := session.Transport().StartTLS(x.clientTLS(remote)); err != nil {
+		return err
+	}
+	session.SetState(StateSecure)
+	return nil
+}
+
+type saslExternal struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
+	Mechanism string   `xml:"mechanism,attr"`
+	Value     string   `xml:",chardata"`
+}
+
+// external authenticates the local domain with its certificate. ok is false
+// if the remote server did not accept it.
+func (x *S2S) external(session *Session) (ok bool, err error) {
+	// An empty authorization identity asks for the identity of the
+	// certificate.
+	if err := session.SendElement(context.Background(), saslExternal{Mechanism: "EXTERNAL", Value: "="}); err != nil {
+		return false, err
+	}
+	start, err := nextElement(session)
+	if err != nil {
+		return false, err
+	}
+	if err := session.Reader().Skip(); err != nil {
+		return false, err
+	}
+	return start.Name.Space == ns.SASL && start.Name.Local == "success", nil
+}
+
+// dialback asks remote to verify the dialback key of the stream with id.
+func (x *S2S) dialback(session *Session, remote, id string) error {
+	result := dialback.Result{
+		From: x.domain.Domain(),
+		To:   remote,
+		Key:  dialback.Key(x.secret, remote, x.domain.Domain(), id),
+	}
+	if err := session.SendElement(context.Background(), result); err != nil {
+		return err
+	}
+	for {
+		start, err := nextElement(session)
+		if err != nil {
+			return err
+		}
+		if start.Name.Space != ns.Dialback || start.Name.Local != "result" {
+			if err := session.Reader().Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		var reply dialback.Result
+		if err := session.Reader().DecodeElement(&reply, &start); err != nil {
+			return err
+		}
+		if reply.Type != dialback.TypeValid {
+			return ErrS2SAuthFailed
+		}
+		return nil
+	}
+}
+
+// ListenAndServe accepts inbound streams on S2SConfig.Listener or Addr
+// until ctx is done or Close is called.
+func (x *S2S) ListenAndServe(ctx context.Context) error {
+	ln, err := x.listen()
+	if err != nil {
+		return err
+	}
+	return x.serve(ctx, ln)
+}
+
+func (x *S2S) listen() (net.Listener, error) {
+	ln := x.cfg.Listener
+	if ln == nil {
+		addr := x.cfg.Addr
+		if addr == "" {
+			addr = DefaultS2SAddr
+		}
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		ln.Close()
+		return nil, ErrS2SClosed
+	}
+	x.listener = ln
+	return ln, nil
+}
+
+func (x *S2S) serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			x.mu.Lock()
+			closed := x.closed
+			x.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go x.serveInbound(ctx, conn)
+	}
+}
+
+// Close closes the listener and every stream.
+func (x *S2S) Close() error {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil
+	}
+	x.closed = true
+	ln := x.listener
+	links := x.out
+	x.out = make(map[string]*s2sLink)
+	inbound := x.in
+	x.in = make(map[*Session]struct{})
+	x.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		if err = ln.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
+	for _, l := range links {
+		go func() {
+			<-l.ready
+			if l.session != nil {
+				_ = l.session.SendRaw(context.Background(), bytes.NewReader(stream.Close()))
+				_ = l.session.Close()
+			}
+		}()
+	}
+	for s := range inbound {
+		_ = s.Close()
+	}
+	return err
+}
@@ -0,0 +1,472 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/dialback"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
+	"github.com/meszmate/xmpp-go/transport"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
+)
+
+// maxPendingDialback is how many dialback keys a stream may have awaiting
+// verification at once; each costs a lookup and a connection to the
+// authoritative server of the domain it claims.
+const maxPendingDialback = 8
+
+// s2sInbound is a stream a remote server opened to the local domain.
+type s2sInbound struct {
+	x       *S2S
+	session *Session
+	id      string
+	peer    string // domain in the from attribute of the stream header
+
+	mu      sync.Mutex
+	domains map[string]bool    // remote domains allowed to send on the stream
+	pending map[[2]string]bool // dialback keys being verified, by from and to
+}
+
+func (x *S2S) serveInbound(ctx context.Context, conn net.Conn) {
+	session, err := NewSession(ctx, transport.NewTCP(conn),
+		WithState(StateServer|StateS2S),
+		WithLocalAddr(x.domain),
+		WithClock(x.cfg.Clock),
+		WithStreamLimits(x.cfg.Limits),
+		WithMetrics(x.cfg.Metrics),
+		WithTracer(x.cfg.Tracer),
+		WithLogger(x.cfg.Logger),
+		withStreamDump(x.cfg.StreamDump),
+	)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		session.Close()
+		return
+	}
+	x.in[session] = struct{}{}
+	x.mu.Unlock()
+	defer func() {
+		x.mu.Lock()
+		delete(x.in, session)
+		x.mu.Unlock()
+		session.Close()
+	}()
+
+	in := &s2sInbound{x: x, session: session, domains: make(map[string]bool), pending: make(map[[2]string]bool)}
+	if err := in.serve(ctx); err != nil {
+		var se *stream.Error
+		if errors.As(err, &se) {
+			_ = session.SendStreamError(ctx, se)
+		} else if se := stream.ForReadError(err); se != nil {
+			_ = session.SendStreamError(ctx, se)
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			session.Log(ctx, slog.LevelWarn, "xmpp: s2s stream failed", "domain", in.peer, "error", err)
+		}
+	}
+}
+
+func (in *s2sInbound) serve(ctx context.Context) error {
+	reader := in.session.Reader()
+	for {
+		tok, err := reader.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case start.Name.Space == ns.Stream && start.Name.Local == "stream":
+			if err := in.open(&start); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.TLS && start.Name.Local == "starttls":
+			if err := in.startTLS(ctx); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.SASL && start.Name.Local == "auth":
+			if err := in.external(ctx, &start); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.Dialback && start.Name.Local == "result":
+			if err := in.result(ctx, &start); err != nil {
+				return err
+			}
+		case start.Name.Space == ns.Dialback && start.Name.Local == "verify":
+			if err := in.verify(ctx, &start); err != nil {
+				return err
+			}
+		case start.Name.Local == "message" || start.Name.Local == "presence" || start.Name.Local == "iq":
+			if err := in.stanza(ctx, &start); err != nil {
+				return err
+			}
+		default:
+			if err := reader.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// open answers a (restarted) stream header with ours and the features the
+// stream is at.
+func (in *s2sInbound) open(start *xml.StartElement) error {
+	var to, from string
+	for _, a := range start.Attr {
+		if a.Name.Space != "" {
+			continue
+		}
+		switch a.Name.Local {
+		case "to":
+			to = a.Value
+		case "from":
+			from = a.Value
+		}
+	}
+	in.id = stanza.GenerateID()
+	peer, _ := jid.New("", from, "")
+	if _, err := in.session.Writer().WriteRaw(s2sHeader(in.x.domain, peer, in.id)); err != nil {
+		return err
+	}
+	if to != "" && to != in.x.domain.Domain() {
+		return stream.NewError(stream.ErrHostUnknown, "")
+	}
+	in.peer = from
+	return in.features()
+}
+
+func (in *s2sInbound) features() error {
+	w := in.session.Writer()
+	start := xml.StartElement{Name: xml.Name{Space: ns.Stream, Local: "features"}}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	state := in.session.State()
+	if state&StateSecure == 0 && in.x.serverTLS != nil {
+		if err := encodeStartTLS(w, !in.x.cfg.AllowInsecure); err != nil {
+			return err
+		}
+	} else if state&StateAuthenticated == 0 {
+		if _, ok := in.peerCertificate(); ok {
+			mechs := xml.StartElement{Name: xml.Name{Space: ns.SASL, Local: "mechanisms"}}
+			mech := xml.StartElement{Name: xml.Name{Local: "mechanism"}}
+			for _, t := range []xml.Token{mechs, mech, xml.CharData("EXTERNAL"), mech.End(), mechs.End()} {
+				if err := w.EncodeToken(t); err != nil {
+					return err
+				}
+			}
+		}
+		if err := w.Encode(dialback.Feature{Errors: &struct{}{}}); err != nil {
+			return err
+		}
+	}
+	return w.EncodeToken(start.End())
+}
+
+func encodeStartTLS(w *xmppxml.StreamWriter, required bool) error {
+	start := xml.StartElement{Name: xml.Name{Space: ns.TLS, Local: "starttls"}}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	if required {
+		req := xml.StartElement{Name: xml.Name{Local: "required"}}
+		if err := w.EncodeToken(req); err != nil {
+			return err
+		}
+		if err := w.EncodeToken(req.End()); err != nil {
+			return err
+		}
+	}
+	return w.EncodeToken(start.End())
+}
+
+func (in *s2sInbound) startTLS(ctx context.Context) error {
+	if err := in.session.Reader().Skip(); err != nil {
+		return err
+	}
+	if in.x.serverTLS == nil || in.session.State()&StateSecure != 0 {
+		return in.session.SendElement(ctx, tlsFailure{})
+	}
+	if err := in.session.SendElement(ctx, tlsProceed{}); err != nil {
+		return err
+	}
+	if err := in.session.Transport().StartTLS(in.x.serverTLS); err != nil {
+		return err
+	}
+	in.session.SetState(StateSecure)
+	return nil
+}
+
+// peerCertificate returns the certificate the peer presented during the
+// TLS handshake.
+func (in *s2sInbound) peerCertificate() (*x509.Certificate, bool) {
+	cs, ok := in.session.Transport().ConnectionState()
+	if !ok || len(cs.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return cs.PeerCertificates[0], true
+}
+
+// verifyCertificate reports whether the peer's certificate is valid for
+// domain.
+func (in *s2sInbound) verifyCertificate(domain string) bool {
+	cs, ok := in.session.Transport().ConnectionState()
+	if !ok || len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       domain,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if in.x.cfg.TLSConfig != nil {
+		opts.Roots = in.x.cfg.TLSConfig.RootCAs
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err == nil
+}
+
+type saslFailure struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
+	Condition struct {
+		XMLName xml.Name
+	}
+}
+
+type saslSuccess struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+}
+
+// external authenticates the peer's domain with SASL EXTERNAL (XEP-0178).
+func (in *s2sInbound) external(ctx context.Context, start *xml.StartElement) error {
+	var auth saslExternal
+	if err := in.session.Reader().DecodeElement(&auth, start); err != nil {
+		return err
+	}
+	fail := func(condition string) error {
+		var f saslFailure
+		f.Condition.XMLName = xml.Name{Local: condition}
+		return in.session.SendElement(ctx, f)
+	}
+	if auth.Mechanism != "EXTERNAL" {
+		return fail("invalid-mechanism")
+	}
+	if in.session.State()&StateAuthenticated != 0 {
+		return fail("not-authorized")
+	}
+	authzid := strings.TrimSpace(auth.Value)
+	if authzid != "" && authzid != "=" {
+		data, err := base64.StdEncoding.DecodeString(authzid)
+		if err != nil {
+			return fail("malformed-request")
+		}
+		if string(data) != in.peer {
+			return fail("invalid-authzid")
+		}
+	}
+	if in.peer == "" || !in.verifyCertificate(in.peer) {
+		return fail("not-authorized")
+	}
+	if err := in.session.SendElement(ctx, saslSuccess{}); err != nil {
+		return err
+	}
+	in.allow(in.peer)
+	in.session.SetState(StateAuthenticated)
+	if peer, err := jid.New("", in.peer, ""); err == nil {
+		in.session.SetRemoteAddr(peer)
+	}
+	return nil
+}
+
+// result verifies the dialback key a remote server sent for its domain with
+// the authoritative server of that domain. The stream goes on meanwhile. A
+// key for a domain already being verified is ignored, and a stream with
+// more than maxPendingDialback keys awaiting verification is closed.
+func (in *s2sInbound) result(ctx context.Context, start *xml.StartElement) error {
+	var r dialback.Result
+	if err := in.session.Reader().DecodeElement(&r, start); err != nil {
+		return err
+	}
+	if in.x.serverTLS != nil && !in.x.cfg.AllowInsecure && in.session.State()&StateSecure == 0 {
+		return stream.NewError(stream.ErrPolicyViolation, "TLS is required")
+	}
+	if r.To != in.x.domain.Domain() {
+		return stream.NewError(stream.ErrHostUnknown, "")
+	}
+	if _, err := jid.New("", r.From, ""); err != nil || r.From == in.x.domain.Domain() {
+		return stream.NewError(stream.ErrInvalidFrom, "")
+	}
+	pair := [2]string{r.From, r.To}
+	in.mu.Lock()
+	if in.pending[pair] {
+		in.mu.Unlock()
+		return nil
+	}
+	if len(in.pending) >= maxPendingDialback {
+		in.mu.Unlock()
+		return stream.NewError(stream.ErrPolicyViolation, "too many pending dialback verifications")
+	}
+	in.pending[pair] = true
+	in.mu.Unlock()
+
+	id := in.id
+	go func() {
+		defer func() {
+			in.mu.Lock()
+			delete(in.pending, pair)
+			in.mu.Unlock()
+		}()
+		valid := false
+		ok, err := in.x.verifyKey(r.From, id, r.Key)
+		if err != nil {
+			in.session.Log(ctx, slog.LevelWarn, "xmpp: s2s dialback verification failed", "domain", r.From, "error", err)
+		} else {
+			valid = ok
+		}
+		reply := dialback.Result{From: r.To, To: r.From, Type: dialback.TypeInvalid}
+		if valid {
+			// The domain is allowed before the reply goes out, so stanzas
+			// it sends right after are accepted.
+			in.allow(r.From)
+			reply.Type = dialback.TypeValid
+		}
+		_ = in.session.SendElement(ctx, reply)
+	}()
+	return nil
+}
+
+// verify answers a receiving server asking whether a key was generated by
+// this server (XEP-0220 section 2.4).
+func (in *s2sInbound) verify(ctx context.Context, start *xml.StartElement) error {
+	var v dialback.Verify
+	if err := in.session.Reader().DecodeElement(&v, start); err != nil {
+		return err
+	}
+	reply := dialback.Verify{From: v.To, To: v.From, ID: v.ID, Type: dialback.TypeInvalid}
+	key := dialback.Key(in.x.secret, v.From, v.To, v.ID)
+	if v.To == in.x.domain.Domain() && subtle.ConstantTimeCompare([]byte(v.Key), []byte(key)) == 1 {
+		reply.Type = dialback.TypeValid
+	}
+	return in.session.SendElement(ctx, reply)
+}
+
+func (in *s2sInbound) allow(domain string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.domains[domain] = true
+}
+
+func (in *s2sInbound) allowed(domain string) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.domains[domain]
+}
+
+// stanza passes a stanza from an authenticated domain to the handler.
+func (in *s2sInbound) stanza(ctx context.Context, start *xml.StartElement) error {
+	var st stanza.Stanza
+	switch start.Name.Local {
+	case "message":
+		st = &stanza.Message{}
+	case "presence":
+		st = &stanza.Presence{}
+	default:
+		st = &stanza.IQ{}
+	}
+	if err := in.session.Reader().DecodeElement(st, start); err != nil {
+		return err
+	}
+	h := st.GetHeader()
+	if !in.allowed(h.From.Domain()) {
+		return stream.NewError(stream.ErrInvalidFrom, "")
+	}
+	if h.To.Domain() != in.x.domain.Domain() {
+		return stream.NewError(stream.ErrHostUnknown, "")
+	}
+	if in.x.cfg.Handler == nil {
+		return nil
+	}
+	st = stanza.WithNamespace(st, ns.Client)
+	return in.x.cfg.Handler.HandleStanza(ctx, in.session, st)
+}
+
+// verifyKey asks the authoritative server of originating whether it
+// generated key for the stream with id.
+func (x *S2S) verifyKey(originating, id, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), x.cfg.Timeout)
+	defer cancel()
+	session, err := x.dialStream(ctx, originating)
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { _ = session.Transport().Close() })
+	defer stop()
+	defer session.SendRaw(ctx, bytes.NewReader(stream.Close()))
+
+	// A verification needs no authentication, but the authoritative server
+	// may insist on TLS first.
+	for {
+		info, err := x.openStream(session, originating)
+		if err != nil {
+			return false, err
+		}
+		if info.startTLS && x.clientTLS != nil && session.State()&StateSecure == 0 {
+			if err := x.startTLS(session, originating); err != nil {
+				return false, err
+			}
+			continue
+		}
+		break
+	}
+	v := dialback.Verify{From: x.domain.Domain(), To: originating, ID: id, Key: key}
+	if err := session.SendElement(ctx, v); err != nil {
+		return false, err
+	}
+	for {
+		start, err := nextElement(session)
+		if err != nil {
+			return false, err
+		}
+		if start.Name.Space != ns.Dialback || start.Name.Local != "verify" {
+			if err := session.Reader().Skip(); err != nil {
+				return false, err
+			}
+			continue
+		}
+		var reply dialback.Verify
+		if err := session.Reader().DecodeElement(&reply, &start); err != nil {
+			return false, err
+		}
+		if reply.ID != id {
+			continue
+		}
+		return reply.Type == dialback.TypeValid, nil
+	}
+}
@@ -0,0 +1,478 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/transport"
+)
+
+// s2sNetwork resolves domains to loopback listeners and counts the
+// connections made to each.
+type s2sNetwork struct {
+	mu    sync.Mutex
+	addrs map[string]string
+	dials map[string]int
+}
+
+func newS2SNetwork() *s2sNetwork {
+	return &s2sNetwork{addrs: make(map[string]string), dials: make(map[string]int)}
+}
+
+func (n *s2sNetwork) dial(ctx context.Context, domain string) (*transport.TCP, error) {
+	n.mu.Lock()
+	addr, ok := n.addrs[domain]
+	n.dials[domain]++
+	n.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return transport.NewTCP(conn), nil
+}
+
+func (n *s2sNetwork) dialCount(domain string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dials[domain]
+}
+
+// s2sServer is an S2S for domain serving on the network, whose received
+// stanzas are delivered on received.
+type s2sServer struct {
+	*S2S
+	received chan stanza.Stanza
+}
+
+func newS2SServer(t *testing.T, n *s2sNetwork, domain string, cfg S2SConfig) *s2sServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan stanza.Stanza, 8)
+	cfg.Listener = ln
+	cfg.Dial = n.dial
+	cfg.Timeout = 5 * time.Second
+	cfg.Handler = HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+		received <- st
+		return nil
+	})
+	x, err := NewS2S(domain, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.mu.Lock()
+	n.addrs[domain] = ln.Addr().String()
+	n.mu.Unlock()
+	go x.ListenAndServe(context.Background())
+	t.Cleanup(func() { x.Close() })
+	return &s2sServer{S2S: x, received: received}
+}
+
+func (s *s2sServer) expect(t *testing.T, body string) *stanza.Message {
+	t.Helper()
+	select {
+	case st := <-s.received:
+		msg, ok := st.(*stanza.Message)
+		if !ok || msg.Body() != body {
+			t.Fatalf("received %#v, want message %q", st, body)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %q not received", body)
+		return nil
+	}
+}
+
+func s2sMessage(from, to, body string) *stanza.Message {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.From = jid.MustParse(from)
+	msg.To = jid.MustParse(to)
+	msg.SetBody(body)
+	return msg
+}
+
+// s2sCertificates returns a CA pool and certificates for domains signed by
+// that CA.
+func s2sCertificates(t *testing.T, domains ...string) (*x509.CertPool, map[string]tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	certs := make(map[string]tls.Certificate)
+	for i, domain := range domains {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			DNSNames:     []string{domain},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[domain] = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, certs
+}
+
+func TestS2SDialback(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	a := newS2SServer(t, n, "a.example", S2SConfig{AllowInsecure: true})
+	b := newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+
+	ctx := context.Background()
+	if err := a.Send(ctx, s2sMessage("alice@a.example/phone", "bob@b.example", "hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := b.expect(t, "hello")
+	if msg.From.String() != "alice@a.example/phone" || msg.XMLName.Space != ns.Client {
+		t.Fatalf("received from %s in %q", msg.From, msg.XMLName.Space)
+	}
+	// b verified the key with a, the authoritative server.
+	if got := n.dialCount("a.example"); got != 1 {
+		t.Fatalf("verification connections = %d, want 1", got)
+	}
+
+	// The stream is reused for later stanzas.
+	if err := a.Send(ctx, s2sMessage("alice@a.example", "carol@b.example", "again")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	b.expect(t, "again")
+	if got := n.dialCount("b.example"); got != 1 {
+		t.Fatalf("connections to b.example = %d, want 1", got)
+	}
+	if links := a.Links(); len(links) != 1 || links[0] != "b.example" {
+		t.Fatalf("Links = %v", links)
+	}
+}
+
+func TestS2SExternal(t *testing.T) {
+	t.Parallel()
+	pool, certs := s2sCertificates(t, "a.example", "b.example")
+	n := newS2SNetwork()
+	a := newS2SServer(t, n, "a.example", S2SConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{certs["a.example"]},
+		RootCAs:      pool,
+	}})
+	b := newS2SServer(t, n, "b.example", S2SConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{certs["b.example"]},
+		RootCAs:      pool,
+	}})
+
+	if err := a.Send(context.Background(), s2sMessage("alice@a.example", "bob@b.example", "hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	b.expect(t, "hello")
+	// The certificate authenticated a.example, so no dialback was needed.
+	if got := n.dialCount("a.example"); got != 0 {
+		t.Fatalf("verification connections = %d, want 0", got)
+	}
+}
+
+func TestS2SExternalGetCertificate(t *testing.T) {
+	t.Parallel()
+	pool, certs := s2sCertificates(t, "a.example", "b.example")
+	n := newS2SNetwork()
+	// A certificate that can be reloaded is only offered through
+	// GetCertificate, also for authenticating to b.example.
+	cert := certs["a.example"]
+	a := newS2SServer(t, n, "a.example", S2SConfig{TLSConfig: &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil },
+		RootCAs:        pool,
+	}})
+	b := newS2SServer(t, n, "b.example", S2SConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{certs["b.example"]},
+		RootCAs:      pool,
+	}})
+
+	if err := a.Send(context.Background(), s2sMessage("alice@a.example", "bob@b.example", "hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	b.expect(t, "hello")
+	if got := n.dialCount("a.example"); got != 0 {
+		t.Fatalf("verification connections = %d, want 0", got)
+	}
+}
+
+func TestS2SDialbackOverTLS(t *testing.T) {
+	t.Parallel()
+	pool, certs := s2sCertificates(t, "b.example")
+	n := newS2SNetwork()
+	// a.example has no certificate to authenticate with, so it uses
+	// dialback on the encrypted stream.
+	a := newS2SServer(t, n, "a.example", S2SConfig{TLSConfig: &tls.Config{RootCAs: pool}})
+	b := newS2SServer(t, n, "b.example", S2SConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{certs["b.example"]},
+		RootCAs:      pool,
+	}})
+
+	if err := a.Send(context.Background(), s2sMessage("alice@a.example", "bob@b.example", "hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	b.expect(t, "hello")
+	if got := n.dialCount("a.example"); got != 1 {
+		t.Fatalf("verification connections = %d, want 1", got)
+	}
+}
+
+func TestS2SRequiresTLS(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	a := newS2SServer(t, n, "a.example", S2SConfig{})
+	newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+
+	err := a.Send(context.Background(), s2sMessage("alice@a.example", "bob@b.example", "hello"))
+	if !errors.Is(err, ErrS2SInsecure) {
+		t.Fatalf("Send = %v, want ErrS2SInsecure", err)
+	}
+	if links := a.Links(); len(links) != 0 {
+		t.Fatalf("failed stream kept in the pool: %v", links)
+	}
+}
+
+func TestS2SForgedDialbackKey(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	newS2SServer(t, n, "a.example", S2SConfig{AllowInsecure: true, Secret: "real"})
+	b := newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+	// An impostor claims a.example without knowing its secret.
+	forger, err := NewS2S("a.example", S2SConfig{AllowInsecure: true, Secret: "guess", Dial: n.dial, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forger.Close()
+
+	err = forger.Send(context.Background(), s2sMessage("alice@a.example", "bob@b.example", "forged"))
+	if !errors.Is(err, ErrS2SAuthFailed) {
+		t.Fatalf("Send = %v, want ErrS2SAuthFailed", err)
+	}
+	select {
+	case st := <-b.received:
+		t.Fatalf("forged stanza delivered: %#v", st)
+	default:
+	}
+}
+
+func TestS2SRejectsUnauthenticatedStanza(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	b := newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+	conn, err := net.Dial("tcp", n.addrs["b.example"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(`<stream:stream xmlns='jabber:server' xmlns:stream='http://etherx.jabber.org/streams' xmlns:db='jabber:server:dialback' from='a.example' to='b.example' version='1.0'>` +
+		`<message from='alice@a.example' to='bob@b.example'><body>spoofed</body></message>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got strings.Builder
+	r := bufio.NewReader(conn)
+	for !strings.Contains(got.String(), "</stream:stream>") {
+		line, err := r.ReadString('>')
+		if err != nil {
+			t.Fatalf("read: %v (got %s)", err, got.String())
+		}
+		got.WriteString(line)
+	}
+	if !strings.Contains(got.String(), "invalid-from") {
+		t.Fatalf("stream ended without invalid-from: %s", got.String())
+	}
+	select {
+	case st := <-b.received:
+		t.Fatalf("unauthenticated stanza delivered: %#v", st)
+	default:
+	}
+}
+
+func TestS2SLimitsPendingDialback(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+	// The authoritative servers accept the verification stream but never
+	// answer, so the keys stay pending.
+	hang, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hang.Close()
+	go func() {
+		for {
+			conn, err := hang.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	n.mu.Lock()
+	for i := range maxPendingDialback + 1 {
+		n.addrs[fmt.Sprintf("d%d.example", i)] = hang.Addr().String()
+	}
+	n.mu.Unlock()
+
+	conn, err := net.Dial("tcp", n.addrs["b.example"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	result := func(from string) string {
+		return "<db:result from='" + from + "' to='b.example'>key</db:result>"
+	}
+	_, err = conn.Write([]byte(`<stream:stream xmlns='jabber:server' xmlns:stream='http://etherx.jabber.org/streams' xmlns:db='jabber:server:dialback' to='b.example' version='1.0'>` +
+		result("d0.example") + result("d0.example")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for n.dialCount("d0.example") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := n.dialCount("d0.example"); got != 1 {
+		t.Fatalf("dialed d0.example %d times for one key, want 1", got)
+	}
+
+	var flood strings.Builder
+	for i := 1; i <= maxPendingDialback; i++ {
+		flood.WriteString(result(fmt.Sprintf("d%d.example", i)))
+	}
+	if _, err := conn.Write([]byte(flood.String())); err != nil {
+		t.Fatal(err)
+	}
+	var got strings.Builder
+	r := bufio.NewReader(conn)
+	for !strings.Contains(got.String(), "</stream:stream>") {
+		line, err := r.ReadString('>')
+		if err != nil {
+			t.Fatalf("read: %v (got %s)", err, got.String())
+		}
+		got.WriteString(line)
+	}
+	if !strings.Contains(got.String(), "policy-violation") {
+		t.Fatalf("stream ended without policy-violation: %s", got.String())
+	}
+	if d := n.dialCount(fmt.Sprintf("d%d.example", maxPendingDialback)); d != 0 {
+		t.Fatalf("dialed the domain over the limit %d times", d)
+	}
+}
+
+func TestS2SRedialsClosedStream(t *testing.T) {
+	t.Parallel()
+	n := newS2SNetwork()
+	a := newS2SServer(t, n, "a.example", S2SConfig{AllowInsecure: true})
+	b := newS2SServer(t, n, "b.example", S2SConfig{AllowInsecure: true})
+	ctx := context.Background()
+	if err := a.Send(ctx, s2sMessage("alice@a.example", "bob@b.example", "one")); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, "one")
+
+	// b drops its inbound streams, as on a restart.
+	b.mu.Lock()
+	for s := range b.in {
+		s.Close()
+	}
+	b.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.Links()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed stream kept in the pool")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := a.Send(ctx, s2sMessage("alice@a.example", "bob@b.example", "two")); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, "two")
+	if got := n.dialCount("b.example"); got != 2 {
+		t.Fatalf("connections to b.example = %d, want 2", got)
+	}
+}
+
+func TestS2SSendErrors(t *testing.T) {
+	t.Parallel()
+	x, err := NewS2S("a.example", S2SConfig{AllowInsecure: true, Dial: newS2SNetwork().dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := x.Send(ctx, s2sMessage("alice@a.example", "bob@a.example", "hi")); !errors.Is(err, ErrS2SLocalDomain) {
+		t.Fatalf("Send to local domain = %v", err)
+	}
+	if err := x.Send(ctx, s2sMessage("alice@a.example", "bob@nowhere.example", "hi")); err == nil {
+		t.Fatal("Send to unreachable domain succeeded")
+	}
+	x.Close()
+	if err := x.Send(ctx, s2sMessage("alice@a.example", "bob@b.example", "hi")); !errors.Is(err, ErrS2SClosed) {
+		t.Fatalf("Send after Close = %v", err)
+	}
+}
+
+func TestServerS2S(t *testing.T) {
+	t.Parallel()
+	s, err := NewServer("a.example", WithServerS2S(S2SConfig{AllowInsecure: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.S2S() == nil || s.S2S().Domain() != "a.example" {
+		t.Fatal("S2S not enabled")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := NewServer("a.example"); s.S2S() != nil {
+		t.Fatal("S2S enabled without WithServerS2S")
+	}
+}
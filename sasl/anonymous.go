@@ -1,5 +1,7 @@
 package sasl
 
+import "unicode/utf8"
+
 // Anonymous implements the ANONYMOUS SASL mechanism (RFC 4505).
 type Anonymous struct {
 	trace     string
@@ -27,3 +29,51 @@ func (a *Anonymous) Next(_ []byte) ([]byte, error) {
 
 // Completed returns true after Start.
 func (a *Anonymous) Completed() bool { return a.completed }
+
+// maxTraceLength is the longest trace a client may send with ANONYMOUS
+// (RFC 4505 §3).
+const maxTraceLength = 255
+
+// AnonymousServer implements the server side of ANONYMOUS (RFC 4505). The
+// client is not authenticated: the server names it with a temporary
+// identity.
+type AnonymousServer struct {
+	identity  func() (string, error)
+	username  string
+	trace     string
+	completed bool
+}
+
+// NewAnonymousServer creates an ANONYMOUS mechanism that names each client
+// with the username identity returns.
+func NewAnonymousServer(identity func() (string, error)) *AnonymousServer {
+	return &AnonymousServer{identity: identity}
+}
+
+// Name returns "ANONYMOUS".
+func (a *AnonymousServer) Name() string { return "ANONYMOUS" }
+
+// Next accepts the optional trace information and assigns the identity.
+func (a *AnonymousServer) Next(response []byte) ([]byte, error) {
+	if a.completed || !utf8.Valid(response) || utf8.RuneCount(response) > maxTraceLength {
+		return nil, ErrMalformedRequest
+	}
+	username, err := a.identity()
+	if err != nil {
+		return nil, err
+	}
+	a.username, a.trace, a.completed = username, string(response), true
+	return nil, nil
+}
+
+// Completed returns true once an identity was assigned.
+func (a *AnonymousServer) Completed() bool { return a.completed }
+
+// Username returns the assigned identity.
+func (a *AnonymousServer) Username() string { return a.username }
+
+// AuthzID returns "": an anonymous client cannot ask for an identity.
+func (a *AnonymousServer) AuthzID() string { return "" }
+
+// Trace returns the trace information the client sent, if any.
+func (a *AnonymousServer) Trace() string { return a.trace }
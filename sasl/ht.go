@@ -0,0 +1,123 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// ErrInvalidToken is returned when an HT initial response does not prove
+// possession of the expected token.
+var ErrInvalidToken = errors.New("sasl: invalid token")
+
+// HT implements the HT-* token mechanisms of XEP-0484 FAST: the client
+// proves that it holds a token the server issued earlier, bound to the TLS
+// channel for the -EXPR variants, and the server proves it knows the token
+// in its additional data.
+type HT struct {
+	name      string
+	hashFunc  func() hash.Hash
+	binding   bool
+	creds     Credentials
+	token     []byte
+	completed bool
+}
+
+// NewHT creates the HT mechanism called name, such as HT-SHA-256-NONE or
+// HT-SHA-256-EXPR, authenticating creds.Username with token. The -EXPR
+// variants bind to creds.ChannelBinding, which must hold tls-exporter data.
+func NewHT(name string, creds Credentials, token string) (*HT, error) {
+	h, cb, ok := htParams(name)
+	if !ok {
+		return nil, ErrNoMechanism
+	}
+	if cb && len(creds.ChannelBinding) == 0 {
+		return nil, ErrChannelBinding
+	}
+	return &HT{name: name, hashFunc: h, binding: cb, creds: creds, token: []byte(token)}, nil
+}
+
+// htParams returns the hash and whether channel binding is used for an HT
+// mechanism name.
+func htParams(name string) (h func() hash.Hash, cb bool, ok bool) {
+	rest, found := strings.CutPrefix(name, "HT-")
+	if !found {
+		return nil, false, false
+	}
+	switch {
+	case strings.HasPrefix(rest, "SHA-256-"):
+		h, rest = sha256.New, rest[len("SHA-256-"):]
+	case strings.HasPrefix(rest, "SHA-512-"):
+		h, rest = sha512.New, rest[len("SHA-512-"):]
+	default:
+		return nil, false, false
+	}
+	switch rest {
+	case "NONE":
+		return h, false, true
+	case "EXPR":
+		return h, true, true
+	default:
+		return nil, false, false
+	}
+}
+
+// Name returns the mechanism name.
+func (t *HT) Name() string { return t.name }
+
+// Start returns the username and the initiator hash.
+func (t *HT) Start() ([]byte, error) {
+	resp := append([]byte(t.creds.Username), 0)
+	return append(resp, t.proof("Initiator")...), nil
+}
+
+// Next verifies the responder hash the server sends with its success.
+func (t *HT) Next(data []byte) ([]byte, error) {
+	if !hmac.Equal(data, t.proof("Responder")) {
+		return nil, ErrAuthFailed
+	}
+	t.completed = true
+	return nil, nil
+}
+
+// Completed returns true once the server has proved it knows the token.
+func (t *HT) Completed() bool { return t.completed }
+
+func (t *HT) proof(role string) []byte {
+	mac := hmac.New(t.hashFunc, t.token)
+	mac.Write([]byte(role))
+	if t.binding {
+		mac.Write(t.creds.ChannelBinding)
+	}
+	return mac.Sum(nil)
+}
+
+// HTResponder returns the additional data with which a server proves that
+// it knows token after accepting an HT authentication; see NewHT.
+func HTResponder(name, token string, channelBinding []byte) ([]byte, error) {
+	t, err := NewHT(name, Credentials{ChannelBinding: channelBinding}, token)
+	if err != nil {
+		return nil, err
+	}
+	return t.proof("Responder"), nil
+}
+
+// VerifyHT checks the initial response of an HT authentication against
+// token and returns the username it names.
+func VerifyHT(name, token string, channelBinding, response []byte) (string, error) {
+	user, proof, ok := strings.Cut(string(response), "\x00")
+	if !ok {
+		return "", ErrInvalidResponse
+	}
+	t, err := NewHT(name, Credentials{ChannelBinding: channelBinding}, token)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(proof), t.proof("Initiator")) {
+		return "", ErrInvalidToken
+	}
+	return user, nil
+}
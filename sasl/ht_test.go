@@ -0,0 +1,64 @@
+package sasl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHTExchange(t *testing.T) {
+	t.Parallel()
+	cb := []byte("exporter-data")
+	for _, name := range []string{"HT-SHA-256-NONE", "HT-SHA-256-EXPR", "HT-SHA-512-EXPR"} {
+		m, err := NewHT(name, Credentials{Username: "user", ChannelBinding: cb}, "secret-token")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp, err := m.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := VerifyHT(name, "secret-token", cb, resp)
+		if err != nil || user != "user" {
+			t.Fatalf("%s: VerifyHT = %q, %v", name, user, err)
+		}
+		if _, err := VerifyHT(name, "other-token", cb, resp); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("%s: wrong token accepted: %v", name, err)
+		}
+
+		responder, err := HTResponder(name, "secret-token", cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Next(bytes.Repeat([]byte{0}, len(responder))); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%s: forged responder accepted: %v", name, err)
+		}
+		if _, err := m.Next(responder); err != nil || !m.Completed() {
+			t.Fatalf("%s: responder rejected: %v", name, err)
+		}
+	}
+}
+
+func TestHTChannelBindingMatters(t *testing.T) {
+	t.Parallel()
+	m, err := NewHT("HT-SHA-256-EXPR", Credentials{Username: "user", ChannelBinding: []byte("a")}, "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := m.Start()
+	if _, err := VerifyHT("HT-SHA-256-EXPR", "tok", []byte("b"), resp); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("response replayed on another channel: %v", err)
+	}
+}
+
+func TestNewHTRejects(t *testing.T) {
+	t.Parallel()
+	if _, err := NewHT("HT-SHA-256-EXPR", Credentials{Username: "user"}, "tok"); !errors.Is(err, ErrChannelBinding) {
+		t.Errorf("EXPR without binding data: %v", err)
+	}
+	for _, name := range []string{"HT-MD5-NONE", "HT-SHA-256-UNIQ", "SCRAM-SHA-1"} {
+		if _, err := NewHT(name, Credentials{Username: "user"}, "tok"); !errors.Is(err, ErrNoMechanism) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package sasl
+
+import (
+	"errors"
+	"strings"
+)
+
+// oauthBearerError is the challenge a server sends for a rejected token
+// (RFC 7628 §3.2.2).
+var oauthBearerError = []byte(`{"status":"invalid_token"}`)
+
+// OAuthBearer implements the client side of OAUTHBEARER (RFC 7628), which
+// authenticates with an OAuth 2.0 bearer token.
+type OAuthBearer struct {
+	authzID   string
+	host      string
+	token     string
+	completed bool
+}
+
+// NewOAuthBearer creates an OAUTHBEARER mechanism sending token to host,
+// asking for authzID if it is not empty.
+func NewOAuthBearer(authzID, host, token string) *OAuthBearer {
+	return &OAuthBearer{authzID: authzID, host: host, token: token}
+}
+
+// Name returns "OAUTHBEARER".
+func (o *OAuthBearer) Name() string { return "OAUTHBEARER" }
+
+// Start returns the initial response carrying the token.
+func (o *OAuthBearer) Start() ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("n,")
+	if o.authzID != "" {
+		b.WriteString("a=" + escapeSCRAM(o.authzID))
+	}
+	b.WriteString(",\x01")
+	if o.host != "" {
+		b.WriteString("host=" + o.host + "\x01")
+	}
+	b.WriteString("auth=Bearer " + o.token + "\x01\x01")
+	o.completed = true
+	return []byte(b.String()), nil
+}
+
+// Next answers the error challenge of a server that rejected the token with
+// the dummy response that ends the exchange.
+func (o *OAuthBearer) Next(_ []byte) ([]byte, error) {
+	return []byte{0x01}, nil
+}
+
+// Completed returns true after Start.
+func (o *OAuthBearer) Completed() bool { return o.completed }
+
+// TokenVerifier checks a bearer token and returns the username it was
+// issued to. It returns ErrAuthFailed or ErrUnknownUser when the token does
+// not authenticate an account.
+type TokenVerifier func(token string) (username string, err error)
+
+// OAuthBearerServer implements the server side of OAUTHBEARER (RFC 7628).
+type OAuthBearerServer struct {
+	verify    TokenVerifier
+	username  string
+	authzID   string
+	failed    error
+	completed bool
+}
+
+// NewOAuthBearerServer creates an OAUTHBEARER mechanism that checks tokens
+// with verify.
+func NewOAuthBearerServer(verify TokenVerifier) *OAuthBearerServer {
+	return &OAuthBearerServer{verify: verify}
+}
+
+// Name returns "OAUTHBEARER".
+func (o *OAuthBearerServer) Name() string { return "OAUTHBEARER" }
+
+// Next checks the token of the initial response. A rejected token is
+// answered with an error challenge, and the exchange fails once the client
+// acknowledges it.
+func (o *OAuthBearerServer) Next(response []byte) ([]byte, error) {
+	switch {
+	case o.completed:
+		return nil, ErrMalformedRequest
+	case o.failed != nil:
+		if string(response) != "\x01" {
+			return nil, ErrMalformedRequest
+		}
+		return nil, o.failed
+	}
+	authzID, token, err := parseOAuthBearer(string(response))
+	if err != nil {
+		return nil, err
+	}
+	username, err := o.verify(token)
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrUnknownUser) {
+		o.failed = err
+		return oauthBearerError, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.username, o.authzID, o.completed = username, authzID, true
+	return nil, nil
+}
+
+// Completed returns true once the token was accepted.
+func (o *OAuthBearerServer) Completed() bool { return o.completed }
+
+// Username returns the identity the token was issued to.
+func (o *OAuthBearerServer) Username() string { return o.username }
+
+// AuthzID returns the requested authorization identity.
+func (o *OAuthBearerServer) AuthzID() string { return o.authzID }
+
+// parseOAuthBearer returns the authorization identity and the bearer token
+// of an OAUTHBEARER initial response: gs2-header %x01 *(kvpair) %x01.
+func parseOAuthBearer(msg string) (authzID, token string, err error) {
+	header, rest, ok := strings.Cut(msg, "\x01")
+	if !ok || !strings.HasSuffix(rest, "\x01\x01") {
+		return "", "", ErrMalformedRequest
+	}
+	parts := strings.Split(header, ",")
+	// Channel binding is not defined for OAUTHBEARER.
+	if len(parts) != 3 || parts[0] != "n" && parts[0] != "y" || parts[2] != "" {
+		return "", "", ErrMalformedRequest
+	}
+	if parts[1] != "" {
+		name, ok := strings.CutPrefix(parts[1], "a=")
+		if !ok {
+			return "", "", ErrMalformedRequest
+		}
+		authzID = unescapeSCRAM(name)
+	}
+	for _, kv := range strings.Split(strings.TrimSuffix(rest, "\x01\x01"), "\x01") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if key == "auth" {
+			scheme, credentials, ok := strings.Cut(value, " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+				return "", "", ErrMalformedRequest
+			}
+			token = strings.TrimSpace(credentials)
+		}
+	}
+	if token == "" {
+		return "", "", ErrMalformedRequest
+	}
+	return authzID, token, nil
+}
@@ -0,0 +1,63 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOAuthBearerStart(t *testing.T) {
+	t.Parallel()
+	resp, err := NewOAuthBearer("user,1@example.com", "example.com", "vF9dft4qmT").Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	want := "n,a=user=2C1@example.com,\x01host=example.com\x01auth=Bearer vF9dft4qmT\x01\x01"
+	if string(resp) != want {
+		t.Errorf("Start() = %q, want %q", resp, want)
+	}
+}
+
+func TestOAuthBearerServer(t *testing.T) {
+	t.Parallel()
+	verify := func(token string) (string, error) {
+		if token != "vF9dft4qmT" {
+			return "", ErrAuthFailed
+		}
+		return "user", nil
+	}
+
+	o := NewOAuthBearerServer(verify)
+	resp, _ := NewOAuthBearer("user@example.com", "example.com", "vF9dft4qmT").Start()
+	if _, err := o.Next(resp); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !o.Completed() || o.Username() != "user" || o.AuthzID() != "user@example.com" {
+		t.Fatalf("completed %v, username %q, authzid %q", o.Completed(), o.Username(), o.AuthzID())
+	}
+
+	// A rejected token gets an error challenge first.
+	client := NewOAuthBearer("", "", "expired")
+	o = NewOAuthBearerServer(verify)
+	resp, _ = client.Start()
+	challenge, err := o.Next(resp)
+	if err != nil || string(challenge) != `{"status":"invalid_token"}` {
+		t.Fatalf("Next = %q, %v; want error challenge", challenge, err)
+	}
+	resp, _ = client.Next(challenge)
+	if _, err := o.Next(resp); !errors.Is(err, ErrAuthFailed) || o.Completed() {
+		t.Fatalf("Next after error challenge: %v, completed %v", err, o.Completed())
+	}
+
+	for _, response := range []string{
+		"n,,\x01auth=Bearer\x01\x01",
+		"n,,\x01auth=Basic dXNlcg==\x01\x01",
+		"p=tls-exporter,,\x01auth=Bearer x\x01\x01",
+		"n,,\x01host=example.com\x01\x01",
+		"n,,auth=Bearer x",
+	} {
+		o := NewOAuthBearerServer(verify)
+		if _, err := o.Next([]byte(response)); !errors.Is(err, ErrMalformedRequest) {
+			t.Errorf("Next(%q) error = %v, want ErrMalformedRequest", response, err)
+		}
+	}
+}
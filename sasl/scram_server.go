@@ -0,0 +1,285 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// CBTypeTLSExporter is the tls-exporter channel binding type (RFC 9266).
+const CBTypeTLSExporter = "tls-exporter"
+
+// TLSExporter returns the tls-exporter channel binding data of a TLS 1.3
+// connection.
+func TLSExporter(cs tls.ConnectionState) ([]byte, error) {
+	if cs.Version < tls.VersionTLS13 {
+		return nil, ErrChannelBinding
+	}
+	return cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+}
+
+// SCRAMCredentials are what a server keeps to verify SCRAM authentication
+// without knowing the password (RFC 5802 §3).
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the credentials for password with the hash of
+// the named SCRAM mechanism, such as "SCRAM-SHA-256".
+func NewSCRAMCredentials(mechanism, password string, salt []byte, iterations int) (SCRAMCredentials, error) {
+	h, _, ok := scramHash(mechanism)
+	if !ok {
+		return SCRAMCredentials{}, ErrNoMechanism
+	}
+	salted := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  hashBytes(h, hmacHash(h, salted, []byte("Client Key"))),
+		ServerKey:  hmacHash(h, salted, []byte("Server Key")),
+	}, nil
+}
+
+// Verify reports whether password matches c, which was derived with the
+// hash of the named SCRAM mechanism. It lets PLAIN authenticate accounts for
+// which only SCRAM credentials are stored.
+func (c SCRAMCredentials) Verify(mechanism, password string) bool {
+	derived, err := NewSCRAMCredentials(mechanism, password, c.Salt, c.Iterations)
+	return err == nil && hmac.Equal(derived.StoredKey, c.StoredKey)
+}
+
+// CredentialLookup returns the SCRAM credentials of username for the named
+// mechanism, or ErrUnknownUser.
+type CredentialLookup func(mechanism, username string) (SCRAMCredentials, error)
+
+// ChannelBinding describes the channel binding a server offers for the
+// -PLUS variants. A zero value means the server offers none.
+type ChannelBinding struct {
+	Type string
+	Data []byte
+}
+
+// SCRAMServer implements the server side of the SCRAM-SHA-* mechanisms and
+// their -PLUS variants (RFC 5802, RFC 7677).
+type SCRAMServer struct {
+	name     string
+	hashFunc func() hash.Hash
+	plus     bool
+	lookup   CredentialLookup
+	cb       ChannelBinding
+
+	step            int
+	username        string
+	authzID         string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           SCRAMCredentials
+	unknown         bool
+	saltKey         []byte
+}
+
+// saltKey keys the salts made up for unknown users by servers that were not
+// given a key with SetSaltKey.
+var saltKey = randomBytes(32)
+
+// DeriveSalt returns a 16-byte salt for username keyed by key. The same
+// username always gets the same salt, so a server that makes one up for a
+// user without credentials does not give the user away by a salt that
+// changes from one attempt to the next.
+func DeriveSalt(key []byte, username string) []byte {
+	return hmacHash(sha256.New, key, []byte(username))[:16]
+}
+
+// NewSCRAMServer creates the server side of the named SCRAM mechanism. cb is
+// the channel binding of the connection; the -PLUS variants require it, and
+// when it is set a client that claims the server does not support channel
+// binding is rejected as a downgrade.
+func NewSCRAMServer(mechanism string, lookup CredentialLookup, cb ChannelBinding) (*SCRAMServer, error) {
+	h, plus, ok := scramHash(mechanism)
+	if !ok {
+		return nil, ErrNoMechanism
+	}
+	if plus && len(cb.Data) == 0 {
+		return nil, ErrChannelBinding
+	}
+	return &SCRAMServer{name: mechanism, hashFunc: h, plus: plus, lookup: lookup, cb: cb}, nil
+}
+
+// SetSaltKey sets the key the salts of unknown users are derived from with
+// DeriveSalt. Servers that restart or run as a cluster should set one that
+// is the same everywhere; the default lasts for the life of the process.
+func (s *SCRAMServer) SetSaltKey(key []byte) { s.saltKey = key }
+
+// Name returns the mechanism name.
+func (s *SCRAMServer) Name() string { return s.name }
+
+// Completed returns true once the client proof has been verified.
+func (s *SCRAMServer) Completed() bool { return s.step >= 2 }
+
+// Username returns the authenticated identity.
+func (s *SCRAMServer) Username() string { return s.username }
+
+// AuthzID returns the requested authorization identity.
+func (s *SCRAMServer) AuthzID() string { return s.authzID }
+
+// Next processes the client-first and client-final messages.
+func (s *SCRAMServer) Next(response []byte) ([]byte, error) {
+	switch s.step {
+	case 0:
+		return s.processClientFirst(string(response))
+	case 1:
+		return s.processClientFinal(string(response))
+	default:
+		return nil, ErrMalformedRequest
+	}
+}
+
+func (s *SCRAMServer) processClientFirst(msg string) ([]byte, error) {
+	// gs2-header is "cbind-flag,[a=authzid],"; the rest is client-first-bare.
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrMalformedRequest
+	}
+	flag, authz, bare := parts[0], parts[1], parts[2]
+	switch {
+	case flag == "n":
+		if s.plus {
+			return nil, ErrMalformedRequest
+		}
+	case flag == "y":
+		// The client supports channel binding but thinks we do not.
+		if s.plus || len(s.cb.Data) > 0 {
+			return nil, ErrChannelBinding
+		}
+	case strings.HasPrefix(flag, "p="):
+		if !s.plus || flag[2:] != s.cb.Type {
+			return nil, ErrChannelBinding
+		}
+	default:
+		return nil, ErrMalformedRequest
+	}
+	if authz != "" {
+		if !strings.HasPrefix(authz, "a=") {
+			return nil, ErrMalformedRequest
+		}
+		s.authzID = unescapeSCRAM(authz[2:])
+	}
+	s.gs2Header = flag + "," + authz + ","
+
+	if strings.HasPrefix(bare, "m=") {
+		return nil, ErrMalformedRequest
+	}
+	attrs := parseSCRAMAttributes(bare)
+	username, clientNonce := unescapeSCRAM(attrs["n"]), attrs["r"]
+	if username == "" || clientNonce == "" {
+		return nil, ErrMalformedRequest
+	}
+
+	creds, err := s.lookup(s.name, username)
+	switch {
+	case err == ErrUnknownUser:
+		// Carry on with made-up credentials so that unknown users are not
+		// told apart from wrong passwords.
+		key := s.saltKey
+		if key == nil {
+			key = saltKey
+		}
+		creds = SCRAMCredentials{Salt: DeriveSalt(key, username), Iterations: 4096}
+		s.unknown = true
+	case err != nil:
+		return nil, err
+	case len(creds.Salt) == 0 || creds.Iterations <= 0 || len(creds.StoredKey) == 0 || len(creds.ServerKey) == 0:
+		return nil, fmt.Errorf("sasl: incomplete SCRAM credentials for %s", username)
+	}
+
+	s.username = username
+	s.clientFirstBare = bare
+	s.creds = creds
+	s.nonce = clientNonce + generateNonce()
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.Iterations)
+	s.step = 1
+	return []byte(s.serverFirst), nil
+}
+
+func (s *SCRAMServer) processClientFinal(msg string) ([]byte, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return nil, ErrMalformedRequest
+	}
+	withoutProof := msg[:idx]
+	attrs := parseSCRAMAttributes(withoutProof)
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+	if err != nil {
+		return nil, ErrMalformedRequest
+	}
+	if attrs["r"] != s.nonce {
+		return nil, ErrMalformedRequest
+	}
+
+	cbInput := []byte(s.gs2Header)
+	if s.plus {
+		cbInput = append(cbInput, s.cb.Data...)
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs["c"])
+	if err != nil || !hmac.Equal(cbind, cbInput) {
+		return nil, ErrChannelBinding
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSig := hmacHash(s.hashFunc, s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSig) || s.unknown {
+		return nil, ErrAuthFailed
+	}
+	clientKey := xorBytes(proof, clientSig)
+	if !hmac.Equal(hashBytes(s.hashFunc, clientKey), s.creds.StoredKey) {
+		return nil, ErrAuthFailed
+	}
+
+	serverSig := hmacHash(s.hashFunc, s.creds.ServerKey, authMessage)
+	s.step = 2
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)), nil
+}
+
+// scramHash returns the hash of the named SCRAM mechanism and whether it is
+// a -PLUS variant.
+func scramHash(mechanism string) (h func() hash.Hash, plus bool, ok bool) {
+	name, plus := strings.CutSuffix(mechanism, "-PLUS")
+	switch name {
+	case "SCRAM-SHA-1":
+		return sha1.New, plus, true
+	case "SCRAM-SHA-256":
+		return sha256.New, plus, true
+	case "SCRAM-SHA-512":
+		return sha512.New, plus, true
+	}
+	return nil, false, false
+}
+
+func unescapeSCRAM(s string) string {
+	s = strings.ReplaceAll(s, "=2C", ",")
+	s = strings.ReplaceAll(s, "=3D", "=")
+	return s
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
@@ -0,0 +1,192 @@
+package sasl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testLookup(t *testing.T, password string) CredentialLookup {
+	return func(mechanism, username string) (SCRAMCredentials, error) {
+		if username != "user" {
+			return SCRAMCredentials{}, ErrUnknownUser
+		}
+		creds, err := NewSCRAMCredentials(mechanism, password, []byte("0123456789abcdef"), 4096)
+		if err != nil {
+			t.Fatalf("NewSCRAMCredentials: %v", err)
+		}
+		return creds, nil
+	}
+}
+
+// exchange runs client against server and returns the first error.
+func exchange(client *SCRAM, server *SCRAMServer) error {
+	resp, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for !server.Completed() {
+		challenge, err := server.Next(resp)
+		if err != nil {
+			return err
+		}
+		if resp, err = client.Next(challenge); err != nil {
+			return err
+		}
+	}
+	if !client.Completed() {
+		return errors.New("client did not complete")
+	}
+	return nil
+}
+
+func TestSCRAMServer(t *testing.T) {
+	t.Parallel()
+	cb := ChannelBinding{Type: CBTypeTLSExporter, Data: []byte("binding-data")}
+	tests := []struct {
+		client func(Credentials) *SCRAM
+		cb     ChannelBinding
+	}{
+		{NewSCRAMSHA1, ChannelBinding{}},
+		{NewSCRAMSHA256, ChannelBinding{}},
+		{NewSCRAMSHA512, ChannelBinding{}},
+		{NewSCRAMSHA1Plus, cb},
+		{NewSCRAMSHA256Plus, cb},
+	}
+	for _, tt := range tests {
+		creds := Credentials{Username: "user", Password: "pencil", ChannelBinding: tt.cb.Data, CBType: tt.cb.Type}
+		client := tt.client(creds)
+		t.Run(client.Name(), func(t *testing.T) {
+			t.Parallel()
+			server, err := NewSCRAMServer(client.Name(), testLookup(t, "pencil"), tt.cb)
+			if err != nil {
+				t.Fatalf("NewSCRAMServer: %v", err)
+			}
+			if err := exchange(client, server); err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if server.Username() != "user" {
+				t.Fatalf("Username = %q", server.Username())
+			}
+		})
+	}
+}
+
+func TestSCRAMServerRejects(t *testing.T) {
+	t.Parallel()
+	cb := ChannelBinding{Type: CBTypeTLSExporter, Data: []byte("binding-data")}
+	tests := []struct {
+		name   string
+		client *SCRAM
+		mech   string
+		cb     ChannelBinding
+		want   error
+	}{
+		{"wrong password", NewSCRAMSHA256(Credentials{Username: "user", Password: "pen"}), "SCRAM-SHA-256", ChannelBinding{}, ErrAuthFailed},
+		{"unknown user", NewSCRAMSHA256(Credentials{Username: "nobody", Password: "pencil"}), "SCRAM-SHA-256", ChannelBinding{}, ErrAuthFailed},
+		{"other binding", NewSCRAMSHA256Plus(Credentials{Username: "user", Password: "pencil", ChannelBinding: []byte("mitm"), CBType: CBTypeTLSExporter}),
+			"SCRAM-SHA-256-PLUS", cb, ErrChannelBinding},
+		{"other binding type", NewSCRAMSHA256Plus(Credentials{Username: "user", Password: "pencil", ChannelBinding: cb.Data, CBType: "tls-unique"}),
+			"SCRAM-SHA-256-PLUS", cb, ErrChannelBinding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			server, err := NewSCRAMServer(tt.mech, testLookup(t, "pencil"), tt.cb)
+			if err != nil {
+				t.Fatalf("NewSCRAMServer: %v", err)
+			}
+			if err := exchange(tt.client, server); !errors.Is(err, tt.want) {
+				t.Fatalf("exchange error = %v, want %v", err, tt.want)
+			}
+			if server.Completed() {
+				t.Fatal("server completed")
+			}
+		})
+	}
+}
+
+func TestSCRAMServerDowngrade(t *testing.T) {
+	t.Parallel()
+	cb := ChannelBinding{Type: CBTypeTLSExporter, Data: []byte("binding-data")}
+	server, err := NewSCRAMServer("SCRAM-SHA-256", testLookup(t, "pencil"), cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "y" says the client could bind but believes the server cannot.
+	if _, err := server.Next([]byte("y,,n=user,r=abc")); !errors.Is(err, ErrChannelBinding) {
+		t.Fatalf("Next error = %v, want ErrChannelBinding", err)
+	}
+
+	if _, err := NewSCRAMServer("SCRAM-SHA-256-PLUS", testLookup(t, "pencil"), ChannelBinding{}); !errors.Is(err, ErrChannelBinding) {
+		t.Fatalf("PLUS without binding: %v", err)
+	}
+	if _, err := NewSCRAMServer("DIGEST-MD5", testLookup(t, "pencil"), ChannelBinding{}); !errors.Is(err, ErrNoMechanism) {
+		t.Fatalf("unknown mechanism: %v", err)
+	}
+}
+
+func TestSCRAMServerMalformed(t *testing.T) {
+	t.Parallel()
+	for _, msg := range []string{"", "n,,", "x,,n=user,r=abc", "n,,m=ext,n=user,r=abc", "n,,n=user", "n,z,n=user,r=abc"} {
+		server, err := NewSCRAMServer("SCRAM-SHA-256", testLookup(t, "pencil"), ChannelBinding{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Next([]byte(msg)); !errors.Is(err, ErrMalformedRequest) {
+			t.Errorf("Next(%q) error = %v, want ErrMalformedRequest", msg, err)
+		}
+	}
+
+	server, _ := NewSCRAMServer("SCRAM-SHA-256", testLookup(t, "pencil"), ChannelBinding{})
+	first, err := server.Next([]byte("n,a=admin,n=user,r=abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.AuthzID() != "admin" || !strings.HasPrefix(string(first), "r=abc") {
+		t.Fatalf("authzid %q, server-first %q", server.AuthzID(), first)
+	}
+	if _, err := server.Next([]byte("c=biws,r=other,p=AAAA")); !errors.Is(err, ErrMalformedRequest) {
+		t.Fatalf("nonce mismatch: %v", err)
+	}
+}
+
+func TestSCRAMCredentialsVerify(t *testing.T) {
+	t.Parallel()
+	creds, err := NewSCRAMCredentials("SCRAM-SHA-256", "pencil", []byte("salt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !creds.Verify("SCRAM-SHA-256", "pencil") || creds.Verify("SCRAM-SHA-256", "pen") || creds.Verify("SCRAM-SHA-1", "pencil") {
+		t.Fatal("Verify gave the wrong answer")
+	}
+}
+
+func TestSCRAMServerUnknownUserSalt(t *testing.T) {
+	serverFirst := func(key []byte, username string) string {
+		t.Helper()
+		server, err := NewSCRAMServer("SCRAM-SHA-256", testLookup(t, "pencil"), ChannelBinding{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			server.SetSaltKey(key)
+		}
+		first, err := server.Next([]byte("n,,n=" + username + ",r=nonce"))
+		if err != nil {
+			t.Fatalf("client-first: %v", err)
+		}
+		return parseSCRAMAttributes(string(first))["s"]
+	}
+
+	// Retrying must not tell an unknown user from an account.
+	if a, b := serverFirst(nil, "nobody"), serverFirst(nil, "nobody"); a != b {
+		t.Errorf("salt changed between attempts: %s, %s", a, b)
+	}
+	if a, b := serverFirst(nil, "nobody"), serverFirst(nil, "someone"); a == b {
+		t.Error("unknown users share a salt")
+	}
+	if a, b := serverFirst([]byte("k1"), "nobody"), serverFirst([]byte("k2"), "nobody"); a == b {
+		t.Error("salt does not depend on the key")
+	}
+}
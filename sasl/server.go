@@ -0,0 +1,78 @@
+package sasl
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	ErrMalformedRequest = errors.New("sasl: malformed request")
+	ErrUnknownUser      = errors.New("sasl: unknown user")
+)
+
+// ServerMechanism is the server side of a SASL mechanism.
+type ServerMechanism interface {
+	// Name returns the SASL mechanism name.
+	Name() string
+
+	// Next processes a response from the client, starting with the initial
+	// response, and returns the next challenge. Once Completed reports true,
+	// the returned data is the additional data sent with the success.
+	Next(response []byte) ([]byte, error)
+
+	// Completed returns true once the client has been authenticated.
+	Completed() bool
+
+	// Username returns the authenticated identity once completed.
+	Username() string
+
+	// AuthzID returns the authorization identity the client asked for, if
+	// any.
+	AuthzID() string
+}
+
+// PasswordVerifier checks a username and password. It returns
+// ErrAuthFailed or ErrUnknownUser when they do not match an account.
+type PasswordVerifier func(username, password string) error
+
+// PlainServer implements the server side of PLAIN (RFC 4616).
+type PlainServer struct {
+	verify    PasswordVerifier
+	username  string
+	authzID   string
+	completed bool
+}
+
+// NewPlainServer creates a PLAIN mechanism that checks passwords with verify.
+func NewPlainServer(verify PasswordVerifier) *PlainServer {
+	return &PlainServer{verify: verify}
+}
+
+// Name returns "PLAIN".
+func (p *PlainServer) Name() string { return "PLAIN" }
+
+// Next checks the [authzid]\0authcid\0passwd response.
+func (p *PlainServer) Next(response []byte) ([]byte, error) {
+	if p.completed {
+		return nil, ErrMalformedRequest
+	}
+	parts := bytes.SplitN(response, []byte{0}, 3)
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, ErrMalformedRequest
+	}
+	username := string(parts[1])
+	if err := p.verify(username, string(parts[2])); err != nil {
+		return nil, err
+	}
+	p.username, p.authzID, p.completed = username, string(parts[0]), true
+	return nil, nil
+}
+
+// Completed returns true once the password was accepted.
+func (p *PlainServer) Completed() bool { return p.completed }
+
+// Username returns the authenticated identity.
+func (p *PlainServer) Username() string { return p.username }
+
+// AuthzID returns the requested authorization identity.
+func (p *PlainServer) AuthzID() string { return p.authzID }
@@ -0,0 +1,81 @@
+package sasl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPlainServer(t *testing.T) {
+	t.Parallel()
+	verify := func(username, password string) error {
+		if username != "user" {
+			return ErrUnknownUser
+		}
+		if password != "pencil" {
+			return ErrAuthFailed
+		}
+		return nil
+	}
+
+	p := NewPlainServer(verify)
+	resp, _ := NewPlain(Credentials{Username: "user", Password: "pencil", AuthzID: "user@example.com"}).Start()
+	if _, err := p.Next(resp); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !p.Completed() || p.Username() != "user" || p.AuthzID() != "user@example.com" {
+		t.Fatalf("completed %v, username %q, authzid %q", p.Completed(), p.Username(), p.AuthzID())
+	}
+
+	tests := []struct {
+		response string
+		want     error
+	}{
+		{"\x00user\x00pen", ErrAuthFailed},
+		{"\x00nobody\x00pencil", ErrUnknownUser},
+		{"\x00\x00pencil", ErrMalformedRequest},
+		{"user", ErrMalformedRequest},
+	}
+	for _, tt := range tests {
+		p := NewPlainServer(verify)
+		if _, err := p.Next([]byte(tt.response)); !errors.Is(err, tt.want) {
+			t.Errorf("Next(%q) error = %v, want %v", tt.response, err, tt.want)
+		}
+		if p.Completed() {
+			t.Errorf("Next(%q) completed", tt.response)
+		}
+	}
+}
+
+func TestAnonymousServer(t *testing.T) {
+	t.Parallel()
+	n := 0
+	identity := func() (string, error) {
+		n++
+		return fmt.Sprintf("guest-%d", n), nil
+	}
+
+	a := NewAnonymousServer(identity)
+	resp, _ := NewAnonymous("widget@example.com").Start()
+	if _, err := a.Next(resp); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !a.Completed() || a.Username() != "guest-1" || a.Trace() != "widget@example.com" || a.AuthzID() != "" {
+		t.Fatalf("completed %v, username %q, trace %q", a.Completed(), a.Username(), a.Trace())
+	}
+	if _, err := a.Next(nil); !errors.Is(err, ErrMalformedRequest) {
+		t.Fatalf("second Next error = %v", err)
+	}
+
+	for _, response := range []string{strings.Repeat("x", 256), "\xff"} {
+		a := NewAnonymousServer(identity)
+		if _, err := a.Next([]byte(response)); !errors.Is(err, ErrMalformedRequest) || a.Completed() {
+			t.Errorf("Next(%.10q) error = %v, completed %v", response, err, a.Completed())
+		}
+	}
+	a = NewAnonymousServer(identity)
+	if _, err := a.Next(nil); err != nil || a.Username() != "guest-2" {
+		t.Fatalf("Next without trace: %v, username %q", err, a.Username())
+	}
+}
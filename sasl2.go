@@ -0,0 +1,497 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/csi"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+var (
+	// ErrSASL2Unsupported is returned by Connect when WithSASL2 is set and
+	// the server does not offer SASL2.
+	ErrSASL2Unsupported = errors.New("xmpp: server does not offer SASL2")
+	// ErrTLSRequired is returned by Connect when the server offers neither
+	// Direct TLS nor STARTTLS and WithNoTLS is not set.
+	ErrTLSRequired = errors.New("xmpp: server does not offer TLS")
+)
+
+// DefaultAuthTimeout bounds the authentication of a client stream with
+// SASL2.
+const DefaultAuthTimeout = 30 * time.Second
+
+// SASL2Error is returned by Connect when the server rejects the SASL2
+// authentication.
+type SASL2Error struct {
+	// Condition is the SASL failure condition, such as not-authorized.
+	Condition string
+	Text      string
+}
+
+func (e *SASL2Error) Error() string {
+	if e.Text != "" {
+		return "xmpp: authentication failed: " + e.Condition + ": " + e.Text
+	}
+	return "xmpp: authentication failed: " + e.Condition
+}
+
+// SASL2Config configures authentication with SASL2 (XEP-0388); see
+// WithSASL2.
+type SASL2Config struct {
+	// UserAgent identifies this installation of the client. Its ID should
+	// be a UUID kept across restarts, since servers tie FAST tokens to it.
+	UserAgent sasl2.UserAgent
+	// Tag names the client software in the Bind2 request; the server
+	// derives the resource from it (XEP-0386).
+	Tag string
+	// FAST requests XEP-0484 tokens and, once one was issued, authenticates
+	// with it instead of the password.
+	FAST bool
+	// Token is a FAST token saved from an earlier run.
+	Token *FastToken
+	// OnToken is called with every token the server issues, so that it can
+	// be saved for the next run. It is called during Connect and must not
+	// call back into the client.
+	OnToken func(FastToken)
+}
+
+// FastToken is a XEP-0484 FAST token and the mechanism it is used with.
+type FastToken struct {
+	Mechanism string
+	Token     string
+	Expiry    time.Time
+}
+
+// usable reports whether t has not expired and its mechanism is offered
+// and, for the -EXPR ones, has channel binding data in creds.
+func (t *FastToken) usable(offered []string, creds sasl.Credentials, now time.Time) bool {
+	if t == nil || t.Token == "" || !slices.Contains(offered, t.Mechanism) {
+		return false
+	}
+	if !t.Expiry.IsZero() && !now.Before(t.Expiry) {
+		return false
+	}
+	_, err := sasl.NewHT(t.Mechanism, creds, t.Token)
+	return err == nil
+}
+
+// clientFeatures is what a client needs from the stream features before it
+// authenticates.
+type clientFeatures struct {
+	StartTLS       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Authentication *struct {
+		Mechanisms []string `xml:"mechanism"`
+		Fast       []string `xml:"inline>fast>mechanism"`
+		Bind       *struct {
+			Features []struct {
+				Var string `xml:"var,attr"`
+			} `xml:"inline>feature"`
+		} `xml:"inline>bind"`
+		SM *struct{} `xml:"inline>sm"`
+	} `xml:"urn:xmpp:sasl:2 authentication"`
+	ChannelBindings []sasl2.ChannelBinding `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding>channel-binding"`
+}
+
+// inlineFeatureNames maps the features Bind2 lists as available inline to
+// the stream features the client checks before using them.
+var inlineFeatureNames = map[string]xml.Name{
+	ns.CSI: csi.Feature,
+	ns.SM:  sm.Feature,
+}
+
+// sasl2Success is what a SASL2 success carries besides Bind2 results.
+type sasl2Success struct {
+	Token   *sasl2.Token `xml:"urn:xmpp:fast:0 token"`
+	Resumed *sm.Resumed  `xml:"urn:xmpp:sm:3 resumed"`
+}
+
+// sasl2Failure decodes the condition of a SASL2 failure.
+type sasl2Failure struct {
+	Conditions []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+	Text string `xml:"text"`
+}
+
+type fastRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:fast:0 fast"`
+}
+
+// authenticate opens the stream on s and authenticates with SASL2, after
+// STARTTLS if the connection is not yet secure. With Bind2 available the
+// resource is bound, Stream Management enabled or resumed and carbons
+// enabled in the same round trip. It runs from connect, with c.connectMu
+// held.
+func (c *Client) authenticate(ctx context.Context, s *Session) error {
+	cfg := c.opts.sasl2
+	// A stuck server must not hold the negotiation past ctx.
+	stop := context.AfterFunc(ctx, func() { _ = s.Transport().Close() })
+	defer stop()
+
+	var f clientFeatures
+	var names []xml.Name
+	for {
+		var err error
+		if f, names, err = c.openStream(s); err != nil {
+			return err
+		}
+		if s.State()&StateSecure != 0 || c.opts.noTLS {
+			break
+		}
+		if f.StartTLS == nil {
+			return ErrTLSRequired
+		}
+		if err := c.startTLS(s); err != nil {
+			return err
+		}
+	}
+	if f.Authentication == nil {
+		return ErrSASL2Unsupported
+	}
+
+	creds := sasl.Credentials{Username: c.addr.Local(), Password: c.password}
+	if cs, ok := s.Transport().ConnectionState(); ok && slices.ContainsFunc(f.ChannelBindings, func(cb sasl2.ChannelBinding) bool {
+		return cb.Type == sasl.CBTypeTLSExporter
+	}) {
+		if data, err := sasl.TLSExporter(cs); err == nil {
+			creds.ChannelBinding, creds.CBType = data, sasl.CBTypeTLSExporter
+		}
+	}
+
+	// The bind request asks for what the client would otherwise enable
+	// after binding.
+	var bind *sasl2.BindRequest
+	if f.Authentication.Bind != nil {
+		c.mu.Lock()
+		carbons := c.carbons
+		c.mu.Unlock()
+		bind = &sasl2.BindRequest{Tag: cfg.Tag, Carbons: carbons}
+		for _, feat := range f.Authentication.Bind.Features {
+			if name, ok := inlineFeatureNames[feat.Var]; ok {
+				names = append(names, name)
+			}
+			if feat.Var == ns.SM && c.sm != nil {
+				bind.SM, bind.Resume = true, c.sm.timeout > 0
+			}
+		}
+	}
+
+	for {
+		token := c.fast
+		useToken := cfg.FAST && token.usable(f.Authentication.Fast, creds, s.clock.Now())
+
+		success, tokenMech, err := c.sasl2Exchange(ctx, s, f, creds, bind, useToken)
+		var failure *SASL2Error
+		if useToken && errors.As(err, &failure) {
+			// The token was revoked or has expired on the server; fall
+			// back to the password on the same stream.
+			c.fast = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.SetStreamFeatures(names...)
+		return c.authenticated(s, success, bind, tokenMech)
+	}
+}
+
+// openStream (re)opens the client stream and reads the features.
+func (c *Client) openStream(s *Session) (clientFeatures, []xml.Name, error) {
+	var f clientFeatures
+	to, err := jid.New("", c.addr.Domain(), "")
+	if err != nil {
+		return f, nil, err
+	}
+	header := stream.Open(stream.Header{To: to, From: c.addr.Bare(), NS: ns.Client})
+	if _, err := s.Writer().WriteRaw(header); err != nil {
+		return f, nil, err
+	}
+	start, err := nextElement(s)
+	if err != nil {
+		return f, nil, err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "stream" {
+		return f, nil, fmt.Errorf("xmpp: expected stream header, got <%s>", start.Name.Local)
+	}
+	s.setStreamLang(&start)
+	if start, err = nextElement(s); err != nil {
+		return f, nil, err
+	}
+	if start.Name.Space != ns.Stream || start.Name.Local != "features" {
+		return f, nil, fmt.Errorf("xmpp: expected stream features, got <%s>", start.Name.Local)
+	}
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := s.Reader().DecodeElement(&raw, &start); err != nil {
+		return f, nil, err
+	}
+	wrapped := append(append([]byte("<features>"), raw.Inner...), "</features>"...)
+	var all streamFeatures
+	if err := xml.Unmarshal(wrapped, &all); err != nil {
+		return f, nil, err
+	}
+	if err := xml.Unmarshal(wrapped, &f); err != nil {
+		return f, nil, err
+	}
+	names := make([]xml.Name, 0, len(all.Features))
+	for _, feat := range all.Features {
+		names = append(names, feat.XMLName)
+	}
+	return f, names, nil
+}
+
+func (c *Client) startTLS(s *Session) error {
+	if err := s.SendElement(context.Background(), tlsStart{}); err != nil {
+		return err
+	}
+	start, err := nextElement(s)
+	if err != nil {
+		return err
+	}
+	if err := s.Reader().Skip(); err != nil {
+		return err
+	}
+	if start.Name.Space != ns.TLS || start.Name.Local != "proceed" {
+		return errors.New("xmpp: STARTTLS refused")
+	}
+	cfg := &tls.Config{ServerName: c.addr.Domain()}
+	if c.dialer.TLSConfig != nil {
+		cfg = c.dialer.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = c.addr.Domain()
+		}
+	}
+	if err := s.Transport().StartTLS(cfg); err != nil {
+		return err
+	}
+	s.SetState(StateSecure)
+	return nil
+}
+
+// sasl2Exchange sends one <authenticate/> and answers the challenges until
+// the server succeeds or fails it. tokenMech is the mechanism of the FAST
+// token used or requested, which a token in the success is for.
+func (c *Client) sasl2Exchange(ctx context.Context, s *Session, f clientFeatures, creds sasl.Credentials, bind *sasl2.BindRequest, useToken bool) (success *sasl2.Success, tokenMech string, err error) {
+	cfg := c.opts.sasl2
+	var mech sasl.Mechanism
+	var inline [][]byte
+	marshal := func(v any) error {
+		data, err := xml.Marshal(v)
+		if err == nil {
+			inline = append(inline, data)
+		}
+		return err
+	}
+
+	if useToken {
+		token := *c.fast
+		if mech, err = sasl.NewHT(token.Mechanism, creds, token.Token); err != nil {
+			return nil, "", err
+		}
+		tokenMech = token.Mechanism
+		if err := marshal(fastRequest{}); err != nil {
+			return nil, "", err
+		}
+	} else {
+		if mech, err = c.passwordMechanism(s, creds, f.Authentication.Mechanisms); err != nil {
+			return nil, "", err
+		}
+		if cfg.FAST {
+			if tokenMech = fastMechanism(f.Authentication.Fast, creds); tokenMech != "" {
+				if err := marshal(sasl2.RequestToken{Mechanism: tokenMech}); err != nil {
+					return nil, "", err
+				}
+			}
+		}
+	}
+
+	if c.sm != nil && f.Authentication.SM != nil {
+		c.sm.mu.Lock()
+		resume := c.sm.canResume()
+		req := sm.Resume{H: c.sm.counts.InboundCount(), PrevID: c.sm.id}
+		c.sm.mu.Unlock()
+		if resume {
+			if err := marshal(req); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if bind != nil {
+		el, err := bind.Element()
+		if err != nil {
+			return nil, "", err
+		}
+		if err := marshal(el); err != nil {
+			return nil, "", err
+		}
+	}
+
+	initial, err := mech.Start()
+	if err != nil {
+		return nil, "", err
+	}
+	auth := sasl2.Authenticate{
+		Mechanism:       mech.Name(),
+		InitialResponse: base64.StdEncoding.EncodeToString(initial),
+		Inline:          bytes.Join(inline, nil),
+	}
+	if cfg.UserAgent != (sasl2.UserAgent{}) {
+		auth.UserAgent = &cfg.UserAgent
+	}
+	if err := s.SendElement(ctx, auth); err != nil {
+		return nil, "", err
+	}
+
+	for {
+		start, err := nextElement(s)
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case start.Name.Space == ns.SASL2 && start.Name.Local == "challenge":
+			var ch sasl2.Challenge
+			if err := s.Reader().DecodeElement(&ch, &start); err != nil {
+				return nil, "", err
+			}
+			data, err := base64.StdEncoding.DecodeString(ch.Value)
+			if err != nil {
+				return nil, "", err
+			}
+			resp, err := mech.Next(data)
+			if err != nil {
+				return nil, "", err
+			}
+			if err := s.SendElement(ctx, sasl2.Response{Value: base64.StdEncoding.EncodeToString(resp)}); err != nil {
+				return nil, "", err
+			}
+		case start.Name.Space == ns.SASL2 && start.Name.Local == "success":
+			var success sasl2.Success
+			if err := s.Reader().DecodeElement(&success, &start); err != nil {
+				return nil, "", err
+			}
+			// The additional data proves that the server knew the
+			// password or token too.
+			if success.AdditionalData != "" || !mech.Completed() {
+				data, err := base64.StdEncoding.DecodeString(success.AdditionalData)
+				if err != nil {
+					return nil, "", err
+				}
+				if _, err := mech.Next(data); err != nil {
+					return nil, "", err
+				}
+			}
+			return &success, tokenMech, nil
+		case start.Name.Space == ns.SASL2 && start.Name.Local == "failure":
+			var failure sasl2Failure
+			if err := s.Reader().DecodeElement(&failure, &start); err != nil {
+				return nil, "", err
+			}
+			se := &SASL2Error{Text: failure.Text}
+			for _, cond := range failure.Conditions {
+				if cond.XMLName.Space == ns.SASL {
+					se.Condition = cond.XMLName.Local
+				}
+			}
+			return nil, "", se
+		default:
+			// Tasks (<continue/>) are not supported.
+			_ = s.Reader().Skip()
+			return nil, "", fmt.Errorf("xmpp: unexpected <%s> during SASL2", start.Name.Local)
+		}
+	}
+}
+
+// passwordMechanism picks the strongest offered mechanism for the
+// password: SCRAM bound to the TLS channel when possible, and PLAIN only on
+// a secure stream or with WithNoTLS.
+func (c *Client) passwordMechanism(s *Session, creds sasl.Credentials, offered []string) (sasl.Mechanism, error) {
+	var mechs []sasl.Mechanism
+	if len(creds.ChannelBinding) > 0 {
+		mechs = append(mechs, sasl.NewSCRAMSHA512Plus(creds), sasl.NewSCRAMSHA256Plus(creds), sasl.NewSCRAMSHA1Plus(creds))
+	}
+	mechs = append(mechs, sasl.NewSCRAMSHA512(creds), sasl.NewSCRAMSHA256(creds), sasl.NewSCRAMSHA1(creds))
+	if s.State()&StateSecure != 0 || c.opts.noTLS {
+		mechs = append(mechs, sasl.NewPlain(creds))
+	}
+	return sasl.NewNegotiator(creds, mechs...).Select(offered)
+}
+
+// fastMechanism returns the FAST mechanism to request a token for: the one
+// bound to the TLS channel when possible.
+func fastMechanism(offered []string, creds sasl.Credentials) string {
+	for _, name := range []string{"HT-SHA-256-EXPR", "HT-SHA-256-NONE"} {
+		if !slices.Contains(offered, name) {
+			continue
+		}
+		if _, err := sasl.NewHT(name, creds, "-"); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// authenticated applies a SASL2 success to s: a new FAST token is kept and
+// reported, a resumed stream picks up where the old one stopped, and a
+// Bind2 result makes s ready with the features enabled inline.
+func (c *Client) authenticated(s *Session, success *sasl2.Success, bind *sasl2.BindRequest, tokenMech string) error {
+	var extra sasl2Success
+	if err := xml.Unmarshal(append(append([]byte("<success>"), success.Inner...), "</success>"...), &extra); err != nil {
+		return err
+	}
+	if t := extra.Token; t != nil {
+		token := FastToken{Mechanism: tokenMech, Token: t.Token}
+		if exp, err := time.Parse(time.RFC3339, t.Expiry); err == nil {
+			token.Expiry = exp
+		}
+		c.fast = &token
+		if f := c.opts.sasl2.OnToken; f != nil {
+			f(token)
+		}
+	}
+
+	if c.sm != nil {
+		c.sm.attach(s)
+	}
+	if r := extra.Resumed; r != nil && c.sm != nil {
+		if local, err := jid.Parse(success.AuthzID); err == nil {
+			s.SetLocalAddr(local)
+		}
+		s.SetState(StateAuthenticated | StateBound | StateReady)
+		return c.sm.resumed(s, r.H)
+	}
+	if c.sm != nil {
+		// Whatever was not resumed is gone on the server.
+		c.sm.forget()
+	}
+	if bind == nil {
+		if local, err := jid.Parse(success.AuthzID); err == nil {
+			s.SetLocalAddr(local)
+		}
+		s.SetState(StateAuthenticated)
+		return nil
+	}
+	f, err := sasl2.ParseInline(success, *bind)
+	if err != nil {
+		return err
+	}
+	s.ApplyInlineFeatures(f)
+	if c.sm != nil && f.SMEnabled {
+		return c.sm.adopt(s, f)
+	}
+	return nil
+}
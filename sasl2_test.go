@@ -0,0 +1,416 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/sasl"
+)
+
+// sasl2Server is a minimal SASL2 server for user@example.com, offering
+// Bind2 with inline Stream Management and FAST.
+type sasl2Server struct {
+	t         *testing.T
+	password  string
+	tlsConfig *tls.Config // offered with STARTTLS when set
+
+	mu     sync.Mutex
+	token  string   // the FAST token accepted
+	issued int      // tokens issued so far
+	mechs  []string // mechanisms of the <authenticate/> elements received
+	inline []string // their inline payloads
+}
+
+func (srv *sasl2Server) dial(_ context.Context, _, _ string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	srv.t.Cleanup(func() { c2.Close() })
+	go srv.serve(c2)
+	return c1, nil
+}
+
+func (srv *sasl2Server) lookup(mechanism, username string) (sasl.SCRAMCredentials, error) {
+	if username != "user" {
+		return sasl.SCRAMCredentials{}, sasl.ErrUnknownUser
+	}
+	return sasl.NewSCRAMCredentials(mechanism, srv.password, []byte("salt"), 4096)
+}
+
+// openStream reads the client's stream header and answers with features.
+func openTestStream(conn net.Conn, dec *xml.Decoder, features string) error {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "stream" {
+			break
+		}
+	}
+	_, err := io.WriteString(conn, `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' id='s1' version='1.0'>`+
+		`<stream:features>`+features+`</stream:features>`)
+	return err
+}
+
+func nextStart(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+func (srv *sasl2Server) serve(conn net.Conn) {
+	dec := xml.NewDecoder(conn)
+	if srv.tlsConfig != nil {
+		if err := openTestStream(conn, dec, `<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>`); err != nil {
+			return
+		}
+		if _, err := nextStart(dec); err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, `<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`); err != nil {
+			return
+		}
+		tlsConn := tls.Server(conn, srv.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			srv.t.Errorf("server handshake: %v", err)
+			return
+		}
+		conn, dec = tlsConn, xml.NewDecoder(tlsConn)
+	}
+
+	var cb []byte
+	features := `<authentication xmlns='urn:xmpp:sasl:2'>` +
+		`<mechanism>SCRAM-SHA-256</mechanism><mechanism>PLAIN</mechanism>`
+	if tc, ok := conn.(*tls.Conn); ok {
+		cb, _ = sasl.TLSExporter(tc.ConnectionState())
+		features += `<mechanism>SCRAM-SHA-256-PLUS</mechanism>`
+	}
+	features += `<inline><fast xmlns='urn:xmpp:fast:0'><mechanism>HT-SHA-256-NONE</mechanism><mechanism>HT-SHA-256-EXPR</mechanism></fast>` +
+		`<bind xmlns='urn:xmpp:bind:0'><inline><feature var='urn:xmpp:csi:0'/><feature var='urn:xmpp:sm:3'/><feature var='urn:xmpp:carbons:2'/></inline></bind>` +
+		`<sm xmlns='urn:xmpp:sm:3'/></inline></authentication>`
+	if cb != nil {
+		features += `<sasl-channel-binding xmlns='urn:xmpp:sasl-cb:0'><channel-binding type='tls-exporter'/></sasl-channel-binding>`
+	}
+	if err := openTestStream(conn, dec, features); err != nil {
+		return
+	}
+
+	for {
+		start, err := nextStart(dec)
+		if err != nil {
+			return
+		}
+		var auth struct {
+			Mechanism string `xml:"mechanism,attr"`
+			Initial   string `xml:"initial-response"`
+			Inner     string `xml:",innerxml"`
+		}
+		if err := dec.DecodeElement(&auth, &start); err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.mechs = append(srv.mechs, auth.Mechanism)
+		srv.inline = append(srv.inline, auth.Inner)
+		token := srv.token
+		srv.mu.Unlock()
+		initial, _ := base64.StdEncoding.DecodeString(auth.Initial)
+
+		var additional []byte
+		switch {
+		case strings.HasPrefix(auth.Mechanism, "HT-"):
+			if _, err := sasl.VerifyHT(auth.Mechanism, token, cb, initial); err != nil || token == "" {
+				io.WriteString(conn, `<failure xmlns='urn:xmpp:sasl:2'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/></failure>`)
+				continue
+			}
+			additional, _ = sasl.HTResponder(auth.Mechanism, token, cb)
+		case strings.HasPrefix(auth.Mechanism, "SCRAM-"):
+			m, err := sasl.NewSCRAMServer(auth.Mechanism, srv.lookup, sasl.ChannelBinding{Type: sasl.CBTypeTLSExporter, Data: cb})
+			if err != nil {
+				srv.t.Errorf("server %s: %v", auth.Mechanism, err)
+				return
+			}
+			first, err := m.Next(initial)
+			if err != nil {
+				srv.t.Errorf("client-first: %v", err)
+				return
+			}
+			io.WriteString(conn, `<challenge xmlns='urn:xmpp:sasl:2'>`+base64.StdEncoding.EncodeToString(first)+`</challenge>`)
+			start, err := nextStart(dec)
+			if err != nil {
+				return
+			}
+			var resp sasl2.Response
+			if err := dec.DecodeElement(&resp, &start); err != nil {
+				return
+			}
+			data, _ := base64.StdEncoding.DecodeString(resp.Value)
+			if additional, err = m.Next(data); err != nil {
+				io.WriteString(conn, `<failure xmlns='urn:xmpp:sasl:2'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/><text>wrong password</text></failure>`)
+				continue
+			}
+		default:
+			srv.t.Errorf("unexpected mechanism %s", auth.Mechanism)
+			return
+		}
+
+		success := `<success xmlns='urn:xmpp:sasl:2'><additional-data>` + base64.StdEncoding.EncodeToString(additional) + `</additional-data>`
+		if strings.Contains(auth.Inner, "<resume") {
+			success += `<authorization-identifier>user@example.com/bot-1</authorization-identifier><resumed xmlns='urn:xmpp:sm:3' h='0' previd='sm1'/>`
+		} else {
+			success += `<authorization-identifier>user@example.com/bot-1</authorization-identifier>` +
+				`<bound xmlns='urn:xmpp:bind:0'><enabled xmlns='urn:xmpp:sm:3' id='sm1' resume='true' max='60'/></bound>`
+		}
+		if strings.Contains(auth.Inner, "request-token") || strings.HasPrefix(auth.Mechanism, "HT-") {
+			srv.mu.Lock()
+			srv.issued++
+			srv.token = "token-" + string(rune('0'+srv.issued))
+			success += `<token xmlns='urn:xmpp:fast:0' token='` + srv.token + `' expiry='2099-01-01T00:00:00Z'/>`
+			srv.mu.Unlock()
+		}
+		io.WriteString(conn, success+`</success>`)
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+}
+
+func (srv *sasl2Server) received() (mechs, inline []string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.mechs...), append([]string(nil), srv.inline...)
+}
+
+func TestClientSASL2BindsInline(t *testing.T) {
+	t.Parallel()
+	srv := &sasl2Server{t: t, password: "secret"}
+	var tokens []FastToken
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(srv.dial),
+		WithNoTLS(),
+		WithStreamManagement(time.Minute),
+		WithSASL2(SASL2Config{
+			UserAgent: sasl2.UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770", Software: "bot"},
+			Tag:       "bot",
+			FAST:      true,
+			OnToken:   func(tok FastToken) { tokens = append(tokens, tok) },
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnableCarbons(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	s := c.Session()
+	if s.LocalAddr().String() != "user@example.com/bot-1" || s.State()&StateReady == 0 {
+		t.Fatalf("session %s in state %b", s.LocalAddr(), s.State())
+	}
+	if f, ok := s.InlineFeatures(); !ok || !f.SMEnabled || !f.CarbonsEnabled {
+		t.Fatalf("inline features %+v", f)
+	}
+	c.sm.mu.Lock()
+	active, id := c.sm.active, c.sm.id
+	c.sm.mu.Unlock()
+	if !active || id != "sm1" {
+		t.Errorf("stream management active=%v id=%q", active, id)
+	}
+
+	mechs, inline := srv.received()
+	if len(mechs) != 1 || mechs[0] != "SCRAM-SHA-256" {
+		t.Fatalf("mechanisms %v", mechs)
+	}
+	for _, want := range []string{"<user-agent", "d4565fa7", "<request-token", "HT-SHA-256-NONE", "<bind", "<tag>bot</tag>", "urn:xmpp:carbons:2", "urn:xmpp:sm:3"} {
+		if !strings.Contains(inline[0], want) {
+			t.Errorf("authenticate lacks %s: %s", want, inline[0])
+		}
+	}
+	if len(tokens) != 1 || tokens[0].Mechanism != "HT-SHA-256-NONE" || tokens[0].Token != "token-1" || tokens[0].Expiry.Year() != 2099 {
+		t.Fatalf("tokens %+v", tokens)
+	}
+
+	// The next connection uses the token instead of the password.
+	c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("second Connect: %v", err)
+	}
+	mechs, inline = srv.received()
+	if len(mechs) != 2 || mechs[1] != "HT-SHA-256-NONE" || !strings.Contains(inline[1], "urn:xmpp:fast:0") {
+		t.Fatalf("second authentication %v: %s", mechs, inline[len(inline)-1])
+	}
+	if len(tokens) != 2 || tokens[1].Token != "token-2" {
+		t.Fatalf("rotated tokens %+v", tokens)
+	}
+}
+
+func TestClientSASL2FallsBackFromStaleToken(t *testing.T) {
+	t.Parallel()
+	srv := &sasl2Server{t: t, password: "secret"}
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(srv.dial),
+		WithNoTLS(),
+		WithSASL2(SASL2Config{
+			FAST:  true,
+			Token: &FastToken{Mechanism: "HT-SHA-256-NONE", Token: "revoked"},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if mechs, _ := srv.received(); len(mechs) != 2 || mechs[0] != "HT-SHA-256-NONE" || mechs[1] != "SCRAM-SHA-256" {
+		t.Fatalf("mechanisms %v", mechs)
+	}
+}
+
+func TestClientSASL2WrongPassword(t *testing.T) {
+	t.Parallel()
+	srv := &sasl2Server{t: t, password: "secret"}
+	c, err := NewClient(jid.MustParse("user@example.com"), "wrong",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(srv.dial),
+		WithNoTLS(),
+		WithSASL2(SASL2Config{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect(context.Background())
+	var se *SASL2Error
+	if !errors.As(err, &se) || se.Condition != "not-authorized" || se.Text != "wrong password" {
+		t.Fatalf("Connect = %v", err)
+	}
+	if c.Session() != nil {
+		t.Error("session kept after a failed authentication")
+	}
+}
+
+func TestClientSASL2ChannelBinding(t *testing.T) {
+	t.Parallel()
+	pool, certs := s2sCertificates(t, "example.com")
+	srv := &sasl2Server{t: t, password: "secret", tlsConfig: &tls.Config{
+		Certificates: []tls.Certificate{certs["example.com"]},
+		MinVersion:   tls.VersionTLS13,
+	}}
+	var tokens []FastToken
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(srv.dial),
+		WithClientTLS(&tls.Config{RootCAs: pool}),
+		WithSASL2(SASL2Config{FAST: true, OnToken: func(tok FastToken) { tokens = append(tokens, tok) }}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if c.Session().State()&StateSecure == 0 {
+		t.Fatal("STARTTLS did not secure the session")
+	}
+	mechs, inline := srv.received()
+	if len(mechs) != 1 || mechs[0] != "SCRAM-SHA-256-PLUS" || !strings.Contains(inline[0], "HT-SHA-256-EXPR") {
+		t.Fatalf("mechanisms %v: %s", mechs, inline)
+	}
+	if len(tokens) != 1 || tokens[0].Mechanism != "HT-SHA-256-EXPR" {
+		t.Fatalf("tokens %+v", tokens)
+	}
+
+	c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("second Connect: %v", err)
+	}
+	if mechs, _ := srv.received(); len(mechs) != 2 || mechs[1] != "HT-SHA-256-EXPR" {
+		t.Fatalf("second authentication %v", mechs)
+	}
+}
+
+func TestClientSASL2RequiresTLS(t *testing.T) {
+	t.Parallel()
+	srv := &sasl2Server{t: t, password: "secret"}
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(srv.dial),
+		WithSASL2(SASL2Config{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); !errors.Is(err, ErrTLSRequired) {
+		t.Fatalf("Connect = %v", err)
+	}
+	if mechs, _ := srv.received(); len(mechs) != 0 {
+		t.Fatalf("authenticated in the clear with %v", mechs)
+	}
+}
+
+func TestClientCloseAbandonsSASL2(t *testing.T) {
+	t.Parallel()
+	// The server reads the stream header and never answers.
+	stalled := func(_ context.Context, _, _ string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c2.Close() })
+		go io.Copy(io.Discard, c2)
+		return c1, nil
+	}
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret",
+		WithResolver(clientRecords("", "xmpp.example.net")),
+		WithDialer(stalled),
+		WithNoTLS(),
+		WithSASL2(SASL2Config{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan error, 1)
+	go func() { connected <- c.Connect(context.Background()) }()
+
+	// Close must not wait for the negotiation, and ends it.
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked on the negotiation")
+	}
+	select {
+	case err := <-connected:
+		if err == nil {
+			t.Fatal("Connect succeeded after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect still negotiating after Close")
+	}
+	if c.Session() != nil {
+		t.Error("session set after Close")
+	}
+}
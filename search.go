@@ -0,0 +1,49 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Search looks up users at the XEP-0055 search service. It fetches the
+// service's search form, fills it with criteria keyed by field var (such as
+// search.FieldNick), submits it and returns the users found.
+func (s *Session) Search(ctx context.Context, service jid.JID, criteria map[string]string) ([]search.Result, error) {
+	offered, err := s.searchIQ(ctx, service, stanza.IQGet, search.Query{})
+	if err != nil {
+		return nil, err
+	}
+	req, err := search.Request(offered, criteria)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.searchIQ(ctx, service, stanza.IQSet, req)
+	if err != nil {
+		return nil, err
+	}
+	return search.Results(found), nil
+}
+
+func (s *Session) searchIQ(ctx context.Context, service jid.JID, typ string, q search.Query) (search.Query, error) {
+	payload, err := xml.Marshal(q)
+	if err != nil {
+		return search.Query{}, err
+	}
+	iq := stanza.NewIQ(typ)
+	iq.To = service
+	iq.Query = payload
+
+	reply, err := s.SendIQ(ctx, iq)
+	if err != nil {
+		return search.Query{}, err
+	}
+	var out search.Query
+	if err := xml.Unmarshal(reply.Query, &out); err != nil {
+		return search.Query{}, err
+	}
+	return out, nil
+}
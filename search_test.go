@@ -0,0 +1,52 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/search"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestSessionSearch(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		return nil
+	}))
+
+	dir := search.NewMemoryDirectory()
+	dir.List(search.Entry{JID: "juliet@example.org", First: "Juliet", Nick: "jc"})
+	dir.List(search.Entry{JID: "romeo@example.org", First: "Romeo"})
+	service := search.New()
+	service.SetDirectory(dir)
+
+	go func() {
+		dec := xml.NewDecoder(peer)
+		enc := xml.NewEncoder(peer)
+		for {
+			var iq stanza.IQ
+			if err := dec.Decode(&iq); err != nil {
+				return
+			}
+			if err := enc.Encode(service.HandleIQ(context.Background(), &iq)); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	results, err := s.Search(ctx, jid.MustParse("search.example.org"), map[string]string{search.FieldFirst: "jul"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 1 || results[0].JID != "juliet@example.org" || results[0].Fields[search.FieldNick] != "jc" {
+		t.Fatalf("results = %+v", results)
+	}
+}
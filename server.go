@@ -3,11 +3,15 @@ package xmpp
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 
 	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/plugin"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/stream"
 	"github.com/meszmate/xmpp-go/transport"
 )
 
@@ -19,7 +23,13 @@ type Server struct {
 	sessions map[string]*Session
 	plugins  *plugin.Manager
 	opts     serverOptions
+	conns    *connLimiter
+	firewall *Firewall
+	s2s      *S2S
 	closed   chan struct{}
+
+	onShutdown []func(context.Context, *Session)
+	drained    chan struct{} // closed by untrack once Shutdown has no sessions left
 }
 
 // NewServer creates a new XMPP server.
@@ -33,6 +43,48 @@ func NewServer(domain string, opts ...ServerOption) (*Server, error) {
 	for _, opt := range opts {
 		opt.apply(&s.opts)
 	}
+	if s.opts.storage != nil {
+		s.opts.storage = storage.LimitRosterItems(s.opts.storage, s.opts.maxRosterItems)
+		if m := s.opts.metrics; m != nil {
+			s.opts.storage = storage.Instrument(s.opts.storage, m.StorageOp)
+		}
+	}
+	s.conns = newConnLimiter(s.opts.maxConnsPerIP, s.opts.maxTotalConns)
+	if len(s.opts.rules) > 0 {
+		cfg := FirewallConfig{Rules: s.opts.rules, Domain: domain, Logger: s.opts.logger, Clock: s.opts.clock}
+		if s.opts.storage != nil {
+			cfg.Roster = s.opts.storage.RosterStore()
+		}
+		f, err := NewFirewall(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.firewall = f
+	}
+
+	if cfg := s.opts.s2s; cfg != nil {
+		if cfg.Clock == nil {
+			cfg.Clock = s.opts.clock
+		}
+		if cfg.Limits == (StreamLimits{}) {
+			cfg.Limits = s.opts.streamLimits
+		}
+		if cfg.Metrics == nil {
+			cfg.Metrics = s.opts.metrics
+		}
+		if cfg.Tracer == nil {
+			cfg.Tracer = s.opts.tracer
+		}
+		if cfg.Logger == nil {
+			cfg.Logger = s.opts.logger
+		}
+		cfg.StreamDump = cfg.StreamDump || s.opts.streamDump
+		x, err := NewS2S(domain, *cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.s2s = x
+	}
 
 	return s, nil
 }
@@ -65,10 +117,17 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 			LocalJID: func() string { return s.domain },
 			RemoteJID: func() string { return "" },
 			Storage:  s.opts.storage,
+			Clock:    s.opts.clock,
 		}
 		if err := mgr.Initialize(ctx, params); err != nil {
 			return err
 		}
+		for _, p := range mgr.Plugins() {
+			if su, ok := p.(plugin.StorageUser); ok && !su.StorageAvailable() {
+				_ = mgr.Close()
+				return fmt.Errorf("xmpp: plugin %s: %w", p.Name(), storage.ErrStorageUnavailable)
+			}
+		}
 		s.plugins = mgr
 	}
 
@@ -86,7 +145,19 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 			return certErr
 		}
 		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, err = tls.Listen("tcp", addr, tlsConfig)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		if err := s.opts.sessionTickets.Apply(ctx, tlsConfig); err != nil {
+			return err
+		}
+		if s.opts.listener != nil {
+			listener = tls.NewListener(s.opts.listener, tlsConfig)
+		} else {
+			listener, err = tls.Listen("tcp", addr, tlsConfig)
+		}
+	} else if s.opts.listener != nil {
+		listener = s.opts.listener
 	} else {
 		listener, err = net.Listen("tcp", addr)
 	}
@@ -95,6 +166,13 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 		return err
 	}
 
+	if s.s2s != nil {
+		if err := s.listenS2S(ctx); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
 	s.mu.Lock()
 	s.listener = listener
 	s.mu.Unlock()
@@ -122,8 +200,90 @@ func (s *Server) serve(ctx context.Context, listener net.Listener) error {
 			}
 		}
 
-		go s.handleConn(ctx, conn)
+		ip := remoteIP(conn.RemoteAddr())
+		if p := s.opts.limitPolicy; p != nil && !p.AllowConnection(ip) {
+			s.conns.reject()
+			conn.Close()
+			continue
+		}
+		if !s.conns.acquire(ip) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.conns.release(ip)
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// listenS2S starts accepting server-to-server streams. Without a TLS config
+// of their own they use the server's certificate.
+func (s *Server) listenS2S(ctx context.Context) error {
+	if s.s2s.cfg.TLSConfig == nil && s.opts.tlsCert != "" && s.opts.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.opts.tlsCert, s.opts.tlsKey)
+		if err != nil {
+			return err
+		}
+		s.s2s.cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.s2s.serverTLS, s.s2s.clientTLS = s2sTLSConfigs(s.s2s.cfg.TLSConfig)
+	}
+	ln, err := s.s2s.listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.s2s.serve(ctx, ln); err != nil {
+			loggerOr(s.s2s.cfg.Logger).Log(ctx, slog.LevelError, "xmpp: s2s listener failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// S2S returns the server-to-server router enabled with WithServerS2S, or
+// nil.
+func (s *Server) S2S() *S2S {
+	return s.s2s
+}
+
+// Storage returns the storage set with WithServerStorage as the server uses
+// it, with the roster limit applied and instrumented for WithServerMetrics,
+// or nil.
+func (s *Server) Storage() storage.Storage {
+	return s.opts.storage
+}
+
+// BOSHHandler returns an http.Handler that accepts BOSH sessions
+// (XEP-0124/0206) and passes them to the server's session handler like TCP
+// connections. Mount it on an HTTP server, conventionally at /http-bind.
+// Its sessions are counted by SessionCount and closed by Close.
+func (s *Server) BOSHHandler(cfg BOSHConfig) *BOSHHandler {
+	// Request bodies are bounded by BOSHConfig.MaxBody and arrive at the
+	// pace of HTTP requests, so only the size and depth limits apply.
+	limits := s.opts.streamLimits
+	limits.ReadRate, limits.ReadBurst = 0, 0
+	h := NewBOSHHandler(s.domain, cfg, s.opts.sessionHandler,
+		WithClock(s.opts.clock), WithStreamLimits(limits), WithMetrics(s.opts.metrics), WithTracer(s.opts.tracer),
+		WithLogger(s.opts.logger), withStreamDump(s.opts.streamDump),
+		WithLimitPolicy(s.opts.limitPolicy), WithFirewall(s.firewall))
+	h.track = func(key string, session *Session) func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-s.closed:
+			return nil
+		default:
+		}
+		s.sessions[key] = session
+		return func() { s.untrack(key) }
 	}
+	return h
+}
+
+// ConnStats returns the number of open connections, in total and by client
+// IP address, and how many were rejected by the connection limits.
+func (s *Server) ConnStats() ConnStats {
+	return s.conns.stats()
 }
 
 func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
@@ -132,21 +292,37 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 	session, err := NewSession(ctx, trans,
 		WithState(StateServer),
 		WithRemoteAddr(jid.JID{}),
+		WithClock(s.opts.clock),
+		WithStreamLimits(s.opts.streamLimits),
+		WithMetrics(s.opts.metrics),
+		WithTracer(s.opts.tracer),
+		WithLogger(s.opts.logger),
+		withStreamDump(s.opts.streamDump),
+		WithLimitPolicy(s.opts.limitPolicy),
+		WithFirewall(s.firewall),
 	)
 	if err != nil {
 		conn.Close()
 		return
 	}
 
+	key := conn.RemoteAddr().String()
 	s.mu.Lock()
-	s.sessions[conn.RemoteAddr().String()] = session
+	select {
+	case <-s.closed:
+		// Accepted while the server was shutting down.
+		s.mu.Unlock()
+		_ = session.SendStreamError(ctx, stream.NewError(stream.ErrSystemShutdown, ""))
+		session.Close()
+		return
+	default:
+	}
+	s.sessions[key] = session
 	s.mu.Unlock()
 
 	defer func() {
 		session.Close()
-		s.mu.Lock()
-		delete(s.sessions, conn.RemoteAddr().String())
-		s.mu.Unlock()
+		s.untrack(key)
 	}()
 
 	if s.opts.sessionHandler != nil {
@@ -154,13 +330,93 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 	}
 }
 
-// Close stops the server.
-func (s *Server) Close() error {
+// untrack forgets the session stored under key, telling a Shutdown waiting
+// for the sessions to end when it was the last one.
+func (s *Server) untrack(key string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	delete(s.sessions, key)
+	if len(s.sessions) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// RegisterOnShutdown registers f to be called by Shutdown for every open
+// session before its stream is ended, for example to move the stanzas a
+// client has not acknowledged into offline storage. The functions run
+// concurrently for different sessions.
+func (s *Server) RegisterOnShutdown(f func(ctx context.Context, session *Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections,
+// calls the functions registered with RegisterOnShutdown for every open
+// session, ends the streams with a system-shutdown stream error and waits
+// for the sessions to close, so their handlers can finish storing what
+// they hold. Sessions still open when ctx is done are closed, and
+// Shutdown returns ctx.Err(). The S2S streams, plugins and storage are then
+// closed as by Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+		close(s.closed)
+	}
+	var firstErr error
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			firstErr = err
+		}
+	}
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	hooks := s.onShutdown
+	drained := make(chan struct{})
+	if len(sessions) == 0 {
+		close(drained)
+	} else {
+		s.drained = drained
+	}
+	s.mu.Unlock()
+
+	shutdown := stream.NewError(stream.ErrSystemShutdown, "")
+	for _, session := range sessions {
+		go func() {
+			for _, f := range hooks {
+				f(ctx, session)
+			}
+			_ = session.SendStreamError(ctx, shutdown)
+		}()
+	}
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		firstErr = ctx.Err()
+		s.mu.Lock()
+		for _, session := range s.sessions {
+			_ = session.Close()
+		}
+		s.mu.Unlock()
+	}
+	return s.closeServices(firstErr)
+}
 
+// Close stops the server, closing the open sessions without waiting for
+// them. Use Shutdown to end them gracefully.
+func (s *Server) Close() error {
+	s.mu.Lock()
 	select {
 	case <-s.closed:
+		s.mu.Unlock()
 		return nil
 	default:
 		close(s.closed)
@@ -178,6 +434,22 @@ func (s *Server) Close() error {
 			firstErr = err
 		}
 	}
+	s.mu.Unlock()
+
+	return s.closeServices(firstErr)
+}
+
+// closeServices closes the S2S streams, plugins and storage of a stopped
+// server, returning firstErr or else the first error closing them.
+func (s *Server) closeServices(firstErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.s2s != nil {
+		if err := s.s2s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 
 	if s.plugins != nil {
 		if err := s.plugins.Close(); err != nil && firstErr == nil {
@@ -1,6 +1,9 @@
 package xmpp
 
 import (
+	"net"
+
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/plugin"
 	"github.com/meszmate/xmpp-go/storage"
 )
@@ -14,6 +17,20 @@ type serverOptions struct {
 	sessionHandler SessionHandlerFunc
 	storage        storage.Storage
 	plugins        []plugin.Plugin
+	clock          clock.Clock
+	maxRosterItems int
+	sessionTickets SessionTicketPolicy
+	listener       net.Listener
+	maxConnsPerIP  int
+	maxTotalConns  int
+	limitPolicy    LimitPolicy
+	rules          []Rule
+	s2s            *S2SConfig
+	streamLimits   StreamLimits
+	metrics        Metrics
+	tracer         Tracer
+	logger         Logger
+	streamDump     bool
 }
 
 // ServerOption configures a Server.
@@ -32,6 +49,53 @@ func WithServerAddr(addr string) ServerOption {
 	})
 }
 
+// WithServerListener makes the server accept connections on ln instead of
+// listening on the address set with WithServerAddr. Use it to put the server
+// behind a listener that decodes the PROXY protocol, so that connection
+// limits apply to the client's address rather than the proxy's.
+func WithServerListener(ln net.Listener) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.listener = ln
+	})
+}
+
+// WithMaxConnsPerIP limits the connections open at once from one IP address
+// to n. Connections over the limit are closed as soon as they are accepted,
+// before any stream negotiation. Zero or a negative value removes the limit.
+func WithMaxConnsPerIP(n int) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.maxConnsPerIP = n
+	})
+}
+
+// WithMaxTotalConns limits the connections open at once to n, closing
+// connections over the limit as soon as they are accepted. Zero or a
+// negative value removes the limit.
+func WithMaxTotalConns(n int) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.maxTotalConns = n
+	})
+}
+
+// WithServerLimitPolicy sets the policy that decides whether the server
+// accepts a connection and its sessions handle stanzas and let peers
+// authenticate, such as a RateLimiter. Refused connections are closed as
+// soon as they are accepted and counted by ConnStats.
+func WithServerLimitPolicy(p LimitPolicy) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.limitPolicy = p
+	})
+}
+
+// WithServerRules sets the rules that filter the stanzas of the server's
+// sessions, checked in order by a Firewall. Rules on the relation to the
+// recipient's roster read it from the storage set with WithServerStorage.
+func WithServerRules(rules []Rule) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.rules = rules
+	})
+}
+
 // WithServerTLS sets TLS certificate and key files.
 func WithServerTLS(cert, key string) ServerOption {
 	return serverOptionFunc(func(o *serverOptions) {
@@ -40,6 +104,14 @@ func WithServerTLS(cert, key string) ServerOption {
 	})
 }
 
+// WithServerSessionTickets sets the TLS session resumption policy of the
+// Direct TLS listener. Session tickets are enabled by default.
+func WithServerSessionTickets(p SessionTicketPolicy) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.sessionTickets = p
+	})
+}
+
 // WithServerAuth sets the authentication handler.
 func WithServerAuth(f AuthFunc) ServerOption {
 	return serverOptionFunc(func(o *serverOptions) {
@@ -67,3 +139,75 @@ func WithServerPlugins(plugins ...plugin.Plugin) ServerOption {
 		o.plugins = append(o.plugins, plugins...)
 	})
 }
+
+// WithServerClock sets the clock handed to sessions and plugins. It defaults
+// to clock.System.
+func WithServerClock(c clock.Clock) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.clock = c
+	})
+}
+
+// WithMaxRosterItems limits every account's roster to n items. Adding a
+// contact to a full roster fails with storage.ErrRosterLimit, which roster
+// handlers report as resource-constraint. Zero or a negative value removes
+// the limit.
+func WithMaxRosterItems(n int) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.maxRosterItems = n
+	})
+}
+
+// WithServerStreamLimits bounds what the server reads from each client
+// stream, and from server-to-server streams unless S2SConfig.Limits is set.
+// A client sending a larger or deeper stanza than allowed gets a
+// policy-violation stream error and is disconnected.
+func WithServerStreamLimits(l StreamLimits) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.streamLimits = l
+	})
+}
+
+// WithServerMetrics reports the server's sessions, their stanzas and the
+// latency of its storage to m. Sessions hand m to session handlers through
+// Session.Metrics, for the authentication failures and routing errors they
+// see. Server-to-server streams report to m unless S2SConfig.Metrics is set.
+func WithServerMetrics(m Metrics) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.metrics = m
+	})
+}
+
+// WithServerTracer starts a span with t around the handling of every
+// stanza that Session.Serve reads on the server's sessions.
+func WithServerTracer(t Tracer) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.tracer = t
+	})
+}
+
+// WithServerLogger sets where the server's sessions log; see WithLogger.
+// Server-to-server streams log there too unless S2SConfig.Logger is set.
+func WithServerLogger(l Logger) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.logger = l
+	})
+}
+
+// WithServerStreamDump logs the XML of every stream the server serves at
+// debug level; see WithStreamDump.
+func WithServerStreamDump() ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.streamDump = true
+	})
+}
+
+// WithServerS2S enables federation with other XMPP servers. ListenAndServe
+// then also accepts server-to-server streams, and stanzas for remote domains
+// can be sent with Server.S2S. When cfg has no TLS config, the certificate
+// set with WithServerTLS is used.
+func WithServerS2S(cfg S2SConfig) ServerOption {
+	return serverOptionFunc(func(o *serverOptions) {
+		o.s2s = &cfg
+	})
+}
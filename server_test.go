@@ -0,0 +1,220 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/plugins/pubsub"
+	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+func TestServerMaxRosterItems(t *testing.T) {
+	s, err := NewServer("example.com",
+		WithServerStorage(memory.New()),
+		WithMaxRosterItems(1),
+	)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	rs := s.opts.storage.RosterStore()
+	ctx := context.Background()
+
+	add := func(contact string) error {
+		return rs.UpsertRosterItem(ctx, &storage.RosterItem{
+			UserJID: "alice@example.com", ContactJID: contact, Subscription: "none",
+		})
+	}
+	if err := add("bob@example.com"); err != nil {
+		t.Fatalf("first item: %v", err)
+	}
+	if err := add("carol@example.com"); !errors.Is(err, storage.ErrRosterLimit) {
+		t.Fatalf("second item: %v, want ErrRosterLimit", err)
+	}
+}
+
+func TestServerNoRosterLimitByDefault(t *testing.T) {
+	s, err := NewServer("example.com", WithServerStorage(memory.New()))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	rs := s.opts.storage.RosterStore()
+	for _, contact := range []string{"bob@example.com", "carol@example.com", "dave@example.com"} {
+		if err := rs.UpsertRosterItem(context.Background(), &storage.RosterItem{
+			UserJID: "alice@example.com", ContactJID: contact, Subscription: "none",
+		}); err != nil {
+			t.Fatalf("UpsertRosterItem %s: %v", contact, err)
+		}
+	}
+}
+
+// storageOps records the storage calls reported to it.
+type storageOps struct {
+	nopMetrics
+	ops chan string
+}
+
+func (m storageOps) StorageOp(op string, _ time.Duration, err error) {
+	if err != nil {
+		op += ": " + err.Error()
+	}
+	m.ops <- op
+}
+
+func TestServerMetricsInstrumentsStorage(t *testing.T) {
+	m := storageOps{ops: make(chan string, 1)}
+	s, err := NewServer("example.com", WithServerStorage(memory.New()), WithServerMetrics(m))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if _, err := s.Storage().UserStore().GetUser(context.Background(), "alice"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if op := <-m.ops; op != "GetUser: "+storage.ErrNotFound.Error() {
+		t.Fatalf("op = %q", op)
+	}
+}
+
+func TestServerRefusesPluginWithoutStorage(t *testing.T) {
+	s, err := NewServer("example.com",
+		WithServerAddr("127.0.0.1:0"),
+		WithServerPlugins(pubsub.New()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	err = s.ListenAndServe(context.Background())
+	if !errors.Is(err, storage.ErrStorageUnavailable) {
+		t.Fatalf("ListenAndServe: %v, want ErrStorageUnavailable", err)
+	}
+}
+
+// startShutdownServer serves sessions on a local listener until their
+// peer ends the stream, reporting each session when its handler returns.
+func startShutdownServer(t *testing.T) (*Server, string, <-chan *Session, <-chan *Session) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan *Session, 4)
+	finished := make(chan *Session, 4)
+	s, err := NewServer("example.com",
+		WithServerListener(ln),
+		WithServerSessionHandler(func(_ context.Context, session *Session) {
+			started <- session
+			_ = session.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error { return nil }))
+			finished <- session
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ListenAndServe(context.Background()) }()
+	return s, ln.Addr().String(), started, finished
+}
+
+func dialStream(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := io.WriteString(c, `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' to='example.com' version='1.0'>`); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, addr, started, finished := startShutdownServer(t)
+	hooked := make(chan *Session, 1)
+	s.RegisterOnShutdown(func(_ context.Context, session *Session) { hooked <- session })
+
+	c := dialStream(t, addr)
+	session := <-started
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	// The client is told why its stream ends, and Shutdown waits for it to
+	// close the stream.
+	r := bufio.NewReader(c)
+	var out string
+	var err error
+	for err == nil && !strings.HasSuffix(out, "</stream:stream>") {
+		var more string
+		more, err = r.ReadString('>')
+		out += more
+	}
+	if err != nil || !strings.Contains(out, "<system-shutdown") {
+		t.Fatalf("client received %q: %v", out, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the stream was closed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := io.WriteString(c, "</stream:stream>"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case got := <-finished:
+		if got != session {
+			t.Fatal("another session finished")
+		}
+	default:
+		t.Fatal("Shutdown returned before the session handler")
+	}
+	if got := <-hooked; got != session {
+		t.Fatal("shutdown hook called for another session")
+	}
+
+	// No connections are accepted afterwards.
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("dial after Shutdown succeeded")
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	s, addr, started, finished := startShutdownServer(t)
+	c := dialStream(t, addr)
+	<-started
+
+	// The client never closes its stream, so Shutdown closes the
+	// connection when its deadline passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("reading closed stream: %v", err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session handler did not return")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close after Shutdown: %v", err)
+	}
+}
@@ -7,13 +7,22 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/internal/ns"
 	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
 	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
 	"github.com/meszmate/xmpp-go/transport"
 	xmppxml "github.com/meszmate/xmpp-go/xml"
 )
 
+// ErrAlreadyServing is returned by Serve if another goroutine is already
+// reading from the session.
+var ErrAlreadyServing = errors.New("xmpp: session is already being served")
+
 // SessionState represents the state of an XMPP session.
 type SessionState uint32
 
@@ -37,28 +46,88 @@ type Session struct {
 	writer    *xmppxml.StreamWriter
 	mux       *Mux
 	closed    chan struct{}
+	ready     chan struct{} // closed once StateReady is set
 	err       error
+	serving   atomic.Bool
+
+	featuresMu sync.RWMutex
+	features   map[xml.Name]struct{}
+	onFeatures func()
+
+	pending      iqTracker
+	requests     iqTracker
+	maxPendingIQ int
+	iqTimeout    time.Duration
+
+	lastRecv atomic.Int64
+	clock    clock.Clock
+
+	metrics  Metrics
+	tracer   Tracer
+	limits   LimitPolicy
+	firewall *Firewall
+
+	id        string
+	logger    Logger
+	direction string
+	wire      wire
+
+	inline atomic.Pointer[sasl2.InlineFeatures]
+	lang   atomic.Pointer[string]
+	sm     atomic.Pointer[streamMgmt]
 }
 
 // NewSession creates a new XMPP session with the given transport and options.
 func NewSession(ctx context.Context, trans transport.Transport, opts ...SessionOption) (*Session, error) {
 	s := &Session{
 		trans:  trans,
-		reader: xmppxml.NewStreamReader(trans),
-		writer: xmppxml.NewStreamWriter(trans),
 		mux:    NewMux(),
 		closed: make(chan struct{}),
+		ready:  make(chan struct{}),
+
+		maxPendingIQ: DefaultMaxPendingIQ,
+		iqTimeout:    DefaultIQTimeout,
+		clock:        clock.System,
+		metrics:      nopMetrics{},
+		id:           newSessionID(),
+		logger:       defaultLogger{},
 	}
+	s.wire.s = s
+	s.reader = xmppxml.NewStreamReader(&s.wire)
+	s.writer = xmppxml.NewStreamWriter(&s.wire)
 
 	for _, opt := range opts {
 		opt.apply(s)
 	}
+	if s.direction == "" {
+		s.direction = DirectionOutbound
+		if s.State()&StateServer != 0 {
+			s.direction = DirectionInbound
+		}
+	}
+	s.metrics.SessionStarted()
 
 	return s, nil
 }
 
-// Send sends a stanza through the session.
+// Send sends a stanza through the session. A stanza the outbound rules of
+// the firewall set with WithFirewall drop is not sent, and one they bounce
+// is not sent either and returns the rule's *stanza.StanzaError, for the
+// caller to answer its sender with.
 func (s *Session) Send(ctx context.Context, st stanza.Stanza) error {
+	if s.firewall != nil {
+		from := st.GetHeader().From
+		if from.IsZero() {
+			from = s.LocalAddr()
+		}
+		switch v := s.firewall.Check(ctx, RuleOutbound, from, st); v.Action {
+		case ActionPass:
+		case ActionBounce:
+			return v.Error
+		default:
+			return nil
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -69,8 +138,13 @@ func (s *Session) Send(ctx context.Context, st stanza.Stanza) error {
 		return errors.New("xmpp: session closed")
 	default:
 	}
+	defer s.writeDeadline(ctx)()
 
-	return s.writer.Encode(st)
+	if err := s.encode(st); err != nil {
+		return err
+	}
+	s.metrics.StanzaSent(st.StanzaType(), st.GetHeader().Type)
+	return nil
 }
 
 // SendRaw writes raw XML to the stream.
@@ -85,11 +159,15 @@ func (s *Session) SendRaw(ctx context.Context, r io.Reader) error {
 		return errors.New("xmpp: session closed")
 	default:
 	}
+	defer s.writeDeadline(ctx)()
 
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	if m := s.sm.Load(); m != nil {
+		return m.writeRaw(s, data)
+	}
 	_, err = s.writer.WriteRaw(data)
 	return err
 }
@@ -106,12 +184,52 @@ func (s *Session) SendElement(ctx context.Context, v any) error {
 		return errors.New("xmpp: session closed")
 	default:
 	}
+	defer s.writeDeadline(ctx)()
 
+	return s.encode(v)
+}
+
+// encode writes v, counting the stanzas among it when stream management is
+// enabled. s.mu is held.
+func (s *Session) encode(v any) error {
+	if m := s.sm.Load(); m != nil {
+		return m.encode(s, v)
+	}
 	return s.writer.Encode(v)
 }
 
+// writeDeadliner is implemented by transports that support write deadlines.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeDeadline applies the deadline of ctx, if any, to the next write so that
+// a stalled connection cannot block a sender past its context. The returned
+// function clears the deadline again.
+func (s *Session) writeDeadline(ctx context.Context) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return func() {}
+	}
+	wd, ok := s.trans.(writeDeadliner)
+	if !ok {
+		return func() {}
+	}
+	_ = wd.SetWriteDeadline(deadline)
+	return func() { _ = wd.SetWriteDeadline(time.Time{}) }
+}
+
 // Serve reads stanzas from the stream and dispatches them to the mux.
+// Each stanza is handled with a context carrying a new trace ID.
+// If the peer sends a stream error, Serve returns it as a *stream.Error.
+// Only one Serve call may run at a time; a concurrent call returns
+// ErrAlreadyServing.
 func (s *Session) Serve(handler Handler) error {
+	if !s.serving.CompareAndSwap(false, true) {
+		return ErrAlreadyServing
+	}
+	defer s.serving.Store(false)
+
 	if handler == nil {
 		handler = s.mux
 	}
@@ -127,47 +245,216 @@ func (s *Session) Serve(handler Handler) error {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
-			return err
+			return s.readFailed(err)
 		}
 
 		start, ok := tok.(xml.StartElement)
 		if !ok {
 			continue
 		}
+		s.lastRecv.Store(s.clock.Now().UnixNano())
+
+		if start.Name.Space == ns.Stream {
+			switch start.Name.Local {
+			case "stream":
+				// A (restarted) stream header; its children are read by this loop.
+				s.setStreamLang(&start)
+				continue
+			case "features":
+				if err := s.readStreamFeatures(&start); err != nil {
+					return s.readFailed(err)
+				}
+				continue
+			case "error":
+				se := &stream.Error{}
+				if err := s.reader.DecodeElement(se, &start); err != nil {
+					return s.readFailed(err)
+				}
+				return se
+			}
+		}
+		if start.Name.Space == ns.SM {
+			if m := s.sm.Load(); m != nil {
+				if err := m.handle(s, &start); err != nil {
+					return s.readFailed(err)
+				}
+			} else if err := s.reader.Skip(); err != nil {
+				return s.readFailed(err)
+			}
+			continue
+		}
 
 		var st stanza.Stanza
 		switch start.Name.Local {
 		case "message":
 			msg := &stanza.Message{}
 			if err := s.reader.DecodeElement(msg, &start); err != nil {
-				return err
+				return s.readFailed(err)
 			}
 			st = msg
+			if m := s.sm.Load(); m != nil {
+				m.received(s)
+			}
 		case "presence":
 			pres := &stanza.Presence{}
 			if err := s.reader.DecodeElement(pres, &start); err != nil {
-				return err
+				return s.readFailed(err)
 			}
 			st = pres
+			if m := s.sm.Load(); m != nil {
+				m.received(s)
+			}
 		case "iq":
 			iq := &stanza.IQ{}
 			if err := s.reader.DecodeElement(iq, &start); err != nil {
-				return err
+				return s.readFailed(err)
+			}
+			if m := s.sm.Load(); m != nil {
+				m.received(s)
+			}
+			if s.pending.resolve(iq, iq.From, s.LocalAddr()) || s.ResolveRequest(iq) {
+				continue
 			}
 			st = iq
 		default:
 			if err := s.reader.Skip(); err != nil {
-				return err
+				return s.readFailed(err)
 			}
 			continue
 		}
 
-		if err := handler.HandleStanza(context.Background(), s, st); err != nil {
+		h := st.GetHeader()
+		if h.Lang == "" {
+			h.Lang = s.StreamLang()
+		}
+		s.metrics.StanzaReceived(st.StanzaType(), h.Type)
+		ctx := WithTraceID(context.Background(), NewTraceID())
+		if ok, err := s.AllowStanza(ctx, st); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ok, err := s.FilterStanza(ctx, st); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.handle(ctx, handler, st); err != nil {
 			return err
 		}
 	}
 }
 
+// readFailed handles an error reading from the stream. When the peer sent
+// XML that is not well-formed, such as a character XML forbids, or crossed
+// the limits of the reader, the stream is closed with a stream error before
+// err is returned.
+func (s *Session) readFailed(err error) error {
+	if se := stream.ForReadError(err); se != nil {
+		_ = s.SendStreamError(context.Background(), se)
+		_ = s.Close()
+	}
+	return err
+}
+
+// StreamLang returns the default language declared by the xml:lang of the
+// peer's stream header, or "" if it declared none. Serve sets it as the
+// Lang of incoming stanzas that do not carry their own, so their bodies and
+// subjects without xml:lang are taken to be in this language.
+func (s *Session) StreamLang() string {
+	if lang := s.lang.Load(); lang != nil {
+		return *lang
+	}
+	return ""
+}
+
+func (s *Session) setStreamLang(start *xml.StartElement) {
+	lang := ""
+	for _, attr := range start.Attr {
+		if attr.Name.Space == ns.XML && attr.Name.Local == "lang" {
+			lang = attr.Value
+		}
+	}
+	s.lang.Store(&lang)
+}
+
+// LastReceived returns the time the last element was read from the stream,
+// or the zero time if nothing has been received yet.
+func (s *Session) LastReceived() time.Time {
+	n := s.lastRecv.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Clock returns the clock the session reads the current time from.
+func (s *Session) Clock() clock.Clock {
+	return s.clock
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// streamFeatures is used to record the children of <stream:features/>.
+type streamFeatures struct {
+	Features []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (s *Session) readStreamFeatures(start *xml.StartElement) error {
+	var f streamFeatures
+	if err := s.reader.DecodeElement(&f, start); err != nil {
+		return err
+	}
+	names := make([]xml.Name, 0, len(f.Features))
+	for _, feat := range f.Features {
+		names = append(names, feat.XMLName)
+	}
+	s.SetStreamFeatures(names...)
+
+	s.featuresMu.RLock()
+	onFeatures := s.onFeatures
+	s.featuresMu.RUnlock()
+	if onFeatures != nil {
+		onFeatures()
+	}
+	return nil
+}
+
+// OnStreamFeatures registers a callback that Serve invokes each time the peer
+// advertises its stream features, after they have been recorded.
+func (s *Session) OnStreamFeatures(f func()) {
+	s.featuresMu.Lock()
+	defer s.featuresMu.Unlock()
+	s.onFeatures = f
+}
+
+// SetStreamFeatures records the stream features advertised by the peer,
+// replacing any previously recorded set.
+func (s *Session) SetStreamFeatures(names ...xml.Name) {
+	features := make(map[xml.Name]struct{}, len(names))
+	for _, name := range names {
+		features[name] = struct{}{}
+	}
+	s.featuresMu.Lock()
+	s.features = features
+	s.featuresMu.Unlock()
+}
+
+// HasStreamFeature reports whether the peer advertised the given stream feature.
+func (s *Session) HasStreamFeature(name xml.Name) bool {
+	s.featuresMu.RLock()
+	defer s.featuresMu.RUnlock()
+	_, ok := s.features[name]
+	return ok
+}
+
 // Close closes the session.
 func (s *Session) Close() error {
 	s.mu.Lock()
@@ -179,6 +466,7 @@ func (s *Session) Close() error {
 	default:
 		close(s.closed)
 	}
+	s.metrics.SessionEnded()
 
 	return s.trans.Close()
 }
@@ -194,6 +482,9 @@ func (s *Session) SetState(state SessionState) {
 		cur := s.state.Load()
 		next := cur | uint32(state)
 		if s.state.CompareAndSwap(cur, next) {
+			if next&uint32(StateReady) != 0 && cur&uint32(StateReady) == 0 {
+				close(s.ready)
+			}
 			return
 		}
 	}
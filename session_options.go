@@ -1,7 +1,11 @@
 package xmpp
 
 import (
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/jid"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
 )
 
 // SessionOption configures a Session.
@@ -34,9 +38,87 @@ func WithState(state SessionState) SessionOption {
 	})
 }
 
+// WithMaxPendingIQ limits how many SendIQ requests may await a reply at
+// once. Zero or a negative value removes the limit.
+func WithMaxPendingIQ(n int) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.maxPendingIQ = n
+	})
+}
+
+// WithIQTimeout sets how long SendIQ waits for a reply when ctx has no
+// earlier deadline. Zero leaves the wait bounded only by ctx.
+func WithIQTimeout(d time.Duration) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.iqTimeout = d
+	})
+}
+
+// WithClock sets the clock the session reads the current time from. It
+// defaults to clock.System.
+func WithClock(c clock.Clock) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.clock = clock.Or(c)
+	})
+}
+
+// WireFormat selects how stanzas are laid out on the wire.
+type WireFormat = xmppxml.WireFormat
+
+// Wire formats for WithWireFormat.
+const (
+	// WireCompact writes stanzas without added whitespace. It is the default.
+	WireCompact = xmppxml.WireCompact
+	// WireIndented writes each stanza on its own indented lines, for
+	// reading the stream while debugging. Whitespace is only added between
+	// child elements, never inside text or <body/>, so the stanzas carry
+	// the same content either way.
+	WireIndented = xmppxml.WireIndented
+)
+
+// WithWireFormat sets the layout of the stanzas and elements the session
+// writes.
+func WithWireFormat(f WireFormat) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.writer.SetFormat(f)
+	})
+}
+
+// StreamLimits bounds the stanzas a session reads from its peer: their
+// size, the depth of their elements and the rate of reading. Zero fields
+// are not enforced.
+type StreamLimits = xmppxml.Limits
+
+// WithStreamLimits sets the limits on what the session reads. A peer
+// crossing the size or depth limit gets a policy-violation stream error
+// and the stream is closed; one reading faster than the rate is slowed
+// down.
+func WithStreamLimits(l StreamLimits) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.reader.SetLimits(l)
+	})
+}
+
 // WithMux sets the stanza multiplexer.
 func WithMux(mux *Mux) SessionOption {
 	return sessionOptionFunc(func(s *Session) {
 		s.mux = mux
 	})
 }
+
+// WithLimitPolicy sets the policy that decides whether the session handles
+// the stanzas it reads and lets its peer authenticate. See AllowStanza,
+// AuthLockout and AuthResult.
+func WithLimitPolicy(p LimitPolicy) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.limits = p
+	})
+}
+
+// WithFirewall sets the firewall whose rules filter the stanzas the session
+// reads and sends. See FilterStanza and Send.
+func WithFirewall(f *Firewall) SessionOption {
+	return sessionOptionFunc(func(s *Session) {
+		s.firewall = f
+	})
+}
@@ -2,13 +2,22 @@ package xmpp
 
 import (
 	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/jid"
 	"github.com/meszmate/xmpp-go/stanza"
+	"github.com/meszmate/xmpp-go/stream"
 	"github.com/meszmate/xmpp-go/transport"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
 )
 
 func newTestSession(t *testing.T, opts ...SessionOption) (*Session, net.Conn) {
@@ -136,7 +145,7 @@ func TestSessionSend(t *testing.T) {
 	defer c2.Close()
 
 	msg := stanza.NewMessage(stanza.MessageChat)
-	msg.Body = "hello"
+	msg.SetBody("hello")
 
 	done := make(chan error, 1)
 	go func() {
@@ -213,3 +222,303 @@ func TestSessionOptions(t *testing.T) {
 		t.Error("WithMux not applied")
 	}
 }
+
+func TestSessionServeRecordsStreamFeatures(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error { return nil }))
+	}()
+
+	input := `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+		`<stream:features><csi xmlns='urn:xmpp:csi:0'/><sm xmlns='urn:xmpp:sm:3'/></stream:features>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatalf("pipe Write: %v", err)
+	}
+	c2.Close()
+	<-done
+
+	if !s.HasStreamFeature(xml.Name{Space: "urn:xmpp:csi:0", Local: "csi"}) {
+		t.Error("CSI feature should be recorded")
+	}
+	if !s.HasStreamFeature(xml.Name{Space: "urn:xmpp:sm:3", Local: "sm"}) {
+		t.Error("SM feature should be recorded")
+	}
+	if s.HasStreamFeature(xml.Name{Space: "urn:xmpp:carbons:2", Local: "carbons"}) {
+		t.Error("unadvertised feature should not be reported")
+	}
+}
+
+func TestSessionServeReturnsStreamError(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error { return nil }))
+	}()
+
+	input := `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+		`<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatalf("pipe Write: %v", err)
+	}
+
+	err := <-done
+	var se *stream.Error
+	if !errors.As(err, &se) {
+		t.Fatalf("Serve error = %v, want *stream.Error", err)
+	}
+	if se.Condition != stream.ErrSystemShutdown {
+		t.Errorf("Condition = %q, want %q", se.Condition, stream.ErrSystemShutdown)
+	}
+}
+
+func TestSessionServeRejectsSecondReader(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(nil) }()
+
+	// Wait until the first Serve call owns the session.
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.serving.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("first Serve did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := s.Serve(nil); !errors.Is(err, ErrAlreadyServing) {
+		t.Fatalf("second Serve error = %v, want ErrAlreadyServing", err)
+	}
+
+	c2.Close()
+	<-done
+}
+
+func TestSessionClockStampsLastReceived(t *testing.T) {
+	now := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	c := clock.NewFake(now)
+	s, peer := newTestSession(t, WithClock(c))
+	defer s.Close()
+	defer peer.Close()
+
+	if s.Clock() != clock.Clock(c) {
+		t.Fatal("Clock did not return the configured clock")
+	}
+
+	handled := make(chan struct{}, 1)
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		handled <- struct{}{}
+		return nil
+	}))
+	if _, err := peer.Write([]byte("<message/>")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	if got := s.LastReceived(); !got.Equal(now) {
+		t.Fatalf("LastReceived = %v, want %v", got, now)
+	}
+}
+
+func TestSessionInheritsStreamLang(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	got := make(chan *stanza.Message, 2)
+	go s.Serve(HandlerFunc(func(ctx context.Context, s *Session, st stanza.Stanza) error {
+		if msg, ok := st.(*stanza.Message); ok {
+			got <- msg
+		}
+		return nil
+	}))
+
+	go fmt.Fprint(peer, "<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' xml:lang='de'>"+
+		"<message><body>Hallo</body><body xml:lang='en'>Hello</body></message>"+
+		"<message xml:lang='fr'><body>Salut</body></message>")
+
+	first := <-got
+	if first.Lang != "de" || s.StreamLang() != "de" {
+		t.Fatalf("Lang = %q, StreamLang = %q, want de", first.Lang, s.StreamLang())
+	}
+	if body := first.Body("de"); body != "Hallo" {
+		t.Errorf("Body(de) = %q, want the body without xml:lang", body)
+	}
+	if body := first.Body("it"); body != "Hallo" {
+		t.Errorf("Body(it) = %q, want stream default fallback", body)
+	}
+	if second := <-got; second.Lang != "fr" {
+		t.Errorf("explicit stanza Lang = %q, want fr", second.Lang)
+	}
+}
+
+func TestSessionWireFormat(t *testing.T) {
+	t.Parallel()
+	s, peer := newTestSession(t, WithWireFormat(WireIndented))
+	defer s.Close()
+	defer peer.Close()
+
+	iq := stanza.NewIQ(stanza.IQGet)
+	iq.ID = "q1"
+	iq.Query = []byte(`<query xmlns='jabber:iq:roster'><item jid='a@example.com'/></query>`)
+	go s.Send(context.Background(), iq)
+
+	buf := make([]byte, 4096)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\n" + `<iq id="q1" type="get">
+  <query xmlns="jabber:iq:roster">
+    <item jid="a@example.com"></item>
+  </query>
+</iq>`
+	if got := string(buf[:n]); got != want {
+		t.Errorf("wire =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSessionServeEnforcesStreamLimits(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		stanza, condition string
+	}{
+		"size":    {`<message><body>` + strings.Repeat("x", 200) + `</body></message>`, "<policy-violation"},
+		"depth":   {`<message><a><b><c/></b></a></message>`, "<policy-violation"},
+		"doctype": {`<!DOCTYPE message [<!ENTITY x "y">]>`, "<restricted-xml"},
+		"comment": {`<message><!-- hi --></message>`, "<restricted-xml"},
+		"prefix":  {`<foo:message/>`, "<not-well-formed"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			s, c2 := newTestSession(t, WithStreamLimits(StreamLimits{MaxStanzaSize: 100, MaxDepth: 3}))
+			defer s.Close()
+			defer c2.Close()
+
+			handled := make(chan stanza.Stanza, 2)
+			done := make(chan error, 1)
+			go func() {
+				done <- s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+					handled <- st
+					return nil
+				}))
+			}()
+			go func() {
+				_, _ = c2.Write([]byte(`<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+					`<message id='ok'><body>hi</body></message>` + tc.stanza))
+			}()
+
+			out, _ := io.ReadAll(c2)
+			if !strings.Contains(string(out), tc.condition) || !strings.HasSuffix(string(out), "</stream:stream>") {
+				t.Fatalf("peer received %q, want %s/>", out, tc.condition)
+			}
+			var limit *xmppxml.LimitError
+			if err := <-done; !errors.As(err, &limit) {
+				t.Fatalf("Serve error = %v, want *xml.LimitError", err)
+			}
+			if st := <-handled; st.(*stanza.Message).ID != "ok" {
+				t.Fatalf("handler received %+v", st)
+			}
+			select {
+			case st := <-handled:
+				t.Fatalf("handler received %+v", st)
+			default:
+			}
+		})
+	}
+}
+
+func TestSessionServeRejectsIllegalCharacters(t *testing.T) {
+	t.Parallel()
+	for name, body := range map[string]string{
+		"nul":            "a\x00b",
+		"control":        "bell\x07",
+		"escape":         "\x1b[31m",
+		"char reference": "&#x1;",
+		"non-character":  "\uFFFE",
+		"invalid utf-8":  "caf\xe9",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			s, c2 := newTestSession(t)
+			defer s.Close()
+			defer c2.Close()
+
+			handled := make(chan stanza.Stanza, 1)
+			done := make(chan error, 1)
+			go func() {
+				done <- s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+					handled <- st
+					return nil
+				}))
+			}()
+			go func() {
+				_, _ = c2.Write([]byte(`<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+					`<message><body>` + body + `</body></message>`))
+			}()
+
+			out, _ := io.ReadAll(c2)
+			if !strings.Contains(string(out), "<not-well-formed") || !strings.HasSuffix(string(out), "</stream:stream>") {
+				t.Fatalf("peer received %q, want a not-well-formed stream error", out)
+			}
+			var syntax *xml.SyntaxError
+			if err := <-done; !errors.As(err, &syntax) {
+				t.Fatalf("Serve error = %v, want *xml.SyntaxError", err)
+			}
+			select {
+			case st := <-handled:
+				t.Fatalf("handler received %+v", st)
+			default:
+			}
+		})
+	}
+}
+
+func TestSessionServeSplitUTF8(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	handled := make(chan stanza.Stanza, 1)
+	go func() {
+		_ = s.Serve(HandlerFunc(func(_ context.Context, _ *Session, st stanza.Stanza) error {
+			handled <- st
+			return nil
+		}))
+	}()
+
+	// Multi-byte characters arrive split across writes, as they may over
+	// the network.
+	input := []byte(`<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+		`<message><body>€ 🎂</body></message>`)
+	for _, b := range input {
+		if _, err := c2.Write([]byte{b}); err != nil {
+			t.Fatalf("pipe Write: %v", err)
+		}
+	}
+	select {
+	case st := <-handled:
+		if got := st.(*stanza.Message).Body(); got != "€ 🎂" {
+			t.Fatalf("Body() = %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+}
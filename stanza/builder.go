@@ -0,0 +1,273 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// ErrInvalidStanza is returned by the builders' Build methods for a stanza
+// that may not be sent as built.
+var ErrInvalidStanza = errors.New("stanza: invalid stanza")
+
+// NewExtension returns v, an XML-marshalable element such as a plugin's
+// payload type, as an Extension to append to a stanza.
+func NewExtension(v any) (Extension, error) {
+	var ext Extension
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return ext, err
+	}
+	err = xml.Unmarshal(data, &ext)
+	return ext, err
+}
+
+// MessageBuilder builds a Message. Methods record the first error, which
+// Build returns:
+//
+//	msg, err := stanza.BuildMessage().To(bob).Type(stanza.MessageChat).Body("hi").Build()
+type MessageBuilder struct {
+	msg *Message
+	firstErr
+}
+
+// BuildMessage starts a normal message with a random ID.
+func BuildMessage() *MessageBuilder {
+	return &MessageBuilder{msg: NewMessage("")}
+}
+
+// ID replaces the random ID.
+func (b *MessageBuilder) ID(id string) *MessageBuilder { b.msg.ID = id; return b }
+
+// From sets the sender.
+func (b *MessageBuilder) From(j jid.JID) *MessageBuilder { b.msg.From = j; return b }
+
+// To sets the recipient.
+func (b *MessageBuilder) To(j jid.JID) *MessageBuilder { b.msg.To = j; return b }
+
+// Type sets the message type, one of the Message* constants.
+func (b *MessageBuilder) Type(typ string) *MessageBuilder { b.msg.Type = typ; return b }
+
+// Lang sets the default language of the message's text.
+func (b *MessageBuilder) Lang(lang string) *MessageBuilder { b.msg.Lang = lang; return b }
+
+// Body adds a body in the default language.
+func (b *MessageBuilder) Body(body string) *MessageBuilder { return b.BodyLang("", body) }
+
+// BodyLang adds a body in language lang.
+func (b *MessageBuilder) BodyLang(lang, body string) *MessageBuilder {
+	b.msg.AddBody(lang, body)
+	return b
+}
+
+// Subject adds a subject in the default language.
+func (b *MessageBuilder) Subject(subject string) *MessageBuilder {
+	b.msg.AddSubject("", subject)
+	return b
+}
+
+// Thread sets the thread and, if parent is not empty, its parent thread.
+func (b *MessageBuilder) Thread(id, parent string) *MessageBuilder {
+	b.msg.SetThread(id, parent)
+	return b
+}
+
+// Extension appends v, marshaled with encoding/xml, as an extension element.
+func (b *MessageBuilder) Extension(v any) *MessageBuilder {
+	ext, err := NewExtension(v)
+	if err != nil {
+		b.fail(err)
+		return b
+	}
+	b.msg.Extensions = append(b.msg.Extensions, ext)
+	return b
+}
+
+// Error sets the type to error and attaches err.
+func (b *MessageBuilder) Error(err *StanzaError) *MessageBuilder {
+	b.msg.Type = MessageError
+	b.msg.Error = err
+	return b
+}
+
+// Build returns the message, or the first error met while building it.
+func (b *MessageBuilder) Build() (*Message, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if !slices.Contains([]string{"", MessageChat, MessageError, MessageGroupchat, MessageHeadline, MessageNormal}, b.msg.Type) {
+		return nil, fmt.Errorf("%w: unknown message type %q", ErrInvalidStanza, b.msg.Type)
+	}
+	if err := checkError(b.msg.Type == MessageError, b.msg.Error); err != nil {
+		return nil, err
+	}
+	return b.msg, nil
+}
+
+// PresenceBuilder builds a Presence. Methods record the first error, which
+// Build returns:
+//
+//	pres, err := stanza.BuildPresence().Show(stanza.ShowAway).Status("Lunch").Build()
+type PresenceBuilder struct {
+	pres *Presence
+	firstErr
+}
+
+// BuildPresence starts an available presence with a random ID.
+func BuildPresence() *PresenceBuilder {
+	return &PresenceBuilder{pres: NewPresence(PresenceAvailable)}
+}
+
+// ID replaces the random ID.
+func (b *PresenceBuilder) ID(id string) *PresenceBuilder { b.pres.ID = id; return b }
+
+// From sets the sender.
+func (b *PresenceBuilder) From(j jid.JID) *PresenceBuilder { b.pres.From = j; return b }
+
+// To sets the recipient; presence without one is broadcast.
+func (b *PresenceBuilder) To(j jid.JID) *PresenceBuilder { b.pres.To = j; return b }
+
+// Type sets the presence type, one of the Presence* constants.
+func (b *PresenceBuilder) Type(typ string) *PresenceBuilder { b.pres.Type = typ; return b }
+
+// Lang sets the language of the status.
+func (b *PresenceBuilder) Lang(lang string) *PresenceBuilder { b.pres.Lang = lang; return b }
+
+// Show sets the availability, one of the Show* constants.
+func (b *PresenceBuilder) Show(show string) *PresenceBuilder { b.pres.Show = show; return b }
+
+// Status sets the status text.
+func (b *PresenceBuilder) Status(status string) *PresenceBuilder { b.pres.Status = status; return b }
+
+// Priority sets the resource priority.
+func (b *PresenceBuilder) Priority(p int8) *PresenceBuilder { b.pres.Priority = p; return b }
+
+// Extension appends v, marshaled with encoding/xml, as an extension element.
+func (b *PresenceBuilder) Extension(v any) *PresenceBuilder {
+	ext, err := NewExtension(v)
+	if err != nil {
+		b.fail(err)
+		return b
+	}
+	b.pres.Extensions = append(b.pres.Extensions, ext)
+	return b
+}
+
+// Error sets the type to error and attaches err.
+func (b *PresenceBuilder) Error(err *StanzaError) *PresenceBuilder {
+	b.pres.Type = PresenceError
+	b.pres.Error = err
+	return b
+}
+
+// Build returns the presence, or the first error met while building it.
+func (b *PresenceBuilder) Build() (*Presence, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	p := b.pres
+	if !slices.Contains([]string{PresenceAvailable, PresenceUnavailable, PresenceSubscribe, PresenceSubscribed,
+		PresenceUnsubscribe, PresenceUnsubscribed, PresenceProbe, PresenceError}, p.Type) {
+		return nil, fmt.Errorf("%w: unknown presence type %q", ErrInvalidStanza, p.Type)
+	}
+	if !slices.Contains([]string{"", ShowAway, ShowChat, ShowDND, ShowXA}, p.Show) {
+		return nil, fmt.Errorf("%w: unknown show %q", ErrInvalidStanza, p.Show)
+	}
+	if err := checkError(p.Type == PresenceError, p.Error); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// IQBuilder builds an IQ. Methods record the first error, which Build
+// returns:
+//
+//	iq, err := stanza.BuildIQ(stanza.IQGet).To(server).Payload(&ping.Ping{}).Build()
+type IQBuilder struct {
+	iq *IQ
+	firstErr
+}
+
+// BuildIQ starts an IQ of type typ with a random ID.
+func BuildIQ(typ string) *IQBuilder {
+	return &IQBuilder{iq: NewIQ(typ)}
+}
+
+// ID replaces the random ID.
+func (b *IQBuilder) ID(id string) *IQBuilder { b.iq.ID = id; return b }
+
+// From sets the sender.
+func (b *IQBuilder) From(j jid.JID) *IQBuilder { b.iq.From = j; return b }
+
+// To sets the recipient; an IQ without one is addressed to the sender's
+// account or server.
+func (b *IQBuilder) To(j jid.JID) *IQBuilder { b.iq.To = j; return b }
+
+// Lang sets the language of the payload's text.
+func (b *IQBuilder) Lang(lang string) *IQBuilder { b.iq.Lang = lang; return b }
+
+// Payload sets the child element to v, marshaled with encoding/xml.
+func (b *IQBuilder) Payload(v any) *IQBuilder {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		b.fail(err)
+		return b
+	}
+	b.iq.Query = data
+	return b
+}
+
+// Error sets the type to error and attaches err.
+func (b *IQBuilder) Error(err *StanzaError) *IQBuilder {
+	b.iq.Type = IQError
+	b.iq.Error = err
+	return b
+}
+
+// Build returns the IQ, or the first error met while building it. A get or
+// set must carry a payload (RFC 6120 §8.2.3).
+func (b *IQBuilder) Build() (*IQ, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	iq := b.iq
+	switch iq.Type {
+	case IQGet, IQSet:
+		if len(iq.Query) == 0 {
+			return nil, fmt.Errorf("%w: %s iq without a payload", ErrInvalidStanza, iq.Type)
+		}
+	case IQResult, IQError:
+	default:
+		return nil, fmt.Errorf("%w: unknown iq type %q", ErrInvalidStanza, iq.Type)
+	}
+	if iq.ID == "" {
+		return nil, fmt.Errorf("%w: iq without an id", ErrInvalidStanza)
+	}
+	if err := checkError(iq.Type == IQError, iq.Error); err != nil {
+		return nil, err
+	}
+	return iq, nil
+}
+
+// firstErr keeps the first error a builder meets.
+type firstErr struct{ err error }
+
+func (f *firstErr) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// checkError reports a stanza whose error type and error child disagree.
+func checkError(isError bool, err *StanzaError) error {
+	switch {
+	case isError && err == nil:
+		return fmt.Errorf("%w: error stanza without an error", ErrInvalidStanza)
+	case !isError && err != nil:
+		return fmt.Errorf("%w: error child on a stanza that is not of type error", ErrInvalidStanza)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+type testPayload struct {
+	XMLName xml.Name `xml:"urn:example:test payload"`
+	Value   string   `xml:"value,attr"`
+}
+
+func TestBuildMessage(t *testing.T) {
+	t.Parallel()
+	msg, err := BuildMessage().
+		To(jid.MustParse("bob@example.com")).
+		Type(MessageChat).
+		Body("hi").
+		BodyLang("de", "hallo").
+		Thread("t1", "").
+		Extension(testPayload{Value: "x"}).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if msg.ID == "" || msg.Type != MessageChat || msg.To.String() != "bob@example.com" {
+		t.Fatalf("header = %+v", msg.Header)
+	}
+	if msg.Body() != "hi" || msg.Body("de") != "hallo" || msg.ThreadID() != "t1" {
+		t.Fatalf("message = %+v", msg)
+	}
+
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<payload xmlns="urn:example:test" value="x"></payload>`; !strings.Contains(string(data), want) {
+		t.Fatalf("%s\ndoes not contain %s", data, want)
+	}
+}
+
+func TestBuildPresence(t *testing.T) {
+	t.Parallel()
+	pres, err := BuildPresence().Show(ShowAway).Status("Lunch").Priority(5).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if pres.Type != PresenceAvailable || pres.Show != ShowAway || pres.Status != "Lunch" || pres.Priority != 5 {
+		t.Fatalf("presence = %+v", pres)
+	}
+
+	sub, err := BuildPresence().To(jid.MustParse("bob@example.com")).Type(PresenceSubscribe).Build()
+	if err != nil || sub.Type != PresenceSubscribe {
+		t.Fatalf("Build subscribe = %+v, %v", sub, err)
+	}
+}
+
+func TestBuildIQ(t *testing.T) {
+	t.Parallel()
+	iq, err := BuildIQ(IQGet).ID("q1").To(jid.MustParse("example.com")).Payload(testPayload{Value: "y"}).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if iq.ID != "q1" || string(iq.Query) != `<payload xmlns="urn:example:test" value="y"></payload>` {
+		t.Fatalf("iq = %+v, query %s", iq, iq.Query)
+	}
+
+	result, err := BuildIQ(IQResult).Build()
+	if err != nil || result.Type != IQResult {
+		t.Fatalf("Build result = %+v, %v", result, err)
+	}
+}
+
+func TestBuildErrorStanza(t *testing.T) {
+	t.Parallel()
+	se := NewStanzaError(ErrorTypeCancel, ErrorItemNotFound, "")
+	msg, err := BuildMessage().Error(se).Build()
+	if err != nil || msg.Type != MessageError || msg.Error != se {
+		t.Fatalf("message = %+v, %v", msg, err)
+	}
+	iq, err := BuildIQ(IQGet).Error(se).Build()
+	if err != nil || iq.Type != IQError {
+		t.Fatalf("iq = %+v, %v", iq, err)
+	}
+}
+
+func TestBuildInvalid(t *testing.T) {
+	t.Parallel()
+	se := NewStanzaError(ErrorTypeCancel, ErrorItemNotFound, "")
+	tests := []struct {
+		name  string
+		build func() error
+	}{
+		{"message type", func() error { _, err := BuildMessage().Type("chatty").Build(); return err }},
+		{"message error without child", func() error { _, err := BuildMessage().Type(MessageError).Build(); return err }},
+		{"error child on chat", func() error {
+			b := BuildMessage().Error(se).Type(MessageChat)
+			_, err := b.Build()
+			return err
+		}},
+		{"presence type", func() error { _, err := BuildPresence().Type("online").Build(); return err }},
+		{"presence show", func() error { _, err := BuildPresence().Show("busy").Build(); return err }},
+		{"iq type", func() error { _, err := BuildIQ("query").Build(); return err }},
+		{"iq get without payload", func() error { _, err := BuildIQ(IQGet).Build(); return err }},
+		{"iq without id", func() error { _, err := BuildIQ(IQResult).ID("").Build(); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.build(); !errors.Is(err, ErrInvalidStanza) {
+			t.Errorf("%s: Build error = %v, want ErrInvalidStanza", tt.name, err)
+		}
+	}
+}
+
+func TestBuildExtensionError(t *testing.T) {
+	t.Parallel()
+	// Channels cannot be marshaled; the error surfaces at Build and later
+	// steps do not replace it.
+	_, err := BuildMessage().Extension(make(chan int)).Type("bogus").Build()
+	var unsupported *xml.UnsupportedTypeError
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("Build error = %v, want *xml.UnsupportedTypeError", err)
+	}
+	if _, err := BuildIQ(IQSet).Payload(make(chan int)).Build(); !errors.As(err, &unsupported) {
+		t.Fatalf("Build error = %v, want *xml.UnsupportedTypeError", err)
+	}
+}
+
+func TestNewExtension(t *testing.T) {
+	t.Parallel()
+	ext, err := NewExtension(testPayload{Value: "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext.XMLName != (xml.Name{Space: "urn:example:test", Local: "payload"}) {
+		t.Fatalf("XMLName = %v", ext.XMLName)
+	}
+	var back testPayload
+	data, _ := xml.Marshal(ext)
+	if err := xml.Unmarshal(data, &back); err != nil || back.Value != "z" {
+		t.Fatalf("round trip = %+v, %v", back, err)
+	}
+}
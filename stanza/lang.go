@@ -0,0 +1,53 @@
+package stanza
+
+import "strings"
+
+// Text is human-readable character data with an optional xml:lang, such as
+// a message <body/> or <subject/>. An empty Lang means the language of the
+// enclosing stanza, which in turn defaults to that of the stream.
+type Text struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// BestText picks the text matching the most preferred language in prefs
+// (RFC 6121 §5.2.3). Texts without a language are in defaultLang. Each
+// preference is tried in order, first for an exact match and then for a
+// match of the primary language subtag, so "en-GB" accepts "en" and "en-US".
+// When no preference matches, the text in defaultLang is returned, and
+// failing that the first text.
+func BestText(texts []Text, defaultLang string, prefs ...string) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	lang := func(t Text) string {
+		if t.Lang == "" {
+			return defaultLang
+		}
+		return t.Lang
+	}
+	for _, pref := range prefs {
+		for _, t := range texts {
+			if strings.EqualFold(lang(t), pref) {
+				return t.Value
+			}
+		}
+		for _, t := range texts {
+			if primary := primaryTag(pref); primary != "" && strings.EqualFold(primaryTag(lang(t)), primary) {
+				return t.Value
+			}
+		}
+	}
+	for _, t := range texts {
+		if t.Lang == "" || strings.EqualFold(t.Lang, defaultLang) {
+			return t.Value
+		}
+	}
+	return texts[0].Value
+}
+
+// primaryTag returns the primary language subtag of a language tag.
+func primaryTag(tag string) string {
+	primary, _, _ := strings.Cut(tag, "-")
+	return primary
+}
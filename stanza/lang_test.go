@@ -0,0 +1,72 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestMessageBodyLanguages(t *testing.T) {
+	t.Parallel()
+	var m Message
+	err := xml.Unmarshal([]byte(`<message xmlns='jabber:client' xml:lang='en'>
+  <body>Hello</body>
+  <body xml:lang='de-AT'>Servus</body>
+  <body xml:lang='fr'>Bonjour</body>
+</message>`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Lang != "en" {
+		t.Fatalf("Lang = %q, want en", m.Lang)
+	}
+
+	tests := []struct {
+		prefs []string
+		want  string
+	}{
+		{nil, "Hello"},
+		{[]string{"fr"}, "Bonjour"},
+		{[]string{"FR"}, "Bonjour"},
+		{[]string{"de"}, "Servus"},
+		{[]string{"de-DE"}, "Servus"},
+		{[]string{"en-GB"}, "Hello"},
+		{[]string{"it", "fr"}, "Bonjour"},
+		// No preferred language is present: fall back to the default.
+		{[]string{"ja", "it"}, "Hello"},
+	}
+	for _, tt := range tests {
+		if got := m.Body(tt.prefs...); got != tt.want {
+			t.Errorf("Body(%v) = %q, want %q", tt.prefs, got, tt.want)
+		}
+	}
+}
+
+func TestBestTextFallbackWithoutDefault(t *testing.T) {
+	t.Parallel()
+	texts := []Text{{Lang: "fr", Value: "Bonjour"}, {Lang: "de", Value: "Hallo"}}
+	if got := BestText(texts, "en", "ja"); got != "Bonjour" {
+		t.Errorf("BestText = %q, want first text", got)
+	}
+	if got := BestText(nil, "en", "ja"); got != "" {
+		t.Errorf("BestText(nil) = %q", got)
+	}
+}
+
+func TestMessageMarshalBodies(t *testing.T) {
+	t.Parallel()
+	m := NewMessage(MessageChat)
+	m.SetBody("Hello")
+	m.AddBody("de", "Hallo")
+	m.SetSubject("Greeting")
+	data, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{"<subject>Greeting</subject>", "<body>Hello</body>", `<body xml:lang="de">Hallo</body>`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("marshaled %s lacks %s", got, want)
+		}
+	}
+}
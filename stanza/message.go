@@ -19,9 +19,9 @@ const (
 type Message struct {
 	Header
 	XMLName    xml.Name    `xml:"message"`
-	Subject    string      `xml:"subject,omitempty"`
-	Body       string      `xml:"body,omitempty"`
-	Thread     string      `xml:"thread,omitempty"`
+	Subjects   []Text      `xml:"subject,omitempty"`
+	Bodies     []Text      `xml:"body,omitempty"`
+	Thread     *Thread     `xml:"thread,omitempty"`
 	Error      *StanzaError `xml:"error,omitempty"`
 	Extensions []Extension `xml:",any,omitempty"`
 }
@@ -41,3 +41,37 @@ func NewMessage(typ string) *Message {
 func (m *Message) StanzaType() string {
 	return "message"
 }
+
+// Body returns the message body best matching the preferred languages, as
+// chosen by BestText. Without preferences it returns the body in the
+// stanza's default language.
+func (m *Message) Body(prefs ...string) string {
+	return BestText(m.Bodies, m.Lang, prefs...)
+}
+
+// SetBody replaces all bodies with a single body in the default language.
+func (m *Message) SetBody(body string) {
+	m.Bodies = []Text{{Value: body}}
+}
+
+// AddBody adds a body in language lang.
+func (m *Message) AddBody(lang, body string) {
+	m.Bodies = append(m.Bodies, Text{Lang: lang, Value: body})
+}
+
+// Subject returns the subject best matching the preferred languages, as
+// chosen by BestText.
+func (m *Message) Subject(prefs ...string) string {
+	return BestText(m.Subjects, m.Lang, prefs...)
+}
+
+// SetSubject replaces all subjects with a single subject in the default
+// language.
+func (m *Message) SetSubject(subject string) {
+	m.Subjects = []Text{{Value: subject}}
+}
+
+// AddSubject adds a subject in language lang.
+func (m *Message) AddSubject(lang, subject string) {
+	m.Subjects = append(m.Subjects, Text{Lang: lang, Value: subject})
+}
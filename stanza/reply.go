@@ -0,0 +1,42 @@
+package stanza
+
+import (
+	"encoding/xml"
+
+	"github.com/meszmate/xmpp-go/internal/ns"
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+// ReplyRef is the <reply/> element that marks a message as a reply to an
+// earlier one (XEP-0461). ID is the ID of the referenced message and To its
+// author, if known.
+type ReplyRef struct {
+	XMLName xml.Name `xml:"urn:xmpp:reply:0 reply"`
+	To      jid.JID  `xml:"to,attr,omitempty"`
+	ID      string   `xml:"id,attr"`
+}
+
+// ReplyTo returns the reference to the message m replies to, if m is a
+// reply.
+func (m *Message) ReplyTo() (ReplyRef, bool) {
+	for _, ext := range m.Extensions {
+		if ext.XMLName.Space != ns.Reply || ext.XMLName.Local != "reply" {
+			continue
+		}
+		ref := ReplyRef{XMLName: ext.XMLName}
+		for _, attr := range ext.Attrs {
+			switch attr.Name.Local {
+			case "id":
+				ref.ID = attr.Value
+			case "to":
+				to, err := jid.Parse(attr.Value)
+				if err != nil {
+					return ReplyRef{}, false
+				}
+				ref.To = to
+			}
+		}
+		return ref, ref.ID != ""
+	}
+	return ReplyRef{}, false
+}
@@ -22,7 +22,7 @@ type Header struct {
 	From    jid.JID  `xml:"from,attr,omitempty"`
 	To      jid.JID  `xml:"to,attr,omitempty"`
 	Type    string   `xml:"type,attr,omitempty"`
-	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 }
 
 // GetHeader returns the stanza header.
@@ -30,6 +30,27 @@ func (h *Header) GetHeader() *Header {
 	return h
 }
 
+// WithNamespace returns st, or a copy of it in namespace space: stanzas are
+// in jabber:client on client streams, in jabber:server between servers and
+// in jabber:component:accept on component streams.
+func WithNamespace(st Stanza, space string) Stanza {
+	switch v := st.(type) {
+	case *Message:
+		c := *v
+		c.XMLName = xml.Name{Space: space, Local: "message"}
+		return &c
+	case *Presence:
+		c := *v
+		c.XMLName = xml.Name{Space: space, Local: "presence"}
+		return &c
+	case *IQ:
+		c := *v
+		c.XMLName = xml.Name{Space: space, Local: "iq"}
+		return &c
+	}
+	return st
+}
+
 // GenerateID generates a random stanza ID.
 func GenerateID() string {
 	b := make([]byte, 16)
@@ -43,3 +64,24 @@ type Extension struct {
 	Inner   []byte `xml:",innerxml"`
 	Attrs   []xml.Attr `xml:",any,attr"`
 }
+
+// MarshalXML writes the extension element. The default namespace is taken
+// from XMLName, so an xmlns attribute kept in Attrs when the extension was
+// decoded is not written a second time, and prefix declarations are kept.
+func (e Extension) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	start := xml.StartElement{Name: e.XMLName}
+	for _, attr := range e.Attrs {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			continue
+		case attr.Name.Space == "xmlns":
+			// Prefix declarations are written verbatim, since Inner
+			// may use the prefix.
+			attr.Name = xml.Name{Local: "xmlns:" + attr.Name.Local}
+		}
+		start.Attr = append(start.Attr, attr)
+	}
+	return enc.EncodeElement(struct {
+		Inner []byte `xml:",innerxml"`
+	}{e.Inner}, start)
+}
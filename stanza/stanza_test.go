@@ -192,3 +192,36 @@ func TestStanzaErrorMarshalXML(t *testing.T) {
 		t.Errorf("missing text in: %s", out)
 	}
 }
+
+func TestExtensionRoundTrip(t *testing.T) {
+	t.Parallel()
+	in := `<message xmlns="jabber:client"><x xmlns="urn:example:x" xmlns:y="urn:example:y" a="1"><y:item/></x></message>`
+	var m Message
+	if err := xml.Unmarshal([]byte(in), &m); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(m.Extensions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<x xmlns="urn:example:x" xmlns:y="urn:example:y" a="1"><y:item/></x>`
+	if string(data) != want {
+		t.Fatalf("got  %s\nwant %s", data, want)
+	}
+}
+
+func TestWithNamespace(t *testing.T) {
+	t.Parallel()
+	msg := NewMessage(MessageChat)
+	got, ok := WithNamespace(msg, "jabber:server").(*Message)
+	if !ok || got.XMLName != (xml.Name{Space: "jabber:server", Local: "message"}) || got.ID != msg.ID {
+		t.Fatalf("got %+v", got)
+	}
+	if msg.XMLName.Space != "" {
+		t.Fatalf("original changed to %s", msg.XMLName.Space)
+	}
+	iq := &IQ{}
+	if got := WithNamespace(iq, "jabber:client").(*IQ); got.XMLName.Local != "iq" || iq.XMLName.Local != "" {
+		t.Fatalf("iq %+v, original %+v", got.XMLName, iq.XMLName)
+	}
+}
@@ -0,0 +1,60 @@
+package stanza
+
+// Thread is the <thread/> element of a message (XEP-0201). ID identifies the
+// conversation thread and Parent, when set, the thread it was forked from.
+type Thread struct {
+	ID     string `xml:",chardata"`
+	Parent string `xml:"parent,attr,omitempty"`
+}
+
+// ThreadID returns the ID of the message's thread, or "" if it has none.
+func (m *Message) ThreadID() string {
+	if m.Thread == nil {
+		return ""
+	}
+	return m.Thread.ID
+}
+
+// ParentThread returns the ID of the thread the message's thread was forked
+// from, or "" if it is not a sub-thread.
+func (m *Message) ParentThread() string {
+	if m.Thread == nil {
+		return ""
+	}
+	return m.Thread.Parent
+}
+
+// SetThread puts the message in thread id, a sub-thread of parent if parent
+// is not empty. An empty id removes the thread.
+func (m *Message) SetThread(id, parent string) {
+	if id == "" {
+		m.Thread = nil
+		return
+	}
+	m.Thread = &Thread{ID: id, Parent: parent}
+}
+
+// Reply returns a message answering m with body, addressed to its sender
+// and of the same type. It continues m's thread; a groupchat reply goes to
+// the room rather than to the occupant.
+func (m *Message) Reply(body string) *Message {
+	reply := NewMessage(m.Type)
+	reply.To = m.From
+	if m.Type == MessageGroupchat {
+		reply.To = m.From.Bare()
+	}
+	if m.Thread != nil {
+		t := *m.Thread
+		reply.Thread = &t
+	}
+	reply.SetBody(body)
+	return reply
+}
+
+// Fork returns a reply to m like Reply in a new thread whose parent is m's
+// thread, for branching off a conversation (XEP-0201 §3).
+func (m *Message) Fork(body string) *Message {
+	reply := m.Reply(body)
+	reply.SetThread(GenerateID(), m.ThreadID())
+	return reply
+}
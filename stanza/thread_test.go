@@ -0,0 +1,101 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/jid"
+)
+
+func TestMessageThreadUnmarshal(t *testing.T) {
+	t.Parallel()
+	var m Message
+	err := xml.Unmarshal([]byte(`<message xmlns='jabber:client' type='chat'>
+  <body>Yes, I'll be there.</body>
+  <thread parent='e0ffe42b28561960c6b12b944a092794b9683a38'>7edac73ab41e45c4aafa7b2d7b749080</thread>
+</message>`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.ThreadID(); got != "7edac73ab41e45c4aafa7b2d7b749080" {
+		t.Errorf("ThreadID() = %q", got)
+	}
+	if got := m.ParentThread(); got != "e0ffe42b28561960c6b12b944a092794b9683a38" {
+		t.Errorf("ParentThread() = %q", got)
+	}
+
+	var plain Message
+	if err := xml.Unmarshal([]byte(`<message><body>hi</body></message>`), &plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.ThreadID() != "" || plain.ParentThread() != "" {
+		t.Errorf("unthreaded message has thread %+v", plain.Thread)
+	}
+}
+
+func TestMessageThreadedReplyMarshal(t *testing.T) {
+	t.Parallel()
+	orig := NewMessage(MessageChat)
+	orig.From = jid.MustParse("romeo@example.net/orchard")
+	orig.SetThread("e0ffe42b28561960c6b12b944a092794b9683a38", "")
+
+	reply := orig.Reply("Wherefore art thou?")
+	reply.ID = "r1"
+	data, err := xml.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<message id="r1" to="romeo@example.net/orchard" type="chat"><body>Wherefore art thou?</body><thread>e0ffe42b28561960c6b12b944a092794b9683a38</thread></message>`
+	if string(data) != want {
+		t.Fatalf("reply:\n got %s\nwant %s", data, want)
+	}
+
+	fork := orig.Fork("A new topic")
+	if fork.ThreadID() == "" || fork.ThreadID() == orig.ThreadID() {
+		t.Fatalf("fork thread = %q", fork.ThreadID())
+	}
+	if fork.ParentThread() != orig.ThreadID() {
+		t.Fatalf("fork parent = %q, want %q", fork.ParentThread(), orig.ThreadID())
+	}
+	data, err = xml.Marshal(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantThread := `<thread parent="e0ffe42b28561960c6b12b944a092794b9683a38">` + fork.ThreadID() + `</thread>`
+	if !strings.Contains(string(data), wantThread) {
+		t.Fatalf("fork %s does not contain %s", data, wantThread)
+	}
+
+	// The reply has its own copy of the thread.
+	reply.SetThread("other", "")
+	if orig.ThreadID() != "e0ffe42b28561960c6b12b944a092794b9683a38" {
+		t.Fatal("changing the reply's thread changed the original")
+	}
+}
+
+func TestMessageGroupchatReply(t *testing.T) {
+	t.Parallel()
+	orig := NewMessage(MessageGroupchat)
+	orig.From = jid.MustParse("coven@chat.shakespeare.lit/thirdwitch")
+	reply := orig.Reply("Hail!")
+	if reply.To.String() != "coven@chat.shakespeare.lit" || reply.Type != MessageGroupchat {
+		t.Fatalf("reply to %s type %q", reply.To, reply.Type)
+	}
+	if reply.Thread != nil {
+		t.Fatalf("reply to an unthreaded message has thread %+v", reply.Thread)
+	}
+}
+
+func TestMessageSetThread(t *testing.T) {
+	t.Parallel()
+	var m Message
+	m.SetThread("t2", "t1")
+	if m.ThreadID() != "t2" || m.ParentThread() != "t1" {
+		t.Fatalf("thread = %+v", m.Thread)
+	}
+	m.SetThread("", "t1")
+	if m.Thread != nil {
+		t.Fatalf("thread = %+v, want nil", m.Thread)
+	}
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// DefaultBlobThreshold is the payload size, in bytes, above which the view
+// returned by Offload moves payloads to its BlobStore when given no
+// threshold.
+const DefaultBlobThreshold = 64 << 10
+
+// BlobStore keeps large binary objects, such as vCard photos, avatars and
+// uploaded files, outside the primary store, typically in an object store.
+type BlobStore interface {
+	// PutBlob stores data under key, replacing any blob there.
+	PutBlob(ctx context.Context, key string, data []byte, contentType string) error
+
+	// GetBlob retrieves the blob stored under key and its content type.
+	// Returns ErrNotFound if there is none.
+	GetBlob(ctx context.Context, key string) (data []byte, contentType string, err error)
+
+	// DeleteBlob removes the blob stored under key. Removing a blob that
+	// does not exist is not an error.
+	DeleteBlob(ctx context.Context, key string) error
+}
+
+// Offload returns a view of s that keeps vCards and pubsub item payloads
+// larger than threshold bytes in blobs, storing only a reference to them in
+// s. Payloads are read back transparently, so the view behaves like s. A
+// threshold of zero or less uses DefaultBlobThreshold; a nil blobs returns
+// s unchanged.
+//
+// The blob is written before the reference and removed after it, so a
+// failed write leaves at worst an unreferenced blob, never a dangling
+// reference.
+func Offload(s Storage, blobs BlobStore, threshold int) Storage {
+	if blobs == nil {
+		return s
+	}
+	if threshold <= 0 {
+		threshold = DefaultBlobThreshold
+	}
+	return &offloaded{Storage: s, blobs: blobs, threshold: threshold}
+}
+
+type offloaded struct {
+	Storage
+	blobs     BlobStore
+	threshold int
+}
+
+func (o *offloaded) VCardStore() VCardStore {
+	vs := o.Storage.VCardStore()
+	if vs == nil {
+		return nil
+	}
+	return &offloadVCardStore{vs, o}
+}
+
+func (o *offloaded) PubSubStore() PubSubStore {
+	ps := o.Storage.PubSubStore()
+	if ps == nil {
+		return nil
+	}
+	return &offloadPubSubStore{ps, o}
+}
+
+// A blob reference is an XML element, so that it fits wherever the
+// payload it replaces did.
+var (
+	blobRefPrefix = []byte(`<blob xmlns='urn:xmpp-go:blob' key='`)
+	blobRefSuffix = []byte(`'/>`)
+)
+
+func blobRef(key string) []byte {
+	return append(append(append([]byte(nil), blobRefPrefix...), key...), blobRefSuffix...)
+}
+
+// parseBlobRef returns the key data refers to, if it is a blob reference.
+func parseBlobRef(data []byte) (string, bool) {
+	rest, ok := bytes.CutPrefix(data, blobRefPrefix)
+	if !ok {
+		return "", false
+	}
+	key, ok := bytes.CutSuffix(rest, blobRefSuffix)
+	return string(key), ok
+}
+
+// blobKey returns the key of the blob of an object named by parts under
+// kind. The parts are hashed, so keys are safe in any object store and do
+// not reveal JIDs.
+func blobKey(kind string, parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return kind + "/" + hex.EncodeToString(h.Sum(nil))
+}
+
+// put stores data in a blob under key if it is over the threshold, and
+// returns what to store in the primary store instead.
+func (o *offloaded) put(ctx context.Context, key string, data []byte) ([]byte, error) {
+	if len(data) <= o.threshold {
+		return data, nil
+	}
+	if err := o.blobs.PutBlob(ctx, key, data, "application/xml"); err != nil {
+		return nil, fmt.Errorf("storage: offload %s: %w", key, err)
+	}
+	return blobRef(key), nil
+}
+
+// get returns the payload data stands for, reading it from its blob if
+// data is a reference.
+func (o *offloaded) get(ctx context.Context, data []byte) ([]byte, error) {
+	key, ok := parseBlobRef(data)
+	if !ok {
+		return data, nil
+	}
+	blob, _, err := o.blobs.GetBlob(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("storage: blob %s is missing: %w", key, err)
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// drop removes the blob that old, a payload that was replaced or deleted,
+// referred to, unless it is still referred to by replacement.
+func (o *offloaded) drop(ctx context.Context, old, replacement []byte) error {
+	key, ok := parseBlobRef(old)
+	if !ok {
+		return nil
+	}
+	if newKey, ok := parseBlobRef(replacement); ok && newKey == key {
+		return nil
+	}
+	return o.blobs.DeleteBlob(ctx, key)
+}
+
+// --- VCardStore ---
+
+type offloadVCardStore struct {
+	VCardStore
+	o *offloaded
+}
+
+func (v *offloadVCardStore) SetVCard(ctx context.Context, userJID string, data []byte) error {
+	old, err := v.VCardStore.GetVCard(ctx, userJID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	stored, err := v.o.put(ctx, blobKey("vcard", userJID), data)
+	if err != nil {
+		return err
+	}
+	if err := v.VCardStore.SetVCard(ctx, userJID, stored); err != nil {
+		return err
+	}
+	return v.o.drop(ctx, old, stored)
+}
+
+func (v *offloadVCardStore) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
+	data, err := v.VCardStore.GetVCard(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	return v.o.get(ctx, data)
+}
+
+func (v *offloadVCardStore) DeleteVCard(ctx context.Context, userJID string) error {
+	old, err := v.VCardStore.GetVCard(ctx, userJID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := v.VCardStore.DeleteVCard(ctx, userJID); err != nil {
+		return err
+	}
+	return v.o.drop(ctx, old, nil)
+}
+
+// --- PubSubStore ---
+
+type offloadPubSubStore struct {
+	PubSubStore
+	o *offloaded
+}
+
+func (p *offloadPubSubStore) DeleteNode(ctx context.Context, host, nodeID string) error {
+	items, err := p.PubSubStore.GetItems(ctx, host, nodeID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := p.PubSubStore.DeleteNode(ctx, host, nodeID); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := p.o.drop(ctx, item.Payload, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *offloadPubSubStore) UpsertItem(ctx context.Context, item *PubSubItem) error {
+	var old []byte
+	switch prev, err := p.PubSubStore.GetItem(ctx, item.Host, item.NodeID, item.ItemID); {
+	case err == nil:
+		old = prev.Payload
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	payload, err := p.o.put(ctx, blobKey("pubsub", item.Host, item.NodeID, item.ItemID), item.Payload)
+	if err != nil {
+		return err
+	}
+	stored := *item
+	stored.Payload = payload
+	if err := p.PubSubStore.UpsertItem(ctx, &stored); err != nil {
+		return err
+	}
+	return p.o.drop(ctx, old, payload)
+}
+
+func (p *offloadPubSubStore) GetItem(ctx context.Context, host, nodeID, itemID string) (*PubSubItem, error) {
+	item, err := p.PubSubStore.GetItem(ctx, host, nodeID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if item.Payload, err = p.o.get(ctx, item.Payload); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (p *offloadPubSubStore) GetItems(ctx context.Context, host, nodeID string) ([]*PubSubItem, error) {
+	items, err := p.PubSubStore.GetItems(ctx, host, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Payload, err = p.o.get(ctx, item.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (p *offloadPubSubStore) DeleteItem(ctx context.Context, host, nodeID, itemID string) error {
+	var old []byte
+	switch prev, err := p.PubSubStore.GetItem(ctx, host, nodeID, itemID); {
+	case err == nil:
+		old = prev.Payload
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	if err := p.PubSubStore.DeleteItem(ctx, host, nodeID, itemID); err != nil {
+		return err
+	}
+	return p.o.drop(ctx, old, nil)
+}
@@ -0,0 +1,370 @@
+// Package cache provides a caching decorator for storage.Storage that keeps
+// the read-heavy per-user stores — rosters, vCards and block lists — in
+// memory, so that presence broadcasts and block checks do not reach the
+// backend every time.
+//
+// Reads are served from size-bounded LRU caches whose entries expire after
+// a TTL. Writes go to the backend first and then drop the cached value of
+// the user, so a process never reads back stale data it wrote itself.
+// Writes made by other processes sharing the backend are only seen once the
+// entry expires, or after a call to Invalidate.
+package cache
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// Defaults for the caches of each store.
+const (
+	DefaultSize = 10000
+	DefaultTTL  = 5 * time.Minute
+)
+
+// Kind names a cached store.
+type Kind string
+
+// Cached stores.
+const (
+	KindRoster   Kind = "roster"
+	KindVCard    Kind = "vcard"
+	KindBlocking Kind = "blocking"
+)
+
+type config struct {
+	size int
+	ttl  time.Duration
+}
+
+// Option configures a Storage.
+type Option func(*Storage)
+
+// WithRoster sets how many users' rosters are cached and for how long. A
+// size of zero or less disables the roster cache; a ttl of zero keeps
+// entries until they are evicted or invalidated.
+func WithRoster(size int, ttl time.Duration) Option {
+	return func(s *Storage) { s.configs[KindRoster] = config{size, ttl} }
+}
+
+// WithVCard sets how many users' vCards are cached and for how long, like
+// WithRoster. Users without a vCard are cached too.
+func WithVCard(size int, ttl time.Duration) Option {
+	return func(s *Storage) { s.configs[KindVCard] = config{size, ttl} }
+}
+
+// WithBlocking sets how many users' block lists are cached and for how
+// long, like WithRoster.
+func WithBlocking(size int, ttl time.Duration) Option {
+	return func(s *Storage) { s.configs[KindBlocking] = config{size, ttl} }
+}
+
+// WithClock sets the clock entries expire by. It defaults to clock.System.
+func WithClock(c clock.Clock) Option {
+	return func(s *Storage) { s.clock = clock.Or(c) }
+}
+
+// OnInvalidate sets a hook called after a write through the Storage
+// dropped the cached value of userJID, for example to tell other processes
+// sharing the backend to call Invalidate.
+func OnInvalidate(fn func(kind Kind, userJID string)) Option {
+	return func(s *Storage) { s.onInvalidate = fn }
+}
+
+// Storage is a storage.Storage that caches the roster, vCard and blocking
+// stores of another. The other sub-stores, Init and Close are passed
+// through.
+type Storage struct {
+	storage.Storage
+
+	configs      map[Kind]config
+	clock        clock.Clock
+	onInvalidate func(Kind, string)
+
+	rosters  *lru[[]storage.RosterItem]
+	versions *lru[string]
+	vcards   *lru[vcardEntry]
+	blocked  *lru[[]string]
+}
+
+type vcardEntry struct {
+	data  []byte
+	found bool
+}
+
+// New returns a Storage caching the stores of s. By default each store
+// caches DefaultSize users for DefaultTTL.
+func New(s storage.Storage, opts ...Option) *Storage {
+	c := &Storage{
+		Storage: s,
+		configs: map[Kind]config{
+			KindRoster:   {DefaultSize, DefaultTTL},
+			KindVCard:    {DefaultSize, DefaultTTL},
+			KindBlocking: {DefaultSize, DefaultTTL},
+		},
+		clock: clock.System,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.rosters = newLRU[[]storage.RosterItem](c.configs[KindRoster], c.clock)
+	c.versions = newLRU[string](c.configs[KindRoster], c.clock)
+	c.vcards = newLRU[vcardEntry](c.configs[KindVCard], c.clock)
+	c.blocked = newLRU[[]string](c.configs[KindBlocking], c.clock)
+	return c
+}
+
+// Invalidate drops the cached value of userJID in the cache of kind, for a
+// write made by another process. It does not call the OnInvalidate hook.
+func (c *Storage) Invalidate(kind Kind, userJID string) {
+	switch kind {
+	case KindRoster:
+		if c.rosters != nil {
+			c.rosters.remove(userJID)
+			c.versions.remove(userJID)
+		}
+	case KindVCard:
+		if c.vcards != nil {
+			c.vcards.remove(userJID)
+		}
+	case KindBlocking:
+		if c.blocked != nil {
+			c.blocked.remove(userJID)
+		}
+	}
+}
+
+// invalidate drops the cached value of userJID after a write through c.
+func (c *Storage) invalidate(kind Kind, userJID string) {
+	c.Invalidate(kind, userJID)
+	if c.onInvalidate != nil {
+		c.onInvalidate(kind, userJID)
+	}
+}
+
+func (c *Storage) RosterStore() storage.RosterStore {
+	rs := c.Storage.RosterStore()
+	if rs == nil || c.rosters == nil {
+		return rs
+	}
+	if rr, ok := rs.(storage.RosterReplacer); ok {
+		return &rosterReplacer{rosterStore{c, rs}, rr}
+	}
+	return &rosterStore{c, rs}
+}
+
+func (c *Storage) VCardStore() storage.VCardStore {
+	vs := c.Storage.VCardStore()
+	if vs == nil || c.vcards == nil {
+		return vs
+	}
+	return &vcardStore{c, vs}
+}
+
+func (c *Storage) BlockingStore() storage.BlockingStore {
+	bs := c.Storage.BlockingStore()
+	if bs == nil || c.blocked == nil {
+		return bs
+	}
+	return &blockingStore{c, bs}
+}
+
+// --- RosterStore ---
+
+type rosterStore struct {
+	c *Storage
+	s storage.RosterStore
+}
+
+// items returns the roster of userJID, from the cache when it is there.
+// The items are the cache's own and must not be modified.
+func (r *rosterStore) items(ctx context.Context, userJID string) ([]storage.RosterItem, error) {
+	items, gen, ok := r.c.rosters.get(userJID)
+	if ok {
+		return items, nil
+	}
+	loaded, err := r.s.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	items = make([]storage.RosterItem, len(loaded))
+	for i, item := range loaded {
+		items[i] = copyRosterItem(item)
+	}
+	r.c.rosters.put(userJID, items, gen)
+	return items, nil
+}
+
+func (r *rosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
+	items, err := r.items(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if items[i].ContactJID == contactJID {
+			item := copyRosterItem(&items[i])
+			return &item, nil
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+func (r *rosterStore) GetRosterItems(ctx context.Context, userJID string) ([]*storage.RosterItem, error) {
+	items, err := r.items(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*storage.RosterItem, len(items))
+	for i := range items {
+		item := copyRosterItem(&items[i])
+		out[i] = &item
+	}
+	return out, nil
+}
+
+func (r *rosterStore) UpsertRosterItem(ctx context.Context, item *storage.RosterItem) error {
+	defer r.c.invalidate(KindRoster, item.UserJID)
+	return r.s.UpsertRosterItem(ctx, item)
+}
+
+func (r *rosterStore) UpsertRosterItems(ctx context.Context, items []*storage.RosterItem) error {
+	defer func() {
+		seen := make(map[string]bool)
+		for _, item := range items {
+			if !seen[item.UserJID] {
+				seen[item.UserJID] = true
+				r.c.invalidate(KindRoster, item.UserJID)
+			}
+		}
+	}()
+	return r.s.UpsertRosterItems(ctx, items)
+}
+
+func (r *rosterStore) DeleteRosterItem(ctx context.Context, userJID, contactJID string) error {
+	defer r.c.invalidate(KindRoster, userJID)
+	return r.s.DeleteRosterItem(ctx, userJID, contactJID)
+}
+
+func (r *rosterStore) GetRosterVersion(ctx context.Context, userJID string) (string, error) {
+	version, gen, ok := r.c.versions.get(userJID)
+	if ok {
+		return version, nil
+	}
+	version, err := r.s.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return "", err
+	}
+	r.c.versions.put(userJID, version, gen)
+	return version, nil
+}
+
+func (r *rosterStore) SetRosterVersion(ctx context.Context, userJID, version string) error {
+	defer r.c.invalidate(KindRoster, userJID)
+	return r.s.SetRosterVersion(ctx, userJID, version)
+}
+
+type rosterReplacer struct {
+	rosterStore
+	rr storage.RosterReplacer
+}
+
+func (r *rosterReplacer) ReplaceRosterItems(ctx context.Context, userJID string, items []*storage.RosterItem, version string) error {
+	defer r.c.invalidate(KindRoster, userJID)
+	return r.rr.ReplaceRosterItems(ctx, userJID, items, version)
+}
+
+func copyRosterItem(item *storage.RosterItem) storage.RosterItem {
+	out := *item
+	out.Groups = slices.Clone(item.Groups)
+	return out
+}
+
+// --- VCardStore ---
+
+type vcardStore struct {
+	c *Storage
+	s storage.VCardStore
+}
+
+func (v *vcardStore) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
+	e, gen, ok := v.c.vcards.get(userJID)
+	if !ok {
+		data, err := v.s.GetVCard(ctx, userJID)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			e = vcardEntry{}
+		case err != nil:
+			return nil, err
+		default:
+			e = vcardEntry{data: slices.Clone(data), found: true}
+		}
+		v.c.vcards.put(userJID, e, gen)
+	}
+	if !e.found {
+		return nil, storage.ErrNotFound
+	}
+	return slices.Clone(e.data), nil
+}
+
+func (v *vcardStore) SetVCard(ctx context.Context, userJID string, data []byte) error {
+	defer v.c.invalidate(KindVCard, userJID)
+	return v.s.SetVCard(ctx, userJID, data)
+}
+
+func (v *vcardStore) DeleteVCard(ctx context.Context, userJID string) error {
+	defer v.c.invalidate(KindVCard, userJID)
+	return v.s.DeleteVCard(ctx, userJID)
+}
+
+// --- BlockingStore ---
+
+type blockingStore struct {
+	c *Storage
+	s storage.BlockingStore
+}
+
+// list returns the block list of userJID, from the cache when it is there.
+// The list is the cache's own and must not be modified.
+func (b *blockingStore) list(ctx context.Context, userJID string) ([]string, error) {
+	jids, gen, ok := b.c.blocked.get(userJID)
+	if ok {
+		return jids, nil
+	}
+	jids, err := b.s.GetBlockedJIDs(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	jids = slices.Clone(jids)
+	b.c.blocked.put(userJID, jids, gen)
+	return jids, nil
+}
+
+func (b *blockingStore) IsBlocked(ctx context.Context, userJID, blockedJID string) (bool, error) {
+	jids, err := b.list(ctx, userJID)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(jids, blockedJID), nil
+}
+
+func (b *blockingStore) GetBlockedJIDs(ctx context.Context, userJID string) ([]string, error) {
+	jids, err := b.list(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(jids), nil
+}
+
+func (b *blockingStore) BlockJID(ctx context.Context, userJID, blockedJID string) error {
+	defer b.c.invalidate(KindBlocking, userJID)
+	return b.s.BlockJID(ctx, userJID, blockedJID)
+}
+
+func (b *blockingStore) UnblockJID(ctx context.Context, userJID, blockedJID string) error {
+	defer b.c.invalidate(KindBlocking, userJID)
+	return b.s.UnblockJID(ctx, userJID, blockedJID)
+}
@@ -0,0 +1,189 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/cache"
+	"github.com/meszmate/xmpp-go/storage/memory"
+	"github.com/meszmate/xmpp-go/storage/storagetest"
+)
+
+func TestCacheStorage(t *testing.T) {
+	storagetest.TestStorage(t, func() storage.Storage {
+		return cache.New(memory.New())
+	})
+}
+
+// counted returns a backend that counts the calls made to it by name.
+func counted() (storage.Storage, func(op string) int) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	s := storage.Instrument(memory.New(), func(op string, _ time.Duration, _ error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[op]++
+	})
+	return s, func(op string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[op]
+	}
+}
+
+func TestCacheRoster(t *testing.T) {
+	ctx := context.Background()
+	backend, calls := counted()
+	var invalidated []string
+	s := cache.New(backend, cache.OnInvalidate(func(kind cache.Kind, user string) {
+		invalidated = append(invalidated, string(kind)+" "+user)
+	}))
+	rs := s.RosterStore()
+
+	if err := rs.UpsertRosterItem(ctx, &storage.RosterItem{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "both", Groups: []string{"Friends"}}); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		item, err := rs.GetRosterItem(ctx, "alice@example.com", "bob@example.com")
+		if err != nil || item.Subscription != "both" {
+			t.Fatalf("GetRosterItem = %+v, %v", item, err)
+		}
+		item.Groups[0] = "Changed"
+	}
+	if _, err := rs.GetRosterItem(ctx, "alice@example.com", "carol@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("missing contact: %v", err)
+	}
+	items, err := rs.GetRosterItems(ctx, "alice@example.com")
+	if err != nil || len(items) != 1 || items[0].Groups[0] != "Friends" {
+		t.Fatalf("GetRosterItems = %+v, %v", items, err)
+	}
+	if n := calls("GetRosterItems"); n != 1 {
+		t.Fatalf("backend read the roster %d times, want 1", n)
+	}
+
+	if err := rs.DeleteRosterItem(ctx, "alice@example.com", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.GetRosterItem(ctx, "alice@example.com", "bob@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("deleted contact: %v", err)
+	}
+	if n := calls("GetRosterItems"); n != 2 {
+		t.Fatalf("backend read the roster %d times, want 2", n)
+	}
+
+	if err := rs.SetRosterVersion(ctx, "alice@example.com", "3"); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if v, err := rs.GetRosterVersion(ctx, "alice@example.com"); err != nil || v != "3" {
+			t.Fatalf("GetRosterVersion = %q, %v", v, err)
+		}
+	}
+	if n := calls("GetRosterVersion"); n != 1 {
+		t.Fatalf("backend read the version %d times, want 1", n)
+	}
+	rr := rs.(storage.RosterReplacer)
+	if err := rr.ReplaceRosterItems(ctx, "alice@example.com", nil, "4"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := rs.GetRosterVersion(ctx, "alice@example.com"); v != "4" {
+		t.Fatalf("version after replace = %q", v)
+	}
+	if len(invalidated) != 4 || invalidated[0] != "roster alice@example.com" {
+		t.Fatalf("invalidated %v", invalidated)
+	}
+}
+
+func TestCacheVCardMisses(t *testing.T) {
+	ctx := context.Background()
+	backend, calls := counted()
+	vs := cache.New(backend).VCardStore()
+	for range 3 {
+		if _, err := vs.GetVCard(ctx, "alice@example.com"); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("GetVCard: %v", err)
+		}
+	}
+	if n := calls("GetVCard"); n != 1 {
+		t.Fatalf("backend read the vCard %d times, want 1", n)
+	}
+	if err := vs.SetVCard(ctx, "alice@example.com", []byte("<vCard/>")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vs.GetVCard(ctx, "alice@example.com"); err != nil || string(data) != "<vCard/>" {
+		t.Fatalf("GetVCard = %q, %v", data, err)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	backend, calls := counted()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	bs := cache.New(backend, cache.WithBlocking(10, time.Minute), cache.WithClock(clk)).BlockingStore()
+
+	if err := bs.BlockJID(ctx, "alice@example.com", "mallory@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(wantCalls int) {
+		t.Helper()
+		if blocked, err := bs.IsBlocked(ctx, "alice@example.com", "mallory@example.com"); err != nil || !blocked {
+			t.Fatalf("IsBlocked = %v, %v", blocked, err)
+		}
+		if n := calls("GetBlockedJIDs"); n != wantCalls {
+			t.Fatalf("backend read the block list %d times, want %d", n, wantCalls)
+		}
+	}
+	check(1)
+	clk.Advance(30 * time.Second)
+	check(1)
+	clk.Advance(time.Minute)
+	check(2)
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	backend, calls := counted()
+	vs := cache.New(backend, cache.WithVCard(2, 0)).VCardStore()
+	for _, user := range []string{"a@example.com", "b@example.com", "a@example.com", "c@example.com", "a@example.com", "b@example.com"} {
+		if _, err := vs.GetVCard(ctx, user); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+	// b is evicted by c, a stays as the most recently used.
+	if n := calls("GetVCard"); n != 4 {
+		t.Fatalf("backend read vCards %d times, want 4", n)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	backend := memory.New()
+	s := cache.New(backend)
+	bs := s.BlockingStore()
+	if blocked, _ := bs.IsBlocked(ctx, "alice@example.com", "mallory@example.com"); blocked {
+		t.Fatal("blocked before blocking")
+	}
+	// Another process writes to the shared backend.
+	if err := backend.BlockingStore().BlockJID(ctx, "alice@example.com", "mallory@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := bs.IsBlocked(ctx, "alice@example.com", "mallory@example.com"); blocked {
+		t.Fatal("cache saw a write it was not told about")
+	}
+	s.Invalidate(cache.KindBlocking, "alice@example.com")
+	if blocked, _ := bs.IsBlocked(ctx, "alice@example.com", "mallory@example.com"); !blocked {
+		t.Fatal("not blocked after Invalidate")
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	backend := memory.New()
+	s := cache.New(backend, cache.WithRoster(0, 0))
+	if _, ok := s.RosterStore().(*memory.Store); !ok {
+		t.Fatalf("RosterStore = %T, want the backend's", s.RosterStore())
+	}
+}
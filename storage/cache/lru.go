@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+)
+
+// lru is a size-bounded cache of values by user JID whose entries expire
+// after a TTL.
+type lru[V any] struct {
+	size  int
+	ttl   time.Duration // zero keeps entries until evicted
+	clock clock.Clock
+
+	mu      sync.Mutex
+	order   *list.List // of *entry[V], most recently used first
+	entries map[string]*list.Element
+	// gen counts invalidations, so that a value loaded before a write is
+	// not stored after it.
+	gen uint64
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRU[V any](c config, clk clock.Clock) *lru[V] {
+	if c.size <= 0 {
+		return nil
+	}
+	return &lru[V]{
+		size:    c.size,
+		ttl:     c.ttl,
+		clock:   clk,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value cached for key, and the generation to pass to put
+// when it is not cached.
+func (c *lru[V]) get(key string) (V, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[V])
+		if c.ttl <= 0 || c.clock.Now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			return e.value, c.gen, true
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	var zero V
+	return zero, c.gen, false
+}
+
+// put caches value for key, unless key was invalidated since the get that
+// returned gen.
+func (c *lru[V]) put(key string, value V, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	e := &entry[V]{key: key, value: value, expires: c.clock.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[V]).key)
+	}
+}
+
+// remove drops the value of key.
+func (c *lru[V]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,19 @@
+package storage
+
+import "context"
+
+// CapsStore caches the service discovery information (XEP-0030) behind
+// entity capabilities verification strings (XEP-0115, XEP-0390), so that a
+// client advertising capabilities seen before need not be queried again.
+// Only information verified against its hash is meant to be stored, which
+// keeps an entry valid forever and safe to share between users and
+// domains.
+type CapsStore interface {
+	// SetCapsInfo stores the disco#info query XML for ver, a verification
+	// string qualified by how it was computed, replacing any there.
+	SetCapsInfo(ctx context.Context, ver string, info []byte) error
+
+	// GetCapsInfo retrieves the disco#info query XML stored for ver.
+	// Returns ErrNotFound if there is none.
+	GetCapsInfo(ctx context.Context, ver string) ([]byte, error)
+}
@@ -0,0 +1,258 @@
+// Package credentials verifies the passwords of stored user accounts and
+// hashes new ones.
+//
+// An account is checked against the first of these it has:
+//
+//   - a password hash in User.Password: Argon2id in its PHC string format
+//     ("$argon2id$v=19$m=...,t=...,p=...$salt$hash") or bcrypt ("$2a$",
+//     "$2b$" or "$2y$");
+//   - SCRAM keys in User.Salt, Iterations, StoredKey and ServerKey, whose
+//     hash (SHA-1, SHA-256 or SHA-512) follows from the key length;
+//   - a plaintext User.Password. Comparing plaintext is deprecated and only
+//     kept so that existing accounts can still log in and be upgraded.
+//
+// Authenticate replaces plaintext passwords, bcrypt hashes and Argon2id
+// hashes weaker than Default with a Default hash when they log in, so
+// stored credentials improve without users resetting their passwords. An
+// account without SCRAM keys gets SCRAM-SHA-256 keys at its next login, so
+// that SCRAM works without a plaintext password, which is kept only when
+// KeepPlaintext is set.
+package credentials
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// Argon2id hashes passwords with Argon2id (RFC 9106).
+type Argon2id struct {
+	Time    uint32 // passes over the memory
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// Default hashes the passwords Authenticate upgrades, with the parameters
+// OWASP recommends as a minimum.
+var Default = Argon2id{Time: 2, Memory: 19 << 10, Threads: 1}
+
+// KeepPlaintext makes Authenticate keep plaintext passwords when it
+// upgrades an account, for SASL mechanisms that derive their credentials
+// from the password, such as SCRAM with hashes other than SHA-256.
+var KeepPlaintext bool
+
+// SCRAMIterations is the iteration count of the SCRAM-SHA-256 keys
+// Authenticate stores for accounts that have none.
+var SCRAMIterations = 4096
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	scramSaltLen  = 16
+)
+
+// Hash returns the PHC string of an Argon2id hash of password with a random
+// salt.
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Hash returns a Default hash of password.
+func Hash(password string) (string, error) {
+	return Default.Hash(password)
+}
+
+// IsHash reports whether s, a User.Password, is a password hash rather
+// than plaintext.
+func IsHash(s string) bool {
+	return isArgon2id(s) || isBcrypt(s)
+}
+
+func isArgon2id(s string) bool { return strings.HasPrefix(s, "$argon2id$") }
+
+func isBcrypt(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// Verify checks password against the credentials of user. It returns
+// storage.ErrAuthFailed if they do not match or user has none, and whether
+// the credentials should be upgraded if they do.
+func Verify(user *storage.User, password string) (rehash bool, err error) {
+	switch {
+	case isArgon2id(user.Password):
+		if _, ok := verifyArgon2id(user.Password, password); !ok {
+			return false, storage.ErrAuthFailed
+		}
+		_, _, keys := scramCredentials(user)
+		return outdated(user.Password) || !keys, nil
+	case isBcrypt(user.Password):
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			return false, storage.ErrAuthFailed
+		}
+		return true, nil
+	}
+	if creds, mechanism, ok := scramCredentials(user); ok {
+		if !creds.Verify(mechanism, password) {
+			return false, storage.ErrAuthFailed
+		}
+		// A plaintext password next to the keys is kept on purpose, for
+		// mechanisms the keys cannot serve.
+		return false, nil
+	}
+	if user.Password == "" || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return false, storage.ErrAuthFailed
+	}
+	return true, nil
+}
+
+// outdated reports whether the User.Password s should be replaced with a
+// Default hash: a bcrypt hash, an Argon2id hash weaker than Default, or
+// plaintext unless KeepPlaintext is set.
+func outdated(s string) bool {
+	switch {
+	case isArgon2id(s):
+		params, _, _, ok := parseArgon2id(s)
+		return !ok || params.Time < Default.Time || params.Memory < Default.Memory
+	case isBcrypt(s):
+		return true
+	}
+	return !KeepPlaintext
+}
+
+// verifyArgon2id checks password against the PHC string hash and returns
+// its parameters.
+func verifyArgon2id(hash, password string) (params Argon2id, ok bool) {
+	params, salt, key, ok := parseArgon2id(hash)
+	if !ok {
+		return params, false
+	}
+	derived := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return params, subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// parseArgon2id decodes the PHC string hash.
+func parseArgon2id(hash string) (params Argon2id, salt, key []byte, ok bool) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, false
+	}
+	return params, salt, key, true
+}
+
+// scramCredentials decodes the SCRAM keys of user and names the mechanism
+// they were derived for.
+func scramCredentials(user *storage.User) (creds sasl.SCRAMCredentials, mechanism string, ok bool) {
+	if user.Salt == "" || user.StoredKey == "" || user.ServerKey == "" || user.Iterations <= 0 {
+		return creds, "", false
+	}
+	var err error
+	if creds.Salt, err = base64.StdEncoding.DecodeString(user.Salt); err != nil {
+		return creds, "", false
+	}
+	if creds.StoredKey, err = base64.StdEncoding.DecodeString(user.StoredKey); err != nil {
+		return creds, "", false
+	}
+	if creds.ServerKey, err = base64.StdEncoding.DecodeString(user.ServerKey); err != nil {
+		return creds, "", false
+	}
+	creds.Iterations = user.Iterations
+	switch len(creds.StoredKey) {
+	case 20:
+		mechanism = "SCRAM-SHA-1"
+	case 32:
+		mechanism = "SCRAM-SHA-256"
+	case 64:
+		mechanism = "SCRAM-SHA-512"
+	default:
+		return creds, "", false
+	}
+	return creds, mechanism, true
+}
+
+// Authenticate checks password against the account username in us, and
+// upgrades its credentials if Verify says so. It implements
+// UserStore.Authenticate for backends: it returns storage.ErrAuthFailed for
+// a wrong password or unknown account.
+func Authenticate(ctx context.Context, us storage.UserStore, username, password string) (bool, error) {
+	user, err := us.GetUser(ctx, username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, storage.ErrAuthFailed
+	}
+	if err != nil {
+		return false, err
+	}
+	rehash, err := Verify(user, password)
+	if err != nil {
+		return false, err
+	}
+	if rehash {
+		upgrade(ctx, us, user, password)
+	}
+	return true, nil
+}
+
+// upgrade stores SCRAM-SHA-256 keys derived from password for user if it
+// has no SCRAM keys, and replaces its password with a Default hash if it is
+// outdated. Nothing changes if the credentials
+// changed since they were verified. Failing to upgrade is not an error: the
+// old credentials still work and are upgraded at the next login.
+func upgrade(ctx context.Context, us storage.UserStore, user *storage.User, password string) {
+	current, err := us.GetUser(ctx, user.Username)
+	if err != nil || current.Password != user.Password || current.StoredKey != user.StoredKey {
+		return
+	}
+	if _, _, ok := scramCredentials(current); !ok {
+		salt := make([]byte, scramSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return
+		}
+		creds, err := sasl.NewSCRAMCredentials("SCRAM-SHA-256", password, salt, SCRAMIterations)
+		if err != nil {
+			return
+		}
+		current.Salt = base64.StdEncoding.EncodeToString(creds.Salt)
+		current.Iterations = creds.Iterations
+		current.StoredKey = base64.StdEncoding.EncodeToString(creds.StoredKey)
+		current.ServerKey = base64.StdEncoding.EncodeToString(creds.ServerKey)
+	}
+	if outdated(current.Password) {
+		hash, err := Hash(password)
+		if err != nil {
+			return
+		}
+		current.Password = hash
+	}
+	_ = us.UpdateUser(ctx, current)
+}
@@ -0,0 +1,112 @@
+package credentials
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+func TestArgon2id(t *testing.T) {
+	hash, err := Hash("pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") || !IsHash(hash) {
+		t.Fatalf("hash = %q", hash)
+	}
+	if other, _ := Hash("pencil"); other == hash {
+		t.Fatal("hashes are not salted")
+	}
+	// Without SCRAM keys the account is upgraded to get them.
+	user := &storage.User{Username: "alice", Password: hash}
+	if rehash, err := Verify(user, "pencil"); err != nil || !rehash {
+		t.Fatalf("Verify without keys = %v, %v", rehash, err)
+	}
+	creds, err := sasl.NewSCRAMCredentials("SCRAM-SHA-256", "pencil", []byte("salt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withKeys := func(password string) *storage.User {
+		return &storage.User{
+			Password:   password,
+			Salt:       base64.StdEncoding.EncodeToString(creds.Salt),
+			Iterations: creds.Iterations,
+			StoredKey:  base64.StdEncoding.EncodeToString(creds.StoredKey),
+			ServerKey:  base64.StdEncoding.EncodeToString(creds.ServerKey),
+		}
+	}
+	user = withKeys(hash)
+	if rehash, err := Verify(user, "pencil"); err != nil || rehash {
+		t.Fatalf("Verify = %v, %v", rehash, err)
+	}
+	if _, err := Verify(user, "Pencil"); err != storage.ErrAuthFailed {
+		t.Fatalf("Verify wrong: got %v, want ErrAuthFailed", err)
+	}
+
+	stronger, _ := Argon2id{Time: 3, Memory: 32 << 10, Threads: 2}.Hash("pencil")
+	if rehash, err := Verify(withKeys(stronger), "pencil"); err != nil || rehash {
+		t.Fatalf("Verify stronger = %v, %v", rehash, err)
+	}
+	weaker, _ := Argon2id{Time: 2, Memory: 8 << 10, Threads: 1}.Hash("pencil")
+	if rehash, err := Verify(withKeys(weaker), "pencil"); err != nil || !rehash {
+		t.Fatalf("Verify weaker = %v, %v", rehash, err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$",
+		"$argon2id$v=18$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0$",
+		"$2b$10$short",
+	} {
+		if _, err := Verify(&storage.User{Password: hash}, ""); err != storage.ErrAuthFailed {
+			t.Errorf("Verify %q: got %v, want ErrAuthFailed", hash, err)
+		}
+	}
+	if _, err := Verify(&storage.User{}, ""); err != storage.ErrAuthFailed {
+		t.Errorf("Verify without credentials: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestVerifySCRAM(t *testing.T) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	for _, mechanism := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		creds, err := sasl.NewSCRAMCredentials(mechanism, "pencil", salt, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := &storage.User{
+			Salt:       base64.StdEncoding.EncodeToString(creds.Salt),
+			Iterations: creds.Iterations,
+			StoredKey:  base64.StdEncoding.EncodeToString(creds.StoredKey),
+			ServerKey:  base64.StdEncoding.EncodeToString(creds.ServerKey),
+		}
+		if rehash, err := Verify(user, "pencil"); err != nil || rehash {
+			t.Errorf("%s: Verify = %v, %v", mechanism, rehash, err)
+		}
+		if _, err := Verify(user, "pen"); err != storage.ErrAuthFailed {
+			t.Errorf("%s: Verify wrong: got %v, want ErrAuthFailed", mechanism, err)
+		}
+	}
+}
+
+func TestVerifyPlaintext(t *testing.T) {
+	user := &storage.User{Password: "pencil"}
+	if IsHash(user.Password) {
+		t.Fatal("plaintext taken for a hash")
+	}
+	if rehash, err := Verify(user, "pencil"); err != nil || !rehash {
+		t.Fatalf("Verify = %v, %v", rehash, err)
+	}
+	if _, err := Verify(user, "pencil "); err != storage.ErrAuthFailed {
+		t.Fatalf("Verify wrong: got %v, want ErrAuthFailed", err)
+	}
+}
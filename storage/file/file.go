@@ -4,33 +4,53 @@ package file
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 )
 
 // Store implements storage.Storage using JSON files on disk.
 type Store struct {
 	mu      sync.RWMutex
 	baseDir string
+	clock   clock.Clock
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithClock sets the clock used to stamp creation and update times. It
+// defaults to clock.System.
+func WithClock(c clock.Clock) Option {
+	return func(s *Store) { s.clock = clock.Or(c) }
 }
 
 // New creates a new file-based store rooted at baseDir.
-func New(baseDir string) *Store {
-	return &Store{baseDir: baseDir}
+func New(baseDir string, opts ...Option) *Store {
+	s := &Store{baseDir: baseDir, clock: clock.System}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Store) Init(_ context.Context) error {
 	dirs := []string{
 		"users", "roster", "roster_versions", "blocking", "vcards",
-		"offline", "mam", "muc_rooms", "muc_affiliations",
+		"offline", "mam", "mam_prefs", "muc_rooms", "muc_affiliations",
 		"pubsub_nodes", "pubsub_items", "pubsub_subscriptions", "bookmarks",
+		"push", "caps", "shared_groups",
 	}
 	for _, d := range dirs {
 		if err := os.MkdirAll(filepath.Join(s.baseDir, d), 0o755); err != nil {
@@ -42,15 +62,18 @@ func (s *Store) Init(_ context.Context) error {
 
 func (s *Store) Close() error { return nil }
 
-func (s *Store) UserStore() storage.UserStore         { return s }
-func (s *Store) RosterStore() storage.RosterStore     { return s }
-func (s *Store) BlockingStore() storage.BlockingStore { return s }
-func (s *Store) VCardStore() storage.VCardStore       { return s }
-func (s *Store) OfflineStore() storage.OfflineStore   { return s }
-func (s *Store) MAMStore() storage.MAMStore           { return s }
-func (s *Store) MUCRoomStore() storage.MUCRoomStore   { return s }
-func (s *Store) PubSubStore() storage.PubSubStore     { return s }
-func (s *Store) BookmarkStore() storage.BookmarkStore { return s }
+func (s *Store) UserStore() storage.UserStore               { return s }
+func (s *Store) RosterStore() storage.RosterStore           { return s }
+func (s *Store) BlockingStore() storage.BlockingStore       { return s }
+func (s *Store) VCardStore() storage.VCardStore             { return s }
+func (s *Store) OfflineStore() storage.OfflineStore         { return s }
+func (s *Store) MAMStore() storage.MAMStore                 { return s }
+func (s *Store) MUCRoomStore() storage.MUCRoomStore         { return s }
+func (s *Store) PubSubStore() storage.PubSubStore           { return s }
+func (s *Store) BookmarkStore() storage.BookmarkStore       { return s }
+func (s *Store) PushStore() storage.PushStore               { return s }
+func (s *Store) CapsStore() storage.CapsStore               { return s }
+func (s *Store) SharedGroupStore() storage.SharedGroupStore { return s }
 
 // File helpers
 
@@ -105,7 +128,7 @@ func (s *Store) CreateUser(_ context.Context, user *storage.User) error {
 	if s.exists(p) {
 		return storage.ErrUserExists
 	}
-	now := time.Now()
+	now := s.clock.Now()
 	user.CreatedAt = now
 	user.UpdatedAt = now
 	return s.writeJSON(p, user)
@@ -128,7 +151,7 @@ func (s *Store) UpdateUser(_ context.Context, user *storage.User) error {
 	if !s.exists(p) {
 		return storage.ErrNotFound
 	}
-	user.UpdatedAt = time.Now()
+	user.UpdatedAt = s.clock.Now()
 	return s.writeJSON(p, user)
 }
 
@@ -142,23 +165,36 @@ func (s *Store) DeleteUser(_ context.Context, username string) error {
 	return os.Remove(p)
 }
 
-func (s *Store) UserExists(_ context.Context, username string) (bool, error) {
+func (s *Store) ListUsers(_ context.Context) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.exists(s.path("users", safeFileName(username)+".json")), nil
+	entries, err := os.ReadDir(s.path("users"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		var user storage.User
+		if err := s.readJSON(filepath.Join(s.path("users"), e.Name()), &user); err != nil {
+			continue
+		}
+		names = append(names, user.Username)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-func (s *Store) Authenticate(_ context.Context, username, password string) (bool, error) {
+func (s *Store) UserExists(_ context.Context, username string) (bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	var user storage.User
-	if err := s.readJSON(s.path("users", safeFileName(username)+".json"), &user); err != nil {
-		return false, storage.ErrAuthFailed
-	}
-	if user.Password != password {
-		return false, storage.ErrAuthFailed
-	}
-	return true, nil
+	return s.exists(s.path("users", safeFileName(username)+".json")), nil
+}
+
+func (s *Store) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	return credentials.Authenticate(ctx, s, username, password)
 }
 
 // --- RosterStore ---
@@ -197,6 +233,34 @@ func (s *Store) UpsertRosterItem(_ context.Context, item *storage.RosterItem) er
 	return s.writeJSON(s.rosterPath(item.UserJID), rf)
 }
 
+// UpsertRosterItems writes the roster file of each user once. All files
+// are read before any is written.
+func (s *Store) UpsertRosterItems(_ context.Context, items []*storage.RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rosters := make(map[string]*rosterFile)
+	var users []string
+	for _, item := range items {
+		rf, ok := rosters[item.UserJID]
+		if !ok {
+			var err error
+			if rf, err = s.loadRoster(item.UserJID); err != nil {
+				return err
+			}
+			rosters[item.UserJID] = rf
+			users = append(users, item.UserJID)
+		}
+		cp := *item
+		rf.Items[item.ContactJID] = &cp
+	}
+	for _, user := range users {
+		if err := s.writeJSON(s.rosterPath(user), rosters[user]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Store) GetRosterItem(_ context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -377,7 +441,7 @@ func (s *Store) StoreOfflineMessage(_ context.Context, msg *storage.OfflineMessa
 	}
 	cp := *msg
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	msgs = append(msgs, &cp)
 	return s.writeJSON(s.offlinePath(msg.UserJID), msgs)
@@ -403,6 +467,20 @@ func (s *Store) DeleteOfflineMessages(_ context.Context, userJID string) error {
 	return os.Remove(p)
 }
 
+func (s *Store) DeleteOfflineMessagesByIDs(_ context.Context, userJID string, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, err := s.loadOffline(userJID)
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	kept := slices.DeleteFunc(msgs, func(msg *storage.OfflineMessage) bool { return slices.Contains(ids, msg.ID) })
+	if len(kept) == 0 {
+		return os.Remove(s.offlinePath(userJID))
+	}
+	return s.writeJSON(s.offlinePath(userJID), kept)
+}
+
 func (s *Store) CountOfflineMessages(_ context.Context, userJID string) (int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -430,7 +508,17 @@ func (s *Store) loadMAM(userJID string) ([]*storage.ArchivedMessage, error) {
 	return msgs, nil
 }
 
-var mamCounter int64
+// nextMAMID returns an ID above every numeric ID in the archive, so that
+// generated IDs stay unique across restarts and between stores.
+func nextMAMID(msgs []*storage.ArchivedMessage) uint64 {
+	var last uint64
+	for _, msg := range msgs {
+		if n, err := strconv.ParseUint(msg.ID, 10, 64); err == nil && n > last {
+			last = n
+		}
+	}
+	return last + 1
+}
 
 func (s *Store) ArchiveMessage(_ context.Context, msg *storage.ArchivedMessage) error {
 	s.mu.Lock()
@@ -439,16 +527,47 @@ func (s *Store) ArchiveMessage(_ context.Context, msg *storage.ArchivedMessage)
 	if err != nil {
 		return err
 	}
+	msgs = s.insertMAM(msgs, msg)
+	return s.writeJSON(s.mamPath(msg.UserJID), msgs)
+}
+
+// ArchiveMessages writes the archive file of each user once. All files
+// are read before any is written.
+func (s *Store) ArchiveMessages(_ context.Context, msgs []*storage.ArchivedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archives := make(map[string][]*storage.ArchivedMessage)
+	var users []string
+	for _, msg := range msgs {
+		archive, ok := archives[msg.UserJID]
+		if !ok {
+			var err error
+			if archive, err = s.loadMAM(msg.UserJID); err != nil {
+				return err
+			}
+			users = append(users, msg.UserJID)
+		}
+		archives[msg.UserJID] = s.insertMAM(archive, msg)
+	}
+	for _, user := range users {
+		if err := s.writeJSON(s.mamPath(user), archives[user]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertMAM adds a copy of msg to archive, stamped and given an ID if it
+// has none.
+func (s *Store) insertMAM(archive []*storage.ArchivedMessage, msg *storage.ArchivedMessage) []*storage.ArchivedMessage {
 	cp := *msg
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	if cp.ID == "" {
-		mamCounter++
-		cp.ID = fmt.Sprintf("%d", mamCounter)
+		cp.ID = strconv.FormatUint(nextMAMID(archive), 10)
 	}
-	msgs = append(msgs, &cp)
-	return s.writeJSON(s.mamPath(msg.UserJID), msgs)
+	return storage.InsertMessage(archive, &cp)
 }
 
 func (s *Store) QueryMessages(_ context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
@@ -458,54 +577,88 @@ func (s *Store) QueryMessages(_ context.Context, query *storage.MAMQuery) (*stor
 	if err != nil {
 		return nil, err
 	}
+	return storage.QueryArchive(msgs, query)
+}
+
+func (s *Store) DeleteMessageArchive(_ context.Context, userJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.mamPath(userJID)
+	if !s.exists(p) {
+		return nil
+	}
+	return os.Remove(p)
+}
+
+func (s *Store) DeleteMessagesBefore(_ context.Context, userJID string, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, err := s.loadMAM(userJID)
+	if err != nil {
+		return 0, err
+	}
+	msgs, n := storage.ExpireMessages(msgs, before)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.writeJSON(s.mamPath(userJID), msgs)
+}
 
-	var filtered []*storage.ArchivedMessage
-	afterIDFound := query.AfterID == ""
+func (s *Store) GetArchivedMessage(_ context.Context, userJID, id string) (*storage.ArchivedMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs, err := s.loadMAM(userJID)
+	if err != nil {
+		return nil, err
+	}
 	for _, msg := range msgs {
-		if !afterIDFound {
-			if msg.ID == query.AfterID {
-				afterIDFound = true
-			}
-			continue
-		}
-		if query.BeforeID != "" && msg.ID == query.BeforeID {
-			break
-		}
-		if query.WithJID != "" && msg.WithJID != query.WithJID {
-			continue
-		}
-		if !query.Start.IsZero() && msg.CreatedAt.Before(query.Start) {
-			continue
+		if msg.ID == id {
+			return msg, nil
 		}
-		if !query.End.IsZero() && msg.CreatedAt.After(query.End) {
-			continue
-		}
-		filtered = append(filtered, msg)
 	}
+	return nil, storage.ErrNotFound
+}
 
-	max := query.Max
-	if max <= 0 {
-		max = 100
+func (s *Store) UpdateArchivedMessage(_ context.Context, msg *storage.ArchivedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, err := s.loadMAM(msg.UserJID)
+	if err != nil {
+		return err
 	}
-	complete := len(filtered) <= max
-	if len(filtered) > max {
-		filtered = filtered[:max]
+	for _, m := range msgs {
+		if m.ID == msg.ID {
+			m.Data = msg.Data
+			return s.writeJSON(s.mamPath(msg.UserJID), msgs)
+		}
 	}
+	return storage.ErrNotFound
+}
 
-	result := &storage.MAMResult{
-		Messages: filtered, Complete: complete, Count: len(filtered),
-	}
-	if len(filtered) > 0 {
-		result.First = filtered[0].ID
-		result.Last = filtered[len(filtered)-1].ID
+func (s *Store) mamPrefsPath(userJID string) string {
+	return s.path("mam_prefs", safeFileName(userJID)+".json")
+}
+
+func (s *Store) GetMAMPrefs(_ context.Context, userJID string) (*storage.MAMPrefs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var prefs storage.MAMPrefs
+	if err := s.readJSON(s.mamPrefsPath(userJID), &prefs); err != nil {
+		return nil, err
 	}
-	return result, nil
+	return &prefs, nil
 }
 
-func (s *Store) DeleteMessageArchive(_ context.Context, userJID string) error {
+func (s *Store) SetMAMPrefs(_ context.Context, prefs *storage.MAMPrefs) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	p := s.mamPath(userJID)
+	return s.writeJSON(s.mamPrefsPath(prefs.UserJID), prefs)
+}
+
+func (s *Store) DeleteMAMPrefs(_ context.Context, userJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.mamPrefsPath(userJID)
 	if !s.exists(p) {
 		return nil
 	}
@@ -728,7 +881,7 @@ func (s *Store) UpsertItem(_ context.Context, item *storage.PubSubItem) error {
 	}
 	cp := *item
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	items[item.ItemID] = &cp
 	return s.writeJSON(s.pubsubItemsPath(item.Host, item.NodeID), items)
@@ -948,3 +1101,195 @@ func (s *Store) DeleteBookmark(_ context.Context, userJID, roomJID string) error
 	delete(bms, roomJID)
 	return s.writeJSON(s.bookmarkPath(userJID), bms)
 }
+
+// --- PushStore ---
+
+func (s *Store) pushPath(userJID string) string {
+	return s.path("push", safeFileName(userJID)+".json")
+}
+
+func (s *Store) loadPushRegistrations(userJID string) ([]*storage.PushRegistration, error) {
+	var regs []*storage.PushRegistration
+	if err := s.readJSON(s.pushPath(userJID), &regs); err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	return regs, nil
+}
+
+func (s *Store) SetPushRegistration(_ context.Context, reg *storage.PushRegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	regs, err := s.loadPushRegistrations(reg.UserJID)
+	if err != nil {
+		return err
+	}
+	cp := *reg
+	replaced := false
+	for i, r := range regs {
+		if r.JID == reg.JID && r.Node == reg.Node {
+			regs[i], replaced = &cp, true
+		}
+	}
+	if !replaced {
+		regs = append(regs, &cp)
+	}
+	return s.writeJSON(s.pushPath(reg.UserJID), regs)
+}
+
+func (s *Store) GetPushRegistrations(_ context.Context, userJID string) ([]*storage.PushRegistration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	regs, err := s.loadPushRegistrations(userJID)
+	if err != nil {
+		return nil, err
+	}
+	if regs == nil {
+		regs = []*storage.PushRegistration{}
+	}
+	return regs, nil
+}
+
+func (s *Store) DeletePushRegistrations(_ context.Context, userJID, jid, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	regs, err := s.loadPushRegistrations(userJID)
+	if err != nil {
+		return err
+	}
+	kept := regs[:0]
+	for _, r := range regs {
+		if r.JID != jid || (node != "" && r.Node != node) {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(regs) {
+		return nil
+	}
+	return s.writeJSON(s.pushPath(userJID), kept)
+}
+
+// --- CapsStore ---
+
+// capsPath hex-encodes ver, since verification strings are case-sensitive
+// base64 and file systems may not be.
+func (s *Store) capsPath(ver string) string {
+	return s.path("caps", hex.EncodeToString([]byte(ver))+".xml")
+}
+
+func (s *Store) SetCapsInfo(_ context.Context, ver string, info []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.WriteFile(s.capsPath(ver), info, 0o644)
+}
+
+func (s *Store) GetCapsInfo(_ context.Context, ver string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, err := os.ReadFile(s.capsPath(ver))
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	}
+	return info, err
+}
+
+// --- SharedGroupStore ---
+
+// sharedGroupPath hex-encodes name, which may hold any character.
+func (s *Store) sharedGroupPath(name string) string {
+	return s.path("shared_groups", hex.EncodeToString([]byte(name))+".json")
+}
+
+func (s *Store) loadSharedGroup(name string) (*storage.SharedGroup, error) {
+	var g storage.SharedGroup
+	if err := s.readJSON(s.sharedGroupPath(name), &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *Store) SetSharedGroup(_ context.Context, group *storage.SharedGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *group
+	cp.Members = slices.Compact(slices.Sorted(slices.Values(group.Members)))
+	return s.writeJSON(s.sharedGroupPath(group.Name), &cp)
+}
+
+func (s *Store) GetSharedGroup(_ context.Context, name string) (*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadSharedGroup(name)
+}
+
+func (s *Store) ListSharedGroups(_ context.Context) ([]*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sharedGroupsWhere(func(*storage.SharedGroup) bool { return true })
+}
+
+func (s *Store) DeleteSharedGroup(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.sharedGroupPath(name))
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) AddSharedGroupMember(_ context.Context, name, memberJID string) error {
+	return s.updateSharedGroup(name, func(g *storage.SharedGroup) {
+		if i, found := slices.BinarySearch(g.Members, memberJID); !found {
+			g.Members = slices.Insert(g.Members, i, memberJID)
+		}
+	})
+}
+
+func (s *Store) RemoveSharedGroupMember(_ context.Context, name, memberJID string) error {
+	return s.updateSharedGroup(name, func(g *storage.SharedGroup) {
+		if i, found := slices.BinarySearch(g.Members, memberJID); found {
+			g.Members = slices.Delete(g.Members, i, i+1)
+		}
+	})
+}
+
+func (s *Store) GetMemberSharedGroups(_ context.Context, memberJID string) ([]*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sharedGroupsWhere(func(g *storage.SharedGroup) bool {
+		_, found := slices.BinarySearch(g.Members, memberJID)
+		return found
+	})
+}
+
+func (s *Store) updateSharedGroup(name string, update func(*storage.SharedGroup)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.loadSharedGroup(name)
+	if err != nil {
+		return err
+	}
+	update(g)
+	return s.writeJSON(s.sharedGroupPath(name), g)
+}
+
+// sharedGroupsWhere returns the groups match accepts, ordered by name. The
+// caller holds s.mu.
+func (s *Store) sharedGroupsWhere(match func(*storage.SharedGroup) bool) ([]*storage.SharedGroup, error) {
+	entries, err := os.ReadDir(s.path("shared_groups"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var groups []*storage.SharedGroup
+	for _, e := range entries {
+		var g storage.SharedGroup
+		if err := s.readJSON(s.path("shared_groups", e.Name()), &g); err != nil {
+			return nil, err
+		}
+		if match(&g) {
+			groups = append(groups, &g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
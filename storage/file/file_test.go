@@ -13,3 +13,9 @@ func TestFileStorage(t *testing.T) {
 		return file.New(t.TempDir())
 	})
 }
+
+func BenchmarkFileStorage(b *testing.B) {
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		return file.New(b.TempDir())
+	})
+}
@@ -0,0 +1,610 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Observer receives the name, duration and error of every storage call made
+// through a view returned by Instrument.
+type Observer func(op string, d time.Duration, err error)
+
+// Instrument returns a view of s that reports every call to its sub-stores
+// to observe, for example to record storage latency. op is the name of the
+// method, such as GetRosterItems. Init and Close are passed through to s.
+func Instrument(s Storage, observe Observer) Storage {
+	return &instrumented{s: s, observer: observe}
+}
+
+type instrumented struct {
+	s        Storage
+	observer Observer
+}
+
+// observe reports a call to op that started at start and failed with
+// *err, once it returns.
+func (i *instrumented) observe(op string, start time.Time, err *error) {
+	i.observer(op, time.Since(start), *err)
+}
+
+func (i *instrumented) Init(ctx context.Context) error { return i.s.Init(ctx) }
+func (i *instrumented) Close() error                   { return i.s.Close() }
+
+func (i *instrumented) UserStore() UserStore {
+	s := i.s.UserStore()
+	if s == nil {
+		return nil
+	}
+	if ul, ok := s.(UserLister); ok {
+		return &instUserLister{instUserStore{i, s}, ul}
+	}
+	return &instUserStore{i, s}
+}
+
+func (i *instrumented) RosterStore() RosterStore {
+	rs := i.s.RosterStore()
+	if rs == nil {
+		return nil
+	}
+	if rr, ok := rs.(RosterReplacer); ok {
+		return &instRosterReplacer{instRosterStore{i, rs}, rr}
+	}
+	return &instRosterStore{i, rs}
+}
+
+func (i *instrumented) BlockingStore() BlockingStore {
+	s := i.s.BlockingStore()
+	if s == nil {
+		return nil
+	}
+	return &instBlockingStore{i, s}
+}
+
+func (i *instrumented) VCardStore() VCardStore {
+	s := i.s.VCardStore()
+	if s == nil {
+		return nil
+	}
+	return &instVCardStore{i, s}
+}
+
+func (i *instrumented) OfflineStore() OfflineStore {
+	s := i.s.OfflineStore()
+	if s == nil {
+		return nil
+	}
+	return &instOfflineStore{i, s}
+}
+
+func (i *instrumented) MAMStore() MAMStore {
+	s := i.s.MAMStore()
+	if s == nil {
+		return nil
+	}
+	if me, ok := s.(MAMEditor); ok {
+		return &instMAMEditor{instMAMStore{i, s}, me}
+	}
+	return &instMAMStore{i, s}
+}
+
+func (i *instrumented) MUCRoomStore() MUCRoomStore {
+	s := i.s.MUCRoomStore()
+	if s == nil {
+		return nil
+	}
+	return &instMUCRoomStore{i, s}
+}
+
+func (i *instrumented) PubSubStore() PubSubStore {
+	s := i.s.PubSubStore()
+	if s == nil {
+		return nil
+	}
+	return &instPubSubStore{i, s}
+}
+
+func (i *instrumented) BookmarkStore() BookmarkStore {
+	s := i.s.BookmarkStore()
+	if s == nil {
+		return nil
+	}
+	return &instBookmarkStore{i, s}
+}
+
+func (i *instrumented) PushStore() PushStore {
+	s := i.s.PushStore()
+	if s == nil {
+		return nil
+	}
+	return &instPushStore{i, s}
+}
+
+func (i *instrumented) CapsStore() CapsStore {
+	s := i.s.CapsStore()
+	if s == nil {
+		return nil
+	}
+	return &instCapsStore{i, s}
+}
+
+func (i *instrumented) SharedGroupStore() SharedGroupStore {
+	s := i.s.SharedGroupStore()
+	if s == nil {
+		return nil
+	}
+	return &instSharedGroupStore{i, s}
+}
+
+// --- UserStore ---
+
+type instUserStore struct {
+	i *instrumented
+	s UserStore
+}
+
+func (u *instUserStore) CreateUser(ctx context.Context, user *User) (err error) {
+	defer u.i.observe("CreateUser", time.Now(), &err)
+	return u.s.CreateUser(ctx, user)
+}
+
+func (u *instUserStore) GetUser(ctx context.Context, username string) (_ *User, err error) {
+	defer u.i.observe("GetUser", time.Now(), &err)
+	return u.s.GetUser(ctx, username)
+}
+
+func (u *instUserStore) UpdateUser(ctx context.Context, user *User) (err error) {
+	defer u.i.observe("UpdateUser", time.Now(), &err)
+	return u.s.UpdateUser(ctx, user)
+}
+
+func (u *instUserStore) DeleteUser(ctx context.Context, username string) (err error) {
+	defer u.i.observe("DeleteUser", time.Now(), &err)
+	return u.s.DeleteUser(ctx, username)
+}
+
+func (u *instUserStore) UserExists(ctx context.Context, username string) (_ bool, err error) {
+	defer u.i.observe("UserExists", time.Now(), &err)
+	return u.s.UserExists(ctx, username)
+}
+
+func (u *instUserStore) Authenticate(ctx context.Context, username, password string) (_ bool, err error) {
+	defer u.i.observe("Authenticate", time.Now(), &err)
+	return u.s.Authenticate(ctx, username, password)
+}
+
+type instUserLister struct {
+	instUserStore
+	ul UserLister
+}
+
+func (u *instUserLister) ListUsers(ctx context.Context) (_ []string, err error) {
+	defer u.i.observe("ListUsers", time.Now(), &err)
+	return u.ul.ListUsers(ctx)
+}
+
+// --- RosterStore ---
+
+type instRosterStore struct {
+	i *instrumented
+	s RosterStore
+}
+
+func (r *instRosterStore) UpsertRosterItem(ctx context.Context, item *RosterItem) (err error) {
+	defer r.i.observe("UpsertRosterItem", time.Now(), &err)
+	return r.s.UpsertRosterItem(ctx, item)
+}
+
+func (r *instRosterStore) UpsertRosterItems(ctx context.Context, items []*RosterItem) (err error) {
+	defer r.i.observe("UpsertRosterItems", time.Now(), &err)
+	return r.s.UpsertRosterItems(ctx, items)
+}
+
+func (r *instRosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (_ *RosterItem, err error) {
+	defer r.i.observe("GetRosterItem", time.Now(), &err)
+	return r.s.GetRosterItem(ctx, userJID, contactJID)
+}
+
+func (r *instRosterStore) GetRosterItems(ctx context.Context, userJID string) (_ []*RosterItem, err error) {
+	defer r.i.observe("GetRosterItems", time.Now(), &err)
+	return r.s.GetRosterItems(ctx, userJID)
+}
+
+func (r *instRosterStore) DeleteRosterItem(ctx context.Context, userJID, contactJID string) (err error) {
+	defer r.i.observe("DeleteRosterItem", time.Now(), &err)
+	return r.s.DeleteRosterItem(ctx, userJID, contactJID)
+}
+
+func (r *instRosterStore) GetRosterVersion(ctx context.Context, userJID string) (_ string, err error) {
+	defer r.i.observe("GetRosterVersion", time.Now(), &err)
+	return r.s.GetRosterVersion(ctx, userJID)
+}
+
+func (r *instRosterStore) SetRosterVersion(ctx context.Context, userJID, version string) (err error) {
+	defer r.i.observe("SetRosterVersion", time.Now(), &err)
+	return r.s.SetRosterVersion(ctx, userJID, version)
+}
+
+type instRosterReplacer struct {
+	instRosterStore
+	rr RosterReplacer
+}
+
+func (r *instRosterReplacer) ReplaceRosterItems(ctx context.Context, userJID string, items []*RosterItem, version string) (err error) {
+	defer r.i.observe("ReplaceRosterItems", time.Now(), &err)
+	return r.rr.ReplaceRosterItems(ctx, userJID, items, version)
+}
+
+// --- BlockingStore ---
+
+type instBlockingStore struct {
+	i *instrumented
+	s BlockingStore
+}
+
+func (b *instBlockingStore) BlockJID(ctx context.Context, userJID, blockedJID string) (err error) {
+	defer b.i.observe("BlockJID", time.Now(), &err)
+	return b.s.BlockJID(ctx, userJID, blockedJID)
+}
+
+func (b *instBlockingStore) UnblockJID(ctx context.Context, userJID, blockedJID string) (err error) {
+	defer b.i.observe("UnblockJID", time.Now(), &err)
+	return b.s.UnblockJID(ctx, userJID, blockedJID)
+}
+
+func (b *instBlockingStore) IsBlocked(ctx context.Context, userJID, blockedJID string) (_ bool, err error) {
+	defer b.i.observe("IsBlocked", time.Now(), &err)
+	return b.s.IsBlocked(ctx, userJID, blockedJID)
+}
+
+func (b *instBlockingStore) GetBlockedJIDs(ctx context.Context, userJID string) (_ []string, err error) {
+	defer b.i.observe("GetBlockedJIDs", time.Now(), &err)
+	return b.s.GetBlockedJIDs(ctx, userJID)
+}
+
+// --- VCardStore ---
+
+type instVCardStore struct {
+	i *instrumented
+	s VCardStore
+}
+
+func (v *instVCardStore) SetVCard(ctx context.Context, userJID string, data []byte) (err error) {
+	defer v.i.observe("SetVCard", time.Now(), &err)
+	return v.s.SetVCard(ctx, userJID, data)
+}
+
+func (v *instVCardStore) GetVCard(ctx context.Context, userJID string) (_ []byte, err error) {
+	defer v.i.observe("GetVCard", time.Now(), &err)
+	return v.s.GetVCard(ctx, userJID)
+}
+
+func (v *instVCardStore) DeleteVCard(ctx context.Context, userJID string) (err error) {
+	defer v.i.observe("DeleteVCard", time.Now(), &err)
+	return v.s.DeleteVCard(ctx, userJID)
+}
+
+// --- OfflineStore ---
+
+type instOfflineStore struct {
+	i *instrumented
+	s OfflineStore
+}
+
+func (o *instOfflineStore) StoreOfflineMessage(ctx context.Context, msg *OfflineMessage) (err error) {
+	defer o.i.observe("StoreOfflineMessage", time.Now(), &err)
+	return o.s.StoreOfflineMessage(ctx, msg)
+}
+
+func (o *instOfflineStore) GetOfflineMessages(ctx context.Context, userJID string) (_ []*OfflineMessage, err error) {
+	defer o.i.observe("GetOfflineMessages", time.Now(), &err)
+	return o.s.GetOfflineMessages(ctx, userJID)
+}
+
+func (o *instOfflineStore) DeleteOfflineMessages(ctx context.Context, userJID string) (err error) {
+	defer o.i.observe("DeleteOfflineMessages", time.Now(), &err)
+	return o.s.DeleteOfflineMessages(ctx, userJID)
+}
+
+func (o *instOfflineStore) DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) (err error) {
+	defer o.i.observe("DeleteOfflineMessagesByIDs", time.Now(), &err)
+	return o.s.DeleteOfflineMessagesByIDs(ctx, userJID, ids)
+}
+
+func (o *instOfflineStore) CountOfflineMessages(ctx context.Context, userJID string) (_ int, err error) {
+	defer o.i.observe("CountOfflineMessages", time.Now(), &err)
+	return o.s.CountOfflineMessages(ctx, userJID)
+}
+
+// --- MAMStore ---
+
+type instMAMStore struct {
+	i *instrumented
+	s MAMStore
+}
+
+func (m *instMAMStore) ArchiveMessage(ctx context.Context, msg *ArchivedMessage) (err error) {
+	defer m.i.observe("ArchiveMessage", time.Now(), &err)
+	return m.s.ArchiveMessage(ctx, msg)
+}
+
+func (m *instMAMStore) ArchiveMessages(ctx context.Context, msgs []*ArchivedMessage) (err error) {
+	defer m.i.observe("ArchiveMessages", time.Now(), &err)
+	return m.s.ArchiveMessages(ctx, msgs)
+}
+
+func (m *instMAMStore) QueryMessages(ctx context.Context, query *MAMQuery) (_ *MAMResult, err error) {
+	defer m.i.observe("QueryMessages", time.Now(), &err)
+	return m.s.QueryMessages(ctx, query)
+}
+
+func (m *instMAMStore) DeleteMessageArchive(ctx context.Context, userJID string) (err error) {
+	defer m.i.observe("DeleteMessageArchive", time.Now(), &err)
+	return m.s.DeleteMessageArchive(ctx, userJID)
+}
+
+func (m *instMAMStore) DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (_ int, err error) {
+	defer m.i.observe("DeleteMessagesBefore", time.Now(), &err)
+	return m.s.DeleteMessagesBefore(ctx, userJID, before)
+}
+
+func (m *instMAMStore) GetMAMPrefs(ctx context.Context, userJID string) (_ *MAMPrefs, err error) {
+	defer m.i.observe("GetMAMPrefs", time.Now(), &err)
+	return m.s.GetMAMPrefs(ctx, userJID)
+}
+
+func (m *instMAMStore) SetMAMPrefs(ctx context.Context, prefs *MAMPrefs) (err error) {
+	defer m.i.observe("SetMAMPrefs", time.Now(), &err)
+	return m.s.SetMAMPrefs(ctx, prefs)
+}
+
+func (m *instMAMStore) DeleteMAMPrefs(ctx context.Context, userJID string) (err error) {
+	defer m.i.observe("DeleteMAMPrefs", time.Now(), &err)
+	return m.s.DeleteMAMPrefs(ctx, userJID)
+}
+
+type instMAMEditor struct {
+	instMAMStore
+	me MAMEditor
+}
+
+func (m *instMAMEditor) GetArchivedMessage(ctx context.Context, userJID, id string) (_ *ArchivedMessage, err error) {
+	defer m.i.observe("GetArchivedMessage", time.Now(), &err)
+	return m.me.GetArchivedMessage(ctx, userJID, id)
+}
+
+func (m *instMAMEditor) UpdateArchivedMessage(ctx context.Context, msg *ArchivedMessage) (err error) {
+	defer m.i.observe("UpdateArchivedMessage", time.Now(), &err)
+	return m.me.UpdateArchivedMessage(ctx, msg)
+}
+
+// --- MUCRoomStore ---
+
+type instMUCRoomStore struct {
+	i *instrumented
+	s MUCRoomStore
+}
+
+func (m *instMUCRoomStore) CreateRoom(ctx context.Context, room *MUCRoom) (err error) {
+	defer m.i.observe("CreateRoom", time.Now(), &err)
+	return m.s.CreateRoom(ctx, room)
+}
+
+func (m *instMUCRoomStore) GetRoom(ctx context.Context, roomJID string) (_ *MUCRoom, err error) {
+	defer m.i.observe("GetRoom", time.Now(), &err)
+	return m.s.GetRoom(ctx, roomJID)
+}
+
+func (m *instMUCRoomStore) UpdateRoom(ctx context.Context, room *MUCRoom) (err error) {
+	defer m.i.observe("UpdateRoom", time.Now(), &err)
+	return m.s.UpdateRoom(ctx, room)
+}
+
+func (m *instMUCRoomStore) DeleteRoom(ctx context.Context, roomJID string) (err error) {
+	defer m.i.observe("DeleteRoom", time.Now(), &err)
+	return m.s.DeleteRoom(ctx, roomJID)
+}
+
+func (m *instMUCRoomStore) ListRooms(ctx context.Context) (_ []*MUCRoom, err error) {
+	defer m.i.observe("ListRooms", time.Now(), &err)
+	return m.s.ListRooms(ctx)
+}
+
+func (m *instMUCRoomStore) SetAffiliation(ctx context.Context, aff *MUCAffiliation) (err error) {
+	defer m.i.observe("SetAffiliation", time.Now(), &err)
+	return m.s.SetAffiliation(ctx, aff)
+}
+
+func (m *instMUCRoomStore) GetAffiliation(ctx context.Context, roomJID, userJID string) (_ *MUCAffiliation, err error) {
+	defer m.i.observe("GetAffiliation", time.Now(), &err)
+	return m.s.GetAffiliation(ctx, roomJID, userJID)
+}
+
+func (m *instMUCRoomStore) GetAffiliations(ctx context.Context, roomJID string) (_ []*MUCAffiliation, err error) {
+	defer m.i.observe("GetAffiliations", time.Now(), &err)
+	return m.s.GetAffiliations(ctx, roomJID)
+}
+
+func (m *instMUCRoomStore) RemoveAffiliation(ctx context.Context, roomJID, userJID string) (err error) {
+	defer m.i.observe("RemoveAffiliation", time.Now(), &err)
+	return m.s.RemoveAffiliation(ctx, roomJID, userJID)
+}
+
+// --- PubSubStore ---
+
+type instPubSubStore struct {
+	i *instrumented
+	s PubSubStore
+}
+
+func (p *instPubSubStore) CreateNode(ctx context.Context, node *PubSubNode) (err error) {
+	defer p.i.observe("CreateNode", time.Now(), &err)
+	return p.s.CreateNode(ctx, node)
+}
+
+func (p *instPubSubStore) GetNode(ctx context.Context, host, nodeID string) (_ *PubSubNode, err error) {
+	defer p.i.observe("GetNode", time.Now(), &err)
+	return p.s.GetNode(ctx, host, nodeID)
+}
+
+func (p *instPubSubStore) DeleteNode(ctx context.Context, host, nodeID string) (err error) {
+	defer p.i.observe("DeleteNode", time.Now(), &err)
+	return p.s.DeleteNode(ctx, host, nodeID)
+}
+
+func (p *instPubSubStore) ListNodes(ctx context.Context, host string) (_ []*PubSubNode, err error) {
+	defer p.i.observe("ListNodes", time.Now(), &err)
+	return p.s.ListNodes(ctx, host)
+}
+
+func (p *instPubSubStore) UpsertItem(ctx context.Context, item *PubSubItem) (err error) {
+	defer p.i.observe("UpsertItem", time.Now(), &err)
+	return p.s.UpsertItem(ctx, item)
+}
+
+func (p *instPubSubStore) GetItem(ctx context.Context, host, nodeID, itemID string) (_ *PubSubItem, err error) {
+	defer p.i.observe("GetItem", time.Now(), &err)
+	return p.s.GetItem(ctx, host, nodeID, itemID)
+}
+
+func (p *instPubSubStore) GetItems(ctx context.Context, host, nodeID string) (_ []*PubSubItem, err error) {
+	defer p.i.observe("GetItems", time.Now(), &err)
+	return p.s.GetItems(ctx, host, nodeID)
+}
+
+func (p *instPubSubStore) DeleteItem(ctx context.Context, host, nodeID, itemID string) (err error) {
+	defer p.i.observe("DeleteItem", time.Now(), &err)
+	return p.s.DeleteItem(ctx, host, nodeID, itemID)
+}
+
+func (p *instPubSubStore) Subscribe(ctx context.Context, sub *PubSubSubscription) (err error) {
+	defer p.i.observe("Subscribe", time.Now(), &err)
+	return p.s.Subscribe(ctx, sub)
+}
+
+func (p *instPubSubStore) Unsubscribe(ctx context.Context, host, nodeID, jid string) (err error) {
+	defer p.i.observe("Unsubscribe", time.Now(), &err)
+	return p.s.Unsubscribe(ctx, host, nodeID, jid)
+}
+
+func (p *instPubSubStore) GetSubscription(ctx context.Context, host, nodeID, jid string) (_ *PubSubSubscription, err error) {
+	defer p.i.observe("GetSubscription", time.Now(), &err)
+	return p.s.GetSubscription(ctx, host, nodeID, jid)
+}
+
+func (p *instPubSubStore) GetSubscriptions(ctx context.Context, host, nodeID string) (_ []*PubSubSubscription, err error) {
+	defer p.i.observe("GetSubscriptions", time.Now(), &err)
+	return p.s.GetSubscriptions(ctx, host, nodeID)
+}
+
+func (p *instPubSubStore) GetUserSubscriptions(ctx context.Context, host, jid string) (_ []*PubSubSubscription, err error) {
+	defer p.i.observe("GetUserSubscriptions", time.Now(), &err)
+	return p.s.GetUserSubscriptions(ctx, host, jid)
+}
+
+// --- BookmarkStore ---
+
+type instBookmarkStore struct {
+	i *instrumented
+	s BookmarkStore
+}
+
+func (b *instBookmarkStore) SetBookmark(ctx context.Context, bm *Bookmark) (err error) {
+	defer b.i.observe("SetBookmark", time.Now(), &err)
+	return b.s.SetBookmark(ctx, bm)
+}
+
+func (b *instBookmarkStore) GetBookmark(ctx context.Context, userJID, roomJID string) (_ *Bookmark, err error) {
+	defer b.i.observe("GetBookmark", time.Now(), &err)
+	return b.s.GetBookmark(ctx, userJID, roomJID)
+}
+
+func (b *instBookmarkStore) GetBookmarks(ctx context.Context, userJID string) (_ []*Bookmark, err error) {
+	defer b.i.observe("GetBookmarks", time.Now(), &err)
+	return b.s.GetBookmarks(ctx, userJID)
+}
+
+func (b *instBookmarkStore) DeleteBookmark(ctx context.Context, userJID, roomJID string) (err error) {
+	defer b.i.observe("DeleteBookmark", time.Now(), &err)
+	return b.s.DeleteBookmark(ctx, userJID, roomJID)
+}
+
+// --- PushStore ---
+
+type instPushStore struct {
+	i *instrumented
+	s PushStore
+}
+
+func (p *instPushStore) SetPushRegistration(ctx context.Context, reg *PushRegistration) (err error) {
+	defer p.i.observe("SetPushRegistration", time.Now(), &err)
+	return p.s.SetPushRegistration(ctx, reg)
+}
+
+func (p *instPushStore) GetPushRegistrations(ctx context.Context, userJID string) (_ []*PushRegistration, err error) {
+	defer p.i.observe("GetPushRegistrations", time.Now(), &err)
+	return p.s.GetPushRegistrations(ctx, userJID)
+}
+
+func (p *instPushStore) DeletePushRegistrations(ctx context.Context, userJID, jid, node string) (err error) {
+	defer p.i.observe("DeletePushRegistrations", time.Now(), &err)
+	return p.s.DeletePushRegistrations(ctx, userJID, jid, node)
+}
+
+// --- CapsStore ---
+
+type instCapsStore struct {
+	i *instrumented
+	s CapsStore
+}
+
+func (c *instCapsStore) SetCapsInfo(ctx context.Context, ver string, info []byte) (err error) {
+	defer c.i.observe("SetCapsInfo", time.Now(), &err)
+	return c.s.SetCapsInfo(ctx, ver, info)
+}
+
+func (c *instCapsStore) GetCapsInfo(ctx context.Context, ver string) (_ []byte, err error) {
+	defer c.i.observe("GetCapsInfo", time.Now(), &err)
+	return c.s.GetCapsInfo(ctx, ver)
+}
+
+// --- SharedGroupStore ---
+
+type instSharedGroupStore struct {
+	i *instrumented
+	s SharedGroupStore
+}
+
+func (g *instSharedGroupStore) SetSharedGroup(ctx context.Context, group *SharedGroup) (err error) {
+	defer g.i.observe("SetSharedGroup", time.Now(), &err)
+	return g.s.SetSharedGroup(ctx, group)
+}
+
+func (g *instSharedGroupStore) GetSharedGroup(ctx context.Context, name string) (_ *SharedGroup, err error) {
+	defer g.i.observe("GetSharedGroup", time.Now(), &err)
+	return g.s.GetSharedGroup(ctx, name)
+}
+
+func (g *instSharedGroupStore) ListSharedGroups(ctx context.Context) (_ []*SharedGroup, err error) {
+	defer g.i.observe("ListSharedGroups", time.Now(), &err)
+	return g.s.ListSharedGroups(ctx)
+}
+
+func (g *instSharedGroupStore) DeleteSharedGroup(ctx context.Context, name string) (err error) {
+	defer g.i.observe("DeleteSharedGroup", time.Now(), &err)
+	return g.s.DeleteSharedGroup(ctx, name)
+}
+
+func (g *instSharedGroupStore) AddSharedGroupMember(ctx context.Context, name, memberJID string) (err error) {
+	defer g.i.observe("AddSharedGroupMember", time.Now(), &err)
+	return g.s.AddSharedGroupMember(ctx, name, memberJID)
+}
+
+func (g *instSharedGroupStore) RemoveSharedGroupMember(ctx context.Context, name, memberJID string) (err error) {
+	defer g.i.observe("RemoveSharedGroupMember", time.Now(), &err)
+	return g.s.RemoveSharedGroupMember(ctx, name, memberJID)
+}
+
+func (g *instSharedGroupStore) GetMemberSharedGroups(ctx context.Context, memberJID string) (_ []*SharedGroup, err error) {
+	defer g.i.observe("GetMemberSharedGroups", time.Now(), &err)
+	return g.s.GetMemberSharedGroups(ctx, memberJID)
+}
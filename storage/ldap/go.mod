@@ -0,0 +1,20 @@
+module github.com/meszmate/xmpp-go/storage/ldap
+
+go 1.25.0
+
+require (
+	github.com/go-ldap/ldap/v3 v3.4.12
+	github.com/meszmate/xmpp-go v0.0.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	golang.org/x/crypto v0.47.0 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
+)
+
+replace github.com/meszmate/xmpp-go => ../..
@@ -0,0 +1,49 @@
+//go:build integration
+
+package ldap_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/ldap"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// TestLDAPDirectory authenticates LDAP_TEST_USER against the directory at
+// LDAP_URL.
+func TestLDAPDirectory(t *testing.T) {
+	url := os.Getenv("LDAP_URL")
+	if url == "" {
+		t.Skip("LDAP_URL not set; skipping integration test")
+	}
+	ctx := context.Background()
+	s, err := ldap.New(memory.New(), ldap.Config{
+		URL:          url,
+		BindDN:       os.Getenv("LDAP_BIND_DN"),
+		BindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:       os.Getenv("LDAP_BASE_DN"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	defer s.Close()
+
+	us := s.UserStore()
+	user, password := os.Getenv("LDAP_TEST_USER"), os.Getenv("LDAP_TEST_PASSWORD")
+	if ok, err := us.UserExists(ctx, user); !ok || err != nil {
+		t.Fatalf("UserExists(%q) = %v, %v", user, ok, err)
+	}
+	if ok, err := us.Authenticate(ctx, user, password); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	if _, err := us.Authenticate(ctx, user, password+"x"); !errors.Is(err, storage.ErrAuthFailed) {
+		t.Fatalf("wrong password: %v", err)
+	}
+}
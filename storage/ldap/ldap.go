@@ -0,0 +1,348 @@
+// Package ldap provides accounts from an LDAP directory, such as OpenLDAP
+// or Active Directory, for xmpp-go.
+//
+// A Storage wraps the storage.Storage that keeps everything else: users
+// are looked up in the directory and authenticated by binding as their
+// entry, so passwords never leave it and no accounts need to be synced.
+// Directory attributes fill in the vCards of users who have not published
+// one, and the members of a user's directory groups appear in their roster
+// under the name of the group.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// ErrReadOnly is returned when accounts are created, changed or deleted:
+// they are managed in the directory.
+var ErrReadOnly = errors.New("ldap: accounts are managed in the directory")
+
+// Defaults for the fields of Config.
+const (
+	DefaultUserFilter      = "(uid={username})"
+	DefaultUsernameAttr    = "uid"
+	DefaultGroupFilter     = "(member={dn})"
+	DefaultGroupMemberAttr = "member"
+	DefaultGroupNameAttr   = "cn"
+	DefaultTimeout         = 10 * time.Second
+)
+
+// DefaultVCard maps vCard fields to the attributes of the inetOrgPerson
+// object class.
+var DefaultVCard = map[string]string{
+	"FN":      "cn",
+	"FAMILY":  "sn",
+	"GIVEN":   "givenName",
+	"EMAIL":   "mail",
+	"TITLE":   "title",
+	"ORGNAME": "o",
+	"ORGUNIT": "ou",
+	"PHOTO":   "jpegPhoto",
+}
+
+// Config configures a Storage.
+type Config struct {
+	// URL is the directory server, such as ldaps://ldap.example.com or
+	// ldap://dc1.corp.example.com:389.
+	URL string
+	// StartTLS upgrades an ldap:// connection with StartTLS.
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS; nil uses the defaults.
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the account the directory is searched
+	// as. Both empty bind anonymously.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the subtree users are searched in.
+	BaseDN string
+	// UserFilter selects the entry of a user, with {username} replaced by
+	// the escaped username. Active Directory needs
+	// (&(objectClass=user)(sAMAccountName={username})).
+	UserFilter string
+	// UsernameAttr holds the username of an entry, such as
+	// sAMAccountName.
+	UsernameAttr string
+
+	// VCard maps the vCard fields FN, FAMILY, GIVEN, NICKNAME, EMAIL,
+	// URL, TITLE, ORGNAME, ORGUNIT, DESC and PHOTO to the attributes
+	// they are read from. Nil means DefaultVCard; an empty map turns
+	// directory vCards off.
+	VCard map[string]string
+
+	// Domain is the XMPP domain of the accounts. It is needed for roster
+	// groups.
+	Domain string
+	// GroupBaseDN is the subtree groups are searched in; empty turns
+	// roster groups off.
+	GroupBaseDN string
+	// GroupFilter selects the groups of a user, with {dn} and {username}
+	// replaced by the escaped DN and username of the user. posixGroup
+	// directories need (memberUid={username}).
+	GroupFilter string
+	// GroupMemberAttr lists the members of a group, by DN or, like
+	// memberUid, by username.
+	GroupMemberAttr string
+	// GroupNameAttr holds the name of a group, used as its roster group.
+	GroupNameAttr string
+
+	// Timeout bounds each request to the directory.
+	Timeout time.Duration
+}
+
+// Storage is a storage.Storage whose accounts are the users of an LDAP
+// directory. The user store is read-only; its vCard and roster stores add
+// directory data to those of the wrapped storage, and the other stores,
+// Init and Close are passed through.
+type Storage struct {
+	storage.Storage
+
+	cfg  Config
+	dial func() (ldap.Client, error)
+
+	mu   sync.Mutex
+	conn ldap.Client
+}
+
+// New returns a Storage with the accounts of the directory cfg describes
+// and the other stores of s.
+func New(s storage.Storage, cfg Config) (*Storage, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("ldap: URL and BaseDN are required")
+	}
+	if cfg.GroupBaseDN != "" && cfg.Domain == "" {
+		return nil, errors.New("ldap: roster groups need the Domain")
+	}
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&cfg.UserFilter, DefaultUserFilter},
+		{&cfg.UsernameAttr, DefaultUsernameAttr},
+		{&cfg.GroupFilter, DefaultGroupFilter},
+		{&cfg.GroupMemberAttr, DefaultGroupMemberAttr},
+		{&cfg.GroupNameAttr, DefaultGroupNameAttr},
+	}
+	for _, d := range defaults {
+		if *d.field == "" {
+			*d.field = d.value
+		}
+	}
+	if cfg.VCard == nil {
+		cfg.VCard = DefaultVCard
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	st := &Storage{Storage: s, cfg: cfg}
+	st.dial = st.dialDirectory
+	return st, nil
+}
+
+// Init initializes the wrapped storage and checks that the directory can
+// be searched.
+func (s *Storage) Init(ctx context.Context) error {
+	if err := s.Storage.Init(ctx); err != nil {
+		return err
+	}
+	_, err := s.client()
+	return err
+}
+
+// Close closes the connection to the directory and the wrapped storage.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.mu.Unlock()
+	return s.Storage.Close()
+}
+
+func (s *Storage) UserStore() storage.UserStore { return users{s} }
+
+func (s *Storage) VCardStore() storage.VCardStore {
+	vs := s.Storage.VCardStore()
+	if vs == nil || len(s.cfg.VCard) == 0 {
+		return vs
+	}
+	return &vcardStore{s, vs}
+}
+
+func (s *Storage) RosterStore() storage.RosterStore {
+	rs := s.Storage.RosterStore()
+	if rs == nil || s.cfg.GroupBaseDN == "" {
+		return rs
+	}
+	return s.rosterStore(rs)
+}
+
+// dialDirectory opens a connection to the directory server.
+func (s *Storage) dialDirectory() (ldap.Client, error) {
+	conn, err := ldap.DialURL(s.cfg.URL, ldap.DialWithTLSConfig(s.cfg.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(s.cfg.Timeout)
+	if s.cfg.StartTLS {
+		if err := conn.StartTLS(s.cfg.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// client returns the connection searches are made on, bound as BindDN,
+// opening it if needed.
+func (s *Storage) client() (ldap.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !s.conn.IsClosing() {
+		return s.conn, nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.BindDN != "" {
+		err = conn.Bind(s.cfg.BindDN, s.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// search runs req on the shared connection, reconnecting once if it was
+// lost.
+func (s *Storage) search(req *ldap.SearchRequest) ([]*ldap.Entry, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := s.client()
+		if err != nil {
+			return nil, err
+		}
+		res, err := conn.SearchWithPaging(req, 500)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) && attempt == 0 {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn.Close()
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res.Entries, nil
+	}
+}
+
+// user returns the entry of username with attrs, or storage.ErrNotFound.
+func (s *Storage) user(username string, attrs ...string) (*ldap.Entry, error) {
+	if username == "" {
+		return nil, storage.ErrNotFound
+	}
+	filter := strings.NewReplacer("{username}", ldap.EscapeFilter(username)).Replace(s.cfg.UserFilter)
+	entries, err := s.search(ldap.NewSearchRequest(s.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(s.cfg.Timeout.Seconds()), false, filter, append([]string{s.cfg.UsernameAttr}, attrs...), nil))
+	if err != nil {
+		return nil, err
+	}
+	// A filter matching several entries does not identify the user.
+	if len(entries) != 1 {
+		return nil, storage.ErrNotFound
+	}
+	return entries[0], nil
+}
+
+// users is the read-only user store of a Storage.
+type users struct{ s *Storage }
+
+func (u users) CreateUser(context.Context, *storage.User) error { return ErrReadOnly }
+func (u users) UpdateUser(context.Context, *storage.User) error { return ErrReadOnly }
+func (u users) DeleteUser(context.Context, string) error        { return ErrReadOnly }
+
+// GetUser returns the account of username. It has no password or SCRAM
+// credentials: only the directory can check passwords, with Authenticate.
+func (u users) GetUser(_ context.Context, username string) (*storage.User, error) {
+	if _, err := u.s.user(username); err != nil {
+		return nil, err
+	}
+	return &storage.User{Username: username}, nil
+}
+
+func (u users) UserExists(_ context.Context, username string) (bool, error) {
+	_, err := u.s.user(username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Authenticate binds to the directory as the entry of username with
+// password, on a connection of its own.
+func (u users) Authenticate(_ context.Context, username, password string) (bool, error) {
+	// An empty password would be an unauthenticated bind, which succeeds.
+	if password == "" {
+		return false, storage.ErrAuthFailed
+	}
+	entry, err := u.s.user(username)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, storage.ErrAuthFailed
+	}
+	if err != nil {
+		return false, err
+	}
+	conn, err := u.s.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, storage.ErrAuthFailed
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListUsers returns the usernames of the entries UserFilter matches.
+func (u users) ListUsers(context.Context) ([]string, error) {
+	filter := strings.NewReplacer("{username}", "*").Replace(u.s.cfg.UserFilter)
+	entries, err := u.s.search(ldap.NewSearchRequest(u.s.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, filter, []string{u.s.cfg.UsernameAttr}, nil))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if name := e.GetAttributeValue(u.s.cfg.UsernameAttr); name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
@@ -0,0 +1,248 @@
+package ldap
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// directory is an in-memory LDAP server for single (attr=value) filters.
+type directory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string // DN -> password
+	binds     []string
+}
+
+// conn is a connection to a directory.
+type conn struct {
+	ldap.Client
+	d *directory
+}
+
+func (c *conn) Close() error                     { return nil }
+func (c *conn) IsClosing() bool                  { return false }
+func (c *conn) UnauthenticatedBind(string) error { return nil }
+
+func (c *conn) Bind(dn, password string) error {
+	c.d.binds = append(c.d.binds, dn)
+	if want, ok := c.d.passwords[dn]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+var simpleFilter = regexp.MustCompile(`^\(([^=()]+)=([^()]*)\)$`)
+
+func (c *conn) SearchWithPaging(req *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+	m := simpleFilter.FindStringSubmatch(req.Filter)
+	if m == nil {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, errors.New(req.Filter))
+	}
+	value := regexp.MustCompile(`\\[0-9a-f]{2}`).ReplaceAllStringFunc(m[2], func(hex string) string {
+		b, _ := strconv.ParseUint(hex[1:], 16, 8)
+		return string(rune(b))
+	})
+	res := &ldap.SearchResult{}
+	for _, e := range c.d.entries {
+		inScope := e.DN == req.BaseDN
+		if req.Scope == ldap.ScopeWholeSubtree {
+			inScope = strings.HasSuffix(e.DN, ","+req.BaseDN)
+		}
+		values := e.GetAttributeValues(m[1])
+		if m[1] == "objectClass" {
+			values = []string{"top"}
+		}
+		if inScope && (m[2] == "*" && len(values) > 0 || slices.Contains(values, value)) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func newTestStorage(t *testing.T, cfg Config) (*Storage, *directory) {
+	t.Helper()
+	d := &directory{
+		entries: []*ldap.Entry{
+			ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"uid": {"alice"}, "cn": {"Alice Liddell"}, "sn": {"Liddell"}, "givenName": {"Alice"},
+				"mail": {"alice@example.com"}, "title": {"Engineer"},
+			}),
+			ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{"uid": {"bob"}}),
+			ldap.NewEntry("cn=Carol Hall,ou=people,dc=example,dc=com", map[string][]string{"uid": {"carol"}}),
+			ldap.NewEntry("cn=engineering,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn": {"Engineering"},
+				"member": {
+					"uid=alice,ou=people,dc=example,dc=com",
+					"uid=bob,ou=people,dc=example,dc=com",
+					"cn=Carol Hall,ou=people,dc=example,dc=com",
+				},
+			}),
+			ldap.NewEntry("cn=staff,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":     {"Staff"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			}),
+		},
+		passwords: map[string]string{
+			"cn=xmppd,dc=example,dc=com":            "service",
+			"uid=alice,ou=people,dc=example,dc=com": "wonderland",
+		},
+	}
+	cfg.URL = "ldap://ldap.example.com"
+	cfg.BaseDN = "ou=people,dc=example,dc=com"
+	cfg.BindDN, cfg.BindPassword = "cn=xmppd,dc=example,dc=com", "service"
+	s, err := New(memory.New(), cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.dial = func() (ldap.Client, error) { return &conn{d: d}, nil }
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, d
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	s, d := newTestStorage(t, Config{})
+	us := s.UserStore()
+
+	for username, want := range map[string]bool{"alice": true, "dave": false, "*": false, "": false} {
+		if ok, err := us.UserExists(ctx, username); ok != want || err != nil {
+			t.Errorf("UserExists(%q) = %v, %v; want %v", username, ok, err, want)
+		}
+	}
+	if u, err := us.GetUser(ctx, "bob"); err != nil || u.Username != "bob" || u.Password != "" {
+		t.Fatalf("GetUser = %+v, %v", u, err)
+	}
+	if _, err := us.GetUser(ctx, "dave"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetUser(dave): %v", err)
+	}
+	names, err := us.(storage.UserLister).ListUsers(ctx)
+	if err != nil || strings.Join(names, ",") != "alice,bob,carol" {
+		t.Fatalf("ListUsers = %v, %v", names, err)
+	}
+
+	d.binds = nil
+	if ok, err := us.Authenticate(ctx, "alice", "wonderland"); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	if len(d.binds) != 1 || d.binds[0] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("binds %v", d.binds)
+	}
+	for _, tt := range []struct{ username, password string }{
+		{"alice", "looking-glass"},
+		{"alice", ""},
+		{"dave", "wonderland"},
+	} {
+		if ok, err := us.Authenticate(ctx, tt.username, tt.password); ok || !errors.Is(err, storage.ErrAuthFailed) {
+			t.Errorf("Authenticate(%q, %q) = %v, %v", tt.username, tt.password, ok, err)
+		}
+	}
+
+	if err := us.CreateUser(ctx, &storage.User{Username: "dave"}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := us.DeleteUser(ctx, "alice"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+}
+
+func TestVCard(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStorage(t, Config{Domain: "example.com"})
+	vs := s.VCardStore()
+
+	data, err := vs.GetVCard(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("GetVCard: %v", err)
+	}
+	var card directoryVCard
+	if err := xml.Unmarshal(data, &card); err != nil {
+		t.Fatal(err)
+	}
+	if card.FN != "Alice Liddell" || card.N == nil || card.N.Given != "Alice" || card.Email == nil || card.Email.UserID != "alice@example.com" || card.Title != "Engineer" {
+		t.Fatalf("directory vCard %s", data)
+	}
+
+	// bob has no attributes to show, and a published vCard wins.
+	if _, err := vs.GetVCard(ctx, "bob@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetVCard(bob): %v", err)
+	}
+	published := []byte(`<vCard xmlns="vcard-temp"><FN>Alice</FN></vCard>`)
+	if err := vs.SetVCard(ctx, "alice@example.com", published); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vs.GetVCard(ctx, "alice@example.com"); err != nil || string(data) != string(published) {
+		t.Fatalf("GetVCard after SetVCard = %s, %v", data, err)
+	}
+
+	if _, err := vs.GetVCard(ctx, "alice@other.example"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetVCard at another domain: %v", err)
+	}
+}
+
+func TestRosterGroups(t *testing.T) {
+	ctx := context.Background()
+	s, d := newTestStorage(t, Config{Domain: "example.com", GroupBaseDN: "ou=groups,dc=example,dc=com"})
+	rs := s.RosterStore()
+
+	items, err := rs.GetRosterItems(ctx, "alice@example.com")
+	if err != nil || len(items) != 2 {
+		t.Fatalf("GetRosterItems = %v, %v", items, err)
+	}
+	bob, carol := items[0], items[1]
+	if bob.ContactJID != "bob@example.com" || bob.Subscription != "both" || strings.Join(bob.Groups, ",") != "Engineering,Staff" {
+		t.Fatalf("bob %+v", bob)
+	}
+	if carol.ContactJID != "carol@example.com" || strings.Join(carol.Groups, ",") != "Engineering" {
+		t.Fatalf("carol %+v", carol)
+	}
+
+	ver, err := rs.GetRosterVersion(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strconv.ParseUint(ver, 10, 64); err != nil {
+		t.Fatalf("version %q is not a number", ver)
+	}
+
+	// Renaming a directory contact stores it; the directory keeps its
+	// groups and subscription.
+	if err := rs.UpsertRosterItem(ctx, &storage.RosterItem{UserJID: "alice@example.com", ContactJID: "bob@example.com", Name: "Bobby", Subscription: "none", Groups: []string{"Friends"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.SetRosterVersion(ctx, "alice@example.com", "5"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := rs.GetRosterItem(ctx, "alice@example.com", "bob@example.com")
+	if err != nil || item.Name != "Bobby" || item.Subscription != "both" || strings.Join(item.Groups, ",") != "Friends,Engineering,Staff" {
+		t.Fatalf("GetRosterItem = %+v, %v", item, err)
+	}
+	ver2, _ := rs.GetRosterVersion(ctx, "alice@example.com")
+	if ver2 == ver {
+		t.Fatal("version did not change with the stored roster")
+	}
+
+	// Leaving a group changes the version too.
+	d.entries = d.entries[:len(d.entries)-1]
+	if ver3, _ := rs.GetRosterVersion(ctx, "alice@example.com"); ver3 == ver2 {
+		t.Fatal("version did not change with the directory")
+	}
+	if _, err := rs.GetRosterItem(ctx, "alice@example.com", "dave@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetRosterItem(dave): %v", err)
+	}
+	if _, ok := rs.(storage.RosterReplacer); !ok {
+		t.Fatal("RosterReplacer of the wrapped store hidden")
+	}
+}
@@ -0,0 +1,203 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// rosterStore adds the members of a user's directory groups to their
+// roster. Writes go to the wrapped store, so contacts can be renamed or
+// put in more groups; directory contacts that are removed come back while
+// they share a group.
+type rosterStore struct {
+	s *Storage
+	storage.RosterStore
+}
+
+// rosterReplacer keeps the storage.RosterReplacer of the wrapped store.
+type rosterReplacer struct {
+	*rosterStore
+	storage.RosterReplacer
+}
+
+func (s *Storage) rosterStore(rs storage.RosterStore) storage.RosterStore {
+	r := &rosterStore{s, rs}
+	if rr, ok := rs.(storage.RosterReplacer); ok {
+		return &rosterReplacer{r, rr}
+	}
+	return r
+}
+
+func (r *rosterStore) GetRosterItems(ctx context.Context, userJID string) ([]*storage.RosterItem, error) {
+	items, err := r.RosterStore.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := r.s.groupContacts(userJID)
+	if err != nil {
+		return nil, err
+	}
+	return mergeContacts(userJID, items, contacts), nil
+}
+
+func (r *rosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
+	item, err := r.RosterStore.GetRosterItem(ctx, userJID, contactJID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	contacts, cerr := r.s.groupContacts(userJID)
+	if cerr != nil {
+		return nil, cerr
+	}
+	groups, ok := contacts[contactJID]
+	if !ok {
+		return item, err
+	}
+	var items []*storage.RosterItem
+	if item != nil {
+		items = append(items, item)
+	}
+	return mergeContacts(userJID, items, map[string][]string{contactJID: groups})[0], nil
+}
+
+// GetRosterVersion returns the stored version of a roster with directory
+// contacts mixed with a digest of them, so that it changes with the
+// directory as well. It stays a number, which roster pushes increment.
+func (r *rosterStore) GetRosterVersion(ctx context.Context, userJID string) (string, error) {
+	ver, err := r.RosterStore.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return "", err
+	}
+	contacts, err := r.s.groupContacts(userJID)
+	if err != nil || len(contacts) == 0 {
+		return ver, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ver))
+	for _, contact := range slices.Sorted(maps.Keys(contacts)) {
+		h.Write([]byte("\x00" + contact + "\x00" + strings.Join(contacts[contact], "\x00")))
+	}
+	return strconv.FormatUint(h.Sum64()>>1, 10), nil
+}
+
+// mergeContacts adds contacts, by JID with their groups, to the stored
+// items of userJID. Directory contacts are subscribed both ways; stored
+// items keep their name and groups and gain those of the directory.
+func mergeContacts(userJID string, items []*storage.RosterItem, contacts map[string][]string) []*storage.RosterItem {
+	merged := make([]*storage.RosterItem, 0, len(items)+len(contacts))
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		groups, ok := contacts[item.ContactJID]
+		if ok {
+			cp := *item
+			cp.Subscription, cp.Ask = "both", ""
+			cp.Groups = slices.Clone(item.Groups)
+			for _, g := range groups {
+				if !slices.Contains(cp.Groups, g) {
+					cp.Groups = append(cp.Groups, g)
+				}
+			}
+			item = &cp
+		}
+		seen[item.ContactJID] = true
+		merged = append(merged, item)
+	}
+	for _, contact := range slices.Sorted(maps.Keys(contacts)) {
+		if !seen[contact] {
+			merged = append(merged, &storage.RosterItem{
+				UserJID:      userJID,
+				ContactJID:   contact,
+				Subscription: "both",
+				Groups:       contacts[contact],
+			})
+		}
+	}
+	return merged
+}
+
+// groupContacts returns the bare JIDs of the members of the directory
+// groups of userJID, with the names of the groups they share.
+func (s *Storage) groupContacts(userJID string) (map[string][]string, error) {
+	j, err := jid.Parse(userJID)
+	if err != nil || j.Local() == "" || !strings.EqualFold(j.Domain(), s.cfg.Domain) {
+		return nil, nil
+	}
+	user, err := s.user(j.Local())
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(user.DN),
+		"{username}", ldap.EscapeFilter(j.Local()),
+	).Replace(s.cfg.GroupFilter)
+	groups, err := s.search(ldap.NewSearchRequest(s.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(s.cfg.Timeout.Seconds()), false, filter, []string{s.cfg.GroupNameAttr, s.cfg.GroupMemberAttr}, nil))
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[string][]string)
+	names := make(map[string]string) // member value -> username
+	for _, group := range groups {
+		name := group.GetAttributeValue(s.cfg.GroupNameAttr)
+		if name == "" {
+			continue
+		}
+		for _, member := range group.GetAttributeValues(s.cfg.GroupMemberAttr) {
+			username, ok := names[member]
+			if !ok {
+				if username, err = s.memberName(member); err != nil {
+					return nil, err
+				}
+				names[member] = username
+			}
+			if username == "" || username == j.Local() {
+				continue
+			}
+			contact, err := jid.New(username, s.cfg.Domain, "")
+			if err != nil {
+				continue
+			}
+			if !slices.Contains(contacts[contact.String()], name) {
+				contacts[contact.String()] = append(contacts[contact.String()], name)
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// memberName returns the username of a group member, given by username or
+// by DN. A DN is only looked up when its first component is not the
+// username attribute. Members that are not users have no username.
+func (s *Storage) memberName(member string) (string, error) {
+	if !strings.Contains(member, "=") {
+		return member, nil
+	}
+	dn, err := ldap.ParseDN(member)
+	if err != nil || len(dn.RDNs) == 0 {
+		return "", nil
+	}
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, s.cfg.UsernameAttr) {
+			return attr.Value, nil
+		}
+	}
+	entries, err := s.search(ldap.NewSearchRequest(member, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, int(s.cfg.Timeout.Seconds()), false, "(objectClass=*)", []string{s.cfg.UsernameAttr}, nil))
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[0].GetAttributeValue(s.cfg.UsernameAttr), nil
+}
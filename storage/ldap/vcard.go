@@ -0,0 +1,106 @@
+package ldap
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// vcardStore returns a vCard built from directory attributes for users who
+// have not stored one.
+type vcardStore struct {
+	s *Storage
+	storage.VCardStore
+}
+
+func (v *vcardStore) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
+	data, err := v.VCardStore.GetVCard(ctx, userJID)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return data, err
+	}
+	j, jerr := jid.Parse(userJID)
+	if jerr != nil || j.Local() == "" || v.s.cfg.Domain != "" && !strings.EqualFold(j.Domain(), v.s.cfg.Domain) {
+		return nil, err
+	}
+	attrs := slices.Sorted(maps.Values(v.s.cfg.VCard))
+	entry, uerr := v.s.user(j.Local(), slices.Compact(attrs)...)
+	if errors.Is(uerr, storage.ErrNotFound) {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+	get := func(field string) string {
+		if attr := v.s.cfg.VCard[field]; attr != "" {
+			return entry.GetAttributeValue(attr)
+		}
+		return ""
+	}
+	card := directoryVCard{
+		FN:       get("FN"),
+		Nickname: get("NICKNAME"),
+		URL:      get("URL"),
+		Title:    get("TITLE"),
+		Desc:     get("DESC"),
+	}
+	if family, given := get("FAMILY"), get("GIVEN"); family != "" || given != "" {
+		card.N = &vcardName{Family: family, Given: given}
+	}
+	if email := get("EMAIL"); email != "" {
+		card.Email = &vcardEmail{UserID: email}
+	}
+	if name, unit := get("ORGNAME"), get("ORGUNIT"); name != "" || unit != "" {
+		card.Org = &vcardOrg{OrgName: name, OrgUnit: unit}
+	}
+	if attr := v.s.cfg.VCard["PHOTO"]; attr != "" {
+		if photo := entry.GetRawAttributeValue(attr); len(photo) > 0 {
+			card.Photo = &vcardPhoto{Type: http.DetectContentType(photo), BinVal: base64.StdEncoding.EncodeToString(photo)}
+		}
+	}
+	if card == (directoryVCard{}) {
+		return nil, err
+	}
+	return xml.Marshal(card)
+}
+
+// directoryVCard is the vcard-temp (XEP-0054) subset directory attributes
+// map to.
+type directoryVCard struct {
+	XMLName  xml.Name    `xml:"vcard-temp vCard"`
+	FN       string      `xml:"FN,omitempty"`
+	N        *vcardName  `xml:"N,omitempty"`
+	Nickname string      `xml:"NICKNAME,omitempty"`
+	Email    *vcardEmail `xml:"EMAIL,omitempty"`
+	URL      string      `xml:"URL,omitempty"`
+	Photo    *vcardPhoto `xml:"PHOTO,omitempty"`
+	Org      *vcardOrg   `xml:"ORG,omitempty"`
+	Title    string      `xml:"TITLE,omitempty"`
+	Desc     string      `xml:"DESC,omitempty"`
+}
+
+type vcardName struct {
+	Family string `xml:"FAMILY,omitempty"`
+	Given  string `xml:"GIVEN,omitempty"`
+}
+
+type vcardEmail struct {
+	UserID string `xml:"USERID"`
+}
+
+type vcardPhoto struct {
+	Type   string `xml:"TYPE"`
+	BinVal string `xml:"BINVAL"`
+}
+
+type vcardOrg struct {
+	OrgName string `xml:"ORGNAME,omitempty"`
+	OrgUnit string `xml:"ORGUNIT,omitempty"`
+}
@@ -2,9 +2,14 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"slices"
 	"time"
 )
 
+// DefaultMAMPageSize is the page size used when a MAMQuery sets no Max.
+const DefaultMAMPageSize = 100
+
 // ArchivedMessage represents a message stored in the archive.
 type ArchivedMessage struct {
 	ID        string
@@ -16,23 +21,61 @@ type ArchivedMessage struct {
 }
 
 // MAMQuery represents query parameters for message archive retrieval.
+//
+// Results are in archive order: oldest first by CreatedAt, with messages
+// archived at the same instant ordered by ID. A query with AfterID returns
+// the first Max messages after that message; a query with BeforeID returns
+// the last Max messages before it, still oldest first, so that paging
+// backwards from the end of the archive works. Both may be set to page
+// within a range. An AfterID or BeforeID that is not in the user's archive
+// fails with ErrNotFound. Last asks for the last page of the archive, as an
+// empty RSM <before/> does.
 type MAMQuery struct {
-	UserJID string
-	WithJID string    // filter by correspondent
-	Start   time.Time // filter: after this time
-	End     time.Time // filter: before this time
-	AfterID string    // RSM: after this message ID
-	BeforeID string   // RSM: before this message ID
-	Max     int       // maximum results (0 = backend default)
+	UserJID  string
+	WithJID  string    // filter by correspondent
+	Start    time.Time // filter: after this time
+	End      time.Time // filter: before this time
+	AfterID  string    // RSM: after this message ID
+	BeforeID string    // RSM: before this message ID
+	Last     bool      // RSM: the last page, when BeforeID is empty
+	Max      int       // maximum results (0 = backend default)
+	Flip     bool      // return the page newest first (XEP-0313 flip-page)
+}
+
+// backward reports whether query pages backwards, keeping the last
+// messages that match it rather than the first.
+func (q *MAMQuery) backward() bool {
+	return (q.BeforeID != "" || q.Last) && q.AfterID == ""
 }
 
 // MAMResult represents the result of a MAM query.
+//
+// First and Last are the IDs of the oldest and newest message of the page,
+// whether or not it is flipped, so that they can be passed as AfterID and
+// BeforeID to read the neighbouring pages.
 type MAMResult struct {
 	Messages []*ArchivedMessage
-	Complete bool   // true if no more results
+	Complete bool   // true if no more results in the paging direction
 	First    string // RSM: first ID in result set
 	Last     string // RSM: last ID in result set
-	Count    int    // total count (if available)
+	Count    int    // RSM: messages matching the filters, in all pages
+	Index    int    // RSM: how many of them come before First
+}
+
+// Archiving preference defaults (XEP-0313 §7).
+const (
+	MAMAlways = "always"
+	MAMNever  = "never"
+	MAMRoster = "roster"
+)
+
+// MAMPrefs are the archiving preferences of a user: which conversations go
+// to their archive. The JIDs in Always and Never win over Default.
+type MAMPrefs struct {
+	UserJID string
+	Default string   // MAMAlways, MAMNever or MAMRoster
+	Always  []string // bare JIDs always archived
+	Never   []string // bare JIDs never archived
 }
 
 // MAMStore manages the message archive.
@@ -40,9 +83,195 @@ type MAMStore interface {
 	// ArchiveMessage stores a message in the archive.
 	ArchiveMessage(ctx context.Context, msg *ArchivedMessage) error
 
+	// ArchiveMessages stores several messages, of one or more users, in
+	// one operation. Backends with transactions store all of them or, on
+	// error, none.
+	ArchiveMessages(ctx context.Context, msgs []*ArchivedMessage) error
+
 	// QueryMessages retrieves messages matching the query.
 	QueryMessages(ctx context.Context, query *MAMQuery) (*MAMResult, error)
 
 	// DeleteMessageArchive removes all archived messages for a user.
 	DeleteMessageArchive(ctx context.Context, userJID string) error
+
+	// DeleteMessagesBefore removes the messages of userJID's archive
+	// archived before the given time and returns how many there were.
+	DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (int, error)
+
+	// GetMAMPrefs retrieves the archiving preferences of a user. Returns
+	// ErrNotFound if the user has not set any.
+	GetMAMPrefs(ctx context.Context, userJID string) (*MAMPrefs, error)
+
+	// SetMAMPrefs creates or replaces the archiving preferences of
+	// prefs.UserJID.
+	SetMAMPrefs(ctx context.Context, prefs *MAMPrefs) error
+
+	// DeleteMAMPrefs removes the archiving preferences of a user.
+	// Removing preferences that were never set is not an error.
+	DeleteMAMPrefs(ctx context.Context, userJID string) error
+}
+
+// MAMEditor is an optional interface for MAM stores that can change the
+// payload of archived messages, such as to replace a retracted or moderated
+// message with a tombstone.
+type MAMEditor interface {
+	// GetArchivedMessage retrieves the message with the given ID from
+	// userJID's archive, or returns ErrNotFound.
+	GetArchivedMessage(ctx context.Context, userJID, id string) (*ArchivedMessage, error)
+
+	// UpdateArchivedMessage replaces the Data of the message with msg.ID in
+	// msg.UserJID's archive, keeping its place in the archive. It returns
+	// ErrNotFound if there is no such message.
+	UpdateArchivedMessage(ctx context.Context, msg *ArchivedMessage) error
+}
+
+// CompareMessages orders a and b in archive order, returning a negative
+// number when a comes first.
+func CompareMessages(a, b *ArchivedMessage) int {
+	if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+		return c
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// ExpireMessages returns archive, which is in archive order, without the
+// messages archived before the given time, and how many it dropped.
+func ExpireMessages(archive []*ArchivedMessage, before time.Time) ([]*ArchivedMessage, int) {
+	i, _ := slices.BinarySearchFunc(archive, before, func(m *ArchivedMessage, t time.Time) int {
+		if m.CreatedAt.Before(t) {
+			return -1
+		}
+		return 1
+	})
+	return archive[i:], i
+}
+
+// InsertMessage adds msg to archive, which is in archive order, and returns
+// the result. Backends that keep archives as lists use it to keep them
+// ordered when messages are archived out of order.
+func InsertMessage(archive []*ArchivedMessage, msg *ArchivedMessage) []*ArchivedMessage {
+	i, _ := slices.BinarySearchFunc(archive, msg, CompareMessages)
+	return slices.Insert(archive, i, msg)
+}
+
+// MessageKey returns a string that sorts like a message archived at
+// createdAt with the given ID in archive order, for backends that index
+// archives by a single ordered field.
+func MessageKey(createdAt time.Time, id string) string {
+	// Flipping the sign bit orders negative times before positive ones.
+	return fmt.Sprintf("%016x", uint64(createdAt.UnixNano())^1<<63) + id
+}
+
+// MessageKeyID returns the message ID a key returned by MessageKey was made
+// from.
+func MessageKeyID(key string) string {
+	if len(key) < 16 {
+		return ""
+	}
+	return key[16:]
+}
+
+// QueryArchive answers query from archive, the user's whole archive in
+// archive order, following the semantics documented on MAMQuery. The
+// returned messages are the ones in archive, not copies.
+func QueryArchive(archive []*ArchivedMessage, query *MAMQuery) (*MAMResult, error) {
+	// Narrow the archive to the time filters before looking at messages.
+	lo, hi := 0, len(archive)
+	if !query.Start.IsZero() {
+		lo, _ = slices.BinarySearchFunc(archive, query.Start, func(m *ArchivedMessage, t time.Time) int {
+			return m.CreatedAt.Compare(t)
+		})
+	}
+	if !query.End.IsZero() {
+		hi, _ = slices.BinarySearchFunc(archive, query.End, func(m *ArchivedMessage, t time.Time) int {
+			if m.CreatedAt.After(t) {
+				return 1
+			}
+			return -1
+		})
+	}
+	window := archive[lo:max(lo, hi)]
+
+	// Anchors are looked up in the whole archive: one outside the time
+	// filters still bounds the page.
+	from, to := 0, len(window)
+	for _, a := range []struct {
+		id    string
+		after bool
+	}{{query.AfterID, true}, {query.BeforeID, false}} {
+		if a.id == "" {
+			continue
+		}
+		i := slices.IndexFunc(archive, func(m *ArchivedMessage) bool { return m.ID == a.id })
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		// Position of the anchor relative to the window.
+		pos := min(max(i-lo, -1), len(window))
+		if a.after {
+			from = max(from, pos+1)
+		} else {
+			to = min(to, pos)
+		}
+	}
+	from = min(from, len(window))
+	to = max(from, min(to, len(window)))
+
+	matches := func(m *ArchivedMessage) bool { return query.WithJID == "" || m.WithJID == query.WithJID }
+	var matched []*ArchivedMessage
+	count, index := 0, 0
+	for i, msg := range window {
+		if !matches(msg) {
+			continue
+		}
+		count++
+		if i < from {
+			index++
+		} else if i < to {
+			matched = append(matched, msg)
+		}
+	}
+	result := PageResult(matched, query)
+	result.Count = count
+	if query.backward() {
+		index += len(matched) - len(result.Messages)
+	}
+	result.Index = index
+	return result, nil
+}
+
+// PageResult builds the result of query from the messages matching it, in
+// archive order, which may hold one more message than the page in the
+// paging direction to signal that the result is not complete. It keeps the
+// first page of them, or the last one when the query pages backwards with
+// BeforeID or Last, and flips it if the query asks for it. Count and Index
+// are left for the caller to set.
+func PageResult(matched []*ArchivedMessage, query *MAMQuery) *MAMResult {
+	size := query.Max
+	if size <= 0 {
+		size = DefaultMAMPageSize
+	}
+	complete := len(matched) <= size
+	if !complete {
+		if query.backward() {
+			matched = matched[len(matched)-size:]
+		} else {
+			matched = matched[:size]
+		}
+	}
+	result := &MAMResult{Messages: matched, Complete: complete}
+	if len(matched) > 0 {
+		result.First = matched[0].ID
+		result.Last = matched[len(matched)-1].ID
+	}
+	if query.Flip {
+		slices.Reverse(matched)
+	}
+	return result
 }
@@ -0,0 +1,55 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// BlobStore is an in-memory implementation of storage.BlobStore.
+type BlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]blob
+}
+
+type blob struct {
+	data        []byte
+	contentType string
+}
+
+// NewBlobStore creates a new in-memory blob store.
+func NewBlobStore() *BlobStore {
+	return &BlobStore{blobs: make(map[string]blob)}
+}
+
+func (b *BlobStore) PutBlob(_ context.Context, key string, data []byte, contentType string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blobs[key] = blob{append([]byte(nil), data...), contentType}
+	return nil
+}
+
+func (b *BlobStore) GetBlob(_ context.Context, key string) ([]byte, string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	bl, ok := b.blobs[key]
+	if !ok {
+		return nil, "", storage.ErrNotFound
+	}
+	return append([]byte(nil), bl.data...), bl.contentType, nil
+}
+
+func (b *BlobStore) DeleteBlob(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.blobs, key)
+	return nil
+}
+
+// Len returns the number of blobs in the store.
+func (b *BlobStore) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.blobs)
+}
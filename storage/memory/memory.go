@@ -4,11 +4,15 @@ package memory
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 )
 
 // Store is an in-memory implementation of storage.Storage.
@@ -34,6 +38,7 @@ type Store struct {
 	// MAM
 	mamMessages  map[string][]*storage.ArchivedMessage // userJID -> messages
 	mamIDCounter int64
+	mamPrefs     map[string]*storage.MAMPrefs // userJID -> preferences
 
 	// MUC rooms
 	mucRooms        map[string]*storage.MUCRoom                   // roomJID -> room
@@ -46,11 +51,34 @@ type Store struct {
 
 	// Bookmarks
 	bookmarks map[string]map[string]*storage.Bookmark // userJID -> roomJID -> bookmark
+
+	// Push
+	pushRegs map[string][]*storage.PushRegistration // userJID -> registrations
+
+	// Caps
+	capsInfo map[string][]byte // ver -> disco#info XML
+
+	// Shared roster groups
+	sharedGroups map[string]*storage.SharedGroup // name -> group
+
+	clock clock.Clock
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithClock sets the clock used to stamp creation and update times. It
+// defaults to clock.System.
+func WithClock(c clock.Clock) Option {
+	return func(s *Store) { s.clock = clock.Or(c) }
 }
 
 // New creates a new in-memory store.
-func New() *Store {
-	s := &Store{}
+func New(opts ...Option) *Store {
+	s := &Store{clock: clock.System}
+	for _, opt := range opts {
+		opt(s)
+	}
 	s.initLocked()
 	return s
 }
@@ -71,25 +99,32 @@ func (s *Store) initLocked() {
 	s.vcards = make(map[string][]byte)
 	s.offlineMsgs = make(map[string][]*storage.OfflineMessage)
 	s.mamMessages = make(map[string][]*storage.ArchivedMessage)
+	s.mamPrefs = make(map[string]*storage.MAMPrefs)
 	s.mucRooms = make(map[string]*storage.MUCRoom)
 	s.mucAffiliations = make(map[string]map[string]*storage.MUCAffiliation)
 	s.pubsubNodes = make(map[string]map[string]*storage.PubSubNode)
 	s.pubsubItems = make(map[string]map[string]map[string]*storage.PubSubItem)
 	s.pubsubSubscriptions = make(map[string]map[string]map[string]*storage.PubSubSubscription)
 	s.bookmarks = make(map[string]map[string]*storage.Bookmark)
+	s.pushRegs = make(map[string][]*storage.PushRegistration)
+	s.capsInfo = make(map[string][]byte)
+	s.sharedGroups = make(map[string]*storage.SharedGroup)
 }
 
 func (s *Store) Close() error { return nil }
 
-func (s *Store) UserStore() storage.UserStore         { return s }
-func (s *Store) RosterStore() storage.RosterStore     { return s }
-func (s *Store) BlockingStore() storage.BlockingStore { return s }
-func (s *Store) VCardStore() storage.VCardStore       { return s }
-func (s *Store) OfflineStore() storage.OfflineStore   { return s }
-func (s *Store) MAMStore() storage.MAMStore           { return s }
-func (s *Store) MUCRoomStore() storage.MUCRoomStore   { return s }
-func (s *Store) PubSubStore() storage.PubSubStore     { return s }
-func (s *Store) BookmarkStore() storage.BookmarkStore { return s }
+func (s *Store) UserStore() storage.UserStore               { return s }
+func (s *Store) RosterStore() storage.RosterStore           { return s }
+func (s *Store) BlockingStore() storage.BlockingStore       { return s }
+func (s *Store) VCardStore() storage.VCardStore             { return s }
+func (s *Store) OfflineStore() storage.OfflineStore         { return s }
+func (s *Store) MAMStore() storage.MAMStore                 { return s }
+func (s *Store) MUCRoomStore() storage.MUCRoomStore         { return s }
+func (s *Store) PubSubStore() storage.PubSubStore           { return s }
+func (s *Store) BookmarkStore() storage.BookmarkStore       { return s }
+func (s *Store) PushStore() storage.PushStore               { return s }
+func (s *Store) CapsStore() storage.CapsStore               { return s }
+func (s *Store) SharedGroupStore() storage.SharedGroupStore { return s }
 
 // --- UserStore ---
 
@@ -99,7 +134,7 @@ func (s *Store) CreateUser(_ context.Context, user *storage.User) error {
 	if _, ok := s.users[user.Username]; ok {
 		return storage.ErrUserExists
 	}
-	now := time.Now()
+	now := s.clock.Now()
 	u := *user
 	u.CreatedAt = now
 	u.UpdatedAt = now
@@ -125,7 +160,7 @@ func (s *Store) UpdateUser(_ context.Context, user *storage.User) error {
 		return storage.ErrNotFound
 	}
 	u := *user
-	u.UpdatedAt = time.Now()
+	u.UpdatedAt = s.clock.Now()
 	s.users[user.Username] = &u
 	return nil
 }
@@ -140,6 +175,17 @@ func (s *Store) DeleteUser(_ context.Context, username string) error {
 	return nil
 }
 
+func (s *Store) ListUsers(_ context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func (s *Store) UserExists(_ context.Context, username string) (bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -147,17 +193,8 @@ func (s *Store) UserExists(_ context.Context, username string) (bool, error) {
 	return ok, nil
 }
 
-func (s *Store) Authenticate(_ context.Context, username, password string) (bool, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	u, ok := s.users[username]
-	if !ok {
-		return false, storage.ErrAuthFailed
-	}
-	if u.Password != password {
-		return false, storage.ErrAuthFailed
-	}
-	return true, nil
+func (s *Store) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	return credentials.Authenticate(ctx, s, username, password)
 }
 
 // --- RosterStore ---
@@ -165,13 +202,26 @@ func (s *Store) Authenticate(_ context.Context, username, password string) (bool
 func (s *Store) UpsertRosterItem(_ context.Context, item *storage.RosterItem) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.upsertRosterItem(item)
+	return nil
+}
+
+func (s *Store) UpsertRosterItems(_ context.Context, items []*storage.RosterItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range items {
+		s.upsertRosterItem(item)
+	}
+	return nil
+}
+
+func (s *Store) upsertRosterItem(item *storage.RosterItem) {
 	if s.rosterItems[item.UserJID] == nil {
 		s.rosterItems[item.UserJID] = make(map[string]*storage.RosterItem)
 	}
 	cp := *item
 	cp.Groups = append([]string(nil), item.Groups...)
 	s.rosterItems[item.UserJID][item.ContactJID] = &cp
-	return nil
 }
 
 func (s *Store) GetRosterItem(_ context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
@@ -230,6 +280,21 @@ func (s *Store) SetRosterVersion(_ context.Context, userJID, version string) err
 	return nil
 }
 
+func (s *Store) ReplaceRosterItems(_ context.Context, userJID string, items []*storage.RosterItem, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]*storage.RosterItem, len(items))
+	for _, item := range items {
+		cp := *item
+		cp.UserJID = userJID
+		cp.Groups = append([]string(nil), item.Groups...)
+		m[item.ContactJID] = &cp
+	}
+	s.rosterItems[userJID] = m
+	s.rosterVersions[userJID] = version
+	return nil
+}
+
 // --- BlockingStore ---
 
 func (s *Store) BlockJID(_ context.Context, userJID, blockedJID string) error {
@@ -308,7 +373,7 @@ func (s *Store) StoreOfflineMessage(_ context.Context, msg *storage.OfflineMessa
 	cp := *msg
 	cp.Data = append([]byte(nil), msg.Data...)
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	s.offlineMsgs[msg.UserJID] = append(s.offlineMsgs[msg.UserJID], &cp)
 	return nil
@@ -334,6 +399,20 @@ func (s *Store) DeleteOfflineMessages(_ context.Context, userJID string) error {
 	return nil
 }
 
+func (s *Store) DeleteOfflineMessagesByIDs(_ context.Context, userJID string, ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := slices.DeleteFunc(s.offlineMsgs[userJID], func(msg *storage.OfflineMessage) bool {
+		return slices.Contains(ids, msg.ID)
+	})
+	if len(msgs) == 0 {
+		delete(s.offlineMsgs, userJID)
+	} else {
+		s.offlineMsgs[userJID] = msgs
+	}
+	return nil
+}
+
 func (s *Store) CountOfflineMessages(_ context.Context, userJID string) (int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -345,79 +424,121 @@ func (s *Store) CountOfflineMessages(_ context.Context, userJID string) (int, er
 func (s *Store) ArchiveMessage(_ context.Context, msg *storage.ArchivedMessage) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.archiveMessage(msg)
+	return nil
+}
+
+func (s *Store) ArchiveMessages(_ context.Context, msgs []*storage.ArchivedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.archiveMessage(msg)
+	}
+	return nil
+}
+
+func (s *Store) archiveMessage(msg *storage.ArchivedMessage) {
 	cp := *msg
 	cp.Data = append([]byte(nil), msg.Data...)
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	if cp.ID == "" {
 		s.mamIDCounter++
 		cp.ID = fmt.Sprintf("%d", s.mamIDCounter)
 	}
-	s.mamMessages[msg.UserJID] = append(s.mamMessages[msg.UserJID], &cp)
-	return nil
+	s.mamMessages[msg.UserJID] = storage.InsertMessage(s.mamMessages[msg.UserJID], &cp)
 }
 
 func (s *Store) QueryMessages(_ context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	msgs := s.mamMessages[query.UserJID]
-	var filtered []*storage.ArchivedMessage
-
-	afterIDFound := query.AfterID == ""
-	for _, msg := range msgs {
-		if !afterIDFound {
-			if msg.ID == query.AfterID {
-				afterIDFound = true
-			}
-			continue
-		}
-		if query.BeforeID != "" && msg.ID == query.BeforeID {
-			break
-		}
-		if query.WithJID != "" && msg.WithJID != query.WithJID {
-			continue
-		}
-		if !query.Start.IsZero() && msg.CreatedAt.Before(query.Start) {
-			continue
-		}
-		if !query.End.IsZero() && msg.CreatedAt.After(query.End) {
-			continue
-		}
+	result, err := storage.QueryArchive(s.mamMessages[query.UserJID], query)
+	if err != nil {
+		return nil, err
+	}
+	for i, msg := range result.Messages {
 		cp := *msg
 		cp.Data = append([]byte(nil), msg.Data...)
-		filtered = append(filtered, &cp)
+		result.Messages[i] = &cp
 	}
+	return result, nil
+}
 
-	max := query.Max
-	if max <= 0 {
-		max = 100
+func (s *Store) DeleteMessageArchive(_ context.Context, userJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mamMessages, userJID)
+	return nil
+}
+
+func (s *Store) DeleteMessagesBefore(_ context.Context, userJID string, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive, n := storage.ExpireMessages(s.mamMessages[userJID], before)
+	if n > 0 {
+		s.mamMessages[userJID] = slices.Clone(archive)
 	}
-	complete := len(filtered) <= max
-	if len(filtered) > max {
-		filtered = filtered[:max]
+	return n, nil
+}
+
+func (s *Store) GetArchivedMessage(_ context.Context, userJID, id string) (*storage.ArchivedMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, msg := range s.mamMessages[userJID] {
+		if msg.ID == id {
+			cp := *msg
+			cp.Data = append([]byte(nil), msg.Data...)
+			return &cp, nil
+		}
 	}
+	return nil, storage.ErrNotFound
+}
 
-	result := &storage.MAMResult{
-		Messages: filtered,
-		Complete: complete,
-		Count:    len(filtered),
+func (s *Store) UpdateArchivedMessage(_ context.Context, msg *storage.ArchivedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.mamMessages[msg.UserJID] {
+		if m.ID == msg.ID {
+			m.Data = append([]byte(nil), msg.Data...)
+			return nil
+		}
 	}
-	if len(filtered) > 0 {
-		result.First = filtered[0].ID
-		result.Last = filtered[len(filtered)-1].ID
+	return storage.ErrNotFound
+}
+
+func (s *Store) GetMAMPrefs(_ context.Context, userJID string) (*storage.MAMPrefs, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefs, ok := s.mamPrefs[userJID]
+	if !ok {
+		return nil, storage.ErrNotFound
 	}
-	return result, nil
+	return copyMAMPrefs(prefs), nil
 }
 
-func (s *Store) DeleteMessageArchive(_ context.Context, userJID string) error {
+func (s *Store) SetMAMPrefs(_ context.Context, prefs *storage.MAMPrefs) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.mamMessages, userJID)
+	s.mamPrefs[prefs.UserJID] = copyMAMPrefs(prefs)
 	return nil
 }
 
+func (s *Store) DeleteMAMPrefs(_ context.Context, userJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mamPrefs, userJID)
+	return nil
+}
+
+func copyMAMPrefs(prefs *storage.MAMPrefs) *storage.MAMPrefs {
+	cp := *prefs
+	cp.Always = slices.Clone(prefs.Always)
+	cp.Never = slices.Clone(prefs.Never)
+	return &cp
+}
+
 // --- MUCRoomStore ---
 
 func (s *Store) CreateRoom(_ context.Context, room *storage.MUCRoom) error {
@@ -609,7 +730,7 @@ func (s *Store) UpsertItem(_ context.Context, item *storage.PubSubItem) error {
 	cp := *item
 	cp.Payload = append([]byte(nil), item.Payload...)
 	if cp.CreatedAt.IsZero() {
-		cp.CreatedAt = time.Now()
+		cp.CreatedAt = s.clock.Now()
 	}
 	s.pubsubItems[item.Host][item.NodeID][item.ItemID] = &cp
 	return nil
@@ -799,3 +920,161 @@ func (s *Store) DeleteBookmark(_ context.Context, userJID, roomJID string) error
 	}
 	return storage.ErrNotFound
 }
+
+// --- PushStore ---
+
+func (s *Store) SetPushRegistration(_ context.Context, reg *storage.PushRegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *reg
+	cp.Options = append([]byte(nil), reg.Options...)
+	regs := s.pushRegs[reg.UserJID]
+	for i, r := range regs {
+		if r.JID == reg.JID && r.Node == reg.Node {
+			regs[i] = &cp
+			return nil
+		}
+	}
+	s.pushRegs[reg.UserJID] = append(regs, &cp)
+	return nil
+}
+
+func (s *Store) GetPushRegistrations(_ context.Context, userJID string) ([]*storage.PushRegistration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	regs := s.pushRegs[userJID]
+	result := make([]*storage.PushRegistration, 0, len(regs))
+	for _, r := range regs {
+		cp := *r
+		cp.Options = append([]byte(nil), r.Options...)
+		result = append(result, &cp)
+	}
+	return result, nil
+}
+
+func (s *Store) DeletePushRegistrations(_ context.Context, userJID, jid, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	regs := s.pushRegs[userJID][:0]
+	for _, r := range s.pushRegs[userJID] {
+		if r.JID != jid || (node != "" && r.Node != node) {
+			regs = append(regs, r)
+		}
+	}
+	if len(regs) == 0 {
+		delete(s.pushRegs, userJID)
+	} else {
+		s.pushRegs[userJID] = regs
+	}
+	return nil
+}
+
+// --- CapsStore ---
+
+func (s *Store) SetCapsInfo(_ context.Context, ver string, info []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capsInfo[ver] = append([]byte(nil), info...)
+	return nil
+}
+
+func (s *Store) GetCapsInfo(_ context.Context, ver string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.capsInfo[ver]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return append([]byte(nil), info...), nil
+}
+
+// --- SharedGroupStore ---
+
+func copySharedGroup(g *storage.SharedGroup) *storage.SharedGroup {
+	cp := *g
+	cp.Members = slices.Clone(g.Members)
+	return &cp
+}
+
+func (s *Store) SetSharedGroup(_ context.Context, group *storage.SharedGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := copySharedGroup(group)
+	slices.Sort(cp.Members)
+	cp.Members = slices.Compact(cp.Members)
+	s.sharedGroups[group.Name] = cp
+	return nil
+}
+
+func (s *Store) GetSharedGroup(_ context.Context, name string) (*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.sharedGroups[name]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return copySharedGroup(g), nil
+}
+
+func (s *Store) ListSharedGroups(_ context.Context) ([]*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sharedGroupsWhere(func(*storage.SharedGroup) bool { return true }), nil
+}
+
+func (s *Store) DeleteSharedGroup(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sharedGroups[name]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.sharedGroups, name)
+	return nil
+}
+
+func (s *Store) AddSharedGroupMember(_ context.Context, name, memberJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.sharedGroups[name]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if i, found := slices.BinarySearch(g.Members, memberJID); !found {
+		g.Members = slices.Insert(g.Members, i, memberJID)
+	}
+	return nil
+}
+
+func (s *Store) RemoveSharedGroupMember(_ context.Context, name, memberJID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.sharedGroups[name]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if i, found := slices.BinarySearch(g.Members, memberJID); found {
+		g.Members = slices.Delete(g.Members, i, i+1)
+	}
+	return nil
+}
+
+func (s *Store) GetMemberSharedGroups(_ context.Context, memberJID string) ([]*storage.SharedGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sharedGroupsWhere(func(g *storage.SharedGroup) bool {
+		_, found := slices.BinarySearch(g.Members, memberJID)
+		return found
+	}), nil
+}
+
+// sharedGroupsWhere returns copies of the groups match accepts, ordered by
+// name. The caller holds s.mu.
+func (s *Store) sharedGroupsWhere(match func(*storage.SharedGroup) bool) []*storage.SharedGroup {
+	var groups []*storage.SharedGroup
+	for _, name := range slices.Sorted(maps.Keys(s.sharedGroups)) {
+		if g := s.sharedGroups[name]; match(g) {
+			groups = append(groups, copySharedGroup(g))
+		}
+	}
+	return groups
+}
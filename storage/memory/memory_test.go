@@ -3,7 +3,9 @@ package memory_test
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/meszmate/xmpp-go/clock"
 	"github.com/meszmate/xmpp-go/storage"
 	"github.com/meszmate/xmpp-go/storage/memory"
 	"github.com/meszmate/xmpp-go/storage/storagetest"
@@ -15,6 +17,12 @@ func TestMemoryStorage(t *testing.T) {
 	})
 }
 
+func BenchmarkMemoryStorage(b *testing.B) {
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		return memory.New()
+	})
+}
+
 func TestMemoryStorageWithoutInit(t *testing.T) {
 	ctx := context.Background()
 	s := memory.New()
@@ -39,3 +47,45 @@ func TestMemoryStorageWithoutInit(t *testing.T) {
 		t.Fatalf("GetRosterItem without Init: got name %q, want Bob", got.Name)
 	}
 }
+
+func TestMemoryStorageClock(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	c := clock.NewFake(now)
+	s := memory.New(memory.WithClock(c))
+
+	if err := s.UserStore().CreateUser(ctx, &storage.User{Username: "alice"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	c.Advance(time.Hour)
+	u, err := s.UserStore().GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if !u.CreatedAt.Equal(now) {
+		t.Errorf("CreatedAt = %v, want %v", u.CreatedAt, now)
+	}
+	if err := s.UserStore().UpdateUser(ctx, u); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	u, _ = s.UserStore().GetUser(ctx, "alice")
+	if want := now.Add(time.Hour); !u.UpdatedAt.Equal(want) {
+		t.Errorf("UpdatedAt = %v, want %v", u.UpdatedAt, want)
+	}
+
+	msg := &storage.ArchivedMessage{UserJID: "alice@example.com", WithJID: "bob@example.com", Data: []byte("<message/>")}
+	if err := s.MAMStore().ArchiveMessage(ctx, msg); err != nil {
+		t.Fatalf("ArchiveMessage: %v", err)
+	}
+	res, err := s.MAMStore().QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("QueryMessages: %v", err)
+	}
+	if len(res.Messages) != 1 || !res.Messages[0].CreatedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("archived messages = %+v, want one stamped %v", res.Messages, now.Add(time.Hour))
+	}
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	storagetest.TestBlobStore(t, func() storage.BlobStore { return memory.NewBlobStore() })
+}
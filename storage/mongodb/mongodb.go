@@ -4,9 +4,12 @@ package mongodb
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -40,14 +43,19 @@ func (s *Store) Init(ctx context.Context) error {
 		{"blocked_jids", bson.D{{Key: "user_jid", Value: 1}, {Key: "blocked_jid", Value: 1}}, true},
 		{"vcards", bson.D{{Key: "user_jid", Value: 1}}, true},
 		{"offline_messages", bson.D{{Key: "user_jid", Value: 1}}, false},
-		{"mam_messages", bson.D{{Key: "user_jid", Value: 1}}, false},
-		{"mam_messages", bson.D{{Key: "user_jid", Value: 1}, {Key: "with_jid", Value: 1}}, false},
+		{"mam_messages", bson.D{{Key: "user_jid", Value: 1}, {Key: "key", Value: 1}}, false},
+		{"mam_messages", bson.D{{Key: "user_jid", Value: 1}, {Key: "with_jid", Value: 1}, {Key: "key", Value: 1}}, false},
+		{"mam_prefs", bson.D{{Key: "user_jid", Value: 1}}, true},
 		{"muc_rooms", bson.D{{Key: "room_jid", Value: 1}}, true},
 		{"muc_affiliations", bson.D{{Key: "room_jid", Value: 1}, {Key: "user_jid", Value: 1}}, true},
 		{"pubsub_nodes", bson.D{{Key: "host", Value: 1}, {Key: "node_id", Value: 1}}, true},
 		{"pubsub_items", bson.D{{Key: "host", Value: 1}, {Key: "node_id", Value: 1}, {Key: "item_id", Value: 1}}, true},
 		{"pubsub_subscriptions", bson.D{{Key: "host", Value: 1}, {Key: "node_id", Value: 1}, {Key: "jid", Value: 1}}, true},
 		{"bookmarks", bson.D{{Key: "user_jid", Value: 1}, {Key: "room_jid", Value: 1}}, true},
+		{"push_registrations", bson.D{{Key: "user_jid", Value: 1}, {Key: "service_jid", Value: 1}, {Key: "node", Value: 1}}, true},
+		{"caps_info", bson.D{{Key: "ver", Value: 1}}, true},
+		{"shared_groups", bson.D{{Key: "name", Value: 1}}, true},
+		{"shared_groups", bson.D{{Key: "members", Value: 1}}, false},
 	}
 	for _, idx := range indexes {
 		opts := options.Index().SetUnique(idx.unique)
@@ -59,6 +67,9 @@ func (s *Store) Init(ctx context.Context) error {
 			return fmt.Errorf("mongodb: create index on %s: %w", idx.collection, err)
 		}
 	}
+	if err := s.keyArchivedMessages(ctx); err != nil {
+		return fmt.Errorf("mongodb: index archived messages: %w", err)
+	}
 	return nil
 }
 
@@ -75,6 +86,11 @@ func (s *Store) MAMStore() storage.MAMStore           { return s }
 func (s *Store) MUCRoomStore() storage.MUCRoomStore   { return s }
 func (s *Store) PubSubStore() storage.PubSubStore     { return s }
 func (s *Store) BookmarkStore() storage.BookmarkStore { return s }
+func (s *Store) PushStore() storage.PushStore         { return s }
+func (s *Store) CapsStore() storage.CapsStore         { return s }
+func (s *Store) SharedGroupStore() storage.SharedGroupStore {
+	return s
+}
 
 func (s *Store) col(name string) *mongo.Collection { return s.db.Collection(name) }
 
@@ -152,24 +168,31 @@ func (s *Store) DeleteUser(ctx context.Context, username string) error {
 	return nil
 }
 
+func (s *Store) ListUsers(ctx context.Context) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"username": 1}).SetSort(bson.D{{Key: "username", Value: 1}})
+	cur, err := s.col("users").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var names []string
+	for cur.Next(ctx) {
+		var doc userDoc
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		names = append(names, doc.Username)
+	}
+	return names, cur.Err()
+}
+
 func (s *Store) UserExists(ctx context.Context, username string) (bool, error) {
 	count, err := s.col("users").CountDocuments(ctx, bson.M{"username": username})
 	return count > 0, err
 }
 
 func (s *Store) Authenticate(ctx context.Context, username, password string) (bool, error) {
-	var doc userDoc
-	err := s.col("users").FindOne(ctx, bson.M{"username": username}).Decode(&doc)
-	if err == mongo.ErrNoDocuments {
-		return false, storage.ErrAuthFailed
-	}
-	if err != nil {
-		return false, err
-	}
-	if doc.Password != password {
-		return false, storage.ErrAuthFailed
-	}
-	return true, nil
+	return credentials.Authenticate(ctx, s, username, password)
 }
 
 // --- RosterStore ---
@@ -185,17 +208,38 @@ type rosterDoc struct {
 
 func (s *Store) UpsertRosterItem(ctx context.Context, item *storage.RosterItem) error {
 	_, err := s.col("roster_items").UpdateOne(ctx,
-		bson.M{"user_jid": item.UserJID, "contact_jid": item.ContactJID},
-		bson.M{"$set": rosterDoc{
-			UserJID: item.UserJID, ContactJID: item.ContactJID,
-			Name: item.Name, Subscription: item.Subscription,
-			Ask: item.Ask, Groups: item.Groups,
-		}},
+		rosterFilter(item), rosterUpdate(item),
 		options.UpdateOne().SetUpsert(true),
 	)
 	return err
 }
 
+// UpsertRosterItems writes the items with one ordered bulk write, which
+// stops at the first failing item.
+func (s *Store) UpsertRosterItems(ctx context.Context, items []*storage.RosterItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(items))
+	for i, item := range items {
+		models[i] = mongo.NewUpdateOneModel().SetFilter(rosterFilter(item)).SetUpdate(rosterUpdate(item)).SetUpsert(true)
+	}
+	_, err := s.col("roster_items").BulkWrite(ctx, models)
+	return err
+}
+
+func rosterFilter(item *storage.RosterItem) bson.M {
+	return bson.M{"user_jid": item.UserJID, "contact_jid": item.ContactJID}
+}
+
+func rosterUpdate(item *storage.RosterItem) bson.M {
+	return bson.M{"$set": rosterDoc{
+		UserJID: item.UserJID, ContactJID: item.ContactJID,
+		Name: item.Name, Subscription: item.Subscription,
+		Ask: item.Ask, Groups: item.Groups,
+	}}
+}
+
 func (s *Store) GetRosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
 	var doc rosterDoc
 	err := s.col("roster_items").FindOne(ctx, bson.M{"user_jid": userJID, "contact_jid": contactJID}).Decode(&doc)
@@ -397,6 +441,14 @@ func (s *Store) DeleteOfflineMessages(ctx context.Context, userJID string) error
 	return err
 }
 
+func (s *Store) DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.col("offline_messages").DeleteMany(ctx, bson.M{"user_jid": userJID, "id": bson.M{"$in": ids}})
+	return err
+}
+
 func (s *Store) CountOfflineMessages(ctx context.Context, userJID string) (int, error) {
 	count, err := s.col("offline_messages").CountDocuments(ctx, bson.M{"user_jid": userJID})
 	return int(count), err
@@ -404,8 +456,11 @@ func (s *Store) CountOfflineMessages(ctx context.Context, userJID string) (int,
 
 // --- MAMStore ---
 
+// mamDoc is an archived message. Key, made by storage.MessageKey, orders
+// the archive and anchors pages.
 type mamDoc struct {
 	ID        string    `bson:"id"`
+	Key       string    `bson:"key"`
 	UserJID   string    `bson:"user_jid"`
 	WithJID   string    `bson:"with_jid"`
 	FromJID   string    `bson:"from_jid"`
@@ -414,14 +469,70 @@ type mamDoc struct {
 }
 
 func (s *Store) ArchiveMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
+	_, err := s.col("mam_messages").InsertOne(ctx, newMAMDoc(msg))
+	return err
+}
+
+// ArchiveMessages inserts the messages with one ordered insert, which
+// stops at the first failing message.
+func (s *Store) ArchiveMessages(ctx context.Context, msgs []*storage.ArchivedMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	docs := make([]mamDoc, len(msgs))
+	for i, msg := range msgs {
+		docs[i] = newMAMDoc(msg)
+	}
+	_, err := s.col("mam_messages").InsertMany(ctx, docs)
+	return err
+}
+
+func newMAMDoc(msg *storage.ArchivedMessage) mamDoc {
 	createdAt := msg.CreatedAt
 	if createdAt.IsZero() {
 		createdAt = time.Now()
 	}
-	_, err := s.col("mam_messages").InsertOne(ctx, mamDoc{
-		ID: msg.ID, UserJID: msg.UserJID, WithJID: msg.WithJID,
+	return mamDoc{
+		ID: msg.ID, Key: storage.MessageKey(createdAt, msg.ID), UserJID: msg.UserJID, WithJID: msg.WithJID,
 		FromJID: msg.FromJID, Data: msg.Data, CreatedAt: createdAt,
-	})
+	}
+}
+
+// keyArchivedMessages sets the key of the messages archived before
+// archives were ordered by it.
+func (s *Store) keyArchivedMessages(ctx context.Context) error {
+	col := s.col("mam_messages")
+	cursor, err := col.Find(ctx, bson.M{"key": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var models []mongo.WriteModel
+	for cursor.Next(ctx) {
+		var doc struct {
+			ObjectID  bson.ObjectID `bson:"_id"`
+			ID        string        `bson:"id"`
+			CreatedAt time.Time     `bson:"created_at"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.ObjectID}).
+			SetUpdate(bson.M{"$set": bson.M{"key": storage.MessageKey(doc.CreatedAt, doc.ID)}}))
+		if len(models) == 1000 {
+			if _, err := col.BulkWrite(ctx, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(models) > 0 {
+		_, err = col.BulkWrite(ctx, models)
+	}
 	return err
 }
 
@@ -440,35 +551,53 @@ func (s *Store) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*st
 			filter["created_at"] = bson.M{"$lte": query.End}
 		}
 	}
-	if query.AfterID != "" {
-		filter["id"] = bson.M{"$gt": query.AfterID}
-	}
-	if query.BeforeID != "" {
-		if existing, ok := filter["id"]; ok {
-			existing.(bson.M)["$lt"] = query.BeforeID
-		} else {
-			filter["id"] = bson.M{"$lt": query.BeforeID}
+	page := maps.Clone(filter)
+	anchors := bson.M{}
+	for _, a := range []struct{ id, op string }{{query.AfterID, "$gt"}, {query.BeforeID, "$lt"}} {
+		if a.id == "" {
+			continue
 		}
+		var doc mamDoc
+		err := s.col("mam_messages").FindOne(ctx, bson.M{"user_jid": query.UserJID, "id": a.id}).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return nil, storage.ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		anchors[a.op] = doc.Key
+	}
+	if len(anchors) > 0 {
+		page["key"] = anchors
 	}
 
 	max := query.Max
 	if max <= 0 {
-		max = 100
+		max = storage.DefaultMAMPageSize
 	}
 
-	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(max + 1))
-	cursor, err := s.col("mam_messages").Find(ctx, filter, opts)
+	// Paging backwards reads the page before BeforeID, or the last page,
+	// from the end.
+	backward := (query.BeforeID != "" || query.Last) && query.AfterID == ""
+	dir := 1
+	if backward {
+		dir = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "key", Value: dir}}).SetLimit(int64(max + 1))
+	cursor, err := s.col("mam_messages").Find(ctx, page, opts)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
 	var msgs []*storage.ArchivedMessage
+	keys := make(map[string]string)
 	for cursor.Next(ctx) {
 		var doc mamDoc
 		if err := cursor.Decode(&doc); err != nil {
 			return nil, err
 		}
+		keys[doc.ID] = doc.Key
 		msgs = append(msgs, &storage.ArchivedMessage{
 			ID: doc.ID, UserJID: doc.UserJID, WithJID: doc.WithJID,
 			FromJID: doc.FromJID, Data: doc.Data, CreatedAt: doc.CreatedAt,
@@ -477,18 +606,24 @@ func (s *Store) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*st
 	if err := cursor.Err(); err != nil {
 		return nil, err
 	}
-
-	complete := len(msgs) <= max
-	if len(msgs) > max {
-		msgs = msgs[:max]
+	if backward {
+		slices.Reverse(msgs)
 	}
+	result := storage.PageResult(msgs, query)
 
-	result := &storage.MAMResult{
-		Messages: msgs, Complete: complete, Count: len(msgs),
+	count, err := s.col("mam_messages").CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
 	}
-	if len(msgs) > 0 {
-		result.First = msgs[0].ID
-		result.Last = msgs[len(msgs)-1].ID
+	result.Count = int(count)
+	if result.First != "" {
+		before := maps.Clone(filter)
+		before["key"] = bson.M{"$lt": keys[result.First]}
+		index, err := s.col("mam_messages").CountDocuments(ctx, before)
+		if err != nil {
+			return nil, err
+		}
+		result.Index = int(index)
 	}
 	return result, nil
 }
@@ -498,6 +633,76 @@ func (s *Store) DeleteMessageArchive(ctx context.Context, userJID string) error
 	return err
 }
 
+func (s *Store) DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (int, error) {
+	res, err := s.col("mam_messages").DeleteMany(ctx, bson.M{"user_jid": userJID, "created_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (s *Store) GetArchivedMessage(ctx context.Context, userJID, id string) (*storage.ArchivedMessage, error) {
+	var doc mamDoc
+	err := s.col("mam_messages").FindOne(ctx, bson.M{"user_jid": userJID, "id": id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ArchivedMessage{
+		ID: doc.ID, UserJID: doc.UserJID, WithJID: doc.WithJID,
+		FromJID: doc.FromJID, Data: doc.Data, CreatedAt: doc.CreatedAt,
+	}, nil
+}
+
+func (s *Store) UpdateArchivedMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
+	res, err := s.col("mam_messages").UpdateOne(ctx,
+		bson.M{"user_jid": msg.UserJID, "id": msg.ID},
+		bson.M{"$set": bson.M{"data": msg.Data}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+type mamPrefsDoc struct {
+	UserJID string   `bson:"user_jid"`
+	Default string   `bson:"default"`
+	Always  []string `bson:"always"`
+	Never   []string `bson:"never"`
+}
+
+func (s *Store) GetMAMPrefs(ctx context.Context, userJID string) (*storage.MAMPrefs, error) {
+	var doc mamPrefsDoc
+	err := s.col("mam_prefs").FindOne(ctx, bson.M{"user_jid": userJID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.MAMPrefs{UserJID: doc.UserJID, Default: doc.Default, Always: doc.Always, Never: doc.Never}, nil
+}
+
+func (s *Store) SetMAMPrefs(ctx context.Context, prefs *storage.MAMPrefs) error {
+	_, err := s.col("mam_prefs").UpdateOne(ctx,
+		bson.M{"user_jid": prefs.UserJID},
+		bson.M{"$set": mamPrefsDoc{UserJID: prefs.UserJID, Default: prefs.Default, Always: prefs.Always, Never: prefs.Never}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *Store) DeleteMAMPrefs(ctx context.Context, userJID string) error {
+	_, err := s.col("mam_prefs").DeleteOne(ctx, bson.M{"user_jid": userJID})
+	return err
+}
+
 // --- MUCRoomStore ---
 
 type mucRoomDoc struct {
@@ -946,3 +1151,168 @@ func (s *Store) DeleteBookmark(ctx context.Context, userJID, roomJID string) err
 	}
 	return nil
 }
+
+// --- PushStore ---
+
+type pushDoc struct {
+	UserJID    string `bson:"user_jid"`
+	ServiceJID string `bson:"service_jid"`
+	Node       string `bson:"node"`
+	Options    []byte `bson:"options,omitempty"`
+}
+
+func (s *Store) SetPushRegistration(ctx context.Context, reg *storage.PushRegistration) error {
+	_, err := s.col("push_registrations").UpdateOne(ctx,
+		bson.M{"user_jid": reg.UserJID, "service_jid": reg.JID, "node": reg.Node},
+		bson.M{"$set": pushDoc{UserJID: reg.UserJID, ServiceJID: reg.JID, Node: reg.Node, Options: reg.Options}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *Store) GetPushRegistrations(ctx context.Context, userJID string) ([]*storage.PushRegistration, error) {
+	cursor, err := s.col("push_registrations").Find(ctx, bson.M{"user_jid": userJID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var regs []*storage.PushRegistration
+	for cursor.Next(ctx) {
+		var doc pushDoc
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		regs = append(regs, &storage.PushRegistration{UserJID: doc.UserJID, JID: doc.ServiceJID, Node: doc.Node, Options: doc.Options})
+	}
+	return regs, cursor.Err()
+}
+
+func (s *Store) DeletePushRegistrations(ctx context.Context, userJID, jid, node string) error {
+	filter := bson.M{"user_jid": userJID, "service_jid": jid}
+	if node != "" {
+		filter["node"] = node
+	}
+	_, err := s.col("push_registrations").DeleteMany(ctx, filter)
+	return err
+}
+
+// --- CapsStore ---
+
+func (s *Store) SetCapsInfo(ctx context.Context, ver string, info []byte) error {
+	_, err := s.col("caps_info").UpdateOne(ctx,
+		bson.M{"ver": ver},
+		bson.M{"$set": bson.M{"ver": ver, "info": info}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *Store) GetCapsInfo(ctx context.Context, ver string) ([]byte, error) {
+	var doc struct {
+		Info []byte `bson:"info"`
+	}
+	err := s.col("caps_info").FindOne(ctx, bson.M{"ver": ver}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Info, nil
+}
+
+// --- SharedGroupStore ---
+
+type sharedGroupDoc struct {
+	Name    string   `bson:"name"`
+	Display string   `bson:"display"`
+	Members []string `bson:"members"`
+}
+
+func (d *sharedGroupDoc) group() *storage.SharedGroup {
+	members := slices.Clone(d.Members)
+	slices.Sort(members)
+	return &storage.SharedGroup{Name: d.Name, Display: d.Display, Members: members}
+}
+
+func (s *Store) SetSharedGroup(ctx context.Context, group *storage.SharedGroup) error {
+	members := slices.Clone(group.Members)
+	if members == nil {
+		members = []string{}
+	}
+	_, err := s.col("shared_groups").UpdateOne(ctx,
+		bson.M{"name": group.Name},
+		bson.M{"$set": sharedGroupDoc{Name: group.Name, Display: group.Display, Members: members}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *Store) GetSharedGroup(ctx context.Context, name string) (*storage.SharedGroup, error) {
+	var doc sharedGroupDoc
+	err := s.col("shared_groups").FindOne(ctx, bson.M{"name": name}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.group(), nil
+}
+
+func (s *Store) ListSharedGroups(ctx context.Context) ([]*storage.SharedGroup, error) {
+	return s.findSharedGroups(ctx, bson.M{})
+}
+
+func (s *Store) DeleteSharedGroup(ctx context.Context, name string) error {
+	res, err := s.col("shared_groups").DeleteOne(ctx, bson.M{"name": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) AddSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	return s.updateSharedGroup(ctx, name, bson.M{"$addToSet": bson.M{"members": memberJID}})
+}
+
+func (s *Store) RemoveSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	return s.updateSharedGroup(ctx, name, bson.M{"$pull": bson.M{"members": memberJID}})
+}
+
+func (s *Store) GetMemberSharedGroups(ctx context.Context, memberJID string) ([]*storage.SharedGroup, error) {
+	return s.findSharedGroups(ctx, bson.M{"members": memberJID})
+}
+
+func (s *Store) updateSharedGroup(ctx context.Context, name string, update bson.M) error {
+	res, err := s.col("shared_groups").UpdateOne(ctx, bson.M{"name": name}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) findSharedGroups(ctx context.Context, filter bson.M) ([]*storage.SharedGroup, error) {
+	cursor, err := s.col("shared_groups").Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []*storage.SharedGroup
+	for cursor.Next(ctx) {
+		var doc sharedGroupDoc
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		groups = append(groups, doc.group())
+	}
+	return groups, cursor.Err()
+}
@@ -26,3 +26,19 @@ func TestMongoDBStorage(t *testing.T) {
 		return s
 	})
 }
+
+func BenchmarkMongoDBStorage(b *testing.B) {
+	uri := os.Getenv("MONGO_URI")
+	db := os.Getenv("MONGO_DB")
+	if uri == "" || db == "" {
+		b.Skip("MONGO_URI or MONGO_DB not set; skipping integration benchmark")
+	}
+
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		s, err := mongodb.New(uri, db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	})
+}
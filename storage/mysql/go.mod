@@ -7,6 +7,10 @@ require (
 	github.com/meszmate/xmpp-go v0.0.0
 )
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	golang.org/x/crypto v0.47.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+)
 
 replace github.com/meszmate/xmpp-go => ../..
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	xmppsql "github.com/meszmate/xmpp-go/storage/sql"
+	"github.com/meszmate/xmpp-go/storage/sql/migrations"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -35,7 +36,7 @@ func (d MySQLDialect) UpsertSuffix(conflictColumns []string, updateColumns []str
 	return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
 }
 
-func (d MySQLDialect) Migrations() []string {
+func (d MySQLDialect) Migrations() []migrations.Migration {
 	return mysqlMigrations
 }
 
@@ -48,131 +49,231 @@ func New(dsn string) (*xmppsql.Store, error) {
 	return xmppsql.New(db, MySQLDialect{}), nil
 }
 
-var mysqlMigrations = []string{
-	// Migration 1: users table
-	`CREATE TABLE IF NOT EXISTS users (
-		username VARCHAR(512) PRIMARY KEY,
-		password TEXT NOT NULL,
-		salt TEXT NOT NULL,
-		iterations INT NOT NULL DEFAULT 0,
-		server_key TEXT NOT NULL,
-		stored_key TEXT NOT NULL,
-		created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
-		updated_at DATETIME(6) NOT NULL DEFAULT NOW(6)
-	)`,
-
-	// Migration 2: roster tables
-	`CREATE TABLE IF NOT EXISTS roster_items (
-		user_jid VARCHAR(512) NOT NULL,
-		contact_jid VARCHAR(512) NOT NULL,
-		name TEXT NOT NULL,
-		subscription VARCHAR(32) NOT NULL DEFAULT 'none',
-		ask VARCHAR(32) NOT NULL DEFAULT '',
-		groups_list TEXT NOT NULL,
-		PRIMARY KEY (user_jid, contact_jid)
-	)`,
-
-	// Migration 2b: roster versions
-	`CREATE TABLE IF NOT EXISTS roster_versions (
-		user_jid VARCHAR(512) PRIMARY KEY,
-		version TEXT NOT NULL
-	)`,
-
-	// Migration 3: blocked JIDs
-	`CREATE TABLE IF NOT EXISTS blocked_jids (
-		user_jid VARCHAR(512) NOT NULL,
-		blocked_jid VARCHAR(512) NOT NULL,
-		PRIMARY KEY (user_jid, blocked_jid)
-	)`,
-
-	// Migration 4: vcards
-	`CREATE TABLE IF NOT EXISTS vcards (
-		user_jid VARCHAR(512) PRIMARY KEY,
-		data LONGBLOB NOT NULL
-	)`,
-
-	// Migration 5: offline messages
-	`CREATE TABLE IF NOT EXISTS offline_messages (
-		id VARCHAR(512) NOT NULL,
-		user_jid VARCHAR(512) NOT NULL,
-		from_jid VARCHAR(512) NOT NULL DEFAULT '',
-		data LONGBLOB NOT NULL,
-		created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
-		INDEX idx_offline_messages_user (user_jid)
-	)`,
-
-	// Migration 6: MAM messages
-	`CREATE TABLE IF NOT EXISTS mam_messages (
-		id VARCHAR(512) NOT NULL,
-		user_jid VARCHAR(512) NOT NULL,
-		with_jid VARCHAR(512) NOT NULL DEFAULT '',
-		from_jid VARCHAR(512) NOT NULL DEFAULT '',
-		data LONGBLOB NOT NULL,
-		created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
-		INDEX idx_mam_messages_user (user_jid),
-		INDEX idx_mam_messages_user_with (user_jid, with_jid)
-	)`,
-
-	// Migration 7: MUC rooms
-	`CREATE TABLE IF NOT EXISTS muc_rooms (
-		room_jid VARCHAR(512) PRIMARY KEY,
-		name TEXT NOT NULL,
-		description TEXT NOT NULL,
-		subject TEXT NOT NULL,
-		password TEXT NOT NULL,
-		is_public BOOLEAN NOT NULL DEFAULT TRUE,
-		is_persistent BOOLEAN NOT NULL DEFAULT FALSE,
-		max_users INT NOT NULL DEFAULT 0
-	)`,
-
-	// Migration 7b: MUC affiliations
-	`CREATE TABLE IF NOT EXISTS muc_affiliations (
-		room_jid VARCHAR(512) NOT NULL,
-		user_jid VARCHAR(512) NOT NULL,
-		affiliation VARCHAR(32) NOT NULL DEFAULT 'none',
-		reason TEXT NOT NULL,
-		PRIMARY KEY (room_jid, user_jid)
-	)`,
-
-	// Migration 8: PubSub nodes
-	`CREATE TABLE IF NOT EXISTS pubsub_nodes (
-		host VARCHAR(512) NOT NULL,
-		node_id VARCHAR(512) NOT NULL,
-		name TEXT NOT NULL,
-		type VARCHAR(32) NOT NULL DEFAULT 'leaf',
-		creator VARCHAR(512) NOT NULL DEFAULT '',
-		PRIMARY KEY (host, node_id)
-	)`,
-
-	// Migration 8b: PubSub items
-	`CREATE TABLE IF NOT EXISTS pubsub_items (
-		host VARCHAR(512) NOT NULL,
-		node_id VARCHAR(512) NOT NULL,
-		item_id VARCHAR(512) NOT NULL,
-		publisher VARCHAR(512) NOT NULL DEFAULT '',
-		payload LONGBLOB,
-		created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
-		PRIMARY KEY (host, node_id, item_id)
-	)`,
-
-	// Migration 8c: PubSub subscriptions
-	`CREATE TABLE IF NOT EXISTS pubsub_subscriptions (
-		host VARCHAR(512) NOT NULL,
-		node_id VARCHAR(512) NOT NULL,
-		jid VARCHAR(512) NOT NULL,
-		sub_id VARCHAR(512) NOT NULL DEFAULT '',
-		state VARCHAR(32) NOT NULL DEFAULT 'subscribed',
-		PRIMARY KEY (host, node_id, jid)
-	)`,
-
-	// Migration 9: Bookmarks
-	`CREATE TABLE IF NOT EXISTS bookmarks (
-		user_jid VARCHAR(512) NOT NULL,
-		room_jid VARCHAR(512) NOT NULL,
-		name TEXT NOT NULL,
-		nick TEXT NOT NULL,
-		password TEXT NOT NULL,
-		autojoin BOOLEAN NOT NULL DEFAULT FALSE,
-		PRIMARY KEY (user_jid, room_jid)
-	)`,
+var mysqlMigrations = []migrations.Migration{
+	{
+		Version: 1,
+		Name:    "users table",
+		Up: `CREATE TABLE IF NOT EXISTS users (
+			username VARCHAR(512) PRIMARY KEY,
+			password TEXT NOT NULL,
+			salt TEXT NOT NULL,
+			iterations INT NOT NULL DEFAULT 0,
+			server_key TEXT NOT NULL,
+			stored_key TEXT NOT NULL,
+			created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
+			updated_at DATETIME(6) NOT NULL DEFAULT NOW(6)
+		)`,
+		Down: `DROP TABLE IF EXISTS users`,
+	},
+	{
+		Version: 2,
+		Name:    "roster tables",
+		Up: `CREATE TABLE IF NOT EXISTS roster_items (
+			user_jid VARCHAR(512) NOT NULL,
+			contact_jid VARCHAR(512) NOT NULL,
+			name TEXT NOT NULL,
+			subscription VARCHAR(32) NOT NULL DEFAULT 'none',
+			ask VARCHAR(32) NOT NULL DEFAULT '',
+			groups_list TEXT NOT NULL,
+			PRIMARY KEY (user_jid, contact_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS roster_items`,
+	},
+	{
+		Version: 3,
+		Name:    "roster versions",
+		Up: `CREATE TABLE IF NOT EXISTS roster_versions (
+			user_jid VARCHAR(512) PRIMARY KEY,
+			version TEXT NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS roster_versions`,
+	},
+	{
+		Version: 4,
+		Name:    "blocked JIDs",
+		Up: `CREATE TABLE IF NOT EXISTS blocked_jids (
+			user_jid VARCHAR(512) NOT NULL,
+			blocked_jid VARCHAR(512) NOT NULL,
+			PRIMARY KEY (user_jid, blocked_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS blocked_jids`,
+	},
+	{
+		Version: 5,
+		Name:    "vcards",
+		Up: `CREATE TABLE IF NOT EXISTS vcards (
+			user_jid VARCHAR(512) PRIMARY KEY,
+			data LONGBLOB NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS vcards`,
+	},
+	{
+		Version: 6,
+		Name:    "offline messages",
+		Up: `CREATE TABLE IF NOT EXISTS offline_messages (
+			id VARCHAR(512) NOT NULL,
+			user_jid VARCHAR(512) NOT NULL,
+			from_jid VARCHAR(512) NOT NULL DEFAULT '',
+			data LONGBLOB NOT NULL,
+			created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
+			INDEX idx_offline_messages_user (user_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS offline_messages`,
+	},
+	{
+		Version: 7,
+		Name:    "MAM messages",
+		Up: `CREATE TABLE IF NOT EXISTS mam_messages (
+			id VARCHAR(512) NOT NULL,
+			user_jid VARCHAR(512) NOT NULL,
+			with_jid VARCHAR(512) NOT NULL DEFAULT '',
+			from_jid VARCHAR(512) NOT NULL DEFAULT '',
+			data LONGBLOB NOT NULL,
+			created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
+			INDEX idx_mam_messages_user (user_jid),
+			INDEX idx_mam_messages_user_with (user_jid, with_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS mam_messages`,
+	},
+	{
+		Version: 8,
+		Name:    "MUC rooms",
+		Up: `CREATE TABLE IF NOT EXISTS muc_rooms (
+			room_jid VARCHAR(512) PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			password TEXT NOT NULL,
+			is_public BOOLEAN NOT NULL DEFAULT TRUE,
+			is_persistent BOOLEAN NOT NULL DEFAULT FALSE,
+			max_users INT NOT NULL DEFAULT 0
+		)`,
+		Down: `DROP TABLE IF EXISTS muc_rooms`,
+	},
+	{
+		Version: 9,
+		Name:    "MUC affiliations",
+		Up: `CREATE TABLE IF NOT EXISTS muc_affiliations (
+			room_jid VARCHAR(512) NOT NULL,
+			user_jid VARCHAR(512) NOT NULL,
+			affiliation VARCHAR(32) NOT NULL DEFAULT 'none',
+			reason TEXT NOT NULL,
+			PRIMARY KEY (room_jid, user_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS muc_affiliations`,
+	},
+	{
+		Version: 10,
+		Name:    "PubSub nodes",
+		Up: `CREATE TABLE IF NOT EXISTS pubsub_nodes (
+			host VARCHAR(512) NOT NULL,
+			node_id VARCHAR(512) NOT NULL,
+			name TEXT NOT NULL,
+			type VARCHAR(32) NOT NULL DEFAULT 'leaf',
+			creator VARCHAR(512) NOT NULL DEFAULT '',
+			PRIMARY KEY (host, node_id)
+		)`,
+		Down: `DROP TABLE IF EXISTS pubsub_nodes`,
+	},
+	{
+		Version: 11,
+		Name:    "PubSub items",
+		Up: `CREATE TABLE IF NOT EXISTS pubsub_items (
+			host VARCHAR(512) NOT NULL,
+			node_id VARCHAR(512) NOT NULL,
+			item_id VARCHAR(512) NOT NULL,
+			publisher VARCHAR(512) NOT NULL DEFAULT '',
+			payload LONGBLOB,
+			created_at DATETIME(6) NOT NULL DEFAULT NOW(6),
+			PRIMARY KEY (host, node_id, item_id)
+		)`,
+		Down: `DROP TABLE IF EXISTS pubsub_items`,
+	},
+	{
+		Version: 12,
+		Name:    "PubSub subscriptions",
+		Up: `CREATE TABLE IF NOT EXISTS pubsub_subscriptions (
+			host VARCHAR(512) NOT NULL,
+			node_id VARCHAR(512) NOT NULL,
+			jid VARCHAR(512) NOT NULL,
+			sub_id VARCHAR(512) NOT NULL DEFAULT '',
+			state VARCHAR(32) NOT NULL DEFAULT 'subscribed',
+			PRIMARY KEY (host, node_id, jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS pubsub_subscriptions`,
+	},
+	{
+		Version: 13,
+		Name:    "bookmarks",
+		Up: `CREATE TABLE IF NOT EXISTS bookmarks (
+			user_jid VARCHAR(512) NOT NULL,
+			room_jid VARCHAR(512) NOT NULL,
+			name TEXT NOT NULL,
+			nick TEXT NOT NULL,
+			password TEXT NOT NULL,
+			autojoin BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY (user_jid, room_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS bookmarks`,
+	},
+	{
+		Version: 14,
+		Name:    "push notification registrations",
+		Up: `CREATE TABLE IF NOT EXISTS push_registrations (
+			user_jid VARCHAR(512) NOT NULL,
+			service_jid VARCHAR(512) NOT NULL,
+			node VARCHAR(512) NOT NULL,
+			options LONGBLOB,
+			PRIMARY KEY (user_jid, service_jid, node)
+		)`,
+		Down: `DROP TABLE IF EXISTS push_registrations`,
+	},
+	{
+		Version: 15,
+		Name:    "MAM paging index",
+		Up:      `CREATE INDEX idx_mam_messages_user_time ON mam_messages (user_jid(255), created_at, id(255))`,
+		Down:    `DROP INDEX idx_mam_messages_user_time ON mam_messages`,
+	},
+	{
+		// Verification strings are case-sensitive base64, which the
+		// default collation would not tell apart.
+		Version: 16,
+		Name:    "entity capabilities",
+		Up: `CREATE TABLE IF NOT EXISTS caps_info (
+			ver VARBINARY(512) PRIMARY KEY,
+			info LONGBLOB NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS caps_info`,
+	},
+	{
+		Version: 17,
+		Name:    "shared roster groups",
+		Up: `CREATE TABLE IF NOT EXISTS shared_groups (
+			name VARCHAR(512) PRIMARY KEY,
+			display TEXT NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS shared_groups`,
+	},
+	{
+		Version: 18,
+		Name:    "shared roster group members",
+		Up: `CREATE TABLE IF NOT EXISTS shared_group_members (
+			group_name VARCHAR(512) NOT NULL,
+			member_jid VARCHAR(512) NOT NULL,
+			PRIMARY KEY (group_name, member_jid),
+			INDEX idx_shared_group_members_member (member_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS shared_group_members`,
+	},
+	{
+		Version: 19,
+		Name:    "MAM preferences",
+		Up: `CREATE TABLE IF NOT EXISTS mam_prefs (
+			user_jid VARCHAR(512) PRIMARY KEY,
+			default_mode VARCHAR(16) NOT NULL,
+			always_list TEXT NOT NULL,
+			never_list TEXT NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS mam_prefs`,
+	},
 }
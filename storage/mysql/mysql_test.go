@@ -25,3 +25,18 @@ func TestMySQLStorage(t *testing.T) {
 		return s
 	})
 }
+
+func BenchmarkMySQLStorage(b *testing.B) {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		b.Skip("MYSQL_DSN not set; skipping integration benchmark")
+	}
+
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		s, err := mysql.New(dsn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	})
+}
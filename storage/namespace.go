@@ -0,0 +1,720 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidNamespace is returned by Namespace for an empty name or one
+// containing '/'.
+var ErrInvalidNamespace = errors.New("storage: invalid namespace")
+
+// Namespace returns a view of s in which every record is scoped to name.
+// A process serving several domains from one backend wraps it once per
+// domain, so data of one domain can never be read through another even
+// when both have an account with the same local part.
+//
+// The owner key of each record (username, user JID, room JID, pubsub host
+// or shared group name) is stored as "name/key" and returned without the
+// prefix. Contact, sender, subscriber and group member JIDs are stored
+// unchanged. Entity capabilities, which no one owns, are shared. Init and Close are passed through to s.
+func Namespace(s Storage, name string) (Storage, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, ErrInvalidNamespace
+	}
+	return &namespaced{s: s, prefix: name + "/"}, nil
+}
+
+type namespaced struct {
+	s      Storage
+	prefix string
+}
+
+func (n *namespaced) key(k string) string { return n.prefix + k }
+
+func (n *namespaced) unkey(k string) string { return strings.TrimPrefix(k, n.prefix) }
+
+func (n *namespaced) Init(ctx context.Context) error { return n.s.Init(ctx) }
+func (n *namespaced) Close() error                   { return n.s.Close() }
+
+func (n *namespaced) UserStore() UserStore {
+	us := n.s.UserStore()
+	if us == nil {
+		return nil
+	}
+	if ul, ok := us.(UserLister); ok {
+		return &nsUserLister{nsUserStore{n, us}, ul}
+	}
+	return &nsUserStore{n, us}
+}
+
+func (n *namespaced) RosterStore() RosterStore {
+	rs := n.s.RosterStore()
+	if rs == nil {
+		return nil
+	}
+	if rr, ok := rs.(RosterReplacer); ok {
+		return &nsRosterReplacer{nsRosterStore{n, rs}, rr}
+	}
+	return &nsRosterStore{n, rs}
+}
+
+func (n *namespaced) BlockingStore() BlockingStore {
+	bs := n.s.BlockingStore()
+	if bs == nil {
+		return nil
+	}
+	return &nsBlockingStore{n, bs}
+}
+
+func (n *namespaced) VCardStore() VCardStore {
+	vs := n.s.VCardStore()
+	if vs == nil {
+		return nil
+	}
+	return &nsVCardStore{n, vs}
+}
+
+func (n *namespaced) OfflineStore() OfflineStore {
+	os := n.s.OfflineStore()
+	if os == nil {
+		return nil
+	}
+	return &nsOfflineStore{n, os}
+}
+
+func (n *namespaced) MAMStore() MAMStore {
+	ms := n.s.MAMStore()
+	if ms == nil {
+		return nil
+	}
+	if me, ok := ms.(MAMEditor); ok {
+		return &nsMAMEditor{nsMAMStore{n, ms}, me}
+	}
+	return &nsMAMStore{n, ms}
+}
+
+func (n *namespaced) MUCRoomStore() MUCRoomStore {
+	ms := n.s.MUCRoomStore()
+	if ms == nil {
+		return nil
+	}
+	return &nsMUCRoomStore{n, ms}
+}
+
+func (n *namespaced) PubSubStore() PubSubStore {
+	ps := n.s.PubSubStore()
+	if ps == nil {
+		return nil
+	}
+	return &nsPubSubStore{n, ps}
+}
+
+func (n *namespaced) BookmarkStore() BookmarkStore {
+	bs := n.s.BookmarkStore()
+	if bs == nil {
+		return nil
+	}
+	return &nsBookmarkStore{n, bs}
+}
+
+func (n *namespaced) PushStore() PushStore {
+	ps := n.s.PushStore()
+	if ps == nil {
+		return nil
+	}
+	return &nsPushStore{n, ps}
+}
+
+// CapsStore is shared between namespaces: its entries are owned by no one
+// and, being verified against their hash, the same for every domain.
+func (n *namespaced) CapsStore() CapsStore { return n.s.CapsStore() }
+
+func (n *namespaced) SharedGroupStore() SharedGroupStore {
+	gs := n.s.SharedGroupStore()
+	if gs == nil {
+		return nil
+	}
+	return &nsSharedGroupStore{n, gs}
+}
+
+// --- UserStore ---
+
+type nsUserStore struct {
+	n *namespaced
+	s UserStore
+}
+
+func (u *nsUserStore) CreateUser(ctx context.Context, user *User) error {
+	cp := *user
+	cp.Username = u.n.key(user.Username)
+	return u.s.CreateUser(ctx, &cp)
+}
+
+func (u *nsUserStore) GetUser(ctx context.Context, username string) (*User, error) {
+	user, err := u.s.GetUser(ctx, u.n.key(username))
+	if err != nil {
+		return nil, err
+	}
+	user.Username = u.n.unkey(user.Username)
+	return user, nil
+}
+
+func (u *nsUserStore) UpdateUser(ctx context.Context, user *User) error {
+	cp := *user
+	cp.Username = u.n.key(user.Username)
+	return u.s.UpdateUser(ctx, &cp)
+}
+
+func (u *nsUserStore) DeleteUser(ctx context.Context, username string) error {
+	return u.s.DeleteUser(ctx, u.n.key(username))
+}
+
+func (u *nsUserStore) UserExists(ctx context.Context, username string) (bool, error) {
+	return u.s.UserExists(ctx, u.n.key(username))
+}
+
+func (u *nsUserStore) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	return u.s.Authenticate(ctx, u.n.key(username), password)
+}
+
+type nsUserLister struct {
+	nsUserStore
+	ul UserLister
+}
+
+// ListUsers returns the users of the namespace only.
+func (u *nsUserLister) ListUsers(ctx context.Context) ([]string, error) {
+	all, err := u.ul.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, u.n.prefix) {
+			names = append(names, u.n.unkey(name))
+		}
+	}
+	return names, nil
+}
+
+// --- RosterStore ---
+
+type nsRosterStore struct {
+	n *namespaced
+	s RosterStore
+}
+
+func (r *nsRosterStore) scoped(item *RosterItem) *RosterItem {
+	cp := *item
+	cp.UserJID = r.n.key(item.UserJID)
+	return &cp
+}
+
+func (r *nsRosterStore) UpsertRosterItem(ctx context.Context, item *RosterItem) error {
+	return r.s.UpsertRosterItem(ctx, r.scoped(item))
+}
+
+func (r *nsRosterStore) UpsertRosterItems(ctx context.Context, items []*RosterItem) error {
+	scoped := make([]*RosterItem, len(items))
+	for i, item := range items {
+		scoped[i] = r.scoped(item)
+	}
+	return r.s.UpsertRosterItems(ctx, scoped)
+}
+
+func (r *nsRosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (*RosterItem, error) {
+	item, err := r.s.GetRosterItem(ctx, r.n.key(userJID), contactJID)
+	if err != nil {
+		return nil, err
+	}
+	item.UserJID = r.n.unkey(item.UserJID)
+	return item, nil
+}
+
+func (r *nsRosterStore) GetRosterItems(ctx context.Context, userJID string) ([]*RosterItem, error) {
+	items, err := r.s.GetRosterItems(ctx, r.n.key(userJID))
+	for _, item := range items {
+		item.UserJID = r.n.unkey(item.UserJID)
+	}
+	return items, err
+}
+
+func (r *nsRosterStore) DeleteRosterItem(ctx context.Context, userJID, contactJID string) error {
+	return r.s.DeleteRosterItem(ctx, r.n.key(userJID), contactJID)
+}
+
+func (r *nsRosterStore) GetRosterVersion(ctx context.Context, userJID string) (string, error) {
+	return r.s.GetRosterVersion(ctx, r.n.key(userJID))
+}
+
+func (r *nsRosterStore) SetRosterVersion(ctx context.Context, userJID, version string) error {
+	return r.s.SetRosterVersion(ctx, r.n.key(userJID), version)
+}
+
+type nsRosterReplacer struct {
+	nsRosterStore
+	rr RosterReplacer
+}
+
+func (r *nsRosterReplacer) ReplaceRosterItems(ctx context.Context, userJID string, items []*RosterItem, version string) error {
+	scoped := make([]*RosterItem, len(items))
+	for i, item := range items {
+		scoped[i] = r.scoped(item)
+	}
+	return r.rr.ReplaceRosterItems(ctx, r.n.key(userJID), scoped, version)
+}
+
+// --- BlockingStore ---
+
+type nsBlockingStore struct {
+	n *namespaced
+	s BlockingStore
+}
+
+func (b *nsBlockingStore) BlockJID(ctx context.Context, userJID, blockedJID string) error {
+	return b.s.BlockJID(ctx, b.n.key(userJID), blockedJID)
+}
+
+func (b *nsBlockingStore) UnblockJID(ctx context.Context, userJID, blockedJID string) error {
+	return b.s.UnblockJID(ctx, b.n.key(userJID), blockedJID)
+}
+
+func (b *nsBlockingStore) IsBlocked(ctx context.Context, userJID, blockedJID string) (bool, error) {
+	return b.s.IsBlocked(ctx, b.n.key(userJID), blockedJID)
+}
+
+func (b *nsBlockingStore) GetBlockedJIDs(ctx context.Context, userJID string) ([]string, error) {
+	return b.s.GetBlockedJIDs(ctx, b.n.key(userJID))
+}
+
+// --- VCardStore ---
+
+type nsVCardStore struct {
+	n *namespaced
+	s VCardStore
+}
+
+func (v *nsVCardStore) SetVCard(ctx context.Context, userJID string, data []byte) error {
+	return v.s.SetVCard(ctx, v.n.key(userJID), data)
+}
+
+func (v *nsVCardStore) GetVCard(ctx context.Context, userJID string) ([]byte, error) {
+	return v.s.GetVCard(ctx, v.n.key(userJID))
+}
+
+func (v *nsVCardStore) DeleteVCard(ctx context.Context, userJID string) error {
+	return v.s.DeleteVCard(ctx, v.n.key(userJID))
+}
+
+// --- OfflineStore ---
+
+type nsOfflineStore struct {
+	n *namespaced
+	s OfflineStore
+}
+
+func (o *nsOfflineStore) StoreOfflineMessage(ctx context.Context, msg *OfflineMessage) error {
+	cp := *msg
+	cp.UserJID = o.n.key(msg.UserJID)
+	return o.s.StoreOfflineMessage(ctx, &cp)
+}
+
+func (o *nsOfflineStore) GetOfflineMessages(ctx context.Context, userJID string) ([]*OfflineMessage, error) {
+	msgs, err := o.s.GetOfflineMessages(ctx, o.n.key(userJID))
+	for _, msg := range msgs {
+		msg.UserJID = o.n.unkey(msg.UserJID)
+	}
+	return msgs, err
+}
+
+func (o *nsOfflineStore) DeleteOfflineMessages(ctx context.Context, userJID string) error {
+	return o.s.DeleteOfflineMessages(ctx, o.n.key(userJID))
+}
+
+func (o *nsOfflineStore) DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) error {
+	return o.s.DeleteOfflineMessagesByIDs(ctx, o.n.key(userJID), ids)
+}
+
+func (o *nsOfflineStore) CountOfflineMessages(ctx context.Context, userJID string) (int, error) {
+	return o.s.CountOfflineMessages(ctx, o.n.key(userJID))
+}
+
+// --- MAMStore ---
+
+type nsMAMStore struct {
+	n *namespaced
+	s MAMStore
+}
+
+func (m *nsMAMStore) ArchiveMessage(ctx context.Context, msg *ArchivedMessage) error {
+	cp := *msg
+	cp.UserJID = m.n.key(msg.UserJID)
+	return m.s.ArchiveMessage(ctx, &cp)
+}
+
+func (m *nsMAMStore) ArchiveMessages(ctx context.Context, msgs []*ArchivedMessage) error {
+	scoped := make([]*ArchivedMessage, len(msgs))
+	for i, msg := range msgs {
+		cp := *msg
+		cp.UserJID = m.n.key(msg.UserJID)
+		scoped[i] = &cp
+	}
+	return m.s.ArchiveMessages(ctx, scoped)
+}
+
+func (m *nsMAMStore) QueryMessages(ctx context.Context, query *MAMQuery) (*MAMResult, error) {
+	q := *query
+	q.UserJID = m.n.key(query.UserJID)
+	res, err := m.s.QueryMessages(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range res.Messages {
+		msg.UserJID = m.n.unkey(msg.UserJID)
+	}
+	return res, nil
+}
+
+func (m *nsMAMStore) DeleteMessageArchive(ctx context.Context, userJID string) error {
+	return m.s.DeleteMessageArchive(ctx, m.n.key(userJID))
+}
+
+func (m *nsMAMStore) DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (int, error) {
+	return m.s.DeleteMessagesBefore(ctx, m.n.key(userJID), before)
+}
+
+func (m *nsMAMStore) GetMAMPrefs(ctx context.Context, userJID string) (*MAMPrefs, error) {
+	prefs, err := m.s.GetMAMPrefs(ctx, m.n.key(userJID))
+	if err != nil {
+		return nil, err
+	}
+	prefs.UserJID = m.n.unkey(prefs.UserJID)
+	return prefs, nil
+}
+
+func (m *nsMAMStore) SetMAMPrefs(ctx context.Context, prefs *MAMPrefs) error {
+	cp := *prefs
+	cp.UserJID = m.n.key(prefs.UserJID)
+	return m.s.SetMAMPrefs(ctx, &cp)
+}
+
+func (m *nsMAMStore) DeleteMAMPrefs(ctx context.Context, userJID string) error {
+	return m.s.DeleteMAMPrefs(ctx, m.n.key(userJID))
+}
+
+type nsMAMEditor struct {
+	nsMAMStore
+	me MAMEditor
+}
+
+func (m *nsMAMEditor) GetArchivedMessage(ctx context.Context, userJID, id string) (*ArchivedMessage, error) {
+	msg, err := m.me.GetArchivedMessage(ctx, m.n.key(userJID), id)
+	if err != nil {
+		return nil, err
+	}
+	msg.UserJID = m.n.unkey(msg.UserJID)
+	return msg, nil
+}
+
+func (m *nsMAMEditor) UpdateArchivedMessage(ctx context.Context, msg *ArchivedMessage) error {
+	cp := *msg
+	cp.UserJID = m.n.key(msg.UserJID)
+	return m.me.UpdateArchivedMessage(ctx, &cp)
+}
+
+// --- MUCRoomStore ---
+
+type nsMUCRoomStore struct {
+	n *namespaced
+	s MUCRoomStore
+}
+
+func (m *nsMUCRoomStore) CreateRoom(ctx context.Context, room *MUCRoom) error {
+	cp := *room
+	cp.RoomJID = m.n.key(room.RoomJID)
+	return m.s.CreateRoom(ctx, &cp)
+}
+
+func (m *nsMUCRoomStore) GetRoom(ctx context.Context, roomJID string) (*MUCRoom, error) {
+	room, err := m.s.GetRoom(ctx, m.n.key(roomJID))
+	if err != nil {
+		return nil, err
+	}
+	room.RoomJID = m.n.unkey(room.RoomJID)
+	return room, nil
+}
+
+func (m *nsMUCRoomStore) UpdateRoom(ctx context.Context, room *MUCRoom) error {
+	cp := *room
+	cp.RoomJID = m.n.key(room.RoomJID)
+	return m.s.UpdateRoom(ctx, &cp)
+}
+
+func (m *nsMUCRoomStore) DeleteRoom(ctx context.Context, roomJID string) error {
+	return m.s.DeleteRoom(ctx, m.n.key(roomJID))
+}
+
+// ListRooms returns only the rooms of this namespace.
+func (m *nsMUCRoomStore) ListRooms(ctx context.Context) ([]*MUCRoom, error) {
+	rooms, err := m.s.ListRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []*MUCRoom
+	for _, room := range rooms {
+		if strings.HasPrefix(room.RoomJID, m.n.prefix) {
+			room.RoomJID = m.n.unkey(room.RoomJID)
+			out = append(out, room)
+		}
+	}
+	return out, nil
+}
+
+func (m *nsMUCRoomStore) SetAffiliation(ctx context.Context, aff *MUCAffiliation) error {
+	cp := *aff
+	cp.RoomJID = m.n.key(aff.RoomJID)
+	return m.s.SetAffiliation(ctx, &cp)
+}
+
+func (m *nsMUCRoomStore) GetAffiliation(ctx context.Context, roomJID, userJID string) (*MUCAffiliation, error) {
+	aff, err := m.s.GetAffiliation(ctx, m.n.key(roomJID), userJID)
+	if err != nil {
+		return nil, err
+	}
+	aff.RoomJID = m.n.unkey(aff.RoomJID)
+	return aff, nil
+}
+
+func (m *nsMUCRoomStore) GetAffiliations(ctx context.Context, roomJID string) ([]*MUCAffiliation, error) {
+	affs, err := m.s.GetAffiliations(ctx, m.n.key(roomJID))
+	for _, aff := range affs {
+		aff.RoomJID = m.n.unkey(aff.RoomJID)
+	}
+	return affs, err
+}
+
+func (m *nsMUCRoomStore) RemoveAffiliation(ctx context.Context, roomJID, userJID string) error {
+	return m.s.RemoveAffiliation(ctx, m.n.key(roomJID), userJID)
+}
+
+// --- PubSubStore ---
+
+type nsPubSubStore struct {
+	n *namespaced
+	s PubSubStore
+}
+
+func (p *nsPubSubStore) CreateNode(ctx context.Context, node *PubSubNode) error {
+	cp := *node
+	cp.Host = p.n.key(node.Host)
+	return p.s.CreateNode(ctx, &cp)
+}
+
+func (p *nsPubSubStore) GetNode(ctx context.Context, host, nodeID string) (*PubSubNode, error) {
+	node, err := p.s.GetNode(ctx, p.n.key(host), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	node.Host = p.n.unkey(node.Host)
+	return node, nil
+}
+
+func (p *nsPubSubStore) DeleteNode(ctx context.Context, host, nodeID string) error {
+	return p.s.DeleteNode(ctx, p.n.key(host), nodeID)
+}
+
+func (p *nsPubSubStore) ListNodes(ctx context.Context, host string) ([]*PubSubNode, error) {
+	nodes, err := p.s.ListNodes(ctx, p.n.key(host))
+	for _, node := range nodes {
+		node.Host = p.n.unkey(node.Host)
+	}
+	return nodes, err
+}
+
+func (p *nsPubSubStore) UpsertItem(ctx context.Context, item *PubSubItem) error {
+	cp := *item
+	cp.Host = p.n.key(item.Host)
+	return p.s.UpsertItem(ctx, &cp)
+}
+
+func (p *nsPubSubStore) GetItem(ctx context.Context, host, nodeID, itemID string) (*PubSubItem, error) {
+	item, err := p.s.GetItem(ctx, p.n.key(host), nodeID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	item.Host = p.n.unkey(item.Host)
+	return item, nil
+}
+
+func (p *nsPubSubStore) GetItems(ctx context.Context, host, nodeID string) ([]*PubSubItem, error) {
+	items, err := p.s.GetItems(ctx, p.n.key(host), nodeID)
+	for _, item := range items {
+		item.Host = p.n.unkey(item.Host)
+	}
+	return items, err
+}
+
+func (p *nsPubSubStore) DeleteItem(ctx context.Context, host, nodeID, itemID string) error {
+	return p.s.DeleteItem(ctx, p.n.key(host), nodeID, itemID)
+}
+
+func (p *nsPubSubStore) Subscribe(ctx context.Context, sub *PubSubSubscription) error {
+	cp := *sub
+	cp.Host = p.n.key(sub.Host)
+	return p.s.Subscribe(ctx, &cp)
+}
+
+func (p *nsPubSubStore) Unsubscribe(ctx context.Context, host, nodeID, jid string) error {
+	return p.s.Unsubscribe(ctx, p.n.key(host), nodeID, jid)
+}
+
+func (p *nsPubSubStore) GetSubscription(ctx context.Context, host, nodeID, jid string) (*PubSubSubscription, error) {
+	sub, err := p.s.GetSubscription(ctx, p.n.key(host), nodeID, jid)
+	if err != nil {
+		return nil, err
+	}
+	sub.Host = p.n.unkey(sub.Host)
+	return sub, nil
+}
+
+func (p *nsPubSubStore) GetSubscriptions(ctx context.Context, host, nodeID string) ([]*PubSubSubscription, error) {
+	subs, err := p.s.GetSubscriptions(ctx, p.n.key(host), nodeID)
+	for _, sub := range subs {
+		sub.Host = p.n.unkey(sub.Host)
+	}
+	return subs, err
+}
+
+func (p *nsPubSubStore) GetUserSubscriptions(ctx context.Context, host, jid string) ([]*PubSubSubscription, error) {
+	subs, err := p.s.GetUserSubscriptions(ctx, p.n.key(host), jid)
+	for _, sub := range subs {
+		sub.Host = p.n.unkey(sub.Host)
+	}
+	return subs, err
+}
+
+// --- BookmarkStore ---
+
+type nsBookmarkStore struct {
+	n *namespaced
+	s BookmarkStore
+}
+
+func (b *nsBookmarkStore) SetBookmark(ctx context.Context, bm *Bookmark) error {
+	cp := *bm
+	cp.UserJID = b.n.key(bm.UserJID)
+	return b.s.SetBookmark(ctx, &cp)
+}
+
+func (b *nsBookmarkStore) GetBookmark(ctx context.Context, userJID, roomJID string) (*Bookmark, error) {
+	bm, err := b.s.GetBookmark(ctx, b.n.key(userJID), roomJID)
+	if err != nil {
+		return nil, err
+	}
+	bm.UserJID = b.n.unkey(bm.UserJID)
+	return bm, nil
+}
+
+func (b *nsBookmarkStore) GetBookmarks(ctx context.Context, userJID string) ([]*Bookmark, error) {
+	bms, err := b.s.GetBookmarks(ctx, b.n.key(userJID))
+	for _, bm := range bms {
+		bm.UserJID = b.n.unkey(bm.UserJID)
+	}
+	return bms, err
+}
+
+func (b *nsBookmarkStore) DeleteBookmark(ctx context.Context, userJID, roomJID string) error {
+	return b.s.DeleteBookmark(ctx, b.n.key(userJID), roomJID)
+}
+
+// --- PushStore ---
+
+type nsPushStore struct {
+	n *namespaced
+	s PushStore
+}
+
+func (p *nsPushStore) SetPushRegistration(ctx context.Context, reg *PushRegistration) error {
+	cp := *reg
+	cp.UserJID = p.n.key(reg.UserJID)
+	return p.s.SetPushRegistration(ctx, &cp)
+}
+
+func (p *nsPushStore) GetPushRegistrations(ctx context.Context, userJID string) ([]*PushRegistration, error) {
+	regs, err := p.s.GetPushRegistrations(ctx, p.n.key(userJID))
+	for _, reg := range regs {
+		reg.UserJID = p.n.unkey(reg.UserJID)
+	}
+	return regs, err
+}
+
+func (p *nsPushStore) DeletePushRegistrations(ctx context.Context, userJID, jid, node string) error {
+	return p.s.DeletePushRegistrations(ctx, p.n.key(userJID), jid, node)
+}
+
+// --- SharedGroupStore ---
+
+type nsSharedGroupStore struct {
+	n *namespaced
+	s SharedGroupStore
+}
+
+func (g *nsSharedGroupStore) SetSharedGroup(ctx context.Context, group *SharedGroup) error {
+	cp := *group
+	cp.Name = g.n.key(group.Name)
+	return g.s.SetSharedGroup(ctx, &cp)
+}
+
+func (g *nsSharedGroupStore) GetSharedGroup(ctx context.Context, name string) (*SharedGroup, error) {
+	group, err := g.s.GetSharedGroup(ctx, g.n.key(name))
+	if err != nil {
+		return nil, err
+	}
+	group.Name = g.n.unkey(group.Name)
+	return group, nil
+}
+
+// ListSharedGroups returns only the groups of this namespace.
+func (g *nsSharedGroupStore) ListSharedGroups(ctx context.Context) ([]*SharedGroup, error) {
+	groups, err := g.s.ListSharedGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return g.own(groups), nil
+}
+
+func (g *nsSharedGroupStore) DeleteSharedGroup(ctx context.Context, name string) error {
+	return g.s.DeleteSharedGroup(ctx, g.n.key(name))
+}
+
+func (g *nsSharedGroupStore) AddSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	return g.s.AddSharedGroupMember(ctx, g.n.key(name), memberJID)
+}
+
+func (g *nsSharedGroupStore) RemoveSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	return g.s.RemoveSharedGroupMember(ctx, g.n.key(name), memberJID)
+}
+
+// GetMemberSharedGroups returns only the groups of this namespace.
+func (g *nsSharedGroupStore) GetMemberSharedGroups(ctx context.Context, memberJID string) ([]*SharedGroup, error) {
+	groups, err := g.s.GetMemberSharedGroups(ctx, memberJID)
+	if err != nil {
+		return nil, err
+	}
+	return g.own(groups), nil
+}
+
+// own returns the groups of this namespace, without the prefix.
+func (g *nsSharedGroupStore) own(groups []*SharedGroup) []*SharedGroup {
+	var out []*SharedGroup
+	for _, group := range groups {
+		if strings.HasPrefix(group.Name, g.n.prefix) {
+			group.Name = g.n.unkey(group.Name)
+			out = append(out, group)
+		}
+	}
+	return out
+}
@@ -25,6 +25,10 @@ type OfflineStore interface {
 	// DeleteOfflineMessages removes all offline messages for a user.
 	DeleteOfflineMessages(ctx context.Context, userJID string) error
 
+	// DeleteOfflineMessagesByIDs removes the offline messages of a user
+	// with the given IDs. IDs the user has no message with are ignored.
+	DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) error
+
 	// CountOfflineMessages returns the number of offline messages for a user.
 	CountOfflineMessages(ctx context.Context, userJID string) (int, error)
 }
@@ -25,3 +25,18 @@ func TestPostgresStorage(t *testing.T) {
 		return s
 	})
 }
+
+func BenchmarkPostgresStorage(b *testing.B) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		b.Skip("PG_DSN not set; skipping integration benchmark")
+	}
+
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		s, err := postgres.New(dsn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	})
+}
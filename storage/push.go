@@ -0,0 +1,30 @@
+package storage
+
+import "context"
+
+// PushRegistration is an app server a user enabled push notifications
+// with (XEP-0357).
+type PushRegistration struct {
+	UserJID string
+	// JID is the XMPP Push Service of the app server.
+	JID  string
+	Node string
+	// Options is the publish-options data form as XML, sent along with
+	// every notification; empty when none was given.
+	Options []byte
+}
+
+// PushStore manages push notification registrations.
+type PushStore interface {
+	// SetPushRegistration adds or replaces the registration for the user,
+	// service JID and node.
+	SetPushRegistration(ctx context.Context, reg *PushRegistration) error
+
+	// GetPushRegistrations retrieves all registrations of a user.
+	GetPushRegistrations(ctx context.Context, userJID string) ([]*PushRegistration, error)
+
+	// DeletePushRegistrations removes the user's registrations with the
+	// service JID, or only the one for node when node is not empty.
+	// Removing registrations that do not exist is not an error.
+	DeletePushRegistrations(ctx context.Context, userJID, jid, node string) error
+}
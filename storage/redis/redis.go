@@ -4,9 +4,12 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -38,6 +41,11 @@ func (s *Store) MAMStore() storage.MAMStore           { return s }
 func (s *Store) MUCRoomStore() storage.MUCRoomStore   { return s }
 func (s *Store) PubSubStore() storage.PubSubStore     { return s }
 func (s *Store) BookmarkStore() storage.BookmarkStore { return s }
+func (s *Store) PushStore() storage.PushStore         { return s }
+func (s *Store) CapsStore() storage.CapsStore         { return s }
+func (s *Store) SharedGroupStore() storage.SharedGroupStore {
+	return s
+}
 
 // Key helpers
 func userKey(username string) string                  { return "xmpp:user:" + username }
@@ -47,7 +55,11 @@ func blockedKey(userJID string) string                { return "xmpp:blocked:" +
 func vcardKey(userJID string) string                  { return "xmpp:vcard:" + userJID }
 func offlineKey(userJID string) string                { return "xmpp:offline:" + userJID }
 func mamKey(userJID string) string                    { return "xmpp:mam:" + userJID }
+func mamIdxKey(userJID string) string                 { return "xmpp:mam_idx:" + userJID }
+func mamWithKey(userJID, withJID string) string       { return "xmpp:mam_with:" + userJID + ":" + withJID }
+func mamWithsKey(userJID string) string               { return "xmpp:mam_withs:" + userJID }
 func mamMsgKey(userJID, id string) string             { return "xmpp:mam_msg:" + userJID + ":" + id }
+func mamPrefsKey(userJID string) string               { return "xmpp:mam_prefs:" + userJID }
 func mucRoomKey(roomJID string) string                { return "xmpp:muc_room:" + roomJID }
 func mucRoomsSetKey() string                          { return "xmpp:muc_rooms" }
 func mucAffKey(roomJID string) string                 { return "xmpp:muc_aff:" + roomJID }
@@ -58,6 +70,11 @@ func pubsubItemsKey(host, nodeID string) string       { return "xmpp:ps_items:"
 func pubsubSubsKey(host, nodeID string) string        { return "xmpp:ps_subs:" + host + ":" + nodeID }
 func pubsubUserSubsKey(host, jid string) string       { return "xmpp:ps_usubs:" + host + ":" + jid }
 func bookmarkKey(userJID string) string               { return "xmpp:bookmarks:" + userJID }
+func pushKey(userJID string) string                   { return "xmpp:push:" + userJID }
+func capsKey(ver string) string                       { return "xmpp:caps:" + ver }
+func sharedGroupsKey() string                         { return "xmpp:shared_groups" }
+func sharedGroupKey(name string) string               { return "xmpp:shared_group:" + name }
+func memberGroupsKey(memberJID string) string         { return "xmpp:member_groups:" + memberJID }
 
 func marshal(v any) string {
 	b, _ := json.Marshal(v)
@@ -121,23 +138,26 @@ func (s *Store) DeleteUser(ctx context.Context, username string) error {
 	return nil
 }
 
+func (s *Store) ListUsers(ctx context.Context) ([]string, error) {
+	var names []string
+	iter := s.rdb.Scan(ctx, 0, userKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		names = append(names, strings.TrimPrefix(iter.Val(), userKey("")))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
 func (s *Store) UserExists(ctx context.Context, username string) (bool, error) {
 	n, err := s.rdb.Exists(ctx, userKey(username)).Result()
 	return n > 0, err
 }
 
 func (s *Store) Authenticate(ctx context.Context, username, password string) (bool, error) {
-	user, err := s.GetUser(ctx, username)
-	if err != nil {
-		if err == storage.ErrNotFound {
-			return false, storage.ErrAuthFailed
-		}
-		return false, err
-	}
-	if user.Password != password {
-		return false, storage.ErrAuthFailed
-	}
-	return true, nil
+	return credentials.Authenticate(ctx, s, username, password)
 }
 
 // --- RosterStore ---
@@ -146,6 +166,19 @@ func (s *Store) UpsertRosterItem(ctx context.Context, item *storage.RosterItem)
 	return s.rdb.HSet(ctx, rosterKey(item.UserJID), item.ContactJID, marshal(item)).Err()
 }
 
+func (s *Store) UpsertRosterItems(ctx context.Context, items []*storage.RosterItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			pipe.HSet(ctx, rosterKey(item.UserJID), item.ContactJID, marshal(item))
+		}
+		return nil
+	})
+	return err
+}
+
 func (s *Store) GetRosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
 	data, err := s.rdb.HGet(ctx, rosterKey(userJID), contactJID).Result()
 	if err == redis.Nil {
@@ -269,6 +302,33 @@ func (s *Store) DeleteOfflineMessages(ctx context.Context, userJID string) error
 	return s.rdb.Del(ctx, offlineKey(userJID)).Err()
 }
 
+// DeleteOfflineMessagesByIDs removes the listed messages by value, so
+// messages stored meanwhile are kept.
+func (s *Store) DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	data, err := s.rdb.LRange(ctx, offlineKey(userJID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.TxPipeline()
+	for _, v := range data {
+		var msg storage.OfflineMessage
+		if err := unmarshal(v, &msg); err != nil {
+			return err
+		}
+		if slices.Contains(ids, msg.ID) {
+			pipe.LRem(ctx, offlineKey(userJID), 0, v)
+		}
+	}
+	if pipe.Len() == 0 {
+		return nil
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
 func (s *Store) CountOfflineMessages(ctx context.Context, userJID string) (int, error) {
 	n, err := s.rdb.LLen(ctx, offlineKey(userJID)).Result()
 	return int(n), err
@@ -277,104 +337,306 @@ func (s *Store) CountOfflineMessages(ctx context.Context, userJID string) (int,
 // --- MAMStore ---
 
 func (s *Store) ArchiveMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
-	if msg.CreatedAt.IsZero() {
-		msg.CreatedAt = time.Now()
-	}
-	score := float64(msg.CreatedAt.UnixNano())
 	pipe := s.rdb.Pipeline()
-	pipe.ZAdd(ctx, mamKey(msg.UserJID), redis.Z{Score: score, Member: msg.ID})
-	pipe.Set(ctx, mamMsgKey(msg.UserJID, msg.ID), marshal(msg), 0)
+	archive(ctx, pipe, msg)
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func (s *Store) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
-	max := query.Max
-	if max <= 0 {
-		max = 100
+func (s *Store) ArchiveMessages(ctx context.Context, msgs []*storage.ArchivedMessage) error {
+	if len(msgs) == 0 {
+		return nil
 	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			archive(ctx, pipe, msg)
+		}
+		return nil
+	})
+	return err
+}
 
-	// Get all message IDs sorted by time.
-	ids, err := s.rdb.ZRangeByScore(ctx, mamKey(query.UserJID), &redis.ZRangeBy{
-		Min: "-inf", Max: "+inf",
-	}).Result()
-	if err != nil {
-		return nil, err
+// Archives are indexed by sorted sets whose members, all scored zero, are
+// storage.MessageKey keys, so that lexicographic ranges over them follow
+// archive order exactly: one of the whole archive, and one per
+// correspondent. The messages themselves are kept under their own keys.
+// Archives written before these indexes existed were indexed by a sorted set
+// of IDs scored by time, under mamKey, and are moved to them when queried.
+
+// archive queues the commands storing msg on pipe.
+func archive(ctx context.Context, pipe redis.Pipeliner, msg *storage.ArchivedMessage) {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
 	}
+	pipe.Set(ctx, mamMsgKey(msg.UserJID, msg.ID), marshal(msg), 0)
+	index(ctx, pipe, msg)
+}
 
-	// Filter and collect messages.
-	var msgs []*storage.ArchivedMessage
-	afterIDFound := query.AfterID == ""
+// index queues the commands adding msg to the indexes of its archive.
+func index(ctx context.Context, pipe redis.Pipeliner, msg *storage.ArchivedMessage) {
+	key := storage.MessageKey(msg.CreatedAt, msg.ID)
+	pipe.ZAdd(ctx, mamIdxKey(msg.UserJID), redis.Z{Member: key})
+	if msg.WithJID != "" {
+		pipe.ZAdd(ctx, mamWithKey(msg.UserJID, msg.WithJID), redis.Z{Member: key})
+		pipe.SAdd(ctx, mamWithsKey(msg.UserJID), msg.WithJID)
+	}
+}
 
-	for _, id := range ids {
-		if !afterIDFound {
-			if id == query.AfterID {
-				afterIDFound = true
-			}
-			continue
-		}
-		if query.BeforeID != "" && id == query.BeforeID {
-			break
+// migrateArchive moves the archive of userJID to the lexicographic
+// indexes, if it still has the index by time.
+func (s *Store) migrateArchive(ctx context.Context, userJID string) error {
+	ids, err := s.rdb.ZRange(ctx, mamKey(userJID), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	msgs, err := s.archivedMessages(ctx, userJID, ids)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			index(ctx, pipe, msg)
 		}
+		pipe.Del(ctx, mamKey(userJID))
+		return nil
+	})
+	return err
+}
 
-		data, err := s.rdb.Get(ctx, mamMsgKey(query.UserJID, id)).Result()
-		if err == redis.Nil {
+// archivedMessages returns the messages of the archive of userJID with the
+// given IDs, in the same order, skipping those that do not exist.
+func (s *Store) archivedMessages(ctx context.Context, userJID string, ids []string) ([]*storage.ArchivedMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = mamMsgKey(userJID, id)
+	}
+	vals, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*storage.ArchivedMessage, 0, len(vals))
+	for _, v := range vals {
+		data, ok := v.(string)
+		if !ok {
 			continue
 		}
-		if err != nil {
-			return nil, err
-		}
-
 		var msg storage.ArchivedMessage
 		if err := unmarshal(data, &msg); err != nil {
 			return nil, err
 		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
 
-		if query.WithJID != "" && msg.WithJID != query.WithJID {
-			continue
+// anchorKey returns the index key of message id in the archive of userJID.
+func (s *Store) anchorKey(ctx context.Context, userJID, id string) (string, error) {
+	msg, err := s.GetArchivedMessage(ctx, userJID, id)
+	if err != nil {
+		return "", err
+	}
+	return storage.MessageKey(msg.CreatedAt, msg.ID), nil
+}
+
+func (s *Store) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
+	if err := s.migrateArchive(ctx, query.UserJID); err != nil {
+		return nil, err
+	}
+	idx := mamIdxKey(query.UserJID)
+	if query.WithJID != "" {
+		idx = mamWithKey(query.UserJID, query.WithJID)
+	}
+
+	// Lexicographic bounds of the filters; a bare time key sorts before
+	// every message key of that instant.
+	lo, hi := "-", "+"
+	if !query.Start.IsZero() {
+		lo = "[" + storage.MessageKey(query.Start, "")
+	}
+	if !query.End.IsZero() {
+		hi = "(" + storage.MessageKey(query.End.Add(time.Nanosecond), "")
+	}
+	pageLo, pageHi := lo, hi
+	if query.AfterID != "" {
+		key, err := s.anchorKey(ctx, query.UserJID, query.AfterID)
+		if err != nil {
+			return nil, err
 		}
-		if !query.Start.IsZero() && msg.CreatedAt.Before(query.Start) {
-			continue
+		if lo == "-" || key >= lo[1:] {
+			pageLo = "(" + key
 		}
-		if !query.End.IsZero() && msg.CreatedAt.After(query.End) {
-			continue
+	}
+	if query.BeforeID != "" {
+		key, err := s.anchorKey(ctx, query.UserJID, query.BeforeID)
+		if err != nil {
+			return nil, err
 		}
-
-		msgs = append(msgs, &msg)
-		if len(msgs) > max {
-			break
+		if hi == "+" || key < hi[1:] {
+			pageHi = "(" + key
 		}
 	}
 
-	complete := len(msgs) <= max
-	if len(msgs) > max {
-		msgs = msgs[:max]
+	max := query.Max
+	if max <= 0 {
+		max = storage.DefaultMAMPageSize
+	}
+
+	// Paging backwards reads the page before BeforeID, or the last page,
+	// from the end.
+	backward := (query.BeforeID != "" || query.Last) && query.AfterID == ""
+	rng := &redis.ZRangeBy{Min: pageLo, Max: pageHi, Count: int64(max + 1)}
+	var keys []string
+	var err error
+	if backward {
+		keys, err = s.rdb.ZRevRangeByLex(ctx, idx, rng).Result()
+		slices.Reverse(keys)
+	} else {
+		keys, err = s.rdb.ZRangeByLex(ctx, idx, rng).Result()
 	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = storage.MessageKeyID(key)
+	}
+	msgs, err := s.archivedMessages(ctx, query.UserJID, ids)
+	if err != nil {
+		return nil, err
+	}
+	result := storage.PageResult(msgs, query)
 
-	result := &storage.MAMResult{
-		Messages: msgs, Complete: complete, Count: len(msgs),
+	pipe := s.rdb.Pipeline()
+	count := pipe.ZLexCount(ctx, idx, lo, hi)
+	var before *redis.IntCmd
+	if result.First != "" {
+		i := slices.Index(ids, result.First)
+		before = pipe.ZLexCount(ctx, idx, lo, "("+keys[i])
 	}
-	if len(msgs) > 0 {
-		result.First = msgs[0].ID
-		result.Last = msgs[len(msgs)-1].ID
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	result.Count = int(count.Val())
+	if before != nil {
+		result.Index = int(before.Val())
 	}
 	return result, nil
 }
 
 func (s *Store) DeleteMessageArchive(ctx context.Context, userJID string) error {
-	ids, err := s.rdb.ZRange(ctx, mamKey(userJID), 0, -1).Result()
+	if err := s.migrateArchive(ctx, userJID); err != nil {
+		return err
+	}
+	keys, err := s.rdb.ZRange(ctx, mamIdxKey(userJID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	withs, err := s.rdb.SMembers(ctx, mamWithsKey(userJID)).Result()
 	if err != nil {
 		return err
 	}
 	pipe := s.rdb.Pipeline()
-	for _, id := range ids {
-		pipe.Del(ctx, mamMsgKey(userJID, id))
+	for _, key := range keys {
+		pipe.Del(ctx, mamMsgKey(userJID, storage.MessageKeyID(key)))
+	}
+	for _, with := range withs {
+		pipe.Del(ctx, mamWithKey(userJID, with))
 	}
-	pipe.Del(ctx, mamKey(userJID))
+	pipe.Del(ctx, mamIdxKey(userJID), mamWithsKey(userJID))
 	_, err = pipe.Exec(ctx)
 	return err
 }
 
+// DeleteMessagesBefore removes the messages whose keys sort before the
+// first key at the given time from the archive and its indexes.
+func (s *Store) DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (int, error) {
+	if err := s.migrateArchive(ctx, userJID); err != nil {
+		return 0, err
+	}
+	bound := "(" + storage.MessageKey(before, "")
+	keys, err := s.rdb.ZRangeByLex(ctx, mamIdxKey(userJID), &redis.ZRangeBy{Min: "-", Max: bound}).Result()
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	withs, err := s.rdb.SMembers(ctx, mamWithsKey(userJID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, mamMsgKey(userJID, storage.MessageKeyID(key)))
+		}
+		pipe.ZRemRangeByLex(ctx, mamIdxKey(userJID), "-", bound)
+		for _, with := range withs {
+			pipe.ZRemRangeByLex(ctx, mamWithKey(userJID, with), "-", bound)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (s *Store) GetArchivedMessage(ctx context.Context, userJID, id string) (*storage.ArchivedMessage, error) {
+	data, err := s.rdb.Get(ctx, mamMsgKey(userJID, id)).Result()
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg storage.ArchivedMessage
+	if err := unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// UpdateArchivedMessage rewrites the stored message; the indexes only hold
+// its key, which does not change.
+func (s *Store) UpdateArchivedMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
+	stored, err := s.GetArchivedMessage(ctx, msg.UserJID, msg.ID)
+	if err != nil {
+		return err
+	}
+	stored.Data = msg.Data
+	ok, err := s.rdb.SetXX(ctx, mamMsgKey(msg.UserJID, msg.ID), marshal(stored), redis.KeepTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) GetMAMPrefs(ctx context.Context, userJID string) (*storage.MAMPrefs, error) {
+	data, err := s.rdb.Get(ctx, mamPrefsKey(userJID)).Result()
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var prefs storage.MAMPrefs
+	if err := unmarshal(data, &prefs); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+func (s *Store) SetMAMPrefs(ctx context.Context, prefs *storage.MAMPrefs) error {
+	return s.rdb.Set(ctx, mamPrefsKey(prefs.UserJID), marshal(prefs), 0).Err()
+}
+
+func (s *Store) DeleteMAMPrefs(ctx context.Context, userJID string) error {
+	return s.rdb.Del(ctx, mamPrefsKey(userJID)).Err()
+}
+
 // --- MUCRoomStore ---
 
 func (s *Store) CreateRoom(ctx context.Context, room *storage.MUCRoom) error {
@@ -721,3 +983,194 @@ func (s *Store) DeleteBookmark(ctx context.Context, userJID, roomJID string) err
 	return nil
 }
 
+// --- PushStore ---
+
+// pushField keys a registration in the user's push hash; a JID never
+// contains a space.
+func pushField(jid, node string) string { return jid + " " + node }
+
+func (s *Store) SetPushRegistration(ctx context.Context, reg *storage.PushRegistration) error {
+	return s.rdb.HSet(ctx, pushKey(reg.UserJID), pushField(reg.JID, reg.Node), marshal(reg)).Err()
+}
+
+func (s *Store) GetPushRegistrations(ctx context.Context, userJID string) ([]*storage.PushRegistration, error) {
+	data, err := s.rdb.HGetAll(ctx, pushKey(userJID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	regs := make([]*storage.PushRegistration, 0, len(data))
+	for _, v := range data {
+		var reg storage.PushRegistration
+		if err := unmarshal(v, &reg); err != nil {
+			return nil, err
+		}
+		regs = append(regs, &reg)
+	}
+	return regs, nil
+}
+
+func (s *Store) DeletePushRegistrations(ctx context.Context, userJID, jid, node string) error {
+	if node != "" {
+		return s.rdb.HDel(ctx, pushKey(userJID), pushField(jid, node)).Err()
+	}
+	fields, err := s.rdb.HKeys(ctx, pushKey(userJID)).Result()
+	if err != nil {
+		return err
+	}
+	var del []string
+	for _, f := range fields {
+		if strings.HasPrefix(f, jid+" ") {
+			del = append(del, f)
+		}
+	}
+	if len(del) == 0 {
+		return nil
+	}
+	return s.rdb.HDel(ctx, pushKey(userJID), del...).Err()
+}
+
+// --- CapsStore ---
+
+func (s *Store) SetCapsInfo(ctx context.Context, ver string, info []byte) error {
+	return s.rdb.Set(ctx, capsKey(ver), info, 0).Err()
+}
+
+func (s *Store) GetCapsInfo(ctx context.Context, ver string) ([]byte, error) {
+	info, err := s.rdb.Get(ctx, capsKey(ver)).Bytes()
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+	return info, err
+}
+
+// --- SharedGroupStore ---
+
+// Shared groups are a hash of names to display names, with a set of members
+// per group and a set of groups per member.
+
+func (s *Store) SetSharedGroup(ctx context.Context, group *storage.SharedGroup) error {
+	old, err := s.rdb.SMembers(ctx, sharedGroupKey(group.Name)).Result()
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sharedGroupsKey(), group.Name, group.Display)
+		pipe.Del(ctx, sharedGroupKey(group.Name))
+		for _, member := range old {
+			pipe.SRem(ctx, memberGroupsKey(member), group.Name)
+		}
+		for _, member := range group.Members {
+			pipe.SAdd(ctx, sharedGroupKey(group.Name), member)
+			pipe.SAdd(ctx, memberGroupsKey(member), group.Name)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *Store) GetSharedGroup(ctx context.Context, name string) (*storage.SharedGroup, error) {
+	display, err := s.rdb.HGet(ctx, sharedGroupsKey(), name).Result()
+	if err == redis.Nil {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.rdb.SMembers(ctx, sharedGroupKey(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(members)
+	return &storage.SharedGroup{Name: name, Display: display, Members: members}, nil
+}
+
+func (s *Store) ListSharedGroups(ctx context.Context) ([]*storage.SharedGroup, error) {
+	names, err := s.rdb.HKeys(ctx, sharedGroupsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.sharedGroups(ctx, names)
+}
+
+func (s *Store) DeleteSharedGroup(ctx context.Context, name string) error {
+	members, err := s.rdb.SMembers(ctx, sharedGroupKey(name)).Result()
+	if err != nil {
+		return err
+	}
+	n, err := s.rdb.HDel(ctx, sharedGroupsKey(), name).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sharedGroupKey(name))
+		for _, member := range members {
+			pipe.SRem(ctx, memberGroupsKey(member), name)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *Store) AddSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	if err := s.sharedGroupExists(ctx, name); err != nil {
+		return err
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, sharedGroupKey(name), memberJID)
+		pipe.SAdd(ctx, memberGroupsKey(memberJID), name)
+		return nil
+	})
+	return err
+}
+
+func (s *Store) RemoveSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	if err := s.sharedGroupExists(ctx, name); err != nil {
+		return err
+	}
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, sharedGroupKey(name), memberJID)
+		pipe.SRem(ctx, memberGroupsKey(memberJID), name)
+		return nil
+	})
+	return err
+}
+
+func (s *Store) GetMemberSharedGroups(ctx context.Context, memberJID string) ([]*storage.SharedGroup, error) {
+	names, err := s.rdb.SMembers(ctx, memberGroupsKey(memberJID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.sharedGroups(ctx, names)
+}
+
+func (s *Store) sharedGroupExists(ctx context.Context, name string) error {
+	ok, err := s.rdb.HExists(ctx, sharedGroupsKey(), name).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// sharedGroups retrieves the named groups in ascending order of name,
+// skipping groups deleted meanwhile.
+func (s *Store) sharedGroups(ctx context.Context, names []string) ([]*storage.SharedGroup, error) {
+	slices.Sort(names)
+	var groups []*storage.SharedGroup
+	for _, name := range names {
+		g, err := s.GetSharedGroup(ctx, name)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
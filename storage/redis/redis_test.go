@@ -25,3 +25,16 @@ func TestRedisStorage(t *testing.T) {
 		})
 	})
 }
+
+func BenchmarkRedisStorage(b *testing.B) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		b.Skip("REDIS_ADDR not set; skipping integration benchmark")
+	}
+
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		return redis.New(&goredis.Options{
+			Addr: addr,
+		})
+	})
+}
@@ -17,6 +17,11 @@ type RosterStore interface {
 	// UpsertRosterItem adds or updates a roster item.
 	UpsertRosterItem(ctx context.Context, item *RosterItem) error
 
+	// UpsertRosterItems adds or updates several roster items, of one or
+	// more users, in one operation. Backends with transactions write all
+	// of them or, on error, none.
+	UpsertRosterItems(ctx context.Context, items []*RosterItem) error
+
 	// GetRosterItem retrieves a single roster item.
 	GetRosterItem(ctx context.Context, userJID, contactJID string) (*RosterItem, error)
 
@@ -32,3 +37,11 @@ type RosterStore interface {
 	// SetRosterVersion sets the roster version for a user.
 	SetRosterVersion(ctx context.Context, userJID, version string) error
 }
+
+// RosterReplacer is an optional interface for roster stores that can replace a
+// user's whole roster and set its version in one atomic operation.
+type RosterReplacer interface {
+	// ReplaceRosterItems replaces all roster items of userJID with items and
+	// sets the roster version.
+	ReplaceRosterItems(ctx context.Context, userJID string, items []*RosterItem, version string) error
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrRosterLimit is returned when adding a contact would grow a roster past
+// the limit set with LimitRosterItems.
+var ErrRosterLimit = errors.New("storage: roster item limit reached")
+
+// LimitRosterItems returns a view of s whose RosterStore holds at most max
+// items per user. Upserting a contact that is not yet in a full roster, or
+// replacing a roster with more than max items, fails with ErrRosterLimit;
+// existing items can still be updated and deleted. A max of zero or less
+// returns s unchanged.
+func LimitRosterItems(s Storage, max int) Storage {
+	if max <= 0 {
+		return s
+	}
+	return &rosterLimited{Storage: s, max: max}
+}
+
+type rosterLimited struct {
+	Storage
+	max int
+	// mu serializes the count and the write so that concurrent adds in
+	// this process cannot cross the limit together.
+	mu sync.Mutex
+}
+
+func (l *rosterLimited) RosterStore() RosterStore {
+	rs := l.Storage.RosterStore()
+	if rs == nil {
+		return nil
+	}
+	if rr, ok := rs.(RosterReplacer); ok {
+		return &limitedRosterReplacer{limitedRosterStore{rs, l}, rr}
+	}
+	return &limitedRosterStore{rs, l}
+}
+
+type limitedRosterStore struct {
+	RosterStore
+	l *rosterLimited
+}
+
+func (r *limitedRosterStore) UpsertRosterItem(ctx context.Context, item *RosterItem) error {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	items, err := r.RosterStore.GetRosterItems(ctx, item.UserJID)
+	if err != nil {
+		return err
+	}
+	if len(items) >= r.l.max && !containsContact(items, item.ContactJID) {
+		return ErrRosterLimit
+	}
+	return r.RosterStore.UpsertRosterItem(ctx, item)
+}
+
+// UpsertRosterItems fails with ErrRosterLimit, writing nothing, if the
+// items would grow any of the rosters they belong to past the limit.
+func (r *limitedRosterStore) UpsertRosterItems(ctx context.Context, items []*RosterItem) error {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	added := make(map[string]map[string]bool) // userJID -> new contacts
+	for _, item := range items {
+		if added[item.UserJID] == nil {
+			added[item.UserJID] = make(map[string]bool)
+		}
+		added[item.UserJID][item.ContactJID] = true
+	}
+	for userJID, contacts := range added {
+		existing, err := r.RosterStore.GetRosterItems(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		for _, item := range existing {
+			delete(contacts, item.ContactJID)
+		}
+		if len(contacts) > 0 && len(existing)+len(contacts) > r.l.max {
+			return ErrRosterLimit
+		}
+	}
+	return r.RosterStore.UpsertRosterItems(ctx, items)
+}
+
+type limitedRosterReplacer struct {
+	limitedRosterStore
+	rr RosterReplacer
+}
+
+func (r *limitedRosterReplacer) ReplaceRosterItems(ctx context.Context, userJID string, items []*RosterItem, version string) error {
+	if len(items) > r.l.max {
+		return ErrRosterLimit
+	}
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	return r.rr.ReplaceRosterItems(ctx, userJID, items, version)
+}
+
+func containsContact(items []*RosterItem, contactJID string) bool {
+	for _, item := range items {
+		if item.ContactJID == contactJID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package storage
+
+import "context"
+
+// SharedGroup is a shared roster group: its members have each other in
+// their rosters, subscribed both ways, without ever sending a subscription
+// request.
+type SharedGroup struct {
+	Name string
+	// Display is the roster group members see each other in; Name when
+	// empty.
+	Display string
+	// Members are the bare JIDs of the members, in ascending order.
+	Members []string
+}
+
+// RosterGroup returns the roster group the members of g appear in.
+func (g *SharedGroup) RosterGroup() string {
+	if g.Display != "" {
+		return g.Display
+	}
+	return g.Name
+}
+
+// SharedGroupStore manages shared roster groups.
+type SharedGroupStore interface {
+	// SetSharedGroup creates a group or replaces its display name and
+	// members.
+	SetSharedGroup(ctx context.Context, group *SharedGroup) error
+
+	// GetSharedGroup retrieves a group. Returns ErrNotFound if there is
+	// none.
+	GetSharedGroup(ctx context.Context, name string) (*SharedGroup, error)
+
+	// ListSharedGroups retrieves all groups in ascending order of name.
+	ListSharedGroups(ctx context.Context) ([]*SharedGroup, error)
+
+	// DeleteSharedGroup removes a group. Returns ErrNotFound if there is
+	// none.
+	DeleteSharedGroup(ctx context.Context, name string) error
+
+	// AddSharedGroupMember adds memberJID to a group. Returns ErrNotFound
+	// if there is no such group.
+	AddSharedGroupMember(ctx context.Context, name, memberJID string) error
+
+	// RemoveSharedGroupMember removes memberJID from a group. Removing a
+	// member that is not in it is not an error. Returns ErrNotFound if
+	// there is no such group.
+	RemoveSharedGroupMember(ctx context.Context, name, memberJID string) error
+
+	// GetMemberSharedGroups retrieves the groups memberJID belongs to, in
+	// ascending order of name.
+	GetMemberSharedGroups(ctx context.Context, memberJID string) ([]*SharedGroup, error)
+}
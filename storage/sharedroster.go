@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ShareRosterGroups returns a view of s whose RosterStore adds the other
+// members of a user's shared groups to the user's roster, subscribed both
+// ways and in the roster group of each group they share. Writes go to s:
+// a shared contact can be renamed or put in more groups, and keeps its
+// shared groups and subscription. If s has no SharedGroupStore, s is
+// returned unchanged.
+//
+// The roster version of a user in shared groups is mixed with a digest of
+// the shared contacts, so that it changes with the groups. It stays a
+// number, which the roster plugin increments on every change.
+func ShareRosterGroups(s Storage) Storage {
+	if s.SharedGroupStore() == nil {
+		return s
+	}
+	return &rosterShared{s}
+}
+
+type rosterShared struct {
+	Storage
+}
+
+func (r *rosterShared) RosterStore() RosterStore {
+	rs := r.Storage.RosterStore()
+	if rs == nil {
+		return nil
+	}
+	if rr, ok := rs.(RosterReplacer); ok {
+		return &sharedRosterReplacer{sharedRosterStore{rs, r.Storage.SharedGroupStore()}, rr}
+	}
+	return &sharedRosterStore{rs, r.Storage.SharedGroupStore()}
+}
+
+type sharedRosterStore struct {
+	RosterStore
+	groups SharedGroupStore
+}
+
+type sharedRosterReplacer struct {
+	sharedRosterStore
+	rr RosterReplacer
+}
+
+func (r *sharedRosterReplacer) ReplaceRosterItems(ctx context.Context, userJID string, items []*RosterItem, version string) error {
+	return r.rr.ReplaceRosterItems(ctx, userJID, items, version)
+}
+
+// sharedContacts returns the other members of the shared groups of userJID
+// with the roster groups they share.
+func (r *sharedRosterStore) sharedContacts(ctx context.Context, userJID string) (map[string][]string, error) {
+	groups, err := r.groups.GetMemberSharedGroups(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[string][]string)
+	for _, g := range groups {
+		for _, member := range g.Members {
+			if member != userJID && !slices.Contains(contacts[member], g.RosterGroup()) {
+				contacts[member] = append(contacts[member], g.RosterGroup())
+			}
+		}
+	}
+	return contacts, nil
+}
+
+func (r *sharedRosterStore) GetRosterItems(ctx context.Context, userJID string) ([]*RosterItem, error) {
+	items, err := r.RosterStore.GetRosterItems(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := r.sharedContacts(ctx, userJID)
+	if err != nil {
+		return nil, err
+	}
+	return addSharedContacts(userJID, items, contacts), nil
+}
+
+func (r *sharedRosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (*RosterItem, error) {
+	item, err := r.RosterStore.GetRosterItem(ctx, userJID, contactJID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	contacts, cerr := r.sharedContacts(ctx, userJID)
+	if cerr != nil {
+		return nil, cerr
+	}
+	groups, ok := contacts[contactJID]
+	if !ok {
+		return item, err
+	}
+	var items []*RosterItem
+	if item != nil {
+		items = append(items, item)
+	}
+	return addSharedContacts(userJID, items, map[string][]string{contactJID: groups})[0], nil
+}
+
+func (r *sharedRosterStore) GetRosterVersion(ctx context.Context, userJID string) (string, error) {
+	ver, err := r.RosterStore.GetRosterVersion(ctx, userJID)
+	if err != nil {
+		return "", err
+	}
+	contacts, err := r.sharedContacts(ctx, userJID)
+	if err != nil || len(contacts) == 0 {
+		return ver, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ver))
+	for _, contact := range slices.Sorted(maps.Keys(contacts)) {
+		h.Write([]byte("\x00" + contact + "\x00" + strings.Join(contacts[contact], "\x00")))
+	}
+	return strconv.FormatUint(h.Sum64()>>1, 10), nil
+}
+
+// addSharedContacts adds contacts, by JID with their roster groups, to the
+// stored items of userJID. Stored items of shared contacts keep their name
+// and groups, gain the shared ones and are subscribed both ways.
+func addSharedContacts(userJID string, items []*RosterItem, contacts map[string][]string) []*RosterItem {
+	out := make([]*RosterItem, 0, len(items)+len(contacts))
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if groups, ok := contacts[item.ContactJID]; ok {
+			cp := *item
+			cp.Subscription, cp.Ask = "both", ""
+			cp.Groups = slices.Clone(item.Groups)
+			for _, g := range groups {
+				if !slices.Contains(cp.Groups, g) {
+					cp.Groups = append(cp.Groups, g)
+				}
+			}
+			item = &cp
+		}
+		seen[item.ContactJID] = true
+		out = append(out, item)
+	}
+	for _, contact := range slices.Sorted(maps.Keys(contacts)) {
+		if !seen[contact] {
+			out = append(out, &RosterItem{
+				UserJID:      userJID,
+				ContactJID:   contact,
+				Subscription: "both",
+				Groups:       contacts[contact],
+			})
+		}
+	}
+	return out
+}
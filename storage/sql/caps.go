@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+type capsStore struct{ s *Store }
+
+func (c *capsStore) SetCapsInfo(ctx context.Context, ver string, info []byte) error {
+	q := "INSERT INTO caps_info (ver, info) VALUES (" + c.s.phs(1, 2) + ") " +
+		c.s.dialect.UpsertSuffix([]string{"ver"}, []string{"info"})
+	_, err := c.s.db.ExecContext(ctx, q, ver, info)
+	return err
+}
+
+func (c *capsStore) GetCapsInfo(ctx context.Context, ver string) ([]byte, error) {
+	var info []byte
+	err := c.s.db.QueryRowContext(ctx,
+		"SELECT info FROM caps_info WHERE ver = "+c.s.ph(1), ver,
+	).Scan(&info)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
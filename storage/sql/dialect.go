@@ -1,5 +1,7 @@
 package sql
 
+import "github.com/meszmate/xmpp-go/storage/sql/migrations"
+
 // Dialect abstracts database-specific SQL differences.
 type Dialect interface {
 	// Name returns the dialect name (e.g. "sqlite", "postgres", "mysql").
@@ -12,8 +14,10 @@ type Dialect interface {
 	// AutoIncrement returns the column type for an auto-incrementing primary key.
 	AutoIncrement() string
 
-	// Migrations returns the SQL migration statements for this dialect.
-	Migrations() []string
+	// Migrations returns the schema migrations for this dialect, numbered
+	// from 1. Released migrations must never change; schema changes are
+	// appended as new ones.
+	Migrations() []migrations.Migration
 
 	// UpsertSuffix returns the dialect-specific upsert clause.
 	// For SQLite: "ON CONFLICT(...) DO UPDATE SET ..."
@@ -2,7 +2,11 @@ package sql
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/meszmate/xmpp-go/storage"
@@ -11,54 +15,72 @@ import (
 type mamStore struct{ s *Store }
 
 func (m *mamStore) ArchiveMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
-	createdAt := msg.CreatedAt
-	if createdAt.IsZero() {
-		createdAt = time.Now()
-	}
-	_, err := m.s.db.ExecContext(ctx,
-		"INSERT INTO mam_messages (id, user_jid, with_jid, from_jid, data, created_at) VALUES ("+m.s.phs(1, 6)+")",
-		msg.ID, msg.UserJID, msg.WithJID, msg.FromJID, msg.Data, createdAt,
-	)
+	_, err := m.s.db.ExecContext(ctx, m.insertQuery(), archiveArgs(msg)...)
 	return err
 }
 
-func (m *mamStore) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
-	where := "WHERE user_jid = " + m.s.ph(1)
-	args := []any{query.UserJID}
-	n := 2
-
-	if query.WithJID != "" {
-		where += " AND with_jid = " + m.s.ph(n)
-		args = append(args, query.WithJID)
-		n++
+func (m *mamStore) ArchiveMessages(ctx context.Context, msgs []*storage.ArchivedMessage) error {
+	if len(msgs) == 0 {
+		return nil
 	}
-	if !query.Start.IsZero() {
-		where += " AND created_at >= " + m.s.ph(n)
-		args = append(args, query.Start)
-		n++
+	tx, err := m.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	if !query.End.IsZero() {
-		where += " AND created_at <= " + m.s.ph(n)
-		args = append(args, query.End)
-		n++
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, m.insertQuery())
+	if err != nil {
+		return err
 	}
-	if query.AfterID != "" {
-		where += " AND id > " + m.s.ph(n)
-		args = append(args, query.AfterID)
-		n++
+	defer stmt.Close()
+	for _, msg := range msgs {
+		if _, err := stmt.ExecContext(ctx, archiveArgs(msg)...); err != nil {
+			return err
+		}
 	}
-	if query.BeforeID != "" {
-		where += " AND id < " + m.s.ph(n)
-		args = append(args, query.BeforeID)
-		n++
+	return tx.Commit()
+}
+
+func (m *mamStore) insertQuery() string {
+	return "INSERT INTO mam_messages (id, user_jid, with_jid, from_jid, data, created_at) VALUES (" + m.s.phs(1, 6) + ")"
+}
+
+func archiveArgs(msg *storage.ArchivedMessage) []any {
+	createdAt := msg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	return []any{msg.ID, msg.UserJID, msg.WithJID, msg.FromJID, msg.Data, createdAt}
+}
+
+func (m *mamStore) QueryMessages(ctx context.Context, query *storage.MAMQuery) (*storage.MAMResult, error) {
+	where, args := m.filter(1, query)
+	for _, a := range []struct{ id, op string }{{query.AfterID, ">"}, {query.BeforeID, "<"}} {
+		if a.id == "" {
+			continue
+		}
+		if err := m.checkAnchor(ctx, query.UserJID, a.id); err != nil {
+			return nil, err
+		}
+		cond, condArgs := m.anchorCond(len(args)+1, a.op, query.UserJID, a.id)
+		where += " AND " + cond
+		args = append(args, condArgs...)
 	}
 
 	max := query.Max
 	if max <= 0 {
-		max = 100
+		max = storage.DefaultMAMPageSize
 	}
 
-	q := fmt.Sprintf("SELECT id, user_jid, with_jid, from_jid, data, created_at FROM mam_messages %s ORDER BY created_at ASC LIMIT %d", where, max+1)
+	// Paging backwards reads the page before BeforeID, or the last page,
+	// from the end.
+	backward := (query.BeforeID != "" || query.Last) && query.AfterID == ""
+	order := "created_at ASC, id ASC"
+	if backward {
+		order = "created_at DESC, id DESC"
+	}
+	q := fmt.Sprintf("SELECT id, user_jid, with_jid, from_jid, data, created_at FROM mam_messages WHERE %s ORDER BY %s LIMIT %d", where, order, max+1)
 	rows, err := m.s.db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
@@ -76,25 +98,152 @@ func (m *mamStore) QueryMessages(ctx context.Context, query *storage.MAMQuery) (
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-
-	complete := len(msgs) <= max
-	if len(msgs) > max {
-		msgs = msgs[:max]
+	if backward {
+		slices.Reverse(msgs)
 	}
+	result := storage.PageResult(msgs, query)
 
-	result := &storage.MAMResult{
-		Messages: msgs,
-		Complete: complete,
-		Count:    len(msgs),
+	// Count the messages matching the filters, and those before the page,
+	// in one statement.
+	before, args := "0", nil
+	if result.First != "" {
+		var cond string
+		cond, args = m.anchorCond(1, "<", query.UserJID, result.First)
+		before = "CASE WHEN " + cond + " THEN 1 ELSE 0 END"
 	}
-	if len(msgs) > 0 {
-		result.First = msgs[0].ID
-		result.Last = msgs[len(msgs)-1].ID
+	where, filterArgs := m.filter(len(args)+1, query)
+	q = fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(%s), 0) FROM mam_messages WHERE %s", before, where)
+	if err := m.s.db.QueryRowContext(ctx, q, append(args, filterArgs...)...).Scan(&result.Count, &result.Index); err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
+// filter returns the condition selecting the messages query filters on,
+// ignoring its anchors, with placeholders numbered from n.
+func (m *mamStore) filter(n int, query *storage.MAMQuery) (string, []any) {
+	where := "user_jid = " + m.s.ph(n)
+	args := []any{query.UserJID}
+	if query.WithJID != "" {
+		where += " AND with_jid = " + m.s.ph(n+len(args))
+		args = append(args, query.WithJID)
+	}
+	if !query.Start.IsZero() {
+		where += " AND created_at >= " + m.s.ph(n+len(args))
+		args = append(args, query.Start)
+	}
+	if !query.End.IsZero() {
+		where += " AND created_at <= " + m.s.ph(n+len(args))
+		args = append(args, query.End)
+	}
+	return where, args
+}
+
+// anchorCond returns the condition selecting the messages that come after
+// (op ">") or before (op "<") message id in archive order, with
+// placeholders numbered from n.
+func (m *mamStore) anchorCond(n int, op, userJID, id string) (string, []any) {
+	anchor := "SELECT created_at FROM mam_messages WHERE user_jid = " + m.s.ph(n) + " AND id = " + m.s.ph(n+1)
+	cond := fmt.Sprintf("(created_at %s (%s) OR (created_at = (SELECT created_at FROM mam_messages WHERE user_jid = %s AND id = %s) AND id %s %s))",
+		op, anchor, m.s.ph(n+2), m.s.ph(n+3), op, m.s.ph(n+4))
+	return cond, []any{userJID, id, userJID, id, id}
+}
+
+// checkAnchor returns storage.ErrNotFound if id is not in the archive of
+// userJID.
+func (m *mamStore) checkAnchor(ctx context.Context, userJID, id string) error {
+	var count int
+	err := m.s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM mam_messages WHERE user_jid = "+m.s.ph(1)+" AND id = "+m.s.ph(2),
+		userJID, id,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
 func (m *mamStore) DeleteMessageArchive(ctx context.Context, userJID string) error {
 	_, err := m.s.db.ExecContext(ctx, "DELETE FROM mam_messages WHERE user_jid = "+m.s.ph(1), userJID)
 	return err
 }
+
+func (m *mamStore) DeleteMessagesBefore(ctx context.Context, userJID string, before time.Time) (int, error) {
+	res, err := m.s.db.ExecContext(ctx,
+		"DELETE FROM mam_messages WHERE user_jid = "+m.s.ph(1)+" AND created_at < "+m.s.ph(2),
+		userJID, before,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *mamStore) GetArchivedMessage(ctx context.Context, userJID, id string) (*storage.ArchivedMessage, error) {
+	var msg storage.ArchivedMessage
+	err := m.s.db.QueryRowContext(ctx,
+		"SELECT id, user_jid, with_jid, from_jid, data, created_at FROM mam_messages WHERE user_jid = "+m.s.ph(1)+" AND id = "+m.s.ph(2),
+		userJID, id,
+	).Scan(&msg.ID, &msg.UserJID, &msg.WithJID, &msg.FromJID, &msg.Data, &msg.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (m *mamStore) UpdateArchivedMessage(ctx context.Context, msg *storage.ArchivedMessage) error {
+	res, err := m.s.db.ExecContext(ctx,
+		"UPDATE mam_messages SET data = "+m.s.ph(1)+" WHERE user_jid = "+m.s.ph(2)+" AND id = "+m.s.ph(3),
+		msg.Data, msg.UserJID, msg.ID,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (m *mamStore) GetMAMPrefs(ctx context.Context, userJID string) (*storage.MAMPrefs, error) {
+	prefs := &storage.MAMPrefs{UserJID: userJID}
+	var always, never string
+	err := m.s.db.QueryRowContext(ctx,
+		"SELECT default_mode, always_list, never_list FROM mam_prefs WHERE user_jid = "+m.s.ph(1), userJID,
+	).Scan(&prefs.Default, &always, &never)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if always != "" {
+		prefs.Always = strings.Split(always, "\n")
+	}
+	if never != "" {
+		prefs.Never = strings.Split(never, "\n")
+	}
+	return prefs, nil
+}
+
+func (m *mamStore) SetMAMPrefs(ctx context.Context, prefs *storage.MAMPrefs) error {
+	q := "INSERT INTO mam_prefs (user_jid, default_mode, always_list, never_list) VALUES (" + m.s.phs(1, 4) + ") " +
+		m.s.dialect.UpsertSuffix([]string{"user_jid"}, []string{"default_mode", "always_list", "never_list"})
+	_, err := m.s.db.ExecContext(ctx, q,
+		prefs.UserJID, prefs.Default, strings.Join(prefs.Always, "\n"), strings.Join(prefs.Never, "\n"),
+	)
+	return err
+}
+
+func (m *mamStore) DeleteMAMPrefs(ctx context.Context, userJID string) error {
+	_, err := m.s.db.ExecContext(ctx, "DELETE FROM mam_prefs WHERE user_jid = "+m.s.ph(1), userJID)
+	return err
+}
@@ -0,0 +1,331 @@
+// Package migrations applies and reverts versioned schema changes to a SQL
+// database.
+//
+// Each migration has a version, numbered from 1 without gaps, an Up step that
+// applies it and a Down step that reverts it. Applied versions are recorded in
+// the schema_version table, so a database is only ever moved forward by the
+// steps it has not run yet, and a build refuses to touch a schema newer than
+// the migrations it knows.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Table is the table applied versions are recorded in.
+const Table = "schema_version"
+
+// legacyTable is where versions were recorded before Table existed. Its
+// versions are adopted and the table dropped the first time a Migrator
+// applies migrations.
+const legacyTable = "xmpp_migrations"
+
+// ErrPending reports a schema behind the migrations of the build, when it
+// is checked rather than migrated.
+var ErrPending = errors.New("migrations: schema is out of date")
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the change and Down reverts it. Each may hold several
+	// statements if the driver runs them in one Exec. A migration without
+	// Down cannot be reverted.
+	Up   string
+	Down string
+}
+
+// Dialect is the part of a SQL dialect the migrator needs.
+type Dialect interface {
+	Placeholder(n int) string
+	TimestampType() string
+	Now() string
+}
+
+// Applied is a migration recorded in the schema_version table.
+type Applied struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migrator moves a database between schema versions.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+	dryRun     bool
+}
+
+// New returns a Migrator applying migrations to db.
+func New(db *sql.DB, dialect Dialect, migrations []Migration) *Migrator {
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}
+}
+
+// SetDryRun makes Up and Down report the migrations they would run without
+// changing the database.
+func (m *Migrator) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+// Latest returns the version the migrations bring a database to.
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Applied returns the migrations recorded in the database, oldest first.
+// It does not change the database.
+func (m *Migrator) Applied(ctx context.Context) ([]Applied, error) {
+	applied, err := m.read(ctx, Table, true)
+	if err != nil {
+		return nil, err
+	}
+	// Versions still in the legacy table count as applied.
+	legacy, err := m.read(ctx, legacyTable, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range legacy {
+		if !containsVersion(applied, a.Version) {
+			applied = append(applied, a)
+		}
+	}
+	slices.SortFunc(applied, func(a, b Applied) int { return a.Version - b.Version })
+	return applied, nil
+}
+
+// Version returns the highest applied version, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.Applied(ctx)
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// Pending returns the migrations not applied yet, oldest first. It does not
+// change the database.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkKnown(applied); err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if !containsVersion(applied, mig.Version) {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies the pending migrations in order, each in its own transaction,
+// and returns them. It stops at the first that fails; the ones before it
+// stay applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	pending, err := m.Pending(ctx)
+	if err != nil || m.dryRun {
+		return pending, err
+	}
+	if err := m.prepare(ctx); err != nil {
+		return nil, err
+	}
+	for i, mig := range pending {
+		err := m.step(ctx, mig.Up,
+			"INSERT INTO "+Table+" (version, name) VALUES ("+m.dialect.Placeholder(1)+", "+m.dialect.Placeholder(2)+")",
+			mig.Version, mig.Name)
+		if err != nil {
+			return pending[:i], fmt.Errorf("migrations: apply %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// Down reverts the applied migrations above version, newest first, and
+// returns them. Nothing is reverted if any of them has no Down step.
+func (m *Migrator) Down(ctx context.Context, version int) ([]Migration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("migrations: invalid version %d", version)
+	}
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkKnown(applied); err != nil {
+		return nil, err
+	}
+	var revert []Migration
+	for _, mig := range slices.Backward(m.migrations) {
+		if mig.Version <= version || !containsVersion(applied, mig.Version) {
+			continue
+		}
+		if mig.Down == "" {
+			return nil, fmt.Errorf("migrations: %d (%s) cannot be reverted", mig.Version, mig.Name)
+		}
+		revert = append(revert, mig)
+	}
+	if m.dryRun || len(revert) == 0 {
+		return revert, nil
+	}
+	if err := m.prepare(ctx); err != nil {
+		return nil, err
+	}
+	for i, mig := range revert {
+		err := m.step(ctx, mig.Down, "DELETE FROM "+Table+" WHERE version = "+m.dialect.Placeholder(1), mig.Version)
+		if err != nil {
+			return revert[:i], fmt.Errorf("migrations: revert %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+	return revert, nil
+}
+
+// step runs stmt and the bookkeeping statement record in one transaction.
+func (m *Migrator) step(ctx context.Context, stmt, record string, args ...any) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepare creates the schema_version table and moves the versions of the
+// legacy table into it.
+func (m *Migrator) prepare(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+Table+` (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		applied_at `+m.dialect.TimestampType()+` NOT NULL DEFAULT (`+m.dialect.Now()+`)
+	)`)
+	if err != nil {
+		return fmt.Errorf("migrations: create %s: %w", Table, err)
+	}
+
+	legacy, err := m.read(ctx, legacyTable, false)
+	if err != nil || legacy == nil {
+		return err
+	}
+	applied, err := m.read(ctx, Table, true)
+	if err != nil {
+		return err
+	}
+	insert := "INSERT INTO " + Table + " (version, name, applied_at) VALUES (" +
+		m.dialect.Placeholder(1) + ", " + m.dialect.Placeholder(2) + ", " + m.dialect.Placeholder(3) + ")"
+	for _, a := range legacy {
+		if containsVersion(applied, a.Version) {
+			continue
+		}
+		if a.Version >= 1 && a.Version <= len(m.migrations) {
+			a.Name = m.migrations[a.Version-1].Name
+		}
+		if _, err := m.db.ExecContext(ctx, insert, a.Version, a.Name, a.AppliedAt); err != nil {
+			return fmt.Errorf("migrations: adopt version %d: %w", a.Version, err)
+		}
+	}
+	// Dropped only once every version is copied, so an interrupted
+	// adoption is picked up again by the next run.
+	if _, err := m.db.ExecContext(ctx, "DROP TABLE "+legacyTable); err != nil {
+		return fmt.Errorf("migrations: drop %s: %w", legacyTable, err)
+	}
+	return nil
+}
+
+// read returns the versions recorded in table, or nil if the table does
+// not exist.
+func (m *Migrator) read(ctx context.Context, table string, named bool) ([]Applied, error) {
+	columns := "version, '', applied_at"
+	if named {
+		columns = "version, name, applied_at"
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT "+columns+" FROM "+table)
+	if err != nil {
+		// There is no portable way to tell a missing table from other
+		// failures, but the others fail a ping as well.
+		if pingErr := m.db.PingContext(ctx); pingErr != nil {
+			return nil, fmt.Errorf("migrations: read %s: %w", table, err)
+		}
+		return nil, nil
+	}
+	defer rows.Close()
+
+	applied := []Applied{}
+	for rows.Next() {
+		var a Applied
+		var at any
+		if err := rows.Scan(&a.Version, &a.Name, &at); err != nil {
+			return nil, fmt.Errorf("migrations: read %s: %w", table, err)
+		}
+		a.AppliedAt = parseTime(at)
+		applied = append(applied, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("migrations: read %s: %w", table, err)
+	}
+	return applied, nil
+}
+
+// parseTime converts a timestamp column, which drivers return as a
+// time.Time or, for SQLite, as text.
+func parseTime(v any) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC()
+	case []byte:
+		return parseTime(string(v))
+	case string:
+		for _, layout := range []string{time.DateTime, time.RFC3339Nano} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// validate checks that the migrations are numbered from 1 without gaps.
+func (m *Migrator) validate() error {
+	for i, mig := range m.migrations {
+		if mig.Version != i+1 {
+			return fmt.Errorf("migrations: migration %d has version %d", i+1, mig.Version)
+		}
+		if mig.Up == "" {
+			return fmt.Errorf("migrations: %d (%s) has no up step", mig.Version, mig.Name)
+		}
+	}
+	return nil
+}
+
+// checkKnown refuses a database migrated by a newer build, whose schema
+// this one does not know how to use or revert.
+func (m *Migrator) checkKnown(applied []Applied) error {
+	if n := len(applied); n > 0 && applied[n-1].Version > len(m.migrations) {
+		return fmt.Errorf("migrations: schema version %d is newer than this build supports (%d)",
+			applied[n-1].Version, len(m.migrations))
+	}
+	return nil
+}
+
+func containsVersion(applied []Applied, version int) bool {
+	return slices.ContainsFunc(applied, func(a Applied) bool { return a.Version == version })
+}
@@ -2,6 +2,7 @@ package sql
 
 import (
 	"context"
+	"slices"
 	"time"
 
 	"github.com/meszmate/xmpp-go/storage"
@@ -47,6 +48,25 @@ func (o *offlineStore) DeleteOfflineMessages(ctx context.Context, userJID string
 	return err
 }
 
+// maxDeleteIDs bounds the IDs deleted by one statement, below the
+// placeholder limits of the databases.
+const maxDeleteIDs = 500
+
+func (o *offlineStore) DeleteOfflineMessagesByIDs(ctx context.Context, userJID string, ids []string) error {
+	for chunk := range slices.Chunk(ids, maxDeleteIDs) {
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, userJID)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		q := "DELETE FROM offline_messages WHERE user_jid = " + o.s.ph(1) + " AND id IN (" + o.s.phs(2, len(chunk)) + ")"
+		if _, err := o.s.db.ExecContext(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (o *offlineStore) CountOfflineMessages(ctx context.Context, userJID string) (int, error) {
 	var count int
 	err := o.s.db.QueryRowContext(ctx,
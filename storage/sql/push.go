@@ -0,0 +1,47 @@
+package sql
+
+import (
+	"context"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+type pushStore struct{ s *Store }
+
+func (p *pushStore) SetPushRegistration(ctx context.Context, reg *storage.PushRegistration) error {
+	q := "INSERT INTO push_registrations (user_jid, service_jid, node, options) VALUES (" + p.s.phs(1, 4) + ") " +
+		p.s.dialect.UpsertSuffix([]string{"user_jid", "service_jid", "node"}, []string{"options"})
+	_, err := p.s.db.ExecContext(ctx, q, reg.UserJID, reg.JID, reg.Node, reg.Options)
+	return err
+}
+
+func (p *pushStore) GetPushRegistrations(ctx context.Context, userJID string) ([]*storage.PushRegistration, error) {
+	rows, err := p.s.db.QueryContext(ctx,
+		"SELECT user_jid, service_jid, node, options FROM push_registrations WHERE user_jid = "+p.s.ph(1), userJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var regs []*storage.PushRegistration
+	for rows.Next() {
+		var reg storage.PushRegistration
+		if err := rows.Scan(&reg.UserJID, &reg.JID, &reg.Node, &reg.Options); err != nil {
+			return nil, err
+		}
+		regs = append(regs, &reg)
+	}
+	return regs, rows.Err()
+}
+
+func (p *pushStore) DeletePushRegistrations(ctx context.Context, userJID, jid, node string) error {
+	q := "DELETE FROM push_registrations WHERE user_jid = " + p.s.ph(1) + " AND service_jid = " + p.s.ph(2)
+	args := []any{userJID, jid}
+	if node != "" {
+		q += " AND node = " + p.s.ph(3)
+		args = append(args, node)
+	}
+	_, err := p.s.db.ExecContext(ctx, q, args...)
+	return err
+}
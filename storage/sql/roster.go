@@ -13,12 +13,39 @@ type rosterStore struct{ s *Store }
 
 func (r *rosterStore) UpsertRosterItem(ctx context.Context, item *storage.RosterItem) error {
 	groups := strings.Join(item.Groups, "\n")
-	q := "INSERT INTO roster_items (user_jid, contact_jid, name, subscription, ask, groups_list) VALUES (" + r.s.phs(1, 6) + ") " +
-		r.s.dialect.UpsertSuffix([]string{"user_jid", "contact_jid"}, []string{"name", "subscription", "ask", "groups_list"})
-	_, err := r.s.db.ExecContext(ctx, q, item.UserJID, item.ContactJID, item.Name, item.Subscription, item.Ask, groups)
+	_, err := r.s.db.ExecContext(ctx, r.upsertQuery(), item.UserJID, item.ContactJID, item.Name, item.Subscription, item.Ask, groups)
 	return err
 }
 
+func (r *rosterStore) UpsertRosterItems(ctx context.Context, items []*storage.RosterItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	tx, err := r.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, r.upsertQuery())
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, item := range items {
+		groups := strings.Join(item.Groups, "\n")
+		if _, err := stmt.ExecContext(ctx, item.UserJID, item.ContactJID, item.Name, item.Subscription, item.Ask, groups); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *rosterStore) upsertQuery() string {
+	return "INSERT INTO roster_items (user_jid, contact_jid, name, subscription, ask, groups_list) VALUES (" + r.s.phs(1, 6) + ") " +
+		r.s.dialect.UpsertSuffix([]string{"user_jid", "contact_jid"}, []string{"name", "subscription", "ask", "groups_list"})
+}
+
 func (r *rosterStore) GetRosterItem(ctx context.Context, userJID, contactJID string) (*storage.RosterItem, error) {
 	row := r.s.db.QueryRowContext(ctx,
 		"SELECT user_jid, contact_jid, name, subscription, ask, groups_list FROM roster_items WHERE user_jid = "+r.s.ph(1)+" AND contact_jid = "+r.s.ph(2),
@@ -88,6 +115,31 @@ func (r *rosterStore) SetRosterVersion(ctx context.Context, userJID, version str
 	return err
 }
 
+func (r *rosterStore) ReplaceRosterItems(ctx context.Context, userJID string, items []*storage.RosterItem, version string) error {
+	tx, err := r.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM roster_items WHERE user_jid = "+r.s.ph(1), userJID); err != nil {
+		return err
+	}
+	insert := "INSERT INTO roster_items (user_jid, contact_jid, name, subscription, ask, groups_list) VALUES (" + r.s.phs(1, 6) + ")"
+	for _, item := range items {
+		groups := strings.Join(item.Groups, "\n")
+		if _, err := tx.ExecContext(ctx, insert, userJID, item.ContactJID, item.Name, item.Subscription, item.Ask, groups); err != nil {
+			return err
+		}
+	}
+	q := "INSERT INTO roster_versions (user_jid, version) VALUES (" + r.s.phs(1, 2) + ") " +
+		r.s.dialect.UpsertSuffix([]string{"user_jid"}, []string{"version"})
+	if _, err := tx.ExecContext(ctx, q, userJID, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func scanRosterItem(row *sql.Row) (*storage.RosterItem, error) {
 	var item storage.RosterItem
 	var groups string
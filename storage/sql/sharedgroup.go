@@ -0,0 +1,143 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+type sharedGroupStore struct{ s *Store }
+
+func (g *sharedGroupStore) SetSharedGroup(ctx context.Context, group *storage.SharedGroup) error {
+	tx, err := g.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := "INSERT INTO shared_groups (name, display) VALUES (" + g.s.phs(1, 2) + ") " +
+		g.s.dialect.UpsertSuffix([]string{"name"}, []string{"display"})
+	if _, err := tx.ExecContext(ctx, q, group.Name, group.Display); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shared_group_members WHERE group_name = "+g.s.ph(1), group.Name); err != nil {
+		return err
+	}
+	insert := "INSERT INTO shared_group_members (group_name, member_jid) VALUES (" + g.s.phs(1, 2) + ") " +
+		g.s.dialect.UpsertSuffix([]string{"group_name", "member_jid"}, nil)
+	for _, member := range group.Members {
+		if _, err := tx.ExecContext(ctx, insert, group.Name, member); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (g *sharedGroupStore) GetSharedGroup(ctx context.Context, name string) (*storage.SharedGroup, error) {
+	groups, err := g.query(ctx,
+		"SELECT g.name, g.display, m.member_jid FROM shared_groups g "+
+			"LEFT JOIN shared_group_members m ON m.group_name = g.name "+
+			"WHERE g.name = "+g.s.ph(1)+" ORDER BY m.member_jid", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return groups[0], nil
+}
+
+func (g *sharedGroupStore) ListSharedGroups(ctx context.Context) ([]*storage.SharedGroup, error) {
+	return g.query(ctx,
+		"SELECT g.name, g.display, m.member_jid FROM shared_groups g "+
+			"LEFT JOIN shared_group_members m ON m.group_name = g.name "+
+			"ORDER BY g.name, m.member_jid")
+}
+
+func (g *sharedGroupStore) DeleteSharedGroup(ctx context.Context, name string) error {
+	tx, err := g.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM shared_groups WHERE name = "+g.s.ph(1), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return storage.ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM shared_group_members WHERE group_name = "+g.s.ph(1), name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (g *sharedGroupStore) AddSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	if err := g.exists(ctx, name); err != nil {
+		return err
+	}
+	q := "INSERT INTO shared_group_members (group_name, member_jid) VALUES (" + g.s.phs(1, 2) + ") " +
+		g.s.dialect.UpsertSuffix([]string{"group_name", "member_jid"}, nil)
+	_, err := g.s.db.ExecContext(ctx, q, name, memberJID)
+	return err
+}
+
+func (g *sharedGroupStore) RemoveSharedGroupMember(ctx context.Context, name, memberJID string) error {
+	if err := g.exists(ctx, name); err != nil {
+		return err
+	}
+	_, err := g.s.db.ExecContext(ctx,
+		"DELETE FROM shared_group_members WHERE group_name = "+g.s.ph(1)+" AND member_jid = "+g.s.ph(2),
+		name, memberJID,
+	)
+	return err
+}
+
+func (g *sharedGroupStore) GetMemberSharedGroups(ctx context.Context, memberJID string) ([]*storage.SharedGroup, error) {
+	return g.query(ctx,
+		"SELECT g.name, g.display, m.member_jid FROM shared_group_members own "+
+			"JOIN shared_groups g ON g.name = own.group_name "+
+			"JOIN shared_group_members m ON m.group_name = g.name "+
+			"WHERE own.member_jid = "+g.s.ph(1)+" ORDER BY g.name, m.member_jid", memberJID)
+}
+
+// exists returns storage.ErrNotFound if there is no group called name.
+func (g *sharedGroupStore) exists(ctx context.Context, name string) error {
+	var n int
+	err := g.s.db.QueryRowContext(ctx, "SELECT 1 FROM shared_groups WHERE name = "+g.s.ph(1), name).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// query reads groups from rows of name, display and member JID, ordered by
+// name, with a NULL member for groups without members.
+func (g *sharedGroupStore) query(ctx context.Context, q string, args ...any) ([]*storage.SharedGroup, error) {
+	rows, err := g.s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*storage.SharedGroup
+	for rows.Next() {
+		var name, display string
+		var member sql.NullString
+		if err := rows.Scan(&name, &display, &member); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, &storage.SharedGroup{Name: name, Display: display})
+		}
+		if member.Valid {
+			last := groups[len(groups)-1]
+			last.Members = append(last.Members, member.String)
+		}
+	}
+	return groups, rows.Err()
+}
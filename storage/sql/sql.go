@@ -4,14 +4,18 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/sql/migrations"
 )
 
 // Store implements storage.Storage using database/sql.
 type Store struct {
 	db      *sql.DB
 	dialect Dialect
+	dryRun  bool
 }
 
 // New creates a new SQL-backed store.
@@ -19,8 +23,37 @@ func New(db *sql.DB, dialect Dialect) *Store {
 	return &Store{db: db, dialect: dialect}
 }
 
+// SetDryRun makes Init check the schema instead of migrating it: Init then
+// fails with migrations.ErrPending, naming the pending migrations, unless
+// the schema is up to date, and leaves the database untouched.
+func (s *Store) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+// Migrator returns a Migrator for the schema of the store.
+func (s *Store) Migrator() *migrations.Migrator {
+	return migrations.New(s.db, s.dialect, s.dialect.Migrations())
+}
+
+// Init brings the schema up to date, or only checks it in dry-run mode.
 func (s *Store) Init(ctx context.Context) error {
-	return Migrate(ctx, s.db, s.dialect)
+	m := s.Migrator()
+	if !s.dryRun {
+		_, err := m.Up(ctx)
+		return err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		names := make([]string, len(pending))
+		for i, mig := range pending {
+			names[i] = fmt.Sprintf("%d (%s)", mig.Version, mig.Name)
+		}
+		return fmt.Errorf("%w: pending %s", migrations.ErrPending, strings.Join(names, ", "))
+	}
+	return nil
 }
 
 func (s *Store) Close() error {
@@ -36,6 +69,11 @@ func (s *Store) MAMStore() storage.MAMStore           { return &mamStore{s} }
 func (s *Store) MUCRoomStore() storage.MUCRoomStore   { return &mucStore{s} }
 func (s *Store) PubSubStore() storage.PubSubStore     { return &pubsubStore{s} }
 func (s *Store) BookmarkStore() storage.BookmarkStore { return &bookmarkStore{s} }
+func (s *Store) PushStore() storage.PushStore         { return &pushStore{s} }
+func (s *Store) CapsStore() storage.CapsStore         { return &capsStore{s} }
+func (s *Store) SharedGroupStore() storage.SharedGroupStore {
+	return &sharedGroupStore{s}
+}
 
 // ph is a helper that returns placeholders for the dialect.
 func (s *Store) ph(n int) string {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
 )
 
 type userStore struct{ s *Store }
@@ -70,6 +71,23 @@ func (u *userStore) DeleteUser(ctx context.Context, username string) error {
 	return nil
 }
 
+func (u *userStore) ListUsers(ctx context.Context) ([]string, error) {
+	rows, err := u.s.db.QueryContext(ctx, "SELECT username FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
 func (u *userStore) UserExists(ctx context.Context, username string) (bool, error) {
 	var count int
 	err := u.s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE username = "+u.s.ph(1), username).Scan(&count)
@@ -80,18 +98,7 @@ func (u *userStore) UserExists(ctx context.Context, username string) (bool, erro
 }
 
 func (u *userStore) Authenticate(ctx context.Context, username, password string) (bool, error) {
-	var storedPassword string
-	err := u.s.db.QueryRowContext(ctx, "SELECT password FROM users WHERE username = "+u.s.ph(1), username).Scan(&storedPassword)
-	if errors.Is(err, sql.ErrNoRows) {
-		return false, storage.ErrAuthFailed
-	}
-	if err != nil {
-		return false, err
-	}
-	if storedPassword != password {
-		return false, storage.ErrAuthFailed
-	}
-	return true, nil
+	return credentials.Authenticate(ctx, u, username, password)
 }
 
 // isUniqueViolation checks for unique constraint violation errors across dialects.
@@ -7,4 +7,9 @@ require (
 	github.com/meszmate/xmpp-go v0.0.0
 )
 
+require (
+	golang.org/x/crypto v0.47.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+)
+
 replace github.com/meszmate/xmpp-go => ../..
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	xmppsql "github.com/meszmate/xmpp-go/storage/sql"
+	"github.com/meszmate/xmpp-go/storage/sql/migrations"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -33,7 +34,7 @@ func (d SQLiteDialect) UpsertSuffix(conflictColumns []string, updateColumns []st
 	return "ON CONFLICT (" + strings.Join(conflictColumns, ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ")
 }
 
-func (d SQLiteDialect) Migrations() []string {
+func (d SQLiteDialect) Migrations() []migrations.Migration {
 	return sqliteMigrations
 }
 
@@ -55,123 +56,209 @@ func New(dsn string) (*xmppsql.Store, error) {
 	return xmppsql.New(db, SQLiteDialect{}), nil
 }
 
-var sqliteMigrations = []string{
-	// Migration 1: users table
-	`CREATE TABLE IF NOT EXISTS users (
-		username TEXT PRIMARY KEY,
-		password TEXT NOT NULL DEFAULT '',
-		salt TEXT NOT NULL DEFAULT '',
-		iterations INTEGER NOT NULL DEFAULT 0,
-		server_key TEXT NOT NULL DEFAULT '',
-		stored_key TEXT NOT NULL DEFAULT '',
-		created_at DATETIME NOT NULL DEFAULT (datetime('now')),
-		updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
-	)`,
-
-	// Migration 2: roster tables
-	`CREATE TABLE IF NOT EXISTS roster_items (
-		user_jid TEXT NOT NULL,
-		contact_jid TEXT NOT NULL,
-		name TEXT NOT NULL DEFAULT '',
-		subscription TEXT NOT NULL DEFAULT 'none',
-		ask TEXT NOT NULL DEFAULT '',
-		groups_list TEXT NOT NULL DEFAULT '',
-		PRIMARY KEY (user_jid, contact_jid)
-	);
-	CREATE TABLE IF NOT EXISTS roster_versions (
-		user_jid TEXT PRIMARY KEY,
-		version TEXT NOT NULL DEFAULT ''
-	)`,
-
-	// Migration 3: blocked JIDs
-	`CREATE TABLE IF NOT EXISTS blocked_jids (
-		user_jid TEXT NOT NULL,
-		blocked_jid TEXT NOT NULL,
-		PRIMARY KEY (user_jid, blocked_jid)
-	)`,
-
-	// Migration 4: vcards
-	`CREATE TABLE IF NOT EXISTS vcards (
-		user_jid TEXT PRIMARY KEY,
-		data BLOB NOT NULL
-	)`,
-
-	// Migration 5: offline messages
-	`CREATE TABLE IF NOT EXISTS offline_messages (
-		id TEXT NOT NULL,
-		user_jid TEXT NOT NULL,
-		from_jid TEXT NOT NULL DEFAULT '',
-		data BLOB NOT NULL,
-		created_at DATETIME NOT NULL DEFAULT (datetime('now'))
-	);
-	CREATE INDEX IF NOT EXISTS idx_offline_messages_user ON offline_messages(user_jid)`,
-
-	// Migration 6: MAM messages
-	`CREATE TABLE IF NOT EXISTS mam_messages (
-		id TEXT NOT NULL,
-		user_jid TEXT NOT NULL,
-		with_jid TEXT NOT NULL DEFAULT '',
-		from_jid TEXT NOT NULL DEFAULT '',
-		data BLOB NOT NULL,
-		created_at DATETIME NOT NULL DEFAULT (datetime('now'))
-	);
-	CREATE INDEX IF NOT EXISTS idx_mam_messages_user ON mam_messages(user_jid);
-	CREATE INDEX IF NOT EXISTS idx_mam_messages_user_with ON mam_messages(user_jid, with_jid)`,
-
-	// Migration 7: MUC rooms and affiliations
-	`CREATE TABLE IF NOT EXISTS muc_rooms (
-		room_jid TEXT PRIMARY KEY,
-		name TEXT NOT NULL DEFAULT '',
-		description TEXT NOT NULL DEFAULT '',
-		subject TEXT NOT NULL DEFAULT '',
-		password TEXT NOT NULL DEFAULT '',
-		is_public INTEGER NOT NULL DEFAULT 1,
-		is_persistent INTEGER NOT NULL DEFAULT 0,
-		max_users INTEGER NOT NULL DEFAULT 0
-	);
-	CREATE TABLE IF NOT EXISTS muc_affiliations (
-		room_jid TEXT NOT NULL,
-		user_jid TEXT NOT NULL,
-		affiliation TEXT NOT NULL DEFAULT 'none',
-		reason TEXT NOT NULL DEFAULT '',
-		PRIMARY KEY (room_jid, user_jid)
-	)`,
-
-	// Migration 8: PubSub
-	`CREATE TABLE IF NOT EXISTS pubsub_nodes (
-		host TEXT NOT NULL,
-		node_id TEXT NOT NULL,
-		name TEXT NOT NULL DEFAULT '',
-		type TEXT NOT NULL DEFAULT 'leaf',
-		creator TEXT NOT NULL DEFAULT '',
-		PRIMARY KEY (host, node_id)
-	);
-	CREATE TABLE IF NOT EXISTS pubsub_items (
-		host TEXT NOT NULL,
-		node_id TEXT NOT NULL,
-		item_id TEXT NOT NULL,
-		publisher TEXT NOT NULL DEFAULT '',
-		payload BLOB,
-		created_at DATETIME NOT NULL DEFAULT (datetime('now')),
-		PRIMARY KEY (host, node_id, item_id)
-	);
-	CREATE TABLE IF NOT EXISTS pubsub_subscriptions (
-		host TEXT NOT NULL,
-		node_id TEXT NOT NULL,
-		jid TEXT NOT NULL,
-		sub_id TEXT NOT NULL DEFAULT '',
-		state TEXT NOT NULL DEFAULT 'subscribed',
-		PRIMARY KEY (host, node_id, jid)
-	)`,
-
-	// Migration 9: Bookmarks
-	`CREATE TABLE IF NOT EXISTS bookmarks (
-		user_jid TEXT NOT NULL,
-		room_jid TEXT NOT NULL,
-		name TEXT NOT NULL DEFAULT '',
-		nick TEXT NOT NULL DEFAULT '',
-		password TEXT NOT NULL DEFAULT '',
-		autojoin INTEGER NOT NULL DEFAULT 0,
-		PRIMARY KEY (user_jid, room_jid)
-	)`,
+var sqliteMigrations = []migrations.Migration{
+	{
+		Version: 1,
+		Name:    "users table",
+		Up: `CREATE TABLE IF NOT EXISTS users (
+			username TEXT PRIMARY KEY,
+			password TEXT NOT NULL DEFAULT '',
+			salt TEXT NOT NULL DEFAULT '',
+			iterations INTEGER NOT NULL DEFAULT 0,
+			server_key TEXT NOT NULL DEFAULT '',
+			stored_key TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		)`,
+		Down: `DROP TABLE IF EXISTS users`,
+	},
+	{
+		Version: 2,
+		Name:    "roster tables",
+		Up: `CREATE TABLE IF NOT EXISTS roster_items (
+			user_jid TEXT NOT NULL,
+			contact_jid TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			subscription TEXT NOT NULL DEFAULT 'none',
+			ask TEXT NOT NULL DEFAULT '',
+			groups_list TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (user_jid, contact_jid)
+		);
+		CREATE TABLE IF NOT EXISTS roster_versions (
+			user_jid TEXT PRIMARY KEY,
+			version TEXT NOT NULL DEFAULT ''
+		)`,
+		Down: `DROP TABLE IF EXISTS roster_versions;
+		DROP TABLE IF EXISTS roster_items`,
+	},
+	{
+		Version: 3,
+		Name:    "blocked JIDs",
+		Up: `CREATE TABLE IF NOT EXISTS blocked_jids (
+			user_jid TEXT NOT NULL,
+			blocked_jid TEXT NOT NULL,
+			PRIMARY KEY (user_jid, blocked_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS blocked_jids`,
+	},
+	{
+		Version: 4,
+		Name:    "vcards",
+		Up: `CREATE TABLE IF NOT EXISTS vcards (
+			user_jid TEXT PRIMARY KEY,
+			data BLOB NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS vcards`,
+	},
+	{
+		Version: 5,
+		Name:    "offline messages",
+		Up: `CREATE TABLE IF NOT EXISTS offline_messages (
+			id TEXT NOT NULL,
+			user_jid TEXT NOT NULL,
+			from_jid TEXT NOT NULL DEFAULT '',
+			data BLOB NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		);
+		CREATE INDEX IF NOT EXISTS idx_offline_messages_user ON offline_messages(user_jid)`,
+		Down: `DROP TABLE IF EXISTS offline_messages`,
+	},
+	{
+		Version: 6,
+		Name:    "MAM messages",
+		Up: `CREATE TABLE IF NOT EXISTS mam_messages (
+			id TEXT NOT NULL,
+			user_jid TEXT NOT NULL,
+			with_jid TEXT NOT NULL DEFAULT '',
+			from_jid TEXT NOT NULL DEFAULT '',
+			data BLOB NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+		);
+		CREATE INDEX IF NOT EXISTS idx_mam_messages_user ON mam_messages(user_jid);
+		CREATE INDEX IF NOT EXISTS idx_mam_messages_user_with ON mam_messages(user_jid, with_jid)`,
+		Down: `DROP TABLE IF EXISTS mam_messages`,
+	},
+	{
+		Version: 7,
+		Name:    "MUC rooms and affiliations",
+		Up: `CREATE TABLE IF NOT EXISTS muc_rooms (
+			room_jid TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			subject TEXT NOT NULL DEFAULT '',
+			password TEXT NOT NULL DEFAULT '',
+			is_public INTEGER NOT NULL DEFAULT 1,
+			is_persistent INTEGER NOT NULL DEFAULT 0,
+			max_users INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE TABLE IF NOT EXISTS muc_affiliations (
+			room_jid TEXT NOT NULL,
+			user_jid TEXT NOT NULL,
+			affiliation TEXT NOT NULL DEFAULT 'none',
+			reason TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (room_jid, user_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS muc_affiliations;
+		DROP TABLE IF EXISTS muc_rooms`,
+	},
+	{
+		Version: 8,
+		Name:    "PubSub",
+		Up: `CREATE TABLE IF NOT EXISTS pubsub_nodes (
+			host TEXT NOT NULL,
+			node_id TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			type TEXT NOT NULL DEFAULT 'leaf',
+			creator TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (host, node_id)
+		);
+		CREATE TABLE IF NOT EXISTS pubsub_items (
+			host TEXT NOT NULL,
+			node_id TEXT NOT NULL,
+			item_id TEXT NOT NULL,
+			publisher TEXT NOT NULL DEFAULT '',
+			payload BLOB,
+			created_at DATETIME NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (host, node_id, item_id)
+		);
+		CREATE TABLE IF NOT EXISTS pubsub_subscriptions (
+			host TEXT NOT NULL,
+			node_id TEXT NOT NULL,
+			jid TEXT NOT NULL,
+			sub_id TEXT NOT NULL DEFAULT '',
+			state TEXT NOT NULL DEFAULT 'subscribed',
+			PRIMARY KEY (host, node_id, jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS pubsub_subscriptions;
+		DROP TABLE IF EXISTS pubsub_items;
+		DROP TABLE IF EXISTS pubsub_nodes`,
+	},
+	{
+		Version: 9,
+		Name:    "bookmarks",
+		Up: `CREATE TABLE IF NOT EXISTS bookmarks (
+			user_jid TEXT NOT NULL,
+			room_jid TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			nick TEXT NOT NULL DEFAULT '',
+			password TEXT NOT NULL DEFAULT '',
+			autojoin INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_jid, room_jid)
+		)`,
+		Down: `DROP TABLE IF EXISTS bookmarks`,
+	},
+	{
+		Version: 10,
+		Name:    "push notification registrations",
+		Up: `CREATE TABLE IF NOT EXISTS push_registrations (
+			user_jid TEXT NOT NULL,
+			service_jid TEXT NOT NULL,
+			node TEXT NOT NULL,
+			options BLOB,
+			PRIMARY KEY (user_jid, service_jid, node)
+		)`,
+		Down: `DROP TABLE IF EXISTS push_registrations`,
+	},
+	{
+		Version: 11,
+		Name:    "MAM paging index",
+		Up:      `CREATE INDEX IF NOT EXISTS idx_mam_messages_user_time ON mam_messages(user_jid, created_at, id)`,
+		Down:    `DROP INDEX IF EXISTS idx_mam_messages_user_time`,
+	},
+	{
+		Version: 12,
+		Name:    "entity capabilities",
+		Up: `CREATE TABLE IF NOT EXISTS caps_info (
+			ver TEXT PRIMARY KEY,
+			info BLOB NOT NULL
+		)`,
+		Down: `DROP TABLE IF EXISTS caps_info`,
+	},
+	{
+		Version: 13,
+		Name:    "shared roster groups",
+		Up: `CREATE TABLE IF NOT EXISTS shared_groups (
+			name TEXT PRIMARY KEY,
+			display TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS shared_group_members (
+			group_name TEXT NOT NULL,
+			member_jid TEXT NOT NULL,
+			PRIMARY KEY (group_name, member_jid)
+		);
+		CREATE INDEX IF NOT EXISTS idx_shared_group_members_member ON shared_group_members(member_jid)`,
+		Down: `DROP TABLE IF EXISTS shared_group_members;
+		DROP TABLE IF EXISTS shared_groups`,
+	},
+	{
+		Version: 14,
+		Name:    "MAM preferences",
+		Up: `CREATE TABLE IF NOT EXISTS mam_prefs (
+			user_jid TEXT PRIMARY KEY,
+			default_mode TEXT NOT NULL,
+			always_list TEXT NOT NULL DEFAULT '',
+			never_list TEXT NOT NULL DEFAULT ''
+		)`,
+		Down: `DROP TABLE IF EXISTS mam_prefs`,
+	},
 }
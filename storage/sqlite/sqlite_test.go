@@ -1,9 +1,14 @@
 package sqlite_test
 
 import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/sql/migrations"
 	"github.com/meszmate/xmpp-go/storage/sqlite"
 	"github.com/meszmate/xmpp-go/storage/storagetest"
 )
@@ -17,3 +22,129 @@ func TestSQLiteStorage(t *testing.T) {
 		return s
 	})
 }
+
+func BenchmarkSQLiteStorage(b *testing.B) {
+	storagetest.BenchmarkStorage(b, func() storage.Storage {
+		s, err := sqlite.New(":memory:")
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "xmpp.db")
+	s, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m := s.Migrator()
+	latest := len(sqlite.SQLiteDialect{}.Migrations())
+
+	// A dry run leaves the database untouched.
+	s.SetDryRun(true)
+	if err := s.Init(ctx); !errors.Is(err, migrations.ErrPending) {
+		t.Fatalf("dry-run Init: got %v, want ErrPending", err)
+	}
+	m.SetDryRun(true)
+	if planned, err := m.Up(ctx); err != nil || len(planned) != latest {
+		t.Fatalf("dry-run Up = %d migrations, %v", len(planned), err)
+	}
+	m.SetDryRun(false)
+	if v, err := m.Version(ctx); err != nil || v != 0 {
+		t.Fatalf("Version after dry run = %d, %v", v, err)
+	}
+
+	s.SetDryRun(false)
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if v, err := m.Version(ctx); err != nil || v != latest {
+		t.Fatalf("Version = %d, %v, want %d", v, err, latest)
+	}
+	s.SetDryRun(true)
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("dry-run Init when up to date: %v", err)
+	}
+
+	reverted, err := m.Down(ctx, latest-2)
+	if err != nil || len(reverted) != 2 || reverted[0].Version != latest {
+		t.Fatalf("Down = %v, %v", reverted, err)
+	}
+	if pending, err := m.Pending(ctx); err != nil || len(pending) != 2 || pending[0].Version != latest-1 {
+		t.Fatalf("Pending after Down = %v, %v", pending, err)
+	}
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 2 {
+		t.Fatalf("Up after Down = %v, %v", applied, err)
+	}
+
+	// A schema migrated by a newer build is refused.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "INSERT INTO schema_version (version, name) VALUES (?, 'future')", latest+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(ctx); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("Init on a newer schema: %v", err)
+	}
+	if _, err := m.Down(ctx, 0); err == nil {
+		t.Fatal("Down on a newer schema succeeded")
+	}
+}
+
+func TestSQLiteMigrationsAdoptLegacyVersions(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "xmpp.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The schema as migrated before versions moved to schema_version, one
+	// migration behind.
+	all := sqlite.SQLiteDialect{}.Migrations()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE xmpp_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at DATETIME DEFAULT (datetime('now'))
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, mig := range all[:len(all)-1] {
+		if _, err := db.ExecContext(ctx, mig.Up); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO xmpp_migrations (version) VALUES (?)", mig.Version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m := s.Migrator()
+	if pending, err := m.Pending(ctx); err != nil || len(pending) != 1 || pending[0].Version != len(all) {
+		t.Fatalf("Pending = %v, %v", pending, err)
+	}
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	applied, err := m.Applied(ctx)
+	if err != nil || len(applied) != len(all) {
+		t.Fatalf("Applied = %v, %v", applied, err)
+	}
+	if applied[0].Name != all[0].Name || applied[0].AppliedAt.IsZero() {
+		t.Fatalf("adopted version = %+v", applied[0])
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'xmpp_migrations'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("legacy table left behind: %d, %v", n, err)
+	}
+}
@@ -12,6 +12,10 @@ var (
 	ErrNotFound   = errors.New("storage: not found")
 	ErrUserExists = errors.New("storage: user already exists")
 	ErrAuthFailed = errors.New("storage: authentication failed")
+	// ErrStorageUnavailable is returned by plugins that need a sub-store
+	// the configured backend does not provide, or when no backend is
+	// configured at all.
+	ErrStorageUnavailable = errors.New("storage: sub-store not available")
 )
 
 // Storage is the composite storage interface that provides access to all sub-stores.
@@ -47,4 +51,14 @@ type Storage interface {
 
 	// BookmarkStore returns the bookmark store, or nil if unsupported.
 	BookmarkStore() BookmarkStore
+
+	// PushStore returns the push registration store, or nil if unsupported.
+	PushStore() PushStore
+
+	// CapsStore returns the entity capabilities store, or nil if unsupported.
+	CapsStore() CapsStore
+
+	// SharedGroupStore returns the shared roster group store, or nil if
+	// unsupported.
+	SharedGroupStore() SharedGroupStore
 }
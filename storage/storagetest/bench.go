@@ -0,0 +1,198 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// Sizes of the data set the benchmarks run against.
+const (
+	benchRosterSize  = 100
+	benchArchiveSize = 500
+	benchPageSize    = 50
+	benchNodeItems   = 100
+)
+
+// BenchmarkStorage measures the hot operations of a storage backend:
+// authentication, roster reads and writes, archiving, archive paging and
+// PubSub publishing. Each sub-benchmark works on fresh keys, so it can run
+// against a shared database; compare backends with
+//
+//	go test -bench . -benchmem
+func BenchmarkStorage(b *testing.B, newStore func() storage.Storage) {
+	b.Run("Authenticate", func(b *testing.B) { benchAuthenticate(b, newStore) })
+	b.Run("UpsertRosterItem", func(b *testing.B) { benchUpsertRosterItem(b, newStore) })
+	b.Run("GetRosterItems", func(b *testing.B) { benchGetRosterItems(b, newStore) })
+	b.Run("ArchiveMessage", func(b *testing.B) { benchArchiveMessage(b, newStore) })
+	b.Run("QueryMessages", func(b *testing.B) { benchQueryMessages(b, newStore) })
+	b.Run("UpsertItem", func(b *testing.B) { benchUpsertItem(b, newStore) })
+}
+
+// benchKey returns a key no earlier run has used.
+func benchKey(name string) string {
+	return fmt.Sprintf("bench-%s-%d", name, time.Now().UnixNano())
+}
+
+func benchAuthenticate(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	us := s.UserStore()
+	if us == nil {
+		b.Skip("UserStore not supported")
+	}
+	ctx := context.Background()
+	user := benchKey("user")
+	if err := us.CreateUser(ctx, &storage.User{Username: user, Password: "secret"}); err != nil {
+		b.Fatalf("CreateUser: %v", err)
+	}
+	b.Cleanup(func() { _ = us.DeleteUser(ctx, user) })
+
+	for b.Loop() {
+		if ok, err := us.Authenticate(ctx, user, "secret"); err != nil || !ok {
+			b.Fatalf("Authenticate: %v, %v", ok, err)
+		}
+	}
+}
+
+func benchUpsertRosterItem(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	rs := s.RosterStore()
+	if rs == nil {
+		b.Skip("RosterStore not supported")
+	}
+	ctx := context.Background()
+	user := benchKey("roster") + "@example.com"
+	b.Cleanup(func() { deleteRoster(ctx, rs, user) })
+
+	i := 0
+	for b.Loop() {
+		item := &storage.RosterItem{
+			UserJID: user, ContactJID: fmt.Sprintf("contact%d@example.com", i%benchRosterSize),
+			Name: fmt.Sprint("Contact ", i), Subscription: "both", Groups: []string{"Friends"},
+		}
+		if err := rs.UpsertRosterItem(ctx, item); err != nil {
+			b.Fatalf("UpsertRosterItem: %v", err)
+		}
+		i++
+	}
+}
+
+func benchGetRosterItems(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	rs := s.RosterStore()
+	if rs == nil {
+		b.Skip("RosterStore not supported")
+	}
+	ctx := context.Background()
+	user := benchKey("roster") + "@example.com"
+	b.Cleanup(func() { deleteRoster(ctx, rs, user) })
+	for i := range benchRosterSize {
+		item := &storage.RosterItem{
+			UserJID: user, ContactJID: fmt.Sprintf("contact%d@example.com", i),
+			Subscription: "both", Groups: []string{"Friends"},
+		}
+		if err := rs.UpsertRosterItem(ctx, item); err != nil {
+			b.Fatalf("UpsertRosterItem: %v", err)
+		}
+	}
+
+	for b.Loop() {
+		items, err := rs.GetRosterItems(ctx, user)
+		if err != nil || len(items) != benchRosterSize {
+			b.Fatalf("GetRosterItems: %d, %v", len(items), err)
+		}
+	}
+}
+
+func deleteRoster(ctx context.Context, rs storage.RosterStore, user string) {
+	items, _ := rs.GetRosterItems(ctx, user)
+	for _, item := range items {
+		_ = rs.DeleteRosterItem(ctx, user, item.ContactJID)
+	}
+}
+
+func benchArchiveMessage(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	ms := s.MAMStore()
+	if ms == nil {
+		b.Skip("MAMStore not supported")
+	}
+	ctx := context.Background()
+	user := benchKey("mam") + "@example.com"
+	b.Cleanup(func() { _ = ms.DeleteMessageArchive(ctx, user) })
+
+	now := time.Now()
+	i := 0
+	for b.Loop() {
+		if err := ms.ArchiveMessage(ctx, benchMessage(user, i, now)); err != nil {
+			b.Fatalf("ArchiveMessage: %v", err)
+		}
+		i++
+	}
+}
+
+func benchQueryMessages(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	ms := s.MAMStore()
+	if ms == nil {
+		b.Skip("MAMStore not supported")
+	}
+	ctx := context.Background()
+	user := benchKey("mam") + "@example.com"
+	b.Cleanup(func() { _ = ms.DeleteMessageArchive(ctx, user) })
+	now := time.Now()
+	for i := range benchArchiveSize {
+		if err := ms.ArchiveMessage(ctx, benchMessage(user, i, now)); err != nil {
+			b.Fatalf("ArchiveMessage: %v", err)
+		}
+	}
+
+	// Page from the middle of the archive, as a client catching up does.
+	query := &storage.MAMQuery{UserJID: user, AfterID: benchMessage(user, benchArchiveSize/2, now).ID, Max: benchPageSize}
+	for b.Loop() {
+		res, err := ms.QueryMessages(ctx, query)
+		if err != nil || len(res.Messages) != benchPageSize {
+			b.Fatalf("QueryMessages: %v", err)
+		}
+	}
+}
+
+// benchMessage returns the i-th message of an archive that starts at start.
+// IDs are zero-padded so that they sort in archive order.
+func benchMessage(user string, i int, start time.Time) *storage.ArchivedMessage {
+	return &storage.ArchivedMessage{
+		ID: fmt.Sprintf("m%09d", i), UserJID: user, WithJID: "bob@example.com", FromJID: "bob@example.com",
+		Data:      []byte(`<message type="chat"><body>Hello, this is a representative chat message.</body></message>`),
+		CreatedAt: start.Add(time.Duration(i) * time.Millisecond),
+	}
+}
+
+func benchUpsertItem(b *testing.B, newStore func() storage.Storage) {
+	s := initStore(b, newStore)
+	ps := s.PubSubStore()
+	if ps == nil {
+		b.Skip("PubSubStore not supported")
+	}
+	ctx := context.Background()
+	host := benchKey("pubsub") + ".example.com"
+	if err := ps.CreateNode(ctx, &storage.PubSubNode{Host: host, NodeID: "news", Type: "leaf"}); err != nil {
+		b.Fatalf("CreateNode: %v", err)
+	}
+	b.Cleanup(func() { _ = ps.DeleteNode(ctx, host, "news") })
+
+	i := 0
+	for b.Loop() {
+		item := &storage.PubSubItem{
+			Host: host, NodeID: "news", ItemID: fmt.Sprint("item", i%benchNodeItems),
+			Publisher: "alice@example.com", Payload: []byte(`<entry xmlns="http://www.w3.org/2005/Atom"><title>News</title></entry>`),
+			CreatedAt: time.Now(),
+		}
+		if err := ps.UpsertItem(ctx, item); err != nil {
+			b.Fatalf("UpsertItem: %v", err)
+		}
+		i++
+	}
+}
@@ -0,0 +1,127 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/memory"
+)
+
+// TestBlobStore runs the conformance test suite against a blob store.
+func TestBlobStore(t *testing.T, newBlobStore func() storage.BlobStore) {
+	bs := newBlobStore()
+	ctx := context.Background()
+
+	if _, _, err := bs.GetBlob(ctx, "vcard/missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetBlob missing: got %v, want ErrNotFound", err)
+	}
+	if err := bs.DeleteBlob(ctx, "vcard/missing"); err != nil {
+		t.Fatalf("DeleteBlob missing: %v", err)
+	}
+
+	data := bytes.Repeat([]byte{0, 1, 2, 0xff}, 1000)
+	if err := bs.PutBlob(ctx, "upload/a b/photo.png", data, "image/png"); err != nil {
+		t.Fatalf("PutBlob: %v", err)
+	}
+	got, contentType, err := bs.GetBlob(ctx, "upload/a b/photo.png")
+	if err != nil || !bytes.Equal(got, data) || contentType != "image/png" {
+		t.Fatalf("GetBlob = %d bytes, %q, %v", len(got), contentType, err)
+	}
+
+	// Put replaces.
+	if err := bs.PutBlob(ctx, "upload/a b/photo.png", []byte("<x/>"), "application/xml"); err != nil {
+		t.Fatalf("PutBlob replace: %v", err)
+	}
+	got, contentType, err = bs.GetBlob(ctx, "upload/a b/photo.png")
+	if err != nil || string(got) != "<x/>" || contentType != "application/xml" {
+		t.Fatalf("GetBlob after replace = %q, %q, %v", got, contentType, err)
+	}
+
+	// Empty blobs are blobs.
+	if err := bs.PutBlob(ctx, "empty", nil, ""); err != nil {
+		t.Fatalf("PutBlob empty: %v", err)
+	}
+	if got, _, err := bs.GetBlob(ctx, "empty"); err != nil || len(got) != 0 {
+		t.Fatalf("GetBlob empty = %q, %v", got, err)
+	}
+
+	if err := bs.DeleteBlob(ctx, "upload/a b/photo.png"); err != nil {
+		t.Fatalf("DeleteBlob: %v", err)
+	}
+	if _, _, err := bs.GetBlob(ctx, "upload/a b/photo.png"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetBlob after delete: got %v, want ErrNotFound", err)
+	}
+}
+
+// testOffload runs the store tests through a view that offloads every
+// payload, and checks that the backend only keeps references to them.
+func testOffload(t *testing.T, newStore func() storage.Storage) {
+	testStores(t, func() storage.Storage {
+		return storage.Offload(newStore(), memory.NewBlobStore(), 1)
+	})
+
+	t.Run("References", func(t *testing.T) {
+		s := initStore(t, newStore)
+		if s.VCardStore() == nil || s.PubSubStore() == nil {
+			t.Skip("VCardStore or PubSubStore not supported")
+		}
+		ctx := context.Background()
+		blobs := memory.NewBlobStore()
+		o := storage.Offload(s, blobs, 64)
+		large := []byte("<vCard><PHOTO><BINVAL>" + strings.Repeat("A", 100) + "</BINVAL></PHOTO></vCard>")
+		small := []byte("<vCard><FN>Alice</FN></vCard>")
+
+		vs := o.VCardStore()
+		if err := vs.SetVCard(ctx, "alice@example.com", large); err != nil {
+			t.Fatalf("SetVCard: %v", err)
+		}
+		raw, err := s.VCardStore().GetVCard(ctx, "alice@example.com")
+		if err != nil || bytes.Equal(raw, large) || blobs.Len() != 1 {
+			t.Fatalf("backend holds %q, %v, with %d blobs", raw, err, blobs.Len())
+		}
+		if got, err := vs.GetVCard(ctx, "alice@example.com"); err != nil || !bytes.Equal(got, large) {
+			t.Fatalf("GetVCard = %q, %v", got, err)
+		}
+		// A smaller vCard replaces the blob.
+		if err := vs.SetVCard(ctx, "alice@example.com", small); err != nil {
+			t.Fatalf("SetVCard small: %v", err)
+		}
+		if raw, _ := s.VCardStore().GetVCard(ctx, "alice@example.com"); !bytes.Equal(raw, small) || blobs.Len() != 0 {
+			t.Fatalf("backend holds %q with %d blobs", raw, blobs.Len())
+		}
+
+		ps := o.PubSubStore()
+		if err := ps.CreateNode(ctx, &storage.PubSubNode{Host: "alice@example.com", NodeID: "urn:xmpp:avatar:data", Creator: "alice@example.com"}); err != nil {
+			t.Fatalf("CreateNode: %v", err)
+		}
+		for _, id := range []string{"a", "b"} {
+			item := &storage.PubSubItem{Host: "alice@example.com", NodeID: "urn:xmpp:avatar:data", ItemID: id, Publisher: "alice@example.com", Payload: large}
+			if err := ps.UpsertItem(ctx, item); err != nil {
+				t.Fatalf("UpsertItem: %v", err)
+			}
+		}
+		if blobs.Len() != 2 {
+			t.Fatalf("%d blobs after publishing, want 2", blobs.Len())
+		}
+		items, err := ps.GetItems(ctx, "alice@example.com", "urn:xmpp:avatar:data")
+		if err != nil || len(items) != 2 || !bytes.Equal(items[0].Payload, large) {
+			t.Fatalf("GetItems = %v, %v", items, err)
+		}
+		if err := ps.DeleteItem(ctx, "alice@example.com", "urn:xmpp:avatar:data", "a"); err != nil {
+			t.Fatalf("DeleteItem: %v", err)
+		}
+		if blobs.Len() != 1 {
+			t.Fatalf("%d blobs after retracting, want 1", blobs.Len())
+		}
+		if err := ps.DeleteNode(ctx, "alice@example.com", "urn:xmpp:avatar:data"); err != nil {
+			t.Fatalf("DeleteNode: %v", err)
+		}
+		if blobs.Len() != 0 {
+			t.Fatalf("%d blobs after deleting the node, want 0", blobs.Len())
+		}
+	})
+}
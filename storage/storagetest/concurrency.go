@@ -0,0 +1,321 @@
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// workers is the number of goroutines each concurrency test runs at once.
+const workers = 16
+
+// testConcurrency hammers the stores with parallel operations on shared and
+// distinct keys. Run it with -race to also catch unsynchronized state.
+func testConcurrency(t *testing.T, newStore func() storage.Storage) {
+	t.Run("UserStore", func(t *testing.T) { testConcurrentUsers(t, newStore) })
+	t.Run("RosterStore", func(t *testing.T) { testConcurrentRoster(t, newStore) })
+	t.Run("BlockingStore", func(t *testing.T) { testConcurrentBlocking(t, newStore) })
+	t.Run("VCardStore", func(t *testing.T) { testConcurrentVCards(t, newStore) })
+	t.Run("OfflineStore", func(t *testing.T) { testConcurrentOffline(t, newStore) })
+}
+
+// parallel runs fn(i) for i in [0, n) on n goroutines released together and
+// returns the errors in index order.
+func parallel(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs[i] = fn(i)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+// expectOne checks that exactly one of errs is nil and the rest are want.
+func expectOne(t *testing.T, op string, errs []error, want error) {
+	t.Helper()
+	ok := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case want:
+		default:
+			t.Fatalf("%s: got %v, want nil or %v", op, err, want)
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("%s: %d calls succeeded, want exactly 1", op, ok)
+	}
+}
+
+func expectNone(t *testing.T, op string, errs []error) {
+	t.Helper()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("%s #%d: %v", op, i, err)
+		}
+	}
+}
+
+func testConcurrentUsers(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	us := s.UserStore()
+	if us == nil {
+		t.Skip("UserStore not supported")
+	}
+	ctx := context.Background()
+
+	// Racing creates of one username: one wins, the rest see ErrUserExists.
+	errs := parallel(workers, func(i int) error {
+		return us.CreateUser(ctx, &storage.User{Username: "alice", Password: fmt.Sprint("pw", i)})
+	})
+	expectOne(t, "CreateUser same", errs, storage.ErrUserExists)
+
+	// Distinct usernames created in parallel are all kept.
+	errs = parallel(workers, func(i int) error {
+		return us.CreateUser(ctx, &storage.User{Username: fmt.Sprint("user", i), Password: "secret"})
+	})
+	expectNone(t, "CreateUser distinct", errs)
+	for i := range workers {
+		if ok, err := us.UserExists(ctx, fmt.Sprint("user", i)); err != nil || !ok {
+			t.Fatalf("UserExists user%d: %v, %v", i, ok, err)
+		}
+	}
+
+	// Updates racing with reads: every read sees one of the written
+	// passwords and the last writer wins.
+	passwords := make(map[string]bool)
+	for i := range workers {
+		passwords[fmt.Sprint("pw", i)] = true
+	}
+	errs = parallel(2*workers, func(i int) error {
+		if i%2 == 0 {
+			return us.UpdateUser(ctx, &storage.User{Username: "alice", Password: fmt.Sprint("pw", i/2)})
+		}
+		u, err := us.GetUser(ctx, "alice")
+		if err != nil {
+			return err
+		}
+		if !passwords[u.Password] {
+			return fmt.Errorf("GetUser: unexpected password %q", u.Password)
+		}
+		return nil
+	})
+	expectNone(t, "UpdateUser/GetUser", errs)
+	got, err := us.GetUser(ctx, "alice")
+	if err != nil || !passwords[got.Password] {
+		t.Fatalf("GetUser after updates: %+v, %v", got, err)
+	}
+
+	// Racing deletes of one username: one wins, the rest see ErrNotFound.
+	errs = parallel(workers, func(int) error { return us.DeleteUser(ctx, "alice") })
+	expectOne(t, "DeleteUser same", errs, storage.ErrNotFound)
+	if _, err := us.GetUser(ctx, "alice"); err != storage.ErrNotFound {
+		t.Fatalf("GetUser after delete: got %v, want ErrNotFound", err)
+	}
+
+	// Distinct deletes racing with creates of other usernames.
+	errs = parallel(2*workers, func(i int) error {
+		if i%2 == 0 {
+			return us.DeleteUser(ctx, fmt.Sprint("user", i/2))
+		}
+		return us.CreateUser(ctx, &storage.User{Username: fmt.Sprint("new", i/2), Password: "secret"})
+	})
+	expectNone(t, "DeleteUser/CreateUser distinct", errs)
+	for i := range workers {
+		if ok, _ := us.UserExists(ctx, fmt.Sprint("user", i)); ok {
+			t.Fatalf("user%d exists after delete", i)
+		}
+		if ok, _ := us.UserExists(ctx, fmt.Sprint("new", i)); !ok {
+			t.Fatalf("new%d missing after create", i)
+		}
+	}
+}
+
+func testConcurrentRoster(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	rs := s.RosterStore()
+	if rs == nil {
+		t.Skip("RosterStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+
+	// Upserts of distinct contacts must not lose each other.
+	errs := parallel(workers, func(i int) error {
+		return rs.UpsertRosterItem(ctx, &storage.RosterItem{
+			UserJID: user, ContactJID: fmt.Sprintf("c%d@example.com", i), Subscription: "both",
+		})
+	})
+	expectNone(t, "UpsertRosterItem distinct", errs)
+	items, err := rs.GetRosterItems(ctx, user)
+	if err != nil || len(items) != workers {
+		t.Fatalf("GetRosterItems: %d, %v, want %d", len(items), err, workers)
+	}
+
+	// Upserts of one contact: exactly one item remains and it is one of the
+	// written values as a whole, not a mix of several.
+	const contact = "bob@example.com"
+	errs = parallel(workers, func(i int) error {
+		return rs.UpsertRosterItem(ctx, &storage.RosterItem{
+			UserJID: user, ContactJID: contact,
+			Name: fmt.Sprint("Bob", i), Subscription: "to", Groups: []string{fmt.Sprint("g", i)},
+		})
+	})
+	expectNone(t, "UpsertRosterItem same", errs)
+	got, err := rs.GetRosterItem(ctx, user, contact)
+	if err != nil {
+		t.Fatalf("GetRosterItem: %v", err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(got.Name, "Bob%d", &n); err != nil || n < 0 || n >= workers {
+		t.Fatalf("GetRosterItem: unexpected name %q", got.Name)
+	}
+	if len(got.Groups) != 1 || got.Groups[0] != fmt.Sprint("g", n) {
+		t.Fatalf("GetRosterItem: groups %v do not match name %q", got.Groups, got.Name)
+	}
+	items, _ = rs.GetRosterItems(ctx, user)
+	if len(items) != workers+1 {
+		t.Fatalf("GetRosterItems after same-key upserts: %d, want %d", len(items), workers+1)
+	}
+
+	// Deletes racing with reads of the remaining items.
+	errs = parallel(2*workers, func(i int) error {
+		if i%2 == 0 {
+			return rs.DeleteRosterItem(ctx, user, fmt.Sprintf("c%d@example.com", i/2))
+		}
+		_, err := rs.GetRosterItem(ctx, user, contact)
+		return err
+	})
+	expectNone(t, "DeleteRosterItem/GetRosterItem", errs)
+	items, _ = rs.GetRosterItems(ctx, user)
+	if len(items) != 1 || items[0].ContactJID != contact {
+		t.Fatalf("GetRosterItems after deletes: %v", items)
+	}
+}
+
+func testConcurrentBlocking(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	bs := s.BlockingStore()
+	if bs == nil {
+		t.Skip("BlockingStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+
+	errs := parallel(workers, func(i int) error {
+		return bs.BlockJID(ctx, user, fmt.Sprintf("spam%d@example.com", i))
+	})
+	expectNone(t, "BlockJID distinct", errs)
+	jids, err := bs.GetBlockedJIDs(ctx, user)
+	if err != nil || len(jids) != workers {
+		t.Fatalf("GetBlockedJIDs: %d, %v, want %d", len(jids), err, workers)
+	}
+
+	// Blocking the same JID repeatedly is idempotent.
+	errs = parallel(workers, func(int) error { return bs.BlockJID(ctx, user, "spam0@example.com") })
+	expectNone(t, "BlockJID same", errs)
+	jids, _ = bs.GetBlockedJIDs(ctx, user)
+	if len(jids) != workers {
+		t.Fatalf("GetBlockedJIDs after same-key blocks: %d, want %d", len(jids), workers)
+	}
+
+	errs = parallel(workers, func(i int) error {
+		return bs.UnblockJID(ctx, user, fmt.Sprintf("spam%d@example.com", i))
+	})
+	expectNone(t, "UnblockJID distinct", errs)
+	jids, _ = bs.GetBlockedJIDs(ctx, user)
+	if len(jids) != 0 {
+		t.Fatalf("GetBlockedJIDs after unblock: %v", jids)
+	}
+}
+
+func testConcurrentVCards(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	vs := s.VCardStore()
+	if vs == nil {
+		t.Skip("VCardStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+
+	written := make(map[string]bool)
+	for i := range workers {
+		written[vcard(i)] = true
+	}
+	errs := parallel(2*workers, func(i int) error {
+		if i%2 == 0 {
+			return vs.SetVCard(ctx, user, []byte(vcard(i/2)))
+		}
+		data, err := vs.GetVCard(ctx, user)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !written[string(data)] {
+			return fmt.Errorf("GetVCard: torn value %q", data)
+		}
+		return nil
+	})
+	expectNone(t, "SetVCard/GetVCard", errs)
+	data, err := vs.GetVCard(ctx, user)
+	if err != nil || !written[string(data)] {
+		t.Fatalf("GetVCard after writes: %q, %v", data, err)
+	}
+
+	errs = parallel(workers, func(int) error {
+		err := vs.DeleteVCard(ctx, user)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	expectNone(t, "DeleteVCard same", errs)
+	if _, err := vs.GetVCard(ctx, user); err != storage.ErrNotFound {
+		t.Fatalf("GetVCard after delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func vcard(i int) string {
+	return fmt.Sprintf("<vCard><FN>Alice %d</FN></vCard>", i)
+}
+
+func testConcurrentOffline(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	os := s.OfflineStore()
+	if os == nil {
+		t.Skip("OfflineStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+
+	errs := parallel(workers, func(i int) error {
+		return os.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+			ID: fmt.Sprint("msg", i), UserJID: user, FromJID: "bob@example.com",
+			Data: []byte("<message/>"), CreatedAt: time.Now(),
+		})
+	})
+	expectNone(t, "StoreOfflineMessage", errs)
+	count, err := os.CountOfflineMessages(ctx, user)
+	if err != nil || count != workers {
+		t.Fatalf("CountOfflineMessages: %d, %v, want %d", count, err, workers)
+	}
+	msgs, err := os.GetOfflineMessages(ctx, user)
+	if err != nil || len(msgs) != workers {
+		t.Fatalf("GetOfflineMessages: %d, %v, want %d", len(msgs), err, workers)
+	}
+}
@@ -0,0 +1,175 @@
+package storagetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/meszmate/xmpp-go/sasl"
+	"github.com/meszmate/xmpp-go/storage"
+	"github.com/meszmate/xmpp-go/storage/credentials"
+)
+
+// testCredentials checks that Authenticate verifies every kind of stored
+// credentials and upgrades the outdated ones to Argon2id, with SCRAM-SHA-256
+// keys for accounts that had none.
+func testCredentials(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	us := s.UserStore()
+	if us == nil {
+		t.Skip("UserStore not supported")
+	}
+	ctx := context.Background()
+
+	weak, err := credentials.Argon2id{Time: 1, Memory: 1 << 10, Threads: 1}.Hash("weak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := credentials.Hash("current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("legacy"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	scram, err := sasl.NewSCRAMCredentials("SCRAM-SHA-256", "scram", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user     storage.User
+		password string
+		upgraded bool
+	}{
+		{storage.User{Username: "plain", Password: "plain"}, "plain", true},
+		{storage.User{Username: "bcrypt", Password: string(legacy)}, "legacy", true},
+		{storage.User{Username: "weak", Password: weak}, "weak", true},
+		{storage.User{Username: "current", Password: current}, "current", false},
+		// The plaintext next to SCRAM keys is kept for other mechanisms.
+		{storage.User{
+			Username:   "scram",
+			Password:   "scram",
+			Salt:       base64.StdEncoding.EncodeToString(scram.Salt),
+			Iterations: scram.Iterations,
+			StoredKey:  base64.StdEncoding.EncodeToString(scram.StoredKey),
+			ServerKey:  base64.StdEncoding.EncodeToString(scram.ServerKey),
+		}, "scram", false},
+	} {
+		t.Run(tc.user.Username, func(t *testing.T) {
+			if err := us.CreateUser(ctx, &tc.user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if _, err := us.Authenticate(ctx, tc.user.Username, "wrong"); err != storage.ErrAuthFailed {
+				t.Fatalf("Authenticate wrong: got %v, want ErrAuthFailed", err)
+			}
+			if got, _ := us.GetUser(ctx, tc.user.Username); got.Password != tc.user.Password {
+				t.Fatal("a failed login changed the credentials")
+			}
+			if ok, err := us.Authenticate(ctx, tc.user.Username, tc.password); err != nil || !ok {
+				t.Fatalf("Authenticate: %v, %v", ok, err)
+			}
+			got, err := us.GetUser(ctx, tc.user.Username)
+			if err != nil {
+				t.Fatalf("GetUser: %v", err)
+			}
+			if upgraded := got.Password != tc.user.Password; upgraded != tc.upgraded {
+				t.Fatalf("password %q upgraded = %v, want %v", got.Password, upgraded, tc.upgraded)
+			}
+			if tc.upgraded && !strings.HasPrefix(got.Password, "$argon2id$") {
+				t.Fatalf("upgraded to %q", got.Password)
+			}
+			if tc.user.StoredKey != "" && got.StoredKey != tc.user.StoredKey {
+				t.Fatal("SCRAM keys changed")
+			}
+			// SCRAM works after a PLAIN login, whatever the account had.
+			if err := scramLogin(ctx, us, tc.user.Username, tc.password); err != nil {
+				t.Fatalf("SCRAM login: %v", err)
+			}
+			// The upgraded credentials still work.
+			if ok, err := us.Authenticate(ctx, tc.user.Username, tc.password); err != nil || !ok {
+				t.Fatalf("Authenticate again: %v, %v", ok, err)
+			}
+			if _, err := us.Authenticate(ctx, tc.user.Username, "wrong"); err != storage.ErrAuthFailed {
+				t.Fatalf("Authenticate wrong again: got %v, want ErrAuthFailed", err)
+			}
+		})
+	}
+
+	if _, err := us.Authenticate(ctx, "nobody", "x"); err != storage.ErrAuthFailed {
+		t.Fatalf("Authenticate unknown: got %v, want ErrAuthFailed", err)
+	}
+
+	// With KeepPlaintext, a plaintext password survives the upgrade for the
+	// mechanisms that need it.
+	t.Run("KeepPlaintext", func(t *testing.T) {
+		credentials.KeepPlaintext = true
+		defer func() { credentials.KeepPlaintext = false }()
+		if err := us.CreateUser(ctx, &storage.User{Username: "kept", Password: "kept"}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if ok, err := us.Authenticate(ctx, "kept", "kept"); err != nil || !ok {
+			t.Fatalf("Authenticate: %v, %v", ok, err)
+		}
+		got, err := us.GetUser(ctx, "kept")
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		if got.Password != "kept" {
+			t.Fatalf("password %q replaced", got.Password)
+		}
+		if err := scramLogin(ctx, us, "kept", "kept"); err != nil {
+			t.Fatalf("SCRAM login: %v", err)
+		}
+	})
+}
+
+// scramLogin runs a SCRAM-SHA-256 exchange for username against the keys
+// stored for the account.
+func scramLogin(ctx context.Context, us storage.UserStore, username, password string) error {
+	lookup := func(_, username string) (sasl.SCRAMCredentials, error) {
+		user, err := us.GetUser(ctx, username)
+		if err != nil {
+			return sasl.SCRAMCredentials{}, err
+		}
+		creds := sasl.SCRAMCredentials{Iterations: user.Iterations}
+		if creds.Salt, err = base64.StdEncoding.DecodeString(user.Salt); err != nil {
+			return creds, err
+		}
+		if creds.StoredKey, err = base64.StdEncoding.DecodeString(user.StoredKey); err != nil {
+			return creds, err
+		}
+		creds.ServerKey, err = base64.StdEncoding.DecodeString(user.ServerKey)
+		return creds, err
+	}
+	server, err := sasl.NewSCRAMServer("SCRAM-SHA-256", lookup, sasl.ChannelBinding{})
+	if err != nil {
+		return err
+	}
+	client := sasl.NewSCRAMSHA256(sasl.Credentials{Username: username, Password: password})
+	resp, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for !server.Completed() {
+		challenge, err := server.Next(resp)
+		if err != nil {
+			return err
+		}
+		if resp, err = client.Next(challenge); err != nil {
+			return err
+		}
+	}
+	if !client.Completed() {
+		return errors.New("client did not complete")
+	}
+	return nil
+}
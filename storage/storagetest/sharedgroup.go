@@ -0,0 +1,196 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+func testSharedGroupStore(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	gs := s.SharedGroupStore()
+	if gs == nil {
+		t.Skip("SharedGroupStore not supported")
+	}
+	ctx := context.Background()
+
+	names := func(groups []*storage.SharedGroup) string {
+		var out []string
+		for _, g := range groups {
+			out = append(out, g.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if _, err := gs.GetSharedGroup(ctx, "staff"); err != storage.ErrNotFound {
+		t.Fatalf("GetSharedGroup before create: %v, want ErrNotFound", err)
+	}
+	staff := &storage.SharedGroup{Name: "staff", Display: "Staff", Members: []string{"carol@example.com", "alice@example.com"}}
+	if err := gs.SetSharedGroup(ctx, staff); err != nil {
+		t.Fatalf("SetSharedGroup: %v", err)
+	}
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "engineering", Members: []string{"alice@example.com"}}); err != nil {
+		t.Fatalf("SetSharedGroup engineering: %v", err)
+	}
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "empty"}); err != nil {
+		t.Fatalf("SetSharedGroup empty: %v", err)
+	}
+
+	g, err := gs.GetSharedGroup(ctx, "staff")
+	if err != nil || g.Display != "Staff" || !slices.Equal(g.Members, []string{"alice@example.com", "carol@example.com"}) {
+		t.Fatalf("GetSharedGroup = %+v, %v", g, err)
+	}
+	if g.RosterGroup() != "Staff" {
+		t.Fatalf("RosterGroup = %q", g.RosterGroup())
+	}
+	groups, err := gs.ListSharedGroups(ctx)
+	if err != nil || names(groups) != "empty,engineering,staff" {
+		t.Fatalf("ListSharedGroups = %s, %v", names(groups), err)
+	}
+	if groups[0].RosterGroup() != "empty" || len(groups[0].Members) != 0 {
+		t.Fatalf("empty group = %+v", groups[0])
+	}
+
+	if err := gs.AddSharedGroupMember(ctx, "staff", "bob@example.com"); err != nil {
+		t.Fatalf("AddSharedGroupMember: %v", err)
+	}
+	if err := gs.AddSharedGroupMember(ctx, "staff", "bob@example.com"); err != nil {
+		t.Fatalf("AddSharedGroupMember again: %v", err)
+	}
+	if err := gs.AddSharedGroupMember(ctx, "nope", "bob@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("AddSharedGroupMember to a missing group: %v, want ErrNotFound", err)
+	}
+	g, err = gs.GetSharedGroup(ctx, "staff")
+	if err != nil || !slices.Equal(g.Members, []string{"alice@example.com", "bob@example.com", "carol@example.com"}) {
+		t.Fatalf("members after add = %v, %v", g, err)
+	}
+
+	groups, err = gs.GetMemberSharedGroups(ctx, "alice@example.com")
+	if err != nil || names(groups) != "engineering,staff" {
+		t.Fatalf("GetMemberSharedGroups alice = %s, %v", names(groups), err)
+	}
+	if len(groups[1].Members) != 3 {
+		t.Fatalf("member groups hold %v, want all members", groups[1].Members)
+	}
+	if groups, err := gs.GetMemberSharedGroups(ctx, "dave@example.com"); err != nil || len(groups) != 0 {
+		t.Fatalf("GetMemberSharedGroups dave = %d, %v", len(groups), err)
+	}
+
+	if err := gs.RemoveSharedGroupMember(ctx, "staff", "carol@example.com"); err != nil {
+		t.Fatalf("RemoveSharedGroupMember: %v", err)
+	}
+	if err := gs.RemoveSharedGroupMember(ctx, "staff", "carol@example.com"); err != nil {
+		t.Fatalf("RemoveSharedGroupMember again: %v", err)
+	}
+	if err := gs.RemoveSharedGroupMember(ctx, "nope", "carol@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("RemoveSharedGroupMember from a missing group: %v, want ErrNotFound", err)
+	}
+	if groups, err := gs.GetMemberSharedGroups(ctx, "carol@example.com"); err != nil || len(groups) != 0 {
+		t.Fatalf("GetMemberSharedGroups carol after removal = %s, %v", names(groups), err)
+	}
+
+	// Setting a group replaces its members.
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "staff", Members: []string{"dave@example.com"}}); err != nil {
+		t.Fatalf("SetSharedGroup replace: %v", err)
+	}
+	if groups, err := gs.GetMemberSharedGroups(ctx, "alice@example.com"); err != nil || names(groups) != "engineering" {
+		t.Fatalf("GetMemberSharedGroups alice after replace = %s, %v", names(groups), err)
+	}
+	if g, err := gs.GetSharedGroup(ctx, "staff"); err != nil || g.Display != "" || g.RosterGroup() != "staff" {
+		t.Fatalf("GetSharedGroup after replace = %+v, %v", g, err)
+	}
+
+	if err := gs.DeleteSharedGroup(ctx, "staff"); err != nil {
+		t.Fatalf("DeleteSharedGroup: %v", err)
+	}
+	if err := gs.DeleteSharedGroup(ctx, "staff"); err != storage.ErrNotFound {
+		t.Fatalf("DeleteSharedGroup again: %v, want ErrNotFound", err)
+	}
+	if groups, err := gs.GetMemberSharedGroups(ctx, "dave@example.com"); err != nil || len(groups) != 0 {
+		t.Fatalf("GetMemberSharedGroups dave after delete = %s, %v", names(groups), err)
+	}
+	// A deleted group starts over without its old members.
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "staff"}); err != nil {
+		t.Fatalf("SetSharedGroup recreate: %v", err)
+	}
+	if g, err := gs.GetSharedGroup(ctx, "staff"); err != nil || len(g.Members) != 0 {
+		t.Fatalf("recreated group = %+v, %v", g, err)
+	}
+}
+
+// testSharedRoster checks that ShareRosterGroups puts the members of shared
+// groups in each other's rosters.
+func testSharedRoster(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, func() storage.Storage { return storage.ShareRosterGroups(newStore()) })
+	rs, gs := s.RosterStore(), s.SharedGroupStore()
+	if rs == nil || gs == nil {
+		t.Skip("RosterStore or SharedGroupStore not supported")
+	}
+	ctx := context.Background()
+	const alice, bob, carol = "alice@example.com", "bob@example.com", "carol@example.com"
+
+	if err := rs.UpsertRosterItem(ctx, &storage.RosterItem{UserJID: alice, ContactJID: bob, Name: "Bobby", Subscription: "none", Ask: "subscribe", Groups: []string{"Friends"}}); err != nil {
+		t.Fatalf("UpsertRosterItem: %v", err)
+	}
+	if err := rs.SetRosterVersion(ctx, alice, "3"); err != nil {
+		t.Fatalf("SetRosterVersion: %v", err)
+	}
+	if ver, err := rs.GetRosterVersion(ctx, alice); err != nil || ver != "3" {
+		t.Fatalf("GetRosterVersion without groups = %q, %v", ver, err)
+	}
+
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "staff", Display: "Staff", Members: []string{alice, bob, carol}}); err != nil {
+		t.Fatalf("SetSharedGroup: %v", err)
+	}
+	if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "eng", Members: []string{alice, bob}}); err != nil {
+		t.Fatalf("SetSharedGroup: %v", err)
+	}
+
+	items, err := rs.GetRosterItems(ctx, alice)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("GetRosterItems = %d items, %v", len(items), err)
+	}
+	slices.SortFunc(items, func(a, b *storage.RosterItem) int { return strings.Compare(a.ContactJID, b.ContactJID) })
+	if it := items[0]; it.ContactJID != bob || it.Name != "Bobby" || it.Subscription != "both" || it.Ask != "" ||
+		strings.Join(it.Groups, ",") != "Friends,eng,Staff" {
+		t.Fatalf("stored shared contact = %+v", it)
+	}
+	if it := items[1]; it.ContactJID != carol || it.UserJID != alice || it.Subscription != "both" || strings.Join(it.Groups, ",") != "Staff" {
+		t.Fatalf("shared contact = %+v", it)
+	}
+	item, err := rs.GetRosterItem(ctx, carol, alice)
+	if err != nil || item.Subscription != "both" || strings.Join(item.Groups, ",") != "Staff" {
+		t.Fatalf("GetRosterItem = %+v, %v", item, err)
+	}
+	if _, err := rs.GetRosterItem(ctx, carol, "dave@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetRosterItem of a stranger: %v, want ErrNotFound", err)
+	}
+
+	ver, err := rs.GetRosterVersion(ctx, alice)
+	if err != nil || ver == "3" {
+		t.Fatalf("GetRosterVersion with groups = %q, %v", ver, err)
+	}
+	if _, err := strconv.ParseUint(ver, 10, 64); err != nil {
+		t.Fatalf("version %q is not a number", ver)
+	}
+	if err := gs.RemoveSharedGroupMember(ctx, "staff", carol); err != nil {
+		t.Fatalf("RemoveSharedGroupMember: %v", err)
+	}
+	if ver2, err := rs.GetRosterVersion(ctx, alice); err != nil || ver2 == ver {
+		t.Fatalf("version after a member left = %q, %v", ver2, err)
+	}
+	if items, err := rs.GetRosterItems(ctx, carol); err != nil || len(items) != 0 {
+		t.Fatalf("roster of a former member = %d items, %v", len(items), err)
+	}
+
+	if _, ok := newStore().RosterStore().(storage.RosterReplacer); ok {
+		if _, ok := rs.(storage.RosterReplacer); !ok {
+			t.Fatal("RosterReplacer of the wrapped store hidden")
+		}
+	}
+}
@@ -5,6 +5,11 @@ package storagetest
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,18 +18,77 @@ import (
 
 // TestStorage runs the full conformance test suite against a storage backend.
 func TestStorage(t *testing.T, newStore func() storage.Storage) {
+	testStores(t, newStore)
+	t.Run("Namespace", func(t *testing.T) {
+		testStores(t, func() storage.Storage {
+			s, err := storage.Namespace(newStore(), "example.org")
+			if err != nil {
+				t.Fatalf("Namespace: %v", err)
+			}
+			return s
+		})
+		t.Run("Isolation", func(t *testing.T) { testNamespaceIsolation(t, newStore) })
+	})
+	t.Run("Instrument", func(t *testing.T) { testInstrument(t, newStore) })
+	t.Run("RosterLimit", func(t *testing.T) { testRosterLimit(t, newStore) })
+	t.Run("SharedRoster", func(t *testing.T) { testSharedRoster(t, newStore) })
+	t.Run("Offload", func(t *testing.T) { testOffload(t, newStore) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newStore) })
+}
+
+// testInstrument runs the store tests through an instrumented view and
+// checks that calls and their errors reach the observer.
+func testInstrument(t *testing.T, newStore func() storage.Storage) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	var notFound int
+	observe := func(op string, d time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d < 0 {
+			t.Errorf("%s took %v", op, d)
+		}
+		calls[op]++
+		if errors.Is(err, storage.ErrNotFound) {
+			notFound++
+		}
+	}
+	testStores(t, func() storage.Storage { return storage.Instrument(newStore(), observe) })
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, op := range []string{"CreateUser", "UpsertRosterItem", "ArchiveMessage", "UpsertItem", "SetBookmark"} {
+		if calls[op] == 0 {
+			t.Errorf("no %s calls observed", op)
+		}
+	}
+	if notFound == 0 {
+		t.Error("no ErrNotFound observed")
+	}
+}
+
+func testStores(t *testing.T, newStore func() storage.Storage) {
 	t.Run("UserStore", func(t *testing.T) { testUserStore(t, newStore) })
+	t.Run("Credentials", func(t *testing.T) { testCredentials(t, newStore) })
 	t.Run("RosterStore", func(t *testing.T) { testRosterStore(t, newStore) })
 	t.Run("BlockingStore", func(t *testing.T) { testBlockingStore(t, newStore) })
 	t.Run("VCardStore", func(t *testing.T) { testVCardStore(t, newStore) })
 	t.Run("OfflineStore", func(t *testing.T) { testOfflineStore(t, newStore) })
 	t.Run("MAMStore", func(t *testing.T) { testMAMStore(t, newStore) })
+	t.Run("MAMPaging", func(t *testing.T) { testMAMPaging(t, newStore) })
+	t.Run("MAMCursors", func(t *testing.T) { testMAMCursors(t, newStore) })
+	t.Run("MAMRetention", func(t *testing.T) { testMAMRetention(t, newStore) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, newStore) })
 	t.Run("MUCRoomStore", func(t *testing.T) { testMUCRoomStore(t, newStore) })
 	t.Run("PubSubStore", func(t *testing.T) { testPubSubStore(t, newStore) })
 	t.Run("BookmarkStore", func(t *testing.T) { testBookmarkStore(t, newStore) })
+	t.Run("PushStore", func(t *testing.T) { testPushStore(t, newStore) })
+	t.Run("CapsStore", func(t *testing.T) { testCapsStore(t, newStore) })
+	t.Run("SharedGroupStore", func(t *testing.T) { testSharedGroupStore(t, newStore) })
+	t.Run("UserData", func(t *testing.T) { testUserData(t, newStore) })
 }
 
-func initStore(t *testing.T, newStore func() storage.Storage) storage.Storage {
+func initStore(t testing.TB, newStore func() storage.Storage) storage.Storage {
 	t.Helper()
 	s := newStore()
 	ctx := context.Background()
@@ -99,6 +163,17 @@ func testUserStore(t *testing.T, newStore func() storage.Storage) {
 		t.Fatalf("Authenticate after update: %v, %v", ok, err)
 	}
 
+	// List
+	if ul, ok := us.(storage.UserLister); ok {
+		if err := us.CreateUser(ctx, &storage.User{Username: "aaron", Password: "pw"}); err != nil {
+			t.Fatalf("CreateUser aaron: %v", err)
+		}
+		names, err := ul.ListUsers(ctx)
+		if err != nil || !slices.Equal(names, []string{"aaron", "alice"}) {
+			t.Fatalf("ListUsers: %v, %v", names, err)
+		}
+	}
+
 	// Delete
 	if err := us.DeleteUser(ctx, "alice"); err != nil {
 		t.Fatalf("DeleteUser: %v", err)
@@ -164,6 +239,112 @@ func testRosterStore(t *testing.T, newStore func() storage.Storage) {
 	if len(items) != 0 {
 		t.Fatalf("GetRosterItems after delete: %d", len(items))
 	}
+
+	// Replace (optional)
+	rr, ok := rs.(storage.RosterReplacer)
+	if !ok {
+		return
+	}
+	if err := rs.UpsertRosterItem(ctx, item); err != nil {
+		t.Fatalf("UpsertRosterItem: %v", err)
+	}
+	replacement := []*storage.RosterItem{
+		{UserJID: "alice@example.com", ContactJID: "carol@example.com", Subscription: "to"},
+		{UserJID: "alice@example.com", ContactJID: "dave@example.com", Subscription: "none", Ask: "subscribe", Groups: []string{"work"}},
+	}
+	if err := rr.ReplaceRosterItems(ctx, "alice@example.com", replacement, "v2"); err != nil {
+		t.Fatalf("ReplaceRosterItems: %v", err)
+	}
+	items, err = rs.GetRosterItems(ctx, "alice@example.com")
+	if err != nil || len(items) != 2 {
+		t.Fatalf("GetRosterItems after replace: %d, %v", len(items), err)
+	}
+	if _, err := rs.GetRosterItem(ctx, "alice@example.com", "bob@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("replaced item still present: %v", err)
+	}
+	got, err = rs.GetRosterItem(ctx, "alice@example.com", "dave@example.com")
+	if err != nil || got.Ask != "subscribe" || len(got.Groups) != 1 {
+		t.Fatalf("GetRosterItem after replace: %+v, %v", got, err)
+	}
+	ver, err = rs.GetRosterVersion(ctx, "alice@example.com")
+	if err != nil || ver != "v2" {
+		t.Fatalf("GetRosterVersion after replace: %q, %v", ver, err)
+	}
+}
+
+func testRosterLimit(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, func() storage.Storage { return storage.LimitRosterItems(newStore(), 2) })
+	rs := s.RosterStore()
+	if rs == nil {
+		t.Skip("RosterStore not supported")
+	}
+	ctx := context.Background()
+
+	add := func(contact, sub string) error {
+		return rs.UpsertRosterItem(ctx, &storage.RosterItem{
+			UserJID: "alice@example.com", ContactJID: contact, Subscription: sub,
+		})
+	}
+	if err := add("bob@example.com", "none"); err != nil {
+		t.Fatalf("UpsertRosterItem bob: %v", err)
+	}
+	if err := add("carol@example.com", "none"); err != nil {
+		t.Fatalf("UpsertRosterItem carol: %v", err)
+	}
+	if err := add("dave@example.com", "none"); !errors.Is(err, storage.ErrRosterLimit) {
+		t.Fatalf("UpsertRosterItem past the limit: %v, want ErrRosterLimit", err)
+	}
+	if err := add("bob@example.com", "both"); err != nil {
+		t.Fatalf("updating an existing item in a full roster: %v", err)
+	}
+	if err := rs.UpsertRosterItem(ctx, &storage.RosterItem{
+		UserJID: "bob@example.com", ContactJID: "alice@example.com", Subscription: "none",
+	}); err != nil {
+		t.Fatalf("limit applies per user: %v", err)
+	}
+	items, err := rs.GetRosterItems(ctx, "alice@example.com")
+	if err != nil || len(items) != 2 {
+		t.Fatalf("GetRosterItems: %d, %v", len(items), err)
+	}
+
+	if err := rs.DeleteRosterItem(ctx, "alice@example.com", "carol@example.com"); err != nil {
+		t.Fatalf("DeleteRosterItem: %v", err)
+	}
+	if err := add("dave@example.com", "none"); err != nil {
+		t.Fatalf("UpsertRosterItem after delete: %v", err)
+	}
+	err = rs.UpsertRosterItems(ctx, []*storage.RosterItem{
+		{UserJID: "bob@example.com", ContactJID: "carol@example.com", Subscription: "none"},
+		{UserJID: "alice@example.com", ContactJID: "erin@example.com", Subscription: "none"},
+	})
+	if !errors.Is(err, storage.ErrRosterLimit) {
+		t.Fatalf("UpsertRosterItems past the limit: %v, want ErrRosterLimit", err)
+	}
+	if _, err := rs.GetRosterItem(ctx, "bob@example.com", "carol@example.com"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("refused batch was partly written: %v", err)
+	}
+	if err := rs.UpsertRosterItems(ctx, []*storage.RosterItem{
+		{UserJID: "bob@example.com", ContactJID: "carol@example.com", Subscription: "none"},
+		{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "to"},
+	}); err != nil {
+		t.Fatalf("UpsertRosterItems within the limit: %v", err)
+	}
+
+	rr, ok := rs.(storage.RosterReplacer)
+	if !ok {
+		return
+	}
+	tooMany := []*storage.RosterItem{
+		{UserJID: "alice@example.com", ContactJID: "x@example.com", Subscription: "none"},
+		{UserJID: "alice@example.com", ContactJID: "y@example.com", Subscription: "none"},
+		{UserJID: "alice@example.com", ContactJID: "z@example.com", Subscription: "none"},
+	}
+	if err := rr.ReplaceRosterItems(ctx, "alice@example.com", tooMany, "v9"); !errors.Is(err, storage.ErrRosterLimit) {
+		t.Fatalf("ReplaceRosterItems past the limit: %v, want ErrRosterLimit", err)
+	}
+	if err := rr.ReplaceRosterItems(ctx, "alice@example.com", tooMany[:2], "v9"); err != nil {
+		t.Fatalf("ReplaceRosterItems within the limit: %v", err)
+	}
 }
 
 func testBlockingStore(t *testing.T, newStore func() storage.Storage) {
@@ -242,6 +423,32 @@ func testVCardStore(t *testing.T, newStore func() storage.Storage) {
 	}
 }
 
+func testCapsStore(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	cs := s.CapsStore()
+	if cs == nil {
+		t.Skip("CapsStore not supported")
+	}
+	ctx := context.Background()
+
+	// Verification strings are base64 and differ only in case.
+	ver := "urn:xmpp:caps#sha-256.K1Njy3HZBThlo4moOD5gBGhn0U0oK7/CbfLlIUDi6o4="
+	other := "urn:xmpp:caps#sha-256.k1Njy3HZBThlo4moOD5gBGhn0U0oK7/CbfLlIUDi6o4="
+	info := []byte("<query xmlns='http://jabber.org/protocol/disco#info'><feature var='urn:xmpp:ping'/></query>")
+	if err := cs.SetCapsInfo(ctx, ver, info); err != nil {
+		t.Fatalf("SetCapsInfo: %v", err)
+	}
+	if got, err := cs.GetCapsInfo(ctx, ver); err != nil || string(got) != string(info) {
+		t.Fatalf("GetCapsInfo: %q, %v", got, err)
+	}
+	if _, err := cs.GetCapsInfo(ctx, other); err != storage.ErrNotFound {
+		t.Fatalf("GetCapsInfo not found: got %v", err)
+	}
+	if err := cs.SetCapsInfo(ctx, ver, info); err != nil {
+		t.Fatalf("SetCapsInfo again: %v", err)
+	}
+}
+
 func testOfflineStore(t *testing.T, newStore func() storage.Storage) {
 	s := initStore(t, newStore)
 	os := s.OfflineStore()
@@ -326,16 +533,436 @@ func testMAMStore(t *testing.T, newStore func() storage.Storage) {
 		t.Fatalf("QueryMessages with filter: %d, %v", len(result.Messages), err)
 	}
 
+	// Edit (optional)
+	if me, ok := ms.(storage.MAMEditor); ok {
+		got, err := me.GetArchivedMessage(ctx, "alice@example.com", "2")
+		if err != nil || got.WithJID != "charlie@example.com" || string(got.Data) != "<msg2/>" {
+			t.Fatalf("GetArchivedMessage: %+v, %v", got, err)
+		}
+		if _, err := me.GetArchivedMessage(ctx, "bob@example.com", "2"); err != storage.ErrNotFound {
+			t.Fatalf("GetArchivedMessage of another archive: %v", err)
+		}
+		got.Data = []byte("<tombstone/>")
+		if err := me.UpdateArchivedMessage(ctx, got); err != nil {
+			t.Fatalf("UpdateArchivedMessage: %v", err)
+		}
+		result, err = ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+		if err != nil || len(result.Messages) != 2 || result.Last != "2" || string(result.Messages[1].Data) != "<tombstone/>" {
+			t.Fatalf("QueryMessages after update: %+v, %v", result, err)
+		}
+		missing := &storage.ArchivedMessage{ID: "3", UserJID: "alice@example.com", Data: []byte("<msg3/>")}
+		if err := me.UpdateArchivedMessage(ctx, missing); err != storage.ErrNotFound {
+			t.Fatalf("UpdateArchivedMessage of a missing message: %v", err)
+		}
+	}
+
+	// Preferences
+	if _, err := ms.GetMAMPrefs(ctx, "alice@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("GetMAMPrefs before set: %v", err)
+	}
+	prefs := &storage.MAMPrefs{
+		UserJID: "alice@example.com", Default: storage.MAMRoster,
+		Always: []string{"bob@example.com", "carol@example.com"}, Never: []string{"spam@example.net"},
+	}
+	if err := ms.SetMAMPrefs(ctx, prefs); err != nil {
+		t.Fatalf("SetMAMPrefs: %v", err)
+	}
+	got, err := ms.GetMAMPrefs(ctx, "alice@example.com")
+	if err != nil || got.UserJID != "alice@example.com" || got.Default != storage.MAMRoster ||
+		!slices.Equal(got.Always, prefs.Always) || !slices.Equal(got.Never, prefs.Never) {
+		t.Fatalf("GetMAMPrefs: %+v, %v", got, err)
+	}
+	if err := ms.SetMAMPrefs(ctx, &storage.MAMPrefs{UserJID: "alice@example.com", Default: storage.MAMNever}); err != nil {
+		t.Fatalf("SetMAMPrefs again: %v", err)
+	}
+	got, err = ms.GetMAMPrefs(ctx, "alice@example.com")
+	if err != nil || got.Default != storage.MAMNever || len(got.Always) != 0 || len(got.Never) != 0 {
+		t.Fatalf("GetMAMPrefs after replace: %+v, %v", got, err)
+	}
+	if _, err := ms.GetMAMPrefs(ctx, "bob@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("GetMAMPrefs of another user: %v", err)
+	}
+
 	// Delete
 	if err := ms.DeleteMessageArchive(ctx, "alice@example.com"); err != nil {
 		t.Fatalf("DeleteMessageArchive: %v", err)
 	}
+	if _, err := ms.GetMAMPrefs(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("GetMAMPrefs after deleting the archive: %v", err)
+	}
+	if err := ms.DeleteMAMPrefs(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("DeleteMAMPrefs: %v", err)
+	}
+	if _, err := ms.GetMAMPrefs(ctx, "alice@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("GetMAMPrefs after delete: %v", err)
+	}
+	if err := ms.DeleteMAMPrefs(ctx, "alice@example.com"); err != nil {
+		t.Fatalf("DeleteMAMPrefs again: %v", err)
+	}
 	result, _ = ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
 	if len(result.Messages) != 0 {
 		t.Fatalf("QueryMessages after delete: %d", len(result.Messages))
 	}
 }
 
+// testMAMRetention checks that DeleteMessagesBefore drops the oldest
+// messages of one archive and keeps its indexes consistent.
+func testMAMRetention(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ms := s.MAMStore()
+	if ms == nil {
+		t.Skip("MAMStore not supported")
+	}
+	ctx := context.Background()
+
+	base := time.Now().Truncate(time.Second)
+	var msgs []*storage.ArchivedMessage
+	for _, user := range []string{"alice@example.com", "bob@example.com"} {
+		for i := range 5 {
+			with := "bob@example.com"
+			if i%2 == 1 {
+				with = "charlie@example.com"
+			}
+			msgs = append(msgs, &storage.ArchivedMessage{
+				ID: strconv.Itoa(i), UserJID: user, WithJID: with, FromJID: with,
+				Data: []byte("<message/>"), CreatedAt: base.Add(time.Duration(i) * time.Second),
+			})
+		}
+	}
+	if err := ms.ArchiveMessages(ctx, msgs); err != nil {
+		t.Fatalf("ArchiveMessages: %v", err)
+	}
+
+	n, err := ms.DeleteMessagesBefore(ctx, "alice@example.com", base.Add(2*time.Second))
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteMessagesBefore = %d, %v; want 2", n, err)
+	}
+	res, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+	if err != nil || len(res.Messages) != 3 || res.First != "2" || res.Count != 3 {
+		t.Fatalf("QueryMessages after expiry: %+v, %v", res, err)
+	}
+	res, err = ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com", WithJID: "charlie@example.com"})
+	if err != nil || len(res.Messages) != 1 || res.First != "3" {
+		t.Fatalf("QueryMessages with charlie after expiry: %+v, %v", res, err)
+	}
+	if n, err := ms.DeleteMessagesBefore(ctx, "alice@example.com", base.Add(2*time.Second)); err != nil || n != 0 {
+		t.Fatalf("DeleteMessagesBefore again = %d, %v; want 0", n, err)
+	}
+	res, err = ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "bob@example.com"})
+	if err != nil || len(res.Messages) != 5 {
+		t.Fatalf("bob's archive: %+v, %v", res, err)
+	}
+	if n, err := ms.DeleteMessagesBefore(ctx, "nobody@example.com", base.Add(time.Hour)); err != nil || n != 0 {
+		t.Fatalf("DeleteMessagesBefore of an empty archive = %d, %v", n, err)
+	}
+}
+
+func testMAMPaging(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ms := s.MAMStore()
+	if ms == nil {
+		t.Skip("MAMStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+
+	// IDs sort differently as strings, as numbers and in time, and the
+	// messages are archived newest first, so only the timestamps give the
+	// archive order.
+	ids := []string{"5", "12", "3", "40", "1", "9", "27"}
+	base := time.Now().Truncate(time.Second)
+	for i := len(ids) - 1; i >= 0; i-- {
+		with := "bob@example.com"
+		if i%2 == 1 {
+			with = "charlie@example.com"
+		}
+		msg := &storage.ArchivedMessage{
+			ID: ids[i], UserJID: user, WithJID: with, FromJID: with,
+			Data: []byte("<message/>"), CreatedAt: base.Add(time.Duration(i) * time.Second),
+		}
+		if err := ms.ArchiveMessage(ctx, msg); err != nil {
+			t.Fatalf("ArchiveMessage %s: %v", msg.ID, err)
+		}
+	}
+	query := func(q storage.MAMQuery) *storage.MAMResult {
+		t.Helper()
+		q.UserJID = user
+		res, err := ms.QueryMessages(ctx, &q)
+		if err != nil {
+			t.Fatalf("QueryMessages %+v: %v", q, err)
+		}
+		return res
+	}
+	expect := func(name string, res *storage.MAMResult, want []string, complete bool) {
+		t.Helper()
+		got := make([]string, len(res.Messages))
+		for i, msg := range res.Messages {
+			got[i] = msg.ID
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: got %v, want %v", name, got, want)
+		}
+		if res.Complete != complete {
+			t.Fatalf("%s: Complete = %v, want %v", name, res.Complete, complete)
+		}
+		if len(want) > 0 && (res.First != want[0] || res.Last != want[len(want)-1]) {
+			t.Fatalf("%s: First, Last = %q, %q, want %q, %q", name, res.First, res.Last, want[0], want[len(want)-1])
+		}
+	}
+
+	// Oldest first.
+	expect("all", query(storage.MAMQuery{}), ids, true)
+
+	// Forward paging reconstructs the archive exactly once.
+	var paged []string
+	after := ""
+	for page := 0; ; page++ {
+		res := query(storage.MAMQuery{AfterID: after, Max: 3})
+		for _, msg := range res.Messages {
+			paged = append(paged, msg.ID)
+		}
+		if res.Complete {
+			break
+		}
+		if page > len(ids) {
+			t.Fatal("forward paging does not terminate")
+		}
+		after = res.Last
+	}
+	if strings.Join(paged, ",") != strings.Join(ids, ",") {
+		t.Fatalf("forward paging: got %v, want %v", paged, ids)
+	}
+	expect("forward page 2", query(storage.MAMQuery{AfterID: ids[2], Max: 3}), ids[3:6], false)
+
+	// Complete at the boundary: a page that ends exactly at the last
+	// message is complete, and so is the empty page after it.
+	expect("exact page", query(storage.MAMQuery{Max: len(ids)}), ids, true)
+	expect("last page", query(storage.MAMQuery{AfterID: ids[3], Max: 3}), ids[4:], true)
+	expect("after last", query(storage.MAMQuery{AfterID: ids[6], Max: 3}), nil, true)
+
+	// Backward paging returns the page right before the anchor.
+	expect("backward page 1", query(storage.MAMQuery{BeforeID: ids[6], Max: 4}), ids[2:6], false)
+	expect("backward page 2", query(storage.MAMQuery{BeforeID: ids[2], Max: 4}), ids[:2], true)
+	expect("before first", query(storage.MAMQuery{BeforeID: ids[0], Max: 4}), nil, true)
+	paged = nil
+	before := ids[6]
+	for page := 0; ; page++ {
+		res := query(storage.MAMQuery{BeforeID: before, Max: 2})
+		var got []string
+		for _, msg := range res.Messages {
+			got = append(got, msg.ID)
+		}
+		paged = append(got, paged...)
+		if res.Complete {
+			break
+		}
+		if page > len(ids) {
+			t.Fatal("backward paging does not terminate")
+		}
+		before = res.First
+	}
+	if strings.Join(paged, ",") != strings.Join(ids[:6], ",") {
+		t.Fatalf("backward paging: got %v, want %v", paged, ids[:6])
+	}
+
+	// Both anchors bound a range.
+	expect("range", query(storage.MAMQuery{AfterID: ids[1], BeforeID: ids[5]}), ids[2:5], true)
+
+	// Paging within a filtered set.
+	bob := []string{ids[0], ids[2], ids[4], ids[6]}
+	expect("with page 1", query(storage.MAMQuery{WithJID: "bob@example.com", Max: 2}), bob[:2], false)
+	expect("with page 2", query(storage.MAMQuery{WithJID: "bob@example.com", AfterID: bob[1], Max: 2}), bob[2:], true)
+
+	// Unknown anchors.
+	if _, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: user, AfterID: "missing"}); err != storage.ErrNotFound {
+		t.Fatalf("QueryMessages unknown AfterID: got %v, want ErrNotFound", err)
+	}
+	if _, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: user, BeforeID: "missing"}); err != storage.ErrNotFound {
+		t.Fatalf("QueryMessages unknown BeforeID: got %v, want ErrNotFound", err)
+	}
+}
+
+// testMAMCursors checks the result set counts, flipped pages, the last
+// page, and anchors tied in time or outside the time filters.
+func testMAMCursors(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ms := s.MAMStore()
+	if ms == nil {
+		t.Skip("MAMStore not supported")
+	}
+	ctx := context.Background()
+	const (
+		user    = "alice@example.com"
+		bob     = "bob@example.com"
+		charlie = "charlie@example.com"
+	)
+
+	if res, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: user, Last: true}); err != nil || len(res.Messages) != 0 || res.Count != 0 || !res.Complete {
+		t.Fatalf("QueryMessages of an empty archive: %+v, %v", res, err)
+	}
+
+	// In archive order; a and b, and 2 and c, are archived at the same
+	// instant and ordered by ID.
+	base := time.Now().Truncate(time.Second)
+	archive := []struct {
+		id   string
+		sec  int
+		with string
+	}{{"a", 0, bob}, {"b", 0, charlie}, {"10", 1, bob}, {"9", 2, charlie}, {"2", 3, bob}, {"c", 3, bob}, {"z", 4, charlie}}
+	for _, i := range []int{5, 1, 6, 3, 0, 4, 2} {
+		m := archive[i]
+		msg := &storage.ArchivedMessage{
+			ID: m.id, UserJID: user, WithJID: m.with, FromJID: m.with,
+			Data: []byte("<message/>"), CreatedAt: base.Add(time.Duration(m.sec) * time.Second),
+		}
+		if err := ms.ArchiveMessage(ctx, msg); err != nil {
+			t.Fatalf("ArchiveMessage %s: %v", msg.ID, err)
+		}
+	}
+	at := func(sec int) time.Time { return base.Add(time.Duration(sec) * time.Second) }
+
+	tests := []struct {
+		name     string
+		query    storage.MAMQuery
+		want     string // IDs as returned
+		first    string
+		last     string
+		count    int
+		index    int
+		complete bool
+	}{
+		{"first page", storage.MAMQuery{Max: 3}, "a,b,10", "a", "10", 7, 0, false},
+		{"after", storage.MAMQuery{AfterID: "10", Max: 2}, "9,2", "9", "2", 7, 3, false},
+		{"after tied anchor", storage.MAMQuery{AfterID: "b"}, "10,9,2,c,z", "10", "z", 7, 2, true},
+		{"after tied anchor later", storage.MAMQuery{AfterID: "2"}, "c,z", "c", "z", 7, 5, true},
+		{"before tied anchor", storage.MAMQuery{BeforeID: "c"}, "a,b,10,9,2", "a", "2", 7, 0, true},
+		{"after last", storage.MAMQuery{AfterID: "z"}, "", "", "", 7, 0, true},
+		{"last page", storage.MAMQuery{Last: true, Max: 3}, "2,c,z", "2", "z", 7, 4, false},
+		{"last page whole", storage.MAMQuery{Last: true}, "a,b,10,9,2,c,z", "a", "z", 7, 0, true},
+		{"flipped", storage.MAMQuery{Flip: true, Max: 3}, "10,b,a", "a", "10", 7, 0, false},
+		{"flipped last", storage.MAMQuery{Flip: true, Last: true, Max: 2}, "z,c", "c", "z", 7, 5, false},
+		{"flipped before", storage.MAMQuery{Flip: true, BeforeID: "9", Max: 2}, "10,b", "b", "10", 7, 1, false},
+		{"with last", storage.MAMQuery{WithJID: bob, Last: true, Max: 3}, "10,2,c", "10", "c", 4, 1, false},
+		{"with after", storage.MAMQuery{WithJID: charlie, AfterID: "b"}, "9,z", "9", "z", 3, 1, true},
+		{"instant", storage.MAMQuery{Start: at(3), End: at(3)}, "2,c", "2", "c", 2, 0, true},
+		{"anchor before start", storage.MAMQuery{Start: at(1), AfterID: "a"}, "10,9,2,c,z", "10", "z", 5, 0, true},
+		{"anchor after end", storage.MAMQuery{End: at(2), BeforeID: "z"}, "a,b,10,9", "a", "9", 4, 0, true},
+		{"filtered after", storage.MAMQuery{Start: at(1), AfterID: "9", Max: 1}, "2", "2", "2", 5, 2, false},
+	}
+	for _, tt := range tests {
+		q := tt.query
+		q.UserJID = user
+		res, err := ms.QueryMessages(ctx, &q)
+		if err != nil {
+			t.Fatalf("%s: QueryMessages: %v", tt.name, err)
+		}
+		got := make([]string, len(res.Messages))
+		for i, msg := range res.Messages {
+			got[i] = msg.ID
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, got, tt.want)
+			continue
+		}
+		if res.First != tt.first || res.Last != tt.last {
+			t.Errorf("%s: First, Last = %q, %q, want %q, %q", tt.name, res.First, res.Last, tt.first, tt.last)
+		}
+		if res.Count != tt.count {
+			t.Errorf("%s: Count = %d, want %d", tt.name, res.Count, tt.count)
+		}
+		if tt.first != "" && res.Index != tt.index {
+			t.Errorf("%s: Index = %d, want %d", tt.name, res.Index, tt.index)
+		}
+		if res.Complete != tt.complete {
+			t.Errorf("%s: Complete = %v, want %v", tt.name, res.Complete, tt.complete)
+		}
+	}
+}
+
+func testBatch(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ctx := context.Background()
+
+	if rs := s.RosterStore(); rs != nil {
+		if err := rs.UpsertRosterItem(ctx, &storage.RosterItem{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "none"}); err != nil {
+			t.Fatalf("UpsertRosterItem: %v", err)
+		}
+		if err := rs.UpsertRosterItems(ctx, nil); err != nil {
+			t.Fatalf("UpsertRosterItems with no items: %v", err)
+		}
+		if err := rs.UpsertRosterItems(ctx, []*storage.RosterItem{
+			{UserJID: "alice@example.com", ContactJID: "bob@example.com", Subscription: "both", Groups: []string{"friends"}},
+			{UserJID: "alice@example.com", ContactJID: "carol@example.com", Subscription: "to"},
+			{UserJID: "bob@example.com", ContactJID: "alice@example.com", Subscription: "both"},
+		}); err != nil {
+			t.Fatalf("UpsertRosterItems: %v", err)
+		}
+		items, err := rs.GetRosterItems(ctx, "alice@example.com")
+		if err != nil || len(items) != 2 {
+			t.Fatalf("GetRosterItems: %d, %v", len(items), err)
+		}
+		got, err := rs.GetRosterItem(ctx, "alice@example.com", "bob@example.com")
+		if err != nil || got.Subscription != "both" || len(got.Groups) != 1 {
+			t.Fatalf("GetRosterItem after batch: %+v, %v", got, err)
+		}
+		if _, err := rs.GetRosterItem(ctx, "bob@example.com", "alice@example.com"); err != nil {
+			t.Fatalf("GetRosterItem of another user: %v", err)
+		}
+	}
+
+	if ms := s.MAMStore(); ms != nil {
+		now := time.Now().Truncate(time.Millisecond)
+		if err := ms.ArchiveMessages(ctx, []*storage.ArchivedMessage{
+			{ID: "b2", UserJID: "alice@example.com", WithJID: "bob@example.com", FromJID: "bob@example.com", Data: []byte("<b2/>"), CreatedAt: now.Add(time.Second)},
+			{ID: "b1", UserJID: "alice@example.com", WithJID: "bob@example.com", FromJID: "alice@example.com", Data: []byte("<b1/>"), CreatedAt: now},
+			{ID: "b3", UserJID: "bob@example.com", WithJID: "alice@example.com", FromJID: "alice@example.com", Data: []byte("<b1/>"), CreatedAt: now},
+		}); err != nil {
+			t.Fatalf("ArchiveMessages: %v", err)
+		}
+		result, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "alice@example.com"})
+		if err != nil || len(result.Messages) != 2 || result.First != "b1" || result.Last != "b2" {
+			t.Fatalf("QueryMessages after batch: %+v, %v", result, err)
+		}
+		result, err = ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: "bob@example.com"})
+		if err != nil || len(result.Messages) != 1 {
+			t.Fatalf("QueryMessages of another user: %+v, %v", result, err)
+		}
+		if err := ms.ArchiveMessages(ctx, nil); err != nil {
+			t.Fatalf("ArchiveMessages with no messages: %v", err)
+		}
+	}
+
+	if os := s.OfflineStore(); os != nil {
+		now := time.Now()
+		for i, id := range []string{"o1", "o2", "o3"} {
+			if err := os.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+				ID: id, UserJID: "alice@example.com", FromJID: "bob@example.com",
+				Data: []byte("<message/>"), CreatedAt: now.Add(time.Duration(i) * time.Second),
+			}); err != nil {
+				t.Fatalf("StoreOfflineMessage: %v", err)
+			}
+		}
+		if err := os.StoreOfflineMessage(ctx, &storage.OfflineMessage{
+			ID: "o1", UserJID: "bob@example.com", FromJID: "alice@example.com", Data: []byte("<message/>"), CreatedAt: now,
+		}); err != nil {
+			t.Fatalf("StoreOfflineMessage: %v", err)
+		}
+		if err := os.DeleteOfflineMessagesByIDs(ctx, "alice@example.com", []string{"o1", "o3", "missing"}); err != nil {
+			t.Fatalf("DeleteOfflineMessagesByIDs: %v", err)
+		}
+		msgs, err := os.GetOfflineMessages(ctx, "alice@example.com")
+		if err != nil || len(msgs) != 1 || msgs[0].ID != "o2" {
+			t.Fatalf("GetOfflineMessages after delete by IDs: %+v, %v", msgs, err)
+		}
+		if count, err := os.CountOfflineMessages(ctx, "bob@example.com"); err != nil || count != 1 {
+			t.Fatalf("CountOfflineMessages of another user: %d, %v", count, err)
+		}
+		if err := os.DeleteOfflineMessagesByIDs(ctx, "alice@example.com", nil); err != nil {
+			t.Fatalf("DeleteOfflineMessagesByIDs with no IDs: %v", err)
+		}
+	}
+}
+
 func testMUCRoomStore(t *testing.T, newStore func() storage.Storage) {
 	s := initStore(t, newStore)
 	ms := s.MUCRoomStore()
@@ -523,3 +1150,193 @@ func testBookmarkStore(t *testing.T, newStore func() storage.Storage) {
 		t.Fatalf("GetBookmark after delete: got %v", err)
 	}
 }
+
+func testPushStore(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ps := s.PushStore()
+	if ps == nil {
+		t.Skip("PushStore not supported")
+	}
+	ctx := context.Background()
+	const user = "alice@example.com"
+	nodes := func() []string {
+		t.Helper()
+		regs, err := ps.GetPushRegistrations(ctx, user)
+		if err != nil {
+			t.Fatalf("GetPushRegistrations: %v", err)
+		}
+		var out []string
+		for _, reg := range regs {
+			if reg.UserJID != user {
+				t.Fatalf("registration of %q", reg.UserJID)
+			}
+			out = append(out, reg.JID+"/"+reg.Node)
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	for _, reg := range []*storage.PushRegistration{
+		{UserJID: user, JID: "push.example.com", Node: "phone"},
+		{UserJID: user, JID: "push.example.com", Node: "tablet", Options: []byte("<x/>")},
+		{UserJID: user, JID: "push.other.example", Node: "phone"},
+	} {
+		if err := ps.SetPushRegistration(ctx, reg); err != nil {
+			t.Fatalf("SetPushRegistration: %v", err)
+		}
+	}
+	// Re-enabling replaces the registration.
+	if err := ps.SetPushRegistration(ctx, &storage.PushRegistration{UserJID: user, JID: "push.example.com", Node: "phone", Options: []byte("<y/>")}); err != nil {
+		t.Fatalf("SetPushRegistration replace: %v", err)
+	}
+	if got := nodes(); strings.Join(got, " ") != "push.example.com/phone push.example.com/tablet push.other.example/phone" {
+		t.Fatalf("registrations = %v", got)
+	}
+	regs, _ := ps.GetPushRegistrations(ctx, user)
+	for _, reg := range regs {
+		if reg.JID == "push.example.com" && reg.Node == "phone" && string(reg.Options) != "<y/>" {
+			t.Fatalf("options = %q", reg.Options)
+		}
+	}
+
+	if err := ps.DeletePushRegistrations(ctx, user, "push.example.com", "tablet"); err != nil {
+		t.Fatalf("DeletePushRegistrations node: %v", err)
+	}
+	if got := nodes(); strings.Join(got, " ") != "push.example.com/phone push.other.example/phone" {
+		t.Fatalf("after disabling a node = %v", got)
+	}
+	if err := ps.DeletePushRegistrations(ctx, user, "push.example.com", ""); err != nil {
+		t.Fatalf("DeletePushRegistrations service: %v", err)
+	}
+	if err := ps.DeletePushRegistrations(ctx, user, "push.example.com", ""); err != nil {
+		t.Fatalf("DeletePushRegistrations again: %v", err)
+	}
+	if got := nodes(); strings.Join(got, " ") != "push.other.example/phone" {
+		t.Fatalf("after disabling a service = %v", got)
+	}
+}
+
+// testNamespaceIsolation serves two domains from one backend and checks that
+// an account with the same local part on both never sees the other's data.
+func testNamespaceIsolation(t *testing.T, newStore func() storage.Storage) {
+	backend := initStore(t, newStore)
+	ctx := context.Background()
+
+	open := func(name string) storage.Storage {
+		s, err := storage.Namespace(backend, name)
+		if err != nil {
+			t.Fatalf("Namespace(%q): %v", name, err)
+		}
+		return s
+	}
+	a, b := open("a.example"), open("b.example")
+
+	if a.UserStore() != nil {
+		if err := a.UserStore().CreateUser(ctx, &storage.User{Username: "alice", Password: "pw-a"}); err != nil {
+			t.Fatalf("CreateUser a: %v", err)
+		}
+		if err := b.UserStore().CreateUser(ctx, &storage.User{Username: "alice", Password: "pw-b"}); err != nil {
+			t.Fatalf("CreateUser b with same username: %v", err)
+		}
+		if ok, _ := b.UserStore().Authenticate(ctx, "alice", "pw-a"); ok {
+			t.Fatal("b authenticated alice with a's password")
+		}
+		u, err := a.UserStore().GetUser(ctx, "alice")
+		if err != nil || u.Username != "alice" {
+			t.Fatalf("GetUser a: %+v, %v", u, err)
+		}
+		if ul, ok := a.UserStore().(storage.UserLister); ok {
+			if err := b.UserStore().CreateUser(ctx, &storage.User{Username: "bob", Password: "pw-b"}); err != nil {
+				t.Fatalf("CreateUser b: %v", err)
+			}
+			names, err := ul.ListUsers(ctx)
+			if err != nil || !slices.Equal(names, []string{"alice"}) {
+				t.Fatalf("ListUsers a: %v, %v", names, err)
+			}
+		}
+	}
+
+	const user = "alice@shared.example"
+	if a.RosterStore() != nil {
+		if err := a.RosterStore().UpsertRosterItem(ctx, &storage.RosterItem{
+			UserJID: user, ContactJID: "bob@example.com", Subscription: "both",
+		}); err != nil {
+			t.Fatalf("UpsertRosterItem: %v", err)
+		}
+		items, err := b.RosterStore().GetRosterItems(ctx, user)
+		if err != nil || len(items) != 0 {
+			t.Fatalf("GetRosterItems b: %d items, %v", len(items), err)
+		}
+		item, err := a.RosterStore().GetRosterItem(ctx, user, "bob@example.com")
+		if err != nil || item.UserJID != user {
+			t.Fatalf("GetRosterItem a: %+v, %v", item, err)
+		}
+	}
+
+	if a.VCardStore() != nil {
+		if err := a.VCardStore().SetVCard(ctx, user, []byte("<vCard/>")); err != nil {
+			t.Fatalf("SetVCard: %v", err)
+		}
+		if _, err := b.VCardStore().GetVCard(ctx, user); err != storage.ErrNotFound {
+			t.Fatalf("GetVCard b: %v, want ErrNotFound", err)
+		}
+	}
+
+	if a.MAMStore() != nil {
+		if err := a.MAMStore().ArchiveMessage(ctx, &storage.ArchivedMessage{
+			ID: "ns-a-1", UserJID: user, WithJID: "bob@example.com",
+			FromJID: "bob@example.com", Data: []byte("<a/>"), CreatedAt: time.Now(),
+		}); err != nil {
+			t.Fatalf("ArchiveMessage: %v", err)
+		}
+		res, err := b.MAMStore().QueryMessages(ctx, &storage.MAMQuery{UserJID: user})
+		if err != nil || len(res.Messages) != 0 {
+			t.Fatalf("QueryMessages b: %v, %v", res, err)
+		}
+		res, err = a.MAMStore().QueryMessages(ctx, &storage.MAMQuery{UserJID: user})
+		if err != nil || len(res.Messages) != 1 || res.Messages[0].UserJID != user {
+			t.Fatalf("QueryMessages a: %v, %v", res, err)
+		}
+	}
+
+	if a.MUCRoomStore() != nil {
+		if err := a.MUCRoomStore().CreateRoom(ctx, &storage.MUCRoom{RoomJID: "room@conference.shared.example"}); err != nil {
+			t.Fatalf("CreateRoom: %v", err)
+		}
+		rooms, err := b.MUCRoomStore().ListRooms(ctx)
+		if err != nil || len(rooms) != 0 {
+			t.Fatalf("ListRooms b: %d rooms, %v", len(rooms), err)
+		}
+		rooms, err = a.MUCRoomStore().ListRooms(ctx)
+		if err != nil || len(rooms) != 1 || rooms[0].RoomJID != "room@conference.shared.example" {
+			t.Fatalf("ListRooms a: %v, %v", rooms, err)
+		}
+	}
+
+	if a.SharedGroupStore() != nil {
+		if err := a.SharedGroupStore().SetSharedGroup(ctx, &storage.SharedGroup{Name: "staff", Members: []string{user}}); err != nil {
+			t.Fatalf("SetSharedGroup: %v", err)
+		}
+		if _, err := b.SharedGroupStore().GetSharedGroup(ctx, "staff"); err != storage.ErrNotFound {
+			t.Fatalf("GetSharedGroup b: %v, want ErrNotFound", err)
+		}
+		groups, err := b.SharedGroupStore().GetMemberSharedGroups(ctx, user)
+		if err != nil || len(groups) != 0 {
+			t.Fatalf("GetMemberSharedGroups b: %d groups, %v", len(groups), err)
+		}
+		groups, err = a.SharedGroupStore().ListSharedGroups(ctx)
+		if err != nil || len(groups) != 1 || groups[0].Name != "staff" {
+			t.Fatalf("ListSharedGroups a: %v, %v", groups, err)
+		}
+	}
+
+	if a.PubSubStore() != nil {
+		if err := a.PubSubStore().CreateNode(ctx, &storage.PubSubNode{Host: user, NodeID: "urn:xmpp:avatar:data", Type: "leaf"}); err != nil {
+			t.Fatalf("CreateNode: %v", err)
+		}
+		nodes, err := b.PubSubStore().ListNodes(ctx, user)
+		if err != nil || len(nodes) != 0 {
+			t.Fatalf("ListNodes b: %d nodes, %v", len(nodes), err)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/storage"
+)
+
+// testUserData checks that ExportUser exports everything stored about a
+// user and DeleteUserData erases it without touching other users.
+func testUserData(t *testing.T, newStore func() storage.Storage) {
+	s := initStore(t, newStore)
+	ctx := context.Background()
+	const host = "pubsub.example.com"
+
+	populate := func(user, contact string, messages int) {
+		t.Helper()
+		userJID := user + "@example.com"
+		if us := s.UserStore(); us != nil {
+			if err := us.CreateUser(ctx, &storage.User{Username: user, Password: "secret-" + user}); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+		}
+		if rs := s.RosterStore(); rs != nil {
+			item := &storage.RosterItem{UserJID: userJID, ContactJID: contact, Name: "Contact", Subscription: "both", Groups: []string{"Friends"}}
+			if err := rs.UpsertRosterItem(ctx, item); err != nil {
+				t.Fatalf("UpsertRosterItem: %v", err)
+			}
+			if err := rs.SetRosterVersion(ctx, userJID, "v1"); err != nil {
+				t.Fatalf("SetRosterVersion: %v", err)
+			}
+		}
+		if bs := s.BlockingStore(); bs != nil {
+			if err := bs.BlockJID(ctx, userJID, "spam@example.net"); err != nil {
+				t.Fatalf("BlockJID: %v", err)
+			}
+		}
+		if vs := s.VCardStore(); vs != nil {
+			if err := vs.SetVCard(ctx, userJID, []byte("<vCard xmlns='vcard-temp'><FN>"+user+"</FN></vCard>")); err != nil {
+				t.Fatalf("SetVCard: %v", err)
+			}
+		}
+		if bs := s.BookmarkStore(); bs != nil {
+			if err := bs.SetBookmark(ctx, &storage.Bookmark{UserJID: userJID, RoomJID: "room@muc.example.com", Nick: user, Autojoin: true}); err != nil {
+				t.Fatalf("SetBookmark: %v", err)
+			}
+		}
+		if ps := s.PushStore(); ps != nil {
+			if err := ps.SetPushRegistration(ctx, &storage.PushRegistration{UserJID: userJID, JID: "push.example.net", Node: user}); err != nil {
+				t.Fatalf("SetPushRegistration: %v", err)
+			}
+		}
+		if ms := s.MUCRoomStore(); ms != nil {
+			if err := ms.SetAffiliation(ctx, &storage.MUCAffiliation{RoomJID: "room@muc.example.com", UserJID: userJID, Affiliation: "member"}); err != nil {
+				t.Fatalf("SetAffiliation: %v", err)
+			}
+		}
+		if ps := s.PubSubStore(); ps != nil {
+			if err := ps.Subscribe(ctx, &storage.PubSubSubscription{Host: host, NodeID: "news", JID: userJID, State: "subscribed"}); err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			if err := ps.CreateNode(ctx, &storage.PubSubNode{Host: userJID, NodeID: "urn:xmpp:microblog:0", Type: "leaf", Creator: userJID}); err != nil {
+				t.Fatalf("CreateNode: %v", err)
+			}
+			item := &storage.PubSubItem{Host: userJID, NodeID: "urn:xmpp:microblog:0", ItemID: "post", Publisher: userJID, Payload: []byte("<entry xmlns='http://www.w3.org/2005/Atom'/>")}
+			if err := ps.UpsertItem(ctx, item); err != nil {
+				t.Fatalf("UpsertItem: %v", err)
+			}
+		}
+		if ofs := s.OfflineStore(); ofs != nil {
+			msg := &storage.OfflineMessage{ID: user + "-offline", UserJID: userJID, FromJID: contact, Data: []byte("<message><body>while you were away</body></message>"), CreatedAt: time.Now()}
+			if err := ofs.StoreOfflineMessage(ctx, msg); err != nil {
+				t.Fatalf("StoreOfflineMessage: %v", err)
+			}
+		}
+		if ms := s.MAMStore(); ms != nil {
+			base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var msgs []*storage.ArchivedMessage
+			for i := range messages {
+				msgs = append(msgs, &storage.ArchivedMessage{
+					ID: fmt.Sprintf("%s-%03d", user, i), UserJID: userJID, WithJID: contact, FromJID: contact,
+					Data: []byte(fmt.Sprintf("<message><body>%d</body></message>", i)), CreatedAt: base.Add(time.Duration(i) * time.Second),
+				})
+			}
+			if err := ms.ArchiveMessages(ctx, msgs); err != nil {
+				t.Fatalf("ArchiveMessages: %v", err)
+			}
+			if err := ms.SetMAMPrefs(ctx, &storage.MAMPrefs{UserJID: userJID, Default: storage.MAMRoster, Never: []string{"spam@example.net"}}); err != nil {
+				t.Fatalf("SetMAMPrefs: %v", err)
+			}
+		}
+	}
+	if gs := s.SharedGroupStore(); gs != nil {
+		if err := gs.SetSharedGroup(ctx, &storage.SharedGroup{Name: "staff", Members: []string{"alice@example.com", "bob@example.com"}}); err != nil {
+			t.Fatalf("SetSharedGroup: %v", err)
+		}
+	}
+	// More messages than a page, so that the archive is exported in pages.
+	aliceMessages := storage.DefaultMAMPageSize + 5
+	populate("alice", "bob@example.com", aliceMessages)
+	populate("bob", "alice@example.com", 3)
+	if ms := s.MUCRoomStore(); ms != nil {
+		if err := ms.CreateRoom(ctx, &storage.MUCRoom{RoomJID: "room@muc.example.com", Persistent: true}); err != nil {
+			t.Fatalf("CreateRoom: %v", err)
+		}
+	}
+
+	t.Run("ExportJSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := storage.ExportUser(ctx, s, "alice@example.com", &buf, storage.ExportOptions{PubSubHosts: []string{host}}); err != nil {
+			t.Fatalf("ExportUser: %v", err)
+		}
+		if strings.Contains(buf.String(), "secret-alice") {
+			t.Fatal("export contains the password")
+		}
+		var export struct {
+			JID     string `json:"jid"`
+			Account *struct {
+				Username string `json:"username"`
+			} `json:"account"`
+			Roster *struct {
+				Version string `json:"version"`
+				Items   []struct {
+					JID    string   `json:"jid"`
+					Groups []string `json:"groups"`
+				} `json:"items"`
+			} `json:"roster"`
+			Blocklist    []struct{ JID string } `json:"blocklist"`
+			VCard        *string                `json:"vcard"`
+			Bookmarks    []json.RawMessage      `json:"bookmarks"`
+			Push         []json.RawMessage      `json:"push"`
+			MUC          []json.RawMessage      `json:"muc"`
+			SharedGroups []struct {
+				Name string `json:"name"`
+			} `json:"shared_groups"`
+			Subscriptions []json.RawMessage `json:"subscriptions"`
+			PEP           []struct {
+				Node  string `json:"node"`
+				Items []struct {
+					Payload string `json:"payload"`
+				} `json:"items"`
+			} `json:"pep"`
+			Offline      []json.RawMessage `json:"offline"`
+			ArchivePrefs *struct {
+				Default string   `json:"default"`
+				Never   []string `json:"never"`
+			} `json:"archive_prefs"`
+			Archive []struct {
+				ID     string `json:"id"`
+				Stanza string `json:"stanza"`
+			} `json:"archive"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+			t.Fatalf("export is not JSON: %v\n%s", err, buf.String())
+		}
+		if export.JID != "alice@example.com" {
+			t.Errorf("jid = %q", export.JID)
+		}
+		if s.UserStore() != nil && (export.Account == nil || export.Account.Username != "alice") {
+			t.Errorf("account = %+v", export.Account)
+		}
+		if s.RosterStore() != nil {
+			if export.Roster == nil || export.Roster.Version != "v1" || len(export.Roster.Items) != 1 ||
+				export.Roster.Items[0].JID != "bob@example.com" || len(export.Roster.Items[0].Groups) != 1 {
+				t.Errorf("roster = %+v", export.Roster)
+			}
+		}
+		if s.BlockingStore() != nil && (len(export.Blocklist) != 1 || export.Blocklist[0].JID != "spam@example.net") {
+			t.Errorf("blocklist = %+v", export.Blocklist)
+		}
+		if s.VCardStore() != nil && (export.VCard == nil || !strings.Contains(*export.VCard, "<FN>alice</FN>")) {
+			t.Errorf("vcard = %v", export.VCard)
+		}
+		for name, tc := range map[string]struct {
+			supported bool
+			got       int
+		}{
+			"bookmarks":     {s.BookmarkStore() != nil, len(export.Bookmarks)},
+			"push":          {s.PushStore() != nil, len(export.Push)},
+			"muc":           {s.MUCRoomStore() != nil, len(export.MUC)},
+			"subscriptions": {s.PubSubStore() != nil, len(export.Subscriptions)},
+			"offline":       {s.OfflineStore() != nil, len(export.Offline)},
+		} {
+			if tc.supported && tc.got != 1 {
+				t.Errorf("%d %s, want 1", tc.got, name)
+			}
+		}
+		if s.SharedGroupStore() != nil && (len(export.SharedGroups) != 1 || export.SharedGroups[0].Name != "staff") {
+			t.Errorf("shared groups = %+v", export.SharedGroups)
+		}
+		if s.PubSubStore() != nil {
+			if len(export.PEP) != 1 || len(export.PEP[0].Items) != 1 || !strings.HasPrefix(export.PEP[0].Items[0].Payload, "<entry") {
+				t.Errorf("pep = %+v", export.PEP)
+			}
+		}
+		if s.MAMStore() != nil {
+			if p := export.ArchivePrefs; p == nil || p.Default != storage.MAMRoster || len(p.Never) != 1 {
+				t.Errorf("archive prefs = %+v", p)
+			}
+			if len(export.Archive) != aliceMessages {
+				t.Fatalf("%d archived messages, want %d", len(export.Archive), aliceMessages)
+			}
+			if last := export.Archive[aliceMessages-1]; last.ID != fmt.Sprintf("alice-%03d", aliceMessages-1) || !strings.Contains(last.Stanza, "<body>") {
+				t.Errorf("last archived message = %+v", last)
+			}
+		}
+	})
+
+	t.Run("ExportXML", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := storage.ExportUser(ctx, s, "alice@example.com", &buf, storage.ExportOptions{Format: storage.ExportXML, PubSubHosts: []string{host}}); err != nil {
+			t.Fatalf("ExportUser: %v", err)
+		}
+		var export struct {
+			XMLName xml.Name `xml:"urn:xmpp-go:user-data:0 user-data"`
+			JID     string   `xml:"jid,attr"`
+			VCard   *struct {
+				FN string `xml:"vCard>FN"`
+			} `xml:"vcard"`
+			ArchivePrefs *struct {
+				Default string   `xml:"default,attr"`
+				Never   []string `xml:"never>jid"`
+			} `xml:"archive_prefs"`
+			Archive []struct {
+				ID   string `xml:"id,attr"`
+				Body string `xml:"message>body"`
+			} `xml:"archive>message"`
+		}
+		if err := xml.Unmarshal(buf.Bytes(), &export); err != nil {
+			t.Fatalf("export is not XML: %v\n%s", err, buf.String())
+		}
+		if export.JID != "alice@example.com" {
+			t.Errorf("jid = %q", export.JID)
+		}
+		if s.VCardStore() != nil && (export.VCard == nil || export.VCard.FN != "alice") {
+			t.Errorf("vcard = %+v", export.VCard)
+		}
+		if s.MAMStore() != nil && (export.ArchivePrefs == nil || export.ArchivePrefs.Default != storage.MAMRoster || len(export.ArchivePrefs.Never) != 1) {
+			t.Errorf("archive prefs = %+v", export.ArchivePrefs)
+		}
+		if s.MAMStore() != nil && (len(export.Archive) != aliceMessages || export.Archive[0].Body != "0") {
+			t.Errorf("%d archived messages, first %+v", len(export.Archive), export.Archive[0])
+		}
+	})
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		if err := storage.ExportUser(ctx, s, "alice@example.com", &bytes.Buffer{}, storage.ExportOptions{Format: "csv"}); err == nil {
+			t.Fatal("ExportUser with an unknown format succeeded")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := storage.DeleteUserData(ctx, s, "alice@example.com", host); err != nil {
+			t.Fatalf("DeleteUserData: %v", err)
+		}
+		// Erasing again finds nothing left and is not an error.
+		if err := storage.DeleteUserData(ctx, s, "alice@example.com", host); err != nil {
+			t.Fatalf("DeleteUserData again: %v", err)
+		}
+
+		for _, u := range []struct {
+			jid  string
+			kept bool
+		}{{"alice@example.com", false}, {"bob@example.com", true}} {
+			username, _, _ := strings.Cut(u.jid, "@")
+			count := func(n int, err error) int {
+				t.Helper()
+				if err != nil {
+					t.Fatalf("%s: %v", u.jid, err)
+				}
+				return n
+			}
+			check := func(what string, n int) {
+				t.Helper()
+				if (n > 0) != u.kept {
+					t.Errorf("%s: %d %s left, kept = %v", u.jid, n, what, u.kept)
+				}
+			}
+			if us := s.UserStore(); us != nil {
+				exists, err := us.UserExists(ctx, username)
+				check("accounts", count(boolCount(exists), err))
+			}
+			if rs := s.RosterStore(); rs != nil {
+				items, err := rs.GetRosterItems(ctx, u.jid)
+				check("roster items", count(len(items), err))
+			}
+			if bs := s.BlockingStore(); bs != nil {
+				blocked, err := bs.GetBlockedJIDs(ctx, u.jid)
+				check("blocked JIDs", count(len(blocked), err))
+			}
+			if vs := s.VCardStore(); vs != nil {
+				_, err := vs.GetVCard(ctx, u.jid)
+				check("vCards", boolCount(err == nil))
+			}
+			if bs := s.BookmarkStore(); bs != nil {
+				bookmarks, err := bs.GetBookmarks(ctx, u.jid)
+				check("bookmarks", count(len(bookmarks), err))
+			}
+			if ps := s.PushStore(); ps != nil {
+				regs, err := ps.GetPushRegistrations(ctx, u.jid)
+				check("push registrations", count(len(regs), err))
+			}
+			if ms := s.MUCRoomStore(); ms != nil {
+				_, err := ms.GetAffiliation(ctx, "room@muc.example.com", u.jid)
+				check("affiliations", boolCount(err == nil))
+			}
+			if gs := s.SharedGroupStore(); gs != nil {
+				groups, err := gs.GetMemberSharedGroups(ctx, u.jid)
+				check("shared groups", count(len(groups), err))
+			}
+			if ps := s.PubSubStore(); ps != nil {
+				subs, err := ps.GetUserSubscriptions(ctx, host, u.jid)
+				check("subscriptions", count(len(subs), err))
+				nodes, err := ps.ListNodes(ctx, u.jid)
+				check("PEP nodes", count(len(nodes), err))
+			}
+			if ofs := s.OfflineStore(); ofs != nil {
+				check("offline messages", count(ofs.CountOfflineMessages(ctx, u.jid)))
+			}
+			if ms := s.MAMStore(); ms != nil {
+				res, err := ms.QueryMessages(ctx, &storage.MAMQuery{UserJID: u.jid})
+				if err != nil {
+					t.Fatalf("QueryMessages: %v", err)
+				}
+				check("archived messages", len(res.Messages))
+				_, err = ms.GetMAMPrefs(ctx, u.jid)
+				check("archive preferences", boolCount(err == nil))
+			}
+		}
+	})
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -8,7 +8,7 @@ import (
 // User represents a stored user account.
 type User struct {
 	Username  string
-	Password  string // plaintext or hashed, depending on backend
+	Password  string // password hash, or deprecated plaintext; see storage/credentials
 	Salt      string // SCRAM salt (base64-encoded)
 	Iterations int   // SCRAM iteration count
 	ServerKey string // SCRAM server key (base64-encoded)
@@ -35,5 +35,14 @@ type UserStore interface {
 	UserExists(ctx context.Context, username string) (bool, error)
 
 	// Authenticate validates username and password. Returns ErrAuthFailed on mismatch.
+	// Backends implement it with credentials.Authenticate, which upgrades
+	// outdated credentials on success.
 	Authenticate(ctx context.Context, username, password string) (bool, error)
 }
+
+// UserLister is an optional interface for user stores that can enumerate
+// their accounts.
+type UserLister interface {
+	// ListUsers returns the usernames of all accounts in ascending order.
+	ListUsers(ctx context.Context) ([]string, error)
+}
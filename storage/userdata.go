@@ -0,0 +1,645 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the encoding of a user data export.
+type ExportFormat string
+
+// Export formats.
+const (
+	ExportJSON ExportFormat = "json"
+	ExportXML  ExportFormat = "xml"
+)
+
+// NSUserData is the namespace of the root element of XML exports.
+const NSUserData = "urn:xmpp-go:user-data:0"
+
+// ExportOptions configures ExportUser.
+type ExportOptions struct {
+	// Format is the encoding of the export, ExportJSON by default.
+	Format ExportFormat
+	// PubSubHosts are the pubsub services whose subscriptions of the user
+	// are exported, besides the user's own PEP service.
+	PubSubHosts []string
+	// Now stamps the export. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// ExportUser writes everything s stores about userJID, a bare JID, to w:
+// the account, roster, block list, vCard, bookmarks, push registrations,
+// MUC affiliations, shared group memberships, pubsub subscriptions, PEP
+// nodes, offline messages, and message archive with its preferences.
+// Sub-stores s does not provide are left out. The archive is read a page at
+// a time, so exports of large archives are streamed.
+//
+// Stanzas and payloads are exported as the XML they are stored as: as
+// strings in JSON and as elements in XML. Password hashes and SCRAM keys
+// are not exported.
+func ExportUser(ctx context.Context, s Storage, userJID string, w io.Writer, opts ExportOptions) error {
+	bw := bufio.NewWriter(w)
+	var e exporter
+	switch opts.Format {
+	case "", ExportJSON:
+		e = &jsonExporter{w: bw}
+	case ExportXML:
+		e = &xmlExporter{enc: xml.NewEncoder(bw)}
+	default:
+		return fmt.Errorf("storage: unknown export format %q", opts.Format)
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	if err := e.start(userJID, now().UTC()); err != nil {
+		return err
+	}
+	if err := exportUser(ctx, s, userJID, opts.PubSubHosts, e); err != nil {
+		return err
+	}
+	if err := e.end(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// DeleteUserData erases everything s stores about userJID, a bare JID: what
+// ExportUser exports, with the subscriptions on pubsubHosts, and last the
+// account itself. It carries on past failures and returns them joined, so
+// a retry only has what is left to do.
+//
+// Data other users keep about userJID, such as their roster items for it,
+// is theirs and not touched.
+func DeleteUserData(ctx context.Context, s Storage, userJID string, pubsubHosts ...string) error {
+	var errs []error
+	keep := func(err error) {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+
+	if rs := s.RosterStore(); rs != nil {
+		if rr, ok := rs.(RosterReplacer); ok {
+			keep(rr.ReplaceRosterItems(ctx, userJID, nil, ""))
+		} else {
+			items, err := rs.GetRosterItems(ctx, userJID)
+			keep(err)
+			for _, item := range items {
+				keep(rs.DeleteRosterItem(ctx, userJID, item.ContactJID))
+			}
+			keep(rs.SetRosterVersion(ctx, userJID, ""))
+		}
+	}
+
+	if bs := s.BlockingStore(); bs != nil {
+		blocked, err := bs.GetBlockedJIDs(ctx, userJID)
+		keep(err)
+		for _, j := range blocked {
+			keep(bs.UnblockJID(ctx, userJID, j))
+		}
+	}
+
+	if vs := s.VCardStore(); vs != nil {
+		keep(vs.DeleteVCard(ctx, userJID))
+	}
+
+	if bs := s.BookmarkStore(); bs != nil {
+		bookmarks, err := bs.GetBookmarks(ctx, userJID)
+		keep(err)
+		for _, bm := range bookmarks {
+			keep(bs.DeleteBookmark(ctx, userJID, bm.RoomJID))
+		}
+	}
+
+	if ps := s.PushStore(); ps != nil {
+		regs, err := ps.GetPushRegistrations(ctx, userJID)
+		keep(err)
+		for _, reg := range regs {
+			keep(ps.DeletePushRegistrations(ctx, userJID, reg.JID, ""))
+		}
+	}
+
+	if ms := s.MUCRoomStore(); ms != nil {
+		affs, err := userAffiliations(ctx, ms, userJID)
+		keep(err)
+		for _, aff := range affs {
+			keep(ms.RemoveAffiliation(ctx, aff.RoomJID, userJID))
+		}
+	}
+
+	if gs := s.SharedGroupStore(); gs != nil {
+		groups, err := gs.GetMemberSharedGroups(ctx, userJID)
+		keep(err)
+		for _, g := range groups {
+			keep(gs.RemoveSharedGroupMember(ctx, g.Name, userJID))
+		}
+	}
+
+	if ps := s.PubSubStore(); ps != nil {
+		subs, err := userSubscriptions(ctx, ps, userJID, pubsubHosts)
+		keep(err)
+		for _, sub := range subs {
+			keep(ps.Unsubscribe(ctx, sub.Host, sub.NodeID, userJID))
+		}
+		nodes, err := ps.ListNodes(ctx, userJID)
+		keep(err)
+		for _, node := range nodes {
+			keep(ps.DeleteNode(ctx, userJID, node.NodeID))
+		}
+	}
+
+	if ofs := s.OfflineStore(); ofs != nil {
+		keep(ofs.DeleteOfflineMessages(ctx, userJID))
+	}
+
+	if ms := s.MAMStore(); ms != nil {
+		keep(ms.DeleteMessageArchive(ctx, userJID))
+		keep(ms.DeleteMAMPrefs(ctx, userJID))
+	}
+
+	// The account goes last: while it exists, a failed erasure can be
+	// found and retried.
+	if us := s.UserStore(); us != nil {
+		if username, _, ok := strings.Cut(userJID, "@"); ok {
+			keep(us.DeleteUser(ctx, username))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type exportAccount struct {
+	XMLName   xml.Name  `json:"-" xml:"account"`
+	Username  string    `json:"username" xml:"username,attr"`
+	CreatedAt time.Time `json:"created_at" xml:"created,attr"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated,attr"`
+}
+
+type exportRoster struct {
+	XMLName xml.Name           `json:"-" xml:"roster"`
+	Version string             `json:"version,omitempty" xml:"ver,attr,omitempty"`
+	Items   []exportRosterItem `json:"items" xml:"item"`
+}
+
+type exportRosterItem struct {
+	JID          string   `json:"jid" xml:"jid,attr"`
+	Name         string   `json:"name,omitempty" xml:"name,attr,omitempty"`
+	Subscription string   `json:"subscription" xml:"subscription,attr"`
+	Ask          string   `json:"ask,omitempty" xml:"ask,attr,omitempty"`
+	Groups       []string `json:"groups,omitempty" xml:"group"`
+}
+
+type exportBlocked struct {
+	XMLName xml.Name `json:"-" xml:"blocked"`
+	JID     string   `json:"jid" xml:"jid,attr"`
+}
+
+type exportBookmark struct {
+	XMLName  xml.Name `json:"-" xml:"bookmark"`
+	RoomJID  string   `json:"room" xml:"room,attr"`
+	Name     string   `json:"name,omitempty" xml:"name,attr,omitempty"`
+	Nick     string   `json:"nick,omitempty" xml:"nick,attr,omitempty"`
+	Password string   `json:"password,omitempty" xml:"password,attr,omitempty"`
+	Autojoin bool     `json:"autojoin" xml:"autojoin,attr"`
+}
+
+type exportPush struct {
+	XMLName xml.Name `json:"-" xml:"push"`
+	JID     string   `json:"jid" xml:"jid,attr"`
+	Node    string   `json:"node" xml:"node,attr"`
+	Options string   `json:"options,omitempty" xml:",innerxml"`
+}
+
+type exportAffiliation struct {
+	XMLName     xml.Name `json:"-" xml:"affiliation"`
+	RoomJID     string   `json:"room" xml:"room,attr"`
+	Affiliation string   `json:"affiliation" xml:"affiliation,attr"`
+	Reason      string   `json:"reason,omitempty" xml:"reason,attr,omitempty"`
+}
+
+type exportSharedGroup struct {
+	XMLName xml.Name `json:"-" xml:"group"`
+	Name    string   `json:"name" xml:"name,attr"`
+}
+
+type exportSubscription struct {
+	XMLName xml.Name `json:"-" xml:"subscription"`
+	Host    string   `json:"host" xml:"host,attr"`
+	NodeID  string   `json:"node" xml:"node,attr"`
+	SubID   string   `json:"subid,omitempty" xml:"subid,attr,omitempty"`
+	State   string   `json:"state" xml:"state,attr"`
+}
+
+type exportNode struct {
+	XMLName xml.Name         `json:"-" xml:"node"`
+	NodeID  string           `json:"node" xml:"node,attr"`
+	Name    string           `json:"name,omitempty" xml:"name,attr,omitempty"`
+	Type    string           `json:"type" xml:"type,attr"`
+	Items   []exportNodeItem `json:"items" xml:"item"`
+}
+
+type exportNodeItem struct {
+	ID        string    `json:"id" xml:"id,attr"`
+	CreatedAt time.Time `json:"created_at" xml:"created,attr"`
+	Payload   string    `json:"payload,omitempty" xml:",innerxml"`
+}
+
+type exportArchivePrefs struct {
+	Default string   `json:"default" xml:"default,attr"`
+	Always  []string `json:"always,omitempty" xml:"always>jid"`
+	Never   []string `json:"never,omitempty" xml:"never>jid"`
+}
+
+type exportMessage struct {
+	XMLName   xml.Name  `json:"-" xml:"message"`
+	ID        string    `json:"id" xml:"id,attr"`
+	WithJID   string    `json:"with,omitempty" xml:"with,attr,omitempty"`
+	FromJID   string    `json:"from,omitempty" xml:"from,attr,omitempty"`
+	CreatedAt time.Time `json:"created_at" xml:"created,attr"`
+	Stanza    string    `json:"stanza" xml:",innerxml"`
+}
+
+func exportUser(ctx context.Context, s Storage, userJID string, pubsubHosts []string, e exporter) error {
+	if us := s.UserStore(); us != nil {
+		if username, _, ok := strings.Cut(userJID, "@"); ok {
+			switch user, err := us.GetUser(ctx, username); {
+			case err == nil:
+				acc := exportAccount{Username: user.Username, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
+				if err := e.value("account", acc); err != nil {
+					return err
+				}
+			case !errors.Is(err, ErrNotFound):
+				return err
+			}
+		}
+	}
+
+	if rs := s.RosterStore(); rs != nil {
+		items, err := rs.GetRosterItems(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		version, err := rs.GetRosterVersion(ctx, userJID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		roster := exportRoster{Version: version, Items: []exportRosterItem{}}
+		for _, item := range items {
+			roster.Items = append(roster.Items, exportRosterItem{
+				JID: item.ContactJID, Name: item.Name, Subscription: item.Subscription, Ask: item.Ask, Groups: item.Groups,
+			})
+		}
+		if err := e.value("roster", roster); err != nil {
+			return err
+		}
+	}
+
+	if bs := s.BlockingStore(); bs != nil {
+		blocked, err := bs.GetBlockedJIDs(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		if err := exportList(e, "blocklist", blocked, func(j string) any { return exportBlocked{JID: j} }); err != nil {
+			return err
+		}
+	}
+
+	if vs := s.VCardStore(); vs != nil {
+		switch data, err := vs.GetVCard(ctx, userJID); {
+		case err == nil:
+			if err := e.value("vcard", string(data)); err != nil {
+				return err
+			}
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+	}
+
+	if bs := s.BookmarkStore(); bs != nil {
+		bookmarks, err := bs.GetBookmarks(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "bookmarks", bookmarks, func(bm *Bookmark) any {
+			return exportBookmark{RoomJID: bm.RoomJID, Name: bm.Name, Nick: bm.Nick, Password: bm.Password, Autojoin: bm.Autojoin}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ps := s.PushStore(); ps != nil {
+		regs, err := ps.GetPushRegistrations(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "push", regs, func(reg *PushRegistration) any {
+			return exportPush{JID: reg.JID, Node: reg.Node, Options: string(reg.Options)}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ms := s.MUCRoomStore(); ms != nil {
+		affs, err := userAffiliations(ctx, ms, userJID)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "muc", affs, func(aff *MUCAffiliation) any {
+			return exportAffiliation{RoomJID: aff.RoomJID, Affiliation: aff.Affiliation, Reason: aff.Reason}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if gs := s.SharedGroupStore(); gs != nil {
+		groups, err := gs.GetMemberSharedGroups(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "shared_groups", groups, func(g *SharedGroup) any {
+			return exportSharedGroup{Name: g.Name}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ps := s.PubSubStore(); ps != nil {
+		subs, err := userSubscriptions(ctx, ps, userJID, pubsubHosts)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "subscriptions", subs, func(sub *PubSubSubscription) any {
+			return exportSubscription{Host: sub.Host, NodeID: sub.NodeID, SubID: sub.SubID, State: sub.State}
+		})
+		if err != nil {
+			return err
+		}
+
+		nodes, err := ps.ListNodes(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		if err := e.startList("pep"); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			items, err := ps.GetItems(ctx, userJID, node.NodeID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			n := exportNode{NodeID: node.NodeID, Name: node.Name, Type: node.Type, Items: []exportNodeItem{}}
+			for _, item := range items {
+				n.Items = append(n.Items, exportNodeItem{ID: item.ItemID, CreatedAt: item.CreatedAt, Payload: string(item.Payload)})
+			}
+			if err := e.item(n); err != nil {
+				return err
+			}
+		}
+		if err := e.endList(); err != nil {
+			return err
+		}
+	}
+
+	if ofs := s.OfflineStore(); ofs != nil {
+		msgs, err := ofs.GetOfflineMessages(ctx, userJID)
+		if err != nil {
+			return err
+		}
+		err = exportList(e, "offline", msgs, func(msg *OfflineMessage) any {
+			return exportMessage{ID: msg.ID, FromJID: msg.FromJID, CreatedAt: msg.CreatedAt, Stanza: string(msg.Data)}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ms := s.MAMStore(); ms != nil {
+		switch prefs, err := ms.GetMAMPrefs(ctx, userJID); {
+		case err == nil:
+			p := exportArchivePrefs{Default: prefs.Default, Always: prefs.Always, Never: prefs.Never}
+			if err := e.value("archive_prefs", p); err != nil {
+				return err
+			}
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+		if err := e.startList("archive"); err != nil {
+			return err
+		}
+		query := &MAMQuery{UserJID: userJID, Max: DefaultMAMPageSize}
+		for {
+			res, err := ms.QueryMessages(ctx, query)
+			if err != nil {
+				return err
+			}
+			for _, msg := range res.Messages {
+				m := exportMessage{ID: msg.ID, WithJID: msg.WithJID, FromJID: msg.FromJID, CreatedAt: msg.CreatedAt, Stanza: string(msg.Data)}
+				if err := e.item(m); err != nil {
+					return err
+				}
+			}
+			if res.Complete || len(res.Messages) == 0 {
+				break
+			}
+			query.AfterID = res.Last
+		}
+		if err := e.endList(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportList[T any](e exporter, name string, values []T, convert func(T) any) error {
+	if err := e.startList(name); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := e.item(convert(v)); err != nil {
+			return err
+		}
+	}
+	return e.endList()
+}
+
+// userAffiliations returns the affiliations of userJID in every room.
+func userAffiliations(ctx context.Context, ms MUCRoomStore, userJID string) ([]*MUCAffiliation, error) {
+	rooms, err := ms.ListRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var affs []*MUCAffiliation
+	for _, room := range rooms {
+		aff, err := ms.GetAffiliation(ctx, room.RoomJID, userJID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		affs = append(affs, aff)
+	}
+	return affs, nil
+}
+
+// userSubscriptions returns the subscriptions of userJID on the pubsub
+// services hosts.
+func userSubscriptions(ctx context.Context, ps PubSubStore, userJID string, hosts []string) ([]*PubSubSubscription, error) {
+	var subs []*PubSubSubscription
+	for _, host := range hosts {
+		hostSubs, err := ps.GetUserSubscriptions(ctx, host, userJID)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, hostSubs...)
+	}
+	return subs, nil
+}
+
+// exporter writes the sections of an export.
+type exporter interface {
+	start(userJID string, at time.Time) error
+	// value writes a section holding one value. A string value is stored
+	// XML.
+	value(name string, v any) error
+	// startList, item and endList write a section holding a list.
+	startList(name string) error
+	item(v any) error
+	endList() error
+	end() error
+}
+
+// jsonExporter writes an export as a JSON object with a member per
+// section.
+type jsonExporter struct {
+	w     *bufio.Writer
+	first bool // no item written to the current list yet
+}
+
+func (j *jsonExporter) start(userJID string, at time.Time) error {
+	if err := j.w.WriteByte('{'); err != nil {
+		return err
+	}
+	if err := j.member("jid", userJID); err != nil {
+		return err
+	}
+	if err := j.w.WriteByte(','); err != nil {
+		return err
+	}
+	return j.member("exported_at", at)
+}
+
+func (j *jsonExporter) value(name string, v any) error {
+	if err := j.w.WriteByte(','); err != nil {
+		return err
+	}
+	return j.member(name, v)
+}
+
+func (j *jsonExporter) startList(name string) error {
+	j.first = true
+	if err := j.w.WriteByte(','); err != nil {
+		return err
+	}
+	if err := j.marshal(name); err != nil {
+		return err
+	}
+	_, err := j.w.WriteString(":[")
+	return err
+}
+
+func (j *jsonExporter) item(v any) error {
+	if !j.first {
+		if err := j.w.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	j.first = false
+	return j.marshal(v)
+}
+
+func (j *jsonExporter) endList() error {
+	return j.w.WriteByte(']')
+}
+
+func (j *jsonExporter) end() error {
+	_, err := j.w.WriteString("}\n")
+	return err
+}
+
+func (j *jsonExporter) member(name string, v any) error {
+	if err := j.marshal(name); err != nil {
+		return err
+	}
+	if err := j.w.WriteByte(':'); err != nil {
+		return err
+	}
+	return j.marshal(v)
+}
+
+func (j *jsonExporter) marshal(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+// xmlExporter writes an export as a <user-data/> element with a child per
+// section.
+type xmlExporter struct {
+	enc  *xml.Encoder
+	list string // the open list section
+}
+
+func (x *xmlExporter) start(userJID string, at time.Time) error {
+	return x.enc.EncodeToken(xml.StartElement{
+		Name: xml.Name{Space: NSUserData, Local: "user-data"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "jid"}, Value: userJID},
+			{Name: xml.Name{Local: "exported"}, Value: at.Format(time.RFC3339)},
+		},
+	})
+}
+
+func (x *xmlExporter) value(name string, v any) error {
+	if raw, ok := v.(string); ok {
+		v = struct {
+			XML string `xml:",innerxml"`
+		}{raw}
+	}
+	return x.enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func (x *xmlExporter) startList(name string) error {
+	x.list = name
+	return x.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func (x *xmlExporter) item(v any) error {
+	return x.enc.Encode(v)
+}
+
+func (x *xmlExporter) endList() error {
+	return x.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: x.list}})
+}
+
+func (x *xmlExporter) end() error {
+	if err := x.enc.EncodeToken(xml.EndElement{Name: xml.Name{Space: NSUserData, Local: "user-data"}}); err != nil {
+		return err
+	}
+	return x.enc.Flush()
+}
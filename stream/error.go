@@ -2,9 +2,12 @@ package stream
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/meszmate/xmpp-go/internal/ns"
+	xmppxml "github.com/meszmate/xmpp-go/xml"
 )
 
 // Error represents an XMPP stream error (RFC 6120 §4.9).
@@ -13,6 +16,8 @@ type Error struct {
 	Condition string
 	Text      string
 	AppError  *xml.Name
+	// OtherHost is the alternate host carried by a see-other-host condition.
+	OtherHost string
 }
 
 // Stream error conditions as defined in RFC 6120 §4.9.3.
@@ -52,6 +57,39 @@ func NewError(condition, text string) *Error {
 	}
 }
 
+// NotWellFormed returns the not-well-formed stream error answering err when
+// err comes from reading XML that is not well-formed, or nil otherwise. The
+// reader rejects characters outside the XML 1.0 Char production, such as
+// NUL and most control characters, and invalid UTF-8 as syntax errors, so
+// they end the stream instead of reaching handlers and storage.
+func NotWellFormed(err error) *Error {
+	var syntax *xml.SyntaxError
+	if !errors.As(err, &syntax) {
+		return nil
+	}
+	return NewError(ErrNotWellFormed, syntax.Msg)
+}
+
+// ForReadError returns the stream error answering err from reading the
+// peer's stream, or nil when err calls for none, such as a closed
+// connection. Besides not-well-formed XML, which includes undeclared
+// namespace prefixes, a peer crossing the reader's limits gets
+// policy-violation, and one sending a document type declaration, comment
+// or processing instruction gets restricted-xml.
+func ForReadError(err error) *Error {
+	var limit *xmppxml.LimitError
+	if !errors.As(err, &limit) {
+		return NotWellFormed(err)
+	}
+	switch limit {
+	case xmppxml.ErrDTD, xmppxml.ErrComment, xmppxml.ErrProcInst:
+		return NewError(ErrRestrictedXML, limit.Msg)
+	case xmppxml.ErrUndeclaredPrefix:
+		return NewError(ErrNotWellFormed, limit.Msg)
+	}
+	return NewError(ErrPolicyViolation, limit.Msg)
+}
+
 // Error implements the error interface.
 func (e *Error) Error() string {
 	if e.Text != "" {
@@ -73,6 +111,11 @@ func (e *Error) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
 	if err := enc.EncodeToken(xml.StartElement{Name: condName}); err != nil {
 		return err
 	}
+	if e.OtherHost != "" {
+		if err := enc.EncodeToken(xml.CharData(e.OtherHost)); err != nil {
+			return err
+		}
+	}
 	if err := enc.EncodeToken(xml.EndElement{Name: condName}); err != nil {
 		return err
 	}
@@ -97,3 +140,38 @@ func (e *Error) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
 
 	return enc.EncodeToken(xml.EndElement{Name: start.Name})
 }
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (e *Error) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var data string
+			if err := dec.DecodeElement(&data, &t); err != nil {
+				return err
+			}
+			switch {
+			case t.Name.Space == ns.Streams && t.Name.Local == "text":
+				e.Text = data
+			case t.Name.Space == ns.Streams:
+				e.Condition = t.Name.Local
+				if t.Name.Local == ErrSeeOtherHost {
+					e.OtherHost = strings.TrimSpace(data)
+				}
+			default:
+				name := t.Name
+				e.AppError = &name
+			}
+		case xml.EndElement:
+			if e.Condition == "" {
+				e.Condition = ErrUndefinedCondition
+			}
+			return nil
+		}
+	}
+}
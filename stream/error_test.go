@@ -3,8 +3,12 @@ package stream
 import (
 	"bytes"
 	"encoding/xml"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
+
+	xmppxml "github.com/meszmate/xmpp-go/xml"
 )
 
 func TestNewStreamError(t *testing.T) {
@@ -63,10 +67,10 @@ func TestStreamErrorString(t *testing.T) {
 func TestStreamErrorMarshalXML(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
-		name      string
-		err       *Error
-		wantCond  string
-		wantText  string
+		name     string
+		err      *Error
+		wantCond string
+		wantText string
 	}{
 		{
 			"condition only",
@@ -99,3 +103,141 @@ func TestStreamErrorMarshalXML(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamErrorUnmarshalXML(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		input         string
+		wantCond      string
+		wantText      string
+		wantOtherHost string
+		wantApp       string
+	}{
+		{
+			"condition only",
+			`<stream:error xmlns:stream='http://etherx.jabber.org/streams'>` +
+				`<conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>`,
+			ErrConflict, "", "", "",
+		},
+		{
+			"with text and app condition",
+			`<stream:error xmlns:stream='http://etherx.jabber.org/streams'>` +
+				`<policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+				`<text xmlns='urn:ietf:params:xml:ns:xmpp-streams' xml:lang='en'>too fast</text>` +
+				`<rate-limited xmlns='urn:example:app'/></stream:error>`,
+			ErrPolicyViolation, "too fast", "", "rate-limited",
+		},
+		{
+			"see-other-host",
+			`<stream:error xmlns:stream='http://etherx.jabber.org/streams'>` +
+				`<see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>[2001:db8::1]:5222</see-other-host></stream:error>`,
+			ErrSeeOtherHost, "", "[2001:db8::1]:5222", "",
+		},
+		{
+			"missing condition",
+			`<stream:error xmlns:stream='http://etherx.jabber.org/streams'/>`,
+			ErrUndefinedCondition, "", "", "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var e Error
+			if err := xml.Unmarshal([]byte(tt.input), &e); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if e.Condition != tt.wantCond {
+				t.Errorf("Condition = %q, want %q", e.Condition, tt.wantCond)
+			}
+			if e.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", e.Text, tt.wantText)
+			}
+			if e.OtherHost != tt.wantOtherHost {
+				t.Errorf("OtherHost = %q, want %q", e.OtherHost, tt.wantOtherHost)
+			}
+			if tt.wantApp == "" && e.AppError != nil {
+				t.Errorf("AppError = %v, want nil", e.AppError)
+			}
+			if tt.wantApp != "" && (e.AppError == nil || e.AppError.Local != tt.wantApp) {
+				t.Errorf("AppError = %v, want %q", e.AppError, tt.wantApp)
+			}
+		})
+	}
+}
+
+func TestStreamErrorRoundTrip(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		in   *Error
+	}{
+		{"see-other-host", &Error{Condition: ErrSeeOtherHost, OtherHost: "xmpp2.example.com:5222"}},
+		{"with text", NewError(ErrSystemShutdown, "maintenance")},
+		{"condition only", NewError(ErrConflict, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			out, err := xml.Marshal(tt.in)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var got Error
+			if err := xml.Unmarshal(out, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got.Condition != tt.in.Condition {
+				t.Errorf("Condition = %q, want %q", got.Condition, tt.in.Condition)
+			}
+			if got.Text != tt.in.Text {
+				t.Errorf("Text = %q, want %q", got.Text, tt.in.Text)
+			}
+			if got.OtherHost != tt.in.OtherHost {
+				t.Errorf("OtherHost = %q, want %q", got.OtherHost, tt.in.OtherHost)
+			}
+		})
+	}
+}
+
+func TestNotWellFormed(t *testing.T) {
+	t.Parallel()
+	for _, input := range []string{"<a>\x00</a>", "<a>\x01</a>", "<a b='&#x8;'/>", "<a>\xff</a>", "<a></b>"} {
+		d := xml.NewDecoder(strings.NewReader(input))
+		var err error
+		for err == nil {
+			_, err = d.Token()
+		}
+		se := NotWellFormed(err)
+		if se == nil || se.Condition != ErrNotWellFormed || se.Text == "" {
+			t.Errorf("NotWellFormed(%v) for %q = %+v", err, input, se)
+		}
+	}
+
+	if se := NotWellFormed(io.ErrUnexpectedEOF); se != nil {
+		t.Errorf("NotWellFormed(ErrUnexpectedEOF) = %+v, want nil", se)
+	}
+	if se := NotWellFormed(fmt.Errorf("read: %w", &xml.SyntaxError{Msg: "bad"})); se == nil || se.Text != "bad" {
+		t.Errorf("NotWellFormed(wrapped) = %+v", se)
+	}
+}
+
+func TestForReadError(t *testing.T) {
+	t.Parallel()
+	for err, want := range map[error]string{
+		xmppxml.ErrStanzaTooLarge:                   ErrPolicyViolation,
+		fmt.Errorf("read: %w", xmppxml.ErrTooDeep):  ErrPolicyViolation,
+		xmppxml.ErrDTD:                              ErrRestrictedXML,
+		xmppxml.ErrComment:                          ErrRestrictedXML,
+		fmt.Errorf("read: %w", xmppxml.ErrProcInst): ErrRestrictedXML,
+		xmppxml.ErrUndeclaredPrefix:                 ErrNotWellFormed,
+		&xml.SyntaxError{Msg: "unexpected EOF"}:     ErrNotWellFormed,
+	} {
+		if se := ForReadError(err); se == nil || se.Condition != want {
+			t.Errorf("ForReadError(%v) = %+v, want %s", err, se, want)
+		}
+	}
+	if se := ForReadError(io.EOF); se != nil {
+		t.Errorf("ForReadError(EOF) = %+v, want nil", se)
+	}
+}
@@ -15,7 +15,7 @@ type Header struct {
 	From    jid.JID  `xml:"from,attr,omitempty"`
 	ID      string   `xml:"id,attr,omitempty"`
 	Version string   `xml:"version,attr,omitempty"`
-	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 	NS      string   `xml:"xmlns,attr,omitempty"`
 }
 
@@ -88,7 +88,7 @@ type WebSocketOpen struct {
 	From    string   `xml:"from,attr,omitempty"`
 	ID      string   `xml:"id,attr,omitempty"`
 	Version string   `xml:"version,attr,omitempty"`
-	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 }
 
 // WebSocketClose represents a WebSocket XMPP close frame (RFC 7395).
@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+// systemShutdownReconnectDelay is how long the client waits before reconnecting
+// after the server announced a system-shutdown.
+var systemShutdownReconnectDelay = 5 * time.Second
+
+// OnStreamError registers a callback invoked when the server terminates the
+// stream with <stream:error/>. The callback runs after the stream has been
+// closed and before any reconnect attempt.
+func (c *Client) OnStreamError(f func(err *stream.Error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onStreamError = f
+}
+
+// SendStreamError terminates the stream with se followed by the closing
+// stream tag (RFC 6120 §4.9). The session should be closed afterwards.
+func (s *Session) SendStreamError(ctx context.Context, se *stream.Error) error {
+	if err := s.SendElement(ctx, se); err != nil {
+		return err
+	}
+	return s.SendRaw(ctx, bytes.NewReader(stream.Close()))
+}
+
+// serve reads from the session until the stream ends, handling stream errors.
+func (c *Client) serve(s *Session) {
+	handler := c.opts.handler
+	if handler == nil {
+		handler = s.Mux()
+	}
+	err := s.Serve(c.trackDeliveries(c.callbacks.wrap(c.rosterPushes(handler))))
+
+	var se *stream.Error
+	if errors.As(err, &se) {
+		c.handleStreamError(s, se)
+		return
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = errConnectionLost
+	}
+	// A stream that can be resumed was lost rather than closed; resume it
+	// on a new connection before the server gives up on it. With
+	// WithReconnect any lost stream is re-established.
+	if c.sm != nil && c.sm.detach(s) || c.opts.backoff != nil {
+		c.dropSession(s)
+		c.reconnect(s, "", err)
+	}
+}
+
+func (c *Client) handleStreamError(s *Session, se *stream.Error) {
+	// A stream error is unrecoverable; close our side of the stream cleanly.
+	_ = s.SendRaw(context.Background(), bytes.NewReader(stream.Close()))
+
+	// The server ended the stream, so it cannot be resumed.
+	if c.sm != nil {
+		c.sm.forget()
+	}
+	c.dropSession(s)
+
+	c.mu.Lock()
+	f := c.onStreamError
+	c.mu.Unlock()
+
+	if f != nil {
+		f(se)
+	}
+
+	host, delay, ok := streamErrorReconnect(se)
+	if !ok && !(c.opts.backoff != nil && transientStreamError(se)) {
+		return
+	}
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+	if !sleep(done, delay) {
+		return
+	}
+	c.reconnect(s, host, se)
+}
+
+// dropSession closes s and, if it is still the active session, detaches it
+// from the client together with its plugins.
+func (c *Client) dropSession(s *Session) {
+	if c.sm != nil {
+		c.sm.detach(s)
+	}
+	_ = s.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == s {
+		c.session = nil
+		if c.plugins != nil {
+			_ = c.plugins.Close()
+			c.plugins = nil
+		}
+	}
+}
+
+// streamErrorReconnect reports whether a stream error warrants reconnecting,
+// and if so to which host (empty for the usual lookup) and after what delay.
+func streamErrorReconnect(se *stream.Error) (host string, delay time.Duration, ok bool) {
+	switch se.Condition {
+	case stream.ErrSeeOtherHost:
+		if se.OtherHost == "" {
+			return "", 0, false
+		}
+		return se.OtherHost, 0, true
+	case stream.ErrSystemShutdown:
+		return "", systemShutdownReconnectDelay, true
+	default:
+		return "", 0, false
+	}
+}
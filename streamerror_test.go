@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/stream"
+)
+
+func TestClientStreamErrorClosesSession(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer c2.Close()
+
+	got := make(chan *stream.Error, 1)
+	c := &Client{session: s}
+	c.OnStreamError(func(err *stream.Error) { got <- err })
+
+	go c.serve(s)
+
+	// Drain whatever the client writes back (the closing stream tag).
+	go io.Copy(io.Discard, c2)
+
+	input := `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>` +
+		`<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>replaced by new connection</text></stream:error>`
+	if _, err := c2.Write([]byte(input)); err != nil {
+		t.Fatalf("pipe Write: %v", err)
+	}
+
+	select {
+	case se := <-got:
+		if se.Condition != stream.ErrConflict {
+			t.Errorf("Condition = %q, want %q", se.Condition, stream.ErrConflict)
+		}
+		if se.Text != "replaced by new connection" {
+			t.Errorf("Text = %q", se.Text)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnStreamError was not called")
+	}
+
+	if c.Session() != nil {
+		t.Error("session should be cleared after a stream error")
+	}
+}
+
+func TestStreamErrorReconnect(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		err       *stream.Error
+		wantOK    bool
+		wantHost  string
+		wantDelay bool
+	}{
+		{"see-other-host", &stream.Error{Condition: stream.ErrSeeOtherHost, OtherHost: "xmpp2.example.com:5222"}, true, "xmpp2.example.com:5222", false},
+		{"see-other-host without host", &stream.Error{Condition: stream.ErrSeeOtherHost}, false, "", false},
+		{"system-shutdown", stream.NewError(stream.ErrSystemShutdown, ""), true, "", true},
+		{"conflict", stream.NewError(stream.ErrConflict, ""), false, "", false},
+		{"not-authorized", stream.NewError(stream.ErrNotAuthorized, ""), false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			host, delay, ok := streamErrorReconnect(tt.err)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if host != tt.wantHost {
+				t.Errorf("host = %q, want %q", host, tt.wantHost)
+			}
+			if (delay > 0) != tt.wantDelay {
+				t.Errorf("delay = %v, wantDelay %v", delay, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestClientCloseInterruptsShutdownWait(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	c := &Client{session: s, done: make(chan struct{})}
+
+	returned := make(chan struct{})
+	go func() {
+		c.handleStreamError(s, stream.NewError(stream.ErrSystemShutdown, ""))
+		close(returned)
+	}()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("handleStreamError kept waiting after Close")
+	}
+}
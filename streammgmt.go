@@ -0,0 +1,403 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/plugins/sasl2"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+)
+
+// streamMgmt is the client side of XEP-0198 Stream Management. It outlives
+// the sessions of a client so that a dropped stream can be resumed on the
+// next one without losing the stanzas the server had not acknowledged.
+type streamMgmt struct {
+	mu      sync.Mutex
+	timeout time.Duration // resumption timeout the client asks for
+	clock   clock.Clock
+
+	counts *sm.Plugin // stanza counters and the unacked queue
+	sess   *Session   // session the state is bound to
+
+	active    bool // counting stanzas on sess
+	resuming  bool // <resume/> sent, waiting for the answer
+	requested bool // an <r/> is outstanding
+
+	id        string
+	resumable bool
+	max       time.Duration // resumption timeout granted by the server
+	lost      time.Time     // when the previous session ended
+
+	// restarted is called when a resumption fails and a new stream is
+	// enabled instead, losing the state the server kept for the old one.
+	restarted func(*Session)
+}
+
+func newStreamMgmt(timeout time.Duration) *streamMgmt {
+	return &streamMgmt{timeout: timeout, clock: clock.System, counts: newSMCounts()}
+}
+
+func newSMCounts() *sm.Plugin {
+	p := sm.New()
+	// The client keeps every unacked stanza; what the server does not
+	// acknowledge must not be lost.
+	p.SetLimits(0, 0)
+	return p
+}
+
+// attach binds the state to a new session of the client. Nothing is counted
+// until stream management is enabled or resumed on it.
+func (m *streamMgmt) attach(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sess = s
+	m.active, m.resuming, m.requested = false, false, false
+	s.sm.Store(m)
+}
+
+// detach records that s has ended and reports whether its stream can be
+// resumed on a new connection.
+func (m *streamMgmt) detach(s *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sess != s {
+		return false
+	}
+	m.sess = nil
+	m.active, m.resuming = false, false
+	m.lost = m.clock.Now()
+	return m.resumable && m.id != ""
+}
+
+// resumes reports whether a resumption of the previous stream is pending on s.
+func (m *streamMgmt) resumes(s *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sess == s && m.resuming
+}
+
+// forget gives up on resuming the current stream. Unacked stanzas are kept
+// and sent again once stream management is enabled on a new stream.
+func (m *streamMgmt) forget() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.id, m.resumable = "", false
+}
+
+// canResume reports whether the stream lost at m.lost may still be resumed.
+func (m *streamMgmt) canResume() bool {
+	if !m.resumable || m.id == "" || m.lost.IsZero() {
+		return false
+	}
+	limit := m.timeout
+	if m.max > 0 && (limit <= 0 || m.max < limit) {
+		limit = m.max
+	}
+	return limit <= 0 || m.clock.Now().Sub(m.lost) <= limit
+}
+
+// negotiate resumes the previous stream or enables stream management on s
+// once the server has advertised support.
+func (m *streamMgmt) negotiate(ctx context.Context, s *Session) error {
+	if !s.HasStreamFeature(sm.Feature) {
+		return nil
+	}
+	m.mu.Lock()
+	if m.sess != s || m.active || m.resuming {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.canResume() {
+		m.resuming = true
+		resume := sm.Resume{H: m.counts.InboundCount(), PrevID: m.id}
+		m.mu.Unlock()
+		return s.SendElement(ctx, resume)
+	}
+	m.mu.Unlock()
+	return m.enable(ctx, s)
+}
+
+// enable starts a new stream management session on s. Stanzas left
+// unacknowledged by an earlier stream are sent again and may reach the
+// recipient twice, which is better than not at all.
+func (m *streamMgmt) enable(ctx context.Context, s *Session) error {
+	return m.start(s, func() error {
+		enable := sm.Enable{Resume: m.timeout > 0, Max: int(m.timeout / time.Second)}
+		return s.writer.Encode(enable)
+	})
+}
+
+// adopt takes over the stream management session that Bind2 enabled on s
+// (XEP-0386), sending again what an earlier stream left unacknowledged.
+func (m *streamMgmt) adopt(s *Session, f sasl2.InlineFeatures) error {
+	return m.start(s, func() error {
+		m.id, m.resumable = f.SMResumeID, f.SMResumeID != ""
+		m.max = time.Duration(f.SMMax) * time.Second
+		return nil
+	})
+}
+
+// start resets the counters for a new stream management session on s,
+// opened by open, and sends the stanzas left unacknowledged before.
+func (m *streamMgmt) start(s *Session, open func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leftover := m.counts.Unacked()
+	m.counts = newSMCounts()
+	m.id, m.resumable, m.max, m.lost = "", false, 0, time.Time{}
+	m.active, m.resuming, m.requested = true, false, false
+
+	if err := open(); err != nil {
+		return err
+	}
+	if err := m.track(leftover...); err != nil {
+		return err
+	}
+	for _, data := range leftover {
+		if _, err := s.writer.WriteRaw(data); err != nil {
+			return err
+		}
+	}
+	return m.sent(s, leftover)
+}
+
+// encode writes v on s, which the caller has locked. The stanzas it
+// contains are counted and kept until the peer acks them; while a
+// resumption is pending they are only queued and go out once the stream
+// is resumed.
+func (m *streamMgmt) encode(s *Session, v any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.counting(s) {
+		return s.writer.Encode(v)
+	}
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	stanzas := stanzaElements(data)
+	if err := m.track(stanzas...); err != nil {
+		return err
+	}
+	if m.resuming && len(stanzas) > 0 {
+		return nil
+	}
+	if err := s.writer.Encode(v); err != nil {
+		return err
+	}
+	return m.sent(s, stanzas)
+}
+
+// writeRaw is encode for raw XML.
+func (m *streamMgmt) writeRaw(s *Session, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.counting(s) {
+		_, err := s.writer.WriteRaw(data)
+		return err
+	}
+	stanzas := stanzaElements(data)
+	if err := m.track(stanzas...); err != nil {
+		return err
+	}
+	if m.resuming && len(stanzas) > 0 {
+		return nil
+	}
+	if _, err := s.writer.WriteRaw(data); err != nil {
+		return err
+	}
+	return m.sent(s, stanzas)
+}
+
+func (m *streamMgmt) counting(s *Session) bool {
+	return m.sess == s && (m.active || m.resuming)
+}
+
+// sent asks for an ack of the stanzas written on s.
+func (m *streamMgmt) sent(s *Session, stanzas [][]byte) error {
+	if len(stanzas) == 0 {
+		return nil
+	}
+	return m.requestAck(s)
+}
+
+// track counts stanzas about to be written and keeps them until the peer
+// acks them. It returns sm.ErrUnackedLimit, counting none of them, when
+// they do not fit within the limits of m.counts; the client sets none.
+func (m *streamMgmt) track(stanzas ...[]byte) error {
+	if err := m.counts.Enqueue(stanzas...); err != nil {
+		return err
+	}
+	for range stanzas {
+		m.counts.IncrementOutbound()
+	}
+	return nil
+}
+
+// stanzaElements returns the message, presence and iq elements at the top
+// level of data, which is what the server counts.
+func stanzaElements(data []byte) [][]byte {
+	var stanzas [][]byte
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	var begin int64
+	var isStanza bool
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err != nil {
+			return stanzas
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				begin = offset
+				switch t.Name.Local {
+				case "message", "presence", "iq":
+					isStanza = true
+				default:
+					isStanza = false
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 && isStanza {
+				stanzas = append(stanzas, data[begin:dec.InputOffset()])
+			}
+		}
+	}
+}
+
+// requestAck asks the server for an ack unless one is outstanding.
+func (m *streamMgmt) requestAck(s *Session) error {
+	if m.requested {
+		return nil
+	}
+	m.requested = true
+	return s.writer.Encode(sm.Request{})
+}
+
+// received counts a stanza read from s.
+func (m *streamMgmt) received(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sess == s && m.active {
+		m.counts.IncrementInbound()
+	}
+}
+
+// handle processes a stream management element read from s.
+func (m *streamMgmt) handle(s *Session, start *xml.StartElement) error {
+	ctx := context.Background()
+	switch start.Name.Local {
+	case "r":
+		if err := s.reader.Skip(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		ack := sm.Ack{H: m.counts.InboundCount()}
+		m.mu.Unlock()
+		return s.SendElement(ctx, ack)
+	case "a":
+		var ack sm.Ack
+		if err := s.reader.DecodeElement(&ack, start); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.counts.Ack(ack.H)
+		m.requested = false
+		m.mu.Unlock()
+		return nil
+	case "enabled":
+		var enabled sm.Enabled
+		if err := s.reader.DecodeElement(&enabled, start); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.id, m.resumable = enabled.ID, enabled.Resume
+		m.max = time.Duration(enabled.Max) * time.Second
+		m.mu.Unlock()
+		return nil
+	case "resumed":
+		var resumed sm.Resumed
+		if err := s.reader.DecodeElement(&resumed, start); err != nil {
+			return err
+		}
+		return m.resumed(s, resumed.H)
+	case "failed":
+		var failed sm.Failed
+		if err := s.reader.DecodeElement(&failed, start); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		resuming := m.resuming
+		m.counts.Ack(failed.H)
+		m.active, m.resuming = false, false
+		m.mu.Unlock()
+		if !resuming {
+			// The server refused to enable stream management.
+			return nil
+		}
+		if err := m.enable(ctx, s); err != nil {
+			return err
+		}
+		if m.restarted != nil {
+			m.restarted(s)
+		}
+		return nil
+	default:
+		return s.reader.Skip()
+	}
+}
+
+// resumed completes a resumption: the stanzas the server acknowledged with
+// h are dropped and the rest are sent again, ahead of any new stanza.
+func (m *streamMgmt) resumed(s *Session, h uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resend(s, h)
+}
+
+// resend drops the stanzas the peer acknowledged with h on resuming the
+// stream on s and sends the rest again. s and m are locked.
+func (m *streamMgmt) resend(s *Session, h uint32) error {
+	m.counts.Ack(h)
+	m.active, m.resuming, m.requested = true, false, false
+	pending := m.counts.Unacked()
+	for _, data := range pending {
+		if _, err := s.writer.WriteRaw(data); err != nil {
+			return err
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return m.requestAck(s)
+}
+
+// unacked returns the number of stanzas the server has not acknowledged.
+func (m *streamMgmt) unacked() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _ := m.counts.Pending()
+	return n
+}
+
+// Unacked returns the number of stanzas sent with stream management enabled
+// that the server has not acknowledged yet.
+func (c *Client) Unacked() int {
+	if c.sm == nil {
+		return 0
+	}
+	return c.sm.unacked()
+}
@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/meszmate/xmpp-go/plugins/sm"
+)
+
+// StreamMgmt is the server side of a XEP-0198 Stream Management session,
+// started when a client enables stream management on its stream. It counts
+// the stanzas handled in each direction and keeps those the server sent
+// until the client acks them. It outlives the session it started on, so
+// that a new stream resuming it takes over what is still unacknowledged.
+type StreamMgmt struct {
+	state *streamMgmt
+}
+
+// EnableStreamMgmt answers a client's <enable/> on s with enabled and
+// counts the stanzas sent and received on s from then on. Up to maxStanzas
+// stanzas of up to maxBytes in total are kept unacknowledged, zero for no
+// bound; beyond that, sending a stanza on s fails with sm.ErrUnackedLimit
+// and the stanza is not sent.
+func (s *Session) EnableStreamMgmt(enabled sm.Enabled, maxStanzas, maxBytes int) (*StreamMgmt, error) {
+	counts := sm.New()
+	counts.SetLimits(maxStanzas, maxBytes)
+	m := &streamMgmt{clock: s.clock, counts: counts, id: enabled.ID, resumable: enabled.Resume}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writer.Encode(enabled); err != nil {
+		return nil, err
+	}
+	m.sess, m.active = s, true
+	s.sm.Store(m)
+	return &StreamMgmt{state: m}, nil
+}
+
+// Handle processes an <r/> or <a/> element the client sent on the stream
+// of the session the stream management session is bound to. Other elements
+// are skipped.
+func (m *StreamMgmt) Handle(start *xml.StartElement) error {
+	m.state.mu.Lock()
+	s := m.state.sess
+	m.state.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return m.state.handle(s, start)
+}
+
+// Received counts a stanza the server handled. The server calls it for
+// every message, presence and iq it reads from the client.
+func (m *StreamMgmt) Received() {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	if m.state.active {
+		m.state.counts.IncrementInbound()
+	}
+}
+
+// Handled returns the number of stanzas the server handled, the h it acks.
+func (m *StreamMgmt) Handled() uint32 {
+	return m.state.counts.InboundCount()
+}
+
+// Detach unbinds the stream management session from s, whose stream has
+// ended, and reports whether it may be resumed. Stanzas sent on s are no
+// longer counted.
+func (m *StreamMgmt) Detach(s *Session) bool {
+	return m.state.detach(s)
+}
+
+// Unacked returns the stanzas the client has not acknowledged, oldest
+// first.
+func (m *StreamMgmt) Unacked() [][]byte {
+	return m.state.counts.Unacked()
+}
+
+// Resume binds the stream management session to s, on which the client
+// asked with <resume/> to resume it, acknowledging h stanzas. It answers
+// with <resumed/> and sends the stanzas still unacknowledged again, ahead
+// of any new stanza.
+func (m *StreamMgmt) Resume(s *Session, h uint32) error {
+	state := m.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	resumed := sm.Resumed{H: state.counts.InboundCount(), PrevID: state.id}
+	if err := s.writer.Encode(resumed); err != nil {
+		return err
+	}
+	state.sess, state.lost = s, time.Time{}
+	s.sm.Store(state)
+	return state.resend(s, h)
+}
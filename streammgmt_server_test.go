@@ -0,0 +1,147 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/plugins/sm"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// smClient plays the client of a server session with stream management.
+type smClient struct {
+	session  *Session
+	conn     net.Conn
+	elements chan smElement
+}
+
+func newSMClient(t *testing.T) *smClient {
+	t.Helper()
+	s, conn := newTestSession(t, WithState(StateServer))
+	t.Cleanup(func() { s.Close(); conn.Close() })
+	c := &smClient{session: s, conn: conn, elements: make(chan smElement, 16)}
+	go func() {
+		dec := xml.NewDecoder(conn)
+		for {
+			var e smElement
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			c.elements <- e
+		}
+	}()
+	return c
+}
+
+func (c *smClient) next(t *testing.T, local string) smElement {
+	t.Helper()
+	select {
+	case e := <-c.elements:
+		if e.XMLName.Local != local {
+			t.Fatalf("got <%s>%s, want <%s>", e.XMLName.Local, e.Inner, local)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no <%s> written", local)
+		return smElement{}
+	}
+}
+
+// handle has m process the stream management element data, written by the
+// client of c.
+func (c *smClient) handle(t *testing.T, m *StreamMgmt, data string) {
+	t.Helper()
+	go func() { _, _ = c.conn.Write([]byte(data)) }()
+	for {
+		tok, err := c.session.Reader().Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Space == sm.Feature.Space {
+			if err := m.Handle(&start); err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *smClient) send(body string) error {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse("alice@example.com/phone")
+	msg.SetBody(body)
+	errc := make(chan error, 1)
+	go func() { errc <- c.session.Send(context.Background(), msg) }()
+	return <-errc
+}
+
+func TestServerStreamMgmt(t *testing.T) {
+	c := newSMClient(t)
+	m, errc := (*StreamMgmt)(nil), make(chan error, 1)
+	go func() {
+		var err error
+		m, err = c.session.EnableStreamMgmt(sm.Enabled{ID: "sm-1", Resume: true, Max: 60}, 2, 0)
+		errc <- err
+	}()
+	if enabled := c.next(t, "enabled"); enabled.attr("id") != "sm-1" || enabled.attr("resume") != "true" {
+		t.Fatalf("enabled = %+v", enabled.Attrs)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("EnableStreamMgmt: %v", err)
+	}
+
+	go func() { errc <- c.send("one") }()
+	c.next(t, "message")
+	c.next(t, "r")
+	if err := <-errc; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	go func() { errc <- c.send("two") }()
+	c.next(t, "message")
+	if err := <-errc; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// The queue holds two stanzas at most.
+	if err := c.send("three"); !errors.Is(err, sm.ErrUnackedLimit) {
+		t.Fatalf("Send beyond the limit: %v", err)
+	}
+
+	c.handle(t, m, smStreamHeader+`<a xmlns='urn:xmpp:sm:3' h='1'/>`)
+	if unacked := m.Unacked(); len(unacked) != 1 || !strings.Contains(string(unacked[0]), "two") {
+		t.Fatalf("unacked = %q", unacked)
+	}
+	m.Received()
+	m.Received()
+	c.handle(t, m, `<r xmlns='urn:xmpp:sm:3'/>`)
+	if a := c.next(t, "a"); a.attr("h") != "2" {
+		t.Fatalf("a = %+v", a.Attrs)
+	}
+
+	if !m.Detach(c.session) {
+		t.Fatal("Detach: not resumable")
+	}
+	m.Received()
+	if m.Handled() != 2 {
+		t.Fatalf("handled %d after detaching", m.Handled())
+	}
+
+	// A new stream takes over what the old one left unacknowledged.
+	resumed := newSMClient(t)
+	go func() { errc <- m.Resume(resumed.session, 1) }()
+	if r := resumed.next(t, "resumed"); r.attr("h") != "2" || r.attr("previd") != "sm-1" {
+		t.Fatalf("resumed = %+v", r.Attrs)
+	}
+	if msg := resumed.next(t, "message"); !strings.Contains(msg.Inner, "two") {
+		t.Fatalf("resent %s", msg.Inner)
+	}
+	resumed.next(t, "r")
+	if err := <-errc; err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+}
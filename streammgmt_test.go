@@ -0,0 +1,324 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/clock"
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+const smStreamHeader = `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>`
+
+// smElement is an element written by the client.
+type smElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (e smElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// smServer plays the server side of a session bound to m.
+type smServer struct {
+	session  *Session
+	conn     net.Conn
+	elements chan smElement
+}
+
+func newSMServer(t *testing.T, m *streamMgmt) *smServer {
+	t.Helper()
+	s, conn := newTestSession(t)
+	t.Cleanup(func() { s.Close(); conn.Close() })
+	m.attach(s)
+	s.OnStreamFeatures(func() { _ = m.negotiate(context.Background(), s) })
+
+	p := &smServer{session: s, conn: conn, elements: make(chan smElement, 16)}
+	go func() {
+		dec := xml.NewDecoder(conn)
+		for {
+			var e smElement
+			if err := dec.Decode(&e); err != nil {
+				return
+			}
+			p.elements <- e
+		}
+	}()
+	go s.Serve(s.Mux())
+	p.write(t, smStreamHeader+`<stream:features><sm xmlns='urn:xmpp:sm:3'/></stream:features>`)
+	return p
+}
+
+func (p *smServer) write(t *testing.T, data string) {
+	t.Helper()
+	if _, err := p.conn.Write([]byte(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func (p *smServer) next(t *testing.T, local string) smElement {
+	t.Helper()
+	select {
+	case e := <-p.elements:
+		if e.XMLName.Local != local {
+			t.Fatalf("got <%s>%s, want <%s>", e.XMLName.Local, e.Inner, local)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no <%s> written", local)
+		return smElement{}
+	}
+}
+
+// sendMessage sends a message with body from the client side of p. Its
+// result is delivered on the returned channel.
+func (p *smServer) sendMessage(body string) <-chan error {
+	msg := stanza.NewMessage(stanza.MessageChat)
+	msg.To = jid.MustParse("bob@example.com")
+	msg.SetBody(body)
+	errc := make(chan error, 1)
+	go func() { errc <- p.session.Send(context.Background(), msg) }()
+	return errc
+}
+
+func waitSent(t *testing.T, errc <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send blocked")
+	}
+}
+
+// send sends a message with body and reads it, along with the ack
+// request that follows when none is outstanding.
+func (p *smServer) send(t *testing.T, body string, request bool) {
+	t.Helper()
+	errc := p.sendMessage(body)
+	p.next(t, "message")
+	if request {
+		p.next(t, "r")
+	}
+	waitSent(t, errc)
+}
+
+// enableSM negotiates stream management with a resumable id on p.
+func enableSM(t *testing.T, p *smServer) {
+	t.Helper()
+	enable := p.next(t, "enable")
+	if enable.attr("resume") != "true" || enable.attr("max") != "60" {
+		t.Fatalf("enable = %+v", enable.Attrs)
+	}
+	p.write(t, `<enabled xmlns='urn:xmpp:sm:3' id='sm-1' resume='true' max='300'/>`)
+}
+
+func waitUnacked(t *testing.T, m *streamMgmt, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for m.unacked() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("unacked = %d, want %d", m.unacked(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreamMgmtCountsAndAcks(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	p := newSMServer(t, m)
+	enableSM(t, p)
+
+	// Writing the message asks for an ack.
+	p.send(t, "one", true)
+	waitUnacked(t, m, 1)
+
+	p.write(t, `<a xmlns='urn:xmpp:sm:3' h='1'/>`)
+	waitUnacked(t, m, 0)
+
+	// Inbound stanzas are counted for the server's own ack requests.
+	p.write(t, `<message from='bob@example.com' type='chat'><body>hi</body></message><r xmlns='urn:xmpp:sm:3'/>`)
+	if a := p.next(t, "a"); a.attr("h") != "1" {
+		t.Fatalf("ack h = %q, want 1", a.attr("h"))
+	}
+}
+
+func TestStreamMgmtOneOutstandingRequest(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	p := newSMServer(t, m)
+	enableSM(t, p)
+
+	p.send(t, "one", true)
+	p.send(t, "two", false)
+	waitUnacked(t, m, 2)
+
+	p.write(t, `<a xmlns='urn:xmpp:sm:3' h='2'/>`)
+	waitUnacked(t, m, 0)
+	p.send(t, "three", true)
+}
+
+func TestStreamMgmtResume(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	fake := clock.NewFake(time.Unix(1000, 0))
+	m.clock = fake
+	p := newSMServer(t, m)
+	enableSM(t, p)
+	p.write(t, `<message from='bob@example.com' type='chat'><body>hi</body></message>`)
+
+	p.send(t, "one", true)
+	p.send(t, "two", false)
+	waitUnacked(t, m, 2)
+
+	if !m.detach(p.session) {
+		t.Fatal("detach reported the stream as not resumable")
+	}
+	p.session.Close()
+	fake.Advance(30 * time.Second)
+
+	p2 := newSMServer(t, m)
+	resume := p2.next(t, "resume")
+	if resume.attr("previd") != "sm-1" || resume.attr("h") != "1" {
+		t.Fatalf("resume = %+v", resume.Attrs)
+	}
+	// Stanzas sent before the stream is resumed wait for it.
+	waitSent(t, p2.sendMessage("three"))
+
+	p2.write(t, `<resumed xmlns='urn:xmpp:sm:3' previd='sm-1' h='1'/>`)
+	for _, want := range []string{"two", "three"} {
+		if msg := p2.next(t, "message"); !strings.Contains(msg.Inner, want) {
+			t.Fatalf("resent %s, want %s", msg.Inner, want)
+		}
+	}
+	p2.next(t, "r")
+	waitUnacked(t, m, 2)
+}
+
+func TestStreamMgmtResumeExpired(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	fake := clock.NewFake(time.Unix(1000, 0))
+	m.clock = fake
+	p := newSMServer(t, m)
+	enableSM(t, p)
+	p.send(t, "one", true)
+
+	m.detach(p.session)
+	p.session.Close()
+	fake.Advance(2 * time.Minute)
+
+	// The stream is gone, so a new one is enabled and the unacked stanza
+	// is sent on it.
+	p2 := newSMServer(t, m)
+	p2.next(t, "enable")
+	if msg := p2.next(t, "message"); !strings.Contains(msg.Inner, "one") {
+		t.Fatalf("resent %s", msg.Inner)
+	}
+	p2.next(t, "r")
+}
+
+func TestStreamMgmtResumeFailed(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	p := newSMServer(t, m)
+	enableSM(t, p)
+	p.send(t, "one", true)
+	p.send(t, "two", false)
+	waitUnacked(t, m, 2)
+	m.detach(p.session)
+	p.session.Close()
+
+	p2 := newSMServer(t, m)
+	p2.next(t, "resume")
+	p2.write(t, `<failed xmlns='urn:xmpp:sm:3' h='1'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></failed>`)
+	p2.next(t, "enable")
+	if msg := p2.next(t, "message"); !strings.Contains(msg.Inner, "two") {
+		t.Fatalf("resent %s, want two", msg.Inner)
+	}
+	p2.next(t, "r")
+	waitUnacked(t, m, 1)
+}
+
+func TestStreamMgmtForget(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(time.Minute)
+	p := newSMServer(t, m)
+	enableSM(t, p)
+	p.send(t, "one", true)
+
+	m.forget()
+	if m.detach(p.session) {
+		t.Fatal("forgotten stream reported as resumable")
+	}
+}
+
+func TestStreamMgmtWithoutResumption(t *testing.T) {
+	t.Parallel()
+	m := newStreamMgmt(0)
+	p := newSMServer(t, m)
+	enable := p.next(t, "enable")
+	if enable.attr("resume") != "" || enable.attr("max") != "" {
+		t.Fatalf("enable = %+v", enable.Attrs)
+	}
+	p.write(t, `<enabled xmlns='urn:xmpp:sm:3'/>`)
+	p.send(t, "one", true)
+	if m.detach(p.session) {
+		t.Fatal("stream without resumption reported as resumable")
+	}
+}
+
+func TestStanzaElements(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		data string
+		want []string
+	}{
+		{`<message><body>a</body></message>`, []string{`<message><body>a</body></message>`}},
+		{`<r xmlns="urn:xmpp:sm:3"/>`, nil},
+		{`<iq id="1"/><presence/>`, []string{`<iq id="1"/>`, `<presence/>`}},
+		{`<a/><message><message/></message>`, []string{`<message><message/></message>`}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, s := range stanzaElements([]byte(tt.data)) {
+			got = append(got, string(s))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("stanzaElements(%s) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestClientUnackedWithoutStreamManagement(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient(jid.MustParse("user@example.com"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.sm != nil || c.Unacked() != 0 {
+		t.Fatal("stream management enabled without WithStreamManagement")
+	}
+	c, err = NewClient(jid.MustParse("user@example.com"), "secret", WithStreamManagement(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.sm == nil || c.sm.timeout != time.Minute {
+		t.Fatal("WithStreamManagement not applied")
+	}
+}
@@ -0,0 +1,21 @@
+package xmpp
+
+import (
+	"context"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// Reply sends body to the sender of msg in msg's conversation thread
+// (XEP-0201) and returns the message sent.
+func (s *Session) Reply(ctx context.Context, msg *stanza.Message, body string) (*stanza.Message, error) {
+	reply := msg.Reply(body)
+	return reply, s.Send(ctx, reply)
+}
+
+// ReplyInSubthread sends body to the sender of msg in a new thread forked
+// from msg's thread and returns the message sent.
+func (s *Session) ReplyInSubthread(ctx context.Context, msg *stanza.Message, body string) (*stanza.Message, error) {
+	reply := msg.Fork(body)
+	return reply, s.Send(ctx, reply)
+}
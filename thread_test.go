@@ -0,0 +1,52 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/meszmate/xmpp-go/jid"
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestSessionReplyInThread(t *testing.T) {
+	s, peer := newTestSession(t)
+	defer s.Close()
+	defer peer.Close()
+
+	orig := stanza.NewMessage(stanza.MessageChat)
+	orig.From = jid.MustParse("romeo@example.net/orchard")
+	orig.SetThread("t1", "")
+
+	got := make(chan stanza.Message, 2)
+	go func() {
+		dec := xml.NewDecoder(peer)
+		for {
+			var m stanza.Message
+			if err := dec.Decode(&m); err != nil {
+				return
+			}
+			got <- m
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := s.Reply(ctx, orig, "Here"); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	sub, err := s.ReplyInSubthread(ctx, orig, "Aside")
+	if err != nil {
+		t.Fatalf("ReplyInSubthread: %v", err)
+	}
+
+	reply := <-got
+	if reply.To != orig.From || reply.ThreadID() != "t1" || reply.ParentThread() != "" || reply.Body() != "Here" {
+		t.Fatalf("reply = %+v", reply)
+	}
+	fork := <-got
+	if fork.ThreadID() != sub.ThreadID() || fork.ParentThread() != "t1" || fork.Body() != "Aside" {
+		t.Fatalf("subthread reply = %+v", fork)
+	}
+}
@@ -0,0 +1,86 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// SessionTicketPolicy controls TLS session resumption with session tickets
+// on the server side, for both Direct TLS and STARTTLS.
+//
+// Resumption saves a full handshake when a client reconnects, which matters
+// for mobile clients that reconnect often. A ticket is however an identifier
+// the client presents again, so whoever can observe connections can link a
+// resumed connection to the earlier one even when the client changed its
+// address. Privacy-sensitive deployments can disable tickets, or rotate the
+// ticket keys often so that a ticket stops working soon after it is issued.
+//
+// The zero value enables tickets with the key rotation of crypto/tls, which
+// replaces the key daily.
+type SessionTicketPolicy struct {
+	// Disabled stops the server from issuing session tickets, so every
+	// connection performs a full handshake.
+	Disabled bool
+	// Rotation is how often a new ticket key is generated. Tickets stay
+	// valid for one more period after their key was replaced, so a ticket
+	// is accepted for at most twice this long. Zero leaves the keys to
+	// crypto/tls.
+	Rotation time.Duration
+}
+
+// Apply configures config according to p. Key rotation runs in the
+// background until ctx is done.
+func (p SessionTicketPolicy) Apply(ctx context.Context, config *tls.Config) error {
+	config.SessionTicketsDisabled = p.Disabled
+	if p.Disabled || p.Rotation <= 0 {
+		return nil
+	}
+	r := &ticketRotator{config: config}
+	if err := r.rotate(); err != nil {
+		return err
+	}
+	go r.run(ctx, p.Rotation)
+	return nil
+}
+
+// ticketRotator replaces the session ticket key of a config, keeping the
+// previous key to decrypt tickets issued before the last rotation.
+type ticketRotator struct {
+	config *tls.Config
+
+	mu   sync.Mutex
+	keys [][32]byte
+}
+
+func (r *ticketRotator) run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A failed rotation keeps the current keys until the next tick.
+			_ = r.rotate()
+		}
+	}
+}
+
+func (r *ticketRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := [][32]byte{key}
+	if len(r.keys) > 0 {
+		keys = append(keys, r.keys[0])
+	}
+	r.keys = keys
+	r.config.SetSessionTicketKeys(keys)
+	return nil
+}
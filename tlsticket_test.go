@@ -0,0 +1,129 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects a client using cache to server and reports whether the
+// session was resumed.
+func handshake(t *testing.T, server *tls.Config, cache tls.ClientSessionCache) bool {
+	t.Helper()
+	// A loopback connection rather than net.Pipe, since both sides write
+	// during the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Close()
+		conn := tls.Server(c, server)
+		if err := conn.Handshake(); err != nil {
+			errc <- err
+			return
+		}
+		// TLS 1.3 tickets follow the handshake; the client reads them
+		// together with this byte.
+		_, err = conn.Write([]byte{1})
+		errc <- err
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := tls.Client(c, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache})
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+func TestSessionTicketsEnabledByDefault(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	if err := (SessionTicketPolicy{}).Apply(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, config, cache)
+	if !handshake(t, config, cache) {
+		t.Fatal("second connection was not resumed")
+	}
+}
+
+func TestSessionTicketsDisabled(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	if err := (SessionTicketPolicy{Disabled: true}).Apply(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, config, cache)
+	if handshake(t, config, cache) {
+		t.Fatal("connection resumed with tickets disabled")
+	}
+}
+
+func TestSessionTicketKeyRotation(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	r := &ticketRotator{config: config}
+	if err := r.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A ticket survives one rotation.
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, config, cache)
+	if err := r.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(t, config, cache) {
+		t.Fatal("ticket rejected after one rotation")
+	}
+
+	// But not two.
+	cache = tls.NewLRUClientSessionCache(1)
+	handshake(t, config, cache)
+	_ = r.rotate()
+	_ = r.rotate()
+	if handshake(t, config, cache) {
+		t.Fatal("ticket accepted after two rotations")
+	}
+}
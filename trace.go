@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+// TraceKey is the slog attribute key under which trace IDs are logged.
+const TraceKey = "trace_id"
+
+type traceIDKey struct{}
+
+// NewTraceID returns a random ID for correlating the handling of a stanza.
+func NewTraceID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithTraceID returns a copy of ctx carrying the trace ID id.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the trace ID carried by ctx, or "" if there is none.
+// Session.Serve assigns a fresh ID to every stanza it reads, so handlers,
+// plugins and storage calls receiving that context share the same ID.
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// TraceMiddleware assigns a trace ID to stanzas whose context has none, for
+// handlers that are invoked outside Session.Serve.
+func TraceMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, session *Session, st stanza.Stanza) error {
+			if TraceID(ctx) == "" {
+				ctx = WithTraceID(ctx, NewTraceID())
+			}
+			return next.HandleStanza(ctx, session, st)
+		})
+	}
+}
+
+// SlogMiddleware logs incoming stanzas to logger at debug level. Combined
+// with NewTraceHandler, each record carries the stanza's trace ID.
+func SlogMiddleware(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, session *Session, st stanza.Stanza) error {
+			header := st.GetHeader()
+			logger.DebugContext(ctx, "xmpp: stanza",
+				"kind", st.StanzaType(),
+				"from", header.From.String(),
+				"to", header.To.String(),
+				"id", header.ID,
+				"type", header.Type)
+			return next.HandleStanza(ctx, session, st)
+		})
+	}
+}
+
+// NewTraceHandler wraps h so that records logged with a context carrying a
+// trace ID get a TraceKey attribute, unless they have one already, as
+// those of Session.Log do.
+func NewTraceHandler(h slog.Handler) slog.Handler {
+	return traceHandler{h}
+}
+
+type traceHandler struct{ slog.Handler }
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := TraceID(ctx); id != "" && !hasAttr(r, TraceKey) {
+		r.AddAttrs(slog.String(TraceKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+func hasAttr(r slog.Record, key string) bool {
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		found = a.Key == key
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,73 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/meszmate/xmpp-go/stanza"
+)
+
+func TestServeAssignsTraceIDPerStanza(t *testing.T) {
+	t.Parallel()
+	s, c2 := newTestSession(t)
+	defer s.Close()
+	defer c2.Close()
+
+	ids := make(chan string, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(HandlerFunc(func(ctx context.Context, _ *Session, _ stanza.Stanza) error {
+			ids <- TraceID(ctx)
+			return nil
+		}))
+	}()
+
+	go func() {
+		_, _ = c2.Write([]byte(`<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>` +
+			`<message id='a'/><message id='b'/>`))
+	}()
+
+	first, second := <-ids, <-ids
+	if first == "" || second == "" || first == second {
+		t.Fatalf("trace IDs = %q, %q; want two distinct IDs", first, second)
+	}
+	c2.Close()
+	<-done
+}
+
+func TestTraceMiddlewareKeepsExistingID(t *testing.T) {
+	t.Parallel()
+	var got string
+	h := TraceMiddleware()(HandlerFunc(func(ctx context.Context, _ *Session, _ stanza.Stanza) error {
+		got = TraceID(ctx)
+		return nil
+	}))
+
+	_ = h.HandleStanza(WithTraceID(context.Background(), "abc"), nil, stanza.NewMessage(stanza.MessageChat))
+	if got != "abc" {
+		t.Errorf("TraceID = %q, want abc", got)
+	}
+	_ = h.HandleStanza(context.Background(), nil, stanza.NewMessage(stanza.MessageChat))
+	if got == "" {
+		t.Error("TraceMiddleware did not assign an ID")
+	}
+}
+
+func TestTraceHandlerAddsAttr(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := slog.New(NewTraceHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	h := SlogMiddleware(logger.With("component", "test"))(HandlerFunc(func(context.Context, *Session, stanza.Stanza) error {
+		return nil
+	}))
+	_ = h.HandleStanza(WithTraceID(context.Background(), "0123abcd"), nil, stanza.NewMessage(stanza.MessageChat))
+
+	out := buf.String()
+	if !strings.Contains(out, TraceKey+"=0123abcd") || !strings.Contains(out, "component=test") {
+		t.Errorf("log output %q lacks trace or logger attrs", out)
+	}
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// CompressionZlib is the XEP-0138 name of the zlib compression method.
+const CompressionZlib = "zlib"
+
+// ErrAlreadyCompressed is returned by StartCompression on a stream that is
+// already compressed.
+var ErrAlreadyCompressed = errors.New("transport: stream already compressed")
+
+// Compressor is implemented by transports that can compress the stream with
+// zlib after XEP-0138 negotiation.
+//
+// Compressing data that shares a stream with secrets an attacker can
+// influence leaks those secrets through the compressed length (the CRIME and
+// BREACH attacks), and TLS does not hide it. Only enable compression where
+// bandwidth matters more than that risk.
+type Compressor interface {
+	// StartCompression compresses all data written and decompresses all
+	// data read from now on.
+	StartCompression() error
+
+	// Compressed reports whether compression has been started.
+	Compressed() bool
+}
+
+// zlibStream compresses writes and decompresses reads on an underlying
+// connection. Every write is sync-flushed so that each stanza reaches the
+// peer at once, as XEP-0138 §6 requires.
+type zlibStream struct {
+	conn io.Reader
+	r    io.ReadCloser
+	w    *zlib.Writer
+}
+
+func newZlibStream(r io.Reader, w io.Writer) *zlibStream {
+	return &zlibStream{conn: r, w: zlib.NewWriter(w)}
+}
+
+// Read creates the decompressor on first use, because reading the zlib
+// header blocks until the peer sends its first compressed data.
+func (z *zlibStream) Read(p []byte) (int, error) {
+	if z.r == nil {
+		r, err := zlib.NewReader(z.conn)
+		if err != nil {
+			return 0, err
+		}
+		z.r = r
+	}
+	return z.r.Read(p)
+}
+
+func (z *zlibStream) Write(p []byte) (int, error) {
+	n, err := z.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, z.w.Flush()
+}
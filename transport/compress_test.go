@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTCPCompression(t *testing.T) {
+	t.Parallel()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tcp1 := NewTCP(c1)
+	tcp2 := NewTCP(c2)
+	var _ Compressor = tcp1
+	for _, tcp := range []*TCP{tcp1, tcp2} {
+		if err := tcp.StartCompression(); err != nil {
+			t.Fatalf("StartCompression: %v", err)
+		}
+	}
+	if !tcp1.Compressed() {
+		t.Fatal("Compressed = false after StartCompression")
+	}
+	if err := tcp1.StartCompression(); !errors.Is(err, ErrAlreadyCompressed) {
+		t.Fatalf("second StartCompression = %v, want ErrAlreadyCompressed", err)
+	}
+
+	// Each write is flushed, so the peer can read it without waiting for
+	// more data.
+	for _, msg := range []string{"<message><body>hello</body></message>", "<presence/>"} {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := tcp1.Write([]byte(msg))
+			errc <- err
+		}()
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(tcp2, buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("Read = %q, want %q", buf, msg)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/tls"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TCP implements Transport over a TCP connection.
@@ -11,6 +13,11 @@ type TCP struct {
 	mu   sync.Mutex
 	conn net.Conn
 	tls  bool
+
+	// zmu serializes compressed writes; zlib is set once by
+	// StartCompression.
+	zmu  sync.Mutex
+	zlib atomic.Pointer[zlibStream]
 }
 
 // NewTCP creates a new TCP transport from an existing connection.
@@ -21,11 +28,19 @@ func NewTCP(conn net.Conn) *TCP {
 
 // Read reads data from the connection.
 func (t *TCP) Read(p []byte) (int, error) {
+	if z := t.zlib.Load(); z != nil {
+		return z.Read(p)
+	}
 	return t.conn.Read(p)
 }
 
 // Write writes data to the connection.
 func (t *TCP) Write(p []byte) (int, error) {
+	if z := t.zlib.Load(); z != nil {
+		t.zmu.Lock()
+		defer t.zmu.Unlock()
+		return z.Write(p)
+	}
 	return t.conn.Write(p)
 }
 
@@ -59,6 +74,23 @@ func (t *TCP) StartTLS(config *tls.Config) error {
 	return nil
 }
 
+// StartCompression implements Compressor. It must be called after the
+// <compressed/> reply was written and before the restarted stream is read.
+func (t *TCP) StartCompression() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.zlib.Load() != nil {
+		return ErrAlreadyCompressed
+	}
+	t.zlib.Store(newZlibStream(t.conn, t.conn))
+	return nil
+}
+
+// Compressed implements Compressor.
+func (t *TCP) Compressed() bool {
+	return t.zlib.Load() != nil
+}
+
 // ConnectionState returns the TLS connection state.
 func (t *TCP) ConnectionState() (tls.ConnectionState, bool) {
 	t.mu.Lock()
@@ -80,6 +112,12 @@ func (t *TCP) LocalAddress() net.Addr {
 	return t.conn.LocalAddr()
 }
 
+// SetWriteDeadline sets the deadline for future Write calls.
+// A zero value disables the deadline.
+func (t *TCP) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
 // Conn returns the underlying net.Conn.
 func (t *TCP) Conn() net.Conn {
 	return t.conn
@@ -0,0 +1,158 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// WireFormat selects how a StreamWriter lays out the elements it encodes.
+type WireFormat int
+
+const (
+	// WireCompact writes elements without added whitespace. It is the
+	// default and the format to use in production.
+	WireCompact WireFormat = iota
+	// WireIndented puts every element written with Encode on its own lines,
+	// indented by nesting depth, for reading the wire while debugging.
+	WireIndented
+)
+
+// indentUnit is the indentation added per nesting level by WireIndented.
+const indentUnit = "  "
+
+// Indent re-lays out the serialized XML elements in data with one child
+// element per line, indenting each level with indent. Whitespace is only
+// added between the children of elements that hold nothing but elements,
+// so character data is never changed. Elements with text content and
+// <body/> and <html/> elements, whose inline markup is whitespace
+// sensitive, are copied exactly as they are.
+func Indent(data []byte, indent string) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	root := &node{}
+	stack := []*node{root}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{start: t.Copy()}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 || parent.start.Name != t.Name {
+				return nil, &xml.SyntaxError{Msg: "unexpected end element </" + qualified(t.Name) + ">"}
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			parent.children = append(parent.children, xml.CopyToken(tok))
+			parent.mixed = true
+		}
+	}
+	if len(stack) != 1 {
+		return nil, &xml.SyntaxError{Msg: "unexpected EOF"}
+	}
+
+	var buf bytes.Buffer
+	for i, child := range root.children {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		writeNode(&buf, child, indent, 0, true)
+	}
+	return buf.Bytes(), nil
+}
+
+// node is an element with its children, which are *node or raw tokens.
+type node struct {
+	start    xml.StartElement
+	children []any
+	// mixed is set when the element has non-element content.
+	mixed bool
+}
+
+func (n *node) verbatim() bool {
+	local := strings.ToLower(n.start.Name.Local)
+	return n.mixed || local == "body" || local == "html"
+}
+
+// writeNode writes child, laying out its element content on indented lines
+// when pretty is set.
+func writeNode(buf *bytes.Buffer, child any, indent string, depth int, pretty bool) {
+	n, ok := child.(*node)
+	if !ok {
+		writeToken(buf, child)
+		return
+	}
+	pretty = pretty && !n.verbatim()
+	writeStart(buf, n.start)
+	for _, c := range n.children {
+		if pretty {
+			buf.WriteByte('\n')
+			buf.WriteString(strings.Repeat(indent, depth+1))
+		}
+		writeNode(buf, c, indent, depth+1, pretty)
+	}
+	if pretty && len(n.children) > 0 {
+		buf.WriteByte('\n')
+		buf.WriteString(strings.Repeat(indent, depth))
+	}
+	buf.WriteString("</")
+	buf.WriteString(qualified(n.start.Name))
+	buf.WriteByte('>')
+}
+
+func writeStart(buf *bytes.Buffer, start xml.StartElement) {
+	buf.WriteByte('<')
+	buf.WriteString(qualified(start.Name))
+	for _, attr := range start.Attr {
+		buf.WriteByte(' ')
+		buf.WriteString(qualified(attr.Name))
+		buf.WriteString(`="`)
+		_ = xml.EscapeText(buf, []byte(attr.Value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('>')
+}
+
+func writeToken(buf *bytes.Buffer, tok any) {
+	switch t := tok.(type) {
+	case xml.CharData:
+		_, _ = textEscaper.WriteString(buf, string(t))
+	case xml.Comment:
+		buf.WriteString("<!--")
+		buf.Write(t)
+		buf.WriteString("-->")
+	case xml.ProcInst:
+		buf.WriteString("<?")
+		buf.WriteString(t.Target)
+		if len(t.Inst) > 0 {
+			buf.WriteByte(' ')
+			buf.Write(t.Inst)
+		}
+		buf.WriteString("?>")
+	case xml.Directive:
+		buf.WriteString("<!")
+		buf.Write(t)
+		buf.WriteByte('>')
+	}
+}
+
+// textEscaper escapes character data like encoding/xml does, leaving
+// newlines and tabs as they are.
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+// qualified returns a raw token name with its prefix.
+func qualified(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
@@ -0,0 +1,81 @@
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+)
+
+func TestIndentElementContent(t *testing.T) {
+	t.Parallel()
+	in := `<iq type="result" id="1"><query xmlns="jabber:iq:roster"><item jid="a@example.com"><group>Friends</group></item><item jid="b@example.com"></item></query></iq>`
+	want := `<iq type="result" id="1">
+  <query xmlns="jabber:iq:roster">
+    <item jid="a@example.com">
+      <group>Friends</group>
+    </item>
+    <item jid="b@example.com"></item>
+  </query>
+</iq>`
+	got, err := Indent([]byte(in), "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Indent =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIndentKeepsSignificantWhitespace(t *testing.T) {
+	t.Parallel()
+	in := `<message><body>  two  spaces
+and a newline </body><html xmlns="http://jabber.org/protocol/xhtml-im"><body xmlns="http://www.w3.org/1999/xhtml"><p><b>bold</b><i>italic</i></p></body></html><x:note xmlns:x="urn:example">a &amp; <y>b</y></x:note></message>`
+	want := `<message>
+  <body>  two  spaces
+and a newline </body>
+  <html xmlns="http://jabber.org/protocol/xhtml-im"><body xmlns="http://www.w3.org/1999/xhtml"><p><b>bold</b><i>italic</i></p></body></html>
+  <x:note xmlns:x="urn:example">a &amp; <y>b</y></x:note>
+</message>`
+	got, err := Indent([]byte(in), "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Indent =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIndentRoundTrip(t *testing.T) {
+	t.Parallel()
+	type msg struct {
+		XMLName xml.Name `xml:"jabber:client message"`
+		To      string   `xml:"to,attr"`
+		Body    string   `xml:"body"`
+		Thread  string   `xml:"thread"`
+	}
+	in := msg{To: `o'brien@example.com`, Body: "line one\n  line <two>", Thread: "t1"}
+
+	var buf bytes.Buffer
+	sw := NewStreamWriter(&buf)
+	sw.SetFormat(WireIndented)
+	if err := sw.Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	var out msg
+	if err := xml.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("Unmarshal %s: %v", buf.Bytes(), err)
+	}
+	out.XMLName = xml.Name{}
+	if out != in {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestIndentMalformed(t *testing.T) {
+	t.Parallel()
+	for _, in := range []string{`<a><b></a>`, `<a></b>`, `<a>`} {
+		if _, err := Indent([]byte(in), "  "); err == nil {
+			t.Errorf("Indent accepted %s", in)
+		}
+	}
+}
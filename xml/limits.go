@@ -0,0 +1,401 @@
+package xml
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Limits bounds what a StreamReader accepts from its peer, so that one
+// peer cannot exhaust the memory of the process with a single unbounded
+// element. Zero fields are not enforced.
+type Limits struct {
+	// MaxStanzaSize is the most bytes one top-level element of the stream
+	// may take: a stanza, or a nonza such as <auth/>. Whitespace between
+	// top-level elements is not counted.
+	MaxStanzaSize int64
+	// MaxDepth is the deepest an element may be nested below the stream
+	// root; a stanza is at depth 1.
+	MaxDepth int
+	// ReadRate throttles reading to this many bytes per second, in bursts
+	// of up to ReadBurst bytes (ReadRate when zero). A peer sending faster
+	// is slowed down rather than disconnected.
+	ReadRate  int64
+	ReadBurst int64
+}
+
+// LimitError reports that the peer exceeded one of the reader's Limits or
+// sent XML the reader refuses. Reading stops at the first one.
+type LimitError struct {
+	Msg string
+}
+
+func (e *LimitError) Error() string { return "xml: " + e.Msg }
+
+// Errors returned by a StreamReader whose peer crosses its limits. A
+// document type declaration is always refused, since it is the only way
+// to declare entities for the parser to expand.
+var (
+	ErrStanzaTooLarge = &LimitError{"stanza too large"}
+	ErrTooDeep        = &LimitError{"elements nested too deep"}
+	ErrDTD            = &LimitError{"document type declarations are not allowed"}
+)
+
+// Errors returned by a StreamReader whose peer sends what RFC 6120 section
+// 11 does not allow in a stream whatever the limits: comments, processing
+// instructions other than the XML declaration before a stream header, and
+// names with a prefix that is not declared where they are used.
+var (
+	ErrComment          = &LimitError{"comments are not allowed"}
+	ErrProcInst         = &LimitError{"processing instructions are not allowed"}
+	ErrUndeclaredPrefix = &LimitError{"undeclared namespace prefix"}
+)
+
+// scanner states.
+const (
+	scanText   = iota
+	scanOpen   // after '<'
+	scanName   // in the name of a start tag
+	scanTag    // in the attributes of a start tag
+	scanQuote  // in an attribute value
+	scanEndTag // in an end tag
+	scanBang   // after "<!"
+	scanCDATA  // in <![CDATA[ ]]>
+	scanTarget // in the target of <? ?>
+	scanPI     // in the rest of <? ?>
+)
+
+// maxStreamRoots is how many times a stream may be opened on one reader:
+// the initial header and the restarts after TLS, SASL and compression. A
+// stream header beyond that counts as an ordinary element.
+const maxStreamRoots = 8
+
+// limitReader sits between the transport and the decoder. It follows the
+// element structure of the bytes it passes on closely enough to measure
+// the size and depth of each top-level element and to find the markup
+// RFC 6120 forbids before the decoder buffers it, and throttles reading.
+// It keeps the bytes it passed on from offset bufOff, so that elements can
+// be cut out of the input as they were sent.
+type limitReader struct {
+	r io.Reader
+
+	mu     sync.Mutex
+	limits Limits
+
+	state   int
+	quote   byte
+	slash   bool // the last byte of a start tag was '/'
+	name    []byte
+	attr    []byte // the last attribute name of a start tag
+	inAttr  bool
+	bang    []byte
+	tail    [3]byte // the last bytes, to find the end of CDATA and PIs
+	depth   int
+	base    int // depth of the innermost stream root
+	roots   int
+	size    int64
+	tokens  float64
+	lastRun time.Time
+	err     error
+
+	// Namespace prefixes declared and used by the start tag being read,
+	// declared by each open element, and how many open elements declare
+	// each.
+	decls    []string
+	uses     []string
+	scopes   [][]string
+	declared map[string]int
+
+	buf    []byte
+	bufOff int64
+}
+
+func (lr *limitReader) setLimits(l Limits) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.limits = l
+	lr.tokens = float64(burst(l))
+	lr.lastRun = time.Time{}
+}
+
+func burst(l Limits) int64 {
+	if l.ReadBurst > 0 {
+		return l.ReadBurst
+	}
+	return l.ReadRate
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	lr.mu.Lock()
+	l := lr.limits
+	lr.mu.Unlock()
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	if b := burst(l); l.ReadRate > 0 && int64(len(p)) > b {
+		p = p[:b]
+	}
+	n, err := lr.r.Read(p)
+	for i := 0; i < n; i++ {
+		if lr.err = lr.scan(p[i], l); lr.err != nil {
+			lr.buf = append(lr.buf, p[:i]...)
+			return i, lr.err
+		}
+	}
+	lr.buf = append(lr.buf, p[:n]...)
+	if l.ReadRate > 0 {
+		lr.throttle(n, l)
+	}
+	return n, err
+}
+
+// slice returns a copy of the input from offset start to offset end.
+func (lr *limitReader) slice(start, end int64) []byte {
+	return bytes.Clone(lr.buf[start-lr.bufOff : end-lr.bufOff])
+}
+
+// discard drops the input before offset off.
+func (lr *limitReader) discard(off int64) {
+	lr.buf = lr.buf[off-lr.bufOff:]
+	lr.bufOff = off
+}
+
+// throttle takes n bytes from the token bucket and sleeps while it is in
+// debt.
+func (lr *limitReader) throttle(n int, l Limits) {
+	lr.mu.Lock()
+	now := time.Now()
+	if !lr.lastRun.IsZero() {
+		lr.tokens += now.Sub(lr.lastRun).Seconds() * float64(l.ReadRate)
+		if max := float64(burst(l)); lr.tokens > max {
+			lr.tokens = max
+		}
+	}
+	lr.lastRun = now
+	lr.tokens -= float64(n)
+	debt := -lr.tokens
+	lr.mu.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / float64(l.ReadRate) * float64(time.Second)))
+	}
+}
+
+// scan advances the scanner over c.
+func (lr *limitReader) scan(c byte, l Limits) error {
+	topLevel := lr.depth <= lr.base
+	if !(lr.state == scanText && topLevel && isSpace(c)) {
+		lr.size++
+		if l.MaxStanzaSize > 0 && lr.size > l.MaxStanzaSize {
+			return ErrStanzaTooLarge
+		}
+	}
+	lr.tail = [3]byte{lr.tail[1], lr.tail[2], c}
+
+	switch lr.state {
+	case scanText:
+		if c == '<' {
+			lr.state = scanOpen
+		}
+	case scanOpen:
+		switch c {
+		case '/':
+			lr.state = scanEndTag
+		case '?':
+			// The XML declaration may precede every stream header,
+			// including those of restarted streams, but not a child.
+			if lr.depth > lr.base {
+				return ErrProcInst
+			}
+			lr.state = scanTarget
+			lr.name = lr.name[:0]
+			lr.tail = [3]byte{}
+		case '!':
+			lr.state = scanBang
+			lr.bang = lr.bang[:0]
+		default:
+			lr.state = scanName
+			lr.name = append(lr.name[:0], c)
+		}
+	case scanName:
+		switch {
+		case isSpace(c):
+			lr.state = scanTag
+		case c == '/':
+			lr.state, lr.slash = scanTag, true
+		case c == '>':
+			return lr.open(false, l)
+		default:
+			lr.name = append(lr.name, c)
+		}
+	case scanTag:
+		switch c {
+		case '"', '\'':
+			lr.state, lr.quote, lr.slash = scanQuote, c, false
+			lr.attribute()
+		case '>':
+			return lr.open(lr.slash, l)
+		case '/':
+			lr.slash = true
+		default:
+			lr.slash = false
+			if isSpace(c) || c == '=' {
+				lr.inAttr = false
+			} else {
+				if !lr.inAttr {
+					lr.attr, lr.inAttr = lr.attr[:0], true
+				}
+				lr.attr = append(lr.attr, c)
+			}
+		}
+	case scanQuote:
+		if c == lr.quote {
+			lr.state = scanTag
+		}
+	case scanEndTag:
+		if c == '>' {
+			lr.state = scanText
+			lr.depth--
+			if lr.depth < lr.base {
+				lr.base = lr.depth
+			}
+			lr.leave()
+			lr.endOfElement()
+		}
+	case scanBang:
+		lr.bang = append(lr.bang, c)
+		switch s := string(lr.bang); {
+		case s == "--":
+			return ErrComment
+		case s == "[CDATA[":
+			lr.state = scanCDATA
+			lr.tail = [3]byte{}
+		case s == "-" || len(s) < len("[CDATA[") && s == "[CDATA["[:len(s)]:
+		default:
+			return ErrDTD
+		}
+	case scanCDATA:
+		if lr.tail == [3]byte{']', ']', '>'} {
+			lr.state = scanText
+		}
+	case scanTarget:
+		if isSpace(c) || c == '?' {
+			if string(lr.name) != "xml" {
+				return ErrProcInst
+			}
+			lr.state = scanPI
+		} else {
+			lr.name = append(lr.name, c)
+		}
+	case scanPI:
+		if lr.tail[1] == '?' && c == '>' {
+			lr.state = scanText
+		}
+	}
+	return nil
+}
+
+// open handles the end of a start tag. A tag named stream at the top level
+// opens a (restarted) stream, whose children are the top-level elements.
+func (lr *limitReader) open(selfClosing bool, l Limits) error {
+	lr.state, lr.slash, lr.inAttr = scanText, false, false
+	if err := lr.enter(selfClosing); err != nil {
+		return err
+	}
+	if !selfClosing && lr.depth == lr.base && lr.roots < maxStreamRoots && localName(lr.name) == "stream" {
+		lr.roots++
+		lr.depth++
+		lr.base = lr.depth
+		lr.size = 0
+		return nil
+	}
+	if l.MaxDepth > 0 && lr.depth+1-lr.base > l.MaxDepth {
+		return ErrTooDeep
+	}
+	if !selfClosing {
+		lr.depth++
+		return nil
+	}
+	lr.endOfElement()
+	return nil
+}
+
+// attribute notes the namespace prefix of the attribute whose value
+// starts: the one it declares if it is xmlns:prefix, or the one it uses.
+func (lr *limitReader) attribute() {
+	lr.inAttr = false
+	prefix, local := splitName(lr.attr)
+	switch string(prefix) {
+	case "", "xml":
+	case "xmlns":
+		lr.decls = append(lr.decls, string(local))
+	default:
+		lr.uses = append(lr.uses, string(prefix))
+	}
+}
+
+// enter opens the namespace scope of the start tag just read, and checks
+// that its name and attributes only use prefixes declared on it or on an
+// enclosing element. A self-closing element leaves its scope at once.
+func (lr *limitReader) enter(selfClosing bool) error {
+	if lr.declared == nil {
+		lr.declared = make(map[string]int)
+	}
+	for _, p := range lr.decls {
+		lr.declared[p]++
+	}
+	lr.scopes = append(lr.scopes, slices.Clone(lr.decls))
+	if prefix, _ := splitName(lr.name); len(prefix) > 0 && string(prefix) != "xml" {
+		lr.uses = append(lr.uses, string(prefix))
+	}
+	uses := lr.uses
+	lr.decls, lr.uses = lr.decls[:0], lr.uses[:0]
+	for _, p := range uses {
+		if lr.declared[p] == 0 {
+			return ErrUndeclaredPrefix
+		}
+	}
+	if selfClosing {
+		lr.leave()
+	}
+	return nil
+}
+
+// leave closes the namespace scope of the innermost element.
+func (lr *limitReader) leave() {
+	if len(lr.scopes) == 0 {
+		return
+	}
+	for _, p := range lr.scopes[len(lr.scopes)-1] {
+		if lr.declared[p]--; lr.declared[p] == 0 {
+			delete(lr.declared, p)
+		}
+	}
+	lr.scopes = lr.scopes[:len(lr.scopes)-1]
+}
+
+// endOfElement starts counting a new top-level element once the current
+// one is complete.
+func (lr *limitReader) endOfElement() {
+	if lr.depth <= lr.base {
+		lr.size = 0
+	}
+}
+
+func localName(name []byte) string {
+	_, local := splitName(name)
+	return string(local)
+}
+
+// splitName splits a qualified name at its first colon.
+func splitName(name []byte) (prefix, local []byte) {
+	if i := bytes.IndexByte(name, ':'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return nil, name
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,148 @@
+package xml
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHeader = `<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' to='example.com'>`
+
+// readAll reads tokens from a reader over input with limits until the
+// input ends or reading fails. The streams in input are left open.
+func readAll(input string, l Limits) error {
+	sr := NewStreamReader(strings.NewReader(input))
+	sr.SetLimits(l)
+	for {
+		if _, err := sr.Token(); err != nil {
+			var syntax *xml.SyntaxError
+			if errors.Is(err, io.EOF) || errors.As(err, &syntax) && syntax.Msg == "unexpected EOF" {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func TestLimitsStanzaSize(t *testing.T) {
+	t.Parallel()
+	l := Limits{MaxStanzaSize: 160}
+	small := `<message to='a@b'><body>hi</body></message>`
+
+	// Each stanza counts on its own, and the whitespace between them not
+	// at all.
+	input := testHeader + strings.Repeat(small+"\n  ", 20)
+	if err := readAll(input, l); err != nil {
+		t.Fatalf("small stanzas: %v", err)
+	}
+	big := `<message><body>` + strings.Repeat("x", 160) + `</body></message>`
+	if err := readAll(testHeader+small+big, l); !errors.Is(err, ErrStanzaTooLarge) {
+		t.Fatalf("large stanza: %v", err)
+	}
+	// A restarted stream counts like the first one.
+	restarted := testHeader + small + testHeader + small
+	if err := readAll(restarted, l); err != nil {
+		t.Fatalf("restarted stream: %v", err)
+	}
+	if err := readAll(restarted+big, l); !errors.Is(err, ErrStanzaTooLarge) {
+		t.Fatalf("large stanza after restart: %v", err)
+	}
+	// Text outside any stanza counts too.
+	if err := readAll(testHeader+strings.Repeat("x", 161), l); !errors.Is(err, ErrStanzaTooLarge) {
+		t.Fatalf("top-level text: %v", err)
+	}
+}
+
+func TestLimitsDepth(t *testing.T) {
+	t.Parallel()
+	l := Limits{MaxDepth: 3}
+	if err := readAll(testHeader+`<iq><query xmlns='jabber:iq:roster'><item jid='a@b'/></query></iq>`, l); err != nil {
+		t.Fatalf("depth 3: %v", err)
+	}
+	if err := readAll(testHeader+`<iq><query><item><group/></item></query></iq>`, l); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("depth 4: %v", err)
+	}
+	// Markup inside attribute values, comments and CDATA is not counted;
+	// the comment is refused for being one.
+	quoted := testHeader + `<a x='b/>c>' y="/>"><![CDATA[<b><c><d>]]></a>`
+	if err := readAll(quoted, l); err != nil {
+		t.Fatalf("quoted markup: %v", err)
+	}
+	if err := readAll(testHeader+`<a><!-- <b><c><d> --></a>`, l); !errors.Is(err, ErrComment) {
+		t.Fatalf("markup in comment: %v", err)
+	}
+	// Stream headers past the legitimate restarts nest like any element,
+	// and may not have an XML declaration.
+	header := strings.TrimPrefix(testHeader, "<?xml version='1.0'?>")
+	if err := readAll(strings.Repeat(header, 20), l); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("nested stream headers: %v", err)
+	}
+	if err := readAll(strings.Repeat(testHeader, 20), Limits{}); !errors.Is(err, ErrProcInst) {
+		t.Fatalf("nested stream headers: %v", err)
+	}
+}
+
+func TestLimitsDTD(t *testing.T) {
+	t.Parallel()
+	bomb := `<?xml version='1.0'?><!DOCTYPE lolz [<!ENTITY lol "lol"><!ENTITY lol2 "&lol;&lol;">]>` + testHeader
+	if err := readAll(bomb, Limits{}); !errors.Is(err, ErrDTD) {
+		t.Fatalf("DOCTYPE: %v", err)
+	}
+	// Refused without limits too.
+	sr := NewStreamReader(strings.NewReader(testHeader + `<!ENTITY x "y">`))
+	for {
+		_, err := sr.Token()
+		if errors.Is(err, ErrDTD) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ENTITY: %v", err)
+		}
+	}
+	// The error sticks.
+	if _, err := sr.Token(); err == nil {
+		t.Fatal("read after refusal succeeded")
+	}
+}
+
+func TestLimitsRestrictedXML(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		input string
+		want  error
+	}{
+		"comment":                {testHeader + `<message><!-- hi --></message>`, ErrComment},
+		"comment before header":  {`<!-- hi -->` + testHeader, ErrComment},
+		"processing instruction": {testHeader + `<?php echo 1; ?>`, ErrProcInst},
+		"declaration in stanza":  {testHeader + `<message><?xml version='1.0'?></message>`, ErrProcInst},
+		"restart":                {testHeader + `<message/>` + testHeader + `<message/>`, nil},
+		"undeclared element":     {testHeader + `<foo:message/>`, ErrUndeclaredPrefix},
+		"undeclared attribute":   {testHeader + `<message foo:a='1'/>`, ErrUndeclaredPrefix},
+		"inherited prefix":       {testHeader + `<message xmlns:foo='urn:foo'><foo:x foo:a='1'/></message><stream:error/>`, nil},
+		"prefix out of scope":    {testHeader + `<message xmlns:foo='urn:foo'/><foo:x/>`, ErrUndeclaredPrefix},
+		"xml prefix":             {testHeader + `<message xml:lang='en'/>`, nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if err := readAll(tc.input, Limits{}); !errors.Is(err, tc.want) {
+				t.Fatalf("read = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLimitsReadRate(t *testing.T) {
+	t.Parallel()
+	// 300 bytes at 1000 bytes/s with a burst of 100 take at least 0.2s.
+	input := testHeader + strings.Repeat(`<presence/>`, 300/len(`<presence/>`))
+	start := time.Now()
+	if err := readAll(input, Limits{ReadRate: 1000, ReadBurst: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("read in %v", elapsed)
+	}
+}
@@ -2,7 +2,9 @@
 package xml
 
 import (
+	"bytes"
 	"encoding/xml"
+	"errors"
 	"io"
 )
 
@@ -17,45 +19,90 @@ type TokenWriter interface {
 	Flush() error
 }
 
-// StreamReader wraps an xml.Decoder for reading XMPP streams.
+// StreamReader wraps an xml.Decoder for reading XMPP streams. It refuses
+// what RFC 6120 does not allow in a stream, such as comments, document
+// type declarations and undeclared prefixes, and can return elements
+// exactly as the peer sent them, for passing them on.
 type StreamReader struct {
-	d *xml.Decoder
+	d  *xml.Decoder
+	lr *limitReader
+
+	start  int64 // input offset of the last token
+	opened bool  // the last token was a start element
 }
 
-// NewStreamReader creates a new StreamReader.
+// NewStreamReader creates a new StreamReader. It enforces no limits until
+// SetLimits is called.
 func NewStreamReader(r io.Reader) *StreamReader {
-	return &StreamReader{d: xml.NewDecoder(r)}
+	lr := &limitReader{r: r}
+	return &StreamReader{d: xml.NewDecoder(lr), lr: lr}
+}
+
+// SetLimits sets the limits on what the reader accepts from now on. A
+// read crossing them fails with a *LimitError, and so do all later reads.
+func (sr *StreamReader) SetLimits(l Limits) {
+	sr.lr.setLimits(l)
 }
 
 // Token reads the next XML token.
 func (sr *StreamReader) Token() (xml.Token, error) {
-	return sr.d.Token()
+	sr.next()
+	tok, err := sr.d.Token()
+	_, sr.opened = tok.(xml.StartElement)
+	return tok, err
 }
 
 // Decode decodes the next element into v.
 func (sr *StreamReader) Decode(v interface{}) error {
+	sr.next()
 	return sr.d.Decode(v)
 }
 
 // DecodeElement decodes a specific element into v.
 func (sr *StreamReader) DecodeElement(v interface{}, start *xml.StartElement) error {
+	sr.next()
 	return sr.d.DecodeElement(v, start)
 }
 
 // Skip skips the current element and its children.
 func (sr *StreamReader) Skip() error {
+	sr.next()
 	return sr.d.Skip()
 }
 
-// Decoder returns the underlying xml.Decoder.
+// RawElement reads the rest of the element opened by start, which must be
+// the last token read, and returns the whole element as the peer sent it:
+// prefixes, quoting and whitespace are kept, so it can be passed on with
+// WriteRaw without being decoded and encoded again. Namespaces it inherits,
+// such as the default namespace of the stream, are not declared in it.
+func (sr *StreamReader) RawElement(start *xml.StartElement) ([]byte, error) {
+	if !sr.opened {
+		return nil, errors.New("xml: <" + start.Name.Local + "> is not the last token read")
+	}
+	sr.opened = false
+	if err := sr.d.Skip(); err != nil {
+		return nil, err
+	}
+	return sr.lr.slice(sr.start, sr.d.InputOffset()), nil
+}
+
+// next drops the input kept for RawElement before the next read.
+func (sr *StreamReader) next() {
+	sr.start, sr.opened = sr.d.InputOffset(), false
+	sr.lr.discard(sr.start)
+}
+
+// Decoder returns the underlying xml.Decoder. The input read through it
+// directly is kept for RawElement until the next read of the StreamReader.
 func (sr *StreamReader) Decoder() *xml.Decoder {
 	return sr.d
 }
 
 // StreamWriter wraps an xml.Encoder for writing XMPP streams.
 type StreamWriter struct {
-	e *xml.Encoder
-	w io.Writer
+	e      *xml.Encoder
+	w      io.Writer
+	format WireFormat
 }
 
 // NewStreamWriter creates a new StreamWriter.
@@ -74,19 +121,77 @@ func (sw *StreamWriter) EncodeToken(t xml.Token) error {
 	return sw.e.Flush()
 }
 
-// Encode encodes a value as XML.
+// Encode encodes a value as XML in the writer's wire format.
 func (sw *StreamWriter) Encode(v interface{}) error {
+	if sw.format == WireIndented {
+		return sw.encodeIndented(v)
+	}
 	if err := sw.e.Encode(v); err != nil {
 		return err
 	}
 	return sw.e.Flush()
 }
 
+func (sw *StreamWriter) encodeIndented(v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if data, err = Indent(data, indentUnit); err != nil {
+		return err
+	}
+	_, err = sw.w.Write(append([]byte("\n"), data...))
+	return err
+}
+
+// SetFormat sets the layout of elements written by Encode. Tokens written
+// with EncodeToken and raw data are not affected.
+func (sw *StreamWriter) SetFormat(f WireFormat) {
+	sw.format = f
+}
+
+// Format returns the writer's wire format.
+func (sw *StreamWriter) Format() WireFormat {
+	return sw.format
+}
+
 // Encoder returns the underlying xml.Encoder.
 func (sw *StreamWriter) Encoder() *xml.Encoder {
 	return sw.e
 }
 
+// EncodeRawToken writes a token read with xml.Decoder.RawToken: the Space
+// of names is written as their prefix rather than declared as a namespace,
+// so elements keep the prefixes they were read with. Comments, processing
+// instructions other than the XML declaration and directives are refused.
+func (sw *StreamWriter) EncodeRawToken(t xml.Token) error {
+	var buf bytes.Buffer
+	switch t := t.(type) {
+	case xml.StartElement:
+		writeStart(&buf, t)
+	case xml.EndElement:
+		buf.WriteString("</" + qualified(t.Name) + ">")
+	case xml.CharData:
+		writeToken(&buf, t)
+	case xml.ProcInst:
+		if t.Target != "xml" {
+			return ErrProcInst
+		}
+		writeToken(&buf, t)
+	case xml.Comment:
+		return ErrComment
+	case xml.Directive:
+		return ErrDTD
+	default:
+		return errors.New("xml: unsupported raw token")
+	}
+	if err := sw.e.Flush(); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(buf.Bytes())
+	return err
+}
+
 // WriteRaw writes raw bytes to the underlying writer, bypassing XML encoding.
 func (sw *StreamWriter) WriteRaw(data []byte) (int, error) {
 	return sw.w.Write(data)
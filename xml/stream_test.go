@@ -3,6 +3,8 @@ package xml
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
+	"io"
 	"strings"
 	"testing"
 )
@@ -108,3 +110,101 @@ func TestStreamWriterWriteRaw(t *testing.T) {
 		t.Errorf("WriteRaw output = %q, want %q", buf.String(), string(raw))
 	}
 }
+
+func TestStreamReaderRawElement(t *testing.T) {
+	t.Parallel()
+	raw := `<message to="b@example.com"  type='chat'>` +
+		`<body>` + strings.Repeat("x", 5000) + ` &amp; &#x42;</body>` +
+		`<foo:x xmlns:foo='urn:foo' foo:a="1"><foo:y/></foo:x>` +
+		`</message>`
+	input := testHeader + strings.Repeat("<presence/>\n", 500) + raw + `<iq type='get' id='1'/>`
+	sr := NewStreamReader(strings.NewReader(input))
+	for {
+		tok, err := sr.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "message" {
+			continue
+		}
+		if start.Name.Space != "jabber:client" {
+			t.Fatalf("namespace = %q", start.Name.Space)
+		}
+		got, err := sr.RawElement(&start)
+		if err != nil {
+			t.Fatalf("RawElement: %v", err)
+		}
+		if string(got) != raw {
+			t.Fatalf("RawElement =\n%s\nwant\n%s", got, raw)
+		}
+		break
+	}
+	// Reading goes on after the element.
+	var iq struct {
+		XMLName xml.Name `xml:"jabber:client iq"`
+		ID      string   `xml:"id,attr"`
+	}
+	if err := sr.Decode(&iq); err != nil || iq.ID != "1" {
+		t.Fatalf("Decode = %+v, %v", iq, err)
+	}
+	if _, err := sr.RawElement(&xml.StartElement{}); err == nil {
+		t.Fatal("RawElement after an end element succeeded")
+	}
+}
+
+func TestStreamWriterEncodeRawToken(t *testing.T) {
+	t.Parallel()
+	in := `<stream:features xmlns:stream="http://etherx.jabber.org/streams">` +
+		`<foo:x xmlns:foo="urn:foo" foo:a="1&amp;2">a&lt;b</foo:x></stream:features>`
+	var buf bytes.Buffer
+	sw := NewStreamWriter(&buf)
+	d := xml.NewDecoder(strings.NewReader(in))
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sw.EncodeRawToken(tok); err != nil {
+			t.Fatalf("EncodeRawToken: %v", err)
+		}
+	}
+	if buf.String() != in {
+		t.Fatalf("wire =\n%s\nwant\n%s", buf.String(), in)
+	}
+	if err := sw.EncodeRawToken(xml.Comment("x")); !errors.Is(err, ErrComment) {
+		t.Fatalf("comment: %v", err)
+	}
+}
+
+func FuzzStreamReader(f *testing.F) {
+	f.Add(`<message xmlns:a='urn:a'><a:b a:c='d'>e</a:b></message>`)
+	f.Add(`<message><!-- x --></message>`)
+	f.Add(`<iq><?x y?></iq><presence/>`)
+	f.Add(`<x:y/>`)
+	f.Fuzz(func(t *testing.T, stanzas string) {
+		input := testHeader + stanzas
+		sr := NewStreamReader(strings.NewReader(input))
+		sr.SetLimits(Limits{MaxStanzaSize: 1 << 16, MaxDepth: 32})
+		for {
+			tok, err := sr.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok || start.Name.Local == "stream" {
+				continue
+			}
+			raw, err := sr.RawElement(&start)
+			if err != nil {
+				return
+			}
+			if !strings.Contains(input, string(raw)) || !bytes.HasPrefix(raw, []byte("<")) {
+				t.Fatalf("RawElement = %q is not from the input", raw)
+			}
+		}
+	})
+}